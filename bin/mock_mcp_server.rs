@@ -70,6 +70,11 @@ fn handle_request(request: &Value) -> Option<Value> {
             // Notifications don't get responses
             None
         }
+        "ping" => Some(json!({
+            "jsonrpc": "2.0",
+            "id": id,
+            "result": {}
+        })),
         "tools/list" => Some(json!({
             "jsonrpc": "2.0",
             "id": id,
@@ -92,6 +97,13 @@ fn handle_request(request: &Value) -> Option<Value> {
                 ]
             }
         })),
+        "resources/list" => Some(json!({
+            "jsonrpc": "2.0",
+            "id": id,
+            "result": {
+                "resources": []
+            }
+        })),
         "tools/call" => {
             let params = request.get("params")?;
             let tool_name = params.get("name")?.as_str()?;
@@ -0,0 +1,76 @@
+//! Records what km is built from for `km version`, the User-Agent and the
+//! client metadata sent with event batches: the commit as `KM_GIT_COMMIT`,
+//! the build date as `KM_BUILD_DATE`, the compiler as `KM_RUSTC_VERSION` and
+//! the target triple as `KM_BUILD_TARGET`. Builds from a source tarball can
+//! set `KM_GIT_COMMIT` themselves; reproducible builds set
+//! `SOURCE_DATE_EPOCH` (or `KM_BUILD_DATE`) to pin the date.
+
+use std::process::Command;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+fn main() {
+    println!("cargo:rerun-if-env-changed=KM_GIT_COMMIT");
+    println!("cargo:rerun-if-env-changed=KM_BUILD_DATE");
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs/heads");
+
+    let commit = std::env::var("KM_GIT_COMMIT")
+        .ok()
+        .filter(|commit| !commit.is_empty())
+        .or_else(|| command_output("git", &["rev-parse", "--short=12", "HEAD"]))
+        .unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=KM_GIT_COMMIT={}", commit);
+
+    let date = std::env::var("KM_BUILD_DATE")
+        .ok()
+        .filter(|date| !date.is_empty())
+        .unwrap_or_else(|| {
+            let secs = std::env::var("SOURCE_DATE_EPOCH")
+                .ok()
+                .and_then(|epoch| epoch.trim().parse::<u64>().ok())
+                .unwrap_or_else(|| {
+                    SystemTime::now()
+                        .duration_since(UNIX_EPOCH)
+                        .map(|d| d.as_secs())
+                        .unwrap_or(0)
+                });
+            civil_date(secs / 86_400)
+        });
+    println!("cargo:rustc-env=KM_BUILD_DATE={}", date);
+
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let rustc_version = command_output(&rustc, &["--version"])
+        .and_then(|version| version.split_whitespace().nth(1).map(String::from))
+        .unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=KM_RUSTC_VERSION={}", rustc_version);
+
+    let target = std::env::var("TARGET").unwrap_or_else(|_| "unknown".to_string());
+    println!("cargo:rustc-env=KM_BUILD_TARGET={}", target);
+}
+
+/// Trimmed stdout of a command that succeeded
+fn command_output(program: &str, args: &[&str]) -> Option<String> {
+    Command::new(program)
+        .args(args)
+        .output()
+        .ok()
+        .filter(|output| output.status.success())
+        .and_then(|output| String::from_utf8(output.stdout).ok())
+        .map(|output| output.trim().to_string())
+}
+
+/// `YYYY-MM-DD` of the day `days` after 1970-01-01 (Howard Hinnant's
+/// civil_from_days), since build scripts can't use chrono
+fn civil_date(days: u64) -> String {
+    let z = days as i64 + 719_468;
+    let era = z.div_euclid(146_097);
+    let doe = z.rem_euclid(146_097);
+    let yoe = (doe - doe / 1460 + doe / 36_524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + i64::from(month <= 2);
+    format!("{:04}-{:02}-{:02}", year, month, day)
+}
@@ -0,0 +1,407 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{HashMap, VecDeque};
+use std::process::Stdio;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tokio::io::AsyncWriteExt;
+use tokio::sync::mpsc;
+
+use crate::plugins::verify::sha256_hex;
+use crate::risk::{RiskAssessment, RiskLevel};
+use crate::search::{Candidate, Query};
+use crate::traffic::{Labels, TrafficEntry};
+
+pub const DEFAULT_MAX_PER_MINUTE: u32 = 10;
+pub const DEFAULT_DEDUP_SECONDS: u64 = 300;
+
+/// How long a webhook, Slack post or command may take before it's abandoned
+const ACTION_TIMEOUT: Duration = Duration::from_secs(10);
+
+const RATE_WINDOW: Duration = Duration::from_secs(60);
+
+/// Rules that notify someone when a captured message matches.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct AlertsConfig {
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<AlertRuleConfig>,
+}
+
+impl AlertsConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        Alerter::from_config(self).map(|_| ())
+    }
+}
+
+/// One alert rule: a `km search` query and what to do when a message
+/// matches it. At least one action must be set.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct AlertRuleConfig {
+    pub name: String,
+    /// Query the message must match, e.g. `risk>=high AND method=tools/call`
+    pub when: String,
+    /// URL the alert is POSTed to as JSON
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub webhook: Option<String>,
+    /// Slack incoming webhook URL
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub slack: Option<String>,
+    /// Program and arguments run with the alert JSON on stdin
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub command: Vec<String>,
+    /// Most alerts sent per minute; later matches are dropped (default 10)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_per_minute: Option<u32>,
+    /// A message identical to one alerted on this many seconds ago, apart
+    /// from its JSON-RPC id, is not sent again (default 300; 0 to send every match)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dedup_seconds: Option<u64>,
+}
+
+impl AlertRuleConfig {
+    fn validate(&self) -> Result<()> {
+        if self.name.trim().is_empty() {
+            return Err(anyhow::anyhow!("Every alert rule needs a name"));
+        }
+        if self.webhook.is_none() && self.slack.is_none() && self.command.is_empty() {
+            return Err(anyhow::anyhow!(
+                "Alert rule '{}' needs a webhook, slack or command action",
+                self.name
+            ));
+        }
+        for url in self.webhook.iter().chain(&self.slack) {
+            if !(url.starts_with("http://") || url.starts_with("https://")) {
+                return Err(anyhow::anyhow!(
+                    "Alert rule '{}': '{}' must start with http:// or https://",
+                    self.name,
+                    url
+                ));
+            }
+        }
+        if self.max_per_minute == Some(0) {
+            return Err(anyhow::anyhow!(
+                "Alert rule '{}': max_per_minute must be greater than 0",
+                self.name
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// What an alert action receives: the rule that fired and the message
+/// that matched it.
+#[derive(Debug, Clone, Serialize)]
+pub struct Alert {
+    pub rule: String,
+    pub timestamp: DateTime<Utc>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub session_id: Option<String>,
+    pub direction: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    /// `params.name` of a tools/call request
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub tool: Option<String>,
+    pub risk: RiskLevel,
+    pub risk_score: f32,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub matched_patterns: Vec<String>,
+    #[serde(skip_serializing_if = "Labels::is_empty")]
+    pub labels: Labels,
+    pub content: String,
+}
+
+impl Alert {
+    /// One line for chat: what happened, how risky it was, and where.
+    pub fn summary(&self) -> String {
+        let mut text = format!(
+            "km alert '{}': {} {}",
+            self.rule,
+            self.method.as_deref().unwrap_or("message"),
+            self.direction
+        );
+        if let Some(ref tool) = self.tool {
+            text.push_str(&format!(" ({})", tool));
+        }
+        text.push_str(&format!(", {} risk ({:.2})", self.risk, self.risk_score));
+        if !self.matched_patterns.is_empty() {
+            text.push_str(&format!(": {}", self.matched_patterns.join(", ")));
+        }
+        if let Some(ref session) = self.session_id {
+            text.push_str(&format!(" in session {}", session));
+        }
+        text
+    }
+}
+
+/// Rate limit and dedup bookkeeping for one rule.
+#[derive(Debug, Default)]
+struct RuleState {
+    sent: VecDeque<Instant>,
+    seen: HashMap<String, Instant>,
+}
+
+#[derive(Debug)]
+struct AlertRule {
+    config: Arc<AlertRuleConfig>,
+    query: Query,
+    max_per_minute: usize,
+    dedup: Duration,
+    state: Mutex<RuleState>,
+}
+
+impl AlertRule {
+    /// Whether an alert for the message with `key` may go out at `now`,
+    /// recording it if so.
+    fn admit(&self, key: &str, now: Instant) -> bool {
+        let mut state = match self.state.lock() {
+            Ok(state) => state,
+            Err(poisoned) => poisoned.into_inner(),
+        };
+        let dedup = self.dedup;
+        state
+            .seen
+            .retain(|_, at| now.saturating_duration_since(*at) < dedup);
+        while state
+            .sent
+            .front()
+            .is_some_and(|at| now.saturating_duration_since(*at) >= RATE_WINDOW)
+        {
+            state.sent.pop_front();
+        }
+
+        if !dedup.is_zero() && state.seen.contains_key(key) {
+            return false;
+        }
+        if state.sent.len() >= self.max_per_minute {
+            return false;
+        }
+        state.sent.push_back(now);
+        if !dedup.is_zero() {
+            state.seen.insert(key.to_string(), now);
+        }
+        true
+    }
+}
+
+/// Checks captured messages against the alert rules and hands the alerts
+/// to a background task that runs their actions.
+#[derive(Debug)]
+pub struct Alerter {
+    rules: Vec<AlertRule>,
+    outbox: Option<mpsc::UnboundedSender<(Arc<AlertRuleConfig>, Alert)>>,
+    sent: AtomicU64,
+    suppressed: AtomicU64,
+}
+
+impl Alerter {
+    pub fn from_config(config: &AlertsConfig) -> Result<Self> {
+        let mut rules: Vec<AlertRule> = Vec::new();
+        for rule in &config.rules {
+            rule.validate()?;
+            if rules.iter().any(|r| r.config.name == rule.name) {
+                return Err(anyhow::anyhow!(
+                    "Alert rule '{}' is defined twice",
+                    rule.name
+                ));
+            }
+            let query = Query::parse(&rule.when)
+                .with_context(|| format!("Alert rule '{}' has an invalid condition", rule.name))?;
+            rules.push(AlertRule {
+                config: Arc::new(rule.clone()),
+                query,
+                max_per_minute: rule.max_per_minute.unwrap_or(DEFAULT_MAX_PER_MINUTE) as usize,
+                dedup: Duration::from_secs(rule.dedup_seconds.unwrap_or(DEFAULT_DEDUP_SECONDS)),
+                state: Mutex::default(),
+            });
+        }
+        Ok(Self {
+            rules,
+            outbox: None,
+            sent: AtomicU64::new(0),
+            suppressed: AtomicU64::new(0),
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rules.is_empty()
+    }
+
+    /// Run the actions of alerts passed to [`Alerter::notify`] on a
+    /// background task. It exits once the alerter is dropped and the
+    /// alerts already raised have been delivered.
+    pub fn spawn(&mut self) -> tokio::task::JoinHandle<()> {
+        let (tx, mut rx) = mpsc::unbounded_channel::<(Arc<AlertRuleConfig>, Alert)>();
+        self.outbox = Some(tx);
+        tokio::spawn(async move {
+            while let Some((rule, alert)) = rx.recv().await {
+                if let Err(e) = deliver(&rule, &alert).await {
+                    tracing::warn!("Alert '{}' failed: {:#}", rule.name, e);
+                }
+            }
+        })
+    }
+
+    /// The alerts `entry` raises at `now`, after rate limiting and
+    /// deduplication. `method` is the message's method, or for a response
+    /// the method of its request.
+    pub fn evaluate(&self, entry: &TrafficEntry, method: Option<&str>, now: Instant) -> Vec<Alert> {
+        if self.rules.is_empty() {
+            return Vec::new();
+        }
+        let risk = RiskAssessment::from_metadata(&entry.metadata);
+        let level = risk.as_ref().map_or(RiskLevel::Low, |r| r.level);
+        let candidate = Candidate {
+            entry,
+            method,
+            risk: level,
+        };
+
+        let mut alerts = Vec::new();
+        let mut key = None;
+        for rule in &self.rules {
+            if !rule.query.matches(&candidate) {
+                continue;
+            }
+            let key = key.get_or_insert_with(|| dedup_key(entry));
+            if !rule.admit(key, now) {
+                self.suppressed.fetch_add(1, Ordering::Relaxed);
+                continue;
+            }
+            self.sent.fetch_add(1, Ordering::Relaxed);
+            alerts.push(Alert {
+                rule: rule.config.name.clone(),
+                timestamp: entry.timestamp,
+                session_id: entry.session_id.clone(),
+                direction: entry.direction.clone(),
+                method: method.map(str::to_string),
+                tool: tool_name(&entry.content, method),
+                risk: level,
+                risk_score: risk.as_ref().map_or(0.0, |r| r.score),
+                matched_patterns: risk
+                    .as_ref()
+                    .map(|r| r.matched_patterns.clone())
+                    .unwrap_or_default(),
+                labels: entry.labels.clone(),
+                content: entry.content.clone(),
+            });
+        }
+        alerts
+    }
+
+    /// Check a captured message and queue the actions of any alerts it
+    /// raises. Never waits on the actions themselves.
+    pub fn notify(&self, entry: &TrafficEntry, method: Option<&str>) {
+        let Some(ref outbox) = self.outbox else {
+            return;
+        };
+        for alert in self.evaluate(entry, method, Instant::now()) {
+            tracing::info!("{}", alert.summary());
+            if let Some(rule) = self.rules.iter().find(|r| r.config.name == alert.rule) {
+                let _ = outbox.send((rule.config.clone(), alert));
+            }
+        }
+    }
+
+    /// Alerts raised so far
+    pub fn sent(&self) -> u64 {
+        self.sent.load(Ordering::Relaxed)
+    }
+
+    /// Matches dropped by the rate limit or as duplicates
+    pub fn suppressed(&self) -> u64 {
+        self.suppressed.load(Ordering::Relaxed)
+    }
+}
+
+/// Messages that differ only in their JSON-RPC id are the same alert.
+fn dedup_key(entry: &TrafficEntry) -> String {
+    let body = match serde_json::from_str::<Value>(&entry.content) {
+        Ok(Value::Object(mut message)) => {
+            message.remove("id");
+            Value::Object(message).to_string()
+        }
+        _ => entry.content.clone(),
+    };
+    format!("{}\0{}", entry.direction, sha256_hex(body.as_bytes()))
+}
+
+fn tool_name(content: &str, method: Option<&str>) -> Option<String> {
+    if method != Some("tools/call") {
+        return None;
+    }
+    let message: Value = serde_json::from_str(content).ok()?;
+    Some(message.pointer("/params/name")?.as_str()?.to_string())
+}
+
+/// Run every action of `rule` for `alert`. All actions are attempted; the
+/// first failure is returned.
+pub async fn deliver(rule: &AlertRuleConfig, alert: &Alert) -> Result<()> {
+    let mut result = Ok(());
+    if let Some(ref url) = rule.webhook {
+        let sent = post(url, &serde_json::to_value(alert)?)
+            .await
+            .context("Webhook failed");
+        result = result.and(sent);
+    }
+    if let Some(ref url) = rule.slack {
+        let sent = post(url, &serde_json::json!({ "text": alert.summary() }))
+            .await
+            .context("Slack message failed");
+        result = result.and(sent);
+    }
+    if !rule.command.is_empty() {
+        result = result.and(run_command(&rule.command, alert).await);
+    }
+    result
+}
+
+async fn post(url: &str, body: &Value) -> Result<()> {
+    let response = crate::http::client()
+        .post(url)
+        .timeout(ACTION_TIMEOUT)
+        .json(body)
+        .send()
+        .await?;
+    if !response.status().is_success() {
+        return Err(anyhow::anyhow!("{} returned {}", url, response.status()));
+    }
+    Ok(())
+}
+
+async fn run_command(command: &[String], alert: &Alert) -> Result<()> {
+    let mut child = tokio::process::Command::new(&command[0])
+        .args(&command[1..])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .kill_on_drop(true)
+        .spawn()
+        .with_context(|| format!("Failed to run alert command '{}'", command[0]))?;
+
+    let input = serde_json::to_vec(alert)?;
+    let run = async {
+        if let Some(mut stdin) = child.stdin.take() {
+            // A command that doesn't read its input still counts as delivered
+            let _ = stdin.write_all(&input).await;
+        }
+        child.wait().await
+    };
+    let status = tokio::time::timeout(ACTION_TIMEOUT, run)
+        .await
+        .map_err(|_| anyhow::anyhow!("Alert command '{}' timed out", command[0]))??;
+    if !status.success() {
+        return Err(anyhow::anyhow!(
+            "Alert command '{}' exited with {}",
+            command[0],
+            status
+        ));
+    }
+    Ok(())
+}
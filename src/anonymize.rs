@@ -0,0 +1,207 @@
+use anyhow::Result;
+use regex::Regex;
+use ring::hmac;
+use ring::rand::{SecureRandom, SystemRandom};
+use serde_json::Value;
+use std::sync::OnceLock;
+
+/// Set to reuse the same tokens across exports, e.g. to share several
+/// captures of one reproduction.
+pub const KEY_ENV: &str = "KM_ANONYMIZE_KEY";
+
+/// Hex characters kept from each HMAC; enough to keep distinct values apart
+/// in a capture without making tokens unwieldy.
+const TOKEN_LEN: usize = 12;
+
+/// JSON-RPC and MCP fields whose values describe the protocol rather than the
+/// user's data. They are kept so an anonymized capture still replays.
+const STRUCTURAL_KEYS: &[&str] = &[
+    "jsonrpc",
+    "method",
+    "protocolVersion",
+    "type",
+    "mimeType",
+    "role",
+];
+
+fn email_pattern() -> &'static Regex {
+    static PATTERN: OnceLock<Regex> = OnceLock::new();
+    PATTERN.get_or_init(|| Regex::new(r"^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$").unwrap())
+}
+
+fn url_pattern() -> &'static Regex {
+    static PATTERN: OnceLock<Regex> = OnceLock::new();
+    PATTERN.get_or_init(|| {
+        Regex::new(
+            r"^([A-Za-z][A-Za-z0-9+.-]*://)(?:[^@/?#\s]*@)?([^/:?#\s]*)(:\d+)?([^?#\s]*)(\S*)$",
+        )
+        .unwrap()
+    })
+}
+
+fn hostname_pattern() -> &'static Regex {
+    static PATTERN: OnceLock<Regex> = OnceLock::new();
+    PATTERN.get_or_init(|| {
+        Regex::new(r"^(?:[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?\.)+[A-Za-z]{2,}$").unwrap()
+    })
+}
+
+fn path_pattern() -> &'static Regex {
+    static PATTERN: OnceLock<Regex> = OnceLock::new();
+    PATTERN.get_or_init(|| Regex::new(r"^(?:/|~/|\./|\.\./|[A-Za-z]:[\\/])\S*$").unwrap())
+}
+
+/// Pseudonymizes captured payloads for sharing. Every value is replaced by a
+/// token derived from an HMAC of the value, so the same file path, host, or
+/// string maps to the same token everywhere in an export while the original
+/// can't be recovered without the key.
+pub struct Anonymizer {
+    key: hmac::Key,
+}
+
+impl Anonymizer {
+    pub fn new(secret: &[u8]) -> Self {
+        Self {
+            key: hmac::Key::new(hmac::HMAC_SHA256, secret),
+        }
+    }
+
+    /// An anonymizer with a fresh random key. Tokens are consistent within
+    /// one export but can't be matched against a dictionary of guesses.
+    pub fn random() -> Result<Self> {
+        let mut secret = [0u8; 32];
+        SystemRandom::new()
+            .fill(&mut secret)
+            .map_err(|_| anyhow::anyhow!("Failed to generate anonymization key"))?;
+        Ok(Self::new(&secret))
+    }
+
+    /// Key from `KM_ANONYMIZE_KEY` when set, otherwise a random one.
+    pub fn from_env() -> Result<Self> {
+        match std::env::var(KEY_ENV) {
+            Ok(secret) if !secret.is_empty() => Ok(Self::new(secret.as_bytes())),
+            _ => Self::random(),
+        }
+    }
+
+    /// Deterministic token for `value`. The kind is mixed in so a string that
+    /// appears as both a host and a literal doesn't link the two.
+    pub fn token(&self, kind: &str, value: &str) -> String {
+        let mut context = hmac::Context::with_key(&self.key);
+        context.update(kind.as_bytes());
+        context.update(&[0]);
+        context.update(value.as_bytes());
+        context
+            .sign()
+            .as_ref()
+            .iter()
+            .map(|b| format!("{:02x}", b))
+            .collect::<String>()[..TOKEN_LEN]
+            .to_string()
+    }
+
+    /// Anonymize a raw captured message. Content that isn't JSON is treated
+    /// as a single string literal.
+    pub fn anonymize_content(&self, content: &str) -> String {
+        match serde_json::from_str::<Value>(content) {
+            Ok(mut value) => {
+                self.anonymize_value(&mut value);
+                value.to_string()
+            }
+            Err(_) => self.anonymize_str(content),
+        }
+    }
+
+    /// Anonymize every string in `value` except structural protocol fields.
+    /// Object keys, numbers, and booleans are kept.
+    pub fn anonymize_value(&self, value: &mut Value) {
+        match value {
+            Value::String(s) => *s = self.anonymize_str(s),
+            Value::Array(items) => items.iter_mut().for_each(|v| self.anonymize_value(v)),
+            Value::Object(map) => {
+                for (key, v) in map.iter_mut() {
+                    if !(STRUCTURAL_KEYS.contains(&key.as_str()) && v.is_string()) {
+                        self.anonymize_value(v);
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Replace a single string, keeping the shape of emails, URLs, hostnames,
+    /// and file paths so the capture stays readable.
+    pub fn anonymize_str(&self, value: &str) -> String {
+        if value.is_empty() {
+            return String::new();
+        }
+        if email_pattern().is_match(value) {
+            return format!("user-{}@example.com", self.token("email", value));
+        }
+        if let Some(caps) = url_pattern().captures(value) {
+            let path = &caps[4];
+            let rest = &caps[5];
+            return format!(
+                "{}{}{}{}{}",
+                &caps[1],
+                self.host(&caps[2]),
+                caps.get(3).map_or("", |m| m.as_str()),
+                self.path(path),
+                if rest.is_empty() {
+                    String::new()
+                } else {
+                    format!("?{}", self.token("query", rest))
+                }
+            );
+        }
+        if hostname_pattern().is_match(value) {
+            return self.host(value);
+        }
+        if path_pattern().is_match(value) {
+            return self.path(value);
+        }
+        format!("str-{}", self.token("string", value))
+    }
+
+    fn host(&self, host: &str) -> String {
+        if host.is_empty() || host == "localhost" || host.parse::<std::net::IpAddr>().is_ok() {
+            return host.to_string();
+        }
+        format!(
+            "host-{}.example",
+            self.token("host", &host.to_ascii_lowercase())
+        )
+    }
+
+    /// Anonymize each path component separately so files in the same
+    /// directory still share a parent. Separators, the root, and extensions
+    /// are kept.
+    fn path(&self, path: &str) -> String {
+        let mut out = String::with_capacity(path.len());
+        let mut component = String::new();
+        for c in path.chars() {
+            if c == '/' || c == '\\' {
+                out.push_str(&self.component(&component));
+                component.clear();
+                out.push(c);
+            } else {
+                component.push(c);
+            }
+        }
+        out.push_str(&self.component(&component));
+        out
+    }
+
+    fn component(&self, component: &str) -> String {
+        let is_drive = component.len() == 2 && component.ends_with(':');
+        if component.is_empty() || is_drive || matches!(component, "." | ".." | "~") {
+            return component.to_string();
+        }
+        match component.rsplit_once('.') {
+            Some((stem, ext)) if !stem.is_empty() && !ext.is_empty() && ext.len() <= 8 => {
+                format!("p-{}.{}", self.token("path", stem), ext)
+            }
+            _ => format!("p-{}", self.token("path", component)),
+        }
+    }
+}
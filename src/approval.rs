@@ -0,0 +1,368 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::fs::OpenOptions;
+use std::io::{BufRead, BufReader, Write};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::mpsc::{self, SyncSender};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use crate::risk::{PatternRiskAnalyzer, RiskLevel};
+use crate::search::{Candidate, Query};
+use crate::traffic::TrafficEntry;
+
+/// JSON-RPC error code returned to the client when a held request is denied
+pub const APPROVAL_DENIED_CODE: i64 = -32003;
+
+pub const DEFAULT_CONFIRM_TIMEOUT_SECS: u64 = 60;
+
+/// Characters of a request's arguments shown in the prompt
+const PREVIEW_CHARS: usize = 200;
+
+#[cfg(unix)]
+const TERMINAL: (&str, &str) = ("/dev/tty", "/dev/tty");
+#[cfg(windows)]
+const TERMINAL: (&str, &str) = ("CONIN$", "CONOUT$");
+
+/// The `km search` query a `--confirm` value stands for. `high-risk` and
+/// `critical-risk` are shorthands; anything else is a query.
+pub fn confirm_query(when: &str) -> &str {
+    match when {
+        "high-risk" => "risk>=high",
+        "critical-risk" => "risk>=critical",
+        other => other,
+    }
+}
+
+/// A request waiting for someone to approve or deny it.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PendingApproval {
+    pub id: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    /// `params.name` of a tools/call request
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tool: Option<String>,
+    pub risk: RiskLevel,
+    pub risk_score: f32,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub matched_patterns: Vec<String>,
+    pub content: String,
+    pub requested_at: DateTime<Utc>,
+    /// When the request is denied if nobody answers
+    pub expires_at: DateTime<Utc>,
+}
+
+impl PendingApproval {
+    /// The prompt shown in the terminal.
+    pub fn prompt(&self) -> Vec<String> {
+        let mut what = self.method.clone().unwrap_or_else(|| "message".to_string());
+        if let Some(ref tool) = self.tool {
+            what.push_str(&format!(" {}", tool));
+        }
+        let mut risk = format!("{} risk {:.2}", self.risk, self.risk_score);
+        if !self.matched_patterns.is_empty() {
+            risk.push_str(&format!(": {}", self.matched_patterns.join(", ")));
+        }
+        let seconds = (self.expires_at - self.requested_at).num_seconds();
+        vec![
+            format!("⚠️  km: approval needed [#{}] {} ({})", self.id, what, risk),
+            format!("   {}", preview(&self.content)),
+            format!(
+                "   Approve? [y/N] (denied in {}s; or km ctl approve {})",
+                seconds, self.id
+            ),
+        ]
+    }
+}
+
+/// The arguments of a call, or the whole message, cut to a readable length.
+fn preview(content: &str) -> String {
+    let shown = serde_json::from_str::<Value>(content)
+        .ok()
+        .and_then(|json| {
+            json.pointer("/params/arguments")
+                .or_else(|| json.get("params"))
+                .map(Value::to_string)
+        })
+        .unwrap_or_else(|| content.to_string());
+    let mut preview: String = shown.chars().take(PREVIEW_CHARS).collect();
+    if preview.len() < shown.len() {
+        preview.push('…');
+    }
+    preview
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ApprovalDecision {
+    Approved,
+    Denied,
+    TimedOut,
+}
+
+/// What happened to a held request, recorded in the `approval` metadata of
+/// its captured event.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ApprovalOutcome {
+    pub id: u64,
+    pub decision: ApprovalDecision,
+    /// `terminal` or `ctl`; absent when the request timed out
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub by: Option<String>,
+    pub waited_ms: u64,
+}
+
+impl ApprovalOutcome {
+    pub fn approved(&self) -> bool {
+        self.decision == ApprovalDecision::Approved
+    }
+
+    /// The error message the client gets for a request that wasn't approved.
+    pub fn reason(&self) -> String {
+        match self.decision {
+            ApprovalDecision::Approved => "Approved".to_string(),
+            ApprovalDecision::Denied => format!(
+                "Denied by the user ({})",
+                self.by.as_deref().unwrap_or("unknown")
+            ),
+            ApprovalDecision::TimedOut => "Denied: nobody approved the request in time".to_string(),
+        }
+    }
+}
+
+type Answer = (bool, &'static str);
+
+type Prompt = Arc<Mutex<Box<dyn Write + Send>>>;
+
+/// Held requests by id, each with the channel its answer goes to
+type Pending = Arc<Mutex<BTreeMap<u64, (PendingApproval, SyncSender<Answer>)>>>;
+
+/// Holds requests that match a query until they are approved, denied, or
+/// time out. Answers come from the terminal km runs in or from `km ctl`.
+pub struct ApprovalGate {
+    query: Query,
+    timeout: Duration,
+    analyzer: Arc<PatternRiskAnalyzer>,
+    pending: Pending,
+    next_id: AtomicU64,
+    prompt: Option<Prompt>,
+}
+
+impl std::fmt::Debug for ApprovalGate {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ApprovalGate")
+            .field("query", &self.query)
+            .field("timeout", &self.timeout)
+            .finish_non_exhaustive()
+    }
+}
+
+impl ApprovalGate {
+    /// Hold requests matching `when` (a `--confirm` value) for up to `timeout`.
+    pub fn new(when: &str, timeout: Duration, analyzer: Arc<PatternRiskAnalyzer>) -> Result<Self> {
+        let query = Query::parse(confirm_query(when)).context("Invalid --confirm query")?;
+        Ok(Self {
+            query,
+            timeout,
+            analyzer,
+            pending: Arc::default(),
+            next_id: AtomicU64::new(1),
+            prompt: None,
+        })
+    }
+
+    /// Also prompt in the controlling terminal. Without one, requests can
+    /// only be answered with `km ctl`.
+    pub fn with_terminal(self) -> Self {
+        let (input, output) = TERMINAL;
+        let terminal = OpenOptions::new()
+            .read(true)
+            .open(input)
+            .and_then(|input| Ok((input, OpenOptions::new().write(true).open(output)?)));
+        match terminal {
+            Ok((input, output)) => self.with_prompt(BufReader::new(input), output),
+            Err(e) => {
+                tracing::warn!(
+                    "No terminal to prompt in ({}); approve held requests with km ctl approve",
+                    e
+                );
+                self
+            }
+        }
+    }
+
+    /// Prompt on `output` and read answers from `input`, one per line. An
+    /// answer applies to the oldest pending request; anything but `y` or
+    /// `yes` denies it.
+    pub fn with_prompt(
+        mut self,
+        input: impl BufRead + Send + 'static,
+        output: impl Write + Send + 'static,
+    ) -> Self {
+        let pending = self.pending.clone();
+        thread::spawn(move || {
+            for line in input.lines() {
+                let Ok(line) = line else {
+                    break;
+                };
+                let approve = matches!(line.trim().to_ascii_lowercase().as_str(), "y" | "yes");
+                let oldest = pending.lock().ok().and_then(|mut pending| {
+                    let id = *pending.keys().next()?;
+                    pending.remove(&id)
+                });
+                if let Some((_, answer)) = oldest {
+                    let _ = answer.try_send((approve, "terminal"));
+                }
+            }
+        });
+        self.prompt = Some(Arc::new(Mutex::new(Box::new(output))));
+        self
+    }
+
+    /// Whether `json` must wait for approval, and the request to approve if so.
+    fn hold(&self, json: &Value, content: &str) -> Option<PendingApproval> {
+        let method = json.get("method").and_then(|m| m.as_str());
+        let assessment = self.analyzer.analyze(method, content);
+        let entry = TrafficEntry {
+            timestamp: Utc::now(),
+            direction: "request".to_string(),
+            content: content.to_string(),
+            duration_ms: None,
+            status: None,
+            error_code: None,
+            elapsed_ms: None,
+            session_id: None,
+            metadata: BTreeMap::new(),
+            labels: Default::default(),
+        };
+        let candidate = Candidate {
+            entry: &entry,
+            method,
+            risk: assessment.level,
+        };
+        if !self.query.matches(&candidate) {
+            return None;
+        }
+
+        let tool = (method == Some("tools/call"))
+            .then(|| json.pointer("/params/name")?.as_str().map(String::from))
+            .flatten();
+        let requested_at = entry.timestamp;
+        Some(PendingApproval {
+            id: self.next_id.fetch_add(1, Ordering::Relaxed),
+            method: method.map(String::from),
+            tool,
+            risk: assessment.level,
+            risk_score: assessment.score,
+            matched_patterns: assessment.matched_patterns,
+            content: entry.content,
+            requested_at,
+            expires_at: requested_at + chrono::Duration::seconds(self.timeout.as_secs() as i64),
+        })
+    }
+
+    /// Check a client request. Returns `None` straight away when it doesn't
+    /// need approval; otherwise waits for an answer or the timeout.
+    pub fn check(&self, json: &Value, content: &str) -> Option<ApprovalOutcome> {
+        let request = self.hold(json, content)?;
+        let id = request.id;
+        let started = Instant::now();
+        let (answer_tx, answer_rx) = mpsc::sync_channel(1);
+        tracing::info!(
+            "Holding request #{} ({}) for approval",
+            id,
+            request.method.as_deref().unwrap_or("message")
+        );
+        if let Some(ref prompt) = self.prompt {
+            if let Ok(mut output) = prompt.lock() {
+                for line in request.prompt() {
+                    let _ = writeln!(output, "{}", line);
+                }
+                let _ = output.flush();
+            }
+        }
+        if let Ok(mut pending) = self.pending.lock() {
+            pending.insert(id, (request, answer_tx));
+        }
+
+        let answer = answer_rx.recv_timeout(self.timeout).ok();
+        if let Ok(mut pending) = self.pending.lock() {
+            pending.remove(&id);
+        }
+        let (decision, by) = match answer {
+            Some((true, by)) => (ApprovalDecision::Approved, Some(by.to_string())),
+            Some((false, by)) => (ApprovalDecision::Denied, Some(by.to_string())),
+            None => (ApprovalDecision::TimedOut, None),
+        };
+        let outcome = ApprovalOutcome {
+            id,
+            decision,
+            by,
+            waited_ms: started.elapsed().as_millis() as u64,
+        };
+        if let Some(ref prompt) = self.prompt {
+            if let Ok(mut output) = prompt.lock() {
+                let _ = writeln!(output, "   #{}: {}", id, outcome.reason());
+            }
+        }
+        tracing::info!("Request #{}: {}", id, outcome.reason());
+        Some(outcome)
+    }
+
+    /// Requests waiting for an answer, oldest first.
+    pub fn pending(&self) -> Vec<PendingApproval> {
+        match self.pending.lock() {
+            Ok(pending) => pending
+                .values()
+                .map(|(request, _)| request.clone())
+                .collect(),
+            Err(_) => Vec::new(),
+        }
+    }
+
+    /// Answer a pending request over `km ctl`.
+    pub fn decide(&self, id: u64, approve: bool) -> Result<()> {
+        let answer = self
+            .pending
+            .lock()
+            .map_err(|_| anyhow::anyhow!("Pending approvals are unavailable"))?
+            .remove(&id);
+        match answer {
+            Some((_, answer)) => {
+                let _ = answer.try_send((approve, "ctl"));
+                Ok(())
+            }
+            None => Err(anyhow::anyhow!(
+                "No request #{} is waiting for approval",
+                id
+            )),
+        }
+    }
+}
+
+/// Render `km ctl pending` for the terminal.
+pub fn render_pending(pending: &[PendingApproval], now: DateTime<Utc>) -> Vec<String> {
+    if pending.is_empty() {
+        return vec!["No requests are waiting for approval".to_string()];
+    }
+    let mut lines = vec![format!(
+        "{:<5}  {:<24}  {:<16}  {:<8}  {}",
+        "ID", "METHOD", "TOOL", "RISK", "DENIED IN"
+    )];
+    for request in pending {
+        lines.push(format!(
+            "{:<5}  {:<24}  {:<16}  {:<8}  {}s",
+            request.id,
+            request.method.as_deref().unwrap_or("-"),
+            request.tool.as_deref().unwrap_or("-"),
+            request.risk.to_string(),
+            (request.expires_at - now).num_seconds().max(0)
+        ));
+    }
+    lines
+}
@@ -0,0 +1,462 @@
+//! Tamper-evident log of the decisions made about traffic: every allow,
+//! block, rewrite and redaction by policies, the policy bundle, plugins,
+//! approvals and filters. Each session writes its own JSONL file; every
+//! record carries the hash of the one before it, so a record that is
+//! edited, removed or reordered breaks the chain from there on.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fs::{self, File};
+use std::io::{BufRead, BufReader, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Mutex;
+
+/// `prev_hash` of the first record of a session
+pub const GENESIS_HASH: &str = "0000000000000000000000000000000000000000000000000000000000000000";
+
+/// `~/.config/kilometers/decisions` (or the platform equivalent)
+pub fn default_dir() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("decisions"))
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DecisionLogConfig {
+    /// Write the decisions of `km monitor` sessions to the decision log
+    #[serde(default = "default_true")]
+    pub enabled: bool,
+    /// Where the decision logs are kept (defaults to the km config directory)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dir: Option<String>,
+}
+
+fn default_true() -> bool {
+    true
+}
+
+impl Default for DecisionLogConfig {
+    fn default() -> Self {
+        Self {
+            enabled: true,
+            dir: None,
+        }
+    }
+}
+
+impl DecisionLogConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn dir(&self) -> Result<PathBuf> {
+        match self.dir {
+            Some(ref dir) => Ok(PathBuf::from(dir)),
+            None => default_dir(),
+        }
+    }
+}
+
+/// What made a decision.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum DecisionSource {
+    /// A rule of the `policy` config section
+    Policy,
+    /// The Rego policy bundle (`--policy-bundle`)
+    PolicyBundle,
+    Plugin,
+    /// Someone answering a held request (`--confirm`)
+    Approval,
+    /// A filter of the monitor's filter pipeline
+    Filter,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Verdict {
+    Allow,
+    Block,
+    /// The message was rewritten before it was forwarded
+    Modify,
+    /// Parts of the message were redacted from what km stores
+    Redact,
+}
+
+/// One line of a decision log: who decided what about which message, and
+/// why.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DecisionRecord {
+    /// Position in the session's chain, from 1
+    pub seq: u64,
+    pub timestamp: DateTime<Utc>,
+    pub session_id: String,
+    /// `request`, or `response` for decisions about the server's answer
+    pub direction: String,
+    pub source: DecisionSource,
+    /// The policy rule, plugin, bundle revision or approver that decided
+    pub actor: String,
+    pub action: Verdict,
+    /// False for decisions only logged, such as policies in monitor mode
+    pub enforced: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub reason: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    /// JSON-RPC id of the message; absent for notifications
+    #[serde(default, skip_serializing_if = "Value::is_null")]
+    pub request_id: Value,
+    /// The tool called, for tools/call
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tool: Option<String>,
+    /// Paths redacted from the stored message
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub redacted: Vec<String>,
+    pub prev_hash: String,
+    pub hash: String,
+}
+
+impl DecisionRecord {
+    /// A decision about `message`; the log fills in its place in the chain.
+    pub fn about(message: &Value, source: DecisionSource, actor: &str, action: Verdict) -> Self {
+        let method = message.get("method").and_then(Value::as_str);
+        let tool = match method {
+            Some("tools/call") => message
+                .pointer("/params/name")
+                .and_then(Value::as_str)
+                .map(String::from),
+            _ => None,
+        };
+        Self {
+            seq: 0,
+            timestamp: Utc::now(),
+            session_id: String::new(),
+            direction: "request".to_string(),
+            source,
+            actor: actor.to_string(),
+            action,
+            enforced: true,
+            reason: None,
+            method: method.map(String::from),
+            request_id: message.get("id").cloned().unwrap_or(Value::Null),
+            tool,
+            redacted: Vec::new(),
+            prev_hash: String::new(),
+            hash: String::new(),
+        }
+    }
+
+    pub fn with_reason(mut self, reason: impl Into<String>) -> Self {
+        self.reason = Some(reason.into());
+        self
+    }
+}
+
+/// Hash of a record as written, without its own `hash` field.
+fn record_hash(record: &serde_json::Map<String, Value>) -> String {
+    let mut fields = record.clone();
+    fields.remove("hash");
+    let digest = Sha256::digest(Value::Object(fields).to_string().as_bytes());
+    digest.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+#[derive(Debug)]
+struct Chain {
+    file: File,
+    seq: u64,
+    last_hash: String,
+}
+
+/// The decision log of the running session.
+#[derive(Debug)]
+pub struct DecisionLog {
+    path: PathBuf,
+    session_id: String,
+    chain: Mutex<Chain>,
+    /// Set after the first failed write, so it's only reported once
+    failed: AtomicBool,
+}
+
+impl DecisionLog {
+    /// Open the log of `session_id` in `dir`, continuing its chain if the
+    /// session already wrote some.
+    pub fn create(dir: &Path, session_id: &str) -> Result<Self> {
+        fs::create_dir_all(dir).context("Failed to create decision log directory")?;
+        let path = dir.join(format!("{}.jsonl", session_id));
+        let (seq, last_hash) = match last_record(&path)? {
+            Some(record) => (record.seq, record.hash),
+            None => (0, GENESIS_HASH.to_string()),
+        };
+        let file = fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)
+            .with_context(|| format!("Failed to open decision log {:?}", path))?;
+        Ok(Self {
+            path,
+            session_id: session_id.to_string(),
+            chain: Mutex::new(Chain {
+                file,
+                seq,
+                last_hash,
+            }),
+            failed: AtomicBool::new(false),
+        })
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Append a decision to the chain.
+    pub fn record(&self, mut record: DecisionRecord) {
+        let mut chain = match self.chain.lock() {
+            Ok(chain) => chain,
+            Err(poisoned) => poisoned.into_inner(),
+        };
+        record.seq = chain.seq + 1;
+        record.session_id = self.session_id.clone();
+        record.prev_hash = chain.last_hash.clone();
+        let Ok(Value::Object(mut fields)) = serde_json::to_value(&record) else {
+            return;
+        };
+        let hash = record_hash(&fields);
+        fields.insert("hash".to_string(), Value::String(hash.clone()));
+        let mut line = Value::Object(fields).to_string();
+        line.push('\n');
+
+        // One write per line, so a crash can only cut off the last one
+        match chain.file.write_all(line.as_bytes()) {
+            Ok(()) => {
+                chain.seq = record.seq;
+                chain.last_hash = hash;
+            }
+            Err(e) => {
+                if !self.failed.swap(true, Ordering::Relaxed) {
+                    tracing::warn!(
+                        "Could not write to decision log {:?}; decisions are going unrecorded: {}",
+                        self.path,
+                        e
+                    );
+                }
+            }
+        }
+    }
+}
+
+/// The last complete record of a log, if it has any.
+fn last_record(path: &Path) -> Result<Option<DecisionRecord>> {
+    let file = match File::open(path) {
+        Ok(file) => file,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {:?}", path)),
+    };
+    let mut last = None;
+    for line in BufReader::new(file).lines() {
+        let line = line.with_context(|| format!("Failed to read {:?}", path))?;
+        if let Ok(record) = serde_json::from_str(&line) {
+            last = Some(record);
+        }
+    }
+    Ok(last)
+}
+
+/// How one session's chain held up.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ChainReport {
+    pub session_id: String,
+    pub records: usize,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub first: Option<DateTime<Utc>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last: Option<DateTime<Utc>>,
+    /// Where and how the chain breaks
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub broken: Option<String>,
+}
+
+impl ChainReport {
+    pub fn is_intact(&self) -> bool {
+        self.broken.is_none()
+    }
+}
+
+/// Check the hash chains in decision log lines, one chain per session, in
+/// the order the sessions first appear. Each session must start at record
+/// 1 from [`GENESIS_HASH`] and go on without gaps, so records dropped from
+/// the head of a session break its chain too.
+pub fn verify(lines: impl BufRead) -> Result<Vec<ChainReport>> {
+    check_chains(lines, false)
+}
+
+/// [`verify`] for an export made with `--since`, whose sessions may start
+/// mid-chain. From its first record on, each chain must still go on
+/// without gaps.
+pub fn verify_excerpt(lines: impl BufRead) -> Result<Vec<ChainReport>> {
+    check_chains(lines, true)
+}
+
+fn check_chains(lines: impl BufRead, excerpt: bool) -> Result<Vec<ChainReport>> {
+    let mut reports: Vec<ChainReport> = Vec::new();
+    // Per session: its report, and the number and hash of its last record
+    let mut tips: BTreeMap<String, (usize, u64, String)> = BTreeMap::new();
+    for (index, line) in lines.lines().enumerate() {
+        let line = line.context("Failed to read decision log")?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let number = index + 1;
+        let fields = match serde_json::from_str::<Value>(&line) {
+            Ok(Value::Object(fields)) => fields,
+            _ => return Err(anyhow::anyhow!("Line {} is not a decision record", number)),
+        };
+        let record: DecisionRecord = serde_json::from_value(Value::Object(fields.clone()))
+            .with_context(|| format!("Line {} is not a decision record", number))?;
+
+        let report_index = match tips.get(&record.session_id) {
+            Some(&(report_index, _, _)) => report_index,
+            None => {
+                reports.push(ChainReport {
+                    session_id: record.session_id.clone(),
+                    records: 0,
+                    first: None,
+                    last: None,
+                    broken: None,
+                });
+                reports.len() - 1
+            }
+        };
+        let report = &mut reports[report_index];
+        report.records += 1;
+        report.first.get_or_insert(record.timestamp);
+        report.last = Some(record.timestamp);
+        if report.broken.is_some() {
+            continue;
+        }
+
+        let problem = match tips.get(&record.session_id) {
+            _ if record_hash(&fields) != record.hash => Some("its hash doesn't match its contents"),
+            Some((_, seq, hash)) if record.seq != seq + 1 || record.prev_hash != *hash => {
+                Some("it doesn't follow the record before it")
+            }
+            None if !excerpt && record.seq != 1 => Some("the records before it are missing"),
+            None if !excerpt && record.prev_hash != GENESIS_HASH => {
+                Some("the first record doesn't start the chain")
+            }
+            _ => None,
+        };
+        if let Some(problem) = problem {
+            report.broken = Some(format!(
+                "line {} (record {}): {}",
+                number, record.seq, problem
+            ));
+        }
+        tips.insert(
+            record.session_id.clone(),
+            (report_index, record.seq, record.hash),
+        );
+    }
+    Ok(reports)
+}
+
+/// Check one decision log file, or with `excerpt` an export made with
+/// `--since` (see [`verify_excerpt`]).
+pub fn verify_file(path: &Path, excerpt: bool) -> Result<Vec<ChainReport>> {
+    let file = File::open(path).with_context(|| format!("Failed to open {:?}", path))?;
+    check_chains(BufReader::new(file), excerpt)
+        .with_context(|| format!("Failed to check {:?}", path))
+}
+
+/// The decision logs in `dir`, oldest first.
+pub fn logs(dir: &Path) -> Result<Vec<PathBuf>> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Failed to list {:?}", dir)),
+    };
+    let mut logs: Vec<(std::time::SystemTime, PathBuf)> = entries
+        .filter_map(|entry| entry.ok())
+        .map(|entry| entry.path())
+        .filter(|path| path.extension().is_some_and(|ext| ext == "jsonl"))
+        .map(|path| {
+            let modified = fs::metadata(&path)
+                .and_then(|m| m.modified())
+                .unwrap_or(std::time::UNIX_EPOCH);
+            (modified, path)
+        })
+        .collect();
+    logs.sort();
+    Ok(logs.into_iter().map(|(_, path)| path).collect())
+}
+
+/// Which records `km audit export` writes.
+#[derive(Debug, Clone, Default)]
+pub struct ExportFilter {
+    /// Session id, or a prefix of it
+    pub session: Option<String>,
+    pub since: Option<DateTime<Utc>>,
+}
+
+/// Write the records of the decision logs in `dir` that pass `filter` to
+/// `output`, exactly as logged so their hashes can still be checked.
+/// Refuses logs whose chain is broken. Returns the number of records
+/// written.
+pub fn export(dir: &Path, filter: &ExportFilter, output: &mut dyn Write) -> Result<usize> {
+    let mut written = 0;
+    for path in logs(dir)? {
+        let session_id = path
+            .file_stem()
+            .map(|stem| stem.to_string_lossy().into_owned())
+            .unwrap_or_default();
+        if let Some(ref session) = filter.session {
+            if !session_id.starts_with(session.as_str()) {
+                continue;
+            }
+        }
+        if let Some(broken) = verify_file(&path, false)?
+            .into_iter()
+            .find_map(|r| r.broken)
+        {
+            return Err(anyhow::anyhow!(
+                "Decision log {:?} has been tampered with at {}",
+                path,
+                broken
+            ));
+        }
+
+        let file = File::open(&path).with_context(|| format!("Failed to open {:?}", path))?;
+        for line in BufReader::new(file).lines() {
+            let line = line.with_context(|| format!("Failed to read {:?}", path))?;
+            let Ok(record) = serde_json::from_str::<DecisionRecord>(&line) else {
+                continue;
+            };
+            if filter.since.is_some_and(|since| record.timestamp < since) {
+                continue;
+            }
+            writeln!(output, "{}", line).context("Failed to write the export")?;
+            written += 1;
+        }
+    }
+    Ok(written)
+}
+
+/// `km audit verify` lines.
+pub fn render(reports: &[ChainReport]) -> Vec<String> {
+    reports
+        .iter()
+        .map(|report| {
+            let state = match report.broken {
+                Some(ref broken) => format!("✗ broken at {}", broken),
+                None => "✓ intact".to_string(),
+            };
+            format!(
+                "{:<38} {:>6} decision(s)  {}",
+                report.session_id, report.records, state
+            )
+        })
+        .collect()
+}
@@ -3,6 +3,8 @@ use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine as _};
 use serde::{Deserialize, Serialize};
 use std::time::{SystemTime, UNIX_EPOCH};
 
+use crate::errors::{Code, KmError};
+
 #[derive(Debug, Clone)]
 pub struct AuthClient {
     api_key: String,
@@ -47,7 +49,7 @@ struct AuthResponse {
 
 impl AuthClient {
     pub fn new(api_key: String, base_url: String) -> Self {
-        let client = reqwest::Client::builder()
+        let client = crate::http::client_builder()
             .timeout(std::time::Duration::from_secs(10))
             .build()
             .unwrap_or_else(|_| reqwest::Client::new());
@@ -60,6 +62,7 @@ impl AuthClient {
     }
 
     pub async fn exchange_for_jwt(&self) -> Result<JwtToken> {
+        crate::offline::ensure_online("Signing in to the API")?;
         let auth_request = AuthRequest {
             api_key: self.api_key.clone(),
         };
@@ -73,10 +76,12 @@ impl AuthClient {
             .context("Failed to send auth request")?;
 
         if !response.status().is_success() {
-            return Err(anyhow::anyhow!(
-                "Auth failed with status: {}",
-                response.status()
-            ));
+            let status = response.status();
+            return Err(KmError::new(
+                Code::for_status(status),
+                format!("Auth failed with status: {}", status),
+            )
+            .into());
         }
 
         let auth_response: AuthResponse = response
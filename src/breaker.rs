@@ -0,0 +1,421 @@
+//! Failure handling for uploads to the Kilometers API. A throttled batch is
+//! retried a few times with backoff before it's spooled; past that, a
+//! circuit breaker stops sending to an API that keeps failing. Once it has
+//! been open for `open_secs` it lets a few probe uploads through
+//! (half-open): a probe that succeeds closes it, one that fails opens it
+//! again. While it's open, batches go straight to the spool.
+
+use anyhow::Result;
+use chrono::{DateTime, Utc};
+use reqwest::StatusCode;
+use serde::{Deserialize, Serialize};
+use std::sync::Mutex;
+use std::time::Duration;
+use tokio::time::Instant;
+
+use crate::latency;
+use crate::rate_limit::Backoff;
+
+const DEFAULT_RETRIES: u32 = 2;
+const DEFAULT_BACKOFF_BASE_MS: u64 = 500;
+const DEFAULT_BACKOFF_MAX_MS: u64 = 10_000;
+const DEFAULT_FAILURE_THRESHOLD: u32 = 5;
+const DEFAULT_OPEN_SECS: u64 = 60;
+const DEFAULT_HALF_OPEN_PROBES: u32 = 1;
+
+fn default_retries() -> u32 {
+    DEFAULT_RETRIES
+}
+
+fn default_backoff_base_ms() -> u64 {
+    DEFAULT_BACKOFF_BASE_MS
+}
+
+fn default_backoff_max_ms() -> u64 {
+    DEFAULT_BACKOFF_MAX_MS
+}
+
+fn default_failure_threshold() -> u32 {
+    DEFAULT_FAILURE_THRESHOLD
+}
+
+fn default_open_secs() -> u64 {
+    DEFAULT_OPEN_SECS
+}
+
+fn default_half_open_probes() -> u32 {
+    DEFAULT_HALF_OPEN_PROBES
+}
+
+/// How batches the API answers with 429 or 503 are retried.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RetryConfig {
+    /// Retries before the batch is spooled
+    #[serde(default = "default_retries")]
+    pub retries: u32,
+    /// Ceiling of the first wait when the API doesn't send `Retry-After`
+    #[serde(default = "default_backoff_base_ms")]
+    pub backoff_base_ms: u64,
+    /// No wait is longer than this
+    #[serde(default = "default_backoff_max_ms")]
+    pub backoff_max_ms: u64,
+}
+
+impl Default for RetryConfig {
+    fn default() -> Self {
+        Self {
+            retries: DEFAULT_RETRIES,
+            backoff_base_ms: DEFAULT_BACKOFF_BASE_MS,
+            backoff_max_ms: DEFAULT_BACKOFF_MAX_MS,
+        }
+    }
+}
+
+impl RetryConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        if self.retries > 10 {
+            return Err(anyhow::anyhow!(
+                "retry.retries must be 10 or less (got {})",
+                self.retries
+            ));
+        }
+        if self.backoff_base_ms == 0 || self.backoff_max_ms < self.backoff_base_ms {
+            return Err(anyhow::anyhow!(
+                "retry.backoff_base_ms must be more than 0 and at most retry.backoff_max_ms"
+            ));
+        }
+        Ok(())
+    }
+
+    pub fn backoff(&self) -> Backoff {
+        Backoff {
+            base: Duration::from_millis(self.backoff_base_ms),
+            max: Duration::from_millis(self.backoff_max_ms),
+        }
+    }
+}
+
+/// When uploads stop after repeated failures, and how they resume.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BreakerConfig {
+    /// Failed uploads in a row that open the breaker; 0 never opens it
+    #[serde(default = "default_failure_threshold")]
+    pub failure_threshold: u32,
+    /// Seconds the breaker stays open before probing the API
+    #[serde(default = "default_open_secs")]
+    pub open_secs: u64,
+    /// Probe uploads allowed in flight at once while half-open
+    #[serde(default = "default_half_open_probes")]
+    pub half_open_probes: u32,
+}
+
+impl Default for BreakerConfig {
+    fn default() -> Self {
+        Self {
+            failure_threshold: DEFAULT_FAILURE_THRESHOLD,
+            open_secs: DEFAULT_OPEN_SECS,
+            half_open_probes: DEFAULT_HALF_OPEN_PROBES,
+        }
+    }
+}
+
+impl BreakerConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        if !(1..=3600).contains(&self.open_secs) {
+            return Err(anyhow::anyhow!(
+                "circuit_breaker.open_secs must be between 1 and 3600 (got {})",
+                self.open_secs
+            ));
+        }
+        if self.half_open_probes == 0 {
+            return Err(anyhow::anyhow!(
+                "circuit_breaker.half_open_probes must be greater than 0"
+            ));
+        }
+        Ok(())
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum BreakerState {
+    /// Uploads go out
+    Closed,
+    /// Uploads are spooled without trying the API
+    Open,
+    /// A limited number of probe uploads go out
+    HalfOpen,
+}
+
+impl BreakerState {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Closed => "closed",
+            Self::Open => "open",
+            Self::HalfOpen => "half-open",
+        }
+    }
+}
+
+/// What `km status --api` shows about a running session's uploads.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BreakerStatus {
+    pub state: BreakerState,
+    /// Uploads that failed since the last one that succeeded
+    pub consecutive_failures: u32,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub opened_at: Option<DateTime<Utc>>,
+    /// When an open breaker starts letting probes through
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub probe_at: Option<DateTime<Utc>>,
+    /// Times the breaker opened this session
+    pub opened: u64,
+    pub breaker: BreakerConfig,
+    pub retry: RetryConfig,
+}
+
+impl BreakerStatus {
+    /// `open after 5 failures in a row, probing at 10:42:07 UTC (opened 1 time(s))`
+    pub fn describe(&self) -> String {
+        let detail = match (self.state, self.probe_at) {
+            (BreakerState::Open, Some(at)) => format!(
+                " after {} failures in a row, probing at {}",
+                self.consecutive_failures,
+                at.format("%H:%M:%S UTC")
+            ),
+            (BreakerState::HalfOpen, _) => " (probing the API)".to_string(),
+            _ if self.consecutive_failures > 0 => {
+                format!(" ({} failed in a row)", self.consecutive_failures)
+            }
+            _ => String::new(),
+        };
+        format!(
+            "{}{} (opened {} time(s))",
+            self.state.as_str(),
+            detail,
+            self.opened
+        )
+    }
+}
+
+#[derive(Debug)]
+struct Inner {
+    state: BreakerState,
+    failures: u32,
+    opened_at: Option<(Instant, DateTime<Utc>)>,
+    /// Probes in flight while half-open
+    probes: u32,
+    opened: u64,
+}
+
+/// Tracks whether the API is up, from the outcome of each upload. Shared
+/// by the event uploader and the spool so both stop and resume together.
+#[derive(Debug)]
+pub struct CircuitBreaker {
+    config: BreakerConfig,
+    retry: RetryConfig,
+    inner: Mutex<Inner>,
+}
+
+impl Default for CircuitBreaker {
+    fn default() -> Self {
+        Self::new(BreakerConfig::default(), RetryConfig::default())
+    }
+}
+
+impl CircuitBreaker {
+    /// `retry` is only reported in the status; the uploader applies it.
+    pub fn new(config: BreakerConfig, retry: RetryConfig) -> Self {
+        Self {
+            config,
+            retry,
+            inner: Mutex::new(Inner {
+                state: BreakerState::Closed,
+                failures: 0,
+                opened_at: None,
+                probes: 0,
+                opened: 0,
+            }),
+        }
+    }
+
+    fn inner(&self) -> std::sync::MutexGuard<'_, Inner> {
+        self.inner.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Permission to try one upload, or `None` while the breaker is open
+    /// or every probe slot is taken. Report how it went on the attempt.
+    pub fn try_acquire(&self) -> Option<Attempt<'_>> {
+        let mut inner = self.inner();
+        if inner.state == BreakerState::Open {
+            let (since, _) = inner.opened_at?;
+            if since.elapsed() < Duration::from_secs(self.config.open_secs) {
+                return None;
+            }
+            tracing::info!("Probing the Kilometers API before resuming uploads");
+            inner.state = BreakerState::HalfOpen;
+            inner.probes = 0;
+        }
+        let probe = inner.state == BreakerState::HalfOpen;
+        if probe {
+            if inner.probes >= self.config.half_open_probes {
+                return None;
+            }
+            inner.probes += 1;
+        }
+        Some(Attempt {
+            breaker: self,
+            probe,
+            reported: false,
+        })
+    }
+
+    fn record(&self, probe: bool, succeeded: bool) {
+        let mut inner = self.inner();
+        if probe {
+            inner.probes = inner.probes.saturating_sub(1);
+        }
+        if succeeded {
+            if inner.state != BreakerState::Closed {
+                tracing::info!("The Kilometers API is answering again; resuming uploads");
+            }
+            inner.state = BreakerState::Closed;
+            inner.failures = 0;
+            inner.opened_at = None;
+            return;
+        }
+        inner.failures = inner.failures.saturating_add(1);
+        let trips = match inner.state {
+            BreakerState::HalfOpen => true,
+            BreakerState::Closed => {
+                self.config.failure_threshold > 0 && inner.failures >= self.config.failure_threshold
+            }
+            // Attempts that started before the breaker opened
+            BreakerState::Open => false,
+        };
+        if trips {
+            tracing::warn!(
+                "Kilometers API uploads failed {} times in a row; spooling events for {}s",
+                inner.failures,
+                self.config.open_secs
+            );
+            inner.state = BreakerState::Open;
+            inner.opened_at = Some((Instant::now(), Utc::now()));
+            inner.opened += 1;
+        }
+    }
+
+    pub fn status(&self) -> BreakerStatus {
+        let inner = self.inner();
+        let opened_at = inner.opened_at.map(|(_, at)| at);
+        BreakerStatus {
+            state: inner.state,
+            consecutive_failures: inner.failures,
+            opened_at,
+            probe_at: opened_at
+                .filter(|_| inner.state == BreakerState::Open)
+                .map(|at| at + chrono::Duration::seconds(self.config.open_secs as i64)),
+            opened: inner.opened,
+            breaker: self.config,
+            retry: self.retry,
+        }
+    }
+}
+
+/// One upload let through by a [`CircuitBreaker`]. An attempt dropped
+/// without a report, e.g. when the upload is cancelled, counts as neither.
+#[derive(Debug)]
+pub struct Attempt<'a> {
+    breaker: &'a CircuitBreaker,
+    probe: bool,
+    reported: bool,
+}
+
+impl Attempt<'_> {
+    pub fn succeeded(mut self) {
+        self.reported = true;
+        self.breaker.record(self.probe, true);
+    }
+
+    pub fn failed(mut self) {
+        self.reported = true;
+        self.breaker.record(self.probe, false);
+    }
+}
+
+impl Drop for Attempt<'_> {
+    fn drop(&mut self) {
+        if !self.reported && self.probe {
+            let mut inner = self.breaker.inner();
+            inner.probes = inner.probes.saturating_sub(1);
+        }
+    }
+}
+
+/// The breaker and retry lines of `km status --api`.
+pub fn render(status: &BreakerStatus) -> Vec<String> {
+    let mut lines = vec![format!("Breaker:  {}", status.describe())];
+    lines.push(match status.breaker.failure_threshold {
+        0 => "Opens:    never".to_string(),
+        failures => format!(
+            "Opens:    after {} failed uploads in a row, for {}s, then {} probe(s) at a time",
+            failures, status.breaker.open_secs, status.breaker.half_open_probes
+        ),
+    });
+    lines.push(format!(
+        "Retries:  {} per throttled batch, waiting up to {}ms then doubling to {}ms",
+        status.retry.retries, status.retry.backoff_base_ms, status.retry.backoff_max_ms
+    ));
+    lines
+}
+
+/// Whether an upload answered with `status` failed because the API is
+/// down or overloaded, rather than because it refused the batch.
+pub fn is_outage(status: StatusCode) -> bool {
+    status.is_server_error()
+        || status == StatusCode::REQUEST_TIMEOUT
+        || status == StatusCode::TOO_MANY_REQUESTS
+}
+
+/// Breaker metrics of a monitor session in the Prometheus text format.
+pub fn prometheus(session_id: &str, status: &BreakerStatus) -> String {
+    let session = latency::label(session_id);
+    let mut out = String::new();
+    out.push_str("# HELP km_api_breaker_state Whether API uploads are closed (flowing), open (spooled) or half-open (probing).\n");
+    out.push_str("# TYPE km_api_breaker_state gauge\n");
+    for state in [
+        BreakerState::Closed,
+        BreakerState::Open,
+        BreakerState::HalfOpen,
+    ] {
+        out.push_str(&format!(
+            "km_api_breaker_state{{session=\"{}\",state=\"{}\"}} {}\n",
+            session,
+            state.as_str(),
+            u8::from(status.state == state)
+        ));
+    }
+    out.push_str("# HELP km_api_breaker_opened_total Times API uploads were stopped after repeated failures.\n");
+    out.push_str("# TYPE km_api_breaker_opened_total counter\n");
+    out.push_str(&format!(
+        "km_api_breaker_opened_total{{session=\"{}\"}} {}\n",
+        session, status.opened
+    ));
+    out.push_str(
+        "# HELP km_api_upload_failures Uploads that failed since the last one that succeeded.\n",
+    );
+    out.push_str("# TYPE km_api_upload_failures gauge\n");
+    out.push_str(&format!(
+        "km_api_upload_failures{{session=\"{}\"}} {}\n",
+        session, status.consecutive_failures
+    ));
+    out
+}
@@ -0,0 +1,60 @@
+//! What this km was built from, recorded by build.rs. Everything that
+//! reports km's version - `km version`, `--version`, the User-Agent of every
+//! request and the client metadata in event batches - reads it from here.
+
+use serde::Serialize;
+
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+/// Commit km was built from, or `unknown`
+pub const COMMIT: &str = env!("KM_GIT_COMMIT");
+/// `YYYY-MM-DD`, or `SOURCE_DATE_EPOCH`'s day for reproducible builds
+pub const DATE: &str = env!("KM_BUILD_DATE");
+/// Version of the Rust compiler, e.g. `1.82.0`
+pub const RUSTC: &str = env!("KM_RUSTC_VERSION");
+/// Target triple, e.g. `x86_64-unknown-linux-gnu`
+pub const TARGET: &str = env!("KM_BUILD_TARGET");
+
+/// `km --version`: `0.2.0 (3cbbcac1f0e2 2026-10-15)`
+pub const LONG_VERSION: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    " (",
+    env!("KM_GIT_COMMIT"),
+    " ",
+    env!("KM_BUILD_DATE"),
+    ")"
+);
+
+/// `km version --json`.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct BuildInfo {
+    pub version: &'static str,
+    pub commit: &'static str,
+    pub build_date: &'static str,
+    pub rustc: &'static str,
+    pub target: &'static str,
+    pub os: &'static str,
+    pub arch: &'static str,
+}
+
+pub fn info() -> BuildInfo {
+    BuildInfo {
+        version: VERSION,
+        commit: COMMIT,
+        build_date: DATE,
+        rustc: RUSTC,
+        target: TARGET,
+        os: std::env::consts::OS,
+        arch: std::env::consts::ARCH,
+    }
+}
+
+/// Sent with every HTTP request: `km/0.2.0 (3cbbcac1f0e2; linux/x86_64)`
+pub fn user_agent() -> String {
+    format!(
+        "km/{} ({}; {}/{})",
+        VERSION,
+        COMMIT,
+        std::env::consts::OS,
+        std::env::consts::ARCH
+    )
+}
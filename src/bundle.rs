@@ -0,0 +1,283 @@
+//! Config bundles, for setting up several machines the same way: `km
+//! config export --bundle` packs the config file (profiles included) and the
+//! installed risk rule packs into one gzipped tar, and `km config import`
+//! unpacks it on another machine.
+//!
+//! Secrets stay out of a bundle unless it's made with `--include-secrets`:
+//! API keys, alert Slack URLs, sink headers and any setting whose name says
+//! it holds a secret. The manifest lists what was withheld, and an import
+//! keeps those settings from the config it replaces.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use flate2::read::GzDecoder;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fs;
+use std::io::Read;
+use std::path::Path;
+
+use crate::build_info;
+use crate::config::{self, Config, CONFIG_VERSION};
+use crate::risk::rules::RulePack;
+use crate::server_env;
+
+/// `format` of every bundle's manifest
+pub const FORMAT: &str = "km-config-bundle";
+/// Version of the bundle layout this km writes
+pub const BUNDLE_VERSION: u32 = 1;
+
+const MANIFEST: &str = "manifest.json";
+const CONFIG: &str = "config.json";
+const RULES_DIR: &str = "rules/";
+
+/// Settings withheld wherever they appear, besides secret-named ones
+const SECRET_KEYS: &[&str] = &["api_key", "slack"];
+
+/// What a bundle holds, stored as `manifest.json`.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Manifest {
+    pub format: String,
+    pub version: u32,
+    /// Format version of the bundled config file
+    pub config_version: u32,
+    /// The km that made the bundle
+    pub km_version: String,
+    pub created_at: DateTime<Utc>,
+    #[serde(default)]
+    pub includes_secrets: bool,
+    /// JSON pointers of the settings left out, e.g. `/alerts/rules/0/slack`
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub withheld: Vec<String>,
+    /// Names of the bundled rule packs
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<String>,
+}
+
+/// A config file and rule packs on their way between machines.
+#[derive(Debug, Clone)]
+pub struct Bundle {
+    pub manifest: Manifest,
+    /// The config file as JSON, in the current format
+    pub config: Value,
+    pub rules: Vec<RulePack>,
+}
+
+impl Bundle {
+    /// Bundle `config` as it's written in the config file (with API keys
+    /// filled in when `include_secrets` is set) and the rule packs `rules`.
+    pub fn create(config: &Config, rules: Vec<RulePack>, include_secrets: bool) -> Result<Self> {
+        let mut value = serde_json::to_value(config).context("Failed to serialize config")?;
+        let withheld = if include_secrets {
+            Vec::new()
+        } else {
+            withhold_secrets(&mut value)
+        };
+        Ok(Self {
+            manifest: Manifest {
+                format: FORMAT.to_string(),
+                version: BUNDLE_VERSION,
+                config_version: CONFIG_VERSION,
+                km_version: build_info::VERSION.to_string(),
+                created_at: Utc::now(),
+                includes_secrets: include_secrets,
+                withheld,
+                rules: rules.iter().map(|pack| pack.name.clone()).collect(),
+            },
+            config: value,
+            rules,
+        })
+    }
+
+    /// Write the bundle to `path`. Bundles with secrets are only readable
+    /// by their owner.
+    pub fn write(&self, path: &Path) -> Result<()> {
+        let mut options = fs::OpenOptions::new();
+        options.write(true).create(true).truncate(true);
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::OpenOptionsExt;
+            if self.manifest.includes_secrets {
+                options.mode(0o600);
+            }
+        }
+        let file = options
+            .open(path)
+            .with_context(|| format!("Failed to create bundle {:?}", path))?;
+
+        let mut archive = tar::Builder::new(GzEncoder::new(file, Compression::default()));
+        let mut add = |name: &str, contents: Vec<u8>| -> Result<()> {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(contents.len() as u64);
+            header.set_mode(0o600);
+            header.set_mtime(self.manifest.created_at.timestamp().max(0) as u64);
+            header.set_cksum();
+            archive
+                .append_data(&mut header, name, contents.as_slice())
+                .with_context(|| format!("Failed to write {} to the bundle", name))
+        };
+        add(MANIFEST, serde_json::to_vec_pretty(&self.manifest)?)?;
+        add(CONFIG, serde_json::to_vec_pretty(&self.config)?)?;
+        for pack in &self.rules {
+            add(
+                &format!("{}{}.json", RULES_DIR, pack.name),
+                serde_json::to_vec_pretty(pack)?,
+            )?;
+        }
+        archive
+            .into_inner()
+            .and_then(|encoder| encoder.finish())
+            .with_context(|| format!("Failed to write bundle {:?}", path))?;
+        Ok(())
+    }
+
+    /// Read a bundle, migrating its config to the current format.
+    pub fn read(path: &Path) -> Result<Self> {
+        let file =
+            fs::File::open(path).with_context(|| format!("Failed to open bundle {:?}", path))?;
+        let mut archive = tar::Archive::new(GzDecoder::new(file));
+
+        let mut manifest = None;
+        let mut config = None;
+        let mut rules = Vec::new();
+        for entry in archive
+            .entries()
+            .with_context(|| format!("{:?} is not a km config bundle", path))?
+        {
+            let mut entry = entry.context("Failed to read bundle")?;
+            if !entry.header().entry_type().is_file() {
+                continue;
+            }
+            let name = entry.path()?.to_string_lossy().into_owned();
+            let mut contents = Vec::new();
+            entry
+                .read_to_end(&mut contents)
+                .with_context(|| format!("Failed to read {} from the bundle", name))?;
+            match name.as_str() {
+                MANIFEST => {
+                    manifest = Some(
+                        serde_json::from_slice::<Manifest>(&contents)
+                            .context("Invalid bundle manifest")?,
+                    )
+                }
+                CONFIG => {
+                    config = Some(
+                        serde_json::from_slice::<Value>(&contents)
+                            .context("Invalid config in the bundle")?,
+                    )
+                }
+                _ if name.starts_with(RULES_DIR) => {
+                    let text = String::from_utf8(contents)
+                        .with_context(|| format!("{} in the bundle is not UTF-8", name))?;
+                    rules
+                        .push(RulePack::parse(Path::new(&name), &text).with_context(|| {
+                            format!("Invalid rule pack {} in the bundle", name)
+                        })?);
+                }
+                _ => tracing::debug!("Ignoring {} in bundle {:?}", name, path),
+            }
+        }
+
+        let manifest = manifest
+            .filter(|manifest| manifest.format == FORMAT)
+            .with_context(|| format!("{:?} is not a km config bundle", path))?;
+        if manifest.version > BUNDLE_VERSION {
+            return Err(anyhow::anyhow!(
+                "Bundle {:?} was made by a newer km ({}); update km to import it",
+                path,
+                manifest.km_version
+            ));
+        }
+        let mut config = config.with_context(|| format!("Bundle {:?} has no config", path))?;
+        config::migrate(&mut config).context("Failed to migrate the bundled config")?;
+        Ok(Self {
+            manifest,
+            config,
+            rules,
+        })
+    }
+
+    /// The bundled config with the withheld settings taken from `local`
+    /// where it has them. Returns the pointers it couldn't fill.
+    pub fn config_for(&self, local: Option<&Config>) -> Result<(Config, Vec<String>)> {
+        let mut value = self.config.clone();
+        let local = local.map(serde_json::to_value).transpose()?;
+        let mut missing = Vec::new();
+        for pointer in &self.manifest.withheld {
+            let kept = local
+                .as_ref()
+                .and_then(|local| local.pointer(pointer))
+                .filter(|kept| !is_empty(kept));
+            match kept {
+                Some(kept) => insert_pointer(&mut value, pointer, kept.clone()),
+                None => missing.push(pointer.clone()),
+            }
+        }
+        // The file always spells out the API key, empty when it's in the
+        // credential store
+        if let Value::Object(ref mut object) = value {
+            object.entry("api_key").or_insert_with(|| Value::from(""));
+        }
+        let config = serde_json::from_value(value).context("Invalid config in the bundle")?;
+        Ok((config, missing))
+    }
+}
+
+/// Remove secrets from a config file's JSON. Returns where they were, as
+/// JSON pointers.
+pub fn withhold_secrets(value: &mut Value) -> Vec<String> {
+    let mut withheld = Vec::new();
+    withhold(value, "", false, &mut withheld);
+    withheld.sort();
+    withheld
+}
+
+fn withhold(value: &mut Value, pointer: &str, in_headers: bool, withheld: &mut Vec<String>) {
+    match value {
+        Value::Object(object) => {
+            let keys: Vec<String> = object.keys().cloned().collect();
+            for key in keys {
+                let path = format!("{}/{}", pointer, key.replace('~', "~0").replace('/', "~1"));
+                let secret = in_headers
+                    || SECRET_KEYS.contains(&key.as_str())
+                    || server_env::is_secret_name(&key);
+                if secret && object.get(&key).is_some_and(|v| !is_empty(v)) {
+                    object.remove(&key);
+                    withheld.push(path);
+                } else if let Some(child) = object.get_mut(&key) {
+                    withhold(child, &path, key == "headers", withheld);
+                }
+            }
+        }
+        Value::Array(items) => {
+            for (i, item) in items.iter_mut().enumerate() {
+                withhold(item, &format!("{}/{}", pointer, i), false, withheld);
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Unset, or a value that says nothing (an empty string, list or object)
+fn is_empty(value: &Value) -> bool {
+    match value {
+        Value::Null => true,
+        Value::String(s) => s.is_empty(),
+        Value::Array(items) => items.is_empty(),
+        Value::Object(object) => object.is_empty(),
+        _ => false,
+    }
+}
+
+/// Set the value at a JSON pointer whose parent exists.
+fn insert_pointer(value: &mut Value, pointer: &str, new_value: Value) {
+    let Some((parent, key)) = pointer.rsplit_once('/') else {
+        return;
+    };
+    let key = key.replace("~1", "/").replace("~0", "~");
+    if let Some(Value::Object(parent)) = value.pointer_mut(parent) {
+        parent.insert(key, new_value);
+    }
+}
@@ -0,0 +1,214 @@
+use anyhow::{Context, Result};
+use reqwest::StatusCode;
+use serde::Deserialize;
+use std::cmp::Ordering;
+use std::time::Duration;
+
+use crate::build_info;
+use crate::errors::{Code, KmError};
+use crate::plugins::compare_versions;
+use crate::rate_limit::RateLimit;
+use crate::schema::{EVENTS_JSON, EVENTS_PROTOBUF};
+
+/// Event batch formats this km can send, oldest first
+pub const EVENT_VERSIONS: &[u32] = &[EVENTS_JSON, EVENTS_PROTOBUF];
+/// Oldest server API version this km works with
+pub const MIN_API_VERSION: u32 = 1;
+/// Newest server API version this km works with
+pub const MAX_API_VERSION: u32 = 1;
+
+/// Feature flags a server may advertise
+pub const FEATURE_GZIP: &str = "gzip-uploads";
+pub const FEATURE_EVENT_BATCHES: &str = "event-batches";
+pub const FEATURE_RISK_SCORING: &str = "risk-scoring";
+
+/// Tried in order; the first that answers describes the server
+const DISCOVERY_PATHS: &[&str] = &["/api/version", "/.well-known/kilometers"];
+const DISCOVERY_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// What a Kilometers API says about itself at `/api/version` or
+/// `/.well-known/kilometers`.
+#[derive(Debug, Clone, PartialEq, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ServerInfo {
+    pub api_version: u32,
+    #[serde(default)]
+    pub server_version: Option<String>,
+    /// Oldest km release the server accepts
+    #[serde(default)]
+    pub min_client_version: Option<String>,
+    /// Event batch formats the server accepts
+    #[serde(default = "default_event_versions")]
+    pub event_versions: Vec<u32>,
+    /// Optional features; servers that don't list any support all of them
+    #[serde(default)]
+    pub features: Option<Vec<String>>,
+    /// Base URL of the API when it isn't served from the configured URL,
+    /// e.g. a self-hosted install behind a path prefix
+    #[serde(default)]
+    pub api_url: Option<String>,
+    /// Requests each client may send; km paces its uploads to stay under it
+    #[serde(default)]
+    pub rate_limit: Option<RateLimit>,
+}
+
+fn default_event_versions() -> Vec<u32> {
+    vec![1]
+}
+
+/// What km and the server agreed on. The default describes servers that
+/// predate version discovery.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Capabilities {
+    pub server_version: Option<String>,
+    /// Event batch format sent with uploads
+    pub event_version: u32,
+    pub gzip_uploads: bool,
+    pub event_batches: bool,
+    pub risk_scoring: bool,
+    /// Where the API actually lives, if the server said so
+    pub api_url: Option<String>,
+    /// The server's request budget, if it set one
+    pub rate_limit: Option<RateLimit>,
+}
+
+impl Default for Capabilities {
+    fn default() -> Self {
+        Self {
+            server_version: None,
+            event_version: EVENT_VERSIONS[0],
+            gzip_uploads: true,
+            event_batches: true,
+            risk_scoring: true,
+            api_url: None,
+            rate_limit: None,
+        }
+    }
+}
+
+impl Capabilities {
+    /// Settle on formats and features both sides understand, or explain why
+    /// this km can't talk to the server.
+    pub fn negotiate(info: &ServerInfo) -> Result<Self> {
+        let server = info.server_version.as_deref().unwrap_or("unknown version");
+        let client = build_info::VERSION;
+
+        if let Some(ref min) = info.min_client_version {
+            if compare_versions(client, min) == Ordering::Less {
+                return Err(anyhow::anyhow!(
+                    "The Kilometers API ({}) needs km {} or newer; this is km {}. Upgrade km to continue",
+                    server,
+                    min,
+                    client
+                ));
+            }
+        }
+        if info.api_version < MIN_API_VERSION {
+            return Err(anyhow::anyhow!(
+                "The Kilometers API ({}) speaks API version {}, older than the {} this km needs. Upgrade the server or use an older km",
+                server,
+                info.api_version,
+                MIN_API_VERSION
+            ));
+        }
+        if info.api_version > MAX_API_VERSION {
+            return Err(anyhow::anyhow!(
+                "The Kilometers API ({}) speaks API version {}, newer than the {} this km supports. Upgrade km to continue",
+                server,
+                info.api_version,
+                MAX_API_VERSION
+            ));
+        }
+
+        let event_version = EVENT_VERSIONS
+            .iter()
+            .rev()
+            .find(|v| info.event_versions.contains(v))
+            .copied()
+            .ok_or_else(|| {
+                anyhow::anyhow!(
+                    "The Kilometers API ({}) accepts event formats {:?} but this km sends {:?}",
+                    server,
+                    info.event_versions,
+                    EVENT_VERSIONS
+                )
+            })?;
+
+        let has = |feature: &str| {
+            info.features
+                .as_ref()
+                .is_none_or(|features| features.iter().any(|f| f == feature))
+        };
+
+        Ok(Self {
+            server_version: info.server_version.clone(),
+            event_version,
+            gzip_uploads: has(FEATURE_GZIP),
+            event_batches: has(FEATURE_EVENT_BATCHES),
+            risk_scoring: has(FEATURE_RISK_SCORING),
+            api_url: info
+                .api_url
+                .as_deref()
+                .filter(|url| !url.is_empty())
+                .map(|url| url.trim_end_matches('/').to_string()),
+            rate_limit: info.rate_limit,
+        })
+    }
+
+    /// Ask the server at `api_url` to describe itself. `None` means neither
+    /// discovery path exists, i.e. a server from before version discovery.
+    pub async fn discover(api_url: &str) -> Result<Option<ServerInfo>> {
+        crate::offline::ensure_online("Asking the API what it supports")?;
+        let client = crate::http::client_builder()
+            .timeout(DISCOVERY_TIMEOUT)
+            .build()
+            .unwrap_or_else(|_| reqwest::Client::new());
+
+        for path in DISCOVERY_PATHS {
+            let url = format!("{}{}", api_url.trim_end_matches('/'), path);
+            let response = client
+                .get(&url)
+                .send()
+                .await
+                .with_context(|| format!("Failed to reach {}", url))?;
+            match response.status() {
+                StatusCode::NOT_FOUND | StatusCode::METHOD_NOT_ALLOWED => continue,
+                status if !status.is_success() => {
+                    return Err(KmError::new(
+                        Code::for_status(status),
+                        format!("{} answered with status {}", url, status),
+                    )
+                    .into())
+                }
+                _ => {}
+            }
+            let info = response
+                .json::<ServerInfo>()
+                .await
+                .with_context(|| format!("{} is not a Kilometers API version document", url))?;
+            return Ok(Some(info));
+        }
+        Ok(None)
+    }
+
+    /// Discover and negotiate with the server at `api_url`. Servers that
+    /// can't be reached are assumed compatible so a flaky network doesn't
+    /// stop monitoring; an incompatible server is an error.
+    pub async fn detect(api_url: &str) -> Result<Self> {
+        match Self::discover(api_url).await {
+            Ok(Some(info)) => {
+                let capabilities = Self::negotiate(&info)?;
+                tracing::debug!("Negotiated with {}: {:?}", api_url, capabilities);
+                Ok(capabilities)
+            }
+            Ok(None) => {
+                tracing::debug!("{} has no version endpoint; assuming defaults", api_url);
+                Ok(Self::default())
+            }
+            Err(e) => {
+                tracing::warn!("Could not check the API version: {:#}", e);
+                Ok(Self::default())
+            }
+        }
+    }
+}
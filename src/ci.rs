@@ -0,0 +1,179 @@
+//! `km monitor --ci`: count what a session did once the server exits and fail
+//! the job when a `--fail-on` threshold is reached, so an agent test suite
+//! run under km breaks the build instead of passing quietly.
+
+use clap::ValueEnum;
+use serde::Serialize;
+use std::fmt;
+
+use crate::report::{FindingKind, SessionReport};
+use crate::risk::RiskLevel;
+
+/// What a `--fail-on` threshold counts.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, ValueEnum)]
+#[serde(rename_all = "kebab-case")]
+pub enum CiMetric {
+    /// Requests scored high or critical risk
+    HighRisk,
+    /// Requests scored critical risk
+    CriticalRisk,
+    /// Error responses
+    Errors,
+    /// Messages a policy rule or the policy bundle denied
+    PolicyViolations,
+    /// Requests of any kind
+    Requests,
+}
+
+impl CiMetric {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            CiMetric::HighRisk => "high-risk",
+            CiMetric::CriticalRisk => "critical-risk",
+            CiMetric::Errors => "errors",
+            CiMetric::PolicyViolations => "policy-violations",
+            CiMetric::Requests => "requests",
+        }
+    }
+}
+
+/// One `--fail-on` entry: the job fails once `metric` reaches `at_least`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Threshold {
+    pub metric: CiMetric,
+    pub at_least: u64,
+}
+
+impl fmt::Display for Threshold {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}>={}", self.metric.as_str(), self.at_least)
+    }
+}
+
+impl Serialize for Threshold {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.collect_str(self)
+    }
+}
+
+/// Parse a threshold such as `high-risk>=1` or `errors>4`.
+pub fn parse_threshold(value: &str) -> std::result::Result<Threshold, String> {
+    let (name, op, count) = [">=", ">"]
+        .iter()
+        .find_map(|op| {
+            let (name, count) = value.split_once(op)?;
+            Some((name.trim(), *op, count.trim()))
+        })
+        .ok_or_else(|| format!("'{}' is not a threshold like errors>=5", value))?;
+    let metric = CiMetric::from_str(name, true).map_err(|_| {
+        let names: Vec<&str> = CiMetric::value_variants()
+            .iter()
+            .map(|m| m.as_str())
+            .collect();
+        format!("Unknown metric '{}'; use one of {}", name, names.join(", "))
+    })?;
+    let count: u64 = count
+        .parse()
+        .map_err(|_| format!("'{}' in '{}' is not a count", count, value))?;
+    let at_least = if op == ">" { count + 1 } else { count };
+    Ok(Threshold { metric, at_least })
+}
+
+/// What a session did, as the thresholds count it.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct CiCounts {
+    pub requests: u64,
+    pub errors: u64,
+    pub high_risk: u64,
+    pub critical_risk: u64,
+    pub policy_violations: u64,
+}
+
+impl CiCounts {
+    /// Count a session from its report.
+    pub fn of_report(report: &SessionReport) -> Self {
+        let risk = |level: RiskLevel| report.risk.get(&level).copied().unwrap_or(0);
+        Self {
+            requests: report.session.requests,
+            errors: report.session.errors,
+            high_risk: risk(RiskLevel::High) + risk(RiskLevel::Critical),
+            critical_risk: risk(RiskLevel::Critical),
+            policy_violations: report
+                .findings
+                .iter()
+                .filter(|f| f.kind == FindingKind::PolicyViolation)
+                .count() as u64,
+        }
+    }
+
+    pub fn get(&self, metric: CiMetric) -> u64 {
+        match metric {
+            CiMetric::HighRisk => self.high_risk,
+            CiMetric::CriticalRisk => self.critical_risk,
+            CiMetric::Errors => self.errors,
+            CiMetric::PolicyViolations => self.policy_violations,
+            CiMetric::Requests => self.requests,
+        }
+    }
+}
+
+/// A threshold the session reached.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Violation {
+    pub threshold: Threshold,
+    pub actual: u64,
+}
+
+/// The summary `km monitor --ci` prints when the session ends.
+#[derive(Debug, Clone, Serialize)]
+pub struct CiSummary {
+    pub session_id: String,
+    pub passed: bool,
+    pub counts: CiCounts,
+    pub thresholds: Vec<Threshold>,
+    pub violations: Vec<Violation>,
+}
+
+impl CiSummary {
+    pub fn evaluate(session_id: &str, counts: CiCounts, thresholds: &[Threshold]) -> Self {
+        let violations: Vec<Violation> = thresholds
+            .iter()
+            .filter_map(|threshold| {
+                let actual = counts.get(threshold.metric);
+                (actual >= threshold.at_least).then_some(Violation {
+                    threshold: *threshold,
+                    actual,
+                })
+            })
+            .collect();
+        Self {
+            session_id: session_id.to_string(),
+            passed: violations.is_empty(),
+            counts,
+            thresholds: thresholds.to_vec(),
+            violations,
+        }
+    }
+
+    /// The thresholds reached, as `high-risk>=1 (was 3), errors>=5 (was 7)`.
+    pub fn reached(&self) -> String {
+        let reached: Vec<String> = self
+            .violations
+            .iter()
+            .map(|v| format!("{} (was {})", v.threshold, v.actual))
+            .collect();
+        reached.join(", ")
+    }
+
+    /// The error the job fails with.
+    pub fn failure(&self) -> Option<String> {
+        (!self.passed).then(|| {
+            format!(
+                "Session {} reached its CI thresholds: {}",
+                self.session_id,
+                self.reached()
+            )
+        })
+    }
+}
@@ -1,8 +1,23 @@
-use clap::{Parser, Subcommand};
+use clap::{Args, Parser, Subcommand};
 use std::path::PathBuf;
 
+use crate::build_info;
+use crate::ci::{self, Threshold};
+use crate::clients::ClientKind;
+use crate::completion::{Shell, ValueKind};
+use crate::errors::{Code, ErrorFormat};
+use crate::export::ExportFormat;
+use crate::framing::Framing;
+use crate::plugins::health::FailurePolicy;
+use crate::probe::{self, ProbeCall};
+use crate::replay;
+use crate::report::ReportFormat;
+use crate::traffic;
+use crate::update::Channel;
+
 #[derive(Parser, Debug)]
 #[command(name = "km")]
+#[command(long_version = build_info::LONG_VERSION)]
 #[command(author, version, about = "Official Kilometers CLI proxy for MCP servers", long_about = None)]
 pub struct Cli {
     /// Verbose mode (-v, -vv, -vvv)
@@ -13,6 +28,18 @@ pub struct Cli {
     #[arg(short, long, default_value = "km_config.json")]
     pub config: PathBuf,
 
+    /// Settings profile from the config file to use (or set KM_PROFILE)
+    #[arg(long, global = true)]
+    pub profile: Option<String>,
+
+    /// How failures are printed: text, or JSON with a stable error code for scripts
+    #[arg(long, global = true, value_enum, default_value_t = ErrorFormat::Text)]
+    pub error_format: ErrorFormat,
+
+    /// Air-gapped mode: no API calls, plugin downloads or update checks (or set KM_OFFLINE)
+    #[arg(long, global = true)]
+    pub offline: bool,
+
     #[command(subcommand)]
     pub command: Commands,
 }
@@ -30,10 +57,59 @@ pub enum Commands {
         api_url: String,
     },
 
+    /// Sign in to Kilometers.ai in the browser (device-code flow)
+    Login {
+        /// API base URL, when there is no config file yet
+        #[arg(long, default_value = "https://api.kilometers.ai")]
+        api_url: String,
+
+        /// Print the sign-in link without opening a browser
+        #[arg(long)]
+        no_browser: bool,
+    },
+
+    /// Sign out: revoke the stored tokens and remove them from the keyring
+    Logout,
+
+    /// Route an MCP client's servers through `km monitor` by editing its config
+    Integrate {
+        #[command(flatten)]
+        target: IntegrateArgs,
+    },
+
+    /// Undo `km integrate`, restoring the client's original server commands
+    Unintegrate {
+        #[command(flatten)]
+        target: IntegrateArgs,
+    },
+
+    /// Update km to the latest release
+    Update {
+        /// Only report whether an update is available; exits non-zero if one is
+        #[arg(long)]
+        check: bool,
+
+        /// Release channel (defaults to update_channel in the config)
+        #[arg(long, value_enum)]
+        channel: Option<Channel>,
+    },
+
+    /// Show the version, commit and build of km, and whether a newer release is out
+    Version {
+        /// Print as JSON
+        #[arg(long)]
+        json: bool,
+    },
+
     /// Monitor and proxy MCP requests
     Monitor {
-        /// Command and arguments to proxy (everything after --)
-        #[arg(trailing_var_arg = true, allow_hyphen_values = true, required = true)]
+        /// Command and arguments to proxy (everything after --); with
+        /// --docker, the arguments for the image
+        #[arg(
+            trailing_var_arg = true,
+            allow_hyphen_values = true,
+            required_unless_present = "docker"
+        )]
         args: Vec<String>,
 
         /// Skip risk analysis filters (local logging only)
@@ -47,6 +123,9 @@ pub enum Commands {
         /// Log file for MCP traffic
         #[arg(long, default_value = "mcp_traffic.jsonl")]
         log_file: PathBuf,
+
+        #[command(flatten)]
+        options: MonitorOptions,
     },
 
     /// Clear all logs
@@ -56,11 +135,14 @@ pub enum Commands {
         include_config: bool,
     },
 
-    /// Show current configuration
+    /// Show current configuration, or read and change settings
     Config {
         /// Show API key (hidden by default)
-        #[arg(long)]
+        #[arg(long, global = true)]
         show_secrets: bool,
+
+        #[command(subcommand)]
+        command: Option<ConfigCommands>,
     },
 
     /// Analyze log files
@@ -90,10 +172,924 @@ pub enum Commands {
         lines: Option<usize>,
     },
 
-    /// Diagnostic commands for troubleshooting
+    /// Export captured MCP traffic to JSONL, CSV, or Parquet
+    Export {
+        /// Traffic log to export from
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Output file, or - for stdout
+        #[arg(short, long)]
+        output: PathBuf,
+
+        /// Output format (inferred from the output extension if omitted)
+        #[arg(long, value_enum)]
+        format: Option<ExportFormat>,
+
+        #[command(flatten)]
+        options: ExportOptions,
+    },
+
+    /// Merge the captures of a run on several machines into one timeline
+    Merge {
+        /// Traffic logs or `km export` JSON lines files
+        #[arg(required = true)]
+        inputs: Vec<PathBuf>,
+
+        /// Merged traffic log, or - for stdout
+        #[arg(short, long)]
+        output: PathBuf,
+
+        /// Only events from sessions started with this --run-id
+        #[arg(long, value_name = "ID")]
+        run_id: Option<String>,
+
+        /// Put every event in this session, keeping its own id in the source.session label
+        #[arg(long, value_name = "ID")]
+        session: Option<String>,
+    },
+
+    /// Search captured traffic with a query such as
+    /// 'method:tools/call AND risk>=high AND payload~"DROP TABLE"'
+    Search {
+        /// Query: field:value terms (method, direction, risk, time, since,
+        /// until, payload, session, label) joined by AND, OR, NOT and
+        /// parentheses; bare words search payloads
+        query: String,
+
+        /// Traffic log to search
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Print matching events as JSON lines
+        #[arg(long)]
+        json: bool,
+
+        /// Show at most N matches (the most recent ones)
+        #[arg(short = 'n', long)]
+        limit: Option<usize>,
+    },
+
+    /// Stream the events of a running `km monitor` session as they happen
+    Tail {
+        /// Session id, or a unique prefix of it (defaults to the most recent running session)
+        session: Option<String>,
+
+        /// Print events as JSON lines, e.g. for piping into jq
+        #[arg(long)]
+        json: bool,
+    },
+
+    /// Control a running `km monitor` session
+    Ctl {
+        /// Session id, or a unique prefix of it (defaults to the most recent running session)
+        #[arg(long, global = true)]
+        session: Option<String>,
+
+        /// Print results as JSON (events as JSON lines)
+        #[arg(long, global = true)]
+        json: bool,
+
+        #[command(subcommand)]
+        command: CtlCommands,
+    },
+
+    /// Replay captured MCP traffic, optionally against a live server
+    Replay {
+        /// Traffic log to replay from
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Session to replay (defaults to the most recent session)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Playback speed multiplier
+        #[arg(long, default_value_t = 1.0, value_parser = replay::parse_speed)]
+        speed: f64,
+
+        /// Replay messages back to back, ignoring their recorded timing
+        #[arg(long, conflicts_with = "speed")]
+        no_delay: bool,
+
+        /// Seconds to wait for each response from the live server
+        #[arg(long, default_value_t = 30)]
+        timeout: u64,
+
+        /// Server command to replay against (everything after --)
+        #[arg(trailing_var_arg = true, allow_hyphen_values = true)]
+        target: Vec<String>,
+    },
+
+    /// Act as an MCP client to test a server's protocol support and performance
+    Probe {
+        /// Tool to call, with JSON arguments (repeatable; calls rotate through the list)
+        #[arg(long = "call", value_name = "TOOL[=JSON]", value_parser = probe::parse_call)]
+        calls: Vec<ProbeCall>,
+
+        /// Tool calls to start per second (0 waits for each response before the next call)
+        #[arg(long, default_value_t = 0.0)]
+        rate: f64,
+
+        /// Number of tool calls to make (defaults to each --call once)
+        #[arg(long, conflicts_with = "duration")]
+        count: Option<u64>,
+
+        /// Keep calling tools for this many seconds
+        #[arg(long)]
+        duration: Option<u64>,
+
+        /// Seconds to wait for each response
+        #[arg(long, default_value_t = 30)]
+        timeout: u64,
+
+        /// Append the probe's traffic to this log as a session
+        #[arg(long, value_name = "FILE")]
+        log_file: Option<PathBuf>,
+
+        /// Print the results as JSON
+        #[arg(long)]
+        json: bool,
+
+        /// Server command to probe (everything after --)
+        #[arg(trailing_var_arg = true, allow_hyphen_values = true, required = true)]
+        target: Vec<String>,
+    },
+
+    /// Serve recorded responses as a stdio MCP server, for offline clients
+    Mock {
+        /// Traffic log to serve responses from
+        #[arg(long, value_name = "FILE")]
+        from: PathBuf,
+
+        /// Only serve responses from this session (id or unique prefix)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Only answer requests whose params match a recording exactly
+        #[arg(long)]
+        strict: bool,
+    },
+
+    /// Live terminal dashboard for a monitored session
+    Dashboard {
+        /// Traffic log written by `km monitor`
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Session to watch (defaults to the most recent session)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Print a single snapshot and exit instead of opening the TUI
+        #[arg(long)]
+        once: bool,
+    },
+
+    /// Browse sessions recorded in a traffic log
+    Sessions {
+        /// Traffic log written by `km monitor`
+        #[arg(short, long, default_value = "mcp_traffic.jsonl", global = true)]
+        file: PathBuf,
+
+        /// Print JSON instead of a table
+        #[arg(long, global = true)]
+        json: bool,
+
+        #[command(subcommand)]
+        command: SessionsCommands,
+    },
+
+    /// Step through the messages of a session interactively
+    Inspect {
+        /// Session id, or a unique prefix of it
+        id: String,
+
+        /// Traffic log written by `km monitor`
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Write event N (as numbered in the inspector) to a JSON file and exit
+        #[arg(long, value_name = "N")]
+        export: Option<usize>,
+    },
+
+    /// Compare two sessions to spot changes in agent behavior
+    Diff {
+        /// Baseline session id, or a unique prefix of it
+        a: String,
+
+        /// Session to compare with the baseline
+        b: String,
+
+        /// Traffic log written by `km monitor`
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Traffic log holding session B, when it isn't in --file
+        #[arg(long, value_name = "FILE")]
+        b_file: Option<PathBuf>,
+
+        /// Print JSON instead of a table
+        #[arg(long)]
+        json: bool,
+    },
+
+    /// Tools the monitored servers offered, and how they changed between sessions
+    Tools {
+        #[command(subcommand)]
+        command: ToolsCommands,
+    },
+
+    /// Write a shareable summary of a session as HTML or Markdown
+    Report {
+        /// Session id, or a unique prefix of it
+        id: String,
+
+        /// Traffic log written by `km monitor`
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Report format (inferred from the output extension if omitted, otherwise Markdown)
+        #[arg(long, value_enum)]
+        format: Option<ReportFormat>,
+
+        /// Write the report to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+
+    /// Upload events that were spooled while the API was unreachable
+    Flush,
+
+    /// Show the signed-in account, its plan and the features it includes
+    Status {
+        /// Print the status as JSON
+        #[arg(long)]
+        json: bool,
+
+        /// Ask the API again instead of using the cached feature list
+        #[arg(long)]
+        refresh: bool,
+
+        /// Show the upload circuit breaker and retry settings of running sessions
+        #[arg(long, conflicts_with = "refresh")]
+        api: bool,
+    },
+
+    /// Show and reclaim the disk space used by captured traffic
+    Storage {
+        /// Traffic log written by `km monitor`
+        #[arg(short, long, default_value = "mcp_traffic.jsonl", global = true)]
+        file: PathBuf,
+
+        /// Print JSON instead of a table
+        #[arg(long, global = true)]
+        json: bool,
+
+        #[command(subcommand)]
+        command: StorageCommands,
+    },
+
+    /// Export and check the tamper-evident log of allow, block and redact decisions
+    Audit {
+        #[command(subcommand)]
+        command: AuditCommands,
+    },
+
+    /// Turn anonymous usage statistics on or off (off unless turned on)
+    Telemetry {
+        #[command(subcommand)]
+        command: TelemetryCommands,
+    },
+
+    /// Find, install and update plugins
+    Plugins {
+        #[command(subcommand)]
+        command: PluginCommands,
+    },
+
+    /// Check the config, API connection, plugins and environment for problems
     Doctor {
+        /// Also check that this MCP server executable can be found
+        #[arg(long)]
+        server: Option<String>,
+
+        #[command(subcommand)]
+        command: Option<DoctorCommands>,
+    },
+
+    /// Check requests against the configured policies
+    Policy {
+        #[command(subcommand)]
+        command: PolicyCommands,
+    },
+
+    /// Capture presets for `km monitor --preset`
+    Presets {
+        #[command(subcommand)]
+        command: PresetsCommands,
+    },
+
+    /// Manage risk rule packs
+    Rules {
+        #[command(subcommand)]
+        command: RulesCommands,
+    },
+
+    /// Explain an error code from a failed command, or list them all
+    Explain {
+        /// Error code, e.g. CONFIG_NOT_FOUND
+        #[arg(value_enum, ignore_case = true)]
+        code: Option<Code>,
+    },
+
+    /// Print a shell completion script (e.g. `km completion bash > /etc/bash_completion.d/km`)
+    Completion {
+        /// Shell to generate the script for
+        #[arg(value_enum)]
+        shell: Shell,
+    },
+
+    /// Generate reference documentation
+    Docs {
         #[command(subcommand)]
-        command: DoctorCommands,
+        command: DocsCommands,
+    },
+
+    /// Print completion candidates; used by the completion scripts
+    #[command(name = "__complete", hide = true)]
+    CompleteValues {
+        #[arg(value_enum)]
+        kind: ValueKind,
+
+        /// Traffic log to read session ids from
+        #[arg(long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+    },
+
+    /// A subcommand provided by an installed plugin
+    #[command(external_subcommand)]
+    Plugin(Vec<String>),
+}
+
+#[derive(Subcommand, Debug)]
+pub enum ConfigCommands {
+    /// Print the value of a setting
+    Get {
+        /// Setting name (e.g. batch_size, redaction.enabled)
+        key: String,
+    },
+    /// Change a setting and save the config file
+    Set {
+        /// Setting name
+        key: String,
+        /// New value (an empty string clears optional settings)
+        value: String,
+    },
+    /// List all settings, including defaults
+    List,
+    /// Check the config file for invalid values
+    Validate,
+    /// Print the JSON Schema of the config file, for completion and checks in editors
+    Schema {
+        /// Write the schema to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+    /// List the profiles in the config file (* marks the selected one)
+    Profiles,
+    /// Bundle the config file, its profiles and the installed risk rule packs for another machine
+    Export {
+        /// Bundle file to write, e.g. team.kmz
+        #[arg(long, value_name = "PATH")]
+        bundle: PathBuf,
+
+        /// Include API keys and other secrets (keep the bundle private)
+        #[arg(long)]
+        include_secrets: bool,
+    },
+    /// Set up this machine from a bundle made with `km config export`
+    Import {
+        /// Bundle file to read
+        bundle: PathBuf,
+
+        /// Replace an existing config file; secrets left out of the bundle are kept
+        #[arg(long)]
+        force: bool,
+    },
+    /// Show where each setting comes from: default, remote layer, config file, profile or environment
+    Source {
+        /// Only show this setting
+        key: Option<String>,
+
+        /// Fetch the remote config layer first
+        #[arg(long)]
+        refresh: bool,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+pub enum PluginCommands {
+    /// Search the plugin marketplace
+    Search {
+        /// Text to match against plugin names and descriptions (lists everything if omitted)
+        query: Option<String>,
+    },
+    /// Install a plugin; `name@version` pins it to that version
+    Install {
+        /// Plugin name, optionally with @version
+        spec: String,
+
+        /// Install even without a signature from a trusted key (development only)
+        #[arg(long)]
+        allow_unsigned: bool,
+    },
+    /// Update installed plugins to their latest version (pinned plugins are skipped)
+    Update {
+        /// Only update this plugin
+        name: Option<String>,
+
+        /// Accept releases without a signature from a trusted key (development only)
+        #[arg(long)]
+        allow_unsigned: bool,
+    },
+    /// Uninstall a plugin and drop its version pin
+    Remove {
+        /// Plugin name
+        name: String,
+    },
+    /// Show the order plugins run in, or set a plugin's priority
+    Order {
+        /// Plugin to reprioritize
+        #[arg(requires = "priority")]
+        name: Option<String>,
+
+        /// Higher runs earlier; 0 is the default
+        #[arg(allow_negative_numbers = true)]
+        priority: Option<i32>,
+    },
+    /// List installed plugins
+    List {
+        /// Only show plugins with a newer version in the marketplace
+        #[arg(long)]
+        outdated: bool,
+    },
+    /// List the subcommands installed plugins add to km
+    Commands,
+    /// Show whether a running session's plugins are healthy, restarting or stopped
+    Status {
+        /// Session id, or a unique prefix of it (defaults to the most recent running session)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Print JSON instead of a table
+        #[arg(long)]
+        json: bool,
+    },
+    /// Set whether requests flow on (open) or are blocked (closed) while a plugin is down
+    OnFailure {
+        /// Plugin name
+        name: String,
+
+        #[arg(value_enum)]
+        policy: FailurePolicy,
+    },
+    /// Show or change a plugin's settings, checked against its schema
+    Config {
+        /// Plugin name
+        name: String,
+
+        /// Setting to show or change (shows all settings if omitted)
+        key: Option<String>,
+
+        /// New value: JSON, or else taken as a string
+        value: Option<String>,
+
+        /// Remove the setting
+        #[arg(long, requires = "key", conflicts_with = "value")]
+        unset: bool,
+    },
+    #[command(flatten)]
+    Develop(PluginDevCommands),
+}
+
+/// `km plugins` commands for writing plugins; these need neither an
+/// account nor an installed plugin.
+#[derive(Subcommand, Debug, PartialEq)]
+pub enum PluginDevCommands {
+    /// Start a new plugin: a Go skeleton, or a Rust crate built to Wasm
+    Scaffold {
+        /// Plugin name
+        name: String,
+
+        /// Generate a WebAssembly plugin instead of a native Go one
+        #[arg(long)]
+        wasm: bool,
+
+        /// Directory to create (defaults to the plugin name)
+        #[arg(long)]
+        dir: Option<PathBuf>,
+    },
+    /// Build a plugin and run it against a captured session, again whenever its sources change
+    Dev {
+        /// Plugin source directory, with its km-plugin.json
+        #[arg(default_value = ".")]
+        dir: PathBuf,
+
+        /// Traffic log to replay
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Session to replay (defaults to the most recent session)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Run once instead of watching for changes
+        #[arg(long)]
+        once: bool,
+    },
+    /// Build a plugin and check its decisions on a captured session against expectations
+    Test {
+        /// Plugin source directory, with its km-plugin.json
+        #[arg(default_value = ".")]
+        dir: PathBuf,
+
+        /// Traffic log to replay
+        #[arg(short, long, default_value = "mcp_traffic.jsonl")]
+        file: PathBuf,
+
+        /// Session to replay (defaults to the most recent session)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Expectations, one JSON object per line (relative to the plugin directory)
+        #[arg(long, default_value = "expect.jsonl")]
+        expect: PathBuf,
+
+        /// Use the existing build instead of building first
+        #[arg(long)]
+        no_build: bool,
+    },
+}
+
+#[derive(Subcommand, Debug, PartialEq)]
+pub enum CtlCommands {
+    /// List the running sessions
+    List,
+
+    /// Show what a session is doing: traffic counts, filters, plugins, upload queues
+    Status {
+        /// Also show response latency percentiles by method
+        #[arg(long)]
+        verbose: bool,
+    },
+
+    /// Upload buffered events and spooled batches now
+    Flush,
+
+    /// Change which messages are captured, until the config file next changes
+    Filters {
+        /// Only capture methods matching this pattern (repeatable, e.g. tools/*)
+        #[arg(long = "method", value_name = "PATTERN")]
+        methods: Vec<String>,
+
+        /// Capture every method again
+        #[arg(long, conflicts_with = "methods")]
+        all_methods: bool,
+
+        /// Leave payloads larger than this out of uploaded events (0 for no limit)
+        #[arg(long, value_name = "BYTES")]
+        payload_size_limit: Option<usize>,
+    },
+
+    /// Restart the session's plugins, picking up new installs and settings
+    ReloadPlugins,
+
+    /// Stream the session's events, like `km tail`
+    Events,
+
+    /// List requests held for approval (`km monitor --confirm`)
+    Pending,
+
+    /// Let a held request through
+    Approve {
+        /// Request number shown in the prompt and by `km ctl pending`
+        id: u64,
+    },
+
+    /// Refuse a held request; the client gets an error
+    Deny {
+        /// Request number shown in the prompt and by `km ctl pending`
+        id: u64,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+pub enum SessionsCommands {
+    /// List sessions, most recent first
+    List {
+        /// Only sessions active at or after this time (RFC 3339, YYYY-MM-DD, or 24h)
+        #[arg(long)]
+        since: Option<String>,
+
+        /// Show at most this many sessions
+        #[arg(short = 'n', long)]
+        limit: Option<usize>,
+
+        /// Only sessions with this label (repeatable; all must match)
+        #[arg(long = "label", value_name = "KEY=VALUE", value_parser = traffic::parse_label)]
+        labels: Vec<(String, String)>,
+    },
+
+    /// Summarize one session
+    Show {
+        /// Session id, or a unique prefix of it
+        id: String,
+    },
+
+    /// List the messages of one session
+    Events {
+        /// Session id, or a unique prefix of it
+        id: String,
+
+        /// Only messages whose method matches this pattern (e.g. tools/*)
+        #[arg(short, long)]
+        method: Option<String>,
+    },
+
+    /// Finalize sessions a killed km left behind and spool their unsent events
+    Recover {
+        /// List interrupted sessions without recovering them
+        #[arg(long)]
+        dry_run: bool,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+pub enum StorageCommands {
+    /// Disk used by each session and by km's other data
+    Usage,
+
+    /// Remove the oldest sessions and blobs beyond the retention limits
+    Prune {
+        /// Remove sessions and blobs last active more than this many days ago
+        #[arg(long)]
+        max_age_days: Option<u64>,
+
+        /// Remove the oldest sessions until the traffic log fits in this many MB
+        #[arg(long)]
+        max_size_mb: Option<u64>,
+
+        /// Keep only this many of the most recent sessions
+        #[arg(long)]
+        max_sessions: Option<usize>,
+
+        /// Show what would be removed without removing anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+pub enum AuditCommands {
+    /// Write logged decisions as JSONL for compliance evidence, after checking their hash chains
+    Export {
+        /// Only decisions of this session (id, or a prefix of it)
+        #[arg(long)]
+        session: Option<String>,
+
+        /// Only decisions made at or after this time (RFC 3339, YYYY-MM-DD, or 24h)
+        #[arg(long)]
+        since: Option<String>,
+
+        /// Output file, or - for stdout
+        #[arg(short, long, default_value = "-")]
+        output: PathBuf,
+    },
+
+    /// Check the hash chains of the decision logs, or of an exported file
+    Verify {
+        /// Exported file to check instead of the decision logs
+        file: Option<PathBuf>,
+
+        /// The file is an export made with --since: its sessions may start mid-chain
+        #[arg(long, requires = "file")]
+        since_export: bool,
+
+        /// Print JSON instead of a table
+        #[arg(long)]
+        json: bool,
+    },
+}
+
+#[derive(Subcommand, Debug, PartialEq)]
+pub enum TelemetryCommands {
+    /// Send anonymous usage statistics: command names, error kinds and timings
+    On,
+    /// Stop sending usage statistics and delete any not yet sent
+    Off,
+    /// Show whether statistics are sent, what is queued and every field recorded
+    Status,
+}
+
+#[derive(Subcommand, Debug)]
+pub enum PolicyCommands {
+    /// Show what the policies would do with requests, without running a server
+    Test {
+        /// A JSON-RPC request (reads one per line from stdin if neither this nor --file is given)
+        message: Option<String>,
+
+        /// Read requests from a file, one per line; `km monitor` traffic logs work too
+        #[arg(short, long, conflicts_with = "message")]
+        file: Option<PathBuf>,
+
+        /// Also evaluate the requests against this OPA bundle
+        #[arg(long, value_name = "PATH")]
+        bundle: Option<PathBuf>,
+    },
+}
+
+#[derive(Subcommand, Debug, PartialEq)]
+pub enum ToolsCommands {
+    /// List the tools a session's server offered, and what changed since
+    /// the same server's previous session
+    List {
+        /// Session id, or a unique prefix of it
+        session: String,
+
+        /// Print JSON instead of a table
+        #[arg(long)]
+        json: bool,
+    },
+}
+
+#[derive(Subcommand, Debug, PartialEq)]
+pub enum PresetsCommands {
+    /// List the built-in presets and those defined in the config file
+    List,
+}
+
+#[derive(Subcommand, Debug, PartialEq)]
+pub enum RulesCommands {
+    /// List installed rule packs and whether they are enabled
+    List,
+    /// Install or update rule packs published by Kilometers
+    Update {
+        /// Only this pack (default: every published pack)
+        name: Option<String>,
+    },
+    /// Apply an installed pack again
+    Enable {
+        /// Rule pack name
+        name: String,
+    },
+    /// Stop applying an installed pack without removing it
+    Disable {
+        /// Rule pack name
+        name: String,
+    },
+}
+
+/// Additional `km monitor` settings
+#[derive(Args, Debug, Clone, Default)]
+pub struct MonitorOptions {
+    /// Redact secrets and personal data from payloads sent to the API
+    #[arg(long)]
+    pub redact: bool,
+
+    /// Don't load installed plugins for this session
+    #[arg(long)]
+    pub no_plugins: bool,
+
+    /// How MCP messages are delimited on stdio
+    #[arg(long, value_enum, default_value_t = Framing::Auto)]
+    pub framing: Framing,
+
+    /// Evaluate each call against the Rego policies in this OPA bundle (.tar.gz or directory)
+    #[arg(long, value_name = "PATH")]
+    pub policy_bundle: Option<PathBuf>,
+
+    /// Label the session (repeatable), e.g. --label team=payments --label env=ci
+    #[arg(long = "label", value_name = "KEY=VALUE", value_parser = traffic::parse_label)]
+    pub labels: Vec<(String, String)>,
+
+    /// Tie this session to others in the same distributed run, e.g. the CI job id; stored as
+    /// the run.id label and sent with each upload batch
+    #[arg(long, value_name = "ID")]
+    pub run_id: Option<String>,
+
+    /// Capture preset: dev, prod-audit, forensic or one from the config file
+    /// (see `km presets list`)
+    #[arg(long, value_name = "NAME")]
+    pub preset: Option<String>,
+
+    /// Hold requests matching this query until they are approved in the
+    /// terminal or with `km ctl approve`; `high-risk` holds risk>=high
+    #[arg(long, value_name = "QUERY")]
+    pub confirm: Option<String>,
+
+    /// Seconds to wait for an approval before denying a held request [default: 60]
+    #[arg(long, value_name = "SECONDS", requires = "confirm")]
+    pub confirm_timeout: Option<u64>,
+
+    /// Serve Prometheus metrics at http://ADDR/metrics, e.g. 127.0.0.1:9090
+    #[arg(long, value_name = "ADDR")]
+    pub metrics_addr: Option<std::net::SocketAddr>,
+
+    /// How long to keep uploading buffered events once the server has exited, e.g. 15s; what's left is spooled [default: 10s]
+    #[arg(long, value_name = "DURATION", value_parser = traffic::parse_duration)]
+    pub shutdown_timeout: Option<std::time::Duration>,
+
+    /// Set the server's environment variables from this KEY=VALUE file (repeatable); they're passed even when server_env would withhold them
+    #[arg(long = "env-file", value_name = "PATH")]
+    pub env_files: Vec<PathBuf>,
+
+    /// Run the server in a container from this image, attached to stdio and removed when the session ends
+    #[arg(long, value_name = "IMAGE")]
+    pub docker: Option<String>,
+
+    /// Extra `docker run` option for --docker (repeatable), e.g. --docker-arg=--network=none
+    #[arg(
+        long = "docker-arg",
+        value_name = "ARG",
+        requires = "docker",
+        allow_hyphen_values = true
+    )]
+    pub docker_args: Vec<String>,
+
+    /// Summarize the session as JSON on stderr when it ends and fail on --fail-on thresholds
+    #[arg(long)]
+    pub ci: bool,
+
+    /// Fail the --ci run at these thresholds, e.g. high-risk>=1,errors>=5; metrics are
+    /// high-risk, critical-risk, errors, policy-violations and requests
+    #[arg(
+        long,
+        value_name = "THRESHOLDS",
+        value_delimiter = ',',
+        value_parser = ci::parse_threshold,
+        requires = "ci"
+    )]
+    pub fail_on: Vec<Threshold>,
+
+    /// Also write the --ci summary to this file
+    #[arg(long, value_name = "PATH", requires = "ci")]
+    pub ci_summary: Option<PathBuf>,
+}
+
+/// Which events `km export` writes and how
+#[derive(Args, Debug, Clone, Default)]
+pub struct ExportOptions {
+    /// Only export events from this session
+    #[arg(long)]
+    pub session: Option<String>,
+
+    /// Only export events at or after this time (RFC 3339, YYYY-MM-DD, or 24h)
+    #[arg(long)]
+    pub since: Option<String>,
+
+    /// Only export events at or before this time
+    #[arg(long)]
+    pub until: Option<String>,
+
+    /// Only export events whose method matches this pattern (e.g. tools/*)
+    #[arg(short, long)]
+    pub method: Option<String>,
+
+    /// Replace paths, hosts, emails, and strings in payloads with
+    /// consistent tokens so the export can be shared
+    #[arg(long)]
+    pub anonymize: bool,
+}
+
+/// Which client config `km integrate` and `km unintegrate` edit.
+#[derive(Args, Debug)]
+pub struct IntegrateArgs {
+    /// MCP client whose config to edit
+    #[arg(value_enum)]
+    pub client: ClientKind,
+
+    /// Only this server (default: every server in the config)
+    #[arg(long)]
+    pub server: Option<String>,
+
+    /// Client config file, when it isn't in the usual place
+    #[arg(long)]
+    pub file: Option<PathBuf>,
+
+    /// Show the changes as a diff without writing anything
+    #[arg(long)]
+    pub dry_run: bool,
+}
+
+#[derive(Subcommand, Debug)]
+pub enum DocsCommands {
+    /// Write the km(1) man page
+    Man {
+        /// Write to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
     },
 }
 
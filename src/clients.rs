@@ -0,0 +1,370 @@
+use anyhow::{Context, Result};
+use clap::ValueEnum;
+use serde_json::{Map, Value};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Desktop MCP clients whose config files km knows how to edit.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum ClientKind {
+    #[value(name = "claude")]
+    ClaudeDesktop,
+    Cursor,
+    #[value(name = "vscode")]
+    VsCode,
+}
+
+impl fmt::Display for ClientKind {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            ClientKind::ClaudeDesktop => "Claude Desktop",
+            ClientKind::Cursor => "Cursor",
+            ClientKind::VsCode => "VS Code",
+        })
+    }
+}
+
+impl ClientKind {
+    pub const ALL: &'static [ClientKind] = &[
+        ClientKind::ClaudeDesktop,
+        ClientKind::Cursor,
+        ClientKind::VsCode,
+    ];
+
+    /// Where this client keeps its MCP server list, most specific first.
+    /// `cwd` matters for clients with per-project configs.
+    pub fn config_paths(self, home: &Path, cwd: &Path) -> Vec<PathBuf> {
+        match self {
+            ClientKind::ClaudeDesktop => {
+                let dir = if cfg!(target_os = "macos") {
+                    home.join("Library").join("Application Support")
+                } else if cfg!(windows) {
+                    home.join("AppData").join("Roaming")
+                } else {
+                    home.join(".config")
+                };
+                vec![dir.join("Claude").join("claude_desktop_config.json")]
+            }
+            ClientKind::Cursor => {
+                let mut paths = vec![cwd.join(".cursor").join("mcp.json")];
+                let global = home.join(".cursor").join("mcp.json");
+                if !paths.contains(&global) {
+                    paths.push(global);
+                }
+                paths
+            }
+            ClientKind::VsCode => {
+                let user = if cfg!(target_os = "macos") {
+                    home.join("Library").join("Application Support")
+                } else if cfg!(windows) {
+                    home.join("AppData").join("Roaming")
+                } else {
+                    home.join(".config")
+                };
+                vec![
+                    cwd.join(".vscode").join("mcp.json"),
+                    user.join("Code").join("User").join("mcp.json"),
+                ]
+            }
+        }
+    }
+
+    /// The first of [`Self::config_paths`] that exists.
+    pub fn find_config(self, home: &Path, cwd: &Path) -> Result<PathBuf> {
+        let paths = self.config_paths(home, cwd);
+        paths
+            .iter()
+            .find(|path| path.is_file())
+            .cloned()
+            .ok_or_else(|| {
+                let tried: Vec<String> = paths.iter().map(|p| p.display().to_string()).collect();
+                anyhow::anyhow!(
+                    "No {} config found (looked for {}). Pass --file to point at it",
+                    self,
+                    tried.join(", ")
+                )
+            })
+    }
+}
+
+/// An MCP client config file found on this machine.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ClientConfig {
+    pub kind: ClientKind,
+    pub path: PathBuf,
+}
+
+/// Config files of the installed MCP clients.
+pub fn detect(home: &Path, cwd: &Path) -> Vec<ClientConfig> {
+    ClientKind::ALL
+        .iter()
+        .flat_map(|&kind| {
+            kind.config_paths(home, cwd)
+                .into_iter()
+                .filter(|path| path.is_file())
+                .map(move |path| ClientConfig { kind, path })
+        })
+        .collect()
+}
+
+/// The current user's home and working directory, where [`detect`] and
+/// [`ClientKind::find_config`] look.
+pub fn default_dirs() -> Result<(PathBuf, PathBuf)> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    let cwd = std::env::current_dir().context("Could not determine current directory")?;
+    Ok((base.home_dir().to_path_buf(), cwd))
+}
+
+/// [`detect`] for the current user and directory.
+pub fn detect_default() -> Result<Vec<ClientConfig>> {
+    let (home, cwd) = default_dirs()?;
+    Ok(detect(&home, &cwd))
+}
+
+/// How a wrapped server entry launches km: this executable, with the config
+/// file given as an absolute path since clients start servers from
+/// wherever they like.
+#[derive(Debug, Clone)]
+pub struct KmCommand {
+    pub exe: String,
+    pub config: PathBuf,
+}
+
+impl KmCommand {
+    pub fn current(config_path: &Path) -> Result<Self> {
+        let exe = std::env::current_exe().context("Could not locate the km executable")?;
+        let config = std::path::absolute(config_path)
+            .with_context(|| format!("Could not resolve {:?}", config_path))?;
+        Ok(Self {
+            exe: exe.to_string_lossy().into_owned(),
+            config,
+        })
+    }
+
+    fn args(&self) -> Vec<Value> {
+        vec![
+            "--config".into(),
+            self.config.to_string_lossy().into_owned().into(),
+            "monitor".into(),
+            "--".into(),
+        ]
+    }
+}
+
+/// A client config file's JSON with helpers for its server list: the
+/// `mcpServers` section, or `servers` in VS Code's `mcp.json`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct McpConfig {
+    doc: Value,
+    key: &'static str,
+}
+
+impl McpConfig {
+    pub fn load(path: &Path) -> Result<Self> {
+        let contents =
+            fs::read_to_string(path).with_context(|| format!("Failed to read {:?}", path))?;
+        Self::parse(&contents).with_context(|| format!("Failed to parse {:?}", path))
+    }
+
+    pub fn parse(contents: &str) -> Result<Self> {
+        let doc: Value = if contents.trim().is_empty() {
+            Value::Object(Map::new())
+        } else {
+            serde_json::from_str(contents)?
+        };
+        if !doc.is_object() {
+            return Err(anyhow::anyhow!("Expected a JSON object"));
+        }
+        let key = if doc.get("mcpServers").is_none() && doc.get("servers").is_some() {
+            "servers"
+        } else {
+            "mcpServers"
+        };
+        Ok(Self { doc, key })
+    }
+
+    fn servers(&self) -> Option<&Map<String, Value>> {
+        self.doc.get(self.key).and_then(Value::as_object)
+    }
+
+    fn servers_mut(&mut self) -> Option<&mut Map<String, Value>> {
+        self.doc.get_mut(self.key).and_then(Value::as_object_mut)
+    }
+
+    pub fn has_server(&self, name: &str) -> bool {
+        self.servers()
+            .is_some_and(|servers| servers.contains_key(name))
+    }
+
+    /// Names of the stdio servers, and whether each already runs through km.
+    /// Servers reached over HTTP have no command to wrap and are left out.
+    pub fn server_names(&self) -> Vec<(String, bool)> {
+        self.servers()
+            .map(|servers| {
+                servers
+                    .iter()
+                    .filter(|(_, entry)| entry.get("command").is_some())
+                    .map(|(name, entry)| (name.clone(), is_wrapped(entry)))
+                    .collect()
+            })
+            .unwrap_or_default()
+    }
+
+    /// Route the named server (or every server) through `km monitor`.
+    /// Returns the servers that changed; wrapped ones are left alone.
+    pub fn wrap(&mut self, km: &KmCommand, only: Option<&str>) -> Vec<String> {
+        let mut changed = Vec::new();
+        let Some(servers) = self.servers_mut() else {
+            return changed;
+        };
+        for (name, entry) in servers.iter_mut() {
+            if only.is_some_and(|only| only != name) || is_wrapped(entry) {
+                continue;
+            }
+            let Some(command) = entry.get("command").cloned() else {
+                continue;
+            };
+            let mut args = km.args();
+            args.push(command);
+            if let Some(Value::Array(original)) = entry.get("args") {
+                args.extend(original.iter().cloned());
+            }
+            entry["command"] = Value::String(km.exe.clone());
+            entry["args"] = Value::Array(args);
+            changed.push(name.clone());
+        }
+        changed
+    }
+
+    /// Undo [`Self::wrap`] for the named server (or every server), putting
+    /// back the command km was launching. Returns the servers that changed.
+    pub fn unwrap(&mut self, only: Option<&str>) -> Vec<String> {
+        let mut changed = Vec::new();
+        let Some(servers) = self.servers_mut() else {
+            return changed;
+        };
+        for (name, entry) in servers.iter_mut() {
+            if only.is_some_and(|only| only != name) || !is_wrapped(entry) {
+                continue;
+            }
+            let args = entry["args"].as_array().cloned().unwrap_or_default();
+            let Some(separator) = args.iter().position(|a| a == "--") else {
+                continue;
+            };
+            let Some(command) = args.get(separator + 1).cloned() else {
+                continue;
+            };
+            let original: Vec<Value> = args[separator + 2..].to_vec();
+            entry["command"] = command;
+            match entry.as_object_mut() {
+                Some(fields) if original.is_empty() => {
+                    fields.remove("args");
+                }
+                _ => entry["args"] = Value::Array(original),
+            }
+            changed.push(name.clone());
+        }
+        changed
+    }
+
+    pub fn to_pretty(&self) -> String {
+        let mut text = serde_json::to_string_pretty(&self.doc).unwrap_or_default();
+        text.push('\n');
+        text
+    }
+
+    /// Write the config back to `path`, keeping the previous contents in
+    /// `<file>.bak`. Returns the backup's path.
+    pub fn save(&self, path: &Path) -> Result<PathBuf> {
+        let backup = backup_path(path);
+        if path.exists() {
+            fs::copy(path, &backup)
+                .with_context(|| format!("Failed to back up {:?} to {:?}", path, backup))?;
+        }
+        fs::write(path, self.to_pretty()).with_context(|| format!("Failed to write {:?}", path))?;
+        Ok(backup)
+    }
+}
+
+pub fn backup_path(path: &Path) -> PathBuf {
+    let mut name = path.file_name().unwrap_or_default().to_os_string();
+    name.push(".bak");
+    path.with_file_name(name)
+}
+
+/// Line diff between two texts, with `-`/`+` marking removed and added
+/// lines and a few lines of context around each change.
+pub fn diff(before: &str, after: &str) -> String {
+    const CONTEXT: usize = 3;
+    let old: Vec<&str> = before.lines().collect();
+    let new: Vec<&str> = after.lines().collect();
+
+    // Longest common subsequence lengths of every suffix pair
+    let mut lcs = vec![vec![0usize; new.len() + 1]; old.len() + 1];
+    for i in (0..old.len()).rev() {
+        for j in (0..new.len()).rev() {
+            lcs[i][j] = if old[i] == new[j] {
+                lcs[i + 1][j + 1] + 1
+            } else {
+                lcs[i + 1][j].max(lcs[i][j + 1])
+            };
+        }
+    }
+
+    let mut lines: Vec<(char, &str)> = Vec::new();
+    let (mut i, mut j) = (0, 0);
+    while i < old.len() || j < new.len() {
+        if i < old.len() && j < new.len() && old[i] == new[j] {
+            lines.push((' ', old[i]));
+            i += 1;
+            j += 1;
+        } else if i < old.len() && (j == new.len() || lcs[i + 1][j] >= lcs[i][j + 1]) {
+            lines.push(('-', old[i]));
+            i += 1;
+        } else {
+            lines.push(('+', new[j]));
+            j += 1;
+        }
+    }
+
+    let changed: Vec<usize> = (0..lines.len()).filter(|&k| lines[k].0 != ' ').collect();
+    let near_change = |k: usize| {
+        changed
+            .iter()
+            .any(|&c| k + CONTEXT >= c && k <= c + CONTEXT)
+    };
+    let mut out = String::new();
+    let mut skipped = false;
+    for (k, (mark, line)) in lines.iter().enumerate() {
+        if near_change(k) {
+            if skipped && !out.is_empty() {
+                out.push_str("...\n");
+            }
+            skipped = false;
+            out.push_str(&format!("{} {}\n", mark, line));
+        } else {
+            skipped = true;
+        }
+    }
+    out
+}
+
+/// Whether a server entry already launches `km monitor`: one written by
+/// [`McpConfig::wrap`] (whatever the executable is called), or a `km`
+/// command with `monitor` among its arguments.
+pub fn is_wrapped(entry: &Value) -> bool {
+    let args = entry
+        .get("args")
+        .and_then(Value::as_array)
+        .map(Vec::as_slice)
+        .unwrap_or_default();
+    let written_by_km =
+        args.len() >= 4 && args[0] == "--config" && args[2] == "monitor" && args[3] == "--";
+    let is_km = entry
+        .get("command")
+        .and_then(Value::as_str)
+        .and_then(|command| Path::new(command).file_stem())
+        .is_some_and(|stem| stem == "km");
+    written_by_km || (is_km && args.iter().any(|a| a == "monitor"))
+}
@@ -0,0 +1,204 @@
+//! Timestamps that survive clock skew. Every captured message records its
+//! wall-clock time and `elapsed_ms`, the time since the session's first
+//! message on the monotonic clock, which doesn't jump when the system clock
+//! is set. When a
+//! session starts, km asks an NTP server how far this machine's clock is off
+//! and labels the session with the offset. Exports and `km merge` use both to
+//! put captures from machines whose clocks disagree on one timeline.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Duration as ChronoDuration, Utc};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::net::{ToSocketAddrs, UdpSocket};
+use std::sync::OnceLock;
+use std::time::{Duration, Instant};
+
+use crate::traffic::TrafficEntry;
+
+/// Label holding how far the session's machine clock was behind NTP time,
+/// in milliseconds (negative when it was ahead)
+pub const OFFSET_LABEL: &str = "clock.offset_ms";
+/// Label holding the offset already added to the timestamps of a
+/// normalized session, which is left as it is by later normalizing
+pub const CORRECTED_LABEL: &str = "clock.corrected_ms";
+
+/// How long a session start waits for the NTP server
+pub const NTP_TIMEOUT: Duration = Duration::from_secs(1);
+
+const NTP_PORT: u16 = 123;
+/// Seconds from the NTP epoch (1900) to the Unix epoch
+const NTP_UNIX_OFFSET: i64 = 2_208_988_800;
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ClockConfig {
+    /// Estimate the clock offset from an NTP server when a session starts
+    #[serde(default = "default_true")]
+    pub ntp: bool,
+    /// The NTP server asked, as `host` or `host:port`
+    #[serde(default = "default_ntp_server")]
+    pub ntp_server: String,
+}
+
+fn default_true() -> bool {
+    true
+}
+
+fn default_ntp_server() -> String {
+    "pool.ntp.org".to_string()
+}
+
+impl Default for ClockConfig {
+    fn default() -> Self {
+        Self {
+            ntp: true,
+            ntp_server: default_ntp_server(),
+        }
+    }
+}
+
+impl ClockConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+/// The wall-clock time, and the milliseconds on the monotonic clock since
+/// the first call.
+pub fn now() -> (DateTime<Utc>, f64) {
+    static ORIGIN: OnceLock<Instant> = OnceLock::new();
+    let origin = *ORIGIN.get_or_init(Instant::now);
+    let elapsed = origin.elapsed();
+    (Utc::now(), elapsed.as_micros() as f64 / 1000.0)
+}
+
+fn millis(ms: f64) -> ChronoDuration {
+    ChronoDuration::microseconds((ms * 1000.0).round() as i64)
+}
+
+/// The result of one exchange with an NTP server.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct NtpSample {
+    /// How far this machine's clock is behind the server's, in milliseconds
+    pub offset_ms: f64,
+    /// Round trip to the server, less its processing time
+    pub delay_ms: f64,
+}
+
+/// Ask `server` for the time (SNTP, RFC 4330) and estimate this machine's
+/// clock offset from the reply.
+pub fn query(server: &str, timeout: Duration) -> Result<NtpSample> {
+    crate::offline::ensure_online("Asking an NTP server for the time")?;
+    // `host:port` and `[v6]:port` name the port; a bare host or v6 address doesn't
+    let has_port = server.matches(':').count() == 1 || server.contains("]:");
+    let addrs = match has_port {
+        true => server.to_socket_addrs(),
+        false => (server.trim_matches(|c| c == '[' || c == ']'), NTP_PORT).to_socket_addrs(),
+    };
+    let addr = addrs
+        .with_context(|| format!("Failed to resolve NTP server {}", server))?
+        .next()
+        .with_context(|| format!("NTP server {} has no address", server))?;
+
+    let local = if addr.is_ipv4() {
+        "0.0.0.0:0"
+    } else {
+        "[::]:0"
+    };
+    let socket = UdpSocket::bind(local).context("Failed to open a UDP socket")?;
+    socket.set_read_timeout(Some(timeout))?;
+    socket.set_write_timeout(Some(timeout))?;
+
+    // Version 4, client mode; the server echoes the transmit time back as
+    // the originate time, which ties its reply to this request
+    let mut request = [0u8; 48];
+    request[0] = 0x23;
+    let sent = Utc::now();
+    let transmit = ntp_timestamp(sent);
+    request[40..48].copy_from_slice(&transmit);
+    socket
+        .send_to(&request, addr)
+        .with_context(|| format!("Failed to send to NTP server {}", server))?;
+
+    let mut reply = [0u8; 68];
+    loop {
+        let (len, from) = socket
+            .recv_from(&mut reply)
+            .with_context(|| format!("No reply from NTP server {}", server))?;
+        let received = Utc::now();
+        if from != addr || len < 48 || reply[24..32] != transmit {
+            continue;
+        }
+        if reply[0] & 0x07 != 4 || !(1..16).contains(&reply[1]) {
+            anyhow::bail!("NTP server {} did not give the time", server);
+        }
+        let t1 = sent.timestamp_micros() as f64 / 1000.0;
+        let t2 = unix_millis(&reply[32..40]);
+        let t3 = unix_millis(&reply[40..48]);
+        let t4 = received.timestamp_micros() as f64 / 1000.0;
+        return Ok(NtpSample {
+            offset_ms: ((t2 - t1) + (t3 - t4)) / 2.0,
+            delay_ms: ((t4 - t1) - (t3 - t2)).max(0.0),
+        });
+    }
+}
+
+/// `time` as a 64-bit NTP timestamp.
+fn ntp_timestamp(time: DateTime<Utc>) -> [u8; 8] {
+    let seconds = (time.timestamp() + NTP_UNIX_OFFSET) as u32;
+    let fraction = ((time.timestamp_subsec_nanos() as u64) << 32) / 1_000_000_000;
+    let mut bytes = [0u8; 8];
+    bytes[..4].copy_from_slice(&seconds.to_be_bytes());
+    bytes[4..].copy_from_slice(&(fraction as u32).to_be_bytes());
+    bytes
+}
+
+/// A 64-bit NTP timestamp as milliseconds since the Unix epoch.
+fn unix_millis(bytes: &[u8]) -> f64 {
+    let seconds = u32::from_be_bytes([bytes[0], bytes[1], bytes[2], bytes[3]]) as i64;
+    // Era 1 starts in 2036; times before 1968 are read as after it
+    let seconds = match seconds & 0x8000_0000 {
+        0 => seconds + (1 << 32),
+        _ => seconds,
+    };
+    let fraction = u32::from_be_bytes([bytes[4], bytes[5], bytes[6], bytes[7]]) as f64;
+    (seconds - NTP_UNIX_OFFSET) as f64 * 1000.0 + fraction * 1000.0 / 4_294_967_296.0
+}
+
+/// Put each session of `entries` on one consistent timeline. Entries with
+/// an `elapsed_ms` are timed from the session's first such entry on the
+/// monotonic clock, so the system clock being set mid-session doesn't
+/// reorder them, and every entry of a session with an NTP offset has it
+/// added. Sessions already normalized are left as they are.
+pub fn normalize(entries: &mut [TrafficEntry]) {
+    let mut starts: HashMap<Option<String>, DateTime<Utc>> = HashMap::new();
+    for entry in entries.iter_mut() {
+        if entry.labels.contains_key(CORRECTED_LABEL) {
+            continue;
+        }
+        if let Some(elapsed) = entry.elapsed_ms {
+            let start = *starts
+                .entry(entry.session_id.clone())
+                .or_insert_with(|| entry.timestamp - millis(elapsed));
+            entry.timestamp = start + millis(elapsed);
+        }
+        let offset = entry
+            .labels
+            .get(OFFSET_LABEL)
+            .and_then(|v| v.parse::<f64>().ok());
+        if let Some(offset) = offset {
+            entry.timestamp += millis(offset);
+            let offset = entry.labels.remove(OFFSET_LABEL).unwrap_or_default();
+            entry.labels.insert(CORRECTED_LABEL.to_string(), offset);
+        }
+    }
+}
+
+/// Time from `earlier` to `later`, on the monotonic clock when both were
+/// captured by the same session.
+pub fn between(earlier: &TrafficEntry, later: &TrafficEntry) -> ChronoDuration {
+    match (earlier.elapsed_ms, later.elapsed_ms) {
+        (Some(a), Some(b)) if earlier.session_id == later.session_id => millis(b - a),
+        _ => later.timestamp - earlier.timestamp,
+    }
+}
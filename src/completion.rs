@@ -0,0 +1,615 @@
+use clap::{Arg, Command, ValueEnum, ValueHint};
+use std::path::Path;
+
+use crate::config::{Config, CONFIG_KEYS};
+use crate::plugins::store::PluginStore;
+use crate::presets;
+use crate::{sessions, traffic};
+
+/// Shells `km completion` writes scripts for.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum Shell {
+    Bash,
+    Zsh,
+    Fish,
+    Powershell,
+}
+
+/// Values the completion scripts look up at completion time by running
+/// `km __complete <kind>`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum ValueKind {
+    /// Session ids in the traffic log
+    Sessions,
+    /// Installed plugins
+    Plugins,
+    /// Profiles in the config file
+    Profiles,
+    /// Capture presets, built in and from the config file
+    Presets,
+    /// Settings `km config get/set` accepts
+    ConfigKeys,
+}
+
+impl ValueKind {
+    fn name(self) -> &'static str {
+        match self {
+            ValueKind::Sessions => "sessions",
+            ValueKind::Plugins => "plugins",
+            ValueKind::Profiles => "profiles",
+            ValueKind::Presets => "presets",
+            ValueKind::ConfigKeys => "config-keys",
+        }
+    }
+}
+
+/// Current values of `kind`, one per completion candidate. Anything that
+/// can't be read just contributes no candidates.
+pub fn values(kind: ValueKind, config_path: &Path, traffic_log: &Path) -> Vec<String> {
+    match kind {
+        ValueKind::Sessions => traffic::read_entries(traffic_log)
+            .map(|entries| {
+                sessions::summarize(&entries)
+                    .into_iter()
+                    .map(|s| s.id)
+                    .collect()
+            })
+            .unwrap_or_default(),
+        ValueKind::Plugins => PluginStore::open_default()
+            .and_then(|store| store.installed())
+            .map(|plugins| plugins.into_iter().map(|p| p.name).collect())
+            .unwrap_or_default(),
+        ValueKind::Profiles => Config::load(config_path)
+            .map(|config| config.profiles.into_keys().collect())
+            .unwrap_or_default(),
+        ValueKind::Presets => {
+            let custom = Config::load(config_path)
+                .map(|config| config.presets)
+                .unwrap_or_default();
+            presets::all(&custom).into_keys().collect()
+        }
+        ValueKind::ConfigKeys => CONFIG_KEYS.iter().map(|k| k.to_string()).collect(),
+    }
+}
+
+/// What can be completed for an option's value or a positional argument.
+#[derive(Debug, Clone, PartialEq)]
+enum Values {
+    /// A flag; nothing follows it
+    None,
+    /// Free text
+    Any,
+    Path,
+    Choices(Vec<String>),
+    Dynamic(ValueKind),
+}
+
+#[derive(Debug)]
+struct Opt {
+    /// `--long` and `-s` spellings
+    names: Vec<String>,
+    help: String,
+    values: Values,
+}
+
+/// One command in the tree, e.g. `km sessions show`.
+#[derive(Debug)]
+struct Node {
+    path: String,
+    subcommands: Vec<(String, String)>,
+    options: Vec<Opt>,
+    positionals: Vec<Values>,
+}
+
+fn help_text(arg: &Arg) -> String {
+    arg.get_help()
+        .map(|h| h.to_string())
+        .unwrap_or_default()
+        .lines()
+        .next()
+        .unwrap_or_default()
+        .to_string()
+}
+
+fn about(cmd: &Command) -> String {
+    cmd.get_about().map(|a| a.to_string()).unwrap_or_default()
+}
+
+fn values_for(path: &str, arg: &Arg) -> Values {
+    let id = arg.get_id().as_str();
+    let in_command = |name: &str| path.split(' ').any(|part| part == name);
+    match id {
+        "profile" => return Values::Dynamic(ValueKind::Profiles),
+        "preset" => return Values::Dynamic(ValueKind::Presets),
+        "session" => return Values::Dynamic(ValueKind::Sessions),
+        "id" | "a" | "b"
+            if in_command("sessions")
+                || in_command("inspect")
+                || in_command("report")
+                || in_command("diff") =>
+        {
+            return Values::Dynamic(ValueKind::Sessions)
+        }
+        "name" if in_command("plugins") => return Values::Dynamic(ValueKind::Plugins),
+        "key" if in_command("config") => return Values::Dynamic(ValueKind::ConfigKeys),
+        _ => {}
+    }
+
+    if !arg.get_action().takes_values() {
+        return Values::None;
+    }
+    let choices: Vec<String> = arg
+        .get_possible_values()
+        .iter()
+        .filter(|v| !v.is_hide_set())
+        .map(|v| v.get_name().to_string())
+        .collect();
+    if !choices.is_empty() {
+        return Values::Choices(choices);
+    }
+    match arg.get_value_hint() {
+        ValueHint::AnyPath | ValueHint::FilePath | ValueHint::DirPath => Values::Path,
+        _ => Values::Any,
+    }
+}
+
+fn collect(cmd: &Command, path: String, nodes: &mut Vec<Node>) {
+    let visible = || cmd.get_subcommands().filter(|c| !c.is_hide_set());
+    let options = cmd
+        .get_arguments()
+        .filter(|a| !a.is_positional() && !a.is_hide_set())
+        .map(|a| {
+            let mut names: Vec<String> = a
+                .get_long()
+                .map(|l| format!("--{}", l))
+                .into_iter()
+                .collect();
+            names.extend(a.get_short().map(|s| format!("-{}", s)));
+            Opt {
+                names,
+                help: help_text(a),
+                values: values_for(&path, a),
+            }
+        })
+        .collect();
+    let positionals = cmd
+        .get_positionals()
+        .filter(|a| !a.is_hide_set())
+        .map(|a| values_for(&path, a))
+        .collect();
+
+    nodes.push(Node {
+        path: path.clone(),
+        subcommands: visible()
+            .map(|c| (c.get_name().to_string(), about(c)))
+            .collect(),
+        options,
+        positionals,
+    });
+    for sub in visible() {
+        collect(sub, format!("{} {}", path, sub.get_name()), nodes);
+    }
+}
+
+fn tree(cmd: &mut Command) -> Vec<Node> {
+    cmd.build();
+    let mut nodes = Vec::new();
+    collect(cmd, cmd.get_name().to_string(), &mut nodes);
+    nodes
+}
+
+/// Options anywhere in the tree that take a value, so the scripts can skip
+/// over those values when working out which command is being completed.
+fn value_options(nodes: &[Node]) -> Vec<String> {
+    let mut names: Vec<String> = nodes
+        .iter()
+        .flat_map(|n| &n.options)
+        .filter(|o| o.values != Values::None)
+        .flat_map(|o| o.names.clone())
+        .collect();
+    names.sort();
+    names.dedup();
+    names
+}
+
+/// `a|b|c` for shell `case` patterns
+fn alternatives(names: &[String]) -> String {
+    names.join("|")
+}
+
+fn single_quoted(text: &str) -> String {
+    format!("'{}'", text.replace('\'', r"'\''"))
+}
+
+/// Completion script for `shell`, built from the `km` command tree.
+pub fn generate(shell: Shell, cmd: &mut Command) -> String {
+    let nodes = tree(cmd);
+    match shell {
+        Shell::Bash => bash(&nodes),
+        Shell::Zsh => zsh(&nodes),
+        Shell::Fish => fish(&nodes),
+        Shell::Powershell => powershell(&nodes),
+    }
+}
+
+fn bash_words(values: &Values) -> Option<String> {
+    match values {
+        Values::Choices(choices) => Some(choices.join(" ")),
+        Values::Dynamic(kind) => Some(format!("$(km __complete {} 2>/dev/null)", kind.name())),
+        _ => None,
+    }
+}
+
+fn bash(nodes: &[Node]) -> String {
+    let mut out = String::new();
+    out.push_str("# bash completion for km; generated by `km completion bash`\n");
+    out.push_str("_km() {\n");
+    out.push_str("    local cur prev cmdpath word i npos=0\n");
+    out.push_str("    cur=\"${COMP_WORDS[COMP_CWORD]}\"\n");
+    out.push_str("    prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n");
+    out.push_str("    cmdpath=\"km\"\n");
+    out.push_str("    for ((i = 1; i < COMP_CWORD; i++)); do\n");
+    out.push_str("        word=\"${COMP_WORDS[i]}\"\n");
+    out.push_str("        case \"$word\" in\n");
+    out.push_str("            --) return ;;\n");
+    out.push_str("            -*) ;;\n");
+    out.push_str("            *)\n");
+    out.push_str(&format!(
+        "                case \"${{COMP_WORDS[i-1]}}\" in\n                    {}) continue ;;\n                esac\n",
+        alternatives(&value_options(nodes))
+    ));
+    let transitions: Vec<String> = nodes
+        .iter()
+        .skip(1)
+        .map(|n| format!("\"{}\"", n.path))
+        .collect();
+    out.push_str(&format!(
+        "                case \"$cmdpath $word\" in\n                    {}) cmdpath=\"$cmdpath $word\"; npos=0 ;;\n                    *) npos=$((npos + 1)) ;;\n                esac\n",
+        transitions.join("|")
+    ));
+    out.push_str("                ;;\n        esac\n    done\n\n");
+
+    out.push_str("    case \"$cmdpath\" in\n");
+    for node in nodes {
+        out.push_str(&format!("        \"{}\")\n", node.path));
+        let with_values: Vec<&Opt> = node
+            .options
+            .iter()
+            .filter(|o| o.values != Values::None)
+            .collect();
+        if !with_values.is_empty() {
+            out.push_str("            case \"$prev\" in\n");
+            for opt in with_values {
+                let action = match bash_words(&opt.values) {
+                    Some(words) => format!(
+                        "COMPREPLY=($(compgen -W \"{}\" -- \"$cur\")); return",
+                        words
+                    ),
+                    None => "return".to_string(),
+                };
+                out.push_str(&format!(
+                    "                {}) {} ;;\n",
+                    alternatives(&opt.names),
+                    action
+                ));
+            }
+            out.push_str("            esac\n");
+        }
+        let flags: Vec<String> = node.options.iter().flat_map(|o| o.names.clone()).collect();
+        out.push_str(&format!(
+            "            if [[ \"$cur\" == -* ]]; then\n                COMPREPLY=($(compgen -W \"{}\" -- \"$cur\"))\n",
+            flags.join(" ")
+        ));
+        if !node.subcommands.is_empty() {
+            let names: Vec<&str> = node.subcommands.iter().map(|(n, _)| n.as_str()).collect();
+            out.push_str(&format!(
+                "            else\n                COMPREPLY=($(compgen -W \"{}\" -- \"$cur\"))\n",
+                names.join(" ")
+            ));
+        } else {
+            for (index, values) in node.positionals.iter().enumerate() {
+                if let Some(words) = bash_words(values) {
+                    out.push_str(&format!(
+                        "            elif [[ $npos -eq {} ]]; then\n                COMPREPLY=($(compgen -W \"{}\" -- \"$cur\"))\n",
+                        index, words
+                    ));
+                }
+            }
+        }
+        out.push_str("            fi\n            ;;\n");
+    }
+    out.push_str("    esac\n}\n\n");
+    // Fall back to file names where nothing else applies
+    out.push_str("complete -o default -F _km km\n");
+    out
+}
+
+fn zsh_action(values: &Values) -> Option<String> {
+    match values {
+        Values::Path => Some("_files".to_string()),
+        Values::Choices(choices) => Some(format!("compadd -- {}", choices.join(" "))),
+        Values::Dynamic(kind) => Some(format!(
+            "compadd -- ${{(f)\"$(km __complete {} 2>/dev/null)\"}}",
+            kind.name()
+        )),
+        _ => None,
+    }
+}
+
+fn zsh_describe(tag: &str, items: &[(String, String)]) -> String {
+    let entries: Vec<String> = items
+        .iter()
+        .map(|(name, help)| single_quoted(&format!("{}:{}", name.replace(':', r"\:"), help)))
+        .collect();
+    format!(
+        "local -a items; items=({}); _describe '{}' items",
+        entries.join(" "),
+        tag
+    )
+}
+
+fn zsh(nodes: &[Node]) -> String {
+    let mut out = String::new();
+    out.push_str("#compdef km\n# zsh completion for km; generated by `km completion zsh`\n\n");
+    out.push_str("_km() {\n");
+    out.push_str("    local cur prev cmdpath word\n    local -i i npos=0\n");
+    out.push_str(
+        "    cur=\"${words[CURRENT]}\"\n    prev=\"${words[CURRENT-1]}\"\n    cmdpath=\"km\"\n",
+    );
+    out.push_str("    for ((i = 2; i < CURRENT; i++)); do\n");
+    out.push_str("        word=\"${words[i]}\"\n");
+    out.push_str("        case \"$word\" in\n");
+    out.push_str("            (--) _files; return ;;\n");
+    out.push_str("            (-*) ;;\n");
+    out.push_str("            (*)\n");
+    out.push_str(&format!(
+        "                case \"${{words[i-1]}}\" in\n                    ({}) continue ;;\n                esac\n",
+        alternatives(&value_options(nodes))
+    ));
+    let transitions: Vec<String> = nodes
+        .iter()
+        .skip(1)
+        .map(|n| format!("\"{}\"", n.path))
+        .collect();
+    out.push_str(&format!(
+        "                case \"$cmdpath $word\" in\n                    ({}) cmdpath=\"$cmdpath $word\"; npos=0 ;;\n                    (*) npos=$((npos + 1)) ;;\n                esac\n",
+        transitions.join("|")
+    ));
+    out.push_str("                ;;\n        esac\n    done\n\n");
+
+    out.push_str("    case \"$cmdpath\" in\n");
+    for node in nodes {
+        out.push_str(&format!("        (\"{}\")\n", node.path));
+        let with_values: Vec<&Opt> = node
+            .options
+            .iter()
+            .filter(|o| o.values != Values::None)
+            .collect();
+        if !with_values.is_empty() {
+            out.push_str("            case \"$prev\" in\n");
+            for opt in with_values {
+                let action = match zsh_action(&opt.values) {
+                    Some(action) => format!("{}; return", action),
+                    None => "return".to_string(),
+                };
+                out.push_str(&format!(
+                    "                ({}) {} ;;\n",
+                    alternatives(&opt.names),
+                    action
+                ));
+            }
+            out.push_str("            esac\n");
+        }
+        let flags: Vec<(String, String)> = node
+            .options
+            .iter()
+            .flat_map(|o| o.names.iter().map(|n| (n.clone(), o.help.clone())))
+            .collect();
+        out.push_str(&format!(
+            "            if [[ \"$cur\" == -* ]]; then\n                {}\n",
+            zsh_describe("option", &flags)
+        ));
+        if !node.subcommands.is_empty() {
+            out.push_str(&format!(
+                "            else\n                {}\n",
+                zsh_describe("command", &node.subcommands)
+            ));
+        } else {
+            for (index, values) in node.positionals.iter().enumerate() {
+                if let Some(action) = zsh_action(values) {
+                    out.push_str(&format!(
+                        "            elif (( npos == {} )); then\n                {}\n",
+                        index, action
+                    ));
+                }
+            }
+        }
+        out.push_str("            fi\n            ;;\n");
+    }
+    out.push_str("    esac\n}\n\n");
+    out.push_str("if [[ \"$funcstack[1]\" == \"_km\" ]]; then\n    _km \"$@\"\nelse\n    compdef _km km\nfi\n");
+    out
+}
+
+fn fish(nodes: &[Node]) -> String {
+    let mut out = String::new();
+    out.push_str("# fish completion for km; generated by `km completion fish`\n\n");
+    out.push_str("function __km_position\n");
+    out.push_str("    set -l tokens (commandline -opc)\n");
+    out.push_str("    set -l cmdpath km\n    set -l npos 0\n    set -l prev ''\n");
+    out.push_str(&format!(
+        "    set -l value_options {}\n",
+        value_options(nodes).join(" ")
+    ));
+    let transitions: Vec<String> = nodes
+        .iter()
+        .skip(1)
+        .map(|n| single_quoted(&n.path))
+        .collect();
+    out.push_str(&format!("    set -l commands {}\n", transitions.join(" ")));
+    out.push_str("    for word in $tokens[2..-1]\n");
+    out.push_str("        if test \"$word\" = '--'\n            set cmdpath \"$cmdpath --\"\n            break\n");
+    out.push_str("        else if string match -q -- '-*' $word\n");
+    out.push_str("        else if contains -- $prev $value_options\n");
+    out.push_str("        else if contains -- \"$cmdpath $word\" $commands\n");
+    out.push_str("            set cmdpath \"$cmdpath $word\"\n            set npos 0\n");
+    out.push_str("        else\n            set npos (math $npos + 1)\n        end\n");
+    out.push_str("        set prev $word\n    end\n");
+    out.push_str("    echo $cmdpath\n    echo $npos\nend\n\n");
+    out.push_str(
+        "function __km_at -a expected\n    test (__km_position)[1] = \"$expected\"\nend\n\n",
+    );
+    out.push_str("function __km_arg -a expected index\n    set -l position (__km_position)\n    test \"$position[1]\" = \"$expected\" -a \"$position[2]\" = \"$index\"\nend\n\n");
+    out.push_str("complete -c km -f\n");
+
+    for node in nodes {
+        let at = format!("-n '__km_at \"{}\"'", node.path);
+        for (name, help) in &node.subcommands {
+            out.push_str(&format!(
+                "complete -c km {} -a {} -d {}\n",
+                at,
+                name,
+                single_quoted(help)
+            ));
+        }
+        for opt in &node.options {
+            let mut spec = String::new();
+            for name in &opt.names {
+                match name.strip_prefix("--") {
+                    Some(long) => spec.push_str(&format!(" -l {}", long)),
+                    None => spec.push_str(&format!(" -s {}", &name[1..])),
+                }
+            }
+            match opt.values {
+                Values::None => {}
+                Values::Any => spec.push_str(" -x"),
+                Values::Path => spec.push_str(" -r -F"),
+                Values::Choices(ref choices) => {
+                    spec.push_str(&format!(" -x -a {}", single_quoted(&choices.join(" "))))
+                }
+                Values::Dynamic(kind) => spec.push_str(&format!(
+                    " -x -a '(km __complete {} 2>/dev/null)'",
+                    kind.name()
+                )),
+            }
+            out.push_str(&format!(
+                "complete -c km {}{} -d {}\n",
+                at,
+                spec,
+                single_quoted(&opt.help)
+            ));
+        }
+        if node.subcommands.is_empty() {
+            for (index, values) in node.positionals.iter().enumerate() {
+                let condition = format!("-n '__km_arg \"{}\" {}'", node.path, index);
+                let action = match values {
+                    Values::Path => "-F".to_string(),
+                    Values::Choices(choices) => format!("-a {}", single_quoted(&choices.join(" "))),
+                    Values::Dynamic(kind) => {
+                        format!("-a '(km __complete {} 2>/dev/null)'", kind.name())
+                    }
+                    _ => continue,
+                };
+                out.push_str(&format!("complete -c km {} {}\n", condition, action));
+            }
+        }
+    }
+    out
+}
+
+fn powershell_list(items: &[String]) -> String {
+    let quoted: Vec<String> = items
+        .iter()
+        .map(|i| format!("'{}'", i.replace('\'', "''")))
+        .collect();
+    format!("@({})", quoted.join(", "))
+}
+
+fn powershell_values(values: &Values) -> Option<String> {
+    match values {
+        Values::Choices(choices) => Some(powershell_list(choices)),
+        Values::Dynamic(kind) => Some(format!("@(km __complete {} 2>$null)", kind.name())),
+        _ => None,
+    }
+}
+
+fn powershell(nodes: &[Node]) -> String {
+    let mut out = String::new();
+    out.push_str("# PowerShell completion for km; generated by `km completion powershell`\n");
+    out.push_str("Register-ArgumentCompleter -Native -CommandName km -ScriptBlock {\n");
+    out.push_str("    param($wordToComplete, $commandAst, $cursorPosition)\n\n");
+    out.push_str(&format!(
+        "    $valueOptions = {}\n",
+        powershell_list(&value_options(nodes))
+    ));
+    let transitions: Vec<String> = nodes.iter().skip(1).map(|n| n.path.clone()).collect();
+    out.push_str(&format!(
+        "    $commands = {}\n",
+        powershell_list(&transitions)
+    ));
+    out.push_str("    $words = @($commandAst.CommandElements | Where-Object { $_.Extent.StartOffset -lt $cursorPosition } | ForEach-Object { $_.ToString() })\n");
+    out.push_str(
+        "    if ($wordToComplete -ne '') { $words = @($words | Select-Object -SkipLast 1) }\n",
+    );
+    out.push_str("    $path = 'km'; $npos = 0; $prev = ''\n");
+    out.push_str("    foreach ($word in ($words | Select-Object -Skip 1)) {\n");
+    out.push_str("        if ($word -eq '--') { return }\n");
+    out.push_str(
+        "        if (-not $word.StartsWith('-') -and $valueOptions -notcontains $prev) {\n",
+    );
+    out.push_str("            if ($commands -contains \"$path $word\") { $path = \"$path $word\"; $npos = 0 } else { $npos++ }\n");
+    out.push_str("        }\n        $prev = $word\n    }\n\n");
+    out.push_str("    $candidates = $null\n");
+
+    let mut branches = Vec::new();
+    for node in nodes {
+        let at = format!("$path -eq '{}'", node.path);
+        for opt in node.options.iter().filter(|o| o.values != Values::None) {
+            let condition = format!(
+                "{} -and {} -contains $prev",
+                at,
+                powershell_list(&opt.names)
+            );
+            let action = match powershell_values(&opt.values) {
+                Some(values) => format!("$candidates = {}", values),
+                // Let PowerShell complete paths
+                None => "return".to_string(),
+            };
+            branches.push((condition, action));
+        }
+        let flags: Vec<String> = node.options.iter().flat_map(|o| o.names.clone()).collect();
+        branches.push((
+            format!("{} -and $wordToComplete.StartsWith('-')", at),
+            format!("$candidates = {}", powershell_list(&flags)),
+        ));
+        if !node.subcommands.is_empty() {
+            let names: Vec<String> = node.subcommands.iter().map(|(n, _)| n.clone()).collect();
+            branches.push((
+                at.clone(),
+                format!("$candidates = {}", powershell_list(&names)),
+            ));
+        } else {
+            for (index, values) in node.positionals.iter().enumerate() {
+                if let Some(values) = powershell_values(values) {
+                    branches.push((
+                        format!("{} -and $npos -eq {}", at, index),
+                        format!("$candidates = {}", values),
+                    ));
+                }
+            }
+        }
+    }
+    for (i, (condition, action)) in branches.iter().enumerate() {
+        let keyword = if i == 0 { "if" } else { "elseif" };
+        out.push_str(&format!(
+            "    {} ({}) {{ {} }}\n",
+            keyword, condition, action
+        ));
+    }
+    out.push_str(
+        "\n    $candidates | Where-Object { $_ -like \"$wordToComplete*\" } | ForEach-Object {\n",
+    );
+    out.push_str("        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)\n");
+    out.push_str("    }\n}\n");
+    out
+}
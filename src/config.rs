@@ -1,14 +1,468 @@
 use anyhow::{Context, Result};
 use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::fmt;
 use std::fs;
 use std::path::Path;
+use std::sync::OnceLock;
+
+use crate::alerts::AlertsConfig;
+use crate::audit::DecisionLogConfig;
+use crate::breaker::{BreakerConfig, RetryConfig};
+use crate::clock::ClockConfig;
+use crate::config_schema;
+use crate::costs::CostConfig;
+use crate::credentials;
+use crate::dedup::DedupConfig;
+use crate::encryption::EncryptionConfig;
+use crate::entitlements::EntitlementSettings;
+use crate::errors::{Code, KmError};
+use crate::http::{HttpConfig, HttpOptions};
+use crate::i18n::Lang;
+use crate::logging::LoggingConfig;
+use crate::payloads::PayloadConfig;
+use crate::plugins::health::FailurePolicy;
+use crate::plugins::sandbox::PluginSandboxConfig;
+use crate::plugins::verify::TrustedKeys;
+use crate::policy::{Policy, PolicyConfig};
+use crate::presets::CapturePreset;
+use crate::redaction::{RedactionConfig, Redactor};
+use crate::remote_config::{self, RemoteConfigSettings};
+use crate::retention::RetentionConfig;
+use crate::risk::provider::RISK_PROVIDERS;
+use crate::risk::rules::RiskRulesConfig;
+use crate::risk::DEFAULT_SCAN_BUDGET;
+use crate::sampling::SamplingConfig;
+use crate::server_env::ServerEnvConfig;
+use crate::sinks::SinkConfig;
+use crate::update::Channel;
+
+pub const DEFAULT_BATCH_SIZE: usize = 100;
+pub const DEFAULT_BATCH_TIMEOUT_SECS: u64 = 5;
+pub const DEFAULT_MAX_BATCH_BYTES: usize = 1024 * 1024;
+pub const DEFAULT_UPLOAD_CONCURRENCY: usize = 4;
+pub const DEFAULT_QUEUE_SIZE: usize = 10_000;
+pub const DEFAULT_QUEUE_WAIT_MS: u64 = 1000;
+pub const LOG_LEVELS: &[&str] = &["error", "warn", "info", "debug", "trace"];
+/// Selects a profile when --profile isn't given
+pub const PROFILE_ENV: &str = "KM_PROFILE";
+
+/// Profile chosen with --profile for this run
+static SELECTED_PROFILE: OnceLock<String> = OnceLock::new();
+
+/// Use the profile `name` for the rest of this run (the --profile flag).
+pub fn select_profile(name: String) {
+    let _ = SELECTED_PROFILE.set(name);
+}
+
+/// The profile selected with --profile or KM_PROFILE, if any.
+pub fn active_profile() -> Option<String> {
+    SELECTED_PROFILE
+        .get()
+        .cloned()
+        .or_else(|| std::env::var(PROFILE_ENV).ok())
+        .filter(|p| !p.is_empty())
+}
+
+/// Version of the config file format this km writes. Files without a
+/// `version` predate versioning and are version 1.
+pub const CONFIG_VERSION: u32 = 1;
+
+/// Upgrades a config file from one format version to the next, in place.
+pub type Migration = fn(&mut Value) -> Result<()>;
+
+/// Step `i` upgrades version `i + 1` files to version `i + 2`. When a
+/// setting is renamed or reshaped, bump `CONFIG_VERSION` and add the step
+/// here, so files written by older km (and bundles made with it) still load.
+const MIGRATIONS: &[Migration] = &[];
+
+/// Settings that can be read and written with `km config get/set`.
+pub const CONFIG_KEYS: &[&str] = &[
+    "api_key",
+    "api_url",
+    "default_tier",
+    "log_level",
+    "language",
+    "offline",
+    "logging.file",
+    "logging.max_file_mb",
+    "logging.max_age_hours",
+    "logging.max_files",
+    "batch_size",
+    "batch_timeout",
+    "max_batch_bytes",
+    "compress_uploads",
+    "upload_concurrency",
+    "queue_size",
+    "queue_wait_ms",
+    "method_whitelist",
+    "payload_size_limit",
+    "capture_pings",
+    "payloads.truncate_bytes",
+    "payloads.blob_threshold_bytes",
+    "payloads.blob_dir",
+    "payloads.blob_url",
+    "payloads.blob_region",
+    "encryption.enabled",
+    "encryption.key_source",
+    "retention.max_age_days",
+    "retention.max_size_mb",
+    "retention.max_sessions",
+    "decision_log.enabled",
+    "decision_log.dir",
+    "clock.ntp",
+    "clock.ntp_server",
+    "risk_scan_budget",
+    "risk_providers",
+    "risk_rules.dir",
+    "risk_rules.disabled",
+    "redaction.enabled",
+    "redaction.builtin_patterns",
+    "policies.mode",
+    "policies.default_action",
+    "sampling.rate",
+    "sampling.always_keep_risk",
+    "sampling.keep_errors",
+    "retry.retries",
+    "retry.backoff_base_ms",
+    "retry.backoff_max_ms",
+    "circuit_breaker.failure_threshold",
+    "circuit_breaker.open_secs",
+    "circuit_breaker.half_open_probes",
+    "plugin_trusted_keys",
+    "allow_unsigned_plugins",
+    "plugin_sandbox.call_timeout_ms",
+    "plugin_sandbox.cpu_seconds",
+    "plugin_sandbox.memory_mb",
+    "plugin_sandbox.restrict_filesystem",
+    "plugin_sandbox.wasm_fuel",
+    "plugin_sandbox.max_lag",
+    "plugin_sandbox.health_interval_secs",
+    "plugin_sandbox.max_restarts",
+    "http.proxy",
+    "http.no_proxy",
+    "http.ca_bundle",
+    "http.client_cert",
+    "http.client_key",
+    "http.insecure_skip_verify",
+    "update_channel",
+    "update_url",
+    "update_trusted_keys",
+    "remote_config.source",
+    "remote_config.trusted_keys",
+    "remote_config.refresh_minutes",
+    "entitlements.revalidate_minutes",
+    "entitlements.offline_grace_hours",
+    "entitlements.trusted_keys",
+];
 
 #[derive(Debug, Serialize, Deserialize)]
 pub struct Config {
+    /// JSON Schema editors check the file against (see `km config schema`)
+    #[serde(rename = "$schema", default, skip_serializing_if = "Option::is_none")]
+    pub schema: Option<String>,
+    /// Format version of the file; older files are migrated when loaded
+    #[serde(default = "first_config_version")]
+    pub version: u32,
     pub api_key: String,
     pub api_url: String,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub default_tier: Option<String>,
+    /// Log level used when no -v flag is given
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub log_level: Option<String>,
+    /// Language of `km doctor` and `km ctl status` output; KM_LANG overrides it
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub language: Option<Lang>,
+    /// Air-gapped mode: no API calls, plugin downloads or update checks
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub offline: bool,
+    /// The JSON log file, its rotation, and levels for parts of km
+    #[serde(default, skip_serializing_if = "LoggingConfig::is_default")]
+    pub logging: LoggingConfig,
+    /// Maximum number of MCP events per upload
+    #[serde(
+        default = "default_batch_size",
+        skip_serializing_if = "is_default_batch_size"
+    )]
+    pub batch_size: usize,
+    /// Seconds to wait before uploading a partial batch
+    #[serde(
+        default = "default_batch_timeout",
+        skip_serializing_if = "is_default_batch_timeout"
+    )]
+    pub batch_timeout: u64,
+    /// Largest upload body in bytes (before compression); bigger batches are split
+    #[serde(
+        default = "default_max_batch_bytes",
+        skip_serializing_if = "is_default_max_batch_bytes"
+    )]
+    pub max_batch_bytes: usize,
+    /// Gzip upload bodies
+    #[serde(
+        default = "default_compress_uploads",
+        skip_serializing_if = "is_default_compress_uploads"
+    )]
+    pub compress_uploads: bool,
+    /// Batches uploaded at once; capture carries on while they're in flight
+    #[serde(
+        default = "default_upload_concurrency",
+        skip_serializing_if = "is_default_upload_concurrency"
+    )]
+    pub upload_concurrency: usize,
+    /// Captured events held in memory while the uploader catches up
+    #[serde(
+        default = "default_queue_size",
+        skip_serializing_if = "is_default_queue_size"
+    )]
+    pub queue_size: usize,
+    /// Milliseconds the proxy waits for room in a full queue before dropping an event
+    #[serde(
+        default = "default_queue_wait_ms",
+        skip_serializing_if = "is_default_queue_wait_ms"
+    )]
+    pub queue_wait_ms: u64,
+    /// Only capture methods matching these patterns (e.g. tools/*); empty captures everything
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub method_whitelist: Vec<String>,
+    /// Upload events without their payload when it is larger than this many bytes
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload_size_limit: Option<usize>,
+    /// Capture, log and upload pings like any other message instead of only counting them
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub capture_pings: bool,
+    /// Capture presets for `km monitor --preset`, besides the built-in ones
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub presets: BTreeMap<String, CapturePreset>,
+    /// Truncation and blob storage for large payloads in uploaded events
+    #[serde(default, skip_serializing_if = "PayloadConfig::is_default")]
+    pub payloads: PayloadConfig,
+    /// Encryption of payloads stored on this machine
+    #[serde(default, skip_serializing_if = "EncryptionConfig::is_default")]
+    pub encryption: EncryptionConfig,
+    /// How much captured traffic is kept on this machine
+    #[serde(default, skip_serializing_if = "RetentionConfig::is_default")]
+    pub retention: RetentionConfig,
+    /// Hash-chained log of the allow, block and redact decisions made about traffic
+    #[serde(default, skip_serializing_if = "DecisionLogConfig::is_default")]
+    pub decision_log: DecisionLogConfig,
+    /// NTP offset estimation for the timestamps of captured traffic
+    #[serde(default, skip_serializing_if = "ClockConfig::is_default")]
+    pub clock: ClockConfig,
+    /// Bytes of each payload scanned by local risk analysis; larger payloads get a partial score
+    #[serde(
+        default = "default_risk_scan_budget",
+        skip_serializing_if = "is_default_risk_scan_budget"
+    )]
+    pub risk_scan_budget: usize,
+    /// Risk scoring providers in fallback order (remote, heuristic, pattern); empty means pattern only
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub risk_providers: Vec<String>,
+    /// Rule packs of extra risk patterns
+    #[serde(default, skip_serializing_if = "RiskRulesConfig::is_default")]
+    pub risk_rules: RiskRulesConfig,
+    /// Notifications sent when captured messages match a rule
+    #[serde(default, skip_serializing_if = "AlertsConfig::is_default")]
+    pub alerts: AlertsConfig,
+    /// Where uploaded events also go: files, S3 buckets, Kafka topics, webhooks
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub sinks: Vec<SinkConfig>,
+    /// Which of km's environment variables MCP servers inherit
+    #[serde(default, skip_serializing_if = "ServerEnvConfig::is_default")]
+    pub server_env: ServerEnvConfig,
+    #[serde(default, skip_serializing_if = "RedactionConfig::is_default")]
+    pub redaction: RedactionConfig,
+    /// Rules that allow, deny or rewrite requests before they reach the server
+    #[serde(default, skip_serializing_if = "PolicyConfig::is_default")]
+    pub policies: PolicyConfig,
+    /// Which captured events are uploaded; the local traffic log keeps everything
+    #[serde(default, skip_serializing_if = "SamplingConfig::is_default")]
+    pub sampling: SamplingConfig,
+    /// Repeated notifications collapsed into one uploaded event
+    #[serde(default, skip_serializing_if = "DedupConfig::is_default")]
+    pub dedup: DedupConfig,
+    /// Prices of the models MCP servers sample from
+    #[serde(default, skip_serializing_if = "CostConfig::is_default")]
+    pub costs: CostConfig,
+    /// Retries of uploads the API throttles
+    #[serde(default, skip_serializing_if = "RetryConfig::is_default")]
+    pub retry: RetryConfig,
+    /// When uploads stop after repeated API failures, and how they resume
+    #[serde(default, skip_serializing_if = "BreakerConfig::is_default")]
+    pub circuit_breaker: BreakerConfig,
+    /// Plugins held at a specific version by `km plugins install name@version`
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub plugin_pins: BTreeMap<String, String>,
+    /// Plugin chain order: higher values run first, unlisted plugins are 0
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub plugin_priorities: BTreeMap<String, i32>,
+    /// What happens to requests while a plugin is down; unlisted plugins fail open
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub plugin_failure_policies: BTreeMap<String, FailurePolicy>,
+    /// Base64 Ed25519 public keys accepted for plugin signatures
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub plugin_trusted_keys: Vec<String>,
+    /// Run installed plugins that weren't signed by a trusted key
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub allow_unsigned_plugins: bool,
+    #[serde(default, skip_serializing_if = "PluginSandboxConfig::is_default")]
+    pub plugin_sandbox: PluginSandboxConfig,
+    /// Settings handed to plugins, keyed by plugin name
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub plugin_config: BTreeMap<String, Value>,
+    /// Proxy and TLS settings for the API, risk scoring and plugin downloads
+    #[serde(default, skip_serializing_if = "HttpConfig::is_default")]
+    pub http: HttpConfig,
+    /// Releases `km update` installs
+    #[serde(default, skip_serializing_if = "is_default_update_channel")]
+    pub update_channel: Channel,
+    /// Release list to update from instead of GitHub (a Kilometers update endpoint)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub update_url: Option<String>,
+    /// Base64 Ed25519 public keys; when set, `km update` only installs releases they signed
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub update_trusted_keys: Vec<String>,
+    /// A signed layer of team settings, applied below this file
+    #[serde(default, skip_serializing_if = "RemoteConfigSettings::is_default")]
+    pub remote_config: RemoteConfigSettings,
+    /// How the plan's features are checked again and trusted offline
+    #[serde(default, skip_serializing_if = "EntitlementSettings::is_default")]
+    pub entitlements: EntitlementSettings,
+    /// Named sets of settings that override the ones above (e.g. staging)
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub profiles: BTreeMap<String, Value>,
+}
+
+fn first_config_version() -> u32 {
+    1
+}
+
+fn default_batch_size() -> usize {
+    DEFAULT_BATCH_SIZE
+}
+
+fn is_default_batch_size(value: &usize) -> bool {
+    *value == DEFAULT_BATCH_SIZE
+}
+
+fn default_batch_timeout() -> u64 {
+    DEFAULT_BATCH_TIMEOUT_SECS
+}
+
+fn is_default_batch_timeout(value: &u64) -> bool {
+    *value == DEFAULT_BATCH_TIMEOUT_SECS
+}
+
+fn default_max_batch_bytes() -> usize {
+    DEFAULT_MAX_BATCH_BYTES
+}
+
+fn is_default_max_batch_bytes(value: &usize) -> bool {
+    *value == DEFAULT_MAX_BATCH_BYTES
+}
+
+fn default_compress_uploads() -> bool {
+    true
+}
+
+fn is_default_compress_uploads(value: &bool) -> bool {
+    *value
+}
+
+fn default_upload_concurrency() -> usize {
+    DEFAULT_UPLOAD_CONCURRENCY
+}
+
+fn is_default_upload_concurrency(value: &usize) -> bool {
+    *value == DEFAULT_UPLOAD_CONCURRENCY
+}
+
+fn default_queue_size() -> usize {
+    DEFAULT_QUEUE_SIZE
+}
+
+fn is_default_queue_size(value: &usize) -> bool {
+    *value == DEFAULT_QUEUE_SIZE
+}
+
+fn default_queue_wait_ms() -> u64 {
+    DEFAULT_QUEUE_WAIT_MS
+}
+
+fn is_default_queue_wait_ms(value: &u64) -> bool {
+    *value == DEFAULT_QUEUE_WAIT_MS
+}
+
+fn default_risk_scan_budget() -> usize {
+    DEFAULT_SCAN_BUDGET
+}
+
+fn is_default_risk_scan_budget(value: &usize) -> bool {
+    *value == DEFAULT_SCAN_BUDGET
+}
+
+fn is_default_update_channel(value: &Channel) -> bool {
+    *value == Channel::default()
+}
+
+impl Default for Config {
+    fn default() -> Self {
+        Self {
+            schema: None,
+            version: CONFIG_VERSION,
+            api_key: String::new(),
+            api_url: String::new(),
+            default_tier: None,
+            log_level: None,
+            language: None,
+            offline: false,
+            logging: LoggingConfig::default(),
+            batch_size: DEFAULT_BATCH_SIZE,
+            batch_timeout: DEFAULT_BATCH_TIMEOUT_SECS,
+            max_batch_bytes: DEFAULT_MAX_BATCH_BYTES,
+            compress_uploads: true,
+            upload_concurrency: DEFAULT_UPLOAD_CONCURRENCY,
+            queue_size: DEFAULT_QUEUE_SIZE,
+            queue_wait_ms: DEFAULT_QUEUE_WAIT_MS,
+            method_whitelist: Vec::new(),
+            payload_size_limit: None,
+            capture_pings: false,
+            presets: BTreeMap::new(),
+            payloads: PayloadConfig::default(),
+            encryption: EncryptionConfig::default(),
+            retention: RetentionConfig::default(),
+            decision_log: DecisionLogConfig::default(),
+            clock: ClockConfig::default(),
+            risk_scan_budget: DEFAULT_SCAN_BUDGET,
+            risk_providers: Vec::new(),
+            risk_rules: RiskRulesConfig::default(),
+            alerts: AlertsConfig::default(),
+            sinks: Vec::new(),
+            server_env: ServerEnvConfig::default(),
+            redaction: RedactionConfig::default(),
+            policies: PolicyConfig::default(),
+            sampling: SamplingConfig::default(),
+            dedup: DedupConfig::default(),
+            costs: CostConfig::default(),
+            retry: RetryConfig::default(),
+            circuit_breaker: BreakerConfig::default(),
+            plugin_pins: BTreeMap::new(),
+            plugin_priorities: BTreeMap::new(),
+            plugin_failure_policies: BTreeMap::new(),
+            plugin_trusted_keys: Vec::new(),
+            allow_unsigned_plugins: false,
+            plugin_sandbox: PluginSandboxConfig::default(),
+            plugin_config: BTreeMap::new(),
+            http: HttpConfig::default(),
+            update_channel: Channel::default(),
+            update_url: None,
+            update_trusted_keys: Vec::new(),
+            remote_config: RemoteConfigSettings::default(),
+            entitlements: EntitlementSettings::default(),
+            profiles: BTreeMap::new(),
+        }
+    }
 }
 
 #[derive(Debug, Deserialize)]
@@ -19,10 +473,34 @@ pub struct ConfigEnv {
 }
 
 impl Config {
+    /// The config file as written, without the remote layer.
     pub fn load(path: &Path) -> Result<Self> {
-        let contents = fs::read_to_string(path).context("Failed to read config file")?;
+        parse(read_file(path)?)
+    }
 
-        serde_json::from_str(&contents).context("Failed to parse config file")
+    /// The config file at `path` over the cached remote config layer it
+    /// names, if any: settings in the file win over the layer's.
+    pub fn load_layered(path: &Path) -> Result<Self> {
+        let file = read_file(path)?;
+        let config = parse(file.clone())?;
+        let Some(layer) = remote_config::cached_layer(path, &config.remote_config, &config.api_url)
+        else {
+            return Ok(config);
+        };
+        let mut merged = layer.settings;
+        merge_json(&mut merged, &file);
+        match serde_json::from_value(merged) {
+            Ok(layered) => Ok(layered),
+            // A bad layer mustn't lock the user out of km
+            Err(e) => {
+                tracing::warn!(
+                    "Ignoring the remote config layer from {}: {}",
+                    layer.source,
+                    e
+                );
+                Ok(config)
+            }
+        }
     }
 
     pub fn load_with_env(path: &Path) -> Result<Self> {
@@ -41,13 +519,16 @@ impl Config {
 
         // Try to load base config from JSON file, or create from env vars
         let mut config = if path.exists() {
-            Self::load(path)?
+            Self::load_layered(path)?
         } else if let Some(ref env) = env_config {
             // Create config from environment variables if file doesn't exist
             let api_key = env
                 .km_api_key
                 .as_ref()
-                .context("No config file found and KM_API_KEY not set")?
+                .context(KmError::new(
+                    Code::ConfigNotFound,
+                    "No config file found and KM_API_KEY not set",
+                ))?
                 .clone();
             let api_url = env
                 .km_api_url
@@ -58,13 +539,20 @@ impl Config {
                 api_key,
                 api_url,
                 default_tier: env.km_default_tier.clone(),
+                ..Default::default()
             }
         } else {
-            return Err(anyhow::anyhow!(
-                "No config file found and no environment variables set"
-            ));
+            return Err(KmError::new(
+                Code::ConfigNotFound,
+                "No config file found and no environment variables set",
+            )
+            .into());
         };
 
+        if let Some(profile) = active_profile() {
+            config = config.with_profile(Some(&profile))?;
+        }
+
         // Override config file values with environment variables if present
         if let Some(env_config) = env_config {
             if let Some(api_key) = env_config.km_api_key {
@@ -78,26 +566,906 @@ impl Config {
             }
         }
 
+        // The API key normally lives in the credential store, not the file
+        if config.api_key.is_empty() && path.exists() {
+            if let Some(api_key) = credentials::load_api_key(path, active_profile().as_deref()) {
+                config.api_key = api_key;
+            }
+        }
+
         Ok(config)
     }
 
     pub fn save(&self, path: &Path) -> Result<()> {
         let contents = serde_json::to_string_pretty(self).context("Failed to serialize config")?;
 
-        fs::write(path, contents).context("Failed to write config file")?;
+        // Write to a sibling file and rename so a failed write never leaves a
+        // half-written config behind
+        let file_name = path
+            .file_name()
+            .context("Config path has no file name")?
+            .to_string_lossy();
+        let tmp_path = path.with_file_name(format!(".{}.tmp", file_name));
+        fs::write(&tmp_path, contents).context("Failed to write config file")?;
+        fs::rename(&tmp_path, path).context("Failed to write config file")?;
 
         Ok(())
     }
 
+    /// Read a setting by key (see `CONFIG_KEYS`). Unset optional values are
+    /// returned as an empty string.
+    pub fn get(&self, key: &str) -> Result<String> {
+        let value = match key {
+            "api_key" => self.api_key.clone(),
+            "api_url" => self.api_url.clone(),
+            "default_tier" => self.default_tier.clone().unwrap_or_default(),
+            "log_level" => self.log_level.clone().unwrap_or_default(),
+            "language" => self.language.map(|l| l.to_string()).unwrap_or_default(),
+            "offline" => self.offline.to_string(),
+            "logging.file" => self.logging.file.to_string(),
+            "logging.max_file_mb" => self.logging.max_file_mb.to_string(),
+            "logging.max_age_hours" => self.logging.max_age_hours.to_string(),
+            "logging.max_files" => self.logging.max_files.to_string(),
+            "batch_size" => self.batch_size.to_string(),
+            "batch_timeout" => self.batch_timeout.to_string(),
+            "max_batch_bytes" => self.max_batch_bytes.to_string(),
+            "compress_uploads" => self.compress_uploads.to_string(),
+            "upload_concurrency" => self.upload_concurrency.to_string(),
+            "queue_size" => self.queue_size.to_string(),
+            "queue_wait_ms" => self.queue_wait_ms.to_string(),
+            "method_whitelist" => self.method_whitelist.join(","),
+            "payload_size_limit" => self
+                .payload_size_limit
+                .map(|l| l.to_string())
+                .unwrap_or_default(),
+            "capture_pings" => self.capture_pings.to_string(),
+            "payloads.truncate_bytes" => self
+                .payloads
+                .truncate_bytes
+                .map(|b| b.to_string())
+                .unwrap_or_default(),
+            "payloads.blob_threshold_bytes" => self
+                .payloads
+                .blob_threshold_bytes
+                .map(|b| b.to_string())
+                .unwrap_or_default(),
+            "payloads.blob_dir" => self.payloads.blob_dir.clone().unwrap_or_default(),
+            "payloads.blob_url" => self.payloads.blob_url.clone().unwrap_or_default(),
+            "payloads.blob_region" => self.payloads.blob_region.clone().unwrap_or_default(),
+            "encryption.enabled" => self.encryption.enabled.to_string(),
+            "encryption.key_source" => enum_name(&self.encryption.key_source),
+            "retention.max_age_days" => self
+                .retention
+                .max_age_days
+                .map(|d| d.to_string())
+                .unwrap_or_default(),
+            "retention.max_size_mb" => self
+                .retention
+                .max_size_mb
+                .map(|m| m.to_string())
+                .unwrap_or_default(),
+            "retention.max_sessions" => self
+                .retention
+                .max_sessions
+                .map(|n| n.to_string())
+                .unwrap_or_default(),
+            "decision_log.enabled" => self.decision_log.enabled.to_string(),
+            "decision_log.dir" => self.decision_log.dir.clone().unwrap_or_default(),
+            "clock.ntp" => self.clock.ntp.to_string(),
+            "clock.ntp_server" => self.clock.ntp_server.clone(),
+            "risk_scan_budget" => self.risk_scan_budget.to_string(),
+            "risk_providers" => self.risk_providers.join(","),
+            "risk_rules.dir" => self.risk_rules.dir.clone().unwrap_or_default(),
+            "risk_rules.disabled" => self.risk_rules.disabled.join(","),
+            "redaction.enabled" => self.redaction.enabled.to_string(),
+            "redaction.builtin_patterns" => self.redaction.builtin_patterns.to_string(),
+            "policies.mode" => enum_name(&self.policies.mode),
+            "policies.default_action" => enum_name(&self.policies.default_action),
+            "sampling.rate" => self.sampling.rate.to_string(),
+            "sampling.always_keep_risk" => self.sampling.always_keep_risk.to_string(),
+            "sampling.keep_errors" => self.sampling.keep_errors.to_string(),
+            "retry.retries" => self.retry.retries.to_string(),
+            "retry.backoff_base_ms" => self.retry.backoff_base_ms.to_string(),
+            "retry.backoff_max_ms" => self.retry.backoff_max_ms.to_string(),
+            "circuit_breaker.failure_threshold" => {
+                self.circuit_breaker.failure_threshold.to_string()
+            }
+            "circuit_breaker.open_secs" => self.circuit_breaker.open_secs.to_string(),
+            "circuit_breaker.half_open_probes" => self.circuit_breaker.half_open_probes.to_string(),
+            "plugin_trusted_keys" => self.plugin_trusted_keys.join(","),
+            "allow_unsigned_plugins" => self.allow_unsigned_plugins.to_string(),
+            "plugin_sandbox.call_timeout_ms" => self.plugin_sandbox.call_timeout_ms.to_string(),
+            "plugin_sandbox.cpu_seconds" => self
+                .plugin_sandbox
+                .cpu_seconds
+                .map(|s| s.to_string())
+                .unwrap_or_default(),
+            "plugin_sandbox.memory_mb" => self
+                .plugin_sandbox
+                .memory_mb
+                .map(|m| m.to_string())
+                .unwrap_or_default(),
+            "plugin_sandbox.restrict_filesystem" => {
+                self.plugin_sandbox.restrict_filesystem.to_string()
+            }
+            "plugin_sandbox.wasm_fuel" => self.plugin_sandbox.wasm_fuel.to_string(),
+            "plugin_sandbox.max_lag" => self.plugin_sandbox.max_lag.to_string(),
+            "plugin_sandbox.health_interval_secs" => {
+                self.plugin_sandbox.health_interval_secs.to_string()
+            }
+            "plugin_sandbox.max_restarts" => self.plugin_sandbox.max_restarts.to_string(),
+            "http.proxy" => self.http.proxy.clone().unwrap_or_default(),
+            "http.no_proxy" => self.http.no_proxy.clone().unwrap_or_default(),
+            "http.ca_bundle" => self.http.ca_bundle.clone().unwrap_or_default(),
+            "http.client_cert" => self.http.client_cert.clone().unwrap_or_default(),
+            "http.client_key" => self.http.client_key.clone().unwrap_or_default(),
+            "http.insecure_skip_verify" => self.http.insecure_skip_verify.to_string(),
+            "update_channel" => self.update_channel.to_string(),
+            "update_url" => self.update_url.clone().unwrap_or_default(),
+            "update_trusted_keys" => self.update_trusted_keys.join(","),
+            "remote_config.source" => self.remote_config.source.clone().unwrap_or_default(),
+            "remote_config.trusted_keys" => self.remote_config.trusted_keys.join(","),
+            "remote_config.refresh_minutes" => self.remote_config.refresh_minutes.to_string(),
+            "entitlements.revalidate_minutes" => self.entitlements.revalidate_minutes.to_string(),
+            "entitlements.offline_grace_hours" => self.entitlements.offline_grace_hours.to_string(),
+            "entitlements.trusted_keys" => self.entitlements.trusted_keys.join(","),
+            other => return Err(unknown_key(other)),
+        };
+        Ok(value)
+    }
+
+    /// Update a setting from its string form. An empty value clears
+    /// optional settings.
+    pub fn set(&mut self, key: &str, value: &str) -> Result<()> {
+        let value = value.trim();
+        let optional = |v: &str| (!v.is_empty()).then(|| v.to_string());
+        let number = |v: &str| -> Result<u64> {
+            v.parse::<u64>()
+                .with_context(|| format!("'{}' expects a number, got '{}'", key, v))
+        };
+        let list = |v: &str| -> Vec<String> {
+            v.split(',')
+                .map(|item| item.trim().to_string())
+                .filter(|item| !item.is_empty())
+                .collect()
+        };
+        let boolean = |v: &str| -> Result<bool> {
+            match v.to_ascii_lowercase().as_str() {
+                "true" | "yes" | "on" | "1" => Ok(true),
+                "false" | "no" | "off" | "0" => Ok(false),
+                _ => Err(anyhow::anyhow!(
+                    "'{}' expects true or false, got '{}'",
+                    key,
+                    v
+                )),
+            }
+        };
+
+        match key {
+            "api_key" => self.api_key = value.to_string(),
+            "api_url" => self.api_url = value.trim_end_matches('/').to_string(),
+            "default_tier" => self.default_tier = optional(value),
+            "log_level" => self.log_level = optional(value).map(|l| l.to_ascii_lowercase()),
+            "language" => {
+                self.language = optional(value).map(|l| parse_enum(key, &l)).transpose()?
+            }
+            "offline" => self.offline = boolean(value)?,
+            "logging.file" => self.logging.file = boolean(value)?,
+            "logging.max_file_mb" => self.logging.max_file_mb = number(value)?,
+            "logging.max_age_hours" => self.logging.max_age_hours = number(value)?,
+            "logging.max_files" => self.logging.max_files = number(value)? as usize,
+            "batch_size" => self.batch_size = number(value)? as usize,
+            "batch_timeout" => self.batch_timeout = number(value)?,
+            "max_batch_bytes" => self.max_batch_bytes = number(value)? as usize,
+            "compress_uploads" => self.compress_uploads = boolean(value)?,
+            "upload_concurrency" => self.upload_concurrency = number(value)? as usize,
+            "queue_size" => self.queue_size = number(value)? as usize,
+            "queue_wait_ms" => self.queue_wait_ms = number(value)?,
+            "method_whitelist" => self.method_whitelist = list(value),
+            "payload_size_limit" => {
+                self.payload_size_limit = match value {
+                    "" => None,
+                    v => Some(number(v)? as usize),
+                }
+            }
+            "capture_pings" => self.capture_pings = boolean(value)?,
+            "payloads.truncate_bytes" => {
+                self.payloads.truncate_bytes = match value {
+                    "" => None,
+                    v => Some(number(v)? as usize),
+                }
+            }
+            "payloads.blob_threshold_bytes" => {
+                self.payloads.blob_threshold_bytes = match value {
+                    "" => None,
+                    v => Some(number(v)? as usize),
+                }
+            }
+            "payloads.blob_dir" => self.payloads.blob_dir = optional(value),
+            "payloads.blob_url" => {
+                self.payloads.blob_url =
+                    optional(value).map(|u| u.trim_end_matches('/').to_string())
+            }
+            "payloads.blob_region" => self.payloads.blob_region = optional(value),
+            "encryption.enabled" => self.encryption.enabled = boolean(value)?,
+            "encryption.key_source" => self.encryption.key_source = parse_enum(key, value)?,
+            "retention.max_age_days" => {
+                self.retention.max_age_days = match value {
+                    "" => None,
+                    v => Some(number(v)?),
+                }
+            }
+            "retention.max_size_mb" => {
+                self.retention.max_size_mb = match value {
+                    "" => None,
+                    v => Some(number(v)?),
+                }
+            }
+            "retention.max_sessions" => {
+                self.retention.max_sessions = match value {
+                    "" => None,
+                    v => Some(number(v)? as usize),
+                }
+            }
+            "decision_log.enabled" => self.decision_log.enabled = boolean(value)?,
+            "decision_log.dir" => self.decision_log.dir = optional(value),
+            "clock.ntp" => self.clock.ntp = boolean(value)?,
+            "clock.ntp_server" => {
+                self.clock.ntp_server = match value {
+                    "" => ClockConfig::default().ntp_server,
+                    v => v.to_string(),
+                }
+            }
+            "risk_scan_budget" => self.risk_scan_budget = number(value)? as usize,
+            "risk_providers" => {
+                self.risk_providers = list(value)
+                    .into_iter()
+                    .map(|p| p.to_ascii_lowercase())
+                    .collect()
+            }
+            "risk_rules.dir" => self.risk_rules.dir = optional(value),
+            "risk_rules.disabled" => self.risk_rules.disabled = list(value),
+            "redaction.enabled" => self.redaction.enabled = boolean(value)?,
+            "redaction.builtin_patterns" => self.redaction.builtin_patterns = boolean(value)?,
+            "policies.mode" => self.policies.mode = parse_enum(key, value)?,
+            "policies.default_action" => self.policies.default_action = parse_enum(key, value)?,
+            "sampling.rate" => {
+                self.sampling.rate = value
+                    .parse::<f64>()
+                    .with_context(|| format!("'{}' expects a number, got '{}'", key, value))?
+            }
+            "sampling.always_keep_risk" => self.sampling.always_keep_risk = value.parse()?,
+            "sampling.keep_errors" => self.sampling.keep_errors = boolean(value)?,
+            "retry.retries" => self.retry.retries = number(value)? as u32,
+            "retry.backoff_base_ms" => self.retry.backoff_base_ms = number(value)?,
+            "retry.backoff_max_ms" => self.retry.backoff_max_ms = number(value)?,
+            "circuit_breaker.failure_threshold" => {
+                self.circuit_breaker.failure_threshold = number(value)? as u32
+            }
+            "circuit_breaker.open_secs" => self.circuit_breaker.open_secs = number(value)?,
+            "circuit_breaker.half_open_probes" => {
+                self.circuit_breaker.half_open_probes = number(value)? as u32
+            }
+            "plugin_trusted_keys" => self.plugin_trusted_keys = list(value),
+            "allow_unsigned_plugins" => self.allow_unsigned_plugins = boolean(value)?,
+            "plugin_sandbox.call_timeout_ms" => {
+                self.plugin_sandbox.call_timeout_ms = number(value)?
+            }
+            "plugin_sandbox.cpu_seconds" => {
+                self.plugin_sandbox.cpu_seconds = match value {
+                    "" => None,
+                    v => Some(number(v)?),
+                }
+            }
+            "plugin_sandbox.memory_mb" => {
+                self.plugin_sandbox.memory_mb = match value {
+                    "" => None,
+                    v => Some(number(v)?),
+                }
+            }
+            "plugin_sandbox.restrict_filesystem" => {
+                self.plugin_sandbox.restrict_filesystem = boolean(value)?
+            }
+            "plugin_sandbox.wasm_fuel" => self.plugin_sandbox.wasm_fuel = number(value)?,
+            "plugin_sandbox.max_lag" => self.plugin_sandbox.max_lag = number(value)?,
+            "plugin_sandbox.health_interval_secs" => {
+                self.plugin_sandbox.health_interval_secs = number(value)?
+            }
+            "plugin_sandbox.max_restarts" => {
+                self.plugin_sandbox.max_restarts = number(value)? as u32
+            }
+            "http.proxy" => self.http.proxy = optional(value),
+            "http.no_proxy" => self.http.no_proxy = optional(value),
+            "http.ca_bundle" => self.http.ca_bundle = optional(value),
+            "http.client_cert" => self.http.client_cert = optional(value),
+            "http.client_key" => self.http.client_key = optional(value),
+            "http.insecure_skip_verify" => self.http.insecure_skip_verify = boolean(value)?,
+            "update_channel" => self.update_channel = parse_enum(key, value)?,
+            "update_url" => {
+                self.update_url = optional(value).map(|u| u.trim_end_matches('/').to_string())
+            }
+            "update_trusted_keys" => self.update_trusted_keys = list(value),
+            "remote_config.source" => {
+                self.remote_config.source =
+                    optional(value).map(|u| u.trim_end_matches('/').to_string())
+            }
+            "remote_config.trusted_keys" => self.remote_config.trusted_keys = list(value),
+            "remote_config.refresh_minutes" => self.remote_config.refresh_minutes = number(value)?,
+            "entitlements.revalidate_minutes" => {
+                self.entitlements.revalidate_minutes = number(value)?
+            }
+            "entitlements.offline_grace_hours" => {
+                self.entitlements.offline_grace_hours = number(value)?
+            }
+            "entitlements.trusted_keys" => self.entitlements.trusted_keys = list(value),
+            other => return Err(unknown_key(other)),
+        }
+
+        Ok(())
+    }
+
+    /// Check every setting and return a description of each problem found.
+    pub fn validate(&self) -> Vec<String> {
+        let mut problems = self.validate_settings();
+
+        // Only report what a profile breaks, not problems it inherits
+        for name in self.profiles.keys() {
+            match self.with_profile(Some(name)) {
+                Ok(profile) => problems.extend(
+                    profile
+                        .validate_settings()
+                        .into_iter()
+                        .filter(|p| !problems.contains(p))
+                        .map(|p| format!("profile '{}': {}", name, p))
+                        .collect::<Vec<_>>(),
+                ),
+                Err(e) => problems.push(format!("profile '{}': {:#}", name, e)),
+            }
+        }
+
+        problems
+    }
+
+    fn validate_settings(&self) -> Vec<String> {
+        let mut problems = Vec::new();
+
+        if self.api_key.trim().is_empty() {
+            problems.push("api_key must not be empty".to_string());
+        }
+        if !(self.api_url.starts_with("http://") || self.api_url.starts_with("https://")) {
+            problems.push(format!(
+                "api_url must start with http:// or https:// (got '{}')",
+                self.api_url
+            ));
+        }
+        if let Some(ref level) = self.log_level {
+            if !LOG_LEVELS.contains(&level.as_str()) {
+                problems.push(format!(
+                    "log_level must be one of {} (got '{}')",
+                    LOG_LEVELS.join(", "),
+                    level
+                ));
+            }
+        }
+        if !(1..=10_000).contains(&self.batch_size) {
+            problems.push(format!(
+                "batch_size must be between 1 and 10000 (got {})",
+                self.batch_size
+            ));
+        }
+        if !(1..=3600).contains(&self.batch_timeout) {
+            problems.push(format!(
+                "batch_timeout must be between 1 and 3600 seconds (got {})",
+                self.batch_timeout
+            ));
+        }
+        if !(1024..=100 * 1024 * 1024).contains(&self.max_batch_bytes) {
+            problems.push(format!(
+                "max_batch_bytes must be between 1024 and 104857600 (got {})",
+                self.max_batch_bytes
+            ));
+        }
+        if !(1..=16).contains(&self.upload_concurrency) {
+            problems.push(format!(
+                "upload_concurrency must be between 1 and 16 (got {})",
+                self.upload_concurrency
+            ));
+        }
+        if !(1..=1_000_000).contains(&self.queue_size) {
+            problems.push(format!(
+                "queue_size must be between 1 and 1000000 (got {})",
+                self.queue_size
+            ));
+        }
+        if self.queue_wait_ms > 60_000 {
+            problems.push(format!(
+                "queue_wait_ms must be at most 60000 (got {})",
+                self.queue_wait_ms
+            ));
+        }
+        if self.payload_size_limit == Some(0) {
+            problems.push("payload_size_limit must be greater than 0".to_string());
+        }
+        if self.risk_scan_budget == 0 {
+            problems.push("risk_scan_budget must be greater than 0".to_string());
+        }
+        for provider in &self.risk_providers {
+            if !RISK_PROVIDERS.contains(&provider.as_str()) {
+                problems.push(format!(
+                    "risk_providers entries must be one of {} (got '{}')",
+                    RISK_PROVIDERS.join(", "),
+                    provider
+                ));
+            }
+        }
+        if let Err(e) = self.risk_rules.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if self.method_whitelist.iter().any(|m| m.trim().is_empty()) {
+            problems.push("method_whitelist must not contain empty entries".to_string());
+        }
+        for (name, preset) in &self.presets {
+            if name.trim().is_empty() {
+                problems.push("presets must have a name".to_string());
+            } else if let Err(e) = preset.validate() {
+                problems.push(format!("preset '{}': {:#}", name, e));
+            }
+        }
+        if let Err(e) = self.server_env.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = Redactor::from_config(&self.redaction) {
+            problems.push(format!("redaction: {:#}", e));
+        }
+        if let Err(e) = Policy::from_config(&self.policies) {
+            problems.push(format!("policies: {:#}", e));
+        }
+        if let Err(e) = self.alerts.validate() {
+            problems.push(format!("alerts: {:#}", e));
+        }
+        for sink in &self.sinks {
+            if let Err(e) = sink.validate() {
+                problems.push(format!("sinks: {:#}", e));
+            }
+        }
+        if let Err(e) = self.payloads.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.sampling.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.dedup.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.costs.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.retry.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.circuit_breaker.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.logging.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.retention.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = TrustedKeys::from_config(&self.plugin_trusted_keys) {
+            problems.push(format!("{:#}", e));
+        }
+        if !(1..=60_000).contains(&self.plugin_sandbox.call_timeout_ms) {
+            problems.push(format!(
+                "plugin_sandbox.call_timeout_ms must be between 1 and 60000 (got {})",
+                self.plugin_sandbox.call_timeout_ms
+            ));
+        }
+        if self.plugin_sandbox.cpu_seconds == Some(0) {
+            problems.push("plugin_sandbox.cpu_seconds must be greater than 0".to_string());
+        }
+        if self.plugin_sandbox.memory_mb == Some(0) {
+            problems.push("plugin_sandbox.memory_mb must be greater than 0".to_string());
+        }
+        if self.plugin_sandbox.wasm_fuel == 0 {
+            problems.push("plugin_sandbox.wasm_fuel must be greater than 0".to_string());
+        }
+        if !(1..=1_000_000).contains(&self.plugin_sandbox.max_lag) {
+            problems.push(format!(
+                "plugin_sandbox.max_lag must be between 1 and 1000000 (got {})",
+                self.plugin_sandbox.max_lag
+            ));
+        }
+        if self.plugin_sandbox.health_interval_secs > 3600 {
+            problems.push(format!(
+                "plugin_sandbox.health_interval_secs must be at most 3600 (got {})",
+                self.plugin_sandbox.health_interval_secs
+            ));
+        }
+        if self.plugin_sandbox.max_restarts > 100 {
+            problems.push(format!(
+                "plugin_sandbox.max_restarts must be at most 100 (got {})",
+                self.plugin_sandbox.max_restarts
+            ));
+        }
+        if let Err(e) = HttpOptions::load(&self.http) {
+            problems.push(format!("{:#}", e));
+        }
+        if let Some(ref url) = self.update_url {
+            if !(url.starts_with("http://") || url.starts_with("https://")) {
+                problems.push(format!(
+                    "update_url must start with http:// or https:// (got '{}')",
+                    url
+                ));
+            }
+        }
+        if let Err(e) = TrustedKeys::from_config(&self.update_trusted_keys) {
+            problems.push(format!("update_trusted_keys: {:#}", e));
+        }
+        if let Err(e) = self.remote_config.validate() {
+            problems.push(format!("{:#}", e));
+        }
+        if let Err(e) = self.entitlements.validate() {
+            problems.push(format!("{:#}", e));
+        }
+
+        problems
+    }
+
+    pub fn tracing_level(&self) -> Option<tracing::Level> {
+        self.log_level.as_deref().and_then(|l| l.parse().ok())
+    }
+
     pub fn new(api_key: String, api_url: String) -> Self {
         Self {
             api_key,
             api_url,
             default_tier: None,
+            ..Default::default()
         }
     }
 
     pub fn exists(path: &Path) -> bool {
         path.exists()
     }
+
+    /// These settings with the profile `name` applied on top. Profile
+    /// sections only hold the settings they change; nested settings (e.g.
+    /// sampling) are merged key by key.
+    pub fn with_profile(&self, name: Option<&str>) -> Result<Config> {
+        let mut merged = serde_json::to_value(self).context("Failed to serialize config")?;
+        if let Some(name) = name {
+            let section = self.profiles.get(name).with_context(|| {
+                format!(
+                    "Unknown profile '{}'. Profiles: {}",
+                    name,
+                    match self.profiles.len() {
+                        0 => "(none)".to_string(),
+                        _ => self.profiles.keys().cloned().collect::<Vec<_>>().join(", "),
+                    }
+                )
+            })?;
+            merge_json(&mut merged, section);
+        }
+        serde_json::from_value(merged)
+            .with_context(|| format!("Invalid settings in profile '{}'", name.unwrap_or("")))
+    }
+
+    /// Change a setting in the profile `profile` only, creating the profile
+    /// if needed. The value is parsed and checked like `set`.
+    pub fn set_in_profile(&mut self, profile: &str, key: &str, value: &str) -> Result<()> {
+        if profile.is_empty()
+            || !profile
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+        {
+            return Err(anyhow::anyhow!(
+                "Profile names may only contain letters, digits, '-' and '_' (got '{}')",
+                profile
+            ));
+        }
+        if key == "api_key" {
+            return Err(anyhow::anyhow!(
+                "API keys are kept in the credential store, not in profiles"
+            ));
+        }
+
+        self.profiles
+            .entry(profile.to_string())
+            .or_insert_with(|| Value::Object(Default::default()));
+        let mut merged = self.with_profile(Some(profile))?;
+        merged.set(key, value)?;
+
+        // Settings at their default value aren't serialized, but the profile
+        // still needs them spelled out to override the top-level value
+        let path: Vec<&str> = key.split('.').collect();
+        let base = serde_json::to_value(&*self)?;
+        let new_value = match json_lookup(&serde_json::to_value(&merged)?, &path) {
+            Some(v) => Some(v.clone()),
+            None => match json_lookup(&base, &path) {
+                None => None,
+                Some(Value::Array(_)) => Some(Value::Array(Vec::new())),
+                Some(Value::String(_)) => Some(match merged.get(key)? {
+                    s if s.is_empty() => Value::Null,
+                    s => Value::String(s),
+                }),
+                Some(_) => Some(serde_json::from_str(&merged.get(key)?).unwrap_or(Value::Null)),
+            },
+        };
+
+        let section = self
+            .profiles
+            .get_mut(profile)
+            .expect("profile inserted above");
+        match new_value {
+            Some(v) => json_insert(section, &path, v),
+            // Default both here and at the top level: inherit it
+            None => json_remove(section, &path),
+        }
+        Ok(())
+    }
+}
+
+/// The config file's JSON, migrated to the current format.
+fn read_file(path: &Path) -> Result<Value> {
+    let contents = fs::read_to_string(path).map_err(|e| {
+        let code = match e.kind() {
+            std::io::ErrorKind::NotFound => Code::ConfigNotFound,
+            _ => Code::ConfigInvalid,
+        };
+        anyhow::Error::new(e).context(KmError::new(code, "Failed to read config file"))
+    })?;
+    let mut value: Value = serde_json::from_str(&contents).context(KmError::new(
+        Code::ConfigInvalid,
+        "Failed to parse config file",
+    ))?;
+    migrate(&mut value)?;
+    Ok(value)
+}
+
+/// The config file's JSON as a config. Settings the schema doesn't know
+/// are only warned about, so a file written for a newer km still loads.
+fn parse(file: Value) -> Result<Config> {
+    let problems = config_schema::check(&file);
+    match serde_json::from_value(file) {
+        Ok(config) => {
+            for problem in &problems {
+                tracing::warn!("Config file: {}", problem);
+            }
+            Ok(config)
+        }
+        Err(e) if problems.is_empty() => Err(e).context(KmError::new(
+            Code::ConfigInvalid,
+            "Failed to parse config file",
+        )),
+        Err(e) => Err(e).context(KmError::new(
+            Code::ConfigInvalid,
+            format!("Failed to parse config file: {}", problems.join("; ")),
+        )),
+    }
+}
+
+/// Problems `km config validate` reports about the file at `path` as
+/// written: settings the schema doesn't know and values of the wrong type.
+pub fn schema_problems(path: &Path) -> Result<Vec<String>> {
+    Ok(config_schema::check(&read_file(path)?))
+}
+
+/// Where the value of a setting comes from, as `km config source` shows it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Source {
+    Default,
+    /// The remote layer, fetched from this URL
+    Remote(String),
+    File,
+    Profile(String),
+    CredentialStore,
+    /// This environment variable
+    Environment(&'static str),
+}
+
+impl fmt::Display for Source {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            Source::Default => write!(f, "default"),
+            Source::Remote(url) => write!(f, "remote ({})", url),
+            Source::File => write!(f, "config file"),
+            Source::Profile(name) => write!(f, "profile '{}'", name),
+            Source::CredentialStore => write!(f, "credential store"),
+            Source::Environment(name) => write!(f, "environment ({})", name),
+        }
+    }
+}
+
+/// Where each of `CONFIG_KEYS` comes from for the config file at `path`,
+/// in the order `load_with_env` applies them: the environment, then the
+/// selected profile, the file, the credential store (API keys only) and the
+/// remote layer.
+pub fn sources(path: &Path) -> Result<Vec<(&'static str, Source)>> {
+    let file = read_file(path)?;
+    let config: Config =
+        serde_json::from_value(file.clone()).context("Failed to parse config file")?;
+    let layer = remote_config::cached_layer(path, &config.remote_config, &config.api_url);
+    let profile = active_profile();
+    let section = profile.as_ref().and_then(|name| config.profiles.get(name));
+
+    let sources = CONFIG_KEYS
+        .iter()
+        .map(|&key| {
+            let path_in: Vec<&str> = key.split('.').collect();
+            let sets = |value: &Value| json_lookup(value, &path_in).is_some_and(|v| !v.is_null());
+            let env = match key {
+                "api_key" => Some("KM_API_KEY"),
+                "api_url" => Some("KM_API_URL"),
+                "default_tier" => Some("KM_DEFAULT_TIER"),
+                _ => None,
+            }
+            .filter(|name| std::env::var(name).is_ok());
+
+            let source = if let Some(name) = env {
+                Source::Environment(name)
+            } else if key == "api_key" {
+                if !config.api_key.is_empty() {
+                    Source::File
+                } else if credentials::load_api_key(path, profile.as_deref()).is_some() {
+                    Source::CredentialStore
+                } else {
+                    Source::Default
+                }
+            } else if let (Some(name), Some(section)) = (&profile, section) {
+                if sets(section) {
+                    Source::Profile(name.clone())
+                } else if sets(&file) {
+                    Source::File
+                } else {
+                    layer_source(&layer, &sets)
+                }
+            } else if sets(&file) {
+                Source::File
+            } else {
+                layer_source(&layer, &sets)
+            };
+            (key, source)
+        })
+        .collect();
+    Ok(sources)
+}
+
+fn layer_source(layer: &Option<remote_config::Layer>, sets: &dyn Fn(&Value) -> bool) -> Source {
+    match layer {
+        Some(layer) if sets(&layer.settings) => Source::Remote(layer.source.clone()),
+        _ => Source::Default,
+    }
+}
+
+/// Bring a config file's JSON up to `CONFIG_VERSION`. Returns the version
+/// it was written in.
+pub fn migrate(value: &mut Value) -> Result<u32> {
+    migrate_with(value, MIGRATIONS)
+}
+
+/// `migrate` with the given steps, where step `i` upgrades version `i + 1`.
+pub fn migrate_with(value: &mut Value, migrations: &[Migration]) -> Result<u32> {
+    let latest = migrations.len() as u32 + 1;
+    let from = match value.get("version") {
+        None => 1,
+        Some(version) => version
+            .as_u64()
+            .and_then(|v| u32::try_from(v).ok())
+            .filter(|&v| v >= 1)
+            .with_context(|| format!("Invalid config version {}", version))?,
+    };
+    if from > latest {
+        return Err(anyhow::anyhow!(
+            "The config file is version {}, newer than this km understands ({}); update km",
+            from,
+            latest
+        ));
+    }
+    for (step, migration) in migrations.iter().enumerate().skip(from as usize - 1) {
+        migration(value).with_context(|| {
+            format!(
+                "Failed to migrate the config file from version {} to {}",
+                step + 1,
+                step + 2
+            )
+        })?;
+    }
+    if let Value::Object(ref mut object) = value {
+        object.insert("version".to_string(), Value::from(latest));
+    }
+    Ok(from)
+}
+
+/// Migrate the config file at `path` to the current format and save it,
+/// keeping a copy of the original next to it. Returns the version it was
+/// migrated from, or `None` if it was already current.
+pub fn migrate_file(path: &Path) -> Result<Option<u32>> {
+    if !path.exists() {
+        return Ok(None);
+    }
+    let contents = fs::read_to_string(path).context("Failed to read config file")?;
+    let mut value: Value =
+        serde_json::from_str(&contents).context("Failed to parse config file")?;
+    let from = migrate(&mut value)?;
+    if from == CONFIG_VERSION {
+        return Ok(None);
+    }
+    let config: Config = serde_json::from_value(value).context("Failed to parse config file")?;
+    let file_name = path
+        .file_name()
+        .context("Config path has no file name")?
+        .to_string_lossy();
+    let backup = path.with_file_name(format!("{}.v{}.bak", file_name, from));
+    fs::write(&backup, contents).context("Failed to back up the config file")?;
+    config.save(path)?;
+    Ok(Some(from))
+}
+
+/// Recursively overlay `overlay` onto `base`; objects merge, anything else replaces.
+fn merge_json(base: &mut Value, overlay: &Value) {
+    match (base, overlay) {
+        (Value::Object(base), Value::Object(overlay)) => {
+            for (key, value) in overlay {
+                match base.get_mut(key) {
+                    Some(existing) => merge_json(existing, value),
+                    None => {
+                        base.insert(key.clone(), value.clone());
+                    }
+                }
+            }
+        }
+        (base, overlay) => *base = overlay.clone(),
+    }
+}
+
+fn json_lookup<'a>(value: &'a Value, path: &[&str]) -> Option<&'a Value> {
+    path.iter().try_fold(value, |v, key| v.get(*key))
+}
+
+fn json_insert(value: &mut Value, path: &[&str], new_value: Value) {
+    let Some((last, parents)) = path.split_last() else {
+        return;
+    };
+    let mut current = value;
+    for key in parents {
+        if !current.get(key).is_some_and(Value::is_object) {
+            current[*key] = Value::Object(Default::default());
+        }
+        current = &mut current[*key];
+    }
+    current[*last] = new_value;
+}
+
+fn json_remove(value: &mut Value, path: &[&str]) {
+    let Some((last, parents)) = path.split_last() else {
+        return;
+    };
+    if let Some(Value::Object(parent)) = parents
+        .iter()
+        .try_fold(&mut *value, |v, key| v.get_mut(*key))
+    {
+        parent.remove(*last);
+    }
+}
+
+fn unknown_key(key: &str) -> anyhow::Error {
+    anyhow::anyhow!(
+        "Unknown config key '{}'. Valid keys: {}",
+        key,
+        CONFIG_KEYS.join(", ")
+    )
+}
+
+/// The serialized name of a unit enum variant (e.g. `enforce`).
+fn enum_name<T: Serialize>(value: &T) -> String {
+    serde_json::to_value(value)
+        .ok()
+        .and_then(|v| v.as_str().map(String::from))
+        .unwrap_or_default()
+}
+
+fn parse_enum<T: serde::de::DeserializeOwned>(key: &str, value: &str) -> Result<T> {
+    serde_json::from_value(Value::String(value.to_ascii_lowercase()))
+        .map_err(|_| anyhow::anyhow!("'{}' does not accept '{}'", key, value))
 }
@@ -0,0 +1,437 @@
+//! JSON Schema of the config file. The schema is traced from the config
+//! structs' `Deserialize` impls, so it always describes what km reads.
+//! `km config schema` prints it for editors, and loading a config file
+//! checks the file against it, so settings km doesn't know get reported.
+
+use serde::de::{
+    self, DeserializeOwned, DeserializeSeed, EnumAccess, MapAccess, SeqAccess, VariantAccess,
+    Visitor,
+};
+use serde_json::{json, Map, Value};
+use std::fmt;
+
+use crate::config::Config;
+use crate::plugins::schema;
+use crate::sinks;
+
+const DRAFT: &str = "http://json-schema.org/draft-07/schema#";
+
+/// The schema of the config file.
+pub fn schema() -> Value {
+    let mut schema = of::<Config>();
+    schema["$schema"] = json!(DRAFT);
+    schema["title"] = json!("km config file");
+    schema
+}
+
+/// Settings whose shape serde can't describe: the schema to use and a
+/// value to hand the config structs instead.
+fn special(path: &str) -> Option<(Value, Value)> {
+    match path {
+        // Internally tagged, which serde only reads from a buffered value
+        "sinks" => Some((
+            json!({"type": "array", "items": sinks::schema()}),
+            json!([]),
+        )),
+        // Each profile overrides some of the settings of the file
+        "profiles" => Some((
+            json!({"type": "object", "additionalProperties": {"$ref": "#"}}),
+            json!({}),
+        )),
+        _ => None,
+    }
+}
+
+/// The schema of `T`, or an empty schema (anything goes) when `T` can't be
+/// described.
+pub fn of<T: DeserializeOwned>() -> Value {
+    let mut schema = json!({});
+    let traced = T::deserialize(Tracer {
+        path: String::new(),
+        schema: &mut schema,
+    });
+    match traced {
+        Ok(_) => schema,
+        Err(_) => json!({}),
+    }
+}
+
+/// Problems with `value` as a config file, each as `setting: problem`:
+/// settings km doesn't know and values of the wrong type.
+pub fn check(value: &Value) -> Vec<String> {
+    schema::validate(&schema(), value)
+}
+
+fn join(path: &str, key: &str) -> String {
+    match path {
+        "" => key.to_string(),
+        _ => format!("{}.{}", path, key),
+    }
+}
+
+/// `schema` accepting null as well.
+fn nullable(mut schema: Value) -> Value {
+    if let Some(kind) = schema
+        .get("type")
+        .and_then(Value::as_str)
+        .map(str::to_string)
+    {
+        schema["type"] = json!([kind, "null"]);
+    } else if let Some(Value::Array(options)) = schema.get_mut("enum") {
+        options.push(Value::Null);
+    } else if schema != json!({}) {
+        schema = json!({"anyOf": [schema, {"type": "null"}]});
+    }
+    schema
+}
+
+#[derive(Debug)]
+struct Error(String);
+
+impl fmt::Display for Error {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str(&self.0)
+    }
+}
+
+impl std::error::Error for Error {}
+
+impl de::Error for Error {
+    fn custom<T: fmt::Display>(msg: T) -> Self {
+        Error(msg.to_string())
+    }
+}
+
+/// A deserializer that hands a type one example of every value it asks
+/// for, and writes down the schema of what was asked for as it goes.
+struct Tracer<'a> {
+    /// Dotted path of the value in the config file
+    path: String,
+    schema: &'a mut Value,
+}
+
+impl<'a> Tracer<'a> {
+    fn simple<'de, V: Visitor<'de>>(
+        self,
+        schema: Value,
+        visit: impl FnOnce(V) -> Result<V::Value, Error>,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        *self.schema = schema;
+        visit(visitor)
+    }
+}
+
+macro_rules! integers {
+    ($($method:ident: $ty:ty),*) => {
+        $(
+            fn $method<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+                let mut schema = json!({"type": "integer"});
+                // Bounds of the narrow types; the wide ones are only kept positive
+                if (<$ty>::MAX as u64) < u64::from(u32::MAX) {
+                    schema["minimum"] = json!(<$ty>::MIN);
+                    schema["maximum"] = json!(<$ty>::MAX);
+                } else if <$ty>::MIN == 0 {
+                    schema["minimum"] = json!(0);
+                }
+                self.simple(schema, |v| v.visit_u8(0), visitor)
+            }
+        )*
+    };
+}
+
+impl<'de, 'a> de::Deserializer<'de> for Tracer<'a> {
+    type Error = Error;
+
+    /// Anything: the config holds raw JSON here
+    fn deserialize_any<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.simple(json!({}), |v| v.visit_unit(), visitor)
+    }
+
+    fn deserialize_bool<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.simple(json!({"type": "boolean"}), |v| v.visit_bool(false), visitor)
+    }
+
+    integers!(
+        deserialize_i8: i8,
+        deserialize_i16: i16,
+        deserialize_i32: i32,
+        deserialize_i64: i64,
+        deserialize_u8: u8,
+        deserialize_u16: u16,
+        deserialize_u32: u32,
+        deserialize_u64: u64
+    );
+
+    fn deserialize_f32<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.simple(json!({"type": "number"}), |v| v.visit_f64(0.0), visitor)
+    }
+
+    fn deserialize_f64<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.simple(json!({"type": "number"}), |v| v.visit_f64(0.0), visitor)
+    }
+
+    fn deserialize_char<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        let schema = json!({"type": "string", "minLength": 1, "maxLength": 1});
+        self.simple(schema, |v| v.visit_char(' '), visitor)
+    }
+
+    fn deserialize_str<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.simple(json!({"type": "string"}), |v| v.visit_str(""), visitor)
+    }
+
+    fn deserialize_string<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.deserialize_str(visitor)
+    }
+
+    fn deserialize_bytes<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        let schema = json!({
+            "type": "array",
+            "items": {"type": "integer", "minimum": 0, "maximum": 255}
+        });
+        self.simple(schema, |v| v.visit_bytes(&[]), visitor)
+    }
+
+    fn deserialize_byte_buf<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.deserialize_bytes(visitor)
+    }
+
+    fn deserialize_option<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        let mut inner = json!({});
+        let value = visitor.visit_some(Tracer {
+            path: self.path,
+            schema: &mut inner,
+        })?;
+        *self.schema = nullable(inner);
+        Ok(value)
+    }
+
+    fn deserialize_unit<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.simple(json!({"type": "null"}), |v| v.visit_unit(), visitor)
+    }
+
+    fn deserialize_unit_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        self.deserialize_unit(visitor)
+    }
+
+    fn deserialize_newtype_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        visitor.visit_newtype_struct(self)
+    }
+
+    fn deserialize_seq<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        let mut items = json!({});
+        let value = visitor.visit_seq(Items(Some(Tracer {
+            path: format!("{}[]", self.path),
+            schema: &mut items,
+        })))?;
+        *self.schema = json!({"type": "array", "items": items});
+        Ok(value)
+    }
+
+    fn deserialize_tuple<V: Visitor<'de>>(
+        self,
+        _len: usize,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        self.deserialize_seq(visitor)
+    }
+
+    fn deserialize_tuple_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        _len: usize,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        self.deserialize_seq(visitor)
+    }
+
+    fn deserialize_map<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        let mut values = json!({});
+        let value = visitor.visit_map(Entries {
+            path: format!("{}.*", self.path),
+            values: Some(&mut values),
+        })?;
+        *self.schema = json!({"type": "object", "additionalProperties": values});
+        Ok(value)
+    }
+
+    fn deserialize_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        fields: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        let mut properties = Map::new();
+        let value = visitor.visit_map(Fields {
+            path: &self.path,
+            fields: fields.iter(),
+            current: "",
+            properties: &mut properties,
+        })?;
+        *self.schema = json!({
+            "type": "object",
+            "properties": properties,
+            "additionalProperties": false,
+        });
+        Ok(value)
+    }
+
+    fn deserialize_enum<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        variants: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        let first = variants
+            .first()
+            .ok_or_else(|| Error("enum has no variants".into()))?;
+        *self.schema = json!({ "enum": variants });
+        visitor.visit_enum(Variant(first))
+    }
+
+    fn deserialize_identifier<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.deserialize_str(visitor)
+    }
+
+    fn deserialize_ignored_any<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        self.deserialize_any(visitor)
+    }
+}
+
+/// A sequence of one item.
+struct Items<'a>(Option<Tracer<'a>>);
+
+impl<'de, 'a> SeqAccess<'de> for Items<'a> {
+    type Error = Error;
+
+    fn next_element_seed<T: DeserializeSeed<'de>>(
+        &mut self,
+        seed: T,
+    ) -> Result<Option<T::Value>, Error> {
+        match self.0.take() {
+            Some(tracer) => seed.deserialize(tracer).map(Some),
+            None => Ok(None),
+        }
+    }
+}
+
+/// A map of one entry.
+struct Entries<'a> {
+    path: String,
+    values: Option<&'a mut Value>,
+}
+
+impl<'de, 'a> MapAccess<'de> for Entries<'a> {
+    type Error = Error;
+
+    fn next_key_seed<K: DeserializeSeed<'de>>(
+        &mut self,
+        seed: K,
+    ) -> Result<Option<K::Value>, Error> {
+        if self.values.is_none() {
+            return Ok(None);
+        }
+        // Keys are property names, strings in any case
+        let mut key = json!({});
+        seed.deserialize(Tracer {
+            path: self.path.clone(),
+            schema: &mut key,
+        })
+        .map(Some)
+    }
+
+    fn next_value_seed<T: DeserializeSeed<'de>>(&mut self, seed: T) -> Result<T::Value, Error> {
+        let schema = self
+            .values
+            .take()
+            .ok_or_else(|| Error("value without a key".into()))?;
+        seed.deserialize(Tracer {
+            path: self.path.clone(),
+            schema,
+        })
+    }
+}
+
+/// Every field of a struct, each with an example value.
+struct Fields<'a> {
+    path: &'a str,
+    fields: std::slice::Iter<'static, &'static str>,
+    current: &'static str,
+    properties: &'a mut Map<String, Value>,
+}
+
+impl<'de, 'a> MapAccess<'de> for Fields<'a> {
+    type Error = Error;
+
+    fn next_key_seed<K: DeserializeSeed<'de>>(
+        &mut self,
+        seed: K,
+    ) -> Result<Option<K::Value>, Error> {
+        let Some(field) = self.fields.next() else {
+            return Ok(None);
+        };
+        self.current = *field;
+        seed.deserialize(de::value::StrDeserializer::<Error>::new(field))
+            .map(Some)
+    }
+
+    fn next_value_seed<T: DeserializeSeed<'de>>(&mut self, seed: T) -> Result<T::Value, Error> {
+        let path = join(self.path, self.current);
+        if let Some((schema, example)) = special(&path) {
+            self.properties.insert(self.current.to_string(), schema);
+            return seed.deserialize(example).map_err(|e| Error(e.to_string()));
+        }
+        let mut schema = json!({});
+        let value = seed.deserialize(Tracer {
+            path,
+            schema: &mut schema,
+        })?;
+        self.properties.insert(self.current.to_string(), schema);
+        Ok(value)
+    }
+}
+
+/// The first variant of an enum, which must be a unit variant.
+struct Variant(&'static str);
+
+impl<'de> EnumAccess<'de> for Variant {
+    type Error = Error;
+    type Variant = Self;
+
+    fn variant_seed<V: DeserializeSeed<'de>>(self, seed: V) -> Result<(V::Value, Self), Error> {
+        let value = seed.deserialize(de::value::StrDeserializer::<Error>::new(self.0))?;
+        Ok((value, self))
+    }
+}
+
+impl<'de> VariantAccess<'de> for Variant {
+    type Error = Error;
+
+    fn unit_variant(self) -> Result<(), Error> {
+        Ok(())
+    }
+
+    fn newtype_variant_seed<T: DeserializeSeed<'de>>(self, _seed: T) -> Result<T::Value, Error> {
+        Err(Error(format!("variant {} holds data", self.0)))
+    }
+
+    fn tuple_variant<V: Visitor<'de>>(self, _len: usize, _visitor: V) -> Result<V::Value, Error> {
+        Err(Error(format!("variant {} holds data", self.0)))
+    }
+
+    fn struct_variant<V: Visitor<'de>>(
+        self,
+        _fields: &'static [&'static str],
+        _visitor: V,
+    ) -> Result<V::Value, Error> {
+        Err(Error(format!("variant {} holds data", self.0)))
+    }
+}
@@ -0,0 +1,96 @@
+use std::fs;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, SystemTime};
+
+use crate::config::Config;
+use crate::remote_config;
+
+/// Watches the config file and calls back with the new settings whenever it
+/// changes and passes validation. Polls rather than relying on platform file
+/// notifications, which are unreliable for editors that replace files on save.
+pub struct ConfigWatcher {
+    stop: Arc<AtomicBool>,
+    thread: Option<thread::JoinHandle<()>>,
+}
+
+fn fingerprint(path: &PathBuf) -> Option<(SystemTime, String)> {
+    let modified = fs::metadata(path).and_then(|m| m.modified()).ok()?;
+    let mut contents = fs::read_to_string(path).ok()?;
+    // A refreshed remote layer changes the settings too
+    if let Some(layer) = remote_config::cache_fingerprint(path) {
+        contents.push_str(&layer);
+    }
+    Some((modified, contents))
+}
+
+impl ConfigWatcher {
+    pub fn spawn<F>(path: PathBuf, interval: Duration, on_change: F) -> Self
+    where
+        F: Fn(Config) + Send + 'static,
+    {
+        let stop = Arc::new(AtomicBool::new(false));
+        let stop_flag = stop.clone();
+
+        let thread = thread::spawn(move || {
+            let mut last = fingerprint(&path);
+
+            loop {
+                // Parked rather than slept so stop() doesn't wait out the interval
+                thread::park_timeout(interval);
+                if stop_flag.load(Ordering::Relaxed) {
+                    break;
+                }
+
+                let current = fingerprint(&path);
+                // Compare contents too: mtime resolution can hide quick edits
+                if current.is_none() || current == last {
+                    continue;
+                }
+                last = current;
+
+                let config = match Config::load_with_env(&path) {
+                    Ok(config) => config,
+                    Err(e) => {
+                        tracing::warn!("Ignoring config change: {:#}", e);
+                        continue;
+                    }
+                };
+
+                let problems = config.validate();
+                if !problems.is_empty() {
+                    tracing::warn!("Ignoring invalid config change: {}", problems.join("; "));
+                    continue;
+                }
+
+                tracing::info!("Configuration reloaded from {:?}", path);
+                on_change(config);
+            }
+        });
+
+        Self {
+            stop,
+            thread: Some(thread),
+        }
+    }
+
+    pub fn stop(mut self) {
+        self.shutdown();
+    }
+
+    fn shutdown(&mut self) {
+        self.stop.store(true, Ordering::Relaxed);
+        if let Some(thread) = self.thread.take() {
+            thread.thread().unpark();
+            let _ = thread.join();
+        }
+    }
+}
+
+impl Drop for ConfigWatcher {
+    fn drop(&mut self) {
+        self.shutdown();
+    }
+}
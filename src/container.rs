@@ -0,0 +1,120 @@
+//! MCP servers run in Docker containers (`km monitor --docker image`).
+//! km starts the container itself with `docker run -i`, so it can name it
+//! after the session, label it, hand it the server's env-file variables
+//! without their values showing up on a command line, and remove it when
+//! the session ends, even if the docker CLI had to be killed.
+
+use anyhow::{Context, Result};
+use std::process::{Command, Stdio};
+
+use crate::traffic::Labels;
+
+pub const DOCKER: &str = "docker";
+/// Container label holding the id of the session that started it
+pub const SESSION_LABEL: &str = "ai.kilometers.session";
+/// Prefix of the container labels copied from the session's labels
+pub const LABEL_PREFIX: &str = "ai.kilometers.label.";
+
+/// One server container.
+#[derive(Debug, Clone, PartialEq)]
+pub struct DockerRun {
+    pub image: String,
+    /// Container name, `km-` and the start of the session id
+    pub name: String,
+    pub session_id: String,
+    /// Arguments for the image's entrypoint
+    pub args: Vec<String>,
+    /// Extra `docker run` options (`--docker-arg`)
+    pub docker_args: Vec<String>,
+    /// Variables passed into the container by name; docker takes their
+    /// values from its own environment
+    pub env: Vec<String>,
+    /// Session labels, copied onto the container
+    pub labels: Labels,
+}
+
+impl DockerRun {
+    pub fn new(image: &str, session_id: &str, args: Vec<String>) -> Self {
+        let short: String = session_id
+            .chars()
+            .filter(char::is_ascii_alphanumeric)
+            .take(12)
+            .collect();
+        Self {
+            image: image.to_string(),
+            name: format!("km-{}", short),
+            session_id: session_id.to_string(),
+            args,
+            docker_args: Vec::new(),
+            env: Vec::new(),
+            labels: Labels::new(),
+        }
+    }
+
+    /// The `docker` arguments that run the container attached to stdio.
+    pub fn command(&self) -> Vec<String> {
+        let mut command: Vec<String> =
+            ["run", "-i", "--rm", "--init", "--name", self.name.as_str()]
+                .iter()
+                .map(|arg| arg.to_string())
+                .collect();
+        command.push("--label".to_string());
+        command.push(format!("{}={}", SESSION_LABEL, self.session_id));
+        for (key, value) in &self.labels {
+            command.push("--label".to_string());
+            command.push(format!("{}{}={}", LABEL_PREFIX, key, value));
+        }
+        for name in &self.env {
+            command.push("--env".to_string());
+            command.push(name.clone());
+        }
+        command.extend(self.docker_args.iter().cloned());
+        command.push(self.image.clone());
+        command.extend(self.args.iter().cloned());
+        command
+    }
+
+    /// Labels the session gets, so its events say which container served them.
+    pub fn session_labels(&self) -> Labels {
+        Labels::from([
+            ("container.image".to_string(), self.image.clone()),
+            ("container.name".to_string(), self.name.clone()),
+        ])
+    }
+}
+
+/// Fail early, with a clear error, when Docker isn't installed or its
+/// daemon isn't running.
+pub fn check_available() -> Result<()> {
+    let output = Command::new(DOCKER)
+        .args(["version", "--format", "{{.Server.Version}}"])
+        .stdin(Stdio::null())
+        .output()
+        .context("Failed to run docker; is Docker installed and on PATH?")?;
+    if !output.status.success() {
+        return Err(anyhow::anyhow!(
+            "Docker isn't available: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    tracing::debug!("Docker {}", String::from_utf8_lossy(&output.stdout).trim());
+    Ok(())
+}
+
+/// Remove the container `name` if it's still there. `--rm` removes it when
+/// it exits; this catches the ones left running because the docker CLI was
+/// killed before it could stop them.
+pub fn remove(name: &str) {
+    let removed = Command::new(DOCKER)
+        .args(["rm", "--force", name])
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status();
+    match removed {
+        Ok(status) if status.success() => tracing::info!("Removed container {}", name),
+        // Already gone
+        Ok(_) => {}
+        Err(e) => tracing::warn!("Could not remove container {}: {}", name, e),
+    }
+}
@@ -0,0 +1,433 @@
+//! Typed metadata for content embedded in MCP results. resources/read and
+//! tools/call answers can carry base64 images, PDFs or CSV text; instead of
+//! an opaque blob, each item is described by its MIME type, size and what
+//! a parser for that type could read from it: image dimensions, PDF pages,
+//! table rows. The descriptions are recorded in the `content` metadata of
+//! captured events, passed to the policy bundle and matched by the
+//! `content` and `content_size` search fields.
+
+use base64::{engine::general_purpose::STANDARD, Engine as _};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::borrow::Cow;
+use std::fmt::Debug;
+
+/// Blobs larger than this are only decoded far enough to detect their type
+pub const MAX_PARSE_BYTES: usize = 16 * 1024 * 1024;
+/// What's decoded of larger blobs
+const SNIFF_BYTES: usize = 64 * 1024;
+
+/// What an embedded item is, as the `kind` search and policy inputs see it.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ContentKind {
+    Image,
+    Audio,
+    Pdf,
+    Table,
+    Json,
+    Text,
+    Binary,
+}
+
+impl ContentKind {
+    pub fn of(mime_type: &str) -> Self {
+        match mime_type {
+            m if m.starts_with("image/") => Self::Image,
+            m if m.starts_with("audio/") => Self::Audio,
+            "application/pdf" => Self::Pdf,
+            "text/csv" | "text/tab-separated-values" => Self::Table,
+            m if m == "application/json" || m.ends_with("+json") => Self::Json,
+            m if m.starts_with("text/") => Self::Text,
+            _ => Self::Binary,
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Image => "image",
+            Self::Audio => "audio",
+            Self::Pdf => "pdf",
+            Self::Table => "table",
+            Self::Json => "json",
+            Self::Text => "text",
+            Self::Binary => "binary",
+        }
+    }
+}
+
+/// One item of content in a result.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ContentInfo {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub uri: Option<String>,
+    /// Detected from the data where possible, else as declared
+    pub mime_type: String,
+    pub kind: ContentKind,
+    /// Size of the decoded data
+    pub bytes: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub width: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub height: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pages: Option<u64>,
+    /// Data rows, not counting the header
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rows: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub columns: Option<u64>,
+}
+
+/// Reads what it can from one kind of content.
+pub trait ContentParser: Send + Sync + Debug {
+    /// Whether this parser understands `mime_type`
+    fn parses(&self, mime_type: &str) -> bool;
+
+    /// Fill in `info` from `data`. `data` is only the start of the content
+    /// when `info.bytes` is larger than [`MAX_PARSE_BYTES`].
+    fn parse(&self, data: &[u8], info: &mut ContentInfo);
+}
+
+/// The built-in parsers.
+pub fn builtin() -> Vec<Box<dyn ContentParser>> {
+    vec![
+        Box::new(ImageParser),
+        Box::new(PdfParser),
+        Box::new(TableParser),
+    ]
+}
+
+/// The parsers consulted for each item, in order; the first that parses
+/// its MIME type describes it.
+#[derive(Debug)]
+pub struct ContentParsers {
+    parsers: Vec<Box<dyn ContentParser>>,
+}
+
+impl Default for ContentParsers {
+    fn default() -> Self {
+        Self::new(builtin())
+    }
+}
+
+impl ContentParsers {
+    pub fn new(parsers: Vec<Box<dyn ContentParser>>) -> Self {
+        Self { parsers }
+    }
+
+    /// Every embedded item in a JSON-RPC response: a resources/read
+    /// result's `contents`, and the images, audio and resources in a
+    /// result's `content`. Empty for anything else.
+    pub fn describe(&self, message: &Value) -> Vec<ContentInfo> {
+        let Some(result) = message.get("result") else {
+            return Vec::new();
+        };
+        let items = result
+            .get("contents")
+            .and_then(Value::as_array)
+            .into_iter()
+            .flatten()
+            .chain(
+                result
+                    .get("content")
+                    .and_then(Value::as_array)
+                    .into_iter()
+                    .flatten()
+                    .filter_map(|item| match item.get("type").and_then(Value::as_str) {
+                        Some("image" | "audio") => Some(item),
+                        Some("resource") => item.get("resource"),
+                        _ => None,
+                    }),
+            );
+        items.filter_map(|item| self.describe_item(item)).collect()
+    }
+
+    fn describe_item(&self, item: &Value) -> Option<ContentInfo> {
+        let declared = item
+            .get("mimeType")
+            .and_then(Value::as_str)
+            .map(|m| m.split(';').next().unwrap_or(m).trim().to_ascii_lowercase());
+        let uri = item.get("uri").and_then(Value::as_str).map(String::from);
+
+        let (data, bytes, text) = if let Some(text) = item.get("text").and_then(Value::as_str) {
+            (Cow::Borrowed(text.as_bytes()), text.len() as u64, true)
+        } else {
+            let encoded = item
+                .get("blob")
+                .or_else(|| item.get("data"))
+                .and_then(Value::as_str)?;
+            let (data, bytes) = decode(encoded);
+            (Cow::Owned(data), bytes, false)
+        };
+
+        let mime_type = sniff(&data)
+            .map(String::from)
+            .or(declared)
+            .unwrap_or_else(|| guess(uri.as_deref(), &data, text));
+        let mut info = ContentInfo {
+            uri,
+            kind: ContentKind::of(&mime_type),
+            mime_type,
+            bytes,
+            width: None,
+            height: None,
+            pages: None,
+            rows: None,
+            columns: None,
+        };
+        if let Some(parser) = self.parsers.iter().find(|p| p.parses(&info.mime_type)) {
+            parser.parse(&data, &mut info);
+        }
+        Some(info)
+    }
+}
+
+/// Decode base64 `encoded`, or only its start when it's larger than
+/// [`MAX_PARSE_BYTES`]. Returns the data and the full decoded size.
+fn decode(encoded: &str) -> (Vec<u8>, u64) {
+    let encoded = encoded.trim();
+    let padding = encoded.bytes().rev().take_while(|b| *b == b'=').count();
+    let bytes = (encoded.len() / 4 * 3).saturating_sub(padding) as u64;
+    let data = if bytes as usize > MAX_PARSE_BYTES {
+        let prefix = &encoded.as_bytes()[..encoded.len().min(SNIFF_BYTES / 3 * 4)];
+        STANDARD.decode(prefix).unwrap_or_default()
+    } else {
+        STANDARD.decode(encoded).unwrap_or_default()
+    };
+    (data, bytes)
+}
+
+/// The MIME type of `data` from its first bytes.
+fn sniff(data: &[u8]) -> Option<&'static str> {
+    let riff = |form: &[u8]| data.starts_with(b"RIFF") && data.get(8..12) == Some(form);
+    if data.starts_with(b"\x89PNG\r\n\x1a\n") {
+        Some("image/png")
+    } else if data.starts_with(&[0xff, 0xd8, 0xff]) {
+        Some("image/jpeg")
+    } else if data.starts_with(b"GIF87a") || data.starts_with(b"GIF89a") {
+        Some("image/gif")
+    } else if riff(b"WEBP") {
+        Some("image/webp")
+    } else if riff(b"WAVE") {
+        Some("audio/wav")
+    } else if data.starts_with(b"%PDF-") {
+        Some("application/pdf")
+    } else if data.starts_with(b"PK\x03\x04") {
+        Some("application/zip")
+    } else {
+        None
+    }
+}
+
+/// A MIME type for undeclared content that has no magic bytes.
+fn guess(uri: Option<&str>, data: &[u8], text: bool) -> String {
+    let extension = uri
+        .and_then(|uri| uri.rsplit('/').next())
+        .and_then(|name| name.rsplit_once('.'))
+        .map(|(_, extension)| extension.to_ascii_lowercase());
+    match extension.as_deref() {
+        Some("csv") => return "text/csv".to_string(),
+        Some("tsv") => return "text/tab-separated-values".to_string(),
+        _ => {}
+    }
+    if !text {
+        "application/octet-stream".to_string()
+    } else if serde_json::from_slice::<Value>(data).is_ok_and(|v| v.is_object() || v.is_array()) {
+        "application/json".to_string()
+    } else {
+        "text/plain".to_string()
+    }
+}
+
+fn be16(data: &[u8], at: usize) -> Option<u64> {
+    Some(u16::from_be_bytes(data.get(at..at + 2)?.try_into().ok()?).into())
+}
+
+fn be32(data: &[u8], at: usize) -> Option<u64> {
+    Some(u32::from_be_bytes(data.get(at..at + 4)?.try_into().ok()?).into())
+}
+
+fn le16(data: &[u8], at: usize) -> Option<u64> {
+    Some(u16::from_le_bytes(data.get(at..at + 2)?.try_into().ok()?).into())
+}
+
+fn le24(data: &[u8], at: usize) -> Option<u64> {
+    let b = data.get(at..at + 3)?;
+    Some(u64::from(b[0]) | u64::from(b[1]) << 8 | u64::from(b[2]) << 16)
+}
+
+/// Dimensions of PNG, JPEG, GIF and WebP images, from their headers.
+#[derive(Debug)]
+pub struct ImageParser;
+
+impl ImageParser {
+    fn dimensions(mime_type: &str, data: &[u8]) -> Option<(u64, u64)> {
+        match mime_type {
+            // IHDR is always the first chunk
+            "image/png" => Some((be32(data, 16)?, be32(data, 20)?)),
+            "image/gif" => Some((le16(data, 6)?, le16(data, 8)?)),
+            "image/jpeg" => Self::jpeg(data),
+            "image/webp" => match data.get(12..16)? {
+                b"VP8 " => Some((le16(data, 26)? & 0x3fff, le16(data, 28)? & 0x3fff)),
+                b"VP8L" => {
+                    let bits = u32::from_le_bytes(data.get(21..25)?.try_into().ok()?);
+                    Some((
+                        u64::from(bits & 0x3fff) + 1,
+                        u64::from((bits >> 14) & 0x3fff) + 1,
+                    ))
+                }
+                b"VP8X" => Some((le24(data, 24)? + 1, le24(data, 27)? + 1)),
+                _ => None,
+            },
+            _ => None,
+        }
+    }
+
+    /// Walk the JPEG segments to the start-of-frame marker.
+    fn jpeg(data: &[u8]) -> Option<(u64, u64)> {
+        let mut at = 2;
+        loop {
+            if *data.get(at)? != 0xff {
+                return None;
+            }
+            let marker = *data.get(at + 1)?;
+            match marker {
+                // Padding before a marker
+                0xff => at += 1,
+                // Markers without a length
+                0xd8 | 0x01 | 0xd0..=0xd7 => at += 2,
+                0xc0..=0xcf if !matches!(marker, 0xc4 | 0xc8 | 0xcc) => {
+                    return Some((be16(data, at + 7)?, be16(data, at + 5)?));
+                }
+                _ => at += 2 + be16(data, at + 2)? as usize,
+            }
+        }
+    }
+}
+
+impl ContentParser for ImageParser {
+    fn parses(&self, mime_type: &str) -> bool {
+        matches!(
+            mime_type,
+            "image/png" | "image/jpeg" | "image/gif" | "image/webp"
+        )
+    }
+
+    fn parse(&self, data: &[u8], info: &mut ContentInfo) {
+        if let Some((width, height)) = Self::dimensions(&info.mime_type, data) {
+            info.width = Some(width);
+            info.height = Some(height);
+        }
+    }
+}
+
+/// Page counts of PDFs, from their page objects.
+#[derive(Debug)]
+pub struct PdfParser;
+
+impl ContentParser for PdfParser {
+    fn parses(&self, mime_type: &str) -> bool {
+        mime_type == "application/pdf"
+    }
+
+    fn parse(&self, data: &[u8], info: &mut ContentInfo) {
+        // Pages in a truncated document would be undercounted
+        if data.len() as u64 != info.bytes {
+            return;
+        }
+        let mut pages = 0;
+        for at in find_all(data, b"/Type") {
+            let rest = &data[at + 5..];
+            let rest = &rest[rest.iter().take_while(|b| b.is_ascii_whitespace()).count()..];
+            // `/Page` but not `/Pages`
+            if rest.starts_with(b"/Page") && !rest[5..].first().is_some_and(|b| *b == b's') {
+                pages += 1;
+            }
+        }
+        // Compressed object streams hide the page objects
+        if pages > 0 {
+            info.pages = Some(pages);
+        }
+    }
+}
+
+/// Every offset of `needle` in `haystack`.
+fn find_all<'a>(haystack: &'a [u8], needle: &'a [u8]) -> impl Iterator<Item = usize> + 'a {
+    haystack
+        .windows(needle.len())
+        .enumerate()
+        .filter(move |(_, window)| *window == needle)
+        .map(|(at, _)| at)
+}
+
+/// Rows and columns of CSV and TSV text. Quoted fields may hold
+/// delimiters and newlines.
+#[derive(Debug)]
+pub struct TableParser;
+
+impl ContentParser for TableParser {
+    fn parses(&self, mime_type: &str) -> bool {
+        ContentKind::of(mime_type) == ContentKind::Table
+    }
+
+    fn parse(&self, data: &[u8], info: &mut ContentInfo) {
+        if data.len() as u64 != info.bytes {
+            return;
+        }
+        let delimiter = if info.mime_type == "text/tab-separated-values" {
+            b'\t'
+        } else {
+            b','
+        };
+        let (mut records, mut columns) = (0u64, 1u64);
+        let (mut quoted, mut empty) = (false, true);
+        for byte in data {
+            match byte {
+                b'"' => quoted = !quoted,
+                b'\n' if !quoted => {
+                    if !empty {
+                        records += 1;
+                    }
+                    empty = true;
+                    continue;
+                }
+                b if *b == delimiter && !quoted && records == 0 => columns += 1,
+                _ => {}
+            }
+            if !byte.is_ascii_whitespace() {
+                empty = false;
+            }
+        }
+        if !empty {
+            records += 1;
+        }
+        if records > 0 {
+            info.rows = Some(records - 1);
+            info.columns = Some(columns);
+        }
+    }
+}
+
+/// Parse a size such as `5MB`, `512KB` or `1.5GB` (binary multiples); a
+/// plain number is bytes.
+pub fn parse_size(value: &str) -> std::result::Result<u64, String> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .unwrap_or(value.len());
+    let (amount, unit) = value.split_at(split);
+    let multiple: u64 = match unit.trim().to_ascii_uppercase().as_str() {
+        "" | "B" => 1,
+        "K" | "KB" | "KIB" => 1024,
+        "M" | "MB" | "MIB" => 1024 * 1024,
+        "G" | "GB" | "GIB" => 1024 * 1024 * 1024,
+        _ => return Err(format!("'{}' is not a size like 512KB or 5MB", value)),
+    };
+    amount
+        .parse::<f64>()
+        .ok()
+        .filter(|amount| amount.is_finite())
+        .map(|amount| (amount * multiple as f64) as u64)
+        .ok_or_else(|| format!("'{}' is not a size like 512KB or 5MB", value))
+}
@@ -0,0 +1,808 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::Ordering;
+use std::sync::{Arc, RwLock};
+use std::time::Duration;
+use tokio::io::{AsyncBufReadExt, AsyncRead, AsyncWrite, AsyncWriteExt, BufReader};
+use tokio::sync::{mpsc, watch, Notify};
+use tokio::task::{JoinHandle, JoinSet};
+
+use crate::approval::ApprovalGate;
+use crate::breaker::{BreakerStatus, CircuitBreaker};
+use crate::correlation::MessageCounts;
+use crate::entitlements::Entitlements;
+use crate::i18n::t;
+use crate::keepalive::{PingHealth, PingTracker};
+use crate::latency::{ApiLatency, ApiLatencySummary, LatencyStats, MethodLatency};
+use crate::plugins::health::{HealthState, PluginHealth};
+use crate::plugins::runtime::PluginHost;
+use crate::proxy::{CaptureCounts, CaptureSettings, ProxyOptions};
+use crate::queue::QueueStats;
+use crate::resources::{ResourceStats, ResourceUsage};
+use crate::sessions::format_duration;
+use crate::spool::{FlushReport, Spool};
+use crate::tail::TailServer;
+use crate::traffic::Labels;
+
+/// How long `km ctl` waits when probing whether a session is still running
+const PROBE_TIMEOUT: Duration = Duration::from_millis(500);
+
+/// Events forwarded to a `km ctl events` client ahead of its socket
+const EVENT_BUFFER: usize = 256;
+
+/// An operation `km ctl` asks a running monitor to perform. Sent as one
+/// JSON object per line, e.g. `{"op":"status"}`.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "op", rename_all = "kebab-case")]
+pub enum ControlRequest {
+    Status,
+    /// Upload buffered events and spooled batches now
+    Flush,
+    /// Change what is captured; fields left out stay as they are
+    UpdateFilters {
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        method_whitelist: Option<Vec<String>>,
+        /// 0 removes the limit
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        payload_size_limit: Option<usize>,
+    },
+    /// Restart the session's plugins, picking up installs and config changes
+    ReloadPlugins,
+    /// Acknowledged once, then every captured event follows as a JSON line
+    StreamEvents,
+    /// Requests held for approval
+    PendingApprovals,
+    /// Answer a held request
+    Decide {
+        id: u64,
+        approve: bool,
+    },
+}
+
+/// The monitor's answer to a [`ControlRequest`], one JSON line.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ControlResponse {
+    pub ok: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub result: Option<Value>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl ControlResponse {
+    fn from_result(result: Result<Value>) -> Self {
+        match result {
+            Ok(result) => Self {
+                ok: true,
+                result: Some(result),
+                error: None,
+            },
+            Err(e) => Self {
+                ok: false,
+                result: None,
+                error: Some(format!("{:#}", e)),
+            },
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct QueueStatus {
+    pub name: String,
+    pub sent: u64,
+    pub delayed: u64,
+    pub dropped: u64,
+}
+
+/// What `km ctl status` reports about a running monitor.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct MonitorStatus {
+    pub session_id: String,
+    pub pid: u32,
+    pub started_at: DateTime<Utc>,
+    pub command: Vec<String>,
+    pub log_file: PathBuf,
+    #[serde(default, skip_serializing_if = "Labels::is_empty")]
+    pub labels: Labels,
+    pub requests: u64,
+    pub responses: u64,
+    /// Captured messages by class
+    #[serde(default)]
+    pub messages: MessageCounts,
+    pub method_whitelist: Vec<String>,
+    pub payload_size_limit: Option<usize>,
+    pub plugins: Vec<String>,
+    /// Health of every plugin in the chain, running or not
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub plugin_health: Vec<PluginHealth>,
+    pub tail_clients: usize,
+    pub uploads: bool,
+    pub queues: Vec<QueueStatus>,
+    /// CPU and memory use of the MCP server, once it's been sampled
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub resources: Option<ResourceUsage>,
+    /// Response latency by method, busiest first
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub latency: Vec<MethodLatency>,
+    /// Pings forwarded without capture, and how they were answered
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pings: Option<PingHealth>,
+    /// Whether uploads to the API are flowing
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub breaker: Option<BreakerStatus>,
+    /// How long the API takes to answer uploads
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub api_latency: Option<ApiLatencySummary>,
+}
+
+/// What `km ctl flush` did.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct FlushOutcome {
+    /// Whether buffered events were handed to the uploader
+    pub events: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub spool: Option<FlushReport>,
+}
+
+/// Starts a fresh set of plugins for `km ctl reload-plugins`.
+pub type PluginLoader = Box<dyn Fn() -> Result<PluginHost> + Send + Sync>;
+
+/// The parts of a running monitor session that `km ctl` can see and change.
+pub struct MonitorControl {
+    pub session_id: String,
+    pub started_at: DateTime<Utc>,
+    pub command: Vec<String>,
+    pub log_file: PathBuf,
+    pub labels: Arc<Labels>,
+    pub capture: Arc<RwLock<CaptureSettings>>,
+    pub counts: Arc<CaptureCounts>,
+    pub queues: Vec<(&'static str, Arc<QueueStats>)>,
+    pub plugins: Option<Arc<PluginHost>>,
+    pub plugin_loader: Option<PluginLoader>,
+    /// What the account's plan includes, for plugins started by a reload;
+    /// kept current by entitlement revalidation
+    pub entitlements: Arc<RwLock<Entitlements>>,
+    pub tail: Option<Arc<TailServer>>,
+    /// Wakes the event uploader to send its partial batch
+    pub upload_flush: Option<Arc<Notify>>,
+    /// Spool to drain on flush, with the latest access token
+    pub spool: Option<(Spool, watch::Receiver<String>)>,
+    /// Requests held by `--confirm`
+    pub approval: Option<Arc<ApprovalGate>>,
+    /// CPU and memory use of the server
+    pub resources: Arc<ResourceStats>,
+    /// How long the server took to answer, by method
+    pub latency: Arc<LatencyStats>,
+    pub pings: Option<Arc<PingTracker>>,
+    /// Stops uploads while the API keeps failing
+    pub breaker: Option<Arc<CircuitBreaker>>,
+    pub api_latency: Option<Arc<ApiLatency>>,
+}
+
+impl MonitorControl {
+    /// Control over the session a proxy run with `options` belongs to.
+    pub fn new(
+        session_id: &str,
+        command: Vec<String>,
+        log_file: &Path,
+        options: &ProxyOptions,
+    ) -> Self {
+        Self {
+            session_id: session_id.to_string(),
+            started_at: Utc::now(),
+            command,
+            log_file: log_file.to_path_buf(),
+            labels: options.labels.clone(),
+            capture: options.capture.clone(),
+            counts: options.counts.clone(),
+            queues: Vec::new(),
+            plugins: options.plugins.clone(),
+            plugin_loader: None,
+            entitlements: Arc::new(RwLock::new(Entitlements::none())),
+            tail: options.tail.clone(),
+            upload_flush: None,
+            spool: None,
+            approval: options.approval.clone(),
+            resources: options.resources.clone(),
+            latency: options.latency.clone(),
+            pings: options.pings.clone(),
+            breaker: None,
+            api_latency: None,
+        }
+    }
+
+    fn capture_settings(&self) -> CaptureSettings {
+        match self.capture.read() {
+            Ok(settings) => settings.clone(),
+            Err(poisoned) => poisoned.into_inner().clone(),
+        }
+    }
+
+    fn entitlements(&self) -> Entitlements {
+        match self.entitlements.read() {
+            Ok(entitlements) => entitlements.clone(),
+            Err(poisoned) => poisoned.into_inner().clone(),
+        }
+    }
+
+    pub fn status(&self) -> MonitorStatus {
+        let capture = self.capture_settings();
+        MonitorStatus {
+            session_id: self.session_id.clone(),
+            pid: std::process::id(),
+            started_at: self.started_at,
+            command: self.command.clone(),
+            log_file: self.log_file.clone(),
+            labels: self.labels.as_ref().clone(),
+            requests: self.counts.requests.load(Ordering::Relaxed),
+            responses: self.counts.responses.load(Ordering::Relaxed),
+            messages: self.counts.classes(),
+            method_whitelist: capture.method_whitelist,
+            payload_size_limit: capture.payload_size_limit,
+            plugins: self
+                .plugins
+                .as_ref()
+                .map(|plugins| plugins.names())
+                .unwrap_or_default(),
+            plugin_health: self
+                .plugins
+                .as_ref()
+                .map(|plugins| plugins.health())
+                .unwrap_or_default(),
+            tail_clients: self
+                .tail
+                .as_ref()
+                .map(|tail| tail.subscriber_count())
+                .unwrap_or_default(),
+            uploads: self.upload_flush.is_some(),
+            queues: self
+                .queues
+                .iter()
+                .map(|(name, stats)| QueueStatus {
+                    name: name.to_string(),
+                    sent: stats.sent(),
+                    delayed: stats.delayed(),
+                    dropped: stats.dropped(),
+                })
+                .collect(),
+            resources: self.resources.usage(),
+            latency: self.latency.snapshot(),
+            pings: self.pings.as_ref().map(|pings| pings.health()),
+            breaker: self.breaker.as_ref().map(|breaker| breaker.status()),
+            api_latency: self.api_latency.as_ref().map(|latency| latency.summary()),
+        }
+    }
+
+    pub async fn flush(&self) -> Result<FlushOutcome> {
+        if let Some(ref flush) = self.upload_flush {
+            flush.notify_one();
+        }
+        let spool = match self.spool {
+            Some((ref spool, ref tokens)) => {
+                let bearer_token = tokens.borrow().clone();
+                Some(spool.flush(&crate::http::client(), &bearer_token).await?)
+            }
+            None => None,
+        };
+        Ok(FlushOutcome {
+            events: self.upload_flush.is_some(),
+            spool,
+        })
+    }
+
+    /// Apply new capture filters. They last until the config file changes.
+    pub fn update_filters(
+        &self,
+        method_whitelist: Option<Vec<String>>,
+        payload_size_limit: Option<usize>,
+    ) -> Result<CaptureSettings> {
+        let mut settings = self
+            .capture
+            .write()
+            .map_err(|_| anyhow::anyhow!("Capture settings are unavailable"))?;
+        if let Some(methods) = method_whitelist {
+            settings.method_whitelist = methods;
+        }
+        if let Some(limit) = payload_size_limit {
+            settings.payload_size_limit = (limit > 0).then_some(limit);
+        }
+        tracing::info!("Capture filters changed over km ctl: {:?}", *settings);
+        Ok(settings.clone())
+    }
+
+    /// Restart the plugins and return the names of those now running.
+    pub fn reload_plugins(&self) -> Result<Vec<String>> {
+        let (Some(plugins), Some(loader)) = (&self.plugins, &self.plugin_loader) else {
+            return Err(anyhow::anyhow!(
+                "Plugins are disabled for this session (--no-plugins)"
+            ));
+        };
+        let fresh = loader()?;
+        fresh.on_session_start(&self.session_id, &self.labels, &self.entitlements());
+        plugins.replace(fresh);
+        let names = plugins.names();
+        tracing::info!("Reloaded plugins over km ctl: {}", names.join(", "));
+        Ok(names)
+    }
+
+    fn approval(&self) -> Result<&ApprovalGate> {
+        self.approval.as_deref().ok_or_else(|| {
+            anyhow::anyhow!(
+                "This session doesn't hold requests for approval (km monitor --confirm)"
+            )
+        })
+    }
+
+    async fn handle(&self, request: ControlRequest) -> Result<Value> {
+        Ok(match request {
+            ControlRequest::Status => serde_json::to_value(self.status())?,
+            ControlRequest::Flush => serde_json::to_value(self.flush().await?)?,
+            ControlRequest::UpdateFilters {
+                method_whitelist,
+                payload_size_limit,
+            } => {
+                let settings = self.update_filters(method_whitelist, payload_size_limit)?;
+                serde_json::json!({
+                    "method_whitelist": settings.method_whitelist,
+                    "payload_size_limit": settings.payload_size_limit,
+                })
+            }
+            ControlRequest::ReloadPlugins => {
+                serde_json::json!({ "plugins": self.reload_plugins()? })
+            }
+            ControlRequest::PendingApprovals => serde_json::to_value(self.approval()?.pending())?,
+            ControlRequest::Decide { id, approve } => {
+                self.approval()?.decide(id, approve)?;
+                serde_json::json!({ "id": id, "approved": approve })
+            }
+            ControlRequest::StreamEvents => {
+                return Err(anyhow::anyhow!("stream-events can't be combined"))
+            }
+        })
+    }
+}
+
+/// How to reach a running monitor's control server: a Unix socket path or,
+/// on Windows, a named pipe. The monitor writes one of these to the control
+/// directory while it runs.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ControlEndpoint {
+    pub session_id: String,
+    pub pid: u32,
+    pub address: String,
+    pub started_at: DateTime<Utc>,
+}
+
+/// `~/.config/kilometers/ctl` (or the platform equivalent)
+pub fn default_dir() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("ctl"))
+}
+
+trait Io: AsyncRead + AsyncWrite + Unpin + Send {}
+impl<T: AsyncRead + AsyncWrite + Unpin + Send> Io for T {}
+
+#[cfg(unix)]
+mod transport {
+    use super::*;
+    use tokio::net::{UnixListener, UnixStream};
+
+    pub fn address(dir: &Path, session_id: &str) -> String {
+        dir.join(format!("{}.sock", session_id))
+            .to_string_lossy()
+            .into_owned()
+    }
+
+    pub fn listen(
+        dir: &Path,
+        address: &str,
+        control: Arc<MonitorControl>,
+    ) -> Result<JoinHandle<()>> {
+        use std::os::unix::fs::PermissionsExt;
+        // Only the current user may connect
+        fs::set_permissions(dir, fs::Permissions::from_mode(0o700))
+            .context("Failed to secure the control directory")?;
+        let _ = fs::remove_file(address);
+        let listener = UnixListener::bind(address)
+            .with_context(|| format!("Failed to listen on {}", address))?;
+        Ok(tokio::spawn(async move {
+            let mut connections = JoinSet::new();
+            while let Ok((stream, _)) = listener.accept().await {
+                connections.spawn(serve(stream, control.clone()));
+                while connections.try_join_next().is_some() {}
+            }
+        }))
+    }
+
+    pub async fn connect(address: &str) -> std::io::Result<Box<dyn Io>> {
+        Ok(Box::new(UnixStream::connect(address).await?))
+    }
+
+    pub fn cleanup(address: &str) {
+        let _ = fs::remove_file(address);
+    }
+}
+
+#[cfg(windows)]
+mod transport {
+    use super::*;
+    use tokio::net::windows::named_pipe::{ClientOptions, ServerOptions};
+
+    pub fn address(_dir: &Path, session_id: &str) -> String {
+        format!(r"\\.\pipe\kilometers-ctl-{}", session_id)
+    }
+
+    pub fn listen(
+        _dir: &Path,
+        address: &str,
+        control: Arc<MonitorControl>,
+    ) -> Result<JoinHandle<()>> {
+        let address = address.to_string();
+        // Named pipes are only reachable by the current user unless
+        // opened up with a security descriptor, and remote clients are refused
+        let mut server = ServerOptions::new()
+            .first_pipe_instance(true)
+            .reject_remote_clients(true)
+            .create(&address)
+            .with_context(|| format!("Failed to create {}", address))?;
+        Ok(tokio::spawn(async move {
+            let mut connections = JoinSet::new();
+            while server.connect().await.is_ok() {
+                let connected = server;
+                server = match ServerOptions::new()
+                    .reject_remote_clients(true)
+                    .create(&address)
+                {
+                    Ok(next) => next,
+                    Err(e) => {
+                        tracing::warn!("Control pipe closed: {}", e);
+                        break;
+                    }
+                };
+                connections.spawn(serve(connected, control.clone()));
+                while connections.try_join_next().is_some() {}
+            }
+        }))
+    }
+
+    pub async fn connect(address: &str) -> std::io::Result<Box<dyn Io>> {
+        Ok(Box::new(ClientOptions::new().open(address)?))
+    }
+
+    pub fn cleanup(_address: &str) {}
+}
+
+/// Serves `km ctl` requests for a running monitor session. Must be started
+/// inside the Tokio runtime; dropping it stops the server, disconnects its
+/// clients and removes its endpoint file.
+pub struct ControlServer {
+    endpoint: ControlEndpoint,
+    path: PathBuf,
+    // Aborting the accept loop drops its connections along with it
+    accept_loop: JoinHandle<()>,
+}
+
+impl ControlServer {
+    /// Listen for `km ctl` and advertise the server in `dir`.
+    pub fn start(dir: &Path, control: MonitorControl) -> Result<Self> {
+        fs::create_dir_all(dir).context("Failed to create control directory")?;
+        let endpoint = ControlEndpoint {
+            session_id: control.session_id.clone(),
+            pid: std::process::id(),
+            address: transport::address(dir, &control.session_id),
+            started_at: control.started_at,
+        };
+        let accept_loop = transport::listen(dir, &endpoint.address, Arc::new(control))?;
+
+        let path = dir.join(format!("{}.json", endpoint.session_id));
+        if let Err(e) = fs::write(&path, serde_json::to_string_pretty(&endpoint)?) {
+            accept_loop.abort();
+            transport::cleanup(&endpoint.address);
+            return Err(e).with_context(|| format!("Failed to write {:?}", path));
+        }
+        tracing::debug!(
+            "Control server for session {} on {}",
+            endpoint.session_id,
+            endpoint.address
+        );
+        Ok(Self {
+            endpoint,
+            path,
+            accept_loop,
+        })
+    }
+}
+
+impl Drop for ControlServer {
+    fn drop(&mut self) {
+        self.accept_loop.abort();
+        transport::cleanup(&self.endpoint.address);
+        let _ = fs::remove_file(&self.path);
+    }
+}
+
+async fn respond<W: AsyncWrite + Unpin>(writer: &mut W, response: ControlResponse) -> bool {
+    let mut line = serde_json::to_string(&response).unwrap_or_default();
+    line.push('\n');
+    writer.write_all(line.as_bytes()).await.is_ok() && writer.flush().await.is_ok()
+}
+
+/// Answer requests on one connection until the client hangs up or switches
+/// it to streaming events.
+async fn serve<S: AsyncRead + AsyncWrite + Unpin>(stream: S, control: Arc<MonitorControl>) {
+    let (reader, mut writer) = tokio::io::split(stream);
+    let mut lines = BufReader::new(reader).lines();
+    while let Ok(Some(line)) = lines.next_line().await {
+        let request = match serde_json::from_str::<ControlRequest>(&line) {
+            Ok(request) => request,
+            Err(e) => {
+                let error = anyhow::anyhow!("Invalid request: {}", e);
+                if !respond(&mut writer, ControlResponse::from_result(Err(error))).await {
+                    return;
+                }
+                continue;
+            }
+        };
+        if request == ControlRequest::StreamEvents {
+            stream_events(&control, &mut writer).await;
+            return;
+        }
+        let response = ControlResponse::from_result(control.handle(request).await);
+        if !respond(&mut writer, response).await {
+            return;
+        }
+    }
+}
+
+async fn stream_events<W: AsyncWrite + Unpin>(control: &MonitorControl, writer: &mut W) {
+    let Some(events) = control.tail.as_ref().and_then(|tail| tail.events()) else {
+        let error = anyhow::anyhow!("Event streaming is unavailable for this session");
+        respond(writer, ControlResponse::from_result(Err(error))).await;
+        return;
+    };
+    if !respond(writer, ControlResponse::from_result(Ok(Value::Null))).await {
+        return;
+    }
+
+    // The tail server hands out events on a blocking channel
+    let (tx, mut rx) = mpsc::channel::<Arc<str>>(EVENT_BUFFER);
+    std::thread::spawn(move || {
+        while let Ok(line) = events.recv() {
+            if tx.blocking_send(line).is_err() {
+                break;
+            }
+        }
+    });
+    while let Some(line) = rx.recv().await {
+        let sent = async {
+            writer.write_all(line.as_bytes()).await?;
+            writer.write_all(b"\n").await?;
+            writer.flush().await
+        };
+        if sent.await.is_err() {
+            break;
+        }
+    }
+}
+
+/// Sessions with a control server right now, most recently started first.
+/// Endpoint files left behind by sessions that are gone are cleaned up.
+pub async fn running(dir: &Path) -> Vec<ControlEndpoint> {
+    let Ok(files) = fs::read_dir(dir) else {
+        return Vec::new();
+    };
+    let mut endpoints = Vec::new();
+    for path in files.flatten().map(|file| file.path()) {
+        if path.extension().is_none_or(|ext| ext != "json") {
+            continue;
+        }
+        let Some(endpoint) = fs::read_to_string(&path)
+            .ok()
+            .and_then(|contents| serde_json::from_str::<ControlEndpoint>(&contents).ok())
+        else {
+            continue;
+        };
+        match tokio::time::timeout(PROBE_TIMEOUT, transport::connect(&endpoint.address)).await {
+            Ok(Ok(_)) => endpoints.push(endpoint),
+            _ => {
+                let _ = fs::remove_file(&path);
+                transport::cleanup(&endpoint.address);
+            }
+        }
+    }
+    endpoints.sort_by(|a, b| b.started_at.cmp(&a.started_at));
+    endpoints
+}
+
+/// The running session whose id starts with `prefix`, or the most recent
+/// one when no prefix is given.
+pub fn resolve<'a>(
+    endpoints: &'a [ControlEndpoint],
+    prefix: Option<&str>,
+) -> Result<&'a ControlEndpoint> {
+    let Some(prefix) = prefix else {
+        return endpoints
+            .first()
+            .ok_or_else(|| anyhow::anyhow!("No running km monitor sessions"));
+    };
+    let matches: Vec<&ControlEndpoint> = endpoints
+        .iter()
+        .filter(|e| e.session_id.starts_with(prefix))
+        .collect();
+    match matches.as_slice() {
+        [endpoint] => Ok(endpoint),
+        [] => Err(anyhow::anyhow!("No running session matches '{}'", prefix)),
+        _ => Err(anyhow::anyhow!(
+            "'{}' matches {} running sessions; use a longer prefix",
+            prefix,
+            matches.len()
+        )),
+    }
+}
+
+/// A `km ctl` connection to a running monitor.
+pub struct ControlClient {
+    stream: BufReader<Box<dyn Io>>,
+}
+
+impl ControlClient {
+    pub async fn connect(endpoint: &ControlEndpoint) -> Result<Self> {
+        let stream = transport::connect(&endpoint.address)
+            .await
+            .with_context(|| format!("Session {} is no longer running", endpoint.session_id))?;
+        Ok(Self {
+            stream: BufReader::new(stream),
+        })
+    }
+
+    async fn read_line(&mut self) -> Result<Option<String>> {
+        let mut line = String::new();
+        let read = self
+            .stream
+            .read_line(&mut line)
+            .await
+            .context("Lost the connection to the session")?;
+        Ok((read > 0).then(|| line.trim_end().to_string()))
+    }
+
+    /// Send a request and wait for its result.
+    pub async fn request(&mut self, request: &ControlRequest) -> Result<Value> {
+        let mut line = serde_json::to_string(request)?;
+        line.push('\n');
+        let stream = self.stream.get_mut();
+        stream
+            .write_all(line.as_bytes())
+            .await
+            .context("Failed to send the request")?;
+        stream.flush().await.context("Failed to send the request")?;
+
+        let reply = self
+            .read_line()
+            .await?
+            .ok_or_else(|| anyhow::anyhow!("The session closed the connection"))?;
+        let response: ControlResponse =
+            serde_json::from_str(&reply).context("Unexpected reply from the session")?;
+        match response.ok {
+            true => Ok(response.result.unwrap_or(Value::Null)),
+            false => Err(anyhow::anyhow!(response
+                .error
+                .unwrap_or_else(|| "Request failed".to_string()))),
+        }
+    }
+
+    /// Switch the connection to streaming events; read them with
+    /// [`Self::next_event`].
+    pub async fn stream_events(&mut self) -> Result<()> {
+        self.request(&ControlRequest::StreamEvents)
+            .await
+            .map(|_| ())
+    }
+
+    /// The next captured event as a JSON line, or `None` once the session
+    /// has ended.
+    pub async fn next_event(&mut self) -> Result<Option<String>> {
+        self.read_line().await
+    }
+}
+
+/// Render a status report for the terminal, in the language chosen at
+/// startup.
+pub fn render_status(status: &MonitorStatus, now: DateTime<Utc>) -> Vec<String> {
+    let mut lines = vec![
+        t(
+            "status.session",
+            &[("id", &status.session_id), ("pid", &status.pid)],
+        ),
+        t("status.command", &[("command", &status.command.join(" "))]),
+        t(
+            "status.started",
+            &[
+                ("time", &status.started_at.format("%Y-%m-%d %H:%M:%S UTC")),
+                (
+                    "uptime",
+                    &format_duration((now - status.started_at).num_seconds().max(0)),
+                ),
+            ],
+        ),
+        t("status.log_file", &[("path", &status.log_file.display())]),
+        t(
+            "status.captured",
+            &[
+                ("requests", &status.requests),
+                ("responses", &status.responses),
+            ],
+        ),
+        t(
+            "status.messages",
+            &[("messages", &status.messages.describe())],
+        ),
+    ];
+    if let Some(ref resources) = status.resources {
+        lines.push(t("status.server", &[("usage", &resources.describe())]));
+    }
+    if let Some(ref pings) = status.pings {
+        lines.push(t("status.pings", &[("pings", &pings.describe())]));
+    }
+    if !status.labels.is_empty() {
+        let labels: Vec<String> = status
+            .labels
+            .iter()
+            .map(|(key, value)| format!("{}={}", key, value))
+            .collect();
+        lines.push(t("status.labels", &[("labels", &labels.join(", "))]));
+    }
+    let methods = if status.method_whitelist.is_empty() {
+        t("status.all_methods", &[])
+    } else {
+        status.method_whitelist.join(", ")
+    };
+    let limit = status
+        .payload_size_limit
+        .map(|limit| t("status.payload_limit", &[("limit", &limit)]))
+        .unwrap_or_default();
+    lines.push(t(
+        "status.capture",
+        &[("methods", &methods), ("limit", &limit)],
+    ));
+    let plugins = if status.plugins.is_empty() {
+        t("status.no_plugins", &[])
+    } else {
+        status.plugins.join(", ")
+    };
+    lines.push(t("status.plugins", &[("plugins", &plugins)]));
+    for plugin in &status.plugin_health {
+        if plugin.state != HealthState::Healthy {
+            lines.push(t(
+                "status.down",
+                &[("name", &plugin.name), ("health", &plugin.describe(now))],
+            ));
+        }
+    }
+    lines.push(t("status.tailing", &[("count", &status.tail_clients)]));
+    lines.push(match status.uploads {
+        true => t("status.uploads_on", &[]),
+        false => t("status.uploads_off", &[]),
+    });
+    if let Some(ref breaker) = status.breaker {
+        lines.push(t("status.breaker", &[("breaker", &breaker.describe())]));
+    }
+    if let Some(ref api_latency) = status.api_latency {
+        lines.push(t("status.api", &[("latency", &api_latency.describe())]));
+    }
+    for queue in &status.queues {
+        lines.push(t(
+            "status.queue",
+            &[
+                ("name", &queue.name),
+                ("sent", &queue.sent),
+                ("delayed", &queue.delayed),
+                ("dropped", &queue.dropped),
+            ],
+        ));
+    }
+    lines
+}
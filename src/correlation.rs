@@ -0,0 +1,303 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::HashMap;
+
+use crate::traffic::TrafficEntry;
+
+/// What a message is, by its JSON-RPC shape and which side sent it. Either
+/// side can send requests and notifications: servers ask clients for
+/// sampling or roots, and clients answer them.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum MessageClass {
+    ClientRequest,
+    ClientResponse,
+    ClientNotification,
+    ServerRequest,
+    ServerResponse,
+    ServerNotification,
+    /// Not a JSON-RPC message, e.g. a line that isn't JSON
+    Other,
+}
+
+impl MessageClass {
+    pub const ALL: [MessageClass; 7] = [
+        MessageClass::ClientRequest,
+        MessageClass::ClientResponse,
+        MessageClass::ClientNotification,
+        MessageClass::ServerRequest,
+        MessageClass::ServerResponse,
+        MessageClass::ServerNotification,
+        MessageClass::Other,
+    ];
+
+    /// Classify `message`, sent by the client when `from_client` and by
+    /// the server otherwise. A request has a method and an id, a
+    /// notification a method and no id, a response a result or an error.
+    pub fn of(message: &Value, from_client: bool) -> Self {
+        if message.get("jsonrpc").is_none() {
+            return Self::Other;
+        }
+        let (request, notification, response) = if from_client {
+            (
+                Self::ClientRequest,
+                Self::ClientNotification,
+                Self::ClientResponse,
+            )
+        } else {
+            (
+                Self::ServerRequest,
+                Self::ServerNotification,
+                Self::ServerResponse,
+            )
+        };
+        if message.get("method").is_some() {
+            if message.get("id").is_some() {
+                request
+            } else {
+                notification
+            }
+        } else if message.get("result").is_some() || message.get("error").is_some() {
+            response
+        } else {
+            Self::Other
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::ClientRequest => "client_request",
+            Self::ClientResponse => "client_response",
+            Self::ClientNotification => "client_notification",
+            Self::ServerRequest => "server_request",
+            Self::ServerResponse => "server_response",
+            Self::ServerNotification => "server_notification",
+            Self::Other => "other",
+        }
+    }
+}
+
+/// Messages of each class seen in a session.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct MessageCounts {
+    #[serde(default)]
+    pub client_requests: u64,
+    #[serde(default)]
+    pub client_responses: u64,
+    #[serde(default)]
+    pub client_notifications: u64,
+    #[serde(default)]
+    pub server_requests: u64,
+    #[serde(default)]
+    pub server_responses: u64,
+    #[serde(default)]
+    pub server_notifications: u64,
+    #[serde(default)]
+    pub other: u64,
+}
+
+impl MessageCounts {
+    pub fn get(&self, class: MessageClass) -> u64 {
+        match class {
+            MessageClass::ClientRequest => self.client_requests,
+            MessageClass::ClientResponse => self.client_responses,
+            MessageClass::ClientNotification => self.client_notifications,
+            MessageClass::ServerRequest => self.server_requests,
+            MessageClass::ServerResponse => self.server_responses,
+            MessageClass::ServerNotification => self.server_notifications,
+            MessageClass::Other => self.other,
+        }
+    }
+
+    pub fn add(&mut self, class: MessageClass, count: u64) {
+        let field = match class {
+            MessageClass::ClientRequest => &mut self.client_requests,
+            MessageClass::ClientResponse => &mut self.client_responses,
+            MessageClass::ClientNotification => &mut self.client_notifications,
+            MessageClass::ServerRequest => &mut self.server_requests,
+            MessageClass::ServerResponse => &mut self.server_responses,
+            MessageClass::ServerNotification => &mut self.server_notifications,
+            MessageClass::Other => &mut self.other,
+        };
+        *field += count;
+    }
+
+    /// E.g. `12 client requests, 12 server responses, 3 server
+    /// notifications`; classes with no messages are left out.
+    pub fn describe(&self) -> String {
+        let parts: Vec<String> = MessageClass::ALL
+            .iter()
+            .filter(|class| self.get(**class) > 0)
+            .map(|class| {
+                let count = self.get(*class);
+                let name = class.as_str().replace('_', " ");
+                match (count, *class) {
+                    (1, _) => format!("1 {}", name),
+                    (_, MessageClass::Other) => format!("{} other", count),
+                    _ => format!("{} {}s", count, name),
+                }
+            })
+            .collect();
+        if parts.is_empty() {
+            "none".to_string()
+        } else {
+            parts.join(", ")
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+#[serde(tag = "status", rename_all = "lowercase")]
+pub enum CallStatus {
+    /// No response has been seen yet (or the session ended without one)
+    Pending,
+    Success,
+    Error {
+        code: Option<i64>,
+        message: String,
+    },
+}
+
+impl CallStatus {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Pending => "pending",
+            Self::Success => "success",
+            Self::Error { .. } => "error",
+        }
+    }
+
+    /// The JSON-RPC error code, for a call that failed with one
+    pub fn code(&self) -> Option<i64> {
+        match self {
+            Self::Error { code, .. } => *code,
+            _ => None,
+        }
+    }
+}
+
+/// A JSON-RPC request matched with its response, with round-trip timing.
+#[derive(Debug, Clone, Serialize)]
+pub struct CorrelatedCall {
+    pub session_id: Option<String>,
+    pub id: Value,
+    pub method: String,
+    pub request: Value,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub response: Option<Value>,
+    pub started_at: DateTime<Utc>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub completed_at: Option<DateTime<Utc>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub duration_ms: Option<f64>,
+    #[serde(flatten)]
+    pub status: CallStatus,
+}
+
+/// Tracks in-flight requests by JSON-RPC id and pairs them with responses
+/// as they arrive. Used both live by the proxy and offline over captures.
+#[derive(Debug, Default)]
+pub struct Correlator {
+    pending: HashMap<String, CorrelatedCall>,
+}
+
+impl Correlator {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Record a client request. Notifications (no id) are not tracked.
+    pub fn on_request(&mut self, rpc: &Value, session_id: Option<&str>, at: DateTime<Utc>) {
+        let (id, method) = match (rpc.get("id"), rpc.get("method").and_then(|m| m.as_str())) {
+            (Some(id), Some(method)) => (id.clone(), method.to_string()),
+            _ => return,
+        };
+
+        self.pending.insert(
+            id.to_string(),
+            CorrelatedCall {
+                session_id: session_id.map(String::from),
+                id,
+                method,
+                request: rpc.clone(),
+                response: None,
+                started_at: at,
+                completed_at: None,
+                duration_ms: None,
+                status: CallStatus::Pending,
+            },
+        );
+    }
+
+    /// Record a server message. Returns the completed call when the message
+    /// is a response to a tracked request.
+    pub fn on_response(&mut self, rpc: &Value, at: DateTime<Utc>) -> Option<CorrelatedCall> {
+        if rpc.get("method").is_some() {
+            return None;
+        }
+        let id = rpc.get("id")?;
+        let mut call = self.pending.remove(&id.to_string())?;
+
+        call.status = match rpc.get("error") {
+            Some(error) => CallStatus::Error {
+                code: error.get("code").and_then(|c| c.as_i64()),
+                message: error
+                    .get("message")
+                    .and_then(|m| m.as_str())
+                    .unwrap_or_default()
+                    .to_string(),
+            },
+            None => CallStatus::Success,
+        };
+        call.duration_ms = (at - call.started_at)
+            .num_microseconds()
+            .map(|us| us as f64 / 1000.0);
+        call.completed_at = Some(at);
+        call.response = Some(rpc.clone());
+
+        Some(call)
+    }
+
+    pub fn pending_count(&self) -> usize {
+        self.pending.len()
+    }
+
+    /// Remove and return requests that never received a response.
+    pub fn drain_pending(&mut self) -> Vec<CorrelatedCall> {
+        let mut calls: Vec<CorrelatedCall> = self.pending.drain().map(|(_, c)| c).collect();
+        calls.sort_by_key(|c| c.started_at);
+        calls
+    }
+}
+
+/// Correlate every request/response pair in a capture. Calls are returned
+/// in request order; unanswered requests are included as pending.
+pub fn correlate(entries: &[TrafficEntry]) -> Vec<CorrelatedCall> {
+    let mut by_session: HashMap<Option<String>, Correlator> = HashMap::new();
+    let mut calls = Vec::new();
+
+    for entry in entries {
+        let rpc = match entry.rpc() {
+            Some(rpc) => rpc,
+            None => continue,
+        };
+        let correlator = by_session.entry(entry.session_id.clone()).or_default();
+
+        if entry.direction == "request" {
+            correlator.on_request(&rpc, entry.session_id.as_deref(), entry.timestamp);
+        } else if let Some(mut call) = correlator.on_response(&rpc, entry.timestamp) {
+            // Prefer the proxy's monotonic measurement when it was recorded
+            if entry.duration_ms.is_some() {
+                call.duration_ms = entry.duration_ms;
+            }
+            calls.push(call);
+        }
+    }
+
+    for (_, mut correlator) in by_session {
+        calls.extend(correlator.drain_pending());
+    }
+    calls.sort_by_key(|c| c.started_at);
+    calls
+}
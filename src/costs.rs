@@ -0,0 +1,342 @@
+//! Token and cost accounting for sampling/createMessage, where the MCP
+//! server asks the client's model for a completion. Each answered request
+//! is counted against the model that answered it, with the token counts
+//! the client reported or, failing that, an estimate from the text, and
+//! priced from a table of USD per million tokens. Totals are sent with
+//! each upload batch and shown by `km report`.
+
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::Mutex;
+
+use crate::traffic::{self, TrafficEntry};
+
+pub const SAMPLING_METHOD: &str = "sampling/createMessage";
+/// Characters per token when a client doesn't report token counts
+const CHARS_PER_TOKEN: u64 = 4;
+/// Sampling requests waiting for an answer; more are not counted
+const MAX_PENDING: usize = 1024;
+/// Model recorded when neither the answer nor the hints name one
+const UNKNOWN_MODEL: &str = "unknown";
+
+/// List prices in USD per million input and output tokens, by model name
+/// pattern. Prices set in `costs.pricing` take precedence.
+const BUILTIN_PRICES: &[(&str, f64, f64)] = &[
+    ("claude-sonnet-4*", 3.0, 15.0),
+    ("claude-3-7-sonnet*", 3.0, 15.0),
+    ("claude-3-5-sonnet*", 3.0, 15.0),
+    ("claude-3-5-haiku*", 0.8, 4.0),
+    ("claude-3-haiku*", 0.25, 1.25),
+    ("gpt-4o*", 2.5, 10.0),
+    ("gpt-4o-mini*", 0.15, 0.6),
+    ("gpt-4.1*", 2.0, 8.0),
+    ("gpt-4.1-mini*", 0.4, 1.6),
+];
+
+/// USD per million tokens.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct ModelPrice {
+    pub input: f64,
+    pub output: f64,
+}
+
+impl ModelPrice {
+    pub fn cost(&self, input_tokens: u64, output_tokens: u64) -> f64 {
+        (input_tokens as f64 * self.input + output_tokens as f64 * self.output) / 1_000_000.0
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct CostConfig {
+    /// Prices by model name pattern (e.g. claude-sonnet-4*), on top of the
+    /// built-in ones
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub pricing: BTreeMap<String, ModelPrice>,
+}
+
+impl CostConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        for (pattern, price) in &self.pricing {
+            if pattern.trim().is_empty() {
+                return Err(anyhow::anyhow!("costs.pricing has an empty model pattern"));
+            }
+            if ![price.input, price.output]
+                .iter()
+                .all(|p| p.is_finite() && *p >= 0.0)
+            {
+                return Err(anyhow::anyhow!(
+                    "costs.pricing.{} prices must be 0 or more",
+                    pattern
+                ));
+            }
+        }
+        Ok(())
+    }
+
+    /// The price of `model`: the longest configured pattern matching it,
+    /// else the longest built-in one.
+    pub fn price(&self, model: &str) -> Option<ModelPrice> {
+        let model = model.to_ascii_lowercase();
+        longest_match(
+            self.pricing
+                .iter()
+                .map(|(pattern, price)| (pattern.as_str(), *price)),
+            &model,
+        )
+        .or_else(|| {
+            longest_match(
+                BUILTIN_PRICES.iter().map(|(pattern, input, output)| {
+                    let price = ModelPrice {
+                        input: *input,
+                        output: *output,
+                    };
+                    (*pattern, price)
+                }),
+                &model,
+            )
+        })
+    }
+}
+
+fn longest_match<'a>(
+    prices: impl Iterator<Item = (&'a str, ModelPrice)>,
+    model: &str,
+) -> Option<ModelPrice> {
+    prices
+        .filter(|(pattern, _)| traffic::method_matches(&pattern.to_ascii_lowercase(), model))
+        .max_by_key(|(pattern, _)| pattern.len())
+        .map(|(_, price)| price)
+}
+
+/// Tokens used by one answered sampling request.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SamplingUsage {
+    pub model: String,
+    pub input_tokens: u64,
+    pub output_tokens: u64,
+    /// The counts are estimated from the text, not reported by the client
+    pub estimated: bool,
+}
+
+impl SamplingUsage {
+    /// Usage of the sampling `request` answered by `response`, both
+    /// JSON-RPC messages. `None` when the response isn't a result.
+    pub fn of(request: &Value, response: &Value) -> Option<Self> {
+        let result = response.get("result")?;
+        let params = request.get("params").unwrap_or(&Value::Null);
+        let model = result
+            .get("model")
+            .and_then(Value::as_str)
+            .filter(|model| !model.is_empty())
+            .or_else(|| params.pointer("/modelPreferences/hints/0/name")?.as_str())
+            .unwrap_or(UNKNOWN_MODEL)
+            .to_string();
+
+        let usage = result
+            .get("usage")
+            .or_else(|| result.pointer("/_meta/usage"));
+        let reported = |keys: &[&str]| keys.iter().find_map(|key| usage?.get(key)?.as_u64());
+        let input = reported(&["inputTokens", "input_tokens", "prompt_tokens"]);
+        let output = reported(&["outputTokens", "output_tokens", "completion_tokens"]);
+        if let (Some(input_tokens), Some(output_tokens)) = (input, output) {
+            return Some(Self {
+                model,
+                input_tokens,
+                output_tokens,
+                estimated: false,
+            });
+        }
+
+        let prompt = params
+            .get("systemPrompt")
+            .and_then(Value::as_str)
+            .map_or(0, |s| s.chars().count() as u64)
+            + params
+                .get("messages")
+                .and_then(Value::as_array)
+                .map_or(0, |messages| {
+                    messages
+                        .iter()
+                        .filter_map(|m| m.get("content"))
+                        .map(text_chars)
+                        .sum()
+                });
+        Some(Self {
+            model,
+            input_tokens: prompt.div_ceil(CHARS_PER_TOKEN),
+            output_tokens: result
+                .get("content")
+                .map_or(0, text_chars)
+                .div_ceil(CHARS_PER_TOKEN),
+            estimated: true,
+        })
+    }
+}
+
+/// Characters of text in a sampling content block or list of blocks.
+/// Images and audio aren't counted.
+fn text_chars(content: &Value) -> u64 {
+    match content {
+        Value::Array(blocks) => blocks.iter().map(text_chars).sum(),
+        Value::Object(block) => block
+            .get("text")
+            .and_then(Value::as_str)
+            .map_or(0, |text| text.chars().count() as u64),
+        _ => 0,
+    }
+}
+
+fn is_zero(value: &u64) -> bool {
+    *value == 0
+}
+
+/// Sampling done with one model.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ModelUsage {
+    pub calls: u64,
+    pub input_tokens: u64,
+    pub output_tokens: u64,
+    /// Calls whose token counts were estimated from the text
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub estimated_calls: u64,
+    /// `None` when the model has no price
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cost_usd: Option<f64>,
+}
+
+/// Sampling usage and cost by model.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct CostSummary {
+    pub models: BTreeMap<String, ModelUsage>,
+}
+
+impl CostSummary {
+    pub fn is_empty(&self) -> bool {
+        self.models.is_empty()
+    }
+
+    pub fn add(&mut self, usage: SamplingUsage, pricing: &CostConfig) {
+        let price = pricing.price(&usage.model);
+        let model = self.models.entry(usage.model).or_default();
+        model.calls += 1;
+        model.input_tokens += usage.input_tokens;
+        model.output_tokens += usage.output_tokens;
+        if usage.estimated {
+            model.estimated_calls += 1;
+        }
+        if let Some(price) = price {
+            let cost = price.cost(usage.input_tokens, usage.output_tokens);
+            model.cost_usd = Some(model.cost_usd.unwrap_or_default() + cost);
+        }
+    }
+
+    /// Cost of the models that have a price
+    pub fn total_usd(&self) -> f64 {
+        self.models.values().filter_map(|m| m.cost_usd).sum()
+    }
+
+    /// Models without a price, whose calls aren't in the total
+    pub fn unpriced(&self) -> Vec<&str> {
+        self.models
+            .iter()
+            .filter(|(_, usage)| usage.cost_usd.is_none())
+            .map(|(model, _)| model.as_str())
+            .collect()
+    }
+}
+
+#[derive(Debug, Default)]
+struct TrackerState {
+    /// Sampling requests by JSON-RPC id, until the client answers
+    pending: HashMap<String, Value>,
+    summary: CostSummary,
+}
+
+/// Pairs a session's sampling requests with the client's answers and adds
+/// up what they cost.
+#[derive(Debug, Default)]
+pub struct CostTracker {
+    pricing: CostConfig,
+    state: Mutex<TrackerState>,
+}
+
+impl CostTracker {
+    pub fn new(pricing: CostConfig) -> Self {
+        Self {
+            pricing,
+            state: Mutex::default(),
+        }
+    }
+
+    /// A sampling/createMessage request from the server.
+    pub fn request(&self, content: &str) {
+        let Ok(message) = serde_json::from_str::<Value>(content) else {
+            return;
+        };
+        let Some(id) = message.get("id").map(Value::to_string) else {
+            return;
+        };
+        if let Ok(mut state) = self.state.lock() {
+            if state.pending.len() < MAX_PENDING {
+                state.pending.insert(id, message);
+            }
+        }
+    }
+
+    /// A response from the client; answers to sampling requests are counted.
+    pub fn response(&self, content: &str) {
+        let Ok(mut state) = self.state.lock() else {
+            return;
+        };
+        if state.pending.is_empty() {
+            return;
+        }
+        let Ok(message) = serde_json::from_str::<Value>(content) else {
+            return;
+        };
+        let Some(request) = message
+            .get("id")
+            .and_then(|id| state.pending.remove(&id.to_string()))
+        else {
+            return;
+        };
+        if let Some(usage) = SamplingUsage::of(&request, &message) {
+            state.summary.add(usage, &self.pricing);
+        }
+    }
+
+    pub fn snapshot(&self) -> CostSummary {
+        self.state
+            .lock()
+            .map(|state| state.summary.clone())
+            .unwrap_or_default()
+    }
+}
+
+/// Sampling costs in the entries of one session, with their resolved
+/// methods (see [`traffic::resolve_methods`]). Sampling requests come from
+/// the server, so they're logged as responses and the answers as requests.
+pub fn summarize(
+    entries: &[TrafficEntry],
+    methods: &[Option<String>],
+    pricing: &CostConfig,
+) -> CostSummary {
+    let tracker = CostTracker::new(pricing.clone());
+    for (entry, method) in entries.iter().zip(methods) {
+        if method.as_deref() != Some(SAMPLING_METHOD) {
+            continue;
+        }
+        match entry.direction.as_str() {
+            "response" => tracker.request(&entry.content),
+            "request" => tracker.response(&entry.content),
+            _ => {}
+        }
+    }
+    tracker.snapshot()
+}
@@ -0,0 +1,381 @@
+use anyhow::{Context, Result};
+use base64::{engine::general_purpose::STANDARD, Engine as _};
+use ring::aead::{self, Aad, LessSafeKey, Nonce, UnboundKey};
+use ring::pbkdf2;
+use ring::rand::{SecureRandom, SystemRandom};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::num::NonZeroU32;
+use std::path::{Path, PathBuf};
+
+use crate::config::Config;
+use crate::keyring_token_store::{is_ci_environment, SERVICE_NAME};
+
+/// Prefix of the names API keys are stored under
+pub const API_KEY: &str = "km-api-key";
+/// File name of the encrypted fallback store, next to the config file
+pub const CREDENTIALS_FILE: &str = "km_credentials.enc";
+/// Overrides the machine-derived key of the encrypted credentials file
+pub const PASSPHRASE_ENV: &str = "KM_CREDENTIALS_PASSPHRASE";
+
+const FILE_VERSION: u32 = 1;
+const PBKDF2_ITERATIONS: u32 = 100_000;
+const SALT_LEN: usize = 16;
+
+/// Somewhere secrets can be kept outside the config file.
+pub trait CredentialStore {
+    /// Human-readable name of the backend, for messages
+    fn backend(&self) -> &'static str;
+    fn get(&self, name: &str) -> Result<Option<String>>;
+    fn set(&self, name: &str, secret: &str) -> Result<()>;
+    fn delete(&self, name: &str) -> Result<()>;
+}
+
+/// The OS credential store: Keychain on macOS, Credential Manager on
+/// Windows and the Secret Service (libsecret) on Linux.
+pub struct KeychainStore;
+
+impl KeychainStore {
+    /// The keychain, if it can be used from this process.
+    pub fn new() -> Result<Self> {
+        if is_ci_environment() {
+            return Err(anyhow::anyhow!("Keyring not available in CI environment"));
+        }
+        // A lookup tells a missing entry apart from a missing keychain
+        match keyring::Entry::new(SERVICE_NAME, API_KEY)
+            .context("Failed to create keyring entry")?
+            .get_password()
+        {
+            Ok(_) | Err(keyring::Error::NoEntry) => Ok(Self),
+            Err(e) => Err(anyhow::anyhow!("OS keychain unavailable: {}", e)),
+        }
+    }
+
+    fn entry(name: &str) -> Result<keyring::Entry> {
+        keyring::Entry::new(SERVICE_NAME, name).context("Failed to create keyring entry")
+    }
+}
+
+impl CredentialStore for KeychainStore {
+    fn backend(&self) -> &'static str {
+        "OS keychain"
+    }
+
+    fn get(&self, name: &str) -> Result<Option<String>> {
+        match Self::entry(name)?.get_password() {
+            Ok(secret) => Ok(Some(secret)),
+            Err(keyring::Error::NoEntry) => Ok(None),
+            Err(e) => Err(anyhow::anyhow!(
+                "Failed to read '{}' from keychain: {}",
+                name,
+                e
+            )),
+        }
+    }
+
+    fn set(&self, name: &str, secret: &str) -> Result<()> {
+        Self::entry(name)?
+            .set_password(secret)
+            .map_err(|e| anyhow::anyhow!("Failed to save '{}' to keychain: {}", name, e))
+    }
+
+    fn delete(&self, name: &str) -> Result<()> {
+        match Self::entry(name)?.delete_credential() {
+            Ok(()) | Err(keyring::Error::NoEntry) => Ok(()),
+            Err(e) => Err(anyhow::anyhow!(
+                "Failed to delete '{}' from keychain: {}",
+                name,
+                e
+            )),
+        }
+    }
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct CredentialsFile {
+    version: u32,
+    /// Base64 PBKDF2 salt
+    salt: String,
+    /// Base64 nonce followed by the AES-256-GCM ciphertext, by name
+    entries: BTreeMap<String, String>,
+}
+
+/// Fallback when there is no OS keychain (headless Linux, containers):
+/// secrets are AES-256-GCM encrypted in a file readable only by the user.
+/// The key comes from `KM_CREDENTIALS_PASSPHRASE`, or else from the machine
+/// id, which only stops the file from being useful on another machine.
+pub struct EncryptedFileStore {
+    path: PathBuf,
+    passphrase: String,
+}
+
+impl EncryptedFileStore {
+    pub fn new(path: PathBuf, passphrase: String) -> Self {
+        Self { path, passphrase }
+    }
+
+    /// The store next to the config file at `config_path`.
+    pub fn for_config(config_path: &Path) -> Self {
+        let passphrase = std::env::var(PASSPHRASE_ENV)
+            .ok()
+            .filter(|p| !p.is_empty())
+            .unwrap_or_else(machine_secret);
+        Self::new(config_path.with_file_name(CREDENTIALS_FILE), passphrase)
+    }
+
+    fn read(&self) -> Result<CredentialsFile> {
+        if !self.path.exists() {
+            let mut salt = [0u8; SALT_LEN];
+            SystemRandom::new()
+                .fill(&mut salt)
+                .map_err(|_| anyhow::anyhow!("Failed to generate salt"))?;
+            return Ok(CredentialsFile {
+                version: FILE_VERSION,
+                salt: STANDARD.encode(salt),
+                entries: BTreeMap::new(),
+            });
+        }
+        let contents = fs::read_to_string(&self.path)
+            .with_context(|| format!("Failed to read {:?}", self.path))?;
+        let file: CredentialsFile = serde_json::from_str(&contents)
+            .with_context(|| format!("Failed to parse {:?}", self.path))?;
+        if file.version != FILE_VERSION {
+            return Err(anyhow::anyhow!(
+                "Unsupported credentials file version {} in {:?}",
+                file.version,
+                self.path
+            ));
+        }
+        Ok(file)
+    }
+
+    fn write(&self, file: &CredentialsFile) -> Result<()> {
+        if let Some(dir) = self.path.parent() {
+            fs::create_dir_all(dir).context("Failed to create credentials directory")?;
+        }
+        let contents = serde_json::to_string_pretty(file)?;
+        let tmp_path = self.path.with_extension("enc.tmp");
+        let mut options = fs::OpenOptions::new();
+        options.write(true).create(true).truncate(true);
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::OpenOptionsExt;
+            options.mode(0o600);
+        }
+        std::io::Write::write_all(
+            &mut options
+                .open(&tmp_path)
+                .context("Failed to write credentials file")?,
+            contents.as_bytes(),
+        )
+        .context("Failed to write credentials file")?;
+        fs::rename(&tmp_path, &self.path).context("Failed to write credentials file")
+    }
+
+    fn key(&self, file: &CredentialsFile) -> Result<LessSafeKey> {
+        let salt = STANDARD
+            .decode(&file.salt)
+            .context("Corrupt salt in credentials file")?;
+        let mut key = [0u8; 32];
+        pbkdf2::derive(
+            pbkdf2::PBKDF2_HMAC_SHA256,
+            NonZeroU32::new(PBKDF2_ITERATIONS).unwrap(),
+            &salt,
+            self.passphrase.as_bytes(),
+            &mut key,
+        );
+        let key = UnboundKey::new(&aead::AES_256_GCM, &key)
+            .map_err(|_| anyhow::anyhow!("Failed to create encryption key"))?;
+        Ok(LessSafeKey::new(key))
+    }
+}
+
+impl CredentialStore for EncryptedFileStore {
+    fn backend(&self) -> &'static str {
+        "encrypted credentials file"
+    }
+
+    fn get(&self, name: &str) -> Result<Option<String>> {
+        if !self.path.exists() {
+            return Ok(None);
+        }
+        let file = self.read()?;
+        let Some(sealed) = file.entries.get(name) else {
+            return Ok(None);
+        };
+        let mut sealed = STANDARD
+            .decode(sealed)
+            .with_context(|| format!("Corrupt credential '{}'", name))?;
+        if sealed.len() < aead::NONCE_LEN {
+            return Err(anyhow::anyhow!("Corrupt credential '{}'", name));
+        }
+        let mut ciphertext = sealed.split_off(aead::NONCE_LEN);
+        let nonce = Nonce::try_assume_unique_for_key(&sealed)
+            .map_err(|_| anyhow::anyhow!("Corrupt credential '{}'", name))?;
+        let plaintext = self
+            .key(&file)?
+            .open_in_place(nonce, Aad::from(name.as_bytes()), &mut ciphertext)
+            .map_err(|_| {
+                anyhow::anyhow!(
+                    "Failed to decrypt credential '{}' (was {} changed?)",
+                    name,
+                    PASSPHRASE_ENV
+                )
+            })?;
+        String::from_utf8(plaintext.to_vec())
+            .map(Some)
+            .with_context(|| format!("Credential '{}' is not valid UTF-8", name))
+    }
+
+    fn set(&self, name: &str, secret: &str) -> Result<()> {
+        let mut file = self.read()?;
+        let mut nonce = [0u8; aead::NONCE_LEN];
+        SystemRandom::new()
+            .fill(&mut nonce)
+            .map_err(|_| anyhow::anyhow!("Failed to generate nonce"))?;
+
+        let mut sealed = secret.as_bytes().to_vec();
+        self.key(&file)?
+            .seal_in_place_append_tag(
+                Nonce::assume_unique_for_key(nonce),
+                Aad::from(name.as_bytes()),
+                &mut sealed,
+            )
+            .map_err(|_| anyhow::anyhow!("Failed to encrypt credential '{}'", name))?;
+
+        let mut stored = nonce.to_vec();
+        stored.extend(sealed);
+        file.entries
+            .insert(name.to_string(), STANDARD.encode(stored));
+        self.write(&file)
+    }
+
+    fn delete(&self, name: &str) -> Result<()> {
+        if !self.path.exists() {
+            return Ok(());
+        }
+        let mut file = self.read()?;
+        if file.entries.remove(name).is_some() {
+            self.write(&file)?;
+        }
+        Ok(())
+    }
+}
+
+/// Stable per-machine, per-user secret used when no passphrase is set.
+fn machine_secret() -> String {
+    let machine_id = ["/etc/machine-id", "/var/lib/dbus/machine-id"]
+        .iter()
+        .find_map(|p| fs::read_to_string(p).ok())
+        .map(|id| id.trim().to_string())
+        .or_else(|| std::env::var("COMPUTERNAME").ok())
+        .or_else(|| std::env::var("HOSTNAME").ok())
+        .unwrap_or_default();
+    let user = std::env::var("USER")
+        .or_else(|_| std::env::var("USERNAME"))
+        .unwrap_or_default();
+    format!("km-credentials:{}:{}", machine_id, user)
+}
+
+/// The name the API key of the config file at `config_path` (and profile,
+/// if given) is stored under, so config files and profiles can each have
+/// their own key.
+pub fn api_key_name(config_path: &Path, profile: Option<&str>) -> String {
+    // The file itself may not exist yet, its directory does
+    let dir = match config_path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+    let dir = fs::canonicalize(dir).unwrap_or_else(|_| dir.to_path_buf());
+    let path = dir.join(config_path.file_name().unwrap_or_default());
+    match profile {
+        Some(profile) => format!("{}:{}#{}", API_KEY, path.display(), profile),
+        None => format!("{}:{}", API_KEY, path.display()),
+    }
+}
+
+/// The OS keychain when it is usable, otherwise the encrypted file next to
+/// the config file.
+pub fn open(config_path: &Path) -> Result<Box<dyn CredentialStore>> {
+    match KeychainStore::new() {
+        Ok(store) => Ok(Box::new(store)),
+        Err(e) => {
+            tracing::debug!("{:#} - using encrypted credentials file", e);
+            Ok(Box::new(EncryptedFileStore::for_config(config_path)))
+        }
+    }
+}
+
+/// The API key stored for the config file at `config_path`: the profile's
+/// own key if it has one, otherwise the top-level key.
+pub fn load_api_key(config_path: &Path, profile: Option<&str>) -> Option<String> {
+    let load = || -> Result<Option<String>> {
+        let store = open(config_path)?;
+        if profile.is_some() {
+            if let Some(key) = store.get(&api_key_name(config_path, profile))? {
+                return Ok(Some(key));
+            }
+        }
+        store.get(&api_key_name(config_path, None))
+    };
+    match load() {
+        Ok(key) => key.filter(|k| !k.is_empty()),
+        Err(e) => {
+            tracing::warn!("Failed to load API key from credential store: {:#}", e);
+            None
+        }
+    }
+}
+
+/// Save `config` to `path`, moving a non-empty API key into `store` so the
+/// file never holds it in plaintext.
+pub fn save_config(config: &mut Config, path: &Path, store: &dyn CredentialStore) -> Result<()> {
+    if !config.api_key.is_empty() {
+        store.set(&api_key_name(path, None), &config.api_key)?;
+    }
+    let api_key = std::mem::take(&mut config.api_key);
+    let saved = config.save(path);
+    config.api_key = api_key;
+    saved
+}
+
+/// Move plaintext API keys (top-level and in profiles) out of the config
+/// file at `path` into the store returned by `store`. Returns the backend
+/// they moved to, or `None` if the file held no keys.
+pub fn migrate_config(
+    path: &Path,
+    store: impl FnOnce() -> Result<Box<dyn CredentialStore>>,
+) -> Result<Option<&'static str>> {
+    if !path.exists() {
+        return Ok(None);
+    }
+    let mut config = Config::load(path)?;
+    let profile_keys: Vec<(String, String)> = config
+        .profiles
+        .iter()
+        .filter_map(|(name, section)| {
+            let key = section.get("api_key")?.as_str()?;
+            Some((name.clone(), key.to_string()))
+        })
+        .collect();
+    if config.api_key.is_empty() && profile_keys.is_empty() {
+        return Ok(None);
+    }
+
+    let store = store()?;
+    for (name, key) in profile_keys {
+        if !key.is_empty() {
+            store.set(&api_key_name(path, Some(&name)), &key)?;
+        }
+        if let Some(section) = config
+            .profiles
+            .get_mut(&name)
+            .and_then(|s| s.as_object_mut())
+        {
+            section.remove("api_key");
+        }
+    }
+    save_config(&mut config, path, store.as_ref())?;
+    Ok(Some(store.backend()))
+}
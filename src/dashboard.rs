@@ -0,0 +1,330 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use crossterm::event::{self, Event, KeyCode, KeyEventKind, KeyModifiers};
+use crossterm::{cursor, execute, queue, terminal};
+use std::collections::{BTreeMap, VecDeque};
+use std::io::{self, Write};
+use std::path::PathBuf;
+use std::time::Duration;
+
+use crate::correlation::Correlator;
+use crate::risk::{PatternRiskAnalyzer, RiskLevel};
+use crate::traffic::{TrafficEntry, TrafficFollower};
+
+const RECENT_HIGH_RISK_LIMIT: usize = 8;
+/// The header says there's been no traffic after this long without a message
+const QUIET_AFTER_SECS: i64 = 30;
+
+#[derive(Debug, Clone)]
+pub struct HighRiskEvent {
+    pub timestamp: DateTime<Utc>,
+    pub method: String,
+    pub level: RiskLevel,
+    pub score: f32,
+    pub patterns: Vec<String>,
+}
+
+/// Aggregated view of a live session, built incrementally from traffic
+/// log entries.
+#[derive(Debug, Default)]
+pub struct DashboardStats {
+    pub session_id: Option<String>,
+    pub total: u64,
+    pub requests: u64,
+    pub responses: u64,
+    pub notifications: u64,
+    pub errors: u64,
+    pub per_method: BTreeMap<String, u64>,
+    pub risk_histogram: BTreeMap<RiskLevel, u64>,
+    pub recent_high_risk: VecDeque<HighRiskEvent>,
+    pub last_activity: Option<DateTime<Utc>>,
+    latency_total_ms: f64,
+    latency_count: u64,
+    correlator: Correlator,
+}
+
+impl DashboardStats {
+    pub fn new(session_id: Option<String>) -> Self {
+        Self {
+            session_id,
+            ..Default::default()
+        }
+    }
+
+    pub fn average_latency_ms(&self) -> Option<f64> {
+        if self.latency_count == 0 {
+            None
+        } else {
+            Some(self.latency_total_ms / self.latency_count as f64)
+        }
+    }
+
+    pub fn record(&mut self, entry: &TrafficEntry, analyzer: &PatternRiskAnalyzer) {
+        let rpc = match entry.rpc() {
+            Some(rpc) => rpc,
+            None => return,
+        };
+
+        self.total += 1;
+        self.last_activity = Some(entry.timestamp);
+
+        let method = match rpc.get("method").and_then(|m| m.as_str()) {
+            Some(method) => {
+                if entry.direction == "request" {
+                    if rpc.get("id").is_some() {
+                        self.requests += 1;
+                        self.correlator.on_request(
+                            &rpc,
+                            entry.session_id.as_deref(),
+                            entry.timestamp,
+                        );
+                    } else {
+                        self.notifications += 1;
+                    }
+                } else {
+                    self.notifications += 1;
+                }
+                Some(method.to_string())
+            }
+            None => {
+                self.responses += 1;
+                if rpc.get("error").is_some() {
+                    self.errors += 1;
+                }
+                let call = self.correlator.on_response(&rpc, entry.timestamp);
+                // The proxy's own measurement is more precise than log timestamps
+                if let Some(duration) = entry
+                    .duration_ms
+                    .or_else(|| call.as_ref().and_then(|c| c.duration_ms))
+                {
+                    self.latency_total_ms += duration;
+                    self.latency_count += 1;
+                }
+                call.map(|c| c.method)
+            }
+        };
+
+        if let Some(ref method) = method {
+            if rpc.get("method").is_some() {
+                *self.per_method.entry(method.clone()).or_insert(0) += 1;
+            }
+        }
+
+        let assessment = analyzer.analyze(method.as_deref(), &entry.content);
+        *self.risk_histogram.entry(assessment.level).or_insert(0) += 1;
+
+        if assessment.level >= RiskLevel::High {
+            self.recent_high_risk.push_front(HighRiskEvent {
+                timestamp: entry.timestamp,
+                method: method.unwrap_or_else(|| "(response)".to_string()),
+                level: assessment.level,
+                score: assessment.score,
+                patterns: assessment.matched_patterns,
+            });
+            self.recent_high_risk.truncate(RECENT_HIGH_RISK_LIMIT);
+        }
+    }
+
+    /// Requests that have not received a response yet
+    pub fn in_flight(&self) -> usize {
+        self.correlator.pending_count()
+    }
+
+    /// Whether the session logged a message recently. This says nothing
+    /// about whether the server is still running: a healthy server can be
+    /// quiet, and a dead one's last messages are still recent for a while.
+    pub fn has_recent_traffic(&self, now: DateTime<Utc>) -> bool {
+        self.last_activity
+            .map(|last| (now - last).num_seconds() < QUIET_AFTER_SECS)
+            .unwrap_or(false)
+    }
+}
+
+fn bar(value: u64, max: u64, width: usize) -> String {
+    if max == 0 {
+        return String::new();
+    }
+    let len = ((value as f64 / max as f64) * width as f64).ceil() as usize;
+    "█".repeat(len.min(width))
+}
+
+/// Render the dashboard as plain text lines so the layout can be tested
+/// independently of the terminal.
+pub fn render_lines(stats: &DashboardStats, now: DateTime<Utc>) -> Vec<String> {
+    let mut lines = Vec::new();
+
+    let activity = if stats.has_recent_traffic(now) {
+        format!("● traffic in the last {}s", QUIET_AFTER_SECS)
+    } else {
+        format!("○ no traffic for {}s", QUIET_AFTER_SECS)
+    };
+    lines.push(format!(
+        "km dashboard — session {}  {}    (q to quit)",
+        stats.session_id.as_deref().unwrap_or("(waiting)"),
+        activity
+    ));
+    lines.push(String::new());
+    lines.push(format!(
+        "Messages: {}  Requests: {}  Responses: {}  Notifications: {}  Errors: {}  In flight: {}  Avg latency: {}",
+        stats.total,
+        stats.requests,
+        stats.responses,
+        stats.notifications,
+        stats.errors,
+        stats.in_flight(),
+        stats
+            .average_latency_ms()
+            .map(|l| format!("{:.1}ms", l))
+            .unwrap_or_else(|| "-".to_string())
+    ));
+    lines.push(String::new());
+
+    lines.push("Methods".to_string());
+    let mut methods: Vec<(&String, &u64)> = stats.per_method.iter().collect();
+    methods.sort_by(|a, b| b.1.cmp(a.1).then(a.0.cmp(b.0)));
+    let max_method = methods.first().map(|(_, c)| **c).unwrap_or(0);
+    for (method, count) in methods.iter().take(10) {
+        lines.push(format!(
+            "  {:<32} {:>6} {}",
+            method,
+            count,
+            bar(**count, max_method, 30)
+        ));
+    }
+    if methods.is_empty() {
+        lines.push("  (no requests yet)".to_string());
+    }
+    lines.push(String::new());
+
+    lines.push("Risk levels".to_string());
+    let max_risk = stats.risk_histogram.values().copied().max().unwrap_or(0);
+    for level in RiskLevel::ALL {
+        let count = stats.risk_histogram.get(&level).copied().unwrap_or(0);
+        lines.push(format!(
+            "  {:<10} {:>6} {}",
+            level.to_string(),
+            count,
+            bar(count, max_risk, 30)
+        ));
+    }
+    lines.push(String::new());
+
+    lines.push("Recent high-risk events".to_string());
+    if stats.recent_high_risk.is_empty() {
+        lines.push("  (none)".to_string());
+    }
+    for event in &stats.recent_high_risk {
+        lines.push(format!(
+            "  {} {:<24} {:<8} ({:.2}) {}",
+            event.timestamp.format("%H:%M:%S"),
+            event.method,
+            event.level.to_string(),
+            event.score,
+            event.patterns.join(", ")
+        ));
+    }
+
+    lines
+}
+
+/// Run the interactive dashboard, following `file` until the user quits.
+pub fn run(file: PathBuf, session: Option<String>) -> Result<()> {
+    let analyzer = PatternRiskAnalyzer::new();
+    let pinned = session.is_some();
+
+    let mut follower = TrafficFollower::new(file);
+    let history = follower.poll()?;
+    let session = session.or_else(|| history.iter().rev().find_map(|e| e.session_id.clone()));
+
+    let mut stats = DashboardStats::new(session.clone());
+    for entry in history.iter().filter(|e| e.session_id == session) {
+        stats.record(entry, &analyzer);
+    }
+
+    let mut stdout = io::stdout();
+    let _screen = FullScreen::enter(&mut stdout)?;
+    event_loop(&mut stdout, &mut follower, &mut stats, &analyzer, pinned)
+}
+
+/// Raw mode on the alternate screen, restored when dropped so the terminal
+/// is left usable however the UI exits.
+pub(crate) struct FullScreen;
+
+impl FullScreen {
+    pub(crate) fn enter(stdout: &mut io::Stdout) -> Result<Self> {
+        terminal::enable_raw_mode().context("Failed to enable raw terminal mode")?;
+        let screen = FullScreen;
+        execute!(stdout, terminal::EnterAlternateScreen, cursor::Hide)?;
+        Ok(screen)
+    }
+}
+
+impl Drop for FullScreen {
+    fn drop(&mut self) {
+        let _ = execute!(io::stdout(), cursor::Show, terminal::LeaveAlternateScreen);
+        let _ = terminal::disable_raw_mode();
+    }
+}
+
+fn event_loop(
+    stdout: &mut io::Stdout,
+    follower: &mut TrafficFollower,
+    stats: &mut DashboardStats,
+    analyzer: &PatternRiskAnalyzer,
+    pinned: bool,
+) -> Result<()> {
+    loop {
+        for entry in follower.poll()? {
+            // Without --session, jump to whichever session started most recently
+            if !pinned && entry.session_id.is_some() && entry.session_id != stats.session_id {
+                *stats = DashboardStats::new(entry.session_id.clone());
+            }
+            if entry.session_id == stats.session_id {
+                stats.record(&entry, analyzer);
+            }
+        }
+
+        draw(stdout, &render_lines(stats, Utc::now()))?;
+
+        if event::poll(Duration::from_millis(500))? {
+            if let Event::Key(key) = event::read()? {
+                if key.kind != KeyEventKind::Press {
+                    continue;
+                }
+                let ctrl_c =
+                    key.code == KeyCode::Char('c') && key.modifiers.contains(KeyModifiers::CONTROL);
+                if ctrl_c || matches!(key.code, KeyCode::Char('q') | KeyCode::Esc) {
+                    return Ok(());
+                }
+            }
+        }
+    }
+}
+
+pub(crate) fn draw(stdout: &mut io::Stdout, lines: &[String]) -> Result<()> {
+    let (width, height) = terminal::size().unwrap_or((120, 40));
+    queue!(stdout, terminal::Clear(terminal::ClearType::All))?;
+    for (row, line) in lines.iter().take(height as usize).enumerate() {
+        let visible: String = line.chars().take(width as usize).collect();
+        queue!(
+            stdout,
+            cursor::MoveTo(0, row as u16),
+            crossterm::style::Print(visible)
+        )?;
+    }
+    stdout.flush()?;
+    Ok(())
+}
+
+/// Summarize a session without a terminal UI, for use in scripts.
+pub fn snapshot(entries: &[TrafficEntry], session: Option<&str>) -> DashboardStats {
+    let analyzer = PatternRiskAnalyzer::new();
+    let session = session
+        .map(String::from)
+        .or_else(|| entries.iter().rev().find_map(|e| e.session_id.clone()));
+    let mut stats = DashboardStats::new(session.clone());
+    for entry in entries.iter().filter(|e| e.session_id == session) {
+        stats.record(entry, &analyzer);
+    }
+    stats
+}
@@ -0,0 +1,260 @@
+//! Collapses floods of identical notifications before they're uploaded.
+//! Agents send bursts of the same progress or log notification; for methods
+//! matching a `dedup` rule, a notification identical to the one before it
+//! (same direction, method and params) within the rule's window is folded
+//! into that first one, which is uploaded once with a repeat count.
+//!
+//! The traffic log, `km tail` and alerts still see every message; only the
+//! upload is collapsed.
+
+use anyhow::Result;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use crate::traffic;
+use crate::uploader::McpEvent;
+
+pub const DEFAULT_WINDOW_MS: u64 = 5000;
+
+/// Collapsing for notifications whose method matches `methods`.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DedupRuleConfig {
+    /// Method patterns (e.g. notifications/progress)
+    pub methods: Vec<String>,
+    /// Repeats up to this long after the first are folded into it; the
+    /// collapsed event is uploaded once the window has passed
+    #[serde(default = "default_window_ms")]
+    pub window_ms: u64,
+    /// Params that may differ between repeats, e.g. `progress`
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub ignore_params: Vec<String>,
+}
+
+fn default_window_ms() -> u64 {
+    DEFAULT_WINDOW_MS
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DedupConfig {
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<DedupRuleConfig>,
+}
+
+impl DedupConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// Whether any notification could be collapsed.
+    pub fn collapses(&self) -> bool {
+        !self.rules.is_empty()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        for (i, rule) in self.rules.iter().enumerate() {
+            if rule.methods.is_empty() || rule.methods.iter().any(|m| m.trim().is_empty()) {
+                return Err(anyhow::anyhow!(
+                    "dedup rule {} needs at least one method pattern",
+                    i + 1
+                ));
+            }
+            if !(1..=600_000).contains(&rule.window_ms) {
+                return Err(anyhow::anyhow!(
+                    "dedup rule {} window_ms must be between 1 and 600000 (got {})",
+                    i + 1,
+                    rule.window_ms
+                ));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// What the deduplicator did with the notifications it saw.
+#[derive(Debug, Default)]
+pub struct DedupStats {
+    collapsed: AtomicU64,
+    aggregates: AtomicU64,
+}
+
+impl DedupStats {
+    /// Notifications folded into an earlier identical one
+    pub fn collapsed(&self) -> u64 {
+        self.collapsed.load(Ordering::Relaxed)
+    }
+
+    /// Events uploaded with a repeat count
+    pub fn aggregates(&self) -> u64 {
+        self.aggregates.load(Ordering::Relaxed)
+    }
+}
+
+/// A notification waiting for its repeats.
+#[derive(Debug)]
+struct Pending {
+    event: McpEvent,
+    fingerprint: String,
+    count: u64,
+    last_at: DateTime<Utc>,
+    started: Instant,
+    window: Duration,
+}
+
+/// Folds repeated notifications into one event. Each (direction, method)
+/// holds at most one notification at a time, released when a different one
+/// arrives, when its window passes or when the session ends.
+#[derive(Debug)]
+pub struct Deduper {
+    config: DedupConfig,
+    pending: Mutex<HashMap<(String, String), Pending>>,
+    stats: Arc<DedupStats>,
+}
+
+impl Deduper {
+    pub fn new(config: DedupConfig) -> Self {
+        Self {
+            config,
+            pending: Mutex::new(HashMap::new()),
+            stats: Arc::new(DedupStats::default()),
+        }
+    }
+
+    pub fn stats(&self) -> Arc<DedupStats> {
+        self.stats.clone()
+    }
+
+    /// The events to upload now for a newly captured one: collapsed events
+    /// whose window has passed, then the event itself unless it's held
+    /// for repeats.
+    pub fn process(&self, event: McpEvent) -> Vec<McpEvent> {
+        self.process_at(event, Instant::now())
+    }
+
+    fn process_at(&self, event: McpEvent, now: Instant) -> Vec<McpEvent> {
+        let Ok(mut pending) = self.pending.lock() else {
+            return vec![event];
+        };
+        let mut ready = self.release(&mut pending, |held| now >= held.started + held.window);
+
+        let rule = match (event.rpc_id.as_ref(), event.method.as_deref()) {
+            // Only notifications: requests and responses are paired by id
+            (None, Some(method)) => self.config.rules.iter().find(|rule| {
+                rule.methods
+                    .iter()
+                    .any(|pattern| traffic::method_matches(pattern, method))
+            }),
+            _ => None,
+        };
+        let Some(rule) = rule else {
+            ready.push(event);
+            return ready;
+        };
+
+        let key = (
+            event.direction.clone(),
+            event.method.clone().unwrap_or_default(),
+        );
+        let fingerprint = fingerprint(&event, &rule.ignore_params);
+        if let Some(held) = pending.get_mut(&key) {
+            if held.fingerprint == fingerprint {
+                held.count += 1;
+                held.last_at = event.timestamp;
+                self.stats.collapsed.fetch_add(1, Ordering::Relaxed);
+                return ready;
+            }
+        }
+        if let Some(held) = pending.remove(&key) {
+            ready.push(self.finish(held));
+        }
+        pending.insert(
+            key,
+            Pending {
+                last_at: event.timestamp,
+                event,
+                fingerprint,
+                count: 1,
+                started: now,
+                window: Duration::from_millis(rule.window_ms),
+            },
+        );
+        ready
+    }
+
+    /// Collapsed events whose window has passed.
+    pub fn expired(&self) -> Vec<McpEvent> {
+        let now = Instant::now();
+        match self.pending.lock() {
+            Ok(mut pending) => self.release(&mut pending, |held| now >= held.started + held.window),
+            Err(_) => Vec::new(),
+        }
+    }
+
+    /// Everything held, when the session ends.
+    pub fn flush(&self) -> Vec<McpEvent> {
+        match self.pending.lock() {
+            Ok(mut pending) => self.release(&mut pending, |_| true),
+            Err(_) => Vec::new(),
+        }
+    }
+
+    fn release(
+        &self,
+        pending: &mut HashMap<(String, String), Pending>,
+        due: impl Fn(&Pending) -> bool,
+    ) -> Vec<McpEvent> {
+        let keys: Vec<_> = pending
+            .iter()
+            .filter(|(_, held)| due(held))
+            .map(|(key, _)| key.clone())
+            .collect();
+        let mut released: Vec<McpEvent> = keys
+            .into_iter()
+            .filter_map(|key| pending.remove(&key))
+            .map(|held| self.finish(held))
+            .collect();
+        released.sort_by_key(|event| event.timestamp);
+        released
+    }
+
+    /// The held event, with `repeat` metadata when repeats were folded in.
+    fn finish(&self, held: Pending) -> McpEvent {
+        let mut event = held.event;
+        if held.count > 1 {
+            self.stats.aggregates.fetch_add(1, Ordering::Relaxed);
+            event.metadata.insert(
+                "repeat".to_string(),
+                serde_json::json!({
+                    "count": held.count,
+                    "first_at": event.timestamp,
+                    "last_at": held.last_at,
+                }),
+            );
+        }
+        event
+    }
+}
+
+/// What has to match for two notifications to count as the same: their
+/// params less `ignore_params`, or the payload hash when the event doesn't
+/// hold the whole message.
+fn fingerprint(event: &McpEvent, ignore_params: &[String]) -> String {
+    match (&event.payload, &event.payload_sha256) {
+        (_, Some(sha256)) => sha256.clone(),
+        (Some(Value::Object(message)), None) => {
+            let mut params = message.get("params").cloned().unwrap_or(Value::Null);
+            if let Value::Object(ref mut params) = params {
+                for name in ignore_params {
+                    params.remove(name);
+                }
+            }
+            params.to_string()
+        }
+        (Some(other), None) => other.to_string(),
+        (None, None) => String::new(),
+    }
+}
@@ -1,6 +1,18 @@
 use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
 use serde::Deserialize;
 use std::time::Duration;
+use tokio::sync::watch;
+
+use crate::auth::{AuthClient, JwtToken};
+use crate::errors::{Code, KmError};
+
+/// Access tokens without a parseable expiry are assumed to last this long
+const DEFAULT_TOKEN_LIFETIME_SECS: u64 = 3600;
+/// Refresh this long before the access token expires
+const REFRESH_MARGIN_SECS: u64 = 120;
+/// Wait before retrying a refresh that failed
+const REFRESH_RETRY: Duration = Duration::from_secs(30);
 
 #[derive(Debug, Deserialize)]
 #[serde(rename_all = "camelCase")]
@@ -23,10 +35,28 @@ pub struct PollSuccessResponse {
 #[serde(rename_all = "camelCase")]
 pub struct TokenInfo {
     pub access_token: String,
-    #[allow(dead_code)]
+    #[serde(default)]
     pub access_token_expires_at: String,
     #[allow(dead_code)]
+    #[serde(default)]
     pub token_type: String,
+    #[serde(default)]
+    pub refresh_token: Option<String>,
+}
+
+impl TokenInfo {
+    pub fn into_jwt(self) -> JwtToken {
+        let now = Utc::now().timestamp().max(0) as u64;
+        let expires_at = DateTime::parse_from_rfc3339(&self.access_token_expires_at)
+            .map(|t| t.timestamp().max(0) as u64)
+            .unwrap_or(now + DEFAULT_TOKEN_LIFETIME_SECS);
+        JwtToken {
+            claims: AuthClient::parse_jwt_claims(&self.access_token).unwrap_or_default(),
+            token: self.access_token,
+            expires_at,
+            refresh_token: self.refresh_token.filter(|t| !t.is_empty()),
+        }
+    }
 }
 
 pub struct DeviceAuthClient {
@@ -36,7 +66,7 @@ pub struct DeviceAuthClient {
 
 impl DeviceAuthClient {
     pub fn new(base_url: String) -> Self {
-        let client = reqwest::Client::builder()
+        let client = crate::http::client_builder()
             .timeout(Duration::from_secs(10))
             .build()
             .unwrap_or_else(|_| reqwest::Client::new());
@@ -44,6 +74,7 @@ impl DeviceAuthClient {
     }
 
     pub async fn start(&self) -> Result<StartResponse> {
+        crate::offline::ensure_online("Signing in")?;
         let res = self
             .client
             .post(format!("{}/api/auth/device-code/start", self.base_url))
@@ -83,4 +114,123 @@ impl DeviceAuthClient {
             .unwrap_or_else(|| format!("http_{}", status));
         Ok(Err(err))
     }
+
+    /// Run the whole device-code flow: start it, show the user where to
+    /// approve it with `prompt`, and poll until it is approved, denied or
+    /// expires.
+    pub async fn login(&self, prompt: impl FnOnce(&StartResponse)) -> Result<JwtToken> {
+        let start = self.start().await?;
+        prompt(&start);
+
+        let deadline = tokio::time::Instant::now() + Duration::from_secs(start.expires_in);
+        let mut interval = Duration::from_secs(start.interval.max(1));
+        loop {
+            tokio::time::sleep(interval).await;
+            if tokio::time::Instant::now() > deadline {
+                return Err(anyhow::anyhow!(
+                    "Device code expired before sign-in finished"
+                ));
+            }
+
+            match self.poll(&start.device_code).await {
+                Ok(Ok(success)) => return Ok(success.token.into_jwt()),
+                Ok(Err(err)) => match err.as_str() {
+                    "authorization_pending" => {}
+                    "slow_down" => interval += Duration::from_secs(5),
+                    "expired_token" => return Err(anyhow::anyhow!("Device code expired")),
+                    "access_denied" => return Err(anyhow::anyhow!("Sign-in was denied")),
+                    other => tracing::debug!("Device code poll returned {}", other),
+                },
+                Err(e) => tracing::debug!("Device code poll failed: {:#}", e),
+            }
+        }
+    }
+
+    /// Trade a refresh token for a new access token. The refresh token is
+    /// kept when the API doesn't rotate it.
+    pub async fn refresh(&self, refresh_token: &str) -> Result<JwtToken> {
+        crate::offline::ensure_online("Renewing the access token")?;
+        let res = self
+            .client
+            .post(format!("{}/api/auth/token/refresh", self.base_url))
+            .json(&serde_json::json!({"refreshToken": refresh_token}))
+            .send()
+            .await
+            .context("Failed to send token refresh request")?;
+        if !res.status().is_success() {
+            let status = res.status();
+            return Err(KmError::new(
+                Code::for_status(status),
+                format!("Token refresh failed with status: {}", status),
+            )
+            .into());
+        }
+        let success: PollSuccessResponse = res
+            .json()
+            .await
+            .context("Failed to parse token refresh response")?;
+
+        let mut jwt = success.token.into_jwt();
+        if jwt.refresh_token.is_none() {
+            jwt.refresh_token = Some(refresh_token.to_string());
+        }
+        Ok(jwt)
+    }
+
+    /// Revoke a token so it can't be used again. Tokens the API no longer
+    /// knows count as revoked.
+    pub async fn revoke(&self, token: &str) -> Result<()> {
+        let res = self
+            .client
+            .post(format!("{}/api/auth/token/revoke", self.base_url))
+            .json(&serde_json::json!({"token": token}))
+            .send()
+            .await
+            .context("Failed to send token revocation request")?;
+        if res.status().is_success() || res.status() == reqwest::StatusCode::NOT_FOUND {
+            Ok(())
+        } else {
+            Err(anyhow::anyhow!(
+                "Token revocation failed with status: {}",
+                res.status()
+            ))
+        }
+    }
+
+    /// Keep `token` fresh for as long as the returned task runs: shortly
+    /// before it expires, refresh it, publish the new access token on
+    /// `updates` and pass the new token to `on_refresh` (to persist it).
+    pub fn spawn_refresher(
+        self,
+        mut token: JwtToken,
+        updates: watch::Sender<String>,
+        on_refresh: impl Fn(&JwtToken) + Send + 'static,
+    ) -> tokio::task::JoinHandle<()> {
+        tokio::spawn(async move {
+            loop {
+                let Some(refresh_token) = token.refresh_token.clone() else {
+                    tracing::debug!("No refresh token; the access token won't be renewed");
+                    return;
+                };
+                let now = Utc::now().timestamp().max(0) as u64;
+                let wait = token.expires_at.saturating_sub(now + REFRESH_MARGIN_SECS);
+                tokio::time::sleep(Duration::from_secs(wait)).await;
+
+                match self.refresh(&refresh_token).await {
+                    Ok(fresh) => {
+                        tracing::info!("Refreshed access token");
+                        on_refresh(&fresh);
+                        if updates.send(fresh.token.clone()).is_err() {
+                            return;
+                        }
+                        token = fresh;
+                    }
+                    Err(e) => {
+                        tracing::warn!("Failed to refresh access token: {:#}", e);
+                        tokio::time::sleep(REFRESH_RETRY).await;
+                    }
+                }
+            }
+        })
+    }
 }
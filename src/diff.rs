@@ -0,0 +1,355 @@
+use serde::Serialize;
+use serde_json::Value;
+use std::collections::{BTreeMap, BTreeSet};
+
+use crate::costs::CostConfig;
+use crate::report::SessionReport;
+use crate::risk::{PatternRiskAnalyzer, RiskLevel};
+use crate::sessions::SessionSummary;
+use crate::traffic::TrafficEntry;
+
+/// A method's share of requests or its error rate moving by this much
+/// counts as drift
+pub const RATE_DRIFT: f64 = 0.10;
+
+/// How deep argument shapes follow nested objects
+const SHAPE_DEPTH: usize = 3;
+
+/// The type structure of a JSON value with the values left out:
+/// `{path: string, options: {recursive: boolean}}`.
+pub fn shape(value: &Value) -> String {
+    shape_at(value, 0)
+}
+
+fn shape_at(value: &Value, depth: usize) -> String {
+    match value {
+        Value::Null => "null".to_string(),
+        Value::Bool(_) => "boolean".to_string(),
+        Value::Number(_) => "number".to_string(),
+        Value::String(_) => "string".to_string(),
+        Value::Array(items) => {
+            let kinds: BTreeSet<String> = items.iter().map(|v| shape_at(v, depth + 1)).collect();
+            match kinds.len() {
+                0 => "[]".to_string(),
+                _ => format!("[{}]", kinds.into_iter().collect::<Vec<_>>().join(" | ")),
+            }
+        }
+        Value::Object(_) if depth >= SHAPE_DEPTH => "object".to_string(),
+        Value::Object(fields) => {
+            let fields: Vec<String> = fields
+                .iter()
+                .map(|(key, value)| format!("{}: {}", key, shape_at(value, depth + 1)))
+                .collect();
+            format!("{{{}}}", fields.join(", "))
+        }
+    }
+}
+
+/// What a session did, in the terms sessions are compared in.
+#[derive(Debug, Clone)]
+pub struct SessionProfile {
+    pub report: SessionReport,
+    /// Argument shapes each tool was called with
+    pub shapes: BTreeMap<String, BTreeSet<String>>,
+}
+
+impl SessionProfile {
+    pub fn build(
+        entries: &[TrafficEntry],
+        session: &SessionSummary,
+        analyzer: &PatternRiskAnalyzer,
+    ) -> Self {
+        let mut shapes: BTreeMap<String, BTreeSet<String>> = BTreeMap::new();
+        for entry in entries {
+            if entry.session_id.as_deref() != Some(session.id.as_str())
+                || entry.direction != "request"
+            {
+                continue;
+            }
+            let Some(rpc) = entry.rpc() else {
+                continue;
+            };
+            if rpc.get("method").and_then(|m| m.as_str()) != Some("tools/call") {
+                continue;
+            }
+            if let Some(tool) = rpc.pointer("/params/name").and_then(|n| n.as_str()) {
+                let arguments = rpc
+                    .pointer("/params/arguments")
+                    .cloned()
+                    .unwrap_or(Value::Null);
+                shapes
+                    .entry(tool.to_string())
+                    .or_default()
+                    .insert(shape(&arguments));
+            }
+        }
+        Self {
+            report: SessionReport::build(entries, session, analyzer, &CostConfig::default()),
+            shapes,
+        }
+    }
+
+    fn requests(&self) -> u64 {
+        self.report.session.requests
+    }
+
+    fn share(&self, count: u64) -> f64 {
+        match self.requests() {
+            0 => 0.0,
+            total => count as f64 / total as f64,
+        }
+    }
+}
+
+/// How often a method was called in each session.
+#[derive(Debug, Clone, Serialize)]
+pub struct MethodChange {
+    pub method: String,
+    pub a: u64,
+    pub b: u64,
+    pub a_share: f64,
+    pub b_share: f64,
+    pub a_error_rate: f64,
+    pub b_error_rate: f64,
+}
+
+impl MethodChange {
+    pub fn is_drift(&self) -> bool {
+        (self.a == 0) != (self.b == 0)
+            || (self.a_share - self.b_share).abs() >= RATE_DRIFT
+            || (self.a_error_rate - self.b_error_rate).abs() >= RATE_DRIFT
+    }
+}
+
+/// How a tool was called in each session.
+#[derive(Debug, Clone, Serialize)]
+pub struct ToolChange {
+    pub tool: String,
+    pub a: u64,
+    pub b: u64,
+    /// Argument shapes only seen in session B
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub new_shapes: Vec<String>,
+    /// Argument shapes only seen in session A
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub missing_shapes: Vec<String>,
+}
+
+impl ToolChange {
+    pub fn is_drift(&self) -> bool {
+        (self.a == 0) != (self.b == 0)
+            || !self.new_shapes.is_empty()
+            || !self.missing_shapes.is_empty()
+    }
+}
+
+/// Share of each session's requests at one risk level.
+#[derive(Debug, Clone, Serialize)]
+pub struct RiskChange {
+    pub level: RiskLevel,
+    pub a: u64,
+    pub b: u64,
+    pub a_share: f64,
+    pub b_share: f64,
+}
+
+impl RiskChange {
+    pub fn is_drift(&self) -> bool {
+        (self.a_share - self.b_share).abs() >= RATE_DRIFT
+    }
+}
+
+/// Differences between two sessions, A (the baseline) and B.
+#[derive(Debug, Clone, Serialize)]
+pub struct SessionDiff {
+    pub a: String,
+    pub b: String,
+    pub methods: Vec<MethodChange>,
+    pub tools: Vec<ToolChange>,
+    pub risk: Vec<RiskChange>,
+}
+
+impl SessionDiff {
+    pub fn has_drift(&self) -> bool {
+        self.methods.iter().any(MethodChange::is_drift)
+            || self.tools.iter().any(ToolChange::is_drift)
+            || self.risk.iter().any(RiskChange::is_drift)
+    }
+}
+
+/// Compare session `b` against the baseline `a`.
+pub fn compare(a: &SessionProfile, b: &SessionProfile) -> SessionDiff {
+    let names: BTreeSet<&String> = a
+        .report
+        .methods
+        .iter()
+        .chain(&b.report.methods)
+        .map(|m| &m.method)
+        .collect();
+    let methods = names
+        .into_iter()
+        .map(|name| {
+            let find = |profile: &SessionProfile| {
+                profile
+                    .report
+                    .methods
+                    .iter()
+                    .find(|m| &m.method == name)
+                    .map(|m| (m.calls, m.error_rate()))
+                    .unwrap_or((0, 0.0))
+            };
+            let ((a_calls, a_error_rate), (b_calls, b_error_rate)) = (find(a), find(b));
+            MethodChange {
+                method: name.clone(),
+                a: a_calls,
+                b: b_calls,
+                a_share: a.share(a_calls),
+                b_share: b.share(b_calls),
+                a_error_rate,
+                b_error_rate,
+            }
+        })
+        .collect();
+
+    let tool_names: BTreeSet<&String> = a
+        .report
+        .session
+        .tools
+        .keys()
+        .chain(b.report.session.tools.keys())
+        .collect();
+    let no_shapes = BTreeSet::new();
+    let tools = tool_names
+        .into_iter()
+        .map(|tool| {
+            let a_shapes = a.shapes.get(tool).unwrap_or(&no_shapes);
+            let b_shapes = b.shapes.get(tool).unwrap_or(&no_shapes);
+            let calls = |profile: &SessionProfile| {
+                profile.report.session.tools.get(tool).copied().unwrap_or(0)
+            };
+            let (a_calls, b_calls) = (calls(a), calls(b));
+            // A tool that's new or gone is reported as such, not shape by shape
+            let both = a_calls > 0 && b_calls > 0;
+            ToolChange {
+                tool: tool.clone(),
+                a: a_calls,
+                b: b_calls,
+                new_shapes: if both {
+                    b_shapes.difference(a_shapes).cloned().collect()
+                } else {
+                    Vec::new()
+                },
+                missing_shapes: if both {
+                    a_shapes.difference(b_shapes).cloned().collect()
+                } else {
+                    Vec::new()
+                },
+            }
+        })
+        .collect();
+
+    let risk = RiskLevel::ALL
+        .iter()
+        .map(|level| {
+            let count =
+                |profile: &SessionProfile| profile.report.risk.get(level).copied().unwrap_or(0);
+            let (a_count, b_count) = (count(a), count(b));
+            RiskChange {
+                level: *level,
+                a: a_count,
+                b: b_count,
+                a_share: a.share(a_count),
+                b_share: b.share(b_count),
+            }
+        })
+        .collect();
+
+    SessionDiff {
+        a: a.report.session.id.clone(),
+        b: b.report.session.id.clone(),
+        methods,
+        tools,
+        risk,
+    }
+}
+
+fn percent(share: f64) -> String {
+    format!("{:.0}%", share * 100.0)
+}
+
+/// Render `km diff`. Lines start with `+` for what only B does, `-` for what
+/// only A did, `~` for what changed and a space for what didn't.
+pub fn render(diff: &SessionDiff) -> Vec<String> {
+    let mut lines = vec![
+        format!("A: {}", diff.a),
+        format!("B: {}", diff.b),
+        String::new(),
+        "Tools".to_string(),
+    ];
+    for tool in &diff.tools {
+        let marker = match (tool.a, tool.b) {
+            (0, _) => '+',
+            (_, 0) => '-',
+            _ if tool.is_drift() => '~',
+            _ => ' ',
+        };
+        lines.push(format!(
+            "{} {:<32} {:>6} -> {:<6}",
+            marker, tool.tool, tool.a, tool.b
+        ));
+        for shape in &tool.new_shapes {
+            lines.push(format!("    + arguments {}", shape));
+        }
+        for shape in &tool.missing_shapes {
+            lines.push(format!("    - arguments {}", shape));
+        }
+    }
+    if diff.tools.is_empty() {
+        lines.push("  (no tool calls)".to_string());
+    }
+
+    lines.push(String::new());
+    lines.push(format!(
+        "  {:<32} {:>15}   {:>15}",
+        "Methods", "calls (share)", "error rate"
+    ));
+    for method in &diff.methods {
+        let marker = match (method.a, method.b) {
+            (0, _) => '+',
+            (_, 0) => '-',
+            _ if method.is_drift() => '~',
+            _ => ' ',
+        };
+        lines.push(format!(
+            "{} {:<32} {:>15}   {:>15}",
+            marker,
+            method.method,
+            format!(
+                "{} -> {} ({} -> {})",
+                method.a,
+                method.b,
+                percent(method.a_share),
+                percent(method.b_share)
+            ),
+            format!(
+                "{} -> {}",
+                percent(method.a_error_rate),
+                percent(method.b_error_rate)
+            )
+        ));
+    }
+
+    lines.push(String::new());
+    lines.push("Risk (share of requests)".to_string());
+    for risk in diff.risk.iter().rev() {
+        lines.push(format!(
+            "{} {:<32} {:>6} -> {:<6}",
+            if risk.is_drift() { '~' } else { ' ' },
+            risk.level,
+            percent(risk.a_share),
+            percent(risk.b_share)
+        ));
+    }
+
+    lines
+}
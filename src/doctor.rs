@@ -0,0 +1,431 @@
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::ffi::OsStr;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::auth::AuthClient;
+use crate::capabilities::{Capabilities, EVENT_VERSIONS};
+use crate::config::Config;
+use crate::i18n::t;
+use crate::offline;
+use crate::plugins::store::{PluginRuntime, PluginStore};
+
+const DEFAULT_API_URL: &str = "https://api.kilometers.ai";
+const HEALTH_TIMEOUT: Duration = Duration::from_secs(5);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Status {
+    Ok,
+    Warning,
+    Failed,
+}
+
+/// Result of one `km doctor` check.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Check {
+    pub name: &'static str,
+    pub status: Status,
+    pub detail: String,
+    /// What to do about a warning or failure
+    pub fix: Option<String>,
+}
+
+impl Check {
+    fn ok(name: &'static str, detail: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Ok,
+            detail: detail.into(),
+            fix: None,
+        }
+    }
+
+    fn warning(name: &'static str, detail: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Warning,
+            detail: detail.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    fn failed(name: &'static str, detail: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Failed,
+            detail: detail.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    /// The check's name in the language chosen at startup.
+    pub fn title(&self) -> String {
+        let id = match self.name {
+            "Config" => "doctor.config",
+            "API" => "doctor.api",
+            "API version" => "doctor.api_version",
+            "Authentication" => "doctor.auth",
+            "Plugins" => "doctor.plugins",
+            "Server" => "doctor.server",
+            "Encoding" => "doctor.encoding",
+            name => return name.to_string(),
+        };
+        t(id, &[])
+    }
+}
+
+/// Run every diagnostic. `server` is the MCP server executable the user
+/// wants to monitor, if they told us.
+pub async fn run(config_path: &Path, store: &PluginStore, server: Option<&str>) -> Vec<Check> {
+    let mut checks = Vec::new();
+
+    let (check, config) = check_config(config_path);
+    checks.push(check);
+    if offline::enabled() {
+        checks.push(Check::ok("API", t("doctor.api.offline", &[])));
+    } else if let Some(ref config) = config {
+        let api = check_api(config).await;
+        let reachable = api.status != Status::Failed;
+        checks.push(api);
+        if reachable {
+            checks.push(check_api_version(config).await);
+        }
+        if reachable && !config.api_key.is_empty() {
+            checks.push(check_auth(config).await);
+        }
+    }
+
+    let allow_unsigned = config.as_ref().is_some_and(|c| c.allow_unsigned_plugins);
+    let plugin_config = config
+        .as_ref()
+        .map(|c| c.plugin_config.clone())
+        .unwrap_or_default();
+    checks.push(check_plugins(store, allow_unsigned, &plugin_config));
+    if let Some(server) = server {
+        checks.push(check_server(server, std::env::var_os("PATH").as_deref()));
+    }
+    checks.push(check_locale(|name| std::env::var(name).ok()));
+    checks
+}
+
+fn check_config(path: &Path) -> (Check, Option<Config>) {
+    let config = match Config::load_with_env(path) {
+        Ok(config) => config,
+        Err(_) if !path.exists() => {
+            let check = Check::warning(
+                "Config",
+                t("doctor.config.missing", &[("path", &format!("{:?}", path))]),
+                t("doctor.config.missing_fix", &[]),
+            );
+            return (check, None);
+        }
+        Err(e) => {
+            let check = Check::failed(
+                "Config",
+                t(
+                    "doctor.config.unreadable",
+                    &[
+                        ("path", &format!("{:?}", path)),
+                        ("error", &format!("{:#}", e)),
+                    ],
+                ),
+                t("doctor.config.unreadable_fix", &[]),
+            );
+            return (check, None);
+        }
+    };
+
+    let problems = config.validate();
+    let check = if !problems.is_empty() {
+        Check::failed(
+            "Config",
+            problems.join("; "),
+            t("doctor.config.invalid_fix", &[]),
+        )
+    } else if config.api_key.is_empty() {
+        Check::warning(
+            "Config",
+            t("doctor.config.no_api_key", &[]),
+            t("doctor.config.no_api_key_fix", &[]),
+        )
+    } else {
+        Check::ok(
+            "Config",
+            t("doctor.config.loaded", &[("path", &format!("{:?}", path))]),
+        )
+    };
+    (check, Some(config))
+}
+
+fn api_url(config: &Config) -> &str {
+    if config.api_url.is_empty() {
+        DEFAULT_API_URL
+    } else {
+        config.api_url.trim_end_matches('/')
+    }
+}
+
+async fn check_api(config: &Config) -> Check {
+    let url = api_url(config);
+    let client = crate::http::client_builder()
+        .timeout(HEALTH_TIMEOUT)
+        .build()
+        .unwrap_or_else(|_| reqwest::Client::new());
+
+    match client.get(format!("{}/api/health", url)).send().await {
+        Ok(response) if response.status().is_success() => {
+            Check::ok("API", t("doctor.api.reachable", &[("url", &url)]))
+        }
+        Ok(response) => Check::warning(
+            "API",
+            t(
+                "doctor.api.unhealthy",
+                &[("url", &url), ("status", &response.status())],
+            ),
+            t("doctor.api.unhealthy_fix", &[]),
+        ),
+        Err(e) => Check::failed(
+            "API",
+            t("doctor.api.unreachable", &[("url", &url), ("error", &e)]),
+            t("doctor.api.unreachable_fix", &[]),
+        ),
+    }
+}
+
+async fn check_api_version(config: &Config) -> Check {
+    let url = api_url(config);
+    let info = match Capabilities::discover(url).await {
+        Ok(Some(info)) => info,
+        Ok(None) => {
+            return Check::ok(
+                "API version",
+                t("doctor.api_version.undiscoverable", &[("url", &url)]),
+            )
+        }
+        Err(e) => {
+            return Check::warning(
+                "API version",
+                format!("{:#}", e),
+                t("doctor.api_version.unknown_fix", &[]),
+            )
+        }
+    };
+
+    match Capabilities::negotiate(&info) {
+        Ok(capabilities) => Check::ok(
+            "API version",
+            t(
+                "doctor.api_version.ok",
+                &[
+                    ("api", &info.api_version),
+                    (
+                        "server",
+                        &info
+                            .server_version
+                            .clone()
+                            .unwrap_or_else(|| t("doctor.api_version.unknown_server", &[])),
+                    ),
+                    ("events", &capabilities.event_version),
+                    (
+                        "rate",
+                        &capabilities
+                            .rate_limit
+                            .map(|limit| {
+                                t(
+                                    "doctor.api_version.rate",
+                                    &[("count", &limit.requests_per_minute)],
+                                )
+                            })
+                            .unwrap_or_default(),
+                    ),
+                ],
+            ),
+        ),
+        Err(e) => Check::failed(
+            "API version",
+            format!("{:#}", e),
+            t(
+                "doctor.api_version.mismatch_fix",
+                &[("versions", &format!("{:?}", EVENT_VERSIONS))],
+            ),
+        ),
+    }
+}
+
+async fn check_auth(config: &Config) -> Check {
+    let client = AuthClient::new(config.api_key.clone(), api_url(config).to_string());
+    match client.exchange_for_jwt().await {
+        Ok(token) => Check::ok(
+            "Authentication",
+            t(
+                "doctor.auth.ok",
+                &[("tier", &token.claims.tier.as_deref().unwrap_or("free"))],
+            ),
+        ),
+        Err(e) => Check::failed(
+            "Authentication",
+            format!("{:#}", e),
+            t("doctor.auth.failed_fix", &[]),
+        ),
+    }
+}
+
+fn check_plugins(
+    store: &PluginStore,
+    allow_unsigned: bool,
+    plugin_config: &BTreeMap<String, Value>,
+) -> Check {
+    let installed = match store.installed() {
+        Ok(installed) => installed,
+        Err(e) => {
+            return Check::failed(
+                "Plugins",
+                format!("{:#}", e),
+                t("doctor.plugins.unreadable_fix", &[]),
+            )
+        }
+    };
+    if installed.is_empty() {
+        return Check::ok("Plugins", t("doctor.plugins.none", &[]));
+    }
+
+    let mut broken = Vec::new();
+    let mut skipped = Vec::new();
+    let mut fixes = Vec::new();
+    for plugin in &installed {
+        if plugin.check_integrity().is_err() {
+            broken.push(plugin.name.as_str());
+        } else if !plugin.signed && !allow_unsigned {
+            skipped.push(t("doctor.plugins.unsigned", &[("name", &plugin.name)]));
+            fixes.push(t("doctor.plugins.unsigned_fix", &[]));
+        } else if plugin.runtime == PluginRuntime::Wasm && !cfg!(feature = "wasm") {
+            skipped.push(t("doctor.plugins.needs_wasm", &[("name", &plugin.name)]));
+            fixes.push(t("doctor.plugins.needs_wasm_fix", &[]));
+        } else if let Some(problem) = plugin
+            .check_settings(plugin_config.get(&plugin.name).unwrap_or(&Value::Null))
+            .first()
+        {
+            skipped.push(t(
+                "doctor.plugins.invalid_settings",
+                &[("name", &plugin.name), ("problem", problem)],
+            ));
+            fixes.push(t("doctor.plugins.invalid_settings_fix", &[]));
+        }
+    }
+    fixes.sort();
+    fixes.dedup();
+
+    if !broken.is_empty() {
+        Check::failed(
+            "Plugins",
+            t("doctor.plugins.modified", &[("names", &broken.join(", "))]),
+            t("doctor.plugins.modified_fix", &[("name", &broken[0])]),
+        )
+    } else if !skipped.is_empty() {
+        Check::warning(
+            "Plugins",
+            t(
+                "doctor.plugins.skipped",
+                &[("plugins", &skipped.join(", "))],
+            ),
+            fixes.join("; "),
+        )
+    } else {
+        Check::ok(
+            "Plugins",
+            t("doctor.plugins.ok", &[("count", &installed.len())]),
+        )
+    }
+}
+
+/// Look `program` up the way the OS will when `km monitor` starts it.
+pub fn find_in_path(program: &str, path: Option<&OsStr>) -> Option<PathBuf> {
+    let candidate = Path::new(program);
+    if candidate.components().count() > 1 {
+        return is_executable(candidate).then(|| candidate.to_path_buf());
+    }
+
+    let extensions: Vec<String> = if cfg!(windows) {
+        let pathext = std::env::var("PATHEXT").unwrap_or_else(|_| ".EXE;.CMD;.BAT".to_string());
+        std::iter::once(String::new())
+            .chain(pathext.split(';').map(str::to_string))
+            .collect()
+    } else {
+        vec![String::new()]
+    };
+
+    std::env::split_paths(path?)
+        .flat_map(|dir| {
+            extensions
+                .iter()
+                .map(move |ext| dir.join(format!("{}{}", program, ext)))
+        })
+        .find(|file| is_executable(file))
+}
+
+fn is_executable(path: &Path) -> bool {
+    let Ok(metadata) = path.metadata() else {
+        return false;
+    };
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        metadata.is_file() && metadata.permissions().mode() & 0o111 != 0
+    }
+    #[cfg(not(unix))]
+    {
+        metadata.is_file()
+    }
+}
+
+pub fn check_server(program: &str, path: Option<&OsStr>) -> Check {
+    match find_in_path(program, path) {
+        Some(found) => Check::ok(
+            "Server",
+            t(
+                "doctor.server.found",
+                &[("program", &program), ("path", &format!("{:?}", found))],
+            ),
+        ),
+        None => Check::failed(
+            "Server",
+            t("doctor.server.missing", &[("program", &program)]),
+            t("doctor.server.missing_fix", &[("program", &program)]),
+        ),
+    }
+}
+
+/// MCP messages are UTF-8 JSON; servers started under a non-UTF-8 locale
+/// may mangle non-ASCII text. `env` looks up an environment variable.
+pub fn check_locale(env: impl Fn(&str) -> Option<String>) -> Check {
+    if cfg!(windows) {
+        return Check::ok("Encoding", t("doctor.encoding.windows", &[]));
+    }
+
+    // Same precedence as the C library
+    let locale = ["LC_ALL", "LC_CTYPE", "LANG"]
+        .iter()
+        .find_map(|name| env(name).filter(|v| !v.is_empty()).map(|v| (*name, v)));
+    match locale {
+        Some((_, value))
+            if value.to_ascii_lowercase().contains("utf-8")
+                || value.to_ascii_lowercase().contains("utf8") =>
+        {
+            Check::ok("Encoding", t("doctor.encoding.utf8", &[("locale", &value)]))
+        }
+        Some((name, value)) => Check::warning(
+            "Encoding",
+            t(
+                "doctor.encoding.not_utf8",
+                &[("name", &name), ("value", &value)],
+            ),
+            t("doctor.encoding.fix", &[]),
+        ),
+        None => Check::warning(
+            "Encoding",
+            t("doctor.encoding.unset", &[]),
+            t("doctor.encoding.fix", &[]),
+        ),
+    }
+}
@@ -0,0 +1,305 @@
+//! Encryption at rest for captured payloads. With `encryption.enabled`, the
+//! traffic log, the offline spool and the session journal hold payloads
+//! sealed with AES-256-GCM; every command that reads them decrypts them
+//! again transparently.
+
+use anyhow::{Context, Result};
+use base64::{engine::general_purpose::STANDARD, Engine as _};
+use ring::aead::{self, Aad, LessSafeKey, Nonce, UnboundKey};
+use ring::pbkdf2;
+use ring::rand::{SecureRandom, SystemRandom};
+use serde::{Deserialize, Serialize};
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::num::NonZeroU32;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex, OnceLock};
+
+use crate::credentials;
+
+/// Passphrase payloads are encrypted with when `encryption.key_source` is
+/// `passphrase`; also lets any km read payloads sealed with it
+pub const PASSPHRASE_ENV: &str = "KM_ENCRYPTION_PASSPHRASE";
+/// Name the generated key is kept under in the credential store
+pub const KEY_NAME: &str = "km-payload-key";
+
+/// Marks a sealed payload: `km-enc:v1:<salt>:<nonce and ciphertext>`, both
+/// base64. The salt is empty for the stored key.
+const PREFIX: &str = "km-enc:v1:";
+const KEY_LEN: usize = 32;
+const SALT_LEN: usize = 16;
+const PBKDF2_ITERATIONS: u32 = 100_000;
+const AAD: &[u8] = b"km-payload";
+
+/// Where the encryption key comes from.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum KeySource {
+    /// A random key generated on first use and kept in the OS keychain (or
+    /// the encrypted credentials file where there is none)
+    #[default]
+    Keychain,
+    /// A key derived from `KM_ENCRYPTION_PASSPHRASE`
+    Passphrase,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct EncryptionConfig {
+    /// Encrypt payloads written to the traffic log, spool and journal
+    #[serde(default)]
+    pub enabled: bool,
+    #[serde(default)]
+    pub key_source: KeySource,
+}
+
+impl EncryptionConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+/// Whether `value` is a sealed payload.
+pub fn is_sealed(value: &str) -> bool {
+    value.starts_with(PREFIX)
+}
+
+/// Seals payloads with one key and opens payloads sealed with any key it
+/// has: the stored key and keys derived from the passphrase.
+pub struct PayloadCipher {
+    /// Salt and key new payloads are sealed with
+    sealing: (String, Arc<LessSafeKey>),
+    stored: Option<Arc<LessSafeKey>>,
+    passphrase: Option<String>,
+    /// Keys derived from the passphrase, by salt
+    derived: Mutex<HashMap<String, Arc<LessSafeKey>>>,
+}
+
+impl std::fmt::Debug for PayloadCipher {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("PayloadCipher")
+            .field("passphrase", &self.passphrase.is_some())
+            .finish_non_exhaustive()
+    }
+}
+
+impl PayloadCipher {
+    /// Seal with a stored key.
+    pub fn from_key(key: &[u8]) -> Result<Self> {
+        let key = Arc::new(aead_key(key)?);
+        Ok(Self {
+            sealing: (String::new(), key.clone()),
+            stored: Some(key),
+            passphrase: None,
+            derived: Mutex::new(HashMap::new()),
+        })
+    }
+
+    /// Seal with a key derived from `passphrase` and a new salt.
+    pub fn from_passphrase(passphrase: &str) -> Result<Self> {
+        let mut salt = [0u8; SALT_LEN];
+        SystemRandom::new()
+            .fill(&mut salt)
+            .map_err(|_| anyhow::anyhow!("Failed to generate salt"))?;
+        let salt = STANDARD.encode(salt);
+        let key = Arc::new(derive_key(passphrase, &salt)?);
+        Ok(Self {
+            sealing: (salt.clone(), key.clone()),
+            stored: None,
+            passphrase: Some(passphrase.to_string()),
+            derived: Mutex::new(HashMap::from([(salt, key)])),
+        })
+    }
+
+    /// Also open payloads sealed with `passphrase`.
+    pub fn with_passphrase(mut self, passphrase: &str) -> Self {
+        self.passphrase = Some(passphrase.to_string());
+        self
+    }
+
+    /// Also open payloads sealed with the stored `key`.
+    pub fn with_key(mut self, key: &[u8]) -> Result<Self> {
+        self.stored = Some(Arc::new(aead_key(key)?));
+        Ok(self)
+    }
+
+    /// The cipher `config` asks for, with every key available to this user.
+    /// The stored key is generated on first use when `create` is set;
+    /// commands that only read leave it alone.
+    pub fn load(config_path: &Path, config: &EncryptionConfig, create: bool) -> Result<Self> {
+        let passphrase = std::env::var(PASSPHRASE_ENV).ok().filter(|p| !p.is_empty());
+        let stored = stored_key(
+            config_path,
+            create && config.key_source == KeySource::Keychain,
+        )?;
+
+        let cipher = match (config.key_source, &stored, &passphrase) {
+            (KeySource::Passphrase, _, Some(passphrase)) | (_, None, Some(passphrase)) => {
+                Self::from_passphrase(passphrase)?
+            }
+            (KeySource::Passphrase, _, None) if create => {
+                return Err(anyhow::anyhow!(
+                    "encryption.key_source is passphrase but {} is not set",
+                    PASSPHRASE_ENV
+                ))
+            }
+            (_, Some(key), _) => Self::from_key(key)?,
+            (_, None, None) => {
+                return Err(anyhow::anyhow!(
+                    "No encryption key found; set {} or run on the machine that wrote the data",
+                    PASSPHRASE_ENV
+                ))
+            }
+        };
+        match (stored, passphrase) {
+            (Some(key), _) if cipher.stored.is_none() => cipher.with_key(&key),
+            (_, Some(passphrase)) if cipher.passphrase.is_none() => {
+                Ok(cipher.with_passphrase(&passphrase))
+            }
+            _ => Ok(cipher),
+        }
+    }
+
+    pub fn seal(&self, plaintext: &str) -> Result<String> {
+        let mut nonce = [0u8; aead::NONCE_LEN];
+        SystemRandom::new()
+            .fill(&mut nonce)
+            .map_err(|_| anyhow::anyhow!("Failed to generate nonce"))?;
+        let mut sealed = plaintext.as_bytes().to_vec();
+        let (salt, key) = &self.sealing;
+        key.seal_in_place_append_tag(
+            Nonce::assume_unique_for_key(nonce),
+            Aad::from(AAD),
+            &mut sealed,
+        )
+        .map_err(|_| anyhow::anyhow!("Failed to encrypt payload"))?;
+
+        let mut stored = nonce.to_vec();
+        stored.extend(sealed);
+        Ok(format!("{}{}:{}", PREFIX, salt, STANDARD.encode(stored)))
+    }
+
+    pub fn open(&self, sealed: &str) -> Result<String> {
+        let (salt, data) = sealed
+            .strip_prefix(PREFIX)
+            .and_then(|rest| rest.split_once(':'))
+            .context("Not an encrypted payload")?;
+        let mut data = STANDARD.decode(data).context("Corrupt encrypted payload")?;
+        if data.len() < aead::NONCE_LEN {
+            return Err(anyhow::anyhow!("Corrupt encrypted payload"));
+        }
+        let mut ciphertext = data.split_off(aead::NONCE_LEN);
+        let nonce = Nonce::try_assume_unique_for_key(&data)
+            .map_err(|_| anyhow::anyhow!("Corrupt encrypted payload"))?;
+        let plaintext = self
+            .key_for(salt)?
+            .open_in_place(nonce, Aad::from(AAD), &mut ciphertext)
+            .map_err(|_| anyhow::anyhow!("Failed to decrypt payload; the key doesn't match"))?;
+        String::from_utf8(plaintext.to_vec()).context("Decrypted payload is not valid UTF-8")
+    }
+
+    fn key_for(&self, salt: &str) -> Result<Arc<LessSafeKey>> {
+        if salt.is_empty() {
+            return self.stored.clone().context(
+                "Payload was encrypted with the key in the OS keychain, which isn't available",
+            );
+        }
+        let mut derived = self.derived.lock().unwrap_or_else(|e| e.into_inner());
+        if let Some(key) = derived.get(salt) {
+            return Ok(key.clone());
+        }
+        let passphrase = self.passphrase.as_deref().with_context(|| {
+            format!(
+                "Payload was encrypted with a passphrase; set {}",
+                PASSPHRASE_ENV
+            )
+        })?;
+        let key = Arc::new(derive_key(passphrase, salt)?);
+        derived.insert(salt.to_string(), key.clone());
+        Ok(key)
+    }
+}
+
+fn aead_key(key: &[u8]) -> Result<LessSafeKey> {
+    let key = UnboundKey::new(&aead::AES_256_GCM, key)
+        .map_err(|_| anyhow::anyhow!("Encryption keys must be {} bytes", KEY_LEN))?;
+    Ok(LessSafeKey::new(key))
+}
+
+fn derive_key(passphrase: &str, salt: &str) -> Result<LessSafeKey> {
+    let salt = STANDARD
+        .decode(salt)
+        .context("Corrupt salt in encrypted payload")?;
+    let mut key = [0u8; KEY_LEN];
+    pbkdf2::derive(
+        pbkdf2::PBKDF2_HMAC_SHA256,
+        NonZeroU32::new(PBKDF2_ITERATIONS).unwrap(),
+        &salt,
+        passphrase.as_bytes(),
+        &mut key,
+    );
+    aead_key(&key)
+}
+
+/// The key kept in the credential store, generated first if `create` is set.
+fn stored_key(config_path: &Path, create: bool) -> Result<Option<Vec<u8>>> {
+    let store = credentials::open(config_path)?;
+    if let Some(key) = store.get(KEY_NAME)? {
+        return STANDARD
+            .decode(key)
+            .map(Some)
+            .context("Corrupt encryption key in the credential store");
+    }
+    if !create {
+        return Ok(None);
+    }
+    let mut key = [0u8; KEY_LEN];
+    SystemRandom::new()
+        .fill(&mut key)
+        .map_err(|_| anyhow::anyhow!("Failed to generate encryption key"))?;
+    store.set(KEY_NAME, &STANDARD.encode(key))?;
+    tracing::info!(
+        "Generated a payload encryption key in the {}",
+        store.backend()
+    );
+    Ok(Some(key.to_vec()))
+}
+
+/// Where the keys for reading come from: the config of this run.
+static SOURCE: OnceLock<(PathBuf, EncryptionConfig)> = OnceLock::new();
+/// The cipher sealed payloads are read with, loaded on first use
+static READER: Mutex<Option<Arc<PayloadCipher>>> = Mutex::new(None);
+
+/// Load keys for reading from the config at `config_path` once a sealed
+/// payload turns up.
+pub fn configure(config_path: &Path, config: EncryptionConfig) {
+    let _ = SOURCE.set((config_path.to_path_buf(), config));
+}
+
+/// Read sealed payloads with `cipher`.
+pub fn install(cipher: Arc<PayloadCipher>) {
+    *READER.lock().unwrap_or_else(|e| e.into_inner()) = Some(cipher);
+}
+
+/// The cipher sealed payloads are read with: the one installed, or else
+/// one with the keys of the configured config file.
+pub fn reader() -> Result<Arc<PayloadCipher>> {
+    let mut reader = READER.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(ref cipher) = *reader {
+        return Ok(cipher.clone());
+    }
+    let (path, config) = SOURCE
+        .get()
+        .cloned()
+        .unwrap_or_else(|| (PathBuf::from("km_config.json"), EncryptionConfig::default()));
+    let cipher = Arc::new(PayloadCipher::load(&path, &config, false)?);
+    *reader = Some(cipher.clone());
+    Ok(cipher)
+}
+
+/// `value`, decrypted if it's a sealed payload.
+pub fn unseal(value: &str) -> Result<Cow<'_, str>> {
+    if !is_sealed(value) {
+        return Ok(Cow::Borrowed(value));
+    }
+    reader()?.open(value).map(Cow::Owned)
+}
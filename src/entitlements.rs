@@ -0,0 +1,523 @@
+//! What the signed-in account may use. The API lists the features of the
+//! account's plan at `/api/user/features`; km caches the answer and checks
+//! it with `has_feature` instead of comparing tier names.
+//!
+//! The API can vouch for the list with a signed entitlement token. With
+//! `entitlements.trusted_keys` set, km only accepts lists signed by one of
+//! those keys, so an edited cache can't unlock features, and hands the token
+//! to plugins so they can check the plan themselves. A running session
+//! checks the plan again every `entitlements.revalidate_minutes`; while the
+//! API is unreachable the cached list stands in for up to
+//! `entitlements.offline_grace_hours` past its expiry.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Duration, Utc};
+use reqwest::StatusCode;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use tokio::sync::watch;
+use tokio::task::JoinHandle;
+
+use crate::auth::JwtToken;
+use crate::errors::{Code, KmError};
+use crate::plugins::verify::TrustedKeys;
+
+/// Server-side risk analysis of every request (`/api/risk/analyze`)
+pub const RISK_ANALYSIS: &str = "risk_analysis";
+
+pub const FREE_TIER: &str = "free";
+/// How long a fetched list is trusted when the API doesn't say
+const DEFAULT_TTL_SECONDS: i64 = 60 * 60;
+pub const DEFAULT_REVALIDATE_MINUTES: u64 = 60;
+pub const DEFAULT_OFFLINE_GRACE_HOURS: u64 = 72;
+/// Longest offline grace period a config may set: 30 days
+const MAX_OFFLINE_GRACE_HOURS: u64 = 30 * 24;
+const FETCH_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(5);
+
+/// How often a running session checks the plan again, how long a cached
+/// plan outlives an unreachable API, and whose signature it needs.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct EntitlementSettings {
+    /// Minutes between checks while `km monitor` runs; 0 checks only at start
+    #[serde(
+        default = "default_revalidate_minutes",
+        skip_serializing_if = "is_default_revalidate_minutes"
+    )]
+    pub revalidate_minutes: u64,
+    /// Hours past its expiry a cached plan stands in for an unreachable API
+    #[serde(
+        default = "default_offline_grace_hours",
+        skip_serializing_if = "is_default_offline_grace_hours"
+    )]
+    pub offline_grace_hours: u64,
+    /// Base64 Ed25519 public keys; when set, the plan must be signed by one
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub trusted_keys: Vec<String>,
+}
+
+fn default_revalidate_minutes() -> u64 {
+    DEFAULT_REVALIDATE_MINUTES
+}
+
+fn is_default_revalidate_minutes(value: &u64) -> bool {
+    *value == DEFAULT_REVALIDATE_MINUTES
+}
+
+fn default_offline_grace_hours() -> u64 {
+    DEFAULT_OFFLINE_GRACE_HOURS
+}
+
+fn is_default_offline_grace_hours(value: &u64) -> bool {
+    *value == DEFAULT_OFFLINE_GRACE_HOURS
+}
+
+impl Default for EntitlementSettings {
+    fn default() -> Self {
+        Self {
+            revalidate_minutes: DEFAULT_REVALIDATE_MINUTES,
+            offline_grace_hours: DEFAULT_OFFLINE_GRACE_HOURS,
+            trusted_keys: Vec::new(),
+        }
+    }
+}
+
+impl EntitlementSettings {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        if self.offline_grace_hours > MAX_OFFLINE_GRACE_HOURS {
+            return Err(anyhow::anyhow!(
+                "entitlements.offline_grace_hours must be at most {} (got {})",
+                MAX_OFFLINE_GRACE_HOURS,
+                self.offline_grace_hours
+            ));
+        }
+        TrustedKeys::from_config(&self.trusted_keys).context("entitlements.trusted_keys")?;
+        Ok(())
+    }
+
+    /// Time between checks while a session runs, if it checks at all.
+    pub fn revalidate_interval(&self) -> Option<std::time::Duration> {
+        (self.revalidate_minutes > 0)
+            .then(|| std::time::Duration::from_secs(self.revalidate_minutes * 60))
+    }
+
+    pub fn offline_grace(&self) -> Duration {
+        Duration::hours(self.offline_grace_hours.min(MAX_OFFLINE_GRACE_HOURS) as i64)
+    }
+}
+
+/// A plan as the API vouches for it: the claims as JSON text, and a base64
+/// Ed25519 signature over exactly those bytes.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SignedEntitlements {
+    pub claims: String,
+    pub signature: String,
+}
+
+/// What a signed entitlement token says.
+#[derive(Debug, Deserialize)]
+struct Claims {
+    tier: String,
+    #[serde(default)]
+    features: BTreeSet<String>,
+    #[serde(default)]
+    user_id: Option<String>,
+    expires_at: DateTime<Utc>,
+}
+
+impl SignedEntitlements {
+    /// The claims, if one of `keys` signed them.
+    fn verify(&self, keys: &TrustedKeys) -> Result<Claims> {
+        if !keys.verifies(self.claims.as_bytes(), &self.signature) {
+            return Err(anyhow::anyhow!(
+                "The plan isn't signed by a key in entitlements.trusted_keys"
+            ));
+        }
+        serde_json::from_str(&self.claims).context("Invalid entitlement token")
+    }
+}
+
+/// Where a set of entitlements came from.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Source {
+    /// Fetched from the API just now
+    Api,
+    /// A cached copy of an earlier answer
+    Cache,
+    /// Derived from the tier name, for servers without the features
+    /// endpoint, `--override-tier` and unreachable APIs
+    Tier,
+    /// No account: local-only mode
+    None,
+}
+
+impl std::fmt::Display for Source {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            Source::Api => "from the API",
+            Source::Cache => "cached",
+            Source::Tier => "from the plan name",
+            Source::None => "not signed in",
+        })
+    }
+}
+
+/// `/api/user/features`
+#[derive(Debug, Deserialize)]
+struct FeaturesResponse {
+    tier: String,
+    #[serde(default)]
+    features: BTreeSet<String>,
+    /// How long the answer may be cached
+    #[serde(default)]
+    ttl_seconds: Option<i64>,
+    /// The same plan, signed
+    #[serde(default)]
+    token: Option<SignedEntitlements>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Entitlements {
+    pub tier: String,
+    pub features: BTreeSet<String>,
+    pub source: Source,
+    pub fetched_at: DateTime<Utc>,
+    pub expires_at: DateTime<Utc>,
+    /// API and account the list belongs to
+    #[serde(default)]
+    pub api_url: String,
+    #[serde(default)]
+    pub user_id: Option<String>,
+    /// The API's signed copy of this plan, handed on to plugins
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub token: Option<SignedEntitlements>,
+}
+
+impl Entitlements {
+    /// Local-only mode: nothing from the cloud.
+    pub fn none() -> Self {
+        let now = Utc::now();
+        Self {
+            tier: FREE_TIER.to_string(),
+            features: BTreeSet::new(),
+            source: Source::None,
+            fetched_at: now,
+            expires_at: now,
+            api_url: String::new(),
+            user_id: None,
+            token: None,
+        }
+    }
+
+    /// The features a plan had before the API listed them: every paid tier
+    /// gets risk analysis.
+    pub fn from_tier(tier: &str) -> Self {
+        let mut features = BTreeSet::new();
+        if !tier.eq_ignore_ascii_case(FREE_TIER) {
+            features.insert(RISK_ANALYSIS.to_string());
+        }
+        Self {
+            tier: tier.to_string(),
+            features,
+            source: Source::Tier,
+            ..Self::none()
+        }
+    }
+
+    pub fn has_feature(&self, feature: &str) -> bool {
+        self.features.contains(feature)
+    }
+
+    pub fn is_expired(&self, now: DateTime<Utc>) -> bool {
+        self.expires_at <= now
+    }
+
+    /// Features `previous` had that these don't.
+    pub fn lost_since(&self, previous: &Entitlements) -> Vec<String> {
+        previous
+            .features
+            .difference(&self.features)
+            .cloned()
+            .collect()
+    }
+
+    /// Whether the plan, tier or feature list differ from `other`.
+    pub fn differs_from(&self, other: &Entitlements) -> bool {
+        self.tier != other.tier || self.features != other.features
+    }
+
+    fn belongs_to(&self, api_url: &str, token: &JwtToken) -> bool {
+        self.api_url == api_url && self.user_id == user_id(token)
+    }
+
+    /// Whether a token signed by one of `keys` says exactly this. Anything
+    /// goes without keys.
+    fn is_vouched_for(&self, keys: &TrustedKeys) -> bool {
+        if keys.is_empty() {
+            return true;
+        }
+        let Some(claims) = self.token.as_ref().and_then(|t| t.verify(keys).ok()) else {
+            return false;
+        };
+        claims.tier == self.tier
+            && claims.features == self.features
+            && claims.user_id == self.user_id
+            && claims.expires_at == self.expires_at
+    }
+}
+
+fn user_id(token: &JwtToken) -> Option<String> {
+    token
+        .claims
+        .user_id
+        .clone()
+        .or_else(|| token.claims.sub.clone())
+}
+
+/// `~/.config/kilometers/entitlements.json` (or the platform equivalent)
+pub fn default_path() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base
+        .config_dir()
+        .join("kilometers")
+        .join("entitlements.json"))
+}
+
+/// The cached entitlements at `path`, if any.
+pub fn load_cached(path: &Path) -> Option<Entitlements> {
+    let content = fs::read_to_string(path).ok()?;
+    match serde_json::from_str(&content) {
+        Ok(cached) => Some(cached),
+        Err(e) => {
+            tracing::debug!("Ignoring unreadable entitlements cache {:?}: {}", path, e);
+            None
+        }
+    }
+}
+
+fn save_cached(path: &Path, entitlements: &Entitlements) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    fs::write(path, serde_json::to_string_pretty(entitlements)?)
+        .with_context(|| format!("Failed to write {:?}", path))
+}
+
+/// Ask the API which features the account has. `None` means the server has
+/// no features endpoint. With `keys`, the answer must carry a token signed
+/// by one of them, and the plan is taken from the token.
+pub async fn fetch(
+    api_url: &str,
+    token: &JwtToken,
+    keys: &TrustedKeys,
+) -> Result<Option<Entitlements>> {
+    crate::offline::ensure_online("Checking your plan's features")?;
+    let client = crate::http::client_builder()
+        .timeout(FETCH_TIMEOUT)
+        .build()
+        .unwrap_or_else(|_| reqwest::Client::new());
+    let url = format!("{}/api/user/features", api_url.trim_end_matches('/'));
+    let response = client
+        .get(&url)
+        .bearer_auth(&token.token)
+        .send()
+        .await
+        .with_context(|| format!("Failed to reach {}", url))?;
+    match response.status() {
+        StatusCode::NOT_FOUND => return Ok(None),
+        status if !status.is_success() => {
+            return Err(KmError::new(
+                Code::for_status(status),
+                format!("{} answered with status {}", url, status),
+            )
+            .into())
+        }
+        _ => {}
+    }
+    let body: FeaturesResponse = response
+        .json()
+        .await
+        .with_context(|| format!("{} sent an invalid feature list", url))?;
+
+    let now = Utc::now();
+    let ttl = body.ttl_seconds.unwrap_or(DEFAULT_TTL_SECONDS).max(0);
+    let mut entitlements = Entitlements {
+        tier: body.tier,
+        features: body.features,
+        source: Source::Api,
+        fetched_at: now,
+        expires_at: now + Duration::seconds(ttl),
+        api_url: api_url.to_string(),
+        user_id: user_id(token),
+        token: body.token,
+    };
+    if !keys.is_empty() {
+        let claims = entitlements
+            .token
+            .as_ref()
+            .with_context(|| format!("{} sent an unsigned feature list", url))?
+            .verify(keys)?;
+        if claims.user_id != entitlements.user_id {
+            return Err(anyhow::anyhow!(
+                "{} sent an entitlement token for another account",
+                url
+            ));
+        }
+        entitlements.tier = claims.tier;
+        entitlements.features = claims.features;
+        entitlements.expires_at = claims.expires_at;
+    }
+    Ok(Some(entitlements))
+}
+
+/// The entitlements of the account behind `token`: the cached list while it
+/// is fresh, else a new one from the API. When the API can't be reached a
+/// recently expired list stands in, then the tier in the token. A plan that
+/// lost features since the last check is logged, and those features simply
+/// switch off. With trusted keys, only signed lists are used or cached.
+pub async fn resolve(
+    cache_path: &Path,
+    api_url: &str,
+    token: Option<&JwtToken>,
+    refresh: bool,
+    settings: &EntitlementSettings,
+) -> Entitlements {
+    let Some(token) = token else {
+        return Entitlements::none();
+    };
+    let claimed_tier = token.claims.tier.as_deref().unwrap_or(FREE_TIER);
+    let keys = match TrustedKeys::from_config(&settings.trusted_keys) {
+        Ok(keys) => keys,
+        Err(e) => {
+            tracing::warn!(
+                "Using the plan name only: entitlements.trusted_keys: {:#}",
+                e
+            );
+            return Entitlements::from_tier(claimed_tier);
+        }
+    };
+    let now = Utc::now();
+    let cached = load_cached(cache_path)
+        .filter(|c| c.belongs_to(api_url, token))
+        .filter(|c| {
+            let vouched = c.is_vouched_for(&keys);
+            if !vouched {
+                tracing::warn!("Ignoring the cached plan: its signature doesn't check out");
+            }
+            vouched
+        });
+    if let Some(ref cached) = cached {
+        if !refresh && !cached.is_expired(now) {
+            return Entitlements {
+                source: Source::Cache,
+                ..cached.clone()
+            };
+        }
+    }
+
+    let fetched = match fetch(api_url, token, &keys).await {
+        Ok(Some(fetched)) => fetched,
+        Ok(None) => Entitlements::from_tier(claimed_tier),
+        Err(e) => {
+            tracing::warn!("Could not check your plan's features: {:#}", e);
+            return match cached {
+                Some(cached) if cached.expires_at + settings.offline_grace() > now => {
+                    Entitlements {
+                        source: Source::Cache,
+                        ..cached
+                    }
+                }
+                Some(_) => {
+                    tracing::warn!(
+                        "The cached plan is past its offline grace period; \
+                         using the features of the plan name"
+                    );
+                    Entitlements::from_tier(claimed_tier)
+                }
+                None => Entitlements::from_tier(claimed_tier),
+            };
+        }
+    };
+
+    if let Some(ref cached) = cached {
+        let lost = fetched.lost_since(cached);
+        if !lost.is_empty() {
+            tracing::warn!(
+                "Your plan changed from {} to {}; no longer available: {}",
+                cached.tier,
+                fetched.tier,
+                lost.join(", ")
+            );
+        }
+    }
+    if fetched.source == Source::Api {
+        if let Err(e) = save_cached(cache_path, &fetched) {
+            tracing::debug!("Not caching entitlements: {:#}", e);
+        }
+    }
+    fetched
+}
+
+/// Checks the plan of a running session again, with the latest access
+/// token.
+pub struct Revalidator {
+    pub cache_path: PathBuf,
+    pub api_url: String,
+    pub token: JwtToken,
+    /// Access tokens renewed during the session
+    pub tokens: Option<watch::Receiver<String>>,
+    pub settings: EntitlementSettings,
+}
+
+impl Revalidator {
+    /// Check the plan again. Returns the new entitlements if they differ
+    /// from `current`.
+    pub async fn check(&mut self, current: &Entitlements) -> Option<Entitlements> {
+        if let Some(ref tokens) = self.tokens {
+            self.token.token = tokens.borrow().clone();
+        }
+        let fresh = resolve(
+            &self.cache_path,
+            &self.api_url,
+            Some(&self.token),
+            true,
+            &self.settings,
+        )
+        .await;
+        if !fresh.differs_from(current) {
+            return None;
+        }
+        tracing::info!(
+            "Your plan's features changed during the session: now {} ({})",
+            fresh.tier,
+            fresh.source
+        );
+        Some(fresh)
+    }
+
+    /// Check the plan every `entitlements.revalidate_minutes` for as long as
+    /// the returned task runs, passing changed entitlements to `on_change`.
+    /// `None` when revalidation is turned off.
+    pub fn spawn(
+        mut self,
+        mut current: Entitlements,
+        on_change: impl Fn(&Entitlements) + Send + 'static,
+    ) -> Option<JoinHandle<()>> {
+        let interval = self.settings.revalidate_interval()?;
+        Some(tokio::spawn(async move {
+            loop {
+                tokio::time::sleep(interval).await;
+                if let Some(fresh) = self.check(&current).await {
+                    on_change(&fresh);
+                    current = fresh;
+                }
+            }
+        }))
+    }
+}
@@ -0,0 +1,310 @@
+//! Stable error codes. A failing command's error carries a [`Code`], either
+//! attached where it happens (a [`KmError`] in the error's context) or
+//! worked out from the underlying error by [`classify`]. `km
+//! --error-format json` prints failures as `{code, message, hint}` for
+//! scripts, and `km explain CODE` says what a code means.
+
+use clap::ValueEnum;
+use serde::Serialize;
+use std::fmt;
+
+/// What part of km a failure comes from.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Category {
+    Config,
+    Auth,
+    Transport,
+    Plugin,
+    Api,
+    Other,
+}
+
+impl Category {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Category::Config => "config",
+            Category::Auth => "auth",
+            Category::Transport => "transport",
+            Category::Plugin => "plugin",
+            Category::Api => "api",
+            Category::Other => "other",
+        }
+    }
+}
+
+/// A kind of failure. The names are stable: scripts can match on them.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, ValueEnum)]
+#[serde(rename_all = "SCREAMING_SNAKE_CASE")]
+#[value(rename_all = "SCREAMING_SNAKE_CASE")]
+pub enum Code {
+    /// There is no config file
+    ConfigNotFound,
+    /// The config file can't be read or has invalid settings
+    ConfigInvalid,
+    /// No API key is set up
+    AuthMissing,
+    /// The API refused the API key or access token
+    AuthRejected,
+    /// No access token could be had for the API
+    AuthFailed,
+    /// A server couldn't be reached
+    TransportUnreachable,
+    /// A server took too long to answer
+    TransportTimeout,
+    /// The command needs the network, and km is in offline mode
+    Offline,
+    /// A plugin isn't installed
+    PluginNotInstalled,
+    /// A plugin failed its checksum or signature check
+    PluginUntrusted,
+    /// The API answered with an error
+    ApiError,
+    /// The API is throttling requests
+    ApiRateLimited,
+    /// The API is down or failing
+    ApiUnavailable,
+    /// Any other failure
+    Other,
+}
+
+impl Code {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Code::ConfigNotFound => "CONFIG_NOT_FOUND",
+            Code::ConfigInvalid => "CONFIG_INVALID",
+            Code::AuthMissing => "AUTH_MISSING",
+            Code::AuthRejected => "AUTH_REJECTED",
+            Code::AuthFailed => "AUTH_FAILED",
+            Code::TransportUnreachable => "TRANSPORT_UNREACHABLE",
+            Code::TransportTimeout => "TRANSPORT_TIMEOUT",
+            Code::Offline => "OFFLINE",
+            Code::PluginNotInstalled => "PLUGIN_NOT_INSTALLED",
+            Code::PluginUntrusted => "PLUGIN_UNTRUSTED",
+            Code::ApiError => "API_ERROR",
+            Code::ApiRateLimited => "API_RATE_LIMITED",
+            Code::ApiUnavailable => "API_UNAVAILABLE",
+            Code::Other => "OTHER",
+        }
+    }
+
+    pub fn category(self) -> Category {
+        match self {
+            Code::ConfigNotFound | Code::ConfigInvalid => Category::Config,
+            Code::AuthMissing | Code::AuthRejected | Code::AuthFailed => Category::Auth,
+            Code::TransportUnreachable | Code::TransportTimeout | Code::Offline => {
+                Category::Transport
+            }
+            Code::PluginNotInstalled | Code::PluginUntrusted => Category::Plugin,
+            Code::ApiError | Code::ApiRateLimited | Code::ApiUnavailable => Category::Api,
+            Code::Other => Category::Other,
+        }
+    }
+
+    /// What to try next, in one line.
+    pub fn hint(self) -> &'static str {
+        match self {
+            Code::ConfigNotFound => "Run `km init` to create a config file, or pass --config",
+            Code::ConfigInvalid => "Run `km config validate` to list the settings to fix",
+            Code::AuthMissing => "Run `km login`, or `km init` with an API key",
+            Code::AuthRejected => "Check the API key, or run `km login` again",
+            Code::AuthFailed => "Run `km doctor` to check the API key and the connection",
+            Code::TransportUnreachable => {
+                "Check the network connection, api_url and any http.proxy setting"
+            }
+            Code::TransportTimeout => "Try again; if it keeps happening, run `km doctor`",
+            Code::Offline => "Run without --offline, KM_OFFLINE and the offline setting",
+            Code::PluginNotInstalled => "Run `km plugins list` to see what is installed",
+            Code::PluginUntrusted => {
+                "Add the publisher's key to plugin_trusted_keys, or pass --allow-unsigned"
+            }
+            Code::ApiError => "Run again with -vv for details",
+            Code::ApiRateLimited => "Wait a moment and try again",
+            Code::ApiUnavailable => "Try again later; captured events are spooled meanwhile",
+            Code::Other => "Run again with -vv for details",
+        }
+    }
+
+    /// The longer explanation `km explain` shows.
+    pub fn explanation(self) -> &'static str {
+        match self {
+            Code::ConfigNotFound => {
+                "km found no config file at the --config path (km_config.json in the current \
+                 directory by default) and no KM_API_KEY in the environment to run without one."
+            }
+            Code::ConfigInvalid => {
+                "The config file isn't valid JSON, a setting has a value of the wrong type, or \
+                 a setting is out of range. The message names the setting. Settings km doesn't \
+                 know are only warned about."
+            }
+            Code::AuthMissing => {
+                "The command talks to the Kilometers API, but there is no API key in the \
+                 credential store, the config file or KM_API_KEY."
+            }
+            Code::AuthRejected => {
+                "The API answered 401 or 403: the API key was revoked or mistyped, the login \
+                 expired and couldn't be refreshed, or the account lacks access to this feature."
+            }
+            Code::AuthFailed => {
+                "km couldn't get an access token for the API. Either the API key was refused \
+                 or the API couldn't be reached; `km doctor` tells which."
+            }
+            Code::TransportUnreachable => {
+                "The connection to the API, the plugin marketplace or another server failed: \
+                 the host name didn't resolve, the connection was refused, or TLS failed. A \
+                 proxy or custom CA bundle set in the http settings may be at fault."
+            }
+            Code::TransportTimeout => {
+                "A server accepted the connection but didn't answer in time. This is usually \
+                 temporary."
+            }
+            Code::Offline => {
+                "km runs in offline mode (--offline, KM_OFFLINE or `offline: true` in the config \
+                 file) and makes no calls to the API, the plugin marketplace or the update feed. \
+                 Local capture, export, policies and reports still work."
+            }
+            Code::PluginNotInstalled => {
+                "The command names a plugin that isn't installed on this machine. Install it \
+                 with `km plugins install NAME`."
+            }
+            Code::PluginUntrusted => {
+                "A downloaded plugin didn't match the checksum in the marketplace manifest, or \
+                 isn't signed by a key in plugin_trusted_keys. km refuses to run it."
+            }
+            Code::ApiError => {
+                "The Kilometers API answered with an error the other codes don't cover, such as \
+                 a malformed request or a missing resource."
+            }
+            Code::ApiRateLimited => {
+                "The API answered 429. Uploads retry on their own (see the retry settings); \
+                 other commands can simply be run again a little later."
+            }
+            Code::ApiUnavailable => {
+                "The API answered with a 5xx status. `km monitor` spools events while the API \
+                 is failing and uploads them once it recovers (or with `km flush`)."
+            }
+            Code::Other => "The failure has no more specific code. The message says what failed.",
+        }
+    }
+
+    /// The code for an HTTP error status from the API.
+    pub fn for_status(status: reqwest::StatusCode) -> Code {
+        match status.as_u16() {
+            401 | 403 => Code::AuthRejected,
+            429 => Code::ApiRateLimited,
+            500..=599 => Code::ApiUnavailable,
+            _ => Code::ApiError,
+        }
+    }
+}
+
+impl fmt::Display for Code {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// An error with a code. Add it as context, so the message of the
+/// underlying error is kept:
+/// `.context(KmError::new(Code::ConfigNotFound, "No configuration found"))`.
+#[derive(Debug)]
+pub struct KmError {
+    pub code: Code,
+    pub message: String,
+}
+
+impl KmError {
+    pub fn new(code: Code, message: impl Into<String>) -> Self {
+        Self {
+            code,
+            message: message.into(),
+        }
+    }
+}
+
+impl fmt::Display for KmError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl std::error::Error for KmError {}
+
+/// The code of `error`: the outermost one attached to it, or else one
+/// worked out from the network and I/O errors in its chain.
+pub fn classify(error: &anyhow::Error) -> Code {
+    if let Some(e) = error.downcast_ref::<KmError>() {
+        return e.code;
+    }
+    for cause in error.chain() {
+        if let Some(e) = cause.downcast_ref::<KmError>() {
+            return e.code;
+        }
+        if let Some(e) = cause.downcast_ref::<reqwest::Error>() {
+            return match e.status() {
+                Some(status) => Code::for_status(status),
+                None if e.is_timeout() => Code::TransportTimeout,
+                None if e.is_decode() => Code::ApiError,
+                None => Code::TransportUnreachable,
+            };
+        }
+        if let Some(e) = cause.downcast_ref::<std::io::Error>() {
+            use std::io::ErrorKind;
+            match e.kind() {
+                ErrorKind::TimedOut => return Code::TransportTimeout,
+                ErrorKind::ConnectionRefused
+                | ErrorKind::ConnectionReset
+                | ErrorKind::ConnectionAborted => return Code::TransportUnreachable,
+                _ => {}
+            }
+        }
+    }
+    Code::Other
+}
+
+/// How failures are printed.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, ValueEnum)]
+pub enum ErrorFormat {
+    /// The message and its causes, then a hint and the code
+    #[default]
+    Text,
+    /// One JSON object: {"code", "message", "hint"}
+    Json,
+}
+
+/// A failure as `--error-format json` prints it.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct ErrorReport {
+    pub code: Code,
+    /// The error with its causes, outermost first
+    pub message: String,
+    pub hint: &'static str,
+}
+
+impl ErrorReport {
+    pub fn new(error: &anyhow::Error) -> Self {
+        let code = classify(error);
+        Self {
+            code,
+            message: format!("{:#}", error),
+            hint: code.hint(),
+        }
+    }
+}
+
+/// Print `error` to stderr in `format`.
+pub fn report(error: &anyhow::Error, format: ErrorFormat) {
+    let report = ErrorReport::new(error);
+    match format {
+        ErrorFormat::Json => match serde_json::to_string(&report) {
+            Ok(json) => eprintln!("{}", json),
+            Err(_) => eprintln!("Error: {:?}", error),
+        },
+        ErrorFormat::Text => {
+            eprintln!("Error: {:?}", error);
+            if report.code != Code::Other {
+                eprintln!();
+                eprintln!("{} [{}]", report.hint, report.code);
+            }
+        }
+    }
+}
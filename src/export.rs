@@ -0,0 +1,277 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use std::fs::File;
+use std::io::{self, BufWriter, Write};
+use std::path::Path;
+
+use crate::anonymize::Anonymizer;
+use crate::traffic::{self, Labels, TrafficEntry};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum ExportFormat {
+    Jsonl,
+    Csv,
+    Parquet,
+}
+
+impl ExportFormat {
+    /// Infer the format from an output file extension.
+    pub fn from_path(path: &Path) -> Option<Self> {
+        match path.extension()?.to_str()?.to_ascii_lowercase().as_str() {
+            "jsonl" | "ndjson" | "json" => Some(Self::Jsonl),
+            "csv" => Some(Self::Csv),
+            "parquet" => Some(Self::Parquet),
+            _ => None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct ExportFilter {
+    pub session_id: Option<String>,
+    pub since: Option<DateTime<Utc>>,
+    pub until: Option<DateTime<Utc>>,
+    pub method: Option<String>,
+}
+
+impl ExportFilter {
+    fn matches(&self, entry: &TrafficEntry, method: Option<&str>) -> bool {
+        if let Some(ref session_id) = self.session_id {
+            if entry.session_id.as_deref() != Some(session_id.as_str()) {
+                return false;
+            }
+        }
+        if let Some(since) = self.since {
+            if entry.timestamp < since {
+                return false;
+            }
+        }
+        if let Some(until) = self.until {
+            if entry.timestamp > until {
+                return false;
+            }
+        }
+        if let Some(ref pattern) = self.method {
+            match method {
+                Some(m) if traffic::method_matches(pattern, m) => {}
+                _ => return false,
+            }
+        }
+        true
+    }
+}
+
+/// Flattened row written by every export format.
+#[derive(Debug, Clone, Serialize)]
+pub struct ExportRecord {
+    pub timestamp: DateTime<Utc>,
+    pub session_id: Option<String>,
+    pub direction: String,
+    pub method: Option<String>,
+    pub rpc_id: Option<String>,
+    pub duration_ms: Option<f64>,
+    /// Milliseconds since the session's first message on the monotonic
+    /// clock; JSON lines only
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub elapsed_ms: Option<f64>,
+    pub payload_size: usize,
+    pub content: String,
+    /// Session labels, including its run id; JSON lines only, so an
+    /// export can be merged with `km merge`
+    #[serde(skip_serializing_if = "Labels::is_empty")]
+    pub labels: Labels,
+}
+
+pub fn collect_records(entries: &[TrafficEntry], filter: &ExportFilter) -> Vec<ExportRecord> {
+    let methods = traffic::resolve_methods(entries);
+
+    entries
+        .iter()
+        .zip(methods)
+        .filter(|(entry, method)| filter.matches(entry, method.as_deref()))
+        .map(|(entry, method)| ExportRecord {
+            timestamp: entry.timestamp,
+            session_id: entry.session_id.clone(),
+            direction: entry.direction.clone(),
+            method,
+            rpc_id: entry.rpc_id().map(|id| match id {
+                serde_json::Value::String(s) => s,
+                other => other.to_string(),
+            }),
+            duration_ms: entry.duration_ms,
+            elapsed_ms: entry.elapsed_ms,
+            payload_size: entry.content.len(),
+            content: entry.content.clone(),
+            labels: entry.labels.clone(),
+        })
+        .collect()
+}
+
+/// Pseudonymize session ids and payloads so the export can be shared.
+/// Methods, ids, sizes, and timing are kept for analysis.
+pub fn anonymize_records(records: &mut [ExportRecord], anonymizer: &Anonymizer) {
+    for record in records {
+        if let Some(ref session_id) = record.session_id {
+            record.session_id = Some(format!(
+                "session-{}",
+                anonymizer.token("session", session_id)
+            ));
+        }
+        record.content = anonymizer.anonymize_content(&record.content);
+    }
+}
+
+/// Export records to `output`. An output of `-` writes to stdout, which is
+/// only supported for the text formats.
+pub fn write_records(records: &[ExportRecord], format: ExportFormat, output: &Path) -> Result<()> {
+    let to_stdout = output == Path::new("-");
+
+    match format {
+        ExportFormat::Jsonl | ExportFormat::Csv => {
+            let mut writer: Box<dyn Write> = if to_stdout {
+                Box::new(BufWriter::new(io::stdout()))
+            } else {
+                Box::new(BufWriter::new(
+                    File::create(output)
+                        .with_context(|| format!("Failed to create {:?}", output))?,
+                ))
+            };
+
+            if format == ExportFormat::Jsonl {
+                write_jsonl(records, &mut writer)?;
+            } else {
+                write_csv(records, &mut writer)?;
+            }
+            writer.flush().context("Failed to flush export output")
+        }
+        ExportFormat::Parquet => {
+            if to_stdout {
+                return Err(anyhow::anyhow!("Parquet export requires an output file"));
+            }
+            write_parquet(records, output)
+        }
+    }
+}
+
+pub fn write_jsonl<W: Write>(records: &[ExportRecord], writer: &mut W) -> Result<()> {
+    for record in records {
+        writeln!(writer, "{}", serde_json::to_string(record)?)
+            .context("Failed to write JSONL record")?;
+    }
+    Ok(())
+}
+
+const CSV_HEADER: &str =
+    "timestamp,session_id,direction,method,rpc_id,duration_ms,payload_size,content";
+
+pub fn write_csv<W: Write>(records: &[ExportRecord], writer: &mut W) -> Result<()> {
+    writeln!(writer, "{}", CSV_HEADER).context("Failed to write CSV header")?;
+
+    for record in records {
+        let fields = [
+            record.timestamp.to_rfc3339(),
+            record.session_id.clone().unwrap_or_default(),
+            record.direction.clone(),
+            record.method.clone().unwrap_or_default(),
+            record.rpc_id.clone().unwrap_or_default(),
+            record
+                .duration_ms
+                .map(|d| d.to_string())
+                .unwrap_or_default(),
+            record.payload_size.to_string(),
+            record.content.clone(),
+        ];
+        let line: Vec<String> = fields.iter().map(|f| csv_escape(f)).collect();
+        writeln!(writer, "{}", line.join(",")).context("Failed to write CSV record")?;
+    }
+    Ok(())
+}
+
+fn csv_escape(field: &str) -> String {
+    if field.contains([',', '"', '\n', '\r']) {
+        format!("\"{}\"", field.replace('"', "\"\""))
+    } else {
+        field.to_string()
+    }
+}
+
+#[cfg(feature = "parquet")]
+fn write_parquet(records: &[ExportRecord], output: &Path) -> Result<()> {
+    use arrow_array::{
+        ArrayRef, Float64Array, RecordBatch, StringArray, TimestampMicrosecondArray, UInt64Array,
+    };
+    use arrow_schema::{DataType, Field, Schema, TimeUnit};
+    use parquet::arrow::ArrowWriter;
+    use std::sync::Arc;
+
+    let schema = Arc::new(Schema::new(vec![
+        Field::new(
+            "timestamp",
+            DataType::Timestamp(TimeUnit::Microsecond, Some("UTC".into())),
+            false,
+        ),
+        Field::new("session_id", DataType::Utf8, true),
+        Field::new("direction", DataType::Utf8, false),
+        Field::new("method", DataType::Utf8, true),
+        Field::new("rpc_id", DataType::Utf8, true),
+        Field::new("duration_ms", DataType::Float64, true),
+        Field::new("payload_size", DataType::UInt64, false),
+        Field::new("content", DataType::Utf8, false),
+    ]));
+
+    let columns: Vec<ArrayRef> = vec![
+        Arc::new(
+            TimestampMicrosecondArray::from(
+                records
+                    .iter()
+                    .map(|r| r.timestamp.timestamp_micros())
+                    .collect::<Vec<_>>(),
+            )
+            .with_timezone("UTC"),
+        ),
+        Arc::new(StringArray::from(
+            records
+                .iter()
+                .map(|r| r.session_id.clone())
+                .collect::<Vec<_>>(),
+        )),
+        Arc::new(StringArray::from_iter_values(
+            records.iter().map(|r| r.direction.as_str()),
+        )),
+        Arc::new(StringArray::from(
+            records.iter().map(|r| r.method.clone()).collect::<Vec<_>>(),
+        )),
+        Arc::new(StringArray::from(
+            records.iter().map(|r| r.rpc_id.clone()).collect::<Vec<_>>(),
+        )),
+        Arc::new(Float64Array::from(
+            records.iter().map(|r| r.duration_ms).collect::<Vec<_>>(),
+        )),
+        Arc::new(UInt64Array::from_iter_values(
+            records.iter().map(|r| r.payload_size as u64),
+        )),
+        Arc::new(StringArray::from_iter_values(
+            records.iter().map(|r| r.content.as_str()),
+        )),
+    ];
+
+    let batch =
+        RecordBatch::try_new(schema.clone(), columns).context("Failed to build record batch")?;
+    let file = File::create(output).with_context(|| format!("Failed to create {:?}", output))?;
+    let mut writer =
+        ArrowWriter::try_new(file, schema, None).context("Failed to create Parquet writer")?;
+    writer
+        .write(&batch)
+        .context("Failed to write Parquet data")?;
+    writer.close().context("Failed to finalize Parquet file")?;
+
+    Ok(())
+}
+
+#[cfg(not(feature = "parquet"))]
+fn write_parquet(_records: &[ExportRecord], _output: &Path) -> Result<()> {
+    Err(anyhow::anyhow!(
+        "Parquet export is not available in this build. Rebuild km with `--features parquet` or export to jsonl/csv"
+    ))
+}
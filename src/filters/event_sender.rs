@@ -1,10 +1,13 @@
 use super::{FilterDecision, ProxyContext, ProxyFilter};
 use crate::auth::JwtToken;
+use crate::redaction::Redactor;
+use crate::spool::Spool;
 use anyhow::{Context, Result};
 use async_trait::async_trait;
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
+use std::sync::Arc;
 use uuid::Uuid;
 
 #[derive(Debug, Clone)]
@@ -12,6 +15,8 @@ pub struct EventSenderFilter {
     api_endpoint: String,
     client: reqwest::Client,
     jwt_token: JwtToken,
+    spool: Option<Spool>,
+    redactor: Option<Arc<Redactor>>,
 }
 
 #[derive(Debug, Serialize)]
@@ -38,12 +43,26 @@ impl EventSenderFilter {
     pub fn new(api_endpoint: String, jwt_token: JwtToken) -> Self {
         Self {
             api_endpoint,
-            client: reqwest::Client::new(),
+            client: crate::http::client(),
             jwt_token,
+            spool: None,
+            redactor: None,
         }
     }
 
-    async fn send_telemetry_event(&self, ctx: &ProxyContext) -> Result<()> {
+    /// Queue events that fail to send on disk instead of dropping them.
+    pub fn with_spool(mut self, spool: Spool) -> Self {
+        self.spool = Some(spool);
+        self
+    }
+
+    /// Scrub events with `redactor` before they are sent or spooled.
+    pub fn with_redactor(mut self, redactor: Arc<Redactor>) -> Self {
+        self.redactor = Some(redactor);
+        self
+    }
+
+    fn build_event(&self, ctx: &ProxyContext) -> Result<serde_json::Value> {
         let session_id = Uuid::new_v4().to_string();
 
         let event = TelemetryEvent {
@@ -68,11 +87,19 @@ impl EventSenderFilter {
                 .collect(),
         };
 
+        let mut payload = serde_json::to_value(&event)?;
+        if let Some(ref redactor) = self.redactor {
+            redactor.redact_value(&mut payload);
+        }
+        Ok(payload)
+    }
+
+    async fn send_telemetry_event(&self, event: &serde_json::Value) -> Result<()> {
         let response = self
             .client
             .post(&self.api_endpoint)
             .bearer_auth(&self.jwt_token.token)
-            .json(&event)
+            .json(event)
             .send()
             .await
             .context("Failed to send telemetry event")?;
@@ -104,7 +131,8 @@ impl EventSenderFilter {
 #[async_trait]
 impl ProxyFilter for EventSenderFilter {
     async fn check(&self, ctx: &ProxyContext) -> Result<FilterDecision> {
-        match self.send_telemetry_event(ctx).await {
+        let event = self.build_event(ctx)?;
+        match self.send_telemetry_event(&event).await {
             Ok(_) => {
                 tracing::debug!("Telemetry event sent for command: {}", ctx.request.command);
             }
@@ -113,6 +141,12 @@ impl ProxyFilter for EventSenderFilter {
                     "Failed to send telemetry event: {} - continuing execution",
                     e
                 );
+                if let Some(ref spool) = self.spool {
+                    match spool.enqueue(&self.api_endpoint, &event) {
+                        Ok(batch) => tracing::info!("Telemetry event spooled as {}", batch.id),
+                        Err(e) => tracing::warn!("Failed to spool telemetry event: {}", e),
+                    }
+                }
             }
         }
 
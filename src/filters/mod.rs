@@ -1,7 +1,11 @@
 use anyhow::Result;
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
+use serde_json::Value;
 use std::collections::HashMap;
+use std::sync::Arc;
+
+use crate::audit::{DecisionLog, DecisionRecord, DecisionSource, Verdict};
 
 pub mod event_sender;
 pub mod local_logger;
@@ -42,6 +46,8 @@ pub trait ProxyFilter: Send + Sync {
 
 pub struct FilterPipeline {
     filters: Vec<Box<dyn ProxyFilter>>,
+    /// Each filter's decision is logged here
+    decisions: Option<Arc<DecisionLog>>,
 }
 
 impl Default for FilterPipeline {
@@ -54,6 +60,7 @@ impl FilterPipeline {
     pub fn new() -> Self {
         Self {
             filters: Vec::new(),
+            decisions: None,
         }
     }
 
@@ -62,12 +69,28 @@ impl FilterPipeline {
         self
     }
 
+    pub fn with_decision_log(mut self, decisions: Arc<DecisionLog>) -> Self {
+        self.decisions = Some(decisions);
+        self
+    }
+
+    fn decided(&self, filter: &dyn ProxyFilter, action: Verdict, reason: Option<&str>) {
+        if let Some(ref decisions) = self.decisions {
+            let mut record =
+                DecisionRecord::about(&Value::Null, DecisionSource::Filter, filter.name(), action);
+            record.reason = reason.map(String::from);
+            decisions.record(record);
+        }
+    }
+
     pub async fn execute(&self, mut ctx: ProxyContext) -> Result<ProxyRequest> {
         for filter in &self.filters {
             let decision = match filter.check(&ctx).await {
                 Ok(decision) => decision,
                 Err(e) => {
                     if filter.is_blocking() {
+                        let reason = format!("the filter failed: {}", e);
+                        self.decided(filter.as_ref(), Verdict::Block, Some(&reason));
                         return Err(anyhow::anyhow!("Filter {} failed: {}", filter.name(), e));
                     } else {
                         tracing::warn!("Non-blocking filter {} failed: {}", filter.name(), e);
@@ -79,9 +102,11 @@ impl FilterPipeline {
             match decision {
                 FilterDecision::Allow => {
                     tracing::debug!("Filter {} allowed request", filter.name());
+                    self.decided(filter.as_ref(), Verdict::Allow, None);
                     continue;
                 }
                 FilterDecision::Block { reason } => {
+                    self.decided(filter.as_ref(), Verdict::Block, Some(&reason));
                     return Err(anyhow::anyhow!(
                         "Request blocked by {}: {}",
                         filter.name(),
@@ -90,6 +115,8 @@ impl FilterPipeline {
                 }
                 FilterDecision::Transform { new_request } => {
                     tracing::info!("Filter {} transformed request", filter.name());
+                    let reason = format!("server command is now {}", new_request.command);
+                    self.decided(filter.as_ref(), Verdict::Modify, Some(&reason));
                     ctx.request = new_request;
                 }
             }
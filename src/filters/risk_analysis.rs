@@ -1,13 +1,16 @@
 use super::{FilterDecision, ProxyContext, ProxyFilter};
+use crate::redaction::Redactor;
 use anyhow::{Context, Result};
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
+use std::sync::Arc;
 
 #[derive(Debug, Clone)]
 pub struct RiskAnalysisFilter {
     api_endpoint: String,
     client: reqwest::Client,
     threshold: f32,
+    redactor: Option<Arc<Redactor>>,
 }
 
 #[derive(Debug, Serialize)]
@@ -38,17 +41,28 @@ impl RiskAnalysisFilter {
     pub fn new(api_endpoint: String, threshold: f32) -> Self {
         Self {
             api_endpoint,
-            client: reqwest::Client::new(),
+            client: crate::http::client(),
             threshold,
+            redactor: None,
         }
     }
 
+    /// Scrub the analysis request with `redactor` before it is sent.
+    pub fn with_redactor(mut self, redactor: Arc<Redactor>) -> Self {
+        self.redactor = Some(redactor);
+        self
+    }
+
     async fn analyze_risk(&self, ctx: &ProxyContext) -> Result<RiskAnalysisResponse> {
         let request = RiskAnalysisRequest {
             command: ctx.request.command.clone(),
             args: ctx.request.args.clone(),
             metadata: serde_json::to_value(&ctx.request.metadata)?,
         };
+        let mut request = serde_json::to_value(&request)?;
+        if let Some(ref redactor) = self.redactor {
+            redactor.redact_value(&mut request);
+        }
 
         let response = self
             .client
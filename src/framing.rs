@@ -0,0 +1,252 @@
+use serde_json::Value;
+use std::io::{self, BufRead, Read};
+
+/// How MCP messages are delimited on a stdio stream.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum Framing {
+    /// Detect the framing of each message
+    #[default]
+    Auto,
+    /// One message per line (the MCP stdio transport)
+    Newline,
+    /// LSP-style `Content-Length` headers
+    ContentLength,
+    /// Balanced `{…}`/`[…]`, for messages spread over several lines
+    Brace,
+}
+
+/// How a particular frame was delimited, so replacements can be framed the
+/// same way.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FrameKind {
+    Line,
+    ContentLength,
+    Brace,
+}
+
+/// One framed message as read from the stream.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Frame {
+    pub kind: FrameKind,
+    /// The exact bytes read, framing included; forwarded unchanged
+    pub raw: Vec<u8>,
+    /// The message text without framing or surrounding whitespace
+    pub body: String,
+}
+
+impl Frame {
+    /// Frame `body` for writing to a stream using `kind` framing.
+    pub fn encode(kind: FrameKind, body: &str) -> Vec<u8> {
+        match kind {
+            FrameKind::ContentLength => {
+                format!("Content-Length: {}\r\n\r\n{}", body.len(), body).into_bytes()
+            }
+            FrameKind::Line | FrameKind::Brace => format!("{}\n", body).into_bytes(),
+        }
+    }
+
+    /// The same frame with a different message.
+    pub fn replace_body(&self, body: String) -> Self {
+        Self {
+            kind: self.kind,
+            raw: Self::encode(self.kind, &body),
+            body,
+        }
+    }
+
+    /// Whether the frame holds a JSON-RPC batch array.
+    pub fn is_batch(&self) -> bool {
+        self.body.starts_with('[')
+    }
+
+    /// The JSON-RPC messages in this frame: one for a plain message, each
+    /// element for a batch array, none if the body isn't JSON.
+    pub fn messages(&self) -> Vec<Value> {
+        match serde_json::from_str::<Value>(&self.body) {
+            Ok(Value::Array(batch)) => batch,
+            Ok(message) => vec![message],
+            Err(_) => Vec::new(),
+        }
+    }
+}
+
+/// Splits a byte stream into frames.
+pub struct FrameReader<R> {
+    reader: R,
+    framing: Framing,
+}
+
+impl<R: BufRead> FrameReader<R> {
+    pub fn new(reader: R, framing: Framing) -> Self {
+        Self { reader, framing }
+    }
+
+    /// The next frame, or `None` at end of stream.
+    pub fn next_frame(&mut self) -> io::Result<Option<Frame>> {
+        match self.framing {
+            Framing::Newline => self.line(Vec::new()),
+            Framing::ContentLength => self.content_length(Vec::new()),
+            Framing::Brace | Framing::Auto => {
+                let prefix = self.whitespace()?;
+                let framing = self.framing;
+                match self.peek()? {
+                    None if prefix.is_empty() => Ok(None),
+                    None => Ok(Some(frame(FrameKind::Line, prefix))),
+                    Some(b'{') | Some(b'[') => self.brace(prefix),
+                    Some(b'C') | Some(b'c') if framing == Framing::Auto => {
+                        self.content_length(prefix)
+                    }
+                    Some(_) => self.line(prefix),
+                }
+            }
+        }
+    }
+
+    fn peek(&mut self) -> io::Result<Option<u8>> {
+        Ok(self.reader.fill_buf()?.first().copied())
+    }
+
+    /// Consume whitespace between messages.
+    fn whitespace(&mut self) -> io::Result<Vec<u8>> {
+        let mut skipped = Vec::new();
+        loop {
+            let buf = self.reader.fill_buf()?;
+            if buf.is_empty() {
+                return Ok(skipped);
+            }
+            let n = buf.iter().take_while(|b| b.is_ascii_whitespace()).count();
+            skipped.extend_from_slice(&buf[..n]);
+            let done = n < buf.len();
+            self.reader.consume(n);
+            if done {
+                return Ok(skipped);
+            }
+        }
+    }
+
+    fn line(&mut self, mut raw: Vec<u8>) -> io::Result<Option<Frame>> {
+        let n = self.reader.read_until(b'\n', &mut raw)?;
+        if n == 0 && raw.is_empty() {
+            return Ok(None);
+        }
+        Ok(Some(frame(FrameKind::Line, raw)))
+    }
+
+    /// Headers up to a blank line, then exactly `Content-Length` bytes. A
+    /// header block without a usable length is passed on as plain lines.
+    fn content_length(&mut self, mut raw: Vec<u8>) -> io::Result<Option<Frame>> {
+        let start = raw.len();
+        let mut length = None;
+        loop {
+            let line_start = raw.len();
+            if self.reader.read_until(b'\n', &mut raw)? == 0 {
+                break;
+            }
+            let line = String::from_utf8_lossy(&raw[line_start..]);
+            let line = line.trim();
+            if line.is_empty() {
+                break;
+            }
+            let header = line
+                .split_once(':')
+                .map(|(name, value)| (name.trim(), value));
+            match header {
+                Some((name, value)) if name.eq_ignore_ascii_case("content-length") => {
+                    length = value.trim().parse::<usize>().ok();
+                }
+                // Output that merely looks like a header ("Connecting: …")
+                _ if line_start == start => {
+                    return Ok(Some(frame(FrameKind::Line, raw)));
+                }
+                Some(_) => {}
+                None => break,
+            }
+        }
+
+        let Some(length) = length else {
+            if raw.is_empty() {
+                return Ok(None);
+            }
+            return Ok(Some(frame(FrameKind::Line, raw)));
+        };
+
+        // A short read means the stream ended mid-message; pass on what there is
+        let headers = raw.len();
+        (&mut self.reader)
+            .take(length as u64)
+            .read_to_end(&mut raw)?;
+
+        let body = String::from_utf8_lossy(&raw[headers..]).trim().to_string();
+        Ok(Some(Frame {
+            kind: FrameKind::ContentLength,
+            raw,
+            body,
+        }))
+    }
+
+    /// A balanced JSON object or array, plus the line break after it.
+    fn brace(&mut self, mut raw: Vec<u8>) -> io::Result<Option<Frame>> {
+        let mut depth = 0usize;
+        let mut in_string = false;
+        let mut escaped = false;
+
+        'scan: loop {
+            let buf = self.reader.fill_buf()?;
+            if buf.is_empty() {
+                // Truncated message; pass on what there is
+                break;
+            }
+            for (i, &b) in buf.iter().enumerate() {
+                if in_string {
+                    match b {
+                        _ if escaped => escaped = false,
+                        b'\\' => escaped = true,
+                        b'"' => in_string = false,
+                        _ => {}
+                    }
+                    continue;
+                }
+                match b {
+                    b'"' => in_string = true,
+                    b'{' | b'[' => depth += 1,
+                    b'}' | b']' => {
+                        depth = depth.saturating_sub(1);
+                        if depth == 0 {
+                            raw.extend_from_slice(&buf[..=i]);
+                            self.reader.consume(i + 1);
+                            break 'scan;
+                        }
+                    }
+                    _ => {}
+                }
+            }
+            let n = buf.len();
+            raw.extend_from_slice(buf);
+            self.reader.consume(n);
+        }
+
+        // Keep the line ending with the message it ends
+        if self.peek()? == Some(b'\r') {
+            raw.push(b'\r');
+            self.reader.consume(1);
+        }
+        if self.peek()? == Some(b'\n') {
+            raw.push(b'\n');
+            self.reader.consume(1);
+        }
+        Ok(Some(frame(FrameKind::Brace, raw)))
+    }
+}
+
+impl<R: BufRead> Iterator for FrameReader<R> {
+    type Item = io::Result<Frame>;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        self.next_frame().transpose()
+    }
+}
+
+fn frame(kind: FrameKind, raw: Vec<u8>) -> Frame {
+    let body = String::from_utf8_lossy(&raw).trim().to_string();
+    Frame { kind, raw, body }
+}
@@ -0,0 +1,174 @@
+//! GitHub Actions output. When `km monitor` runs in a workflow, the
+//! session's findings become workflow command annotations, pointing at the
+//! file a tool call was about when it lies in the checkout, and its stats
+//! are added to the job summary.
+
+use anyhow::{Context, Result};
+use std::fmt::Write as _;
+use std::fs::OpenOptions;
+use std::io::Write as _;
+use std::path::{Path, PathBuf};
+
+use crate::ci::{CiCounts, CiSummary};
+use crate::report::{md_cell, Finding, FindingKind, SessionReport};
+use crate::sessions::format_duration;
+
+/// Findings listed in the job summary; annotations cover them all
+const SUMMARY_FINDINGS: usize = 50;
+
+/// The workflow run km is part of.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct GitHubActions {
+    /// The checkout, which annotation paths are relative to
+    pub workspace: Option<PathBuf>,
+    /// The file the job summary is appended to
+    pub step_summary: Option<PathBuf>,
+}
+
+impl GitHubActions {
+    /// `None` unless running in GitHub Actions. `env` looks up an
+    /// environment variable.
+    pub fn detect(env: impl Fn(&str) -> Option<String>) -> Option<Self> {
+        if env("GITHUB_ACTIONS").as_deref() != Some("true") {
+            return None;
+        }
+        let path = |name: &str| env(name).filter(|v| !v.is_empty()).map(PathBuf::from);
+        Some(Self {
+            workspace: path("GITHUB_WORKSPACE"),
+            step_summary: path("GITHUB_STEP_SUMMARY"),
+        })
+    }
+
+    /// `path` relative to the checkout, if it's in it.
+    fn relative(&self, path: &str) -> Option<String> {
+        let path = Path::new(path);
+        let relative = if path.is_absolute() {
+            path.strip_prefix(self.workspace.as_ref()?).ok()?
+        } else if path.starts_with("~") {
+            return None;
+        } else {
+            path.strip_prefix(".").unwrap_or(path)
+        };
+        let relative = relative.to_string_lossy().replace('\\', "/");
+        (!relative.is_empty() && !relative.split('/').any(|part| part == "..")).then_some(relative)
+    }
+
+    /// The `::warning` or `::error` workflow command for `finding`.
+    pub fn annotation(&self, finding: &Finding) -> String {
+        let title = match finding.kind {
+            FindingKind::HighRisk => "km: high-risk request",
+            FindingKind::PolicyViolation => "km: policy violation",
+        };
+        let mut properties = Vec::new();
+        if let Some(ref target) = finding.target {
+            if let Some(file) = self.relative(&target.path) {
+                properties.push(format!("file={}", escape_property(&file)));
+                if let Some(line) = target.line {
+                    properties.push(format!("line={}", line));
+                }
+            }
+        }
+        properties.push(format!("title={}", escape_property(title)));
+        format!(
+            "::{} {}::{}",
+            finding.level(),
+            properties.join(","),
+            escape_data(&finding.message)
+        )
+    }
+
+    /// Print the report's annotations to stderr, where the runner picks them
+    /// up without getting in the way of the MCP traffic on stdout, and append
+    /// the job summary.
+    pub fn publish(&self, report: &SessionReport, ci: Option<&CiSummary>) -> Result<()> {
+        for finding in &report.findings {
+            eprintln!("{}", self.annotation(finding));
+        }
+        let Some(ref path) = self.step_summary else {
+            return Ok(());
+        };
+        let mut file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .with_context(|| format!("Failed to open the job summary {:?}", path))?;
+        file.write_all(job_summary(report, ci).as_bytes())
+            .with_context(|| format!("Failed to write the job summary {:?}", path))
+    }
+}
+
+/// Escape workflow command data.
+fn escape_data(value: &str) -> String {
+    value
+        .replace('%', "%25")
+        .replace('\r', "%0D")
+        .replace('\n', "%0A")
+}
+
+/// Escape a workflow command property, which also ends at `,` and `:`.
+fn escape_property(value: &str) -> String {
+    escape_data(value).replace(':', "%3A").replace(',', "%2C")
+}
+
+/// The session's stats, its `--ci` result and its findings as Markdown for
+/// the job summary.
+pub fn job_summary(report: &SessionReport, ci: Option<&CiSummary>) -> String {
+    let session = &report.session;
+    let counts = CiCounts::of_report(report);
+    let mut out = String::new();
+    let _ = writeln!(out, "### km session `{}`\n", session.id);
+    out.push_str("| | |\n|---|---|\n");
+    let mut rows = vec![
+        (
+            "Server",
+            session.server.clone().unwrap_or_else(|| "-".into()),
+        ),
+        ("Duration", format_duration(session.duration_secs())),
+        ("Messages", session.messages.to_string()),
+        ("Requests", counts.requests.to_string()),
+        ("Errors", counts.errors.to_string()),
+        ("High-risk requests", counts.high_risk.to_string()),
+        ("Critical-risk requests", counts.critical_risk.to_string()),
+        ("Policy violations", counts.policy_violations.to_string()),
+    ];
+    if let Some(ci) = ci {
+        let result = match ci.passed {
+            true => "✅ passed".to_string(),
+            false => format!("❌ {}", ci.reached()),
+        };
+        rows.push(("CI thresholds", result));
+    }
+    for (name, value) in rows {
+        let _ = writeln!(out, "| **{}** | {} |", name, md_cell(&value));
+    }
+
+    if !report.findings.is_empty() {
+        out.push_str("\n| Time | Finding | Tool | Message |\n|---|---|---|---|\n");
+        for finding in report.findings.iter().take(SUMMARY_FINDINGS) {
+            let _ = writeln!(
+                out,
+                "| {} | {} | {} | {} |",
+                finding.timestamp.format("%H:%M:%S"),
+                finding.kind.rule_id(),
+                md_cell(
+                    finding
+                        .tool
+                        .as_deref()
+                        .or(finding.method.as_deref())
+                        .unwrap_or("-")
+                ),
+                md_cell(&finding.message)
+            );
+        }
+        if report.findings.len() > SUMMARY_FINDINGS {
+            let _ = writeln!(
+                out,
+                "\n_{} more findings; `km report {} --format sarif` lists them all._",
+                report.findings.len() - SUMMARY_FINDINGS,
+                session.id
+            );
+        }
+    }
+    out.push('\n');
+    out
+}
@@ -1,16 +1,113 @@
 use anyhow::{Context, Result};
+use clap::{CommandFactory, ValueEnum};
+use std::collections::HashSet;
 use std::fs;
 use std::path::{Path, PathBuf};
+use std::sync::atomic::Ordering;
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::Duration;
 
+use crate::alerts::Alerter;
+use crate::anonymize::Anonymizer;
+use crate::approval::{self, ApprovalGate};
+use crate::audit::{self, DecisionLog};
 use crate::auth::{self, AuthClient, JwtToken};
-use crate::config::Config;
+use crate::breaker::{self, CircuitBreaker};
+use crate::build_info;
+use crate::bundle::Bundle;
+use crate::capabilities::Capabilities;
+use crate::ci::{CiCounts, CiSummary};
+use crate::cli::{
+    AuditCommands, Cli, ConfigCommands, CtlCommands, ExportOptions, IntegrateArgs, MonitorOptions,
+    PluginCommands, PluginDevCommands, PolicyCommands, PresetsCommands, RulesCommands,
+    SessionsCommands, StorageCommands, TelemetryCommands, ToolsCommands,
+};
+use crate::clients;
+use crate::clock;
+use crate::completion::{self, Shell, ValueKind};
+use crate::config::{self, Config, CONFIG_KEYS};
+use crate::config_schema;
+use crate::config_watcher::ConfigWatcher;
+use crate::container::{self, DockerRun};
+use crate::control::{self, ControlClient, ControlRequest, ControlServer, MonitorControl};
+use crate::costs::CostTracker;
+use crate::credentials;
+use crate::dashboard;
+use crate::dedup::Deduper;
 use crate::device_auth::DeviceAuthClient;
+use crate::diff::{self, SessionProfile};
+use crate::doctor::{self, Status};
+use crate::encryption::{self, PayloadCipher};
+use crate::entitlements::{self, Entitlements};
+use crate::errors::{Code, KmError};
+use crate::export::{self, ExportFilter, ExportFormat};
 use crate::filters::event_sender::EventSenderFilter;
 use crate::filters::local_logger::LocalLoggerFilter;
 use crate::filters::risk_analysis::RiskAnalysisFilter;
 use crate::filters::{FilterPipeline, ProxyContext, ProxyRequest};
+use crate::github::GitHubActions;
+use crate::i18n;
+use crate::idempotency::SentBatches;
+use crate::inspect::{self, Inspector};
+use crate::inventory::{self, InventoryTracker};
+use crate::journal::{self, Journal, JournalStart};
+use crate::keepalive;
 use crate::keyring_token_store::KeyringTokenStore;
-use crate::proxy;
+use crate::latency::{self, ApiLatency};
+use crate::launcher::{self, Launcher};
+use crate::logging;
+use crate::manpage;
+use crate::merge::{self, MergeOptions};
+use crate::metrics::{MetricsServer, MetricsSource};
+use crate::mock::MockServer;
+use crate::offline;
+use crate::opa::{self, OpaPolicy};
+use crate::otel::{OtlpConfig, SpanExporter};
+use crate::payloads::{
+    BlobStore, PayloadConfig, PayloadShaper, S3Credentials, S3Uploader, DEFAULT_BLOB_REGION,
+};
+use crate::plugins::dev::{self, DevManifest, Template};
+use crate::plugins::health::{self, FailurePolicy};
+use crate::plugins::marketplace::{MarketplaceClient, PluginManifest, PluginRelease};
+use crate::plugins::runtime::{sort_by_priority, PluginAction, PluginHost};
+use crate::plugins::store::PluginStore;
+use crate::plugins::verify::{self, Trust, TrustedKeys};
+use crate::plugins::{self, compare_versions};
+use crate::policy::{Decision, Policy, PolicyMode};
+use crate::presets::{self, CapturePreset};
+use crate::probe::{self, ProbeOptions};
+use crate::process;
+use crate::proxy::{self, CaptureSettings, ProxyOptions};
+use crate::queue::{self, QueueStats};
+use crate::rate_limit::RateLimiter;
+use crate::redaction::Redactor;
+use crate::remote_config;
+use crate::replay::{self, ReplayChecks, ReplayOutcome, ReplayStep, ReplaySummary};
+use crate::report::{self, ReportFormat, SessionReport};
+use crate::retention::{self, Janitor};
+use crate::risk::heuristic::HeuristicRiskAnalyzer;
+use crate::risk::provider::{RiskAnalyzer, RiskEngine};
+use crate::risk::remote::RemoteRiskAnalyzer;
+use crate::risk::rules::{self, InstalledPack, RuleStore};
+use crate::risk::{PatternRiskAnalyzer, RiskLevel};
+use crate::sampling::Sampler;
+use crate::search;
+use crate::server_env::ServerEnv;
+use crate::sessions;
+use crate::sinks::Sinks;
+use crate::spool::Spool;
+use crate::tail::{self, TailPrinter, TailServer};
+use crate::telemetry::{self, Telemetry};
+use crate::traffic;
+use crate::update::{self, LatestCheck, Updater};
+use crate::uploader::{BatchSettings, DrainReport, EventUploader, McpEvent, SessionEnd};
+
+const SPOOL_UPLOAD_INTERVAL: Duration = Duration::from_secs(30);
+/// How long uploads may drain after the server exits (`--shutdown-timeout`)
+const DEFAULT_SHUTDOWN_TIMEOUT: Duration = Duration::from_secs(10);
+const CONFIG_POLL_INTERVAL: Duration = Duration::from_secs(2);
+/// How long `km version` waits to learn the latest release
+const VERSION_CHECK_TIMEOUT: Duration = Duration::from_secs(3);
 
 pub async fn handle_init(
     config_path: &PathBuf,
@@ -19,12 +116,7 @@ pub async fn handle_init(
 ) -> Result<()> {
     if Config::exists(config_path) {
         println!("Configuration already exists at {:?}", config_path);
-        print!("Overwrite? (y/N): ");
-        std::io::Write::flush(&mut std::io::stdout())?;
-
-        let mut input = String::new();
-        std::io::stdin().read_line(&mut input)?;
-        if !input.trim().eq_ignore_ascii_case("y") {
+        if !confirm("Overwrite?") {
             println!("Cancelled.");
             return Ok(());
         }
@@ -60,92 +152,17 @@ pub async fn handle_init(
 
     if should_try_device_flow {
         println!("No valid login found. Starting device sign-in...");
-        let dac = DeviceAuthClient::new(api_url.clone());
-        if let Ok(start) = dac.start().await {
-            println!("\nOpen to sign in: {}", start.verification_uri_complete);
-            println!(
-                "Or visit {} and enter code: {}\n",
-                start.verification_uri, start.user_code
-            );
-            println!("Device Code (DEBUG): {}", start.device_code);
-
-            // Best-effort browser open
-            #[cfg(target_os = "macos")]
-            let _ = std::process::Command::new("open")
-                .arg(&start.verification_uri_complete)
-                .status();
-            #[cfg(target_os = "windows")]
-            let _ = std::process::Command::new("cmd")
-                .args(["/C", "start", &start.verification_uri_complete])
-                .status();
-            #[cfg(target_os = "linux")]
-            let _ = std::process::Command::new("xdg-open")
-                .arg(&start.verification_uri_complete)
-                .status();
-
-            let deadline =
-                std::time::Instant::now() + std::time::Duration::from_secs(start.expires_in + 10);
-            let mut interval = std::time::Duration::from_secs(start.interval.max(5));
-            loop {
-                if std::time::Instant::now() > deadline {
-                    println!("Device code expired. Falling back to API key auth.");
-                    break;
-                }
-
-                match dac.poll(&start.device_code).await {
-                    Ok(Ok(success)) => {
-                        println!("✓ Sign-in approved");
-                        // Build JwtToken
-                        let claims =
-                            auth::AuthClient::parse_jwt_claims(&success.token.access_token)
-                                .unwrap_or_default();
-                        let now = std::time::SystemTime::now()
-                            .duration_since(std::time::UNIX_EPOCH)
-                            .unwrap()
-                            .as_secs();
-                        let jwt = JwtToken {
-                            token: success.token.access_token.clone(),
-                            expires_at: now + 3600, // dashboard returns RFC3339; we use 1h default if parsing not implemented here
-                            claims,
-                            refresh_token: None,
-                        };
-                        if let Ok(store) = KeyringTokenStore::new() {
-                            let _ = store.save_tokens(&jwt, None);
-                        }
-                        // Save config with empty API key (we're using JWT tokens now)
-                        let cfg = Config::new(String::new(), api_url.clone());
-                        cfg.save(config_path)?;
-                        println!("✓ Configuration saved to {:?}", config_path);
-                        return Ok(());
-                    }
-                    Ok(Err(err)) => match err.as_str() {
-                        "authorization_pending" => {
-                            tokio::time::sleep(interval).await;
-                        }
-                        "slow_down" => {
-                            interval += std::time::Duration::from_secs(5);
-                            tokio::time::sleep(interval).await;
-                        }
-                        "expired_token" | "access_denied" => {
-                            println!(
-                                "{}",
-                                if err == "expired_token" {
-                                    "Device code expired"
-                                } else {
-                                    "Access denied"
-                                }
-                            );
-                            break;
-                        }
-                        _ => {
-                            tokio::time::sleep(interval).await;
-                        }
-                    },
-                    Err(_) => {
-                        tokio::time::sleep(interval).await;
-                    }
-                }
+        match device_sign_in(&api_url, true).await {
+            Ok(jwt) => {
+                println!("✓ Sign-in approved");
+                save_login(&jwt)?;
+                // Save config with empty API key (we're using JWT tokens now)
+                save_account(config_path, "", &api_url)?;
+                println!("✓ Configuration saved to {:?}", config_path);
+                offer_client_setup(config_path);
+                return Ok(());
             }
+            Err(e) => println!("{}. Falling back to API key auth.", e),
         }
     }
 
@@ -226,9 +243,10 @@ pub async fn handle_init(
                 }
             }
 
-            // Save config only after successful authentication
-            let config = Config::new(api_key, api_url);
-            config.save(config_path)?;
+            // Save config only after successful authentication; the API key
+            // itself goes to the credential store
+            let backend = save_account(config_path, &api_key, &api_url)?;
+            println!("✓ API key stored in the {}", backend);
             println!("✓ Configuration saved to {:?}", config_path);
 
             // Display user info if available
@@ -239,6 +257,7 @@ pub async fn handle_init(
                 println!("✓ User tier: {}", tier);
             }
 
+            offer_client_setup(config_path);
             Ok(())
         }
         Err(e) => {
@@ -247,14 +266,421 @@ pub async fn handle_init(
             println!("  • Your API key is correct");
             println!("  • You have network connectivity");
             println!("  • The API URL is correct: {}", api_url);
-            Err(anyhow::anyhow!(
-                "Failed to authenticate with provided API key"
-            ))
+            Err(e.context("Failed to authenticate with provided API key"))
+        }
+    }
+}
+
+fn confirm(question: &str) -> bool {
+    print!("{} (y/N): ", question);
+    std::io::Write::flush(&mut std::io::stdout()).ok();
+    let mut input = String::new();
+    std::io::stdin().read_line(&mut input).ok();
+    input.trim().eq_ignore_ascii_case("y")
+}
+
+/// Last step of an interactive `km init`: find installed MCP clients and
+/// offer to route their servers through `km monitor`. Failures here are
+/// reported but don't undo the setup that already succeeded.
+fn offer_client_setup(config_path: &Path) {
+    use std::io::IsTerminal;
+    if !std::io::stdin().is_terminal() || crate::keyring_token_store::is_ci_environment() {
+        return;
+    }
+    if let Err(e) = client_setup(config_path) {
+        println!("⚠ Could not set up MCP clients: {:#}", e);
+    }
+}
+
+fn client_setup(config_path: &Path) -> Result<()> {
+    let found = clients::detect_default()?;
+    if found.is_empty() {
+        println!(
+            "\nNo Claude Desktop, Cursor or VS Code config found. Wrap a server by hand with:"
+        );
+        println!("  km monitor -- <server command> [args...]");
+        return Ok(());
+    }
+
+    let km = clients::KmCommand::current(config_path)?;
+    for client in found {
+        let mut config = clients::McpConfig::load(&client.path)?;
+        let pending: Vec<String> = config
+            .server_names()
+            .into_iter()
+            .filter(|(_, wrapped)| !wrapped)
+            .map(|(name, _)| name)
+            .collect();
+        if pending.is_empty() {
+            continue;
+        }
+        println!(
+            "\nFound {} servers in {} ({}): {}",
+            client.kind,
+            client.path.display(),
+            pending.len(),
+            pending.join(", ")
+        );
+        if !confirm("Route them through km monitor?") {
+            continue;
+        }
+        config.wrap(&km, None);
+        let backup = config.save(&client.path)?;
+        println!(
+            "✓ Updated {} (previous version saved to {})",
+            client.path.display(),
+            backup.display()
+        );
+        println!("  Restart {} to pick up the change", client.kind);
+    }
+    Ok(())
+}
+
+/// `km integrate` (`wrap`) and `km unintegrate`: edit one client's config
+/// file, or with `--dry-run` show what would change.
+pub fn handle_integrate(config_path: &Path, target: IntegrateArgs, wrap: bool) -> Result<()> {
+    let path = match target.file {
+        Some(path) => path,
+        None => {
+            let (home, cwd) = clients::default_dirs()?;
+            target.client.find_config(&home, &cwd)?
+        }
+    };
+    let mut config = clients::McpConfig::load(&path)?;
+    if let Some(ref server) = target.server {
+        if !config.has_server(server) {
+            return Err(anyhow::anyhow!(
+                "{} has no server named '{}'",
+                path.display(),
+                server
+            ));
+        }
+    }
+
+    let before = config.to_pretty();
+    let changed = if wrap {
+        if !config_path.exists() {
+            println!(
+                "⚠ {:?} doesn't exist yet; run `km init` before starting the client",
+                config_path
+            );
+        }
+        config.wrap(
+            &clients::KmCommand::current(config_path)?,
+            target.server.as_deref(),
+        )
+    } else {
+        config.unwrap(target.server.as_deref())
+    };
+
+    if changed.is_empty() {
+        println!(
+            "Nothing to change in {}: {}",
+            path.display(),
+            if wrap {
+                "every server already runs through km"
+            } else {
+                "no server runs through km"
+            }
+        );
+        return Ok(());
+    }
+
+    if target.dry_run {
+        println!("Would change {}:\n", path.display());
+        print!("{}", clients::diff(&before, &config.to_pretty()));
+        return Ok(());
+    }
+
+    let backup = config.save(&path)?;
+    println!(
+        "✓ {} {} in {}",
+        if wrap { "Wrapped" } else { "Unwrapped" },
+        changed.join(", "),
+        path.display()
+    );
+    println!("  Previous version saved to {}", backup.display());
+    println!("  Restart {} to pick up the change", target.client);
+    Ok(())
+}
+
+/// Sign in through the device-code flow, printing where to approve it and
+/// opening the browser there when `open_browser` is set.
+async fn device_sign_in(api_url: &str, open_browser: bool) -> Result<JwtToken> {
+    DeviceAuthClient::new(api_url.to_string())
+        .login(|start| {
+            println!("\nOpen to sign in: {}", start.verification_uri_complete);
+            println!(
+                "Or visit {} and enter code: {}\n",
+                start.verification_uri, start.user_code
+            );
+            println!("Waiting for approval...");
+
+            if !open_browser {
+                return;
+            }
+            // Best-effort browser open
+            #[cfg(target_os = "macos")]
+            let _ = std::process::Command::new("open")
+                .arg(&start.verification_uri_complete)
+                .status();
+            #[cfg(target_os = "windows")]
+            let _ = std::process::Command::new("cmd")
+                .args(["/C", "start", &start.verification_uri_complete])
+                .status();
+            #[cfg(target_os = "linux")]
+            let _ = std::process::Command::new("xdg-open")
+                .arg(&start.verification_uri_complete)
+                .status();
+        })
+        .await
+}
+
+/// Save what `km init` and `km login` set up: a fresh config file, or with
+/// a profile selected, that profile's section of the existing one. Returns
+/// where the API key was stored.
+fn save_account(config_path: &Path, api_key: &str, api_url: &str) -> Result<&'static str> {
+    let store = credentials::open(config_path)?;
+    match config::active_profile() {
+        None => {
+            let mut config = Config::new(api_key.to_string(), api_url.to_string());
+            // Starting over at the top level shouldn't lose the profiles
+            if let Ok(existing) = Config::load(config_path) {
+                config.profiles = existing.profiles;
+            }
+            credentials::save_config(&mut config, config_path, store.as_ref())?;
+        }
+        Some(profile) => {
+            let mut config = if config_path.exists() {
+                Config::load(config_path)?
+            } else {
+                Config::new(String::new(), api_url.to_string())
+            };
+            config.set_in_profile(&profile, "api_url", api_url)?;
+            if !api_key.is_empty() {
+                store.set(
+                    &credentials::api_key_name(config_path, Some(&profile)),
+                    api_key,
+                )?;
+            }
+            config.save(config_path)?;
+        }
+    }
+    Ok(store.backend())
+}
+
+/// Store a signed-in session's tokens in the keyring.
+fn save_login(jwt: &JwtToken) -> Result<()> {
+    KeyringTokenStore::new()?
+        .save_tokens(jwt, jwt.refresh_token.as_deref())
+        .context("Failed to store tokens in keyring")
+}
+
+pub async fn handle_login(config_path: &Path, api_url: String, no_browser: bool) -> Result<()> {
+    let existing = Config::load_with_env(config_path).ok();
+    let api_url = std::env::var("KM_API_URL").unwrap_or_else(|_| {
+        existing
+            .as_ref()
+            .map(|c| c.api_url.clone())
+            .unwrap_or(api_url)
+    });
+
+    println!("Signing in to {}...", api_url);
+    let jwt = device_sign_in(&api_url, !no_browser).await.map_err(|e| {
+        println!("✗ Sign-in failed: {:#}", e);
+        e
+    })?;
+    println!("✓ Sign-in approved");
+
+    save_login(&jwt)?;
+    println!("✓ Tokens stored securely in keyring");
+    if jwt.refresh_token.is_none() {
+        println!("⚠ No refresh token was issued; run 'km login' again when the session expires");
+    }
+
+    // The gateway reads the API URL from the config file
+    if existing.is_none() {
+        save_account(config_path, "", &api_url)?;
+        println!("✓ Configuration saved to {:?}", config_path);
+    }
+
+    if let Some(user_id) = &jwt.claims.user_id {
+        println!("✓ Authenticated as user: {}", user_id);
+    }
+    Ok(())
+}
+
+pub async fn handle_logout(config_path: &Path) -> Result<()> {
+    let store = KeyringTokenStore::new()?;
+    if !store.token_exists() {
+        println!("Not logged in");
+        return Ok(());
+    }
+
+    // Revoke the refresh token first: it's the one that outlives the session
+    let api_url = Config::load_with_env(config_path)
+        .map(|c| c.api_url)
+        .unwrap_or_else(|_| "https://api.kilometers.ai".to_string());
+    let client = DeviceAuthClient::new(api_url);
+    let refresh_token = store.load_refresh_token().ok().flatten();
+    let access_token = store.load_access_token().ok().map(|t| t.token);
+    for token in refresh_token.iter().chain(access_token.iter()) {
+        if let Err(e) = client.revoke(token).await {
+            println!("⚠ Could not revoke token: {:#}", e);
+        }
+    }
+
+    store.clear_tokens()?;
+    println!("✓ Logged out; tokens removed from keyring");
+    Ok(())
+}
+
+/// The release feed `km update` reads: `KM_UPDATE_URL`, `update_url` or
+/// GitHub.
+fn updater(settings: &Config) -> Result<Updater> {
+    let url = std::env::var("KM_UPDATE_URL")
+        .ok()
+        .filter(|u| !u.is_empty())
+        .or_else(|| settings.update_url.clone())
+        .unwrap_or_else(|| update::DEFAULT_UPDATE_URL.to_string());
+    let keys = TrustedKeys::from_config(&settings.update_trusted_keys)
+        .context("Invalid update_trusted_keys")?;
+    Ok(Updater::new(url, keys))
+}
+
+/// The newest km on `channel` as last checked. Without an `updater` only
+/// the saved check is read; with one, a check older than a day is
+/// repeated. Failures only cost the notice.
+async fn latest_release(
+    updater: Option<&Updater>,
+    channel: update::Channel,
+) -> Option<LatestCheck> {
+    let path = update::check_path().ok()?;
+    let saved = update::load_check(&path, channel);
+    let Some(updater) = updater else {
+        return saved;
+    };
+    if saved
+        .as_ref()
+        .is_some_and(|check| check.is_fresh(chrono::Utc::now()))
+    {
+        return saved;
+    }
+    match tokio::time::timeout(VERSION_CHECK_TIMEOUT, updater.latest(channel)).await {
+        Ok(Ok(Some(release))) => {
+            let check = LatestCheck::new(channel, release.version);
+            if let Err(e) = update::save_check(&path, &check) {
+                tracing::debug!("{:#}", e);
+            }
+            Some(check)
+        }
+        Ok(Ok(None)) => saved,
+        Ok(Err(e)) => {
+            tracing::debug!("Could not check for a newer km: {:#}", e);
+            saved
+        }
+        Err(_) => {
+            tracing::debug!("Timed out checking for a newer km");
+            saved
+        }
+    }
+}
+
+/// `km version`: what this km was built from, and whether a newer release
+/// is out.
+pub async fn handle_version(config_path: &Path, json: bool) -> Result<()> {
+    let settings = Config::load_with_env(config_path).unwrap_or_default();
+    let channel = settings.update_channel;
+    let latest = match updater(&settings) {
+        // Offline, only the last check is shown
+        Ok(_) if offline::enabled() => latest_release(None, channel).await,
+        Ok(updater) => latest_release(Some(&updater), channel).await,
+        Err(e) => {
+            tracing::debug!("{:#}", e);
+            None
+        }
+    };
+    let newer = latest
+        .as_ref()
+        .and_then(|check| check.newer_than(build_info::VERSION));
+    let info = build_info::info();
+
+    if json {
+        let mut value = serde_json::to_value(&info)?;
+        value["channel"] = serde_json::json!(channel);
+        value["latest"] = serde_json::json!(latest.as_ref().map(|check| &check.latest));
+        value["update_available"] = serde_json::json!(newer.is_some());
+        println!("{}", serde_json::to_string_pretty(&value)?);
+        return Ok(());
+    }
+
+    println!("km {}", info.version);
+    println!("  Commit:   {}", info.commit);
+    println!("  Built:    {}", info.build_date);
+    println!("  Rust:     {}", info.rustc);
+    println!("  Target:   {}", info.target);
+    if let Some(newer) = newer {
+        println!(
+            "⚠ km {} is available on the {} channel. Run `km update` to install it",
+            newer, channel
+        );
+    }
+    Ok(())
+}
+
+pub async fn handle_update(
+    config_path: &Path,
+    check: bool,
+    channel: Option<update::Channel>,
+) -> Result<()> {
+    let settings = Config::load_with_env(config_path).unwrap_or_default();
+    let channel = channel.unwrap_or(settings.update_channel);
+    let updater = updater(&settings)?;
+
+    let current = build_info::VERSION;
+    let release = updater
+        .latest(channel)
+        .await?
+        .ok_or_else(|| anyhow::anyhow!("No {} releases of km were found", channel))?;
+    if let Ok(path) = update::check_path() {
+        let check = LatestCheck::new(channel, release.version.clone());
+        if let Err(e) = update::save_check(&path, &check) {
+            tracing::debug!("{:#}", e);
         }
     }
+    if !update::is_newer(&release.version, current) {
+        println!("km {} is up to date ({} channel).", current, channel);
+        return Ok(());
+    }
+    if check {
+        return Err(anyhow::anyhow!(
+            "km {} is available on the {} channel (installed: {}). Run `km update` to install it",
+            release.version,
+            channel,
+            current
+        ));
+    }
+
+    let asset_name = update::asset_name()
+        .ok_or_else(|| anyhow::anyhow!("There is no prebuilt km for this platform"))?;
+    let asset = release.asset(&asset_name).ok_or_else(|| {
+        anyhow::anyhow!("km {} has no download for {}", release.version, asset_name)
+    })?;
+    println!("Downloading km {}...", release.version);
+    let archive = updater.download(&release, asset).await?;
+    let binary = update::extract_binary(&asset.name, &archive)?;
+    let exe = std::env::current_exe().context("Failed to find the running km executable")?;
+    update::replace_executable(&exe, &binary)?;
+
+    println!("✓ Updated km {} → {}", current, release.version);
+    Ok(())
 }
 
 pub async fn get_jwt_token_with_cache(api_key: String, api_url: String) -> Option<JwtToken> {
+    if offline::enabled() {
+        tracing::debug!("Offline mode - not signing in");
+        return None;
+    }
     let token_store = match KeyringTokenStore::new() {
         Ok(store) => store,
         Err(e) => {
@@ -269,6 +695,26 @@ pub async fn get_jwt_token_with_cache(api_key: String, api_url: String) -> Optio
             if !auth::AuthClient::is_token_expired(&cached_token) {
                 tracing::debug!("Using cached JWT token from keyring");
                 return Some(cached_token);
+            } else if let Some(refresh_token) = cached_token
+                .refresh_token
+                .clone()
+                .or_else(|| token_store.load_refresh_token().ok().flatten())
+            {
+                tracing::debug!("Cached token expired, refreshing it");
+                match DeviceAuthClient::new(api_url.clone())
+                    .refresh(&refresh_token)
+                    .await
+                {
+                    Ok(fresh) => {
+                        if let Err(e) =
+                            token_store.save_tokens(&fresh, fresh.refresh_token.as_deref())
+                        {
+                            tracing::warn!("Failed to save refreshed token to keyring: {}", e);
+                        }
+                        return Some(fresh);
+                    }
+                    Err(e) => tracing::debug!("Token refresh failed: {:#}", e),
+                }
             } else {
                 tracing::debug!("Cached token expired, fetching new token");
             }
@@ -279,6 +725,12 @@ pub async fn get_jwt_token_with_cache(api_key: String, api_url: String) -> Optio
         tracing::debug!("No token found in keyring, fetching new token");
     }
 
+    // Signed in with `km login` only: there is no API key to fall back on
+    if api_key.is_empty() {
+        tracing::warn!("Login session expired - run 'km login' to sign in again");
+        return None;
+    }
+
     // Exchange for new token
     let auth_client = auth::AuthClient::new(api_key, api_url);
     match auth_client.exchange_for_jwt().await {
@@ -305,6 +757,8 @@ pub async fn get_jwt_token_with_cache(api_key: String, api_url: String) -> Optio
     }
 }
 
+/// `handle_monitor_with_options` with every optional feature left at its default
+#[allow(dead_code)]
 pub async fn handle_monitor(
     config_path: &Path,
     args: Vec<String>,
@@ -312,25 +766,78 @@ pub async fn handle_monitor(
     override_tier: Option<String>,
     log_file: PathBuf,
 ) -> Result<()> {
-    if args.is_empty() {
+    handle_monitor_with_options(
+        config_path,
+        args,
+        local_only,
+        override_tier,
+        log_file,
+        MonitorOptions::default(),
+    )
+    .await
+}
+
+pub async fn handle_monitor_with_options(
+    config_path: &Path,
+    args: Vec<String>,
+    local_only: bool,
+    override_tier: Option<String>,
+    log_file: PathBuf,
+    options: MonitorOptions,
+) -> Result<()> {
+    if args.is_empty() && options.docker.is_none() {
         return Err(anyhow::anyhow!("No command provided to proxy"));
     }
+    if options.docker.is_some() {
+        container::check_available()?;
+    }
+    // Air-gapped, a session captures locally as with --local-only
+    let offline = offline::enabled();
+    let local_only = local_only || offline;
 
-    let program = args[0].clone();
-    let program_args = args[1..].to_vec();
-
-    tracing::info!("Proxying command: {} {:?}", program, program_args);
+    // The team's remote layer is refreshed before the settings are read, so
+    // a changed policy applies to this session; offline, the cached copy does
+    if !local_only {
+        match refresh_remote_config(config_path, false).await {
+            Ok(Some(layer)) => tracing::info!("Fetched the remote config from {}", layer.source),
+            Ok(None) => {}
+            Err(e) => tracing::warn!("Using the cached remote config: {:#}", e),
+        }
+    }
 
     // Load config with environment variable support, but gracefully handle missing config
     let default_api_url = "https://api.kilometers.ai".to_string();
+    let mut settings = Config::default();
+    let mut capabilities = Capabilities::default();
+    // Only set when signing in was tried and didn't work
+    let mut auth_failed = false;
     let (jwt_token_option, api_url) = if local_only {
-        tracing::info!("Running in local-only mode - skipping authentication");
+        if offline {
+            tracing::info!("Offline mode - skipping authentication");
+        } else {
+            tracing::info!("Running in local-only mode (--local-only) - skipping authentication");
+        }
+        // Capture settings still apply without cloud features
+        if let Ok(config) = Config::load_with_env(config_path) {
+            settings = config;
+        }
         (None, default_api_url)
     } else {
         match Config::load_with_env(config_path) {
             Ok(config) => {
-                let (api_key, api_url) = (config.api_key, config.api_url.clone());
-                let token = get_jwt_token_with_cache(api_key, api_url.clone()).await;
+                let mut api_url = config.api_url.clone();
+                // Fail before starting the server rather than upload in a
+                // format the API can't read
+                if !config.api_key.is_empty() {
+                    capabilities = Capabilities::detect(&api_url).await?;
+                    if let Some(ref advertised) = capabilities.api_url {
+                        tracing::info!("{} serves the API from {}", api_url, advertised);
+                        api_url = advertised.clone();
+                    }
+                }
+                let token = get_jwt_token_with_cache(config.api_key.clone(), api_url.clone()).await;
+                auth_failed = token.is_none();
+                settings = config;
                 (token, api_url)
             }
             Err(e) => {
@@ -340,18 +847,147 @@ pub async fn handle_monitor(
             }
         }
     };
+    if !capabilities.risk_scoring && settings.risk_providers.iter().any(|p| p == "remote") {
+        tracing::info!("The API doesn't offer risk scoring; skipping the remote provider");
+        settings.risk_providers.retain(|p| p != "remote");
+    }
 
-    let (user_tier, jwt_token) = if let Some(token) = jwt_token_option {
-        let tier = override_tier
-            .as_deref()
-            .or(token.claims.tier.as_deref())
-            .unwrap_or("free");
-        tracing::info!("User tier: {}", tier);
-        (tier.to_string(), Some(token))
+    // An outdated km is warned about from the last check, which is repeated
+    // in the background when it's over a day old
+    if !local_only {
+        let channel = settings.update_channel;
+        let newer = latest_release(None, channel)
+            .await
+            .and_then(|check| check.newer_than(build_info::VERSION).map(String::from));
+        if let Some(newer) = newer {
+            tracing::warn!(
+                "km {} is available (running {}); run `km update` to install it",
+                newer,
+                build_info::VERSION
+            );
+        }
+        if let Ok(updater) = updater(&settings) {
+            tokio::spawn(async move {
+                latest_release(Some(&updater), channel).await;
+            });
+        }
+    }
+
+    // A preset replaces the capture settings of the config file
+    let preset = options
+        .preset
+        .as_deref()
+        .map(|name| presets::find(&settings.presets, name))
+        .transpose()?;
+    if let Some(ref name) = options.preset {
+        tracing::info!("Capture preset: {}", name);
+    }
+
+    // How far this machine's clock is off, asked while the session starts up
+    let clock_offset = (settings.clock.ntp && !offline).then(|| {
+        let server = settings.clock.ntp_server.clone();
+        tokio::task::spawn_blocking(move || clock::query(&server, clock::NTP_TIMEOUT))
+    });
+
+    // The server's own secrets come from env files; km's stay with km
+    let mut server_env = ServerEnv::resolve(&settings.server_env, &options.env_files)
+        .context("Failed to prepare the server's environment")?;
+    // `${VAR}` in the command is filled in from the server's environment, so
+    // client configs can refer to secrets kept in env files
+    let expand = |args: &[String]| {
+        args.iter()
+            .map(|arg| launcher::expand(arg, |name| server_env.get(name)))
+            .collect::<Result<Vec<_>>>()
+            .context("Failed to fill in the server command")
+    };
+    let args = expand(&args)?;
+    let docker_args = expand(&options.docker_args)?;
+    // Chosen up front so the container and the upload journal can be named after it
+    let session_id = uuid::Uuid::new_v4().to_string();
+    let docker = options.docker.as_ref().map(|image| {
+        let mut run = DockerRun::new(image, &session_id, args.clone());
+        run.docker_args = docker_args;
+        run.env = server_env.from_files().to_vec();
+        run.labels = options.labels.iter().cloned().collect();
+        run
+    });
+    let (program, program_args) = match docker {
+        Some(ref run) => {
+            tracing::info!("Running {} in container {}", run.image, run.name);
+            (container::DOCKER.to_string(), run.command())
+        }
+        None => (args[0].clone(), args[1..].to_vec()),
+    };
+    let launcher = match docker {
+        Some(_) => None,
+        None => Launcher::detect(&program, &program_args),
+    };
+    if let Some(launcher) = launcher {
+        tracing::info!(
+            "Starting the server through {}; its output before the first MCP message goes to stderr",
+            launcher.name()
+        );
+        for (name, value) in launcher.env() {
+            server_env.set_default(name, value);
+        }
+    }
+    let server_env = Arc::new(server_env);
+    tracing::info!(
+        "Proxying command: {} {:?}",
+        program,
+        server_env.scrub(&program_args)
+    );
+    tracing::info!("Server environment: {}", server_env.describe());
+    if !server_env.withheld().is_empty() {
+        tracing::debug!(
+            "Withheld from the server: {}",
+            server_env.withheld().join(", ")
+        );
+    }
+
+    // Redaction applies to everything sent to the API; --redact turns it on
+    // even when the config file doesn't
+    let redactor = if options.redact || settings.redaction.enabled {
+        let redactor = Redactor::from_config(&settings.redaction)
+            .context("Invalid redaction configuration")?;
+        tracing::info!("Payload redaction enabled");
+        Some(Arc::new(redactor))
     } else {
-        tracing::info!("Authentication failed - running in local-only mode");
-        ("free".to_string(), None)
+        None
+    };
+
+    // Payloads written to the traffic log, spool and journal are encrypted;
+    // km refuses to run rather than write them in the clear
+    let cipher = if settings.encryption.enabled {
+        let cipher = PayloadCipher::load(config_path, &settings.encryption, true)
+            .context("Payload encryption is enabled but no key is available")?;
+        let cipher = Arc::new(cipher);
+        encryption::install(cipher.clone());
+        tracing::info!("Payload encryption enabled");
+        Some(cipher)
+    } else {
+        None
+    };
+
+    // What the account's plan includes; --override-tier stands in for the API
+    let entitlements = match (&jwt_token_option, override_tier.as_deref()) {
+        (Some(_), Some(tier)) => Entitlements::from_tier(tier),
+        (Some(token), None) => match entitlements::default_path() {
+            Ok(path) => {
+                entitlements::resolve(&path, &api_url, Some(token), false, &settings.entitlements)
+                    .await
+            }
+            Err(_) => Entitlements::from_tier(token.claims.tier.as_deref().unwrap_or("free")),
+        },
+        (None, _) => Entitlements::none(),
     };
+    let user_tier = entitlements.tier.clone();
+    let jwt_token = jwt_token_option;
+    if jwt_token.is_some() {
+        tracing::info!("User tier: {} ({})", user_tier, entitlements.source);
+    } else if auth_failed {
+        tracing::info!("Authentication failed - running in local-only mode");
+    }
 
     let proxy_request = ProxyRequest::new(program.clone(), program_args.clone());
     let proxy_context = ProxyContext::new(
@@ -362,213 +998,2797 @@ pub async fn handle_monitor(
             .unwrap_or_default(),
     );
 
-    let pipeline = if local_only || jwt_token.is_none() {
-        if local_only {
-            tracing::info!("Using local logging only (--local-only specified)");
-        } else {
-            tracing::info!("Using local logging only (authentication failed)");
+    // Drains events spooled while the API was unreachable, for as long as the proxy runs
+    let mut spool_uploader = None;
+    // Batches captured MCP messages and uploads them to the API
+    let mut event_uploader = None;
+    // Its settings and counters, for spooling and reporting at shutdown
+    let mut shutdown_uploader: Option<EventUploader> = None;
+    let mut events_queue = None;
+    // Copies payload blobs to the configured bucket
+    let mut blob_uploader = None;
+    // Renews the access token before it expires, for as long as the proxy runs
+    let mut token_refresher = None;
+    let mut batch_settings_tx = None;
+    // What `km ctl flush` wakes and drains
+    let mut upload_flush = None;
+    let mut ctl_spool = None;
+    // Access tokens renewed by token_refresher, for checking the plan again
+    let mut token_updates = None;
+    // Whether uploads are flowing, for `km status --api` and the metrics
+    let mut api_breaker = None;
+    let mut api_latency = None;
+    // Spools what the event uploader couldn't send before the shutdown deadline
+    let mut shutdown_spool = None;
+    let analyzer = Arc::new(pattern_analyzer(&settings));
+    let clock_offset = match clock_offset {
+        Some(query) => match query.await {
+            Ok(Ok(sample)) => {
+                tracing::debug!(
+                    "Clock offset {:+.1} ms (NTP round trip {:.1} ms)",
+                    sample.offset_ms,
+                    sample.delay_ms
+                );
+                Some(sample.offset_ms)
+            }
+            Ok(Err(e)) => {
+                tracing::debug!("Clock offset unknown: {:#}", e);
+                None
+            }
+            Err(_) => None,
+        },
+        None => None,
+    };
+    // Removed once the last upload has drained
+    let mut journal = None;
+    let mut proxy_options = ProxyOptions {
+        capture: Arc::new(RwLock::new(capture_settings(&settings, preset.as_ref()))),
+        events: None,
+        sampler: None,
+        dedup: None,
+        policy: None,
+        opa: None,
+        plugins: None,
+        traces: None,
+        framing: options.framing,
+        labels: Arc::new(
+            options
+                .labels
+                .iter()
+                .cloned()
+                .chain(docker.iter().flat_map(DockerRun::session_labels))
+                .chain(
+                    options
+                        .run_id
+                        .iter()
+                        .map(|id| (traffic::RUN_ID_LABEL.to_string(), id.clone())),
+                )
+                .chain(
+                    clock_offset.map(|ms| (clock::OFFSET_LABEL.to_string(), format!("{:.1}", ms))),
+                )
+                .collect(),
+        ),
+        tail: None,
+        counts: Arc::default(),
+        payloads: None,
+        risk: Some(analyzer.clone()),
+        alerts: None,
+        approval: None,
+        stop: Default::default(),
+        resources: Arc::default(),
+        latency: Arc::default(),
+        pings: (!preset
+            .as_ref()
+            .map_or(settings.capture_pings, |preset| preset.capture_pings))
+        .then(Arc::default),
+        handshake: Arc::default(),
+        inventory: None,
+        costs: Arc::new(CostTracker::new(settings.costs.clone())),
+        content: Arc::default(),
+        divert_preamble: launcher.is_some(),
+        journal: None,
+        cipher: cipher.clone(),
+        janitor: None,
+        env: server_env.clone(),
+        decisions: None,
+    };
+    if settings.decision_log.enabled {
+        match settings
+            .decision_log
+            .dir()
+            .and_then(|dir| DecisionLog::create(&dir, &session_id))
+        {
+            Ok(log) => {
+                tracing::debug!("Logging decisions to {:?}", log.path());
+                proxy_options.decisions = Some(Arc::new(log));
+            }
+            Err(e) => tracing::warn!("Decisions won't be logged this session: {:#}", e),
         }
-        // Use separate log file for command metadata vs MCP traffic
-        let metadata_log = log_file
-            .parent()
-            .unwrap_or_else(|| std::path::Path::new("."))
-            .join("km_commands.log");
-        FilterPipeline::new().add_filter(Box::new(LocalLoggerFilter::new(metadata_log)))
-    } else if let Some(token) = jwt_token.clone() {
-        tracing::info!(
-            "Using filter pipeline with telemetry for {} tier",
-            user_tier
-        );
-        let mut pipeline = FilterPipeline::new()
-            .add_filter(Box::new(LocalLoggerFilter::new(log_file.clone())))
-            .add_filter(Box::new(EventSenderFilter::new(
-                format!("{}/api/events/telemetry", api_url),
-                token.clone(),
+    }
+    if !settings.retention.is_default() {
+        proxy_options.janitor = Some(Arc::new(Mutex::new(Janitor::new(
+            settings.retention.clone(),
+            &session_id,
+            blob_dir(&settings.payloads).ok(),
+        ))));
+    }
+    match inventory::default_dir() {
+        Ok(dir) => {
+            let command = server_env.scrub(
+                &std::iter::once(program.clone())
+                    .chain(program_args.iter().cloned())
+                    .collect::<Vec<_>>(),
+            );
+            proxy_options.inventory = Some(Arc::new(InventoryTracker::new(
+                dir,
+                &session_id,
+                &command.join(" "),
             )));
+        }
+        Err(e) => tracing::warn!("Not keeping the server's tool catalog: {:#}", e),
+    }
+
+    // Bounded so a slow uploader holds the proxy back instead of growing memory
+    let queue_wait = Duration::from_millis(settings.queue_wait_ms);
+    let mut queue_stats: Vec<(&str, Arc<QueueStats>)> = Vec::new();
+    let mut sampling_stats = None;
+    let mut dedup_stats = None;
+
+    // Spans for MCP calls, when an OTLP collector is configured via OTEL_*
+    let mut span_exporter = None;
+    match OtlpConfig::from_env(|name| std::env::var(name).ok()) {
+        Ok(Some(otlp)) => {
+            tracing::info!("Exporting MCP call spans to {}", otlp.endpoint);
+            let (traces_tx, traces_rx) = queue::bounded(settings.queue_size, queue_wait);
+            queue_stats.push(("spans", traces_tx.stats()));
+            proxy_options.traces = Some(traces_tx);
+            span_exporter = Some(
+                SpanExporter::new(otlp)
+                    .with_risk_engine(risk_engine(
+                        &settings,
+                        &api_url,
+                        jwt_token.as_ref(),
+                        redactor.as_ref(),
+                    ))
+                    .spawn(traces_rx),
+            );
+        }
+        Ok(None) => {}
+        Err(e) => tracing::warn!("Not exporting traces: {:#}", e),
+    }
+
+    if !settings.policies.is_default() {
+        let policy = Policy::from_config(&settings.policies).context("Invalid policies")?;
+        if !policy.is_empty() {
+            tracing::info!(
+                "Checking requests against policies ({:?} mode)",
+                policy.mode()
+            );
+            proxy_options.policy = Some(Arc::new(policy));
+        }
+    }
+
+    if let Some(ref bundle) = options.policy_bundle {
+        let opa = OpaPolicy::load(bundle)
+            .with_context(|| format!("Failed to load policy bundle {:?}", bundle))?;
+        tracing::info!(
+            "Evaluating calls against policy bundle {:?} (revision {})",
+            bundle,
+            opa.revision().unwrap_or("unknown")
+        );
+        proxy_options.opa = Some(Arc::new(opa));
+    }
+
+    if !options.no_plugins {
+        let loaded = load_plugins(&settings).map(|host| match proxy_options.decisions {
+            Some(ref decisions) => host.with_decision_log(decisions.clone()),
+            None => host,
+        });
+        match loaded {
+            Ok(host) => {
+                if host.is_empty() {
+                    tracing::debug!("No plugins loaded");
+                }
+                // Kept even when empty so `km ctl reload-plugins` can add some
+                let host = Arc::new(host);
+                if let Some(interval) = settings.plugin_sandbox.health_interval() {
+                    PluginHost::watch(&host, interval);
+                }
+                proxy_options.plugins = Some(host);
+            }
+            Err(e) => tracing::warn!("Failed to load plugins: {:#}", e),
+        }
+    }
+
+    if let Some(ref when) = options.confirm {
+        let timeout = Duration::from_secs(
+            options
+                .confirm_timeout
+                .unwrap_or(approval::DEFAULT_CONFIRM_TIMEOUT_SECS),
+        );
+        let gate = ApprovalGate::new(when, timeout, analyzer.clone())?.with_terminal();
+        tracing::info!(
+            "Holding requests matching '{}' for approval ({}s timeout)",
+            approval::confirm_query(when),
+            timeout.as_secs()
+        );
+        proxy_options.approval = Some(Arc::new(gate));
+    }
+
+    // Runs alert actions in the background; kept to report how many were sent
+    let mut alert_dispatcher = None;
+    let mut alerter = None;
+    let mut alerts = Alerter::from_config(&settings.alerts).context("Invalid alert rules")?;
+    if !alerts.is_empty() {
+        tracing::info!(
+            "Checking captured messages against {} alert rule(s)",
+            settings.alerts.rules.len()
+        );
+        alert_dispatcher = Some(alerts.spawn());
+        let alerts = Arc::new(alerts);
+        proxy_options.alerts = Some(alerts.clone());
+        alerter = Some(alerts);
+    }
+
+    let pipeline = if local_only || jwt_token.is_none() {
+        if offline {
+            tracing::info!("Using local logging only (offline mode)");
+        } else if local_only {
+            tracing::info!("Using local logging only (--local-only specified)");
+        } else if auth_failed {
+            tracing::info!("Using local logging only (authentication failed)");
+        } else {
+            tracing::info!("Using local logging only (no configuration)");
+        }
+        if !settings.sinks.is_empty() {
+            tracing::warn!(
+                "Sinks get the batches uploaded to the API, so none are sent this session"
+            );
+        }
+        // Use separate log file for command metadata vs MCP traffic
+        let metadata_log = log_file
+            .parent()
+            .unwrap_or_else(|| std::path::Path::new("."))
+            .join("km_commands.log");
+        FilterPipeline::new().add_filter(Box::new(LocalLoggerFilter::new(metadata_log)))
+    } else if let Some(token) = jwt_token.clone() {
+        tracing::info!(
+            "Using filter pipeline with telemetry for {} tier",
+            user_tier
+        );
+        let mut event_sender =
+            EventSenderFilter::new(format!("{}/api/events/telemetry", api_url), token.clone());
+        if let Some(ref redactor) = redactor {
+            event_sender = event_sender.with_redactor(redactor.clone());
+        }
+        let (tokens_tx, tokens_rx) = tokio::sync::watch::channel(token.token.clone());
+        token_updates = Some(tokens_rx.clone());
+        if token.refresh_token.is_some() {
+            token_refresher = Some(DeviceAuthClient::new(api_url.clone()).spawn_refresher(
+                token.clone(),
+                tokens_tx,
+                |fresh| save_login(fresh).unwrap_or_else(|e| tracing::warn!("{:#}", e)),
+            ));
+        }
+        // One budget for event batches and spool uploads alike, and one
+        // breaker so both stop and resume together
+        let limiter = Arc::new(RateLimiter::new(capabilities.rate_limit.as_ref()));
+        let breaker = Arc::new(CircuitBreaker::new(
+            settings.circuit_breaker,
+            settings.retry,
+        ));
+        api_breaker = Some(breaker.clone());
+        let upload_latency = Arc::new(ApiLatency::default());
+        api_latency = Some(upload_latency.clone());
+        let mut events = EventUploader::new(token.token.clone())
+            .with_token_updates(tokens_rx.clone())
+            .with_capabilities(&capabilities)
+            .with_rate_limiter(limiter.clone())
+            .with_retry(settings.retry)
+            .with_breaker(breaker.clone())
+            .with_api_latency(upload_latency.clone())
+            .with_latency(proxy_options.latency.clone())
+            .with_costs(proxy_options.costs.clone());
+        if let Some(ref redactor) = redactor {
+            events = events.with_redactor(redactor.clone());
+        }
+        if let Some(ref run_id) = options.run_id {
+            events = events.with_run_id(run_id);
+        }
+        let sent_batches = match SentBatches::open_default() {
+            Ok(sent) => Some(Arc::new(sent)),
+            Err(e) => {
+                tracing::warn!("Duplicate batch checks unavailable: {:#}", e);
+                None
+            }
+        };
+        if let Some(ref sent) = sent_batches {
+            events = events.with_sent_batches(sent.clone());
+        }
+        let sinks = Sinks::from_config(&settings.sinks)?;
+        if !sinks.is_empty() {
+            tracing::info!("Also sending events to {}", sinks.names().join(", "));
+            events = events.with_sinks(sinks);
+        }
+        match Spool::open_default() {
+            Ok(spool) => {
+                let mut spool = match cipher {
+                    Some(ref cipher) => spool.with_cipher(cipher.clone()),
+                    None => spool,
+                }
+                .with_rate_limiter(limiter)
+                .with_breaker(breaker)
+                .with_api_latency(upload_latency);
+                if let Some(sent) = sent_batches {
+                    spool = spool.with_sent_batches(sent);
+                }
+                event_sender = event_sender.with_spool(spool.clone());
+                events = events.with_spool(spool.clone());
+                shutdown_spool = Some(spool.clone());
+                ctl_spool = Some((spool.clone(), tokens_rx.clone()));
+                spool_uploader = Some(spool.spawn_uploader(
+                    crate::http::client(),
+                    tokens_rx,
+                    SPOOL_UPLOAD_INTERVAL,
+                ));
+            }
+            Err(e) => tracing::warn!("Offline spool unavailable: {}", e),
+        }
+
+        if capabilities.event_batches {
+            let batch_settings_now = batch_settings(&settings, &api_url);
+            match journal::default_dir() {
+                Ok(dir) => {
+                    // Sessions a killed km left behind go to the spool, which
+                    // the spool uploader then drains
+                    if let Some((ref spool, _)) = ctl_spool {
+                        match recover_sessions(&dir, &settings, spool) {
+                            Ok(recovered) if !recovered.is_empty() => tracing::info!(
+                                "Spooled the unsent events of {} interrupted session(s)",
+                                recovered.len()
+                            ),
+                            Ok(_) => {}
+                            Err(e) => tracing::warn!("{:#}", e),
+                        }
+                    }
+                    let start = JournalStart {
+                        session_id: session_id.clone(),
+                        pid: std::process::id(),
+                        started_at: chrono::Utc::now(),
+                        endpoint: batch_settings_now.endpoint.clone(),
+                        command: server_env.scrub(
+                            &std::iter::once(program.clone())
+                                .chain(program_args.iter().cloned())
+                                .collect::<Vec<_>>(),
+                        ),
+                        labels: proxy_options.labels.as_ref().clone(),
+                        redact: redactor.is_some(),
+                    };
+                    let created = Journal::create(&dir, &start).map(|created| match cipher {
+                        Some(ref cipher) => created.with_cipher(cipher.clone()),
+                        None => created,
+                    });
+                    match created {
+                        Ok(created) => {
+                            tracing::debug!("Journaling events to {:?}", created.path());
+                            let created = Arc::new(created);
+                            events = events.with_journal(created.clone());
+                            proxy_options.journal = Some(created.clone());
+                            journal = Some(created);
+                        }
+                        Err(e) => tracing::warn!("Uploads won't survive a crash: {:#}", e),
+                    }
+                }
+                Err(e) => tracing::warn!("Uploads won't survive a crash: {:#}", e),
+            }
+            let (events_tx, events_rx) = queue::bounded(settings.queue_size, queue_wait);
+            queue_stats.push(("events", events_tx.stats()));
+            events_queue = Some(events_tx.stats());
+            let (settings_tx, settings_rx) = tokio::sync::watch::channel(batch_settings_now);
+            proxy_options.events = Some(events_tx);
+            if settings.sampling.samples() {
+                tracing::info!("Sampling uploaded events");
+                let sampler = Sampler::new(settings.sampling.clone());
+                sampling_stats = Some(sampler.stats());
+                proxy_options.sampler = Some(Arc::new(sampler));
+            }
+            if settings.dedup.collapses() {
+                let deduper = Deduper::new(settings.dedup.clone());
+                dedup_stats = Some(deduper.stats());
+                proxy_options.dedup = Some(Arc::new(deduper));
+            }
+            match payload_shaper(&settings.payloads) {
+                Ok((shaper, uploader)) => {
+                    if !shaper.is_noop() {
+                        proxy_options.payloads = Some(Arc::new(shaper));
+                    }
+                    blob_uploader = uploader;
+                }
+                Err(e) => tracing::warn!("Uploading payloads in full: {:#}", e),
+            }
+            batch_settings_tx = Some(settings_tx);
+            let flush = Arc::new(tokio::sync::Notify::new());
+            upload_flush = Some(flush.clone());
+            shutdown_uploader = Some(events.clone());
+            event_uploader = Some(
+                events
+                    .with_flush_signal(flush)
+                    .spawn(settings_rx, events_rx),
+            );
+        } else {
+            tracing::info!("The API doesn't take event batches; sending telemetry only");
+        }
+
+        let mut pipeline = FilterPipeline::new()
+            .add_filter(Box::new(LocalLoggerFilter::new(log_file.clone())))
+            .add_filter(Box::new(event_sender));
+
+        if entitlements.has_feature(entitlements::RISK_ANALYSIS) {
+            tracing::info!("Adding risk analysis ({} plan)", user_tier);
+            let mut risk_filter =
+                RiskAnalysisFilter::new(format!("{}/api/risk/analyze", api_url), 0.8);
+            if let Some(ref redactor) = redactor {
+                risk_filter = risk_filter.with_redactor(redactor.clone());
+            }
+            pipeline = pipeline.add_filter(Box::new(risk_filter));
+        }
+
+        pipeline
+    } else {
+        // Fallback case (should not happen but be safe)
+        tracing::info!("Fallback to local logging only");
+        // Use separate log file for command metadata vs MCP traffic
+        let metadata_log = log_file
+            .parent()
+            .unwrap_or_else(|| std::path::Path::new("."))
+            .join("km_commands.log");
+        FilterPipeline::new().add_filter(Box::new(LocalLoggerFilter::new(metadata_log)))
+    };
+
+    // New versions of the remote layer land in its cache, which the watcher
+    // below picks up like an edit to the file
+    let remote_refresher = (!local_only && settings.remote_config.source.is_some()).then(|| {
+        let config_path = config_path.to_path_buf();
+        let interval = settings.remote_config.refresh_interval();
+        tokio::spawn(async move {
+            loop {
+                tokio::time::sleep(interval).await;
+                if let Err(e) = refresh_remote_config(&config_path, true).await {
+                    tracing::warn!("Keeping the cached remote config: {:#}", e);
+                }
+            }
+        })
+    });
+
+    // A plan that lapses or changes mid-session reaches the plugins and
+    // `km ctl reload-plugins`; --override-tier pins it
+    let session_entitlements = Arc::new(RwLock::new(entitlements.clone()));
+    let entitlement_revalidator = match (&jwt_token, &override_tier) {
+        (Some(token), None) => entitlements::default_path().ok().and_then(|cache_path| {
+            let revalidator = entitlements::Revalidator {
+                cache_path,
+                api_url: api_url.clone(),
+                token: token.clone(),
+                tokens: token_updates.clone(),
+                settings: settings.entitlements.clone(),
+            };
+            let current = session_entitlements.clone();
+            let plugins = proxy_options.plugins.clone();
+            revalidator.spawn(entitlements.clone(), move |fresh| {
+                if let Ok(mut current) = current.write() {
+                    *current = fresh.clone();
+                }
+                if let Some(ref plugins) = plugins {
+                    plugins.on_entitlements_changed(fresh);
+                }
+            })
+        }),
+        _ => None,
+    };
+
+    // Apply config file edits to the running session
+    let watcher = Config::exists(config_path).then(|| {
+        let capture = proxy_options.capture.clone();
+        // The session token belongs to this API, so the endpoint stays put
+        let api_url = api_url.clone();
+        ConfigWatcher::spawn(
+            config_path.to_path_buf(),
+            CONFIG_POLL_INTERVAL,
+            move |config| {
+                if let Ok(mut current) = capture.write() {
+                    *current = capture_settings(&config, preset.as_ref());
+                }
+                if let Some(ref tx) = batch_settings_tx {
+                    tx.send_replace(batch_settings(&config, &api_url));
+                }
+                if let Some(level) = config.tracing_level() {
+                    logging::set_level(level);
+                }
+                logging::set_levels(&config.logging.levels);
+            },
+        )
+    });
+
+    let pipeline = match proxy_options.decisions {
+        Some(ref decisions) => pipeline.with_decision_log(decisions.clone()),
+        None => pipeline,
+    };
+    let result = match pipeline.execute(proxy_context).await {
+        Ok(filtered_request) => {
+            tracing::info!("Request approved, executing proxy");
+            // The proxy's threads log in this span too
+            let _session = logging::session_span(&session_id).entered();
+            tracing::info!("Session ID: {}", session_id);
+            if let Some(ref plugins) = proxy_options.plugins {
+                plugins.on_session_start(&session_id, &proxy_options.labels, &entitlements);
+            }
+            match tail::default_dir().and_then(|dir| TailServer::start(&dir, &session_id)) {
+                Ok(server) => proxy_options.tail = Some(Arc::new(server)),
+                Err(e) => tracing::warn!("km tail unavailable for this session: {:#}", e),
+            }
+
+            let mut command = vec![filtered_request.command.clone()];
+            command.extend(filtered_request.args.iter().cloned());
+            let command = server_env.scrub(&command);
+            let mut control = MonitorControl::new(&session_id, command, &log_file, &proxy_options);
+            let started_at = control.started_at;
+            control.queues = queue_stats.clone();
+            control.entitlements = session_entitlements.clone();
+            control.upload_flush = upload_flush.take();
+            control.spool = ctl_spool.take();
+            control.breaker = api_breaker.clone();
+            control.api_latency = api_latency.clone();
+            if proxy_options.plugins.is_some() {
+                let config_path = config_path.to_path_buf();
+                control.plugin_loader = Some(Box::new(move || {
+                    // Pick up plugin settings edited since the session started
+                    load_plugins(&Config::load_with_env(&config_path).unwrap_or_default())
+                }));
+            }
+            let control_server = control::default_dir()
+                .and_then(|dir| ControlServer::start(&dir, control))
+                .map_err(|e| tracing::warn!("km ctl unavailable for this session: {:#}", e))
+                .ok();
+
+            let metrics_server = options.metrics_addr.and_then(|addr| {
+                let session_id = session_id.clone();
+                let counts = proxy_options.counts.clone();
+                let latency = proxy_options.latency.clone();
+                let pings = proxy_options.pings.clone();
+                let breaker = api_breaker.clone();
+                let api_latency = api_latency.clone();
+                let source: MetricsSource = Arc::new(move || {
+                    let mut metrics = latency::prometheus(
+                        &session_id,
+                        counts.requests.load(Ordering::Relaxed),
+                        counts.responses.load(Ordering::Relaxed),
+                        &counts.classes(),
+                        &latency.snapshot(),
+                    );
+                    if let Some(ref pings) = pings {
+                        metrics.push_str(&keepalive::prometheus(&session_id, &pings.health()));
+                    }
+                    if let Some(ref breaker) = breaker {
+                        metrics.push_str(&breaker::prometheus(&session_id, &breaker.status()));
+                    }
+                    if let Some(ref api_latency) = api_latency {
+                        metrics.push_str(&latency::api_prometheus(
+                            &session_id,
+                            &api_latency.summary(),
+                        ));
+                    }
+                    metrics
+                });
+                MetricsServer::start(addr, source)
+                    .inspect(|server| {
+                        tracing::info!("Serving metrics on http://{}/metrics", server.addr())
+                    })
+                    .map_err(|e| tracing::warn!("Metrics unavailable for this session: {:#}", e))
+                    .ok()
+            });
+
+            let summary_events = proxy_options.events.clone();
+            let counts = proxy_options.counts.clone();
+            let resources = proxy_options.resources.clone();
+            let handshake = proxy_options.handshake.clone();
+            let labels = proxy_options.labels.clone();
+
+            // Shut the server down cleanly instead of dying with it, so the
+            // traffic log, uploads and alerts are all finished
+            let stop = proxy_options.stop.clone();
+            let shutdown = tokio::spawn(async move {
+                match process::shutdown_requested().await {
+                    Ok(signal) => {
+                        tracing::info!("Received {}, shutting down", signal);
+                        stop.request();
+                    }
+                    Err(e) => tracing::warn!("Could not listen for shutdown signals: {}", e),
+                }
+            });
+
+            let result = proxy::run_proxy(
+                &filtered_request.command,
+                &filtered_request.args,
+                &log_file,
+                &session_id,
+                proxy_options,
+            )
+            .map_err(anyhow::Error::from);
+            shutdown.abort();
+            if let Some(ref run) = docker {
+                container::remove(&run.name);
+            }
+
+            // Closes the session for the API, with how hard the server worked
+            let summary = SessionEnd {
+                started_at,
+                ended_at: chrono::Utc::now(),
+                requests: counts.requests.load(Ordering::Relaxed),
+                responses: counts.responses.load(Ordering::Relaxed),
+                messages: counts.classes(),
+                resources: resources.usage(),
+                handshake: handshake.snapshot(),
+            };
+            tracing::info!("Captured {}", summary.messages.describe());
+            if let Some(ref usage) = summary.resources {
+                tracing::info!("MCP server resource use: {}", usage.describe());
+            }
+            if let Some(events) = summary_events {
+                let mut event = McpEvent::session_end(&session_id, &summary);
+                event.labels = labels.as_ref().clone();
+                if let Some(ref journal) = journal {
+                    journal.record(&event);
+                }
+                events.push(event);
+            }
+            drop(control_server);
+            drop(metrics_server);
+            result
+        }
+        Err(e) => {
+            drop(proxy_options);
+            Err(anyhow::anyhow!("Request blocked: {}", e))
+        }
+    };
+
+    if let Some(watcher) = watcher {
+        watcher.stop();
+    }
+    if let Some(remote_refresher) = remote_refresher {
+        remote_refresher.abort();
+    }
+    if let Some(entitlement_revalidator) = entitlement_revalidator {
+        entitlement_revalidator.abort();
+    }
+
+    // The proxy has stopped and dropped its event sender, so no new events
+    // arrive; the uploader sends its last partial batch and exits. Every
+    // drain below shares one deadline
+    let shutdown_timeout = options.shutdown_timeout.unwrap_or(DEFAULT_SHUTDOWN_TIMEOUT);
+    let deadline = tokio::time::Instant::now() + shutdown_timeout;
+    let mut spooled_at_shutdown = 0;
+    if let Some(mut event_uploader) = event_uploader {
+        if tokio::time::timeout_at(deadline, &mut event_uploader)
+            .await
+            .is_ok()
+        {
+            if let Some(ref journal) = journal {
+                journal.finish();
+            }
+        } else {
+            event_uploader.abort();
+            let _ = event_uploader.await;
+            match (&journal, &shutdown_spool, &shutdown_uploader) {
+                (Some(journal), Some(spool), Some(uploader)) => {
+                    match journal.spool_pending(uploader, spool, settings.max_batch_bytes) {
+                        Ok(spooled) => {
+                            spooled_at_shutdown = spooled as u64;
+                            tracing::warn!(
+                                "Uploads didn't finish within {:?}; spooled {} event(s) for 'km flush' or the next session",
+                                shutdown_timeout,
+                                spooled
+                            );
+                        }
+                        // The journal stays, so the next run spools what's left
+                        Err(e) => tracing::warn!("Could not spool the unsent events: {:#}", e),
+                    }
+                }
+                _ => tracing::warn!(
+                    "Uploads didn't finish within {:?}; the unsent events are lost",
+                    shutdown_timeout
+                ),
+            }
+        }
+    }
+    if let Some(blob_uploader) = blob_uploader {
+        if tokio::time::timeout_at(deadline, blob_uploader)
+            .await
+            .is_err()
+        {
+            tracing::warn!(
+                "Timed out uploading payload blobs; the rest stay in the blob directory"
+            );
+        }
+    }
+    if let Some(alerter) = alerter {
+        if alerter.sent() + alerter.suppressed() > 0 {
+            tracing::info!(
+                "Raised {} alert(s), suppressed {} (rate limit or duplicates)",
+                alerter.sent(),
+                alerter.suppressed()
+            );
+        }
+        // The last reference: dropping it lets the dispatcher finish
+        drop(alerter);
+        if let Some(alert_dispatcher) = alert_dispatcher {
+            if tokio::time::timeout_at(deadline, alert_dispatcher)
+                .await
+                .is_err()
+            {
+                tracing::warn!("Timed out running the last alert actions");
+            }
+        }
+    }
+    if let Some(span_exporter) = span_exporter {
+        if tokio::time::timeout_at(deadline, span_exporter)
+            .await
+            .is_err()
+        {
+            tracing::warn!("Timed out exporting the final spans");
+        }
+    }
+
+    if let (Some(queue), Some(uploader)) = (events_queue, shutdown_uploader) {
+        let report = DrainReport::new(&queue, &uploader.stats(), spooled_at_shutdown);
+        if report.dropped > 0 {
+            tracing::warn!(
+                "Events: {} uploaded, {} spooled, {} dropped",
+                report.uploaded,
+                report.spooled,
+                report.dropped
+            );
+        } else {
+            tracing::info!(
+                "Events: all {} persisted ({} uploaded, {} spooled)",
+                report.persisted(),
+                report.uploaded,
+                report.spooled
+            );
+        }
+    }
+
+    if let Some(spool_uploader) = spool_uploader {
+        spool_uploader.abort();
+    }
+    if let Some(token_refresher) = token_refresher {
+        token_refresher.abort();
+    }
+
+    if let Some(redactor) = redactor {
+        for (rule, count) in redactor.counts() {
+            tracing::info!("Redacted {} match(es) for rule {}", count, rule);
+        }
+    }
+
+    if let Some(stats) = sampling_stats {
+        tracing::info!(
+            "Uploaded {} sampled events, left out {} ({} kept for risk or errors)",
+            stats.kept(),
+            stats.dropped(),
+            stats.rescued()
+        );
+    }
+    if let Some(stats) = dedup_stats.filter(|stats| stats.collapsed() > 0) {
+        tracing::info!(
+            "Collapsed {} repeated notifications into {} events",
+            stats.collapsed(),
+            stats.aggregates()
+        );
+    }
+
+    for (name, stats) in queue_stats {
+        if stats.dropped() > 0 {
+            tracing::warn!(
+                "Dropped {} of {} {} because the upload queue stayed full; consider raising queue_size",
+                stats.dropped(),
+                stats.sent() + stats.dropped(),
+                name
+            );
+        } else if stats.delayed() > 0 {
+            tracing::info!(
+                "{} of {} {} waited for room in the upload queue",
+                stats.delayed(),
+                stats.sent(),
+                name
+            );
+        }
+    }
+
+    // Counted from the traffic log once it's complete
+    let github = GitHubActions::detect(|name| std::env::var(name).ok());
+    if options.ci || github.is_some() {
+        let report = session_report(&log_file, &session_id, &settings, &analyzer)?;
+        let ci = match options.ci {
+            true => Some(ci_summary(&options, &session_id, report.as_ref())?),
+            false => None,
+        };
+        if let (Some(github), Some(report)) = (github, report) {
+            if let Err(e) = github.publish(&report, ci.as_ref()) {
+                tracing::warn!("{:#}", e);
+            }
+        }
+        // A server that failed fails the run on its own; thresholds are
+        // checked only for sessions that ended normally
+        if let (Ok(()), Some(failure)) = (&result, ci.and_then(|ci| ci.failure())) {
+            return Err(anyhow::anyhow!(failure));
+        }
+    }
+
+    result
+}
+
+/// The report for the session `km monitor` just ran, from its traffic log;
+/// `None` when it captured nothing.
+fn session_report(
+    log_file: &Path,
+    session_id: &str,
+    settings: &Config,
+    analyzer: &PatternRiskAnalyzer,
+) -> Result<Option<SessionReport>> {
+    if !log_file.exists() {
+        return Ok(None);
+    }
+    let entries = traffic::read_entries(log_file).context("Failed to summarize the session")?;
+    let summaries = sessions::summarize(&entries);
+    Ok(summaries
+        .iter()
+        .find(|s| s.id == session_id)
+        .map(|session| {
+            let mut report = SessionReport::build(&entries, session, analyzer, &settings.costs);
+            report.log = Some(log_file.to_path_buf());
+            report
+        }))
+}
+
+/// The `km monitor --ci` summary, printed to stderr, which stays clear of
+/// the MCP traffic on stdout.
+fn ci_summary(
+    options: &MonitorOptions,
+    session_id: &str,
+    report: Option<&SessionReport>,
+) -> Result<CiSummary> {
+    let counts = report.map(CiCounts::of_report).unwrap_or_default();
+    let summary = CiSummary::evaluate(session_id, counts, &options.fail_on);
+    let json = serde_json::to_string_pretty(&summary)?;
+    eprintln!("{}", json);
+    if let Some(ref path) = options.ci_summary {
+        fs::write(path, format!("{}\n", json))
+            .with_context(|| format!("Failed to write the CI summary to {:?}", path))?;
+    }
+    Ok(summary)
+}
+
+/// Start the installed plugins as configured.
+fn load_plugins(settings: &Config) -> Result<PluginHost> {
+    start_plugins(&PluginStore::open_default()?, settings)
+}
+
+fn start_plugins(store: &PluginStore, settings: &Config) -> Result<PluginHost> {
+    PluginHost::start(
+        store,
+        &settings.plugin_sandbox,
+        settings.allow_unsigned_plugins,
+        &settings.plugin_priorities,
+        &settings.plugin_config,
+    )
+    .map(|host| host.with_failure_policies(&settings.plugin_failure_policies))
+}
+
+fn capture_settings(config: &Config, preset: Option<&CapturePreset>) -> CaptureSettings {
+    match preset {
+        Some(preset) => preset.capture_settings(),
+        None => CaptureSettings {
+            method_whitelist: config.method_whitelist.clone(),
+            payload_size_limit: config.payload_size_limit,
+            risk_at_least: None,
+        },
+    }
+}
+
+/// How large payloads are trimmed or stored, and the task copying blobs
+/// to a bucket when one is configured.
+fn payload_shaper(
+    config: &PayloadConfig,
+) -> Result<(PayloadShaper, Option<tokio::task::JoinHandle<()>>)> {
+    let shaper = PayloadShaper::new(config.truncate_bytes);
+    let Some(threshold) = config.blob_threshold_bytes else {
+        return Ok((shaper, None));
+    };
+    let store = BlobStore::new(blob_dir(config)?);
+    let Some(ref url) = config.blob_url else {
+        return Ok((shaper.with_blobs(threshold, store), None));
+    };
+    let region = config.blob_region.as_deref().unwrap_or(DEFAULT_BLOB_REGION);
+    let uploader = S3Uploader::new(region, S3Credentials::from_env()?);
+    let (store, blobs) = store.with_bucket(url)?;
+    tracing::info!("Storing payloads of {} bytes or more in {}", threshold, url);
+    Ok((
+        shaper.with_blobs(threshold, store),
+        Some(uploader.spawn(blobs)),
+    ))
+}
+
+/// Where payload blobs are written: `payloads.blob_dir` or the default.
+fn blob_dir(config: &PayloadConfig) -> Result<PathBuf> {
+    match config.blob_dir {
+        Some(ref dir) => Ok(PathBuf::from(dir)),
+        None => BlobStore::default_dir(),
+    }
+}
+
+/// Spool the unsent events of sessions whose km was killed, redacted as
+/// they would have been. Returns the id and spooled event count of each.
+fn recover_sessions(dir: &Path, config: &Config, spool: &Spool) -> Result<Vec<(String, usize)>> {
+    let mut recovered = Vec::new();
+    for session in journal::interrupted(dir)? {
+        let session_id = session.start.session_id.clone();
+        let mut uploader = EventUploader::new(String::new());
+        if session.start.redact || config.redaction.enabled {
+            let redactor = Redactor::from_config(&config.redaction)
+                .context("Invalid redaction configuration; interrupted sessions were kept")?;
+            uploader = uploader.with_redactor(Arc::new(redactor));
+        }
+        match journal::recover(session, &uploader, spool, config.max_batch_bytes) {
+            Ok(events) => recovered.push((session_id, events)),
+            Err(e) => tracing::warn!("Could not recover session {}: {:#}", session_id, e),
+        }
+    }
+    Ok(recovered)
+}
+
+fn batch_settings(config: &Config, api_url: &str) -> BatchSettings {
+    BatchSettings {
+        endpoint: format!("{}/api/events/batch", api_url),
+        batch_size: config.batch_size.max(1),
+        batch_timeout: Duration::from_secs(config.batch_timeout.max(1)),
+        max_batch_bytes: config.max_batch_bytes.max(1024),
+        compress: config.compress_uploads,
+        concurrency: config.upload_concurrency,
+    }
+}
+
+/// The local pattern analyzer: built-in patterns plus enabled rule packs.
+fn pattern_analyzer(config: &Config) -> PatternRiskAnalyzer {
+    PatternRiskAnalyzer::new()
+        .with_scan_budget(config.risk_scan_budget)
+        .with_patterns(rules::enabled_patterns(&config.risk_rules))
+}
+
+/// Risk providers from `risk_providers`, in order. The remote provider
+/// needs a session token and is skipped without one.
+fn risk_engine(
+    config: &Config,
+    api_url: &str,
+    jwt_token: Option<&JwtToken>,
+    redactor: Option<&Arc<Redactor>>,
+) -> RiskEngine {
+    let patterns = pattern_analyzer(config);
+    let mut providers: Vec<Box<dyn RiskAnalyzer>> = Vec::new();
+    for name in &config.risk_providers {
+        match name.as_str() {
+            "remote" => match jwt_token {
+                Some(token) => {
+                    let mut remote = RemoteRiskAnalyzer::new(
+                        format!("{}/api/risk/score", api_url),
+                        token.token.clone(),
+                    )
+                    .with_content_limit(config.risk_scan_budget);
+                    if let Some(redactor) = redactor {
+                        remote = remote.with_redactor(redactor.clone());
+                    }
+                    providers.push(Box::new(remote));
+                }
+                None => tracing::info!("Remote risk scoring needs authentication; skipping it"),
+            },
+            "heuristic" => providers.push(Box::new(HeuristicRiskAnalyzer::new(patterns.clone()))),
+            // The pattern analyzer is always the final fallback
+            _ => {}
+        }
+    }
+    let engine = RiskEngine::new(providers, patterns);
+    tracing::debug!("Risk providers: {}", engine.names().join(", "));
+    engine
+}
+
+/// Recover sessions whose km process was killed before they finished; their
+/// unsent events go to the spool for the next upload or `km flush`.
+pub fn handle_sessions_recover(config_path: &Path, dry_run: bool) -> Result<()> {
+    let dir = journal::default_dir()?;
+    let interrupted = journal::interrupted(&dir)?;
+    if interrupted.is_empty() {
+        println!("No interrupted sessions to recover.");
+        return Ok(());
+    }
+
+    for session in &interrupted {
+        println!(
+            "{}  started {}  {}  {} unsent event(s){}",
+            session.start.session_id,
+            session.start.started_at.format("%Y-%m-%d %H:%M:%S"),
+            session.start.command.join(" "),
+            session.pending.len(),
+            if session.ended {
+                ""
+            } else {
+                ", no session_end"
+            }
+        );
+    }
+    if dry_run {
+        return Ok(());
+    }
+
+    let config = Config::load_with_env(config_path).unwrap_or_default();
+    let mut spool = Spool::open_default()?;
+    if config.encryption.enabled {
+        spool = spool.with_cipher(Arc::new(PayloadCipher::load(
+            config_path,
+            &config.encryption,
+            true,
+        )?));
+    }
+    let recovered = recover_sessions(&dir, &config, &spool)?;
+    let events: usize = recovered.iter().map(|(_, events)| events).sum();
+    println!(
+        "✓ Spooled {} event(s) from {} session(s); run `km flush` to upload them now",
+        events,
+        recovered.len()
+    );
+    if recovered.len() < interrupted.len() {
+        return Err(anyhow::anyhow!(
+            "{} session(s) could not be recovered; their journals were kept in {:?}",
+            interrupted.len() - recovered.len(),
+            dir
+        ));
+    }
+    Ok(())
+}
+
+pub fn handle_storage(
+    config_path: &Path,
+    file: &Path,
+    json: bool,
+    command: StorageCommands,
+) -> Result<()> {
+    let config = Config::load_with_env(config_path).unwrap_or_default();
+    match command {
+        StorageCommands::Usage => {
+            let areas: Vec<(&str, PathBuf)> = [
+                ("spool", Spool::default_dir()),
+                ("blobs", blob_dir(&config.payloads)),
+                ("journal", journal::default_dir()),
+                ("decisions", config.decision_log.dir()),
+                ("tools", inventory::default_dir()),
+                ("logs", logging::default_dir()),
+            ]
+            .into_iter()
+            .filter_map(|(name, dir)| Some((name, dir.ok()?)))
+            .collect();
+            let usage = retention::usage(file, &areas)?;
+            if json {
+                println!("{}", serde_json::to_string_pretty(&usage)?);
+            } else {
+                for line in retention::render_usage(&usage) {
+                    println!("{}", line);
+                }
+            }
+        }
+        StorageCommands::Prune {
+            max_age_days,
+            max_size_mb,
+            max_sessions,
+            dry_run,
+        } => {
+            let mut limits = config.retention.clone();
+            limits.max_age_days = max_age_days.or(limits.max_age_days);
+            limits.max_size_mb = max_size_mb.or(limits.max_size_mb);
+            limits.max_sessions = max_sessions.or(limits.max_sessions);
+            limits.validate()?;
+            if limits.is_default() {
+                return Err(anyhow::anyhow!(
+                    "No retention limits set; pass --max-age-days, --max-size-mb or --max-sessions, or set retention.* with `km config set`"
+                ));
+            }
+
+            // Rewriting the log would cut off sessions still writing to it
+            let running = tail::running(&tail::default_dir()?);
+            let mut report = if running.is_empty() || dry_run {
+                retention::prune_log(file, &limits, &HashSet::new(), chrono::Utc::now(), dry_run)?
+            } else {
+                eprintln!(
+                    "Not pruning {:?} while {} km monitor session(s) are running",
+                    file,
+                    running.len()
+                );
+                retention::PruneReport::default()
+            };
+            (report.blobs, report.blob_bytes) = retention::prune_blobs(
+                &blob_dir(&config.payloads)?,
+                &limits,
+                std::time::SystemTime::now(),
+                dry_run,
+            )?;
+
+            if json {
+                println!("{}", serde_json::to_string_pretty(&report)?);
+            } else if report.is_empty() {
+                println!("Nothing to prune.");
+            } else {
+                let verb = if dry_run {
+                    "Would remove"
+                } else {
+                    "✓ Removed"
+                };
+                if !report.sessions.is_empty() {
+                    println!(
+                        "{} {} session(s), {} entries ({}) from {:?}",
+                        verb,
+                        report.sessions.len(),
+                        report.entries,
+                        retention::human_bytes(report.log_bytes),
+                        file
+                    );
+                    for session in &report.sessions {
+                        println!("  {}", session);
+                    }
+                }
+                if report.blobs > 0 {
+                    println!(
+                        "{} {} blob(s) ({})",
+                        verb,
+                        report.blobs,
+                        retention::human_bytes(report.blob_bytes)
+                    );
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+pub fn handle_audit(config_path: &Path, command: AuditCommands) -> Result<()> {
+    use std::io::{BufWriter, Write};
+
+    let config = Config::load_with_env(config_path).unwrap_or_default();
+    let dir = config.decision_log.dir()?;
+    match command {
+        AuditCommands::Export {
+            session,
+            since,
+            output,
+        } => {
+            let filter = audit::ExportFilter {
+                session,
+                since: since
+                    .as_deref()
+                    .map(traffic::parse_time_bound)
+                    .transpose()?,
+            };
+            let to_stdout = output == Path::new("-");
+            let mut writer: Box<dyn Write> = if to_stdout {
+                Box::new(BufWriter::new(std::io::stdout()))
+            } else {
+                Box::new(BufWriter::new(
+                    fs::File::create(&output)
+                        .with_context(|| format!("Failed to create {:?}", output))?,
+                ))
+            };
+            let written = audit::export(&dir, &filter, &mut writer)?;
+            writer.flush().context("Failed to flush export output")?;
+            if !to_stdout {
+                println!("✓ Exported {} decisions to {:?}", written, output);
+            }
+        }
+        AuditCommands::Verify {
+            file,
+            since_export,
+            json,
+        } => {
+            let reports = match file {
+                Some(ref file) => audit::verify_file(file, since_export)?,
+                None => {
+                    let mut reports = Vec::new();
+                    for path in audit::logs(&dir)? {
+                        reports.extend(audit::verify_file(&path, false)?);
+                    }
+                    reports
+                }
+            };
+            if json {
+                println!("{}", serde_json::to_string_pretty(&reports)?);
+            } else if reports.is_empty() {
+                println!("No decisions logged.");
+            } else {
+                for line in audit::render(&reports) {
+                    println!("{}", line);
+                }
+            }
+            let broken = reports.iter().filter(|r| !r.is_intact()).count();
+            if broken > 0 {
+                return Err(anyhow::anyhow!(
+                    "{} decision log(s) have been tampered with",
+                    broken
+                ));
+            }
+        }
+    }
+    Ok(())
+}
+
+pub fn handle_telemetry(command: TelemetryCommands) -> Result<()> {
+    let telemetry = Telemetry::open_default()?;
+    match command {
+        TelemetryCommands::On => {
+            telemetry.enable()?;
+            println!("✓ Anonymous usage statistics are on. Thank you!");
+            println!("  'km telemetry status' lists what is sent; 'km telemetry off' stops it.");
+            if let Some(var) = telemetry::disabled_by_env() {
+                println!("  {} is set, so nothing is sent until it's unset.", var);
+            }
+        }
+        TelemetryCommands::Off => {
+            telemetry.disable()?;
+            println!("✓ Usage statistics are off; nothing queued will be sent.");
+        }
+        TelemetryCommands::Status => {
+            let state = telemetry.state();
+            match (state.enabled, telemetry::disabled_by_env()) {
+                (true, None) => println!("Telemetry: on"),
+                (true, Some(var)) => println!("Telemetry: off ({} is set)", var),
+                (false, _) => println!("Telemetry: off"),
+            }
+            if let Some(ref install_id) = state.install_id {
+                println!(
+                    "Install ID: {} (random, not linked to your account)",
+                    install_id
+                );
+            }
+            println!(
+                "Queued events: {} (in {:?})",
+                telemetry.queued()?.len(),
+                telemetry.dir()
+            );
+            if let Some(last_upload) = state.last_upload {
+                println!(
+                    "Last upload: {}",
+                    last_upload.format("%Y-%m-%d %H:%M:%S UTC")
+                );
+            }
+            println!();
+            println!("Each km command records only these fields:");
+            for (field, description) in telemetry::FIELDS {
+                println!("  {:<15} {}", field, description);
+            }
+            println!("Arguments, payloads, file paths and account details are never recorded.");
+        }
+    }
+    Ok(())
+}
+
+pub async fn handle_flush(config_path: &Path) -> Result<()> {
+    let mut spool = Spool::open_default()?;
+    let queued = spool.count()?;
+    if queued == 0 {
+        println!("No spooled events to upload.");
+        return Ok(());
+    }
+    offline::ensure_online("Uploading spooled events")?;
+
+    let config = Config::load_with_env(config_path)
+        .context("No configuration found. Run 'km init' first.")?;
+    // Without an API key only a `km login` session could have worked
+    let code = if config.api_key.is_empty() {
+        Code::AuthMissing
+    } else {
+        Code::AuthFailed
+    };
+    let token = get_jwt_token_with_cache(config.api_key, config.api_url)
+        .await
+        .context(KmError::new(
+            code,
+            "Authentication failed; spooled events were kept",
+        ))?;
+
+    match SentBatches::open_default() {
+        Ok(sent) => spool = spool.with_sent_batches(Arc::new(sent)),
+        Err(e) => tracing::warn!("Duplicate batch checks unavailable: {:#}", e),
+    }
+
+    println!("Uploading {} spooled batch(es)...", queued);
+    let report = spool.flush(&crate::http::client(), &token.token).await?;
+
+    println!("✓ Uploaded: {}", report.sent);
+    if report.already_sent > 0 {
+        println!(
+            "✓ Already delivered, removed without resending: {}",
+            report.already_sent
+        );
+    }
+    if report.rejected > 0 {
+        println!("✗ Rejected by the API and dropped: {}", report.rejected);
+    }
+    if report.remaining > 0 {
+        if let Some(seconds) = report.retry_after_secs {
+            return Err(anyhow::anyhow!(
+                "{} batch(es) are still spooled in {:?}; the API is rate limiting, try again in {}s",
+                report.remaining,
+                spool.dir(),
+                seconds
+            ));
+        }
+        return Err(anyhow::anyhow!(
+            "{} batch(es) are still spooled in {:?}; the API may be unreachable",
+            report.remaining,
+            spool.dir()
+        ));
+    }
+
+    Ok(())
+}
+
+pub async fn handle_status(config_path: &Path, json: bool, refresh: bool) -> Result<()> {
+    let config = Config::load_with_env(config_path).ok();
+    let token = match config {
+        Some(ref config) => {
+            get_jwt_token_with_cache(config.api_key.clone(), config.api_url.clone()).await
+        }
+        None => None,
+    };
+    let api_url = config
+        .as_ref()
+        .map(|c| c.api_url.clone())
+        .unwrap_or_default();
+    let entitlement_settings = config
+        .as_ref()
+        .map(|c| c.entitlements.clone())
+        .unwrap_or_default();
+    let entitlements = match token {
+        Some(ref token) => {
+            entitlements::resolve(
+                &entitlements::default_path()?,
+                &api_url,
+                Some(token),
+                refresh,
+                &entitlement_settings,
+            )
+            .await
+        }
+        None => Entitlements::none(),
+    };
+
+    if json {
+        let account = token
+            .as_ref()
+            .and_then(|t| t.claims.user_id.clone().or_else(|| t.claims.sub.clone()));
+        let status = serde_json::json!({
+            "offline": offline::enabled(),
+            "signed_in": token.is_some(),
+            "api_url": (!api_url.is_empty()).then_some(&api_url),
+            "account": account,
+            "entitlements": entitlements,
+        });
+        println!("{}", serde_json::to_string_pretty(&status)?);
+        return Ok(());
+    }
+
+    if offline::enabled() {
+        println!("Offline mode: no API calls, plugin downloads or update checks.");
+        println!("Capture, storage, export, policies and reports work as usual.");
+        if !api_url.is_empty() {
+            println!("API:      {} (not contacted)", api_url);
+        }
+        return Ok(());
+    }
+    match (&config, &token) {
+        (None, _) => {
+            println!("Not signed in: running in local-only mode.");
+            println!("Run 'km login' or 'km init' to use cloud features.");
+            return Ok(());
+        }
+        (Some(_), None) => {
+            println!("Configured for {}, but authentication failed.", api_url);
+            println!("Running in local-only mode; see 'km doctor' for details.");
+            return Ok(());
+        }
+        (Some(_), Some(token)) => {
+            println!("API:      {}", api_url);
+            if let Some(account) = token.claims.user_id.as_ref().or(token.claims.sub.as_ref()) {
+                println!("Account:  {}", account);
+            }
+        }
+    }
+    println!("Plan:     {} ({})", entitlements.tier, entitlements.source);
+    if entitlements.features.is_empty() {
+        println!("Features: none");
+    } else {
+        println!(
+            "Features: {}",
+            entitlements
+                .features
+                .iter()
+                .cloned()
+                .collect::<Vec<_>>()
+                .join(", ")
+        );
+    }
+    if matches!(
+        entitlements.source,
+        entitlements::Source::Api | entitlements::Source::Cache
+    ) {
+        println!(
+            "Checked:  {} (next check after {})",
+            entitlements.fetched_at.format("%Y-%m-%d %H:%M:%S UTC"),
+            entitlements.expires_at.format("%Y-%m-%d %H:%M:%S UTC")
+        );
+    }
+    Ok(())
+}
+
+/// `km status --api`: how uploads are going in each running session.
+pub async fn handle_api_status(json: bool) -> Result<()> {
+    let endpoints = control::running(&control::default_dir()?).await;
+    let mut sessions = Vec::new();
+    for endpoint in &endpoints {
+        let status = async {
+            let mut client = ControlClient::connect(endpoint).await?;
+            let result = client.request(&ControlRequest::Status).await?;
+            Ok::<_, anyhow::Error>(serde_json::from_value::<control::MonitorStatus>(result)?)
+        }
+        .await;
+        match status {
+            Ok(status) => sessions.push(status),
+            Err(e) => tracing::warn!("Session {}: {:#}", endpoint.session_id, e),
+        }
+    }
+
+    if json {
+        let sessions: Vec<serde_json::Value> = sessions
+            .iter()
+            .map(|status| {
+                serde_json::json!({
+                    "session_id": status.session_id,
+                    "uploads": status.uploads,
+                    "breaker": status.breaker,
+                    "latency": status.api_latency,
+                })
+            })
+            .collect();
+        println!("{}", serde_json::to_string_pretty(&sessions)?);
+        return Ok(());
+    }
+    if sessions.is_empty() {
+        println!("No running km monitor sessions");
+        return Ok(());
+    }
+    for (i, status) in sessions.iter().enumerate() {
+        if i > 0 {
+            println!();
+        }
+        println!("Session:  {} (pid {})", status.session_id, status.pid);
+        match status.breaker {
+            Some(ref breaker) => {
+                for line in breaker::render(breaker) {
+                    println!("{}", line);
+                }
+                if let Some(ref api_latency) = status.api_latency {
+                    println!("Latency:  {}", api_latency.describe());
+                }
+            }
+            None => println!("Uploads:  off (local only)"),
+        }
+    }
+    Ok(())
+}
+
+pub fn handle_clear_logs(include_config: bool, config_path: &Path) -> Result<()> {
+    let log_files = vec!["mcp_traffic.jsonl", "mcp_requests.log", "mcp_proxy.log"];
+    let mut had_errors = false;
+
+    for file in log_files {
+        let file_path = PathBuf::from(file);
+        if file_path.exists() {
+            match fs::remove_file(&file_path) {
+                Ok(_) => println!("✓ Deleted {}", file),
+                Err(e) => {
+                    tracing::warn!("Failed to delete {}: {}", file, e);
+                    had_errors = true;
+                    // Continue processing other files
+                }
+            }
+        }
+    }
+
+    if include_config && config_path.exists() {
+        // The stored API key is named after the config file, so remove it first
+        match credentials::open(config_path)
+            .and_then(|store| store.delete(&credentials::api_key_name(config_path, None)))
+        {
+            Ok(()) => {}
+            Err(e) => tracing::warn!("Failed to remove stored API key: {:#}", e),
+        }
+        match fs::remove_file(config_path) {
+            Ok(_) => println!("✓ Deleted config at {:?}", config_path),
+            Err(e) => {
+                tracing::warn!("Failed to delete config: {}", e);
+                had_errors = true;
+            }
+        }
+    }
+
+    // Clear tokens from keyring (best effort, don't fail if keyring is unavailable)
+    match KeyringTokenStore::new() {
+        Ok(token_store) => {
+            if token_store.token_exists() {
+                if let Err(e) = token_store.clear_tokens() {
+                    tracing::warn!("Failed to clear tokens from keyring: {}", e);
+                    // Don't mark as error - keyring might not be available in CI
+                } else {
+                    println!("✓ Cleared tokens from keyring");
+                }
+            }
+        }
+        Err(e) => {
+            // Keyring not available (e.g., in CI), just log and continue
+            tracing::debug!("Keyring not available: {}", e);
+        }
+    }
+
+    if had_errors {
+        println!("Logs cleared with some warnings (see above).");
+    } else {
+        println!("All logs cleared.");
+    }
+
+    Ok(())
+}
+
+fn mask_secret(secret: &str) -> String {
+    if secret.len() > 8 {
+        format!("{}...{}", &secret[..4], &secret[secret.len() - 4..])
+    } else {
+        "****".to_string()
+    }
+}
+
+pub fn handle_config(
+    config_path: &PathBuf,
+    show_secrets: bool,
+    command: Option<ConfigCommands>,
+) -> Result<()> {
+    let command = match command {
+        // Sets up a machine that may have no config yet
+        Some(ConfigCommands::Import { bundle, force }) => {
+            return handle_config_import(config_path, &bundle, force)
+        }
+        // Needs no config file
+        Some(ConfigCommands::Schema { output }) => return handle_config_schema(output),
+        Some(command) => command,
+        None => return handle_show_config(config_path, show_secrets),
+    };
+
+    if !Config::exists(config_path) {
+        return Err(KmError::new(
+            Code::ConfigNotFound,
+            format!(
+                "No configuration found at {:?}. Run 'km init' to create one.",
+                config_path
+            ),
+        )
+        .into());
+    }
+    let profile = config::active_profile();
+    // The file as written, with the top-level API key filled in from the
+    // credential store; `resolve` applies the selected profile on top
+    let mut config = Config::load(config_path)?;
+    if config.api_key.is_empty() {
+        config.api_key = credentials::load_api_key(config_path, None).unwrap_or_default();
+    }
+    let resolve = |config: &Config| -> Result<Config> {
+        let mut resolved = config.with_profile(profile.as_deref())?;
+        if profile.is_some() {
+            if let Some(api_key) = credentials::load_api_key(config_path, profile.as_deref()) {
+                resolved.api_key = api_key;
+            }
+        }
+        Ok(resolved)
+    };
+    let display = |config: &Config, key: &str| -> Result<String> {
+        let value = config.get(key)?;
+        Ok(if key == "api_key" && !show_secrets {
+            mask_secret(&value)
+        } else {
+            value
+        })
+    };
+
+    // What commands see: the file over the team's remote layer
+    let api_key = config.api_key.clone();
+    let effective = || -> Result<Config> {
+        let mut layered = Config::load_layered(config_path)?;
+        if layered.api_key.is_empty() {
+            layered.api_key = api_key.clone();
+        }
+        resolve(&layered)
+    };
+
+    match command {
+        ConfigCommands::Get { key } => println!("{}", display(&effective()?, &key)?),
+        ConfigCommands::Set { key, value } => {
+            let existing = config.validate();
+            match profile.as_deref() {
+                Some(_) if key == "api_key" => {}
+                Some(profile) => config.set_in_profile(profile, &key, &value)?,
+                None => config.set(&key, &value)?,
+            }
+
+            // Only refuse problems introduced by this change, so a config
+            // that was already broken can still be fixed one key at a time
+            let introduced: Vec<String> = config
+                .validate()
+                .into_iter()
+                .filter(|p| !existing.contains(p))
+                .collect();
+            if !introduced.is_empty() {
+                return Err(anyhow::anyhow!(
+                    "Not saving invalid configuration: {}",
+                    introduced.join("; ")
+                ));
+            }
+
+            let store = credentials::open(config_path)?;
+            if key == "api_key" {
+                let name = credentials::api_key_name(config_path, profile.as_deref());
+                match value.as_str() {
+                    "" => store.delete(&name)?,
+                    // A profile's key is stored directly; the top-level one by save_config
+                    _ if profile.is_some() => store.set(&name, &value)?,
+                    _ => {}
+                }
+            }
+            credentials::save_config(&mut config, config_path, store.as_ref())?;
+            println!("✓ {} = {}", key, display(&resolve(&config)?, &key)?);
+        }
+        ConfigCommands::List => {
+            let resolved = effective()?;
+            for key in CONFIG_KEYS {
+                println!("{} = {}", key, display(&resolved, key)?);
+            }
+        }
+        ConfigCommands::Profiles => {
+            if config.profiles.is_empty() {
+                println!("No profiles in {:?}", config_path);
+            }
+            for name in config.profiles.keys() {
+                let marker = if profile.as_deref() == Some(name.as_str()) {
+                    "*"
+                } else {
+                    " "
+                };
+                let api_url = config
+                    .with_profile(Some(name))
+                    .map(|c| c.api_url)
+                    .unwrap_or_else(|e| format!("invalid: {:#}", e));
+                println!("{} {:<20} {}", marker, name, api_url);
+            }
+        }
+        ConfigCommands::Validate => {
+            let mut problems = config::schema_problems(config_path)?;
+            problems.extend(config.validate());
+            if problems.is_empty() {
+                println!("✓ Configuration at {:?} is valid", config_path);
+            } else {
+                for problem in &problems {
+                    println!("✗ {}", problem);
+                }
+                return Err(KmError::new(
+                    Code::ConfigInvalid,
+                    format!("Configuration has {} problem(s)", problems.len()),
+                )
+                .into());
+            }
+        }
+        ConfigCommands::Export {
+            bundle,
+            include_secrets,
+        } => handle_config_export(config_path, config, &bundle, include_secrets)?,
+        ConfigCommands::Import { .. } | ConfigCommands::Schema { .. } => {
+            unreachable!("handled above")
+        }
+        ConfigCommands::Source { .. } => unreachable!("handled in main"),
+    }
+
+    Ok(())
+}
+
+/// `km config schema`: the JSON Schema of the config file. Pointing the
+/// file's `$schema` at a saved copy gets editors to complete and check it.
+fn handle_config_schema(output: Option<PathBuf>) -> Result<()> {
+    let schema = serde_json::to_string_pretty(&config_schema::schema())?;
+    match output {
+        Some(path) => {
+            fs::write(&path, schema + "\n")
+                .with_context(|| format!("Failed to write the schema to {:?}", path))?;
+            println!("✓ Wrote the config schema to {}", path.display());
+        }
+        None => println!("{}", schema),
+    }
+    Ok(())
+}
+
+/// `km config source`: each setting's value and the layer it comes from,
+/// after fetching the remote layer again with `--refresh`.
+pub async fn handle_config_source(
+    config_path: &Path,
+    show_secrets: bool,
+    key: Option<String>,
+    refresh: bool,
+) -> Result<()> {
+    if !Config::exists(config_path) {
+        return Err(KmError::new(
+            Code::ConfigNotFound,
+            format!(
+                "No configuration found at {:?}. Run 'km init' to create one.",
+                config_path
+            ),
+        )
+        .into());
+    }
+    if let Some(ref key) = key {
+        if !CONFIG_KEYS.contains(&key.as_str()) {
+            // The same message `km config get` gives
+            Config::default().get(key)?;
+        }
+    }
+    if refresh {
+        match refresh_remote_config(config_path, true).await? {
+            Some(layer) => println!("✓ Fetched the remote config from {}", layer.source),
+            None => println!("⚠ No remote config is set up (remote_config.source)"),
+        }
+    }
+
+    let file = Config::load(config_path)?;
+    match file.remote_config.url(&file.api_url) {
+        Some(url) => {
+            match remote_config::cached_layer(config_path, &file.remote_config, &file.api_url) {
+                Some(layer) => println!(
+                    "Remote config: {} (fetched {})",
+                    layer.source,
+                    layer.fetched_at.format("%Y-%m-%d %H:%M:%S UTC")
+                ),
+                None => println!(
+                    "Remote config: {} (not fetched yet; run 'km config source --refresh')",
+                    url
+                ),
+            }
+        }
+        None => println!("Remote config: none"),
+    }
+
+    let settings = Config::load_with_env(config_path)?;
+    for (name, source) in config::sources(config_path)? {
+        if key.as_deref().is_some_and(|key| key != name) {
+            continue;
+        }
+        let value = settings.get(name)?;
+        let value = if name == "api_key" && !show_secrets {
+            mask_secret(&value)
+        } else {
+            value
+        };
+        println!("{:<34} {:<40} {}", name, value, source);
+    }
+    Ok(())
+}
+
+/// Fetch and cache the remote config layer the config file names, unless
+/// the cached copy is still fresh and `force` is off. Returns the new layer,
+/// or `None` when nothing was fetched.
+async fn refresh_remote_config(
+    config_path: &Path,
+    force: bool,
+) -> Result<Option<remote_config::Layer>> {
+    if !Config::exists(config_path) {
+        return Ok(None);
+    }
+    // The file as written says where the layer comes from; a layer can't
+    // move itself
+    let file = Config::load(config_path)?;
+    let remote = &file.remote_config;
+    if remote.source.is_none()
+        || (!force && !remote_config::is_stale(config_path, remote, &file.api_url))
+    {
+        return Ok(None);
+    }
+    let token = if remote.uses_api() {
+        let settings = Config::load_with_env(config_path)?;
+        get_jwt_token_with_cache(settings.api_key, file.api_url.clone())
+            .await
+            .map(|t| t.token)
+    } else {
+        None
+    };
+    remote_config::refresh(config_path, remote, &file.api_url, token.as_deref())
+        .await
+        .map(Some)
+}
+
+/// `km config export --bundle`: the config file as written, with the API
+/// keys from the credential store when secrets are included, and the
+/// installed rule packs.
+fn handle_config_export(
+    config_path: &Path,
+    mut config: Config,
+    path: &Path,
+    include_secrets: bool,
+) -> Result<()> {
+    if include_secrets && !config.profiles.is_empty() {
+        let store = credentials::open(config_path)?;
+        for (name, section) in config.profiles.iter_mut() {
+            let key = store.get(&credentials::api_key_name(config_path, Some(name)))?;
+            if let (Some(key), Some(section)) = (key, section.as_object_mut()) {
+                section.insert("api_key".to_string(), serde_json::Value::String(key));
+            }
+        }
+    }
+    let packs = RuleStore::from_config(&config.risk_rules)?
+        .installed()?
+        .into_iter()
+        .map(|installed| installed.pack)
+        .collect();
+    let bundle = Bundle::create(&config, packs, include_secrets)?;
+    bundle.write(path)?;
+
+    println!("✓ Wrote {:?}", path);
+    println!("  Profiles:   {}", config.profiles.len());
+    println!("  Rule packs: {}", bundle.manifest.rules.len());
+    if include_secrets {
+        println!("⚠ The bundle contains secrets; share it only with people who may use them");
+    } else if !bundle.manifest.withheld.is_empty() {
+        println!(
+            "  Left out:   {} (use --include-secrets to bundle them)",
+            bundle.manifest.withheld.join(", ")
+        );
+    }
+    Ok(())
+}
+
+/// `km config import`: write the bundled config, keeping the settings the
+/// bundle left out from the config it replaces, and install its rule packs.
+fn handle_config_import(config_path: &Path, path: &Path, force: bool) -> Result<()> {
+    let bundle = Bundle::read(path)?;
+    let local = if Config::exists(config_path) {
+        if !force {
+            return Err(anyhow::anyhow!(
+                "{:?} already exists; pass --force to replace it",
+                config_path
+            ));
+        }
+        let mut local = Config::load(config_path)?;
+        if local.api_key.is_empty() {
+            local.api_key = credentials::load_api_key(config_path, None).unwrap_or_default();
+        }
+        Some(local)
+    } else {
+        None
+    };
+    let (mut config, missing) = bundle.config_for(local.as_ref())?;
+
+    // API keys go to the credential store, never into the file
+    let store = credentials::open(config_path)?;
+    for (name, section) in config.profiles.iter_mut() {
+        let Some(section) = section.as_object_mut() else {
+            continue;
+        };
+        if let Some(serde_json::Value::String(key)) = section.remove("api_key") {
+            store.set(&credentials::api_key_name(config_path, Some(name)), &key)?;
+        }
+    }
+    if let Some(dir) = config_path.parent().filter(|d| !d.as_os_str().is_empty()) {
+        fs::create_dir_all(dir).context("Failed to create config directory")?;
+    }
+    credentials::save_config(&mut config, config_path, store.as_ref())?;
+
+    let rules = RuleStore::from_config(&config.risk_rules)?;
+    for pack in &bundle.rules {
+        rules.install(pack)?;
+    }
+
+    println!(
+        "✓ Imported {:?} (made {} by km {})",
+        path,
+        bundle.manifest.created_at.format("%Y-%m-%d %H:%M"),
+        bundle.manifest.km_version
+    );
+    println!("  Config:     {:?}", config_path);
+    println!("  Profiles:   {}", config.profiles.len());
+    println!("  Rule packs: {} in {:?}", bundle.rules.len(), rules.dir());
+    if !missing.is_empty() {
+        println!(
+            "⚠ Not in the bundle, set these yourself: {}",
+            missing.join(", ")
+        );
+    }
+    if config.api_key.is_empty() {
+        config.api_key = credentials::load_api_key(config_path, None).unwrap_or_default();
+    }
+    for problem in config.validate() {
+        println!("⚠ {}", problem);
+    }
+    Ok(())
+}
+
+pub fn handle_show_config(config_path: &PathBuf, show_secrets: bool) -> Result<()> {
+    if !Config::exists(config_path) {
+        println!("No configuration found. Run 'km init' to create one.");
+        return Ok(());
+    }
+
+    let profile = config::active_profile();
+    let mut config = Config::load(config_path)?.with_profile(profile.as_deref())?;
+    if let Some(api_key) = credentials::load_api_key(config_path, profile.as_deref()) {
+        config.api_key = api_key;
+    }
+
+    println!("Configuration at {:?}:", config_path);
+    if let Some(profile) = &profile {
+        println!("  Profile: {}", profile);
+    }
+    println!("  API URL: {}", config.api_url);
+
+    if show_secrets {
+        println!("  API Key: {}", config.api_key);
+    } else {
+        println!(
+            "  API Key: {} (use --show-secrets to reveal)",
+            mask_secret(&config.api_key)
+        );
+    }
+
+    if let Some(tier) = &config.default_tier {
+        println!("  Default Tier: {}", tier);
+    }
+
+    Ok(())
+}
+
+pub fn handle_logs(
+    file: PathBuf,
+    requests: bool,
+    responses: bool,
+    method: Option<String>,
+    tail: bool,
+    lines: Option<usize>,
+) -> Result<()> {
+    if !file.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", file));
+    }
+
+    let contents = fs::read_to_string(&file)?;
+    let all_lines: Vec<&str> = contents.lines().collect();
+
+    let filtered_lines: Vec<&str> = all_lines
+        .iter()
+        .filter(|line| {
+            if let Ok(json) = serde_json::from_str::<serde_json::Value>(line) {
+                // Filter by direction
+                if requests && json.get("direction") == Some(&serde_json::json!("response")) {
+                    return false;
+                }
+                if responses && json.get("direction") == Some(&serde_json::json!("request")) {
+                    return false;
+                }
+
+                // Filter by method
+                if let Some(ref m) = method {
+                    if let Some(content) = json.get("content").and_then(|c| c.as_str()) {
+                        if let Ok(rpc) = serde_json::from_str::<serde_json::Value>(content) {
+                            if rpc.get("method").and_then(|v| v.as_str()) != Some(m) {
+                                return false;
+                            }
+                        }
+                    }
+                }
+
+                true
+            } else {
+                false
+            }
+        })
+        .copied()
+        .collect();
+
+    let display_lines = if let Some(n) = lines {
+        filtered_lines.iter().rev().take(n).rev().copied().collect()
+    } else {
+        filtered_lines
+    };
+
+    for line in display_lines {
+        if let Ok(json) = serde_json::from_str::<serde_json::Value>(line) {
+            println!("{}", serde_json::to_string_pretty(&json)?);
+        }
+    }
+
+    if tail {
+        println!("\nTail mode not yet implemented.");
+    }
+
+    Ok(())
+}
+
+pub fn handle_export(
+    file: PathBuf,
+    output: PathBuf,
+    format: Option<ExportFormat>,
+    options: ExportOptions,
+) -> Result<()> {
+    if !file.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", file));
+    }
+
+    let format = match format.or_else(|| ExportFormat::from_path(&output)) {
+        Some(format) => format,
+        None => {
+            return Err(anyhow::anyhow!(
+                "Cannot infer export format from {:?}; pass --format jsonl|csv|parquet",
+                output
+            ))
+        }
+    };
+
+    let filter = ExportFilter {
+        session_id: options.session,
+        since: options
+            .since
+            .as_deref()
+            .map(traffic::parse_time_bound)
+            .transpose()?,
+        until: options
+            .until
+            .as_deref()
+            .map(traffic::parse_time_bound)
+            .transpose()?,
+        method: options.method,
+    };
+
+    let mut entries = traffic::read_entries(&file)?;
+    clock::normalize(&mut entries);
+    let mut records = export::collect_records(&entries, &filter);
+    if options.anonymize {
+        export::anonymize_records(&mut records, &Anonymizer::from_env()?);
+    }
+    export::write_records(&records, format, &output)?;
+
+    if output != Path::new("-") {
+        println!("✓ Exported {} events to {:?}", records.len(), output);
+    }
+
+    Ok(())
+}
+
+pub fn handle_merge(inputs: Vec<PathBuf>, output: PathBuf, options: MergeOptions) -> Result<()> {
+    use std::io::{BufWriter, Write};
+
+    let mut captures = Vec::with_capacity(inputs.len());
+    for (path, name) in inputs.iter().zip(merge::source_names(&inputs)) {
+        if !path.exists() {
+            return Err(anyhow::anyhow!("Capture {:?} not found", path));
+        }
+        if merge::is_output(path, &output) {
+            return Err(anyhow::anyhow!(
+                "{:?} is both an input and the output",
+                path
+            ));
+        }
+        let entries = traffic::read_entries(path)?;
+        captures.push(merge::Capture { name, entries });
+    }
+    let merged = merge::merge(captures, &options);
+
+    let mut writer: Box<dyn Write> = if output == Path::new("-") {
+        Box::new(BufWriter::new(std::io::stdout()))
+    } else {
+        Box::new(BufWriter::new(
+            fs::File::create(&output).with_context(|| format!("Failed to create {:?}", output))?,
+        ))
+    };
+    merge::write_entries(&merged, &mut writer)?;
+    writer
+        .flush()
+        .context("Failed to flush the merged capture")?;
+
+    if output != Path::new("-") {
+        println!(
+            "✓ Merged {} events from {} captures into {:?}",
+            merged.len(),
+            inputs.len(),
+            output
+        );
+    }
+    Ok(())
+}
+
+pub fn handle_replay(
+    config_path: &Path,
+    file: PathBuf,
+    session: Option<String>,
+    speed: f64,
+    timeout: u64,
+    target: Vec<String>,
+) -> Result<()> {
+    if !file.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", file));
+    }
 
-        if user_tier != "free" {
-            tracing::info!("Adding risk analysis for paid tier user");
-            pipeline = pipeline.add_filter(Box::new(RiskAnalysisFilter::new(
-                format!("{}/api/risk/analyze", api_url),
-                0.8,
-            )));
+    let entries = traffic::read_entries(&file)?;
+    let session = replay::select_session(&entries, session.as_deref());
+    let steps = replay::build_steps(&entries, session.as_deref());
+    if steps.is_empty() {
+        return Err(anyhow::anyhow!("No client messages found to replay"));
+    }
+
+    // The same checks monitor runs on client messages
+    let settings = Config::load_with_env(config_path).unwrap_or_default();
+    let mut policy = None;
+    if !settings.policies.is_default() {
+        let rules = Policy::from_config(&settings.policies).context("Invalid policies")?;
+        if !rules.is_empty() {
+            policy = Some(rules);
         }
+    }
+    let checks = ReplayChecks::new(pattern_analyzer(&settings), policy);
 
-        pipeline
+    println!(
+        "Replaying {} messages from session {}",
+        steps.len(),
+        session.as_deref().unwrap_or("(none)")
+    );
+
+    let results = if target.is_empty() {
+        replay::replay_dry_run(&steps, speed, &checks)
     } else {
-        // Fallback case (should not happen but be safe)
-        tracing::info!("Fallback to local logging only");
-        // Use separate log file for command metadata vs MCP traffic
-        let metadata_log = log_file
-            .parent()
-            .unwrap_or_else(|| std::path::Path::new("."))
-            .join("km_commands.log");
-        FilterPipeline::new().add_filter(Box::new(LocalLoggerFilter::new(metadata_log)))
+        println!("Target: {}", target.join(" "));
+        replay::replay_against_server(
+            &steps,
+            &target[0],
+            &target[1..],
+            speed,
+            std::time::Duration::from_secs(timeout),
+            &checks,
+        )?
     };
 
-    match pipeline.execute(proxy_context).await {
-        Ok(filtered_request) => {
-            tracing::info!("Request approved, executing proxy");
-            proxy::run_proxy(&filtered_request.command, &filtered_request.args, &log_file)?;
+    for result in &results {
+        let method = result.step.method.as_deref().unwrap_or("(unknown)");
+        let duration = result
+            .duration_ms
+            .map(|d| format!(" {:.1}ms", d))
+            .unwrap_or_default();
+        let status = match &result.outcome {
+            ReplayOutcome::Sent => "→".to_string(),
+            ReplayOutcome::Match => "✓ match".to_string(),
+            ReplayOutcome::Mismatch { expected, actual } => {
+                format!(
+                    "✗ mismatch\n    expected: {}\n    actual:   {}",
+                    expected, actual
+                )
+            }
+            ReplayOutcome::Timeout => "✗ timeout".to_string(),
+            ReplayOutcome::Blocked { rule, message } => {
+                format!("✗ blocked by policy {}: {}", rule, message)
+            }
+        };
+        println!(
+            "[+{:>8.3}s] {}{} {}",
+            result.step.offset.as_secs_f64(),
+            method,
+            duration,
+            status
+        );
+        let risk = &result.checked.risk;
+        if risk.level >= RiskLevel::Medium {
+            println!(
+                "    risk: {} (score {:.2}) {}",
+                risk.level,
+                risk.score,
+                risk.matched_patterns.join(", ")
+            );
         }
-        Err(e) => {
-            return Err(anyhow::anyhow!("Request blocked: {}", e));
+        if let Some(decision) = &result.checked.policy {
+            println!(
+                "    policy: {} ({:?})",
+                decision.rule().unwrap_or_default(),
+                decision.action()
+            );
         }
     }
 
+    let summary = ReplaySummary::from_results(&results);
+    println!();
+    println!(
+        "Sent: {}  Matched: {}  Mismatched: {}  Timed out: {}  Blocked: {}  High risk: {}",
+        summary.sent,
+        summary.matched,
+        summary.mismatched,
+        summary.timed_out,
+        summary.blocked,
+        summary.high_risk
+    );
+
+    if !summary.is_success() {
+        return Err(anyhow::anyhow!(
+            "Replay found differences against the live server"
+        ));
+    }
+
     Ok(())
 }
 
-pub fn handle_clear_logs(include_config: bool, config_path: &Path) -> Result<()> {
-    let log_files = vec!["mcp_traffic.jsonl", "mcp_requests.log", "mcp_proxy.log"];
-    let mut had_errors = false;
+pub fn handle_probe(
+    target: Vec<String>,
+    options: ProbeOptions,
+    log_file: Option<PathBuf>,
+    json: bool,
+) -> Result<()> {
+    if target.is_empty() {
+        return Err(anyhow::anyhow!("No server command provided to probe"));
+    }
+    if !json {
+        println!("Probing: {}", target.join(" "));
+    }
+    let report = probe::probe(&target[0], &target[1..], &options, log_file.as_deref())?;
 
-    for file in log_files {
-        let file_path = PathBuf::from(file);
-        if file_path.exists() {
-            match fs::remove_file(&file_path) {
-                Ok(_) => println!("✓ Deleted {}", file),
-                Err(e) => {
-                    tracing::warn!("Failed to delete {}: {}", file, e);
-                    had_errors = true;
-                    // Continue processing other files
-                }
+    if json {
+        println!("{}", serde_json::to_string_pretty(&report)?);
+    } else {
+        println!(
+            "Server:    {}",
+            report.server.as_deref().unwrap_or("(unknown)")
+        );
+        println!(
+            "Protocol:  {}",
+            report.protocol_version.as_deref().unwrap_or("(unknown)")
+        );
+        println!(
+            "Tools:     {}{}",
+            report.tools.len(),
+            if report.tools.is_empty() {
+                String::new()
+            } else {
+                format!(" ({})", report.tools.join(", "))
             }
+        );
+        if let Some(resources) = report.resources {
+            println!("Resources: {}", resources);
+        }
+        println!();
+        println!(
+            "  {:<32} {:>6} {:>7} {:>9} {:>9} {:>9} {:>9} {:>9}",
+            "Method", "Calls", "Errors", "No reply", "p50", "p90", "p99", "max"
+        );
+        let ms = |value: f64| format!("{:.1}ms", value);
+        for method in &report.methods {
+            let latency = method
+                .latency
+                .as_ref()
+                .map(|l| [ms(l.p50), ms(l.p90), ms(l.p99), ms(l.max)])
+                .unwrap_or_else(|| std::array::from_fn(|_| "-".to_string()));
+            println!(
+                "  {:<32} {:>6} {:>7} {:>9} {:>9} {:>9} {:>9} {:>9}",
+                method.method,
+                method.calls,
+                method.errors,
+                method.unanswered,
+                latency[0],
+                latency[1],
+                latency[2],
+                latency[3]
+            );
+        }
+        if report.tool_calls > 0 {
+            println!();
+            println!(
+                "Tool calls: {} in {:.1}s ({:.1}/s)",
+                report.tool_calls,
+                report.elapsed_secs,
+                report.throughput()
+            );
+        }
+        println!();
+        if report.problems.is_empty() {
+            println!("✓ No protocol problems found");
+        }
+        for problem in &report.problems {
+            println!("✗ {}", problem);
+        }
+        if let Some(ref log_file) = log_file {
+            println!(
+                "Traffic recorded as session {} in {:?}",
+                report.session_id, log_file
+            );
         }
     }
 
-    if include_config && config_path.exists() {
-        match fs::remove_file(config_path) {
-            Ok(_) => println!("✓ Deleted config at {:?}", config_path),
-            Err(e) => {
-                tracing::warn!("Failed to delete config: {}", e);
-                had_errors = true;
-            }
-        }
+    if !report.is_success() {
+        return Err(anyhow::anyhow!("The server failed the probe"));
     }
+    Ok(())
+}
 
-    // Clear tokens from keyring (best effort, don't fail if keyring is unavailable)
-    match KeyringTokenStore::new() {
-        Ok(token_store) => {
-            if token_store.token_exists() {
-                if let Err(e) = token_store.clear_tokens() {
-                    tracing::warn!("Failed to clear tokens from keyring: {}", e);
-                    // Don't mark as error - keyring might not be available in CI
-                } else {
-                    println!("✓ Cleared tokens from keyring");
-                }
-            }
-        }
-        Err(e) => {
-            // Keyring not available (e.g., in CI), just log and continue
-            tracing::debug!("Keyring not available: {}", e);
-        }
+pub fn handle_mock(from: PathBuf, session: Option<String>, strict: bool) -> Result<()> {
+    if !from.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", from));
     }
 
-    if had_errors {
-        println!("Logs cleared with some warnings (see above).");
-    } else {
-        println!("All logs cleared.");
+    let entries = traffic::read_entries(&from)?;
+    let session = match session {
+        Some(ref id) => {
+            let summaries = sessions::summarize(&entries);
+            Some(sessions::resolve(&summaries, id)?.id.clone())
+        }
+        None => None,
+    };
+    let mut server = MockServer::from_entries(&entries, session.as_deref(), strict);
+    if server.recorded() == 0 {
+        return Err(anyhow::anyhow!("No recorded responses found in {:?}", from));
     }
 
+    // stdout carries the protocol; everything else goes to stderr
+    eprintln!(
+        "km mock: serving {} recorded responses from {:?}",
+        server.recorded(),
+        from
+    );
+    server
+        .serve(std::io::stdin().lock(), std::io::stdout().lock())
+        .context("Failed to serve the client")?;
+    let stats = &server.stats;
+    eprintln!(
+        "km mock: {} exact matches, {} by method, {} without a recording",
+        stats.exact, stats.by_method, stats.missed
+    );
     Ok(())
 }
 
-pub fn handle_show_config(config_path: &PathBuf, show_secrets: bool) -> Result<()> {
-    if !Config::exists(config_path) {
-        println!("No configuration found. Run 'km init' to create one.");
+pub fn handle_dashboard(file: PathBuf, session: Option<String>, once: bool) -> Result<()> {
+    if once {
+        if !file.exists() {
+            return Err(anyhow::anyhow!("Log file {:?} not found", file));
+        }
+        let entries = traffic::read_entries(&file)?;
+        let stats = dashboard::snapshot(&entries, session.as_deref());
+        for line in dashboard::render_lines(&stats, chrono::Utc::now()) {
+            println!("{}", line);
+        }
         return Ok(());
     }
 
-    let config = Config::load(config_path)?;
+    dashboard::run(file, session)
+}
 
-    println!("Configuration at {:?}:", config_path);
-    println!("  API URL: {}", config.api_url);
+pub fn handle_search(file: PathBuf, query: &str, json: bool, limit: Option<usize>) -> Result<()> {
+    let query = search::Query::parse(query).context("Invalid search query")?;
+    if !file.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", file));
+    }
+    let entries = traffic::read_entries(&file)?;
+    let mut hits = search::search(&entries, &query);
+    if let Some(limit) = limit {
+        hits.drain(..hits.len().saturating_sub(limit));
+    }
 
-    if show_secrets {
-        println!("  API Key: {}", config.api_key);
+    let lines = if json {
+        hits.iter()
+            .map(serde_json::to_string)
+            .collect::<serde_json::Result<_>>()?
+    } else if hits.is_empty() {
+        vec![format!("No matching events in {:?}", file)]
     } else {
-        let masked = if config.api_key.len() > 8 {
-            format!(
-                "{}...{}",
-                &config.api_key[..4],
-                &config.api_key[config.api_key.len() - 4..]
-            )
+        search::render(&hits)
+    };
+    for line in lines {
+        println!("{}", line);
+    }
+    Ok(())
+}
+
+pub fn handle_tail(session: Option<String>, json: bool) -> Result<()> {
+    let endpoints = tail::running(&tail::default_dir()?);
+    let endpoint = tail::resolve(&endpoints, session.as_deref())?;
+    let events = tail::subscribe(endpoint)?;
+    if !json {
+        eprintln!("Tailing session {} (Ctrl+C to stop)", endpoint.session_id);
+    }
+
+    use std::io::Write;
+    let mut printer = TailPrinter::new();
+    let mut stdout = std::io::stdout().lock();
+    for line in events {
+        let line = line.context("Lost the connection to the session")?;
+        let written = if json {
+            writeln!(stdout, "{}", line)
         } else {
-            "****".to_string()
+            match serde_json::from_str::<traffic::TrafficEntry>(&line) {
+                Ok(entry) => writeln!(stdout, "{}", printer.render(&entry)),
+                Err(_) => continue,
+            }
         };
-        println!("  API Key: {} (use --show-secrets to reveal)", masked);
+        // Stop quietly when piped into something that exits, like `head`
+        if written.and_then(|_| stdout.flush()).is_err() {
+            return Ok(());
+        }
     }
+    if !json {
+        eprintln!("Session {} ended", endpoint.session_id);
+    }
+    Ok(())
+}
 
-    if let Some(tier) = &config.default_tier {
-        println!("  Default Tier: {}", tier);
+pub async fn handle_ctl(session: Option<String>, json: bool, command: CtlCommands) -> Result<()> {
+    let endpoints = control::running(&control::default_dir()?).await;
+    if command == CtlCommands::List {
+        if json {
+            println!("{}", serde_json::to_string_pretty(&endpoints)?);
+        } else if endpoints.is_empty() {
+            println!("No running km monitor sessions");
+        } else {
+            for endpoint in &endpoints {
+                println!(
+                    "{}  pid {:<7}  started {}",
+                    endpoint.session_id,
+                    endpoint.pid,
+                    endpoint.started_at.format("%Y-%m-%d %H:%M:%S UTC")
+                );
+            }
+        }
+        return Ok(());
     }
 
+    let endpoint = control::resolve(&endpoints, session.as_deref())?;
+    let mut client = ControlClient::connect(endpoint).await?;
+    let verbose = matches!(command, CtlCommands::Status { verbose: true });
+    let request = match command {
+        CtlCommands::List => unreachable!("handled above"),
+        CtlCommands::Status { .. } => ControlRequest::Status,
+        CtlCommands::Flush => ControlRequest::Flush,
+        CtlCommands::Filters {
+            methods,
+            all_methods,
+            payload_size_limit,
+        } => {
+            let method_whitelist = match (methods.is_empty(), all_methods) {
+                (_, true) => Some(Vec::new()),
+                (false, false) => Some(methods),
+                (true, false) => None,
+            };
+            if method_whitelist.is_none() && payload_size_limit.is_none() {
+                return Err(anyhow::anyhow!(
+                    "Nothing to change; pass --method, --all-methods or --payload-size-limit"
+                ));
+            }
+            ControlRequest::UpdateFilters {
+                method_whitelist,
+                payload_size_limit,
+            }
+        }
+        CtlCommands::ReloadPlugins => ControlRequest::ReloadPlugins,
+        CtlCommands::Pending => ControlRequest::PendingApprovals,
+        CtlCommands::Approve { id } => ControlRequest::Decide { id, approve: true },
+        CtlCommands::Deny { id } => ControlRequest::Decide { id, approve: false },
+        CtlCommands::Events => {
+            client.stream_events().await?;
+            let mut printer = TailPrinter::new();
+            while let Some(line) = client.next_event().await? {
+                if json {
+                    println!("{}", line);
+                } else if let Ok(entry) = serde_json::from_str::<traffic::TrafficEntry>(&line) {
+                    println!("{}", printer.render(&entry));
+                }
+            }
+            return Ok(());
+        }
+    };
+
+    let result = client.request(&request).await?;
+    if json {
+        println!("{}", serde_json::to_string_pretty(&result)?);
+        return Ok(());
+    }
+    match request {
+        ControlRequest::Status => {
+            let status: control::MonitorStatus = serde_json::from_value(result)?;
+            for line in control::render_status(&status, chrono::Utc::now()) {
+                println!("{}", line);
+            }
+            if verbose {
+                for line in latency::render(&status.latency) {
+                    println!("{}", line);
+                }
+            }
+        }
+        ControlRequest::Flush => {
+            let outcome: control::FlushOutcome = serde_json::from_value(result)?;
+            if outcome.events {
+                println!("✅ Sent buffered events to the uploader");
+            } else {
+                println!("Event uploads are off for this session");
+            }
+            if let Some(spool) = outcome.spool {
+                println!(
+                    "Spool: {} sent, {} rejected, {} remaining",
+                    spool.sent, spool.rejected, spool.remaining
+                );
+            }
+        }
+        ControlRequest::UpdateFilters { .. } => {
+            let methods: Vec<String> = result
+                .get("method_whitelist")
+                .cloned()
+                .map(serde_json::from_value)
+                .transpose()?
+                .unwrap_or_default();
+            if methods.is_empty() {
+                println!("✅ Capturing all methods");
+            } else {
+                println!("✅ Capturing only {}", methods.join(", "));
+            }
+            match result.get("payload_size_limit").and_then(|v| v.as_u64()) {
+                Some(limit) => println!("   Uploads omit payloads over {} bytes", limit),
+                None => println!("   Uploads keep payloads of any size"),
+            }
+        }
+        ControlRequest::ReloadPlugins => {
+            let names: Vec<String> = result
+                .get("plugins")
+                .cloned()
+                .map(serde_json::from_value)
+                .transpose()?
+                .unwrap_or_default();
+            if names.is_empty() {
+                println!("✅ Plugins reloaded; none are running");
+            } else {
+                println!("✅ Plugins reloaded: {}", names.join(", "));
+            }
+        }
+        ControlRequest::PendingApprovals => {
+            let pending: Vec<approval::PendingApproval> = serde_json::from_value(result)?;
+            for line in approval::render_pending(&pending, chrono::Utc::now()) {
+                println!("{}", line);
+            }
+        }
+        ControlRequest::Decide { id, approve } => {
+            if approve {
+                println!("✅ Approved request #{}", id);
+            } else {
+                println!("⛔ Denied request #{}", id);
+            }
+        }
+        ControlRequest::StreamEvents => {}
+    }
     Ok(())
 }
 
-pub fn handle_logs(
-    file: PathBuf,
-    requests: bool,
-    responses: bool,
-    method: Option<String>,
-    tail: bool,
-    lines: Option<usize>,
-) -> Result<()> {
+pub fn handle_sessions(file: PathBuf, json: bool, command: SessionsCommands) -> Result<()> {
     if !file.exists() {
         return Err(anyhow::anyhow!("Log file {:?} not found", file));
     }
+    let entries = traffic::read_entries(&file)?;
+    let summaries = sessions::summarize(&entries);
 
-    let contents = fs::read_to_string(&file)?;
-    let all_lines: Vec<&str> = contents.lines().collect();
+    let lines = match command {
+        SessionsCommands::List {
+            since,
+            limit,
+            labels,
+        } => {
+            let mut summaries = match since {
+                Some(since) => sessions::since(summaries, traffic::parse_time_bound(&since)?),
+                None => summaries,
+            };
+            summaries.retain(|s| traffic::has_labels(&s.labels, &labels));
+            summaries.truncate(limit.unwrap_or(usize::MAX));
+            if json {
+                vec![serde_json::to_string_pretty(&summaries)?]
+            } else if summaries.is_empty() {
+                vec![format!("No sessions found in {:?}", file)]
+            } else {
+                sessions::render_list(&summaries)
+            }
+        }
+        SessionsCommands::Show { id } => {
+            let session = sessions::resolve(&summaries, &id)?;
+            if json {
+                vec![serde_json::to_string_pretty(session)?]
+            } else {
+                sessions::render_summary(session)
+            }
+        }
+        SessionsCommands::Events { id, method } => {
+            let session = sessions::resolve(&summaries, &id)?;
+            let records = sessions::events(&entries, &session.id, method.as_deref());
+            if json {
+                records
+                    .iter()
+                    .map(serde_json::to_string)
+                    .collect::<serde_json::Result<_>>()?
+            } else {
+                sessions::render_events(&records)
+            }
+        }
+        SessionsCommands::Recover { .. } => unreachable!("handled in main"),
+    };
 
-    let filtered_lines: Vec<&str> = all_lines
-        .iter()
-        .filter(|line| {
-            if let Ok(json) = serde_json::from_str::<serde_json::Value>(line) {
-                // Filter by direction
-                if requests && json.get("direction") == Some(&serde_json::json!("response")) {
-                    return false;
-                }
-                if responses && json.get("direction") == Some(&serde_json::json!("request")) {
-                    return false;
-                }
+    for line in lines {
+        println!("{}", line);
+    }
+    Ok(())
+}
 
-                // Filter by method
-                if let Some(ref m) = method {
-                    if let Some(content) = json.get("content").and_then(|c| c.as_str()) {
-                        if let Ok(rpc) = serde_json::from_str::<serde_json::Value>(content) {
-                            if rpc.get("method").and_then(|v| v.as_str()) != Some(m) {
-                                return false;
-                            }
-                        }
-                    }
-                }
+pub fn handle_diff(
+    a: &str,
+    b: &str,
+    file: PathBuf,
+    b_file: Option<PathBuf>,
+    json: bool,
+) -> Result<()> {
+    let analyzer = PatternRiskAnalyzer::new();
+    let profile = |file: &Path, id: &str| -> Result<SessionProfile> {
+        if !file.exists() {
+            return Err(anyhow::anyhow!("Log file {:?} not found", file));
+        }
+        let entries = traffic::read_entries(file)?;
+        let summaries = sessions::summarize(&entries);
+        let session = sessions::resolve(&summaries, id)?;
+        Ok(SessionProfile::build(&entries, session, &analyzer))
+    };
+    let a = profile(&file, a)?;
+    let b = profile(b_file.as_deref().unwrap_or(&file), b)?;
 
-                true
+    let diff = diff::compare(&a, &b);
+    if json {
+        println!("{}", serde_json::to_string_pretty(&diff)?);
+    } else {
+        for line in diff::render(&diff) {
+            println!("{}", line);
+        }
+        println!();
+    }
+    if diff.has_drift() {
+        return Err(anyhow::anyhow!(
+            "Behavior changed between sessions {} and {}",
+            diff.a,
+            diff.b
+        ));
+    }
+    if !json {
+        println!("No behavioral drift found");
+    }
+    Ok(())
+}
+
+pub fn handle_tools(command: ToolsCommands) -> Result<()> {
+    match command {
+        ToolsCommands::List { session, json } => {
+            let catalogs = inventory::load_all(&inventory::default_dir()?)?;
+            let catalog = inventory::resolve(&catalogs, &session)?;
+            let changes = inventory::previous(&catalogs, catalog)
+                .map(|previous| inventory::changes(previous, catalog));
+            if json {
+                println!(
+                    "{}",
+                    serde_json::to_string_pretty(&serde_json::json!({
+                        "catalog": catalog,
+                        "changes": changes,
+                    }))?
+                );
             } else {
-                false
+                for line in inventory::render_list(catalog, changes.as_ref()) {
+                    println!("{}", line);
+                }
             }
-        })
-        .copied()
-        .collect();
+        }
+    }
+    Ok(())
+}
+
+pub fn handle_report(
+    config_path: &Path,
+    file: PathBuf,
+    id: &str,
+    format: Option<ReportFormat>,
+    output: Option<PathBuf>,
+) -> Result<()> {
+    if !file.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", file));
+    }
+    let entries = traffic::read_entries(&file)?;
+    let summaries = sessions::summarize(&entries);
+    let session = sessions::resolve(&summaries, id)?;
+
+    let format = format
+        .or_else(|| output.as_deref().and_then(ReportFormat::from_path))
+        .unwrap_or(ReportFormat::Md);
+    let pricing = Config::load_with_env(config_path).unwrap_or_default().costs;
+    let mut report = SessionReport::build(&entries, session, &PatternRiskAnalyzer::new(), &pricing);
+    report.log = Some(file);
+    let rendered = report::render(&report, format);
+    match output {
+        Some(output) => {
+            std::fs::write(&output, rendered)
+                .with_context(|| format!("Failed to write report to {:?}", output))?;
+            println!(
+                "✓ Wrote the report for session {} to {:?}",
+                session.id, output
+            );
+        }
+        None => print!("{}", rendered),
+    }
+    Ok(())
+}
 
-    let display_lines = if let Some(n) = lines {
-        filtered_lines.iter().rev().take(n).rev().copied().collect()
-    } else {
-        filtered_lines
-    };
+pub fn handle_inspect(file: PathBuf, id: &str, export: Option<usize>) -> Result<()> {
+    if !file.exists() {
+        return Err(anyhow::anyhow!("Log file {:?} not found", file));
+    }
+    let entries = traffic::read_entries(&file)?;
+    let summaries = sessions::summarize(&entries);
+    let session = sessions::resolve(&summaries, id)?;
 
-    for line in display_lines {
-        if let Ok(json) = serde_json::from_str::<serde_json::Value>(line) {
-            println!("{}", serde_json::to_string_pretty(&json)?);
+    match export {
+        Some(n) => {
+            let mut inspector = Inspector::new(&entries, &session.id);
+            if n == 0 || n > inspector.events.len() {
+                return Err(anyhow::anyhow!(
+                    "Session {} has {} events; pick one from 1 to {}",
+                    session.id,
+                    inspector.events.len(),
+                    inspector.events.len()
+                ));
+            }
+            inspector.select(n - 1);
+            let path = inspector.export_selected(Path::new("."))?;
+            println!("✓ Exported event {} to {}", n, path.display());
+            Ok(())
         }
+        None => inspect::run(&entries, &session.id),
     }
+}
 
-    if tail {
-        println!("\nTail mode not yet implemented.");
+pub async fn handle_doctor(config_path: &Path, server: Option<&str>) -> Result<()> {
+    let store = PluginStore::open_default()?;
+    let checks = doctor::run(config_path, &store, server).await;
+
+    for check in &checks {
+        let mark = match check.status {
+            Status::Ok => "✓",
+            Status::Warning => "!",
+            Status::Failed => "✗",
+        };
+        println!("{} {}: {}", mark, check.title(), check.detail);
+        if let Some(ref fix) = check.fix {
+            println!("    → {}", fix);
+        }
     }
 
+    let failed = checks.iter().filter(|c| c.status == Status::Failed).count();
+    println!();
+    if failed > 0 {
+        return Err(anyhow::anyhow!(i18n::t(
+            "doctor.failed",
+            &[("count", &failed)]
+        )));
+    }
+    println!("{}", i18n::t("doctor.passed", &[]));
     Ok(())
 }
 
@@ -684,3 +3904,855 @@ pub fn handle_doctor_jwt() -> Result<()> {
         }
     }
 }
+
+pub async fn handle_plugins(config_path: &Path, command: PluginCommands) -> Result<()> {
+    if let PluginCommands::Develop(command) = command {
+        return handle_plugin_dev(config_path, command).await;
+    }
+    let store = PluginStore::open_default()?;
+    run_plugin_command(config_path, &store, command).await
+}
+
+/// `km plugins` against an explicit plugin directory.
+pub async fn run_plugin_command(
+    config_path: &Path,
+    store: &PluginStore,
+    command: PluginCommands,
+) -> Result<()> {
+    let settings = Config::load_with_env(config_path)
+        .context("No configuration found. Run 'km init' first.")?;
+    let token = get_jwt_token_with_cache(settings.api_key.clone(), settings.api_url.clone())
+        .await
+        .map(|token| token.token);
+    let marketplace = MarketplaceClient::new(settings.api_url.clone(), token);
+    let trusted_keys = TrustedKeys::from_config(&settings.plugin_trusted_keys)?;
+    match command {
+        PluginCommands::Search { query } => {
+            let manifest = marketplace.fetch_manifest().await?;
+            let results = manifest.search(query.as_deref().unwrap_or(""));
+            if results.is_empty() {
+                println!("No plugins found.");
+                return Ok(());
+            }
+            for release in results {
+                let installed = match store.get(&release.name)? {
+                    Some(plugin) => format!(" (installed {})", plugin.version),
+                    None => String::new(),
+                };
+                println!(
+                    "{:<24} {:<10} {}{}",
+                    release.name, release.version, release.description, installed
+                );
+            }
+        }
+        PluginCommands::Install {
+            spec,
+            allow_unsigned,
+        } => {
+            let (name, version) = plugins::parse_spec(&spec)?;
+            let manifest = marketplace.fetch_manifest().await?;
+            let release = match version {
+                Some(ref version) => manifest.find(&name, version).with_context(|| {
+                    format!(
+                        "Version {} of '{}' is not in the marketplace",
+                        version, name
+                    )
+                })?,
+                None => manifest
+                    .latest(&name)
+                    .with_context(|| format!("Plugin '{}' is not in the marketplace", name))?,
+            };
+
+            let (binary, trust) =
+                download_plugin(&marketplace, &trusted_keys, release, allow_unsigned).await?;
+            let plugin = store.install(release, &binary, trust)?;
+            println!("✓ Installed {}@{}", plugin.name, plugin.version);
+
+            // An explicit version pins the plugin; installing latest unpins it
+            update_plugin_pin(config_path, &name, version.map(|_| plugin.version.clone()))?;
+        }
+        PluginCommands::Update {
+            name,
+            allow_unsigned,
+        } => {
+            let installed = match name {
+                Some(ref name) => vec![store.get(name)?.with_context(|| {
+                    KmError::new(
+                        Code::PluginNotInstalled,
+                        format!("Plugin '{}' is not installed", name),
+                    )
+                })?],
+                None => store.installed()?,
+            };
+            if installed.is_empty() {
+                println!("No plugins installed.");
+                return Ok(());
+            }
+
+            let manifest = marketplace.fetch_manifest().await?;
+            let mut updated = 0;
+            for plugin in installed {
+                if let Some(pinned) = settings.plugin_pins.get(&plugin.name) {
+                    println!("- {} is pinned to {}; skipping", plugin.name, pinned);
+                    continue;
+                }
+                let latest = match manifest.latest(&plugin.name) {
+                    Some(latest) => latest,
+                    None => {
+                        println!("- {} is no longer in the marketplace", plugin.name);
+                        continue;
+                    }
+                };
+                if compare_versions(&latest.version, &plugin.version).is_le() {
+                    println!("- {} {} is up to date", plugin.name, plugin.version);
+                    continue;
+                }
+
+                let (binary, trust) =
+                    download_plugin(&marketplace, &trusted_keys, latest, allow_unsigned).await?;
+                store.install(latest, &binary, trust)?;
+                println!(
+                    "✓ Updated {} {} → {}",
+                    plugin.name, plugin.version, latest.version
+                );
+                updated += 1;
+            }
+            println!("{} plugin(s) updated.", updated);
+        }
+        PluginCommands::Remove { name } => {
+            if !store.remove(&name)? {
+                return Err(KmError::new(
+                    Code::PluginNotInstalled,
+                    format!("Plugin '{}' is not installed", name),
+                )
+                .into());
+            }
+            update_plugin_pin(config_path, &name, None)?;
+            println!("✓ Removed {}", name);
+        }
+        PluginCommands::Order { name, priority } => {
+            if let (Some(name), Some(priority)) = (name, priority) {
+                plugins::validate_name(&name)?;
+                if !Config::exists(config_path) {
+                    return Err(KmError::new(
+                        Code::ConfigNotFound,
+                        format!(
+                            "No configuration found at {:?}. Run 'km init' first.",
+                            config_path
+                        ),
+                    )
+                    .into());
+                }
+                let mut config = Config::load(config_path)?;
+                if priority == 0 {
+                    config.plugin_priorities.remove(&name);
+                } else {
+                    config.plugin_priorities.insert(name.clone(), priority);
+                }
+                config.save(config_path)?;
+                println!("✓ Set priority of {} to {}", name, priority);
+                return Ok(());
+            }
+
+            let mut installed = store.installed()?;
+            if installed.is_empty() {
+                println!("No plugins installed.");
+                return Ok(());
+            }
+            sort_by_priority(&mut installed, &settings.plugin_priorities);
+            for (position, plugin) in installed.iter().enumerate() {
+                let priority = settings
+                    .plugin_priorities
+                    .get(&plugin.name)
+                    .copied()
+                    .unwrap_or(0);
+                println!(
+                    "{:>2}. {:<24} priority {}",
+                    position + 1,
+                    plugin.name,
+                    priority
+                );
+            }
+        }
+        PluginCommands::List { outdated } => {
+            let installed = store.installed()?;
+            let manifest = if outdated && !installed.is_empty() {
+                marketplace.fetch_manifest().await?
+            } else {
+                PluginManifest::default()
+            };
+
+            let mut shown = 0;
+            for plugin in installed {
+                let mut notes = String::new();
+                if settings.plugin_pins.contains_key(&plugin.name) {
+                    notes.push_str(" (pinned)");
+                }
+                if !plugin.signed {
+                    notes.push_str(" (unsigned)");
+                }
+                if plugin.check_integrity().is_err() {
+                    notes.push_str(" (modified!)");
+                }
+                if outdated {
+                    match manifest.latest(&plugin.name) {
+                        Some(latest)
+                            if compare_versions(&latest.version, &plugin.version).is_gt() =>
+                        {
+                            println!(
+                                "{:<24} {:<10} → {}{}",
+                                plugin.name, plugin.version, latest.version, notes
+                            );
+                        }
+                        _ => continue,
+                    }
+                } else {
+                    println!(
+                        "{:<24} {:<10} {}{}",
+                        plugin.name, plugin.version, plugin.description, notes
+                    );
+                }
+                shown += 1;
+            }
+
+            if shown == 0 {
+                if outdated {
+                    println!("All plugins are up to date.");
+                } else {
+                    println!("No plugins installed.");
+                }
+            }
+        }
+        PluginCommands::Config {
+            name,
+            key,
+            value,
+            unset,
+        } => {
+            plugins::validate_name(&name)?;
+            let installed = store.get(&name)?;
+            let current = settings.plugin_config.get(&name);
+            let Some(key) = key else {
+                let shown = current.cloned().unwrap_or_else(|| serde_json::json!({}));
+                println!("{}", serde_json::to_string_pretty(&shown)?);
+                let schema = installed.as_ref().and_then(|p| p.config_schema.as_ref());
+                let properties = schema
+                    .and_then(|s| s.get("properties"))
+                    .and_then(|p| p.as_object());
+                if let Some(properties) = properties {
+                    println!("\nSettings:");
+                    for (key, property) in properties {
+                        let kind = match property.get("type") {
+                            Some(serde_json::Value::String(kind)) => kind.clone(),
+                            Some(kinds) => kinds.to_string(),
+                            None => String::new(),
+                        };
+                        let about = property.get("description").and_then(|d| d.as_str());
+                        println!("  {:<24} {:<10} {}", key, kind, about.unwrap_or(""));
+                    }
+                }
+                return Ok(());
+            };
+            if value.is_none() && !unset {
+                match current.and_then(|c| c.get(&key)) {
+                    Some(serde_json::Value::String(value)) => println!("{}", value),
+                    Some(value) => println!("{}", value),
+                    None => println!(),
+                }
+                return Ok(());
+            }
+
+            if !Config::exists(config_path) {
+                return Err(KmError::new(
+                    Code::ConfigNotFound,
+                    format!(
+                        "No configuration found at {:?}. Run 'km init' first.",
+                        config_path
+                    ),
+                )
+                .into());
+            }
+            let mut config = Config::load(config_path)?;
+            let check = |config: &Config| match installed {
+                Some(ref plugin) => plugin.check_settings(
+                    config
+                        .plugin_config
+                        .get(&name)
+                        .unwrap_or(&serde_json::Value::Null),
+                ),
+                None => Vec::new(),
+            };
+            let before = check(&config);
+            let entry = config
+                .plugin_config
+                .entry(name.clone())
+                .or_insert_with(|| serde_json::json!({}));
+            let Some(entry) = entry.as_object_mut() else {
+                return Err(anyhow::anyhow!(
+                    "plugin_config.{} in {:?} is not an object",
+                    name,
+                    config_path
+                ));
+            };
+            match value {
+                Some(value) => {
+                    let parsed =
+                        serde_json::from_str(&value).unwrap_or(serde_json::Value::String(value));
+                    entry.insert(key.clone(), parsed);
+                }
+                None => {
+                    entry.remove(&key);
+                }
+            }
+            if entry.is_empty() {
+                config.plugin_config.remove(&name);
+            }
+
+            // Settings that were already incomplete can be filled in one at a time
+            let problems = check(&config);
+            let introduced: Vec<&String> =
+                problems.iter().filter(|p| !before.contains(p)).collect();
+            if !introduced.is_empty() {
+                return Err(anyhow::anyhow!(
+                    "Invalid settings for {}: {}",
+                    name,
+                    introduced
+                        .iter()
+                        .map(|p| p.as_str())
+                        .collect::<Vec<_>>()
+                        .join("; ")
+                ));
+            }
+            config.save(config_path)?;
+            match unset {
+                true => println!("✓ Removed {} setting {}", name, key),
+                false => println!("✓ Set {} setting {}", name, key),
+            }
+            if !problems.is_empty() {
+                println!(
+                    "⚠️  {} won't load until its settings are complete: {}",
+                    name,
+                    problems.join("; ")
+                );
+            }
+        }
+        PluginCommands::Commands => {
+            let commands = start_plugins(store, &settings)?.commands();
+            if commands.is_empty() {
+                println!("No plugin commands installed.");
+            }
+            for command in commands {
+                println!(
+                    "{:<24} {:<24} {}",
+                    format!("km {}", command.name),
+                    command.plugin,
+                    command.about
+                );
+            }
+        }
+        PluginCommands::Status { session, json } => {
+            let endpoints = control::running(&control::default_dir()?).await;
+            if endpoints.is_empty() {
+                println!("No running km monitor sessions");
+                return Ok(());
+            }
+            let endpoint = control::resolve(&endpoints, session.as_deref())?;
+            let mut client = ControlClient::connect(endpoint).await?;
+            let result = client.request(&ControlRequest::Status).await?;
+            let status: control::MonitorStatus = serde_json::from_value(result)?;
+            if json {
+                println!("{}", serde_json::to_string_pretty(&status.plugin_health)?);
+            } else if status.plugin_health.is_empty() {
+                println!("No plugins loaded in session {}", status.session_id);
+            } else {
+                for line in health::render(&status.plugin_health, chrono::Utc::now()) {
+                    println!("{}", line);
+                }
+            }
+        }
+        PluginCommands::OnFailure { name, policy } => {
+            plugins::validate_name(&name)?;
+            if !Config::exists(config_path) {
+                return Err(KmError::new(
+                    Code::ConfigNotFound,
+                    format!(
+                        "No configuration found at {:?}. Run 'km init' first.",
+                        config_path
+                    ),
+                )
+                .into());
+            }
+            let mut config = Config::load(config_path)?;
+            if policy == FailurePolicy::Open {
+                config.plugin_failure_policies.remove(&name);
+            } else {
+                config.plugin_failure_policies.insert(name.clone(), policy);
+            }
+            config.save(config_path)?;
+            println!("✓ {} now fails {}", name, policy.as_str());
+        }
+        PluginCommands::Develop(command) => handle_plugin_dev(config_path, command).await?,
+    }
+
+    Ok(())
+}
+
+/// `km plugins scaffold`, `dev` and `test`: writing a plugin, before it's
+/// published or installed.
+pub async fn handle_plugin_dev(config_path: &Path, command: PluginDevCommands) -> Result<()> {
+    let settings = Config::load_with_env(config_path).unwrap_or_default();
+    match command {
+        PluginDevCommands::Scaffold { name, wasm, dir } => {
+            let dir = dir.unwrap_or_else(|| PathBuf::from(&name));
+            let template = match wasm {
+                true => Template::Wasm,
+                false => Template::Go,
+            };
+            let files = dev::scaffold(&dir, &name, template)?;
+            println!("✓ Created plugin {} in {:?}", name, dir);
+            for file in files {
+                println!("  {}", file.display());
+            }
+            println!();
+            println!(
+                "Capture a session with `km monitor`, then run `km plugins dev {}`",
+                dir.display()
+            );
+        }
+        PluginDevCommands::Dev {
+            dir,
+            file,
+            session,
+            once,
+        } => {
+            let manifest = DevManifest::read(&dir)?;
+            let steps = capture_steps(&file, session.as_deref())?;
+            let mut last_run = None;
+            loop {
+                let fingerprint = dev::fingerprint(&dir, &manifest);
+                if last_run != Some(fingerprint) {
+                    last_run = Some(fingerprint);
+                    match replay_to_plugin(&dir, &manifest, &settings, &steps, true) {
+                        Ok(decided) => print_decisions(&decided),
+                        Err(e) if once => return Err(e),
+                        Err(e) => println!("❌ {:#}", e),
+                    }
+                    if once {
+                        break;
+                    }
+                    println!();
+                    println!("Watching {:?} for changes (Ctrl+C to stop)", dir);
+                }
+                tokio::time::sleep(Duration::from_millis(500)).await;
+            }
+        }
+        PluginDevCommands::Test {
+            dir,
+            file,
+            session,
+            expect,
+            no_build,
+        } => {
+            let manifest = DevManifest::read(&dir)?;
+            let expectations = dev::read_expectations(&dir.join(&expect))?;
+            let steps = capture_steps(&file, session.as_deref())?;
+            let decided = replay_to_plugin(&dir, &manifest, &settings, &steps, !no_build)?;
+            let failures = dev::check(&expectations, &decided);
+            if !failures.is_empty() {
+                for failure in &failures {
+                    println!("✗ {}", failure);
+                }
+                return Err(anyhow::anyhow!(
+                    "{} of {} expectations failed",
+                    failures.len(),
+                    expectations.len()
+                ));
+            }
+            println!(
+                "✓ {} expectations held over {} requests",
+                expectations.len(),
+                decided.len()
+            );
+        }
+    }
+    Ok(())
+}
+
+/// The client messages of one captured session, for a plugin to decide on.
+fn capture_steps(file: &Path, session: Option<&str>) -> Result<Vec<ReplayStep>> {
+    if !file.exists() {
+        return Err(anyhow::anyhow!(
+            "Log file {:?} not found; capture a session with `km monitor` first",
+            file
+        ));
+    }
+    let entries = traffic::read_entries(file)?;
+    let session = replay::select_session(&entries, session);
+    let steps = replay::build_steps(&entries, session.as_deref());
+    if steps.is_empty() {
+        return Err(anyhow::anyhow!("No client messages found to replay"));
+    }
+    println!(
+        "Replaying {} messages from session {}",
+        steps.len(),
+        session.as_deref().unwrap_or("(none)")
+    );
+    Ok(steps)
+}
+
+/// Build the plugin if asked, then play the captured session to it.
+fn replay_to_plugin(
+    dir: &Path,
+    manifest: &DevManifest,
+    settings: &Config,
+    steps: &[ReplayStep],
+    build: bool,
+) -> Result<Vec<dev::Decided>> {
+    if build {
+        println!("Building {}...", manifest.release.name);
+        manifest.build(dir)?;
+    }
+    let plugin_settings = settings
+        .plugin_config
+        .get(&manifest.release.name)
+        .cloned()
+        .unwrap_or_default();
+    let harness = dev::Harness::load(dir, manifest, &settings.plugin_sandbox, &plugin_settings)?;
+    Ok(harness.replay(steps))
+}
+
+fn print_decisions(decided: &[dev::Decided]) {
+    for decision in decided {
+        let method = match (&decision.method, &decision.tool) {
+            (Some(method), Some(tool)) => format!("{} {}", method, tool),
+            (Some(method), None) => method.clone(),
+            (None, _) => "(unknown)".to_string(),
+        };
+        match decision.action {
+            PluginAction::Allow => println!("✓ allow    {}", method),
+            PluginAction::Block { ref reason } => println!("✗ block    {}: {}", method, reason),
+            PluginAction::Modify { ref message } => {
+                println!("~ modify   {}", method);
+                println!("  → {}", message);
+            }
+        }
+        if !decision.metadata.is_empty() {
+            println!(
+                "  metadata: {}",
+                serde_json::to_string(&decision.metadata).unwrap_or_default()
+            );
+        }
+    }
+}
+
+/// `km <command>` for a command a plugin provides, like `km compliance report`.
+pub fn handle_plugin_command(config_path: &Path, args: &[String]) -> Result<()> {
+    let settings = Config::load_with_env(config_path).unwrap_or_default();
+    run_plugin_subcommand(&PluginStore::open_default()?, &settings, args)
+}
+
+/// A plugin subcommand against an explicit plugin directory.
+pub fn run_plugin_subcommand(
+    store: &PluginStore,
+    settings: &Config,
+    args: &[String],
+) -> Result<()> {
+    let (name, args) = args.split_first().context("Missing command")?;
+    let host = start_plugins(store, settings)?;
+    let Some(output) = host.run_command(name, args)? else {
+        return Err(anyhow::anyhow!(
+            "Unknown command '{}'. See 'km --help', or 'km plugins commands' for commands from plugins",
+            name
+        ));
+    };
+    print!("{}", output.stdout);
+    eprint!("{}", output.stderr);
+    if output.exit_code != 0 {
+        return Err(anyhow::anyhow!(
+            "km {} failed with exit code {}",
+            name,
+            output.exit_code
+        ));
+    }
+    Ok(())
+}
+
+/// Download a release and check it against the manifest checksum and the
+/// trusted signing keys.
+async fn download_plugin(
+    marketplace: &MarketplaceClient,
+    trusted_keys: &TrustedKeys,
+    release: &PluginRelease,
+    allow_unsigned: bool,
+) -> Result<(Vec<u8>, Trust)> {
+    let binary = marketplace.download(release).await?;
+    let trust = verify::verify_release(release, &binary, trusted_keys)?;
+    verify::require_trust(release, trust, allow_unsigned)?;
+    if !trust.is_signed() {
+        println!(
+            "⚠ Installing {}@{} without a trusted signature",
+            release.name, release.version
+        );
+    }
+    Ok((binary, trust))
+}
+
+/// Record (or clear, with `None`) a plugin's version pin in the config file.
+fn update_plugin_pin(config_path: &Path, name: &str, version: Option<String>) -> Result<()> {
+    if !Config::exists(config_path) {
+        if version.is_some() {
+            println!(
+                "Note: no config file at {:?}, so the version pin was not saved",
+                config_path
+            );
+        }
+        return Ok(());
+    }
+
+    let mut config = Config::load(config_path)?;
+    let changed = match version {
+        Some(version) => {
+            config.plugin_pins.insert(name.to_string(), version.clone()) != Some(version)
+        }
+        None => config.plugin_pins.remove(name).is_some(),
+    };
+    if changed {
+        config.save(config_path)?;
+    }
+    Ok(())
+}
+
+pub fn handle_presets(config_path: &Path, command: PresetsCommands) -> Result<()> {
+    let settings = Config::load_with_env(config_path).unwrap_or_default();
+
+    match command {
+        PresetsCommands::List => {
+            for (name, (preset, custom)) in presets::all(&settings.presets) {
+                println!(
+                    "{:<16} {:<9} {}",
+                    name,
+                    if custom { "config" } else { "built-in" },
+                    preset.description
+                );
+                println!("{:<16} {:<9} captures {}", "", "", preset.describe());
+            }
+        }
+    }
+
+    Ok(())
+}
+
+pub async fn handle_rules(config_path: &Path, command: RulesCommands) -> Result<()> {
+    let settings = Config::load_with_env(config_path)
+        .context("No configuration found. Run 'km init' first.")?;
+    let store = RuleStore::from_config(&settings.risk_rules)?;
+
+    match command {
+        RulesCommands::List => {
+            let installed = store.installed()?;
+            if installed.is_empty() {
+                println!("No rule packs installed in {:?}.", store.dir());
+                return Ok(());
+            }
+            for InstalledPack { pack, path } in installed {
+                let state = if settings.risk_rules.is_enabled(&pack.name) {
+                    "enabled"
+                } else {
+                    "disabled"
+                };
+                println!(
+                    "{:<24} {:<10} {:<9} {} rule(s)  {}",
+                    pack.name,
+                    pack.version,
+                    state,
+                    pack.rules.len(),
+                    path.display()
+                );
+            }
+        }
+        RulesCommands::Update { name } => {
+            let token =
+                get_jwt_token_with_cache(settings.api_key.clone(), settings.api_url.clone())
+                    .await
+                    .map(|token| token.token);
+            let index = rules::fetch_index(&settings.api_url, token.as_deref()).await?;
+            let updates = store.update_from(&index, name.as_deref())?;
+            for update in &updates {
+                match update.from {
+                    Some(ref from) => {
+                        println!("✓ Updated {} {} → {}", update.name, from, update.to)
+                    }
+                    None => println!("✓ Installed {} {}", update.name, update.to),
+                }
+            }
+            if updates.is_empty() {
+                println!("All rule packs are up to date.");
+            }
+        }
+        RulesCommands::Enable { ref name } | RulesCommands::Disable { ref name } => {
+            let enable = matches!(command, RulesCommands::Enable { .. });
+            if !store.installed()?.iter().any(|p| p.pack.name == *name) {
+                return Err(anyhow::anyhow!("Rule pack '{}' is not installed", name));
+            }
+            let mut config = Config::load(config_path)?;
+            config.risk_rules.disabled.retain(|pack| pack != name);
+            if !enable {
+                config.risk_rules.disabled.push(name.clone());
+            }
+            config.save(config_path)?;
+            println!("✓ {} {}", if enable { "Enabled" } else { "Disabled" }, name);
+        }
+    }
+
+    Ok(())
+}
+
+pub fn handle_policy(config_path: &Path, command: PolicyCommands) -> Result<()> {
+    let settings = Config::load_with_env(config_path)
+        .context("No configuration found. Run 'km init' first.")?;
+    let policy = Policy::from_config(&settings.policies).context("Invalid policies")?;
+
+    match command {
+        PolicyCommands::Test {
+            message,
+            file,
+            bundle,
+        } => {
+            let opa = bundle
+                .map(|bundle| {
+                    OpaPolicy::load(&bundle)
+                        .with_context(|| format!("Failed to load policy bundle {:?}", bundle))
+                })
+                .transpose()?;
+            let lines: Vec<String> = match (message, file) {
+                (Some(message), _) => vec![message],
+                (None, Some(file)) => fs::read_to_string(&file)
+                    .with_context(|| format!("Failed to read {:?}", file))?
+                    .lines()
+                    .map(String::from)
+                    .collect(),
+                (None, None) => std::io::stdin()
+                    .lines()
+                    .collect::<std::io::Result<_>>()
+                    .context("Failed to read requests from stdin")?,
+            };
+
+            if policy.is_empty() && opa.is_none() {
+                println!("No policies configured; every request is allowed.");
+            }
+            for line in lines.iter().filter(|l| !l.trim().is_empty()) {
+                let Some(request) = policy_test_request(line) else {
+                    continue;
+                };
+                let method = request
+                    .get("method")
+                    .and_then(|m| m.as_str())
+                    .unwrap_or("(response)");
+                match policy.evaluate(&request) {
+                    Decision::Allow { rule } => match rule {
+                        Some(rule) => println!("✓ allow    {} (rule {})", method, rule),
+                        None => println!("✓ allow    {}", method),
+                    },
+                    Decision::Deny { rule, message } => {
+                        println!("✗ deny     {} (rule {}): {}", method, rule, message)
+                    }
+                    Decision::Rewrite { rule, message } => {
+                        println!("~ rewrite  {} (rule {})", method, rule);
+                        println!("  → {}", message);
+                    }
+                }
+                if let Some(ref opa) = opa {
+                    let decision = opa.decide(&opa::input("request", &request, None, "test"))?;
+                    let reason = decision.reason.as_deref().unwrap_or("no reason given");
+                    if decision.allow {
+                        println!("  bundle: allow");
+                    } else {
+                        println!("  bundle: deny ({})", reason);
+                    }
+                    if !decision.redact.is_empty() {
+                        println!("  bundle: redact {}", decision.redact.join(", "));
+                    }
+                }
+            }
+
+            if policy.mode() == PolicyMode::Audit && !policy.is_empty() {
+                println!();
+                println!(
+                    "Policies are in audit mode: km monitor logs these decisions but forwards every request."
+                );
+                println!("Run `km config set policies.mode enforce` to apply them.");
+            }
+        }
+    }
+    Ok(())
+}
+
+/// A client request from a `km policy test` input line: a JSON-RPC message,
+/// or the request in a traffic log entry.
+fn policy_test_request(line: &str) -> Option<serde_json::Value> {
+    let value: serde_json::Value = match serde_json::from_str(line) {
+        Ok(value) => value,
+        Err(e) => {
+            eprintln!("Skipping line that isn't JSON: {}", e);
+            return None;
+        }
+    };
+    if value.get("jsonrpc").is_some() {
+        return Some(value);
+    }
+    match serde_json::from_value::<traffic::TrafficEntry>(value) {
+        Ok(entry) if entry.direction == "request" => match entry.unsealed() {
+            Ok(entry) => serde_json::from_str(&entry.content).ok(),
+            Err(e) => {
+                eprintln!("Skipping line: {:#}", e);
+                None
+            }
+        },
+        _ => None,
+    }
+}
+
+/// `km explain`: what an error code means and what to do about it, or a
+/// list of every code.
+pub fn handle_explain(code: Option<Code>) {
+    let Some(code) = code else {
+        for code in Code::value_variants() {
+            let summary = code
+                .to_possible_value()
+                .and_then(|v| v.get_help().map(ToString::to_string))
+                .unwrap_or_default();
+            println!("{:<22} {:<10} {}", code, code.category().as_str(), summary);
+        }
+        return;
+    };
+    println!("{} ({} error)", code, code.category().as_str());
+    println!();
+    println!("{}", code.explanation());
+    println!();
+    println!("Hint: {}", code.hint());
+}
+
+pub fn handle_completion(shell: Shell) {
+    print!("{}", completion::generate(shell, &mut Cli::command()));
+}
+
+pub fn handle_man(output: Option<PathBuf>) -> Result<()> {
+    let page = manpage::render(&mut Cli::command());
+    match output {
+        Some(path) => {
+            fs::write(&path, page)
+                .with_context(|| format!("Failed to write man page to {:?}", path))?;
+            println!("Wrote man page to {}", path.display());
+        }
+        None => print!("{}", page),
+    }
+    Ok(())
+}
+
+/// Print completion candidates one per line. Errors are swallowed: a
+/// completion script has nowhere to show them.
+pub fn handle_complete_values(config_path: &Path, kind: ValueKind, traffic_log: &Path) {
+    for value in completion::values(kind, config_path, traffic_log) {
+        println!("{}", value);
+    }
+}
@@ -0,0 +1,161 @@
+//! The MCP initialize exchange: who the client and server are, the protocol
+//! version they settled on and what each declared it can do. Kept with the
+//! session, shown by `km sessions show` and uploaded in its `session_end`
+//! event so sessions can be told apart by server.
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+
+pub const INITIALIZE_METHOD: &str = "initialize";
+
+/// `clientInfo` or `serverInfo`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct PeerInfo {
+    pub name: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub version: Option<String>,
+}
+
+impl PeerInfo {
+    fn from(info: Option<&Value>) -> Option<Self> {
+        let info = info?;
+        Some(Self {
+            name: info.get("name")?.as_str()?.to_string(),
+            version: info
+                .get("version")
+                .and_then(|v| v.as_str())
+                .map(String::from),
+        })
+    }
+
+    /// `name 1.2.0`
+    pub fn describe(&self) -> String {
+        match self.version {
+            Some(ref version) => format!("{} {}", self.name, version),
+            None => self.name.clone(),
+        }
+    }
+}
+
+/// Declared capabilities, each with the options it turned on, e.g.
+/// `tools: [listChanged]` or `resources: [listChanged, subscribe]`.
+pub type DeclaredCapabilities = BTreeMap<String, Vec<String>>;
+
+/// What the initialize request and its response said.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct Handshake {
+    /// The version the server answered with, or the one the client asked
+    /// for until it has
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub protocol_version: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub client: Option<PeerInfo>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub server: Option<PeerInfo>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub client_capabilities: DeclaredCapabilities,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub server_capabilities: DeclaredCapabilities,
+}
+
+impl Handshake {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// Take what there is from `message` if it's an initialize request or
+    /// the response to one; anything else is ignored.
+    pub fn observe(&mut self, message: &Value) {
+        if message.get("method").and_then(|m| m.as_str()) == Some(INITIALIZE_METHOD) {
+            let Some(params) = message.get("params") else {
+                return;
+            };
+            if self.protocol_version.is_none() {
+                self.protocol_version = version(params);
+            }
+            self.client = PeerInfo::from(params.get("clientInfo")).or(self.client.take());
+            self.client_capabilities = capabilities(params.get("capabilities"));
+            return;
+        }
+        // Only an initialize result says which server and version it is
+        let Some(result) = message.get("result") else {
+            return;
+        };
+        if result.get("protocolVersion").is_none() && result.get("serverInfo").is_none() {
+            return;
+        }
+        self.protocol_version = version(result).or(self.protocol_version.take());
+        self.server = PeerInfo::from(result.get("serverInfo")).or(self.server.take());
+        self.server_capabilities = capabilities(result.get("capabilities"));
+    }
+
+    /// `tools (listChanged), resources (subscribe, listChanged)`, or `-`
+    pub fn describe_capabilities(capabilities: &DeclaredCapabilities) -> String {
+        if capabilities.is_empty() {
+            return "-".to_string();
+        }
+        capabilities
+            .iter()
+            .map(|(name, options)| match options.as_slice() {
+                [] => name.clone(),
+                options => format!("{} ({})", name, options.join(", ")),
+            })
+            .collect::<Vec<_>>()
+            .join(", ")
+    }
+}
+
+fn version(value: &Value) -> Option<String> {
+    value
+        .get("protocolVersion")
+        .and_then(|v| v.as_str())
+        .map(String::from)
+}
+
+/// The capabilities object, with the options of each that are on: `true`
+/// flags, and the keys of nested objects such as `experimental`.
+fn capabilities(value: Option<&Value>) -> DeclaredCapabilities {
+    let Some(Value::Object(declared)) = value else {
+        return DeclaredCapabilities::new();
+    };
+    declared
+        .iter()
+        .filter(|(_, value)| !matches!(value, Value::Null | Value::Bool(false)))
+        .map(|(name, value)| {
+            let options = match value {
+                Value::Object(options) => options
+                    .iter()
+                    .filter(|(_, on)| !matches!(on, Value::Null | Value::Bool(false)))
+                    .map(|(option, _)| option.clone())
+                    .collect(),
+                _ => Vec::new(),
+            };
+            (name.clone(), options)
+        })
+        .collect()
+}
+
+/// The handshake of a proxy run, filled in by the capture thread and read
+/// when the session ends.
+#[derive(Debug, Default)]
+pub struct HandshakeTracker(Mutex<Handshake>);
+
+impl HandshakeTracker {
+    /// Take what there is from `content`, an initialize request or response.
+    pub fn observe(&self, content: &str) {
+        let Ok(message) = serde_json::from_str::<Value>(content) else {
+            return;
+        };
+        if let Ok(mut handshake) = self.0.lock() {
+            handshake.observe(&message);
+        }
+    }
+
+    /// The handshake so far, if any of it has been seen.
+    pub fn snapshot(&self) -> Option<Handshake> {
+        let handshake = self.0.lock().ok()?.clone();
+        (!handshake.is_empty()).then_some(handshake)
+    }
+}
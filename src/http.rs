@@ -0,0 +1,181 @@
+use anyhow::{Context, Result};
+use reqwest::{Certificate, ClientBuilder, Identity, NoProxy, Proxy};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::sync::OnceLock;
+
+use crate::build_info;
+
+/// Proxy and TLS settings for every request km makes: the API, risk
+/// scoring, span export and plugin downloads.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct HttpConfig {
+    /// Proxy URL for all requests; HTTP_PROXY/HTTPS_PROXY apply when unset
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub proxy: Option<String>,
+    /// Comma-separated hosts and domains reached without `proxy` (like NO_PROXY)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub no_proxy: Option<String>,
+    /// PEM file of CA certificates trusted in addition to the system ones
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ca_bundle: Option<String>,
+    /// PEM client certificate for mutual TLS
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub client_cert: Option<String>,
+    /// PEM private key for `client_cert`, if it isn't in the same file
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub client_key: Option<String>,
+    /// Accept any server certificate. Only for on-prem test instances.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub insecure_skip_verify: bool,
+}
+
+impl HttpConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// These settings with `KM_HTTP_PROXY`, `KM_NO_PROXY`, `KM_CA_BUNDLE`,
+    /// `KM_CLIENT_CERT`, `KM_CLIENT_KEY` and `KM_INSECURE_SKIP_VERIFY`
+    /// applied on top.
+    pub fn with_env(mut self) -> Self {
+        let var = |name: &str| std::env::var(name).ok().filter(|v| !v.is_empty());
+        if let Some(proxy) = var("KM_HTTP_PROXY") {
+            self.proxy = Some(proxy);
+        }
+        if let Some(no_proxy) = var("KM_NO_PROXY") {
+            self.no_proxy = Some(no_proxy);
+        }
+        if let Some(ca_bundle) = var("KM_CA_BUNDLE") {
+            self.ca_bundle = Some(ca_bundle);
+        }
+        if let Some(client_cert) = var("KM_CLIENT_CERT") {
+            self.client_cert = Some(client_cert);
+        }
+        if let Some(client_key) = var("KM_CLIENT_KEY") {
+            self.client_key = Some(client_key);
+        }
+        if let Some(insecure) = var("KM_INSECURE_SKIP_VERIFY") {
+            self.insecure_skip_verify = matches!(insecure.as_str(), "1" | "true" | "yes");
+        }
+        self
+    }
+}
+
+/// `HttpConfig` with its files loaded, ready to apply to client builders.
+#[derive(Debug, Clone, Default)]
+pub struct HttpOptions {
+    proxy: Option<Proxy>,
+    certificates: Vec<Certificate>,
+    identity: Option<Identity>,
+    insecure_skip_verify: bool,
+}
+
+impl HttpOptions {
+    pub fn load(config: &HttpConfig) -> Result<Self> {
+        let proxy = match config.proxy.as_deref() {
+            Some(url) => {
+                let proxy = Proxy::all(url)
+                    .with_context(|| format!("http.proxy is not a valid proxy URL: '{}'", url))?;
+                Some(proxy.no_proxy(config.no_proxy.as_deref().and_then(NoProxy::from_string)))
+            }
+            None => None,
+        };
+
+        let certificates = match config.ca_bundle.as_deref() {
+            Some(path) => {
+                let pem = fs::read(path)
+                    .with_context(|| format!("Failed to read http.ca_bundle {}", path))?;
+                let certificates = Certificate::from_pem_bundle(&pem)
+                    .with_context(|| format!("http.ca_bundle {} is not a PEM bundle", path))?;
+                if certificates.is_empty() {
+                    return Err(anyhow::anyhow!(
+                        "http.ca_bundle {} contains no certificates",
+                        path
+                    ));
+                }
+                certificates
+            }
+            None => Vec::new(),
+        };
+
+        let identity = match (config.client_cert.as_deref(), config.client_key.as_deref()) {
+            (Some(cert), key) => {
+                let mut pem = fs::read(cert)
+                    .with_context(|| format!("Failed to read http.client_cert {}", cert))?;
+                if let Some(key) = key {
+                    pem.push(b'\n');
+                    pem.extend(
+                        fs::read(key)
+                            .with_context(|| format!("Failed to read http.client_key {}", key))?,
+                    );
+                }
+                Some(Identity::from_pem(&pem).with_context(|| {
+                    format!(
+                        "http.client_cert {} needs a PEM certificate and private key",
+                        cert
+                    )
+                })?)
+            }
+            (None, Some(_)) => {
+                return Err(anyhow::anyhow!(
+                    "http.client_key is set but http.client_cert is not"
+                ))
+            }
+            (None, None) => None,
+        };
+
+        Ok(Self {
+            proxy,
+            certificates,
+            identity,
+            insecure_skip_verify: config.insecure_skip_verify,
+        })
+    }
+
+    pub fn apply(&self, mut builder: ClientBuilder) -> ClientBuilder {
+        if let Some(ref proxy) = self.proxy {
+            builder = builder.proxy(proxy.clone());
+        }
+        for certificate in &self.certificates {
+            builder = builder.add_root_certificate(certificate.clone());
+        }
+        if let Some(ref identity) = self.identity {
+            builder = builder.identity(identity.clone());
+        }
+        if self.insecure_skip_verify {
+            builder = builder.danger_accept_invalid_certs(true);
+        }
+        builder
+    }
+}
+
+static OPTIONS: OnceLock<HttpOptions> = OnceLock::new();
+
+/// Load `config` for every client built afterwards. Call once at startup.
+pub fn init(config: &HttpConfig) -> Result<()> {
+    let options = HttpOptions::load(config)?;
+    if options.insecure_skip_verify {
+        tracing::warn!("TLS certificate verification is disabled (http.insecure_skip_verify)");
+    }
+    let _ = OPTIONS.set(options);
+    Ok(())
+}
+
+/// A client builder with km's User-Agent and the proxy and TLS settings
+/// applied.
+pub fn client_builder() -> ClientBuilder {
+    let builder = reqwest::Client::builder().user_agent(build_info::user_agent());
+    match OPTIONS.get() {
+        Some(options) => options.apply(builder),
+        None => builder,
+    }
+}
+
+/// A client with the proxy and TLS settings applied.
+pub fn client() -> reqwest::Client {
+    client_builder().build().unwrap_or_else(|e| {
+        tracing::warn!("Failed to build HTTP client: {} - using defaults", e);
+        reqwest::Client::new()
+    })
+}
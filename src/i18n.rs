@@ -0,0 +1,678 @@
+//! Translations of user-facing text. The language comes from `KM_LANG` or
+//! the `language` setting and is chosen once at startup; messages are
+//! looked up by id with [`t`], and `{name}` placeholders in them are filled
+//! from the arguments. Text that has no translation yet stays English.
+
+use serde::{Deserialize, Serialize};
+use std::fmt::{self, Display};
+use std::sync::OnceLock;
+
+/// A language km can print in.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Lang {
+    #[default]
+    En,
+    Ja,
+    De,
+}
+
+impl Lang {
+    pub const ALL: [Lang; 3] = [Lang::En, Lang::Ja, Lang::De];
+
+    /// The language of a tag such as `ja`, `de-DE` or `en_US.UTF-8`.
+    pub fn from_tag(tag: &str) -> Option<Lang> {
+        let primary = tag
+            .split(['_', '-', '.', '@'])
+            .next()
+            .unwrap_or_default()
+            .to_ascii_lowercase();
+        match primary.as_str() {
+            "en" => Some(Lang::En),
+            "ja" => Some(Lang::Ja),
+            "de" => Some(Lang::De),
+            _ => None,
+        }
+    }
+}
+
+impl Display for Lang {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Lang::En => "en",
+            Lang::Ja => "ja",
+            Lang::De => "de",
+        })
+    }
+}
+
+/// The language to use: `KM_LANG` when it names one, else the configured
+/// one, else English.
+pub fn select(km_lang: Option<&str>, configured: Option<Lang>) -> Lang {
+    if let Some(tag) = km_lang.filter(|tag| !tag.is_empty()) {
+        match Lang::from_tag(tag) {
+            Some(lang) => return lang,
+            None => tracing::warn!("Ignoring KM_LANG={}: km speaks en, ja and de", tag),
+        }
+    }
+    configured.unwrap_or_default()
+}
+
+static LANG: OnceLock<Lang> = OnceLock::new();
+
+/// Print in `lang` from here on. Call once at startup.
+pub fn init(lang: Lang) {
+    let _ = LANG.set(lang);
+}
+
+/// The language chosen at startup (English if none was).
+pub fn current() -> Lang {
+    LANG.get().copied().unwrap_or_default()
+}
+
+/// Message `id` in the current language, with `args` filled in.
+pub fn t(id: &str, args: &[(&str, &dyn Display)]) -> String {
+    text(current(), id, args)
+}
+
+/// Message `id` in `lang`, with `args` filled in. Falls back to English,
+/// then to the id itself.
+pub fn text(lang: Lang, id: &str, args: &[(&str, &dyn Display)]) -> String {
+    let template = lookup(catalog(lang), id)
+        .or_else(|| lookup(EN, id))
+        .unwrap_or(id);
+    fill(template, args)
+}
+
+fn lookup(catalog: &'static [(&str, &str)], id: &str) -> Option<&'static str> {
+    catalog
+        .iter()
+        .find(|(key, _)| *key == id)
+        .map(|(_, template)| *template)
+}
+
+/// Replace each `{name}` in `template` with its argument. Placeholders
+/// without one are left as they are, and filled-in text isn't scanned
+/// again.
+fn fill(template: &str, args: &[(&str, &dyn Display)]) -> String {
+    let mut out = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(start) = rest.find('{') {
+        out.push_str(&rest[..start]);
+        let after = &rest[start + 1..];
+        let value = after.find('}').and_then(|end| {
+            let name = &after[..end];
+            let (_, value) = args.iter().find(|(arg, _)| *arg == name)?;
+            Some((end, value))
+        });
+        match value {
+            Some((end, value)) => {
+                out.push_str(&value.to_string());
+                rest = &after[end + 1..];
+            }
+            None => {
+                out.push('{');
+                rest = after;
+            }
+        }
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Every message of `lang` as (id, template) pairs.
+pub fn catalog(lang: Lang) -> &'static [(&'static str, &'static str)] {
+    match lang {
+        Lang::En => EN,
+        Lang::Ja => JA,
+        Lang::De => DE,
+    }
+}
+
+const EN: &[(&str, &str)] = &[
+    // `km ctl status`
+    ("status.session", "Session:  {id} (pid {pid})"),
+    ("status.command", "Command:  {command}"),
+    ("status.started", "Started:  {time} (up {uptime})"),
+    ("status.log_file", "Log file: {path}"),
+    (
+        "status.captured",
+        "Captured: {requests} requests, {responses} responses",
+    ),
+    ("status.messages", "Messages: {messages}"),
+    ("status.server", "Server:   {usage}"),
+    ("status.pings", "Pings:    {pings}"),
+    ("status.labels", "Labels:   {labels}"),
+    ("status.capture", "Capture:  {methods}{limit}"),
+    ("status.all_methods", "all methods"),
+    (
+        "status.payload_limit",
+        "; uploads omit payloads over {limit} bytes",
+    ),
+    ("status.plugins", "Plugins:  {plugins}"),
+    ("status.no_plugins", "none"),
+    ("status.down", "Down:     {name} {health}"),
+    ("status.tailing", "Tailing:  {count} client(s)"),
+    ("status.uploads_on", "Uploads:  on"),
+    ("status.uploads_off", "Uploads:  off (local only)"),
+    ("status.breaker", "Breaker:  {breaker}"),
+    ("status.api", "API:      {latency}"),
+    (
+        "status.queue",
+        "Queue:    {name}: {sent} sent, {delayed} delayed, {dropped} dropped",
+    ),
+    // `km doctor`
+    ("doctor.failed", "{count} check(s) failed"),
+    (
+        "doctor.passed",
+        "No problems found that would stop `km monitor`.",
+    ),
+    ("doctor.config", "Config"),
+    (
+        "doctor.config.missing",
+        "No config file at {path}; km monitor only logs locally",
+    ),
+    (
+        "doctor.config.missing_fix",
+        "Run `km init` to connect to Kilometers.ai",
+    ),
+    (
+        "doctor.config.unreadable",
+        "{path} could not be loaded: {error}",
+    ),
+    (
+        "doctor.config.unreadable_fix",
+        "Fix the file by hand, or recreate it with `km init`",
+    ),
+    (
+        "doctor.config.invalid_fix",
+        "Correct these settings with `km config set <key> <value>`",
+    ),
+    ("doctor.config.no_api_key", "No API key configured"),
+    (
+        "doctor.config.no_api_key_fix",
+        "Run `km init` or set KM_API_KEY",
+    ),
+    ("doctor.config.loaded", "Loaded {path}"),
+    ("doctor.api", "API"),
+    ("doctor.api.reachable", "{url} is reachable"),
+    (
+        "doctor.api.unhealthy",
+        "{url} answered the health check with {status}",
+    ),
+    (
+        "doctor.api.unhealthy_fix",
+        "The API may be degraded; try again later",
+    ),
+    ("doctor.api.unreachable", "Cannot reach {url}: {error}"),
+    (
+        "doctor.api.unreachable_fix",
+        "Check api_url, your network and any HTTPS_PROXY settings. \
+         `km monitor --local-only` works without the API",
+    ),
+    ("doctor.api.offline", "Not contacted: km is in offline mode"),
+    ("doctor.api_version", "API version"),
+    (
+        "doctor.api_version.undiscoverable",
+        "{url} predates version discovery; using defaults",
+    ),
+    (
+        "doctor.api_version.unknown_fix",
+        "km monitor will assume the server is compatible",
+    ),
+    (
+        "doctor.api_version.ok",
+        "API v{api} ({server}), event format v{events}{rate}",
+    ),
+    ("doctor.api_version.unknown_server", "unknown version"),
+    ("doctor.api_version.rate", ", {count} requests/min"),
+    (
+        "doctor.api_version.mismatch_fix",
+        "This km sends event formats {versions}; match km and server versions",
+    ),
+    ("doctor.auth", "Authentication"),
+    ("doctor.auth.ok", "API key accepted (tier: {tier})"),
+    (
+        "doctor.auth.failed_fix",
+        "Check the API key in your config or KM_API_KEY, or run `km init` to replace it",
+    ),
+    ("doctor.plugins", "Plugins"),
+    (
+        "doctor.plugins.unreadable_fix",
+        "Check the permissions of the plugin directory",
+    ),
+    ("doctor.plugins.none", "No plugins installed"),
+    ("doctor.plugins.unsigned", "{name} is unsigned"),
+    (
+        "doctor.plugins.unsigned_fix",
+        "Install signed releases (or set allow_unsigned_plugins for development)",
+    ),
+    ("doctor.plugins.needs_wasm", "{name} needs wasm support"),
+    (
+        "doctor.plugins.needs_wasm_fix",
+        "Rebuild km with `--features wasm`",
+    ),
+    (
+        "doctor.plugins.invalid_settings",
+        "{name} has invalid settings ({problem})",
+    ),
+    (
+        "doctor.plugins.invalid_settings_fix",
+        "Fix them with `km plugins config <name> <key> <value>`",
+    ),
+    (
+        "doctor.plugins.modified",
+        "Modified since installation: {names}",
+    ),
+    (
+        "doctor.plugins.modified_fix",
+        "Reinstall with `km plugins install {name}`",
+    ),
+    (
+        "doctor.plugins.skipped",
+        "Not loaded by km monitor: {plugins}",
+    ),
+    ("doctor.plugins.ok", "{count} installed, all intact"),
+    ("doctor.server", "Server"),
+    ("doctor.server.found", "{program} found at {path}"),
+    ("doctor.server.missing", "{program} was not found in PATH"),
+    (
+        "doctor.server.missing_fix",
+        "Install {program} or pass its full path to `km monitor`. \
+         MCP clients often start km with a shorter PATH than your shell",
+    ),
+    ("doctor.encoding", "Encoding"),
+    (
+        "doctor.encoding.windows",
+        "Windows pipes carry raw UTF-8 bytes",
+    ),
+    ("doctor.encoding.utf8", "UTF-8 locale ({locale})"),
+    (
+        "doctor.encoding.not_utf8",
+        "{name}={value} is not a UTF-8 locale",
+    ),
+    (
+        "doctor.encoding.unset",
+        "No locale set; servers may fall back to ASCII",
+    ),
+    (
+        "doctor.encoding.fix",
+        "Set LANG=C.UTF-8 (or another UTF-8 locale) for the server environment",
+    ),
+];
+
+const JA: &[(&str, &str)] = &[
+    ("status.session", "セッション: {id} (pid {pid})"),
+    ("status.command", "コマンド:   {command}"),
+    ("status.started", "開始:       {time} (稼働 {uptime})"),
+    ("status.log_file", "ログ:       {path}"),
+    (
+        "status.captured",
+        "記録:       リクエスト {requests} 件、レスポンス {responses} 件",
+    ),
+    ("status.messages", "メッセージ: {messages}"),
+    ("status.server", "サーバー:   {usage}"),
+    ("status.pings", "Ping:       {pings}"),
+    ("status.labels", "ラベル:     {labels}"),
+    ("status.capture", "記録対象:   {methods}{limit}"),
+    ("status.all_methods", "すべてのメソッド"),
+    (
+        "status.payload_limit",
+        "; {limit} バイトを超えるペイロードはアップロードしません",
+    ),
+    ("status.plugins", "プラグイン: {plugins}"),
+    ("status.no_plugins", "なし"),
+    ("status.down", "停止中:     {name} {health}"),
+    ("status.tailing", "tail:       クライアント {count} 件"),
+    ("status.uploads_on", "アップロード: オン"),
+    ("status.uploads_off", "アップロード: オフ (ローカルのみ)"),
+    ("status.breaker", "ブレーカー: {breaker}"),
+    ("status.api", "API:        {latency}"),
+    (
+        "status.queue",
+        "キュー:     {name}: 送信 {sent} 件、遅延 {delayed} 件、破棄 {dropped} 件",
+    ),
+    ("doctor.failed", "{count} 件のチェックが失敗しました"),
+    (
+        "doctor.passed",
+        "`km monitor` の妨げになる問題は見つかりませんでした。",
+    ),
+    ("doctor.config", "設定"),
+    (
+        "doctor.config.missing",
+        "{path} に設定ファイルがありません。km monitor はローカルにのみ記録します",
+    ),
+    (
+        "doctor.config.missing_fix",
+        "`km init` を実行して Kilometers.ai に接続してください",
+    ),
+    (
+        "doctor.config.unreadable",
+        "{path} を読み込めませんでした: {error}",
+    ),
+    (
+        "doctor.config.unreadable_fix",
+        "ファイルを手で修正するか、`km init` で作り直してください",
+    ),
+    (
+        "doctor.config.invalid_fix",
+        "`km config set <key> <value>` でこれらの設定を修正してください",
+    ),
+    ("doctor.config.no_api_key", "API キーが設定されていません"),
+    (
+        "doctor.config.no_api_key_fix",
+        "`km init` を実行するか KM_API_KEY を設定してください",
+    ),
+    ("doctor.config.loaded", "{path} を読み込みました"),
+    ("doctor.api", "API"),
+    ("doctor.api.reachable", "{url} に接続できます"),
+    (
+        "doctor.api.unhealthy",
+        "{url} のヘルスチェックの応答: {status}",
+    ),
+    (
+        "doctor.api.unhealthy_fix",
+        "API の性能が低下している可能性があります。しばらくしてから再試行してください",
+    ),
+    ("doctor.api.unreachable", "{url} に接続できません: {error}"),
+    (
+        "doctor.api.unreachable_fix",
+        "api_url、ネットワーク、HTTPS_PROXY の設定を確認してください。\
+         `km monitor --local-only` は API なしで動作します",
+    ),
+    (
+        "doctor.api.offline",
+        "接続していません: km はオフラインモードです",
+    ),
+    ("doctor.api_version", "API バージョン"),
+    (
+        "doctor.api_version.undiscoverable",
+        "{url} はバージョン検出に対応していません。既定値を使います",
+    ),
+    (
+        "doctor.api_version.unknown_fix",
+        "km monitor はサーバーに互換性があるものとして動作します",
+    ),
+    (
+        "doctor.api_version.ok",
+        "API v{api} ({server})、イベント形式 v{events}{rate}",
+    ),
+    ("doctor.api_version.unknown_server", "バージョン不明"),
+    ("doctor.api_version.rate", "、毎分 {count} リクエスト"),
+    (
+        "doctor.api_version.mismatch_fix",
+        "この km が送るイベント形式は {versions} です。km とサーバーのバージョンを合わせてください",
+    ),
+    ("doctor.auth", "認証"),
+    (
+        "doctor.auth.ok",
+        "API キーが受け付けられました (プラン: {tier})",
+    ),
+    (
+        "doctor.auth.failed_fix",
+        "設定ファイルか KM_API_KEY の API キーを確認するか、`km init` で置き換えてください",
+    ),
+    ("doctor.plugins", "プラグイン"),
+    (
+        "doctor.plugins.unreadable_fix",
+        "プラグインディレクトリのアクセス権を確認してください",
+    ),
+    (
+        "doctor.plugins.none",
+        "インストール済みのプラグインはありません",
+    ),
+    ("doctor.plugins.unsigned", "{name} は署名されていません"),
+    (
+        "doctor.plugins.unsigned_fix",
+        "署名済みのリリースをインストールしてください (開発時は allow_unsigned_plugins を設定)",
+    ),
+    (
+        "doctor.plugins.needs_wasm",
+        "{name} には wasm 対応が必要です",
+    ),
+    (
+        "doctor.plugins.needs_wasm_fix",
+        "`--features wasm` を付けて km をビルドし直してください",
+    ),
+    (
+        "doctor.plugins.invalid_settings",
+        "{name} の設定が不正です ({problem})",
+    ),
+    (
+        "doctor.plugins.invalid_settings_fix",
+        "`km plugins config <name> <key> <value>` で修正してください",
+    ),
+    (
+        "doctor.plugins.modified",
+        "インストール後に変更されています: {names}",
+    ),
+    (
+        "doctor.plugins.modified_fix",
+        "`km plugins install {name}` で再インストールしてください",
+    ),
+    (
+        "doctor.plugins.skipped",
+        "km monitor が読み込まないもの: {plugins}",
+    ),
+    (
+        "doctor.plugins.ok",
+        "{count} 件インストール済み、すべて正常",
+    ),
+    ("doctor.server", "サーバー"),
+    ("doctor.server.found", "{program} は {path} にあります"),
+    (
+        "doctor.server.missing",
+        "{program} が PATH に見つかりません",
+    ),
+    (
+        "doctor.server.missing_fix",
+        "{program} をインストールするか、`km monitor` にフルパスを渡してください。\
+         MCP クライアントはシェルより短い PATH で km を起動することがよくあります",
+    ),
+    ("doctor.encoding", "文字コード"),
+    (
+        "doctor.encoding.windows",
+        "Windows のパイプは UTF-8 のバイト列をそのまま渡します",
+    ),
+    ("doctor.encoding.utf8", "UTF-8 ロケール ({locale})"),
+    (
+        "doctor.encoding.not_utf8",
+        "{name}={value} は UTF-8 ロケールではありません",
+    ),
+    (
+        "doctor.encoding.unset",
+        "ロケールが設定されていません。サーバーが ASCII で動作する可能性があります",
+    ),
+    (
+        "doctor.encoding.fix",
+        "サーバーの環境に LANG=C.UTF-8 (または別の UTF-8 ロケール) を設定してください",
+    ),
+];
+
+const DE: &[(&str, &str)] = &[
+    ("status.session", "Sitzung:    {id} (PID {pid})"),
+    ("status.command", "Befehl:     {command}"),
+    ("status.started", "Gestartet:  {time} (seit {uptime})"),
+    ("status.log_file", "Logdatei:   {path}"),
+    (
+        "status.captured",
+        "Erfasst:    {requests} Anfragen, {responses} Antworten",
+    ),
+    ("status.messages", "Nachrichten: {messages}"),
+    ("status.server", "Server:     {usage}"),
+    ("status.pings", "Pings:      {pings}"),
+    ("status.labels", "Labels:     {labels}"),
+    ("status.capture", "Erfassung:  {methods}{limit}"),
+    ("status.all_methods", "alle Methoden"),
+    (
+        "status.payload_limit",
+        "; Uploads lassen Payloads über {limit} Bytes weg",
+    ),
+    ("status.plugins", "Plugins:    {plugins}"),
+    ("status.no_plugins", "keine"),
+    ("status.down", "Ausgefallen: {name} {health}"),
+    ("status.tailing", "Tailing:    {count} Client(s)"),
+    ("status.uploads_on", "Uploads:    an"),
+    ("status.uploads_off", "Uploads:    aus (nur lokal)"),
+    ("status.breaker", "Breaker:    {breaker}"),
+    ("status.api", "API:        {latency}"),
+    (
+        "status.queue",
+        "Warteschlange: {name}: {sent} gesendet, {delayed} verzögert, {dropped} verworfen",
+    ),
+    ("doctor.failed", "{count} Prüfung(en) fehlgeschlagen"),
+    (
+        "doctor.passed",
+        "Keine Probleme gefunden, die `km monitor` verhindern würden.",
+    ),
+    ("doctor.config", "Konfiguration"),
+    (
+        "doctor.config.missing",
+        "Keine Konfigurationsdatei unter {path}; km monitor protokolliert nur lokal",
+    ),
+    (
+        "doctor.config.missing_fix",
+        "Führen Sie `km init` aus, um sich mit Kilometers.ai zu verbinden",
+    ),
+    (
+        "doctor.config.unreadable",
+        "{path} konnte nicht geladen werden: {error}",
+    ),
+    (
+        "doctor.config.unreadable_fix",
+        "Korrigieren Sie die Datei von Hand oder erstellen Sie sie mit `km init` neu",
+    ),
+    (
+        "doctor.config.invalid_fix",
+        "Korrigieren Sie diese Einstellungen mit `km config set <key> <value>`",
+    ),
+    (
+        "doctor.config.no_api_key",
+        "Kein API-Schlüssel konfiguriert",
+    ),
+    (
+        "doctor.config.no_api_key_fix",
+        "Führen Sie `km init` aus oder setzen Sie KM_API_KEY",
+    ),
+    ("doctor.config.loaded", "{path} geladen"),
+    ("doctor.api", "API"),
+    ("doctor.api.reachable", "{url} ist erreichbar"),
+    (
+        "doctor.api.unhealthy",
+        "{url} hat den Health-Check mit {status} beantwortet",
+    ),
+    (
+        "doctor.api.unhealthy_fix",
+        "Die API ist möglicherweise beeinträchtigt; versuchen Sie es später erneut",
+    ),
+    (
+        "doctor.api.unreachable",
+        "{url} ist nicht erreichbar: {error}",
+    ),
+    (
+        "doctor.api.unreachable_fix",
+        "Prüfen Sie api_url, Ihr Netzwerk und etwaige HTTPS_PROXY-Einstellungen. \
+         `km monitor --local-only` funktioniert ohne die API",
+    ),
+    (
+        "doctor.api.offline",
+        "Nicht kontaktiert: km läuft im Offline-Modus",
+    ),
+    ("doctor.api_version", "API-Version"),
+    (
+        "doctor.api_version.undiscoverable",
+        "{url} kennt noch keine Versionserkennung; Standardwerte werden verwendet",
+    ),
+    (
+        "doctor.api_version.unknown_fix",
+        "km monitor geht davon aus, dass der Server kompatibel ist",
+    ),
+    (
+        "doctor.api_version.ok",
+        "API v{api} ({server}), Ereignisformat v{events}{rate}",
+    ),
+    ("doctor.api_version.unknown_server", "unbekannte Version"),
+    ("doctor.api_version.rate", ", {count} Anfragen/Min."),
+    (
+        "doctor.api_version.mismatch_fix",
+        "Dieses km sendet die Ereignisformate {versions}; gleichen Sie die Versionen \
+         von km und Server an",
+    ),
+    ("doctor.auth", "Authentifizierung"),
+    ("doctor.auth.ok", "API-Schlüssel akzeptiert (Tarif: {tier})"),
+    (
+        "doctor.auth.failed_fix",
+        "Prüfen Sie den API-Schlüssel in der Konfiguration oder in KM_API_KEY, oder ersetzen \
+         Sie ihn mit `km init`",
+    ),
+    ("doctor.plugins", "Plugins"),
+    (
+        "doctor.plugins.unreadable_fix",
+        "Prüfen Sie die Berechtigungen des Plugin-Verzeichnisses",
+    ),
+    ("doctor.plugins.none", "Keine Plugins installiert"),
+    ("doctor.plugins.unsigned", "{name} ist nicht signiert"),
+    (
+        "doctor.plugins.unsigned_fix",
+        "Installieren Sie signierte Releases (oder setzen Sie allow_unsigned_plugins \
+         zum Entwickeln)",
+    ),
+    (
+        "doctor.plugins.needs_wasm",
+        "{name} benötigt Wasm-Unterstützung",
+    ),
+    (
+        "doctor.plugins.needs_wasm_fix",
+        "Bauen Sie km mit `--features wasm` neu",
+    ),
+    (
+        "doctor.plugins.invalid_settings",
+        "{name} hat ungültige Einstellungen ({problem})",
+    ),
+    (
+        "doctor.plugins.invalid_settings_fix",
+        "Korrigieren Sie sie mit `km plugins config <name> <key> <value>`",
+    ),
+    (
+        "doctor.plugins.modified",
+        "Seit der Installation verändert: {names}",
+    ),
+    (
+        "doctor.plugins.modified_fix",
+        "Installieren Sie es mit `km plugins install {name}` neu",
+    ),
+    (
+        "doctor.plugins.skipped",
+        "Von km monitor nicht geladen: {plugins}",
+    ),
+    ("doctor.plugins.ok", "{count} installiert, alle unverändert"),
+    ("doctor.server", "Server"),
+    ("doctor.server.found", "{program} gefunden unter {path}"),
+    (
+        "doctor.server.missing",
+        "{program} wurde im PATH nicht gefunden",
+    ),
+    (
+        "doctor.server.missing_fix",
+        "Installieren Sie {program} oder übergeben Sie `km monitor` den vollständigen Pfad. \
+         MCP-Clients starten km oft mit einem kürzeren PATH als Ihre Shell",
+    ),
+    ("doctor.encoding", "Kodierung"),
+    (
+        "doctor.encoding.windows",
+        "Windows-Pipes übertragen UTF-8-Bytes unverändert",
+    ),
+    ("doctor.encoding.utf8", "UTF-8-Locale ({locale})"),
+    (
+        "doctor.encoding.not_utf8",
+        "{name}={value} ist keine UTF-8-Locale",
+    ),
+    (
+        "doctor.encoding.unset",
+        "Keine Locale gesetzt; Server fallen womöglich auf ASCII zurück",
+    ),
+    (
+        "doctor.encoding.fix",
+        "Setzen Sie LANG=C.UTF-8 (oder eine andere UTF-8-Locale) für die Serverumgebung",
+    ),
+];
@@ -0,0 +1,124 @@
+//! Idempotency keys for uploads, and a local record of the batches the API
+//! has acknowledged, so a batch retried after an ambiguous failure or left
+//! in the spool by a crash isn't delivered twice.
+
+use anyhow::{Context, Result};
+use chrono::{Duration, Utc};
+use serde_json::Value;
+use std::collections::HashSet;
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::PathBuf;
+use std::sync::Mutex;
+
+use crate::plugins::verify::sha256_hex;
+
+/// Carries a batch's ID; the API answers a repeated key with the original
+/// result instead of storing the batch again
+pub const IDEMPOTENCY_KEY_HEADER: &str = "Idempotency-Key";
+
+/// Acknowledged batches are remembered this long
+const RETENTION: Duration = Duration::days(7);
+/// At most this many are kept, newest first
+const MAX_ENTRIES: usize = 10_000;
+
+/// The ID of an upload body: a hash of its event IDs, so the same events
+/// get the same key however often they're retried, spooled or recovered.
+/// Bodies without event IDs are hashed whole.
+pub fn batch_id(payload: &Value) -> String {
+    let ids: Vec<&str> = payload["events"]
+        .as_array()
+        .map(|events| events.iter().filter_map(|e| e["id"].as_str()).collect())
+        .unwrap_or_default();
+    if ids.is_empty() {
+        sha256_hex(payload.to_string().as_bytes())
+    } else {
+        sha256_hex(ids.join("\n").as_bytes())
+    }
+}
+
+/// `~/.config/kilometers/sent_batches` (or the platform equivalent)
+pub fn default_path() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("sent_batches"))
+}
+
+/// IDs of the batches the API acknowledged recently, one
+/// `<unix seconds> <id>` line each.
+#[derive(Debug)]
+pub struct SentBatches {
+    path: PathBuf,
+    ids: Mutex<HashSet<String>>,
+}
+
+impl SentBatches {
+    /// Load the record at `path`, forgetting batches older than a week.
+    pub fn open(path: PathBuf) -> Result<Self> {
+        let contents = match fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read sent batches {:?}", path))
+            }
+        };
+        let cutoff = (Utc::now() - RETENTION).timestamp();
+        let lines: Vec<&str> = contents.lines().filter(|l| !l.trim().is_empty()).collect();
+        let mut kept: Vec<&str> = lines
+            .iter()
+            .copied()
+            .filter(|line| {
+                line.split_once(' ')
+                    .and_then(|(at, _)| at.parse::<i64>().ok())
+                    .is_some_and(|at| at >= cutoff)
+            })
+            .collect();
+        if kept.len() > MAX_ENTRIES {
+            kept.drain(..kept.len() - MAX_ENTRIES);
+        }
+        if kept.len() < lines.len() {
+            let mut rewritten = kept.join("\n");
+            rewritten.push('\n');
+            let tmp = path.with_extension("tmp");
+            fs::write(&tmp, rewritten)
+                .and_then(|()| fs::rename(&tmp, &path))
+                .with_context(|| format!("Failed to rewrite sent batches {:?}", path))?;
+        }
+
+        let ids = kept
+            .iter()
+            .filter_map(|line| line.split_once(' ').map(|(_, id)| id.to_string()))
+            .collect();
+        Ok(Self {
+            path,
+            ids: Mutex::new(ids),
+        })
+    }
+
+    pub fn open_default() -> Result<Self> {
+        Self::open(default_path()?)
+    }
+
+    /// The API already acknowledged the batch with this ID.
+    pub fn contains(&self, id: &str) -> bool {
+        self.ids.lock().map(|ids| ids.contains(id)).unwrap_or(false)
+    }
+
+    /// Remember that the API acknowledged the batch with this ID.
+    pub fn record(&self, id: &str) -> Result<()> {
+        let Ok(mut ids) = self.ids.lock() else {
+            return Ok(());
+        };
+        if !ids.insert(id.to_string()) {
+            return Ok(());
+        }
+        if let Some(dir) = self.path.parent() {
+            fs::create_dir_all(dir).context("Failed to create config directory")?;
+        }
+        OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&self.path)
+            .and_then(|mut file| writeln!(file, "{} {}", Utc::now().timestamp(), id))
+            .with_context(|| format!("Failed to record sent batch in {:?}", self.path))
+    }
+}
@@ -0,0 +1,349 @@
+use anyhow::{Context, Result};
+use crossterm::event::{self, Event, KeyCode, KeyEventKind, KeyModifiers};
+use crossterm::terminal;
+use serde_json::{json, Value};
+use std::collections::HashMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use crate::dashboard;
+use crate::risk::{PatternRiskAnalyzer, RiskAssessment, RiskLevel};
+use crate::traffic::{self, TrafficEntry};
+
+/// Rows above the event list: header, column titles and separator
+const HEADER_ROWS: usize = 3;
+/// Share of the screen given to the event list
+const LIST_SHARE: f32 = 0.4;
+
+/// One captured message, with the message it pairs with (a request's
+/// response, or a response's request).
+#[derive(Debug, Clone)]
+pub struct InspectedEvent {
+    pub entry: TrafficEntry,
+    pub method: Option<String>,
+    pub risk: RiskAssessment,
+    pub partner: Option<usize>,
+}
+
+impl InspectedEvent {
+    pub fn is_high_risk(&self) -> bool {
+        self.risk.level >= RiskLevel::High
+    }
+
+    fn payload(&self) -> Value {
+        self.entry
+            .rpc()
+            .unwrap_or_else(|| Value::String(self.entry.content.clone()))
+    }
+}
+
+/// State of `km inspect`: the events of one session, which one is
+/// selected and how far its payload is scrolled.
+#[derive(Debug)]
+pub struct Inspector {
+    pub session_id: String,
+    pub events: Vec<InspectedEvent>,
+    pub selected: usize,
+    pub detail_scroll: usize,
+    /// One-line message shown in the footer after an action
+    pub status: Option<String>,
+}
+
+impl Inspector {
+    pub fn new(entries: &[TrafficEntry], session_id: &str) -> Self {
+        let analyzer = PatternRiskAnalyzer::new();
+        let entries: Vec<TrafficEntry> = entries
+            .iter()
+            .filter(|e| e.session_id.as_deref() == Some(session_id))
+            .cloned()
+            .collect();
+        let methods = traffic::resolve_methods(&entries);
+
+        let mut events: Vec<InspectedEvent> = entries
+            .into_iter()
+            .zip(methods)
+            .map(|(entry, method)| InspectedEvent {
+                // Prefer the score recorded at capture time, which includes rule packs
+                risk: RiskAssessment::from_metadata(&entry.metadata)
+                    .unwrap_or_else(|| analyzer.analyze(method.as_deref(), &entry.content)),
+                entry,
+                method,
+                partner: None,
+            })
+            .collect();
+
+        // Pair responses with the latest request carrying the same id
+        let mut pending: HashMap<String, usize> = HashMap::new();
+        for i in 0..events.len() {
+            let Some(rpc) = events[i].entry.rpc() else {
+                continue;
+            };
+            let Some(id) = rpc.get("id").map(|id| id.to_string()) else {
+                continue;
+            };
+            if rpc.get("method").is_some() {
+                pending.insert(id, i);
+            } else if let Some(request) = pending.remove(&id) {
+                events[request].partner = Some(i);
+                events[i].partner = Some(request);
+            }
+        }
+
+        Self {
+            session_id: session_id.to_string(),
+            events,
+            selected: 0,
+            detail_scroll: 0,
+            status: None,
+        }
+    }
+
+    pub fn current(&self) -> Option<&InspectedEvent> {
+        self.events.get(self.selected)
+    }
+
+    pub fn select(&mut self, index: usize) {
+        let index = index.min(self.events.len().saturating_sub(1));
+        if index != self.selected {
+            self.selected = index;
+            self.detail_scroll = 0;
+        }
+    }
+
+    pub fn move_by(&mut self, delta: isize) {
+        self.select(self.selected.saturating_add_signed(delta));
+    }
+
+    pub fn first(&mut self) {
+        self.select(0);
+    }
+
+    pub fn last(&mut self) {
+        self.select(usize::MAX);
+    }
+
+    /// Jump between a request and its response.
+    pub fn jump_to_partner(&mut self) {
+        match self.current().and_then(|e| e.partner) {
+            Some(partner) => self.select(partner),
+            None => self.status = Some("No matching request or response".to_string()),
+        }
+    }
+
+    /// Select the next (or previous) high-risk event, wrapping around.
+    pub fn jump_to_high_risk(&mut self, forward: bool) {
+        let len = self.events.len();
+        let found = (1..=len)
+            .map(|step| {
+                if forward {
+                    (self.selected + step) % len
+                } else {
+                    (self.selected + len - step % len) % len
+                }
+            })
+            .find(|&i| self.events[i].is_high_risk());
+        match found {
+            Some(i) => self.select(i),
+            None => self.status = Some("No high-risk events in this session".to_string()),
+        }
+    }
+
+    pub fn scroll_detail(&mut self, delta: isize) {
+        self.detail_scroll = self.detail_scroll.saturating_add_signed(delta);
+    }
+
+    /// The selected event as a self-contained JSON document, for attaching
+    /// to bug reports.
+    pub fn export_document(&self) -> Option<Value> {
+        let event = self.current()?;
+        let partner = event.partner.map(|i| &self.events[i]);
+        Some(json!({
+            "session_id": self.session_id,
+            "event": self.selected + 1,
+            "timestamp": event.entry.timestamp,
+            "direction": event.entry.direction,
+            "method": event.method,
+            "duration_ms": event.entry.duration_ms.or(partner.and_then(|p| p.entry.duration_ms)),
+            "risk": {
+                "score": event.risk.score,
+                "level": event.risk.level,
+                "patterns": event.risk.matched_patterns,
+                "explanation": event.risk.explanation,
+            },
+            "metadata": event.entry.metadata,
+            "message": event.payload(),
+            "paired_message": partner.map(|p| p.payload()),
+        }))
+    }
+
+    /// Write the selected event to `dir` and return the file name.
+    pub fn export_selected(&mut self, dir: &Path) -> Result<PathBuf> {
+        let document = self.export_document().context("No event selected")?;
+        let short: String = self.session_id.chars().take(8).collect();
+        let path = dir.join(format!("km-event-{}-{}.json", short, self.selected + 1));
+        fs::write(&path, serde_json::to_string_pretty(&document)?)
+            .with_context(|| format!("Failed to write {:?}", path))?;
+        self.status = Some(format!("Exported event to {}", path.display()));
+        Ok(path)
+    }
+
+    /// Render the screen as plain text lines so the layout can be tested
+    /// independently of the terminal.
+    pub fn render_lines(&self, width: usize, height: usize) -> Vec<String> {
+        let mut lines = vec![
+            format!(
+                "km inspect — session {}  event {}/{}    (? for keys, q to quit)",
+                self.session_id,
+                if self.events.is_empty() {
+                    0
+                } else {
+                    self.selected + 1
+                },
+                self.events.len()
+            ),
+            format!(
+                "  {:>5}  {:<12}  {:<8}  {:<24}  {:>6}  {:<8}  {}",
+                "#", "TIME", "DIR", "METHOD", "ID", "RISK", "PAIR"
+            ),
+            "─".repeat(width.min(100)),
+        ];
+
+        // Event list, scrolled to keep the selection visible
+        let list_rows = ((height as f32 * LIST_SHARE) as usize).max(3);
+        let top = self.selected.saturating_sub(list_rows / 2);
+        let top = top.min(self.events.len().saturating_sub(list_rows));
+        for (i, event) in self.events.iter().enumerate().skip(top).take(list_rows) {
+            let marker = if i == self.selected { '›' } else { ' ' };
+            let flag = if event.is_high_risk() { '!' } else { ' ' };
+            lines.push(format!(
+                "{} {:>5}  {:<12}  {:<8}  {:<24}  {:>6}  {}{:<7}  {}",
+                marker,
+                i + 1,
+                event.entry.timestamp.format("%H:%M:%S%.3f"),
+                event.entry.direction,
+                event.method.as_deref().unwrap_or("-"),
+                event
+                    .entry
+                    .rpc_id()
+                    .map(|id| match id {
+                        Value::String(s) => s,
+                        other => other.to_string(),
+                    })
+                    .unwrap_or_else(|| "-".to_string()),
+                flag,
+                event.risk.level.to_string(),
+                event
+                    .partner
+                    .map(|p| format!("#{}", p + 1))
+                    .unwrap_or_else(|| "-".to_string()),
+            ));
+        }
+        if self.events.is_empty() {
+            lines.push("  (no events in this session)".to_string());
+        }
+        lines.push("─".repeat(width.min(100)));
+
+        if let Some(event) = self.current() {
+            lines.push(format!(
+                "Risk: {} ({:.2}) {}  Latency: {}",
+                event.risk.level,
+                event.risk.score,
+                event.risk.matched_patterns.join(", "),
+                event
+                    .entry
+                    .duration_ms
+                    .map(|d| format!("{:.1}ms", d))
+                    .unwrap_or_else(|| "-".to_string())
+            ));
+            lines.extend(event.risk.explanation.lines());
+            let detail_rows = height.saturating_sub(lines.len() + 1);
+            let pretty = serde_json::to_string_pretty(&event.payload()).unwrap_or_default();
+            lines.extend(
+                pretty
+                    .lines()
+                    .skip(self.detail_scroll)
+                    .take(detail_rows)
+                    .map(String::from),
+            );
+        }
+
+        while lines.len() + 1 < height {
+            lines.push(String::new());
+        }
+        lines.push(self.status.clone().unwrap_or_default());
+        lines
+    }
+}
+
+const HELP: &[&str] = &[
+    "km inspect keys",
+    "",
+    "  ↑/k ↓/j        previous / next event",
+    "  PgUp PgDn      page through events",
+    "  g / G          first / last event",
+    "  p or Enter     jump between request and response",
+    "  n / N          next / previous high-risk event",
+    "  u / d          scroll the payload",
+    "  e              export the event to a JSON file",
+    "  q or Esc       quit",
+    "",
+    "Press any key to return.",
+];
+
+/// Browse the events of a session interactively until the user quits.
+pub fn run(entries: &[TrafficEntry], session_id: &str) -> Result<()> {
+    let mut inspector = Inspector::new(entries, session_id);
+    let mut stdout = io::stdout();
+    let _screen = dashboard::FullScreen::enter(&mut stdout)?;
+    event_loop(&mut stdout, &mut inspector)
+}
+
+fn event_loop(stdout: &mut io::Stdout, inspector: &mut Inspector) -> Result<()> {
+    let mut help = false;
+    loop {
+        let (width, height) = terminal::size().unwrap_or((120, 40));
+        let lines = if help {
+            HELP.iter().map(|l| l.to_string()).collect()
+        } else {
+            inspector.render_lines(width as usize, height as usize)
+        };
+        dashboard::draw(stdout, &lines)?;
+
+        let Event::Key(key) = event::read()? else {
+            continue;
+        };
+        if key.kind != KeyEventKind::Press {
+            continue;
+        }
+        if help {
+            help = false;
+            continue;
+        }
+        inspector.status = None;
+
+        let page = (height as f32 * LIST_SHARE) as isize - HEADER_ROWS as isize;
+        match key.code {
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => return Ok(()),
+            KeyCode::Char('q') | KeyCode::Esc => return Ok(()),
+            KeyCode::Char('?') => help = true,
+            KeyCode::Down | KeyCode::Char('j') => inspector.move_by(1),
+            KeyCode::Up | KeyCode::Char('k') => inspector.move_by(-1),
+            KeyCode::PageDown | KeyCode::Char(' ') => inspector.move_by(page.max(1)),
+            KeyCode::PageUp => inspector.move_by(-page.max(1)),
+            KeyCode::Home | KeyCode::Char('g') => inspector.first(),
+            KeyCode::End | KeyCode::Char('G') => inspector.last(),
+            KeyCode::Enter | KeyCode::Char('p') => inspector.jump_to_partner(),
+            KeyCode::Char('n') => inspector.jump_to_high_risk(true),
+            KeyCode::Char('N') => inspector.jump_to_high_risk(false),
+            KeyCode::Char('d') => inspector.scroll_detail(10),
+            KeyCode::Char('u') => inspector.scroll_detail(-10),
+            KeyCode::Char('e') => {
+                if let Err(e) = inspector.export_selected(Path::new(".")) {
+                    inspector.status = Some(format!("Export failed: {:#}", e));
+                }
+            }
+            _ => {}
+        }
+    }
+}
@@ -0,0 +1,467 @@
+//! Tool catalogs: the tools a server offered in a session, taken from its
+//! tools/list responses. Each session's catalog is saved in
+//! `~/.config/kilometers/tools`, listed by `km tools list` and compared with
+//! the catalog of the same server's previous session, so a tool that shows
+//! up between sessions, and a dangerous-looking one especially, doesn't go
+//! unnoticed.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+pub const TOOLS_LIST_METHOD: &str = "tools/list";
+
+/// Words in a tool's name that say what it can do to the machine it runs
+/// on, by category
+const DANGEROUS_WORDS: &[(&str, &[&str])] = &[
+    (
+        "code_execution",
+        &[
+            "exec",
+            "execute",
+            "shell",
+            "bash",
+            "sh",
+            "cmd",
+            "powershell",
+            "terminal",
+            "command",
+            "eval",
+            "script",
+            "subprocess",
+            "spawn",
+        ],
+    ),
+    (
+        "destructive",
+        &[
+            "delete",
+            "remove",
+            "rm",
+            "drop",
+            "truncate",
+            "destroy",
+            "wipe",
+            "purge",
+            "erase",
+            "kill",
+            "terminate",
+        ],
+    ),
+    (
+        "file_write",
+        &["write", "overwrite", "chmod", "chown", "move", "rename"],
+    ),
+    (
+        "network",
+        &["http", "curl", "wget", "fetch", "download", "webhook"],
+    ),
+    (
+        "credentials",
+        &[
+            "secret",
+            "secrets",
+            "password",
+            "credential",
+            "credentials",
+            "token",
+        ],
+    ),
+];
+
+/// `~/.config/kilometers/tools` (or the platform equivalent)
+pub fn default_dir() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("tools"))
+}
+
+/// One tool from a tools/list response.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Tool {
+    pub name: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub description: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub input_schema: Option<Value>,
+}
+
+impl Tool {
+    fn from(value: &Value) -> Option<Self> {
+        Some(Self {
+            name: value.get("name")?.as_str()?.to_string(),
+            description: value
+                .get("description")
+                .and_then(|d| d.as_str())
+                .map(String::from),
+            input_schema: value.get("inputSchema").cloned(),
+        })
+    }
+
+    /// What the tool's name says it can do that's worth a second look,
+    /// e.g. `code_execution` for `run_shell_command`.
+    pub fn dangers(&self) -> Vec<&'static str> {
+        let words = words(&self.name);
+        DANGEROUS_WORDS
+            .iter()
+            .filter(|(_, dangerous)| dangerous.iter().any(|word| words.contains(*word)))
+            .map(|(category, _)| *category)
+            .collect()
+    }
+}
+
+/// The lowercase words of a tool name: `runShell-command_v2` is `run`,
+/// `shell`, `command` and `v2`.
+fn words(name: &str) -> BTreeSet<String> {
+    let mut words = BTreeSet::new();
+    let mut word = String::new();
+    let mut previous_lower = false;
+    for c in name.chars() {
+        if !c.is_alphanumeric() {
+            if !word.is_empty() {
+                words.insert(std::mem::take(&mut word));
+            }
+            previous_lower = false;
+            continue;
+        }
+        if c.is_uppercase() && previous_lower && !word.is_empty() {
+            words.insert(std::mem::take(&mut word));
+        }
+        previous_lower = c.is_lowercase() || c.is_ascii_digit();
+        word.extend(c.to_lowercase());
+    }
+    if !word.is_empty() {
+        words.insert(word);
+    }
+    words
+}
+
+/// The tools a server offered in one session.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Catalog {
+    pub session_id: String,
+    /// `serverInfo.name` from the initialize response, if it was seen
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub server: Option<String>,
+    /// The server command, with secrets scrubbed
+    pub command: String,
+    pub updated_at: DateTime<Utc>,
+    /// By name
+    pub tools: Vec<Tool>,
+}
+
+impl Catalog {
+    pub fn new(session_id: &str, command: &str) -> Self {
+        Self {
+            session_id: session_id.to_string(),
+            server: None,
+            command: command.to_string(),
+            updated_at: Utc::now(),
+            tools: Vec::new(),
+        }
+    }
+
+    /// Add the tools of a tools/list `result`, one page of them when the
+    /// list is paginated. A tool listed again replaces the earlier one.
+    /// Returns whether the catalog changed.
+    pub fn merge(&mut self, result: &Value) -> bool {
+        let Some(Value::Array(tools)) = result.get("tools") else {
+            return false;
+        };
+        let mut changed = false;
+        for tool in tools.iter().filter_map(Tool::from) {
+            match self.tools.binary_search_by(|t| t.name.cmp(&tool.name)) {
+                Ok(i) if self.tools[i] == tool => {}
+                Ok(i) => {
+                    self.tools[i] = tool;
+                    changed = true;
+                }
+                Err(i) => {
+                    self.tools.insert(i, tool);
+                    changed = true;
+                }
+            }
+        }
+        if changed {
+            self.updated_at = Utc::now();
+        }
+        changed
+    }
+
+    pub fn get(&self, name: &str) -> Option<&Tool> {
+        self.tools.iter().find(|tool| tool.name == name)
+    }
+
+    /// Whether `other` is a catalog of the same server: the same
+    /// `serverInfo.name` when both have one, otherwise the same command.
+    pub fn same_server(&self, other: &Catalog) -> bool {
+        match (&self.server, &other.server) {
+            (Some(a), Some(b)) => a == b,
+            _ => self.command == other.command,
+        }
+    }
+
+    fn path(dir: &Path, session_id: &str) -> PathBuf {
+        dir.join(format!("{}.json", session_id))
+    }
+
+    pub fn save(&self, dir: &Path) -> Result<()> {
+        fs::create_dir_all(dir).with_context(|| format!("Failed to create {:?}", dir))?;
+        let path = Self::path(dir, &self.session_id);
+        fs::write(&path, serde_json::to_string_pretty(self)?)
+            .with_context(|| format!("Failed to write tool catalog {:?}", path))
+    }
+}
+
+/// Every catalog saved in `dir`, most recently updated first. Unreadable
+/// ones are skipped.
+pub fn load_all(dir: &Path) -> Result<Vec<Catalog>> {
+    if !dir.exists() {
+        return Ok(Vec::new());
+    }
+    let mut catalogs = Vec::new();
+    for entry in fs::read_dir(dir).with_context(|| format!("Failed to read {:?}", dir))? {
+        let path = entry?.path();
+        if path.extension().and_then(|e| e.to_str()) != Some("json") {
+            continue;
+        }
+        let catalog = fs::read_to_string(&path)
+            .map_err(anyhow::Error::from)
+            .and_then(|contents| Ok(serde_json::from_str::<Catalog>(&contents)?));
+        match catalog {
+            Ok(catalog) => catalogs.push(catalog),
+            Err(e) => tracing::debug!("Skipping tool catalog {:?}: {}", path, e),
+        }
+    }
+    catalogs.sort_by(|a, b| {
+        b.updated_at
+            .cmp(&a.updated_at)
+            .then(a.session_id.cmp(&b.session_id))
+    });
+    Ok(catalogs)
+}
+
+/// Find the catalog of the session `id` refers to: an exact id, or a prefix
+/// that matches exactly one session.
+pub fn resolve<'a>(catalogs: &'a [Catalog], id: &str) -> Result<&'a Catalog> {
+    if let Some(catalog) = catalogs.iter().find(|c| c.session_id == id) {
+        return Ok(catalog);
+    }
+
+    let matches: Vec<_> = catalogs
+        .iter()
+        .filter(|c| c.session_id.starts_with(id))
+        .collect();
+    match matches.as_slice() {
+        [catalog] => Ok(catalog),
+        [] => Err(anyhow::anyhow!(
+            "No tool catalog for a session matching '{}'; was tools/list called in it?",
+            id
+        )),
+        _ => Err(anyhow::anyhow!(
+            "'{}' matches {} sessions; use more of the id",
+            id,
+            matches.len()
+        )),
+    }
+}
+
+/// The catalog of the same server's session before `catalog`'s.
+pub fn previous<'a>(catalogs: &'a [Catalog], catalog: &Catalog) -> Option<&'a Catalog> {
+    catalogs.iter().find(|other| {
+        other.session_id != catalog.session_id
+            && other.updated_at <= catalog.updated_at
+            && other.same_server(catalog)
+    })
+}
+
+/// How a server's tools changed from one session to the next.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct ToolChanges {
+    pub previous_session: String,
+    pub added: Vec<String>,
+    pub removed: Vec<String>,
+    /// Tools whose description or input schema changed
+    pub changed: Vec<String>,
+    /// Added tools that look dangerous, with what makes them so
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub dangerous: BTreeMap<String, Vec<&'static str>>,
+}
+
+impl ToolChanges {
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.removed.is_empty() && self.changed.is_empty()
+    }
+}
+
+pub fn changes(previous: &Catalog, current: &Catalog) -> ToolChanges {
+    let mut changes = ToolChanges {
+        previous_session: previous.session_id.clone(),
+        ..Default::default()
+    };
+    for tool in &current.tools {
+        match previous.get(&tool.name) {
+            Some(before) if before == tool => {}
+            Some(_) => changes.changed.push(tool.name.clone()),
+            None => {
+                changes.added.push(tool.name.clone());
+                let dangers = tool.dangers();
+                if !dangers.is_empty() {
+                    changes.dangerous.insert(tool.name.clone(), dangers);
+                }
+            }
+        }
+    }
+    changes.removed = previous
+        .tools
+        .iter()
+        .filter(|tool| current.get(&tool.name).is_none())
+        .map(|tool| tool.name.clone())
+        .collect();
+    changes
+}
+
+/// Keeps the catalog of a monitor session up to date as the server answers
+/// tools/list, and warns about new dangerous-looking tools.
+#[derive(Debug)]
+pub struct InventoryTracker {
+    dir: PathBuf,
+    state: Mutex<TrackerState>,
+}
+
+#[derive(Debug)]
+struct TrackerState {
+    catalog: Catalog,
+    /// Tools already warned about
+    warned: BTreeSet<String>,
+}
+
+impl InventoryTracker {
+    pub fn new(dir: PathBuf, session_id: &str, command: &str) -> Self {
+        Self {
+            dir,
+            state: Mutex::new(TrackerState {
+                catalog: Catalog::new(session_id, command),
+                warned: BTreeSet::new(),
+            }),
+        }
+    }
+
+    /// The input schema of `tool`, if the server has listed it.
+    pub fn input_schema(&self, tool: &str) -> Option<Value> {
+        let state = self.state.lock().ok()?;
+        state.catalog.get(tool)?.input_schema.clone()
+    }
+
+    /// Take the tools from `content`, a response to tools/list. `server` is
+    /// the server's name, if the initialize exchange gave one.
+    pub fn observe(&self, content: &str, server: Option<String>) {
+        let Some(result) = serde_json::from_str::<Value>(content)
+            .ok()
+            .and_then(|message| message.get("result").cloned())
+        else {
+            return;
+        };
+        let Ok(mut state) = self.state.lock() else {
+            return;
+        };
+        let TrackerState { catalog, warned } = &mut *state;
+        if !catalog.merge(&result) {
+            return;
+        }
+        if server.is_some() {
+            catalog.server = server;
+        }
+        if let Err(e) = catalog.save(&self.dir) {
+            tracing::warn!("{:#}", e);
+        }
+
+        let catalogs = load_all(&self.dir).unwrap_or_default();
+        let Some(previous) = previous(&catalogs, catalog) else {
+            return;
+        };
+        let changes = changes(previous, catalog);
+        for (name, dangers) in &changes.dangerous {
+            if warned.insert(name.clone()) {
+                tracing::warn!(
+                    "The server offers a new tool since session {}: {} ({})",
+                    previous.session_id,
+                    name,
+                    dangers.join(", ")
+                );
+            }
+        }
+    }
+}
+
+/// Render `km tools list` for one session's catalog and, when there's an
+/// earlier session of the same server, how its tools changed since.
+pub fn render_list(catalog: &Catalog, changes: Option<&ToolChanges>) -> Vec<String> {
+    let mut lines = vec![
+        format!("Session:  {}", catalog.session_id),
+        format!(
+            "Server:   {} ({})",
+            catalog.server.as_deref().unwrap_or("-"),
+            catalog.command
+        ),
+        format!(
+            "Updated:  {}",
+            catalog.updated_at.format("%Y-%m-%d %H:%M:%S UTC")
+        ),
+        String::new(),
+        format!("  {:<32}  {}", "TOOL", "DESCRIPTION"),
+    ];
+    for tool in &catalog.tools {
+        let dangers = tool.dangers();
+        let description = tool.description.as_deref().unwrap_or("-");
+        let mut summary: String = description.chars().take(60).collect();
+        if summary.len() < description.len() {
+            summary.push('…');
+        }
+        if !dangers.is_empty() {
+            summary = format!("{} [{}]", summary, dangers.join(", "));
+        }
+        lines.push(format!(
+            "{} {:<32}  {}",
+            if dangers.is_empty() { ' ' } else { '!' },
+            tool.name,
+            summary
+        ));
+    }
+    if catalog.tools.is_empty() {
+        lines.push("  (no tools)".to_string());
+    }
+
+    let Some(changes) = changes else {
+        return lines;
+    };
+    lines.push(String::new());
+    if changes.is_empty() {
+        lines.push(format!(
+            "No changes since session {}",
+            changes.previous_session
+        ));
+        return lines;
+    }
+    lines.push(format!(
+        "Changes since session {}",
+        changes.previous_session
+    ));
+    for name in &changes.added {
+        match changes.dangerous.get(name) {
+            Some(dangers) => lines.push(format!("  + {}  ! {}", name, dangers.join(", "))),
+            None => lines.push(format!("  + {}", name)),
+        }
+    }
+    for name in &changes.removed {
+        lines.push(format!("  - {}", name));
+    }
+    for name in &changes.changed {
+        lines.push(format!("  ~ {} (description or input schema)", name));
+    }
+    lines
+}
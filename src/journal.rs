@@ -0,0 +1,351 @@
+//! Write-ahead journal of the events a `km monitor` session queues for
+//! upload. Each event is journaled before it's queued and acknowledged once
+//! the uploader has delivered or spooled it, so when km is killed mid-session
+//! the next run can finalize the session and spool what was left unsent.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::json;
+use std::collections::HashSet;
+use std::fs::{self, File};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+
+use crate::correlation::{MessageClass, MessageCounts};
+use crate::encryption::{self, PayloadCipher};
+use crate::handshake::{Handshake, INITIALIZE_METHOD};
+use crate::process;
+use crate::spool::Spool;
+use crate::traffic::Labels;
+use crate::uploader::{EventUploader, McpEvent, SessionEnd};
+
+/// `~/.config/kilometers/journal` (or the platform equivalent)
+pub fn default_dir() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("journal"))
+}
+
+/// The session a journal belongs to, written as its first line.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct JournalStart {
+    pub session_id: String,
+    /// The km process writing the journal
+    pub pid: u32,
+    pub started_at: DateTime<Utc>,
+    /// Where the session's events are uploaded
+    pub endpoint: String,
+    #[serde(default)]
+    pub command: Vec<String>,
+    #[serde(default, skip_serializing_if = "Labels::is_empty")]
+    pub labels: Labels,
+    /// Payloads are redacted before upload (`--redact`)
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub redact: bool,
+}
+
+/// One line of a journal.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+enum Record {
+    Start(JournalStart),
+    Event {
+        event: McpEvent,
+    },
+    /// An event encrypted at rest (`encryption.enabled`)
+    SealedEvent {
+        event: String,
+    },
+    /// Events delivered to the API or moved to the spool
+    Ack {
+        ids: Vec<String>,
+    },
+}
+
+/// The journal of the running session.
+#[derive(Debug)]
+pub struct Journal {
+    path: PathBuf,
+    /// `None` once the session has finished
+    file: Mutex<Option<File>>,
+    /// Set after the first failed write, so it's only reported once
+    failed: AtomicBool,
+    /// Events are encrypted with this before they're written
+    cipher: Option<Arc<PayloadCipher>>,
+}
+
+impl Journal {
+    pub fn create(dir: &Path, start: &JournalStart) -> Result<Self> {
+        fs::create_dir_all(dir).context("Failed to create journal directory")?;
+        let path = dir.join(format!("{}.jsonl", start.session_id));
+        let file =
+            open_private(&path).with_context(|| format!("Failed to create journal {:?}", path))?;
+        let journal = Self {
+            path,
+            file: Mutex::new(Some(file)),
+            failed: AtomicBool::new(false),
+            cipher: None,
+        };
+        journal.write(&Record::Start(start.clone()));
+        Ok(journal)
+    }
+
+    pub fn with_cipher(mut self, cipher: Arc<PayloadCipher>) -> Self {
+        self.cipher = Some(cipher);
+        self
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Journal an event about to be queued for upload.
+    pub fn record(&self, event: &McpEvent) {
+        let Some(ref cipher) = self.cipher else {
+            return self.write(&Record::Event {
+                event: event.clone(),
+            });
+        };
+        match serde_json::to_string(event)
+            .map_err(anyhow::Error::from)
+            .and_then(|event| cipher.seal(&event))
+        {
+            Ok(event) => self.write(&Record::SealedEvent { event }),
+            Err(e) => tracing::warn!("Could not journal event {}: {:#}", event.id, e),
+        }
+    }
+
+    /// Mark events as delivered or spooled; recovery leaves them alone.
+    pub fn ack(&self, ids: Vec<String>) {
+        if !ids.is_empty() {
+            self.write(&Record::Ack { ids });
+        }
+    }
+
+    /// The session ended and its uploads drained: remove the journal.
+    pub fn finish(&self) {
+        if let Ok(mut file) = self.file.lock() {
+            // Closed first; Windows won't remove an open file
+            if file.take().is_some() {
+                if let Err(e) = fs::remove_file(&self.path) {
+                    tracing::warn!("Could not remove journal {:?}: {}", self.path, e);
+                }
+            }
+        }
+    }
+
+    /// The session ended but its uploads didn't drain in time: move the
+    /// unacknowledged events to the spool now, as upload bodies built by
+    /// `uploader`, rather than at the next start, and remove the journal.
+    /// Stop the uploader first; a batch it was still sending may then
+    /// reach the API twice. Returns the number of events spooled.
+    pub fn spool_pending(
+        &self,
+        uploader: &EventUploader,
+        spool: &Spool,
+        max_batch_bytes: usize,
+    ) -> Result<usize> {
+        let session = match self.file.lock() {
+            Ok(mut file) => {
+                if file.take().is_none() {
+                    return Ok(0);
+                }
+                Interrupted::read(&self.path)?
+            }
+            Err(_) => return Ok(0),
+        };
+        for payload in uploader.batch_payloads(&session.pending, max_batch_bytes) {
+            spool.enqueue(&session.start.endpoint, &payload)?;
+        }
+        fs::remove_file(&self.path)
+            .with_context(|| format!("Failed to remove journal {:?}", self.path))?;
+        Ok(session.pending.len())
+    }
+
+    fn write(&self, record: &Record) {
+        let Ok(mut line) = serde_json::to_string(record) else {
+            return;
+        };
+        line.push('\n');
+        let result = match self.file.lock() {
+            // One write per line, so a crash can only cut off the last one
+            Ok(mut file) => match file.as_mut() {
+                Some(file) => file.write_all(line.as_bytes()),
+                None => Ok(()),
+            },
+            Err(_) => Ok(()),
+        };
+        if let Err(e) = result {
+            if !self.failed.swap(true, Ordering::Relaxed) {
+                tracing::warn!(
+                    "Could not write to journal {:?}; events may be lost if km is killed: {}",
+                    self.path,
+                    e
+                );
+            }
+        }
+    }
+}
+
+/// Journals hold payloads, so only the user may read them
+fn open_private(path: &Path) -> std::io::Result<File> {
+    let mut options = fs::OpenOptions::new();
+    options.create(true).append(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600);
+    }
+    options.open(path)
+}
+
+/// A session whose km process went away without finishing its journal.
+#[derive(Debug, Clone)]
+pub struct Interrupted {
+    pub path: PathBuf,
+    pub start: JournalStart,
+    /// Events journaled but never acknowledged, oldest first
+    pub pending: Vec<McpEvent>,
+    /// Requests and responses journaled over the whole session
+    pub requests: u64,
+    pub responses: u64,
+    /// The same messages by class; those journaled without a payload
+    /// count as `other`
+    pub messages: MessageCounts,
+    /// The initialize exchange, from the journaled payloads
+    pub handshake: Handshake,
+    /// The session's `session_end` event was journaled
+    pub ended: bool,
+    /// Time of the last journaled event
+    pub last_event: Option<DateTime<Utc>>,
+}
+
+impl Interrupted {
+    /// Read the journal at `path`. A line cut off by a crash is skipped.
+    pub fn read(path: &Path) -> Result<Self> {
+        let contents = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read journal {:?}", path))?;
+        let mut start = None;
+        let mut events = Vec::new();
+        let mut acked = HashSet::new();
+        for line in contents.lines().filter(|l| !l.trim().is_empty()) {
+            match serde_json::from_str(line) {
+                Ok(Record::Start(record)) => start = Some(record),
+                Ok(Record::Event { event }) => events.push(event),
+                Ok(Record::SealedEvent { event }) => {
+                    let event = encryption::unseal(&event)
+                        .with_context(|| format!("Failed to read journal {:?}", path))?;
+                    match serde_json::from_str(&event) {
+                        Ok(event) => events.push(event),
+                        Err(e) => tracing::debug!("Skipping journal event in {:?}: {}", path, e),
+                    }
+                }
+                Ok(Record::Ack { ids }) => acked.extend(ids),
+                Err(e) => tracing::debug!("Skipping journal line in {:?}: {}", path, e),
+            }
+        }
+        let start = start.with_context(|| format!("Journal {:?} has no start record", path))?;
+
+        let count = |direction: &str| events.iter().filter(|e| e.direction == direction).count();
+        let mut messages = MessageCounts::default();
+        let mut handshake = Handshake::default();
+        for event in events.iter().filter(|e| e.direction != "session_end") {
+            let class = match event.payload {
+                Some(ref payload) => MessageClass::of(payload, event.direction == "request"),
+                None => MessageClass::Other,
+            };
+            messages.add(class, 1);
+            if let (Some(INITIALIZE_METHOD), Some(payload)) =
+                (event.method.as_deref(), event.payload.as_ref())
+            {
+                handshake.observe(payload);
+            }
+        }
+        Ok(Self {
+            path: path.to_path_buf(),
+            requests: count("request") as u64,
+            responses: count("response") as u64,
+            messages,
+            handshake,
+            ended: events.iter().any(|e| e.direction == "session_end"),
+            last_event: events.iter().map(|e| e.timestamp).max(),
+            pending: events
+                .into_iter()
+                .filter(|e| !acked.contains(&e.id))
+                .collect(),
+            start,
+        })
+    }
+
+    /// Close the session with a `session_end` event if it never got one.
+    /// Its counts are of the journaled (uploaded) events, so they leave out
+    /// anything sampling dropped.
+    pub fn finalize(&mut self) {
+        if self.ended {
+            return;
+        }
+        let summary = SessionEnd {
+            started_at: self.start.started_at,
+            ended_at: self.last_event.unwrap_or(self.start.started_at),
+            requests: self.requests,
+            responses: self.responses,
+            messages: self.messages,
+            resources: None,
+            handshake: (!self.handshake.is_empty()).then(|| self.handshake.clone()),
+        };
+        let mut event = McpEvent::session_end(&self.start.session_id, &summary);
+        event.timestamp = summary.ended_at;
+        event.labels = self.start.labels.clone();
+        event.metadata.insert("recovered".to_string(), json!(true));
+        self.pending.push(event);
+        self.ended = true;
+    }
+}
+
+/// Journals in `dir` whose km process is no longer running, oldest first.
+/// Unreadable journals are skipped.
+pub fn interrupted(dir: &Path) -> Result<Vec<Interrupted>> {
+    if !dir.exists() {
+        return Ok(Vec::new());
+    }
+    let mut sessions: Vec<Interrupted> = fs::read_dir(dir)
+        .context("Failed to read journal directory")?
+        .filter_map(|entry| entry.ok().map(|e| e.path()))
+        .filter(|p| p.extension().is_some_and(|ext| ext == "jsonl"))
+        .filter_map(|path| match Interrupted::read(&path) {
+            Ok(session) => Some(session),
+            Err(e) => {
+                tracing::warn!("Skipping journal: {:#}", e);
+                None
+            }
+        })
+        .filter(|session| !process::is_running(session.start.pid))
+        .collect();
+    sessions.sort_by_key(|s| s.start.started_at);
+    Ok(sessions)
+}
+
+/// Finalize an interrupted session and move its unsent events to the spool,
+/// as upload bodies built by `uploader`, then remove its journal. Returns
+/// the number of events spooled.
+pub fn recover(
+    mut session: Interrupted,
+    uploader: &EventUploader,
+    spool: &Spool,
+    max_batch_bytes: usize,
+) -> Result<usize> {
+    session.finalize();
+    for payload in uploader.batch_payloads(&session.pending, max_batch_bytes) {
+        spool.enqueue(&session.start.endpoint, &payload)?;
+    }
+    fs::remove_file(&session.path)
+        .with_context(|| format!("Failed to remove journal {:?}", session.path))?;
+    tracing::info!(
+        "Recovered interrupted session {}: spooled {} event(s)",
+        session.start.session_id,
+        session.pending.len()
+    );
+    Ok(session.pending.len())
+}
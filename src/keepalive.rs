@@ -0,0 +1,187 @@
+//! Pings between the client and the MCP server. Clients and servers ping
+//! each other to check the connection, some every second; unless
+//! `capture_pings` is set, the proxy forwards them as they are, past
+//! policies, plugins and capture, and only counts them and times the
+//! answers. Reported by `km ctl status` and the metrics endpoint.
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::VecDeque;
+use std::sync::Mutex;
+use std::time::Instant;
+
+use crate::latency;
+
+pub const PING_METHOD: &str = "ping";
+
+/// Pings and their answers are a few dozen bytes; longer frames are never
+/// parsed for the fast path
+const MAX_PING_BYTES: usize = 256;
+/// Unanswered pings remembered; older ones are counted as unanswered
+const MAX_OUTSTANDING: usize = 64;
+
+/// Which side sent a frame.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Peer {
+    Client,
+    Server,
+}
+
+/// How the pings of a session are going.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct PingHealth {
+    /// Pings from the client to the server
+    pub client_pings: u64,
+    /// Pings from the server to the client
+    pub server_pings: u64,
+    /// Pings answered with a result
+    pub answered: u64,
+    /// Pings answered with an error
+    pub errors: u64,
+    /// Pings not answered, or not answered yet
+    pub unanswered: u64,
+    /// Round trip of the latest answered ping
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_rtt_ms: Option<f64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_rtt_ms: Option<f64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_answered_at: Option<DateTime<Utc>>,
+}
+
+impl PingHealth {
+    /// `12 from the client, 0 from the server; 12 answered (last 0.4ms, max 1.2ms), 0 errors, 0 unanswered`
+    pub fn describe(&self) -> String {
+        let rtt = match (self.last_rtt_ms, self.max_rtt_ms) {
+            (Some(last), Some(max)) => format!(" (last {:.1}ms, max {:.1}ms)", last, max),
+            _ => String::new(),
+        };
+        format!(
+            "{} from the client, {} from the server; {} answered{}, {} errors, {} unanswered",
+            self.client_pings, self.server_pings, self.answered, rtt, self.errors, self.unanswered
+        )
+    }
+}
+
+/// Just enough of a message to tell pings and their answers apart.
+#[derive(Deserialize)]
+struct Shape {
+    id: Option<Value>,
+    method: Option<String>,
+    error: Option<Value>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    health: PingHealth,
+    /// Pings waiting for an answer: who sent them, their id and when
+    outstanding: VecDeque<(Peer, Value, Instant)>,
+    /// Pings forgotten before they were answered
+    expired: u64,
+}
+
+/// Spots pings and their answers in the frames the proxy forwards, shared
+/// between both directions of a proxy run and whoever reports on it.
+#[derive(Debug, Default)]
+pub struct PingTracker(Mutex<State>);
+
+impl PingTracker {
+    /// Whether `body`, a frame from `from`, is a ping or the answer to one.
+    /// It's counted if so, and the proxy forwards it without looking further.
+    pub fn observe(&self, from: Peer, body: &str) -> bool {
+        if body.len() > MAX_PING_BYTES || !body.trim_start().starts_with('{') {
+            return false;
+        }
+        let Ok(shape) = serde_json::from_str::<Shape>(body) else {
+            return false;
+        };
+        let Ok(mut state) = self.0.lock() else {
+            return false;
+        };
+        match (shape.method.as_deref(), shape.id) {
+            (Some(PING_METHOD), id) => {
+                match from {
+                    Peer::Client => state.health.client_pings += 1,
+                    Peer::Server => state.health.server_pings += 1,
+                }
+                if let Some(id) = id {
+                    if state.outstanding.len() == MAX_OUTSTANDING {
+                        state.outstanding.pop_front();
+                        state.expired += 1;
+                    }
+                    state.outstanding.push_back((from, id, Instant::now()));
+                }
+                true
+            }
+            (None, Some(id)) => {
+                let Some(index) = state
+                    .outstanding
+                    .iter()
+                    .position(|(sender, ping, _)| *sender != from && *ping == id)
+                else {
+                    return false;
+                };
+                let Some((_, _, sent)) = state.outstanding.remove(index) else {
+                    return false;
+                };
+                let rtt_ms = sent.elapsed().as_secs_f64() * 1000.0;
+                let health = &mut state.health;
+                if shape.error.is_some() {
+                    health.errors += 1;
+                } else {
+                    health.answered += 1;
+                }
+                health.last_rtt_ms = Some(rtt_ms);
+                health.max_rtt_ms = Some(health.max_rtt_ms.unwrap_or(0.0).max(rtt_ms));
+                health.last_answered_at = Some(Utc::now());
+                true
+            }
+            _ => false,
+        }
+    }
+
+    pub fn health(&self) -> PingHealth {
+        match self.0.lock() {
+            Ok(state) => PingHealth {
+                unanswered: state.outstanding.len() as u64 + state.expired,
+                ..state.health.clone()
+            },
+            Err(_) => PingHealth::default(),
+        }
+    }
+}
+
+/// Ping metrics of a monitor session in the Prometheus text format.
+pub fn prometheus(session_id: &str, health: &PingHealth) -> String {
+    let session = latency::label(session_id);
+    let mut out = String::new();
+    out.push_str("# HELP km_pings_total Pings forwarded without capture, by sender.\n");
+    out.push_str("# TYPE km_pings_total counter\n");
+    for (from, count) in [
+        ("client", health.client_pings),
+        ("server", health.server_pings),
+    ] {
+        out.push_str(&format!(
+            "km_pings_total{{session=\"{}\",from=\"{}\"}} {}\n",
+            session, from, count
+        ));
+    }
+    out.push_str("# HELP km_ping_answers_total Answers to pings, by outcome.\n");
+    out.push_str("# TYPE km_ping_answers_total counter\n");
+    for (outcome, count) in [("result", health.answered), ("error", health.errors)] {
+        out.push_str(&format!(
+            "km_ping_answers_total{{session=\"{}\",outcome=\"{}\"}} {}\n",
+            session, outcome, count
+        ));
+    }
+    if let Some(rtt_ms) = health.last_rtt_ms {
+        out.push_str("# HELP km_ping_rtt_milliseconds Round trip of the latest answered ping.\n");
+        out.push_str("# TYPE km_ping_rtt_milliseconds gauge\n");
+        out.push_str(&format!(
+            "km_ping_rtt_milliseconds{{session=\"{}\"}} {}\n",
+            session, rtt_ms
+        ));
+    }
+    out
+}
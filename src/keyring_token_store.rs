@@ -1,13 +1,14 @@
 use crate::auth::JwtToken;
+use crate::config;
 use anyhow::{Context, Result};
 use keyring::Entry;
 
-const SERVICE_NAME: &str = "ai.kilometers.km";
+pub const SERVICE_NAME: &str = "ai.kilometers.km";
 const ACCESS_TOKEN_KEY: &str = "km-access-token";
 const REFRESH_TOKEN_KEY: &str = "km-refresh-token";
 
 /// Check if running in a CI environment where keyring access may not be available
-fn is_ci_environment() -> bool {
+pub(crate) fn is_ci_environment() -> bool {
     std::env::var("CI").is_ok() || std::env::var("GITHUB_ACTIONS").is_ok()
 }
 
@@ -25,10 +26,19 @@ impl KeyringTokenStore {
             return Err(anyhow::anyhow!("Keyring not available in CI environment"));
         }
 
-        let access_token_entry = Entry::new(SERVICE_NAME, ACCESS_TOKEN_KEY)
+        // Each profile signs in separately, possibly to another backend
+        let (access_key, refresh_key) = match config::active_profile() {
+            Some(profile) => (
+                format!("{}:{}", ACCESS_TOKEN_KEY, profile),
+                format!("{}:{}", REFRESH_TOKEN_KEY, profile),
+            ),
+            None => (ACCESS_TOKEN_KEY.to_string(), REFRESH_TOKEN_KEY.to_string()),
+        };
+
+        let access_token_entry = Entry::new(SERVICE_NAME, &access_key)
             .context("Failed to create keyring entry for access token")?;
 
-        let refresh_token_entry = Entry::new(SERVICE_NAME, REFRESH_TOKEN_KEY)
+        let refresh_token_entry = Entry::new(SERVICE_NAME, &refresh_key)
             .context("Failed to create keyring entry for refresh token")?;
 
         Ok(Self {
@@ -77,7 +87,6 @@ impl KeyringTokenStore {
         Ok(token)
     }
 
-    #[allow(dead_code)]
     pub fn load_refresh_token(&self) -> Result<Option<String>> {
         match self.refresh_token_entry.get_password() {
             Ok(refresh_token) => Ok(Some(refresh_token)),
@@ -0,0 +1,433 @@
+//! Latency histograms of the MCP server's responses, per method, kept while
+//! `km monitor` runs. Shown by `km ctl status --verbose`, served on the
+//! metrics endpoint and sent with each upload batch. The round trips of
+//! uploads to the Kilometers API are tracked here too.
+
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, VecDeque};
+use std::sync::Mutex;
+
+use crate::correlation::{MessageClass, MessageCounts};
+
+/// Latencies at or below this many milliseconds share the first bucket
+const MIN_MS: f64 = 0.01;
+/// Buckets per doubling of latency. Each bucket is about 9% wider than the
+/// one before, which bounds the error of a percentile.
+const BUCKETS_PER_DOUBLING: f64 = 8.0;
+/// Enough buckets for latencies up to about an hour
+const BUCKETS: usize = 232;
+
+/// Upper bounds of the buckets exported to Prometheus, in milliseconds
+pub const EXPORT_BUCKETS_MS: [f64; 14] = [
+    1.0, 2.5, 5.0, 10.0, 25.0, 50.0, 100.0, 250.0, 500.0, 1000.0, 2500.0, 5000.0, 10000.0, 30000.0,
+];
+
+fn bucket(ms: f64) -> usize {
+    if ms <= MIN_MS {
+        return 0;
+    }
+    (((ms / MIN_MS).log2() * BUCKETS_PER_DOUBLING).ceil() as usize).min(BUCKETS - 1)
+}
+
+fn upper_bound(bucket: usize) -> f64 {
+    MIN_MS * 2f64.powf(bucket as f64 / BUCKETS_PER_DOUBLING)
+}
+
+/// Log-scale histogram of latencies in milliseconds. Percentiles are the
+/// upper bound of the bucket they fall in, so within about 9%.
+#[derive(Debug, Clone)]
+pub struct LatencyHistogram {
+    counts: Vec<u64>,
+    /// Counts per `EXPORT_BUCKETS_MS` bucket, plus one for larger latencies
+    export: [u64; EXPORT_BUCKETS_MS.len() + 1],
+    count: u64,
+    sum_ms: f64,
+    min_ms: f64,
+    max_ms: f64,
+}
+
+impl Default for LatencyHistogram {
+    fn default() -> Self {
+        Self {
+            counts: vec![0; BUCKETS],
+            export: [0; EXPORT_BUCKETS_MS.len() + 1],
+            count: 0,
+            sum_ms: 0.0,
+            min_ms: 0.0,
+            max_ms: 0.0,
+        }
+    }
+}
+
+impl LatencyHistogram {
+    pub fn record(&mut self, ms: f64) {
+        if !ms.is_finite() || ms < 0.0 {
+            return;
+        }
+        self.counts[bucket(ms)] += 1;
+        let export = EXPORT_BUCKETS_MS
+            .iter()
+            .position(|le| ms <= *le)
+            .unwrap_or(EXPORT_BUCKETS_MS.len());
+        self.export[export] += 1;
+        self.min_ms = if self.count == 0 {
+            ms
+        } else {
+            self.min_ms.min(ms)
+        };
+        self.max_ms = self.max_ms.max(ms);
+        self.sum_ms += ms;
+        self.count += 1;
+    }
+
+    /// The latency `p` percent of responses were at or under, or `None`
+    /// before the first response
+    pub fn percentile(&self, p: f64) -> Option<f64> {
+        if self.count == 0 {
+            return None;
+        }
+        let rank = ((p / 100.0 * self.count as f64).ceil() as u64).clamp(1, self.count);
+        let mut seen = 0;
+        for (bucket, count) in self.counts.iter().enumerate() {
+            seen += count;
+            if seen >= rank {
+                return Some(upper_bound(bucket).clamp(self.min_ms, self.max_ms));
+            }
+        }
+        Some(self.max_ms)
+    }
+
+    pub fn summary(&self, method: &str) -> MethodLatency {
+        let mut cumulative = 0;
+        MethodLatency {
+            method: method.to_string(),
+            count: self.count,
+            sum_ms: self.sum_ms,
+            min_ms: self.min_ms,
+            p50_ms: self.percentile(50.0).unwrap_or_default(),
+            p90_ms: self.percentile(90.0).unwrap_or_default(),
+            p99_ms: self.percentile(99.0).unwrap_or_default(),
+            max_ms: self.max_ms,
+            buckets: EXPORT_BUCKETS_MS
+                .iter()
+                .zip(self.export)
+                .map(|(le_ms, count)| {
+                    cumulative += count;
+                    LatencyBucket {
+                        le_ms: *le_ms,
+                        count: cumulative,
+                    }
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Responses at or under `le_ms`, counted Prometheus-style (cumulatively).
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LatencyBucket {
+    pub le_ms: f64,
+    pub count: u64,
+}
+
+/// A method's latency histogram, summarized.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct MethodLatency {
+    pub method: String,
+    pub count: u64,
+    pub sum_ms: f64,
+    pub min_ms: f64,
+    pub p50_ms: f64,
+    pub p90_ms: f64,
+    pub p99_ms: f64,
+    pub max_ms: f64,
+    pub buckets: Vec<LatencyBucket>,
+}
+
+impl MethodLatency {
+    pub fn mean_ms(&self) -> f64 {
+        if self.count == 0 {
+            0.0
+        } else {
+            self.sum_ms / self.count as f64
+        }
+    }
+}
+
+/// Latency histograms by method, shared between the proxy that records
+/// them and whoever reports them.
+#[derive(Debug, Default)]
+pub struct LatencyStats(Mutex<BTreeMap<String, LatencyHistogram>>);
+
+impl LatencyStats {
+    pub fn record(&self, method: &str, ms: f64) {
+        if let Ok(mut histograms) = self.0.lock() {
+            match histograms.get_mut(method) {
+                Some(histogram) => histogram.record(ms),
+                None => {
+                    let mut histogram = LatencyHistogram::default();
+                    histogram.record(ms);
+                    histograms.insert(method.to_string(), histogram);
+                }
+            }
+        }
+    }
+
+    /// Every method's histogram so far, busiest first
+    pub fn snapshot(&self) -> Vec<MethodLatency> {
+        let mut methods: Vec<MethodLatency> = match self.0.lock() {
+            Ok(histograms) => histograms
+                .iter()
+                .map(|(method, histogram)| histogram.summary(method))
+                .collect(),
+            Err(_) => Vec::new(),
+        };
+        methods.sort_by(|a, b| b.count.cmp(&a.count));
+        methods
+    }
+}
+
+/// Recent uploads the API latency percentiles are taken over
+pub const API_WINDOW: usize = 256;
+/// Weight of the newest upload in the moving average. Older uploads fade
+/// out gradually instead of being halved away by each new one.
+const API_EWMA_ALPHA: f64 = 0.1;
+
+#[derive(Debug, Default)]
+struct ApiWindow {
+    /// The last `API_WINDOW` round trips, oldest first
+    recent: VecDeque<f64>,
+    ewma_ms: Option<f64>,
+    count: u64,
+    sum_ms: f64,
+}
+
+/// How long the Kilometers API takes to answer uploads, shared between the
+/// event uploader and the spool.
+#[derive(Debug, Default)]
+pub struct ApiLatency(Mutex<ApiWindow>);
+
+impl ApiLatency {
+    /// One request answered by the API after `ms` milliseconds, whatever
+    /// its status.
+    pub fn record(&self, ms: f64) {
+        if !ms.is_finite() || ms < 0.0 {
+            return;
+        }
+        if let Ok(mut window) = self.0.lock() {
+            if window.recent.len() == API_WINDOW {
+                window.recent.pop_front();
+            }
+            window.recent.push_back(ms);
+            window.ewma_ms = Some(match window.ewma_ms {
+                Some(ewma) => ewma + API_EWMA_ALPHA * (ms - ewma),
+                None => ms,
+            });
+            window.count += 1;
+            window.sum_ms += ms;
+        }
+    }
+
+    pub fn summary(&self) -> ApiLatencySummary {
+        let Ok(window) = self.0.lock() else {
+            return ApiLatencySummary::default();
+        };
+        let mut recent: Vec<f64> = window.recent.iter().copied().collect();
+        recent.sort_by(f64::total_cmp);
+        // Nearest rank; the window is small enough to keep exact values
+        let percentile = |p: f64| {
+            let rank = (p / 100.0 * recent.len() as f64).ceil() as usize;
+            recent
+                .get(rank.clamp(1, recent.len().max(1)) - 1)
+                .copied()
+                .unwrap_or_default()
+        };
+        ApiLatencySummary {
+            count: window.count,
+            sum_ms: window.sum_ms,
+            ewma_ms: window.ewma_ms.unwrap_or_default(),
+            window: recent.len(),
+            mean_ms: if recent.is_empty() {
+                0.0
+            } else {
+                recent.iter().sum::<f64>() / recent.len() as f64
+            },
+            p50_ms: percentile(50.0),
+            p95_ms: percentile(95.0),
+            p99_ms: percentile(99.0),
+            max_ms: recent.last().copied().unwrap_or_default(),
+        }
+    }
+}
+
+/// API upload latency, summarized. The percentiles, mean and max are over
+/// the last `window` uploads.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ApiLatencySummary {
+    /// Uploads the API answered this session
+    pub count: u64,
+    pub sum_ms: f64,
+    /// Exponentially weighted moving average
+    pub ewma_ms: f64,
+    pub window: usize,
+    pub mean_ms: f64,
+    pub p50_ms: f64,
+    pub p95_ms: f64,
+    pub p99_ms: f64,
+    pub max_ms: f64,
+}
+
+impl ApiLatencySummary {
+    pub fn describe(&self) -> String {
+        if self.count == 0 {
+            return "no uploads answered yet".to_string();
+        }
+        format!(
+            "{:.1}ms average over {} uploads; last {}: p50 {:.1}ms, p95 {:.1}ms, \
+             p99 {:.1}ms, max {:.1}ms",
+            self.ewma_ms,
+            self.count,
+            self.window,
+            self.p50_ms,
+            self.p95_ms,
+            self.p99_ms,
+            self.max_ms
+        )
+    }
+}
+
+/// The `km ctl status --verbose` table.
+pub fn render(methods: &[MethodLatency]) -> Vec<String> {
+    if methods.is_empty() {
+        return vec!["Latency:  no responses yet".to_string()];
+    }
+    let ms = |value: f64| format!("{:.1}ms", value);
+    let mut lines = vec![format!(
+        "Latency:  {:<28} {:>7} {:>9} {:>9} {:>9} {:>9} {:>9}",
+        "method", "calls", "mean", "p50", "p90", "p99", "max"
+    )];
+    for method in methods {
+        lines.push(format!(
+            "          {:<28} {:>7} {:>9} {:>9} {:>9} {:>9} {:>9}",
+            method.method,
+            method.count,
+            ms(method.mean_ms()),
+            ms(method.p50_ms),
+            ms(method.p90_ms),
+            ms(method.p99_ms),
+            ms(method.max_ms)
+        ));
+    }
+    lines
+}
+
+/// `value` escaped for a Prometheus label
+pub(crate) fn label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Metrics of a monitor session in the Prometheus text format.
+pub fn prometheus(
+    session_id: &str,
+    requests: u64,
+    responses: u64,
+    messages: &MessageCounts,
+    methods: &[MethodLatency],
+) -> String {
+    let session = label(session_id);
+    let mut out = String::new();
+    out.push_str("# HELP km_requests_total Client messages captured.\n");
+    out.push_str("# TYPE km_requests_total counter\n");
+    out.push_str(&format!(
+        "km_requests_total{{session=\"{}\"}} {}\n",
+        session, requests
+    ));
+    out.push_str("# HELP km_responses_total Server messages captured.\n");
+    out.push_str("# TYPE km_responses_total counter\n");
+    out.push_str(&format!(
+        "km_responses_total{{session=\"{}\"}} {}\n",
+        session, responses
+    ));
+    out.push_str("# HELP km_messages_total Messages captured, by class.\n");
+    out.push_str("# TYPE km_messages_total counter\n");
+    for class in MessageClass::ALL {
+        out.push_str(&format!(
+            "km_messages_total{{session=\"{}\",class=\"{}\"}} {}\n",
+            session,
+            class.as_str(),
+            messages.get(class)
+        ));
+    }
+    out.push_str(
+        "# HELP km_response_latency_milliseconds Time from a request to the server's response.\n",
+    );
+    out.push_str("# TYPE km_response_latency_milliseconds histogram\n");
+    for method in methods {
+        let labels = format!(
+            "session=\"{}\",method=\"{}\"",
+            session,
+            label(&method.method)
+        );
+        for bucket in &method.buckets {
+            out.push_str(&format!(
+                "km_response_latency_milliseconds_bucket{{{},le=\"{}\"}} {}\n",
+                labels, bucket.le_ms, bucket.count
+            ));
+        }
+        out.push_str(&format!(
+            "km_response_latency_milliseconds_bucket{{{},le=\"+Inf\"}} {}\n",
+            labels, method.count
+        ));
+        out.push_str(&format!(
+            "km_response_latency_milliseconds_sum{{{}}} {}\n",
+            labels, method.sum_ms
+        ));
+        out.push_str(&format!(
+            "km_response_latency_milliseconds_count{{{}}} {}\n",
+            labels, method.count
+        ));
+    }
+    out
+}
+
+/// API upload latency in the Prometheus text format.
+pub fn api_prometheus(session_id: &str, summary: &ApiLatencySummary) -> String {
+    let session = label(session_id);
+    let mut out = String::new();
+    out.push_str(
+        "# HELP km_api_upload_latency_milliseconds Time for the API to answer an upload.\n",
+    );
+    out.push_str("# TYPE km_api_upload_latency_milliseconds summary\n");
+    if summary.window > 0 {
+        for (quantile, value) in [
+            ("0.5", summary.p50_ms),
+            ("0.95", summary.p95_ms),
+            ("0.99", summary.p99_ms),
+        ] {
+            out.push_str(&format!(
+                "km_api_upload_latency_milliseconds{{session=\"{}\",quantile=\"{}\"}} {}\n",
+                session, quantile, value
+            ));
+        }
+    }
+    out.push_str(&format!(
+        "km_api_upload_latency_milliseconds_sum{{session=\"{}\"}} {}\n",
+        session, summary.sum_ms
+    ));
+    out.push_str(&format!(
+        "km_api_upload_latency_milliseconds_count{{session=\"{}\"}} {}\n",
+        session, summary.count
+    ));
+    out.push_str(
+        "# HELP km_api_upload_latency_average_milliseconds Moving average of API upload latency.\n",
+    );
+    out.push_str("# TYPE km_api_upload_latency_average_milliseconds gauge\n");
+    out.push_str(&format!(
+        "km_api_upload_latency_average_milliseconds{{session=\"{}\"}} {}\n",
+        session, summary.ewma_ms
+    ));
+    out
+}
@@ -0,0 +1,119 @@
+//! Package launchers (npx, uvx, pipx) that install an MCP server on first
+//! use and then start it, and `${VAR}` templates in server commands.
+//!
+//! A launcher can print install progress or prompts on stdout, where the
+//! client expects only MCP messages. For servers started through one, km
+//! sets the launcher's own variables for quiet, non-interactive installs
+//! and sends anything the server prints before its first JSON-RPC message
+//! to stderr instead of the client.
+
+use anyhow::Result;
+use std::path::Path;
+
+/// A package launcher a server command starts with.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Launcher {
+    Npx,
+    Uvx,
+    Pipx,
+}
+
+impl Launcher {
+    /// The launcher `program` is, e.g. `npx`, `npx.cmd`, `uvx`, `uv tool
+    /// run` or `pipx run`.
+    pub fn detect(program: &str, args: &[String]) -> Option<Self> {
+        let name = Path::new(program)
+            .file_stem()?
+            .to_string_lossy()
+            .to_ascii_lowercase();
+        let first = |expected: &[&str]| {
+            args.len() >= expected.len() && args.iter().zip(expected).all(|(arg, e)| arg == e)
+        };
+        match name.as_str() {
+            "npx" => Some(Self::Npx),
+            "uvx" => Some(Self::Uvx),
+            "uv" if first(&["tool", "run"]) => Some(Self::Uvx),
+            "pipx" if first(&["run"]) => Some(Self::Pipx),
+            _ => None,
+        }
+    }
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Npx => "npx",
+            Self::Uvx => "uvx",
+            Self::Pipx => "pipx",
+        }
+    }
+
+    /// Variables that keep the installer quiet and stop it asking
+    /// questions; ones the server's environment already sets are kept.
+    pub fn env(self) -> &'static [(&'static str, &'static str)] {
+        match self {
+            Self::Npx => &[
+                // Otherwise npx asks before installing, and waits for an answer
+                ("npm_config_yes", "true"),
+                ("npm_config_loglevel", "error"),
+                ("npm_config_update_notifier", "false"),
+                ("npm_config_fund", "false"),
+                ("npm_config_audit", "false"),
+            ],
+            Self::Uvx => &[("UV_NO_PROGRESS", "1")],
+            Self::Pipx => &[
+                ("PIP_NO_INPUT", "1"),
+                ("PIP_DISABLE_PIP_VERSION_CHECK", "1"),
+                ("PIP_PROGRESS_BAR", "off"),
+            ],
+        }
+    }
+}
+
+/// `template` with `${NAME}` replaced by the value of `NAME` and
+/// `${NAME:-default}` by the value, or `default` when it's unset or empty.
+/// `$${` is a literal `${`.
+pub fn expand(template: &str, lookup: impl Fn(&str) -> Option<String>) -> Result<String> {
+    let mut expanded = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(start) = rest.find('$') {
+        expanded.push_str(&rest[..start]);
+        let after = &rest[start..];
+        if let Some(escaped) = after.strip_prefix("$${") {
+            expanded.push_str("${");
+            rest = escaped;
+            continue;
+        }
+        let Some(body) = after.strip_prefix("${") else {
+            expanded.push('$');
+            rest = &after[1..];
+            continue;
+        };
+        let end = body
+            .find('}')
+            .ok_or_else(|| anyhow::anyhow!("Unclosed '${{' in '{}'", template))?;
+        let (name, default) = match body[..end].split_once(":-") {
+            Some((name, default)) => (name, Some(default)),
+            None => (&body[..end], None),
+        };
+        if name.is_empty() || !name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_') {
+            return Err(anyhow::anyhow!(
+                "'${{{}}}' in '{}' isn't a variable name",
+                &body[..end],
+                template
+            ));
+        }
+        match (lookup(name).filter(|value| !value.is_empty()), default) {
+            (Some(value), _) => expanded.push_str(&value),
+            (None, Some(default)) => expanded.push_str(default),
+            (None, None) => {
+                return Err(anyhow::anyhow!(
+                    "{} isn't set; set it, add it to an --env-file or use ${{{}:-default}}",
+                    name,
+                    name
+                ))
+            }
+        }
+        rest = &body[end + 1..];
+    }
+    expanded.push_str(rest);
+    Ok(expanded)
+}
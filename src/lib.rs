@@ -1,8 +1,84 @@
+pub mod alerts;
+pub mod anonymize;
+pub mod approval;
+pub mod audit;
 pub mod auth;
+pub mod breaker;
+pub mod build_info;
+pub mod bundle;
+pub mod capabilities;
+pub mod ci;
 pub mod cli;
+pub mod clients;
+pub mod clock;
+pub mod completion;
 pub mod config;
+pub mod config_schema;
+pub mod config_watcher;
+pub mod container;
+pub mod content;
+pub mod control;
+pub mod correlation;
+pub mod costs;
+pub mod credentials;
+pub mod dashboard;
+pub mod dedup;
 pub mod device_auth;
+pub mod diff;
+pub mod doctor;
+pub mod encryption;
+pub mod entitlements;
+pub mod errors;
+pub mod export;
 pub mod filters;
+pub mod framing;
+pub mod github;
 pub mod handlers;
+pub mod handshake;
+pub mod http;
+pub mod i18n;
+pub mod idempotency;
+pub mod inspect;
+pub mod inventory;
+pub mod journal;
+pub mod keepalive;
 pub mod keyring_token_store;
+pub mod latency;
+pub mod launcher;
+pub mod logging;
+pub mod manpage;
+pub mod merge;
+pub mod metrics;
+pub mod mock;
+pub mod offline;
+pub mod opa;
+pub mod otel;
+pub mod payloads;
+pub mod plugins;
+pub mod policy;
+pub mod presets;
+pub mod probe;
+pub mod process;
 pub mod proxy;
+pub mod queue;
+pub mod rate_limit;
+pub mod redaction;
+pub mod remote_config;
+pub mod replay;
+pub mod report;
+pub mod resources;
+pub mod retention;
+pub mod risk;
+pub mod sampling;
+pub mod schema;
+pub mod search;
+pub mod server_env;
+pub mod sessions;
+pub mod sinks;
+pub mod spool;
+pub mod syslog;
+pub mod tail;
+pub mod telemetry;
+pub mod traffic;
+pub mod update;
+pub mod uploader;
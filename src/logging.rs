@@ -0,0 +1,401 @@
+//! Logging for every km command: readable lines on the console and, unless
+//! `logging.file` is off, JSON lines in a rotating file under
+//! ~/.config/kilometers/logs.
+
+use anyhow::{Context, Result};
+use chrono::{SecondsFormat, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+use std::collections::BTreeMap;
+use std::fs::{self, File};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Mutex, OnceLock};
+use std::time::{Duration, SystemTime};
+use tracing::field::{Field, Visit};
+use tracing::span::{Attributes, Id, Record};
+use tracing::{Event, Subscriber};
+use tracing_subscriber::filter::{LevelFilter, Targets};
+use tracing_subscriber::layer::{Context as LayerContext, Layer};
+use tracing_subscriber::prelude::*;
+use tracing_subscriber::registry::LookupSpan;
+use tracing_subscriber::{fmt, reload, Registry};
+
+/// Name of the current log file; rotated files get `.1`, `.2`, ...
+pub const LOG_FILE_NAME: &str = "km.log";
+
+static FILTER_HANDLE: OnceLock<reload::Handle<Targets, Registry>> = OnceLock::new();
+/// Whether the default level follows the config file (no -v flag given)
+static LEVEL_FROM_CONFIG: AtomicBool = AtomicBool::new(false);
+
+/// The `logging` section of the config file.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LoggingConfig {
+    /// Write JSON log lines to ~/.config/kilometers/logs/km.log
+    #[serde(default = "default_file")]
+    pub file: bool,
+    /// Levels for parts of km by module path, e.g. `"km::uploader": "debug"`
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub levels: BTreeMap<String, String>,
+    /// Start a new log file once the current one reaches this size
+    #[serde(default = "default_max_file_mb")]
+    pub max_file_mb: u64,
+    /// Start a new log file once the current one is this old; 0 never does
+    #[serde(default = "default_max_age_hours")]
+    pub max_age_hours: u64,
+    /// Rotated log files kept besides the current one
+    #[serde(default = "default_max_files")]
+    pub max_files: usize,
+}
+
+fn default_file() -> bool {
+    true
+}
+
+fn default_max_file_mb() -> u64 {
+    10
+}
+
+fn default_max_age_hours() -> u64 {
+    24
+}
+
+fn default_max_files() -> usize {
+    5
+}
+
+impl Default for LoggingConfig {
+    fn default() -> Self {
+        Self {
+            file: default_file(),
+            levels: BTreeMap::new(),
+            max_file_mb: default_max_file_mb(),
+            max_age_hours: default_max_age_hours(),
+            max_files: default_max_files(),
+        }
+    }
+}
+
+impl LoggingConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        for (target, level) in &self.levels {
+            if target.trim().is_empty() {
+                return Err(anyhow::anyhow!("logging.levels must not have empty keys"));
+            }
+            if level.parse::<tracing::Level>().is_err() {
+                return Err(anyhow::anyhow!(
+                    "logging.levels.{} must be one of error, warn, info, debug, trace (got '{}')",
+                    target,
+                    level
+                ));
+            }
+        }
+        if self.max_file_mb == 0 {
+            return Err(anyhow::anyhow!(
+                "logging.max_file_mb must be greater than 0"
+            ));
+        }
+        Ok(())
+    }
+
+    /// Open the log file these settings describe, in `dir`.
+    pub fn open(&self, dir: &Path) -> io::Result<RotatingFile> {
+        RotatingFile::open(
+            &dir.join(LOG_FILE_NAME),
+            self.max_file_mb * 1024 * 1024,
+            (self.max_age_hours > 0).then(|| Duration::from_secs(self.max_age_hours * 3600)),
+            self.max_files,
+        )
+    }
+}
+
+/// Where the log file is written.
+pub fn default_dir() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("logs"))
+}
+
+/// The level filter for `default`, with `levels` overriding it for the
+/// targets they name. Entries that aren't a level are skipped.
+pub fn targets(default: LevelFilter, levels: &BTreeMap<String, String>) -> Targets {
+    Targets::new().with_default(default).with_targets(
+        levels.iter().filter_map(|(target, level)| {
+            Some((target.clone(), level.parse::<LevelFilter>().ok()?))
+        }),
+    )
+}
+
+/// Install the global subscriber. With `reloadable`, the level can later be
+/// changed through `set_level` (used when the level comes from the config
+/// file rather than -v flags).
+pub fn init(level: tracing::Level, reloadable: bool, config: &LoggingConfig) {
+    let (filter, handle) =
+        reload::Layer::new(targets(LevelFilter::from_level(level), &config.levels));
+    let file = config
+        .file
+        .then(|| default_dir().and_then(|dir| Ok(config.open(&dir)?)));
+    let (json, file_error) = match file {
+        Some(Ok(file)) => (Some(JsonLayer::new(file)), None),
+        Some(Err(e)) => (None, Some(e)),
+        None => (None, None),
+    };
+    tracing_subscriber::registry()
+        .with(filter)
+        .with(fmt::layer())
+        .with(json)
+        .init();
+    let _ = FILTER_HANDLE.set(handle);
+    LEVEL_FROM_CONFIG.store(reloadable, Ordering::Relaxed);
+    if let Some(e) = file_error {
+        tracing::warn!("Not writing a log file: {:#}", e);
+    }
+}
+
+/// Change the log level of the running process. Returns false if logging
+/// was not initialized as reloadable.
+pub fn set_level(level: tracing::Level) -> bool {
+    if !LEVEL_FROM_CONFIG.load(Ordering::Relaxed) {
+        return false;
+    }
+    FILTER_HANDLE
+        .get()
+        .map(|handle| {
+            handle
+                .modify(|filter| {
+                    // Rebuilt rather than amended, so the filter's maximum
+                    // level can go down as well as up
+                    *filter = Targets::new()
+                        .with_default(LevelFilter::from_level(level))
+                        .with_targets(filter.iter().map(|(t, l)| (t.to_string(), l)))
+                })
+                .is_ok()
+        })
+        .unwrap_or(false)
+}
+
+/// Replace the per-component levels of the running process, keeping its
+/// default level.
+pub fn set_levels(levels: &BTreeMap<String, String>) -> bool {
+    FILTER_HANDLE
+        .get()
+        .map(|handle| {
+            handle
+                .modify(|filter| {
+                    let default = filter.default_level().unwrap_or(LevelFilter::INFO);
+                    *filter = targets(default, levels)
+                })
+                .is_ok()
+        })
+        .unwrap_or(false)
+}
+
+/// The span a monitor session runs in; JSON log lines from inside it carry
+/// its `session_id`, so sessions sharing a process can be told apart.
+/// Error level, so a quieter log level doesn't drop the id.
+pub fn session_span(session_id: &str) -> tracing::Span {
+    tracing::error_span!("session", session_id = session_id)
+}
+
+/// An append-only log file that starts over, keeping `max_files` old ones,
+/// when it gets too big or too old.
+#[derive(Debug)]
+pub struct RotatingFile {
+    path: PathBuf,
+    max_bytes: u64,
+    max_age: Option<Duration>,
+    max_files: usize,
+    file: File,
+    size: u64,
+    opened: SystemTime,
+}
+
+impl RotatingFile {
+    pub fn open(
+        path: &Path,
+        max_bytes: u64,
+        max_age: Option<Duration>,
+        max_files: usize,
+    ) -> io::Result<Self> {
+        if let Some(dir) = path.parent() {
+            fs::create_dir_all(dir)?;
+        }
+        let file = open_private(path)?;
+        let metadata = file.metadata()?;
+        Ok(Self {
+            path: path.to_path_buf(),
+            max_bytes,
+            max_age,
+            max_files,
+            size: metadata.len(),
+            // When the file was started, as far as the filesystem can tell
+            opened: metadata
+                .created()
+                .or_else(|_| metadata.modified())
+                .unwrap_or_else(|_| SystemTime::now()),
+            file,
+        })
+    }
+
+    /// Path of the `n`th most recent rotated file
+    pub fn rotated_path(&self, n: usize) -> PathBuf {
+        let mut name = self.path.as_os_str().to_os_string();
+        name.push(format!(".{}", n));
+        PathBuf::from(name)
+    }
+
+    fn is_due(&self, incoming: usize) -> bool {
+        if self.size == 0 {
+            return false;
+        }
+        let too_old = self
+            .max_age
+            .is_some_and(|max_age| self.opened.elapsed().is_ok_and(|age| age >= max_age));
+        too_old || self.size + incoming as u64 > self.max_bytes
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        if self.max_files == 0 {
+            fs::remove_file(&self.path)?;
+        } else {
+            // Renaming over an existing file fails on Windows
+            let _ = fs::remove_file(self.rotated_path(self.max_files));
+            for n in (1..self.max_files).rev() {
+                let _ = fs::rename(self.rotated_path(n), self.rotated_path(n + 1));
+            }
+            fs::rename(&self.path, self.rotated_path(1))?;
+        }
+        self.file = open_private(&self.path)?;
+        self.size = 0;
+        self.opened = SystemTime::now();
+        Ok(())
+    }
+}
+
+impl Write for RotatingFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if self.is_due(buf.len()) {
+            self.rotate()?;
+        }
+        self.file.write_all(buf)?;
+        self.size += buf.len() as u64;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.file.flush()
+    }
+}
+
+/// Logs can hold paths and payload excerpts, so only the user may read them
+fn open_private(path: &Path) -> io::Result<File> {
+    let mut options = fs::OpenOptions::new();
+    options.create(true).append(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600);
+    }
+    options.open(path)
+}
+
+/// Fields of a span or event, as JSON.
+#[derive(Debug, Default)]
+struct JsonFields(Map<String, Value>);
+
+impl Visit for JsonFields {
+    fn record_f64(&mut self, field: &Field, value: f64) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_i64(&mut self, field: &Field, value: i64) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_u64(&mut self, field: &Field, value: u64) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_bool(&mut self, field: &Field, value: bool) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.0
+            .insert(field.name().to_string(), format!("{:?}", value).into());
+    }
+}
+
+/// Writes each event as one JSON object per line, with the fields of the
+/// spans it happened in, such as its session's `session_id`.
+pub struct JsonLayer<W> {
+    writer: Mutex<W>,
+}
+
+impl<W: Write> JsonLayer<W> {
+    pub fn new(writer: W) -> Self {
+        Self {
+            writer: Mutex::new(writer),
+        }
+    }
+}
+
+impl<S, W> Layer<S> for JsonLayer<W>
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+    W: Write + Send + 'static,
+{
+    fn on_new_span(&self, attrs: &Attributes<'_>, id: &Id, ctx: LayerContext<'_, S>) {
+        let mut fields = JsonFields::default();
+        attrs.record(&mut fields);
+        if let Some(span) = ctx.span(id) {
+            span.extensions_mut().insert(fields);
+        }
+    }
+
+    fn on_record(&self, id: &Id, values: &Record<'_>, ctx: LayerContext<'_, S>) {
+        if let Some(span) = ctx.span(id) {
+            if let Some(fields) = span.extensions_mut().get_mut::<JsonFields>() {
+                values.record(fields);
+            }
+        }
+    }
+
+    fn on_event(&self, event: &Event<'_>, ctx: LayerContext<'_, S>) {
+        let metadata = event.metadata();
+        let mut line = Map::new();
+        line.insert(
+            "timestamp".to_string(),
+            Utc::now()
+                .to_rfc3339_opts(SecondsFormat::Millis, true)
+                .into(),
+        );
+        line.insert("level".to_string(), metadata.level().as_str().into());
+        line.insert("target".to_string(), metadata.target().into());
+        if let Some(scope) = ctx.event_scope(event) {
+            for span in scope.from_root() {
+                if let Some(fields) = span.extensions().get::<JsonFields>() {
+                    line.extend(fields.0.clone());
+                }
+            }
+        }
+        let mut fields = JsonFields::default();
+        event.record(&mut fields);
+        line.extend(fields.0);
+
+        let mut text = Value::Object(line).to_string();
+        text.push('\n');
+        if let Ok(mut writer) = self.writer.lock() {
+            // Nowhere left to report a failed write
+            let _ = writer.write_all(text.as_bytes());
+        }
+    }
+}
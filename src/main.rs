@@ -1,46 +1,237 @@
 use anyhow::Result;
-use clap::Parser;
+use clap::{CommandFactory, FromArgMatches};
+use std::process::ExitCode;
 
+mod alerts;
+mod anonymize;
+mod approval;
+mod audit;
 mod auth;
+mod breaker;
+mod build_info;
+mod bundle;
+mod capabilities;
+mod ci;
 mod cli;
+mod clients;
+mod clock;
+mod completion;
 mod config;
+mod config_schema;
+mod config_watcher;
+mod container;
+mod content;
+mod control;
+mod correlation;
+mod costs;
+mod credentials;
+mod dashboard;
+mod dedup;
 mod device_auth;
+mod diff;
+mod doctor;
+mod encryption;
+mod entitlements;
+mod errors;
+mod export;
 mod filters;
+mod framing;
+mod github;
 mod handlers;
+mod handshake;
+mod http;
+mod i18n;
+mod idempotency;
+mod inspect;
+mod inventory;
+mod journal;
+mod keepalive;
 mod keyring_token_store;
+mod latency;
+mod launcher;
+mod logging;
+mod manpage;
+mod merge;
+mod metrics;
+mod mock;
+mod offline;
+mod opa;
+mod otel;
+mod payloads;
+mod plugins;
+mod policy;
+mod presets;
+mod probe;
+mod process;
 mod proxy;
+mod queue;
+mod rate_limit;
+mod redaction;
+mod remote_config;
+mod replay;
+mod report;
+mod resources;
+mod retention;
+mod risk;
+mod sampling;
+mod schema;
+mod search;
+mod server_env;
+mod sessions;
+mod sinks;
+mod spool;
+mod syslog;
+mod tail;
+mod telemetry;
+mod traffic;
+mod update;
+mod uploader;
 
-use cli::{Cli, Commands, DoctorCommands};
+use cli::{Cli, Commands, ConfigCommands, DocsCommands, DoctorCommands, SessionsCommands};
+use merge::MergeOptions;
 
 #[tokio::main]
-async fn main() -> Result<()> {
-    let cli = Cli::parse();
+async fn main() -> ExitCode {
+    let matches = Cli::command().get_matches();
+    let cli = Cli::from_arg_matches(&matches).unwrap_or_else(|e| e.exit());
+    if let Some(profile) = cli.profile.clone() {
+        config::select_profile(profile);
+    }
+
+    // Initialize logging with verbosity level; the config's log_level applies
+    // (and follows config reloads) when no -v flag is given
+    let settings = config::Config::load_layered(&cli.config)
+        .and_then(|c| c.with_profile(config::active_profile().as_deref()))
+        .ok();
+    let log_level = match cli.verbose {
+        0 => settings
+            .as_ref()
+            .and_then(|c| c.tracing_level())
+            .unwrap_or_else(|| cli.get_log_level()),
+        _ => cli.get_log_level(),
+    };
+    let logging_config = settings
+        .as_ref()
+        .map(|c| c.logging.clone())
+        .unwrap_or_default();
+    logging::init(log_level, cli.verbose == 0, &logging_config);
+
+    // Language of translated output: KM_LANG, else the config's language
+    i18n::init(i18n::select(
+        std::env::var("KM_LANG").ok().as_deref(),
+        settings.as_ref().and_then(|c| c.language),
+    ));
 
-    // Initialize logging with verbosity level
-    tracing_subscriber::fmt()
-        .with_max_level(cli.get_log_level())
-        .init();
+    // Air-gapped mode: --offline, else KM_OFFLINE, else the config's offline
+    offline::init(offline::select(
+        cli.offline,
+        std::env::var(offline::OFFLINE_ENV).ok().as_deref(),
+        settings.as_ref().is_some_and(|c| c.offline),
+    ));
+
+    // Encrypted payloads are read with the keys this config points to
+    encryption::configure(
+        &cli.config,
+        settings
+            .as_ref()
+            .map(|c| c.encryption.clone())
+            .unwrap_or_default(),
+    );
+
+    // Proxy and TLS settings apply to every HTTP client built from here on
+    let http_config = settings.map(|c| c.http).unwrap_or_default().with_env();
+    if let Err(e) = http::init(&http_config) {
+        tracing::warn!("Ignoring proxy and TLS settings: {:#}", e);
+    }
 
     tracing::debug!("Starting km cli with command: {:?}", cli.command);
 
+    // Config files written by older km are upgraded to the current format
+    match config::migrate_file(&cli.config) {
+        Ok(Some(from)) => tracing::info!(
+            "Migrated {:?} from config version {} to {}",
+            cli.config,
+            from,
+            config::CONFIG_VERSION
+        ),
+        Ok(None) => {}
+        Err(e) => tracing::warn!("Could not migrate {:?}: {:#}", cli.config, e),
+    }
+
+    // Older versions kept the API key in the config file in plaintext
+    match credentials::migrate_config(&cli.config, || credentials::open(&cli.config)) {
+        Ok(Some(backend)) => {
+            tracing::info!("Moved the API key from {:?} to the {}", cli.config, backend)
+        }
+        Ok(None) => {}
+        Err(e) => tracing::warn!(
+            "Could not move the API key out of {:?}: {:#}",
+            cli.config,
+            e
+        ),
+    }
+
+    // Usage statistics, only when turned on with `km telemetry on`
+    let command_name = telemetry::command_name(&Cli::command(), &matches);
+    let started = std::time::Instant::now();
+    let error_format = cli.error_format;
+    let result = run(cli).await;
+    if let Some(ref name) = command_name {
+        telemetry::record_command(name, started.elapsed(), &result).await;
+    }
+    match result {
+        Ok(()) => ExitCode::SUCCESS,
+        Err(e) => {
+            errors::report(&e, error_format);
+            ExitCode::FAILURE
+        }
+    }
+}
+
+async fn run(cli: Cli) -> Result<()> {
     match cli.command {
         Commands::Init { api_key, api_url } => {
             handlers::handle_init(&cli.config, api_key, api_url).await?
         }
+        Commands::Login {
+            api_url,
+            no_browser,
+        } => handlers::handle_login(&cli.config, api_url, no_browser).await?,
+        Commands::Logout => handlers::handle_logout(&cli.config).await?,
+        Commands::Integrate { target } => handlers::handle_integrate(&cli.config, target, true)?,
+        Commands::Unintegrate { target } => handlers::handle_integrate(&cli.config, target, false)?,
+        Commands::Update { check, channel } => {
+            handlers::handle_update(&cli.config, check, channel).await?
+        }
+        Commands::Version { json } => handlers::handle_version(&cli.config, json).await?,
         Commands::Monitor {
             args,
             local_only,
             override_tier,
             log_file,
+            options,
         } => {
-            handlers::handle_monitor(&cli.config, args, local_only, override_tier, log_file).await?
+            handlers::handle_monitor_with_options(
+                &cli.config,
+                args,
+                local_only,
+                override_tier,
+                log_file,
+                options,
+            )
+            .await?
         }
         Commands::ClearLogs { include_config } => {
             handlers::handle_clear_logs(include_config, &cli.config)?
         }
-        Commands::Config { show_secrets } => {
-            handlers::handle_show_config(&cli.config, show_secrets)?
-        }
+        Commands::Config {
+            show_secrets,
+            command: Some(ConfigCommands::Source { key, refresh }),
+        } => handlers::handle_config_source(&cli.config, show_secrets, key, refresh).await?,
+        Commands::Config {
+            show_secrets,
+            command,
+        } => handlers::handle_config(&cli.config, show_secrets, command)?,
         Commands::Logs {
             file,
             requests,
@@ -49,14 +240,129 @@ async fn main() -> Result<()> {
             tail,
             lines,
         } => handlers::handle_logs(file, requests, responses, method, tail, lines)?,
-        Commands::Doctor { command } => handle_doctor(command)?,
+        Commands::Merge {
+            inputs,
+            output,
+            run_id,
+            session,
+        } => handlers::handle_merge(inputs, output, MergeOptions { run_id, session })?,
+        Commands::Export {
+            file,
+            output,
+            format,
+            options,
+        } => handlers::handle_export(file, output, format, options)?,
+        Commands::Search {
+            query,
+            file,
+            json,
+            limit,
+        } => handlers::handle_search(file, &query, json, limit)?,
+        Commands::Tail { session, json } => handlers::handle_tail(session, json)?,
+        Commands::Ctl {
+            session,
+            json,
+            command,
+        } => handlers::handle_ctl(session, json, command).await?,
+        Commands::Replay {
+            file,
+            session,
+            speed,
+            no_delay,
+            timeout,
+            target,
+        } => {
+            let speed = if no_delay { 0.0 } else { speed };
+            handlers::handle_replay(&cli.config, file, session, speed, timeout, target)?
+        }
+        Commands::Probe {
+            calls,
+            rate,
+            count,
+            duration,
+            timeout,
+            log_file,
+            json,
+            target,
+        } => handlers::handle_probe(
+            target,
+            probe::ProbeOptions {
+                calls,
+                rate,
+                count,
+                duration: duration.map(std::time::Duration::from_secs),
+                timeout: std::time::Duration::from_secs(timeout),
+            },
+            log_file,
+            json,
+        )?,
+        Commands::Mock {
+            from,
+            session,
+            strict,
+        } => handlers::handle_mock(from, session, strict)?,
+        Commands::Dashboard {
+            file,
+            session,
+            once,
+        } => handlers::handle_dashboard(file, session, once)?,
+        Commands::Sessions {
+            command: SessionsCommands::Recover { dry_run },
+            ..
+        } => handlers::handle_sessions_recover(&cli.config, dry_run)?,
+        Commands::Sessions {
+            file,
+            json,
+            command,
+        } => handlers::handle_sessions(file, json, command)?,
+        Commands::Inspect { id, file, export } => handlers::handle_inspect(file, &id, export)?,
+        Commands::Diff {
+            a,
+            b,
+            file,
+            b_file,
+            json,
+        } => handlers::handle_diff(&a, &b, file, b_file, json)?,
+        Commands::Tools { command } => handlers::handle_tools(command)?,
+        Commands::Report {
+            id,
+            file,
+            format,
+            output,
+        } => handlers::handle_report(&cli.config, file, &id, format, output)?,
+        Commands::Flush => handlers::handle_flush(&cli.config).await?,
+        Commands::Status { json, refresh, api } => {
+            if api {
+                handlers::handle_api_status(json).await?
+            } else {
+                handlers::handle_status(&cli.config, json, refresh).await?
+            }
+        }
+        Commands::Storage {
+            file,
+            json,
+            command,
+        } => handlers::handle_storage(&cli.config, &file, json, command)?,
+        Commands::Audit { command } => handlers::handle_audit(&cli.config, command)?,
+        Commands::Telemetry { command } => handlers::handle_telemetry(command)?,
+        Commands::Plugins { command } => handlers::handle_plugins(&cli.config, command).await?,
+        Commands::Doctor { server, command } => match command {
+            Some(DoctorCommands::Jwt) => handlers::handle_doctor_jwt()?,
+            None => handlers::handle_doctor(&cli.config, server.as_deref()).await?,
+        },
+        Commands::Policy { command } => handlers::handle_policy(&cli.config, command)?,
+        Commands::Presets { command } => handlers::handle_presets(&cli.config, command)?,
+        Commands::Rules { command } => handlers::handle_rules(&cli.config, command).await?,
+        Commands::Explain { code } => handlers::handle_explain(code),
+        Commands::Completion { shell } => handlers::handle_completion(shell),
+        Commands::Docs {
+            command: DocsCommands::Man { output },
+        } => handlers::handle_man(output)?,
+        Commands::CompleteValues { kind, file } => {
+            handlers::handle_complete_values(&cli.config, kind, &file)
+        }
+        Commands::Plugin(args) => handlers::handle_plugin_command(&cli.config, &args)?,
     }
 
     Ok(())
 }
-
-fn handle_doctor(command: DoctorCommands) -> Result<()> {
-    match command {
-        DoctorCommands::Jwt => handlers::handle_doctor_jwt(),
-    }
-}
@@ -0,0 +1,146 @@
+use clap::{Arg, Command};
+
+/// Escape text for roff: backslashes, hyphens (so they render as ASCII and
+/// can be searched for), and a leading `.` or `'` that would read as a request.
+fn escape(text: &str) -> String {
+    let escaped = text.replace('\\', r"\\").replace('-', r"\-");
+    if escaped.starts_with('.') || escaped.starts_with('\'') {
+        format!(r"\&{}", escaped)
+    } else {
+        escaped
+    }
+}
+
+fn flag_spec(arg: &Arg) -> String {
+    let mut names = Vec::new();
+    if let Some(short) = arg.get_short() {
+        names.push(format!(r"\fB\-{}\fR", short));
+    }
+    if let Some(long) = arg.get_long() {
+        names.push(format!(r"\fB\-\-{}\fR", escape(long)));
+    }
+    let mut spec = names.join(", ");
+    if arg.get_action().takes_values() {
+        let value = arg
+            .get_value_names()
+            .and_then(|names| names.first())
+            .map(|n| n.to_string())
+            .unwrap_or_else(|| arg.get_id().as_str().to_uppercase());
+        spec.push_str(&format!(r" \fI{}\fR", escape(&value)));
+    }
+    spec
+}
+
+fn positional_spec(arg: &Arg) -> String {
+    let name = arg
+        .get_value_names()
+        .and_then(|names| names.first())
+        .map(|n| n.to_string())
+        .unwrap_or_else(|| arg.get_id().as_str().to_uppercase());
+    if arg.is_required_set() {
+        format!("<{}>", name)
+    } else {
+        format!("[{}]", name)
+    }
+}
+
+fn help_of(arg: &Arg) -> String {
+    let mut help = arg.get_help().map(|h| h.to_string()).unwrap_or_default();
+    let choices: Vec<String> = arg
+        .get_possible_values()
+        .iter()
+        .filter(|v| !v.is_hide_set())
+        .map(|v| v.get_name().to_string())
+        .collect();
+    if !choices.is_empty() && arg.get_action().takes_values() {
+        help.push_str(&format!(" [possible values: {}]", choices.join(", ")));
+    }
+    let defaults: Vec<String> = arg
+        .get_default_values()
+        .iter()
+        .map(|v| v.to_string_lossy().into_owned())
+        .collect();
+    if !defaults.is_empty() && arg.get_action().takes_values() {
+        help.push_str(&format!(" [default: {}]", defaults.join(", ")));
+    }
+    help
+}
+
+fn options(out: &mut String, cmd: &Command) {
+    for arg in cmd
+        .get_arguments()
+        .filter(|a| !a.is_hide_set() && !a.is_positional())
+    {
+        out.push_str(&format!(
+            ".TP\n{}\n{}\n",
+            flag_spec(arg),
+            escape(&help_of(arg))
+        ));
+    }
+    for arg in cmd.get_positionals().filter(|a| !a.is_hide_set()) {
+        out.push_str(&format!(
+            ".TP\n\\fI{}\\fR\n{}\n",
+            escape(&positional_spec(arg)),
+            escape(&help_of(arg))
+        ));
+    }
+}
+
+fn synopsis(cmd: &Command, path: &str) -> String {
+    let mut parts = vec![format!(r"\fB{}\fR", escape(path))];
+    if cmd
+        .get_arguments()
+        .any(|a| !a.is_positional() && !a.is_hide_set())
+    {
+        parts.push("[OPTIONS]".to_string());
+    }
+    parts.extend(
+        cmd.get_positionals()
+            .filter(|a| !a.is_hide_set())
+            .map(|a| escape(&positional_spec(a))),
+    );
+    if cmd.get_subcommands().any(|c| !c.is_hide_set()) {
+        parts.push("<COMMAND>".to_string());
+    }
+    parts.join(" ")
+}
+
+fn commands(out: &mut String, cmd: &Command, path: &str) {
+    for sub in cmd.get_subcommands().filter(|c| !c.is_hide_set()) {
+        let sub_path = format!("{} {}", path, sub.get_name());
+        out.push_str(&format!(".SS {}\n", escape(&sub_path)));
+        out.push_str(&format!("{}\n.PP\n", synopsis(sub, &sub_path)));
+        if let Some(about) = sub.get_long_about().or(sub.get_about()) {
+            out.push_str(&format!("{}\n", escape(&about.to_string())));
+        }
+        options(out, sub);
+        commands(out, sub, &sub_path);
+    }
+}
+
+/// The km(1) man page in roff, covering every visible command.
+pub fn render(cmd: &mut Command) -> String {
+    cmd.build();
+    let name = cmd.get_name().to_string();
+    let version = cmd.get_version().unwrap_or_default().to_string();
+    let about = cmd.get_about().map(|a| a.to_string()).unwrap_or_default();
+
+    let mut out = String::new();
+    out.push_str(&format!(
+        ".TH {} 1 \"\" \"{} {}\" \"User Commands\"\n",
+        name.to_uppercase(),
+        name,
+        escape(&version)
+    ));
+    out.push_str(&format!(".SH NAME\n{} \\- {}\n", name, escape(&about)));
+    out.push_str(&format!(".SH SYNOPSIS\n{}\n", synopsis(cmd, &name)));
+    out.push_str(".SH OPTIONS\n");
+    options(&mut out, cmd);
+    out.push_str(".SH COMMANDS\n");
+    commands(&mut out, cmd, &name);
+    out.push_str(
+        ".SH FILES\n.TP\n\\fIkm_config.json\\fR\nDefault config file; see \\fBkm config\\fR.\n",
+    );
+    out.push_str(".SH SEE ALSO\nhttps://kilometers.ai\n");
+    out
+}
@@ -0,0 +1,107 @@
+//! `km merge`: put the captures of a run spread over several machines on
+//! one timeline. Each event is labeled with the capture it came from, and
+//! the result is a traffic log the other commands read like any other.
+
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+use crate::clock;
+use crate::traffic::{TrafficEntry, RUN_ID_LABEL};
+
+/// Label naming the capture an event came from
+pub const SOURCE_LABEL: &str = "source";
+/// Label keeping an event's own session id when `--session` replaces it
+pub const SOURCE_SESSION_LABEL: &str = "source.session";
+
+/// The events of one traffic log or `km export` JSON lines file.
+#[derive(Debug, Clone)]
+pub struct Capture {
+    /// The source label its events get
+    pub name: String,
+    pub entries: Vec<TrafficEntry>,
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct MergeOptions {
+    /// Only events from sessions started with this `--run-id`
+    pub run_id: Option<String>,
+    /// Put every event in this session, so the run reads as one session
+    pub session: Option<String>,
+}
+
+/// Source names for `paths`: their file names, numbered when two are the
+/// same, as `traffic.jsonl`, `traffic.jsonl#2`.
+pub fn source_names(paths: &[PathBuf]) -> Vec<String> {
+    let mut seen: HashMap<String, usize> = HashMap::new();
+    paths
+        .iter()
+        .map(|path| {
+            let name = path
+                .file_name()
+                .map(|name| name.to_string_lossy().into_owned())
+                .unwrap_or_else(|| path.display().to_string());
+            let count = seen.entry(name.clone()).or_default();
+            *count += 1;
+            match *count {
+                1 => name,
+                n => format!("{}#{}", name, n),
+            }
+        })
+        .collect()
+}
+
+/// The events of `captures` on one timeline, ordered by timestamp once each
+/// capture's clock is normalized. Events with the same timestamp keep the
+/// order of the captures they came from.
+pub fn merge(captures: Vec<Capture>, options: &MergeOptions) -> Vec<TrafficEntry> {
+    let mut merged: Vec<TrafficEntry> = captures
+        .into_iter()
+        .flat_map(|mut capture| {
+            clock::normalize(&mut capture.entries);
+            let name = capture.name;
+            capture.entries.into_iter().map(move |mut entry| {
+                entry.labels.insert(SOURCE_LABEL.to_string(), name.clone());
+                entry
+            })
+        })
+        .filter(|entry| match options.run_id {
+            Some(ref run_id) => entry.labels.get(RUN_ID_LABEL) == Some(run_id),
+            None => true,
+        })
+        .map(|mut entry| {
+            if let Some(ref session) = options.session {
+                if let Some(original) = entry.session_id.replace(session.clone()) {
+                    if original != *session {
+                        entry
+                            .labels
+                            .insert(SOURCE_SESSION_LABEL.to_string(), original);
+                    }
+                }
+            }
+            entry
+        })
+        .collect();
+    merged.sort_by_key(|entry| entry.timestamp);
+    merged
+}
+
+/// Write `entries` as a traffic log.
+pub fn write_entries(entries: &[TrafficEntry], writer: &mut dyn Write) -> Result<()> {
+    for entry in entries {
+        writeln!(writer, "{}", serde_json::to_string(entry)?)
+            .context("Failed to write the merged capture")?;
+    }
+    Ok(())
+}
+
+/// Whether `path` is the output, so a merge doesn't read what it writes.
+pub fn is_output(path: &Path, output: &Path) -> bool {
+    output != Path::new("-")
+        && (path == output
+            || matches!(
+                (path.canonicalize(), output.canonicalize()),
+                (Ok(a), Ok(b)) if a == b
+            ))
+}
@@ -0,0 +1,106 @@
+//! The `km monitor --metrics-addr` endpoint: Prometheus metrics of the
+//! running session over plain HTTP.
+
+use anyhow::{Context, Result};
+use std::io::{BufRead, BufReader, Write};
+use std::net::{SocketAddr, TcpListener, TcpStream};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::Duration;
+
+/// How long a scrape may take to send its request
+const READ_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Renders the metrics text for each scrape
+pub type MetricsSource = Arc<dyn Fn() -> String + Send + Sync>;
+
+/// Serves `GET /metrics` until dropped.
+pub struct MetricsServer {
+    addr: SocketAddr,
+    stopping: Arc<AtomicBool>,
+    accept_loop: Option<thread::JoinHandle<()>>,
+}
+
+impl MetricsServer {
+    pub fn start(addr: SocketAddr, source: MetricsSource) -> Result<Self> {
+        let listener = TcpListener::bind(addr)
+            .with_context(|| format!("Failed to open the metrics endpoint on {}", addr))?;
+        let addr = listener.local_addr()?;
+        let stopping = Arc::new(AtomicBool::new(false));
+        let accept_loop = {
+            let stopping = stopping.clone();
+            thread::spawn(move || {
+                for stream in listener.incoming() {
+                    if stopping.load(Ordering::SeqCst) {
+                        break;
+                    }
+                    if let Ok(stream) = stream {
+                        if let Err(e) = serve(stream, &source) {
+                            tracing::debug!("Metrics request failed: {}", e);
+                        }
+                    }
+                }
+            })
+        };
+        Ok(Self {
+            addr,
+            stopping,
+            accept_loop: Some(accept_loop),
+        })
+    }
+
+    /// Where the endpoint is listening (resolves port 0)
+    pub fn addr(&self) -> SocketAddr {
+        self.addr
+    }
+}
+
+impl Drop for MetricsServer {
+    fn drop(&mut self) {
+        self.stopping.store(true, Ordering::SeqCst);
+        // Wake the accept loop so it sees the flag
+        if TcpStream::connect_timeout(&self.addr, READ_TIMEOUT).is_ok() {
+            if let Some(accept_loop) = self.accept_loop.take() {
+                let _ = accept_loop.join();
+            }
+        }
+    }
+}
+
+fn serve(stream: TcpStream, source: &MetricsSource) -> std::io::Result<()> {
+    stream.set_read_timeout(Some(READ_TIMEOUT))?;
+    let mut reader = BufReader::new(&stream);
+    let mut request_line = String::new();
+    reader.read_line(&mut request_line)?;
+    // Skip the headers; scrapes have no body
+    let mut header = String::new();
+    while reader.read_line(&mut header)? > 0 && header.trim_end() != "" {
+        header.clear();
+    }
+
+    let mut parts = request_line.split_whitespace();
+    let (status, content_type, body) = match (parts.next(), parts.next()) {
+        (Some("GET"), Some("/metrics")) => (
+            "200 OK",
+            "text/plain; version=0.0.4; charset=utf-8",
+            source(),
+        ),
+        (Some("GET"), _) => ("404 Not Found", "text/plain", "Not found\n".to_string()),
+        _ => (
+            "405 Method Not Allowed",
+            "text/plain",
+            "Method not allowed\n".to_string(),
+        ),
+    };
+    let mut stream = &stream;
+    write!(
+        stream,
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        status,
+        content_type,
+        body.len(),
+        body
+    )?;
+    stream.flush()
+}
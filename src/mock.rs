@@ -0,0 +1,166 @@
+//! `km mock`: a stdio MCP server that answers with responses recorded by
+//! `km monitor`, so client developers can run agents offline against fixed
+//! fixtures.
+
+use serde::Serialize;
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::io::{self, BufRead, Write};
+
+use crate::correlation;
+use crate::framing::{Frame, FrameReader, Framing};
+use crate::traffic::TrafficEntry;
+
+/// JSON-RPC error code returned when no recorded response fits a request
+pub const MOCK_MISS_CODE: i64 = -32004;
+
+/// The key a request's recorded response is looked up by: its method and a
+/// hash of its params. `_meta` (progress tokens and the like) is left out,
+/// since it differs between runs without changing the answer.
+pub fn request_key(method: &str, params: Option<&Value>) -> String {
+    let mut params = params.cloned().unwrap_or(Value::Null);
+    if let Some(params) = params.as_object_mut() {
+        params.remove("_meta");
+    }
+    // Object keys serialize sorted, so equal params hash the same
+    let digest = Sha256::digest(params.to_string().as_bytes());
+    let hash: String = digest[..8].iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}#{}", method, hash)
+}
+
+/// Recorded responses to one kind of request, served in the order they
+/// were recorded. The last one is repeated once they run out.
+#[derive(Debug, Default)]
+struct Recordings {
+    responses: Vec<Value>,
+    next: usize,
+}
+
+impl Recordings {
+    fn next(&mut self) -> Value {
+        let response = self.responses[self.next.min(self.responses.len() - 1)].clone();
+        self.next += 1;
+        response
+    }
+}
+
+/// How requests were answered.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct MockStats {
+    /// Answered with a response recorded for the same method and params
+    pub exact: u64,
+    /// Answered with a response recorded for the same method only
+    pub by_method: u64,
+    /// Answered with a `MOCK_MISS_CODE` error
+    pub missed: u64,
+}
+
+/// Recorded responses, indexed for serving.
+#[derive(Debug, Default)]
+pub struct MockServer {
+    exact: HashMap<String, Recordings>,
+    by_method: HashMap<String, Recordings>,
+    /// Only answer with responses recorded for the same params
+    strict: bool,
+    pub stats: MockStats,
+}
+
+impl MockServer {
+    /// Index the responses recorded in `entries`, from one session or all
+    /// of them.
+    pub fn from_entries(entries: &[TrafficEntry], session: Option<&str>, strict: bool) -> Self {
+        let mut server = Self {
+            strict,
+            ..Default::default()
+        };
+        for call in correlation::correlate(entries) {
+            if session.is_some() && call.session_id.as_deref() != session {
+                continue;
+            }
+            let Some(response) = call.response else {
+                continue;
+            };
+            let key = request_key(&call.method, call.request.get("params"));
+            server
+                .exact
+                .entry(key)
+                .or_default()
+                .responses
+                .push(response.clone());
+            server
+                .by_method
+                .entry(call.method)
+                .or_default()
+                .responses
+                .push(response);
+        }
+        server
+    }
+
+    /// Number of recorded responses
+    pub fn recorded(&self) -> usize {
+        self.by_method.values().map(|r| r.responses.len()).sum()
+    }
+
+    /// The answer to one client message; `None` for notifications and for
+    /// responses to server requests.
+    pub fn respond(&mut self, message: &Value) -> Option<Value> {
+        let method = message.get("method")?.as_str()?;
+        let id = message.get("id")?.clone();
+
+        let key = request_key(method, message.get("params"));
+        let recorded = match self.exact.get_mut(&key) {
+            Some(recordings) => {
+                self.stats.exact += 1;
+                Some(recordings.next())
+            }
+            None if !self.strict => self.by_method.get_mut(method).map(|recordings| {
+                tracing::debug!("No recording of {} with these params; using another", key);
+                self.stats.by_method += 1;
+                recordings.next()
+            }),
+            None => None,
+        };
+
+        let mut response = recorded.unwrap_or_else(|| {
+            tracing::warn!("No recorded response for {}", key);
+            self.stats.missed += 1;
+            json!({
+                "jsonrpc": "2.0",
+                "error": {
+                    "code": MOCK_MISS_CODE,
+                    "message": format!("No recorded response for {}", method),
+                    "data": {"method": method, "key": key},
+                },
+            })
+        });
+        response["id"] = id;
+        Some(response)
+    }
+
+    /// Answer client messages from `input` on `output` until `input` closes,
+    /// framing each answer the way its request was framed.
+    pub fn serve<R: BufRead, W: Write>(&mut self, input: R, mut output: W) -> io::Result<()> {
+        for frame in FrameReader::new(input, Framing::Auto) {
+            let frame = frame?;
+            let messages = frame.messages();
+            let body = if messages.is_empty() {
+                json!({"jsonrpc": "2.0", "id": null,
+                       "error": {"code": -32700, "message": "Parse error"}})
+                .to_string()
+            } else {
+                let mut responses: Vec<Value> =
+                    messages.iter().filter_map(|m| self.respond(m)).collect();
+                match (frame.is_batch(), responses.len()) {
+                    (_, 0) => continue,
+                    (true, _) => Value::Array(responses).to_string(),
+                    (false, _) => responses.remove(0).to_string(),
+                }
+            };
+            output.write_all(&Frame::encode(frame.kind, &body))?;
+            output.flush()?;
+        }
+        Ok(())
+    }
+}
@@ -0,0 +1,58 @@
+//! Air-gapped mode. With `km --offline`, `KM_OFFLINE=1` or `offline: true`
+//! in the config file, km makes no calls to the Kilometers API, the plugin
+//! marketplace, the update feed or NTP servers. Capture, storage, export,
+//! policies, installed plugins and reports work as they do online; commands
+//! that only make sense with the network fail with `OFFLINE`. Sinks,
+//! alerts and span export go where the config file sends them, so they
+//! keep working on the local network.
+
+use anyhow::Result;
+use std::sync::OnceLock;
+
+use crate::errors::{Code, KmError};
+
+/// Environment variable that turns offline mode on (`1`, `true` or `yes`)
+pub const OFFLINE_ENV: &str = "KM_OFFLINE";
+
+/// Whether km runs offline: `--offline`, else `KM_OFFLINE` when it is set,
+/// else the `offline` setting.
+pub fn select(flag: bool, km_offline: Option<&str>, configured: bool) -> bool {
+    if flag {
+        return true;
+    }
+    match km_offline.filter(|v| !v.is_empty()) {
+        Some(value) => matches!(
+            value.to_ascii_lowercase().as_str(),
+            "1" | "true" | "yes" | "on"
+        ),
+        None => configured,
+    }
+}
+
+static OFFLINE: OnceLock<bool> = OnceLock::new();
+
+/// Run offline (or not) from here on. Call once at startup.
+pub fn init(offline: bool) {
+    if offline {
+        tracing::info!("Offline mode: no API calls, plugin downloads or update checks");
+    }
+    let _ = OFFLINE.set(offline);
+}
+
+/// Whether km was started in offline mode.
+pub fn enabled() -> bool {
+    OFFLINE.get().copied().unwrap_or(false)
+}
+
+/// Fails with `OFFLINE` in offline mode. `what` says what needs the
+/// network, e.g. "Signing in".
+pub fn ensure_online(what: &str) -> Result<()> {
+    if enabled() {
+        return Err(KmError::new(
+            Code::Offline,
+            format!("{} needs the network, and km is in offline mode", what),
+        )
+        .into());
+    }
+    Ok(())
+}
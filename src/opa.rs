@@ -0,0 +1,273 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::fs;
+use std::io::Read;
+use std::path::Path;
+
+/// The rule evaluated for every call
+pub const DECISION_QUERY: &str = "data.km.decision";
+/// What redacted values are replaced with in captured events
+const REDACTED: &str = "[REDACTED:policy]";
+
+/// Rego modules and data from an OPA bundle (a `.tar.gz` as built by
+/// `opa build`, or a directory with the same layout).
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct PolicyBundle {
+    /// (path, source) of each `.rego` file
+    pub modules: Vec<(String, String)>,
+    /// `data.json` files merged at their directory paths
+    pub data: Value,
+    /// `revision` from the bundle's `.manifest`
+    pub revision: Option<String>,
+}
+
+impl PolicyBundle {
+    pub fn open(path: &Path) -> Result<Self> {
+        let mut bundle = Self {
+            data: json!({}),
+            ..Self::default()
+        };
+        if path.is_dir() {
+            bundle.read_dir(path, path)?;
+        } else {
+            let file = fs::File::open(path)
+                .with_context(|| format!("Failed to open policy bundle {:?}", path))?;
+            let mut archive = tar::Archive::new(flate2::read::GzDecoder::new(file));
+            for entry in archive
+                .entries()
+                .context("Policy bundle is not a .tar.gz archive")?
+            {
+                let mut entry = entry.context("Failed to read policy bundle")?;
+                if !entry.header().entry_type().is_file() {
+                    continue;
+                }
+                let name = entry.path()?.to_string_lossy().into_owned();
+                let mut contents = String::new();
+                entry
+                    .read_to_string(&mut contents)
+                    .with_context(|| format!("{} in the policy bundle is not UTF-8", name))?;
+                bundle.add_file(&name, contents)?;
+            }
+        }
+
+        if bundle.modules.is_empty() {
+            return Err(anyhow::anyhow!(
+                "Policy bundle {:?} contains no .rego files",
+                path
+            ));
+        }
+        Ok(bundle)
+    }
+
+    fn read_dir(&mut self, root: &Path, dir: &Path) -> Result<()> {
+        let mut entries: Vec<_> = fs::read_dir(dir)
+            .with_context(|| format!("Failed to read policy bundle {:?}", dir))?
+            .collect::<std::io::Result<_>>()?;
+        entries.sort_by_key(|e| e.path());
+        for entry in entries {
+            let path = entry.path();
+            if path.is_dir() {
+                self.read_dir(root, &path)?;
+            } else {
+                let name = path.strip_prefix(root).unwrap_or(&path);
+                let contents = fs::read_to_string(&path)
+                    .with_context(|| format!("Failed to read {:?}", path))?;
+                self.add_file(&name.to_string_lossy(), contents)?;
+            }
+        }
+        Ok(())
+    }
+
+    fn add_file(&mut self, name: &str, contents: String) -> Result<()> {
+        let name = name.trim_start_matches("./").trim_start_matches('/');
+        let file_name = name.rsplit('/').next().unwrap_or(name);
+
+        if name.ends_with(".rego") {
+            self.modules.push((name.to_string(), contents));
+        } else if file_name == ".manifest" {
+            let manifest: Value = serde_json::from_str(&contents)
+                .context("Policy bundle .manifest is not valid JSON")?;
+            self.revision = manifest
+                .get("revision")
+                .and_then(|r| r.as_str())
+                .filter(|r| !r.is_empty())
+                .map(String::from);
+        } else if file_name == "data.json" {
+            let data: Value = serde_json::from_str(&contents)
+                .with_context(|| format!("{} in the policy bundle is not valid JSON", name))?;
+            // a/b/data.json becomes data.a.b
+            let mut target = &mut self.data;
+            for key in name
+                .split('/')
+                .filter(|k| !k.is_empty() && *k != "data.json")
+            {
+                target = target
+                    .as_object_mut()
+                    .context("Conflicting data.json paths in policy bundle")?
+                    .entry(key)
+                    .or_insert_with(|| json!({}));
+            }
+            merge(target, data);
+        }
+        Ok(())
+    }
+}
+
+fn merge(target: &mut Value, data: Value) {
+    match (target, data) {
+        (Value::Object(target), Value::Object(data)) => {
+            for (key, value) in data {
+                merge(target.entry(key).or_insert(Value::Null), value);
+            }
+        }
+        (target, data) => *target = data,
+    }
+}
+
+/// What `data.km.decision` returned for a call. A rule may also return a
+/// plain boolean, meaning allow or deny.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct OpaDecision {
+    #[serde(default = "default_allow")]
+    pub allow: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub reason: Option<String>,
+    /// JSON pointers to hide in the captured event
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub redact: Vec<String>,
+}
+
+fn default_allow() -> bool {
+    true
+}
+
+impl OpaDecision {
+    pub fn allowed() -> Self {
+        Self {
+            allow: true,
+            reason: None,
+            redact: Vec::new(),
+        }
+    }
+
+    /// Interpret the JSON value of the decision rule. An undefined rule
+    /// allows the call.
+    #[cfg_attr(not(feature = "opa"), allow(dead_code))]
+    pub fn from_value(value: Value) -> Result<Self> {
+        match value {
+            Value::Null => Ok(Self::allowed()),
+            Value::Bool(allow) => Ok(Self {
+                allow,
+                ..Self::allowed()
+            }),
+            other => serde_json::from_value(other).with_context(|| {
+                format!(
+                    "{} must be a boolean or an object with allow, reason and redact",
+                    DECISION_QUERY
+                )
+            }),
+        }
+    }
+
+    /// The decision log entry attached to the captured event.
+    pub fn log(&self, phase: &str, revision: Option<&str>) -> Value {
+        json!({
+            "query": DECISION_QUERY,
+            "phase": phase,
+            "revision": revision,
+            "result": self,
+        })
+    }
+}
+
+/// The `input` document for one phase of a call.
+pub fn input(phase: &str, request: &Value, response: Option<&Value>, session_id: &str) -> Value {
+    let method = request.get("method").and_then(|m| m.as_str());
+    let tool = (method == Some("tools/call"))
+        .then(|| request.pointer("/params/name"))
+        .flatten();
+    json!({
+        "phase": phase,
+        "session_id": session_id,
+        "method": method,
+        "tool": tool,
+        "request": request,
+        "response": response,
+    })
+}
+
+/// Replace the values at `pointers` so they don't end up in captured events.
+pub fn redact(message: &mut Value, pointers: &[String]) {
+    for pointer in pointers {
+        if let Some(value) = message.pointer_mut(pointer) {
+            *value = Value::String(REDACTED.to_string());
+        }
+    }
+}
+
+/// Rego policies from a bundle, evaluated in-process.
+pub struct OpaPolicy {
+    #[cfg(feature = "opa")]
+    engine: std::sync::Mutex<regorus::Engine>,
+    revision: Option<String>,
+}
+
+impl std::fmt::Debug for OpaPolicy {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("OpaPolicy")
+            .field("revision", &self.revision)
+            .finish_non_exhaustive()
+    }
+}
+
+impl OpaPolicy {
+    #[cfg(feature = "opa")]
+    pub fn load(path: &Path) -> Result<Self> {
+        let bundle = PolicyBundle::open(path)?;
+        let mut engine = regorus::Engine::new();
+        for (name, source) in bundle.modules {
+            engine
+                .add_policy(name.clone(), source)
+                .with_context(|| format!("Failed to compile {}", name))?;
+        }
+        engine.add_data(regorus::Value::from_json_str(&bundle.data.to_string())?)?;
+
+        Ok(Self {
+            engine: std::sync::Mutex::new(engine),
+            revision: bundle.revision,
+        })
+    }
+
+    #[cfg(not(feature = "opa"))]
+    pub fn load(path: &Path) -> Result<Self> {
+        // Still check the bundle so the error is about the build, not the file
+        PolicyBundle::open(path)?;
+        Err(anyhow::anyhow!(
+            "OPA policy bundles are not available in this build. Rebuild km with `--features opa`"
+        ))
+    }
+
+    pub fn revision(&self) -> Option<&str> {
+        self.revision.as_deref()
+    }
+
+    #[cfg(feature = "opa")]
+    pub fn decide(&self, input: &Value) -> Result<OpaDecision> {
+        let mut engine = self
+            .engine
+            .lock()
+            .map_err(|_| anyhow::anyhow!("Policy engine is unavailable"))?;
+        engine.set_input(regorus::Value::from_json_str(&input.to_string())?);
+        let result = engine.eval_rule(DECISION_QUERY.to_string())?;
+        if result == regorus::Value::Undefined {
+            return Ok(OpaDecision::allowed());
+        }
+        OpaDecision::from_value(serde_json::from_str(&result.to_json_str()?)?)
+    }
+
+    #[cfg(not(feature = "opa"))]
+    pub fn decide(&self, _input: &Value) -> Result<OpaDecision> {
+        Ok(OpaDecision::allowed())
+    }
+}
@@ -0,0 +1,329 @@
+use anyhow::{Context, Result};
+use serde_json::{json, Value};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::mpsc;
+
+use crate::build_info;
+use crate::correlation::{CallStatus, CorrelatedCall};
+use crate::risk::provider::{RiskEngine, RiskSample};
+use crate::risk::RiskAssessment;
+
+const DEFAULT_TIMEOUT_MS: u64 = 10_000;
+const DEFAULT_SERVICE_NAME: &str = "km";
+/// Spans are exported once this many are waiting...
+const MAX_EXPORT_BATCH: usize = 512;
+/// ...or the oldest has waited this long
+const EXPORT_DELAY: Duration = Duration::from_secs(5);
+
+/// Where and how to export spans, read from the standard `OTEL_*`
+/// environment variables.
+#[derive(Debug, Clone, PartialEq)]
+pub struct OtlpConfig {
+    /// Full OTLP/HTTP traces URL, e.g. `http://localhost:4318/v1/traces`
+    pub endpoint: String,
+    pub headers: Vec<(String, String)>,
+    pub service_name: String,
+    pub resource_attributes: Vec<(String, String)>,
+    pub timeout: Duration,
+}
+
+fn parse_pairs(value: &str) -> Vec<(String, String)> {
+    value
+        .split(',')
+        .filter_map(|pair| pair.split_once('='))
+        .map(|(k, v)| (k.trim().to_string(), v.trim().to_string()))
+        .filter(|(k, _)| !k.is_empty())
+        .collect()
+}
+
+impl OtlpConfig {
+    /// `None` unless an OTLP endpoint is configured and tracing isn't
+    /// switched off. `env` looks up an environment variable.
+    pub fn from_env(env: impl Fn(&str) -> Option<String>) -> Result<Option<Self>> {
+        // Signal-specific variables take precedence over the general ones
+        let var = |name: &str| {
+            env(&format!("OTEL_EXPORTER_OTLP_TRACES_{}", name))
+                .or_else(|| env(&format!("OTEL_EXPORTER_OTLP_{}", name)))
+                .filter(|v| !v.trim().is_empty())
+        };
+
+        if env("OTEL_SDK_DISABLED").is_some_and(|v| v.trim().eq_ignore_ascii_case("true")) {
+            return Ok(None);
+        }
+        if let Some(exporters) = env("OTEL_TRACES_EXPORTER") {
+            if !exporters.split(',').any(|e| e.trim() == "otlp") {
+                return Ok(None);
+            }
+        }
+
+        let endpoint = match (
+            env("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT").filter(|v| !v.trim().is_empty()),
+            env("OTEL_EXPORTER_OTLP_ENDPOINT").filter(|v| !v.trim().is_empty()),
+        ) {
+            (Some(traces), _) => traces.trim().to_string(),
+            (None, Some(base)) => format!("{}/v1/traces", base.trim().trim_end_matches('/')),
+            (None, None) => return Ok(None),
+        };
+
+        if let Some(protocol) = var("PROTOCOL") {
+            match protocol.trim() {
+                "http/json" => {}
+                "grpc" => {
+                    return Err(anyhow::anyhow!(
+                        "OTLP over gRPC is not supported; point OTEL_EXPORTER_OTLP_ENDPOINT at the collector's HTTP port (4318) and use http/json"
+                    ))
+                }
+                other => tracing::warn!(
+                    "OTEL_EXPORTER_OTLP_PROTOCOL={} is not supported; exporting spans as http/json",
+                    other
+                ),
+            }
+        }
+
+        let timeout_ms = match var("TIMEOUT") {
+            Some(ms) => ms
+                .trim()
+                .parse::<u64>()
+                .context("OTEL_EXPORTER_OTLP_TIMEOUT must be a number of milliseconds")?,
+            None => DEFAULT_TIMEOUT_MS,
+        };
+
+        let resource_attributes = env("OTEL_RESOURCE_ATTRIBUTES")
+            .map(|v| parse_pairs(&v))
+            .unwrap_or_default();
+        let service_name = env("OTEL_SERVICE_NAME")
+            .filter(|v| !v.trim().is_empty())
+            .or_else(|| {
+                resource_attributes
+                    .iter()
+                    .find(|(k, _)| k == "service.name")
+                    .map(|(_, v)| v.clone())
+            })
+            .unwrap_or_else(|| DEFAULT_SERVICE_NAME.to_string());
+
+        Ok(Some(Self {
+            endpoint,
+            headers: var("HEADERS").map(|v| parse_pairs(&v)).unwrap_or_default(),
+            service_name,
+            resource_attributes,
+            timeout: Duration::from_millis(timeout_ms),
+        }))
+    }
+}
+
+fn attribute(key: &str, value: Value) -> Value {
+    let value = match value {
+        Value::String(s) => json!({ "stringValue": s }),
+        Value::Bool(b) => json!({ "boolValue": b }),
+        // OTLP JSON encodes 64-bit integers as strings
+        Value::Number(n) if n.is_i64() => json!({ "intValue": n.to_string() }),
+        Value::Number(n) => json!({ "doubleValue": n.as_f64() }),
+        other => json!({ "stringValue": other.to_string() }),
+    };
+    json!({ "key": key, "value": value })
+}
+
+fn unix_nanos(at: chrono::DateTime<chrono::Utc>) -> String {
+    at.timestamp_nanos_opt().unwrap_or_default().to_string()
+}
+
+/// Trace id for a session: every call in a `km monitor` session shares one
+/// trace. Session ids are UUIDs, which are exactly the 16 bytes a trace id
+/// needs.
+pub fn trace_id(session_id: Option<&str>) -> String {
+    session_id
+        .and_then(|id| uuid::Uuid::parse_str(id).ok())
+        .unwrap_or_else(uuid::Uuid::new_v4)
+        .simple()
+        .to_string()
+}
+
+/// One OTLP span for a completed call. The span is named after the method
+/// and carries the call's risk score and payload sizes as attributes.
+pub fn span(call: &CorrelatedCall, risk: &RiskAssessment) -> Value {
+    let request = call.request.to_string();
+
+    let mut attributes = vec![
+        attribute("rpc.system", json!("jsonrpc")),
+        attribute("rpc.method", json!(call.method)),
+        attribute("rpc.jsonrpc.request_id", json!(call.id.to_string())),
+        attribute("km.risk.score", json!(risk.score as f64)),
+        attribute("km.risk.level", json!(risk.level.to_string())),
+        attribute("km.risk.provider", json!(risk.provider)),
+        attribute("mcp.request.size", json!(request.len() as i64)),
+    ];
+    if risk.confidence < 1.0 {
+        attributes.push(attribute(
+            "km.risk.confidence",
+            json!(risk.confidence as f64),
+        ));
+    }
+    if let Some(ref session_id) = call.session_id {
+        attributes.push(attribute("mcp.session.id", json!(session_id)));
+    }
+    if let Some(ref response) = call.response {
+        attributes.push(attribute(
+            "mcp.response.size",
+            json!(response.to_string().len() as i64),
+        ));
+    }
+    if let Some(tool) = call
+        .request
+        .pointer("/params/name")
+        .and_then(|name| name.as_str())
+    {
+        attributes.push(attribute("mcp.tool.name", json!(tool)));
+    }
+
+    // STATUS_CODE_OK = 1, STATUS_CODE_ERROR = 2
+    let status = match call.status {
+        CallStatus::Error { code, ref message } => {
+            if let Some(code) = code {
+                attributes.push(attribute("rpc.jsonrpc.error_code", json!(code)));
+            }
+            json!({ "code": 2, "message": message })
+        }
+        CallStatus::Success => json!({ "code": 1 }),
+        CallStatus::Pending => json!({}),
+    };
+
+    json!({
+        "traceId": trace_id(call.session_id.as_deref()),
+        "spanId": uuid::Uuid::new_v4().simple().to_string()[..16].to_string(),
+        "name": call.method,
+        // SPAN_KIND_CLIENT: km calls the server on the agent's behalf
+        "kind": 3,
+        "startTimeUnixNano": unix_nanos(call.started_at),
+        "endTimeUnixNano": unix_nanos(call.completed_at.unwrap_or(call.started_at)),
+        "attributes": attributes,
+        "status": status,
+    })
+}
+
+/// Sends spans for correlated calls to an OTLP/HTTP collector.
+#[derive(Debug, Clone)]
+pub struct SpanExporter {
+    config: OtlpConfig,
+    client: reqwest::Client,
+    risk: Arc<RiskEngine>,
+}
+
+impl SpanExporter {
+    pub fn new(config: OtlpConfig) -> Self {
+        let client = crate::http::client_builder()
+            .timeout(config.timeout)
+            .build()
+            .unwrap_or_else(|_| reqwest::Client::new());
+        Self {
+            config,
+            client,
+            risk: Arc::new(RiskEngine::default()),
+        }
+    }
+
+    /// Score requests with `risk` instead of the pattern analyzer alone.
+    pub fn with_risk_engine(mut self, risk: RiskEngine) -> Self {
+        self.risk = Arc::new(risk);
+        self
+    }
+
+    /// OTLP `ExportTraceServiceRequest` body for a batch of calls.
+    pub async fn payload(&self, calls: &[CorrelatedCall]) -> Value {
+        let mut resource = vec![attribute("service.name", json!(self.config.service_name))];
+        resource.extend(
+            self.config
+                .resource_attributes
+                .iter()
+                .filter(|(k, _)| k != "service.name")
+                .map(|(k, v)| attribute(k, json!(v))),
+        );
+        let requests: Vec<String> = calls.iter().map(|c| c.request.to_string()).collect();
+        let samples: Vec<RiskSample> = calls
+            .iter()
+            .zip(&requests)
+            .map(|(call, request)| RiskSample {
+                method: Some(&call.method),
+                content: request,
+            })
+            .collect();
+        let risks = self.risk.analyze_batch(&samples).await;
+        let spans: Vec<Value> = calls
+            .iter()
+            .zip(&risks)
+            .map(|(call, risk)| span(call, risk))
+            .collect();
+
+        json!({
+            "resourceSpans": [{
+                "resource": { "attributes": resource },
+                "scopeSpans": [{
+                    "scope": { "name": "km", "version": build_info::VERSION },
+                    "spans": spans,
+                }],
+            }],
+        })
+    }
+
+    pub async fn export(&self, calls: &[CorrelatedCall]) -> Result<()> {
+        if calls.is_empty() {
+            return Ok(());
+        }
+
+        let mut request = self.client.post(&self.config.endpoint);
+        for (name, value) in &self.config.headers {
+            request = request.header(name.as_str(), value.as_str());
+        }
+        let response = request
+            .json(&self.payload(calls).await)
+            .send()
+            .await
+            .context("Failed to reach OTLP collector")?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "OTLP collector answered with status {}",
+                response.status()
+            ));
+        }
+        Ok(())
+    }
+
+    /// Export calls from `rx` in batches until the sender side is dropped,
+    /// then flush whatever is left.
+    pub fn spawn(self, mut rx: mpsc::Receiver<CorrelatedCall>) -> tokio::task::JoinHandle<()> {
+        tokio::spawn(async move {
+            let mut batch = Vec::new();
+            let mut deadline = None;
+            loop {
+                let next = match deadline {
+                    Some(deadline) => tokio::time::timeout_at(deadline, rx.recv()).await,
+                    None => Ok(rx.recv().await),
+                };
+                let closed = match next {
+                    Ok(Some(call)) => {
+                        if batch.is_empty() {
+                            deadline = Some(tokio::time::Instant::now() + EXPORT_DELAY);
+                        }
+                        batch.push(call);
+                        if batch.len() < MAX_EXPORT_BATCH {
+                            continue;
+                        }
+                        false
+                    }
+                    Ok(None) => true,
+                    Err(_) => false,
+                };
+
+                if let Err(e) = self.export(&batch).await {
+                    tracing::warn!("Dropping {} spans: {:#}", batch.len(), e);
+                }
+                batch.clear();
+                deadline = None;
+
+                if closed {
+                    break;
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,415 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use reqwest::header::CONTENT_TYPE;
+use reqwest::Url;
+use ring::hmac;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fs;
+use std::path::{Path, PathBuf};
+use tokio::sync::mpsc;
+
+use crate::plugins::verify::sha256_hex;
+use crate::uploader::McpEvent;
+
+pub const DEFAULT_BLOB_REGION: &str = "us-east-1";
+
+/// Keeps large payloads out of uploaded events. The traffic log always
+/// keeps them in full.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct PayloadConfig {
+    /// Upload only the first this many bytes of larger payloads, with their size and SHA-256
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub truncate_bytes: Option<usize>,
+    /// Store payloads of at least this many bytes as blobs and reference them by URI
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub blob_threshold_bytes: Option<usize>,
+    /// Directory blobs are written to (default ~/.config/kilometers/blobs)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub blob_dir: Option<String>,
+    /// S3-compatible bucket URL blobs are uploaded to, e.g. https://s3.us-east-1.amazonaws.com/bucket/km
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub blob_url: Option<String>,
+    /// Region used to sign blob uploads (default us-east-1)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub blob_region: Option<String>,
+}
+
+impl PayloadConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        if self.truncate_bytes == Some(0) {
+            return Err(anyhow::anyhow!(
+                "payloads.truncate_bytes must be greater than 0"
+            ));
+        }
+        if self.blob_threshold_bytes == Some(0) {
+            return Err(anyhow::anyhow!(
+                "payloads.blob_threshold_bytes must be greater than 0"
+            ));
+        }
+        if let Some(ref url) = self.blob_url {
+            bucket_url(url).context("Invalid payloads.blob_url")?;
+            if self.blob_threshold_bytes.is_none() {
+                return Err(anyhow::anyhow!(
+                    "payloads.blob_url needs payloads.blob_threshold_bytes"
+                ));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Parse a bucket URL, normalised to end with a slash so object names can
+/// be joined onto it.
+pub fn bucket_url(url: &str) -> Result<Url> {
+    let url = Url::parse(&format!("{}/", url.trim_end_matches('/')))
+        .with_context(|| format!("Invalid URL '{}'", url))?;
+    if !matches!(url.scheme(), "http" | "https") {
+        return Err(anyhow::anyhow!(
+            "'{}' must start with http:// or https://",
+            url
+        ));
+    }
+    Ok(url)
+}
+
+/// Trims or offloads event payloads as they are captured, so a session
+/// full of images and files doesn't fill memory and upload batches.
+#[derive(Debug, Default)]
+pub struct PayloadShaper {
+    truncate_bytes: Option<usize>,
+    blobs: Option<(usize, BlobStore)>,
+}
+
+impl PayloadShaper {
+    pub fn new(truncate_bytes: Option<usize>) -> Self {
+        Self {
+            truncate_bytes,
+            blobs: None,
+        }
+    }
+
+    /// Store payloads of at least `threshold` bytes in `store`.
+    pub fn with_blobs(mut self, threshold: usize, store: BlobStore) -> Self {
+        self.blobs = Some((threshold, store));
+        self
+    }
+
+    /// Whether the shaper would leave every payload alone.
+    pub fn is_noop(&self) -> bool {
+        self.truncate_bytes.is_none() && self.blobs.is_none()
+    }
+
+    /// Replace a large payload with a blob reference or its first bytes.
+    /// Payloads that can't be stored are truncated instead, if configured.
+    pub fn shape(&self, event: &mut McpEvent, content: &str) {
+        if let Some((threshold, ref store)) = self.blobs {
+            if content.len() >= threshold {
+                match store.put(content) {
+                    Ok(uri) => {
+                        event.payload = None;
+                        event.payload_uri = Some(uri);
+                        event.payload_sha256 = Some(sha256_hex(content.as_bytes()));
+                        return;
+                    }
+                    Err(e) => tracing::warn!("Failed to store payload blob: {:#}", e),
+                }
+            }
+        }
+        if let Some(limit) = self.truncate_bytes {
+            if event.payload.is_some() && content.len() > limit {
+                let mut end = limit;
+                while !content.is_char_boundary(end) {
+                    end -= 1;
+                }
+                event.payload = Some(Value::String(content[..end].to_string()));
+                event.payload_truncated = true;
+                event.payload_sha256 = Some(sha256_hex(content.as_bytes()));
+            }
+        }
+    }
+}
+
+/// A stored payload waiting to be uploaded to the bucket.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Blob {
+    pub path: PathBuf,
+    pub url: Url,
+}
+
+/// Writes payloads to files named by their SHA-256, so a payload seen many
+/// times is stored once. With a bucket, each new file is also queued for
+/// upload and events reference the bucket URL.
+#[derive(Debug)]
+pub struct BlobStore {
+    dir: PathBuf,
+    bucket: Option<(Url, mpsc::UnboundedSender<Blob>)>,
+}
+
+impl BlobStore {
+    pub fn new(dir: PathBuf) -> Self {
+        Self { dir, bucket: None }
+    }
+
+    /// `~/.config/kilometers/blobs` (or the platform equivalent)
+    pub fn default_dir() -> Result<PathBuf> {
+        let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+        Ok(base.config_dir().join("kilometers").join("blobs"))
+    }
+
+    /// Also upload blobs to the bucket at `url`; hand the receiver to
+    /// [`S3Uploader::spawn`].
+    pub fn with_bucket(mut self, url: &str) -> Result<(Self, mpsc::UnboundedReceiver<Blob>)> {
+        let (tx, rx) = mpsc::unbounded_channel();
+        self.bucket = Some((bucket_url(url)?, tx));
+        Ok((self, rx))
+    }
+
+    /// Store `content` and return the URI events should reference.
+    pub fn put(&self, content: &str) -> Result<String> {
+        let name = format!("{}.json", sha256_hex(content.as_bytes()));
+        let path = self.dir.join(&name);
+        let new = !path.exists();
+        if new {
+            fs::create_dir_all(&self.dir).context("Failed to create blob directory")?;
+            // Written under a temporary name so a reader never sees half a blob
+            let partial = self.dir.join(format!("{}.tmp", name));
+            fs::write(&partial, content)
+                .and_then(|_| fs::rename(&partial, &path))
+                .with_context(|| format!("Failed to write {:?}", path))?;
+        } else {
+            // Retention ages blobs from their last use
+            let _ = fs::File::options()
+                .append(true)
+                .open(&path)
+                .and_then(|file| file.set_modified(std::time::SystemTime::now()));
+        }
+
+        match self.bucket {
+            Some((ref bucket, ref uploads)) => {
+                let url = bucket.join(&name)?;
+                if new {
+                    let _ = uploads.send(Blob {
+                        path,
+                        url: url.clone(),
+                    });
+                }
+                Ok(url.to_string())
+            }
+            None => Ok(file_uri(&path)),
+        }
+    }
+}
+
+fn file_uri(path: &Path) -> String {
+    fs::canonicalize(path)
+        .ok()
+        .and_then(|path| Url::from_file_path(path).ok())
+        .map(|url| url.to_string())
+        .unwrap_or_else(|| format!("file://{}", path.display()))
+}
+
+/// Keys for signing bucket uploads, from the standard AWS variables.
+#[derive(Debug, Clone, PartialEq)]
+pub struct S3Credentials {
+    pub access_key_id: String,
+    pub secret_access_key: String,
+    pub session_token: Option<String>,
+}
+
+impl S3Credentials {
+    pub fn from_env() -> Result<Self> {
+        let var = |name: &str| std::env::var(name).ok().filter(|v| !v.is_empty());
+        match (var("AWS_ACCESS_KEY_ID"), var("AWS_SECRET_ACCESS_KEY")) {
+            (Some(access_key_id), Some(secret_access_key)) => Ok(Self {
+                access_key_id,
+                secret_access_key,
+                session_token: var("AWS_SESSION_TOKEN"),
+            }),
+            _ => Err(anyhow::anyhow!(
+                "Set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to upload to S3-compatible storage"
+            )),
+        }
+    }
+}
+
+/// Uploads objects to an S3-compatible bucket with signed PUT requests.
+#[derive(Debug, Clone)]
+pub struct S3Uploader {
+    client: reqwest::Client,
+    region: String,
+    credentials: S3Credentials,
+}
+
+impl S3Uploader {
+    pub fn new(region: &str, credentials: S3Credentials) -> Self {
+        Self {
+            client: crate::http::client(),
+            region: region.to_string(),
+            credentials,
+        }
+    }
+
+    /// PUT the blob, then remove the local copy.
+    pub async fn upload(&self, blob: &Blob) -> Result<()> {
+        let body =
+            fs::read(&blob.path).with_context(|| format!("Failed to read {:?}", blob.path))?;
+        self.put(&blob.url, body, "application/json").await?;
+        let _ = fs::remove_file(&blob.path);
+        Ok(())
+    }
+
+    /// PUT `body` at `url`, replacing any object already there.
+    pub async fn put(&self, url: &Url, body: Vec<u8>, content_type: &str) -> Result<()> {
+        let payload_hash = sha256_hex(&body);
+        let now = Utc::now();
+        let mut headers = vec![
+            ("x-amz-content-sha256".to_string(), payload_hash.clone()),
+            ("x-amz-date".to_string(), now.format(AMZ_DATE).to_string()),
+        ];
+        if let Some(ref token) = self.credentials.session_token {
+            headers.push(("x-amz-security-token".to_string(), token.clone()));
+        }
+        let authorization = sign(
+            "PUT",
+            url,
+            &headers,
+            &payload_hash,
+            &self.credentials,
+            &self.region,
+            now,
+        );
+
+        let mut request = self
+            .client
+            .put(url.clone())
+            .header(CONTENT_TYPE, content_type)
+            .header("authorization", authorization);
+        for (name, value) in headers {
+            request = request.header(name, value);
+        }
+        let response = request
+            .body(body)
+            .send()
+            .await
+            .with_context(|| format!("Failed to upload {}", url))?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "Uploading {} failed with status {}",
+                url,
+                response.status()
+            ));
+        }
+        Ok(())
+    }
+
+    /// Upload blobs from `rx` until every store sending to it is dropped.
+    /// Blobs that fail to upload stay in the blob directory.
+    pub fn spawn(self, mut rx: mpsc::UnboundedReceiver<Blob>) -> tokio::task::JoinHandle<()> {
+        tokio::spawn(async move {
+            while let Some(blob) = rx.recv().await {
+                if let Err(e) = self.upload(&blob).await {
+                    tracing::warn!("{:#}; keeping {:?}", e, blob.path);
+                }
+            }
+        })
+    }
+}
+
+const AMZ_DATE: &str = "%Y%m%dT%H%M%SZ";
+
+/// The `Authorization` header for an AWS Signature Version 4 request to S3.
+/// `headers` are the `x-amz-*` headers sent with it; `host` is signed too.
+pub fn sign(
+    method: &str,
+    url: &Url,
+    headers: &[(String, String)],
+    payload_hash: &str,
+    credentials: &S3Credentials,
+    region: &str,
+    now: DateTime<Utc>,
+) -> String {
+    let host = match url.port() {
+        Some(port) => format!("{}:{}", url.host_str().unwrap_or_default(), port),
+        None => url.host_str().unwrap_or_default().to_string(),
+    };
+    let mut signed: Vec<(String, String)> = headers
+        .iter()
+        .map(|(name, value)| (name.to_ascii_lowercase(), value.trim().to_string()))
+        .chain(std::iter::once(("host".to_string(), host)))
+        .collect();
+    signed.sort();
+    let canonical_headers: String = signed
+        .iter()
+        .map(|(name, value)| format!("{}:{}\n", name, value))
+        .collect();
+    let signed_headers = signed
+        .iter()
+        .map(|(name, _)| name.as_str())
+        .collect::<Vec<_>>()
+        .join(";");
+
+    let mut query: Vec<(String, String)> = url.query_pairs().into_owned().collect();
+    query.sort();
+    let canonical_query = query
+        .iter()
+        .map(|(k, v)| format!("{}={}", uri_encode(k), uri_encode(v)))
+        .collect::<Vec<_>>()
+        .join("&");
+
+    let canonical_request = format!(
+        "{}\n{}\n{}\n{}\n{}\n{}",
+        method,
+        url.path(),
+        canonical_query,
+        canonical_headers,
+        signed_headers,
+        payload_hash
+    );
+
+    let date = now.format("%Y%m%d").to_string();
+    let scope = format!("{}/{}/s3/aws4_request", date, region);
+    let string_to_sign = format!(
+        "AWS4-HMAC-SHA256\n{}\n{}\n{}",
+        now.format(AMZ_DATE),
+        scope,
+        sha256_hex(canonical_request.as_bytes())
+    );
+
+    let key = [date.as_str(), region, "s3", "aws4_request"].iter().fold(
+        format!("AWS4{}", credentials.secret_access_key).into_bytes(),
+        |key, part| hmac_sha256(&key, part.as_bytes()),
+    );
+    let signature: String = hmac_sha256(&key, string_to_sign.as_bytes())
+        .iter()
+        .map(|b| format!("{:02x}", b))
+        .collect();
+
+    format!(
+        "AWS4-HMAC-SHA256 Credential={}/{}, SignedHeaders={}, Signature={}",
+        credentials.access_key_id, scope, signed_headers, signature
+    )
+}
+
+fn hmac_sha256(key: &[u8], data: &[u8]) -> Vec<u8> {
+    hmac::sign(&hmac::Key::new(hmac::HMAC_SHA256, key), data)
+        .as_ref()
+        .to_vec()
+}
+
+/// Percent-encode everything but unreserved characters, as SigV4 requires.
+fn uri_encode(value: &str) -> String {
+    value
+        .bytes()
+        .map(|b| match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => {
+                (b as char).to_string()
+            }
+            _ => format!("%{:02X}", b),
+        })
+        .collect()
+}
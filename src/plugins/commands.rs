@@ -0,0 +1,32 @@
+use serde::{Deserialize, Serialize};
+
+/// A subcommand a plugin adds to km, like `km compliance`.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PluginCommand {
+    pub name: String,
+    /// One line for `km plugins commands`
+    #[serde(default)]
+    pub about: String,
+    /// The plugin providing it
+    #[serde(default, skip_deserializing)]
+    pub plugin: String,
+}
+
+/// A plugin's reply to `describe`.
+#[derive(Debug, Default, Deserialize)]
+pub struct Description {
+    #[serde(default)]
+    pub commands: Vec<PluginCommand>,
+}
+
+/// A plugin's reply to `run_command`. Plugins run sandboxed with their
+/// output captured, so km prints it on their behalf.
+#[derive(Debug, Clone, Default, PartialEq, Deserialize)]
+pub struct CommandOutput {
+    #[serde(default)]
+    pub stdout: String,
+    #[serde(default)]
+    pub stderr: String,
+    #[serde(default)]
+    pub exit_code: i32,
+}
@@ -0,0 +1,583 @@
+//! Tools for writing plugins. `km plugins scaffold` writes a starting
+//! point, `km plugins dev` builds a plugin and runs it against a captured
+//! session whenever its sources change, and [`Harness`] checks the
+//! decisions it makes on recorded requests, for `km plugins test` or a
+//! plugin's own tests.
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::time::SystemTime;
+
+use super::marketplace::PluginRelease;
+use super::runtime::{ChainOutcome, Metadata, PluginAction, PluginHost};
+use super::sandbox::PluginSandboxConfig;
+use super::store::PluginStore;
+use super::validate_name;
+use super::verify::Trust;
+use crate::replay::ReplayStep;
+use crate::traffic;
+
+/// Describes a plugin under development, in its source directory.
+pub const MANIFEST_FILE: &str = "km-plugin.json";
+/// Where `km plugins dev` and `km plugins test` install the build
+const DEV_DIR: &str = ".km-dev";
+
+/// What `km plugins scaffold` generates.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Template {
+    /// A native plugin in Go, speaking JSON lines on stdin/stdout
+    Go,
+    /// A Rust crate compiled to a WebAssembly module
+    Wasm,
+}
+
+/// `km-plugin.json`: the release entry the plugin will be published with,
+/// plus how to build it.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DevManifest {
+    #[serde(flatten)]
+    pub release: PluginRelease,
+    /// Command that builds the plugin, run in its directory
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub build: Vec<String>,
+    /// What the build produces, relative to the plugin directory
+    pub binary: PathBuf,
+}
+
+impl DevManifest {
+    pub fn read(dir: &Path) -> Result<Self> {
+        let path = dir.join(MANIFEST_FILE);
+        let content = fs::read_to_string(&path).with_context(|| {
+            format!(
+                "No {} in {:?}; run 'km plugins scaffold' to start a plugin",
+                MANIFEST_FILE, dir
+            )
+        })?;
+        let manifest: Self = serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {:?}", path))?;
+        validate_name(&manifest.release.name)?;
+        Ok(manifest)
+    }
+
+    /// Run the build command, with its output going to the terminal.
+    pub fn build(&self, dir: &Path) -> Result<()> {
+        let Some((program, args)) = self.build.split_first() else {
+            return Ok(());
+        };
+        let status = Command::new(program)
+            .args(args)
+            .current_dir(dir)
+            .status()
+            .with_context(|| format!("Failed to run {}", program))?;
+        if !status.success() {
+            return Err(anyhow::anyhow!(
+                "`{}` failed with {}",
+                self.build.join(" "),
+                status
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Write a new plugin named `name` into `dir`, which must be empty or not
+/// exist yet. Returns the files written.
+pub fn scaffold(dir: &Path, name: &str, template: Template) -> Result<Vec<PathBuf>> {
+    validate_name(name)?;
+    if fs::read_dir(dir).is_ok_and(|mut entries| entries.next().is_some()) {
+        return Err(anyhow::anyhow!("{:?} already exists and is not empty", dir));
+    }
+
+    let crate_name = name.replace('-', "_");
+    let (files, build, binary) = match template {
+        Template::Go => (
+            vec![
+                ("go.mod", GO_MOD),
+                ("main.go", GO_MAIN),
+                ("main_test.go", GO_TEST),
+                (".gitignore", GO_GITIGNORE),
+            ],
+            vec!["go", "build", "-o", name, "."],
+            PathBuf::from(format!("{}{}", name, std::env::consts::EXE_SUFFIX)),
+        ),
+        Template::Wasm => (
+            vec![
+                ("Cargo.toml", WASM_CARGO),
+                ("src/lib.rs", WASM_LIB),
+                (".gitignore", WASM_GITIGNORE),
+            ],
+            vec![
+                "cargo",
+                "build",
+                "--release",
+                "--target",
+                "wasm32-unknown-unknown",
+            ],
+            Path::new("target/wasm32-unknown-unknown/release").join(format!("{}.wasm", crate_name)),
+        ),
+    };
+    let manifest = DevManifest {
+        release: PluginRelease {
+            name: name.to_string(),
+            version: "0.1.0".to_string(),
+            description: String::new(),
+            download_url: None,
+            sha256: None,
+            signature: None,
+            protocol: 1,
+            config_schema: None,
+        },
+        build: build.into_iter().map(String::from).collect(),
+        binary,
+    };
+
+    let mut written = Vec::new();
+    let mut write = |file: &str, content: String| -> Result<()> {
+        let path = dir.join(file);
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(&path, content).with_context(|| format!("Failed to write {:?}", path))?;
+        written.push(path);
+        Ok(())
+    };
+    write(
+        MANIFEST_FILE,
+        serde_json::to_string_pretty(&manifest)? + "\n",
+    )?;
+    for (file, content) in files {
+        write(file, content.replace("{name}", name))?;
+    }
+    write("expect.jsonl", EXPECTATIONS.to_string())?;
+    Ok(written)
+}
+
+/// Newest modification time among the plugin's sources, to notice edits.
+/// Hidden files, build output and the built binary don't count.
+pub fn fingerprint(dir: &Path, manifest: &DevManifest) -> Option<SystemTime> {
+    fn newest(path: &Path, skip: &Path) -> Option<SystemTime> {
+        let name = path.file_name()?.to_string_lossy();
+        if path == skip || name.starts_with('.') || name == "target" {
+            return None;
+        }
+        let metadata = fs::metadata(path).ok()?;
+        if !metadata.is_dir() {
+            return metadata.modified().ok();
+        }
+        fs::read_dir(path)
+            .ok()?
+            .filter_map(|entry| entry.ok())
+            .filter_map(|entry| newest(&entry.path(), skip))
+            .max()
+    }
+
+    let skip = dir.join(&manifest.binary);
+    fs::read_dir(dir)
+        .ok()?
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| newest(&entry.path(), &skip))
+        .max()
+}
+
+/// What the plugin did with one recorded request.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Decided {
+    pub id: Option<Value>,
+    pub method: Option<String>,
+    /// Tool name, for `tools/call`
+    pub tool: Option<String>,
+    pub action: PluginAction,
+    pub metadata: Metadata,
+}
+
+/// A plugin under development, loaded on its own from a scratch plugin
+/// directory so nothing installed runs next to it.
+#[derive(Debug)]
+pub struct Harness {
+    host: PluginHost,
+}
+
+impl Harness {
+    /// Load the plugin `manifest` describes from its built binary in `dir`.
+    /// `settings` is its `plugin_config` entry.
+    pub fn load(
+        dir: &Path,
+        manifest: &DevManifest,
+        config: &PluginSandboxConfig,
+        settings: &Value,
+    ) -> Result<Self> {
+        let binary_path = dir.join(&manifest.binary);
+        let binary = fs::read(&binary_path)
+            .with_context(|| format!("Failed to read plugin build {:?}", binary_path))?;
+        let store = PluginStore::new(dir.join(DEV_DIR).join("plugins"));
+        let plugin = store.install(&manifest.release, &binary, Trust::Unverified)?;
+
+        let settings = BTreeMap::from([(plugin.name.clone(), settings.clone())]);
+        let host = PluginHost::start(&store, config, true, &BTreeMap::new(), &settings)?;
+        if host.is_empty() {
+            return Err(anyhow::anyhow!(
+                "Plugin {} did not start; see the warnings above and {:?}",
+                plugin.name,
+                plugin
+                    .path
+                    .parent()
+                    .unwrap_or(dir)
+                    .join("work")
+                    .join("plugin.log")
+            ));
+        }
+        Ok(Self { host })
+    }
+
+    /// Run a client → server message through the plugin.
+    pub fn on_request(&self, message: &Value) -> (PluginAction, Metadata) {
+        match self.host.on_request(message) {
+            ChainOutcome::Forward {
+                message: forwarded,
+                metadata,
+            } if &forwarded != message => (PluginAction::Modify { message: forwarded }, metadata),
+            ChainOutcome::Forward { metadata, .. } => (PluginAction::Allow, metadata),
+            ChainOutcome::Block {
+                reason, metadata, ..
+            } => (PluginAction::Block { reason }, metadata),
+        }
+    }
+
+    /// Play a captured session to the plugin: each request for a decision,
+    /// then the response recorded for it.
+    pub fn replay(&self, steps: &[ReplayStep]) -> Vec<Decided> {
+        let mut decided = Vec::new();
+        for step in steps {
+            let Some(message) = step.request.rpc() else {
+                continue;
+            };
+            let (action, metadata) = self.on_request(&message);
+            decided.push(Decided {
+                id: step.id.clone(),
+                method: step.method.clone(),
+                tool: tool_name(&message),
+                action,
+                metadata,
+            });
+            if let Some(ref response) = step.recorded_response {
+                self.host.on_response(response);
+            }
+        }
+        decided
+    }
+}
+
+fn tool_name(message: &Value) -> Option<String> {
+    if message.get("method").and_then(Value::as_str) != Some("tools/call") {
+        return None;
+    }
+    message
+        .pointer("/params/name")
+        .and_then(Value::as_str)
+        .map(String::from)
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ExpectedAction {
+    Allow,
+    Block,
+    Modify,
+}
+
+/// One line of an expectations file: what the plugin should do with every
+/// recorded request matching `id`, `method` and `tool` (whichever are set).
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Expectation {
+    /// JSON-RPC id of the request
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<Value>,
+    /// Method pattern, like `tools/*`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    /// Tool name, for `tools/call`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tool: Option<String>,
+    pub action: ExpectedAction,
+    /// Text the block reason must contain
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub reason: Option<String>,
+}
+
+impl Expectation {
+    fn matches(&self, decided: &Decided) -> bool {
+        self.id
+            .as_ref()
+            .map_or(true, |id| decided.id.as_ref() == Some(id))
+            && self.method.as_deref().map_or(true, |pattern| {
+                decided
+                    .method
+                    .as_deref()
+                    .is_some_and(|method| traffic::method_matches(pattern, method))
+            })
+            && self
+                .tool
+                .as_deref()
+                .map_or(true, |tool| decided.tool.as_deref() == Some(tool))
+    }
+
+    fn describe(&self) -> String {
+        let mut parts = Vec::new();
+        if let Some(ref id) = self.id {
+            parts.push(format!("id {}", id));
+        }
+        if let Some(ref method) = self.method {
+            parts.push(method.clone());
+        }
+        if let Some(ref tool) = self.tool {
+            parts.push(format!("tool {}", tool));
+        }
+        match parts.is_empty() {
+            true => "every request".to_string(),
+            false => parts.join(", "),
+        }
+    }
+}
+
+/// Read an expectations file: one JSON object per line; blank lines and
+/// lines starting with `#` are skipped.
+pub fn read_expectations(path: &Path) -> Result<Vec<Expectation>> {
+    let content = fs::read_to_string(path).with_context(|| format!("Failed to read {:?}", path))?;
+    content
+        .lines()
+        .enumerate()
+        .filter(|(_, line)| !line.trim().is_empty() && !line.trim_start().starts_with('#'))
+        .map(|(number, line)| {
+            serde_json::from_str(line)
+                .with_context(|| format!("{:?} line {}: invalid expectation", path, number + 1))
+        })
+        .collect()
+}
+
+/// Check the decisions from a replay against the expectations. Returns
+/// what didn't hold; an expectation that matches no request fails too, so
+/// a typo can't pass unnoticed.
+pub fn check(expectations: &[Expectation], decided: &[Decided]) -> Vec<String> {
+    let mut failures = Vec::new();
+    for expectation in expectations {
+        let matching: Vec<&Decided> = decided.iter().filter(|d| expectation.matches(d)).collect();
+        if matching.is_empty() {
+            failures.push(format!(
+                "{}: no such request in the capture",
+                expectation.describe()
+            ));
+        }
+        for decided in matching {
+            let actual = match decided.action {
+                PluginAction::Allow => ExpectedAction::Allow,
+                PluginAction::Block { .. } => ExpectedAction::Block,
+                PluginAction::Modify { .. } => ExpectedAction::Modify,
+            };
+            let request = format!(
+                "{} (id {})",
+                decided.method.as_deref().unwrap_or("(unknown)"),
+                decided
+                    .id
+                    .as_ref()
+                    .map_or("none".to_string(), Value::to_string)
+            );
+            if actual != expectation.action {
+                failures.push(format!(
+                    "{}: expected {:?}, got {:?}",
+                    request, expectation.action, actual
+                ));
+                continue;
+            }
+            if let (Some(wanted), PluginAction::Block { reason }) =
+                (&expectation.reason, &decided.action)
+            {
+                if !reason.contains(wanted.as_str()) {
+                    failures.push(format!(
+                        "{}: block reason {:?} does not mention {:?}",
+                        request, reason, wanted
+                    ));
+                }
+            }
+        }
+    }
+    failures
+}
+
+const EXPECTATIONS: &str = r#"# What the plugin should decide for recorded requests, checked by
+# `km plugins test`. Match on "id", "method" (patterns like tools/*) and
+# "tool"; "action" is allow, block or modify, and "reason" is text a block
+# reason must contain.
+{"method": "initialize", "action": "allow"}
+"#;
+
+const GO_MOD: &str = "module {name}
+
+go 1.21
+";
+
+const GO_GITIGNORE: &str = "/.km-dev/
+/{name}
+/{name}.exe
+";
+
+const GO_MAIN: &str = r#"// Command {name} is a km plugin. km starts it once per monitor session
+// and writes one JSON hook call per line to its stdin; every on_request
+// call is answered with one JSON line on stdout. See the Plugin Protocol
+// section of km's API_ENDPOINTS.md.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type call struct {
+	ID       uint64          `json:"id"`
+	Hook     string          `json:"hook"`
+	Message  json.RawMessage `json:"message"`
+	Metadata map[string]any  `json:"metadata"`
+}
+
+type request struct {
+	Method string `json:"method"`
+	Params struct {
+		Name string `json:"name"`
+	} `json:"params"`
+}
+
+type reply struct {
+	ID     uint64 `json:"id"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// decide is where the plugin's checks go: it returns "allow", or "block"
+// with a reason.
+func decide(req request) (action, reason string) {
+	if req.Method == "tools/call" && req.Params.Name == "shell" {
+		return "block", "shell access is not allowed"
+	}
+	return "allow", ""
+}
+
+func main() {
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	out := json.NewEncoder(os.Stdout)
+	for in.Scan() {
+		var c call
+		if err := json.Unmarshal(in.Bytes(), &c); err != nil {
+			fmt.Fprintln(os.Stderr, "unreadable call:", err)
+			continue
+		}
+		if c.Hook != "on_request" {
+			// on_response and on_session_start aren't answered
+			continue
+		}
+		var req request
+		_ = json.Unmarshal(c.Message, &req)
+		action, reason := decide(req)
+		if err := out.Encode(reply{ID: c.ID, Action: action, Reason: reason}); err != nil {
+			os.Exit(1)
+		}
+	}
+}
+"#;
+
+const GO_TEST: &str = r#"package main
+
+import "testing"
+
+func TestDecide(t *testing.T) {
+	var req request
+	req.Method = "tools/call"
+	req.Params.Name = "shell"
+	if action, _ := decide(req); action != "block" {
+		t.Errorf("shell call: got %q, want block", action)
+	}
+
+	req.Params.Name = "read_file"
+	if action, _ := decide(req); action != "allow" {
+		t.Errorf("read_file call: got %q, want allow", action)
+	}
+}
+"#;
+
+const WASM_CARGO: &str = r#"[package]
+name = "{name}"
+version = "0.1.0"
+edition = "2021"
+
+[lib]
+crate-type = ["cdylib"]
+
+[dependencies]
+serde_json = "1"
+
+[profile.release]
+opt-level = "s"
+"#;
+
+const WASM_GITIGNORE: &str = "/.km-dev/
+/target/
+";
+
+const WASM_LIB: &str = r##"//! {name}, a km plugin compiled to WebAssembly. km writes each hook's
+//! input as JSON into this module's memory; see "Wasm plugins" in km's
+//! API_ENDPOINTS.md for the exports and imports.
+
+use serde_json::{json, Value};
+
+/// Reserve `len` bytes for km to write a hook's input into.
+#[no_mangle]
+pub extern "C" fn km_alloc(len: i32) -> i32 {
+    let mut buf = Vec::<u8>::with_capacity(len as usize);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr as i32
+}
+
+/// Where the plugin's checks go: `None` allows the request, `Some(reason)`
+/// blocks it.
+fn decide(message: &Value) -> Option<String> {
+    let tool = message.pointer("/params/name").and_then(Value::as_str);
+    if message["method"] == "tools/call" && tool == Some("shell") {
+        return Some("shell access is not allowed".to_string());
+    }
+    None
+}
+
+#[no_mangle]
+pub extern "C" fn on_request(ptr: i32, len: i32) -> i64 {
+    let input = unsafe { std::slice::from_raw_parts(ptr as *const u8, len as usize) };
+    let Ok(input) = serde_json::from_slice::<Value>(input) else {
+        return 0;
+    };
+    let Some(reason) = decide(&input["message"]) else {
+        return 0;
+    };
+    let reply = json!({"action": "block", "reason": reason}).to_string().into_bytes();
+    let (ptr, len) = (reply.as_ptr() as i64, reply.len() as i64);
+    std::mem::forget(reply);
+    (ptr << 32) | len
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn blocks_shell_calls() {
+        let call = |name: &str| json!({"method": "tools/call", "params": {"name": name}});
+        assert!(decide(&call("shell")).is_some());
+        assert!(decide(&call("read_file")).is_none());
+    }
+}
+"##;
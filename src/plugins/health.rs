@@ -0,0 +1,115 @@
+//! How the plugins of a session are doing. A plugin that crashes, stops
+//! answering or fails a health check is restarted with backoff; its failure
+//! policy decides whether requests flow on without it in the meantime.
+
+use chrono::{DateTime, Utc};
+use clap::ValueEnum;
+use serde::{Deserialize, Serialize};
+use std::time::Duration;
+
+pub const DEFAULT_HEALTH_INTERVAL_SECS: u64 = 10;
+pub const DEFAULT_MAX_RESTARTS: u32 = 5;
+/// Wait before the first restart; doubles with every failure in a row
+const RESTART_BACKOFF_BASE: Duration = Duration::from_secs(1);
+const RESTART_BACKOFF_MAX: Duration = Duration::from_secs(60);
+
+/// What happens to requests while a plugin is down.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum FailurePolicy {
+    /// Requests flow on without the plugin
+    #[default]
+    Open,
+    /// Requests are blocked until the plugin is back
+    Closed,
+}
+
+impl FailurePolicy {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            FailurePolicy::Open => "open",
+            FailurePolicy::Closed => "closed",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum HealthState {
+    Healthy,
+    /// Down, with a restart scheduled
+    Restarting,
+    /// Down for the rest of the session
+    Stopped,
+}
+
+/// One plugin's health, as `km plugins status` shows it.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PluginHealth {
+    pub name: String,
+    pub state: HealthState,
+    pub failure_policy: FailurePolicy,
+    /// Failures since the plugin last answered
+    pub consecutive_failures: u32,
+    pub restarts: u32,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_error: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_check: Option<DateTime<Utc>>,
+    /// When the plugin is started again, while restarting
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub restart_at: Option<DateTime<Utc>>,
+}
+
+impl PluginHealth {
+    pub fn healthy(name: &str) -> Self {
+        Self {
+            name: name.to_string(),
+            state: HealthState::Healthy,
+            failure_policy: FailurePolicy::Open,
+            consecutive_failures: 0,
+            restarts: 0,
+            last_error: None,
+            last_check: None,
+            restart_at: None,
+        }
+    }
+
+    pub fn describe(&self, now: DateTime<Utc>) -> String {
+        let state = match self.state {
+            HealthState::Healthy => "healthy".to_string(),
+            HealthState::Restarting => match self.restart_at {
+                Some(at) => format!("restarting in {}s", (at - now).num_seconds().max(0)),
+                None => "restarting".to_string(),
+            },
+            HealthState::Stopped => "stopped".to_string(),
+        };
+        let mut text = format!(
+            "{}, fail-{}, {} restart(s)",
+            state,
+            self.failure_policy.as_str(),
+            self.restarts
+        );
+        if self.state != HealthState::Healthy {
+            if let Some(ref error) = self.last_error {
+                text.push_str(&format!(": {}", error));
+            }
+        }
+        text
+    }
+}
+
+/// How long to wait before restarting a plugin that has failed
+/// `consecutive_failures` times in a row.
+pub fn restart_delay(consecutive_failures: u32) -> Duration {
+    let doublings = consecutive_failures.saturating_sub(1).min(16);
+    (RESTART_BACKOFF_BASE * 2u32.pow(doublings)).min(RESTART_BACKOFF_MAX)
+}
+
+/// `km plugins status` lines.
+pub fn render(health: &[PluginHealth], now: DateTime<Utc>) -> Vec<String> {
+    health
+        .iter()
+        .map(|plugin| format!("{:<24} {}", plugin.name, plugin.describe(now)))
+        .collect()
+}
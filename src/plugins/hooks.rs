@@ -0,0 +1,103 @@
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+
+/// A `tools/call` request.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ToolCall {
+    pub name: String,
+    #[serde(default)]
+    pub arguments: Map<String, Value>,
+}
+
+/// A `resources/read` request.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ResourceRead {
+    pub uri: String,
+}
+
+/// A `prompts/get` request.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PromptGet {
+    pub name: String,
+    #[serde(default)]
+    pub arguments: Map<String, Value>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SamplingMessage {
+    pub role: String,
+    pub content: Value,
+}
+
+/// A `sampling/createMessage` request from the server.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SamplingRequest {
+    pub messages: Vec<SamplingMessage>,
+    #[serde(
+        default,
+        alias = "systemPrompt",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub system_prompt: Option<String>,
+    #[serde(default, alias = "maxTokens", skip_serializing_if = "Option::is_none")]
+    pub max_tokens: Option<u64>,
+    #[serde(
+        default,
+        alias = "modelPreferences",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub model_preferences: Option<Value>,
+}
+
+/// An MCP message with its params already parsed, for plugins speaking
+/// protocol 2. Serialized as the `call` field of the hook input.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+#[serde(untagged)]
+pub enum TypedHook {
+    ToolCall(ToolCall),
+    ResourceRead(ResourceRead),
+    PromptGet(PromptGet),
+    SamplingRequest(SamplingRequest),
+}
+
+fn params<T: serde::de::DeserializeOwned>(message: &Value) -> Option<T> {
+    serde_json::from_value(message.get("params")?.clone()).ok()
+}
+
+impl TypedHook {
+    /// The typed hook for a client → server message, if it has one. Messages
+    /// whose params don't parse go to `on_request` as usual.
+    pub fn for_request(message: &Value) -> Option<Self> {
+        match message.get("method")?.as_str()? {
+            "tools/call" => params(message).map(TypedHook::ToolCall),
+            "resources/read" => params(message).map(TypedHook::ResourceRead),
+            "prompts/get" => params(message).map(TypedHook::PromptGet),
+            _ => None,
+        }
+    }
+
+    /// The typed hook for a server → client message, if it has one.
+    pub fn for_server_message(message: &Value) -> Option<Self> {
+        match message.get("method")?.as_str()? {
+            "sampling/createMessage" => params(message).map(TypedHook::SamplingRequest),
+            _ => None,
+        }
+    }
+
+    pub fn hook(&self) -> &'static str {
+        match self {
+            TypedHook::ToolCall(_) => "on_tool_call",
+            TypedHook::ResourceRead(_) => "on_resource_read",
+            TypedHook::PromptGet(_) => "on_prompt_get",
+            TypedHook::SamplingRequest(_) => "on_sampling_request",
+        }
+    }
+
+    /// The protocol 1 hook plugins get for this message instead.
+    pub fn fallback(&self) -> &'static str {
+        match self {
+            TypedHook::SamplingRequest(_) => "on_response",
+            _ => "on_request",
+        }
+    }
+}
@@ -0,0 +1,156 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use super::compare_versions;
+use crate::errors::{Code, KmError};
+
+/// One published version of a plugin, as listed by the manifest API.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PluginRelease {
+    pub name: String,
+    pub version: String,
+    #[serde(default)]
+    pub description: String,
+    /// Where to fetch the binary; defaults to the API's download endpoint
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub download_url: Option<String>,
+    /// Hex SHA-256 of the binary
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sha256: Option<String>,
+    /// Base64 Ed25519 signature over the binary
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signature: Option<String>,
+    /// Plugin protocol the release speaks
+    #[serde(default = "super::default_protocol")]
+    pub protocol: u32,
+    /// JSON schema for the plugin's `plugin_config` entry
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub config_schema: Option<Value>,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct PluginManifest {
+    #[serde(default)]
+    pub plugins: Vec<PluginRelease>,
+}
+
+impl PluginManifest {
+    /// The newest release of `name`
+    pub fn latest(&self, name: &str) -> Option<&PluginRelease> {
+        self.plugins
+            .iter()
+            .filter(|release| release.name == name)
+            .max_by(|a, b| compare_versions(&a.version, &b.version))
+    }
+
+    pub fn find(&self, name: &str, version: &str) -> Option<&PluginRelease> {
+        self.plugins.iter().find(|release| {
+            release.name == name
+                && compare_versions(&release.version, version) == std::cmp::Ordering::Equal
+        })
+    }
+
+    /// Latest release of every plugin whose name or description contains
+    /// `query` (case-insensitive), sorted by name.
+    pub fn search(&self, query: &str) -> Vec<&PluginRelease> {
+        let query = query.to_lowercase();
+        let mut names: Vec<&str> = self
+            .plugins
+            .iter()
+            .filter(|release| {
+                release.name.to_lowercase().contains(&query)
+                    || release.description.to_lowercase().contains(&query)
+            })
+            .map(|release| release.name.as_str())
+            .collect();
+        names.sort();
+        names.dedup();
+        names
+            .into_iter()
+            .filter_map(|name| self.latest(name))
+            .collect()
+    }
+}
+
+/// Client for the plugin manifest and download endpoints.
+#[derive(Debug, Clone)]
+pub struct MarketplaceClient {
+    client: reqwest::Client,
+    api_url: String,
+    bearer_token: Option<String>,
+}
+
+impl MarketplaceClient {
+    pub fn new(api_url: String, bearer_token: Option<String>) -> Self {
+        Self {
+            client: crate::http::client(),
+            api_url: api_url.trim_end_matches('/').to_string(),
+            bearer_token,
+        }
+    }
+
+    fn get(&self, url: &str) -> reqwest::RequestBuilder {
+        let request = self.client.get(url);
+        match self.bearer_token {
+            Some(ref token) => request.bearer_auth(token),
+            None => request,
+        }
+    }
+
+    pub async fn fetch_manifest(&self) -> Result<PluginManifest> {
+        crate::offline::ensure_online("The plugin marketplace")?;
+        let url = format!("{}/api/plugins/manifest", self.api_url);
+        let response = self
+            .get(&url)
+            .send()
+            .await
+            .context("Failed to reach the plugin marketplace")?;
+
+        if !response.status().is_success() {
+            let status = response.status();
+            return Err(KmError::new(
+                Code::for_status(status),
+                format!("Plugin manifest request failed with status {}", status),
+            )
+            .into());
+        }
+
+        response
+            .json::<PluginManifest>()
+            .await
+            .context("Failed to parse plugin manifest")
+    }
+
+    pub fn download_url(&self, release: &PluginRelease) -> String {
+        release.download_url.clone().unwrap_or_else(|| {
+            format!(
+                "{}/api/plugins/{}/{}/download",
+                self.api_url, release.name, release.version
+            )
+        })
+    }
+
+    pub async fn download(&self, release: &PluginRelease) -> Result<Vec<u8>> {
+        crate::offline::ensure_online("Downloading plugins")?;
+        let url = self.download_url(release);
+        let response =
+            self.get(&url).send().await.with_context(|| {
+                format!("Failed to download {}@{}", release.name, release.version)
+            })?;
+
+        if !response.status().is_success() {
+            let status = response.status();
+            return Err(KmError::new(
+                Code::for_status(status),
+                format!(
+                    "Download of {}@{} failed with status {}",
+                    release.name, release.version, status
+                ),
+            )
+            .into());
+        }
+
+        Ok(response.bytes().await?.to_vec())
+    }
+}
@@ -0,0 +1,92 @@
+use anyhow::Result;
+use std::cmp::Ordering;
+
+pub mod commands;
+pub mod dev;
+pub mod health;
+pub mod hooks;
+pub mod marketplace;
+pub mod outbox;
+pub mod runtime;
+pub mod sandbox;
+pub mod schema;
+pub mod store;
+pub mod verify;
+#[cfg(feature = "wasm")]
+pub mod wasm;
+
+/// Plugin protocol this km speaks. Version 2 added the typed hooks
+/// (`on_tool_call` and friends), version 3 subcommands (`describe` and
+/// `run_command`), version 4 acknowledged responses, version 5 health
+/// checks; plugins built for version 1 keep getting only `on_request` and
+/// `on_response`.
+pub const PROTOCOL_VERSION: u32 = 5;
+
+/// Plugins published before the protocol was versioned speak version 1.
+fn default_protocol() -> u32 {
+    1
+}
+
+/// Plugin names double as directory names, so keep them to a safe alphabet.
+pub fn validate_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-' || c == '_');
+    if valid {
+        Ok(())
+    } else {
+        Err(anyhow::anyhow!(
+            "Invalid plugin name '{}': use lowercase letters, digits, '-' and '_'",
+            name
+        ))
+    }
+}
+
+/// Split `name@version` into its parts. The version is optional.
+pub fn parse_spec(spec: &str) -> Result<(String, Option<String>)> {
+    let (name, version) = match spec.split_once('@') {
+        Some((name, version)) if !version.is_empty() => (name, Some(version.to_string())),
+        Some(_) => return Err(anyhow::anyhow!("Missing version in '{}'", spec)),
+        None => (spec, None),
+    };
+    validate_name(name)?;
+    Ok((name.to_string(), version))
+}
+
+/// Compare dotted version strings numerically ("1.10.0" > "1.9.2"). A
+/// leading 'v' is ignored, and a pre-release suffix sorts before the release.
+pub fn compare_versions(a: &str, b: &str) -> Ordering {
+    fn split(version: &str) -> (Vec<u64>, Option<&str>) {
+        let version = version.trim().trim_start_matches('v');
+        let (core, pre) = match version.split_once('-') {
+            Some((core, pre)) => (core, Some(pre)),
+            None => (version, None),
+        };
+        let parts = core
+            .split('.')
+            .map(|part| part.parse::<u64>().unwrap_or(0))
+            .collect();
+        (parts, pre)
+    }
+
+    let (a_parts, a_pre) = split(a);
+    let (b_parts, b_pre) = split(b);
+    let len = a_parts.len().max(b_parts.len());
+    for i in 0..len {
+        let ordering = a_parts
+            .get(i)
+            .unwrap_or(&0)
+            .cmp(b_parts.get(i).unwrap_or(&0));
+        if ordering != Ordering::Equal {
+            return ordering;
+        }
+    }
+
+    match (a_pre, b_pre) {
+        (None, None) => Ordering::Equal,
+        (None, Some(_)) => Ordering::Greater,
+        (Some(_), None) => Ordering::Less,
+        (Some(a), Some(b)) => a.cmp(b),
+    }
+}
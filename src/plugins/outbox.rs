@@ -0,0 +1,168 @@
+//! Durable queue of the server messages shown to a plugin that acknowledges
+//! them (protocol 4). Each message is written to disk before it's sent and
+//! stays there until the plugin acknowledges it, so messages a busy plugin
+//! never got to, or that were in flight when it or km stopped, are sent
+//! again when it next runs: at least once, and possibly twice.
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::fs::{self, File};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+pub const DEFAULT_MAX_LAG: u64 = 1000;
+
+/// One line of an outbox.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+enum Record {
+    Message {
+        seq: u64,
+        message: Value,
+    },
+    /// Acknowledged by the plugin, or dropped for lagging too far behind
+    Ack {
+        seq: u64,
+    },
+}
+
+/// A plugin's unacknowledged messages, oldest first, backed by a file in
+/// its plugin directory.
+#[derive(Debug)]
+pub struct Outbox {
+    path: PathBuf,
+    file: File,
+    pending: BTreeMap<u64, Value>,
+    next_seq: u64,
+    /// Messages the plugin may leave unacknowledged before the oldest are
+    /// dropped
+    max_lag: u64,
+    dropped: u64,
+    /// Set after the first failed write, so it's only reported once
+    failed: bool,
+}
+
+impl Outbox {
+    /// Open the outbox at `path`, keeping whatever an earlier run left
+    /// unacknowledged. The file is rewritten with only those.
+    pub fn open(path: &Path, max_lag: u64) -> Result<Self> {
+        let mut pending = BTreeMap::new();
+        let mut next_seq = 1;
+        if let Ok(content) = fs::read_to_string(path) {
+            // A crash can only cut off the last line; skip anything unreadable
+            for record in content
+                .lines()
+                .filter_map(|line| serde_json::from_str::<Record>(line).ok())
+            {
+                match record {
+                    Record::Message { seq, message } => {
+                        next_seq = next_seq.max(seq + 1);
+                        pending.insert(seq, message);
+                    }
+                    Record::Ack { seq } => {
+                        pending.remove(&seq);
+                    }
+                }
+            }
+        }
+
+        let mut compacted = String::new();
+        for (seq, message) in &pending {
+            let record = Record::Message {
+                seq: *seq,
+                message: message.clone(),
+            };
+            compacted.push_str(&serde_json::to_string(&record)?);
+            compacted.push('\n');
+        }
+        let temp = path.with_extension("jsonl.tmp");
+        fs::write(&temp, compacted)
+            .and_then(|_| fs::rename(&temp, path))
+            .with_context(|| format!("Failed to write plugin outbox {:?}", path))?;
+        let file = fs::OpenOptions::new()
+            .append(true)
+            .open(path)
+            .with_context(|| format!("Failed to open plugin outbox {:?}", path))?;
+
+        Ok(Self {
+            path: path.to_path_buf(),
+            file,
+            pending,
+            next_seq,
+            max_lag: max_lag.max(1),
+            dropped: 0,
+            failed: false,
+        })
+    }
+
+    /// Queue `message` and return its sequence number. When the plugin is
+    /// `max_lag` messages behind, the oldest is dropped to make room.
+    pub fn push(&mut self, message: &Value) -> u64 {
+        while self.pending.len() as u64 >= self.max_lag {
+            let Some((seq, _)) = self.pending.pop_first() else {
+                break;
+            };
+            if self.dropped == 0 {
+                tracing::warn!(
+                    "Plugin outbox {:?} is {} messages behind; dropping the oldest",
+                    self.path,
+                    self.max_lag
+                );
+            }
+            self.dropped += 1;
+            self.write(&Record::Ack { seq });
+        }
+        let seq = self.next_seq;
+        self.next_seq += 1;
+        self.write(&Record::Message {
+            seq,
+            message: message.clone(),
+        });
+        self.pending.insert(seq, message.clone());
+        seq
+    }
+
+    /// The plugin acknowledged message `seq`. Acknowledging a message twice,
+    /// or one already dropped, does nothing.
+    pub fn ack(&mut self, seq: u64) {
+        if self.pending.remove(&seq).is_none() {
+            return;
+        }
+        if self.pending.is_empty() {
+            // Nothing left to send again; start the file over
+            if let Err(e) = self.file.set_len(0) {
+                tracing::debug!("Could not truncate plugin outbox {:?}: {}", self.path, e);
+            }
+        } else {
+            self.write(&Record::Ack { seq });
+        }
+    }
+
+    /// Unacknowledged messages, oldest first, with their sequence numbers.
+    pub fn pending(&self) -> Vec<(u64, Value)> {
+        self.pending
+            .iter()
+            .map(|(seq, message)| (*seq, message.clone()))
+            .collect()
+    }
+
+    fn write(&mut self, record: &Record) {
+        let Ok(mut line) = serde_json::to_string(record) else {
+            return;
+        };
+        line.push('\n');
+        // One write per line, so a crash can only cut off the last one
+        if let Err(e) = self.file.write_all(line.as_bytes()) {
+            if !self.failed {
+                self.failed = true;
+                tracing::warn!(
+                    "Could not write to plugin outbox {:?}; messages may not be sent again: {}",
+                    self.path,
+                    e
+                );
+            }
+        }
+    }
+}
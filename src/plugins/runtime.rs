@@ -0,0 +1,1050 @@
+use anyhow::{Context, Result};
+use chrono::Utc;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::io::{BufRead, BufReader, Write};
+use std::process::{Child, ChildStdin, Command, Stdio};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::commands::{CommandOutput, Description, PluginCommand};
+use super::health::{self, FailurePolicy, HealthState, PluginHealth};
+use super::hooks::TypedHook;
+use super::outbox::Outbox;
+use super::sandbox::{self, PluginSandboxConfig};
+use super::store::{InstalledPlugin, PluginRuntime, PluginStore};
+use crate::audit::{DecisionLog, DecisionRecord, DecisionSource, Verdict};
+use crate::entitlements::Entitlements;
+use crate::process::ProcessGuard;
+
+/// How long a plugin may take to list its subcommands
+const DESCRIBE_TIMEOUT: Duration = Duration::from_secs(5);
+/// How long a plugin subcommand may run
+const COMMAND_TIMEOUT: Duration = Duration::from_secs(600);
+/// Plugins from this protocol on acknowledge the server messages they're
+/// shown, and get the unacknowledged ones again
+const ACK_PROTOCOL: u32 = 4;
+/// Plugins from this protocol on answer health checks
+const HEALTH_PROTOCOL: u32 = 5;
+
+/// Annotations plugins attach to a message; stored with the captured event.
+pub type Metadata = BTreeMap<String, Value>;
+
+/// One hook invocation, written to the plugin's stdin as a JSON line.
+#[derive(Debug, Serialize)]
+struct HookCall<'a> {
+    id: u64,
+    hook: &'a str,
+    message: &'a Value,
+    /// The message's params, parsed, for typed hooks
+    #[serde(skip_serializing_if = "Option::is_none")]
+    call: Option<&'a TypedHook>,
+    /// Annotations from plugins earlier in the chain
+    metadata: &'a Metadata,
+}
+
+/// What a plugin decided about a message.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "action", rename_all = "snake_case")]
+pub enum PluginAction {
+    Allow,
+    Block {
+        reason: String,
+    },
+    /// Replace the message; later plugins and the server see the new one
+    Modify {
+        message: Value,
+    },
+}
+
+#[derive(Debug, Clone, PartialEq, Deserialize)]
+pub struct PluginReply {
+    #[serde(flatten)]
+    pub action: PluginAction,
+    #[serde(default)]
+    pub metadata: Metadata,
+}
+
+/// Result of running a message through the plugin chain.
+#[derive(Debug, Clone, PartialEq)]
+pub enum ChainOutcome {
+    Forward {
+        message: Value,
+        metadata: Metadata,
+    },
+    Block {
+        plugin: String,
+        reason: String,
+        metadata: Metadata,
+    },
+}
+
+/// Order plugins for the chain: higher `plugin_priorities` entries run
+/// first, unlisted plugins count as priority 0, ties go by name.
+pub fn sort_by_priority(plugins: &mut [InstalledPlugin], priorities: &BTreeMap<String, i32>) {
+    let priority = |name: &str| priorities.get(name).copied().unwrap_or(0);
+    plugins.sort_by(|a, b| {
+        priority(&b.name)
+            .cmp(&priority(&a.name))
+            .then_with(|| a.name.cmp(&b.name))
+    });
+}
+
+/// A loaded plugin, whatever runs it.
+pub trait PluginInstance: Send + std::fmt::Debug {
+    fn name(&self) -> &str;
+
+    /// Run a hook and wait for the plugin's decision.
+    fn call(&mut self, hook: &str, message: &Value, metadata: &Metadata) -> Result<PluginReply>;
+
+    /// Deliver a hook the plugin can only observe (e.g. `on_response`).
+    fn notify(&mut self, hook: &str, message: &Value, metadata: &Metadata) -> Result<()>;
+
+    /// Run the typed hook for `message`. Plugins that don't take typed hooks
+    /// get the generic one instead.
+    fn call_typed(
+        &mut self,
+        typed: &TypedHook,
+        message: &Value,
+        metadata: &Metadata,
+    ) -> Result<PluginReply> {
+        self.call(typed.fallback(), message, metadata)
+    }
+
+    /// Deliver a typed hook the plugin can only observe.
+    fn notify_typed(
+        &mut self,
+        typed: &TypedHook,
+        message: &Value,
+        metadata: &Metadata,
+    ) -> Result<()> {
+        self.notify(typed.fallback(), message, metadata)
+    }
+
+    /// Ask the plugin something outside the traffic chain (`describe`,
+    /// `run_command`) and return its reply, or `None` if it doesn't handle
+    /// `hook`.
+    fn invoke(&mut self, hook: &str, message: &Value, timeout: Duration) -> Result<Option<Value>> {
+        let _ = (hook, message, timeout);
+        Ok(None)
+    }
+
+    /// Fail if the plugin is no longer able to serve.
+    fn check_health(&mut self) -> Result<()> {
+        Ok(())
+    }
+
+    fn kill(&mut self) {}
+}
+
+/// A running native plugin. Native plugins are long-lived child processes
+/// that answer hook calls over stdin/stdout, one JSON object per line.
+#[derive(Debug)]
+pub struct PluginProcess {
+    name: String,
+    child: Child,
+    /// Kills anything the plugin started when km exits (Windows)
+    _guard: Option<ProcessGuard>,
+    stdin: ChildStdin,
+    replies: Receiver<String>,
+    next_id: u64,
+    call_timeout: Duration,
+    /// Plugin protocol version the plugin speaks
+    protocol: u32,
+    /// Server messages sent but not yet acknowledged (protocol 4)
+    outbox: Option<Outbox>,
+    /// Outbox sequence numbers of the messages sent, by call id
+    unacked: HashMap<u64, u64>,
+    /// Whether what an earlier run left in the outbox has been sent again
+    redelivered: bool,
+}
+
+impl PluginProcess {
+    pub fn spawn(plugin: &InstalledPlugin, config: &PluginSandboxConfig) -> Result<Self> {
+        let plugin_dir = plugin
+            .path
+            .parent()
+            .context("Plugin binary has no parent directory")?;
+        let workdir = plugin_dir.join("work");
+        fs::create_dir_all(&workdir).context("Failed to create plugin workdir")?;
+        let stderr =
+            fs::File::create(workdir.join("plugin.log")).context("Failed to create plugin log")?;
+
+        let mut command = Command::new(&plugin.path);
+        command
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(stderr);
+        sandbox::apply(&mut command, config, plugin_dir, &workdir);
+
+        let mut child = command
+            .spawn()
+            .with_context(|| format!("Failed to start plugin {}", plugin.name))?;
+        let guard = ProcessGuard::attach(&child)
+            .map_err(|e| tracing::warn!("Plugin {} may outlive km: {}", plugin.name, e))
+            .ok();
+        let stdin = child.stdin.take().context("Failed to open plugin stdin")?;
+        let stdout = child
+            .stdout
+            .take()
+            .context("Failed to open plugin stdout")?;
+
+        // Lines are read on a separate thread so calls can time out
+        let (tx, replies) = mpsc::channel();
+        thread::spawn(move || {
+            for line in BufReader::new(stdout).lines() {
+                match line {
+                    Ok(line) => {
+                        if tx.send(line).is_err() {
+                            break;
+                        }
+                    }
+                    Err(_) => break,
+                }
+            }
+        });
+
+        let outbox = if plugin.protocol >= ACK_PROTOCOL {
+            Outbox::open(&plugin_dir.join("outbox.jsonl"), config.max_lag)
+                .map_err(|e| {
+                    tracing::warn!(
+                        "Plugin {} may miss responses if it stops: {:#}",
+                        plugin.name,
+                        e
+                    )
+                })
+                .ok()
+        } else {
+            None
+        };
+
+        Ok(Self {
+            name: plugin.name.clone(),
+            child,
+            _guard: guard,
+            stdin,
+            replies,
+            next_id: 1,
+            call_timeout: config.call_timeout(),
+            protocol: plugin.protocol,
+            outbox,
+            unacked: HashMap::new(),
+            redelivered: false,
+        })
+    }
+
+    fn send(
+        &mut self,
+        hook: &str,
+        message: &Value,
+        call: Option<&TypedHook>,
+        metadata: &Metadata,
+    ) -> Result<u64> {
+        let id = self.next_id;
+        self.next_id += 1;
+
+        let line = serde_json::to_string(&HookCall {
+            id,
+            hook,
+            message,
+            call,
+            metadata,
+        })?;
+        writeln!(self.stdin, "{}", line)
+            .and_then(|_| self.stdin.flush())
+            .with_context(|| format!("Plugin {} is not accepting input", self.name))?;
+        Ok(id)
+    }
+
+    /// Send one hook call and wait up to the call timeout for the reply.
+    fn request(
+        &mut self,
+        hook: &str,
+        message: &Value,
+        call: Option<&TypedHook>,
+        metadata: &Metadata,
+    ) -> Result<PluginReply> {
+        let id = self.send(hook, message, call, metadata)?;
+        let reply = self.reply(id, hook, self.call_timeout)?;
+        serde_json::from_value(reply)
+            .map_err(|e| anyhow::anyhow!("Plugin {} sent an invalid reply: {}", self.name, e))
+    }
+
+    /// Wait up to `timeout` for the reply to call `id`.
+    fn reply(&mut self, id: u64, hook: &str, timeout: Duration) -> Result<Value> {
+        let deadline = Instant::now() + timeout;
+        loop {
+            let remaining = deadline.saturating_duration_since(Instant::now());
+            let line = match self.replies.recv_timeout(remaining) {
+                Ok(line) => line,
+                Err(RecvTimeoutError::Timeout) => {
+                    return Err(anyhow::anyhow!(
+                        "Plugin {} did not answer {} within {:?}",
+                        self.name,
+                        hook,
+                        timeout
+                    ))
+                }
+                Err(RecvTimeoutError::Disconnected) => {
+                    return Err(anyhow::anyhow!("Plugin {} exited", self.name))
+                }
+            };
+
+            let reply: Value = serde_json::from_str(&line).map_err(|e| {
+                anyhow::anyhow!("Plugin {} sent an invalid reply: {}", self.name, e)
+            })?;
+            match reply.get("id").and_then(Value::as_u64) {
+                Some(reply_id) if reply_id == id => return Ok(reply),
+                // Late answer to a call that already timed out, or to a notification
+                Some(reply_id) => self.acknowledged(reply_id),
+                None => {
+                    return Err(anyhow::anyhow!(
+                        "Plugin {} sent an invalid reply: missing id",
+                        self.name
+                    ))
+                }
+            }
+        }
+    }
+}
+
+impl PluginProcess {
+    /// The plugin answered call `id`; if that was a server message, it's
+    /// delivered.
+    fn acknowledged(&mut self, id: u64) {
+        if let Some(seq) = self.unacked.remove(&id) {
+            if let Some(ref mut outbox) = self.outbox {
+                outbox.ack(seq);
+            }
+        }
+    }
+
+    /// Take in the answers that arrived since the last call.
+    fn collect_acks(&mut self) {
+        while let Ok(line) = self.replies.try_recv() {
+            if let Some(id) = serde_json::from_str::<Value>(&line)
+                .ok()
+                .and_then(|reply| reply.get("id").and_then(Value::as_u64))
+            {
+                self.acknowledged(id);
+            }
+        }
+    }
+
+    /// The hook a server → client message goes to, with its parsed params
+    /// when the plugin takes typed hooks.
+    fn response_hook<'a>(
+        &self,
+        typed: Option<&'a TypedHook>,
+    ) -> (&'static str, Option<&'a TypedHook>) {
+        match typed {
+            Some(typed) if self.protocol >= 2 => (typed.hook(), Some(typed)),
+            Some(typed) => (typed.fallback(), None),
+            None => ("on_response", None),
+        }
+    }
+
+    /// Show the plugin a server → client message: queued in the outbox
+    /// until it's acknowledged when the plugin speaks protocol 4, otherwise
+    /// fire and forget.
+    fn show(&mut self, typed: Option<&TypedHook>, message: &Value) -> Result<()> {
+        let (hook, call) = self.response_hook(typed);
+        if self.outbox.is_none() {
+            return self.send(hook, message, call, &Metadata::new()).map(|_| ());
+        }
+        self.redeliver()?;
+        self.collect_acks();
+        let seq = self
+            .outbox
+            .as_mut()
+            .map_or(0, |outbox| outbox.push(message));
+        let id = self.send(hook, message, call, &Metadata::new())?;
+        self.unacked.insert(id, seq);
+        Ok(())
+    }
+
+    /// Send the messages an earlier run left unacknowledged, once, before
+    /// anything new.
+    fn redeliver(&mut self) -> Result<()> {
+        if self.redelivered {
+            return Ok(());
+        }
+        self.redelivered = true;
+        let pending = self
+            .outbox
+            .as_ref()
+            .map(|outbox| outbox.pending())
+            .unwrap_or_default();
+        if !pending.is_empty() {
+            tracing::info!(
+                "Sending {} unacknowledged response(s) to plugin {} again",
+                pending.len(),
+                self.name
+            );
+        }
+        for (seq, message) in pending {
+            let typed = TypedHook::for_server_message(&message);
+            let (hook, call) = self.response_hook(typed.as_ref());
+            let id = self.send(hook, &message, call, &Metadata::new())?;
+            self.unacked.insert(id, seq);
+        }
+        Ok(())
+    }
+}
+
+impl PluginInstance for PluginProcess {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn call(&mut self, hook: &str, message: &Value, metadata: &Metadata) -> Result<PluginReply> {
+        self.request(hook, message, None, metadata)
+    }
+
+    /// Fire and forget: any reply is skipped by the next `call`, or for
+    /// `on_response` at protocol 4, taken as the acknowledgement.
+    fn notify(&mut self, hook: &str, message: &Value, metadata: &Metadata) -> Result<()> {
+        if hook == "on_response" {
+            return self.show(None, message);
+        }
+        self.send(hook, message, None, metadata).map(|_| ())
+    }
+
+    fn call_typed(
+        &mut self,
+        typed: &TypedHook,
+        message: &Value,
+        metadata: &Metadata,
+    ) -> Result<PluginReply> {
+        if self.protocol < 2 {
+            return self.call(typed.fallback(), message, metadata);
+        }
+        self.request(typed.hook(), message, Some(typed), metadata)
+    }
+
+    fn notify_typed(
+        &mut self,
+        typed: &TypedHook,
+        message: &Value,
+        _metadata: &Metadata,
+    ) -> Result<()> {
+        self.show(Some(typed), message)
+    }
+
+    fn invoke(&mut self, hook: &str, message: &Value, timeout: Duration) -> Result<Option<Value>> {
+        if self.protocol < 3 {
+            return Ok(None);
+        }
+        let id = self.send(hook, message, None, &Metadata::new())?;
+        self.reply(id, hook, timeout).map(Some)
+    }
+
+    /// The process must still be running, and from protocol 5 on, answer
+    /// a `health` call with `"status": "serving"` within the call timeout.
+    fn check_health(&mut self) -> Result<()> {
+        if let Ok(Some(status)) = self.child.try_wait() {
+            return Err(anyhow::anyhow!(
+                "Plugin {} exited with {}",
+                self.name,
+                status
+            ));
+        }
+        if self.protocol < HEALTH_PROTOCOL {
+            return Ok(());
+        }
+        let id = self.send("health", &Value::Null, None, &Metadata::new())?;
+        let reply = self.reply(id, "health", self.call_timeout)?;
+        match reply.get("status").and_then(Value::as_str) {
+            Some("serving") => Ok(()),
+            status => Err(anyhow::anyhow!(
+                "Plugin {} reports it is {}",
+                self.name,
+                status.unwrap_or("not serving")
+            )),
+        }
+    }
+
+    fn kill(&mut self) {
+        // Acknowledgements already sent count; the rest are sent again
+        self.collect_acks();
+        let _ = self.child.kill();
+        let _ = self.child.wait();
+    }
+}
+
+impl Drop for PluginProcess {
+    fn drop(&mut self) {
+        self.kill();
+    }
+}
+
+/// The plugins loaded for a monitor session. A plugin that fails, times out
+/// or fails a health check is restarted with backoff, up to
+/// `plugin_sandbox.max_restarts` times in a row. While it's down, traffic
+/// flows on without it, or with a `closed` failure policy, requests are
+/// blocked, so a broken plugin can never stall the MCP connection.
+#[derive(Debug, Default)]
+pub struct PluginHost {
+    chain: Mutex<Chain>,
+    /// Each plugin's decision on each request is logged here
+    decisions: Option<Arc<DecisionLog>>,
+}
+
+#[derive(Debug, Default)]
+struct Chain {
+    slots: Vec<Slot>,
+    /// Sent to plugins again when they're restarted
+    session_start: Option<Value>,
+}
+
+/// One plugin in the chain, running or down.
+#[derive(Debug)]
+struct Slot {
+    instance: Option<Box<dyn PluginInstance>>,
+    /// How to start the plugin again; plugins handed to `PluginHost::new`
+    /// aren't restarted
+    source: Option<Source>,
+    health: PluginHealth,
+}
+
+#[derive(Debug)]
+struct Source {
+    plugin: InstalledPlugin,
+    config: PluginSandboxConfig,
+    settings: Value,
+}
+
+impl Slot {
+    fn running(instance: Box<dyn PluginInstance>, source: Option<Source>) -> Self {
+        let health = PluginHealth::healthy(instance.name());
+        Self {
+            instance: Some(instance),
+            source,
+            health,
+        }
+    }
+
+    fn name(&self) -> &str {
+        &self.health.name
+    }
+
+    /// The plugin failed: stop it, and schedule a restart unless it has
+    /// failed too often in a row.
+    fn failed(&mut self, error: &anyhow::Error) {
+        if let Some(mut instance) = self.instance.take() {
+            instance.kill();
+        }
+        self.health.consecutive_failures += 1;
+        self.health.last_error = Some(format!("{:#}", error));
+        let max_restarts = self.source.as_ref().map_or(0, |s| s.config.max_restarts);
+        if self.health.consecutive_failures > max_restarts {
+            tracing::warn!("{:#}; disabling it for this session", error);
+            self.health.state = HealthState::Stopped;
+            self.health.restart_at = None;
+            return;
+        }
+        let delay = health::restart_delay(self.health.consecutive_failures);
+        tracing::warn!("{:#}; restarting it in {:?}", error, delay);
+        self.health.state = HealthState::Restarting;
+        self.health.restart_at = chrono::Duration::from_std(delay)
+            .ok()
+            .map(|delay| Utc::now() + delay);
+    }
+
+    /// Run a request hook, or return `None` if the plugin failed it.
+    fn request(
+        &mut self,
+        typed: Option<&TypedHook>,
+        message: &Value,
+        metadata: &Metadata,
+    ) -> Option<PluginReply> {
+        let plugin = self.instance.as_mut()?;
+        let reply = match typed {
+            Some(typed) => plugin.call_typed(typed, message, metadata),
+            None => plugin.call("on_request", message, metadata),
+        };
+        match reply {
+            Ok(reply) => {
+                self.answered();
+                Some(reply)
+            }
+            Err(e) => {
+                self.failed(&e);
+                None
+            }
+        }
+    }
+
+    /// The plugin answered; it starts over with a full set of restarts.
+    fn answered(&mut self) {
+        self.health.consecutive_failures = 0;
+    }
+
+    /// Whether the plugin is running, restarting it first if it's down and
+    /// its restart is due.
+    fn revive(&mut self, session_start: Option<&Value>) -> bool {
+        if self.instance.is_some() {
+            return true;
+        }
+        let due = self.health.state == HealthState::Restarting
+            && self.health.restart_at.map_or(true, |at| at <= Utc::now());
+        let Some(source) = self.source.as_ref().filter(|_| due) else {
+            return false;
+        };
+        let started =
+            start(&source.plugin, &source.config, &source.settings).and_then(|mut instance| {
+                if let Some(message) = session_start {
+                    instance.notify("on_session_start", message, &Metadata::new())?;
+                }
+                Ok(instance)
+            });
+        match started {
+            Ok(instance) => {
+                tracing::info!("Restarted plugin {}", self.name());
+                self.instance = Some(instance);
+                self.health.state = HealthState::Healthy;
+                self.health.restart_at = None;
+                self.health.restarts += 1;
+                true
+            }
+            Err(e) => {
+                self.failed(&e.context(format!("Plugin {} did not restart", self.name())));
+                false
+            }
+        }
+    }
+}
+
+/// Load one installed plugin with the runtime its binary needs.
+fn load(
+    plugin: &InstalledPlugin,
+    config: &PluginSandboxConfig,
+    settings: &Value,
+) -> Result<Box<dyn PluginInstance>> {
+    plugin.check_integrity()?;
+    match plugin.runtime {
+        PluginRuntime::Native => Ok(Box::new(PluginProcess::spawn(plugin, config)?)),
+        #[cfg(feature = "wasm")]
+        PluginRuntime::Wasm => Ok(Box::new(super::wasm::WasmPlugin::load(
+            plugin, config, settings,
+        )?)),
+        #[cfg(not(feature = "wasm"))]
+        PluginRuntime::Wasm => {
+            let _ = settings;
+            Err(anyhow::anyhow!(
+                "Wasm plugins are not available in this build. Rebuild km with `--features wasm`"
+            ))
+        }
+    }
+}
+
+/// Load a plugin and, when it declares a settings schema, hand it its
+/// settings.
+fn start(
+    plugin: &InstalledPlugin,
+    config: &PluginSandboxConfig,
+    settings: &Value,
+) -> Result<Box<dyn PluginInstance>> {
+    let mut instance = load(plugin, config, settings)?;
+    if plugin.config_schema.is_some() {
+        if let Err(e) = configure(instance.as_mut(), settings) {
+            instance.kill();
+            return Err(e);
+        }
+    }
+    Ok(instance)
+}
+
+/// Hand a plugin that declares a settings schema its settings before any
+/// traffic. It may refuse them by blocking.
+fn configure(plugin: &mut dyn PluginInstance, settings: &Value) -> Result<()> {
+    let settings = match settings {
+        Value::Null => Value::Object(Default::default()),
+        settings => settings.clone(),
+    };
+    match plugin
+        .call("configure", &settings, &Metadata::new())?
+        .action
+    {
+        PluginAction::Block { reason } => {
+            Err(anyhow::anyhow!("it refused its plugin_config: {}", reason))
+        }
+        _ => Ok(()),
+    }
+}
+
+impl PluginHost {
+    pub fn new(plugins: Vec<Box<dyn PluginInstance>>) -> Self {
+        Self {
+            chain: Mutex::new(Chain {
+                slots: plugins
+                    .into_iter()
+                    .map(|plugin| Slot::running(plugin, None))
+                    .collect(),
+                session_start: None,
+            }),
+            decisions: None,
+        }
+    }
+
+    /// Start every installed plugin that passes the integrity and signature
+    /// checks, in chain order. Plugins that can't be started are skipped with
+    /// a warning, and kept in the chain as stopped so a `closed` failure
+    /// policy still holds.
+    pub fn start(
+        store: &PluginStore,
+        config: &PluginSandboxConfig,
+        allow_unsigned: bool,
+        priorities: &BTreeMap<String, i32>,
+        settings: &BTreeMap<String, Value>,
+    ) -> Result<Self> {
+        let mut installed = store.installed()?;
+        sort_by_priority(&mut installed, priorities);
+
+        let mut slots = Vec::new();
+        for plugin in installed {
+            let plugin_settings = settings.get(&plugin.name).cloned().unwrap_or(Value::Null);
+            let started = if !plugin.signed && !allow_unsigned {
+                Err(anyhow::anyhow!(
+                    "it is unsigned (set allow_unsigned_plugins to run it)"
+                ))
+            } else {
+                let problems = plugin.check_settings(&plugin_settings);
+                match problems.is_empty() {
+                    true => start(&plugin, config, &plugin_settings),
+                    false => Err(anyhow::anyhow!(
+                        "invalid plugin_config: {}",
+                        problems.join("; ")
+                    )),
+                }
+            };
+            let source = Source {
+                plugin,
+                config: config.clone(),
+                settings: plugin_settings,
+            };
+            match started {
+                Ok(instance) => {
+                    tracing::info!(
+                        "Loaded plugin {} {}",
+                        source.plugin.name,
+                        source.plugin.version
+                    );
+                    slots.push(Slot::running(instance, Some(source)));
+                }
+                Err(e) => {
+                    tracing::warn!("Not loading plugin {}: {:#}", source.plugin.name, e);
+                    let mut health = PluginHealth::healthy(&source.plugin.name);
+                    health.state = HealthState::Stopped;
+                    health.last_error = Some(format!("{:#}", e));
+                    slots.push(Slot {
+                        instance: None,
+                        source: Some(source),
+                        health,
+                    });
+                }
+            }
+        }
+        Ok(Self {
+            chain: Mutex::new(Chain {
+                slots,
+                session_start: None,
+            }),
+            decisions: None,
+        })
+    }
+
+    /// Apply the `plugin_failure_policies` entries; plugins without one
+    /// fail open.
+    pub fn with_failure_policies(self, policies: &BTreeMap<String, FailurePolicy>) -> Self {
+        {
+            let mut chain = self.lock();
+            for slot in chain.slots.iter_mut() {
+                slot.health.failure_policy = policies.get(slot.name()).copied().unwrap_or_default();
+            }
+        }
+        self
+    }
+
+    /// Log every plugin's decision on every request to `decisions`; kept
+    /// when the plugins are replaced.
+    pub fn with_decision_log(mut self, decisions: Arc<DecisionLog>) -> Self {
+        self.decisions = Some(decisions);
+        self
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, Chain> {
+        match self.chain.lock() {
+            Ok(chain) => chain,
+            Err(poisoned) => poisoned.into_inner(),
+        }
+    }
+
+    /// Whether no plugin is running.
+    pub fn is_empty(&self) -> bool {
+        self.lock().slots.iter().all(|slot| slot.instance.is_none())
+    }
+
+    /// Names of the running plugins, in chain order.
+    pub fn names(&self) -> Vec<String> {
+        self.lock()
+            .slots
+            .iter()
+            .filter(|slot| slot.instance.is_some())
+            .map(|slot| slot.name().to_string())
+            .collect()
+    }
+
+    /// Health of every plugin in the chain, running or not, in chain order.
+    pub fn health(&self) -> Vec<PluginHealth> {
+        self.lock()
+            .slots
+            .iter()
+            .map(|slot| slot.health.clone())
+            .collect()
+    }
+
+    /// Swap in the plugins of `other`, stopping the current ones.
+    pub fn replace(&self, other: PluginHost) {
+        let incoming = other.chain.into_inner().unwrap_or_else(|p| p.into_inner());
+        let outgoing = std::mem::replace(&mut *self.lock(), incoming);
+        // Stopped outside the lock so traffic isn't held up
+        for slot in outgoing.slots {
+            if let Some(mut plugin) = slot.instance {
+                plugin.kill();
+            }
+        }
+    }
+
+    /// Check on every running plugin, and restart those whose restart is
+    /// due.
+    pub fn check_health(&self) {
+        let mut chain = self.lock();
+        let chain = &mut *chain;
+        for slot in chain.slots.iter_mut() {
+            let result = match slot.instance {
+                Some(ref mut instance) => instance.check_health(),
+                None => {
+                    slot.revive(chain.session_start.as_ref());
+                    continue;
+                }
+            };
+            slot.health.last_check = Some(Utc::now());
+            match result {
+                Ok(()) => slot.answered(),
+                Err(e) => slot.failed(&e),
+            }
+        }
+    }
+
+    /// Check the plugins every `interval` on a background thread, for as
+    /// long as the host is in use.
+    pub fn watch(host: &Arc<Self>, interval: Duration) {
+        let host = Arc::downgrade(host);
+        thread::spawn(move || loop {
+            thread::sleep(interval);
+            match host.upgrade() {
+                Some(host) => host.check_health(),
+                None => break,
+            }
+        });
+    }
+
+    /// Pass a client → server message through the chain. Each plugin sees
+    /// the message as left by the plugins before it; the first block stops
+    /// the chain, as does a plugin that is down with a `closed` failure
+    /// policy.
+    pub fn on_request(&self, message: &Value) -> ChainOutcome {
+        let mut chain = self.lock();
+        let chain = &mut *chain;
+
+        let mut message = message.clone();
+        let mut typed = TypedHook::for_request(&message);
+        let mut metadata = Metadata::new();
+        let mut blocked = None;
+        for slot in chain.slots.iter_mut() {
+            let reply = match slot.revive(chain.session_start.as_ref()) {
+                true => slot.request(typed.as_ref(), &message, &metadata),
+                false => None,
+            };
+            let Some(reply) = reply else {
+                let reason = format!("plugin {} is unavailable", slot.name());
+                if slot.health.failure_policy == FailurePolicy::Closed {
+                    self.decided(&message, slot.name(), Verdict::Block, Some(&reason));
+                    blocked = Some((slot.name().to_string(), reason));
+                    break;
+                }
+                let reason = format!("{}; failing open", reason);
+                self.decided(&message, slot.name(), Verdict::Allow, Some(&reason));
+                continue;
+            };
+            metadata.extend(reply.metadata);
+            match reply.action {
+                PluginAction::Allow => self.decided(&message, slot.name(), Verdict::Allow, None),
+                PluginAction::Modify { message: modified } => {
+                    self.decided(&message, slot.name(), Verdict::Modify, None);
+                    typed = TypedHook::for_request(&modified);
+                    message = modified;
+                }
+                PluginAction::Block { reason } => {
+                    self.decided(&message, slot.name(), Verdict::Block, Some(&reason));
+                    blocked = Some((slot.name().to_string(), reason));
+                    break;
+                }
+            }
+        }
+
+        match blocked {
+            Some((plugin, reason)) => ChainOutcome::Block {
+                plugin,
+                reason,
+                metadata,
+            },
+            None => ChainOutcome::Forward { message, metadata },
+        }
+    }
+
+    fn decided(&self, message: &Value, plugin: &str, action: Verdict, reason: Option<&str>) {
+        if let Some(ref decisions) = self.decisions {
+            let mut record = DecisionRecord::about(message, DecisionSource::Plugin, plugin, action);
+            record.reason = reason.map(String::from);
+            decisions.record(record);
+        }
+    }
+
+    /// Subcommands the plugins add to km, in chain order. When two plugins
+    /// offer the same name, the one earlier in the chain keeps it.
+    pub fn commands(&self) -> Vec<PluginCommand> {
+        let mut chain = self.lock();
+        let mut commands: Vec<PluginCommand> = Vec::new();
+        for plugin in chain.slots.iter_mut().filter_map(|s| s.instance.as_mut()) {
+            let reply = plugin.invoke("describe", &Value::Null, DESCRIBE_TIMEOUT);
+            let description = match reply.map(|r| r.map(serde_json::from_value::<Description>)) {
+                Ok(Some(Ok(description))) => description,
+                Ok(None) => continue,
+                Ok(Some(Err(e))) => {
+                    tracing::warn!(
+                        "Plugin {} sent an invalid description: {}",
+                        plugin.name(),
+                        e
+                    );
+                    continue;
+                }
+                Err(e) => {
+                    tracing::warn!("{:#}", e);
+                    continue;
+                }
+            };
+            for mut command in description.commands {
+                if let Some(taken) = commands.iter().find(|c| c.name == command.name) {
+                    tracing::warn!(
+                        "Plugin {} also provides `km {}`; using the one from {}",
+                        plugin.name(),
+                        command.name,
+                        taken.plugin
+                    );
+                    continue;
+                }
+                command.plugin = plugin.name().to_string();
+                commands.push(command);
+            }
+        }
+        commands
+    }
+
+    /// Run `km <name> <args>` in the plugin that provides `name`, or return
+    /// `None` if none does.
+    pub fn run_command(&self, name: &str, args: &[String]) -> Result<Option<CommandOutput>> {
+        let Some(command) = self.commands().into_iter().find(|c| c.name == name) else {
+            return Ok(None);
+        };
+        let mut chain = self.lock();
+        let plugin = chain
+            .slots
+            .iter_mut()
+            .filter_map(|s| s.instance.as_mut())
+            .find(|p| p.name() == command.plugin)
+            .context("Plugin stopped")?;
+        let message = serde_json::json!({"command": name, "args": args});
+        let reply = plugin
+            .invoke("run_command", &message, COMMAND_TIMEOUT)?
+            .with_context(|| format!("Plugin {} did not run `km {}`", command.plugin, name))?;
+        serde_json::from_value(reply)
+            .with_context(|| format!("Plugin {} sent an invalid command result", command.plugin))
+            .map(Some)
+    }
+
+    /// Tell every plugin a monitor session is starting, with the session id,
+    /// its labels and the features the account's plan includes, signed by
+    /// the API when it signs them. Plugins that don't handle
+    /// `on_session_start` ignore it.
+    pub fn on_session_start(
+        &self,
+        session_id: &str,
+        labels: &BTreeMap<String, String>,
+        entitlements: &Entitlements,
+    ) {
+        let message = serde_json::json!({
+            "session_id": session_id,
+            "labels": labels,
+            "tier": entitlements.tier,
+            "features": entitlements.features,
+            "entitlement_token": entitlements.token,
+        });
+        self.lock().session_start = Some(message.clone());
+        self.broadcast(|plugin, metadata| plugin.notify("on_session_start", &message, metadata));
+    }
+
+    /// Tell every plugin the account's plan changed during the session, so
+    /// premium plugins can switch features off (or on). Plugins restarted
+    /// later are told the new plan in `on_session_start`.
+    pub fn on_entitlements_changed(&self, entitlements: &Entitlements) {
+        let message = serde_json::json!({
+            "tier": entitlements.tier,
+            "features": entitlements.features,
+            "entitlement_token": entitlements.token,
+        });
+        if let Some(Value::Object(start)) = self.lock().session_start.as_mut() {
+            for (key, value) in message.as_object().into_iter().flatten() {
+                start.insert(key.clone(), value.clone());
+            }
+        }
+        self.broadcast(|plugin, metadata| {
+            plugin.notify("on_entitlements_changed", &message, metadata)
+        });
+    }
+
+    /// Show a server → client message to every plugin. Plugins can't change
+    /// or block responses, so nothing waits for them. Sampling requests go
+    /// to `on_sampling_request` for plugins that take typed hooks.
+    pub fn on_response(&self, message: &Value) {
+        match TypedHook::for_server_message(message) {
+            Some(typed) => {
+                self.broadcast(|plugin, metadata| plugin.notify_typed(&typed, message, metadata))
+            }
+            None => {
+                self.broadcast(|plugin, metadata| plugin.notify("on_response", message, metadata))
+            }
+        }
+    }
+
+    fn broadcast<F>(&self, mut notify: F)
+    where
+        F: FnMut(&mut Box<dyn PluginInstance>, &Metadata) -> Result<()>,
+    {
+        let mut chain = self.lock();
+        let metadata = Metadata::new();
+        for slot in chain.slots.iter_mut() {
+            let Some(ref mut plugin) = slot.instance else {
+                continue;
+            };
+            if let Err(e) = notify(plugin, &metadata) {
+                slot.failed(&e);
+            }
+        }
+    }
+}
@@ -0,0 +1,320 @@
+use serde::{Deserialize, Serialize};
+use std::path::Path;
+use std::process::Command;
+use std::time::Duration;
+
+use super::health::{DEFAULT_HEALTH_INTERVAL_SECS, DEFAULT_MAX_RESTARTS};
+use super::outbox::DEFAULT_MAX_LAG;
+
+pub const DEFAULT_CALL_TIMEOUT_MS: u64 = 1000;
+pub const DEFAULT_WASM_FUEL: u64 = 50_000_000;
+
+/// Limits applied to every plugin. Wasm plugins run in-process, so only
+/// `memory_mb` and `wasm_fuel` apply to them.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PluginSandboxConfig {
+    /// How long a plugin may take to answer one hook call before the message
+    /// is forwarded without it and the plugin is stopped
+    #[serde(default = "default_call_timeout_ms")]
+    pub call_timeout_ms: u64,
+    /// CPU time limit for the plugin process, in seconds (unix only)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cpu_seconds: Option<u64>,
+    /// Address space limit for the plugin process, in MiB (unix only)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub memory_mb: Option<u64>,
+    /// Confine filesystem access to the plugin's own directory plus
+    /// read-only system paths (Linux with Landlock only)
+    #[serde(default = "default_true")]
+    pub restrict_filesystem: bool,
+    /// Instructions a wasm plugin may execute per hook call
+    #[serde(default = "default_wasm_fuel")]
+    pub wasm_fuel: u64,
+    /// Server messages a protocol 4 plugin may leave unacknowledged before
+    /// the oldest are dropped
+    #[serde(default = "default_max_lag")]
+    pub max_lag: u64,
+    /// Seconds between health checks of running plugins; 0 turns them off
+    #[serde(default = "default_health_interval_secs")]
+    pub health_interval_secs: u64,
+    /// Restarts in a row before a failing plugin is left stopped for the
+    /// session; 0 never restarts
+    #[serde(default = "default_max_restarts")]
+    pub max_restarts: u32,
+}
+
+fn default_call_timeout_ms() -> u64 {
+    DEFAULT_CALL_TIMEOUT_MS
+}
+
+fn default_wasm_fuel() -> u64 {
+    DEFAULT_WASM_FUEL
+}
+
+fn default_max_lag() -> u64 {
+    DEFAULT_MAX_LAG
+}
+
+fn default_health_interval_secs() -> u64 {
+    DEFAULT_HEALTH_INTERVAL_SECS
+}
+
+fn default_max_restarts() -> u32 {
+    DEFAULT_MAX_RESTARTS
+}
+
+fn default_true() -> bool {
+    true
+}
+
+impl Default for PluginSandboxConfig {
+    fn default() -> Self {
+        Self {
+            call_timeout_ms: DEFAULT_CALL_TIMEOUT_MS,
+            cpu_seconds: None,
+            memory_mb: None,
+            restrict_filesystem: true,
+            wasm_fuel: DEFAULT_WASM_FUEL,
+            max_lag: DEFAULT_MAX_LAG,
+            health_interval_secs: DEFAULT_HEALTH_INTERVAL_SECS,
+            max_restarts: DEFAULT_MAX_RESTARTS,
+        }
+    }
+}
+
+impl PluginSandboxConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn call_timeout(&self) -> Duration {
+        Duration::from_millis(self.call_timeout_ms)
+    }
+
+    /// How often to check on running plugins, if at all.
+    pub fn health_interval(&self) -> Option<Duration> {
+        (self.health_interval_secs > 0).then(|| Duration::from_secs(self.health_interval_secs))
+    }
+}
+
+/// Environment variables passed through to plugins; everything else
+/// (API keys, tokens) is withheld.
+const PASSTHROUGH_ENV: &[&str] = &["PATH", "LANG", "LC_ALL", "TZ", "SYSTEMROOT"];
+
+/// Prepare `command` to run inside the sandbox: a scrubbed environment,
+/// `workdir` as working, home, app data and temp directory, and on unix the
+/// configured resource limits. `plugin_dir` stays readable so the plugin can
+/// load files shipped next to its binary.
+pub fn apply(
+    command: &mut Command,
+    config: &PluginSandboxConfig,
+    plugin_dir: &Path,
+    workdir: &Path,
+) {
+    command.env_clear();
+    for name in PASSTHROUGH_ENV {
+        if let Ok(value) = std::env::var(name) {
+            command.env(name, value);
+        }
+    }
+    command
+        .env("HOME", workdir)
+        .env("TMPDIR", workdir)
+        .env("TEMP", workdir)
+        .env("TMP", workdir)
+        .current_dir(workdir);
+    // Windows programs find their home and app data through these instead
+    #[cfg(windows)]
+    command
+        .env("USERPROFILE", workdir)
+        .env("APPDATA", workdir)
+        .env("LOCALAPPDATA", workdir);
+
+    #[cfg(unix)]
+    unix::apply(command, config, plugin_dir, workdir);
+
+    #[cfg(not(unix))]
+    let _ = (config, plugin_dir);
+}
+
+#[cfg(unix)]
+mod unix {
+    use super::PluginSandboxConfig;
+    use std::path::Path;
+    use std::process::Command;
+
+    pub fn apply(
+        command: &mut Command,
+        config: &PluginSandboxConfig,
+        plugin_dir: &Path,
+        workdir: &Path,
+    ) {
+        use std::os::unix::process::CommandExt;
+
+        let cpu_seconds = config.cpu_seconds;
+        let memory_bytes = config.memory_mb.map(|mb| mb.saturating_mul(1024 * 1024));
+
+        #[cfg(target_os = "linux")]
+        let ruleset = if config.restrict_filesystem {
+            super::landlock::Ruleset::prepare(plugin_dir, workdir)
+        } else {
+            None
+        };
+        #[cfg(not(target_os = "linux"))]
+        let _ = (plugin_dir, workdir);
+
+        // Runs in the forked child before exec: only async-signal-safe calls
+        unsafe {
+            command.pre_exec(move || {
+                if let Some(seconds) = cpu_seconds {
+                    set_limit(libc::RLIMIT_CPU, seconds)?;
+                }
+                if let Some(bytes) = memory_bytes {
+                    set_limit(libc::RLIMIT_AS, bytes)?;
+                }
+                #[cfg(target_os = "linux")]
+                if let Some(ref ruleset) = ruleset {
+                    ruleset.restrict_self()?;
+                }
+                Ok(())
+            });
+        }
+    }
+
+    #[cfg(all(target_os = "linux", target_env = "gnu"))]
+    type Resource = libc::__rlimit_resource_t;
+    #[cfg(not(all(target_os = "linux", target_env = "gnu")))]
+    type Resource = libc::c_int;
+
+    fn set_limit(resource: Resource, value: u64) -> std::io::Result<()> {
+        let limit = libc::rlimit {
+            rlim_cur: value as libc::rlim_t,
+            rlim_max: value as libc::rlim_t,
+        };
+        if unsafe { libc::setrlimit(resource, &limit) } != 0 {
+            return Err(std::io::Error::last_os_error());
+        }
+        Ok(())
+    }
+}
+
+/// Minimal Landlock (ABI v1) support: the child may only touch the plugin
+/// directory (read/execute), its workdir (read/write) and system paths
+/// needed to run at all (read/execute).
+#[cfg(target_os = "linux")]
+mod landlock {
+    use std::ffi::CString;
+    use std::os::unix::ffi::OsStrExt;
+    use std::path::Path;
+
+    const CREATE_RULESET_VERSION: u32 = 1;
+    const RULE_PATH_BENEATH: u32 = 1;
+
+    const ACCESS_EXECUTE: u64 = 1 << 0;
+    const ACCESS_WRITE_FILE: u64 = 1 << 1;
+    const ACCESS_READ_FILE: u64 = 1 << 2;
+    const ACCESS_READ_DIR: u64 = 1 << 3;
+    /// Every filesystem right known to ABI v1
+    const ACCESS_ALL: u64 = (1 << 13) - 1;
+    const ACCESS_READ: u64 = ACCESS_EXECUTE | ACCESS_READ_FILE | ACCESS_READ_DIR;
+
+    const SYSTEM_PATHS: &[&str] = &["/usr", "/lib", "/lib64", "/bin", "/sbin", "/etc", "/proc"];
+
+    #[repr(C)]
+    struct RulesetAttr {
+        handled_access_fs: u64,
+    }
+
+    #[repr(C, packed)]
+    struct PathBeneathAttr {
+        allowed_access: u64,
+        parent_fd: i32,
+    }
+
+    pub struct Ruleset {
+        rules: Vec<(CString, u64)>,
+    }
+
+    impl Ruleset {
+        /// `None` when the kernel has no Landlock support.
+        pub fn prepare(plugin_dir: &Path, workdir: &Path) -> Option<Self> {
+            let abi = unsafe {
+                libc::syscall(
+                    libc::SYS_landlock_create_ruleset,
+                    std::ptr::null::<RulesetAttr>(),
+                    0usize,
+                    CREATE_RULESET_VERSION,
+                )
+            };
+            if abi < 1 {
+                tracing::warn!(
+                    "Landlock is not available; plugin filesystem access is not restricted"
+                );
+                return None;
+            }
+
+            let path = |p: &Path| CString::new(p.as_os_str().as_bytes()).ok();
+            let mut rules: Vec<(CString, u64)> = SYSTEM_PATHS
+                .iter()
+                .filter(|p| Path::new(p).exists())
+                .filter_map(|p| path(Path::new(p)).map(|p| (p, ACCESS_READ)))
+                .collect();
+            rules.extend(path(Path::new("/dev")).map(|p| (p, ACCESS_READ | ACCESS_WRITE_FILE)));
+            rules.extend(path(plugin_dir).map(|p| (p, ACCESS_READ)));
+            rules.extend(path(workdir).map(|p| (p, ACCESS_ALL)));
+            Some(Self { rules })
+        }
+
+        /// Called between fork and exec.
+        pub fn restrict_self(&self) -> std::io::Result<()> {
+            let attr = RulesetAttr {
+                handled_access_fs: ACCESS_ALL,
+            };
+            let fd = unsafe {
+                libc::syscall(
+                    libc::SYS_landlock_create_ruleset,
+                    &attr as *const RulesetAttr,
+                    std::mem::size_of::<RulesetAttr>(),
+                    0u32,
+                )
+            };
+            if fd < 0 {
+                return Err(std::io::Error::last_os_error());
+            }
+            let fd = fd as i32;
+
+            for (path, access) in &self.rules {
+                let parent_fd =
+                    unsafe { libc::open(path.as_ptr(), libc::O_PATH | libc::O_CLOEXEC) };
+                if parent_fd < 0 {
+                    continue;
+                }
+                let rule = PathBeneathAttr {
+                    allowed_access: *access,
+                    parent_fd,
+                };
+                unsafe {
+                    libc::syscall(
+                        libc::SYS_landlock_add_rule,
+                        fd,
+                        RULE_PATH_BENEATH,
+                        &rule as *const PathBeneathAttr,
+                        0u32,
+                    );
+                    libc::close(parent_fd);
+                }
+            }
+
+            let restricted = unsafe {
+                libc::prctl(libc::PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) == 0
+                    && libc::syscall(libc::SYS_landlock_restrict_self, fd, 0u32) == 0
+            };
+            let error = std::io::Error::last_os_error();
+            unsafe { libc::close(fd) };
+            if !restricted {
+                return Err(error);
+            }
+            Ok(())
+        }
+    }
+}
@@ -0,0 +1,164 @@
+use serde_json::Value;
+
+/// Check `value` against the part of JSON Schema plugins describe their
+/// settings with: `type`, `enum`, `const`, `properties`, `required`,
+/// `additionalProperties`, `items`, `minimum`, `maximum`, `minLength`,
+/// `maxLength` and `pattern`, plus `$ref` to the whole schema and `oneOf`
+/// variants told apart by a `const` property (as the config schema uses
+/// them). Other keywords are ignored. Returns one problem per violation,
+/// prefixed with the path of the setting.
+pub fn validate(schema: &Value, value: &Value) -> Vec<String> {
+    let mut problems = Vec::new();
+    check(schema, schema, value, "", &mut problems);
+    problems
+}
+
+fn type_name(value: &Value) -> &'static str {
+    match value {
+        Value::Null => "null",
+        Value::Bool(_) => "boolean",
+        Value::Number(n) if n.is_i64() || n.is_u64() => "integer",
+        Value::Number(_) => "number",
+        Value::String(_) => "string",
+        Value::Array(_) => "array",
+        Value::Object(_) => "object",
+    }
+}
+
+fn has_type(value: &Value, expected: &str) -> bool {
+    match (expected, value) {
+        ("number", Value::Number(_)) => true,
+        ("integer", Value::Number(n)) => n.as_f64().is_some_and(|n| n.fract() == 0.0),
+        _ => type_name(value) == expected,
+    }
+}
+
+fn join(path: &str, key: &str) -> String {
+    match path {
+        "" => key.to_string(),
+        _ => format!("{}.{}", path, key),
+    }
+}
+
+fn check(root: &Value, schema: &Value, value: &Value, path: &str, problems: &mut Vec<String>) {
+    if schema.get("$ref").and_then(Value::as_str) == Some("#") {
+        return check(root, root, value, path, problems);
+    }
+    let mut problem = |message: String| match path {
+        "" => problems.push(message),
+        _ => problems.push(format!("{}: {}", path, message)),
+    };
+    // `true` and `{}` accept anything
+    let Some(schema) = schema.as_object() else {
+        return;
+    };
+
+    let types: Vec<&str> = match schema.get("type") {
+        Some(Value::String(expected)) => vec![expected.as_str()],
+        Some(Value::Array(expected)) => expected.iter().filter_map(Value::as_str).collect(),
+        _ => Vec::new(),
+    };
+    if !types.is_empty() && !types.iter().any(|t| has_type(value, t)) {
+        problem(format!(
+            "expected {}, got {}",
+            types.join(" or "),
+            type_name(value)
+        ));
+        return;
+    }
+    if let Some(allowed) = schema.get("enum").and_then(Value::as_array) {
+        if !allowed.contains(value) {
+            let allowed: Vec<String> = allowed.iter().map(Value::to_string).collect();
+            problem(format!("must be one of {}", allowed.join(", ")));
+        }
+    }
+    if let Some(expected) = schema.get("const").filter(|c| *c != value) {
+        problem(format!("must be {}", expected));
+    }
+
+    let limit = |key: &str| schema.get(key).and_then(Value::as_f64);
+    match value {
+        Value::Number(n) => {
+            let n = n.as_f64().unwrap_or_default();
+            if let Some(minimum) = limit("minimum").filter(|m| n < *m) {
+                problem(format!("must be at least {}", minimum));
+            }
+            if let Some(maximum) = limit("maximum").filter(|m| n > *m) {
+                problem(format!("must be at most {}", maximum));
+            }
+        }
+        Value::String(s) => {
+            let len = s.chars().count() as f64;
+            if let Some(min) = limit("minLength").filter(|m| len < *m) {
+                problem(format!("must be at least {} characters", min));
+            }
+            if let Some(max) = limit("maxLength").filter(|m| len > *m) {
+                problem(format!("must be at most {} characters", max));
+            }
+            if let Some(pattern) = schema.get("pattern").and_then(Value::as_str) {
+                match regex::Regex::new(pattern) {
+                    Ok(re) if !re.is_match(s) => problem(format!("must match {}", pattern)),
+                    Ok(_) => {}
+                    Err(_) => tracing::debug!("Ignoring invalid schema pattern {}", pattern),
+                }
+            }
+        }
+        Value::Array(items) => {
+            if let Some(item_schema) = schema.get("items") {
+                for (i, item) in items.iter().enumerate() {
+                    check(
+                        root,
+                        item_schema,
+                        item,
+                        &format!("{}[{}]", path, i),
+                        problems,
+                    );
+                }
+            }
+        }
+        Value::Object(map) => {
+            let required = schema.get("required").and_then(Value::as_array);
+            for key in required.into_iter().flatten().filter_map(Value::as_str) {
+                if !map.contains_key(key) {
+                    problems.push(format!("{}: required", join(path, key)));
+                }
+            }
+            let properties = schema.get("properties").and_then(Value::as_object);
+            let additional = schema.get("additionalProperties");
+            for (key, item) in map {
+                match (properties.and_then(|p| p.get(key)), additional) {
+                    (Some(property), _) => check(root, property, item, &join(path, key), problems),
+                    (None, Some(Value::Bool(false))) => {
+                        problems.push(format!("{}: unknown setting", join(path, key)))
+                    }
+                    (None, Some(other)) => check(root, other, item, &join(path, key), problems),
+                    (None, None) => {}
+                }
+            }
+        }
+        _ => {}
+    }
+
+    if let Some(variants) = schema.get("oneOf").and_then(Value::as_array) {
+        let mut tag_name = "";
+        let mut tags = Vec::new();
+        for variant in variants {
+            let properties = variant.get("properties").and_then(Value::as_object);
+            let tag = properties
+                .into_iter()
+                .flatten()
+                .find_map(|(name, p)| Some((name.as_str(), p.get("const")?)));
+            let Some((name, tag)) = tag else { continue };
+            if value.get(name) == Some(tag) {
+                return check(root, variant, value, path, problems);
+            }
+            tag_name = name;
+            tags.push(tag.to_string());
+        }
+        problems.push(format!(
+            "{}: must be one of {}",
+            join(path, tag_name),
+            tags.join(", ")
+        ));
+    }
+}
@@ -0,0 +1,245 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use super::marketplace::PluginRelease;
+use super::schema;
+use super::verify::{sha256_hex, Trust};
+use super::{validate_name, PROTOCOL_VERSION};
+
+const METADATA_FILE: &str = "plugin.json";
+
+/// Every WebAssembly module starts with these bytes.
+const WASM_MAGIC: &[u8] = b"\0asm";
+
+/// How an installed plugin is run.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PluginRuntime {
+    /// A native executable run as a sandboxed child process
+    #[default]
+    Native,
+    /// A WebAssembly module run in-process
+    Wasm,
+}
+
+impl PluginRuntime {
+    pub fn detect(binary: &[u8]) -> Self {
+        if binary.starts_with(WASM_MAGIC) {
+            PluginRuntime::Wasm
+        } else {
+            PluginRuntime::Native
+        }
+    }
+}
+
+/// A plugin present in the local plugin directory.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct InstalledPlugin {
+    pub name: String,
+    pub version: String,
+    #[serde(default)]
+    pub description: String,
+    pub installed_at: DateTime<Utc>,
+    /// Plugin executable
+    pub path: PathBuf,
+    /// Hex SHA-256 of the executable when it was installed
+    #[serde(default)]
+    pub sha256: String,
+    /// Whether a trusted key signed the binary
+    #[serde(default)]
+    pub signed: bool,
+    #[serde(default)]
+    pub runtime: PluginRuntime,
+    #[serde(default = "super::default_protocol")]
+    pub protocol: u32,
+    /// JSON schema the plugin's settings must follow
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub config_schema: Option<Value>,
+}
+
+impl InstalledPlugin {
+    /// Make sure the executable hasn't changed since it was installed.
+    pub fn check_integrity(&self) -> Result<()> {
+        let binary = fs::read(&self.path)
+            .with_context(|| format!("Failed to read plugin binary {:?}", self.path))?;
+        if sha256_hex(&binary) != self.sha256 {
+            return Err(anyhow::anyhow!(
+                "Plugin {} has been modified since it was installed; reinstall it",
+                self.name
+            ));
+        }
+        Ok(())
+    }
+
+    /// Problems with `settings` (the plugin's `plugin_config` entry) under
+    /// the schema the plugin declares. A missing entry counts as `{}`.
+    pub fn check_settings(&self, settings: &Value) -> Vec<String> {
+        let Some(ref schema) = self.config_schema else {
+            return Vec::new();
+        };
+        match settings {
+            Value::Null => schema::validate(schema, &Value::Object(Default::default())),
+            settings => schema::validate(schema, settings),
+        }
+    }
+}
+
+/// Local plugin directory. Each plugin lives in `<dir>/<name>/` next to a
+/// `plugin.json` describing the installed version; only one version of a
+/// plugin is installed at a time.
+#[derive(Debug, Clone)]
+pub struct PluginStore {
+    dir: PathBuf,
+}
+
+impl PluginStore {
+    pub fn new(dir: PathBuf) -> Self {
+        Self { dir }
+    }
+
+    /// `~/.config/kilometers/plugins` (or the platform equivalent)
+    pub fn default_dir() -> Result<PathBuf> {
+        let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+        Ok(base.config_dir().join("kilometers").join("plugins"))
+    }
+
+    pub fn open_default() -> Result<Self> {
+        Ok(Self::new(Self::default_dir()?))
+    }
+
+    fn plugin_dir(&self, name: &str) -> PathBuf {
+        self.dir.join(name)
+    }
+
+    pub fn get(&self, name: &str) -> Result<Option<InstalledPlugin>> {
+        validate_name(name)?;
+        let metadata = self.plugin_dir(name).join(METADATA_FILE);
+        if !metadata.exists() {
+            return Ok(None);
+        }
+        let content = fs::read_to_string(&metadata)
+            .with_context(|| format!("Failed to read {:?}", metadata))?;
+        let plugin = serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {:?}", metadata))?;
+        Ok(Some(plugin))
+    }
+
+    /// Installed plugins sorted by name. Directories without readable
+    /// metadata are skipped.
+    pub fn installed(&self) -> Result<Vec<InstalledPlugin>> {
+        if !self.dir.exists() {
+            return Ok(Vec::new());
+        }
+
+        let mut plugins = Vec::new();
+        for entry in fs::read_dir(&self.dir).context("Failed to read plugin directory")? {
+            let name = entry?.file_name().to_string_lossy().into_owned();
+            match self.get(&name) {
+                Ok(Some(plugin)) => plugins.push(plugin),
+                Ok(None) => {}
+                Err(e) => tracing::warn!("Skipping plugin {}: {:#}", name, e),
+            }
+        }
+        plugins.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(plugins)
+    }
+
+    /// Write the plugin binary and its metadata, replacing any installed
+    /// version. The new version is staged next to the old one and swapped in
+    /// with a rename so a failed install leaves the old version working.
+    pub fn install(
+        &self,
+        release: &PluginRelease,
+        binary: &[u8],
+        trust: Trust,
+    ) -> Result<InstalledPlugin> {
+        let name = release.name.as_str();
+        validate_name(name)?;
+        if release.protocol > PROTOCOL_VERSION {
+            return Err(anyhow::anyhow!(
+                "{} {} needs plugin protocol {}; update km to install it",
+                name,
+                release.version,
+                release.protocol
+            ));
+        }
+        fs::create_dir_all(&self.dir).context("Failed to create plugin directory")?;
+
+        let staging = self
+            .dir
+            .join(format!(".{}.{}", name, uuid::Uuid::new_v4().simple()));
+        fs::create_dir_all(&staging)?;
+        let result = self.stage(&staging, release, binary, trust);
+        let plugin = match result {
+            Ok(plugin) => plugin,
+            Err(e) => {
+                let _ = fs::remove_dir_all(&staging);
+                return Err(e);
+            }
+        };
+
+        let target = self.plugin_dir(name);
+        if target.exists() {
+            fs::remove_dir_all(&target)
+                .with_context(|| format!("Failed to remove old version of {}", name))?;
+        }
+        fs::rename(&staging, &target).context("Failed to install plugin")?;
+
+        Ok(plugin)
+    }
+
+    fn stage(
+        &self,
+        staging: &Path,
+        release: &PluginRelease,
+        binary: &[u8],
+        trust: Trust,
+    ) -> Result<InstalledPlugin> {
+        let name = release.name.as_str();
+        let runtime = PluginRuntime::detect(binary);
+        let file_name = match runtime {
+            PluginRuntime::Native => format!("{}{}", name, std::env::consts::EXE_SUFFIX),
+            PluginRuntime::Wasm => format!("{}.wasm", name),
+        };
+        fs::write(staging.join(&file_name), binary).context("Failed to write plugin binary")?;
+
+        #[cfg(unix)]
+        if runtime == PluginRuntime::Native {
+            use std::os::unix::fs::PermissionsExt;
+            fs::set_permissions(staging.join(&file_name), fs::Permissions::from_mode(0o755))?;
+        }
+
+        let plugin = InstalledPlugin {
+            name: name.to_string(),
+            version: release.version.clone(),
+            description: release.description.clone(),
+            installed_at: Utc::now(),
+            path: self.plugin_dir(name).join(&file_name),
+            sha256: sha256_hex(binary),
+            signed: trust.is_signed(),
+            runtime,
+            protocol: release.protocol,
+            config_schema: release.config_schema.clone(),
+        };
+        fs::write(
+            staging.join(METADATA_FILE),
+            serde_json::to_string_pretty(&plugin)?,
+        )?;
+        Ok(plugin)
+    }
+
+    /// Returns false if the plugin wasn't installed.
+    pub fn remove(&self, name: &str) -> Result<bool> {
+        validate_name(name)?;
+        let dir = self.plugin_dir(name);
+        if !dir.exists() {
+            return Ok(false);
+        }
+        fs::remove_dir_all(&dir).with_context(|| format!("Failed to remove {:?}", dir))?;
+        Ok(true)
+    }
+}
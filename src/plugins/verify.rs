@@ -0,0 +1,127 @@
+use anyhow::{Context, Result};
+use base64::Engine;
+use ed25519_dalek::{Signature, Verifier, VerifyingKey};
+use sha2::{Digest, Sha256};
+
+use super::marketplace::PluginRelease;
+use crate::errors::{Code, KmError};
+
+/// How much a downloaded plugin binary could be checked.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Trust {
+    /// Checksum matched and a trusted key signed the binary
+    Signed,
+    /// Checksum matched but there is no signature from a trusted key
+    ChecksumOnly,
+    /// The manifest had no checksum for this release
+    Unverified,
+}
+
+impl Trust {
+    pub fn is_signed(self) -> bool {
+        self == Trust::Signed
+    }
+}
+
+pub fn sha256_hex(bytes: &[u8]) -> String {
+    hex_encode(&Sha256::digest(bytes))
+}
+
+fn hex_encode(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+fn decode_base64(value: &str) -> Result<Vec<u8>> {
+    base64::engine::general_purpose::STANDARD
+        .decode(value.trim())
+        .context("Invalid base64")
+}
+
+/// Ed25519 public keys whose signatures are accepted on plugin binaries.
+#[derive(Debug, Clone, Default)]
+pub struct TrustedKeys {
+    keys: Vec<VerifyingKey>,
+}
+
+impl TrustedKeys {
+    /// Parse base64-encoded 32-byte Ed25519 public keys.
+    pub fn from_config(keys: &[String]) -> Result<Self> {
+        let keys =
+            keys.iter()
+                .map(|key| {
+                    let bytes = decode_base64(key)
+                        .with_context(|| format!("Invalid trusted plugin key '{}'", key))?;
+                    let bytes: [u8; 32] = bytes.as_slice().try_into().map_err(|_| {
+                        anyhow::anyhow!("Trusted plugin key '{}' is not 32 bytes", key)
+                    })?;
+                    VerifyingKey::from_bytes(&bytes)
+                        .with_context(|| format!("Invalid trusted plugin key '{}'", key))
+                })
+                .collect::<Result<Vec<_>>>()?;
+        Ok(Self { keys })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.keys.is_empty()
+    }
+
+    /// Whether one of the keys made `signature` (base64) over `binary`.
+    pub fn verifies(&self, binary: &[u8], signature: &str) -> bool {
+        let signature = match decode_base64(signature)
+            .ok()
+            .and_then(|bytes| Signature::from_slice(&bytes).ok())
+        {
+            Some(signature) => signature,
+            None => return false,
+        };
+        self.keys
+            .iter()
+            .any(|key| key.verify(binary, &signature).is_ok())
+    }
+}
+
+/// Check a downloaded binary against its manifest entry. A checksum
+/// mismatch is always an error; whether anything short of `Trust::Signed`
+/// is acceptable is up to the caller.
+pub fn verify_release(release: &PluginRelease, binary: &[u8], keys: &TrustedKeys) -> Result<Trust> {
+    let expected = match release.sha256 {
+        Some(ref expected) => expected.trim().to_lowercase(),
+        None => return Ok(Trust::Unverified),
+    };
+
+    let actual = sha256_hex(binary);
+    if actual != expected {
+        return Err(KmError::new(
+            Code::PluginUntrusted,
+            format!(
+                "Checksum mismatch for {}@{}: expected {}, got {}",
+                release.name, release.version, expected, actual
+            ),
+        )
+        .into());
+    }
+
+    match release.signature {
+        Some(ref signature) if keys.verifies(binary, signature) => Ok(Trust::Signed),
+        _ => Ok(Trust::ChecksumOnly),
+    }
+}
+
+/// Refuse anything that isn't signed unless the user opted out.
+pub fn require_trust(release: &PluginRelease, trust: Trust, allow_unsigned: bool) -> Result<()> {
+    if trust.is_signed() || allow_unsigned {
+        return Ok(());
+    }
+    let reason = match trust {
+        Trust::Unverified => "has no checksum in the marketplace manifest",
+        _ => "is not signed by a trusted key",
+    };
+    Err(KmError::new(
+        Code::PluginUntrusted,
+        format!(
+            "{}@{} {}. Add the publisher's key to plugin_trusted_keys, or pass --allow-unsigned for development",
+            release.name, release.version, reason
+        ),
+    )
+    .into())
+}
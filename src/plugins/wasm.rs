@@ -0,0 +1,336 @@
+use anyhow::{Context, Result};
+use serde_json::{json, Value};
+use std::fs;
+use wasmi::{
+    Caller, Engine, Extern, Instance, Linker, Memory, Module, Store, StoreLimits,
+    StoreLimitsBuilder, TypedFunc,
+};
+
+use super::hooks::TypedHook;
+use super::runtime::{Metadata, PluginAction, PluginInstance, PluginReply};
+use super::sandbox::PluginSandboxConfig;
+use super::store::InstalledPlugin;
+
+struct HostState {
+    plugin: String,
+    config: Value,
+    limits: StoreLimits,
+}
+
+/// A plugin shipped as a portable WebAssembly module and run in-process.
+/// It has no filesystem, network or clock access; the only host functions
+/// are `km.log` and `km.config_get` (see API_ENDPOINTS.md for the ABI).
+pub struct WasmPlugin {
+    name: String,
+    store: Store<HostState>,
+    instance: Instance,
+    memory: Memory,
+    alloc: TypedFunc<i32, i32>,
+    fuel: u64,
+}
+
+impl std::fmt::Debug for WasmPlugin {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("WasmPlugin")
+            .field("name", &self.name)
+            .finish_non_exhaustive()
+    }
+}
+
+fn pack(ptr: i32, len: usize) -> i64 {
+    ((ptr as u32 as i64) << 32) | (len as u32 as i64)
+}
+
+fn unpack(value: i64) -> (usize, usize) {
+    (
+        (value as u64 >> 32) as usize,
+        (value as u64 & 0xffff_ffff) as usize,
+    )
+}
+
+fn guest_string(
+    caller: &Caller<'_, HostState>,
+    ptr: i32,
+    len: i32,
+) -> Result<String, wasmi::Error> {
+    let memory = caller
+        .get_export("memory")
+        .and_then(Extern::into_memory)
+        .ok_or_else(|| wasmi::Error::new("plugin does not export its memory"))?;
+    let mut buf = vec![0; len as u32 as usize];
+    memory
+        .read(caller, ptr as u32 as usize, &mut buf)
+        .map_err(|e| wasmi::Error::new(e.to_string()))?;
+    Ok(String::from_utf8_lossy(&buf).into_owned())
+}
+
+fn link(engine: &Engine) -> Result<Linker<HostState>> {
+    let mut linker = Linker::new(engine);
+    linker.func_wrap(
+        "km",
+        "log",
+        |caller: Caller<'_, HostState>,
+         level: i32,
+         ptr: i32,
+         len: i32|
+         -> Result<(), wasmi::Error> {
+            let text = guest_string(&caller, ptr, len)?;
+            let plugin = &caller.data().plugin;
+            match level {
+                0 => tracing::error!("[plugin {}] {}", plugin, text),
+                1 => tracing::warn!("[plugin {}] {}", plugin, text),
+                2 => tracing::info!("[plugin {}] {}", plugin, text),
+                3 => tracing::debug!("[plugin {}] {}", plugin, text),
+                _ => tracing::trace!("[plugin {}] {}", plugin, text),
+            }
+            Ok(())
+        },
+    )?;
+    linker.func_wrap(
+        "km",
+        "config_get",
+        |mut caller: Caller<'_, HostState>, ptr: i32, len: i32| -> Result<i64, wasmi::Error> {
+            let key = guest_string(&caller, ptr, len)?;
+            let value = match caller.data().config.get(&key) {
+                Some(Value::String(s)) => s.clone(),
+                Some(Value::Null) | None => return Ok(0),
+                Some(other) => other.to_string(),
+            };
+
+            let alloc = caller
+                .get_export("km_alloc")
+                .and_then(Extern::into_func)
+                .ok_or_else(|| wasmi::Error::new("plugin does not export km_alloc"))?
+                .typed::<i32, i32>(&caller)?;
+            let out = alloc.call(&mut caller, value.len() as i32)?;
+            let memory = caller
+                .get_export("memory")
+                .and_then(Extern::into_memory)
+                .ok_or_else(|| wasmi::Error::new("plugin does not export its memory"))?;
+            memory
+                .write(&mut caller, out as u32 as usize, value.as_bytes())
+                .map_err(|e| wasmi::Error::new(e.to_string()))?;
+            Ok(pack(out, value.len()))
+        },
+    )?;
+    Ok(linker)
+}
+
+impl WasmPlugin {
+    /// Compile and instantiate the plugin's module. `settings` is its
+    /// `plugin_config` entry.
+    pub fn load(
+        plugin: &InstalledPlugin,
+        config: &PluginSandboxConfig,
+        settings: &Value,
+    ) -> Result<Self> {
+        let bytes = fs::read(&plugin.path)
+            .with_context(|| format!("Failed to read plugin module {:?}", plugin.path))?;
+
+        let mut engine_config = wasmi::Config::default();
+        engine_config.consume_fuel(true);
+        let engine = Engine::new(&engine_config);
+        let module = Module::new(&engine, &bytes[..])
+            .map_err(|e| anyhow::anyhow!("Invalid wasm module for {}: {}", plugin.name, e))?;
+
+        let mut limits = StoreLimitsBuilder::new();
+        if let Some(mb) = config.memory_mb {
+            limits = limits.memory_size(mb.saturating_mul(1024 * 1024) as usize);
+        }
+        let mut store = Store::new(
+            &engine,
+            HostState {
+                plugin: plugin.name.clone(),
+                config: settings.clone(),
+                limits: limits.build(),
+            },
+        );
+        store.limiter(|state| &mut state.limits);
+        store
+            .set_fuel(config.wasm_fuel)
+            .map_err(|e| anyhow::anyhow!("{}", e))?;
+
+        let instance = link(&engine)?
+            .instantiate(&mut store, &module)
+            .and_then(|pre| pre.start(&mut store))
+            .map_err(|e| anyhow::anyhow!("Failed to start plugin {}: {}", plugin.name, e))?;
+        let memory = instance
+            .get_memory(&store, "memory")
+            .with_context(|| format!("Plugin {} does not export its memory", plugin.name))?;
+        let alloc = instance
+            .get_typed_func::<i32, i32>(&store, "km_alloc")
+            .map_err(|e| anyhow::anyhow!("Plugin {} has no usable km_alloc: {}", plugin.name, e))?;
+
+        Ok(Self {
+            name: plugin.name.clone(),
+            store,
+            instance,
+            memory,
+            alloc,
+            fuel: config.wasm_fuel,
+        })
+    }
+
+    /// Copy the hook input into guest memory, refilling the fuel tank first.
+    fn input(
+        &mut self,
+        hook: &str,
+        message: &Value,
+        call: Option<&TypedHook>,
+        metadata: &Metadata,
+    ) -> Result<(i32, i32)> {
+        self.store
+            .set_fuel(self.fuel)
+            .map_err(|e| anyhow::anyhow!("{}", e))?;
+        let mut input = json!({
+            "hook": hook,
+            "message": message,
+            "metadata": metadata,
+        });
+        if let Some(call) = call {
+            input["call"] = serde_json::to_value(call)?;
+        }
+        let input = serde_json::to_vec(&input)?;
+        let ptr = self
+            .alloc
+            .call(&mut self.store, input.len() as i32)
+            .map_err(|e| self.trap(hook, e))?;
+        self.memory
+            .write(&mut self.store, ptr as u32 as usize, &input)
+            .map_err(|e| anyhow::anyhow!("Plugin {} returned a bad buffer: {}", self.name, e))?;
+        Ok((ptr, input.len() as i32))
+    }
+
+    fn trap(&self, hook: &str, error: wasmi::Error) -> anyhow::Error {
+        anyhow::anyhow!("Plugin {} failed in {}: {}", self.name, hook, error)
+    }
+
+    fn exports(&self, hook: &str) -> bool {
+        self.instance.get_func(&self.store, hook).is_some()
+    }
+
+    fn request(
+        &mut self,
+        hook: &str,
+        message: &Value,
+        call: Option<&TypedHook>,
+        metadata: &Metadata,
+    ) -> Result<PluginReply> {
+        let Ok(func) = self
+            .instance
+            .get_typed_func::<(i32, i32), i64>(&self.store, hook)
+        else {
+            // Modules only export the hooks they care about
+            return Ok(PluginReply {
+                action: PluginAction::Allow,
+                metadata: Metadata::new(),
+            });
+        };
+
+        let args = self.input(hook, message, call, metadata)?;
+        let result = func
+            .call(&mut self.store, args)
+            .map_err(|e| self.trap(hook, e))?;
+        if result == 0 {
+            return Ok(PluginReply {
+                action: PluginAction::Allow,
+                metadata: Metadata::new(),
+            });
+        }
+
+        let (ptr, len) = unpack(result);
+        let mut buf = vec![0; len];
+        self.memory
+            .read(&self.store, ptr, &mut buf)
+            .map_err(|e| anyhow::anyhow!("Plugin {} returned a bad buffer: {}", self.name, e))?;
+        serde_json::from_slice(&buf)
+            .with_context(|| format!("Plugin {} sent an invalid reply", self.name))
+    }
+
+    fn observe(
+        &mut self,
+        hook: &str,
+        message: &Value,
+        call: Option<&TypedHook>,
+        metadata: &Metadata,
+    ) -> Result<()> {
+        let Ok(func) = self
+            .instance
+            .get_typed_func::<(i32, i32), ()>(&self.store, hook)
+        else {
+            return Ok(());
+        };
+        let args = self.input(hook, message, call, metadata)?;
+        func.call(&mut self.store, args)
+            .map_err(|e| self.trap(hook, e))
+    }
+}
+
+impl PluginInstance for WasmPlugin {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn call(&mut self, hook: &str, message: &Value, metadata: &Metadata) -> Result<PluginReply> {
+        self.request(hook, message, None, metadata)
+    }
+
+    fn notify(&mut self, hook: &str, message: &Value, metadata: &Metadata) -> Result<()> {
+        self.observe(hook, message, None, metadata)
+    }
+
+    /// Modules take a typed hook by exporting it; others get the generic one.
+    fn call_typed(
+        &mut self,
+        typed: &TypedHook,
+        message: &Value,
+        metadata: &Metadata,
+    ) -> Result<PluginReply> {
+        match self.exports(typed.hook()) {
+            true => self.request(typed.hook(), message, Some(typed), metadata),
+            false => self.request(typed.fallback(), message, None, metadata),
+        }
+    }
+
+    fn notify_typed(
+        &mut self,
+        typed: &TypedHook,
+        message: &Value,
+        metadata: &Metadata,
+    ) -> Result<()> {
+        match self.exports(typed.hook()) {
+            true => self.observe(typed.hook(), message, Some(typed), metadata),
+            false => self.observe(typed.fallback(), message, None, metadata),
+        }
+    }
+
+    /// Fuel bounds these calls instead of `timeout`.
+    fn invoke(
+        &mut self,
+        hook: &str,
+        message: &Value,
+        _timeout: std::time::Duration,
+    ) -> Result<Option<Value>> {
+        let Ok(func) = self
+            .instance
+            .get_typed_func::<(i32, i32), i64>(&self.store, hook)
+        else {
+            return Ok(None);
+        };
+        let args = self.input(hook, message, None, &Metadata::new())?;
+        let result = func
+            .call(&mut self.store, args)
+            .map_err(|e| self.trap(hook, e))?;
+        if result == 0 {
+            return Ok(None);
+        }
+        let (ptr, len) = unpack(result);
+        let mut buf = vec![0; len];
+        self.memory
+            .read(&self.store, ptr, &mut buf)
+            .map_err(|e| anyhow::anyhow!("Plugin {} returned a bad buffer: {}", self.name, e))?;
+        serde_json::from_slice(&buf)
+            .map(Some)
+            .with_context(|| format!("Plugin {} sent an invalid reply", self.name))
+    }
+}
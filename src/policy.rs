@@ -0,0 +1,325 @@
+use anyhow::{Context, Result};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+
+use crate::risk::PatternRiskAnalyzer;
+use crate::traffic;
+
+/// JSON-RPC error code returned to the client when a policy blocks a request
+pub const POLICY_BLOCKED_CODE: i64 = -32002;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PolicyMode {
+    /// Log what the policies would do, but forward everything
+    #[default]
+    Audit,
+    /// Block and rewrite requests before they reach the server
+    Enforce,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PolicyAction {
+    #[default]
+    Allow,
+    Deny,
+    Rewrite,
+}
+
+/// One policy rule. Every condition that is set must match; the first
+/// matching rule decides.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PolicyRuleConfig {
+    pub name: String,
+    pub action: PolicyAction,
+    /// Method patterns (e.g. tools/*)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub methods: Vec<String>,
+    /// Tool name patterns, matched against `params.name` of tools/call
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tools: Vec<String>,
+    /// Regexes matched against tool arguments by name; `*` matches any argument
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub arguments: BTreeMap<String, String>,
+    /// Only match requests whose local risk score is at least this
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub risk_above: Option<f32>,
+    /// For rewrite rules: JSON pointers into the request and their new values
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub set: BTreeMap<String, Value>,
+    /// Shown to the client when the rule denies a request
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub message: Option<String>,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct PolicyConfig {
+    #[serde(default)]
+    pub mode: PolicyMode,
+    /// What happens to requests no rule matches
+    #[serde(default)]
+    pub default_action: PolicyAction,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<PolicyRuleConfig>,
+}
+
+impl PolicyConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+#[derive(Debug, Clone)]
+struct PolicyRule {
+    name: String,
+    action: PolicyAction,
+    methods: Vec<String>,
+    tools: Vec<String>,
+    arguments: Vec<(String, Regex)>,
+    risk_above: Option<f32>,
+    set: Vec<(String, Value)>,
+    message: Option<String>,
+}
+
+/// What the policies decided for one request.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Decision {
+    Allow { rule: Option<String> },
+    Deny { rule: String, message: String },
+    Rewrite { rule: String, message: Value },
+}
+
+impl Decision {
+    pub fn action(&self) -> PolicyAction {
+        match self {
+            Decision::Allow { .. } => PolicyAction::Allow,
+            Decision::Deny { .. } => PolicyAction::Deny,
+            Decision::Rewrite { .. } => PolicyAction::Rewrite,
+        }
+    }
+
+    pub fn rule(&self) -> Option<&str> {
+        match self {
+            Decision::Allow { rule } => rule.as_deref(),
+            Decision::Deny { rule, .. } | Decision::Rewrite { rule, .. } => Some(rule),
+        }
+    }
+}
+
+/// Compiled policy rules.
+#[derive(Debug, Clone)]
+pub struct Policy {
+    mode: PolicyMode,
+    default_action: PolicyAction,
+    rules: Vec<PolicyRule>,
+    analyzer: PatternRiskAnalyzer,
+}
+
+impl Policy {
+    pub fn from_config(config: &PolicyConfig) -> Result<Self> {
+        if config.default_action == PolicyAction::Rewrite {
+            return Err(anyhow::anyhow!(
+                "policies.default_action must be allow or deny"
+            ));
+        }
+
+        let mut rules = Vec::new();
+        for rule in &config.rules {
+            let arguments = rule
+                .arguments
+                .iter()
+                .map(|(name, pattern)| {
+                    Regex::new(pattern)
+                        .map(|re| (name.clone(), re))
+                        .with_context(|| {
+                            format!(
+                                "Policy rule '{}' has an invalid regex for {}",
+                                rule.name, name
+                            )
+                        })
+                })
+                .collect::<Result<Vec<_>>>()?;
+            if rule.action == PolicyAction::Rewrite && rule.set.is_empty() {
+                return Err(anyhow::anyhow!(
+                    "Policy rule '{}' rewrites but has nothing to set",
+                    rule.name
+                ));
+            }
+            if let Some(pointer) = rule.set.keys().find(|p| !p.starts_with('/')) {
+                return Err(anyhow::anyhow!(
+                    "Policy rule '{}': '{}' is not a JSON pointer (e.g. /params/arguments/path)",
+                    rule.name,
+                    pointer
+                ));
+            }
+            rules.push(PolicyRule {
+                name: rule.name.clone(),
+                action: rule.action,
+                methods: rule.methods.clone(),
+                tools: rule.tools.clone(),
+                arguments,
+                risk_above: rule.risk_above,
+                set: rule
+                    .set
+                    .iter()
+                    .map(|(k, v)| (k.clone(), v.clone()))
+                    .collect(),
+                message: rule.message.clone(),
+            });
+        }
+
+        Ok(Self {
+            mode: config.mode,
+            default_action: config.default_action,
+            rules,
+            analyzer: PatternRiskAnalyzer::new(),
+        })
+    }
+
+    pub fn mode(&self) -> PolicyMode {
+        self.mode
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rules.is_empty() && self.default_action == PolicyAction::Allow
+    }
+
+    /// Decide what to do with a client request.
+    pub fn evaluate(&self, message: &Value) -> Decision {
+        let Some(method) = message.get("method").and_then(|m| m.as_str()) else {
+            // Responses to server requests aren't subject to policy
+            return Decision::Allow { rule: None };
+        };
+
+        for rule in &self.rules {
+            if !self.matches(rule, method, message) {
+                continue;
+            }
+            return match rule.action {
+                PolicyAction::Allow => Decision::Allow {
+                    rule: Some(rule.name.clone()),
+                },
+                PolicyAction::Deny => Decision::Deny {
+                    rule: rule.name.clone(),
+                    message: rule
+                        .message
+                        .clone()
+                        .unwrap_or_else(|| format!("{} is not allowed", describe(method, message))),
+                },
+                PolicyAction::Rewrite => {
+                    let mut rewritten = message.clone();
+                    for (pointer, value) in &rule.set {
+                        set_pointer(&mut rewritten, pointer, value.clone());
+                    }
+                    Decision::Rewrite {
+                        rule: rule.name.clone(),
+                        message: rewritten,
+                    }
+                }
+            };
+        }
+
+        match self.default_action {
+            PolicyAction::Deny => Decision::Deny {
+                rule: "default".to_string(),
+                message: format!("{} is not allowed", describe(method, message)),
+            },
+            _ => Decision::Allow { rule: None },
+        }
+    }
+
+    fn matches(&self, rule: &PolicyRule, method: &str, message: &Value) -> bool {
+        if !rule.methods.is_empty()
+            && !rule
+                .methods
+                .iter()
+                .any(|pattern| traffic::method_matches(pattern, method))
+        {
+            return false;
+        }
+
+        let tool = tool_name(method, message);
+        if !rule.tools.is_empty()
+            && !tool.is_some_and(|tool| {
+                rule.tools
+                    .iter()
+                    .any(|pattern| traffic::method_matches(pattern, tool))
+            })
+        {
+            return false;
+        }
+
+        let arguments = message.pointer("/params/arguments");
+        for (name, regex) in &rule.arguments {
+            let matched = match (name.as_str(), arguments) {
+                ("*", Some(Value::Object(args))) => args.values().any(|v| regex.is_match(&text(v))),
+                ("*", Some(other)) => regex.is_match(&text(other)),
+                (name, Some(args)) => args.get(name).is_some_and(|v| regex.is_match(&text(v))),
+                (_, None) => false,
+            };
+            if !matched {
+                return false;
+            }
+        }
+
+        if let Some(threshold) = rule.risk_above {
+            let risk = self.analyzer.analyze(Some(method), &message.to_string());
+            if risk.score < threshold {
+                return false;
+            }
+        }
+        true
+    }
+}
+
+fn tool_name<'a>(method: &str, message: &'a Value) -> Option<&'a str> {
+    (method == "tools/call")
+        .then(|| message.pointer("/params/name").and_then(|n| n.as_str()))
+        .flatten()
+}
+
+fn describe(method: &str, message: &Value) -> String {
+    match tool_name(method, message) {
+        Some(tool) => format!("Tool {}", tool),
+        None => format!("Method {}", method),
+    }
+}
+
+/// Strings match as themselves, anything else as its JSON text.
+fn text(value: &Value) -> String {
+    match value {
+        Value::String(s) => s.clone(),
+        other => other.to_string(),
+    }
+}
+
+/// Set the value at a JSON pointer, creating objects along the way.
+fn set_pointer(target: &mut Value, pointer: &str, value: Value) {
+    let mut current = target;
+    let mut segments = pointer
+        .split('/')
+        .skip(1)
+        .map(|s| s.replace("~1", "/").replace("~0", "~"))
+        .peekable();
+    while let Some(segment) = segments.next() {
+        if !current.is_object() && !current.is_array() {
+            *current = Value::Object(Default::default());
+        }
+        let last = segments.peek().is_none();
+        current = match current {
+            Value::Array(items) => match segment.parse::<usize>() {
+                Ok(i) if i < items.len() => &mut items[i],
+                _ => return,
+            },
+            Value::Object(map) => map.entry(segment).or_insert(Value::Null),
+            _ => return,
+        };
+        if last {
+            *current = value;
+            return;
+        }
+    }
+}
@@ -0,0 +1,124 @@
+//! Capture presets: named sets of capture settings for `km monitor
+//! --preset`. km ships `dev`, `prod-audit` and `forensic`; the `presets`
+//! config section adds more, or replaces a built-in one of the same name.
+
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+use crate::proxy::CaptureSettings;
+use crate::risk::RiskLevel;
+
+/// Names of the presets km ships
+pub const BUILT_IN: [&str; 3] = ["dev", "prod-audit", "forensic"];
+
+/// What a session captures. A preset replaces the capture settings of the
+/// config file (`method_whitelist`, `payload_size_limit`, `capture_pings`).
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct CapturePreset {
+    /// What the preset is for, shown by `km presets list`
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub description: String,
+    /// Only capture methods matching these patterns; empty captures every method
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub methods: Vec<String>,
+    /// Also capture messages of other methods scored at or above this risk level
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub risk_at_least: Option<RiskLevel>,
+    /// Capture, log and upload pings like any other message
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub capture_pings: bool,
+    /// Upload events without their payload when it is larger than this many bytes
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload_size_limit: Option<usize>,
+}
+
+impl CapturePreset {
+    pub fn validate(&self) -> Result<()> {
+        if self.methods.iter().any(|m| m.trim().is_empty()) {
+            return Err(anyhow::anyhow!("methods must not contain empty entries"));
+        }
+        if self.payload_size_limit == Some(0) {
+            return Err(anyhow::anyhow!("payload_size_limit must be greater than 0"));
+        }
+        Ok(())
+    }
+
+    /// What the preset captures, for `km presets list`.
+    pub fn describe(&self) -> String {
+        let mut parts = vec![match (self.methods.is_empty(), self.risk_at_least) {
+            (true, _) => "every method".to_string(),
+            (false, None) => self.methods.join(", "),
+            (false, Some(level)) => {
+                format!("{}, and {} risk or above", self.methods.join(", "), level)
+            }
+        }];
+        if self.capture_pings {
+            parts.push("pings".to_string());
+        }
+        if let Some(limit) = self.payload_size_limit {
+            parts.push(format!("uploads payloads up to {} bytes", limit));
+        }
+        parts.join("; ")
+    }
+
+    pub fn capture_settings(&self) -> CaptureSettings {
+        CaptureSettings {
+            method_whitelist: self.methods.clone(),
+            payload_size_limit: self.payload_size_limit,
+            // With no methods listed everything is captured anyway
+            risk_at_least: self.risk_at_least.filter(|_| !self.methods.is_empty()),
+        }
+    }
+}
+
+/// The built-in preset `name`.
+pub fn built_in(name: &str) -> Option<CapturePreset> {
+    let preset = match name {
+        "dev" => CapturePreset {
+            description: "Every message but pings, as without a preset".to_string(),
+            ..Default::default()
+        },
+        "prod-audit" => CapturePreset {
+            description: "Tool calls, and other messages scored high risk or above".to_string(),
+            methods: vec!["tools/call".to_string()],
+            risk_at_least: Some(RiskLevel::High),
+            ..Default::default()
+        },
+        "forensic" => CapturePreset {
+            description: "Everything, including pings, with whole payloads".to_string(),
+            capture_pings: true,
+            ..Default::default()
+        },
+        _ => return None,
+    };
+    Some(preset)
+}
+
+/// Every preset by name: the built-in ones and those of the config file,
+/// which take the place of a built-in one of the same name. The flag is
+/// set for presets from the config file.
+pub fn all(custom: &BTreeMap<String, CapturePreset>) -> BTreeMap<String, (CapturePreset, bool)> {
+    let mut presets: BTreeMap<String, (CapturePreset, bool)> = BUILT_IN
+        .iter()
+        .filter_map(|name| Some((name.to_string(), (built_in(name)?, false))))
+        .collect();
+    for (name, preset) in custom {
+        presets.insert(name.clone(), (preset.clone(), true));
+    }
+    presets
+}
+
+/// The preset `name`, from the config file or built in.
+pub fn find(custom: &BTreeMap<String, CapturePreset>, name: &str) -> Result<CapturePreset> {
+    if let Some(preset) = custom.get(name) {
+        return Ok(preset.clone());
+    }
+    built_in(name).ok_or_else(|| {
+        anyhow::anyhow!(
+            "Unknown preset '{}'. Presets: {}",
+            name,
+            all(custom).into_keys().collect::<Vec<_>>().join(", ")
+        )
+    })
+}
@@ -0,0 +1,609 @@
+//! `km probe`: an MCP client for testing servers. It runs the initialize
+//! handshake, lists what the server offers, optionally calls tools at a
+//! target rate, and reports latency, errors and protocol problems.
+
+use anyhow::{Context, Result};
+use chrono::Utc;
+use serde::Serialize;
+use serde_json::{json, Value};
+use std::collections::HashMap;
+use std::fs::{File, OpenOptions};
+use std::io::{BufReader, BufWriter, Write};
+use std::path::Path;
+use std::process::{Child, ChildStdin};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError};
+use std::thread::{self, JoinHandle};
+use std::time::{Duration, Instant};
+
+use crate::build_info;
+use crate::framing::{FrameReader, Framing};
+use crate::process;
+use crate::proxy;
+use crate::report::{Latency, MethodReport};
+use crate::traffic::TrafficEntry;
+
+/// Protocol version `km probe` asks for in `initialize`
+pub const PROTOCOL_VERSION: &str = "2024-11-05";
+
+/// Pages of `tools/list` or `resources/list` followed before giving up
+const MAX_PAGES: usize = 100;
+
+/// A tool to call while probing.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ProbeCall {
+    pub tool: String,
+    pub arguments: Value,
+}
+
+/// Parse `--call NAME` or `--call NAME=JSON`; the arguments default to `{}`.
+pub fn parse_call(value: &str) -> std::result::Result<ProbeCall, String> {
+    let (tool, arguments) = match value.split_once('=') {
+        Some((tool, arguments)) => {
+            let arguments: Value = serde_json::from_str(arguments)
+                .map_err(|e| format!("arguments for {} aren't valid JSON: {}", tool, e))?;
+            if !arguments.is_object() {
+                return Err(format!("arguments for {} must be a JSON object", tool));
+            }
+            (tool, arguments)
+        }
+        None => (value, json!({})),
+    };
+    if tool.is_empty() {
+        return Err("expected TOOL or TOOL=JSON".to_string());
+    }
+    Ok(ProbeCall {
+        tool: tool.to_string(),
+        arguments,
+    })
+}
+
+/// How `km probe` exercises a server.
+#[derive(Debug, Clone)]
+pub struct ProbeOptions {
+    /// Tools to call, in rotation
+    pub calls: Vec<ProbeCall>,
+    /// Tool calls started per second; 0 waits for each response before the
+    /// next call
+    pub rate: f64,
+    /// Tool calls to make; defaults to each of `calls` once unless
+    /// `duration` is set
+    pub count: Option<u64>,
+    /// Keep calling tools for this long
+    pub duration: Option<Duration>,
+    /// How long to wait for a response
+    pub timeout: Duration,
+}
+
+impl Default for ProbeOptions {
+    fn default() -> Self {
+        Self {
+            calls: Vec::new(),
+            rate: 0.0,
+            count: None,
+            duration: None,
+            timeout: Duration::from_secs(30),
+        }
+    }
+}
+
+/// What a probe found out about a server.
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ProbeReport {
+    /// Session id of the probe's traffic, when it was recorded
+    pub session_id: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub server: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub protocol_version: Option<String>,
+    pub tools: Vec<String>,
+    /// Resources listed, if the server offers resources
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub resources: Option<usize>,
+    /// Every request the probe made, by method; tool calls are listed per
+    /// tool as `tools/call <name>`
+    pub methods: Vec<MethodReport>,
+    /// Tool calls started after the handshake
+    pub tool_calls: u64,
+    /// Seconds spent starting tool calls
+    pub elapsed_secs: f64,
+    /// Ways the server broke the protocol
+    pub problems: Vec<String>,
+}
+
+impl ProbeReport {
+    /// Tool calls started per second
+    pub fn throughput(&self) -> f64 {
+        if self.elapsed_secs > 0.0 {
+            self.tool_calls as f64 / self.elapsed_secs
+        } else {
+            0.0
+        }
+    }
+
+    /// No protocol problems and every request answered. Error responses
+    /// don't fail a probe; they're counted per method.
+    pub fn is_success(&self) -> bool {
+        self.problems.is_empty() && self.methods.iter().all(|m| m.unanswered == 0)
+    }
+}
+
+/// Something the server wrote to stdout.
+enum Output {
+    Message(Value),
+    /// A frame that isn't JSON
+    Invalid(String),
+}
+
+#[derive(Debug, Default)]
+struct MethodStats {
+    calls: u64,
+    errors: u64,
+    durations: Vec<f64>,
+}
+
+struct Client {
+    child: Child,
+    stdin: Option<ChildStdin>,
+    output: Receiver<(Output, Instant)>,
+    reader: Option<JoinHandle<()>>,
+    session_id: String,
+    log: Option<BufWriter<File>>,
+    next_id: u64,
+    /// Requests awaiting a response, with their stats key and when they were sent
+    pending: HashMap<u64, (String, Instant)>,
+    /// Stats by method, in the order methods were first called
+    stats: Vec<(String, MethodStats)>,
+    problems: Vec<String>,
+    /// The server closed its stdout
+    closed: bool,
+}
+
+impl Client {
+    fn start(program: &str, args: &[String], log_file: Option<&Path>) -> Result<Self> {
+        let log = match log_file {
+            Some(path) => Some(BufWriter::new(
+                OpenOptions::new()
+                    .create(true)
+                    .append(true)
+                    .open(path)
+                    .with_context(|| format!("Failed to open log file {:?}", path))?,
+            )),
+            None => None,
+        };
+
+        let mut child =
+            proxy::spawn_proxy_process(program, args).context("Failed to start the server")?;
+        let stdin = child.stdin.take().context("Failed to open server stdin")?;
+        let stdout = child
+            .stdout
+            .take()
+            .context("Failed to open server stdout")?;
+
+        let (tx, output) = mpsc::channel();
+        let reader = thread::spawn(move || {
+            for frame in FrameReader::new(BufReader::new(stdout), Framing::Auto) {
+                let Ok(frame) = frame else {
+                    break;
+                };
+                let at = Instant::now();
+                let messages = frame.messages();
+                if messages.is_empty() && tx.send((Output::Invalid(frame.body), at)).is_err() {
+                    return;
+                }
+                for message in messages {
+                    if tx.send((Output::Message(message), at)).is_err() {
+                        return;
+                    }
+                }
+            }
+        });
+
+        Ok(Self {
+            child,
+            stdin: Some(stdin),
+            output,
+            reader: Some(reader),
+            session_id: uuid::Uuid::new_v4().to_string(),
+            log,
+            next_id: 1,
+            pending: HashMap::new(),
+            stats: Vec::new(),
+            problems: Vec::new(),
+            closed: false,
+        })
+    }
+
+    fn problem(&mut self, problem: String) {
+        if !self.problems.contains(&problem) {
+            self.problems.push(problem);
+        }
+    }
+
+    fn stats(&mut self, key: &str) -> &mut MethodStats {
+        let index = match self.stats.iter().position(|(k, _)| k == key) {
+            Some(index) => index,
+            None => {
+                self.stats.push((key.to_string(), MethodStats::default()));
+                self.stats.len() - 1
+            }
+        };
+        &mut self.stats[index].1
+    }
+
+    fn record(&mut self, direction: &str, message: &Value, duration_ms: Option<f64>) {
+        let Some(log) = self.log.as_mut() else {
+            return;
+        };
+        let entry = TrafficEntry {
+            timestamp: Utc::now(),
+            direction: direction.to_string(),
+            content: message.to_string(),
+            duration_ms,
+            status: None,
+            error_code: None,
+            elapsed_ms: None,
+            session_id: Some(self.session_id.clone()),
+            metadata: Default::default(),
+            labels: Default::default(),
+        };
+        if let Ok(line) = serde_json::to_string(&entry) {
+            let _ = writeln!(log, "{}", line);
+        }
+    }
+
+    fn write(&mut self, message: &Value) -> Result<()> {
+        let stdin = self.stdin.as_mut().context("Server stdin is closed")?;
+        writeln!(stdin, "{}", message)
+            .and_then(|_| stdin.flush())
+            .context("Failed to write to the server")?;
+        self.record("request", message, None);
+        Ok(())
+    }
+
+    /// Send a request, counted under `key`, and return its id.
+    fn send(&mut self, method: &str, key: &str, params: Value) -> Result<u64> {
+        let id = self.next_id;
+        self.next_id += 1;
+        self.write(&json!({"jsonrpc": "2.0", "id": id, "method": method, "params": params}))?;
+        self.pending.insert(id, (key.to_string(), Instant::now()));
+        self.stats(key).calls += 1;
+        Ok(id)
+    }
+
+    fn notify(&mut self, method: &str) -> Result<()> {
+        self.write(&json!({"jsonrpc": "2.0", "method": method}))
+    }
+
+    /// Check and account for one thing the server wrote. Returns the id of
+    /// the request it answered, if any.
+    fn handle(&mut self, output: Output, at: Instant) -> Option<(u64, Value)> {
+        let message = match output {
+            Output::Message(message) => message,
+            Output::Invalid(body) => {
+                let excerpt: String = body.chars().take(80).collect();
+                self.problem(format!("Server wrote output that isn't JSON: {}", excerpt));
+                return None;
+            }
+        };
+        if !message.is_object() {
+            self.problem("Server sent a message that isn't a JSON object".to_string());
+            return None;
+        }
+        if message.get("jsonrpc").and_then(|v| v.as_str()) != Some("2.0") {
+            self.problem("Server sent messages without \"jsonrpc\": \"2.0\"".to_string());
+        }
+
+        if let Some(method) = message.get("method").and_then(|m| m.as_str()) {
+            self.record("response", &message, None);
+            // A server request needs an answer; only ping is supported
+            if let Some(id) = message.get("id") {
+                let reply = if method == "ping" {
+                    json!({"jsonrpc": "2.0", "id": id, "result": {}})
+                } else {
+                    json!({"jsonrpc": "2.0", "id": id,
+                           "error": {"code": -32601, "message": "Method not found"}})
+                };
+                let _ = self.write(&reply);
+            }
+            return None;
+        }
+
+        let id = message.get("id").and_then(|id| id.as_u64());
+        let pending = id.and_then(|id| self.pending.remove(&id));
+        let duration_ms = pending
+            .as_ref()
+            .map(|(_, sent)| at.duration_since(*sent).as_secs_f64() * 1000.0);
+        self.record("response", &message, duration_ms);
+
+        let Some(id) = id.filter(|id| *id < self.next_id) else {
+            self.problem(format!(
+                "Server sent a response to unknown request id {}",
+                message.get("id").unwrap_or(&Value::Null)
+            ));
+            return None;
+        };
+        // A late response to a request that already timed out
+        let (key, _) = pending?;
+        let is_error = message.get("error").is_some();
+        if !is_error && message.get("result").is_none() {
+            self.problem(format!("Response to {} has neither result nor error", key));
+        }
+        let stats = self.stats(&key);
+        stats.durations.extend(duration_ms);
+        if is_error {
+            stats.errors += 1;
+        }
+        Some((id, message))
+    }
+
+    /// Handle output until `deadline`; false once the server has closed its
+    /// stdout.
+    fn pump(&mut self, deadline: Instant) -> bool {
+        while let Some(remaining) = deadline.checked_duration_since(Instant::now()) {
+            match self.output.recv_timeout(remaining) {
+                Ok((output, at)) => {
+                    self.handle(output, at);
+                }
+                Err(RecvTimeoutError::Timeout) => break,
+                Err(RecvTimeoutError::Disconnected) => {
+                    self.closed = true;
+                    return false;
+                }
+            }
+        }
+        !self.closed
+    }
+
+    /// Wait up to `timeout` for the response to `id`.
+    fn wait_for(&mut self, id: u64, timeout: Duration) -> Option<Value> {
+        let deadline = Instant::now() + timeout;
+        while let Some(remaining) = deadline.checked_duration_since(Instant::now()) {
+            match self.output.recv_timeout(remaining) {
+                Ok((output, at)) => match self.handle(output, at) {
+                    Some((answered, message)) if answered == id => return Some(message),
+                    _ => {}
+                },
+                Err(RecvTimeoutError::Timeout) => break,
+                Err(RecvTimeoutError::Disconnected) => {
+                    self.closed = true;
+                    break;
+                }
+            }
+        }
+        if let Some((key, _)) = self.pending.remove(&id) {
+            if !self.closed {
+                self.problem(format!("{}: no response within {:?}", key, timeout));
+            }
+        }
+        None
+    }
+
+    /// Wait up to `timeout` for every outstanding request.
+    fn drain(&mut self, timeout: Duration) {
+        let deadline = Instant::now() + timeout;
+        while !self.pending.is_empty() && Instant::now() < deadline {
+            if !self.pump(deadline.min(Instant::now() + Duration::from_millis(50))) {
+                break;
+            }
+        }
+    }
+
+    /// Send a request and wait for its result, noting an error response as
+    /// a problem.
+    fn request(&mut self, method: &str, params: Value, timeout: Duration) -> Option<Value> {
+        let id = self
+            .send(method, method, params)
+            .map_err(|e| self.problem(format!("{}: {}", method, e)))
+            .ok()?;
+        let response = self.wait_for(id, timeout)?;
+        match response.get("result") {
+            Some(result) => Some(result.clone()),
+            None => {
+                let error = response.get("error").cloned().unwrap_or(Value::Null);
+                self.problem(format!(
+                    "{} failed: {}",
+                    method,
+                    error
+                        .get("message")
+                        .and_then(|m| m.as_str())
+                        .map(String::from)
+                        .unwrap_or_else(|| error.to_string())
+                ));
+                None
+            }
+        }
+    }
+
+    /// Every item of a paginated list (`tools/list`, `resources/list`).
+    fn list(&mut self, method: &str, key: &str, timeout: Duration) -> Option<Vec<Value>> {
+        let mut items = Vec::new();
+        let mut cursor: Option<String> = None;
+        for _ in 0..MAX_PAGES {
+            let params = match cursor {
+                Some(ref cursor) => json!({ "cursor": cursor }),
+                None => json!({}),
+            };
+            let result = self.request(method, params, timeout)?;
+            match result.get(key).and_then(|v| v.as_array()) {
+                Some(page) => items.extend(page.iter().cloned()),
+                None => {
+                    self.problem(format!("{} result has no {} array", method, key));
+                    return None;
+                }
+            }
+            cursor = result
+                .get("nextCursor")
+                .and_then(|c| c.as_str())
+                .map(String::from);
+            if cursor.is_none() {
+                return Some(items);
+            }
+        }
+        self.problem(format!("{} returned more than {} pages", method, MAX_PAGES));
+        Some(items)
+    }
+
+    fn finish(mut self, mut report: ProbeReport) -> ProbeReport {
+        drop(self.stdin.take());
+        let _ = process::stop(&mut self.child, process::SHUTDOWN_GRACE);
+        if let Some(reader) = self.reader.take() {
+            let _ = reader.join();
+        }
+        // Responses that arrived while the server shut down
+        while let Ok((output, at)) = self.output.try_recv() {
+            self.handle(output, at);
+        }
+        if let Some(mut log) = self.log.take() {
+            let _ = log.flush();
+        }
+
+        report.session_id = self.session_id.clone();
+        report.methods = std::mem::take(&mut self.stats)
+            .into_iter()
+            .map(|(method, stats)| MethodReport {
+                method,
+                calls: stats.calls,
+                errors: stats.errors,
+                unanswered: stats.calls - stats.durations.len() as u64,
+                latency: Latency::of(stats.durations),
+            })
+            .collect();
+        report.problems.append(&mut self.problems);
+        report
+    }
+}
+
+/// Probe the server started by `program`: handshake, list its tools and
+/// resources, then make the tool calls in `options`. The traffic is
+/// appended to `log_file` as a session, so `km report` and `km diff` work
+/// on it.
+pub fn probe(
+    program: &str,
+    args: &[String],
+    options: &ProbeOptions,
+    log_file: Option<&Path>,
+) -> Result<ProbeReport> {
+    let mut client = Client::start(program, args, log_file)?;
+    let mut report = ProbeReport::default();
+    let timeout = options.timeout;
+
+    let initialize = json!({
+        "protocolVersion": PROTOCOL_VERSION,
+        "capabilities": {},
+        "clientInfo": {"name": "km-probe", "version": build_info::VERSION},
+    });
+    let Some(result) = client.request("initialize", initialize, timeout) else {
+        if client.closed {
+            client.problem("Server exited before answering initialize".to_string());
+        }
+        return Ok(client.finish(report));
+    };
+
+    match result.get("protocolVersion").and_then(|v| v.as_str()) {
+        Some(version) => report.protocol_version = Some(version.to_string()),
+        None => client.problem("initialize result has no protocolVersion".to_string()),
+    }
+    match result.pointer("/serverInfo/name").and_then(|n| n.as_str()) {
+        Some(name) => {
+            report.server = Some(
+                match result
+                    .pointer("/serverInfo/version")
+                    .and_then(|v| v.as_str())
+                {
+                    Some(version) => format!("{} {}", name, version),
+                    None => name.to_string(),
+                },
+            )
+        }
+        None => client.problem("initialize result has no serverInfo.name".to_string()),
+    }
+    let capabilities = match result.get("capabilities") {
+        Some(Value::Object(capabilities)) => capabilities.clone(),
+        _ => {
+            client.problem("initialize result has no capabilities object".to_string());
+            Default::default()
+        }
+    };
+    client.notify("notifications/initialized")?;
+
+    let mut listed_tools = false;
+    if capabilities.contains_key("tools") {
+        if let Some(tools) = client.list("tools/list", "tools", timeout) {
+            listed_tools = true;
+            for tool in tools {
+                let Some(name) = tool.get("name").and_then(|n| n.as_str()) else {
+                    client.problem("tools/list returned a tool without a name".to_string());
+                    continue;
+                };
+                if !tool.get("inputSchema").is_some_and(|s| s.is_object()) {
+                    client.problem(format!("Tool {} has no inputSchema object", name));
+                }
+                report.tools.push(name.to_string());
+            }
+        }
+    }
+    if capabilities.contains_key("resources") {
+        report.resources = client
+            .list("resources/list", "resources", timeout)
+            .map(|resources| resources.len());
+    }
+
+    for call in &options.calls {
+        if listed_tools && !report.tools.contains(&call.tool) {
+            client.problem(format!("{} isn't offered by tools/list", call.tool));
+        }
+    }
+
+    if !options.calls.is_empty() && !client.closed {
+        let total = options.count.or_else(|| {
+            options
+                .duration
+                .is_none()
+                .then_some(options.calls.len() as u64)
+        });
+        let interval = (options.rate > 0.0).then(|| Duration::from_secs_f64(1.0 / options.rate));
+        let started = Instant::now();
+        let mut sent = 0u64;
+        loop {
+            if total.is_some_and(|total| sent >= total)
+                || options.duration.is_some_and(|d| started.elapsed() >= d)
+            {
+                break;
+            }
+            let call = &options.calls[sent as usize % options.calls.len()];
+            let key = format!("tools/call {}", call.tool);
+            let params = json!({"name": call.tool, "arguments": call.arguments});
+            let id = client.send("tools/call", &key, params)?;
+            sent += 1;
+            match interval {
+                Some(interval) => {
+                    if !client.pump(started + interval.mul_f64(sent as f64)) {
+                        break;
+                    }
+                }
+                None => {
+                    client.wait_for(id, timeout);
+                    if client.closed {
+                        break;
+                    }
+                }
+            }
+        }
+        report.tool_calls = sent;
+        report.elapsed_secs = started.elapsed().as_secs_f64();
+        client.drain(timeout);
+        let late: Vec<String> = client
+            .pending
+            .values()
+            .map(|(key, _)| key.clone())
+            .collect();
+        for key in late {
+            client.problem(format!("{}: no response within {:?}", key, timeout));
+        }
+    }
+
+    if client.closed {
+        client.problem("Server exited before the probe finished".to_string());
+    }
+    Ok(client.finish(report))
+}
@@ -0,0 +1,271 @@
+//! Starting and stopping MCP server processes the same way on every
+//! platform.
+//!
+//! Servers get a chance to shut down cleanly before they're killed: SIGTERM
+//! on Unix, CTRL_BREAK on Windows (where each server runs in its own process
+//! group so the event reaches it and not km). On Windows the server is also
+//! placed in a job object, so anything it started dies with km even when
+//! km itself is killed.
+
+use std::io;
+use std::process::{Child, Command, ExitStatus};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// How long a server gets to exit after being asked before it's killed
+pub const SHUTDOWN_GRACE: Duration = Duration::from_secs(5);
+
+/// How often a stopping server is checked for having exited
+const EXIT_POLL: Duration = Duration::from_millis(20);
+
+/// A command for `program` set up so `stop` can shut it down gracefully.
+pub fn command(program: &str, args: &[String]) -> Command {
+    let mut command = Command::new(program);
+    command.args(args);
+    platform::configure(&mut command);
+    command
+}
+
+/// Ask a process to exit without forcing it.
+pub fn interrupt(child: &Child) -> io::Result<()> {
+    platform::interrupt(child)
+}
+
+/// Ask `child` to exit, then kill it if it's still running after `grace`.
+pub fn stop(child: &mut Child, grace: Duration) -> io::Result<ExitStatus> {
+    if let Some(status) = child.try_wait()? {
+        return Ok(status);
+    }
+    if let Err(e) = interrupt(child) {
+        tracing::debug!("Could not interrupt process {}: {}", child.id(), e);
+    }
+    if let Some(status) = wait_timeout(child, grace)? {
+        return Ok(status);
+    }
+    tracing::warn!(
+        "Process {} did not exit within {:?}; killing it",
+        child.id(),
+        grace
+    );
+    child.kill()?;
+    child.wait()
+}
+
+/// Wait up to `timeout` for `child` to exit.
+pub fn wait_timeout(child: &mut Child, timeout: Duration) -> io::Result<Option<ExitStatus>> {
+    let deadline = Instant::now() + timeout;
+    loop {
+        if let Some(status) = child.try_wait()? {
+            return Ok(Some(status));
+        }
+        if Instant::now() >= deadline {
+            return Ok(None);
+        }
+        thread::sleep(EXIT_POLL);
+    }
+}
+
+/// Ties a server's lifetime to km's: on Windows anything left in the job
+/// object is killed when the guard is dropped or km exits. On Unix there's
+/// nothing to hold, and servers are stopped explicitly.
+pub struct ProcessGuard {
+    #[cfg(windows)]
+    job: platform::Job,
+}
+
+impl ProcessGuard {
+    pub fn attach(child: &Child) -> io::Result<Self> {
+        #[cfg(windows)]
+        {
+            Ok(Self {
+                job: platform::Job::attach(child)?,
+            })
+        }
+        #[cfg(not(windows))]
+        {
+            let _ = child;
+            Ok(Self {})
+        }
+    }
+}
+
+impl std::fmt::Debug for ProcessGuard {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ProcessGuard").finish_non_exhaustive()
+    }
+}
+
+/// Set when km has been asked to shut down; the proxy then stops the
+/// server gracefully instead of waiting for the client to hang up.
+#[derive(Debug, Clone, Default)]
+pub struct StopSignal(Arc<AtomicBool>);
+
+impl StopSignal {
+    pub fn request(&self) {
+        self.0.store(true, Ordering::SeqCst);
+    }
+
+    pub fn is_requested(&self) -> bool {
+        self.0.load(Ordering::SeqCst)
+    }
+}
+
+/// Whether a process with this id is running.
+pub fn is_running(pid: u32) -> bool {
+    platform::is_running(pid)
+}
+
+/// Resolves when km is asked to shut down: Ctrl-C everywhere, SIGTERM on
+/// Unix, Ctrl-Break and closing the console window on Windows.
+pub async fn shutdown_requested() -> io::Result<&'static str> {
+    platform::shutdown_requested().await
+}
+
+#[cfg(unix)]
+mod platform {
+    use std::io;
+    use std::process::{Child, Command};
+    use tokio::signal::unix::{signal, SignalKind};
+
+    /// Servers stay in km's process group, so a Ctrl-C in the terminal
+    /// reaches them as it always has.
+    pub fn configure(_command: &mut Command) {}
+
+    pub fn interrupt(child: &Child) -> io::Result<()> {
+        let pid = libc::pid_t::try_from(child.id()).map_err(io::Error::other)?;
+        // SAFETY: kill has no memory safety requirements
+        if unsafe { libc::kill(pid, libc::SIGTERM) } == 0 {
+            Ok(())
+        } else {
+            Err(io::Error::last_os_error())
+        }
+    }
+
+    pub fn is_running(pid: u32) -> bool {
+        // 0 and negative ids would address process groups
+        let Some(pid) = libc::pid_t::try_from(pid).ok().filter(|&pid| pid > 0) else {
+            return false;
+        };
+        // SAFETY: signal 0 only checks that the process exists
+        let found = unsafe { libc::kill(pid, 0) } == 0;
+        found || io::Error::last_os_error().raw_os_error() == Some(libc::EPERM)
+    }
+
+    pub async fn shutdown_requested() -> io::Result<&'static str> {
+        let mut terminate = signal(SignalKind::terminate())?;
+        let mut hangup = signal(SignalKind::hangup())?;
+        tokio::select! {
+            result = tokio::signal::ctrl_c() => result.map(|_| "Ctrl-C"),
+            _ = terminate.recv() => Ok("SIGTERM"),
+            _ = hangup.recv() => Ok("SIGHUP"),
+        }
+    }
+}
+
+#[cfg(windows)]
+mod platform {
+    use std::io;
+    use std::os::windows::io::AsRawHandle;
+    use std::os::windows::process::CommandExt;
+    use std::process::{Child, Command};
+    use windows_sys::Win32::Foundation::{CloseHandle, HANDLE, STILL_ACTIVE};
+    use windows_sys::Win32::System::Console::{GenerateConsoleCtrlEvent, CTRL_BREAK_EVENT};
+    use windows_sys::Win32::System::JobObjects::{
+        AssignProcessToJobObject, CreateJobObjectW, JobObjectExtendedLimitInformation,
+        SetInformationJobObject, JOBOBJECT_EXTENDED_LIMIT_INFORMATION,
+        JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+    };
+    use windows_sys::Win32::System::Threading::{
+        GetExitCodeProcess, OpenProcess, CREATE_NEW_PROCESS_GROUP,
+        PROCESS_QUERY_LIMITED_INFORMATION,
+    };
+
+    /// A process group of its own lets CTRL_BREAK be sent to the server
+    /// without also reaching km.
+    pub fn configure(command: &mut Command) {
+        command.creation_flags(CREATE_NEW_PROCESS_GROUP);
+    }
+
+    pub fn interrupt(child: &Child) -> io::Result<()> {
+        // SAFETY: plain FFI call; the group id is the server's process id
+        if unsafe { GenerateConsoleCtrlEvent(CTRL_BREAK_EVENT, child.id()) } != 0 {
+            Ok(())
+        } else {
+            Err(io::Error::last_os_error())
+        }
+    }
+
+    pub fn is_running(pid: u32) -> bool {
+        // SAFETY: plain FFI call; a null handle means no such process
+        let handle = unsafe { OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, 0, pid) };
+        if handle.is_null() {
+            return false;
+        }
+        let mut code = 0;
+        // SAFETY: the handle is open and `code` outlives the call
+        let running =
+            unsafe { GetExitCodeProcess(handle, &mut code) } != 0 && code == STILL_ACTIVE as u32;
+        // SAFETY: the handle came from OpenProcess and is closed once
+        unsafe { CloseHandle(handle) };
+        running
+    }
+
+    pub async fn shutdown_requested() -> io::Result<&'static str> {
+        let mut ctrl_break = tokio::signal::windows::ctrl_break()?;
+        let mut ctrl_close = tokio::signal::windows::ctrl_close()?;
+        tokio::select! {
+            result = tokio::signal::ctrl_c() => result.map(|_| "Ctrl-C"),
+            _ = ctrl_break.recv() => Ok("Ctrl-Break"),
+            _ = ctrl_close.recv() => Ok("console close"),
+        }
+    }
+
+    /// A job object that kills every process in it when its last handle
+    /// is closed.
+    pub struct Job(HANDLE);
+
+    // SAFETY: a job handle may be used and closed from any thread
+    unsafe impl Send for Job {}
+    unsafe impl Sync for Job {}
+
+    impl Job {
+        pub fn attach(child: &Child) -> io::Result<Self> {
+            // SAFETY: null attributes and name create an anonymous job
+            let handle = unsafe { CreateJobObjectW(std::ptr::null(), std::ptr::null()) };
+            if handle.is_null() {
+                return Err(io::Error::last_os_error());
+            }
+            let job = Job(handle);
+
+            // SAFETY: the struct is plain data, so all zeroes is valid
+            let mut limits: JOBOBJECT_EXTENDED_LIMIT_INFORMATION = unsafe { std::mem::zeroed() };
+            limits.BasicLimitInformation.LimitFlags = JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE;
+            // SAFETY: the pointer and size describe `limits`, which outlives the call
+            let set = unsafe {
+                SetInformationJobObject(
+                    job.0,
+                    JobObjectExtendedLimitInformation,
+                    &limits as *const _ as *const _,
+                    std::mem::size_of::<JOBOBJECT_EXTENDED_LIMIT_INFORMATION>() as u32,
+                )
+            };
+            if set == 0 {
+                return Err(io::Error::last_os_error());
+            }
+            // SAFETY: both handles are open for the duration of the call
+            if unsafe { AssignProcessToJobObject(job.0, child.as_raw_handle() as HANDLE) } == 0 {
+                return Err(io::Error::last_os_error());
+            }
+            Ok(job)
+        }
+    }
+
+    impl Drop for Job {
+        fn drop(&mut self) {
+            // SAFETY: the handle came from CreateJobObjectW and is closed once
+            unsafe { CloseHandle(self.0) };
+        }
+    }
+}
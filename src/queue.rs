@@ -0,0 +1,107 @@
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant};
+use tokio::sync::mpsc::{self, error::TrySendError};
+
+/// How often a full queue is re-checked while the producer waits
+const RETRY_INTERVAL: Duration = Duration::from_millis(5);
+
+/// Delivery counters for one queue.
+#[derive(Debug, Default)]
+pub struct QueueStats {
+    sent: AtomicU64,
+    delayed: AtomicU64,
+    dropped: AtomicU64,
+}
+
+impl QueueStats {
+    pub fn sent(&self) -> u64 {
+        self.sent.load(Ordering::Relaxed)
+    }
+
+    /// Items that had to wait for room in the queue
+    pub fn delayed(&self) -> u64 {
+        self.delayed.load(Ordering::Relaxed)
+    }
+
+    /// Items given up on after waiting `max_wait`
+    pub fn dropped(&self) -> u64 {
+        self.dropped.load(Ordering::Relaxed)
+    }
+}
+
+/// Producer side of a bounded queue from the proxy threads to an async
+/// consumer (uploader, exporter). When the consumer falls behind, `push`
+/// blocks the calling thread, and with it the pipe it reads from, rather
+/// than letting memory grow. Only if the queue stays full for `max_wait`
+/// is the item dropped, and counted.
+#[derive(Debug)]
+pub struct BoundedQueue<T> {
+    tx: mpsc::Sender<T>,
+    max_wait: Duration,
+    stats: Arc<QueueStats>,
+}
+
+impl<T> Clone for BoundedQueue<T> {
+    fn clone(&self) -> Self {
+        Self {
+            tx: self.tx.clone(),
+            max_wait: self.max_wait,
+            stats: self.stats.clone(),
+        }
+    }
+}
+
+pub fn bounded<T>(capacity: usize, max_wait: Duration) -> (BoundedQueue<T>, mpsc::Receiver<T>) {
+    let (tx, rx) = mpsc::channel(capacity.max(1));
+    let queue = BoundedQueue {
+        tx,
+        max_wait,
+        stats: Arc::new(QueueStats::default()),
+    };
+    (queue, rx)
+}
+
+impl<T> BoundedQueue<T> {
+    /// Queue `item`, waiting for room if necessary. Must not be called from
+    /// an async task. Returns false if the item was dropped or the consumer
+    /// is gone.
+    pub fn push(&self, item: T) -> bool {
+        let mut item = match self.tx.try_send(item) {
+            Ok(()) => {
+                self.stats.sent.fetch_add(1, Ordering::Relaxed);
+                return true;
+            }
+            Err(TrySendError::Closed(_)) => return false,
+            Err(TrySendError::Full(item)) => item,
+        };
+
+        self.stats.delayed.fetch_add(1, Ordering::Relaxed);
+        let deadline = Instant::now() + self.max_wait;
+        loop {
+            thread::sleep(RETRY_INTERVAL);
+            item = match self.tx.try_send(item) {
+                Ok(()) => {
+                    self.stats.sent.fetch_add(1, Ordering::Relaxed);
+                    return true;
+                }
+                Err(TrySendError::Closed(_)) => return false,
+                Err(TrySendError::Full(item)) => item,
+            };
+            if Instant::now() >= deadline {
+                if self.stats.dropped.fetch_add(1, Ordering::Relaxed) == 0 {
+                    tracing::warn!(
+                        "Queue stayed full for {:?}; dropping items until it drains",
+                        self.max_wait
+                    );
+                }
+                return false;
+            }
+        }
+    }
+
+    pub fn stats(&self) -> Arc<QueueStats> {
+        self.stats.clone()
+    }
+}
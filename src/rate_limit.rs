@@ -0,0 +1,152 @@
+//! Pacing of requests to the Kilometers API: a token bucket sized from the
+//! rate limit the API advertises, `Retry-After` on 429 and 503 answers, and
+//! jittered exponential backoff so many km instances don't retry in step.
+
+use chrono::{DateTime, Utc};
+use reqwest::header::{HeaderMap, RETRY_AFTER};
+use reqwest::StatusCode;
+use serde::{Deserialize, Serialize};
+use std::sync::Mutex;
+use std::time::Duration;
+use tokio::time::Instant;
+
+/// Longest km waits on one `Retry-After` before giving up on the request
+pub const MAX_RETRY_WAIT: Duration = Duration::from_secs(60);
+
+/// The request budget the API advertises in its version document.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct RateLimit {
+    pub requests_per_minute: u32,
+    /// Requests that may go out back to back after a quiet spell; a
+    /// second's worth when unset
+    #[serde(default)]
+    pub burst: Option<u32>,
+}
+
+impl RateLimit {
+    fn capacity(&self) -> u32 {
+        self.burst.unwrap_or(self.requests_per_minute / 60).max(1)
+    }
+}
+
+/// The API is asking km to slow down rather than failing the request.
+pub fn is_throttled(status: StatusCode) -> bool {
+    status == StatusCode::TOO_MANY_REQUESTS || status == StatusCode::SERVICE_UNAVAILABLE
+}
+
+/// How long a response's `Retry-After` asks km to wait, given in seconds
+/// or as an HTTP date. A date in the past means now.
+pub fn retry_after(headers: &HeaderMap, now: DateTime<Utc>) -> Option<Duration> {
+    let value = headers.get(RETRY_AFTER)?.to_str().ok()?.trim();
+    if let Ok(seconds) = value.parse::<u64>() {
+        return Some(Duration::from_secs(seconds));
+    }
+    let at = DateTime::parse_from_rfc2822(value).ok()?;
+    Some(
+        (at.with_timezone(&Utc) - now)
+            .to_std()
+            .unwrap_or(Duration::ZERO),
+    )
+}
+
+/// Exponential backoff with jitter.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Backoff {
+    /// Ceiling of the first wait
+    pub base: Duration,
+    /// No wait is longer than this
+    pub max: Duration,
+}
+
+impl Backoff {
+    /// The wait before retry number `attempt` (from 0): half of
+    /// `base * 2^attempt`, capped at `max`, plus a random share of the
+    /// other half.
+    pub fn delay(&self, attempt: u32) -> Duration {
+        let factor = 1u32.checked_shl(attempt.min(31)).unwrap_or(u32::MAX);
+        let ceiling = self.base.saturating_mul(factor).min(self.max);
+        ceiling / 2 + (ceiling / 2).mul_f64(fastrand::f64())
+    }
+}
+
+#[derive(Debug)]
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+    /// Set by a `Retry-After`; nothing goes out before it
+    paused_until: Option<Instant>,
+}
+
+/// Paces the requests of every uploader that shares it. Without an
+/// advertised rate limit it only holds requests back for `Retry-After`.
+#[derive(Debug)]
+pub struct RateLimiter {
+    /// Tokens added per second and the most the bucket holds
+    rate: Option<(f64, f64)>,
+    bucket: Mutex<Bucket>,
+}
+
+impl Default for RateLimiter {
+    fn default() -> Self {
+        Self::new(None)
+    }
+}
+
+impl RateLimiter {
+    pub fn new(limit: Option<&RateLimit>) -> Self {
+        let rate = limit
+            .filter(|limit| limit.requests_per_minute > 0)
+            .map(|limit| {
+                (
+                    f64::from(limit.requests_per_minute) / 60.0,
+                    f64::from(limit.capacity()),
+                )
+            });
+        Self {
+            rate,
+            bucket: Mutex::new(Bucket {
+                tokens: rate.map_or(0.0, |(_, capacity)| capacity),
+                updated: Instant::now(),
+                paused_until: None,
+            }),
+        }
+    }
+
+    /// Take a token if one is free; otherwise how long until one is.
+    pub fn try_acquire(&self) -> Result<(), Duration> {
+        let now = Instant::now();
+        let mut bucket = self.bucket.lock().unwrap_or_else(|e| e.into_inner());
+        if let Some(until) = bucket.paused_until.filter(|until| *until > now) {
+            return Err(until - now);
+        }
+        let Some((per_second, capacity)) = self.rate else {
+            return Ok(());
+        };
+        let elapsed = now.saturating_duration_since(bucket.updated).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * per_second).min(capacity);
+        bucket.updated = now;
+        if bucket.tokens >= 1.0 {
+            bucket.tokens -= 1.0;
+            Ok(())
+        } else {
+            Err(Duration::from_secs_f64((1.0 - bucket.tokens) / per_second))
+        }
+    }
+
+    /// Wait for a token.
+    pub async fn acquire(&self) {
+        while let Err(wait) = self.try_acquire() {
+            tokio::time::sleep(wait).await;
+        }
+    }
+
+    /// Hold every request back for `wait`, as a `Retry-After` asked.
+    pub fn pause(&self, wait: Duration) {
+        let until = Instant::now() + wait;
+        let mut bucket = self.bucket.lock().unwrap_or_else(|e| e.into_inner());
+        if bucket.paused_until.is_none_or(|paused| paused < until) {
+            bucket.paused_until = Some(until);
+        }
+    }
+}
@@ -0,0 +1,319 @@
+use anyhow::{Context, Result};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+
+/// A user-defined redaction rule. Exactly one of `pattern` (a regex applied
+/// to every string) or `json_path` (a node selector) should be set.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RedactionRuleConfig {
+    pub name: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pattern: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub json_path: Option<String>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RedactionConfig {
+    #[serde(default)]
+    pub enabled: bool,
+    /// Include the built-in patterns (API keys, emails, SSNs, private keys)
+    #[serde(default = "default_true")]
+    pub builtin_patterns: bool,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<RedactionRuleConfig>,
+}
+
+fn default_true() -> bool {
+    true
+}
+
+impl Default for RedactionConfig {
+    fn default() -> Self {
+        Self {
+            enabled: false,
+            builtin_patterns: true,
+            rules: Vec::new(),
+        }
+    }
+}
+
+impl RedactionConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+const BUILTIN_PATTERNS: &[(&str, &str)] = &[
+    (
+        "private_key",
+        r"-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----",
+    ),
+    (
+        "api_key",
+        r"\b(AKIA[0-9A-Z]{16}|ghp_[A-Za-z0-9]{36}|xox[abprs]-[A-Za-z0-9-]{10,}|sk-[A-Za-z0-9_-]{20,}|km_[A-Za-z0-9_]{16,})\b",
+    ),
+    ("bearer_token", r"(?i)\bbearer\s+[A-Za-z0-9._~+/-]{16,}=*"),
+    (
+        "email",
+        r"\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b",
+    ),
+    ("ssn", r"\b\d{3}-\d{2}-\d{4}\b"),
+];
+
+#[derive(Debug, Clone, PartialEq)]
+enum PathSegment {
+    Key(String),
+    Index(usize),
+    Wildcard,
+    /// `..key`: match `key` at any depth
+    Descendant(String),
+}
+
+/// Parse the JSONPath subset used by redaction rules: `$.a.b`, `$.a[0]`,
+/// `$.a[*].b` and `$..key`.
+fn parse_json_path(path: &str) -> Result<Vec<PathSegment>> {
+    let rest = path
+        .strip_prefix('$')
+        .with_context(|| format!("JSONPath '{}' must start with '$'", path))?;
+    let mut segments = Vec::new();
+    let mut chars = rest.chars().peekable();
+
+    let read_name = |chars: &mut std::iter::Peekable<std::str::Chars>| {
+        let mut name = String::new();
+        while let Some(&c) = chars.peek() {
+            if c == '.' || c == '[' {
+                break;
+            }
+            name.push(c);
+            chars.next();
+        }
+        name
+    };
+
+    while let Some(c) = chars.next() {
+        match c {
+            '.' if chars.peek() == Some(&'.') => {
+                chars.next();
+                let name = read_name(&mut chars);
+                if name.is_empty() {
+                    return Err(anyhow::anyhow!("Empty key after '..' in '{}'", path));
+                }
+                segments.push(PathSegment::Descendant(name));
+            }
+            '.' => {
+                let name = read_name(&mut chars);
+                match name.as_str() {
+                    "" => return Err(anyhow::anyhow!("Empty key in JSONPath '{}'", path)),
+                    "*" => segments.push(PathSegment::Wildcard),
+                    _ => segments.push(PathSegment::Key(name)),
+                }
+            }
+            '[' => {
+                let mut inner = String::new();
+                for c in chars.by_ref() {
+                    if c == ']' {
+                        break;
+                    }
+                    inner.push(c);
+                }
+                let inner = inner.trim().trim_matches(|c| c == '\'' || c == '"');
+                if inner == "*" {
+                    segments.push(PathSegment::Wildcard);
+                } else if let Ok(index) = inner.parse() {
+                    segments.push(PathSegment::Index(index));
+                } else if !inner.is_empty() {
+                    segments.push(PathSegment::Key(inner.to_string()));
+                } else {
+                    return Err(anyhow::anyhow!("Empty brackets in JSONPath '{}'", path));
+                }
+            }
+            other => {
+                return Err(anyhow::anyhow!(
+                    "Unexpected '{}' in JSONPath '{}'",
+                    other,
+                    path
+                ))
+            }
+        }
+    }
+
+    Ok(segments)
+}
+
+/// Replace every node selected by `segments` with `replacement`, returning
+/// how many nodes were replaced.
+fn replace_path(value: &mut Value, segments: &[PathSegment], replacement: &str) -> u64 {
+    let (segment, rest) = match segments.split_first() {
+        Some(split) => split,
+        None => {
+            *value = Value::String(replacement.to_string());
+            return 1;
+        }
+    };
+
+    match segment {
+        PathSegment::Key(key) => value
+            .get_mut(key.as_str())
+            .map(|child| replace_path(child, rest, replacement))
+            .unwrap_or(0),
+        PathSegment::Index(index) => value
+            .get_mut(*index)
+            .map(|child| replace_path(child, rest, replacement))
+            .unwrap_or(0),
+        PathSegment::Wildcard => match value {
+            Value::Object(map) => map
+                .values_mut()
+                .map(|child| replace_path(child, rest, replacement))
+                .sum(),
+            Value::Array(items) => items
+                .iter_mut()
+                .map(|child| replace_path(child, rest, replacement))
+                .sum(),
+            _ => 0,
+        },
+        PathSegment::Descendant(key) => {
+            let mut count = 0;
+            match value {
+                Value::Object(map) => {
+                    for (name, child) in map.iter_mut() {
+                        if name == key {
+                            count += replace_path(child, rest, replacement);
+                        } else {
+                            count += replace_path(child, segments, replacement);
+                        }
+                    }
+                }
+                Value::Array(items) => {
+                    for child in items.iter_mut() {
+                        count += replace_path(child, segments, replacement);
+                    }
+                }
+                _ => {}
+            }
+            count
+        }
+    }
+}
+
+#[derive(Debug)]
+enum Matcher {
+    Pattern(Regex),
+    JsonPath(Vec<PathSegment>),
+}
+
+#[derive(Debug)]
+struct Rule {
+    name: String,
+    matcher: Matcher,
+}
+
+/// Scrubs sensitive data from payloads before they are sent to the API.
+/// Keeps a running count of how often each rule fired.
+#[derive(Debug)]
+pub struct Redactor {
+    rules: Vec<Rule>,
+    counts: Mutex<BTreeMap<String, u64>>,
+}
+
+impl Redactor {
+    pub fn from_config(config: &RedactionConfig) -> Result<Self> {
+        let mut rules = Vec::new();
+
+        if config.builtin_patterns {
+            for (name, pattern) in BUILTIN_PATTERNS {
+                rules.push(Rule {
+                    name: name.to_string(),
+                    matcher: Matcher::Pattern(Regex::new(pattern)?),
+                });
+            }
+        }
+
+        for rule in &config.rules {
+            let matcher = match (&rule.pattern, &rule.json_path) {
+                (Some(pattern), None) => Matcher::Pattern(
+                    Regex::new(pattern)
+                        .with_context(|| format!("Invalid pattern in rule '{}'", rule.name))?,
+                ),
+                (None, Some(path)) => Matcher::JsonPath(
+                    parse_json_path(path)
+                        .with_context(|| format!("Invalid json_path in rule '{}'", rule.name))?,
+                ),
+                _ => {
+                    return Err(anyhow::anyhow!(
+                        "Redaction rule '{}' must set exactly one of pattern or json_path",
+                        rule.name
+                    ))
+                }
+            };
+            rules.push(Rule {
+                name: rule.name.clone(),
+                matcher,
+            });
+        }
+
+        Ok(Self {
+            rules,
+            counts: Mutex::new(BTreeMap::new()),
+        })
+    }
+
+    fn record(&self, rule: &str, hits: u64) {
+        if hits == 0 {
+            return;
+        }
+        if let Ok(mut counts) = self.counts.lock() {
+            *counts.entry(rule.to_string()).or_insert(0) += hits;
+        }
+    }
+
+    fn placeholder(rule: &str) -> String {
+        format!("[REDACTED:{}]", rule)
+    }
+
+    /// Apply the regex rules to a single string.
+    pub fn redact_str(&self, input: &str) -> String {
+        let mut output = input.to_string();
+        for rule in &self.rules {
+            if let Matcher::Pattern(ref regex) = rule.matcher {
+                let hits = regex.find_iter(&output).count() as u64;
+                if hits > 0 {
+                    output = regex
+                        .replace_all(&output, Self::placeholder(&rule.name).as_str())
+                        .into_owned();
+                    self.record(&rule.name, hits);
+                }
+            }
+        }
+        output
+    }
+
+    /// Apply JSONPath rules, then the regex rules to every remaining string
+    /// (object keys are left alone).
+    pub fn redact_value(&self, value: &mut Value) {
+        for rule in &self.rules {
+            if let Matcher::JsonPath(ref segments) = rule.matcher {
+                let hits = replace_path(value, segments, &Self::placeholder(&rule.name));
+                self.record(&rule.name, hits);
+            }
+        }
+        self.redact_strings(value);
+    }
+
+    fn redact_strings(&self, value: &mut Value) {
+        match value {
+            Value::String(s) => *s = self.redact_str(s),
+            Value::Array(items) => items.iter_mut().for_each(|v| self.redact_strings(v)),
+            Value::Object(map) => map.values_mut().for_each(|v| self.redact_strings(v)),
+            _ => {}
+        }
+    }
+
+    /// Number of redactions performed so far, per rule.
+    pub fn counts(&self) -> BTreeMap<String, u64> {
+        self.counts.lock().map(|c| c.clone()).unwrap_or_default()
+    }
+}
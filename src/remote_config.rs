@@ -0,0 +1,304 @@
+//! Team-wide settings from a remote config layer. An admin publishes a
+//! signed layer of settings (filters, policies, sinks, ...) on the
+//! Kilometers API or any HTTPS server; km fetches it, checks the signature
+//! against `remote_config.trusted_keys` and caches it next to the config
+//! file, so it still applies offline.
+//!
+//! The layer sits below the config file: a setting in the file (or in the
+//! selected profile, the environment or the credential store) wins over
+//! the same setting in the layer. Loading a config never touches the
+//! network; `km monitor` refreshes the cache when it starts and every
+//! `remote_config.refresh_minutes` while it runs.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::errors::{Code, KmError};
+use crate::plugins::verify::TrustedKeys;
+
+/// `remote_config.source` for the layer on the configured Kilometers API
+pub const API_SOURCE: &str = "api";
+pub const DEFAULT_REFRESH_MINUTES: u64 = 60;
+
+/// Settings a remote layer can't set: they say where the layer comes from
+/// and who the user is
+const LOCAL_ONLY: &[&str] = &["version", "api_key", "remote_config"];
+
+/// How long a fetch may take before the cached layer is used instead
+const FETCH_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Where to fetch the team's layer from and whose signature it needs.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RemoteConfigSettings {
+    /// `api` for the Kilometers API, or an http(s) URL serving the layer
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub source: Option<String>,
+    /// Base64 Ed25519 public keys; the layer must be signed by one of them
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub trusted_keys: Vec<String>,
+    /// How often a running `km monitor` fetches the layer again
+    #[serde(
+        default = "default_refresh_minutes",
+        skip_serializing_if = "is_default_refresh_minutes"
+    )]
+    pub refresh_minutes: u64,
+}
+
+fn default_refresh_minutes() -> u64 {
+    DEFAULT_REFRESH_MINUTES
+}
+
+fn is_default_refresh_minutes(value: &u64) -> bool {
+    *value == DEFAULT_REFRESH_MINUTES
+}
+
+impl Default for RemoteConfigSettings {
+    fn default() -> Self {
+        Self {
+            source: None,
+            trusted_keys: Vec::new(),
+            refresh_minutes: DEFAULT_REFRESH_MINUTES,
+        }
+    }
+}
+
+impl RemoteConfigSettings {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        let Some(ref source) = self.source else {
+            return Ok(());
+        };
+        if source != API_SOURCE
+            && !(source.starts_with("https://") || source.starts_with("http://"))
+        {
+            return Err(anyhow::anyhow!(
+                "remote_config.source must be '{}' or an http(s) URL (got '{}')",
+                API_SOURCE,
+                source
+            ));
+        }
+        if self.trusted_keys.is_empty() {
+            return Err(anyhow::anyhow!(
+                "remote_config.trusted_keys must list the key the layer is signed with"
+            ));
+        }
+        TrustedKeys::from_config(&self.trusted_keys).context("remote_config.trusted_keys")?;
+        if self.refresh_minutes == 0 {
+            return Err(anyhow::anyhow!(
+                "remote_config.refresh_minutes must be greater than 0"
+            ));
+        }
+        Ok(())
+    }
+
+    /// The URL the layer is fetched from, with `api` resolved against
+    /// `api_url`. `None` when no layer is configured.
+    pub fn url(&self, api_url: &str) -> Option<String> {
+        self.source.as_deref().map(|source| match source {
+            API_SOURCE => format!("{}/api/cli/config", api_url.trim_end_matches('/')),
+            url => url.to_string(),
+        })
+    }
+
+    /// Whether fetching needs the user's API token
+    pub fn uses_api(&self) -> bool {
+        self.source.as_deref() == Some(API_SOURCE)
+    }
+
+    pub fn refresh_interval(&self) -> Duration {
+        Duration::from_secs(self.refresh_minutes.max(1) * 60)
+    }
+}
+
+/// A layer as it's served: the settings as JSON text, and a base64 Ed25519
+/// signature over exactly those bytes.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SignedLayer {
+    pub layer: String,
+    pub signature: String,
+}
+
+/// The cache file: the signed layer as fetched, checked again on every load.
+#[derive(Debug, Serialize, Deserialize)]
+struct CachedLayer {
+    /// URL it was fetched from
+    source: String,
+    fetched_at: DateTime<Utc>,
+    #[serde(flatten)]
+    signed: SignedLayer,
+}
+
+/// A verified layer.
+#[derive(Debug, Clone)]
+pub struct Layer {
+    /// URL it was fetched from
+    pub source: String,
+    pub fetched_at: DateTime<Utc>,
+    /// The settings it sets, in config file form
+    pub settings: Value,
+}
+
+/// Where the layer for the config file at `config_path` is cached, e.g.
+/// `km_config.remote.json` next to `km_config.json`.
+pub fn cache_path(config_path: &Path) -> PathBuf {
+    let stem = config_path
+        .file_stem()
+        .map(|stem| stem.to_string_lossy().into_owned())
+        .unwrap_or_else(|| "km_config".to_string());
+    config_path.with_file_name(format!("{}.remote.json", stem))
+}
+
+/// Check the signature on `signed` and return the settings it holds,
+/// without the ones a layer can't set.
+pub fn verify(signed: &SignedLayer, keys: &TrustedKeys) -> Result<Value> {
+    if keys.is_empty() || !keys.verifies(signed.layer.as_bytes(), &signed.signature) {
+        return Err(anyhow::anyhow!(
+            "The remote config layer isn't signed by a key in remote_config.trusted_keys"
+        ));
+    }
+    let mut settings: Value =
+        serde_json::from_str(&signed.layer).context("Invalid remote config layer")?;
+    let Value::Object(ref mut object) = settings else {
+        return Err(anyhow::anyhow!(
+            "The remote config layer must be a JSON object of settings"
+        ));
+    };
+    for key in LOCAL_ONLY {
+        if object.remove(*key).is_some() {
+            tracing::debug!("Ignoring '{}' in the remote config layer", key);
+        }
+    }
+    Ok(settings)
+}
+
+/// The cached layer for the config file at `config_path`, if `settings`
+/// name one and the cache holds a verified copy from the same source.
+/// Problems with the cache are logged, not returned: the config still loads
+/// without the layer.
+pub fn cached_layer(
+    config_path: &Path,
+    settings: &RemoteConfigSettings,
+    api_url: &str,
+) -> Option<Layer> {
+    let url = settings.url(api_url)?;
+    let path = cache_path(config_path);
+    let contents = fs::read_to_string(&path).ok()?;
+    let loaded = serde_json::from_str::<CachedLayer>(&contents)
+        .with_context(|| format!("Invalid remote config cache {:?}", path))
+        .and_then(|cached| {
+            let keys = TrustedKeys::from_config(&settings.trusted_keys)?;
+            let layer = verify(&cached.signed, &keys)?;
+            Ok((cached, layer))
+        });
+    match loaded {
+        Ok((cached, _)) if cached.source != url => {
+            tracing::debug!(
+                "Ignoring the remote config cached from {} (now {})",
+                cached.source,
+                url
+            );
+            None
+        }
+        Ok((cached, layer)) => Some(Layer {
+            source: cached.source,
+            fetched_at: cached.fetched_at,
+            settings: layer,
+        }),
+        Err(e) => {
+            tracing::warn!("Ignoring the cached remote config: {:#}", e);
+            None
+        }
+    }
+}
+
+/// Whether the cached layer is missing or older than the refresh interval.
+pub fn is_stale(config_path: &Path, settings: &RemoteConfigSettings, api_url: &str) -> bool {
+    match cached_layer(config_path, settings, api_url) {
+        Some(layer) => {
+            let age = Utc::now().signed_duration_since(layer.fetched_at);
+            age.to_std()
+                .map_or(false, |age| age >= settings.refresh_interval())
+        }
+        None => true,
+    }
+}
+
+/// The signed layer and signature as cached, for noticing when a refresh
+/// changed it (the fetch time alone changes on every refresh).
+pub fn cache_fingerprint(config_path: &Path) -> Option<String> {
+    let contents = fs::read_to_string(cache_path(config_path)).ok()?;
+    let cached: CachedLayer = serde_json::from_str(&contents).ok()?;
+    Some(format!(
+        "{}\n{}",
+        cached.signed.signature, cached.signed.layer
+    ))
+}
+
+/// Download the signed layer from `url`.
+pub async fn fetch(url: &str, bearer_token: Option<&str>) -> Result<SignedLayer> {
+    crate::offline::ensure_online("Fetching the remote config")?;
+    let mut request = crate::http::client().get(url).timeout(FETCH_TIMEOUT);
+    if let Some(token) = bearer_token {
+        request = request.bearer_auth(token);
+    }
+    let response = request
+        .send()
+        .await
+        .with_context(|| format!("Failed to reach {}", url))?;
+
+    if !response.status().is_success() {
+        let status = response.status();
+        return Err(KmError::new(
+            Code::for_status(status),
+            format!("Remote config request failed with status {}", status),
+        )
+        .into());
+    }
+
+    response
+        .json::<SignedLayer>()
+        .await
+        .context("Failed to parse the remote config layer")
+}
+
+/// Fetch the layer `settings` name, check its signature and cache it for
+/// the config file at `config_path`. A layer that doesn't verify is never
+/// cached, so the last good one stays in effect.
+pub async fn refresh(
+    config_path: &Path,
+    settings: &RemoteConfigSettings,
+    api_url: &str,
+    bearer_token: Option<&str>,
+) -> Result<Layer> {
+    let url = settings
+        .url(api_url)
+        .context("No remote config source is configured")?;
+    let keys = TrustedKeys::from_config(&settings.trusted_keys)?;
+    let signed = fetch(&url, bearer_token).await?;
+    let layer = verify(&signed, &keys)?;
+
+    let cached = CachedLayer {
+        source: url,
+        fetched_at: Utc::now(),
+        signed,
+    };
+    let path = cache_path(config_path);
+    let tmp_path = path.with_extension("json.tmp");
+    fs::write(&tmp_path, serde_json::to_vec_pretty(&cached)?)
+        .with_context(|| format!("Failed to write {:?}", tmp_path))?;
+    fs::rename(&tmp_path, &path).with_context(|| format!("Failed to write {:?}", path))?;
+
+    Ok(Layer {
+        source: cached.source,
+        fetched_at: cached.fetched_at,
+        settings: layer,
+    })
+}
@@ -0,0 +1,396 @@
+use anyhow::{Context, Result};
+use serde_json::Value;
+use std::collections::{HashMap, VecDeque};
+use std::io::{BufRead, BufReader, Write};
+use std::sync::mpsc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use crate::clock;
+use crate::correlation::{self, CorrelatedCall};
+use crate::policy::{Decision, Policy, PolicyMode};
+use crate::process;
+use crate::proxy;
+use crate::risk::{PatternRiskAnalyzer, RiskAssessment, RiskLevel};
+use crate::traffic::TrafficEntry;
+
+/// A client message from a capture, paired with the server response that
+/// was recorded for it (if any).
+#[derive(Debug, Clone)]
+pub struct ReplayStep {
+    /// Time since the first message of the session
+    pub offset: Duration,
+    pub request: TrafficEntry,
+    pub method: Option<String>,
+    pub id: Option<Value>,
+    pub recorded_response: Option<Value>,
+    pub recorded_duration_ms: Option<f64>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum ReplayOutcome {
+    /// Notification or request sent without a response to compare against
+    Sent,
+    Match,
+    Mismatch {
+        expected: Value,
+        actual: Value,
+    },
+    Timeout,
+    /// An enforced policy denied the message, so it wasn't sent
+    Blocked {
+        rule: String,
+        message: String,
+    },
+}
+
+/// What the checks `km monitor` runs on client messages made of one
+/// replayed message.
+#[derive(Debug, Clone)]
+pub struct Checked {
+    pub risk: RiskAssessment,
+    /// The decision of the policy rule that matched, if one did
+    pub policy: Option<Decision>,
+}
+
+#[derive(Debug, Clone)]
+pub struct ReplayResult {
+    pub step: ReplayStep,
+    pub outcome: ReplayOutcome,
+    pub duration_ms: Option<f64>,
+    pub checked: Checked,
+}
+
+#[derive(Debug, Default)]
+pub struct ReplaySummary {
+    pub sent: usize,
+    pub matched: usize,
+    pub mismatched: usize,
+    pub timed_out: usize,
+    pub blocked: usize,
+    /// Messages the risk analyzer rated high or critical
+    pub high_risk: usize,
+}
+
+impl ReplaySummary {
+    pub fn from_results(results: &[ReplayResult]) -> Self {
+        let mut summary = Self::default();
+        for result in results {
+            match result.outcome {
+                ReplayOutcome::Sent => summary.sent += 1,
+                ReplayOutcome::Match => summary.matched += 1,
+                ReplayOutcome::Mismatch { .. } => summary.mismatched += 1,
+                ReplayOutcome::Timeout => summary.timed_out += 1,
+                ReplayOutcome::Blocked { .. } => summary.blocked += 1,
+            }
+            if result.checked.risk.level >= RiskLevel::High {
+                summary.high_risk += 1;
+            }
+        }
+        summary
+    }
+
+    pub fn is_success(&self) -> bool {
+        self.mismatched == 0 && self.timed_out == 0
+    }
+}
+
+/// The checks `km monitor` runs on each client message before forwarding
+/// it - policy rules, then risk analysis - run on replayed messages.
+#[derive(Debug, Default)]
+pub struct ReplayChecks {
+    analyzer: PatternRiskAnalyzer,
+    policy: Option<Policy>,
+}
+
+impl ReplayChecks {
+    pub fn new(analyzer: PatternRiskAnalyzer, policy: Option<Policy>) -> Self {
+        Self { analyzer, policy }
+    }
+
+    /// Check one step. Returns what the checks found and the message to
+    /// send, rewritten by an enforced policy, or the policy that blocked it.
+    pub fn check(
+        &self,
+        step: &ReplayStep,
+    ) -> (Checked, std::result::Result<String, ReplayOutcome>) {
+        let mut content = step.request.content.clone();
+        let mut policy = None;
+        let mut blocked = None;
+        if let (Some(rules), Some(request)) = (&self.policy, step.request.rpc()) {
+            let decision = rules.evaluate(&request);
+            let enforce = rules.mode() == PolicyMode::Enforce;
+            match decision {
+                Decision::Deny {
+                    ref rule,
+                    ref message,
+                } if enforce => {
+                    blocked = Some(ReplayOutcome::Blocked {
+                        rule: rule.clone(),
+                        message: message.clone(),
+                    });
+                }
+                Decision::Rewrite { ref message, .. } if enforce => content = message.to_string(),
+                _ => {}
+            }
+            policy = decision.rule().is_some().then_some(decision);
+        }
+        let risk = self.analyzer.analyze(step.method.as_deref(), &content);
+        let checked = Checked { risk, policy };
+        match blocked {
+            Some(outcome) => (checked, Err(outcome)),
+            None => (checked, Ok(content)),
+        }
+    }
+}
+
+/// Parse `--speed`: a finite multiplier above zero.
+pub fn parse_speed(value: &str) -> std::result::Result<f64, String> {
+    let speed: f64 = value
+        .parse()
+        .map_err(|_| format!("{} isn't a number", value))?;
+    if !speed.is_finite() || speed <= 0.0 {
+        return Err(format!("{} isn't a speed above 0", value));
+    }
+    Ok(speed)
+}
+
+/// Pick the session to replay: the requested one, or the most recent
+/// session in the capture when none is given.
+pub fn select_session(entries: &[TrafficEntry], session: Option<&str>) -> Option<String> {
+    match session {
+        Some(id) => Some(id.to_string()),
+        None => entries.iter().rev().find_map(|e| e.session_id.clone()),
+    }
+}
+
+/// Rebuild the ordered list of client messages for one session, pairing
+/// each request with its recorded response by JSON-RPC id.
+pub fn build_steps(entries: &[TrafficEntry], session: Option<&str>) -> Vec<ReplayStep> {
+    let session_entries: Vec<&TrafficEntry> = entries
+        .iter()
+        .filter(|e| session.is_none() || e.session_id.as_deref() == session)
+        .collect();
+
+    let start = match session_entries.first() {
+        Some(first) => *first,
+        None => return Vec::new(),
+    };
+
+    let owned: Vec<TrafficEntry> = session_entries.iter().map(|e| (*e).clone()).collect();
+    let mut calls: HashMap<String, VecDeque<CorrelatedCall>> = HashMap::new();
+    for call in correlation::correlate(&owned) {
+        calls
+            .entry(call.id.to_string())
+            .or_default()
+            .push_back(call);
+    }
+
+    session_entries
+        .into_iter()
+        .filter(|e| e.direction == "request")
+        .filter_map(|entry| {
+            let rpc = entry.rpc()?;
+            let id = rpc.get("id").cloned();
+            let call = id
+                .as_ref()
+                .and_then(|id| calls.get_mut(&id.to_string()))
+                .and_then(|queue| queue.pop_front());
+            let (recorded_response, recorded_duration_ms) = call
+                .map(|c| (c.response, c.duration_ms))
+                .unwrap_or((None, None));
+
+            Some(ReplayStep {
+                offset: clock::between(start, entry).to_std().unwrap_or_default(),
+                method: rpc.get("method").and_then(|m| m.as_str()).map(String::from),
+                request: entry.clone(),
+                id,
+                recorded_response,
+                recorded_duration_ms,
+            })
+        })
+        .collect()
+}
+
+/// Compare a recorded response to a live one. Only the `result`/`error`
+/// payloads are compared; ids and envelope fields are ignored.
+pub fn compare_responses(expected: &Value, actual: &Value) -> ReplayOutcome {
+    let pick = |v: &Value| {
+        v.get("result")
+            .cloned()
+            .or_else(|| v.get("error").map(|e| serde_json::json!({ "error": e })))
+            .unwrap_or(Value::Null)
+    };
+
+    if pick(expected) == pick(actual) {
+        ReplayOutcome::Match
+    } else {
+        ReplayOutcome::Mismatch {
+            expected: expected.clone(),
+            actual: actual.clone(),
+        }
+    }
+}
+
+/// Sleep so that `offset` is honoured relative to `started`, scaled by
+/// `speed`. A speed of 0 disables delays entirely.
+fn wait_for_offset(started: Instant, offset: Duration, speed: f64) {
+    if speed.is_nan() || speed <= 0.0 {
+        return;
+    }
+    // Too slow to represent is as good as never
+    let target = Duration::try_from_secs_f64(offset.as_secs_f64() / speed).unwrap_or(Duration::MAX);
+    let elapsed = started.elapsed();
+    if target > elapsed {
+        thread::sleep(target - elapsed);
+    }
+}
+
+/// Replay steps against a live MCP server spawned from `program`, comparing
+/// each response with the one recorded in the capture. Each message goes
+/// through `checks` first, as `km monitor` would put it.
+pub fn replay_against_server(
+    steps: &[ReplayStep],
+    program: &str,
+    args: &[String],
+    speed: f64,
+    timeout: Duration,
+    checks: &ReplayChecks,
+) -> Result<Vec<ReplayResult>> {
+    let mut child =
+        proxy::spawn_proxy_process(program, args).context("Failed to start replay target")?;
+    let mut child_stdin = child.stdin.take().context("Failed to open target stdin")?;
+    let child_stdout = child
+        .stdout
+        .take()
+        .context("Failed to open target stdout")?;
+
+    let (tx, rx) = mpsc::channel::<Value>();
+    let reader = thread::spawn(move || {
+        for line in BufReader::new(child_stdout).lines().map_while(Result::ok) {
+            if let Ok(json) = serde_json::from_str::<Value>(&line) {
+                if tx.send(json).is_err() {
+                    break;
+                }
+            }
+        }
+    });
+
+    let started = Instant::now();
+    let mut results = Vec::with_capacity(steps.len());
+    let mut unmatched: HashMap<String, Value> = HashMap::new();
+
+    for step in steps {
+        wait_for_offset(started, step.offset, speed);
+
+        let (checked, content) = checks.check(step);
+        let content = match content {
+            Ok(content) => content,
+            Err(outcome) => {
+                results.push(ReplayResult {
+                    step: step.clone(),
+                    outcome,
+                    duration_ms: None,
+                    checked,
+                });
+                continue;
+            }
+        };
+        writeln!(child_stdin, "{}", content).context("Failed to write to target")?;
+        child_stdin
+            .flush()
+            .context("Failed to flush target stdin")?;
+        let sent_at = Instant::now();
+
+        let id = match (&step.id, &step.method) {
+            (Some(id), Some(_)) => id.to_string(),
+            _ => {
+                results.push(ReplayResult {
+                    step: step.clone(),
+                    outcome: ReplayOutcome::Sent,
+                    duration_ms: None,
+                    checked,
+                });
+                continue;
+            }
+        };
+
+        let response = match unmatched.remove(&id) {
+            Some(response) => Some(response),
+            None => wait_for_response(&rx, &id, timeout, &mut unmatched),
+        };
+        let duration_ms = Some(sent_at.elapsed().as_secs_f64() * 1000.0);
+
+        let outcome = match (response, &step.recorded_response) {
+            (None, _) => ReplayOutcome::Timeout,
+            (Some(_), None) => ReplayOutcome::Sent,
+            (Some(actual), Some(expected)) => compare_responses(expected, &actual),
+        };
+
+        results.push(ReplayResult {
+            step: step.clone(),
+            outcome,
+            duration_ms,
+            checked,
+        });
+    }
+
+    drop(child_stdin);
+    let _ = process::stop(&mut child, process::SHUTDOWN_GRACE);
+    let _ = reader.join();
+
+    Ok(results)
+}
+
+fn wait_for_response(
+    rx: &mpsc::Receiver<Value>,
+    id: &str,
+    timeout: Duration,
+    unmatched: &mut HashMap<String, Value>,
+) -> Option<Value> {
+    let deadline = Instant::now() + timeout;
+    loop {
+        let remaining = deadline.checked_duration_since(Instant::now())?;
+        let message = rx.recv_timeout(remaining).ok()?;
+
+        // Server-initiated requests and notifications carry a method
+        if message.get("method").is_some() {
+            continue;
+        }
+        match message.get("id").map(|v| v.to_string()) {
+            Some(ref msg_id) if msg_id == id => return Some(message),
+            Some(msg_id) => {
+                unmatched.insert(msg_id, message);
+            }
+            None => {}
+        }
+    }
+}
+
+/// Walk the capture without a live server at the original (or scaled)
+/// pace, putting each call through `checks` and pairing it with its
+/// recorded outcome.
+pub fn replay_dry_run(
+    steps: &[ReplayStep],
+    speed: f64,
+    checks: &ReplayChecks,
+) -> Vec<ReplayResult> {
+    let started = Instant::now();
+    steps
+        .iter()
+        .map(|step| {
+            wait_for_offset(started, step.offset, speed);
+            let (checked, content) = checks.check(step);
+            let (outcome, duration_ms) = match content {
+                Ok(_) => (ReplayOutcome::Sent, step.recorded_duration_ms),
+                Err(outcome) => (outcome, None),
+            };
+            ReplayResult {
+                step: step.clone(),
+                outcome,
+                duration_ms,
+                checked,
+            }
+        })
+        .collect()
+}
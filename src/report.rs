@@ -0,0 +1,980 @@
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use serde_json::{json, Value};
+use std::collections::{BTreeMap, HashMap};
+use std::fmt::Write as _;
+use std::path::{Path, PathBuf};
+
+use crate::build_info;
+use crate::correlation::{self, CallStatus};
+use crate::costs::{self, CostConfig, CostSummary};
+use crate::risk::arguments::{self, ArgumentRole};
+use crate::risk::{PatternRiskAnalyzer, RiskAssessment, RiskLevel};
+use crate::sessions::{format_duration, SessionSummary};
+use crate::traffic::{self, TrafficEntry};
+
+/// Payloads listed under "Largest payloads"
+const LARGEST_PAYLOADS: usize = 10;
+/// Calls shown in the timeline; longer sessions note how many were left out
+const TIMELINE_LIMIT: usize = 500;
+const SARIF_SCHEMA: &str = "https://json.schemastore.org/sarif-2.1.0.json";
+const REPOSITORY_URL: &str = "https://github.com/kilometers-ai/kilometers-cli";
+/// tools/call arguments that give the line of a path argument
+const LINE_ARGUMENTS: &[&str] = &[
+    "line",
+    "start_line",
+    "startLine",
+    "line_number",
+    "lineNumber",
+];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum ReportFormat {
+    Html,
+    #[value(alias = "markdown")]
+    Md,
+    /// High-risk requests and policy violations, for code scanning tools
+    Sarif,
+}
+
+impl ReportFormat {
+    /// Infer the format from an output file extension.
+    pub fn from_path(path: &Path) -> Option<Self> {
+        match path.extension()?.to_str()?.to_ascii_lowercase().as_str() {
+            "html" | "htm" => Some(Self::Html),
+            "md" | "markdown" => Some(Self::Md),
+            "sarif" => Some(Self::Sarif),
+            _ => None,
+        }
+    }
+}
+
+/// Latency percentiles of one method's answered calls, in milliseconds.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Latency {
+    pub p50: f64,
+    pub p90: f64,
+    pub p99: f64,
+    pub max: f64,
+}
+
+impl Latency {
+    /// Percentiles of `durations`, or `None` when there are none
+    pub fn of(mut durations: Vec<f64>) -> Option<Self> {
+        if durations.is_empty() {
+            return None;
+        }
+        durations.sort_by(|a, b| a.total_cmp(b));
+        Some(Self {
+            p50: percentile(&durations, 50.0),
+            p90: percentile(&durations, 90.0),
+            p99: percentile(&durations, 99.0),
+            max: durations[durations.len() - 1],
+        })
+    }
+}
+
+/// Nearest-rank percentile of sorted values.
+pub fn percentile(sorted: &[f64], p: f64) -> f64 {
+    let rank = (p / 100.0 * sorted.len() as f64).ceil() as usize;
+    sorted[rank.clamp(1, sorted.len()) - 1]
+}
+
+/// Calls, failures and latency of one method.
+#[derive(Debug, Clone, Serialize)]
+pub struct MethodReport {
+    pub method: String,
+    pub calls: u64,
+    pub errors: u64,
+    /// Requests that never got a response
+    pub unanswered: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub latency: Option<Latency>,
+}
+
+impl MethodReport {
+    pub fn error_rate(&self) -> f64 {
+        if self.calls == 0 {
+            0.0
+        } else {
+            self.errors as f64 / self.calls as f64
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct PayloadSize {
+    pub timestamp: DateTime<Utc>,
+    pub direction: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    pub bytes: usize,
+}
+
+/// One call in the session timeline.
+#[derive(Debug, Clone, Serialize)]
+pub struct TimelineCall {
+    pub timestamp: DateTime<Utc>,
+    pub method: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub tool: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub duration_ms: Option<f64>,
+    #[serde(flatten)]
+    pub status: CallStatus,
+    pub risk: RiskLevel,
+}
+
+/// Why an event is a finding.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FindingKind {
+    /// A request scored high or critical risk
+    HighRisk,
+    /// A message a policy rule or the policy bundle denied
+    PolicyViolation,
+}
+
+impl FindingKind {
+    pub const ALL: [FindingKind; 2] = [FindingKind::HighRisk, FindingKind::PolicyViolation];
+
+    /// The SARIF rule id.
+    pub fn rule_id(self) -> &'static str {
+        match self {
+            FindingKind::HighRisk => "km/high-risk-request",
+            FindingKind::PolicyViolation => "km/policy-violation",
+        }
+    }
+}
+
+/// The file, and line if one was given, a tools/call request was about.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct FileTarget {
+    pub path: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub line: Option<u64>,
+}
+
+impl FileTarget {
+    /// The request's first path argument, with the line from an argument
+    /// such as `line` or `start_line`.
+    pub fn of_request(request: &Value) -> Option<Self> {
+        let args = request.pointer("/params/arguments")?.as_object()?;
+        let path = args.iter().find_map(|(name, value)| {
+            (arguments::role(name, None) == Some(ArgumentRole::Path))
+                .then(|| value.as_str())
+                .flatten()
+        })?;
+        let line = LINE_ARGUMENTS
+            .iter()
+            .find_map(|name| {
+                let value = args.get(*name)?;
+                value.as_u64().or_else(|| value.as_str()?.parse().ok())
+            })
+            .filter(|line| *line > 0);
+        Some(Self {
+            path: path.to_string(),
+            line,
+        })
+    }
+}
+
+/// An event security teams should look at.
+#[derive(Debug, Clone, Serialize)]
+pub struct Finding {
+    pub kind: FindingKind,
+    pub timestamp: DateTime<Utc>,
+    /// Line of the event in the traffic log
+    pub line: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub tool: Option<String>,
+    /// Risk of the request, or of the request a response answers
+    pub risk: RiskLevel,
+    /// For policy violations, whether the message was blocked
+    pub blocked: bool,
+    pub message: String,
+    /// The file the request's arguments point at
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub target: Option<FileTarget>,
+}
+
+impl Finding {
+    /// `error` for critical risk and blocked messages, `warning` otherwise.
+    pub fn level(&self) -> &'static str {
+        let severe = match self.kind {
+            FindingKind::HighRisk => self.risk == RiskLevel::Critical,
+            FindingKind::PolicyViolation => self.blocked,
+        };
+        if severe {
+            "error"
+        } else {
+            "warning"
+        }
+    }
+}
+
+/// What a message was about, as `tool shell` or `resources/read`.
+fn subject(method: Option<&str>, tool: Option<&str>) -> String {
+    match (tool, method) {
+        (Some(tool), _) => format!("tool {}", tool),
+        (None, Some(method)) => method.to_string(),
+        (None, None) => "a message".to_string(),
+    }
+}
+
+/// Everything `km report` shows about one session.
+#[derive(Debug, Clone, Serialize)]
+pub struct SessionReport {
+    pub session: SessionSummary,
+    /// Requests per risk level
+    pub risk: BTreeMap<RiskLevel, u64>,
+    pub methods: Vec<MethodReport>,
+    /// Tokens and cost of the server's sampling requests, by model
+    pub costs: CostSummary,
+    pub largest_payloads: Vec<PayloadSize>,
+    pub timeline: Vec<TimelineCall>,
+    /// Calls left out of the timeline
+    pub timeline_omitted: usize,
+    pub findings: Vec<Finding>,
+    /// Traffic log the report was built from, for SARIF locations
+    #[serde(skip)]
+    pub log: Option<PathBuf>,
+}
+
+impl SessionReport {
+    /// Build the report for `session` from the entries of a traffic log,
+    /// pricing sampling with `pricing`.
+    pub fn build(
+        entries: &[TrafficEntry],
+        session: &SessionSummary,
+        analyzer: &PatternRiskAnalyzer,
+        pricing: &CostConfig,
+    ) -> Self {
+        let (lines, entries): (Vec<usize>, Vec<TrafficEntry>) = entries
+            .iter()
+            .enumerate()
+            .filter(|(_, e)| e.session_id.as_deref() == Some(session.id.as_str()))
+            .map(|(index, e)| (index + 1, e.clone()))
+            .unzip();
+        let methods = traffic::resolve_methods(&entries);
+        let sampling = costs::summarize(&entries, &methods, pricing);
+
+        // Prefer the score recorded at capture time, which includes rule packs
+        let mut risk: BTreeMap<RiskLevel, u64> =
+            RiskLevel::ALL.iter().map(|level| (*level, 0)).collect();
+        let mut request_risk = HashMap::new();
+        let mut findings = Vec::new();
+        // Tool, risk and file of the latest request with each id, for its response
+        let mut pending: HashMap<String, (Option<String>, RiskLevel, Option<FileTarget>)> =
+            HashMap::new();
+        for ((entry, method), line) in entries.iter().zip(&methods).zip(&lines) {
+            let finding = |kind, tool: &Option<String>, risk, blocked, message, target| Finding {
+                kind,
+                timestamp: entry.timestamp,
+                line: *line,
+                method: method.clone(),
+                tool: tool.clone(),
+                risk,
+                blocked,
+                message,
+                target,
+            };
+            if entry.direction != "request" {
+                let (tool, level, target) = entry
+                    .rpc_id()
+                    .and_then(|id| pending.get(&id.to_string()).cloned())
+                    .unwrap_or((None, RiskLevel::Low, None));
+                if let Some(reason) = bundle_denial(entry) {
+                    let message = format!(
+                        "The policy bundle blocked the response to {}: {}",
+                        subject(method.as_deref(), tool.as_deref()),
+                        reason
+                    );
+                    findings.push(finding(
+                        FindingKind::PolicyViolation,
+                        &tool,
+                        level,
+                        true,
+                        message,
+                        target,
+                    ));
+                }
+                continue;
+            }
+            let assessment = RiskAssessment::from_metadata(&entry.metadata)
+                .unwrap_or_else(|| analyzer.analyze(method.as_deref(), &entry.content));
+            let level = assessment.level;
+            *risk.entry(level).or_default() += 1;
+            let rpc = (method.as_deref() == Some("tools/call"))
+                .then(|| entry.rpc())
+                .flatten();
+            let tool = rpc
+                .as_ref()
+                .and_then(|rpc| rpc.pointer("/params/name")?.as_str())
+                .map(String::from);
+            let file = rpc.as_ref().and_then(FileTarget::of_request);
+            if let Some(id) = entry.rpc_id() {
+                request_risk.insert((entry.timestamp, id.to_string()), level);
+                pending.insert(id.to_string(), (tool.clone(), level, file.clone()));
+            }
+
+            let target = subject(method.as_deref(), tool.as_deref());
+            if level >= RiskLevel::High {
+                let mut message = format!(
+                    "{} risk request to {} (score {:.2})",
+                    capitalized(&level.to_string()),
+                    target,
+                    assessment.score
+                );
+                if !assessment.matched_patterns.is_empty() {
+                    let _ = write!(
+                        message,
+                        "; matched {}",
+                        assessment.matched_patterns.join(", ")
+                    );
+                }
+                findings.push(finding(
+                    FindingKind::HighRisk,
+                    &tool,
+                    level,
+                    false,
+                    message,
+                    file.clone(),
+                ));
+            }
+            let policy = entry.metadata.get("policy");
+            if let Some(policy) = policy.filter(|p| p["decision"] == "deny") {
+                let rule = policy["rule"].as_str().unwrap_or("unknown");
+                let blocked = policy["enforced"].as_bool().unwrap_or(false);
+                let message = if blocked {
+                    format!("Policy rule {} blocked a request to {}", rule, target)
+                } else {
+                    format!(
+                        "Policy rule {} denies requests to {}; forwarded in audit mode",
+                        rule, target
+                    )
+                };
+                findings.push(finding(
+                    FindingKind::PolicyViolation,
+                    &tool,
+                    level,
+                    blocked,
+                    message,
+                    file.clone(),
+                ));
+            }
+            if let Some(reason) = bundle_denial(entry) {
+                let message = format!(
+                    "The policy bundle blocked a request to {}: {}",
+                    target, reason
+                );
+                findings.push(finding(
+                    FindingKind::PolicyViolation,
+                    &tool,
+                    level,
+                    true,
+                    message,
+                    file.clone(),
+                ));
+            }
+        }
+
+        let mut largest_payloads: Vec<PayloadSize> = entries
+            .iter()
+            .zip(&methods)
+            .map(|(entry, method)| PayloadSize {
+                timestamp: entry.timestamp,
+                direction: entry.direction.clone(),
+                method: method.clone(),
+                bytes: entry.content.len(),
+            })
+            .collect();
+        largest_payloads.sort_by(|a, b| b.bytes.cmp(&a.bytes).then(a.timestamp.cmp(&b.timestamp)));
+        largest_payloads.truncate(LARGEST_PAYLOADS);
+
+        let mut calls = correlation::correlate(&entries);
+        calls.sort_by(|a, b| a.started_at.cmp(&b.started_at));
+
+        let mut by_method: BTreeMap<String, (MethodReport, Vec<f64>)> = BTreeMap::new();
+        let mut timeline = Vec::with_capacity(calls.len().min(TIMELINE_LIMIT));
+        for call in &calls {
+            let (stats, durations) = by_method.entry(call.method.clone()).or_insert_with(|| {
+                (
+                    MethodReport {
+                        method: call.method.clone(),
+                        calls: 0,
+                        errors: 0,
+                        unanswered: 0,
+                        latency: None,
+                    },
+                    Vec::new(),
+                )
+            });
+            stats.calls += 1;
+            match call.status {
+                CallStatus::Error { .. } => stats.errors += 1,
+                CallStatus::Pending => stats.unanswered += 1,
+                CallStatus::Success => {}
+            }
+            durations.extend(call.duration_ms);
+
+            if timeline.len() < TIMELINE_LIMIT {
+                let tool = (call.method == "tools/call")
+                    .then(|| call.request.pointer("/params/name")?.as_str())
+                    .flatten()
+                    .map(String::from);
+                timeline.push(TimelineCall {
+                    timestamp: call.started_at,
+                    method: call.method.clone(),
+                    tool,
+                    duration_ms: call.duration_ms,
+                    status: call.status.clone(),
+                    risk: request_risk
+                        .get(&(call.started_at, call.id.to_string()))
+                        .copied()
+                        .unwrap_or(RiskLevel::Low),
+                });
+            }
+        }
+
+        let mut methods: Vec<MethodReport> = by_method
+            .into_values()
+            .map(|(mut stats, durations)| {
+                stats.latency = Latency::of(durations);
+                stats
+            })
+            .collect();
+        methods.sort_by(|a, b| b.calls.cmp(&a.calls).then(a.method.cmp(&b.method)));
+
+        Self {
+            session: session.clone(),
+            risk,
+            methods,
+            costs: sampling,
+            largest_payloads,
+            timeline_omitted: calls.len() - timeline.len(),
+            timeline,
+            findings,
+            log: None,
+        }
+    }
+
+    /// Seconds since the session started, as `+1m05s`.
+    fn offset(&self, at: DateTime<Utc>) -> String {
+        format!(
+            "+{}",
+            format_duration((at - self.session.started).num_seconds().max(0))
+        )
+    }
+
+    fn total_requests(&self) -> u64 {
+        self.risk.values().sum()
+    }
+}
+
+/// The reason the policy bundle denied `entry`, if it did. Denials are
+/// logged on the message of the phase they were made in.
+fn bundle_denial(entry: &TrafficEntry) -> Option<String> {
+    let decision = entry.metadata.get("policy_bundle")?;
+    if decision["phase"] != entry.direction.as_str() || decision["result"]["allow"] != false {
+        return None;
+    }
+    Some(
+        decision["result"]["reason"]
+            .as_str()
+            .unwrap_or("denied")
+            .to_string(),
+    )
+}
+
+fn capitalized(text: &str) -> String {
+    let mut chars = text.chars();
+    match chars.next() {
+        Some(first) => first.to_uppercase().chain(chars).collect(),
+        None => String::new(),
+    }
+}
+
+fn share(count: u64, total: u64) -> String {
+    if total == 0 {
+        "-".to_string()
+    } else {
+        format!("{:.1}%", count as f64 * 100.0 / total as f64)
+    }
+}
+
+fn format_ms(ms: f64) -> String {
+    if ms >= 1000.0 {
+        format!("{:.2}s", ms / 1000.0)
+    } else {
+        format!("{:.1}ms", ms)
+    }
+}
+
+fn format_tokens(tokens: u64, estimated: bool) -> String {
+    if estimated {
+        format!("~{}", tokens)
+    } else {
+        tokens.to_string()
+    }
+}
+
+fn format_bytes(bytes: usize) -> String {
+    match bytes {
+        b if b >= 1024 * 1024 => format!("{:.1} MiB", b as f64 / (1024.0 * 1024.0)),
+        b if b >= 1024 => format!("{:.1} KiB", b as f64 / 1024.0),
+        b => format!("{} B", b),
+    }
+}
+
+fn status_text(status: &CallStatus) -> String {
+    match status {
+        CallStatus::Success => "ok".to_string(),
+        CallStatus::Pending => "no response".to_string(),
+        CallStatus::Error {
+            code: Some(code),
+            message,
+        } => format!("error {}: {}", code, message),
+        CallStatus::Error {
+            code: None,
+            message,
+        } => format!("error: {}", message),
+    }
+}
+
+/// The sections of a report as plain rows, shared by both renderers.
+struct Table {
+    title: &'static str,
+    headers: Vec<&'static str>,
+    rows: Vec<Vec<String>>,
+    empty: &'static str,
+    note: Option<String>,
+}
+
+fn overview(report: &SessionReport) -> Vec<(&'static str, String)> {
+    let session = &report.session;
+    let mut rows = vec![
+        ("Session", session.id.clone()),
+        (
+            "Server",
+            session.server.clone().unwrap_or_else(|| "-".into()),
+        ),
+        (
+            "Started",
+            session.started.format("%Y-%m-%d %H:%M:%S UTC").to_string(),
+        ),
+        ("Duration", format_duration(session.duration_secs())),
+        (
+            "Messages",
+            format!(
+                "{} ({} requests, {} errors)",
+                session.messages, session.requests, session.errors
+            ),
+        ),
+    ];
+    if !session.labels.is_empty() {
+        let labels: Vec<String> = session
+            .labels
+            .iter()
+            .map(|(key, value)| format!("{}={}", key, value))
+            .collect();
+        rows.push(("Labels", labels.join(", ")));
+    }
+    rows
+}
+
+fn tables(report: &SessionReport) -> Vec<Table> {
+    let tool_calls: u64 = report.session.tools.values().sum();
+    let mut tools: Vec<_> = report.session.tools.iter().collect();
+    tools.sort_by(|a, b| b.1.cmp(a.1).then(a.0.cmp(b.0)));
+
+    let total_requests = report.total_requests();
+    let latency = |m: &MethodReport, pick: fn(&Latency) -> f64| {
+        m.latency
+            .as_ref()
+            .map(|l| format_ms(pick(l)))
+            .unwrap_or_else(|| "-".to_string())
+    };
+
+    let mut tables = vec![
+        Table {
+            title: "Tools",
+            headers: vec!["Tool", "Calls", "Share"],
+            rows: tools
+                .into_iter()
+                .map(|(tool, count)| {
+                    vec![tool.clone(), count.to_string(), share(*count, tool_calls)]
+                })
+                .collect(),
+            empty: "No tools were called.",
+            note: None,
+        },
+        Table {
+            title: "Risk",
+            headers: vec!["Level", "Requests", "Share"],
+            rows: report
+                .risk
+                .iter()
+                .rev()
+                .map(|(level, count)| {
+                    vec![
+                        level.to_string(),
+                        count.to_string(),
+                        share(*count, total_requests),
+                    ]
+                })
+                .collect(),
+            empty: "No requests.",
+            note: None,
+        },
+        Table {
+            title: "Methods",
+            headers: vec![
+                "Method",
+                "Calls",
+                "Errors",
+                "Error rate",
+                "No response",
+                "p50",
+                "p90",
+                "p99",
+                "Max",
+            ],
+            rows: report
+                .methods
+                .iter()
+                .map(|m| {
+                    vec![
+                        m.method.clone(),
+                        m.calls.to_string(),
+                        m.errors.to_string(),
+                        format!("{:.1}%", m.error_rate() * 100.0),
+                        m.unanswered.to_string(),
+                        latency(m, |l| l.p50),
+                        latency(m, |l| l.p90),
+                        latency(m, |l| l.p99),
+                        latency(m, |l| l.max),
+                    ]
+                })
+                .collect(),
+            empty: "No calls.",
+            note: None,
+        },
+        Table {
+            title: "Largest payloads",
+            headers: vec!["Time", "Direction", "Method", "Size"],
+            rows: report
+                .largest_payloads
+                .iter()
+                .map(|p| {
+                    vec![
+                        report.offset(p.timestamp),
+                        p.direction.clone(),
+                        p.method.clone().unwrap_or_else(|| "-".into()),
+                        format_bytes(p.bytes),
+                    ]
+                })
+                .collect(),
+            empty: "No messages.",
+            note: None,
+        },
+        Table {
+            title: "Timeline",
+            headers: vec!["Time", "Method", "Tool", "Latency", "Risk", "Result"],
+            rows: report
+                .timeline
+                .iter()
+                .map(|call| {
+                    vec![
+                        report.offset(call.timestamp),
+                        call.method.clone(),
+                        call.tool.clone().unwrap_or_else(|| "-".into()),
+                        call.duration_ms
+                            .map(format_ms)
+                            .unwrap_or_else(|| "-".into()),
+                        call.risk.to_string(),
+                        status_text(&call.status),
+                    ]
+                })
+                .collect(),
+            empty: "No calls.",
+            note: (report.timeline_omitted > 0).then(|| {
+                format!(
+                    "{} later calls are not shown; use `km sessions events {}` to list them all.",
+                    report.timeline_omitted, report.session.id
+                )
+            }),
+        },
+    ];
+    if !report.costs.is_empty() {
+        tables.insert(3, costs_table(&report.costs));
+    }
+    tables
+}
+
+fn costs_table(costs: &CostSummary) -> Table {
+    let mut notes = Vec::new();
+    if costs.models.values().any(|m| m.estimated_calls > 0) {
+        notes.push(format!(
+            "Token counts marked ~ are estimated from the text. Total: ${:.4}.",
+            costs.total_usd()
+        ));
+    } else {
+        notes.push(format!("Total: ${:.4}.", costs.total_usd()));
+    }
+    let unpriced = costs.unpriced();
+    if !unpriced.is_empty() {
+        notes.push(format!(
+            "No price is set for {}; add one under `costs.pricing`.",
+            unpriced.join(", ")
+        ));
+    }
+    Table {
+        title: "Sampling",
+        headers: vec!["Model", "Calls", "Input tokens", "Output tokens", "Cost"],
+        rows: costs
+            .models
+            .iter()
+            .map(|(model, usage)| {
+                let estimated = usage.estimated_calls > 0;
+                vec![
+                    model.clone(),
+                    usage.calls.to_string(),
+                    format_tokens(usage.input_tokens, estimated),
+                    format_tokens(usage.output_tokens, estimated),
+                    usage
+                        .cost_usd
+                        .map(|cost| format!("${:.4}", cost))
+                        .unwrap_or_else(|| "-".into()),
+                ]
+            })
+            .collect(),
+        empty: "No sampling requests.",
+        note: Some(notes.join(" ")),
+    }
+}
+
+/// `value` as a Markdown table cell.
+pub fn md_cell(value: &str) -> String {
+    value.replace('|', "\\|").replace('\n', " ")
+}
+
+/// Render the report as Markdown, e.g. for a PR description.
+pub fn render_markdown(report: &SessionReport) -> String {
+    let mut out = String::new();
+    let _ = writeln!(out, "# Session report: {}\n", md_cell(&report.session.id));
+    out.push_str("| | |\n|---|---|\n");
+    for (name, value) in overview(report) {
+        let _ = writeln!(out, "| **{}** | {} |", name, md_cell(&value));
+    }
+    for table in tables(report) {
+        let _ = writeln!(out, "\n## {}\n", table.title);
+        if table.rows.is_empty() {
+            let _ = writeln!(out, "{}", table.empty);
+            continue;
+        }
+        let _ = writeln!(out, "| {} |", table.headers.join(" | "));
+        let _ = writeln!(out, "|{}", "---|".repeat(table.headers.len()));
+        for row in &table.rows {
+            let cells: Vec<String> = row.iter().map(|cell| md_cell(cell)).collect();
+            let _ = writeln!(out, "| {} |", cells.join(" | "));
+        }
+        if let Some(note) = table.note {
+            let _ = writeln!(out, "\n_{}_", note);
+        }
+    }
+    let _ = writeln!(out, "\n_Generated by km {}._", build_info::VERSION);
+    out
+}
+
+fn html_escape(value: &str) -> String {
+    value
+        .replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+        .replace('\'', "&#39;")
+}
+
+const HTML_STYLE: &str =
+    "body{font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;margin:2rem;color:#1f2328}\
+table{border-collapse:collapse;margin:0.5rem 0 1.5rem}\
+th,td{border:1px solid #d0d7de;padding:4px 10px;text-align:left}\
+th{background:#f6f8fa}\
+td.num{text-align:right;font-variant-numeric:tabular-nums}\
+.risk-high,.risk-critical{color:#cf222e;font-weight:600}\
+.note,footer{color:#59636e}";
+
+/// Render the report as a standalone HTML page, e.g. to attach to a ticket.
+pub fn render_html(report: &SessionReport) -> String {
+    let mut out = String::new();
+    let title = format!("Session report: {}", html_escape(&report.session.id));
+    let _ = writeln!(
+        out,
+        "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>{}</title>\n<style>{}</style>\n</head>\n<body>\n<h1>{}</h1>",
+        title, HTML_STYLE, title
+    );
+    out.push_str("<table>\n");
+    for (name, value) in overview(report) {
+        let _ = writeln!(
+            out,
+            "<tr><th>{}</th><td>{}</td></tr>",
+            name,
+            html_escape(&value)
+        );
+    }
+    out.push_str("</table>\n");
+
+    for table in tables(report) {
+        let _ = writeln!(out, "<h2>{}</h2>", table.title);
+        if table.rows.is_empty() {
+            let _ = writeln!(out, "<p class=\"note\">{}</p>", table.empty);
+            continue;
+        }
+        out.push_str("<table>\n<tr>");
+        for header in &table.headers {
+            let _ = write!(out, "<th>{}</th>", header);
+        }
+        out.push_str("</tr>\n");
+        for row in &table.rows {
+            out.push_str("<tr>");
+            for cell in row {
+                let class = if RiskLevel::ALL.iter().any(|l| l.to_string() == *cell) {
+                    format!(" class=\"risk-{}\"", cell)
+                } else if cell.starts_with(|c: char| c.is_ascii_digit()) {
+                    " class=\"num\"".to_string()
+                } else {
+                    String::new()
+                };
+                let _ = write!(out, "<td{}>{}</td>", class, html_escape(cell));
+            }
+            out.push_str("</tr>\n");
+        }
+        out.push_str("</table>\n");
+        if let Some(note) = table.note {
+            let _ = writeln!(out, "<p class=\"note\">{}</p>", html_escape(&note));
+        }
+    }
+    let _ = writeln!(
+        out,
+        "<footer>Generated by km {}.</footer>\n</body>\n</html>",
+        build_info::VERSION
+    );
+    out
+}
+
+fn sarif_rule(kind: FindingKind) -> Value {
+    let (name, short, full, severity) = match kind {
+        FindingKind::HighRisk => (
+            "HighRiskRequest",
+            "High-risk MCP request",
+            "The request scored high or critical risk: it may run commands, touch \
+             credentials or change files outside the project.",
+            "8.0",
+        ),
+        FindingKind::PolicyViolation => (
+            "PolicyViolation",
+            "MCP message denied by policy",
+            "A policy rule or the policy bundle denied the message. Enforced \
+             denials were blocked; in audit mode the message was forwarded.",
+            "7.0",
+        ),
+    };
+    json!({
+        "id": kind.rule_id(),
+        "name": name,
+        "shortDescription": {"text": short},
+        "fullDescription": {"text": full},
+        "help": {
+            "text": "Review the event with `km inspect`, then tighten the server's tools or \
+                     the policy that applies to it."
+        },
+        "defaultConfiguration": {"level": "warning"},
+        "properties": {"tags": ["security", "mcp"], "security-severity": severity},
+    })
+}
+
+/// Render the report's findings as a SARIF 2.1.0 log, e.g. to upload to
+/// GitHub code scanning. Results point at the event's line in the traffic
+/// log when the report knows which log it was built from.
+pub fn render_sarif(report: &SessionReport) -> String {
+    let uri = report
+        .log
+        .as_ref()
+        .map(|log| log.to_string_lossy().replace('\\', "/"));
+    let results: Vec<Value> = report
+        .findings
+        .iter()
+        .map(|finding| {
+            let mut location = json!({
+                "logicalLocations": [{
+                    "name": finding.tool.as_deref().or(finding.method.as_deref()).unwrap_or("-"),
+                    "kind": if finding.tool.is_some() { "function" } else { "member" },
+                }],
+            });
+            if let Some(ref uri) = uri {
+                location["physicalLocation"] = json!({
+                    "artifactLocation": {"uri": uri},
+                    "region": {"startLine": finding.line},
+                });
+            }
+            json!({
+                "ruleId": finding.kind.rule_id(),
+                "ruleIndex": FindingKind::ALL.iter().position(|k| *k == finding.kind),
+                "level": finding.level(),
+                "message": {"text": finding.message},
+                "locations": [location],
+                "partialFingerprints": {
+                    "kmEvent/v1": format!(
+                        "{}:{}:{}",
+                        report.session.id,
+                        finding.timestamp.to_rfc3339(),
+                        finding.kind.rule_id()
+                    ),
+                },
+                "properties": {
+                    "timestamp": finding.timestamp,
+                    "method": finding.method,
+                    "tool": finding.tool,
+                    "risk": finding.risk,
+                    "blocked": finding.blocked,
+                },
+            })
+        })
+        .collect();
+
+    let sarif = json!({
+        "$schema": SARIF_SCHEMA,
+        "version": "2.1.0",
+        "runs": [{
+            "tool": {
+                "driver": {
+                    "name": "km",
+                    "semanticVersion": build_info::VERSION,
+                    "informationUri": REPOSITORY_URL,
+                    "rules": FindingKind::ALL.iter().map(|k| sarif_rule(*k)).collect::<Vec<_>>(),
+                },
+            },
+            "results": results,
+            "properties": {
+                "session": report.session.id,
+                "server": report.session.server,
+                "started": report.session.started,
+            },
+        }],
+    });
+    let mut out = serde_json::to_string_pretty(&sarif).unwrap_or_default();
+    out.push('\n');
+    out
+}
+
+/// Render `report` in `format`.
+pub fn render(report: &SessionReport, format: ReportFormat) -> String {
+    match format {
+        ReportFormat::Html => render_html(report),
+        ReportFormat::Md => render_markdown(report),
+        ReportFormat::Sarif => render_sarif(report),
+    }
+}
@@ -0,0 +1,275 @@
+//! CPU and memory use of the monitored MCP server, sampled while the proxy
+//! runs. Reported by `km ctl status` and summarized at the end of a session.
+
+use serde::{Deserialize, Serialize};
+use std::io;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// How often the server's resource use is sampled
+pub const SAMPLE_INTERVAL: Duration = Duration::from_secs(1);
+
+/// One reading of a process's resource use.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct ResourceSample {
+    /// CPU used since the previous sample, as a percentage of one core
+    pub cpu_percent: f64,
+    /// Resident memory
+    pub memory_bytes: u64,
+}
+
+/// Latest, average and peak resource use over a session.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ResourceUsage {
+    pub samples: u64,
+    pub cpu_percent: f64,
+    pub cpu_percent_avg: f64,
+    pub cpu_percent_peak: f64,
+    pub memory_bytes: u64,
+    pub memory_bytes_avg: u64,
+    pub memory_bytes_peak: u64,
+}
+
+impl ResourceUsage {
+    pub fn add(&mut self, sample: ResourceSample) {
+        let n = self.samples as f64;
+        self.cpu_percent_avg = (self.cpu_percent_avg * n + sample.cpu_percent) / (n + 1.0);
+        self.memory_bytes_avg =
+            ((self.memory_bytes_avg as f64 * n + sample.memory_bytes as f64) / (n + 1.0)) as u64;
+        self.cpu_percent_peak = self.cpu_percent_peak.max(sample.cpu_percent);
+        self.memory_bytes_peak = self.memory_bytes_peak.max(sample.memory_bytes);
+        self.cpu_percent = sample.cpu_percent;
+        self.memory_bytes = sample.memory_bytes;
+        self.samples += 1;
+    }
+
+    /// `CPU 3.1% (avg 1.2%, peak 12.0%), memory 24.5 MB (avg 22.0 MB, peak 30.1 MB)`
+    pub fn describe(&self) -> String {
+        format!(
+            "CPU {:.1}% (avg {:.1}%, peak {:.1}%), memory {} (avg {}, peak {})",
+            self.cpu_percent,
+            self.cpu_percent_avg,
+            self.cpu_percent_peak,
+            format_bytes(self.memory_bytes),
+            format_bytes(self.memory_bytes_avg),
+            format_bytes(self.memory_bytes_peak)
+        )
+    }
+}
+
+fn format_bytes(bytes: u64) -> String {
+    const MB: f64 = 1024.0 * 1024.0;
+    if bytes as f64 >= 1024.0 * MB {
+        format!("{:.1} GB", bytes as f64 / (1024.0 * MB))
+    } else {
+        format!("{:.1} MB", bytes as f64 / MB)
+    }
+}
+
+/// Samples one process, working out CPU use from the change in its CPU
+/// time between samples.
+#[derive(Debug)]
+pub struct ProcessSampler {
+    pid: u32,
+    cpu_time: Duration,
+    at: Instant,
+}
+
+impl ProcessSampler {
+    pub fn new(pid: u32) -> Self {
+        let cpu_time = platform::read(pid)
+            .map(|(cpu_time, _)| cpu_time)
+            .unwrap_or_default();
+        Self {
+            pid,
+            cpu_time,
+            at: Instant::now(),
+        }
+    }
+
+    pub fn sample(&mut self) -> io::Result<ResourceSample> {
+        let (cpu_time, memory_bytes) = platform::read(self.pid)?;
+        let now = Instant::now();
+        let wall = now.duration_since(self.at).as_secs_f64();
+        let used = cpu_time.saturating_sub(self.cpu_time).as_secs_f64();
+        self.cpu_time = cpu_time;
+        self.at = now;
+        Ok(ResourceSample {
+            cpu_percent: if wall > 0.0 { used / wall * 100.0 } else { 0.0 },
+            memory_bytes,
+        })
+    }
+}
+
+/// Resource use of the server, shared between the proxy that samples it and
+/// whoever reports it.
+#[derive(Debug, Default)]
+pub struct ResourceStats(Mutex<ResourceUsage>);
+
+impl ResourceStats {
+    pub fn record(&self, sample: ResourceSample) {
+        if let Ok(mut usage) = self.0.lock() {
+            usage.add(sample);
+        }
+    }
+
+    /// `None` until the first sample
+    pub fn usage(&self) -> Option<ResourceUsage> {
+        self.0
+            .lock()
+            .ok()
+            .map(|usage| usage.clone())
+            .filter(|usage| usage.samples > 0)
+    }
+}
+
+/// Total CPU time and resident memory of a process.
+#[cfg(target_os = "linux")]
+mod platform {
+    use std::io;
+    use std::time::Duration;
+
+    pub fn read(pid: u32) -> io::Result<(Duration, u64)> {
+        let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid))?;
+        // The command name can hold spaces and parentheses; the fields
+        // start after the last ')'
+        let fields: Vec<&str> = stat
+            .rsplit_once(')')
+            .map(|(_, rest)| rest.split_whitespace().collect())
+            .unwrap_or_default();
+        let ticks = |index: usize| -> io::Result<u64> {
+            fields
+                .get(index)
+                .and_then(|value| value.parse().ok())
+                .ok_or_else(|| io::Error::other(format!("Unexpected /proc/{}/stat", pid)))
+        };
+        // utime and stime, fields 14 and 15 counting from the pid
+        let cpu_ticks = ticks(11)? + ticks(12)?;
+
+        let statm = std::fs::read_to_string(format!("/proc/{}/statm", pid))?;
+        let resident_pages: u64 = statm
+            .split_whitespace()
+            .nth(1)
+            .and_then(|value| value.parse().ok())
+            .ok_or_else(|| io::Error::other(format!("Unexpected /proc/{}/statm", pid)))?;
+
+        // SAFETY: sysconf has no memory safety requirements
+        let (ticks_per_second, page_size) = unsafe {
+            (
+                libc::sysconf(libc::_SC_CLK_TCK),
+                libc::sysconf(libc::_SC_PAGESIZE),
+            )
+        };
+        let ticks_per_second = u64::try_from(ticks_per_second).unwrap_or(100).max(1);
+        let page_size = u64::try_from(page_size).unwrap_or(4096);
+        Ok((
+            Duration::from_nanos(cpu_ticks * 1_000_000_000 / ticks_per_second),
+            resident_pages * page_size,
+        ))
+    }
+}
+
+#[cfg(target_os = "macos")]
+mod platform {
+    use std::io;
+    use std::time::Duration;
+
+    #[allow(deprecated)]
+    pub fn read(pid: u32) -> io::Result<(Duration, u64)> {
+        let pid = libc::c_int::try_from(pid).map_err(io::Error::other)?;
+        // SAFETY: all-zero is a valid proc_taskinfo
+        let mut info: libc::proc_taskinfo = unsafe { std::mem::zeroed() };
+        let size = std::mem::size_of::<libc::proc_taskinfo>() as libc::c_int;
+        // SAFETY: the buffer is `info`, of `size` bytes
+        let written = unsafe {
+            libc::proc_pidinfo(
+                pid,
+                libc::PROC_PIDTASKINFO,
+                0,
+                &mut info as *mut _ as *mut libc::c_void,
+                size,
+            )
+        };
+        if written != size {
+            return Err(io::Error::last_os_error());
+        }
+
+        // CPU times are in Mach time units, which are only nanoseconds on Intel
+        let mut timebase = libc::mach_timebase_info { numer: 0, denom: 0 };
+        // SAFETY: the pointer is to a local struct
+        unsafe { libc::mach_timebase_info(&mut timebase) };
+        let (numer, denom) = if timebase.denom == 0 {
+            (1, 1)
+        } else {
+            (timebase.numer as u64, timebase.denom as u64)
+        };
+        let ticks = info.pti_total_user + info.pti_total_system;
+        Ok((
+            Duration::from_nanos(ticks.saturating_mul(numer) / denom),
+            info.pti_resident_size,
+        ))
+    }
+}
+
+#[cfg(windows)]
+mod platform {
+    use std::io;
+    use std::time::Duration;
+    use windows_sys::Win32::Foundation::{CloseHandle, FILETIME};
+    use windows_sys::Win32::System::ProcessStatus::{
+        K32GetProcessMemoryInfo, PROCESS_MEMORY_COUNTERS,
+    };
+    use windows_sys::Win32::System::Threading::{
+        GetProcessTimes, OpenProcess, PROCESS_QUERY_LIMITED_INFORMATION,
+    };
+
+    pub fn read(pid: u32) -> io::Result<(Duration, u64)> {
+        // SAFETY: plain FFI call; the handle is closed below
+        let handle = unsafe { OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, 0, pid) };
+        if handle.is_null() {
+            return Err(io::Error::last_os_error());
+        }
+        let result = (|| {
+            let zero = FILETIME {
+                dwLowDateTime: 0,
+                dwHighDateTime: 0,
+            };
+            let (mut created, mut exited, mut kernel, mut user) = (zero, zero, zero, zero);
+            // SAFETY: every pointer is to a local FILETIME
+            if unsafe { GetProcessTimes(handle, &mut created, &mut exited, &mut kernel, &mut user) }
+                == 0
+            {
+                return Err(io::Error::last_os_error());
+            }
+            // SAFETY: all-zero is a valid PROCESS_MEMORY_COUNTERS
+            let mut counters: PROCESS_MEMORY_COUNTERS = unsafe { std::mem::zeroed() };
+            counters.cb = std::mem::size_of::<PROCESS_MEMORY_COUNTERS>() as u32;
+            // SAFETY: the size passed is the size of `counters`
+            if unsafe { K32GetProcessMemoryInfo(handle, &mut counters, counters.cb) } == 0 {
+                return Err(io::Error::last_os_error());
+            }
+            // FILETIMEs count 100ns intervals
+            let hundred_ns = |t: FILETIME| (t.dwHighDateTime as u64) << 32 | t.dwLowDateTime as u64;
+            Ok((
+                Duration::from_nanos((hundred_ns(kernel) + hundred_ns(user)) * 100),
+                counters.WorkingSetSize as u64,
+            ))
+        })();
+        // SAFETY: the handle came from OpenProcess and is closed once
+        unsafe { CloseHandle(handle) };
+        result
+    }
+}
+
+#[cfg(not(any(target_os = "linux", target_os = "macos", windows)))]
+mod platform {
+    use std::io;
+    use std::time::Duration;
+
+    pub fn read(_pid: u32) -> io::Result<(Duration, u64)> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            "Resource sampling isn't supported on this platform",
+        ))
+    }
+}
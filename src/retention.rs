@@ -0,0 +1,432 @@
+//! Retention limits for captured traffic: the traffic log is pruned a
+//! whole session at a time, oldest first, and payload blobs by age.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Duration, Utc};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashSet};
+use std::fs::{self, File};
+use std::io::{BufWriter, Write};
+use std::path::{Path, PathBuf};
+use std::time::{Instant, SystemTime};
+
+use crate::tail;
+
+/// How often `km monitor` applies the retention limits
+pub const JANITOR_INTERVAL: std::time::Duration = std::time::Duration::from_secs(15 * 60);
+
+/// Entries without a session id (written by older versions) are grouped
+/// under this name
+pub const NO_SESSION: &str = "(none)";
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct RetentionConfig {
+    /// Remove sessions and blobs last active more than this many days ago
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_age_days: Option<u64>,
+    /// Remove the oldest sessions once the traffic log is larger than this
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_size_mb: Option<u64>,
+    /// Keep only this many of the most recent sessions
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_sessions: Option<usize>,
+}
+
+impl RetentionConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        for (key, value) in [
+            ("retention.max_age_days", self.max_age_days),
+            ("retention.max_size_mb", self.max_size_mb),
+            (
+                "retention.max_sessions",
+                self.max_sessions.map(|n| n as u64),
+            ),
+        ] {
+            if value == Some(0) {
+                return Err(anyhow::anyhow!("{} must be greater than 0", key));
+            }
+        }
+        Ok(())
+    }
+
+    fn max_age(&self) -> Option<Duration> {
+        self.max_age_days
+            .map(|days| Duration::days(days.min(i32::MAX as u64) as i64))
+    }
+}
+
+/// Disk used by one session of the traffic log.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SessionUsage {
+    pub session_id: String,
+    pub entries: usize,
+    pub bytes: u64,
+    pub first_seen: DateTime<Utc>,
+    pub last_seen: DateTime<Utc>,
+}
+
+/// Disk used by one of km's data directories.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct AreaUsage {
+    pub name: String,
+    pub path: PathBuf,
+    pub files: usize,
+    pub bytes: u64,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StorageUsage {
+    pub log_file: PathBuf,
+    pub log_bytes: u64,
+    /// Most recently active first
+    pub sessions: Vec<SessionUsage>,
+    pub areas: Vec<AreaUsage>,
+}
+
+/// The parts of a traffic log entry retention needs; they're stored in the
+/// clear even when payloads are encrypted.
+#[derive(Deserialize)]
+struct EntryHeader {
+    timestamp: DateTime<Utc>,
+    #[serde(default)]
+    session_id: Option<String>,
+}
+
+/// A traffic log split into lines, each with the session it belongs to.
+/// Lines that aren't entries belong to no session and are always kept.
+struct Log {
+    lines: Vec<(Option<String>, String)>,
+    sessions: BTreeMap<String, SessionUsage>,
+}
+
+impl Log {
+    fn read(path: &Path) -> Result<Self> {
+        let contents = match fs::read_to_string(path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read traffic log {:?}", path))
+            }
+        };
+        let mut lines = Vec::new();
+        let mut sessions: BTreeMap<String, SessionUsage> = BTreeMap::new();
+        for line in contents.lines().filter(|l| !l.trim().is_empty()) {
+            let Ok(header) = serde_json::from_str::<EntryHeader>(line) else {
+                lines.push((None, line.to_string()));
+                continue;
+            };
+            let id = header.session_id.unwrap_or_else(|| NO_SESSION.to_string());
+            let usage = sessions.entry(id.clone()).or_insert_with(|| SessionUsage {
+                session_id: id.clone(),
+                entries: 0,
+                bytes: 0,
+                first_seen: header.timestamp,
+                last_seen: header.timestamp,
+            });
+            usage.entries += 1;
+            usage.bytes += line.len() as u64 + 1;
+            usage.first_seen = usage.first_seen.min(header.timestamp);
+            usage.last_seen = usage.last_seen.max(header.timestamp);
+            lines.push((Some(id), line.to_string()));
+        }
+        Ok(Self { lines, sessions })
+    }
+
+    /// Sessions, most recently active first.
+    fn sessions(&self) -> Vec<SessionUsage> {
+        let mut sessions: Vec<SessionUsage> = self.sessions.values().cloned().collect();
+        sessions.sort_by(|a, b| b.last_seen.cmp(&a.last_seen));
+        sessions
+    }
+}
+
+/// Disk used by the traffic log at `log_file`, by session, and by the
+/// directories in `areas`.
+pub fn usage(log_file: &Path, areas: &[(&str, PathBuf)]) -> Result<StorageUsage> {
+    let log = Log::read(log_file)?;
+    Ok(StorageUsage {
+        log_file: log_file.to_path_buf(),
+        log_bytes: fs::metadata(log_file).map(|m| m.len()).unwrap_or(0),
+        sessions: log.sessions(),
+        areas: areas
+            .iter()
+            .map(|(name, path)| {
+                let (files, bytes) = dir_usage(path);
+                AreaUsage {
+                    name: name.to_string(),
+                    path: path.clone(),
+                    files,
+                    bytes,
+                }
+            })
+            .collect(),
+    })
+}
+
+fn dir_usage(dir: &Path) -> (usize, u64) {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return (0, 0);
+    };
+    entries
+        .flatten()
+        .filter_map(|entry| entry.metadata().ok())
+        .filter(|metadata| metadata.is_file())
+        .fold((0, 0), |(files, bytes), m| (files + 1, bytes + m.len()))
+}
+
+pub fn render_usage(usage: &StorageUsage) -> Vec<String> {
+    let mut lines = vec![format!(
+        "{:?}: {} in {} session(s)",
+        usage.log_file,
+        human_bytes(usage.log_bytes),
+        usage.sessions.len()
+    )];
+    if !usage.sessions.is_empty() {
+        lines.push(String::new());
+        lines.push(format!(
+            "{:<36}  {:>9}  {:>8}  LAST ACTIVE",
+            "SESSION", "SIZE", "ENTRIES"
+        ));
+        for session in &usage.sessions {
+            lines.push(format!(
+                "{:<36}  {:>9}  {:>8}  {}",
+                session.session_id,
+                human_bytes(session.bytes),
+                session.entries,
+                session.last_seen.format("%Y-%m-%d %H:%M:%S")
+            ));
+        }
+    }
+    if !usage.areas.is_empty() {
+        lines.push(String::new());
+        for area in &usage.areas {
+            lines.push(format!(
+                "{:<8} {:>9} in {} file(s)  {:?}",
+                area.name,
+                human_bytes(area.bytes),
+                area.files,
+                area.path
+            ));
+        }
+    }
+    lines
+}
+
+pub fn human_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KB", "MB", "GB", "TB"];
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut value = bytes as f64 / 1024.0;
+    let mut unit = 0;
+    while value >= 1024.0 && unit < UNITS.len() - 1 {
+        value /= 1024.0;
+        unit += 1;
+    }
+    format!("{:.1} {}", value, UNITS[unit])
+}
+
+/// What pruning removed, or would remove with `dry_run`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct PruneReport {
+    /// Sessions removed from the traffic log, oldest first
+    pub sessions: Vec<String>,
+    pub entries: usize,
+    pub log_bytes: u64,
+    pub blobs: usize,
+    pub blob_bytes: u64,
+}
+
+impl PruneReport {
+    pub fn is_empty(&self) -> bool {
+        self.sessions.is_empty() && self.blobs == 0
+    }
+}
+
+/// The sessions of `log` that `config` no longer allows, never those in
+/// `keep`. Age and count limits go first; then the oldest remaining
+/// sessions go until the log fits the size limit.
+fn expired(
+    log: &Log,
+    config: &RetentionConfig,
+    keep: &HashSet<String>,
+    now: DateTime<Utc>,
+) -> Vec<SessionUsage> {
+    // Oldest first
+    let mut sessions = log.sessions();
+    sessions.reverse();
+    let mut total: u64 = log.lines.iter().map(|(_, l)| l.len() as u64 + 1).sum();
+    let mut remaining = sessions.len();
+    let mut removed = Vec::new();
+    for session in sessions {
+        if keep.contains(&session.session_id) {
+            continue;
+        }
+        let too_old = config
+            .max_age()
+            .is_some_and(|age| session.last_seen < now - age);
+        let too_many = config.max_sessions.is_some_and(|max| remaining > max);
+        let too_big = config
+            .max_size_mb
+            .is_some_and(|mb| total > mb.saturating_mul(1024 * 1024));
+        if too_old || too_many || too_big {
+            total -= session.bytes;
+            remaining -= 1;
+            removed.push(session);
+        }
+    }
+    removed
+}
+
+/// Remove the sessions `config` no longer allows from the traffic log at
+/// `path`, except those in `keep`. The log is rewritten to a temporary file
+/// and renamed over the original, so a crash leaves one or the other.
+pub fn prune_log(
+    path: &Path,
+    config: &RetentionConfig,
+    keep: &HashSet<String>,
+    now: DateTime<Utc>,
+    dry_run: bool,
+) -> Result<PruneReport> {
+    let log = Log::read(path)?;
+    let removed = expired(&log, config, keep, now);
+    let report = PruneReport {
+        sessions: removed.iter().map(|s| s.session_id.clone()).collect(),
+        entries: removed.iter().map(|s| s.entries).sum(),
+        log_bytes: removed.iter().map(|s| s.bytes).sum(),
+        ..Default::default()
+    };
+    if removed.is_empty() || dry_run {
+        return Ok(report);
+    }
+
+    let removed: HashSet<&str> = report.sessions.iter().map(String::as_str).collect();
+    let file_name = path
+        .file_name()
+        .context("Traffic log path has no file name")?
+        .to_string_lossy();
+    let tmp = path.with_file_name(format!(".{}.tmp", file_name));
+    let write = || -> std::io::Result<()> {
+        let mut out = BufWriter::new(File::create(&tmp)?);
+        for (session, line) in &log.lines {
+            if !session.as_deref().is_some_and(|s| removed.contains(s)) {
+                writeln!(out, "{}", line)?;
+            }
+        }
+        out.into_inner()?.sync_all()?;
+        fs::rename(&tmp, path)
+    };
+    if let Err(e) = write() {
+        let _ = fs::remove_file(&tmp);
+        return Err(e).with_context(|| format!("Failed to rewrite traffic log {:?}", path));
+    }
+    Ok(report)
+}
+
+/// Remove blobs in `dir` not written or reused within `config`'s maximum
+/// age. Returns the number of blobs and bytes removed.
+pub fn prune_blobs(
+    dir: &Path,
+    config: &RetentionConfig,
+    now: SystemTime,
+    dry_run: bool,
+) -> Result<(usize, u64)> {
+    let Some(max_age) = config.max_age_days else {
+        return Ok((0, 0));
+    };
+    let Some(cutoff) = now.checked_sub(std::time::Duration::from_secs(
+        max_age.saturating_mul(24 * 60 * 60),
+    )) else {
+        return Ok((0, 0));
+    };
+    let Ok(entries) = fs::read_dir(dir) else {
+        return Ok((0, 0));
+    };
+    let (mut blobs, mut bytes) = (0, 0);
+    for entry in entries.flatten() {
+        let Ok(metadata) = entry.metadata() else {
+            continue;
+        };
+        let old = metadata.modified().is_ok_and(|modified| modified < cutoff);
+        if !metadata.is_file() || !old {
+            continue;
+        }
+        if !dry_run {
+            fs::remove_file(entry.path())
+                .with_context(|| format!("Failed to remove blob {:?}", entry.path()))?;
+        }
+        blobs += 1;
+        bytes += metadata.len();
+    }
+    Ok((blobs, bytes))
+}
+
+/// Applies the retention limits while `km monitor` runs. It runs on the
+/// thread writing the traffic log, between writes, so its own session never
+/// loses an entry; it leaves the log alone while another session is running,
+/// since rewriting it would cut that session's writes off.
+#[derive(Debug)]
+pub struct Janitor {
+    config: RetentionConfig,
+    session_id: String,
+    blob_dir: Option<PathBuf>,
+    next: Instant,
+}
+
+impl Janitor {
+    /// The first run is due straight away.
+    pub fn new(config: RetentionConfig, session_id: &str, blob_dir: Option<PathBuf>) -> Self {
+        Self {
+            config,
+            session_id: session_id.to_string(),
+            blob_dir,
+            next: Instant::now(),
+        }
+    }
+
+    pub fn due(&self) -> bool {
+        Instant::now() >= self.next
+    }
+
+    /// Prune the traffic log at `log_file` and the blobs. The caller must
+    /// have closed the log.
+    pub fn run(&mut self, log_file: &Path) {
+        self.next = Instant::now() + JANITOR_INTERVAL;
+        let others = tail::default_dir()
+            .map(|dir| tail::running(&dir))
+            .unwrap_or_default()
+            .into_iter()
+            .any(|endpoint| endpoint.session_id != self.session_id);
+        if others {
+            tracing::debug!(
+                "Not pruning {:?} while other sessions are running",
+                log_file
+            );
+        } else {
+            let keep = HashSet::from([self.session_id.clone()]);
+            match prune_log(log_file, &self.config, &keep, Utc::now(), false) {
+                Ok(report) if !report.sessions.is_empty() => tracing::info!(
+                    "Pruned {} session(s) ({} bytes) from {:?}",
+                    report.sessions.len(),
+                    report.log_bytes,
+                    log_file
+                ),
+                Ok(_) => {}
+                Err(e) => tracing::warn!("Retention: {:#}", e),
+            }
+        }
+        if let Some(ref dir) = self.blob_dir {
+            match prune_blobs(dir, &self.config, SystemTime::now(), false) {
+                Ok((0, _)) => {}
+                Ok((blobs, bytes)) => {
+                    tracing::info!("Pruned {} blob(s) ({} bytes)", blobs, bytes)
+                }
+                Err(e) => tracing::warn!("Retention: {:#}", e),
+            }
+        }
+    }
+}
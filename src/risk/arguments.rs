@@ -0,0 +1,367 @@
+//! Rules for the arguments of tools/call requests. The payload patterns
+//! match anywhere in a message, so a note that merely mentions `/etc/passwd`
+//! scores like a tool told to read it. Here the arguments are parsed and
+//! each one's role - a path, a SQL statement, a URL, a shell command - is
+//! worked out from its name and, when the server's tools/list answer was
+//! seen, its input schema. Targeted rules then check only the arguments
+//! they apply to, and the payload patterns they stand in for are dropped.
+
+use reqwest::Url;
+use serde_json::Value;
+use std::net::IpAddr;
+
+use super::{RiskAssessment, RiskExplanation, RiskLevel};
+
+pub const TOOLS_CALL_METHOD: &str = "tools/call";
+
+/// What an argument holds.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ArgumentRole {
+    Path,
+    Sql,
+    Url,
+    Command,
+}
+
+impl ArgumentRole {
+    const ALL: [ArgumentRole; 4] = [Self::Path, Self::Sql, Self::Url, Self::Command];
+
+    /// Payload patterns and heuristic signals this role's rules stand in for
+    fn supersedes(self) -> &'static [&'static str] {
+        match self {
+            Self::Path => &["sensitive_path", "path_traversal"],
+            Self::Sql => &["destructive_sql"],
+            Self::Url => &["raw_ip_url"],
+            Self::Command => &["command_chaining"],
+        }
+    }
+}
+
+/// Name, category, weight and role of each argument rule
+const RULES: &[(&str, &str, f32, ArgumentRole)] = &[
+    (
+        "sensitive_path_argument",
+        "sensitive_data",
+        0.4,
+        ArgumentRole::Path,
+    ),
+    (
+        "path_traversal_argument",
+        "sensitive_data",
+        0.3,
+        ArgumentRole::Path,
+    ),
+    (
+        "destructive_sql_argument",
+        "destructive",
+        0.5,
+        ArgumentRole::Sql,
+    ),
+    (
+        "cloud_metadata_url_argument",
+        "network",
+        0.6,
+        ArgumentRole::Url,
+    ),
+    ("internal_url_argument", "network", 0.4, ArgumentRole::Url),
+    (
+        "command_chaining_argument",
+        "code_execution",
+        0.2,
+        ArgumentRole::Command,
+    ),
+];
+
+/// Paths, or path prefixes, holding system configuration or credentials
+const SENSITIVE_PREFIXES: &[&str] = &[
+    "/etc/",
+    "/root/",
+    "/proc/",
+    "/sys/",
+    "/boot/",
+    "/dev/",
+    "/var/run/secrets/",
+    "c:/windows/system32/",
+];
+/// Files and directories holding credentials wherever they are
+const SENSITIVE_PARTS: &[&str] = &[
+    "/.ssh/",
+    "/.aws/",
+    "/.gnupg/",
+    "/.kube/",
+    "/.docker/config.json",
+    "/.netrc",
+    "/.git-credentials",
+    "/id_rsa",
+    "/id_ed25519",
+];
+
+/// The role of the argument `name`, from its name and, when the tool's
+/// input schema is known, its `format` and `description`.
+pub fn role(name: &str, schema: Option<&Value>) -> Option<ArgumentRole> {
+    let field = |key: &str| schema.and_then(|s| s.get(key)).and_then(Value::as_str);
+    if matches!(
+        field("format"),
+        Some("uri" | "url" | "iri" | "uri-reference")
+    ) {
+        return Some(ArgumentRole::Url);
+    }
+
+    let name = name.to_ascii_lowercase().replace(['-', '_'], "");
+    let name = name.strip_suffix('s').unwrap_or(&name);
+    let ends = |suffixes: &[&str]| suffixes.iter().any(|suffix| name.ends_with(suffix));
+    if name.contains("sql") || matches!(name, "query" | "statement") {
+        return Some(ArgumentRole::Sql);
+    }
+    if ends(&["url", "uri", "endpoint", "href", "webhook"]) {
+        return Some(ArgumentRole::Url);
+    }
+    if ends(&[
+        "path",
+        "file",
+        "filename",
+        "dir",
+        "directory",
+        "folder",
+        "cwd",
+    ]) {
+        return Some(ArgumentRole::Path);
+    }
+    if ends(&["command", "cmd", "script", "shell"]) {
+        return Some(ArgumentRole::Command);
+    }
+
+    let description = field("description")?.to_ascii_lowercase();
+    if description.contains("sql") {
+        Some(ArgumentRole::Sql)
+    } else if description.contains("url") {
+        Some(ArgumentRole::Url)
+    } else if description.contains("path") || description.contains("directory") {
+        Some(ArgumentRole::Path)
+    } else if description.contains("shell command") {
+        Some(ArgumentRole::Command)
+    } else {
+        None
+    }
+}
+
+/// The rules `value`, an argument with `role`, matches.
+fn check(role: ArgumentRole, value: &str) -> Vec<&'static str> {
+    let mut matched = Vec::new();
+    match role {
+        ArgumentRole::Path => {
+            let path = value.replace('\\', "/").to_ascii_lowercase();
+            // Relative paths and ones in the home directory can only match
+            // the credential files
+            let rooted = format!("/{}", path.trim_start_matches("~/"));
+            let segments = || path.split('/');
+            if SENSITIVE_PREFIXES
+                .iter()
+                .any(|prefix| path.starts_with(prefix) || path == prefix.trim_end_matches('/'))
+                || SENSITIVE_PARTS.iter().any(|part| rooted.contains(part))
+                || segments().any(|s| s == ".env" || s.starts_with(".env."))
+            {
+                matched.push("sensitive_path_argument");
+            }
+            if segments().any(|s| s == "..") {
+                matched.push("path_traversal_argument");
+            }
+        }
+        ArgumentRole::Sql => {
+            let destructive = value.split(';').any(|statement| {
+                let statement = statement.trim().to_ascii_lowercase();
+                let words: Vec<&str> = statement.split_whitespace().collect();
+                match words.as_slice() {
+                    ["drop", "table" | "database" | "schema", ..]
+                    | ["truncate", ..]
+                    | ["alter", "table", ..]
+                    | ["grant", ..]
+                    | ["revoke", ..] => true,
+                    // Every row
+                    ["delete", ..] | ["update", ..] => !words.contains(&"where"),
+                    _ => false,
+                }
+            });
+            if destructive {
+                matched.push("destructive_sql_argument");
+            }
+        }
+        ArgumentRole::Url => {
+            let host = Url::parse(value.trim())
+                .ok()
+                .and_then(|url| url.host_str().map(|h| h.to_ascii_lowercase()));
+            if let Some(host) = host {
+                let ip = host
+                    .trim_start_matches('[')
+                    .trim_end_matches(']')
+                    .parse::<IpAddr>()
+                    .ok();
+                if host == "169.254.169.254"
+                    || host == "metadata.google.internal"
+                    || host == "[fd00:ec2::254]"
+                {
+                    matched.push("cloud_metadata_url_argument");
+                } else if internal(&host, ip) {
+                    matched.push("internal_url_argument");
+                }
+            }
+        }
+        ArgumentRole::Command => {
+            if ["&&", "||", ";", "|", "$(", "`", ">"]
+                .iter()
+                .any(|chain| value.contains(chain))
+            {
+                matched.push("command_chaining_argument");
+            }
+        }
+    }
+    matched
+}
+
+/// Loopback, private and link-local addresses, and names only a local
+/// network resolves.
+fn internal(host: &str, ip: Option<IpAddr>) -> bool {
+    match ip {
+        Some(IpAddr::V4(ip)) => {
+            ip.is_loopback() || ip.is_private() || ip.is_link_local() || ip.is_unspecified()
+        }
+        Some(IpAddr::V6(ip)) => {
+            let first = ip.segments()[0];
+            ip.is_loopback()
+                || ip.is_unspecified()
+                // Unique local (fc00::/7) and link-local (fe80::/10)
+                || first & 0xfe00 == 0xfc00
+                || first & 0xffc0 == 0xfe80
+        }
+        None => {
+            host == "localhost"
+                || [".localhost", ".internal", ".local"]
+                    .iter()
+                    .any(|suffix| host.ends_with(suffix))
+        }
+    }
+}
+
+/// An argument rule that matched.
+#[derive(Debug, Clone, PartialEq)]
+struct Finding {
+    rule: &'static str,
+    /// Where the argument is, e.g. `path` or `options.target`
+    argument: String,
+}
+
+/// What checking the arguments of a call found.
+#[derive(Debug, Default)]
+struct Checked {
+    /// Roles of the arguments that were checked
+    roles: Vec<ArgumentRole>,
+    findings: Vec<Finding>,
+}
+
+fn walk(
+    name: &str,
+    value: &Value,
+    schema: Option<&Value>,
+    role: Option<ArgumentRole>,
+    checked: &mut Checked,
+) {
+    match value {
+        Value::String(value) => {
+            let Some(role) = role else {
+                return;
+            };
+            if !checked.roles.contains(&role) {
+                checked.roles.push(role);
+            }
+            for rule in check(role, value) {
+                // Each rule counts once, for the first argument it matches
+                if !checked.findings.iter().any(|f| f.rule == rule) {
+                    checked.findings.push(Finding {
+                        rule,
+                        argument: name.to_string(),
+                    });
+                }
+            }
+        }
+        Value::Array(items) => {
+            let items_schema = schema.and_then(|s| s.get("items"));
+            for item in items {
+                walk(name, item, items_schema, role, checked);
+            }
+        }
+        Value::Object(fields) => {
+            for (key, value) in fields {
+                let schema = schema
+                    .and_then(|s| s.get("properties"))
+                    .and_then(|p| p.get(key));
+                let path = if name.is_empty() {
+                    key.clone()
+                } else {
+                    format!("{}.{}", name, key)
+                };
+                walk(&path, value, schema, self::role(key, schema), checked);
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Rescore a tools/call request with the argument rules. `input_schema`
+/// looks up a tool's input schema by name. With a schema every argument's
+/// role is known, and the payload patterns the rules stand in for are
+/// dropped; without one, a role's patterns are dropped only when the call
+/// has an argument with that role.
+pub fn refine(
+    assessment: &mut RiskAssessment,
+    content: &str,
+    input_schema: impl FnOnce(&str) -> Option<Value>,
+) {
+    let Ok(message) = serde_json::from_str::<Value>(content) else {
+        return;
+    };
+    let Some(arguments @ Value::Object(_)) = message.pointer("/params/arguments") else {
+        return;
+    };
+    let schema = message
+        .pointer("/params/name")
+        .and_then(Value::as_str)
+        .and_then(input_schema)
+        .filter(|schema| schema.get("properties").is_some());
+
+    let mut checked = Checked::default();
+    walk("", arguments, schema.as_ref(), None, &mut checked);
+
+    let superseded: Vec<&str> = ArgumentRole::ALL
+        .iter()
+        .filter(|role| schema.is_some() || checked.roles.contains(role))
+        .flat_map(|role| role.supersedes())
+        .copied()
+        .collect();
+    assessment
+        .matched_patterns
+        .retain(|pattern| !superseded.contains(&pattern.as_str()));
+    let explanation = &mut assessment.explanation;
+    explanation.remove(&superseded);
+    for finding in checked.findings {
+        if let Some((name, category, weight, _)) = rule(finding.rule) {
+            explanation.add_for_argument(name, category, weight, &finding.argument);
+            assessment.matched_patterns.push(name.to_string());
+        }
+    }
+    assessment.score = explanation.score();
+    assessment.level = RiskLevel::from_score(assessment.score);
+}
+
+fn rule(name: &str) -> Option<(&'static str, &'static str, f32, ArgumentRole)> {
+    RULES.iter().find(|(rule, ..)| *rule == name).copied()
+}
+
+/// Whether an argument rule in `explanation` already covers the payload
+/// pattern or signal `pattern`.
+pub fn superseded(explanation: &RiskExplanation, pattern: &str) -> bool {
+    explanation.contributions.iter().any(|contribution| {
+        contribution.argument.is_some()
+            && rule(&contribution.pattern)
+                .is_some_and(|(.., role)| role.supersedes().contains(&pattern))
+    })
+}
@@ -0,0 +1,134 @@
+use anyhow::Result;
+use async_trait::async_trait;
+use regex::Regex;
+use std::borrow::Cow;
+
+use super::arguments;
+use super::provider::{RiskAnalyzer, RiskSample};
+use super::{PatternRiskAnalyzer, RiskAssessment, RiskLevel};
+
+/// Tokens at least this long are checked for randomness
+const MIN_SECRET_LEN: usize = 32;
+/// Bits per character above which a token looks like a key rather than text
+const SECRET_ENTROPY: f64 = 4.5;
+
+/// Name, category, regex and weight of each signal
+const SIGNALS: &[(&str, &str, &str, f32)] = &[
+    (
+        "command_chaining",
+        "code_execution",
+        r"(?i)(&&|\|\||;)\s*(curl|wget|bash|sh|python3?|nc|ncat|powershell)\b",
+        0.15,
+    ),
+    (
+        "raw_ip_url",
+        "network",
+        r"(?i)\b(https?|ftp)://\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b",
+        0.2,
+    ),
+    (
+        "path_traversal",
+        "sensitive_data",
+        r"(\.\./){2,}|(\.\.\\){2,}",
+        0.3,
+    ),
+    (
+        "obfuscated_payload",
+        "obfuscation",
+        r"(?i)\bbase64\s+(-d|--decode)\b|\beval\s*\(\s*(atob|base64_decode)\b",
+        0.3,
+    ),
+];
+
+/// A local ensemble: the pattern score plus weaker signals that catch
+/// things no single pattern names, like high-entropy secrets, raw IP URLs
+/// and path traversal.
+#[derive(Debug, Clone)]
+pub struct HeuristicRiskAnalyzer {
+    patterns: PatternRiskAnalyzer,
+    signals: Vec<(&'static str, &'static str, Regex, f32)>,
+    secret_candidate: Regex,
+}
+
+impl HeuristicRiskAnalyzer {
+    pub fn new(patterns: PatternRiskAnalyzer) -> Self {
+        let signals = SIGNALS
+            .iter()
+            .filter_map(|(name, category, pattern, weight)| {
+                Regex::new(pattern)
+                    .ok()
+                    .map(|re| (*name, *category, re, *weight))
+            })
+            .collect();
+        Self {
+            patterns,
+            signals,
+            secret_candidate: Regex::new(r"[A-Za-z0-9+/=_\-]{32,}").expect("valid regex"),
+        }
+    }
+
+    pub fn analyze(&self, method: Option<&str>, content: &str) -> RiskAssessment {
+        let mut assessment = self.patterns.analyze(method, content);
+
+        // The heuristics stay within the same scan budget
+        let mut end = content.len().min(self.patterns.scan_budget);
+        while !content.is_char_boundary(end) {
+            end -= 1;
+        }
+        let scanned = &content[..end];
+
+        let explanation = &mut assessment.explanation;
+        for (name, category, regex, weight) in &self.signals {
+            if regex.is_match(scanned) && !arguments::superseded(explanation, name) {
+                explanation.add(name, category, *weight);
+                assessment.matched_patterns.push(name.to_string());
+            }
+        }
+        let secret = self
+            .secret_candidate
+            .find_iter(scanned)
+            .any(|m| m.as_str().len() >= MIN_SECRET_LEN && entropy(m.as_str()) > SECRET_ENTROPY);
+        if secret {
+            explanation.add("high_entropy_secret", "secrets", 0.3);
+            assessment
+                .matched_patterns
+                .push("high_entropy_secret".to_string());
+        }
+
+        assessment.score = assessment.explanation.score();
+        assessment.level = RiskLevel::from_score(assessment.score);
+        assessment.provider = Cow::Borrowed("heuristic");
+        assessment
+    }
+}
+
+/// Shannon entropy in bits per character.
+fn entropy(token: &str) -> f64 {
+    let mut counts = [0u32; 256];
+    for b in token.bytes() {
+        counts[b as usize] += 1;
+    }
+    let len = token.len() as f64;
+    counts
+        .iter()
+        .filter(|&&c| c > 0)
+        .map(|&c| {
+            let p = c as f64 / len;
+            -p * p.log2()
+        })
+        .sum()
+}
+
+#[async_trait]
+impl RiskAnalyzer for HeuristicRiskAnalyzer {
+    fn name(&self) -> &'static str {
+        "heuristic"
+    }
+
+    async fn analyze_batch(&self, samples: &[RiskSample<'_>]) -> Result<Vec<RiskAssessment>> {
+        Ok(samples
+            .iter()
+            .map(|s| self.analyze(s.method, s.content))
+            .collect())
+    }
+}
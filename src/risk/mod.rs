@@ -0,0 +1,414 @@
+use regex::bytes::Regex;
+use serde::{Deserialize, Serialize};
+use std::borrow::Cow;
+use std::collections::BTreeMap;
+use std::fmt;
+
+pub mod arguments;
+pub mod heuristic;
+pub mod provider;
+pub mod remote;
+pub mod rules;
+
+/// Bytes of a payload scanned by default before the analyzer gives up and
+/// reports a partial score
+pub const DEFAULT_SCAN_BUDGET: usize = 4 * 1024 * 1024;
+/// Payloads are scanned this many bytes at a time...
+const CHUNK_SIZE: usize = 64 * 1024;
+/// ...with this much of the previous chunk repeated, so matches spanning a
+/// chunk boundary are still found
+const CHUNK_OVERLAP: usize = 1024;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum RiskLevel {
+    Low,
+    Medium,
+    High,
+    Critical,
+}
+
+impl RiskLevel {
+    pub const ALL: [RiskLevel; 4] = [
+        RiskLevel::Low,
+        RiskLevel::Medium,
+        RiskLevel::High,
+        RiskLevel::Critical,
+    ];
+
+    pub fn from_score(score: f32) -> Self {
+        if score >= 0.85 {
+            RiskLevel::Critical
+        } else if score >= 0.6 {
+            RiskLevel::High
+        } else if score >= 0.3 {
+            RiskLevel::Medium
+        } else {
+            RiskLevel::Low
+        }
+    }
+}
+
+impl fmt::Display for RiskLevel {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let s = match self {
+            RiskLevel::Low => "low",
+            RiskLevel::Medium => "medium",
+            RiskLevel::High => "high",
+            RiskLevel::Critical => "critical",
+        };
+        f.write_str(s)
+    }
+}
+
+impl std::str::FromStr for RiskLevel {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "low" => Ok(RiskLevel::Low),
+            "medium" => Ok(RiskLevel::Medium),
+            "high" => Ok(RiskLevel::High),
+            "critical" => Ok(RiskLevel::Critical),
+            other => Err(anyhow::anyhow!("Unknown risk level '{}'", other)),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RiskAssessment {
+    pub score: f32,
+    pub level: RiskLevel,
+    pub matched_patterns: Vec<String>,
+    /// Share of the payload that was scanned, 1.0 unless the scan budget ran
+    /// out. A partial score is a lower bound.
+    pub confidence: f32,
+    /// Which risk provider produced the assessment
+    pub provider: Cow<'static, str>,
+    /// How the score was reached; empty for remote scores
+    #[serde(default)]
+    pub explanation: RiskExplanation,
+}
+
+impl RiskAssessment {
+    /// The assessment stored in an event's `risk` metadata, if any.
+    pub fn from_metadata(metadata: &BTreeMap<String, serde_json::Value>) -> Option<Self> {
+        serde_json::from_value(metadata.get("risk")?.clone()).ok()
+    }
+}
+
+/// What one matched pattern or signal added to a score.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RiskContribution {
+    pub pattern: String,
+    pub category: String,
+    pub weight: f32,
+    /// The tools/call argument an argument rule matched
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub argument: Option<String>,
+}
+
+/// Why a payload got its score: the method's baseline plus the weight of
+/// everything that matched, capped at 1.0.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct RiskExplanation {
+    /// Baseline for the JSON-RPC method before looking at the payload
+    pub method_base: f32,
+    pub contributions: Vec<RiskContribution>,
+    /// Total weight added per category
+    pub categories: BTreeMap<String, f32>,
+    /// The weights added up to more than 1.0
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub capped: bool,
+}
+
+impl RiskExplanation {
+    pub fn new(method_base: f32) -> Self {
+        Self {
+            method_base,
+            ..Default::default()
+        }
+    }
+
+    pub fn add(&mut self, pattern: &str, category: &str, weight: f32) {
+        self.contributions.push(RiskContribution {
+            pattern: pattern.to_string(),
+            category: category.to_string(),
+            weight,
+            argument: None,
+        });
+        *self.categories.entry(category.to_string()).or_default() += weight;
+    }
+
+    /// Like [`RiskExplanation::add`], for a rule that matched `argument`.
+    pub fn add_for_argument(&mut self, pattern: &str, category: &str, weight: f32, argument: &str) {
+        self.add(pattern, category, weight);
+        if let Some(contribution) = self.contributions.last_mut() {
+            contribution.argument = Some(argument.to_string());
+        }
+    }
+
+    /// Take back what `patterns` added.
+    fn remove(&mut self, patterns: &[&str]) {
+        self.contributions
+            .retain(|c| !patterns.contains(&c.pattern.as_str()));
+        self.categories.clear();
+        for c in &self.contributions {
+            *self.categories.entry(c.category.clone()).or_default() += c.weight;
+        }
+    }
+
+    /// The score before capping.
+    pub fn total(&self) -> f32 {
+        self.method_base + self.contributions.iter().map(|c| c.weight).sum::<f32>()
+    }
+
+    /// The score, capped at 1.0; records whether the cap applied.
+    fn score(&mut self) -> f32 {
+        let total = self.total();
+        self.capped = total > 1.0;
+        total.min(1.0)
+    }
+
+    /// One line per part of the score, largest first, for `km inspect`.
+    pub fn lines(&self) -> Vec<String> {
+        let mut contributions: Vec<&RiskContribution> = self.contributions.iter().collect();
+        contributions.sort_by(|a, b| b.weight.total_cmp(&a.weight));
+
+        let mut lines = Vec::new();
+        if self.method_base > 0.0 {
+            lines.push(format!("  +{:.2}  method baseline", self.method_base));
+        }
+        for c in contributions {
+            let argument = match c.argument {
+                Some(ref argument) => format!(" in `{}`", argument),
+                None => String::new(),
+            };
+            lines.push(format!(
+                "  +{:.2}  {} ({}){}",
+                c.weight, c.pattern, c.category, argument
+            ));
+        }
+        if self.capped {
+            lines.push(format!("  = {:.2}, capped at 1.00", self.total()));
+        }
+        lines
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct RiskPattern {
+    pub name: String,
+    /// What kind of risk the pattern detects, e.g. `secrets`
+    pub category: String,
+    pub regex: Regex,
+    pub weight: f32,
+}
+
+/// Scores MCP messages locally by matching their payload against known
+/// dangerous patterns (destructive commands, secrets, sensitive paths).
+#[derive(Debug, Clone)]
+pub struct PatternRiskAnalyzer {
+    patterns: Vec<RiskPattern>,
+    scan_budget: usize,
+}
+
+/// Name, category, regex and weight of each built-in pattern
+const BUILTIN_PATTERNS: &[(&str, &str, &str, f32)] = &[
+    (
+        "destructive_shell",
+        "destructive",
+        r"(?i)\brm\s+-[a-z]*[rf][a-z]*\b|\bmkfs(\.\w+)?\b|\bdd\s+if=|:\(\)\s*\{",
+        0.6,
+    ),
+    (
+        "destructive_sql",
+        "destructive",
+        r"(?i)\b(drop\s+(table|database)|truncate\s+table|delete\s+from)\b",
+        0.5,
+    ),
+    (
+        "sensitive_path",
+        "sensitive_data",
+        r"(/etc/(passwd|shadow|sudoers)|\.ssh/|id_rsa|\.aws/credentials|\.kube/config)",
+        0.4,
+    ),
+    (
+        "private_key",
+        "secrets",
+        r"-----BEGIN [A-Z ]*PRIVATE KEY-----",
+        0.7,
+    ),
+    (
+        "cloud_credential",
+        "secrets",
+        r"\b(AKIA[0-9A-Z]{16}|ghp_[A-Za-z0-9]{36}|sk-[A-Za-z0-9]{20,})\b",
+        0.5,
+    ),
+    (
+        "remote_execution",
+        "code_execution",
+        r"(?i)(curl|wget)[^|]*\|\s*(ba|z)?sh\b",
+        0.6,
+    ),
+    (
+        "privilege_escalation",
+        "privilege_escalation",
+        r"(?i)\b(sudo|chmod\s+777|chown\s+root)\b",
+        0.3,
+    ),
+];
+
+impl Default for PatternRiskAnalyzer {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl PatternRiskAnalyzer {
+    pub fn new() -> Self {
+        let patterns = BUILTIN_PATTERNS
+            .iter()
+            .filter_map(|(name, category, pattern, weight)| {
+                Regex::new(pattern).ok().map(|regex| RiskPattern {
+                    name: name.to_string(),
+                    category: category.to_string(),
+                    regex,
+                    weight: *weight,
+                })
+            })
+            .collect();
+
+        Self {
+            patterns,
+            scan_budget: DEFAULT_SCAN_BUDGET,
+        }
+    }
+
+    /// Also match `patterns`, e.g. from rule packs.
+    pub fn with_patterns(mut self, patterns: Vec<RiskPattern>) -> Self {
+        self.patterns.extend(patterns);
+        self
+    }
+
+    /// Scan at most `bytes` of each payload.
+    pub fn with_scan_budget(mut self, bytes: usize) -> Self {
+        self.scan_budget = bytes.max(1);
+        self
+    }
+
+    /// Baseline risk for a JSON-RPC method before looking at the payload.
+    pub fn method_base_score(method: Option<&str>) -> f32 {
+        match method {
+            Some("tools/call") => 0.2,
+            Some("resources/read") | Some("sampling/createMessage") => 0.1,
+            _ => 0.0,
+        }
+    }
+
+    pub fn analyze(&self, method: Option<&str>, content: &str) -> RiskAssessment {
+        self.analyze_with_schemas(method, content, |_| None)
+    }
+
+    /// Like [`PatternRiskAnalyzer::analyze`], with `input_schema` looking up
+    /// the input schema of a called tool, so its arguments can be checked
+    /// by role.
+    pub fn analyze_with_schemas(
+        &self,
+        method: Option<&str>,
+        content: &str,
+        input_schema: impl FnOnce(&str) -> Option<serde_json::Value>,
+    ) -> RiskAssessment {
+        let mut scanner = self.scanner(method);
+        scanner.feed(content.as_bytes());
+        let mut assessment = scanner.finish();
+        if method == Some(arguments::TOOLS_CALL_METHOD) {
+            arguments::refine(&mut assessment, content, input_schema);
+        }
+        assessment
+    }
+
+    /// Start an incremental scan; feed it the payload in pieces.
+    pub fn scanner(&self, method: Option<&str>) -> RiskScanner<'_> {
+        RiskScanner {
+            analyzer: self,
+            base_score: Self::method_base_score(method),
+            matched: vec![false; self.patterns.len()],
+            window: Vec::new(),
+            scanned: 0,
+            seen: 0,
+            complete: false,
+        }
+    }
+}
+
+/// Scans a payload chunk by chunk within the analyzer's budget. Each
+/// pattern is only searched for until it first matches, and scanning stops
+/// early once every pattern has matched.
+#[derive(Debug)]
+pub struct RiskScanner<'a> {
+    analyzer: &'a PatternRiskAnalyzer,
+    base_score: f32,
+    matched: Vec<bool>,
+    /// The overlap carried from the previous chunk, then the current chunk
+    window: Vec<u8>,
+    scanned: u64,
+    seen: u64,
+    /// Every pattern has matched; the rest of the payload can't change the score
+    complete: bool,
+}
+
+impl RiskScanner<'_> {
+    pub fn feed(&mut self, data: &[u8]) {
+        self.seen += data.len() as u64;
+        if self.complete {
+            return;
+        }
+
+        let remaining = (self.analyzer.scan_budget as u64).saturating_sub(self.scanned);
+        let data = &data[..data.len().min(remaining as usize)];
+        for chunk in data.chunks(CHUNK_SIZE) {
+            self.window.extend_from_slice(chunk);
+            for (pattern, matched) in self.analyzer.patterns.iter().zip(&mut self.matched) {
+                if !*matched && pattern.regex.is_match(&self.window) {
+                    *matched = true;
+                }
+            }
+            self.scanned += chunk.len() as u64;
+
+            if self.matched.iter().all(|m| *m) {
+                self.complete = true;
+                self.window = Vec::new();
+                return;
+            }
+            let keep = self.window.len().min(CHUNK_OVERLAP);
+            self.window.drain(..self.window.len() - keep);
+        }
+    }
+
+    pub fn finish(self) -> RiskAssessment {
+        let mut explanation = RiskExplanation::new(self.base_score);
+        let mut matched_patterns = Vec::new();
+        for (pattern, matched) in self.analyzer.patterns.iter().zip(&self.matched) {
+            if *matched {
+                explanation.add(&pattern.name, &pattern.category, pattern.weight);
+                matched_patterns.push(pattern.name.clone());
+            }
+        }
+
+        let confidence = if self.complete || self.scanned >= self.seen {
+            1.0
+        } else {
+            self.scanned as f32 / self.seen as f32
+        };
+        let score = explanation.score();
+        RiskAssessment {
+            score,
+            level: RiskLevel::from_score(score),
+            matched_patterns,
+            confidence,
+            provider: Cow::Borrowed("pattern"),
+            explanation,
+        }
+    }
+}
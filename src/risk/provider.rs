@@ -0,0 +1,98 @@
+use anyhow::Result;
+use async_trait::async_trait;
+use std::fmt::Debug;
+
+use super::{PatternRiskAnalyzer, RiskAssessment};
+
+/// Names accepted in the `risk_providers` setting, most capable first.
+pub const RISK_PROVIDERS: &[&str] = &["remote", "heuristic", "pattern"];
+
+/// One payload to score.
+#[derive(Debug, Clone, Copy)]
+pub struct RiskSample<'a> {
+    pub method: Option<&'a str>,
+    pub content: &'a str,
+}
+
+/// A source of risk scores. Providers score a batch at a time so remote
+/// ones can make a single request per batch.
+#[async_trait]
+pub trait RiskAnalyzer: Send + Sync + Debug {
+    fn name(&self) -> &'static str;
+
+    /// One assessment per sample, in order.
+    async fn analyze_batch(&self, samples: &[RiskSample<'_>]) -> Result<Vec<RiskAssessment>>;
+}
+
+#[async_trait]
+impl RiskAnalyzer for PatternRiskAnalyzer {
+    fn name(&self) -> &'static str {
+        "pattern"
+    }
+
+    async fn analyze_batch(&self, samples: &[RiskSample<'_>]) -> Result<Vec<RiskAssessment>> {
+        Ok(samples
+            .iter()
+            .map(|s| self.analyze(s.method, s.content))
+            .collect())
+    }
+}
+
+/// Providers tried in order: when one fails (a remote API that is down, a
+/// malformed answer), the batch is scored by the next. The pattern analyzer
+/// always comes last, so scoring itself never fails.
+#[derive(Debug)]
+pub struct RiskEngine {
+    providers: Vec<Box<dyn RiskAnalyzer>>,
+    fallback: PatternRiskAnalyzer,
+}
+
+impl Default for RiskEngine {
+    fn default() -> Self {
+        Self::new(Vec::new(), PatternRiskAnalyzer::new())
+    }
+}
+
+impl RiskEngine {
+    pub fn new(providers: Vec<Box<dyn RiskAnalyzer>>, fallback: PatternRiskAnalyzer) -> Self {
+        Self {
+            providers,
+            fallback,
+        }
+    }
+
+    /// Provider names in the order they are tried.
+    pub fn names(&self) -> Vec<&'static str> {
+        let mut names: Vec<_> = self.providers.iter().map(|p| p.name()).collect();
+        names.push(self.fallback.name());
+        names
+    }
+
+    pub async fn analyze_batch(&self, samples: &[RiskSample<'_>]) -> Vec<RiskAssessment> {
+        if samples.is_empty() {
+            return Vec::new();
+        }
+
+        for provider in &self.providers {
+            match provider.analyze_batch(samples).await {
+                Ok(assessments) if assessments.len() == samples.len() => return assessments,
+                Ok(assessments) => tracing::warn!(
+                    "Risk provider {} scored {} of {} samples; falling back",
+                    provider.name(),
+                    assessments.len(),
+                    samples.len()
+                ),
+                Err(e) => tracing::warn!(
+                    "Risk provider {} failed, falling back: {:#}",
+                    provider.name(),
+                    e
+                ),
+            }
+        }
+
+        samples
+            .iter()
+            .map(|s| self.fallback.analyze(s.method, s.content))
+            .collect()
+    }
+}
@@ -0,0 +1,137 @@
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use serde::Deserialize;
+use serde_json::json;
+use std::borrow::Cow;
+use std::sync::Arc;
+use std::time::Duration;
+
+use super::provider::{RiskAnalyzer, RiskSample};
+use super::{RiskAssessment, RiskExplanation, RiskLevel, DEFAULT_SCAN_BUDGET};
+use crate::redaction::Redactor;
+
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Deserialize)]
+struct ScoreResponse {
+    results: Vec<ScoreResult>,
+}
+
+#[derive(Debug, Deserialize)]
+struct ScoreResult {
+    risk_score: f32,
+    #[serde(default)]
+    risk_level: Option<String>,
+    #[serde(default)]
+    signals: Vec<String>,
+}
+
+/// Scores batches with the Kilometers.ai risk model. Each batch is one
+/// request to `/api/risk/score`.
+#[derive(Debug, Clone)]
+pub struct RemoteRiskAnalyzer {
+    endpoint: String,
+    jwt_token: String,
+    client: reqwest::Client,
+    redactor: Option<Arc<Redactor>>,
+    content_limit: usize,
+}
+
+impl RemoteRiskAnalyzer {
+    pub fn new(endpoint: String, jwt_token: String) -> Self {
+        let client = crate::http::client_builder()
+            .timeout(REQUEST_TIMEOUT)
+            .build()
+            .unwrap_or_else(|_| reqwest::Client::new());
+        Self {
+            endpoint,
+            jwt_token,
+            client,
+            redactor: None,
+            content_limit: DEFAULT_SCAN_BUDGET,
+        }
+    }
+
+    /// Scrub payloads with `redactor` before they are sent.
+    pub fn with_redactor(mut self, redactor: Arc<Redactor>) -> Self {
+        self.redactor = Some(redactor);
+        self
+    }
+
+    /// Send at most `bytes` of each payload.
+    pub fn with_content_limit(mut self, bytes: usize) -> Self {
+        self.content_limit = bytes.max(1);
+        self
+    }
+
+    fn truncate<'a>(&self, content: &'a str) -> &'a str {
+        let mut end = content.len().min(self.content_limit);
+        while !content.is_char_boundary(end) {
+            end -= 1;
+        }
+        &content[..end]
+    }
+}
+
+#[async_trait]
+impl RiskAnalyzer for RemoteRiskAnalyzer {
+    fn name(&self) -> &'static str {
+        "remote"
+    }
+
+    async fn analyze_batch(&self, samples: &[RiskSample<'_>]) -> Result<Vec<RiskAssessment>> {
+        let events: Vec<_> = samples
+            .iter()
+            .map(|s| json!({ "method": s.method, "content": self.truncate(s.content) }))
+            .collect();
+        let mut request = json!({ "events": events });
+        if let Some(ref redactor) = self.redactor {
+            redactor.redact_value(&mut request);
+        }
+
+        let response = self
+            .client
+            .post(&self.endpoint)
+            .bearer_auth(&self.jwt_token)
+            .json(&request)
+            .send()
+            .await
+            .context("Failed to send risk scoring request")?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "Risk scoring failed with status: {}",
+                response.status()
+            ));
+        }
+        let response: ScoreResponse = response
+            .json()
+            .await
+            .context("Failed to parse risk scoring response")?;
+
+        Ok(response
+            .results
+            .into_iter()
+            .zip(samples)
+            .map(|(result, sample)| {
+                let score = result.risk_score.clamp(0.0, 1.0);
+                let level = result
+                    .risk_level
+                    .and_then(|l| l.parse().ok())
+                    .unwrap_or_else(|| RiskLevel::from_score(score));
+                let sent = self.truncate(sample.content).len();
+                RiskAssessment {
+                    score,
+                    level,
+                    matched_patterns: result.signals,
+                    confidence: if sample.content.is_empty() {
+                        1.0
+                    } else {
+                        sent as f32 / sample.content.len() as f32
+                    },
+                    provider: Cow::Borrowed("remote"),
+                    explanation: RiskExplanation::default(),
+                }
+            })
+            .collect())
+    }
+}
@@ -0,0 +1,379 @@
+use anyhow::{Context, Result};
+use regex::bytes::Regex;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use super::RiskPattern;
+use crate::plugins::compare_versions;
+
+/// Where rule packs are loaded from and which of them are switched off.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct RiskRulesConfig {
+    /// Directory rule packs are loaded from (default ~/.config/kilometers/rules)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dir: Option<String>,
+    /// Installed packs that are not applied, by name
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub disabled: Vec<String>,
+}
+
+impl RiskRulesConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        for name in &self.disabled {
+            validate_pack_name(name).context("Invalid risk_rules.disabled entry")?;
+        }
+        Ok(())
+    }
+
+    pub fn is_enabled(&self, pack: &str) -> bool {
+        !self.disabled.iter().any(|name| name == pack)
+    }
+}
+
+fn validate_pack_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-' || c == '_');
+    if valid {
+        Ok(())
+    } else {
+        Err(anyhow::anyhow!(
+            "Invalid rule pack name '{}': use lowercase letters, digits, '-' and '_'",
+            name
+        ))
+    }
+}
+
+/// One pattern in a rule pack.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RiskRule {
+    pub name: String,
+    /// Regex matched against the raw payload
+    pub pattern: String,
+    /// What kind of risk the rule detects, e.g. `exfiltration`; defaults to the pack name
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub category: String,
+    /// Added to the score when the rule matches, between 0 and 1
+    pub weight: f32,
+}
+
+/// A versioned set of risk patterns, shipped as a JSON or YAML file or
+/// published through the API.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RulePack {
+    pub name: String,
+    pub version: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub description: String,
+    pub rules: Vec<RiskRule>,
+}
+
+impl RulePack {
+    /// Parse a pack; the extension of `path` picks JSON or YAML.
+    pub fn parse(path: &Path, text: &str) -> Result<Self> {
+        let pack: RulePack = match extension(path).as_deref() {
+            Some("json") => serde_json::from_str(text)?,
+            Some("yaml") | Some("yml") => parse_yaml(text)?,
+            _ => {
+                return Err(anyhow::anyhow!(
+                    "Rule packs must be .json, .yaml or .yml files"
+                ))
+            }
+        };
+        pack.validate()?;
+        Ok(pack)
+    }
+
+    pub fn load(path: &Path) -> Result<Self> {
+        let text =
+            fs::read_to_string(path).with_context(|| format!("Failed to read {:?}", path))?;
+        Self::parse(path, &text).with_context(|| format!("Invalid rule pack {:?}", path))
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        validate_pack_name(&self.name)?;
+        if self.version.trim().is_empty() {
+            return Err(anyhow::anyhow!("Rule pack '{}' has no version", self.name));
+        }
+        if self.rules.is_empty() {
+            return Err(anyhow::anyhow!("Rule pack '{}' has no rules", self.name));
+        }
+        self.patterns().map(|_| ())
+    }
+
+    /// Compile the rules. Matches are reported as `pack/rule`.
+    pub fn patterns(&self) -> Result<Vec<RiskPattern>> {
+        self.rules
+            .iter()
+            .map(|rule| {
+                if rule.name.is_empty() {
+                    return Err(anyhow::anyhow!(
+                        "A rule in pack '{}' has no name",
+                        self.name
+                    ));
+                }
+                if !(0.0..=1.0).contains(&rule.weight) {
+                    return Err(anyhow::anyhow!(
+                        "Rule '{}' weight must be between 0 and 1 (got {})",
+                        rule.name,
+                        rule.weight
+                    ));
+                }
+                let regex = Regex::new(&rule.pattern)
+                    .with_context(|| format!("Rule '{}' has an invalid pattern", rule.name))?;
+                Ok(RiskPattern {
+                    name: format!("{}/{}", self.name, rule.name),
+                    category: if rule.category.is_empty() {
+                        self.name.clone()
+                    } else {
+                        rule.category.clone()
+                    },
+                    regex,
+                    weight: rule.weight,
+                })
+            })
+            .collect()
+    }
+}
+
+fn extension(path: &Path) -> Option<String> {
+    Some(path.extension()?.to_str()?.to_ascii_lowercase())
+}
+
+#[cfg(feature = "yaml")]
+fn parse_yaml(text: &str) -> Result<RulePack> {
+    Ok(serde_yaml::from_str(text)?)
+}
+
+#[cfg(not(feature = "yaml"))]
+fn parse_yaml(_text: &str) -> Result<RulePack> {
+    Err(anyhow::anyhow!(
+        "YAML rule packs require building with --features yaml; use JSON instead"
+    ))
+}
+
+/// A rule pack found in the rules directory.
+#[derive(Debug, Clone)]
+pub struct InstalledPack {
+    pub pack: RulePack,
+    pub path: PathBuf,
+}
+
+/// The local rules directory. Packs are the `.json`, `.yaml` and `.yml`
+/// files directly inside it; packs from the API are saved as `<name>.json`.
+#[derive(Debug, Clone)]
+pub struct RuleStore {
+    dir: PathBuf,
+}
+
+impl RuleStore {
+    pub fn new(dir: PathBuf) -> Self {
+        Self { dir }
+    }
+
+    /// `~/.config/kilometers/rules` (or the platform equivalent)
+    pub fn default_dir() -> Result<PathBuf> {
+        let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+        Ok(base.config_dir().join("kilometers").join("rules"))
+    }
+
+    pub fn from_config(config: &RiskRulesConfig) -> Result<Self> {
+        match config.dir {
+            Some(ref dir) => Ok(Self::new(PathBuf::from(dir))),
+            None => Ok(Self::new(Self::default_dir()?)),
+        }
+    }
+
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// Installed packs sorted by name. Files that don't parse are skipped
+    /// with a warning, and when two files define the same pack the first by
+    /// file name wins.
+    pub fn installed(&self) -> Result<Vec<InstalledPack>> {
+        if !self.dir.exists() {
+            return Ok(Vec::new());
+        }
+
+        let mut paths = Vec::new();
+        for entry in fs::read_dir(&self.dir).context("Failed to read rules directory")? {
+            let path = entry?.path();
+            let is_pack = matches!(
+                extension(&path).as_deref(),
+                Some("json") | Some("yaml") | Some("yml")
+            );
+            if is_pack && path.is_file() {
+                paths.push(path);
+            }
+        }
+        paths.sort();
+
+        let mut packs: Vec<InstalledPack> = Vec::new();
+        for path in paths {
+            match RulePack::load(&path) {
+                Ok(pack) => match packs.iter().find(|p| p.pack.name == pack.name) {
+                    Some(first) => tracing::warn!(
+                        "Ignoring {:?}: rule pack '{}' is already defined in {:?}",
+                        path,
+                        pack.name,
+                        first.path
+                    ),
+                    None => packs.push(InstalledPack { pack, path }),
+                },
+                Err(e) => tracing::warn!("Skipping rule pack: {:#}", e),
+            }
+        }
+        packs.sort_by(|a, b| a.pack.name.cmp(&b.pack.name));
+        Ok(packs)
+    }
+
+    /// Save a pack from the API as `<name>.json`, replacing the installed
+    /// copy. Packs written by hand in another file are left alone.
+    pub fn install(&self, pack: &RulePack) -> Result<PathBuf> {
+        pack.validate()?;
+        let path = self.dir.join(format!("{}.json", pack.name));
+        if let Some(existing) = self
+            .installed()?
+            .into_iter()
+            .find(|p| p.pack.name == pack.name && p.path != path)
+        {
+            return Err(anyhow::anyhow!(
+                "Rule pack '{}' is defined in {:?}; remove it to install the published version",
+                pack.name,
+                existing.path
+            ));
+        }
+
+        fs::create_dir_all(&self.dir).context("Failed to create rules directory")?;
+        let staging = self.dir.join(format!(".{}.json.tmp", pack.name));
+        fs::write(&staging, serde_json::to_string_pretty(pack)?)
+            .context("Failed to write rule pack")?;
+        fs::rename(&staging, &path).context("Failed to install rule pack")?;
+        Ok(path)
+    }
+}
+
+/// A pack `km rules update` installed or upgraded.
+#[derive(Debug, Clone, PartialEq)]
+pub struct PackUpdate {
+    pub name: String,
+    /// Version that was installed before, if any
+    pub from: Option<String>,
+    pub to: String,
+}
+
+impl RuleStore {
+    /// Install the newest published version of each pack in `index` (or of
+    /// `only`) that is missing or older locally.
+    pub fn update_from(
+        &self,
+        index: &RulePackIndex,
+        only: Option<&str>,
+    ) -> Result<Vec<PackUpdate>> {
+        let installed = self.installed()?;
+        let names = match only {
+            Some(name) => {
+                if index.latest(name).is_none() {
+                    return Err(anyhow::anyhow!("Rule pack '{}' is not published", name));
+                }
+                vec![name]
+            }
+            None => index.names(),
+        };
+
+        let mut updates = Vec::new();
+        for name in names {
+            let Some(latest) = index.latest(name) else {
+                continue;
+            };
+            let current = installed.iter().find(|p| p.pack.name == name);
+            if let Some(current) = current {
+                if compare_versions(&latest.version, &current.pack.version).is_le() {
+                    continue;
+                }
+            }
+            self.install(latest)?;
+            updates.push(PackUpdate {
+                name: name.to_string(),
+                from: current.map(|p| p.pack.version.clone()),
+                to: latest.version.clone(),
+            });
+        }
+        Ok(updates)
+    }
+}
+
+/// Patterns from every enabled pack. A broken rules directory is logged
+/// rather than stopping the session; the built-in patterns still apply.
+pub fn enabled_patterns(config: &RiskRulesConfig) -> Vec<RiskPattern> {
+    let packs = match RuleStore::from_config(config).and_then(|store| store.installed()) {
+        Ok(packs) => packs,
+        Err(e) => {
+            tracing::warn!("Failed to load risk rule packs: {:#}", e);
+            return Vec::new();
+        }
+    };
+
+    packs
+        .into_iter()
+        .filter(|installed| config.is_enabled(&installed.pack.name))
+        .flat_map(|installed| installed.pack.patterns().unwrap_or_default())
+        .collect()
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct RulePackIndex {
+    #[serde(default)]
+    pub packs: Vec<RulePack>,
+}
+
+impl RulePackIndex {
+    /// The newest published version of `name`
+    pub fn latest(&self, name: &str) -> Option<&RulePack> {
+        self.packs
+            .iter()
+            .filter(|pack| pack.name == name)
+            .max_by(|a, b| compare_versions(&a.version, &b.version))
+    }
+
+    /// Names of every published pack, sorted
+    pub fn names(&self) -> Vec<&str> {
+        let mut names: Vec<&str> = self.packs.iter().map(|p| p.name.as_str()).collect();
+        names.sort();
+        names.dedup();
+        names
+    }
+}
+
+/// Fetch the published rule packs from the Kilometers API.
+pub async fn fetch_index(api_url: &str, bearer_token: Option<&str>) -> Result<RulePackIndex> {
+    crate::offline::ensure_online("The rule pack registry")?;
+    let url = format!("{}/api/risk/rule-packs", api_url.trim_end_matches('/'));
+    let mut request = crate::http::client().get(&url);
+    if let Some(token) = bearer_token {
+        request = request.bearer_auth(token);
+    }
+    let response = request
+        .send()
+        .await
+        .context("Failed to reach the rule pack registry")?;
+
+    if !response.status().is_success() {
+        return Err(anyhow::anyhow!(
+            "Rule pack request failed with status {}",
+            response.status()
+        ));
+    }
+
+    response
+        .json::<RulePackIndex>()
+        .await
+        .context("Failed to parse rule pack list")
+}
@@ -0,0 +1,307 @@
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use crate::risk::{PatternRiskAnalyzer, RiskLevel};
+use crate::traffic;
+use crate::uploader::McpEvent;
+
+/// Requests held back waiting for their response, so an error or risky
+/// answer can still bring the request along
+const MAX_HELD: usize = 1000;
+const RATE_WINDOW: Duration = Duration::from_secs(1);
+
+/// Sampling for methods matching `methods`.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SamplingRuleConfig {
+    /// Method patterns (e.g. notifications/*)
+    pub methods: Vec<String>,
+    /// Share of events uploaded, 0.0 to 1.0
+    #[serde(default = "default_rate")]
+    pub rate: f64,
+    /// Upload at most this many events per second for each matching method
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_per_second: Option<u32>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SamplingConfig {
+    /// Share of events uploaded for methods no rule matches
+    #[serde(default = "default_rate")]
+    pub rate: f64,
+    /// Events at or above this risk level are uploaded whatever the rate
+    #[serde(default = "default_always_keep_risk")]
+    pub always_keep_risk: RiskLevel,
+    /// Upload error responses, and the requests they answer, whatever the rate
+    #[serde(default = "default_keep_errors")]
+    pub keep_errors: bool,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<SamplingRuleConfig>,
+}
+
+fn default_rate() -> f64 {
+    1.0
+}
+
+fn default_always_keep_risk() -> RiskLevel {
+    RiskLevel::High
+}
+
+fn default_keep_errors() -> bool {
+    true
+}
+
+impl Default for SamplingConfig {
+    fn default() -> Self {
+        Self {
+            rate: default_rate(),
+            always_keep_risk: default_always_keep_risk(),
+            keep_errors: default_keep_errors(),
+            rules: Vec::new(),
+        }
+    }
+}
+
+impl SamplingConfig {
+    pub fn is_default(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// Whether any event could be left out.
+    pub fn samples(&self) -> bool {
+        self.rate < 1.0
+            || self
+                .rules
+                .iter()
+                .any(|r| r.rate < 1.0 || r.max_per_second.is_some())
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        if !(0.0..=1.0).contains(&self.rate) {
+            return Err(anyhow::anyhow!(
+                "sampling.rate must be between 0 and 1 (got {})",
+                self.rate
+            ));
+        }
+        for (i, rule) in self.rules.iter().enumerate() {
+            if rule.methods.is_empty() || rule.methods.iter().any(|m| m.trim().is_empty()) {
+                return Err(anyhow::anyhow!(
+                    "sampling rule {} needs at least one method pattern",
+                    i + 1
+                ));
+            }
+            if !(0.0..=1.0).contains(&rule.rate) {
+                return Err(anyhow::anyhow!(
+                    "sampling rule {} rate must be between 0 and 1 (got {})",
+                    i + 1,
+                    rule.rate
+                ));
+            }
+            if rule.max_per_second == Some(0) {
+                return Err(anyhow::anyhow!(
+                    "sampling rule {} max_per_second must be greater than 0",
+                    i + 1
+                ));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// What the sampler did with the events it saw.
+#[derive(Debug, Default)]
+pub struct SamplingStats {
+    kept: AtomicU64,
+    dropped: AtomicU64,
+    rescued: AtomicU64,
+}
+
+impl SamplingStats {
+    pub fn kept(&self) -> u64 {
+        self.kept.load(Ordering::Relaxed)
+    }
+
+    /// Events left out by the sample rate or rate limit
+    pub fn dropped(&self) -> u64 {
+        self.dropped.load(Ordering::Relaxed)
+    }
+
+    /// Events kept only because they were risky or errors
+    pub fn rescued(&self) -> u64 {
+        self.rescued.load(Ordering::Relaxed)
+    }
+}
+
+#[derive(Debug)]
+struct SamplerState {
+    rng: fastrand::Rng,
+    /// Per-method (window start, events kept in the window)
+    windows: HashMap<String, (Instant, u32)>,
+    /// Requests whose responses follow them into the upload
+    kept: HashSet<(String, String)>,
+    /// Requests left out at the head, until their response decides
+    held: HashMap<(String, String), McpEvent>,
+    held_order: VecDeque<(String, String)>,
+}
+
+/// Decides which captured events are uploaded. A request is sampled when it
+/// is seen (head sampling) and its response follows the same decision; a
+/// request left out is held until its response arrives, and uploaded after
+/// all if the response is an error or risky (tail sampling). Events at or
+/// above the configured risk level are always kept.
+#[derive(Debug)]
+pub struct Sampler {
+    config: SamplingConfig,
+    analyzer: PatternRiskAnalyzer,
+    state: Mutex<SamplerState>,
+    stats: Arc<SamplingStats>,
+}
+
+impl Sampler {
+    pub fn new(config: SamplingConfig) -> Self {
+        Self {
+            config,
+            analyzer: PatternRiskAnalyzer::new(),
+            state: Mutex::new(SamplerState {
+                rng: fastrand::Rng::new(),
+                windows: HashMap::new(),
+                kept: HashSet::new(),
+                held: HashMap::new(),
+                held_order: VecDeque::new(),
+            }),
+            stats: Arc::new(SamplingStats::default()),
+        }
+    }
+
+    pub fn stats(&self) -> Arc<SamplingStats> {
+        self.stats.clone()
+    }
+
+    /// The events to upload now for a newly captured one: none, the event
+    /// itself, or a held request followed by its response.
+    pub fn sample(&self, mut event: McpEvent, content: &str) -> Vec<McpEvent> {
+        let rpc = serde_json::from_str::<Value>(content).ok();
+        let is_request = rpc.as_ref().is_some_and(|r| r.get("method").is_some());
+        let id = rpc
+            .as_ref()
+            .and_then(|r| r.get("id"))
+            .map(|id| id.to_string());
+        let is_error = rpc.as_ref().is_some_and(|r| r.get("error").is_some());
+        let risky = self
+            .analyzer
+            .analyze(event.method.as_deref(), content)
+            .level
+            >= self.config.always_keep_risk;
+
+        let Ok(mut state) = self.state.lock() else {
+            return vec![event];
+        };
+
+        // A response: follow the request's decision, or decide for both now
+        if let (false, Some(id)) = (is_request, id.as_ref()) {
+            let key = (opposite(&event.direction).to_string(), id.clone());
+            if state.kept.remove(&key) {
+                return self.keep(vec![event]);
+            }
+            if let Some(request) = state.held.remove(&key) {
+                state.held_order.retain(|k| *k != key);
+                if risky || (is_error && self.config.keep_errors) {
+                    self.stats.rescued.fetch_add(2, Ordering::Relaxed);
+                    return self.keep(vec![request, event]);
+                }
+                self.stats.dropped.fetch_add(2, Ordering::Relaxed);
+                return Vec::new();
+            }
+        }
+
+        let sampled_rate = match self.head(&mut state, event.method.as_deref()) {
+            Some(rate) => rate,
+            None if risky || (is_error && self.config.keep_errors) => {
+                self.stats.rescued.fetch_add(1, Ordering::Relaxed);
+                1.0
+            }
+            None => {
+                match (is_request, id) {
+                    (true, Some(id)) => self.hold(&mut state, (event.direction.clone(), id), event),
+                    _ => {
+                        self.stats.dropped.fetch_add(1, Ordering::Relaxed);
+                    }
+                }
+                return Vec::new();
+            }
+        };
+
+        if sampled_rate < 1.0 {
+            // Lets the backend scale counts back up
+            event
+                .metadata
+                .insert("sample_rate".to_string(), Value::from(sampled_rate));
+        }
+        if let (true, Some(id)) = (is_request, id) {
+            state.kept.insert((event.direction.clone(), id));
+        }
+        self.keep(vec![event])
+    }
+
+    fn keep(&self, events: Vec<McpEvent>) -> Vec<McpEvent> {
+        self.stats
+            .kept
+            .fetch_add(events.len() as u64, Ordering::Relaxed);
+        events
+    }
+
+    fn hold(&self, state: &mut SamplerState, key: (String, String), event: McpEvent) {
+        if state.held.len() >= MAX_HELD {
+            if let Some(oldest) = state.held_order.pop_front() {
+                state.held.remove(&oldest);
+                self.stats.dropped.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        state.held_order.push_back(key.clone());
+        state.held.insert(key, event);
+    }
+
+    /// The rate an event was sampled at, or `None` if the rate or the rate
+    /// limit leaves it out.
+    fn head(&self, state: &mut SamplerState, method: Option<&str>) -> Option<f64> {
+        let rule = method.and_then(|method| {
+            self.config.rules.iter().find(|rule| {
+                rule.methods
+                    .iter()
+                    .any(|pattern| traffic::method_matches(pattern, method))
+            })
+        });
+        let rate = rule.map(|r| r.rate).unwrap_or(self.config.rate);
+
+        if let (Some(limit), Some(method)) = (rule.and_then(|r| r.max_per_second), method) {
+            let now = Instant::now();
+            let window = state.windows.entry(method.to_string()).or_insert((now, 0));
+            if now.duration_since(window.0) >= RATE_WINDOW {
+                *window = (now, 0);
+            }
+            if window.1 >= limit {
+                return None;
+            }
+            if rate < 1.0 && state.rng.f64() >= rate {
+                return None;
+            }
+            window.1 += 1;
+            return Some(rate);
+        }
+
+        (rate >= 1.0 || state.rng.f64() < rate).then_some(rate)
+    }
+}
+
+/// Requests and their responses travel in opposite directions.
+fn opposite(direction: &str) -> &str {
+    if direction == "request" {
+        "response"
+    } else {
+        "request"
+    }
+}
@@ -0,0 +1,414 @@
+//! The event batch schema, defined once. Version 1 is the JSON body
+//! `McpEvent` serializes to; version 2 carries the same fields as protobuf,
+//! encoded by walking the tables below, which also produce the `.proto`
+//! file in API_ENDPOINTS.md.
+
+use anyhow::{Context, Result};
+use serde_json::{json, Map, Value};
+use std::fmt::Write as _;
+
+use crate::build_info;
+
+/// Event batch format 1: JSON
+pub const EVENTS_JSON: u32 = 1;
+/// Event batch format 2: protobuf messages from `proto()`
+pub const EVENTS_PROTOBUF: u32 = 2;
+
+/// How a field is represented on the wire.
+#[derive(Debug, Clone, Copy)]
+pub enum Kind {
+    String,
+    Uint64,
+    Double,
+    Bool,
+    /// Any JSON value, sent as its text in a protobuf string
+    Json,
+    /// `map<string, string>`
+    StringMap,
+    /// `map<string, string>` whose values are JSON text
+    JsonMap,
+    Message(&'static Message),
+}
+
+#[derive(Debug)]
+pub struct Field {
+    /// The JSON key and the protobuf field name
+    pub name: &'static str,
+    pub number: u32,
+    pub kind: Kind,
+    pub repeated: bool,
+}
+
+#[derive(Debug)]
+pub struct Message {
+    pub name: &'static str,
+    pub fields: &'static [Field],
+}
+
+const fn field(name: &'static str, number: u32, kind: Kind) -> Field {
+    Field {
+        name,
+        number,
+        kind,
+        repeated: false,
+    }
+}
+
+const fn repeated(name: &'static str, number: u32, kind: Kind) -> Field {
+    Field {
+        name,
+        number,
+        kind,
+        repeated: true,
+    }
+}
+
+/// An upload body: `{"events": [...], "metadata": {...}}`
+pub static BATCH: Message = Message {
+    name: "Batch",
+    fields: &[
+        repeated("events", 1, Kind::Message(&EVENT)),
+        field("metadata", 2, Kind::Message(&BATCH_METADATA)),
+    ],
+};
+
+/// One captured message; see `McpEvent`
+pub static EVENT: Message = Message {
+    name: "Event",
+    fields: &[
+        field("id", 1, Kind::String),
+        field("session_id", 2, Kind::String),
+        field("timestamp", 3, Kind::String),
+        field("direction", 4, Kind::String),
+        field("method", 5, Kind::String),
+        field("rpc_id", 6, Kind::Json),
+        field("duration_ms", 7, Kind::Double),
+        field("payload_size", 8, Kind::Uint64),
+        field("payload", 9, Kind::Json),
+        field("payload_sha256", 10, Kind::String),
+        field("payload_truncated", 11, Kind::Bool),
+        field("payload_uri", 12, Kind::String),
+        field("metadata", 13, Kind::JsonMap),
+        field("labels", 14, Kind::StringMap),
+    ],
+};
+
+pub static BATCH_METADATA: Message = Message {
+    name: "BatchMetadata",
+    fields: &[
+        repeated("latency", 1, Kind::Message(&METHOD_LATENCY)),
+        field("client", 2, Kind::Message(&CLIENT)),
+        field("costs", 3, Kind::Json),
+        field("sequence", 4, Kind::Uint64),
+    ],
+};
+
+pub static CLIENT: Message = Message {
+    name: "Client",
+    fields: &[
+        field("name", 1, Kind::String),
+        field("version", 2, Kind::String),
+        field("commit", 3, Kind::String),
+        field("build_date", 4, Kind::String),
+        field("target", 5, Kind::String),
+    ],
+};
+
+pub static METHOD_LATENCY: Message = Message {
+    name: "MethodLatency",
+    fields: &[
+        field("method", 1, Kind::String),
+        field("count", 2, Kind::Uint64),
+        field("sum_ms", 3, Kind::Double),
+        field("min_ms", 4, Kind::Double),
+        field("p50_ms", 5, Kind::Double),
+        field("p90_ms", 6, Kind::Double),
+        field("p99_ms", 7, Kind::Double),
+        field("max_ms", 8, Kind::Double),
+        repeated("buckets", 9, Kind::Message(&LATENCY_BUCKET)),
+    ],
+};
+
+pub static LATENCY_BUCKET: Message = Message {
+    name: "LatencyBucket",
+    fields: &[
+        field("le_ms", 1, Kind::Double),
+        field("count", 2, Kind::Uint64),
+    ],
+};
+
+/// Every message, in the order `proto()` lists them
+static MESSAGES: &[&Message] = &[
+    &BATCH,
+    &EVENT,
+    &BATCH_METADATA,
+    &CLIENT,
+    &METHOD_LATENCY,
+    &LATENCY_BUCKET,
+];
+
+/// Which km sent a batch, in its `metadata.client`.
+pub fn client_metadata() -> Value {
+    json!({
+        "name": "km",
+        "version": build_info::VERSION,
+        "commit": build_info::COMMIT,
+        "build_date": build_info::DATE,
+        "target": build_info::TARGET,
+    })
+}
+
+/// The `Content-Type` of a batch in `version`.
+pub fn content_type(version: u32) -> &'static str {
+    if version == EVENTS_PROTOBUF {
+        "application/x-protobuf"
+    } else {
+        "application/json"
+    }
+}
+
+/// The body of `batch` in event format `version`.
+pub fn encode_batch(version: u32, batch: &Value) -> Result<Vec<u8>> {
+    if version == EVENTS_PROTOBUF {
+        let mut body = Vec::new();
+        encode(&BATCH, batch, &mut body);
+        Ok(body)
+    } else {
+        serde_json::to_vec(batch).context("Failed to serialize event batch")
+    }
+}
+
+/// The schema as a proto3 file.
+// Only the test that keeps API_ENDPOINTS.md in step calls this
+#[allow(dead_code)]
+pub fn proto() -> String {
+    let mut proto = String::from("syntax = \"proto3\";\n\npackage kilometers.events.v2;\n");
+    for message in MESSAGES {
+        let _ = writeln!(proto, "\nmessage {} {{", message.name);
+        for field in message.fields {
+            let (kind, note) = match field.kind {
+                Kind::String => ("string", ""),
+                Kind::Uint64 => ("uint64", ""),
+                Kind::Double => ("double", ""),
+                Kind::Bool => ("bool", ""),
+                Kind::Json => ("string", " // JSON"),
+                Kind::StringMap => ("map<string, string>", ""),
+                Kind::JsonMap => ("map<string, string>", " // values are JSON"),
+                Kind::Message(message) => (message.name, ""),
+            };
+            let label = if field.repeated { "repeated " } else { "" };
+            let _ = writeln!(
+                proto,
+                "  {}{} {} = {};{}",
+                label, kind, field.name, field.number, note
+            );
+        }
+        proto.push_str("}\n");
+    }
+    proto
+}
+
+const VARINT: u64 = 0;
+const FIXED64: u64 = 1;
+const LENGTH_DELIMITED: u64 = 2;
+
+fn put_varint(out: &mut Vec<u8>, mut value: u64) {
+    while value >= 0x80 {
+        out.push((value as u8) | 0x80);
+        value >>= 7;
+    }
+    out.push(value as u8);
+}
+
+fn put_bytes(out: &mut Vec<u8>, number: u32, bytes: &[u8]) {
+    put_varint(out, (u64::from(number) << 3) | LENGTH_DELIMITED);
+    put_varint(out, bytes.len() as u64);
+    out.extend_from_slice(bytes);
+}
+
+fn text(value: &Value) -> String {
+    match value {
+        Value::String(s) => s.clone(),
+        other => other.to_string(),
+    }
+}
+
+/// Append `value`'s fields to `out` as a protobuf `message`. Keys the
+/// message doesn't define, and nulls, are left out.
+fn encode(message: &Message, value: &Value, out: &mut Vec<u8>) {
+    for field in message.fields {
+        let value = &value[field.name];
+        match (field.repeated, value) {
+            (_, Value::Null) => {}
+            (true, Value::Array(items)) => {
+                for item in items {
+                    encode_field(field, item, out);
+                }
+            }
+            _ => encode_field(field, value, out),
+        }
+    }
+}
+
+fn encode_field(field: &Field, value: &Value, out: &mut Vec<u8>) {
+    let number = field.number;
+    match field.kind {
+        Kind::String => put_bytes(out, number, text(value).as_bytes()),
+        Kind::Json => put_bytes(out, number, value.to_string().as_bytes()),
+        Kind::Uint64 => {
+            put_varint(out, (u64::from(number) << 3) | VARINT);
+            put_varint(
+                out,
+                value
+                    .as_u64()
+                    .unwrap_or_else(|| value.as_f64().unwrap_or(0.0) as u64),
+            );
+        }
+        Kind::Double => {
+            put_varint(out, (u64::from(number) << 3) | FIXED64);
+            out.extend(value.as_f64().unwrap_or(0.0).to_le_bytes());
+        }
+        Kind::Bool => {
+            put_varint(out, (u64::from(number) << 3) | VARINT);
+            put_varint(out, u64::from(value.as_bool().unwrap_or(false)));
+        }
+        Kind::StringMap | Kind::JsonMap => {
+            for (key, value) in value.as_object().into_iter().flatten() {
+                let value = match field.kind {
+                    Kind::JsonMap => value.to_string(),
+                    _ => text(value),
+                };
+                let mut entry = Vec::new();
+                put_bytes(&mut entry, 1, key.as_bytes());
+                put_bytes(&mut entry, 2, value.as_bytes());
+                put_bytes(out, number, &entry);
+            }
+        }
+        Kind::Message(message) => {
+            let mut nested = Vec::new();
+            encode(message, value, &mut nested);
+            put_bytes(out, number, &nested);
+        }
+    }
+}
+
+/// Read a version 2 body back into its JSON form.
+// The CLI only sends batches; tests check the encoding round-trips
+#[allow(dead_code)]
+pub fn decode_batch(body: &[u8]) -> Result<Value> {
+    decode(&BATCH, body)
+}
+
+struct Reader<'a> {
+    bytes: &'a [u8],
+}
+
+impl<'a> Reader<'a> {
+    fn varint(&mut self) -> Result<u64> {
+        let mut value = 0u64;
+        for shift in (0..64).step_by(7) {
+            let (&byte, rest) = self
+                .bytes
+                .split_first()
+                .context("Truncated protobuf varint")?;
+            self.bytes = rest;
+            value |= u64::from(byte & 0x7f) << shift;
+            if byte & 0x80 == 0 {
+                return Ok(value);
+            }
+        }
+        Err(anyhow::anyhow!("Protobuf varint is too long"))
+    }
+
+    fn take(&mut self, len: usize) -> Result<&'a [u8]> {
+        if len > self.bytes.len() {
+            return Err(anyhow::anyhow!("Truncated protobuf field"));
+        }
+        let (taken, rest) = self.bytes.split_at(len);
+        self.bytes = rest;
+        Ok(taken)
+    }
+}
+
+fn decode(message: &Message, bytes: &[u8]) -> Result<Value> {
+    let mut reader = Reader { bytes };
+    let mut object = Map::new();
+    while !reader.bytes.is_empty() {
+        let key = reader.varint()?;
+        let (number, wire) = (key >> 3, key & 7);
+        let raw = match wire {
+            VARINT => Raw::Varint(reader.varint()?),
+            FIXED64 => {
+                let bytes: [u8; 8] = reader.take(8)?.try_into()?;
+                Raw::Fixed64(u64::from_le_bytes(bytes))
+            }
+            LENGTH_DELIMITED => {
+                let len = reader.varint()? as usize;
+                Raw::Bytes(reader.take(len)?)
+            }
+            other => return Err(anyhow::anyhow!("Unsupported protobuf wire type {}", other)),
+        };
+        let Some(field) = message
+            .fields
+            .iter()
+            .find(|f| u64::from(f.number) == number)
+        else {
+            continue;
+        };
+        let string = |raw: &Raw| match raw {
+            Raw::Bytes(bytes) => Ok(String::from_utf8(bytes.to_vec())?),
+            _ => Err(anyhow::anyhow!("{} is not length-delimited", field.name)),
+        };
+        let value = match (field.kind, &raw) {
+            (Kind::String, _) => Value::String(string(&raw)?),
+            (Kind::Json, _) => serde_json::from_str(&string(&raw)?)?,
+            (Kind::Uint64, Raw::Varint(n)) => json!(n),
+            (Kind::Bool, Raw::Varint(n)) => json!(*n != 0),
+            (Kind::Double, Raw::Fixed64(bits)) => json!(f64::from_bits(*bits)),
+            (Kind::StringMap | Kind::JsonMap, Raw::Bytes(entry)) => {
+                let entry = decode(&MAP_ENTRY, entry)?;
+                let key = entry["key"].as_str().unwrap_or_default().to_string();
+                let value = entry["value"].as_str().unwrap_or_default();
+                let value = match field.kind {
+                    Kind::JsonMap => serde_json::from_str(value)?,
+                    _ => Value::String(value.to_string()),
+                };
+                object
+                    .entry(field.name)
+                    .or_insert_with(|| json!({}))
+                    .as_object_mut()
+                    .context("Map field used as a scalar")?
+                    .insert(key, value);
+                continue;
+            }
+            (Kind::Message(nested), Raw::Bytes(bytes)) => decode(nested, bytes)?,
+            _ => return Err(anyhow::anyhow!("{} has the wrong wire type", field.name)),
+        };
+        if field.repeated {
+            object
+                .entry(field.name)
+                .or_insert_with(|| json!([]))
+                .as_array_mut()
+                .context("Repeated field used as a scalar")?
+                .push(value);
+        } else {
+            object.insert(field.name.to_string(), value);
+        }
+    }
+    Ok(Value::Object(object))
+}
+
+enum Raw<'a> {
+    Varint(u64),
+    Fixed64(u64),
+    Bytes(&'a [u8]),
+}
+
+/// The implicit message of a protobuf map entry
+static MAP_ENTRY: Message = Message {
+    name: "MapEntry",
+    fields: &[
+        field("key", 1, Kind::String),
+        field("value", 2, Kind::String),
+    ],
+};
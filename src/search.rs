@@ -0,0 +1,538 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use regex::Regex;
+use serde::Serialize;
+
+use crate::content::{self, ContentInfo};
+use crate::risk::{PatternRiskAnalyzer, RiskLevel};
+use crate::traffic::{self, TrafficEntry};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Op {
+    Colon,
+    Eq,
+    Ne,
+    Gt,
+    Ge,
+    Lt,
+    Le,
+    Tilde,
+}
+
+impl Op {
+    /// Longest operators first so `>=` isn't read as `>`
+    const ALL: &'static [(&'static str, Op)] = &[
+        (">=", Op::Ge),
+        ("<=", Op::Le),
+        ("!=", Op::Ne),
+        (":", Op::Colon),
+        ("=", Op::Eq),
+        (">", Op::Gt),
+        ("<", Op::Lt),
+        ("~", Op::Tilde),
+    ];
+
+    fn symbol(self) -> &'static str {
+        Self::ALL
+            .iter()
+            .find(|(_, op)| *op == self)
+            .map(|(s, _)| *s)
+            .unwrap_or_default()
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token {
+    LParen,
+    RParen,
+    And,
+    Or,
+    Not,
+    /// `field op value`, or a bare word searched for in payloads
+    Term {
+        field: Option<String>,
+        op: Op,
+        value: String,
+    },
+}
+
+/// A value: a `"quoted string"` (with `\"` and `\\` escapes) or a run of
+/// characters up to whitespace or a parenthesis. Returns the value, where
+/// it ends and whether it was quoted.
+fn read_value(chars: &[char], start: usize) -> Result<(String, usize, bool)> {
+    if chars.get(start) == Some(&'"') {
+        let mut value = String::new();
+        let mut i = start + 1;
+        while i < chars.len() {
+            match chars[i] {
+                '\\' if i + 1 < chars.len() => {
+                    value.push(chars[i + 1]);
+                    i += 2;
+                }
+                '"' => return Ok((value, i + 1, true)),
+                c => {
+                    value.push(c);
+                    i += 1;
+                }
+            }
+        }
+        return Err(anyhow::anyhow!(
+            "Unterminated quote at column {}",
+            start + 1
+        ));
+    }
+
+    let end = (start..chars.len())
+        .find(|&i| chars[i].is_whitespace() || chars[i] == '(' || chars[i] == ')')
+        .unwrap_or(chars.len());
+    Ok((chars[start..end].iter().collect(), end, false))
+}
+
+fn tokenize(query: &str) -> Result<Vec<Token>> {
+    let chars: Vec<char> = query.chars().collect();
+    let mut tokens = Vec::new();
+    let mut i = 0;
+    while i < chars.len() {
+        match chars[i] {
+            c if c.is_whitespace() => {
+                i += 1;
+                continue;
+            }
+            '(' => {
+                tokens.push(Token::LParen);
+                i += 1;
+                continue;
+            }
+            ')' => {
+                tokens.push(Token::RParen);
+                i += 1;
+                continue;
+            }
+            _ => {}
+        }
+
+        // `field op value`
+        let name_end = (i..chars.len())
+            .find(|&j| !(chars[j].is_ascii_alphanumeric() || chars[j] == '_'))
+            .unwrap_or(chars.len());
+        if name_end > i {
+            let rest: String = chars[name_end..chars.len().min(name_end + 2)]
+                .iter()
+                .collect();
+            if let Some((symbol, op)) = Op::ALL.iter().find(|(s, _)| rest.starts_with(s)) {
+                let field: String = chars[i..name_end].iter().collect();
+                let (value, end, quoted) = read_value(&chars, name_end + symbol.len())?;
+                if value.is_empty() && !quoted {
+                    return Err(anyhow::anyhow!("'{}{}' needs a value", field, symbol));
+                }
+                tokens.push(Token::Term {
+                    field: Some(field.to_ascii_lowercase()),
+                    op: *op,
+                    value,
+                });
+                i = end;
+                continue;
+            }
+        }
+
+        let (value, end, quoted) = read_value(&chars, i)?;
+        tokens.push(match value.as_str() {
+            "AND" if !quoted => Token::And,
+            "OR" if !quoted => Token::Or,
+            "NOT" if !quoted => Token::Not,
+            _ => Token::Term {
+                field: None,
+                op: Op::Colon,
+                value,
+            },
+        });
+        i = end;
+    }
+    Ok(tokens)
+}
+
+/// How a text field is matched.
+#[derive(Debug, Clone)]
+enum TextMatch {
+    /// `*` wildcards
+    Glob(String),
+    /// Case-insensitive substring; the needle is lowercased
+    Contains(String),
+    Prefix(String),
+    Regex(Regex),
+}
+
+impl TextMatch {
+    fn matches(&self, text: &str) -> bool {
+        match self {
+            TextMatch::Glob(pattern) => traffic::method_matches(pattern, text),
+            TextMatch::Contains(needle) => text.to_lowercase().contains(needle),
+            TextMatch::Prefix(prefix) => text.starts_with(prefix.as_str()),
+            TextMatch::Regex(regex) => regex.is_match(text),
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+enum Condition {
+    Method(TextMatch),
+    Direction(String),
+    Risk(Op, RiskLevel),
+    Time(Op, DateTime<Utc>),
+    Payload(TextMatch),
+    Session(TextMatch),
+    Label(String, String),
+    /// Embedded content of a kind (`image`) or MIME type (`image/*`)
+    Content(TextMatch),
+    ContentSize(Op, u64),
+    /// How the call a response answers ended: `success` or `error`
+    Status(String),
+    /// Round-trip time of the call a response answers, in milliseconds
+    Duration(Op, f64),
+}
+
+#[derive(Debug, Clone)]
+enum Expr {
+    And(Box<Expr>, Box<Expr>),
+    Or(Box<Expr>, Box<Expr>),
+    Not(Box<Expr>),
+    Cond(Condition),
+}
+
+fn regex(value: &str) -> Result<TextMatch> {
+    Regex::new(value)
+        .map(TextMatch::Regex)
+        .with_context(|| format!("Invalid regex '{}'", value))
+}
+
+/// Milliseconds from `250`, `250ms` or `1.5s`.
+fn parse_millis(value: &str) -> Result<f64> {
+    let (amount, scale) = match value.strip_suffix("ms") {
+        Some(amount) => (amount, 1.0),
+        None => match value.strip_suffix('s') {
+            Some(amount) => (amount, 1000.0),
+            None => (value, 1.0),
+        },
+    };
+    amount
+        .parse::<f64>()
+        .ok()
+        .filter(|amount| amount.is_finite() && *amount >= 0.0)
+        .map(|amount| amount * scale)
+        .ok_or_else(|| anyhow::anyhow!("'{}' is not a duration like 250ms or 2s", value))
+}
+
+fn unsupported(field: &str, op: Op) -> anyhow::Error {
+    anyhow::anyhow!("'{}' can't be compared with '{}'", field, op.symbol())
+}
+
+/// Turn one `field op value` term into a condition; `!=` becomes NOT.
+fn condition(field: Option<&str>, op: Op, value: &str) -> Result<Expr> {
+    let negate = op == Op::Ne;
+    let equality = matches!(op, Op::Colon | Op::Eq | Op::Ne);
+    let field_name = field.unwrap_or("payload");
+
+    let cond = match field_name {
+        "method" => match op {
+            _ if equality => Condition::Method(TextMatch::Glob(value.to_string())),
+            Op::Tilde => Condition::Method(regex(value)?),
+            _ => return Err(unsupported(field_name, op)),
+        },
+        "direction" | "dir" if equality => match value.to_ascii_lowercase().as_str() {
+            "request" | "req" => Condition::Direction("request".to_string()),
+            "response" | "resp" => Condition::Direction("response".to_string()),
+            other => {
+                return Err(anyhow::anyhow!(
+                    "Unknown direction '{}'; use request or response",
+                    other
+                ))
+            }
+        },
+        "risk" if op != Op::Tilde => {
+            let level = value.parse::<RiskLevel>()?;
+            let op = if equality { Op::Eq } else { op };
+            Condition::Risk(op, level)
+        }
+        "time" if matches!(op, Op::Gt | Op::Ge | Op::Lt | Op::Le) => {
+            Condition::Time(op, traffic::parse_time_bound(value)?)
+        }
+        "since" if op == Op::Colon => Condition::Time(Op::Ge, traffic::parse_time_bound(value)?),
+        "until" if op == Op::Colon => Condition::Time(Op::Le, traffic::parse_time_bound(value)?),
+        "payload" => match op {
+            _ if equality => Condition::Payload(TextMatch::Contains(value.to_lowercase())),
+            Op::Tilde => Condition::Payload(regex(value)?),
+            _ => return Err(unsupported(field_name, op)),
+        },
+        "session" => match op {
+            _ if equality => Condition::Session(TextMatch::Prefix(value.to_string())),
+            Op::Tilde => Condition::Session(regex(value)?),
+            _ => return Err(unsupported(field_name, op)),
+        },
+        "label" if equality => {
+            let (key, value) = traffic::parse_label(value).map_err(|e| anyhow::anyhow!(e))?;
+            Condition::Label(key, value)
+        }
+        "content" => match op {
+            _ if equality => Condition::Content(TextMatch::Glob(value.to_ascii_lowercase())),
+            Op::Tilde => Condition::Content(regex(value)?),
+            _ => return Err(unsupported(field_name, op)),
+        },
+        "content_size" if op != Op::Tilde => {
+            let size = content::parse_size(value).map_err(|e| anyhow::anyhow!(e))?;
+            let op = if equality { Op::Eq } else { op };
+            Condition::ContentSize(op, size)
+        }
+        "status" if equality => match value.to_ascii_lowercase().as_str() {
+            status @ ("success" | "error") => Condition::Status(status.to_string()),
+            other => {
+                return Err(anyhow::anyhow!(
+                    "Unknown status '{}'; use success or error",
+                    other
+                ))
+            }
+        },
+        "duration" if op != Op::Tilde => {
+            let op = if equality { Op::Eq } else { op };
+            Condition::Duration(op, parse_millis(value)?)
+        }
+        "direction" | "dir" | "risk" | "time" | "since" | "until" | "label" | "content_size"
+        | "status" | "duration" => return Err(unsupported(field_name, op)),
+        other => {
+            return Err(anyhow::anyhow!(
+                "Unknown field '{}'. Fields: method, direction, risk, time, since, until, payload, session, label, content, content_size, status, duration. Quote text to search payloads for it",
+                other
+            ))
+        }
+    };
+
+    let expr = Expr::Cond(cond);
+    Ok(if negate {
+        Expr::Not(Box::new(expr))
+    } else {
+        expr
+    })
+}
+
+struct Parser {
+    tokens: Vec<Token>,
+    pos: usize,
+}
+
+impl Parser {
+    fn peek(&self) -> Option<&Token> {
+        self.tokens.get(self.pos)
+    }
+
+    fn next(&mut self) -> Option<Token> {
+        let token = self.tokens.get(self.pos).cloned();
+        self.pos += 1;
+        token
+    }
+
+    fn or(&mut self) -> Result<Expr> {
+        let mut left = self.and()?;
+        while self.peek() == Some(&Token::Or) {
+            self.pos += 1;
+            left = Expr::Or(Box::new(left), Box::new(self.and()?));
+        }
+        Ok(left)
+    }
+
+    /// Terms next to each other are ANDed, with or without `AND`
+    fn and(&mut self) -> Result<Expr> {
+        let mut left = self.not()?;
+        loop {
+            match self.peek() {
+                Some(Token::And) => self.pos += 1,
+                Some(Token::Or) | Some(Token::RParen) | None => return Ok(left),
+                _ => {}
+            }
+            left = Expr::And(Box::new(left), Box::new(self.not()?));
+        }
+    }
+
+    fn not(&mut self) -> Result<Expr> {
+        if self.peek() == Some(&Token::Not) {
+            self.pos += 1;
+            return Ok(Expr::Not(Box::new(self.not()?)));
+        }
+        self.primary()
+    }
+
+    fn primary(&mut self) -> Result<Expr> {
+        match self.next() {
+            Some(Token::LParen) => {
+                let expr = self.or()?;
+                match self.next() {
+                    Some(Token::RParen) => Ok(expr),
+                    _ => Err(anyhow::anyhow!("Missing ')'")),
+                }
+            }
+            Some(Token::Term { field, op, value }) => condition(field.as_deref(), op, &value),
+            Some(Token::RParen) => Err(anyhow::anyhow!("Unexpected ')'")),
+            Some(token) => Err(anyhow::anyhow!("Expected a search term, found {:?}", token)),
+            None => Err(anyhow::anyhow!(
+                "Query ends where a search term was expected"
+            )),
+        }
+    }
+}
+
+/// A parsed `km search` query.
+#[derive(Debug, Clone)]
+pub struct Query {
+    expr: Option<Expr>,
+}
+
+/// What a query is matched against: one captured message.
+#[derive(Debug, Clone, Copy)]
+pub struct Candidate<'a> {
+    pub entry: &'a TrafficEntry,
+    pub method: Option<&'a str>,
+    pub risk: RiskLevel,
+}
+
+impl Query {
+    /// Parse a query such as
+    /// `method:tools/call AND risk>=high AND payload~"DROP TABLE"`.
+    /// An empty query matches everything.
+    pub fn parse(query: &str) -> Result<Self> {
+        let tokens = tokenize(query)?;
+        if tokens.is_empty() {
+            return Ok(Self { expr: None });
+        }
+        let mut parser = Parser { tokens, pos: 0 };
+        let expr = parser.or()?;
+        if parser.pos < parser.tokens.len() {
+            return Err(anyhow::anyhow!("Unexpected ')'"));
+        }
+        Ok(Self { expr: Some(expr) })
+    }
+
+    pub fn matches(&self, candidate: &Candidate) -> bool {
+        self.expr
+            .as_ref()
+            .is_none_or(|expr| evaluate(expr, candidate))
+    }
+}
+
+fn compare<T: PartialOrd>(op: Op, left: T, right: T) -> bool {
+    match op {
+        Op::Gt => left > right,
+        Op::Ge => left >= right,
+        Op::Lt => left < right,
+        Op::Le => left <= right,
+        _ => left == right,
+    }
+}
+
+fn evaluate(expr: &Expr, candidate: &Candidate) -> bool {
+    match expr {
+        Expr::And(a, b) => evaluate(a, candidate) && evaluate(b, candidate),
+        Expr::Or(a, b) => evaluate(a, candidate) || evaluate(b, candidate),
+        Expr::Not(e) => !evaluate(e, candidate),
+        Expr::Cond(cond) => match cond {
+            Condition::Method(m) => candidate.method.is_some_and(|method| m.matches(method)),
+            Condition::Direction(d) => candidate.entry.direction == *d,
+            Condition::Risk(op, level) => compare(*op, candidate.risk, *level),
+            Condition::Time(op, at) => compare(*op, candidate.entry.timestamp, *at),
+            Condition::Payload(m) => m.matches(&candidate.entry.content),
+            Condition::Session(m) => candidate
+                .entry
+                .session_id
+                .as_deref()
+                .is_some_and(|id| m.matches(id)),
+            Condition::Label(key, value) => candidate.entry.labels.get(key) == Some(value),
+            Condition::Content(m) => embedded(candidate.entry)
+                .iter()
+                .any(|item| m.matches(item.kind.as_str()) || m.matches(&item.mime_type)),
+            Condition::ContentSize(op, size) => embedded(candidate.entry)
+                .iter()
+                .any(|item| compare(*op, item.bytes, *size)),
+            Condition::Status(status) => candidate.entry.status.as_ref() == Some(status),
+            Condition::Duration(op, ms) => candidate
+                .entry
+                .duration_ms
+                .is_some_and(|duration| compare(*op, duration, *ms)),
+        },
+    }
+}
+
+/// The content `km monitor` found embedded in a captured response.
+fn embedded(entry: &TrafficEntry) -> Vec<ContentInfo> {
+    entry
+        .metadata
+        .get("content")
+        .and_then(|value| serde_json::from_value(value.clone()).ok())
+        .unwrap_or_default()
+}
+
+/// One message found by `km search`.
+#[derive(Debug, Clone, Serialize)]
+pub struct SearchHit {
+    pub timestamp: DateTime<Utc>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub session_id: Option<String>,
+    pub direction: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    pub risk: RiskLevel,
+    pub content: String,
+}
+
+/// Every message in `entries` matching `query`, oldest first.
+pub fn search(entries: &[TrafficEntry], query: &Query) -> Vec<SearchHit> {
+    let analyzer = PatternRiskAnalyzer::new();
+    let methods = traffic::resolve_methods(entries);
+    entries
+        .iter()
+        .zip(methods)
+        .filter_map(|(entry, method)| {
+            let risk = analyzer.analyze(method.as_deref(), &entry.content).level;
+            let candidate = Candidate {
+                entry,
+                method: method.as_deref(),
+                risk,
+            };
+            query.matches(&candidate).then(|| SearchHit {
+                timestamp: entry.timestamp,
+                session_id: entry.session_id.clone(),
+                direction: entry.direction.clone(),
+                method: method.clone(),
+                risk,
+                content: entry.content.clone(),
+            })
+        })
+        .collect()
+}
+
+/// Render search hits as a table.
+pub fn render(hits: &[SearchHit]) -> Vec<String> {
+    let mut lines = vec![format!(
+        "{:<23}  {:<12}  {:<8}  {:<24}  {:<8}  {}",
+        "TIME", "SESSION", "DIR", "METHOD", "RISK", "PAYLOAD"
+    )];
+    for hit in hits {
+        let session: String = hit
+            .session_id
+            .as_deref()
+            .unwrap_or("-")
+            .chars()
+            .take(12)
+            .collect();
+        let mut payload: String = hit.content.chars().take(60).collect();
+        if payload.len() < hit.content.len() {
+            payload.push('…');
+        }
+        lines.push(format!(
+            "{:<23}  {:<12}  {:<8}  {:<24}  {:<8}  {}",
+            hit.timestamp.format("%Y-%m-%d %H:%M:%S%.3f"),
+            session,
+            hit.direction,
+            hit.method.as_deref().unwrap_or("-"),
+            hit.risk.to_string(),
+            payload
+        ));
+    }
+    lines
+}
@@ -0,0 +1,292 @@
+use anyhow::Result;
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use std::collections::BTreeMap;
+
+use crate::export::{self, ExportFilter, ExportRecord};
+use crate::handshake::Handshake;
+use crate::traffic::{Labels, TrafficEntry};
+
+/// What a monitored session did, built from its traffic log entries.
+#[derive(Debug, Clone, Serialize)]
+pub struct SessionSummary {
+    pub id: String,
+    pub started: DateTime<Utc>,
+    pub ended: DateTime<Utc>,
+    /// `serverInfo.name` from the initialize response, if it was captured
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub server: Option<String>,
+    /// Client, server, protocol version and capabilities from the
+    /// initialize exchange
+    #[serde(skip_serializing_if = "Handshake::is_empty")]
+    pub handshake: Handshake,
+    pub messages: u64,
+    pub requests: u64,
+    pub errors: u64,
+    /// Requests per method
+    pub methods: BTreeMap<String, u64>,
+    /// tools/call requests per tool name
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub tools: BTreeMap<String, u64>,
+    /// Labels given to `km monitor --label`
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub labels: Labels,
+}
+
+impl SessionSummary {
+    fn new(id: String, timestamp: DateTime<Utc>) -> Self {
+        Self {
+            id,
+            started: timestamp,
+            ended: timestamp,
+            server: None,
+            handshake: Handshake::default(),
+            messages: 0,
+            requests: 0,
+            errors: 0,
+            methods: BTreeMap::new(),
+            tools: BTreeMap::new(),
+            labels: Labels::new(),
+        }
+    }
+
+    pub fn duration_secs(&self) -> i64 {
+        (self.ended - self.started).num_seconds()
+    }
+
+    fn record(&mut self, entry: &TrafficEntry) {
+        self.messages += 1;
+        self.started = self.started.min(entry.timestamp);
+        self.ended = self.ended.max(entry.timestamp);
+        for (key, value) in &entry.labels {
+            self.labels.insert(key.clone(), value.clone());
+        }
+
+        let Some(rpc) = entry.rpc() else {
+            return;
+        };
+        if rpc.get("error").is_some() {
+            self.errors += 1;
+        }
+        if let Some(name) = rpc
+            .pointer("/result/serverInfo/name")
+            .and_then(|n| n.as_str())
+        {
+            self.server = Some(name.to_string());
+        }
+        self.handshake.observe(&rpc);
+        if entry.direction != "request" {
+            return;
+        }
+        if let Some(method) = rpc.get("method").and_then(|m| m.as_str()) {
+            self.requests += 1;
+            *self.methods.entry(method.to_string()).or_default() += 1;
+            if method == "tools/call" {
+                if let Some(tool) = rpc.pointer("/params/name").and_then(|n| n.as_str()) {
+                    *self.tools.entry(tool.to_string()).or_default() += 1;
+                }
+            }
+        }
+    }
+}
+
+/// Summarize every session in a traffic log, most recent first. Entries
+/// without a session id are ignored.
+pub fn summarize(entries: &[TrafficEntry]) -> Vec<SessionSummary> {
+    let mut sessions: BTreeMap<&str, SessionSummary> = BTreeMap::new();
+    for entry in entries {
+        let Some(ref id) = entry.session_id else {
+            continue;
+        };
+        sessions
+            .entry(id.as_str())
+            .or_insert_with(|| SessionSummary::new(id.clone(), entry.timestamp))
+            .record(entry);
+    }
+
+    let mut sessions: Vec<_> = sessions.into_values().collect();
+    sessions.sort_by(|a, b| b.started.cmp(&a.started).then(a.id.cmp(&b.id)));
+    sessions
+}
+
+/// Find the session `id` refers to: an exact id, or a prefix that matches
+/// exactly one session.
+pub fn resolve<'a>(sessions: &'a [SessionSummary], id: &str) -> Result<&'a SessionSummary> {
+    if let Some(session) = sessions.iter().find(|s| s.id == id) {
+        return Ok(session);
+    }
+
+    let matches: Vec<_> = sessions.iter().filter(|s| s.id.starts_with(id)).collect();
+    match matches.as_slice() {
+        [session] => Ok(session),
+        [] => Err(anyhow::anyhow!("No session matches '{}'", id)),
+        _ => Err(anyhow::anyhow!(
+            "'{}' matches {} sessions; use more of the id",
+            id,
+            matches.len()
+        )),
+    }
+}
+
+/// The events of one session, optionally only those whose method matches
+/// `method` (responses match through their request).
+pub fn events(
+    entries: &[TrafficEntry],
+    session_id: &str,
+    method: Option<&str>,
+) -> Vec<ExportRecord> {
+    let filter = ExportFilter {
+        session_id: Some(session_id.to_string()),
+        method: method.map(String::from),
+        ..Default::default()
+    };
+    export::collect_records(entries, &filter)
+}
+
+fn short_id(id: &str) -> &str {
+    match id.char_indices().nth(12) {
+        Some((end, _)) => &id[..end],
+        None => id,
+    }
+}
+
+pub fn format_duration(secs: i64) -> String {
+    match secs {
+        s if s < 60 => format!("{}s", s),
+        s if s < 3600 => format!("{}m{:02}s", s / 60, s % 60),
+        s => format!("{}h{:02}m", s / 3600, (s % 3600) / 60),
+    }
+}
+
+/// Render `km sessions list` as a table.
+pub fn render_list(sessions: &[SessionSummary]) -> Vec<String> {
+    let mut lines = vec![format!(
+        "{:<12}  {:<19}  {:>8}  {:>8}  {:>8}  {:>6}  {}",
+        "SESSION", "STARTED", "DURATION", "MESSAGES", "REQUESTS", "ERRORS", "SERVER"
+    )];
+    for session in sessions {
+        lines.push(format!(
+            "{:<12}  {:<19}  {:>8}  {:>8}  {:>8}  {:>6}  {}",
+            short_id(&session.id),
+            session.started.format("%Y-%m-%d %H:%M:%S"),
+            format_duration(session.duration_secs()),
+            session.messages,
+            session.requests,
+            session.errors,
+            session.server.as_deref().unwrap_or("-")
+        ));
+    }
+    lines
+}
+
+/// Render `km sessions show` for one session.
+pub fn render_summary(session: &SessionSummary) -> Vec<String> {
+    let handshake = &session.handshake;
+    let server = match handshake.server {
+        Some(ref server) => server.describe(),
+        None => session.server.clone().unwrap_or_else(|| "-".to_string()),
+    };
+    let mut lines = vec![
+        format!("Session:  {}", session.id),
+        format!("Server:   {}", server),
+        format!(
+            "Started:  {}",
+            session.started.format("%Y-%m-%d %H:%M:%S UTC")
+        ),
+        format!(
+            "Ended:    {} ({})",
+            session.ended.format("%Y-%m-%d %H:%M:%S UTC"),
+            format_duration(session.duration_secs())
+        ),
+        format!(
+            "Messages: {}  Requests: {}  Errors: {}",
+            session.messages, session.requests, session.errors
+        ),
+    ];
+    if !session.labels.is_empty() {
+        let labels: Vec<String> = session
+            .labels
+            .iter()
+            .map(|(key, value)| format!("{}={}", key, value))
+            .collect();
+        lines.push(format!("Labels:   {}", labels.join(", ")));
+    }
+    if !handshake.is_empty() {
+        lines.push(String::new());
+        lines.push("Handshake".to_string());
+        lines.push(format!(
+            "  Protocol:             {}",
+            handshake.protocol_version.as_deref().unwrap_or("-")
+        ));
+        lines.push(format!(
+            "  Client:               {}",
+            handshake
+                .client
+                .as_ref()
+                .map(|client| client.describe())
+                .unwrap_or_else(|| "-".to_string())
+        ));
+        lines.push(format!(
+            "  Client capabilities:  {}",
+            Handshake::describe_capabilities(&handshake.client_capabilities)
+        ));
+        lines.push(format!(
+            "  Server capabilities:  {}",
+            Handshake::describe_capabilities(&handshake.server_capabilities)
+        ));
+    }
+    lines.push(String::new());
+    lines.push("Methods".to_string());
+
+    let mut methods: Vec<_> = session.methods.iter().collect();
+    methods.sort_by(|a, b| b.1.cmp(a.1).then(a.0.cmp(b.0)));
+    for (method, count) in &methods {
+        lines.push(format!("  {:<32} {:>6}", method, count));
+    }
+    if methods.is_empty() {
+        lines.push("  (no requests)".to_string());
+    }
+
+    if !session.tools.is_empty() {
+        lines.push(String::new());
+        lines.push("Tools".to_string());
+        let mut tools: Vec<_> = session.tools.iter().collect();
+        tools.sort_by(|a, b| b.1.cmp(a.1).then(a.0.cmp(b.0)));
+        for (tool, count) in tools {
+            lines.push(format!("  {:<32} {:>6}", tool, count));
+        }
+    }
+    lines
+}
+
+/// Render `km sessions events` as a table, one line per message.
+pub fn render_events(records: &[ExportRecord]) -> Vec<String> {
+    let mut lines = vec![format!(
+        "{:<12}  {:<8}  {:<24}  {:>6}  {:>9}  {}",
+        "TIME", "DIR", "METHOD", "ID", "LATENCY", "PAYLOAD"
+    )];
+    for record in records {
+        let mut payload: String = record.content.chars().take(60).collect();
+        if payload.len() < record.content.len() {
+            payload.push('…');
+        }
+        lines.push(format!(
+            "{:<12}  {:<8}  {:<24}  {:>6}  {:>9}  {}",
+            record.timestamp.format("%H:%M:%S%.3f"),
+            record.direction,
+            record.method.as_deref().unwrap_or("-"),
+            record.rpc_id.as_deref().unwrap_or("-"),
+            record
+                .duration_ms
+                .map(|d| format!("{:.1}ms", d))
+                .unwrap_or_else(|| "-".to_string()),
+            payload
+        ));
+    }
+    lines
+}
+
+/// Sessions with any activity at or after `since`.
+pub fn since(sessions: Vec<SessionSummary>, since: DateTime<Utc>) -> Vec<SessionSummary> {
+    sessions.into_iter().filter(|s| s.ended >= since).collect()
+}
@@ -0,0 +1,479 @@
+//! Destinations for captured events besides the Kilometers API: a local
+//! JSON lines file, an S3-compatible bucket, a Kafka topic (through a Kafka
+//! REST proxy), any webhook, and syslog or journald (see `syslog`). Every
+//! configured sink gets each batch the API gets, after sampling and redaction.
+
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use chrono::Utc;
+use reqwest::header::{HeaderName, HeaderValue, CONTENT_TYPE};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io::Write;
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::Duration;
+
+use crate::config_schema;
+use crate::idempotency;
+use crate::payloads::{self, S3Credentials, S3Uploader, DEFAULT_BLOB_REGION};
+use crate::syslog::{self, JournaldSink, SyslogFormat, SyslogProtocol, SyslogSink};
+
+/// How long one sink may take with a batch before it's abandoned
+const SINK_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// One entry of the `sinks` list in the config file.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum SinkConfig {
+    /// Append events to a local file, one JSON object per line
+    File { path: String },
+    /// Write each batch as a JSON lines object under an S3-compatible
+    /// bucket URL, e.g. https://s3.us-east-1.amazonaws.com/bucket/mcp
+    S3 {
+        url: String,
+        /// Region used to sign uploads (default us-east-1)
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        region: Option<String>,
+    },
+    /// Produce each event to `topic` through the Kafka REST proxy at `url`
+    Kafka { url: String, topic: String },
+    /// POST each batch as JSON, with `headers` added to the request
+    Webhook {
+        url: String,
+        #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+        headers: BTreeMap<String, String>,
+    },
+    /// Send each event as a syslog record to `address` (host:port)
+    Syslog {
+        address: String,
+        #[serde(default)]
+        protocol: SyslogProtocol,
+        #[serde(default)]
+        format: SyslogFormat,
+        /// Syslog facility, 0-23 (default 16, local0)
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        facility: Option<u8>,
+        /// PEM certificates to trust for TLS instead of the built-in roots
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        ca_file: Option<String>,
+    },
+    /// Write each event to the systemd journal (Linux only)
+    Journald,
+}
+
+impl SinkConfig {
+    pub fn validate(&self) -> Result<()> {
+        match self {
+            Self::File { path } => {
+                if path.trim().is_empty() {
+                    return Err(anyhow::anyhow!("File sinks need a path"));
+                }
+            }
+            Self::S3 { url, .. } => {
+                payloads::bucket_url(url).context("Invalid S3 sink url")?;
+            }
+            Self::Kafka { url, topic } => {
+                http_url(url)?;
+                if topic.trim().is_empty() {
+                    return Err(anyhow::anyhow!("Kafka sink '{}' needs a topic", url));
+                }
+            }
+            Self::Webhook { url, headers } => {
+                http_url(url)?;
+                for (name, value) in headers {
+                    HeaderName::try_from(name.as_str())
+                        .map_err(anyhow::Error::from)
+                        .and_then(|_| Ok(HeaderValue::try_from(value.as_str())?))
+                        .with_context(|| {
+                            format!("Webhook sink '{}': bad header '{}'", url, name)
+                        })?;
+                }
+            }
+            Self::Syslog {
+                address,
+                protocol,
+                facility,
+                ca_file,
+                ..
+            } => {
+                let port = address
+                    .rsplit_once(':')
+                    .map(|(_, port)| port.parse::<u16>());
+                if !matches!(port, Some(Ok(_))) {
+                    return Err(anyhow::anyhow!(
+                        "Syslog sink address '{}' must be host:port",
+                        address
+                    ));
+                }
+                if facility.is_some_and(|f| f > 23) {
+                    return Err(anyhow::anyhow!("Syslog facility must be 0-23"));
+                }
+                if ca_file.is_some() && *protocol != SyslogProtocol::Tls {
+                    return Err(anyhow::anyhow!(
+                        "Syslog sink '{}': ca_file needs protocol \"tls\"",
+                        address
+                    ));
+                }
+            }
+            Self::Journald => {
+                if !cfg!(target_os = "linux") {
+                    return Err(anyhow::anyhow!(
+                        "The journald sink is only available on Linux"
+                    ));
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+/// JSON Schema of one `sinks` entry. Written out by hand: serde can't
+/// describe an internally tagged enum to `config_schema`.
+pub fn schema() -> Value {
+    let string = json!({"type": "string"});
+    json!({
+        "type": "object",
+        "oneOf": [
+            variant_schema("file", json!({"path": string}), &["path"]),
+            variant_schema("s3", json!({"url": string, "region": string}), &["url"]),
+            variant_schema("kafka", json!({"url": string, "topic": string}), &["url", "topic"]),
+            variant_schema(
+                "webhook",
+                json!({
+                    "url": string,
+                    "headers": {"type": "object", "additionalProperties": string},
+                }),
+                &["url"],
+            ),
+            variant_schema(
+                "syslog",
+                json!({
+                    "address": string,
+                    "protocol": config_schema::of::<SyslogProtocol>(),
+                    "format": config_schema::of::<SyslogFormat>(),
+                    "facility": {"type": "integer", "minimum": 0, "maximum": 23},
+                    "ca_file": string,
+                }),
+                &["address"],
+            ),
+            variant_schema("journald", json!({}), &[]),
+        ],
+    })
+}
+
+fn variant_schema(kind: &str, mut properties: Value, required: &[&str]) -> Value {
+    properties["type"] = json!({ "const": kind });
+    let required: Vec<&str> = std::iter::once("type")
+        .chain(required.iter().copied())
+        .collect();
+    json!({
+        "properties": properties,
+        "required": required,
+        "additionalProperties": false,
+    })
+}
+
+fn http_url(url: &str) -> Result<()> {
+    if url.starts_with("http://") || url.starts_with("https://") {
+        Ok(())
+    } else {
+        Err(anyhow::anyhow!(
+            "'{}' must start with http:// or https://",
+            url
+        ))
+    }
+}
+
+/// Somewhere batches of events can be delivered.
+#[async_trait]
+pub trait EventSink: Send + Sync + std::fmt::Debug {
+    /// Shown in logs, e.g. `file:/var/log/km/events.jsonl`
+    fn name(&self) -> &str;
+
+    /// Deliver one batch: the `{"events": [...]}` body the API receives.
+    async fn send(&self, batch: &Value) -> Result<()>;
+}
+
+fn events(batch: &Value) -> &[Value] {
+    batch["events"].as_array().map_or(&[][..], Vec::as_slice)
+}
+
+/// The events of `batch` as JSON lines.
+fn json_lines(batch: &Value) -> Vec<u8> {
+    let mut lines = Vec::new();
+    for event in events(batch) {
+        lines.extend(event.to_string().into_bytes());
+        lines.push(b'\n');
+    }
+    lines
+}
+
+/// Appends events to a JSON lines file readable only by the user.
+#[derive(Debug)]
+pub struct FileSink {
+    name: String,
+    path: PathBuf,
+}
+
+impl FileSink {
+    pub fn new(path: PathBuf) -> Self {
+        Self {
+            name: format!("file:{}", path.display()),
+            path,
+        }
+    }
+}
+
+#[async_trait]
+impl EventSink for FileSink {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    async fn send(&self, batch: &Value) -> Result<()> {
+        if let Some(dir) = self.path.parent().filter(|d| !d.as_os_str().is_empty()) {
+            fs::create_dir_all(dir).with_context(|| format!("Failed to create {:?}", dir))?;
+        }
+        let mut options = fs::OpenOptions::new();
+        options.create(true).append(true);
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::OpenOptionsExt;
+            options.mode(0o600);
+        }
+        // One write per batch, so batches from concurrent sessions don't interleave
+        options
+            .open(&self.path)
+            .and_then(|mut file| file.write_all(&json_lines(batch)))
+            .with_context(|| format!("Failed to write to {:?}", self.path))
+    }
+}
+
+/// Writes each batch to its own object, partitioned by day:
+/// `<url>/dt=YYYY-MM-DD/<batch id>.jsonl`. A retried batch overwrites its
+/// object rather than adding another.
+#[derive(Debug)]
+pub struct S3Sink {
+    name: String,
+    bucket: reqwest::Url,
+    uploader: S3Uploader,
+}
+
+impl S3Sink {
+    pub fn new(url: &str, uploader: S3Uploader) -> Result<Self> {
+        Ok(Self {
+            name: format!("s3:{}", url),
+            bucket: payloads::bucket_url(url)?,
+            uploader,
+        })
+    }
+}
+
+#[async_trait]
+impl EventSink for S3Sink {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    async fn send(&self, batch: &Value) -> Result<()> {
+        let url = self.bucket.join(&format!(
+            "dt={}/{}.jsonl",
+            Utc::now().format("%Y-%m-%d"),
+            idempotency::batch_id(batch)
+        ))?;
+        self.uploader
+            .put(&url, json_lines(batch), "application/x-ndjson")
+            .await
+    }
+}
+
+/// Produces one record per event, keyed by session, through the REST proxy
+/// API (v2) so km needs no Kafka client of its own.
+#[derive(Debug)]
+pub struct KafkaSink {
+    name: String,
+    url: String,
+    client: reqwest::Client,
+}
+
+impl KafkaSink {
+    pub fn new(url: &str, topic: &str) -> Self {
+        Self {
+            name: format!("kafka:{}", topic),
+            url: format!("{}/topics/{}", url.trim_end_matches('/'), topic),
+            client: sink_client(),
+        }
+    }
+}
+
+#[async_trait]
+impl EventSink for KafkaSink {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    async fn send(&self, batch: &Value) -> Result<()> {
+        let records: Vec<Value> = events(batch)
+            .iter()
+            .map(|event| json!({ "key": event["session_id"], "value": event }))
+            .collect();
+        let response = self
+            .client
+            .post(&self.url)
+            .header(CONTENT_TYPE, "application/vnd.kafka.json.v2+json")
+            .body(json!({ "records": records }).to_string())
+            .send()
+            .await
+            .with_context(|| format!("Failed to reach {}", self.url))?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "{} answered with status {}",
+                self.url,
+                response.status()
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// POSTs each batch as JSON.
+#[derive(Debug)]
+pub struct WebhookSink {
+    url: String,
+    headers: BTreeMap<String, String>,
+    client: reqwest::Client,
+}
+
+impl WebhookSink {
+    pub fn new(url: &str, headers: BTreeMap<String, String>) -> Self {
+        Self {
+            url: url.to_string(),
+            headers,
+            client: sink_client(),
+        }
+    }
+}
+
+#[async_trait]
+impl EventSink for WebhookSink {
+    fn name(&self) -> &str {
+        &self.url
+    }
+
+    async fn send(&self, batch: &Value) -> Result<()> {
+        let mut request = self
+            .client
+            .post(&self.url)
+            .header(CONTENT_TYPE, "application/json")
+            .header(
+                idempotency::IDEMPOTENCY_KEY_HEADER,
+                idempotency::batch_id(batch),
+            );
+        for (name, value) in &self.headers {
+            request = request.header(name, value);
+        }
+        let response = request
+            .body(batch.to_string())
+            .send()
+            .await
+            .with_context(|| format!("Failed to reach {}", self.url))?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "{} answered with status {}",
+                self.url,
+                response.status()
+            ));
+        }
+        Ok(())
+    }
+}
+
+fn sink_client() -> reqwest::Client {
+    crate::http::client_builder()
+        .timeout(SINK_TIMEOUT)
+        .build()
+        .unwrap_or_else(|_| reqwest::Client::new())
+}
+
+/// The configured sinks. Each batch goes to all of them at once; a sink
+/// that fails misses that batch, without holding up the others or the API.
+#[derive(Debug, Clone, Default)]
+pub struct Sinks {
+    sinks: Vec<Arc<dyn EventSink>>,
+}
+
+impl Sinks {
+    pub fn new(sinks: Vec<Arc<dyn EventSink>>) -> Self {
+        Self { sinks }
+    }
+
+    pub fn from_config(configs: &[SinkConfig]) -> Result<Self> {
+        let mut sinks: Vec<Arc<dyn EventSink>> = Vec::new();
+        for config in configs {
+            config.validate()?;
+            sinks.push(match config {
+                SinkConfig::File { path } => Arc::new(FileSink::new(PathBuf::from(path))),
+                SinkConfig::S3 { url, region } => {
+                    let region = region.as_deref().unwrap_or(DEFAULT_BLOB_REGION);
+                    let credentials =
+                        S3Credentials::from_env().with_context(|| format!("S3 sink {}", url))?;
+                    Arc::new(S3Sink::new(url, S3Uploader::new(region, credentials))?)
+                }
+                SinkConfig::Kafka { url, topic } => Arc::new(KafkaSink::new(url, topic)),
+                SinkConfig::Webhook { url, headers } => {
+                    Arc::new(WebhookSink::new(url, headers.clone()))
+                }
+                SinkConfig::Syslog {
+                    address,
+                    protocol,
+                    format,
+                    facility,
+                    ca_file,
+                } => Arc::new(SyslogSink::new(
+                    address,
+                    *protocol,
+                    *format,
+                    facility.unwrap_or(syslog::DEFAULT_FACILITY),
+                    ca_file.as_deref(),
+                )?),
+                SinkConfig::Journald => Arc::new(JournaldSink),
+            });
+        }
+        Ok(Self::new(sinks))
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.sinks.is_empty()
+    }
+
+    pub fn names(&self) -> Vec<&str> {
+        self.sinks.iter().map(|sink| sink.name()).collect()
+    }
+
+    /// Deliver `batch` to every sink. Returns the names of the sinks that
+    /// failed; their errors are logged.
+    pub async fn send(&self, batch: &Value) -> Vec<String> {
+        let batch = Arc::new(batch.clone());
+        let mut sends = tokio::task::JoinSet::new();
+        for sink in &self.sinks {
+            let (sink, batch) = (sink.clone(), batch.clone());
+            sends.spawn(async move {
+                let result = tokio::time::timeout(SINK_TIMEOUT, sink.send(&batch))
+                    .await
+                    .unwrap_or_else(|_| Err(anyhow::anyhow!("timed out")));
+                (sink, result)
+            });
+        }
+        let mut failed = Vec::new();
+        while let Some(joined) = sends.join_next().await {
+            if let Ok((sink, Err(e))) = joined {
+                tracing::warn!("Sink {} missed a batch: {:#}", sink.name(), e);
+                failed.push(sink.name().to_string());
+            }
+        }
+        failed
+    }
+}
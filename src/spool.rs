@@ -0,0 +1,397 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use reqwest::StatusCode;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicI64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::sync::watch;
+
+use crate::breaker::{self, CircuitBreaker};
+use crate::encryption::{self, PayloadCipher};
+use crate::idempotency::{self, SentBatches, IDEMPOTENCY_KEY_HEADER};
+use crate::latency::ApiLatency;
+use crate::rate_limit::{self, Backoff, RateLimiter};
+
+/// The API refused the batch itself, so sending it again won't help.
+fn is_rejection(status: StatusCode) -> bool {
+    matches!(
+        status,
+        StatusCode::BAD_REQUEST | StatusCode::PAYLOAD_TOO_LARGE | StatusCode::UNPROCESSABLE_ENTITY
+    )
+}
+
+/// Last id prefix handed out, so batches spooled within the same
+/// millisecond still sort in the order they were enqueued
+static LAST_STAMP: AtomicI64 = AtomicI64::new(0);
+
+fn stamp(created_at: &DateTime<Utc>) -> i64 {
+    let now = created_at.timestamp_millis();
+    let last = LAST_STAMP
+        .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |last| {
+            Some(last.max(now - 1) + 1)
+        })
+        .unwrap_or(now - 1);
+    last.max(now - 1) + 1
+}
+
+/// A payload that could not be delivered to the API and is waiting on disk
+/// for the next upload attempt.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SpooledBatch {
+    pub id: String,
+    pub endpoint: String,
+    pub created_at: DateTime<Utc>,
+    #[serde(default)]
+    pub attempts: u32,
+    pub payload: Value,
+    /// The payload is stored encrypted
+    #[serde(skip)]
+    sealed: bool,
+}
+
+/// Decrypt a batch read from disk; it's encrypted again when rewritten.
+fn unseal(mut batch: SpooledBatch) -> Result<SpooledBatch> {
+    if let Value::String(ref payload) = batch.payload {
+        if encryption::is_sealed(payload) {
+            let payload = encryption::unseal(payload)?;
+            batch.payload =
+                serde_json::from_str(&payload).context("Corrupt encrypted spool payload")?;
+            batch.sealed = true;
+        }
+    }
+    Ok(batch)
+}
+
+#[derive(Debug, Default, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct FlushReport {
+    /// Batches accepted by the API and removed from the spool
+    pub sent: usize,
+    /// Batches the API refused outright; these are dropped, retrying won't help
+    pub rejected: usize,
+    /// Batches still on disk after this attempt
+    pub remaining: usize,
+    /// Batches the API had already acknowledged; removed without resending
+    #[serde(default)]
+    pub already_sent: usize,
+    /// The API asked km to wait this long before trying again
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub retry_after_secs: Option<u64>,
+}
+
+/// Disk-backed queue of undelivered API payloads. Each batch is a separate
+/// file so a crash mid-write can never corrupt batches already queued.
+#[derive(Debug, Clone)]
+pub struct Spool {
+    dir: PathBuf,
+    /// Payloads are encrypted with this when they're queued
+    cipher: Option<Arc<PayloadCipher>>,
+    /// Paces uploads and holds them back for `Retry-After`
+    limiter: Arc<RateLimiter>,
+    /// Holds uploads back while the API keeps failing
+    breaker: Option<Arc<CircuitBreaker>>,
+    /// How long the API takes to answer each upload
+    api_latency: Option<Arc<ApiLatency>>,
+    /// Batches the API already acknowledged; these aren't sent again
+    sent: Option<Arc<SentBatches>>,
+}
+
+impl Spool {
+    pub fn new(dir: PathBuf) -> Self {
+        Self {
+            dir,
+            cipher: None,
+            limiter: Arc::default(),
+            breaker: None,
+            api_latency: None,
+            sent: None,
+        }
+    }
+
+    pub fn with_cipher(mut self, cipher: Arc<PayloadCipher>) -> Self {
+        self.cipher = Some(cipher);
+        self
+    }
+
+    /// Skip batches recorded in `sent`, and record the ones delivered.
+    pub fn with_sent_batches(mut self, sent: Arc<SentBatches>) -> Self {
+        self.sent = Some(sent);
+        self
+    }
+
+    /// Pace uploads with `limiter`, shared with the event uploader.
+    pub fn with_rate_limiter(mut self, limiter: Arc<RateLimiter>) -> Self {
+        self.limiter = limiter;
+        self
+    }
+
+    /// Report uploads to `breaker`, shared with the event uploader, and
+    /// leave batches queued while it's open.
+    pub fn with_breaker(mut self, breaker: Arc<CircuitBreaker>) -> Self {
+        self.breaker = Some(breaker);
+        self
+    }
+
+    /// Record how long the API takes to answer in `api_latency`, shared
+    /// with the event uploader.
+    pub fn with_api_latency(mut self, api_latency: Arc<ApiLatency>) -> Self {
+        self.api_latency = Some(api_latency);
+        self
+    }
+
+    /// `~/.config/kilometers/spool` (or the platform equivalent)
+    pub fn default_dir() -> Result<PathBuf> {
+        let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+        Ok(base.config_dir().join("kilometers").join("spool"))
+    }
+
+    pub fn open_default() -> Result<Self> {
+        Ok(Self::new(Self::default_dir()?))
+    }
+
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    pub fn enqueue(&self, endpoint: &str, payload: &Value) -> Result<SpooledBatch> {
+        fs::create_dir_all(&self.dir).context("Failed to create spool directory")?;
+
+        let created_at = Utc::now();
+        let batch = SpooledBatch {
+            // Timestamp prefix keeps directory order equal to enqueue order
+            id: format!("{}-{}", stamp(&created_at), uuid::Uuid::new_v4().simple()),
+            endpoint: endpoint.to_string(),
+            created_at,
+            attempts: 0,
+            payload: payload.clone(),
+            sealed: self.cipher.is_some(),
+        };
+        self.write(&batch)?;
+
+        tracing::debug!("Spooled batch {} for {}", batch.id, endpoint);
+        Ok(batch)
+    }
+
+    fn path_for(&self, id: &str) -> PathBuf {
+        self.dir.join(format!("{}.json", id))
+    }
+
+    fn write(&self, batch: &SpooledBatch) -> Result<()> {
+        let tmp = self.dir.join(format!(".{}.tmp", batch.id));
+        let sealed;
+        let batch = if batch.sealed {
+            let cipher = match self.cipher {
+                Some(ref cipher) => cipher.clone(),
+                None => encryption::reader()?,
+            };
+            sealed = SpooledBatch {
+                payload: Value::String(cipher.seal(&batch.payload.to_string())?),
+                ..batch.clone()
+            };
+            &sealed
+        } else {
+            batch
+        };
+        let contents = serde_json::to_vec(batch).context("Failed to serialize spooled batch")?;
+        fs::write(&tmp, contents).context("Failed to write spooled batch")?;
+        fs::rename(&tmp, self.path_for(&batch.id)).context("Failed to write spooled batch")?;
+        Ok(())
+    }
+
+    /// All queued batches, oldest first. Unreadable files are skipped.
+    pub fn pending(&self) -> Result<Vec<SpooledBatch>> {
+        if !self.dir.exists() {
+            return Ok(Vec::new());
+        }
+
+        let mut paths: Vec<PathBuf> = fs::read_dir(&self.dir)
+            .context("Failed to read spool directory")?
+            .filter_map(|entry| entry.ok().map(|e| e.path()))
+            .filter(|p| p.extension().is_some_and(|ext| ext == "json"))
+            .collect();
+        paths.sort();
+
+        Ok(paths
+            .iter()
+            .filter_map(|path| {
+                let contents = fs::read_to_string(path).ok()?;
+                match serde_json::from_str(&contents)
+                    .map_err(anyhow::Error::from)
+                    .and_then(unseal)
+                {
+                    Ok(batch) => Some(batch),
+                    Err(e) => {
+                        tracing::warn!("Skipping unreadable spool file {:?}: {}", path, e);
+                        None
+                    }
+                }
+            })
+            .collect())
+    }
+
+    pub fn count(&self) -> Result<usize> {
+        Ok(self.pending()?.len())
+    }
+
+    pub fn remove(&self, id: &str) -> Result<()> {
+        fs::remove_file(self.path_for(id)).context("Failed to remove spooled batch")
+    }
+
+    /// Upload queued batches in order. Stops at the first connectivity,
+    /// server or authentication error so the remaining batches keep their
+    /// order for next time; only batches the API rejects as malformed are
+    /// dropped.
+    pub async fn flush(&self, client: &reqwest::Client, bearer_token: &str) -> Result<FlushReport> {
+        let batches = self.pending()?;
+        let mut report = FlushReport::default();
+
+        for (index, mut batch) in batches.iter().cloned().enumerate() {
+            let batch_id = idempotency::batch_id(&batch.payload);
+            if self
+                .sent
+                .as_ref()
+                .is_some_and(|sent| sent.contains(&batch_id))
+            {
+                tracing::debug!("Spooled batch {} was already delivered", batch.id);
+                self.remove(&batch.id)?;
+                report.already_sent += 1;
+                continue;
+            }
+            let attempt = match self.breaker {
+                Some(ref breaker) => match breaker.try_acquire() {
+                    Some(attempt) => Some(attempt),
+                    None => {
+                        report.remaining = batches.len() - index;
+                        return Ok(report);
+                    }
+                },
+                None => None,
+            };
+            self.limiter.acquire().await;
+            let sent_at = Instant::now();
+            let result = client
+                .post(&batch.endpoint)
+                .bearer_auth(bearer_token)
+                .header(IDEMPOTENCY_KEY_HEADER, &batch_id)
+                .json(&batch.payload)
+                .send()
+                .await;
+
+            let status = match result {
+                Ok(response) => {
+                    if let Some(ref api_latency) = self.api_latency {
+                        api_latency.record(sent_at.elapsed().as_secs_f64() * 1000.0);
+                    }
+                    if let Some(attempt) = attempt {
+                        if breaker::is_outage(response.status()) {
+                            attempt.failed();
+                        } else {
+                            attempt.succeeded();
+                        }
+                    }
+                    if rate_limit::is_throttled(response.status()) {
+                        if let Some(wait) = rate_limit::retry_after(response.headers(), Utc::now())
+                        {
+                            self.limiter.pause(wait.min(rate_limit::MAX_RETRY_WAIT));
+                            report.retry_after_secs = Some(wait.as_secs());
+                        }
+                    }
+                    response.status()
+                }
+                Err(e) => {
+                    if let Some(attempt) = attempt {
+                        attempt.failed();
+                    }
+                    tracing::debug!("Spool upload failed, will retry later: {}", e);
+                    batch.attempts += 1;
+                    self.write(&batch)?;
+                    report.remaining = batches.len() - index;
+                    return Ok(report);
+                }
+            };
+
+            if status.is_success() {
+                if let Some(ref sent) = self.sent {
+                    if let Err(e) = sent.record(&batch_id) {
+                        tracing::debug!("{:#}", e);
+                    }
+                }
+                self.remove(&batch.id)?;
+                report.sent += 1;
+            } else if breaker::is_outage(status) {
+                tracing::debug!("Spool upload got {}, will retry later", status);
+                batch.attempts += 1;
+                self.write(&batch)?;
+                report.remaining = batches.len() - index;
+                return Ok(report);
+            } else if is_rejection(status) {
+                tracing::warn!(
+                    "API rejected spooled batch {} with status {} - dropping it",
+                    batch.id,
+                    status
+                );
+                self.remove(&batch.id)?;
+                report.rejected += 1;
+            } else {
+                // Usually an expired or rotated token: nothing is wrong with
+                // the batches, so they wait for the next flush
+                tracing::warn!(
+                    "API refused spooled batch {} with status {} - keeping {} batch(es) to retry",
+                    batch.id,
+                    status,
+                    batches.len() - index
+                );
+                report.remaining = batches.len() - index;
+                return Ok(report);
+            }
+        }
+
+        Ok(report)
+    }
+
+    /// Periodically drain the spool in the background until the returned
+    /// handle is aborted, authenticating with the latest token on `tokens`.
+    pub fn spawn_uploader(
+        self,
+        client: reqwest::Client,
+        tokens: watch::Receiver<String>,
+        interval: Duration,
+    ) -> tokio::task::JoinHandle<()> {
+        // After failed attempts the wait grows, with jitter, so km instances
+        // coming back from the same outage don't all retry at once
+        let backoff = Backoff {
+            base: interval,
+            max: interval * 20,
+        };
+        tokio::spawn(async move {
+            let mut failures = 0;
+            loop {
+                let bearer_token = tokens.borrow().clone();
+                let wait = match self.flush(&client, &bearer_token).await {
+                    Ok(report) => {
+                        if report.sent > 0 {
+                            tracing::info!("Uploaded {} spooled batch(es)", report.sent);
+                        }
+                        if report.remaining > 0 {
+                            failures += 1;
+                            let retry_after =
+                                Duration::from_secs(report.retry_after_secs.unwrap_or(0));
+                            backoff.delay(failures - 1).max(retry_after)
+                        } else {
+                            failures = 0;
+                            interval
+                        }
+                    }
+                    Err(e) => {
+                        tracing::warn!("Failed to drain spool: {}", e);
+                        interval
+                    }
+                };
+                tokio::time::sleep(wait).await;
+            }
+        })
+    }
+}
@@ -0,0 +1,506 @@
+//! Sinks for enterprise logging pipelines: syslog records (RFC 5424, or
+//! CEF/LEEF for SIEMs) over UDP, TCP or TLS, and the systemd journal on
+//! Linux. The event's risk level sets the record's severity.
+
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use chrono::{DateTime, SecondsFormat, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::fmt::Write as _;
+use std::sync::Arc;
+use tokio::io::{AsyncWrite, AsyncWriteExt};
+use tokio::net::{TcpStream, UdpSocket};
+use tokio::sync::Mutex;
+use tokio_rustls::rustls::pki_types::pem::PemObject;
+use tokio_rustls::rustls::pki_types::{CertificateDer, ServerName};
+use tokio_rustls::rustls::{self, ClientConfig, RootCertStore};
+use tokio_rustls::TlsConnector;
+
+use crate::build_info;
+use crate::sinks::EventSink;
+
+/// Facility used when the config doesn't set one: local0
+pub const DEFAULT_FACILITY: u8 = 16;
+/// Application name in every record
+const APP_NAME: &str = "km";
+/// Structured data ID for event fields; 32473 is the enterprise number
+/// RFC 5612 reserves for documentation
+const SD_ID: &str = "km@32473";
+/// Records over UDP are cut to this many bytes, to stay within one datagram
+const MAX_DATAGRAM: usize = 8192;
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SyslogProtocol {
+    #[default]
+    Udp,
+    Tcp,
+    /// TCP with TLS (RFC 5425)
+    Tls,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SyslogFormat {
+    /// Event fields as RFC 5424 structured data
+    #[default]
+    Rfc5424,
+    /// ArcSight Common Event Format
+    Cef,
+    /// QRadar Log Event Extended Format
+    Leef,
+}
+
+/// Syslog severity (0 emergency to 7 debug) for an event: critical risk is
+/// critical, high is error, medium is warning, low is notice and anything
+/// unscored is informational.
+pub fn severity(event: &Value) -> u8 {
+    match event["metadata"]["risk"]["level"].as_str() {
+        Some("critical") => 2,
+        Some("high") => 3,
+        Some("medium") => 4,
+        Some("low") => 5,
+        _ => 6,
+    }
+}
+
+/// The event's risk score on the 0-10 scale CEF and LEEF use.
+fn risk_score(event: &Value) -> u8 {
+    let score = event["metadata"]["risk"]["score"].as_f64().unwrap_or(0.0);
+    (score * 10.0).round().clamp(0.0, 10.0) as u8
+}
+
+fn risk_level(event: &Value) -> &str {
+    event["metadata"]["risk"]["level"]
+        .as_str()
+        .unwrap_or("none")
+}
+
+/// What the event is about: the method, or the direction for responses.
+fn event_name(event: &Value) -> &str {
+    event["method"]
+        .as_str()
+        .or_else(|| event["direction"].as_str())
+        .unwrap_or("event")
+}
+
+/// The fields of an event a SIEM indexes, in a fixed order.
+fn fields(event: &Value) -> Vec<(&'static str, String)> {
+    let text = |value: &Value| match value {
+        Value::String(s) => Some(s.clone()),
+        Value::Null => None,
+        other => Some(other.to_string()),
+    };
+    let mut fields = Vec::new();
+    for (name, value) in [
+        ("id", &event["id"]),
+        ("session", &event["session_id"]),
+        ("direction", &event["direction"]),
+        ("method", &event["method"]),
+        ("rpcId", &event["rpc_id"]),
+        ("durationMs", &event["duration_ms"]),
+        ("size", &event["payload_size"]),
+    ] {
+        if let Some(value) = text(value) {
+            fields.push((name, value));
+        }
+    }
+    if let Some(risk) = event["metadata"]["risk"].as_object() {
+        fields.push(("risk", risk_level(event).to_string()));
+        if let Some(score) = risk.get("score").and_then(text) {
+            fields.push(("riskScore", score));
+        }
+        if let Some(patterns) = risk.get("matched_patterns").and_then(Value::as_array) {
+            let patterns: Vec<&str> = patterns.iter().filter_map(Value::as_str).collect();
+            if !patterns.is_empty() {
+                fields.push(("patterns", patterns.join(",")));
+            }
+        }
+    }
+    fields
+}
+
+fn timestamp(event: &Value) -> String {
+    event["timestamp"]
+        .as_str()
+        .and_then(|t| DateTime::parse_from_rfc3339(t).ok())
+        .map(|t| t.with_timezone(&Utc))
+        .unwrap_or_else(Utc::now)
+        .to_rfc3339_opts(SecondsFormat::Millis, true)
+}
+
+/// An RFC 5424 record for `event`, with `msg` as its message.
+fn rfc5424(event: &Value, facility: u8, hostname: &str, sd: &str, msg: &str) -> String {
+    format!(
+        "<{}>1 {} {} {} {} {} {} {}",
+        u16::from(facility) * 8 + u16::from(severity(event)),
+        timestamp(event),
+        hostname,
+        APP_NAME,
+        std::process::id(),
+        // MSGID is at most 32 printable characters
+        event_name(event)
+            .chars()
+            .filter(|c| c.is_ascii_graphic())
+            .take(32)
+            .collect::<String>(),
+        sd,
+        msg
+    )
+    .trim_end()
+    .to_string()
+}
+
+/// `[km@32473 id="..." ...]`, escaping `"`, `\` and `]` in values.
+fn structured_data(event: &Value) -> String {
+    let mut sd = format!("[{}", SD_ID);
+    for (name, value) in fields(event) {
+        let value = value
+            .replace('\\', "\\\\")
+            .replace('"', "\\\"")
+            .replace(']', "\\]");
+        let _ = write!(sd, " {}=\"{}\"", name, value);
+    }
+    sd.push(']');
+    sd
+}
+
+/// A CEF:0 message. Header fields escape `|` and `\`, extension values `=`,
+/// `\` and line breaks.
+pub fn cef(event: &Value) -> String {
+    let header = |s: &str| s.replace('\\', "\\\\").replace('|', "\\|");
+    let extension = |s: &str| {
+        s.replace('\\', "\\\\")
+            .replace('=', "\\=")
+            .replace('\n', "\\n")
+            .replace('\r', "\\r")
+    };
+    let mut ext = Vec::new();
+    for (name, value) in fields(event) {
+        let key = match name {
+            "id" => "externalId",
+            "session" => "cs1",
+            "direction" => "act",
+            "method" => "requestMethod",
+            "rpcId" => "cs2",
+            "durationMs" => "cn1",
+            "size" => "in",
+            "risk" => "cs3",
+            "riskScore" => "cfp1",
+            "patterns" => "cs4",
+            _ => continue,
+        };
+        ext.push(format!("{}={}", key, extension(&value)));
+        let label = match key {
+            "cs1" => "session",
+            "cs2" => "rpcId",
+            "cn1" => "durationMs",
+            "cs3" => "risk",
+            "cfp1" => "riskScore",
+            "cs4" => "patterns",
+            _ => continue,
+        };
+        ext.push(format!("{}Label={}", key, label));
+    }
+    format!(
+        "CEF:0|Kilometers|km|{}|{}|MCP {}|{}|{}",
+        build_info::VERSION,
+        header(event_name(event)),
+        header(event_name(event)),
+        risk_score(event),
+        ext.join(" ")
+    )
+}
+
+/// A LEEF:1.0 message with tab-separated attributes.
+pub fn leef(event: &Value) -> String {
+    let header = |s: &str| s.replace('|', "_");
+    let value = |s: &str| s.replace(['\t', '\n', '\r'], " ");
+    let mut attrs = vec![
+        format!("devTime={}", timestamp(event)),
+        "devTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSX".to_string(),
+        format!("sev={}", risk_score(event).max(1)),
+    ];
+    for (name, field) in fields(event) {
+        attrs.push(format!("{}={}", name, value(&field)));
+    }
+    format!(
+        "LEEF:1.0|Kilometers|km|{}|{}|{}",
+        build_info::VERSION,
+        header(event_name(event)),
+        attrs.join("\t")
+    )
+}
+
+/// The syslog record for `event` in `format`. CEF and LEEF messages ride in
+/// an RFC 5424 record without structured data.
+pub fn record(event: &Value, format: SyslogFormat, facility: u8, hostname: &str) -> String {
+    match format {
+        SyslogFormat::Rfc5424 => {
+            let msg = format!(
+                "{} {} risk={}",
+                event["direction"].as_str().unwrap_or("event"),
+                event_name(event),
+                risk_level(event)
+            );
+            rfc5424(event, facility, hostname, &structured_data(event), &msg)
+        }
+        SyslogFormat::Cef => rfc5424(event, facility, hostname, "-", &cef(event)),
+        SyslogFormat::Leef => rfc5424(event, facility, hostname, "-", &leef(event)),
+    }
+}
+
+/// This machine's name, or `-` (the RFC 5424 nil value) if unknown.
+fn hostname() -> String {
+    #[cfg(unix)]
+    {
+        let mut buf = [0u8; 256];
+        // SAFETY: the buffer is valid for its whole length
+        if unsafe { libc::gethostname(buf.as_mut_ptr().cast(), buf.len()) } == 0 {
+            let len = buf.iter().position(|&b| b == 0).unwrap_or(buf.len());
+            if let Ok(name) = std::str::from_utf8(&buf[..len]) {
+                if !name.is_empty() {
+                    return name.to_string();
+                }
+            }
+        }
+    }
+    std::env::var("COMPUTERNAME")
+        .ok()
+        .filter(|name| !name.is_empty())
+        .unwrap_or_else(|| "-".to_string())
+}
+
+type Stream = Box<dyn AsyncWrite + Send + Unpin>;
+
+/// Sends each event as one syslog record to a collector. TCP and TLS
+/// records are octet-counted (RFC 6587); the connection is reopened after
+/// a failed write.
+pub struct SyslogSink {
+    name: String,
+    address: String,
+    protocol: SyslogProtocol,
+    format: SyslogFormat,
+    facility: u8,
+    hostname: String,
+    /// Trusted roots for TLS: the system's, or the `ca_file` certificates
+    tls: Option<Arc<ClientConfig>>,
+    connection: Mutex<Option<Stream>>,
+}
+
+impl std::fmt::Debug for SyslogSink {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("SyslogSink")
+            .field("address", &self.address)
+            .field("protocol", &self.protocol)
+            .field("format", &self.format)
+            .finish_non_exhaustive()
+    }
+}
+
+impl SyslogSink {
+    pub fn new(
+        address: &str,
+        protocol: SyslogProtocol,
+        format: SyslogFormat,
+        facility: u8,
+        ca_file: Option<&str>,
+    ) -> Result<Self> {
+        let tls = match protocol {
+            SyslogProtocol::Tls => Some(tls_config(ca_file)?),
+            _ => None,
+        };
+        Ok(Self {
+            name: format!("syslog:{}", address),
+            address: address.to_string(),
+            protocol,
+            format,
+            facility,
+            hostname: hostname(),
+            tls,
+            connection: Mutex::new(None),
+        })
+    }
+
+    async fn connect(&self) -> Result<Stream> {
+        let tcp = TcpStream::connect(&self.address)
+            .await
+            .with_context(|| format!("Failed to connect to {}", self.address))?;
+        let Some(ref tls) = self.tls else {
+            return Ok(Box::new(tcp));
+        };
+        let host = self
+            .address
+            .rsplit_once(':')
+            .map_or(self.address.as_str(), |(host, _)| host)
+            .trim_matches(['[', ']']);
+        let server_name = ServerName::try_from(host.to_string())
+            .with_context(|| format!("Invalid TLS server name '{}'", host))?;
+        let stream = TlsConnector::from(tls.clone())
+            .connect(server_name, tcp)
+            .await
+            .with_context(|| format!("TLS handshake with {} failed", self.address))?;
+        Ok(Box::new(stream))
+    }
+
+    async fn send_stream(&self, records: &[String]) -> Result<()> {
+        let mut framed = Vec::new();
+        for record in records {
+            framed.extend(format!("{} {}", record.len(), record).into_bytes());
+        }
+        let mut connection = self.connection.lock().await;
+        // A kept connection may have been closed by the collector; a fresh
+        // one gets a single try
+        if let Some(mut stream) = connection.take() {
+            if stream.write_all(&framed).await.is_ok() && stream.flush().await.is_ok() {
+                *connection = Some(stream);
+                return Ok(());
+            }
+        }
+        let mut stream = self.connect().await?;
+        stream
+            .write_all(&framed)
+            .await
+            .with_context(|| format!("Failed to write to {}", self.address))?;
+        stream.flush().await?;
+        *connection = Some(stream);
+        Ok(())
+    }
+
+    async fn send_datagrams(&self, records: &[String]) -> Result<()> {
+        let bind = if self.address.starts_with('[') {
+            "[::]:0"
+        } else {
+            "0.0.0.0:0"
+        };
+        let socket = UdpSocket::bind(bind).await?;
+        socket
+            .connect(&self.address)
+            .await
+            .with_context(|| format!("Failed to resolve {}", self.address))?;
+        for record in records {
+            let bytes = record.as_bytes();
+            socket
+                .send(&bytes[..bytes.len().min(MAX_DATAGRAM)])
+                .await
+                .with_context(|| format!("Failed to send to {}", self.address))?;
+        }
+        Ok(())
+    }
+}
+
+fn tls_config(ca_file: Option<&str>) -> Result<Arc<ClientConfig>> {
+    let mut roots = RootCertStore::empty();
+    match ca_file {
+        Some(path) => {
+            for cert in CertificateDer::pem_file_iter(path)
+                .with_context(|| format!("Failed to read CA file {}", path))?
+            {
+                roots
+                    .add(cert.with_context(|| format!("Invalid certificate in {}", path))?)
+                    .with_context(|| format!("Invalid certificate in {}", path))?;
+            }
+        }
+        None => roots.extend(webpki_roots::TLS_SERVER_ROOTS.iter().cloned()),
+    }
+    let config =
+        ClientConfig::builder_with_provider(Arc::new(rustls::crypto::ring::default_provider()))
+            .with_safe_default_protocol_versions()?
+            .with_root_certificates(roots)
+            .with_no_client_auth();
+    Ok(Arc::new(config))
+}
+
+#[async_trait]
+impl EventSink for SyslogSink {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    async fn send(&self, batch: &Value) -> Result<()> {
+        let records: Vec<String> = batch["events"]
+            .as_array()
+            .into_iter()
+            .flatten()
+            .map(|event| record(event, self.format, self.facility, &self.hostname))
+            .collect();
+        match self.protocol {
+            SyslogProtocol::Udp => self.send_datagrams(&records).await,
+            SyslogProtocol::Tcp | SyslogProtocol::Tls => self.send_stream(&records).await,
+        }
+    }
+}
+
+/// journald's native protocol socket
+#[cfg(target_os = "linux")]
+const JOURNAL_SOCKET: &str = "/run/systemd/journal/socket";
+
+/// One journal entry in the native protocol: `KEY=value` lines, or the
+/// key, a little-endian length and the raw value when it spans lines.
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+pub fn journal_entry(event: &Value) -> Vec<u8> {
+    let mut entry = Vec::new();
+    let mut field = |key: &str, value: &str| {
+        entry.extend(key.as_bytes());
+        if value.contains('\n') {
+            entry.push(b'\n');
+            entry.extend((value.len() as u64).to_le_bytes());
+        } else {
+            entry.push(b'=');
+        }
+        entry.extend(value.as_bytes());
+        entry.push(b'\n');
+    };
+    field(
+        "MESSAGE",
+        &format!(
+            "{} {} risk={}",
+            event["direction"].as_str().unwrap_or("event"),
+            event_name(event),
+            risk_level(event)
+        ),
+    );
+    field("PRIORITY", &severity(event).to_string());
+    field("SYSLOG_IDENTIFIER", APP_NAME);
+    for (name, value) in fields(event) {
+        let key: String = name
+            .chars()
+            .flat_map(|c| {
+                let sep = c.is_ascii_uppercase().then_some('_');
+                sep.into_iter()
+                    .chain(std::iter::once(c.to_ascii_uppercase()))
+            })
+            .collect();
+        field(&format!("KM_{}", key), &value);
+    }
+    entry
+}
+
+/// Writes each event to the systemd journal, with its fields as `KM_*`
+/// journal fields.
+#[derive(Debug, Default)]
+pub struct JournaldSink;
+
+#[async_trait]
+impl EventSink for JournaldSink {
+    fn name(&self) -> &str {
+        "journald"
+    }
+
+    #[cfg(target_os = "linux")]
+    async fn send(&self, batch: &Value) -> Result<()> {
+        let socket = std::os::unix::net::UnixDatagram::unbound()?;
+        for event in batch["events"].as_array().into_iter().flatten() {
+            socket
+                .send_to(&journal_entry(event), JOURNAL_SOCKET)
+                .with_context(|| format!("Failed to write to {}", JOURNAL_SOCKET))?;
+        }
+        Ok(())
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    async fn send(&self, _batch: &Value) -> Result<()> {
+        Err(anyhow::anyhow!("journald is only available on Linux"))
+    }
+}
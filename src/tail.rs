@@ -0,0 +1,335 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io::{self, BufRead, BufReader, Write};
+use std::net::{Ipv4Addr, SocketAddr, TcpListener, TcpStream};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::mpsc::{self, Receiver, SyncSender, TrySendError};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Duration;
+
+use crate::risk::PatternRiskAnalyzer;
+use crate::traffic::{MethodResolver, TrafficEntry};
+
+/// Events buffered for each `km tail` client; a client that falls further
+/// behind misses events rather than slowing the proxy down
+const SUBSCRIBER_BUFFER: usize = 1024;
+
+/// How long a connecting client has to present its token
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// How long `km tail` waits when probing whether a session is still running
+const PROBE_TIMEOUT: Duration = Duration::from_millis(500);
+
+/// How a running `km monitor` session can be tailed. The monitor writes one
+/// of these to the tail directory while it runs; `km tail` connects to
+/// `port` on localhost and sends `token` to subscribe.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct TailEndpoint {
+    pub session_id: String,
+    pub pid: u32,
+    pub port: u16,
+    pub token: String,
+    pub started_at: DateTime<Utc>,
+}
+
+/// `~/.config/kilometers/tail` (or the platform equivalent)
+pub fn default_dir() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base.config_dir().join("kilometers").join("tail"))
+}
+
+fn endpoint_path(dir: &Path, session_id: &str) -> PathBuf {
+    dir.join(format!("{}.json", session_id))
+}
+
+/// Readable only by the current user, since the token lets anyone who has
+/// it read the session's traffic
+fn write_private(path: &Path, contents: &str) -> Result<()> {
+    let mut options = fs::OpenOptions::new();
+    options.write(true).create(true).truncate(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600);
+    }
+    options
+        .open(path)
+        .and_then(|mut file| file.write_all(contents.as_bytes()))
+        .with_context(|| format!("Failed to write {:?}", path))
+}
+
+type Subscribers = Mutex<Vec<SyncSender<Arc<str>>>>;
+
+/// Streams a monitor session's captured events to `km tail` clients over a
+/// localhost socket. Dropping the server disconnects its clients and
+/// removes its endpoint file.
+#[derive(Debug)]
+pub struct TailServer {
+    addr: SocketAddr,
+    path: PathBuf,
+    subscribers: Arc<Subscribers>,
+    stopping: Arc<AtomicBool>,
+    accept_loop: Option<thread::JoinHandle<()>>,
+    dropped: AtomicU64,
+}
+
+impl TailServer {
+    /// Listen on a free localhost port and advertise it in `dir`.
+    pub fn start(dir: &Path, session_id: &str) -> Result<Self> {
+        let listener = TcpListener::bind((Ipv4Addr::LOCALHOST, 0))
+            .context("Failed to open the tail socket")?;
+        let addr = listener.local_addr()?;
+        let endpoint = TailEndpoint {
+            session_id: session_id.to_string(),
+            pid: std::process::id(),
+            port: addr.port(),
+            token: uuid::Uuid::new_v4().simple().to_string(),
+            started_at: Utc::now(),
+        };
+
+        fs::create_dir_all(dir).context("Failed to create tail directory")?;
+        let path = endpoint_path(dir, session_id);
+        write_private(&path, &serde_json::to_string_pretty(&endpoint)?)?;
+
+        let subscribers: Arc<Subscribers> = Arc::default();
+        let stopping = Arc::new(AtomicBool::new(false));
+        let accept_loop = {
+            let subscribers = subscribers.clone();
+            let stopping = stopping.clone();
+            thread::spawn(move || {
+                for stream in listener.incoming() {
+                    if stopping.load(Ordering::SeqCst) {
+                        break;
+                    }
+                    if let Ok(stream) = stream {
+                        let subscribers = subscribers.clone();
+                        let stopping = stopping.clone();
+                        let token = endpoint.token.clone();
+                        thread::spawn(move || serve(stream, &token, &subscribers, &stopping));
+                    }
+                }
+            })
+        };
+
+        tracing::debug!("Tail server for session {} on {}", session_id, addr);
+        Ok(Self {
+            addr,
+            path,
+            subscribers,
+            stopping,
+            accept_loop: Some(accept_loop),
+            dropped: AtomicU64::new(0),
+        })
+    }
+
+    /// Send a captured entry to every connected client.
+    pub fn publish(&self, entry: &TrafficEntry) {
+        let Ok(mut subscribers) = self.subscribers.lock() else {
+            return;
+        };
+        if subscribers.is_empty() {
+            return;
+        }
+        let Ok(line) = serde_json::to_string(entry) else {
+            return;
+        };
+        let line: Arc<str> = Arc::from(line);
+        subscribers.retain(|subscriber| match subscriber.try_send(line.clone()) {
+            Ok(()) => true,
+            Err(TrySendError::Full(_)) => {
+                self.dropped.fetch_add(1, Ordering::Relaxed);
+                true
+            }
+            Err(TrySendError::Disconnected(_)) => false,
+        });
+    }
+
+    /// Subscribe in-process: captured events arrive as JSON lines until the
+    /// server stops.
+    pub fn events(&self) -> Option<Receiver<Arc<str>>> {
+        register(&self.subscribers, &self.stopping)
+    }
+
+    /// Connected clients that have presented their token
+    pub fn subscriber_count(&self) -> usize {
+        self.subscribers.lock().map(|s| s.len()).unwrap_or_default()
+    }
+}
+
+impl Drop for TailServer {
+    fn drop(&mut self) {
+        self.stopping.store(true, Ordering::SeqCst);
+        // Wake the accept loop so it sees the flag, and wait for it to
+        // close the socket
+        if TcpStream::connect_timeout(&self.addr, PROBE_TIMEOUT).is_ok() {
+            if let Some(accept_loop) = self.accept_loop.take() {
+                let _ = accept_loop.join();
+            }
+        }
+        if let Ok(mut subscribers) = self.subscribers.lock() {
+            subscribers.clear();
+        }
+        let _ = fs::remove_file(&self.path);
+        let dropped = self.dropped.load(Ordering::Relaxed);
+        if dropped > 0 {
+            tracing::info!("Tail clients fell behind and missed {} events", dropped);
+        }
+    }
+}
+
+/// Add a subscriber, unless the server is shutting down.
+fn register(subscribers: &Subscribers, stopping: &AtomicBool) -> Option<Receiver<Arc<str>>> {
+    let (tx, rx) = mpsc::sync_channel::<Arc<str>>(SUBSCRIBER_BUFFER);
+    let mut subscribers = subscribers.lock().ok()?;
+    // Checked under the lock so a server shutting down can't miss us
+    if stopping.load(Ordering::SeqCst) {
+        return None;
+    }
+    subscribers.push(tx);
+    Some(rx)
+}
+
+/// Check a client's token, then forward events to it until either side
+/// goes away.
+fn serve(stream: TcpStream, token: &str, subscribers: &Subscribers, stopping: &AtomicBool) {
+    let _ = stream.set_read_timeout(Some(HANDSHAKE_TIMEOUT));
+    let mut hello = String::new();
+    let Ok(reader) = stream.try_clone() else {
+        return;
+    };
+    if BufReader::new(reader).read_line(&mut hello).is_err() || hello.trim() != token {
+        return;
+    }
+
+    let Some(rx) = register(subscribers, stopping) else {
+        return;
+    };
+    let mut writer = io::BufWriter::new(stream);
+    while let Ok(line) = rx.recv() {
+        // Send whatever else is already queued with the same flush
+        let sent = std::iter::once(line)
+            .chain(rx.try_iter())
+            .try_for_each(|line| {
+                writer.write_all(line.as_bytes())?;
+                writer.write_all(b"\n")
+            })
+            .and_then(|_| writer.flush());
+        if sent.is_err() {
+            break;
+        }
+    }
+}
+
+/// Sessions that can be tailed right now, most recently started first.
+/// Endpoint files left behind by sessions that are gone are cleaned up.
+pub fn running(dir: &Path) -> Vec<TailEndpoint> {
+    let Ok(files) = fs::read_dir(dir) else {
+        return Vec::new();
+    };
+    let mut endpoints: Vec<TailEndpoint> = files
+        .flatten()
+        .map(|file| file.path())
+        .filter(|path| path.extension().is_some_and(|ext| ext == "json"))
+        .filter_map(|path| {
+            let endpoint: TailEndpoint = fs::read_to_string(&path)
+                .ok()
+                .and_then(|contents| serde_json::from_str(&contents).ok())?;
+            let addr = SocketAddr::from((Ipv4Addr::LOCALHOST, endpoint.port));
+            match TcpStream::connect_timeout(&addr, PROBE_TIMEOUT) {
+                Ok(_) => Some(endpoint),
+                Err(_) => {
+                    let _ = fs::remove_file(&path);
+                    None
+                }
+            }
+        })
+        .collect();
+    endpoints.sort_by(|a, b| b.started_at.cmp(&a.started_at));
+    endpoints
+}
+
+/// The running session whose id starts with `prefix`, or the most recent
+/// one when no prefix is given.
+pub fn resolve<'a>(
+    endpoints: &'a [TailEndpoint],
+    prefix: Option<&str>,
+) -> Result<&'a TailEndpoint> {
+    let Some(prefix) = prefix else {
+        return endpoints.first().ok_or_else(|| {
+            anyhow::anyhow!(
+                "No running km monitor sessions to tail; use `km sessions` for past ones"
+            )
+        });
+    };
+    let matches: Vec<&TailEndpoint> = endpoints
+        .iter()
+        .filter(|e| e.session_id.starts_with(prefix))
+        .collect();
+    match matches.as_slice() {
+        [endpoint] => Ok(endpoint),
+        [] => Err(anyhow::anyhow!(
+            "No running session matches '{}'; use `km sessions` for past ones",
+            prefix
+        )),
+        _ => Err(anyhow::anyhow!(
+            "'{}' matches {} running sessions; use a longer prefix",
+            prefix,
+            matches.len()
+        )),
+    }
+}
+
+/// Subscribe to a running session. Yields each captured event as a JSON
+/// line and ends when the session does.
+pub fn subscribe(endpoint: &TailEndpoint) -> Result<io::Lines<BufReader<TcpStream>>> {
+    let addr = SocketAddr::from((Ipv4Addr::LOCALHOST, endpoint.port));
+    let mut stream = TcpStream::connect(addr)
+        .with_context(|| format!("Session {} is no longer running", endpoint.session_id))?;
+    writeln!(stream, "{}", endpoint.token).context("Failed to subscribe to the session")?;
+    Ok(BufReader::new(stream).lines())
+}
+
+/// Formats events for the terminal: time, direction, method, risk level
+/// and the start of the payload.
+#[derive(Debug, Default)]
+pub struct TailPrinter {
+    methods: MethodResolver,
+    analyzer: PatternRiskAnalyzer,
+}
+
+impl TailPrinter {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn render(&mut self, entry: &TrafficEntry) -> String {
+        let method = self.methods.resolve(entry);
+        let risk = self.analyzer.analyze(method.as_deref(), &entry.content);
+        let arrow = if entry.direction == "request" {
+            "→"
+        } else {
+            "←"
+        };
+        let duration = entry
+            .duration_ms
+            .map(|ms| format!(" {:.1}ms", ms))
+            .unwrap_or_default();
+        let mut payload: String = entry.content.chars().take(80).collect();
+        if payload.len() < entry.content.len() {
+            payload.push('…');
+        }
+        format!(
+            "{} {} {:<24} {:<8}{}  {}",
+            entry.timestamp.format("%H:%M:%S%.3f"),
+            arrow,
+            method.as_deref().unwrap_or("-"),
+            risk.level.to_string(),
+            duration,
+            payload
+        )
+    }
+}
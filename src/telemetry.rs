@@ -0,0 +1,379 @@
+//! Anonymous usage statistics, off unless the user turns them on with
+//! `km telemetry on`. Each km command adds one event to a local queue: the
+//! command's name, whether it failed and how, and how long it took. Never
+//! arguments, payloads, paths, API keys or account details. The queue is
+//! uploaded about once a day.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Duration, NaiveDate, Utc};
+use clap::ArgMatches;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+use crate::build_info;
+
+/// Where queued events are sent; `KM_TELEMETRY_URL` overrides it
+pub const DEFAULT_TELEMETRY_URL: &str = "https://api.kilometers.ai/api/telemetry";
+/// Set to `0`, `off` or `false` to keep telemetry off whatever
+/// `km telemetry on` said
+pub const TELEMETRY_ENV: &str = "KM_TELEMETRY";
+/// The cross-tool opt-out (<https://consoledonottrack.com>)
+pub const DO_NOT_TRACK_ENV: &str = "DO_NOT_TRACK";
+
+/// Events kept while uploads fail; the oldest are dropped beyond this
+const MAX_QUEUED: usize = 1000;
+/// Upload as soon as this many events are queued
+const UPLOAD_BATCH: usize = 50;
+/// Otherwise upload this long after the last upload
+const UPLOAD_INTERVAL: Duration = Duration::hours(24);
+const UPLOAD_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(3);
+
+/// Every field of an event, as shown by `km telemetry status`.
+pub const FIELDS: &[(&str, &str)] = &[
+    (
+        "command",
+        "Subcommand name, e.g. storage prune; plugin subcommands are all plugin",
+    ),
+    ("outcome", "ok or error"),
+    (
+        "error_category",
+        "network, timeout, io, parse or other; never the message",
+    ),
+    ("duration_ms", "How long the command ran"),
+    ("version", "km version"),
+    ("os", "Operating system, e.g. linux"),
+    ("arch", "CPU architecture, e.g. x86_64"),
+    ("day", "UTC date the command ran, without the time"),
+];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Outcome {
+    Ok,
+    Error,
+}
+
+/// One km command, as recorded in the queue and uploaded.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct UsageEvent {
+    pub command: String,
+    pub outcome: Outcome,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error_category: Option<String>,
+    pub duration_ms: u64,
+    pub version: String,
+    pub os: String,
+    pub arch: String,
+    pub day: NaiveDate,
+}
+
+impl UsageEvent {
+    /// The event for a command that ran for `duration` and ended with `result`.
+    pub fn new(command: &str, duration: std::time::Duration, result: &Result<()>) -> Self {
+        Self {
+            command: command.to_string(),
+            outcome: if result.is_ok() {
+                Outcome::Ok
+            } else {
+                Outcome::Error
+            },
+            error_category: result.as_ref().err().map(|e| error_category(e).to_string()),
+            duration_ms: duration.as_millis() as u64,
+            version: build_info::VERSION.to_string(),
+            os: std::env::consts::OS.to_string(),
+            arch: std::env::consts::ARCH.to_string(),
+            day: Utc::now().date_naive(),
+        }
+    }
+}
+
+/// The user's choice, kept in `state.json`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct TelemetryState {
+    #[serde(default)]
+    pub enabled: bool,
+    /// Random id sent with uploads so events from one machine can be told
+    /// apart; a new one is made each time telemetry is turned on
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub install_id: Option<String>,
+    /// When telemetry was last turned on or off
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub changed_at: Option<DateTime<Utc>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_upload: Option<DateTime<Utc>>,
+}
+
+/// Upload body
+#[derive(Serialize)]
+struct UploadRequest<'a> {
+    install_id: &'a str,
+    events: &'a [UsageEvent],
+}
+
+/// The telemetry directory: the user's choice and the queue of events
+/// waiting to be uploaded.
+#[derive(Debug, Clone)]
+pub struct Telemetry {
+    dir: PathBuf,
+}
+
+impl Telemetry {
+    pub fn new(dir: PathBuf) -> Self {
+        Self { dir }
+    }
+
+    /// `~/.config/kilometers/telemetry` (or the platform equivalent)
+    pub fn default_dir() -> Result<PathBuf> {
+        let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+        Ok(base.config_dir().join("kilometers").join("telemetry"))
+    }
+
+    pub fn open_default() -> Result<Self> {
+        Ok(Self::new(Self::default_dir()?))
+    }
+
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    fn state_path(&self) -> PathBuf {
+        self.dir.join("state.json")
+    }
+
+    fn queue_path(&self) -> PathBuf {
+        self.dir.join("queue.jsonl")
+    }
+
+    /// The saved choice; telemetry is off when nothing was saved.
+    pub fn state(&self) -> TelemetryState {
+        fs::read_to_string(self.state_path())
+            .ok()
+            .and_then(|content| serde_json::from_str(&content).ok())
+            .unwrap_or_default()
+    }
+
+    fn save_state(&self, state: &TelemetryState) -> Result<()> {
+        fs::create_dir_all(&self.dir).context("Failed to create telemetry directory")?;
+        fs::write(self.state_path(), serde_json::to_string_pretty(state)?)
+            .context("Failed to save telemetry settings")
+    }
+
+    /// Turn telemetry on, with a new install id unless it's already on.
+    pub fn enable(&self) -> Result<TelemetryState> {
+        let mut state = self.state();
+        if !state.enabled {
+            state = TelemetryState {
+                enabled: true,
+                install_id: Some(uuid::Uuid::new_v4().to_string()),
+                changed_at: Some(Utc::now()),
+                last_upload: None,
+            };
+            self.save_state(&state)?;
+        }
+        Ok(state)
+    }
+
+    /// Turn telemetry off, forget the install id and delete queued events.
+    pub fn disable(&self) -> Result<()> {
+        self.save_state(&TelemetryState {
+            enabled: false,
+            changed_at: Some(Utc::now()),
+            ..TelemetryState::default()
+        })?;
+        match fs::remove_file(self.queue_path()) {
+            Ok(()) => Ok(()),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(()),
+            Err(e) => Err(e).context("Failed to delete queued telemetry"),
+        }
+    }
+
+    /// Whether events are recorded: turned on, and not overridden by
+    /// `KM_TELEMETRY` or `DO_NOT_TRACK`.
+    pub fn is_active(&self) -> bool {
+        self.state().enabled && disabled_by_env().is_none()
+    }
+
+    /// Queued events, oldest first. Unreadable lines are skipped.
+    pub fn queued(&self) -> Result<Vec<UsageEvent>> {
+        let content = match fs::read_to_string(self.queue_path()) {
+            Ok(content) => content,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(e).context("Failed to read queued telemetry"),
+        };
+        Ok(content
+            .lines()
+            .filter_map(|line| serde_json::from_str(line).ok())
+            .collect())
+    }
+
+    /// Add an event to the queue, dropping the oldest past `MAX_QUEUED`.
+    pub fn record(&self, event: &UsageEvent) -> Result<()> {
+        fs::create_dir_all(&self.dir).context("Failed to create telemetry directory")?;
+        let mut queue = fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(self.queue_path())
+            .context("Failed to open telemetry queue")?;
+        writeln!(queue, "{}", serde_json::to_string(event)?)
+            .context("Failed to queue telemetry")?;
+        drop(queue);
+
+        let events = self.queued()?;
+        if events.len() > MAX_QUEUED {
+            self.rewrite(&events[events.len() - MAX_QUEUED..])?;
+        }
+        Ok(())
+    }
+
+    fn rewrite(&self, events: &[UsageEvent]) -> Result<()> {
+        let tmp = self.dir.join(".queue.jsonl.tmp");
+        let mut content = String::new();
+        for event in events {
+            content.push_str(&serde_json::to_string(event)?);
+            content.push('\n');
+        }
+        fs::write(&tmp, content).context("Failed to write telemetry queue")?;
+        fs::rename(&tmp, self.queue_path()).context("Failed to write telemetry queue")
+    }
+
+    /// Whether the queue should be uploaded now: it's full enough, or the
+    /// last upload (or turning telemetry on) was a day ago.
+    pub fn upload_due(&self, queued: usize, now: DateTime<Utc>) -> bool {
+        if queued == 0 {
+            return false;
+        }
+        if queued >= UPLOAD_BATCH {
+            return true;
+        }
+        let state = self.state();
+        match state.last_upload.or(state.changed_at) {
+            Some(since) => now - since >= UPLOAD_INTERVAL,
+            None => true,
+        }
+    }
+
+    /// Send the queued events to `url` and empty the queue. Returns how
+    /// many were sent.
+    pub async fn upload(&self, client: &reqwest::Client, url: &str) -> Result<usize> {
+        let mut state = self.state();
+        let Some(install_id) = state.install_id.clone().filter(|_| state.enabled) else {
+            return Ok(0);
+        };
+        let events = self.queued()?;
+        if events.is_empty() {
+            return Ok(0);
+        }
+
+        let response = client
+            .post(url)
+            .json(&UploadRequest {
+                install_id: &install_id,
+                events: &events,
+            })
+            .send()
+            .await
+            .with_context(|| format!("Failed to reach {}", url))?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "{} answered with status {}",
+                url,
+                response.status()
+            ));
+        }
+
+        // Events recorded while uploading stay queued
+        let remaining = self.queued()?;
+        self.rewrite(remaining.get(events.len()..).unwrap_or_default())?;
+        state.last_upload = Some(Utc::now());
+        self.save_state(&state)?;
+        Ok(events.len())
+    }
+}
+
+/// The environment variable that keeps telemetry off, if one is set.
+pub fn disabled_by_env() -> Option<&'static str> {
+    disabled_by(|name| std::env::var(name).ok())
+}
+
+/// `disabled_by_env` with the environment read through `var`.
+pub fn disabled_by(var: impl Fn(&str) -> Option<String>) -> Option<&'static str> {
+    let set = |name: &str| var(name).map(|v| v.trim().to_ascii_lowercase());
+    if set(TELEMETRY_ENV).is_some_and(|v| matches!(v.as_str(), "0" | "off" | "false" | "no")) {
+        return Some(TELEMETRY_ENV);
+    }
+    if set(DO_NOT_TRACK_ENV).is_some_and(|v| !v.is_empty() && v != "0" && v != "false") {
+        return Some(DO_NOT_TRACK_ENV);
+    }
+    None
+}
+
+/// Name recorded for the command `matches` was parsed from: the subcommand
+/// and its own subcommand, if any. Subcommands `cli` doesn't define come
+/// from plugins and are all recorded as `plugin`; hidden ones (shell
+/// completion) aren't recorded at all.
+pub fn command_name(cli: &clap::Command, matches: &ArgMatches) -> Option<String> {
+    let (name, sub_matches) = matches.subcommand()?;
+    let Some(command) = cli.find_subcommand(name) else {
+        return Some("plugin".to_string());
+    };
+    if command.is_hide_set() {
+        return None;
+    }
+    Some(match sub_matches.subcommand_name() {
+        Some(sub) => format!("{} {}", name, sub),
+        None => name.to_string(),
+    })
+}
+
+/// What kind of failure `error` was, from the errors in its chain.
+pub fn error_category(error: &anyhow::Error) -> &'static str {
+    for cause in error.chain() {
+        if let Some(e) = cause.downcast_ref::<reqwest::Error>() {
+            return if e.is_timeout() { "timeout" } else { "network" };
+        }
+        if let Some(e) = cause.downcast_ref::<std::io::Error>() {
+            return if e.kind() == std::io::ErrorKind::TimedOut {
+                "timeout"
+            } else {
+                "io"
+            };
+        }
+        if cause.is::<serde_json::Error>() {
+            return "parse";
+        }
+    }
+    "other"
+}
+
+/// Record a finished command if telemetry is on, and upload the queue when
+/// it's due. Never fails: problems are only logged.
+pub async fn record_command(command: &str, duration: std::time::Duration, result: &Result<()>) {
+    let telemetry = match Telemetry::open_default() {
+        Ok(telemetry) if telemetry.is_active() => telemetry,
+        _ => return,
+    };
+    if let Err(e) = telemetry.record(&UsageEvent::new(command, duration, result)) {
+        tracing::debug!("Not recording telemetry: {:#}", e);
+        return;
+    }
+
+    // Offline, events wait in the queue until km runs online again
+    let queued = telemetry.queued().map(|events| events.len()).unwrap_or(0);
+    if crate::offline::enabled() || !telemetry.upload_due(queued, Utc::now()) {
+        return;
+    }
+    let client = crate::http::client_builder()
+        .timeout(UPLOAD_TIMEOUT)
+        .build()
+        .unwrap_or_else(|_| reqwest::Client::new());
+    let url = std::env::var("KM_TELEMETRY_URL")
+        .ok()
+        .filter(|url| !url.is_empty())
+        .unwrap_or_else(|| DEFAULT_TELEMETRY_URL.to_string());
+    match telemetry.upload(&client, &url).await {
+        Ok(sent) => tracing::debug!("Uploaded {} telemetry event(s)", sent),
+        Err(e) => tracing::debug!("Telemetry upload failed, keeping the queue: {:#}", e),
+    }
+}
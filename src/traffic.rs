@@ -0,0 +1,292 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Duration, NaiveDate, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{BTreeMap, HashMap};
+use std::fs::{self, File};
+use std::io::{Read, Seek, SeekFrom};
+use std::path::{Path, PathBuf};
+
+use crate::encryption;
+
+/// A single MCP message captured by the proxy, as stored in the traffic log.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TrafficEntry {
+    pub timestamp: DateTime<Utc>,
+    pub direction: String,
+    pub content: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub duration_ms: Option<f64>,
+    /// How the call a response answers ended, `success` or `error`; see
+    /// [`crate::correlation::CallStatus`]
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub status: Option<String>,
+    /// The JSON-RPC error code, when `status` is `error`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error_code: Option<i64>,
+    /// Milliseconds since the session's first message on the monotonic
+    /// clock; see [`crate::clock::normalize`]
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub elapsed_ms: Option<f64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub session_id: Option<String>,
+    /// Annotations added by plugins
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub metadata: BTreeMap<String, Value>,
+    /// Labels the session was started with (`km monitor --label`)
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub labels: Labels,
+}
+
+/// Key/value labels attached to a monitor session with `--label`.
+pub type Labels = BTreeMap<String, String>;
+
+/// Label holding the `km monitor --run-id` that ties sessions on several
+/// machines into one run
+pub const RUN_ID_LABEL: &str = "run.id";
+
+/// Parse a `key=value` label. Keys are letters, digits and `_ - . /`;
+/// values may be anything, including empty.
+pub fn parse_label(value: &str) -> std::result::Result<(String, String), String> {
+    let (key, value) = value
+        .split_once('=')
+        .ok_or_else(|| format!("'{}' is not a key=value label", value))?;
+    let key = key.trim();
+    if key.is_empty() {
+        return Err("Label keys can't be empty".to_string());
+    }
+    if let Some(c) = key
+        .chars()
+        .find(|c| !(c.is_ascii_alphanumeric() || "_-./".contains(*c)))
+    {
+        return Err(format!(
+            "Label key '{}' contains '{}'; use letters, digits, '_', '-', '.' or '/'",
+            key, c
+        ));
+    }
+    Ok((key.to_string(), value.to_string()))
+}
+
+/// Whether `labels` has every `key=value` pair in `wanted`.
+pub fn has_labels(labels: &Labels, wanted: &[(String, String)]) -> bool {
+    wanted
+        .iter()
+        .all(|(key, value)| labels.get(key) == Some(value))
+}
+
+impl TrafficEntry {
+    /// Parse the captured content as a JSON-RPC message, if it is one.
+    pub fn rpc(&self) -> Option<Value> {
+        serde_json::from_str::<Value>(&self.content).ok()
+    }
+
+    pub fn rpc_id(&self) -> Option<Value> {
+        self.rpc().and_then(|rpc| rpc.get("id").cloned())
+    }
+
+    /// The entry with its content decrypted, if it was stored encrypted.
+    pub fn unsealed(mut self) -> Result<Self> {
+        if encryption::is_sealed(&self.content) {
+            self.content = encryption::unseal(&self.content)?.into_owned();
+        }
+        Ok(self)
+    }
+}
+
+/// Read every well-formed entry from a traffic log, skipping lines that
+/// cannot be parsed (partial writes, legacy formats). Encrypted payloads
+/// are decrypted.
+pub fn read_entries(path: &Path) -> Result<Vec<TrafficEntry>> {
+    let contents = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read traffic log {:?}", path))?;
+
+    contents
+        .lines()
+        .filter(|line| !line.trim().is_empty())
+        .filter_map(|line| serde_json::from_str::<TrafficEntry>(line).ok())
+        .map(|entry| {
+            entry
+                .unsealed()
+                .with_context(|| format!("Failed to read traffic log {:?}", path))
+        })
+        .collect()
+}
+
+/// Incrementally reads entries appended to a traffic log, for commands
+/// that follow a live session.
+#[derive(Debug)]
+pub struct TrafficFollower {
+    path: PathBuf,
+    offset: u64,
+    partial: String,
+}
+
+impl TrafficFollower {
+    /// Start following from the beginning of the file.
+    pub fn new(path: PathBuf) -> Self {
+        Self {
+            path,
+            offset: 0,
+            partial: String::new(),
+        }
+    }
+
+    /// Return entries appended since the last poll. A missing file yields
+    /// no entries; a truncated file is read again from the start.
+    pub fn poll(&mut self) -> Result<Vec<TrafficEntry>> {
+        let mut file = match File::open(&self.path) {
+            Ok(file) => file,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(e).context("Failed to open traffic log"),
+        };
+
+        let len = file.metadata().context("Failed to stat traffic log")?.len();
+        if len < self.offset {
+            self.offset = 0;
+            self.partial.clear();
+        }
+        if len == self.offset {
+            return Ok(Vec::new());
+        }
+
+        file.seek(SeekFrom::Start(self.offset))
+            .context("Failed to seek traffic log")?;
+        let mut buf = String::new();
+        let read = file
+            .read_to_string(&mut buf)
+            .context("Failed to read traffic log")?;
+        self.offset += read as u64;
+
+        self.partial.push_str(&buf);
+        let mut entries = Vec::new();
+        while let Some(pos) = self.partial.find('\n') {
+            let line: String = self.partial.drain(..=pos).collect();
+            if let Ok(entry) = serde_json::from_str::<TrafficEntry>(line.trim()) {
+                entries.push(entry.unsealed()?);
+            }
+        }
+
+        Ok(entries)
+    }
+}
+
+/// Works out entries' JSON-RPC methods as they arrive. Responses do not
+/// carry a method, so they inherit it from the request with the same id in
+/// the same session.
+#[derive(Debug, Default)]
+pub struct MethodResolver {
+    pending: HashMap<(Option<String>, String), String>,
+}
+
+impl MethodResolver {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn resolve(&mut self, entry: &TrafficEntry) -> Option<String> {
+        let rpc = entry.rpc();
+        let method = rpc
+            .as_ref()
+            .and_then(|r| r.get("method").and_then(|m| m.as_str()).map(String::from));
+        let id_key = rpc
+            .as_ref()
+            .and_then(|r| r.get("id"))
+            .map(|id| (entry.session_id.clone(), id.to_string()));
+
+        match (method, id_key) {
+            (Some(method), Some(key)) => {
+                self.pending.insert(key, method.clone());
+                Some(method)
+            }
+            (Some(method), None) => Some(method),
+            (None, Some(key)) => self.pending.remove(&key),
+            (None, None) => None,
+        }
+    }
+}
+
+/// Resolve the JSON-RPC method for every entry; see [`MethodResolver`].
+pub fn resolve_methods(entries: &[TrafficEntry]) -> Vec<Option<String>> {
+    let mut resolver = MethodResolver::new();
+    entries
+        .iter()
+        .map(|entry| resolver.resolve(entry))
+        .collect()
+}
+
+/// Match a method name against a simple glob pattern where `*` matches any
+/// run of characters, e.g. `tools/*` or `*/list`.
+pub fn method_matches(pattern: &str, method: &str) -> bool {
+    let parts: Vec<&str> = pattern.split('*').collect();
+    if parts.len() == 1 {
+        return pattern == method;
+    }
+
+    let mut rest = method;
+    for (i, part) in parts.iter().enumerate() {
+        if i == 0 {
+            match rest.strip_prefix(part) {
+                Some(r) => rest = r,
+                None => return false,
+            }
+        } else if i == parts.len() - 1 {
+            return rest.ends_with(part);
+        } else {
+            match rest.find(part) {
+                Some(pos) => rest = &rest[pos + part.len()..],
+                None => return false,
+            }
+        }
+    }
+
+    true
+}
+
+/// Parse a time bound given as RFC 3339, a plain date (`2025-01-31`), or a
+/// relative duration back from now (`30m`, `24h`, `7d`).
+pub fn parse_time_bound(value: &str) -> Result<DateTime<Utc>> {
+    if let Ok(ts) = DateTime::parse_from_rfc3339(value) {
+        return Ok(ts.with_timezone(&Utc));
+    }
+
+    if let Ok(date) = NaiveDate::parse_from_str(value, "%Y-%m-%d") {
+        if let Some(dt) = date.and_hms_opt(0, 0, 0) {
+            return Ok(dt.and_utc());
+        }
+    }
+
+    if let Some(duration) = parse_relative_duration(value) {
+        return Ok(Utc::now() - duration);
+    }
+
+    Err(anyhow::anyhow!(
+        "Invalid time '{}': expected RFC 3339, YYYY-MM-DD, or a duration like 24h",
+        value
+    ))
+}
+
+/// Parse a duration such as `15s` or `2m`; a plain number is seconds.
+pub fn parse_duration(value: &str) -> std::result::Result<std::time::Duration, String> {
+    let duration = match value.parse::<u32>() {
+        Ok(seconds) => Duration::seconds(seconds.into()),
+        Err(_) => parse_relative_duration(value)
+            .ok_or_else(|| format!("'{}' is not a duration like 15s or 2m", value))?,
+    };
+    duration
+        .to_std()
+        .map_err(|_| format!("'{}' is negative", value))
+}
+
+fn parse_relative_duration(value: &str) -> Option<Duration> {
+    let unit = value.chars().last()?;
+    let amount: i64 = value[..value.len() - unit.len_utf8()].parse().ok()?;
+
+    match unit {
+        's' => Some(Duration::seconds(amount)),
+        'm' => Some(Duration::minutes(amount)),
+        'h' => Some(Duration::hours(amount)),
+        'd' => Some(Duration::days(amount)),
+        'w' => Some(Duration::weeks(amount)),
+        _ => None,
+    }
+}
@@ -0,0 +1,444 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Duration, Utc};
+use clap::ValueEnum;
+use flate2::read::{DeflateDecoder, GzDecoder};
+use serde::{Deserialize, Serialize};
+use std::cmp::Ordering;
+use std::fs;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+
+use crate::plugins::compare_versions;
+use crate::plugins::verify::{sha256_hex, TrustedKeys};
+
+/// GitHub releases of km; `update_url` can point at a Kilometers update
+/// endpoint instead
+pub const DEFAULT_UPDATE_URL: &str =
+    "https://api.github.com/repos/kilometers-ai/kilometers-cli/releases";
+
+/// Which releases `km update` installs.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize, ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum Channel {
+    /// Full releases only
+    #[default]
+    Stable,
+    /// Pre-releases as well
+    Beta,
+}
+
+impl std::fmt::Display for Channel {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            Channel::Stable => "stable",
+            Channel::Beta => "beta",
+        })
+    }
+}
+
+/// One downloadable file of a release.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Asset {
+    pub name: String,
+    pub url: String,
+    /// Hex SHA-256 of the file
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sha256: Option<String>,
+    /// Base64 Ed25519 signature over the file
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signature: Option<String>,
+}
+
+/// A published km version, as listed by the Kilometers update endpoint.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Release {
+    pub version: String,
+    #[serde(default)]
+    pub channel: Channel,
+    #[serde(default)]
+    pub assets: Vec<Asset>,
+}
+
+impl Release {
+    pub fn asset(&self, name: &str) -> Option<&Asset> {
+        self.assets.iter().find(|asset| asset.name == name)
+    }
+}
+
+#[derive(Deserialize)]
+struct GitHubAsset {
+    name: String,
+    browser_download_url: String,
+}
+
+#[derive(Deserialize)]
+struct GitHubRelease {
+    tag_name: String,
+    #[serde(default)]
+    prerelease: bool,
+    #[serde(default)]
+    draft: bool,
+    #[serde(default)]
+    assets: Vec<GitHubAsset>,
+}
+
+/// Either GitHub's release list or the Kilometers update endpoint's
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum Feed {
+    GitHub(Vec<GitHubRelease>),
+    Kilometers { releases: Vec<Release> },
+}
+
+impl Feed {
+    fn into_releases(self) -> Vec<Release> {
+        match self {
+            Feed::Kilometers { releases } => releases,
+            Feed::GitHub(releases) => releases
+                .into_iter()
+                .filter(|release| !release.draft)
+                .map(|release| Release {
+                    version: release.tag_name.trim_start_matches('v').to_string(),
+                    channel: if release.prerelease {
+                        Channel::Beta
+                    } else {
+                        Channel::Stable
+                    },
+                    assets: release
+                        .assets
+                        .into_iter()
+                        .map(|asset| Asset {
+                            name: asset.name,
+                            url: asset.browser_download_url,
+                            sha256: None,
+                            signature: None,
+                        })
+                        .collect(),
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Name of the release archive for an OS and architecture, as in
+/// `std::env::consts`.
+pub fn asset_name_for(os: &str, arch: &str) -> Option<String> {
+    let arch = match arch {
+        "x86_64" => "amd64",
+        "aarch64" => "arm64",
+        _ => return None,
+    };
+    match os {
+        "linux" => Some(format!("km-linux-{}.tar.gz", arch)),
+        "macos" => Some(format!("km-darwin-{}.tar.gz", arch)),
+        "windows" if arch == "amd64" => Some("km-windows-amd64.zip".to_string()),
+        _ => None,
+    }
+}
+
+/// Release archive for the platform km is running on
+pub fn asset_name() -> Option<String> {
+    asset_name_for(std::env::consts::OS, std::env::consts::ARCH)
+}
+
+/// Whether `candidate` is a later version than `current`
+pub fn is_newer(candidate: &str, current: &str) -> bool {
+    compare_versions(candidate, current) == Ordering::Greater
+}
+
+/// How long a check for the latest release is trusted before asking again
+const CHECK_TTL_HOURS: i64 = 24;
+
+/// The newest release on a channel when km last looked, so `km monitor`
+/// can warn about an outdated km without asking the network.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LatestCheck {
+    pub channel: Channel,
+    pub latest: String,
+    pub checked_at: DateTime<Utc>,
+}
+
+impl LatestCheck {
+    pub fn new(channel: Channel, latest: String) -> Self {
+        Self {
+            channel,
+            latest,
+            checked_at: Utc::now(),
+        }
+    }
+
+    /// Whether the check is recent enough to skip asking again
+    pub fn is_fresh(&self, now: DateTime<Utc>) -> bool {
+        now - self.checked_at < Duration::hours(CHECK_TTL_HOURS)
+    }
+
+    /// The latest version, if it's newer than `current`
+    pub fn newer_than(&self, current: &str) -> Option<&str> {
+        is_newer(&self.latest, current).then_some(self.latest.as_str())
+    }
+}
+
+/// `~/.config/kilometers/latest_release.json` (or the platform equivalent)
+pub fn check_path() -> Result<PathBuf> {
+    let base = directories::BaseDirs::new().context("Could not determine home directory")?;
+    Ok(base
+        .config_dir()
+        .join("kilometers")
+        .join("latest_release.json"))
+}
+
+/// The last check for `channel` saved at `path`, if any.
+pub fn load_check(path: &Path, channel: Channel) -> Option<LatestCheck> {
+    let content = fs::read_to_string(path).ok()?;
+    serde_json::from_str::<LatestCheck>(&content)
+        .ok()
+        .filter(|check| check.channel == channel)
+}
+
+pub fn save_check(path: &Path, check: &LatestCheck) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    fs::write(path, serde_json::to_string_pretty(check)?)
+        .with_context(|| format!("Failed to write {:?}", path))
+}
+
+/// Looks up and downloads km releases.
+pub struct Updater {
+    client: reqwest::Client,
+    url: String,
+    trusted_keys: TrustedKeys,
+}
+
+impl Updater {
+    /// With `trusted_keys`, only releases signed by one of them are installed.
+    pub fn new(url: String, trusted_keys: TrustedKeys) -> Self {
+        Self {
+            client: crate::http::client(),
+            url,
+            trusted_keys,
+        }
+    }
+
+    async fn fetch(&self, url: &str) -> Result<reqwest::Response> {
+        crate::offline::ensure_online("Checking for km updates")?;
+        let response = self
+            .client
+            .get(url)
+            .send()
+            .await
+            .with_context(|| format!("Failed to reach {}", url))?;
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "{} answered with status {}",
+                url,
+                response.status()
+            ));
+        }
+        Ok(response)
+    }
+
+    pub async fn releases(&self) -> Result<Vec<Release>> {
+        let feed = self
+            .fetch(&self.url)
+            .await?
+            .json::<Feed>()
+            .await
+            .with_context(|| format!("{} is not a km release list", self.url))?;
+        Ok(feed.into_releases())
+    }
+
+    /// The newest release `channel` offers
+    pub async fn latest(&self, channel: Channel) -> Result<Option<Release>> {
+        Ok(self
+            .releases()
+            .await?
+            .into_iter()
+            .filter(|release| channel == Channel::Beta || release.channel == Channel::Stable)
+            .max_by(|a, b| compare_versions(&a.version, &b.version)))
+    }
+
+    /// Fill in a missing checksum or signature from the release's
+    /// `<name>.sha256` and `<name>.sig` files. The signature is only fetched
+    /// when there are keys to check it against.
+    async fn complete(&self, release: &Release, asset: &Asset) -> Result<Asset> {
+        let mut asset = asset.clone();
+        if asset.sha256.is_none() {
+            if let Some(sums) = release.asset(&format!("{}.sha256", asset.name)) {
+                let text = self.fetch(&sums.url).await?.text().await?;
+                asset.sha256 = text.split_whitespace().next().map(String::from);
+            }
+        }
+        if asset.signature.is_none() && !self.trusted_keys.is_empty() {
+            if let Some(sig) = release.asset(&format!("{}.sig", asset.name)) {
+                asset.signature = Some(self.fetch(&sig.url).await?.text().await?);
+            }
+        }
+        Ok(asset)
+    }
+
+    /// Download `asset` and check it against its checksum and, when trusted
+    /// keys are configured, its signature.
+    pub async fn download(&self, release: &Release, asset: &Asset) -> Result<Vec<u8>> {
+        let asset = self.complete(release, asset).await?;
+        let expected = asset.sha256.as_deref().ok_or_else(|| {
+            anyhow::anyhow!(
+                "km {} has no checksum for {}; refusing to install it",
+                release.version,
+                asset.name
+            )
+        })?;
+
+        let bytes = self.fetch(&asset.url).await?.bytes().await?.to_vec();
+        let actual = sha256_hex(&bytes);
+        if actual != expected.trim().to_lowercase() {
+            return Err(anyhow::anyhow!(
+                "Checksum mismatch for {}: expected {}, got {}",
+                asset.name,
+                expected,
+                actual
+            ));
+        }
+
+        if !self.trusted_keys.is_empty() {
+            let signed = asset
+                .signature
+                .as_deref()
+                .is_some_and(|signature| self.trusted_keys.verifies(&bytes, signature));
+            if !signed {
+                return Err(anyhow::anyhow!(
+                    "{} of km {} is not signed by a key in update_trusted_keys",
+                    asset.name,
+                    release.version
+                ));
+            }
+        }
+        Ok(bytes)
+    }
+}
+
+/// The km executable inside a downloaded release archive (`.tar.gz` or
+/// `.zip`); other files are taken to be the executable itself.
+pub fn extract_binary(asset_name: &str, archive: &[u8]) -> Result<Vec<u8>> {
+    if asset_name.ends_with(".tar.gz") {
+        let mut tar = tar::Archive::new(GzDecoder::new(archive));
+        for entry in tar.entries().context("Failed to read release archive")? {
+            let mut entry = entry.context("Failed to read release archive")?;
+            let path = entry.path()?.into_owned();
+            if path.file_name().is_some_and(|name| name == "km") {
+                let mut binary = Vec::new();
+                entry.read_to_end(&mut binary)?;
+                return Ok(binary);
+            }
+        }
+        Err(anyhow::anyhow!("No km executable in {}", asset_name))
+    } else if asset_name.ends_with(".zip") {
+        extract_zip_entry(archive, "km.exe")
+            .with_context(|| format!("Failed to read {}", asset_name))
+    } else {
+        Ok(archive.to_vec())
+    }
+}
+
+/// Read one file from a zip archive by walking its local file headers.
+/// Only stored and deflated entries with sizes in the header are handled,
+/// which covers the archives the release workflow builds.
+fn extract_zip_entry(archive: &[u8], wanted: &str) -> Result<Vec<u8>> {
+    const LOCAL_HEADER: [u8; 4] = [0x50, 0x4b, 0x03, 0x04];
+    let u16_at = |i: usize| -> Result<usize> {
+        archive
+            .get(i..i + 2)
+            .map(|b| u16::from_le_bytes([b[0], b[1]]) as usize)
+            .context("Truncated zip archive")
+    };
+    let u32_at = |i: usize| -> Result<usize> {
+        archive
+            .get(i..i + 4)
+            .map(|b| u32::from_le_bytes([b[0], b[1], b[2], b[3]]) as usize)
+            .context("Truncated zip archive")
+    };
+
+    let mut offset = 0;
+    while archive.get(offset..offset + 4) == Some(&LOCAL_HEADER[..]) {
+        let flags = u16_at(offset + 6)?;
+        let method = u16_at(offset + 8)?;
+        let compressed = u32_at(offset + 18)?;
+        let name_len = u16_at(offset + 26)?;
+        let extra_len = u16_at(offset + 28)?;
+        let name_start = offset + 30;
+        let data_start = name_start + name_len + extra_len;
+        if flags & 0x08 != 0 {
+            return Err(anyhow::anyhow!("Streamed zip entries are not supported"));
+        }
+        let name = archive
+            .get(name_start..name_start + name_len)
+            .map(String::from_utf8_lossy)
+            .context("Truncated zip archive")?;
+        let data = archive
+            .get(data_start..data_start + compressed)
+            .context("Truncated zip archive")?;
+
+        if name.rsplit('/').next() == Some(wanted) {
+            return match method {
+                0 => Ok(data.to_vec()),
+                8 => {
+                    let mut binary = Vec::new();
+                    DeflateDecoder::new(data)
+                        .read_to_end(&mut binary)
+                        .context("Failed to decompress zip entry")?;
+                    Ok(binary)
+                }
+                other => Err(anyhow::anyhow!(
+                    "Unsupported zip compression method {}",
+                    other
+                )),
+            };
+        }
+        offset = data_start + compressed;
+    }
+    Err(anyhow::anyhow!("No {} in the archive", wanted))
+}
+
+/// Swap `binary` in for the executable at `target`. The new file is written
+/// next to it and renamed into place, so an interrupted update leaves the
+/// old executable working. Windows can't replace a running executable, so
+/// there the old one is moved aside to `<name>.old` first.
+pub fn replace_executable(target: &Path, binary: &[u8]) -> Result<()> {
+    let dir = target
+        .parent()
+        .context("The km executable has no parent directory")?;
+    let file_name = target
+        .file_name()
+        .context("The km executable has no file name")?
+        .to_string_lossy();
+    let staging = dir.join(format!(".{}.new", file_name));
+
+    fs::write(&staging, binary)
+        .with_context(|| format!("Failed to write {:?}; is the directory writable?", staging))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(&staging, fs::Permissions::from_mode(0o755))?;
+    }
+
+    #[cfg(windows)]
+    {
+        let old = dir.join(format!("{}.old", file_name));
+        let _ = fs::remove_file(&old);
+        fs::rename(target, &old).context("Failed to move the running km aside")?;
+        if let Err(e) = fs::rename(&staging, target) {
+            let _ = fs::rename(&old, target);
+            return Err(e).context("Failed to install the new km");
+        }
+        return Ok(());
+    }
+
+    #[cfg(not(windows))]
+    {
+        if let Err(e) = fs::rename(&staging, target) {
+            let _ = fs::remove_file(&staging);
+            return Err(e).context("Failed to install the new km");
+        }
+        Ok(())
+    }
+}
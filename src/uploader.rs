@@ -0,0 +1,909 @@
+use anyhow::{Context, Result};
+use chrono::{DateTime, Utc};
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use reqwest::header::{CONTENT_ENCODING, CONTENT_TYPE};
+use reqwest::StatusCode;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{BTreeMap, VecDeque};
+use std::io::Write;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::sync::{mpsc, watch, Notify};
+use tokio::task::JoinSet;
+
+use crate::breaker::{self, Attempt, CircuitBreaker, RetryConfig};
+use crate::capabilities::Capabilities;
+use crate::correlation::MessageCounts;
+use crate::costs::CostTracker;
+use crate::errors::{Code, KmError};
+use crate::handshake::Handshake;
+use crate::idempotency::{self, SentBatches, IDEMPOTENCY_KEY_HEADER};
+use crate::journal::Journal;
+use crate::latency::{ApiLatency, LatencyStats};
+use crate::plugins::verify::sha256_hex;
+use crate::queue::QueueStats;
+use crate::rate_limit::{self, RateLimiter};
+use crate::redaction::Redactor;
+use crate::resources::ResourceUsage;
+use crate::schema;
+use crate::sinks::Sinks;
+use crate::spool::Spool;
+
+/// Bytes of the `{"events":[]}` wrapper around the events in a body
+const BATCH_ENVELOPE_BYTES: usize = 13;
+/// Bytes of the largest `,"sequence":N` added to the metadata by `spawn`
+const SEQUENCE_BYTES: usize = 32;
+/// Bodies smaller than this aren't worth compressing
+const MIN_COMPRESS_BYTES: usize = 1024;
+/// Tells the API which event batch format the body uses
+pub const EVENT_VERSION_HEADER: &str = "km-event-version";
+
+/// A single captured MCP message as uploaded to the API.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct McpEvent {
+    pub id: String,
+    pub session_id: String,
+    pub timestamp: DateTime<Utc>,
+    /// Milliseconds since the session's first message on the monotonic
+    /// clock, which doesn't jump when the system clock is set
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub elapsed_ms: Option<f64>,
+    pub direction: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub method: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rpc_id: Option<Value>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub duration_ms: Option<f64>,
+    /// How the call a response answers ended, `success` or `error`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub status: Option<String>,
+    /// The JSON-RPC error code, when `status` is `error`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error_code: Option<i64>,
+    pub payload_size: usize,
+    /// Parsed message, or the raw line if it wasn't JSON. `None` when the
+    /// payload was over the configured size limit or stored as a blob.
+    pub payload: Option<Value>,
+    /// SHA-256 of the whole message, when `payload` doesn't hold all of it
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload_sha256: Option<String>,
+    /// `payload` is only the start of the message, as a string
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub payload_truncated: bool,
+    /// Where the whole message was stored instead (`payloads.blob_*` settings)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload_uri: Option<String>,
+    /// Annotations added by plugins
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub metadata: BTreeMap<String, Value>,
+    /// Labels of the session (`km monitor --label`)
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub labels: BTreeMap<String, String>,
+}
+
+impl McpEvent {
+    pub fn new(
+        session_id: &str,
+        direction: &str,
+        content: &str,
+        method: Option<String>,
+        duration_ms: Option<f64>,
+        payload_size_limit: Option<usize>,
+    ) -> Self {
+        let parsed = serde_json::from_str::<Value>(content).ok();
+        let rpc_id = parsed.as_ref().and_then(|v| v.get("id").cloned());
+        let oversized = payload_size_limit.is_some_and(|limit| content.len() > limit);
+
+        let (payload, payload_sha256) = if oversized {
+            (None, Some(sha256_hex(content.as_bytes())))
+        } else {
+            (
+                Some(parsed.unwrap_or_else(|| Value::String(content.to_string()))),
+                None,
+            )
+        };
+
+        Self {
+            id: uuid::Uuid::new_v4().to_string(),
+            session_id: session_id.to_string(),
+            timestamp: Utc::now(),
+            elapsed_ms: None,
+            direction: direction.to_string(),
+            method,
+            rpc_id,
+            duration_ms,
+            status: None,
+            error_code: None,
+            payload_size: content.len(),
+            payload,
+            payload_sha256,
+            payload_truncated: false,
+            payload_uri: None,
+            metadata: BTreeMap::new(),
+            labels: BTreeMap::new(),
+        }
+    }
+}
+
+/// What a `km monitor` session did, uploaded as its last event.
+#[derive(Debug, Clone, Serialize)]
+pub struct SessionEnd {
+    pub started_at: DateTime<Utc>,
+    pub ended_at: DateTime<Utc>,
+    /// Messages from the client and from the server
+    pub requests: u64,
+    pub responses: u64,
+    /// Messages by what they are: client requests, server notifications...
+    pub messages: MessageCounts,
+    /// Average and peak CPU and memory use of the MCP server
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub resources: Option<ResourceUsage>,
+    /// Client, server, protocol version and capabilities from the
+    /// initialize exchange
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub handshake: Option<Handshake>,
+}
+
+impl McpEvent {
+    /// The `session_end` event closing a session, with the summary as its payload.
+    pub fn session_end(session_id: &str, summary: &SessionEnd) -> Self {
+        let content = serde_json::to_string(summary).unwrap_or_default();
+        Self::new(session_id, "session_end", &content, None, None, None)
+    }
+}
+
+/// Where and how often events are uploaded. Watched by the uploader so
+/// config changes take effect on the next batch.
+#[derive(Debug, Clone, PartialEq)]
+pub struct BatchSettings {
+    pub endpoint: String,
+    pub batch_size: usize,
+    pub batch_timeout: Duration,
+    /// Largest request body before compression; bigger batches are split
+    pub max_batch_bytes: usize,
+    /// Gzip request bodies
+    pub compress: bool,
+    /// Batches uploaded at once by `spawn`
+    pub concurrency: usize,
+}
+
+/// What the uploader did with the events it was given.
+#[derive(Debug, Default)]
+pub struct UploadStats {
+    uploaded: AtomicU64,
+    spooled: AtomicU64,
+    dropped: AtomicU64,
+}
+
+impl UploadStats {
+    /// Events the API accepted
+    pub fn uploaded(&self) -> u64 {
+        self.uploaded.load(Ordering::Relaxed)
+    }
+
+    /// Events written to the spool after an upload failed
+    pub fn spooled(&self) -> u64 {
+        self.spooled.load(Ordering::Relaxed)
+    }
+
+    /// Events that could neither be uploaded nor spooled
+    pub fn dropped(&self) -> u64 {
+        self.dropped.load(Ordering::Relaxed)
+    }
+}
+
+/// What became of a session's events by the time km exited.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct DrainReport {
+    pub uploaded: u64,
+    /// Spooled by the uploader, or at shutdown when uploads ran out of time
+    pub spooled: u64,
+    /// Dropped by a full queue or a failed spool, or still unsent at the
+    /// deadline with nowhere to keep them
+    pub dropped: u64,
+}
+
+impl DrainReport {
+    /// Account for every event `queue` took or dropped: what `uploads`
+    /// did with them, plus `spooled_at_shutdown` events moved to the spool
+    /// at the deadline. Anything else was lost.
+    pub fn new(queue: &QueueStats, uploads: &UploadStats, spooled_at_shutdown: u64) -> Self {
+        let uploaded = uploads.uploaded();
+        let spooled = uploads.spooled() + spooled_at_shutdown;
+        let unaccounted = queue
+            .sent()
+            .saturating_sub(uploaded + spooled + uploads.dropped());
+        Self {
+            uploaded,
+            spooled,
+            dropped: queue.dropped() + uploads.dropped() + unaccounted,
+        }
+    }
+
+    /// Events that reached the API or are on disk waiting for it
+    pub fn persisted(&self) -> u64 {
+        self.uploaded + self.spooled
+    }
+}
+
+/// Sends captured MCP events to the API in batches. Batches that can't be
+/// delivered are spooled to disk when a spool is configured.
+#[derive(Debug, Clone)]
+pub struct EventUploader {
+    client: reqwest::Client,
+    /// Latest access token; updated when the session is refreshed
+    bearer_token: watch::Receiver<String>,
+    redactor: Option<Arc<Redactor>>,
+    spool: Option<Spool>,
+    /// Set once the API answers a gzip body with 415; later bodies go uncompressed
+    gzip_rejected: Arc<AtomicBool>,
+    /// Event batch format agreed with the API
+    event_version: u32,
+    /// Signalled to send the partial batch without waiting for its timeout
+    flush: Option<Arc<Notify>>,
+    /// Sent with each batch as `metadata.latency`
+    latency: Option<Arc<LatencyStats>>,
+    /// Sent with each batch as `metadata.costs`
+    costs: Option<Arc<CostTracker>>,
+    /// Sent with each batch as `metadata.run_id`
+    run_id: Option<String>,
+    /// How long the API takes to answer each request
+    api_latency: Option<Arc<ApiLatency>>,
+    /// Told which events were delivered or spooled
+    journal: Option<Arc<Journal>>,
+    stats: Arc<UploadStats>,
+    /// Paces requests and holds them back for `Retry-After`
+    limiter: Arc<RateLimiter>,
+    /// How batches the API answers with 429 or 503 are retried
+    retry: RetryConfig,
+    /// Spools batches without trying the API while it keeps failing
+    breaker: Option<Arc<CircuitBreaker>>,
+    /// Batches the API already acknowledged; these aren't sent again
+    sent: Option<Arc<SentBatches>>,
+    /// Also sent every batch, e.g. a data lake
+    sinks: Sinks,
+}
+
+impl EventUploader {
+    pub fn new(bearer_token: String) -> Self {
+        Self {
+            client: crate::http::client(),
+            bearer_token: watch::channel(bearer_token).1,
+            redactor: None,
+            spool: None,
+            gzip_rejected: Arc::new(AtomicBool::new(false)),
+            event_version: Capabilities::default().event_version,
+            flush: None,
+            latency: None,
+            costs: None,
+            run_id: None,
+            api_latency: None,
+            journal: None,
+            stats: Arc::default(),
+            limiter: Arc::default(),
+            retry: RetryConfig::default(),
+            breaker: None,
+            sent: None,
+            sinks: Sinks::default(),
+        }
+    }
+
+    /// Counts of uploaded, spooled and dropped events, shared with clones.
+    pub fn stats(&self) -> Arc<UploadStats> {
+        self.stats.clone()
+    }
+
+    pub fn with_redactor(mut self, redactor: Arc<Redactor>) -> Self {
+        self.redactor = Some(redactor);
+        self
+    }
+
+    pub fn with_spool(mut self, spool: Spool) -> Self {
+        self.spool = Some(spool);
+        self
+    }
+
+    /// Send the current partial batch whenever `flush` is notified.
+    pub fn with_flush_signal(mut self, flush: Arc<Notify>) -> Self {
+        self.flush = Some(flush);
+        self
+    }
+
+    /// Send the session's response latency by method with each batch.
+    pub fn with_latency(mut self, latency: Arc<LatencyStats>) -> Self {
+        self.latency = Some(latency);
+        self
+    }
+
+    /// Send the session's sampling tokens and cost by model with each batch.
+    pub fn with_costs(mut self, costs: Arc<CostTracker>) -> Self {
+        self.costs = Some(costs);
+        self
+    }
+
+    /// Send the `--run-id` the session belongs to with each batch, so the
+    /// API can put sessions from several machines together.
+    pub fn with_run_id(mut self, run_id: &str) -> Self {
+        self.run_id = Some(run_id.to_string());
+        self
+    }
+
+    /// Record how long the API takes to answer in `api_latency`, shared
+    /// with the spool uploader.
+    pub fn with_api_latency(mut self, api_latency: Arc<ApiLatency>) -> Self {
+        self.api_latency = Some(api_latency);
+        self
+    }
+
+    /// Acknowledge events in `journal` once they're delivered or spooled.
+    pub fn with_journal(mut self, journal: Arc<Journal>) -> Self {
+        self.journal = Some(journal);
+        self
+    }
+
+    /// Authenticate with whatever token was last sent on `tokens`.
+    pub fn with_token_updates(mut self, tokens: watch::Receiver<String>) -> Self {
+        self.bearer_token = tokens;
+        self
+    }
+
+    /// Pace requests with `limiter`, shared with the spool uploader so both
+    /// stay within the API's rate limit together.
+    pub fn with_rate_limiter(mut self, limiter: Arc<RateLimiter>) -> Self {
+        self.limiter = limiter;
+        self
+    }
+
+    /// Retry throttled batches as `retry` says.
+    pub fn with_retry(mut self, retry: RetryConfig) -> Self {
+        self.retry = retry;
+        self
+    }
+
+    /// Report each upload to `breaker`, shared with the spool uploader, and
+    /// spool batches without sending them while it's open.
+    pub fn with_breaker(mut self, breaker: Arc<CircuitBreaker>) -> Self {
+        self.breaker = Some(breaker);
+        self
+    }
+
+    /// Send every batch to `sinks` as well as the API.
+    pub fn with_sinks(mut self, sinks: Sinks) -> Self {
+        self.sinks = sinks;
+        self
+    }
+
+    /// Skip batches recorded in `sent`, and record the ones delivered.
+    pub fn with_sent_batches(mut self, sent: Arc<SentBatches>) -> Self {
+        self.sent = Some(sent);
+        self
+    }
+
+    /// Send the event format negotiated with the API, and skip gzip when the
+    /// API doesn't accept it.
+    pub fn with_capabilities(mut self, capabilities: &Capabilities) -> Self {
+        self.event_version = capabilities.event_version;
+        if !capabilities.gzip_uploads {
+            self.gzip_rejected.store(true, Ordering::Relaxed);
+        }
+        self
+    }
+
+    /// Split `events` into request bodies of at most `max_bytes` each. An
+    /// event that is too big on its own is sent without its payload.
+    pub fn batch_payloads(&self, events: &[McpEvent], max_bytes: usize) -> Vec<Value> {
+        let mut metadata = serde_json::json!({ "client": schema::client_metadata() });
+        if let Some(latency) = self
+            .latency
+            .as_ref()
+            .map(|latency| latency.snapshot())
+            .filter(|latency| !latency.is_empty())
+        {
+            metadata["latency"] = serde_json::json!(latency);
+        }
+        if let Some(costs) = self
+            .costs
+            .as_ref()
+            .map(|costs| costs.snapshot())
+            .filter(|costs| !costs.is_empty())
+        {
+            metadata["costs"] = serde_json::json!(costs);
+        }
+        if let Some(ref run_id) = self.run_id {
+            metadata["run_id"] = serde_json::json!(run_id);
+        }
+        // `,"metadata":` and the metadata itself ride along in every body
+        let envelope_bytes =
+            BATCH_ENVELOPE_BYTES + 12 + metadata.to_string().len() + SEQUENCE_BYTES;
+        let body =
+            |events: Vec<Value>| serde_json::json!({ "events": events, "metadata": metadata });
+
+        let mut payloads = Vec::new();
+        let mut chunk = Vec::new();
+        let mut chunk_bytes = envelope_bytes;
+
+        for event in events {
+            let mut value = serde_json::to_value(event).unwrap_or(Value::Null);
+            if let Some(ref redactor) = self.redactor {
+                redactor.redact_value(&mut value);
+            }
+            let mut bytes = value.to_string().len();
+            if envelope_bytes + bytes > max_bytes && value["payload"] != Value::Null {
+                tracing::warn!(
+                    event_id = %event.id,
+                    "Event {} is {} bytes, over max_batch_bytes; uploading it without its payload",
+                    event.id,
+                    bytes
+                );
+                value["payload"] = Value::Null;
+                bytes = value.to_string().len();
+            }
+
+            // One byte for the comma between events
+            let separator = usize::from(!chunk.is_empty());
+            if !chunk.is_empty() && chunk_bytes + separator + bytes > max_bytes {
+                payloads.push(body(std::mem::take(&mut chunk)));
+                chunk_bytes = envelope_bytes;
+            }
+            chunk_bytes += usize::from(!chunk.is_empty()) + bytes;
+            chunk.push(value);
+        }
+        if !chunk.is_empty() {
+            payloads.push(body(chunk));
+        }
+        payloads
+    }
+
+    async fn post(
+        &self,
+        endpoint: &str,
+        payload: &Value,
+        batch_id: &str,
+        compress: bool,
+        mut attempt: Option<Attempt<'_>>,
+    ) -> Result<()> {
+        let body = schema::encode_batch(self.event_version, payload)?;
+        let mut gzip = compress
+            && body.len() >= MIN_COMPRESS_BYTES
+            && !self.gzip_rejected.load(Ordering::Relaxed);
+
+        let mut retries = 0;
+        loop {
+            self.limiter.acquire().await;
+            let token = self.bearer_token.borrow().clone();
+            let request = self
+                .client
+                .post(endpoint)
+                .bearer_auth(token)
+                .header(CONTENT_TYPE, schema::content_type(self.event_version))
+                .header(EVENT_VERSION_HEADER, self.event_version)
+                .header(IDEMPOTENCY_KEY_HEADER, batch_id);
+            let request = if gzip {
+                request
+                    .header(CONTENT_ENCODING, "gzip")
+                    .body(gzip_body(&body)?)
+            } else {
+                request.body(body.clone())
+            };
+            let sent_at = Instant::now();
+            let response = match request.send().await {
+                Ok(response) => {
+                    if let Some(ref api_latency) = self.api_latency {
+                        api_latency.record(sent_at.elapsed().as_secs_f64() * 1000.0);
+                    }
+                    response
+                }
+                Err(e) => {
+                    if let Some(attempt) = attempt.take() {
+                        attempt.failed();
+                    }
+                    return Err(e).context("Failed to send event batch");
+                }
+            };
+
+            if gzip && response.status() == StatusCode::UNSUPPORTED_MEDIA_TYPE {
+                tracing::warn!("The API does not accept gzip uploads; sending uncompressed");
+                self.gzip_rejected.store(true, Ordering::Relaxed);
+                gzip = false;
+                continue;
+            }
+            if rate_limit::is_throttled(response.status()) {
+                let wait = rate_limit::retry_after(response.headers(), Utc::now())
+                    .unwrap_or_else(|| self.retry.backoff().delay(retries));
+                self.limiter.pause(wait.min(rate_limit::MAX_RETRY_WAIT));
+                if retries < self.retry.retries && wait <= rate_limit::MAX_RETRY_WAIT {
+                    tracing::debug!(
+                        "API answered {}; retrying the batch in {:?}",
+                        response.status(),
+                        wait
+                    );
+                    retries += 1;
+                    continue;
+                }
+            }
+            if let Some(attempt) = attempt.take() {
+                // Refusals mean the API is up; only outages count against it
+                if breaker::is_outage(response.status()) {
+                    attempt.failed();
+                } else {
+                    attempt.succeeded();
+                }
+            }
+            if !response.status().is_success() {
+                let status = response.status();
+                return Err(KmError::new(
+                    Code::for_status(status),
+                    format!("Event batch upload failed with status {}", status),
+                )
+                .into());
+            }
+            return Ok(());
+        }
+    }
+
+    /// Upload one batch, split to fit `settings.max_batch_bytes`. Parts that
+    /// can't be delivered are spooled.
+    pub async fn send_batch(&self, settings: &BatchSettings, events: &[McpEvent]) -> Result<()> {
+        if events.is_empty() {
+            return Ok(());
+        }
+        let payloads = self.batch_payloads(events, settings.max_batch_bytes);
+        self.send_payloads(settings, payloads).await
+    }
+
+    /// Upload the parts of one batch in order, spooling the ones that can't
+    /// be delivered. Once a part is spooled, the parts after it follow it
+    /// into the spool instead of overtaking it.
+    async fn send_payloads(&self, settings: &BatchSettings, payloads: Vec<Value>) -> Result<()> {
+        if payloads.len() > 1 {
+            tracing::debug!("Splitting a batch into {} uploads", payloads.len());
+        }
+        let mut held_back = false;
+        let mut result = Ok(());
+        for payload in payloads {
+            let delivery = self.deliver(settings, &payload, held_back).await;
+            if let Err(e) = self.settle(settings, &payload, delivery, &mut held_back) {
+                result = Err(e);
+            }
+        }
+        result
+    }
+
+    /// Send one upload body to the sinks and the API. With `held_back` an
+    /// earlier body of its session was spooled, so this one isn't posted.
+    async fn deliver(
+        &self,
+        settings: &BatchSettings,
+        payload: &Value,
+        held_back: bool,
+    ) -> Delivery {
+        let batch_id = idempotency::batch_id(payload);
+        if self
+            .sent
+            .as_ref()
+            .is_some_and(|sent| sent.contains(&batch_id))
+        {
+            tracing::debug!("Batch {} was already delivered; not resending", batch_id);
+            return Delivery::AlreadySent;
+        }
+        if !self.sinks.is_empty() {
+            self.sinks.send(payload).await;
+        }
+        let attempt = if held_back {
+            Err(anyhow::anyhow!(
+                "An earlier batch of this session is spooled"
+            ))
+        } else {
+            match self.breaker {
+                Some(ref breaker) => match breaker.try_acquire() {
+                    Some(attempt) => Ok(Some(attempt)),
+                    None => Err(anyhow::anyhow!(
+                        "Uploads are paused after repeated API failures"
+                    )),
+                },
+                None => Ok(None),
+            }
+        };
+        let outcome = match attempt {
+            Ok(attempt) => {
+                self.post(
+                    &settings.endpoint,
+                    payload,
+                    &batch_id,
+                    settings.compress,
+                    attempt,
+                )
+                .await
+            }
+            Err(e) => Err(e),
+        };
+        match outcome {
+            Ok(()) => Delivery::Delivered,
+            Err(e) => Delivery::Failed(e),
+        }
+    }
+
+    /// Account for one upload body once its turn comes: count it, remember
+    /// it was delivered or spool it, and acknowledge its events in the
+    /// journal. Spooling sets `held_back`, so the rest of the session
+    /// follows it into the spool. Fails when the events had to be dropped.
+    fn settle(
+        &self,
+        settings: &BatchSettings,
+        payload: &Value,
+        delivery: Delivery,
+        held_back: &mut bool,
+    ) -> Result<()> {
+        let count = payload["events"].as_array().map_or(0, |e| e.len());
+        match delivery {
+            Delivery::AlreadySent => {
+                self.stats
+                    .uploaded
+                    .fetch_add(count as u64, Ordering::Relaxed);
+            }
+            Delivery::Delivered => {
+                tracing::debug!("Uploaded batch of {} events", count);
+                self.stats
+                    .uploaded
+                    .fetch_add(count as u64, Ordering::Relaxed);
+                if let Some(ref sent) = self.sent {
+                    if let Err(e) = sent.record(&idempotency::batch_id(payload)) {
+                        tracing::debug!("{:#}", e);
+                    }
+                }
+            }
+            Delivery::Failed(e) => match self.spool {
+                Some(ref spool) => {
+                    tracing::warn!("{} - spooling {} events", e, count);
+                    if let Err(e) = spool.enqueue(&settings.endpoint, payload) {
+                        self.stats
+                            .dropped
+                            .fetch_add(count as u64, Ordering::Relaxed);
+                        return Err(e);
+                    }
+                    self.stats
+                        .spooled
+                        .fetch_add(count as u64, Ordering::Relaxed);
+                    *held_back = true;
+                }
+                None => {
+                    tracing::warn!("Dropping {} events: {}", count, e);
+                    self.stats
+                        .dropped
+                        .fetch_add(count as u64, Ordering::Relaxed);
+                    return Err(e);
+                }
+            },
+        }
+        if let Some(ref journal) = self.journal {
+            journal.ack(event_ids(payload));
+        }
+        Ok(())
+    }
+
+    /// Batch events from `rx` until the sender side is dropped, then flush
+    /// whatever is left. Up to `concurrency` batches are uploaded in the
+    /// background while the next one fills, so a slow API only holds
+    /// capture back once every upload slot is taken. A session's uploads
+    /// start in the order they were batched, and are settled - counted,
+    /// spooled or acknowledged in the journal - in that order too, however
+    /// they finish; once one is spooled, the session's uploads that haven't
+    /// started yet follow it into the spool. Each upload carries
+    /// `metadata.sequence`, the order it was batched in, for the API to put
+    /// the ones that finished out of order back in line.
+    pub fn spawn(
+        self,
+        settings: watch::Receiver<BatchSettings>,
+        mut rx: mpsc::Receiver<McpEvent>,
+    ) -> tokio::task::JoinHandle<()> {
+        tokio::spawn(async move {
+            let mut batch: Vec<McpEvent> = Vec::new();
+            // A partial batch is sent once its oldest event has waited batch_timeout
+            let mut deadline = None;
+            let mut lanes = Lanes::default();
+            let mut sequence: u64 = 0;
+            loop {
+                let settings = settings.borrow().clone();
+                let recv = async {
+                    match deadline {
+                        Some(deadline) => tokio::time::timeout_at(deadline, rx.recv()).await.ok(),
+                        None => Some(rx.recv().await),
+                    }
+                };
+                let flush_requested = async {
+                    match self.flush {
+                        Some(ref flush) => flush.notified().await,
+                        None => std::future::pending().await,
+                    }
+                };
+                // None when the batch is due: timed out or flushed on request
+                let next = tokio::select! {
+                    next = recv => next,
+                    _ = flush_requested => None,
+                };
+                let closed = match next {
+                    Some(Some(event)) => {
+                        if batch.is_empty() {
+                            deadline = Some(tokio::time::Instant::now() + settings.batch_timeout);
+                        }
+                        batch.push(event);
+                        if batch.len() < settings.batch_size {
+                            continue;
+                        }
+                        false
+                    }
+                    Some(None) => true,
+                    None => false,
+                };
+
+                if !batch.is_empty() {
+                    while lanes.outstanding() >= settings.concurrency.max(1) {
+                        lanes.settle_one(&self, &settings).await;
+                        lanes.dispatch(&self, &settings);
+                    }
+                    let mut sessions: Vec<(String, Vec<McpEvent>)> = Vec::new();
+                    for event in batch.drain(..) {
+                        match sessions.iter_mut().find(|(id, _)| *id == event.session_id) {
+                            Some((_, events)) => events.push(event),
+                            None => sessions.push((event.session_id.clone(), vec![event])),
+                        }
+                    }
+                    for (session, events) in sessions {
+                        let mut payloads = self.batch_payloads(&events, settings.max_batch_bytes);
+                        for payload in &mut payloads {
+                            sequence += 1;
+                            payload["metadata"]["sequence"] = sequence.into();
+                        }
+                        lanes.push(session, payloads);
+                    }
+                    lanes.dispatch(&self, &settings);
+                }
+                deadline = None;
+
+                if closed {
+                    while lanes.outstanding() > 0 {
+                        lanes.settle_one(&self, &settings).await;
+                        lanes.dispatch(&self, &settings);
+                    }
+                    break;
+                }
+            }
+        })
+    }
+}
+
+fn event_ids(payload: &Value) -> Vec<String> {
+    payload["events"]
+        .as_array()
+        .map(|events| {
+            events
+                .iter()
+                .filter_map(|e| e["id"].as_str().map(str::to_string))
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+fn gzip_body(body: &[u8]) -> Result<Vec<u8>> {
+    let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+    encoder
+        .write_all(body)
+        .context("Failed to compress event batch")?;
+    encoder.finish().context("Failed to compress event batch")
+}
+
+/// What became of one upload body.
+enum Delivery {
+    /// The API acknowledged it on an earlier run
+    AlreadySent,
+    Delivered,
+    Failed(anyhow::Error),
+}
+
+/// Upload bodies of one session, in sequence order.
+#[derive(Default)]
+struct Lane {
+    waiting: VecDeque<Value>,
+    /// Bodies started and not yet settled, oldest first, with their
+    /// delivery once the upload finished
+    started: VecDeque<(u64, Option<(Value, Delivery)>)>,
+    /// A body was spooled; the ones started after it follow
+    held_back: bool,
+}
+
+impl Lane {
+    /// Settle finished uploads from the oldest on, up to the first one
+    /// still in flight.
+    fn settle_finished(&mut self, uploader: &EventUploader, settings: &BatchSettings) {
+        while self.started.front().is_some_and(|(_, done)| done.is_some()) {
+            let Some((_, Some((payload, delivery)))) = self.started.pop_front() else {
+                break;
+            };
+            // Failures are logged as they're settled
+            let _ = uploader.settle(settings, &payload, delivery, &mut self.held_back);
+        }
+    }
+}
+
+/// Upload bodies waiting or in flight, per session. A session has at most
+/// `concurrency` bodies started past its oldest unsettled one, so a slow
+/// upload holds back only its own session, and only so far.
+#[derive(Default)]
+struct Lanes {
+    lanes: BTreeMap<String, Lane>,
+    uploads: JoinSet<(String, u64, Value, Delivery)>,
+}
+
+impl Lanes {
+    fn push(&mut self, session: String, payloads: Vec<Value>) {
+        self.lanes
+            .entry(session)
+            .or_default()
+            .waiting
+            .extend(payloads);
+    }
+
+    /// Bodies waiting, in flight or finished but not yet settled
+    fn outstanding(&self) -> usize {
+        self.lanes
+            .values()
+            .map(|lane| lane.waiting.len() + lane.started.len())
+            .sum()
+    }
+
+    /// Start waiting bodies, oldest first per session, while upload slots
+    /// are free.
+    fn dispatch(&mut self, uploader: &EventUploader, settings: &BatchSettings) {
+        let limit = settings.concurrency.max(1);
+        for (session, lane) in self.lanes.iter_mut() {
+            while self.uploads.len() < limit && lane.started.len() < limit {
+                let Some(payload) = lane.waiting.pop_front() else {
+                    break;
+                };
+                let sequence = payload["metadata"]["sequence"].as_u64().unwrap_or(0);
+                lane.started.push_back((sequence, None));
+                let held_back = lane.held_back;
+                let (uploader, settings, session) =
+                    (uploader.clone(), settings.clone(), session.clone());
+                self.uploads.spawn(async move {
+                    let delivery = uploader.deliver(&settings, &payload, held_back).await;
+                    (session, sequence, payload, delivery)
+                });
+            }
+        }
+        // A held-back session stays, so its later bodies go to the spool too
+        self.lanes.retain(|_, lane| {
+            lane.held_back || !lane.waiting.is_empty() || !lane.started.is_empty()
+        });
+    }
+
+    /// Wait for one upload to finish, then settle whatever its session can.
+    async fn settle_one(&mut self, uploader: &EventUploader, settings: &BatchSettings) {
+        match self.uploads.join_next().await {
+            Some(Ok((session, sequence, payload, delivery))) => {
+                let Some(lane) = self.lanes.get_mut(&session) else {
+                    return;
+                };
+                if let Some((_, done)) = lane.started.iter_mut().find(|(s, _)| *s == sequence) {
+                    *done = Some((payload, delivery));
+                }
+                lane.settle_finished(uploader, settings);
+            }
+            // A panicked upload can't say whose it was; once nothing is in
+            // flight, give up on the bodies that never finished
+            Some(Err(e)) if self.uploads.is_empty() => {
+                tracing::warn!("An event upload failed: {}", e);
+                for lane in self.lanes.values_mut() {
+                    lane.started.retain(|(_, done)| done.is_some());
+                    lane.settle_finished(uploader, settings);
+                }
+            }
+            Some(Err(e)) => tracing::warn!("An event upload failed: {}", e),
+            None => {}
+        }
+    }
+}
@@ -0,0 +1,333 @@
+use km::alerts::{self, Alert, AlertRuleConfig, Alerter, AlertsConfig};
+use km::config::Config;
+use km::risk::{PatternRiskAnalyzer, RiskLevel};
+use km::traffic::TrafficEntry;
+use serde_json::Value;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+const DANGEROUS: &str = r#"{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"shell","arguments":{"cmd":"rm -rf /"}}}"#;
+const HARMLESS: &str = r#"{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"echo","arguments":{"text":"hi"}}}"#;
+
+fn rule(name: &str, when: &str) -> AlertRuleConfig {
+    AlertRuleConfig {
+        name: name.to_string(),
+        when: when.to_string(),
+        webhook: Some("http://127.0.0.1:9/alerts".to_string()),
+        slack: None,
+        command: Vec::new(),
+        max_per_minute: None,
+        dedup_seconds: None,
+    }
+}
+
+fn alerter(rules: Vec<AlertRuleConfig>) -> Alerter {
+    Alerter::from_config(&AlertsConfig { rules }).unwrap()
+}
+
+/// A captured request with its risk stored as `km monitor` stores it
+fn captured(content: &str) -> TrafficEntry {
+    let mut entry = TrafficEntry {
+        timestamp: chrono::Utc::now(),
+        direction: "request".to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("session-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    };
+    let assessment = PatternRiskAnalyzer::new().analyze(Some("tools/call"), content);
+    if assessment.score > 0.0 {
+        entry.metadata.insert(
+            "risk".to_string(),
+            serde_json::to_value(&assessment).unwrap(),
+        );
+    }
+    entry
+}
+
+fn with_id(id: u64) -> String {
+    DANGEROUS.replace(r#""id":1"#, &format!(r#""id":{}"#, id))
+}
+
+#[test]
+fn test_rules_match_on_the_stored_risk() {
+    let alerts = alerter(vec![rule("dangerous", "risk>=high AND method=tools/call")]);
+    let now = Instant::now();
+
+    let raised = alerts.evaluate(&captured(DANGEROUS), Some("tools/call"), now);
+    assert_eq!(raised.len(), 1);
+    let alert = &raised[0];
+    assert_eq!(alert.rule, "dangerous");
+    assert_eq!(alert.tool.as_deref(), Some("shell"));
+    assert!(alert.risk >= RiskLevel::High);
+    assert!(alert
+        .matched_patterns
+        .contains(&"destructive_shell".to_string()));
+    assert!(alert.summary().contains("tools/call request (shell)"));
+
+    assert!(alerts
+        .evaluate(&captured(HARMLESS), Some("tools/call"), now)
+        .is_empty());
+    assert!(alerts
+        .evaluate(&captured(DANGEROUS), Some("resources/read"), now)
+        .is_empty());
+}
+
+#[test]
+fn test_duplicates_are_suppressed_for_the_dedup_window() {
+    let alerts = alerter(vec![rule("dangerous", "risk>=high")]);
+    let now = Instant::now();
+
+    // Retrying the same call under a new id is the same alert
+    assert_eq!(
+        alerts
+            .evaluate(&captured(&with_id(1)), Some("tools/call"), now)
+            .len(),
+        1
+    );
+    assert!(alerts
+        .evaluate(&captured(&with_id(2)), Some("tools/call"), now)
+        .is_empty());
+
+    let other = DANGEROUS.replace("rm -rf /", "rm -rf /home");
+    assert_eq!(
+        alerts
+            .evaluate(&captured(&other), Some("tools/call"), now)
+            .len(),
+        1
+    );
+
+    let later = now + Duration::from_secs(alerts::DEFAULT_DEDUP_SECONDS + 1);
+    assert_eq!(
+        alerts
+            .evaluate(&captured(&with_id(3)), Some("tools/call"), later)
+            .len(),
+        1
+    );
+    assert_eq!(alerts.sent(), 3);
+    assert_eq!(alerts.suppressed(), 1);
+}
+
+#[test]
+fn test_alerts_are_rate_limited_per_rule() {
+    let mut limited = rule("limited", "method=tools/call");
+    limited.max_per_minute = Some(2);
+    limited.dedup_seconds = Some(0);
+    let alerts = alerter(vec![limited, rule("unlimited", "method=tools/call")]);
+    let now = Instant::now();
+
+    let fired = |at: Instant| -> Vec<String> {
+        alerts
+            .evaluate(&captured(HARMLESS), Some("tools/call"), at)
+            .into_iter()
+            .map(|a| a.rule)
+            .collect()
+    };
+    assert_eq!(fired(now), vec!["limited", "unlimited"]);
+    assert_eq!(fired(now), vec!["limited"]);
+    assert!(fired(now).is_empty());
+    assert_eq!(fired(now + Duration::from_secs(61)), vec!["limited"]);
+}
+
+#[test]
+fn test_invalid_rules_are_rejected() {
+    let mut no_action = rule("quiet", "risk>=high");
+    no_action.webhook = None;
+    assert!(Alerter::from_config(&AlertsConfig {
+        rules: vec![no_action]
+    })
+    .is_err());
+
+    let err = Alerter::from_config(&AlertsConfig {
+        rules: vec![rule("typo", "risky>=high")],
+    })
+    .unwrap_err();
+    assert!(format!("{:#}", err).contains("Unknown field"), "{:#}", err);
+
+    assert!(Alerter::from_config(&AlertsConfig {
+        rules: vec![rule("twice", "risk>=high"), rule("twice", "risk>=medium")],
+    })
+    .is_err());
+
+    let mut bad_url = rule("bad", "risk>=high");
+    bad_url.slack = Some("hooks.slack.com/services/x".to_string());
+    let config = Config {
+        api_key: "key".to_string(),
+        api_url: "https://api.kilometers.ai".to_string(),
+        alerts: AlertsConfig {
+            rules: vec![bad_url],
+        },
+        ..Default::default()
+    };
+    assert!(config.validate().iter().any(|p| p.starts_with("alerts:")));
+}
+
+/// An HTTP server that records each request body and answers 200.
+async fn recording_server() -> (String, Arc<Mutex<Vec<(String, Value)>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let seen = Arc::new(Mutex::new(Vec::new()));
+    let recorder = seen.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut data = Vec::new();
+            let mut buf = vec![0u8; 64 * 1024];
+            let body_start = loop {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break None;
+                }
+                data.extend_from_slice(&buf[..n]);
+                if let Some(pos) = data.windows(4).position(|w| w == b"\r\n\r\n") {
+                    break Some(pos + 4);
+                }
+            };
+            let Some(body_start) = body_start else {
+                continue;
+            };
+            let head = String::from_utf8_lossy(&data[..body_start]).to_ascii_lowercase();
+            let length: usize = head
+                .lines()
+                .find_map(|l| l.strip_prefix("content-length:"))
+                .and_then(|v| v.trim().parse().ok())
+                .unwrap_or(0);
+            while data.len() < body_start + length {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break;
+                }
+                data.extend_from_slice(&buf[..n]);
+            }
+            let path = head.split_whitespace().nth(1).unwrap_or("").to_string();
+            let body = serde_json::from_slice(&data[body_start..]).unwrap_or(Value::Null);
+            recorder.lock().unwrap().push((path, body));
+            let _ = socket
+                .write_all(b"HTTP/1.1 200 OK\r\ncontent-length: 0\r\nconnection: close\r\n\r\n")
+                .await;
+        }
+    });
+
+    (format!("http://{}", addr), seen)
+}
+
+fn dangerous_alert() -> Alert {
+    alerter(vec![rule("dangerous", "risk>=high")])
+        .evaluate(&captured(DANGEROUS), Some("tools/call"), Instant::now())
+        .remove(0)
+}
+
+#[tokio::test]
+async fn test_webhook_and_slack_actions() {
+    let (server, seen) = recording_server().await;
+    let mut config = rule("dangerous", "risk>=high");
+    config.webhook = Some(format!("{}/hook", server));
+    config.slack = Some(format!("{}/slack", server));
+
+    alerts::deliver(&config, &dangerous_alert()).await.unwrap();
+
+    let seen = seen.lock().unwrap();
+    assert_eq!(seen.len(), 2);
+    let (path, webhook) = &seen[0];
+    assert_eq!(path, "/hook");
+    assert_eq!(webhook["rule"], "dangerous");
+    assert_eq!(webhook["tool"], "shell");
+    assert_eq!(webhook["session_id"], "session-1");
+    assert_eq!(webhook["content"], DANGEROUS);
+    let (path, slack) = &seen[1];
+    assert_eq!(path, "/slack");
+    assert!(slack["text"]
+        .as_str()
+        .unwrap()
+        .starts_with("km alert 'dangerous'"));
+}
+
+#[tokio::test]
+async fn test_failed_actions_are_reported() {
+    let mut config = rule("dangerous", "risk>=high");
+    config.webhook = Some("http://127.0.0.1:9/unreachable".to_string());
+    assert!(alerts::deliver(&config, &dangerous_alert()).await.is_err());
+}
+
+#[cfg(unix)]
+#[tokio::test]
+async fn test_command_action_gets_the_alert_on_stdin() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let out = dir.path().join("alert.json");
+    let mut config = rule("dangerous", "risk>=high");
+    config.webhook = None;
+    config.command = vec![
+        "sh".to_string(),
+        "-c".to_string(),
+        format!("cat > '{}'", out.display()),
+    ];
+
+    alerts::deliver(&config, &dangerous_alert()).await.unwrap();
+    let alert: Value = serde_json::from_str(&std::fs::read_to_string(&out).unwrap()).unwrap();
+    assert_eq!(alert["rule"], "dangerous");
+    assert_eq!(alert["method"], "tools/call");
+
+    config.command = vec!["sh".to_string(), "-c".to_string(), "exit 3".to_string()];
+    assert!(alerts::deliver(&config, &dangerous_alert()).await.is_err());
+}
+
+#[cfg(unix)]
+#[test]
+fn test_monitor_runs_alert_commands() {
+    use std::io::Write;
+    use std::process::{Command, Stdio};
+
+    let dir = tempfile::TempDir::new().unwrap();
+    let out = dir.path().join("alerts.jsonl");
+    let mut config = rule("dangerous", "risk>=high AND method=tools/call");
+    config.webhook = None;
+    config.command = vec![
+        "sh".to_string(),
+        "-c".to_string(),
+        format!("cat >> '{}'; echo >> '{}'", out.display(), out.display()),
+    ];
+    Config {
+        api_key: "test-key".to_string(),
+        api_url: "http://127.0.0.1:9".to_string(),
+        alerts: AlertsConfig {
+            rules: vec![config],
+        },
+        ..Default::default()
+    }
+    .save(&dir.path().join("km_config.json"))
+    .unwrap();
+
+    let mut child = Command::new(env!("CARGO_BIN_EXE_km"))
+        .current_dir(dir.path())
+        .args(["monitor", "--local-only", "--no-plugins", "--log-file"])
+        .arg(dir.path().join("traffic.jsonl"))
+        .args(["--", env!("CARGO_BIN_EXE_mock_mcp_server")])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+        .unwrap();
+    {
+        let mut stdin = child.stdin.take().unwrap();
+        writeln!(stdin, "{}", with_id(1)).unwrap();
+        writeln!(stdin, "{}", with_id(2)).unwrap();
+        writeln!(stdin, "{}", HARMLESS).unwrap();
+    }
+    assert!(child.wait().unwrap().success());
+
+    let written = std::fs::read_to_string(&out).unwrap();
+    let alerts: Vec<Value> = written
+        .lines()
+        .filter(|l| !l.trim().is_empty())
+        .map(|l| serde_json::from_str(l).unwrap())
+        .collect();
+    assert_eq!(alerts.len(), 1, "the retry is a duplicate: {}", written);
+    assert_eq!(alerts[0]["tool"], "shell");
+    assert_eq!(alerts[0]["risk"], "high");
+}
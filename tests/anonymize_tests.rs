@@ -0,0 +1,164 @@
+use km::anonymize::Anonymizer;
+use km::cli::ExportOptions;
+use km::export::{self, ExportFilter};
+use km::handlers::handle_export;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+use std::fs;
+use tempfile::TempDir;
+
+fn anonymizer() -> Anonymizer {
+    Anonymizer::new(b"test-key")
+}
+
+#[test]
+fn test_same_value_maps_to_the_same_token() {
+    let a = anonymizer();
+    assert_eq!(a.anonymize_str("hello"), a.anonymize_str("hello"));
+    assert_ne!(a.anonymize_str("hello"), a.anonymize_str("world"));
+    assert!(a.anonymize_str("hello").starts_with("str-"));
+
+    // A different key gives unrelated tokens
+    assert_ne!(
+        a.anonymize_str("hello"),
+        Anonymizer::new(b"other-key").anonymize_str("hello")
+    );
+}
+
+#[test]
+fn test_values_keep_their_shape() {
+    let a = anonymizer();
+
+    let email = a.anonymize_str("alice@corp.example.com");
+    assert!(email.starts_with("user-") && email.ends_with("@example.com"));
+    assert!(!email.contains("alice"));
+
+    let host = a.anonymize_str("db.internal.corp.com");
+    assert!(host.starts_with("host-") && host.ends_with(".example"));
+    assert_eq!(host, a.anonymize_str("DB.internal.corp.com"));
+
+    // Files in the same directory still share their parent
+    let main = a.anonymize_str("/home/alice/project/src/main.rs");
+    let lib = a.anonymize_str("/home/alice/project/src/lib.rs");
+    assert!(main.starts_with('/') && main.ends_with(".rs"));
+    assert!(!main.contains("alice"));
+    assert_eq!(
+        main.rsplit_once('/').unwrap().0,
+        lib.rsplit_once('/').unwrap().0
+    );
+
+    let windows = a.anonymize_str(r"C:\Users\alice\notes.txt");
+    assert!(windows.starts_with(r"C:\p-") && windows.ends_with(".txt"));
+
+    let url = a.anonymize_str("https://api.corp.com:8443/v1/users?token=secret");
+    assert!(url.starts_with("https://host-"), "{}", url);
+    assert!(url.contains(".example:8443/p-"), "{}", url);
+    assert!(!url.contains("corp") && !url.contains("secret"), "{}", url);
+    assert_eq!(
+        a.anonymize_str("http://localhost:3000/health"),
+        format!("http://localhost:3000/{}", &a.anonymize_str("/health")[1..])
+    );
+}
+
+#[test]
+fn test_protocol_fields_are_kept() {
+    let a = anonymizer();
+    let mut message = json!({
+        "jsonrpc": "2.0",
+        "id": 7,
+        "method": "tools/call",
+        "params": {
+            "name": "read_file",
+            "arguments": {"path": "/etc/passwd", "limit": 10, "follow": true},
+        },
+    });
+    a.anonymize_value(&mut message);
+
+    assert_eq!(message["jsonrpc"], "2.0");
+    assert_eq!(message["id"], 7);
+    assert_eq!(message["method"], "tools/call");
+    assert_eq!(message["params"]["arguments"]["limit"], 10);
+    assert_eq!(message["params"]["arguments"]["follow"], true);
+    assert_ne!(message["params"]["name"], "read_file");
+    let path = message["params"]["arguments"]["path"].as_str().unwrap();
+    assert!(path.starts_with("/p-") && !path.contains("passwd"));
+
+    // Content that isn't JSON is a single literal
+    assert_eq!(a.anonymize_content("not json"), a.anonymize_str("not json"));
+}
+
+#[test]
+fn test_anonymize_records_links_sessions_and_payloads() {
+    let entry = |session: &str, content: Value| TrafficEntry {
+        timestamp: chrono::Utc::now(),
+        direction: "request".to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    };
+    let entries = vec![
+        entry(
+            "session-alice",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+                   "params": {"arguments": {"to": "bob@corp.com"}}}),
+        ),
+        entry(
+            "session-alice",
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call",
+                   "params": {"arguments": {"cc": "bob@corp.com"}}}),
+        ),
+    ];
+    let mut records = export::collect_records(&entries, &ExportFilter::default());
+    export::anonymize_records(&mut records, &anonymizer());
+
+    assert_eq!(records[0].session_id, records[1].session_id);
+    assert!(!records[0].session_id.as_ref().unwrap().contains("alice"));
+    assert_eq!(records[0].method.as_deref(), Some("tools/call"));
+    assert_eq!(records[1].rpc_id.as_deref(), Some("2"));
+    let first: Value = serde_json::from_str(&records[0].content).unwrap();
+    let second: Value = serde_json::from_str(&records[1].content).unwrap();
+    assert_eq!(
+        first["params"]["arguments"]["to"],
+        second["params"]["arguments"]["cc"]
+    );
+    assert!(!records[0].content.contains("corp.com"));
+}
+
+#[test]
+fn test_handle_export_anonymize() {
+    let temp_dir = TempDir::new().unwrap();
+    let log_file = temp_dir.path().join("traffic.jsonl");
+    fs::write(
+        &log_file,
+        r#"{"timestamp":"2025-01-01T10:00:00Z","direction":"request","content":"{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"resources/read\",\"params\":{\"uri\":\"file:///home/alice/secrets.txt\"}}","session_id":"session-a"}"#,
+    )
+    .unwrap();
+    let output = temp_dir.path().join("export.jsonl");
+
+    handle_export(
+        log_file,
+        output.clone(),
+        None,
+        ExportOptions {
+            anonymize: true,
+            ..Default::default()
+        },
+    )
+    .unwrap();
+
+    let contents = fs::read_to_string(&output).unwrap();
+    assert!(!contents.contains("alice"), "{}", contents);
+    assert!(!contents.contains("session-a\""), "{}", contents);
+    let record: Value = serde_json::from_str(contents.lines().next().unwrap()).unwrap();
+    assert_eq!(record["method"], "resources/read");
+    let content: Value = serde_json::from_str(record["content"].as_str().unwrap()).unwrap();
+    assert!(content["params"]["uri"]
+        .as_str()
+        .unwrap()
+        .starts_with("file:///p-"));
+}
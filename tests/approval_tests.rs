@@ -0,0 +1,228 @@
+use km::approval::{self, ApprovalDecision, ApprovalGate, APPROVAL_DENIED_CODE};
+use km::risk::PatternRiskAnalyzer;
+use serde_json::{json, Value};
+use std::io::{self, Read, Write};
+use std::sync::mpsc::{self, Receiver, Sender};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Duration;
+
+fn dangerous() -> Value {
+    json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+           "params": {"name": "shell", "arguments": {"cmd": "rm -rf /"}}})
+}
+
+fn harmless() -> Value {
+    json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call",
+           "params": {"name": "echo", "arguments": {"text": "hi"}}})
+}
+
+fn gate(timeout: Duration) -> ApprovalGate {
+    ApprovalGate::new("high-risk", timeout, Arc::new(PatternRiskAnalyzer::new())).unwrap()
+}
+
+/// Check `request` on another thread, returning the id it's held under.
+fn hold(
+    gate: &Arc<ApprovalGate>,
+    request: Value,
+) -> (u64, thread::JoinHandle<Option<approval::ApprovalOutcome>>) {
+    let checker = gate.clone();
+    let handle = thread::spawn(move || checker.check(&request, &request.to_string()));
+    for _ in 0..200 {
+        if let Some(pending) = gate.pending().first() {
+            return (pending.id, handle);
+        }
+        thread::sleep(Duration::from_millis(10));
+    }
+    panic!("request was not held");
+}
+
+#[test]
+fn test_only_matching_requests_are_held() {
+    assert_eq!(approval::confirm_query("high-risk"), "risk>=high");
+    assert_eq!(
+        approval::confirm_query("method=tools/call"),
+        "method=tools/call"
+    );
+    assert!(ApprovalGate::new(
+        "risky>=high",
+        Duration::from_secs(1),
+        Arc::new(PatternRiskAnalyzer::new())
+    )
+    .is_err());
+
+    let gate = gate(Duration::from_secs(30));
+    let request = harmless();
+    assert!(gate.check(&request, &request.to_string()).is_none());
+    assert!(gate.pending().is_empty());
+}
+
+#[test]
+fn test_unanswered_requests_time_out() {
+    let gate = gate(Duration::from_millis(100));
+    let request = dangerous();
+    let outcome = gate.check(&request, &request.to_string()).unwrap();
+    assert_eq!(outcome.decision, ApprovalDecision::TimedOut);
+    assert!(!outcome.approved());
+    assert!(outcome.by.is_none());
+    assert!(outcome.waited_ms >= 100);
+    assert!(gate.pending().is_empty());
+}
+
+#[test]
+fn test_requests_can_be_answered_over_ctl() {
+    let gate = Arc::new(gate(Duration::from_secs(30)));
+
+    let (id, handle) = hold(&gate, dangerous());
+    let pending = gate.pending();
+    assert_eq!(pending[0].tool.as_deref(), Some("shell"));
+    assert!(pending[0]
+        .matched_patterns
+        .contains(&"destructive_shell".to_string()));
+    gate.decide(id, true).unwrap();
+    let outcome = handle.join().unwrap().unwrap();
+    assert_eq!(outcome.decision, ApprovalDecision::Approved);
+    assert_eq!(outcome.by.as_deref(), Some("ctl"));
+
+    let (id, handle) = hold(&gate, dangerous());
+    gate.decide(id, false).unwrap();
+    let outcome = handle.join().unwrap().unwrap();
+    assert_eq!(outcome.decision, ApprovalDecision::Denied);
+    assert!(outcome.reason().contains("Denied by the user"));
+
+    assert!(gate.decide(id, true).is_err(), "already answered");
+}
+
+/// Terminal input fed line by line from the test.
+struct Keyboard(Receiver<Vec<u8>>, Vec<u8>);
+
+impl Read for Keyboard {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        if self.1.is_empty() {
+            match self.0.recv() {
+                Ok(bytes) => self.1 = bytes,
+                Err(_) => return Ok(0),
+            }
+        }
+        let n = buf.len().min(self.1.len());
+        buf[..n].copy_from_slice(&self.1[..n]);
+        self.1.drain(..n);
+        Ok(n)
+    }
+}
+
+#[derive(Clone, Default)]
+struct Screen(Arc<Mutex<Vec<u8>>>);
+
+impl Write for Screen {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.0.lock().unwrap().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+fn terminal_gate() -> (Arc<ApprovalGate>, Sender<Vec<u8>>, Screen) {
+    let (keys, rx) = mpsc::channel();
+    let screen = Screen::default();
+    let gate = gate(Duration::from_secs(30))
+        .with_prompt(io::BufReader::new(Keyboard(rx, Vec::new())), screen.clone());
+    (Arc::new(gate), keys, screen)
+}
+
+#[test]
+fn test_requests_can_be_answered_in_the_terminal() {
+    let (gate, keys, screen) = terminal_gate();
+
+    let (_, handle) = hold(&gate, dangerous());
+    keys.send(b"y\n".to_vec()).unwrap();
+    let outcome = handle.join().unwrap().unwrap();
+    assert_eq!(outcome.decision, ApprovalDecision::Approved);
+    assert_eq!(outcome.by.as_deref(), Some("terminal"));
+
+    let shown = String::from_utf8(screen.0.lock().unwrap().clone()).unwrap();
+    assert!(
+        shown.contains("approval needed [#1] tools/call shell"),
+        "{}",
+        shown
+    );
+    assert!(shown.contains(r#"{"cmd":"rm -rf /"}"#), "{}", shown);
+    assert!(shown.contains("km ctl approve 1"), "{}", shown);
+
+    // Anything but yes denies
+    let (_, handle) = hold(&gate, dangerous());
+    keys.send(b"\n".to_vec()).unwrap();
+    assert_eq!(
+        handle.join().unwrap().unwrap().decision,
+        ApprovalDecision::Denied
+    );
+}
+
+#[test]
+fn test_render_pending() {
+    let gate = Arc::new(gate(Duration::from_secs(30)));
+    let (id, handle) = hold(&gate, dangerous());
+    let lines = approval::render_pending(&gate.pending(), chrono::Utc::now());
+    assert!(lines[0].starts_with("ID"));
+    assert!(lines[1].starts_with(&id.to_string()));
+    assert!(lines[1].contains("shell"));
+    gate.decide(id, false).unwrap();
+    handle.join().unwrap();
+
+    assert_eq!(
+        approval::render_pending(&[], chrono::Utc::now()),
+        vec!["No requests are waiting for approval"]
+    );
+}
+
+#[cfg(unix)]
+#[test]
+fn test_monitor_denies_requests_nobody_approves() {
+    use std::io::BufRead;
+    use std::os::unix::process::CommandExt;
+    use std::process::{Command, Stdio};
+
+    let dir = tempfile::TempDir::new().unwrap();
+    let log_file = dir.path().join("traffic.jsonl");
+    let mut command = Command::new(env!("CARGO_BIN_EXE_km"));
+    command
+        .current_dir(dir.path())
+        .args(["monitor", "--local-only", "--no-plugins", "--log-file"])
+        .arg(&log_file)
+        .args(["--confirm", "high-risk", "--confirm-timeout", "1"])
+        .args(["--", env!("CARGO_BIN_EXE_mock_mcp_server")])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null());
+    // No controlling terminal, so nobody can be prompted
+    unsafe {
+        command.pre_exec(|| {
+            libc::setsid();
+            Ok(())
+        });
+    }
+    let mut child = command.spawn().unwrap();
+    {
+        let mut stdin = child.stdin.take().unwrap();
+        writeln!(stdin, "{}", dangerous()).unwrap();
+        writeln!(stdin, "{}", harmless()).unwrap();
+    }
+    let responses: Vec<Value> = io::BufReader::new(child.stdout.take().unwrap())
+        .lines()
+        .map(|line| serde_json::from_str(&line.unwrap()).unwrap())
+        .collect();
+    child.wait().unwrap();
+
+    let denied = responses.iter().find(|r| r["id"] == 1).unwrap();
+    assert_eq!(denied["error"]["code"], APPROVAL_DENIED_CODE);
+    assert!(responses
+        .iter()
+        .any(|r| r["id"] == 2 && r.get("result").is_some()));
+
+    let log = std::fs::read_to_string(&log_file).unwrap();
+    let request: Value = serde_json::from_str(log.lines().next().unwrap()).unwrap();
+    assert_eq!(request["metadata"]["approval"]["decision"], "timed_out");
+}
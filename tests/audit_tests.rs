@@ -0,0 +1,179 @@
+use km::audit::{self, DecisionLog, DecisionRecord, DecisionSource, ExportFilter, Verdict};
+use serde_json::{json, Value};
+use std::fs;
+use std::io::Cursor;
+use std::path::Path;
+use tempfile::TempDir;
+
+fn tool_call(id: u64, name: &str) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "method": "tools/call", "params": {"name": name}})
+}
+
+/// Three decisions about one session's requests.
+fn log_session(dir: &Path, session_id: &str) -> DecisionLog {
+    let log = DecisionLog::create(dir, session_id).unwrap();
+    log.record(DecisionRecord::about(
+        &tool_call(1, "read_file"),
+        DecisionSource::Plugin,
+        "pii-filter",
+        Verdict::Allow,
+    ));
+    log.record(
+        DecisionRecord::about(
+            &tool_call(2, "shell"),
+            DecisionSource::Policy,
+            "no-shell",
+            Verdict::Block,
+        )
+        .with_reason("shell access is not allowed"),
+    );
+    log.record(DecisionRecord::about(
+        &json!({"jsonrpc": "2.0", "method": "notifications/initialized"}),
+        DecisionSource::Approval,
+        "terminal",
+        Verdict::Allow,
+    ));
+    log
+}
+
+fn lines(path: &Path) -> Vec<String> {
+    fs::read_to_string(path)
+        .unwrap()
+        .lines()
+        .map(String::from)
+        .collect()
+}
+
+#[test]
+fn test_decisions_are_hash_chained() {
+    let temp_dir = TempDir::new().unwrap();
+    let log = log_session(temp_dir.path(), "session-a");
+
+    let records: Vec<DecisionRecord> = lines(log.path())
+        .iter()
+        .map(|line| serde_json::from_str(line).unwrap())
+        .collect();
+    assert_eq!(records.len(), 3);
+    assert_eq!(records[0].seq, 1);
+    assert_eq!(records[0].prev_hash, audit::GENESIS_HASH);
+    assert_eq!(records[1].prev_hash, records[0].hash);
+    assert_eq!(records[1].session_id, "session-a");
+    assert_eq!(records[1].tool.as_deref(), Some("shell"));
+    assert_eq!(records[1].request_id, json!(2));
+    assert_eq!(
+        records[1].reason.as_deref(),
+        Some("shell access is not allowed")
+    );
+    assert_eq!(records[2].request_id, Value::Null);
+
+    let reports = audit::verify_file(log.path(), false).unwrap();
+    assert_eq!(reports.len(), 1);
+    assert!(reports[0].is_intact());
+    assert_eq!(reports[0].records, 3);
+
+    // Reopening the session's log continues its chain
+    drop(log);
+    let log = DecisionLog::create(temp_dir.path(), "session-a").unwrap();
+    log.record(DecisionRecord::about(
+        &tool_call(3, "read_file"),
+        DecisionSource::PolicyBundle,
+        "revision 7",
+        Verdict::Redact,
+    ));
+    let reports = audit::verify_file(log.path(), false).unwrap();
+    assert!(reports[0].is_intact(), "{:?}", reports[0].broken);
+    assert_eq!(reports[0].records, 4);
+}
+
+#[test]
+fn test_edits_and_removals_break_the_chain() {
+    let temp_dir = TempDir::new().unwrap();
+    let log = log_session(temp_dir.path(), "session-a");
+    let original = lines(log.path());
+
+    let edited = original[1].replace("\"block\"", "\"allow\"");
+    let text = [original[0].clone(), edited, original[2].clone()].join("\n");
+    let reports = audit::verify(Cursor::new(text)).unwrap();
+    assert_eq!(
+        reports[0].broken.as_deref(),
+        Some("line 2 (record 2): its hash doesn't match its contents")
+    );
+
+    let text = [original[0].clone(), original[2].clone()].join("\n");
+    let reports = audit::verify(Cursor::new(text)).unwrap();
+    assert_eq!(
+        reports[0].broken.as_deref(),
+        Some("line 2 (record 3): it doesn't follow the record before it")
+    );
+
+    let text = [original[1].clone(), original[0].clone()].join("\n");
+    let reports = audit::verify(Cursor::new(text)).unwrap();
+    assert!(!reports[0].is_intact());
+
+    assert!(audit::verify(Cursor::new("not json")).is_err());
+}
+
+#[test]
+fn test_dropping_the_head_breaks_the_chain() {
+    let temp_dir = TempDir::new().unwrap();
+    let log = log_session(temp_dir.path(), "session-a");
+    let original = lines(log.path());
+
+    // The rest of the chain is intact, but it doesn't start at record 1
+    let text = original[1..].join("\n");
+    let reports = audit::verify(Cursor::new(&text)).unwrap();
+    assert_eq!(
+        reports[0].broken.as_deref(),
+        Some("line 1 (record 2): the records before it are missing")
+    );
+    fs::write(log.path(), &text).unwrap();
+    assert!(!audit::verify_file(log.path(), false).unwrap()[0].is_intact());
+    let error =
+        audit::export(temp_dir.path(), &ExportFilter::default(), &mut Vec::new()).unwrap_err();
+    assert!(error.to_string().contains("tampered with"), "{}", error);
+
+    // An export made with --since may start there, but not skip records
+    let reports = audit::verify_excerpt(Cursor::new(&text)).unwrap();
+    assert!(reports[0].is_intact(), "{:?}", reports[0].broken);
+    assert!(audit::verify_file(log.path(), true).unwrap()[0].is_intact());
+    let reports = audit::verify_excerpt(Cursor::new(&original[2])).unwrap();
+    assert!(reports[0].is_intact());
+    let text = [original[0].clone(), original[2].clone()].join("\n");
+    let reports = audit::verify_excerpt(Cursor::new(text)).unwrap();
+    assert!(!reports[0].is_intact());
+}
+
+#[test]
+fn test_export_checks_chains_and_filters() {
+    let temp_dir = TempDir::new().unwrap();
+    let dir = temp_dir.path().join("decisions");
+    log_session(&dir, "aaaa-1111");
+    let second = log_session(&dir, "bbbb-2222");
+
+    let mut output = Vec::new();
+    let written = audit::export(&dir, &ExportFilter::default(), &mut output).unwrap();
+    assert_eq!(written, 6);
+    // Exported as logged, so the export checks out on its own
+    let reports = audit::verify(Cursor::new(&output)).unwrap();
+    assert_eq!(reports.len(), 2);
+    assert!(reports.iter().all(|r| r.is_intact()));
+
+    let filter = ExportFilter {
+        session: Some("bbbb".to_string()),
+        since: None,
+    };
+    let mut output = Vec::new();
+    assert_eq!(audit::export(&dir, &filter, &mut output).unwrap(), 3);
+    assert!(String::from_utf8(output).unwrap().contains("bbbb-2222"));
+
+    let filter = ExportFilter {
+        session: None,
+        since: Some(chrono::Utc::now() + chrono::Duration::hours(1)),
+    };
+    assert_eq!(audit::export(&dir, &filter, &mut Vec::new()).unwrap(), 0);
+
+    let text = fs::read_to_string(second.path()).unwrap();
+    fs::write(second.path(), text.replace("no-shell", "no-shel1")).unwrap();
+    let error = audit::export(&dir, &ExportFilter::default(), &mut Vec::new()).unwrap_err();
+    assert!(error.to_string().contains("tampered with"), "{}", error);
+}
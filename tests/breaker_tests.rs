@@ -0,0 +1,235 @@
+use km::breaker::{self, BreakerConfig, BreakerState, CircuitBreaker, RetryConfig};
+use km::config::Config;
+use km::latency::ApiLatency;
+use km::spool::Spool;
+use km::uploader::{BatchSettings, EventUploader, McpEvent};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering every request with `status` and counting
+/// how many requests it saw.
+async fn serve_status(status: u16) -> (String, Arc<AtomicUsize>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let hits = Arc::new(AtomicUsize::new(0));
+    let counter = hits.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 64 * 1024];
+            let _ = socket.read(&mut buf).await;
+            counter.fetch_add(1, Ordering::SeqCst);
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                status
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    (format!("http://{}/api/events/batch", addr), hits)
+}
+
+fn settings(endpoint: &str) -> BatchSettings {
+    BatchSettings {
+        endpoint: endpoint.to_string(),
+        batch_size: 100,
+        batch_timeout: Duration::from_secs(5),
+        max_batch_bytes: 1024 * 1024,
+        compress: false,
+        concurrency: 1,
+    }
+}
+
+fn event(content: &str) -> McpEvent {
+    McpEvent::new("session", "request", content, None, None, None)
+}
+
+fn breaker(failure_threshold: u32, open_secs: u64) -> Arc<CircuitBreaker> {
+    Arc::new(CircuitBreaker::new(
+        BreakerConfig {
+            failure_threshold,
+            open_secs,
+            half_open_probes: 1,
+        },
+        RetryConfig::default(),
+    ))
+}
+
+#[tokio::test]
+async fn test_breaker_opens_then_probes_and_closes() {
+    let breaker = breaker(2, 1);
+    breaker.try_acquire().unwrap().failed();
+    assert_eq!(breaker.status().state, BreakerState::Closed);
+    breaker.try_acquire().unwrap().failed();
+
+    let status = breaker.status();
+    assert_eq!(status.state, BreakerState::Open);
+    assert_eq!((status.consecutive_failures, status.opened), (2, 1));
+    assert!(status.probe_at.unwrap() > status.opened_at.unwrap());
+    assert!(breaker.try_acquire().is_none());
+
+    tokio::time::sleep(Duration::from_millis(1100)).await;
+    let probe = breaker.try_acquire().unwrap();
+    assert_eq!(breaker.status().state, BreakerState::HalfOpen);
+    // One probe at a time
+    assert!(breaker.try_acquire().is_none());
+    // A failed probe opens it again right away
+    probe.failed();
+    assert_eq!(breaker.status().state, BreakerState::Open);
+    assert_eq!(breaker.status().opened, 2);
+
+    tokio::time::sleep(Duration::from_millis(1100)).await;
+    // A probe dropped without an outcome frees its slot
+    drop(breaker.try_acquire().unwrap());
+    breaker.try_acquire().unwrap().succeeded();
+    let status = breaker.status();
+    assert_eq!(status.state, BreakerState::Closed);
+    assert_eq!(status.consecutive_failures, 0);
+    assert!(status.opened_at.is_none());
+}
+
+#[tokio::test]
+async fn test_threshold_zero_never_opens() {
+    let breaker = breaker(0, 1);
+    for _ in 0..20 {
+        breaker.try_acquire().unwrap().failed();
+    }
+    assert_eq!(breaker.status().state, BreakerState::Closed);
+    assert_eq!(breaker.status().consecutive_failures, 20);
+}
+
+#[tokio::test]
+async fn test_uploader_spools_without_sending_while_open() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let breaker = breaker(1, 60);
+
+    // A refused batch means the API is up
+    let (refusing, _) = serve_status(400).await;
+    let uploader = EventUploader::new("token".to_string())
+        .with_spool(spool.clone())
+        .with_breaker(breaker.clone());
+    let _ = uploader
+        .send_batch(&settings(&refusing), &[event(r#"{"n":1}"#)])
+        .await;
+    assert_eq!(breaker.status().state, BreakerState::Closed);
+
+    let (failing, hits) = serve_status(500).await;
+    uploader
+        .send_batch(&settings(&failing), &[event(r#"{"n":2}"#)])
+        .await
+        .unwrap();
+    assert_eq!(breaker.status().state, BreakerState::Open);
+    assert_eq!(hits.load(Ordering::SeqCst), 1);
+
+    uploader
+        .send_batch(&settings(&failing), &[event(r#"{"n":3}"#)])
+        .await
+        .unwrap();
+    assert_eq!(hits.load(Ordering::SeqCst), 1);
+    assert_eq!(spool.pending().unwrap().len(), 3);
+
+    // The spool holds its batches back too
+    let spool = spool.with_breaker(breaker);
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+    assert_eq!((report.sent, report.remaining), (0, 3));
+    assert_eq!(hits.load(Ordering::SeqCst), 1);
+}
+
+#[tokio::test]
+async fn test_uploader_retries_as_configured() {
+    let (endpoint, hits) = serve_status(429).await;
+    let temp_dir = TempDir::new().unwrap();
+    let api_latency = Arc::new(ApiLatency::default());
+    let uploader = EventUploader::new("token".to_string())
+        .with_spool(Spool::new(temp_dir.path().to_path_buf()))
+        .with_api_latency(api_latency.clone())
+        .with_retry(RetryConfig {
+            retries: 0,
+            ..RetryConfig::default()
+        });
+    uploader
+        .send_batch(&settings(&endpoint), &[event(r#"{"n":1}"#)])
+        .await
+        .unwrap();
+    assert_eq!(hits.load(Ordering::SeqCst), 1);
+    assert_eq!(uploader.stats().spooled(), 1);
+    // Throttled answers are still answers
+    assert_eq!(api_latency.summary().count, 1);
+}
+
+#[test]
+fn test_settings_are_configurable() {
+    let mut config = Config::default();
+    assert_eq!(
+        config.get("circuit_breaker.failure_threshold").unwrap(),
+        "5"
+    );
+    assert_eq!(config.get("circuit_breaker.open_secs").unwrap(), "60");
+    assert_eq!(config.get("retry.retries").unwrap(), "2");
+    let json = serde_json::to_value(&config).unwrap();
+    assert!(json.get("retry").is_none());
+    assert!(json.get("circuit_breaker").is_none());
+
+    config.set("circuit_breaker.open_secs", "30").unwrap();
+    config.set("circuit_breaker.half_open_probes", "2").unwrap();
+    config.set("retry.backoff_max_ms", "2000").unwrap();
+    assert_eq!(config.circuit_breaker.open_secs, 30);
+    assert_eq!(config.circuit_breaker.half_open_probes, 2);
+    assert_eq!(config.retry.backoff().max, Duration::from_secs(2));
+
+    // Unset fields keep their defaults
+    let partial: BreakerConfig = serde_json::from_str(r#"{"open_secs": 10}"#).unwrap();
+    assert_eq!(partial.failure_threshold, 5);
+
+    assert!(BreakerConfig {
+        open_secs: 0,
+        ..BreakerConfig::default()
+    }
+    .validate()
+    .is_err());
+    assert!(RetryConfig {
+        backoff_base_ms: 5000,
+        backoff_max_ms: 1000,
+        ..RetryConfig::default()
+    }
+    .validate()
+    .is_err());
+}
+
+#[test]
+fn test_status_lines_and_metrics() {
+    let breaker = breaker(1, 60);
+    breaker.try_acquire().unwrap().failed();
+    let status = breaker.status();
+
+    let lines = breaker::render(&status);
+    assert!(
+        lines[0].starts_with("Breaker:  open after 1 failures in a row, probing at "),
+        "{}",
+        lines[0]
+    );
+    assert_eq!(
+        lines[1],
+        "Opens:    after 1 failed uploads in a row, for 60s, then 1 probe(s) at a time"
+    );
+    assert!(lines[2].starts_with("Retries:  2 per throttled batch"));
+
+    let metrics = breaker::prometheus("abc", &status);
+    assert!(metrics.contains("km_api_breaker_state{session=\"abc\",state=\"open\"} 1\n"));
+    assert!(metrics.contains("km_api_breaker_state{session=\"abc\",state=\"closed\"} 0\n"));
+    assert!(metrics.contains("km_api_breaker_opened_total{session=\"abc\"} 1\n"));
+
+    // Round-trips through `km ctl status`
+    let json = serde_json::to_value(&status).unwrap();
+    assert_eq!(json["state"], "open");
+    assert_eq!(
+        serde_json::from_value::<breaker::BreakerStatus>(json).unwrap(),
+        status
+    );
+}
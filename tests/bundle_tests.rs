@@ -0,0 +1,286 @@
+use km::bundle::{self, Bundle, BUNDLE_VERSION, FORMAT};
+use km::cli::ConfigCommands;
+use km::config::{self, Config, Migration, CONFIG_VERSION};
+use km::handlers::handle_config;
+use km::risk::rules::{RiskRule, RulePack, RuleStore};
+use serde_json::{json, Value};
+use std::fs;
+use tempfile::TempDir;
+
+fn pack(name: &str) -> RulePack {
+    RulePack {
+        name: name.to_string(),
+        version: "1.2.0".to_string(),
+        description: "Team rules".to_string(),
+        rules: vec![RiskRule {
+            name: "exfil_upload".to_string(),
+            pattern: r"(?i)transfer\.sh".to_string(),
+            category: "exfiltration".to_string(),
+            weight: 0.5,
+        }],
+    }
+}
+
+fn team_config(rules_dir: &str) -> Config {
+    serde_json::from_value(json!({
+        "api_key": "km_live_0123456789abcdef",
+        "api_url": "https://api.kilometers.ai",
+        "batch_size": 50,
+        "risk_rules": {"dir": rules_dir},
+        "alerts": {"rules": [{
+            "name": "exfil",
+            "when": "risk>=high",
+            "slack": "https://hooks.slack.com/services/T0/B0/secret"
+        }]},
+        "sinks": [{
+            "type": "webhook",
+            "url": "https://hooks.example.com/km",
+            "headers": {"Authorization": "Bearer abc", "X-Team": "payments"}
+        }],
+        "plugin_config": {"jira": {"project": "SEC", "api_token": "t0k3n"}},
+        "profiles": {"staging": {"api_url": "https://staging.kilometers.ai"}}
+    }))
+    .unwrap()
+}
+
+#[test]
+fn test_secrets_are_withheld() {
+    let mut value = serde_json::to_value(team_config("/rules")).unwrap();
+    let withheld = bundle::withhold_secrets(&mut value);
+
+    assert_eq!(
+        withheld,
+        [
+            "/alerts/rules/0/slack",
+            "/api_key",
+            "/plugin_config/jira/api_token",
+            "/sinks/0/headers/Authorization",
+            "/sinks/0/headers/X-Team",
+        ]
+    );
+    assert_eq!(value["plugin_config"]["jira"], json!({"project": "SEC"}));
+    assert_eq!(value["sinks"][0]["url"], "https://hooks.example.com/km");
+    assert_eq!(
+        value["profiles"]["staging"]["api_url"],
+        "https://staging.kilometers.ai"
+    );
+}
+
+#[test]
+fn test_bundle_round_trips_config_and_rule_packs() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("team.kmz");
+    let config = team_config("/rules");
+
+    Bundle::create(&config, vec![pack("team")], false)
+        .unwrap()
+        .write(&path)
+        .unwrap();
+    let bundle = Bundle::read(&path).unwrap();
+
+    assert_eq!(bundle.manifest.format, FORMAT);
+    assert_eq!(bundle.manifest.version, BUNDLE_VERSION);
+    assert_eq!(bundle.manifest.config_version, CONFIG_VERSION);
+    assert!(!bundle.manifest.includes_secrets);
+    assert_eq!(bundle.manifest.rules, ["team"]);
+    assert_eq!(bundle.rules, [pack("team")]);
+    assert_eq!(bundle.config["batch_size"], 50);
+    assert!(bundle.config.get("api_key").is_none());
+}
+
+#[test]
+fn test_bundle_with_secrets_keeps_them() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("team.kmz");
+
+    Bundle::create(&team_config("/rules"), Vec::new(), true)
+        .unwrap()
+        .write(&path)
+        .unwrap();
+    let bundle = Bundle::read(&path).unwrap();
+
+    assert!(bundle.manifest.includes_secrets);
+    assert!(bundle.manifest.withheld.is_empty());
+    assert_eq!(bundle.config["api_key"], "km_live_0123456789abcdef");
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mode = fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o077, 0);
+    }
+}
+
+#[test]
+fn test_import_keeps_local_secrets_and_reports_missing_ones() {
+    let bundle = Bundle::create(&team_config("/rules"), Vec::new(), false).unwrap();
+    let local: Config = serde_json::from_value(json!({
+        "api_key": "km_live_local",
+        "api_url": "https://api.kilometers.ai",
+        "alerts": {"rules": [{
+            "name": "exfil",
+            "when": "risk>=high",
+            "slack": "https://hooks.slack.com/services/T0/B0/local"
+        }]}
+    }))
+    .unwrap();
+
+    let (config, missing) = bundle.config_for(Some(&local)).unwrap();
+
+    assert_eq!(config.api_key, "km_live_local");
+    assert_eq!(
+        config.alerts.rules[0].slack.as_deref(),
+        Some("https://hooks.slack.com/services/T0/B0/local")
+    );
+    assert_eq!(config.batch_size, 50);
+    assert_eq!(
+        missing,
+        [
+            "/plugin_config/jira/api_token",
+            "/sinks/0/headers/Authorization",
+            "/sinks/0/headers/X-Team",
+        ]
+    );
+
+    let (fresh, missing) = bundle.config_for(None).unwrap();
+    assert_eq!(fresh.api_key, "");
+    assert_eq!(missing.len(), 5);
+}
+
+#[test]
+fn test_reading_something_else_fails() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("notes.kmz");
+    fs::write(&path, "not a bundle").unwrap();
+
+    assert!(Bundle::read(&path).is_err());
+}
+
+#[test]
+fn test_bundles_from_a_newer_km_are_refused() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("future.kmz");
+    let mut bundle = Bundle::create(&team_config("/rules"), Vec::new(), false).unwrap();
+    bundle.manifest.version = BUNDLE_VERSION + 1;
+    bundle.write(&path).unwrap();
+
+    let err = Bundle::read(&path).unwrap_err();
+    assert!(err.to_string().contains("newer km"), "{}", err);
+}
+
+#[test]
+fn test_unversioned_config_files_load_as_the_first_version() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("km_config.json");
+    fs::write(
+        &path,
+        r#"{"api_key": "", "api_url": "https://api.kilometers.ai"}"#,
+    )
+    .unwrap();
+
+    assert_eq!(Config::load(&path).unwrap().version, CONFIG_VERSION);
+    assert_eq!(config::migrate_file(&path).unwrap(), None);
+}
+
+#[test]
+fn test_config_files_from_a_newer_km_are_refused() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("km_config.json");
+    fs::write(
+        &path,
+        format!(
+            r#"{{"version": {}, "api_key": "", "api_url": "https://api.kilometers.ai"}}"#,
+            CONFIG_VERSION + 1
+        ),
+    )
+    .unwrap();
+
+    let err = Config::load(&path).unwrap_err();
+    assert!(
+        format!("{:#}", err).contains("newer than this km"),
+        "{:#}",
+        err
+    );
+}
+
+#[test]
+fn test_migrations_run_in_order_from_the_file_version() {
+    fn rename_whitelist(value: &mut Value) -> anyhow::Result<()> {
+        if let Some(methods) = value.as_object_mut().unwrap().remove("methods") {
+            value["method_whitelist"] = methods;
+        }
+        Ok(())
+    }
+    fn double_batch(value: &mut Value) -> anyhow::Result<()> {
+        let size = value["batch_size"].as_u64().unwrap_or(100);
+        value["batch_size"] = json!(size * 2);
+        Ok(())
+    }
+    let steps: &[Migration] = &[rename_whitelist, double_batch];
+
+    let mut old = json!({"methods": ["tools/*"], "batch_size": 10});
+    assert_eq!(config::migrate_with(&mut old, steps).unwrap(), 1);
+    assert_eq!(
+        old,
+        json!({"method_whitelist": ["tools/*"], "batch_size": 20, "version": 3})
+    );
+
+    let mut newer = json!({"version": 2, "batch_size": 10});
+    assert_eq!(config::migrate_with(&mut newer, steps).unwrap(), 2);
+    assert_eq!(newer, json!({"batch_size": 20, "version": 3}));
+}
+
+#[test]
+fn test_export_then_import_through_km_config() {
+    let dir = TempDir::new().unwrap();
+    let rules_dir = dir.path().join("rules");
+    RuleStore::new(rules_dir.clone())
+        .install(&pack("team"))
+        .unwrap();
+    let source = dir.path().join("source.json");
+    let mut config = team_config(rules_dir.to_str().unwrap());
+    config.api_key = String::new();
+    config.save(&source).unwrap();
+    let bundle = dir.path().join("team.kmz");
+
+    handle_config(
+        &source,
+        false,
+        Some(ConfigCommands::Export {
+            bundle: bundle.clone(),
+            include_secrets: false,
+        }),
+    )
+    .unwrap();
+
+    // The bundled rules directory is where packs are installed on import
+    fs::remove_dir_all(&rules_dir).unwrap();
+    let target = dir.path().join("machine2").join("km_config.json");
+    handle_config(
+        &target,
+        false,
+        Some(ConfigCommands::Import {
+            bundle: bundle.clone(),
+            force: false,
+        }),
+    )
+    .unwrap();
+
+    let imported = Config::load(&target).unwrap();
+    assert_eq!(imported.batch_size, 50);
+    assert!(imported.profiles.contains_key("staging"));
+    assert_eq!(imported.alerts.rules[0].slack, None);
+    assert_eq!(
+        RuleStore::new(rules_dir).installed().unwrap()[0].pack,
+        pack("team")
+    );
+
+    let again = handle_config(
+        &target,
+        false,
+        Some(ConfigCommands::Import {
+            bundle,
+            force: false,
+        }),
+    );
+    assert!(again.unwrap_err().to_string().contains("--force"));
+}
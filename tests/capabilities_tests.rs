@@ -0,0 +1,166 @@
+use km::capabilities::{Capabilities, ServerInfo, FEATURE_EVENT_BATCHES, FEATURE_GZIP};
+use km::rate_limit::RateLimit;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering `path` with `(status, body)` and 404 for
+/// everything else.
+async fn serve(routes: Vec<(&'static str, u16, &'static str)>) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 16 * 1024];
+            let n = socket.read(&mut buf).await.unwrap_or(0);
+            let request = String::from_utf8_lossy(&buf[..n]).into_owned();
+            let path = request.split_whitespace().nth(1).unwrap_or("").to_string();
+
+            let (status, body) = routes
+                .iter()
+                .find(|(p, _, _)| *p == path)
+                .map(|(_, status, body)| (*status, *body))
+                .unwrap_or((404, ""));
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-type: application/json\r\ncontent-length: {}\r\nconnection: close\r\n\r\n{}",
+                status,
+                body.len(),
+                body
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}", addr)
+}
+
+fn info(json: &str) -> ServerInfo {
+    serde_json::from_str(json).unwrap()
+}
+
+#[test]
+fn test_negotiate_with_minimal_server_info() {
+    let capabilities = Capabilities::negotiate(&info(r#"{"apiVersion": 1}"#)).unwrap();
+    assert_eq!(capabilities, Capabilities::default());
+}
+
+#[test]
+fn test_negotiate_turns_off_unlisted_features() {
+    let capabilities = Capabilities::negotiate(&info(&format!(
+        r#"{{"apiVersion": 1, "serverVersion": "2.4.0", "features": ["{}"],
+            "apiUrl": "https://km.corp.example/kilometers/"}}"#,
+        FEATURE_EVENT_BATCHES
+    )))
+    .unwrap();
+
+    assert!(capabilities.event_batches);
+    assert!(!capabilities.gzip_uploads);
+    assert!(!capabilities.risk_scoring);
+    assert_eq!(capabilities.server_version.as_deref(), Some("2.4.0"));
+    assert_eq!(
+        capabilities.api_url.as_deref(),
+        Some("https://km.corp.example/kilometers")
+    );
+}
+
+#[test]
+fn test_negotiate_prefers_protobuf_events() {
+    let capabilities =
+        Capabilities::negotiate(&info(r#"{"apiVersion": 1, "eventVersions": [1, 2]}"#)).unwrap();
+    assert_eq!(capabilities.event_version, 2);
+    let capabilities =
+        Capabilities::negotiate(&info(r#"{"apiVersion": 1, "eventVersions": [1]}"#)).unwrap();
+    assert_eq!(capabilities.event_version, 1);
+}
+
+#[test]
+fn test_negotiate_keeps_the_rate_limit() {
+    let capabilities = Capabilities::negotiate(&info(
+        r#"{"apiVersion": 1, "rateLimit": {"requestsPerMinute": 120, "burst": 10}}"#,
+    ))
+    .unwrap();
+    assert_eq!(
+        capabilities.rate_limit,
+        Some(RateLimit {
+            requests_per_minute: 120,
+            burst: Some(10),
+        })
+    );
+}
+
+#[test]
+fn test_negotiate_rejects_incompatible_servers() {
+    let err = Capabilities::negotiate(&info(
+        r#"{"apiVersion": 1, "serverVersion": "9.0.0", "minClientVersion": "999.0.0"}"#,
+    ))
+    .unwrap_err();
+    assert!(err.to_string().contains("needs km 999.0.0 or newer"));
+
+    let err = Capabilities::negotiate(&info(r#"{"apiVersion": 7}"#)).unwrap_err();
+    assert!(err.to_string().contains("Upgrade km"));
+
+    let err = Capabilities::negotiate(&info(r#"{"apiVersion": 0}"#)).unwrap_err();
+    assert!(err.to_string().contains("Upgrade the server"));
+
+    let err = Capabilities::negotiate(&info(r#"{"apiVersion": 1, "eventVersions": [3, 4]}"#))
+        .unwrap_err();
+    assert!(err.to_string().contains("event formats [3, 4]"));
+}
+
+#[tokio::test]
+async fn test_discover_tries_well_known_path() {
+    let base = serve(vec![(
+        "/.well-known/kilometers",
+        200,
+        r#"{"apiVersion": 1, "serverVersion": "self-hosted", "features": ["gzip-uploads"]}"#,
+    )])
+    .await;
+
+    let info = Capabilities::discover(&base).await.unwrap().unwrap();
+    assert_eq!(info.server_version.as_deref(), Some("self-hosted"));
+    assert_eq!(info.features, Some(vec![FEATURE_GZIP.to_string()]));
+}
+
+#[tokio::test]
+async fn test_discover_prefers_api_version() {
+    let base = serve(vec![
+        (
+            "/api/version",
+            200,
+            r#"{"apiVersion": 1, "serverVersion": "a"}"#,
+        ),
+        (
+            "/.well-known/kilometers",
+            200,
+            r#"{"apiVersion": 1, "serverVersion": "b"}"#,
+        ),
+    ])
+    .await;
+
+    let info = Capabilities::discover(&base).await.unwrap().unwrap();
+    assert_eq!(info.server_version.as_deref(), Some("a"));
+}
+
+#[tokio::test]
+async fn test_detect_assumes_defaults_for_old_or_failing_servers() {
+    // Neither discovery path exists
+    let base = serve(Vec::new()).await;
+    assert_eq!(Capabilities::discover(&base).await.unwrap(), None);
+    assert_eq!(
+        Capabilities::detect(&base).await.unwrap(),
+        Capabilities::default()
+    );
+
+    let base = serve(vec![("/api/version", 503, "")]).await;
+    assert!(Capabilities::discover(&base).await.is_err());
+    assert_eq!(
+        Capabilities::detect(&base).await.unwrap(),
+        Capabilities::default()
+    );
+}
+
+#[tokio::test]
+async fn test_detect_fails_fast_on_incompatible_server() {
+    let base = serve(vec![("/api/version", 200, r#"{"apiVersion": 99}"#)]).await;
+    assert!(Capabilities::detect(&base).await.is_err());
+}
@@ -0,0 +1,139 @@
+use chrono::{DateTime, Duration, Utc};
+use km::ci::{self, CiCounts, CiMetric, CiSummary, Threshold};
+use km::costs::CostConfig;
+use km::report::SessionReport;
+use km::risk::PatternRiskAnalyzer;
+use km::sessions;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+
+fn at(ms: i64) -> DateTime<Utc> {
+    DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+        .unwrap()
+        .with_timezone(&Utc)
+        + Duration::milliseconds(ms)
+}
+
+fn entry(session: &str, ms: i64, direction: &str, content: Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(ms),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn call(id: u64, tool: &str, arguments: Value) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "method": "tools/call",
+           "params": {"name": tool, "arguments": arguments}})
+}
+
+fn error(id: u64) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "error": {"code": -32000, "message": "failed"}})
+}
+
+fn session() -> Vec<TrafficEntry> {
+    let mut denied = entry("run-1", 3_000, "request", call(3, "list_dir", json!({})));
+    denied.metadata.insert(
+        "policy".to_string(),
+        json!({"rule": "no-list", "decision": "deny", "enforced": true}),
+    );
+    vec![
+        entry(
+            "run-1",
+            0,
+            "request",
+            call(1, "read_file", json!({"path": "a.txt"})),
+        ),
+        entry("run-1", 10, "response", error(1)),
+        entry(
+            "run-1",
+            1_000,
+            "request",
+            call(2, "shell", json!({"cmd": "rm -rf /"})),
+        ),
+        entry("run-1", 1_010, "response", error(2)),
+        denied,
+        entry("other", 0, "response", error(9)),
+    ]
+}
+
+fn counts() -> CiCounts {
+    let entries = session();
+    let summaries = sessions::summarize(&entries);
+    let session = summaries.iter().find(|s| s.id == "run-1").unwrap();
+    let report = SessionReport::build(
+        &entries,
+        session,
+        &PatternRiskAnalyzer::new(),
+        &CostConfig::default(),
+    );
+    CiCounts::of_report(&report)
+}
+
+#[test]
+fn test_thresholds_parse() {
+    assert_eq!(
+        ci::parse_threshold("high-risk>=1").unwrap(),
+        Threshold {
+            metric: CiMetric::HighRisk,
+            at_least: 1
+        }
+    );
+    // `>` is one more than `>=`
+    let errors = ci::parse_threshold("errors > 4").unwrap();
+    assert_eq!(errors.at_least, 5);
+    assert_eq!(errors.to_string(), "errors>=5");
+
+    assert!(ci::parse_threshold("errors=5").is_err());
+    assert!(ci::parse_threshold("errors>=many").is_err());
+    let unknown = ci::parse_threshold("warnings>=1").unwrap_err();
+    assert!(unknown.contains("policy-violations"), "{}", unknown);
+}
+
+#[test]
+fn test_session_counts() {
+    let counts = counts();
+    assert_eq!(counts.requests, 3);
+    assert_eq!(counts.errors, 2);
+    assert!(counts.high_risk >= 1);
+    assert_eq!(counts.policy_violations, 1);
+    assert!(counts.critical_risk <= counts.high_risk);
+}
+
+#[test]
+fn test_summary_lists_the_thresholds_reached() {
+    let counts = counts();
+    let thresholds = [
+        ci::parse_threshold("high-risk>=1").unwrap(),
+        ci::parse_threshold("errors>=5").unwrap(),
+        ci::parse_threshold("policy-violations>0").unwrap(),
+    ];
+    let summary = CiSummary::evaluate("run-1", counts.clone(), &thresholds);
+    assert!(!summary.passed);
+    assert_eq!(summary.violations.len(), 2);
+    assert_eq!(
+        summary.failure().unwrap(),
+        format!(
+            "Session run-1 reached its CI thresholds: high-risk>=1 (was {}), \
+             policy-violations>=1 (was 1)",
+            counts.high_risk
+        )
+    );
+
+    let json = serde_json::to_value(&summary).unwrap();
+    assert_eq!(json["passed"], false);
+    assert_eq!(json["counts"]["errors"], 2);
+    assert_eq!(json["thresholds"][1], "errors>=5");
+    assert_eq!(json["violations"][1]["threshold"], "policy-violations>=1");
+
+    let summary = CiSummary::evaluate("run-1", counts, &thresholds[1..2]);
+    assert!(summary.passed);
+    assert_eq!(summary.failure(), None);
+}
@@ -1,5 +1,6 @@
 use clap::Parser;
-use km::cli::{Cli, Commands};
+use km::cli::{Cli, Commands, PresetsCommands};
+use km::errors::{Code, ErrorFormat};
 use std::path::PathBuf;
 
 #[test]
@@ -54,6 +55,24 @@ fn test_init_command_without_api_key() {
     }
 }
 
+#[test]
+fn test_login_and_logout_commands() {
+    let cli = Cli::parse_from(vec!["km", "login", "--no-browser"]);
+    match cli.command {
+        Commands::Login {
+            api_url,
+            no_browser,
+        } => {
+            assert_eq!(api_url, "https://api.kilometers.ai");
+            assert!(no_browser);
+        }
+        _ => panic!("Expected Login command"),
+    }
+
+    let cli = Cli::parse_from(vec!["km", "logout"]);
+    assert!(matches!(cli.command, Commands::Logout));
+}
+
 #[test]
 fn test_clear_logs_command() {
     let args = vec!["km", "clear-logs"];
@@ -160,11 +179,27 @@ fn test_monitor_command_basic() {
             local_only,
             override_tier,
             log_file,
+            options,
         } => {
             assert_eq!(args, vec!["npx", "server"]);
             assert!(!local_only);
             assert_eq!(override_tier, None);
             assert_eq!(log_file, PathBuf::from("mcp_traffic.jsonl"));
+            assert!(!options.redact);
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+}
+
+#[test]
+fn test_monitor_command_with_redact() {
+    let args = vec!["km", "monitor", "--redact", "--", "echo", "test"];
+    let cli = Cli::parse_from(args);
+
+    match cli.command {
+        Commands::Monitor { args, options, .. } => {
+            assert!(options.redact);
+            assert_eq!(args, vec!["echo", "test"]);
         }
         _ => panic!("Expected Monitor command"),
     }
@@ -210,20 +245,39 @@ fn test_config_command_basic() {
     let cli = Cli::parse_from(args);
 
     match cli.command {
-        Commands::Config { show_secrets } => {
+        Commands::Config { show_secrets, .. } => {
             assert!(!show_secrets);
         }
         _ => panic!("Expected Config command"),
     }
 }
 
+#[test]
+fn test_profile_flag_is_global() {
+    let cli = Cli::parse_from(vec!["km", "--profile", "staging", "monitor", "--", "echo"]);
+    assert_eq!(cli.profile.as_deref(), Some("staging"));
+
+    let cli = Cli::parse_from(vec![
+        "km",
+        "config",
+        "--profile",
+        "prod",
+        "set",
+        "api_url",
+        "https://x",
+    ]);
+    assert_eq!(cli.profile.as_deref(), Some("prod"));
+
+    assert_eq!(Cli::parse_from(vec!["km", "config"]).profile, None);
+}
+
 #[test]
 fn test_config_command_with_show_secrets() {
     let args = vec!["km", "config", "--show-secrets"];
     let cli = Cli::parse_from(args);
 
     match cli.command {
-        Commands::Config { show_secrets } => {
+        Commands::Config { show_secrets, .. } => {
             assert!(show_secrets);
         }
         _ => panic!("Expected Config command"),
@@ -339,11 +393,887 @@ fn test_doctor_jwt_command() {
     let cli = Cli::parse_from(args);
 
     match cli.command {
-        Commands::Doctor { command } => match command {
-            km::cli::DoctorCommands::Jwt => {
+        Commands::Doctor { command, .. } => match command {
+            Some(km::cli::DoctorCommands::Jwt) => {
                 // Command parsed correctly
             }
+            None => panic!("Expected the jwt subcommand"),
         },
         _ => panic!("Expected Doctor command"),
     }
 }
+
+#[test]
+fn test_doctor_checks_command() {
+    let cli = Cli::parse_from(["km", "doctor", "--server", "npx"]);
+
+    match cli.command {
+        Commands::Doctor { server, command } => {
+            assert_eq!(server.as_deref(), Some("npx"));
+            assert!(command.is_none());
+        }
+        _ => panic!("Expected Doctor command"),
+    }
+}
+
+#[test]
+fn test_policy_test_command() {
+    let cli = Cli::parse_from(["km", "policy", "test", "--file", "requests.jsonl"]);
+
+    match cli.command {
+        Commands::Policy {
+            command:
+                km::cli::PolicyCommands::Test {
+                    message,
+                    file,
+                    bundle,
+                },
+        } => {
+            assert!(message.is_none());
+            assert!(bundle.is_none());
+            assert_eq!(file, Some(PathBuf::from("requests.jsonl")));
+        }
+        _ => panic!("Expected Policy test command"),
+    }
+}
+
+#[test]
+fn test_report_command() {
+    let cli = Cli::parse_from(["km", "report", "abc", "--format", "markdown", "-o", "pr.md"]);
+
+    match cli.command {
+        Commands::Report {
+            id,
+            file,
+            format,
+            output,
+        } => {
+            assert_eq!(id, "abc");
+            assert_eq!(file, PathBuf::from("mcp_traffic.jsonl"));
+            assert_eq!(format, Some(km::report::ReportFormat::Md));
+            assert_eq!(output, Some(PathBuf::from("pr.md")));
+        }
+        _ => panic!("Expected Report command"),
+    }
+}
+
+#[test]
+fn test_diff_command() {
+    let cli = Cli::parse_from([
+        "km",
+        "diff",
+        "abc",
+        "def",
+        "--b-file",
+        "after.jsonl",
+        "--json",
+    ]);
+
+    match cli.command {
+        Commands::Diff {
+            a,
+            b,
+            file,
+            b_file,
+            json,
+        } => {
+            assert_eq!(a, "abc");
+            assert_eq!(b, "def");
+            assert_eq!(file, PathBuf::from("mcp_traffic.jsonl"));
+            assert_eq!(b_file, Some(PathBuf::from("after.jsonl")));
+            assert!(json);
+        }
+        _ => panic!("Expected Diff command"),
+    }
+}
+
+#[test]
+fn test_probe_command() {
+    let cli = Cli::parse_from([
+        "km",
+        "probe",
+        "--call",
+        r#"echo={"text": "hi"}"#,
+        "--rate",
+        "20",
+        "--duration",
+        "30",
+        "--",
+        "npx",
+        "-y",
+        "server",
+    ]);
+
+    match cli.command {
+        Commands::Probe {
+            calls,
+            rate,
+            count,
+            duration,
+            timeout,
+            log_file,
+            json,
+            target,
+        } => {
+            assert_eq!(calls.len(), 1);
+            assert_eq!(calls[0].tool, "echo");
+            assert_eq!(rate, 20.0);
+            assert_eq!(count, None);
+            assert_eq!(duration, Some(30));
+            assert_eq!(timeout, 30);
+            assert_eq!(log_file, None);
+            assert!(!json);
+            assert_eq!(target, vec!["npx", "-y", "server"]);
+        }
+        _ => panic!("Expected Probe command"),
+    }
+    assert!(Cli::try_parse_from(["km", "probe"]).is_err());
+}
+
+#[test]
+fn test_mock_command() {
+    let cli = Cli::parse_from(["km", "mock", "--from", "fixture.jsonl", "--strict"]);
+
+    match cli.command {
+        Commands::Mock {
+            from,
+            session,
+            strict,
+        } => {
+            assert_eq!(from, PathBuf::from("fixture.jsonl"));
+            assert_eq!(session, None);
+            assert!(strict);
+        }
+        _ => panic!("Expected Mock command"),
+    }
+    assert!(Cli::try_parse_from(["km", "mock"]).is_err());
+}
+
+#[test]
+fn test_sessions_events_command() {
+    let cli = Cli::parse_from([
+        "km", "sessions", "events", "abc", "--method", "tools/*", "--json",
+    ]);
+
+    match cli.command {
+        Commands::Sessions {
+            file,
+            json,
+            command: km::cli::SessionsCommands::Events { id, method },
+        } => {
+            assert_eq!(file, PathBuf::from("mcp_traffic.jsonl"));
+            assert!(json);
+            assert_eq!(id, "abc");
+            assert_eq!(method.as_deref(), Some("tools/*"));
+        }
+        _ => panic!("Expected Sessions events command"),
+    }
+}
+
+#[test]
+fn test_unknown_commands_go_to_plugins() {
+    let cli = Cli::parse_from(["km", "compliance", "report", "--since", "7d"]);
+    match cli.command {
+        Commands::Plugin(args) => assert_eq!(args, vec!["compliance", "report", "--since", "7d"]),
+        _ => panic!("Expected a plugin command"),
+    }
+
+    let cli = Cli::parse_from(["km", "plugins", "config", "pii-filter", "mode", "strict"]);
+    match cli.command {
+        Commands::Plugins {
+            command:
+                km::cli::PluginCommands::Config {
+                    name,
+                    key,
+                    value,
+                    unset,
+                },
+        } => {
+            assert_eq!(name, "pii-filter");
+            assert_eq!(key.as_deref(), Some("mode"));
+            assert_eq!(value.as_deref(), Some("strict"));
+            assert!(!unset);
+        }
+        _ => panic!("Expected plugins config command"),
+    }
+    assert!(Cli::try_parse_from(["km", "plugins", "config", "pii-filter", "--unset"]).is_err());
+    assert!(
+        Cli::try_parse_from(["km", "plugins", "config", "x", "mode", "strict", "--unset"]).is_err()
+    );
+
+    let cli = Cli::parse_from(["km", "plugins", "commands"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Plugins {
+            command: km::cli::PluginCommands::Commands
+        }
+    ));
+}
+
+#[test]
+fn test_plugin_dev_commands() {
+    use km::cli::{PluginCommands, PluginDevCommands};
+
+    let cli = Cli::parse_from(["km", "plugins", "scaffold", "pii-filter", "--wasm"]);
+    match cli.command {
+        Commands::Plugins {
+            command: PluginCommands::Develop(PluginDevCommands::Scaffold { name, wasm, dir }),
+        } => {
+            assert_eq!(name, "pii-filter");
+            assert!(wasm);
+            assert_eq!(dir, None);
+        }
+        _ => panic!("Expected plugins scaffold command"),
+    }
+
+    let cli = Cli::parse_from(["km", "plugins", "test", "--no-build"]);
+    match cli.command {
+        Commands::Plugins {
+            command:
+                PluginCommands::Develop(PluginDevCommands::Test {
+                    dir,
+                    file,
+                    expect,
+                    no_build,
+                    ..
+                }),
+        } => {
+            assert_eq!(dir, PathBuf::from("."));
+            assert_eq!(file, PathBuf::from("mcp_traffic.jsonl"));
+            assert_eq!(expect, PathBuf::from("expect.jsonl"));
+            assert!(no_build);
+        }
+        _ => panic!("Expected plugins test command"),
+    }
+}
+
+#[test]
+fn test_plugin_health_commands() {
+    use km::cli::PluginCommands;
+    use km::plugins::health::FailurePolicy;
+
+    let cli = Cli::parse_from(["km", "plugins", "status", "--session", "abc", "--json"]);
+    match cli.command {
+        Commands::Plugins {
+            command: PluginCommands::Status { session, json },
+        } => {
+            assert_eq!(session.as_deref(), Some("abc"));
+            assert!(json);
+        }
+        _ => panic!("Expected plugins status command"),
+    }
+
+    let cli = Cli::parse_from(["km", "plugins", "on-failure", "pii-filter", "closed"]);
+    match cli.command {
+        Commands::Plugins {
+            command: PluginCommands::OnFailure { name, policy },
+        } => {
+            assert_eq!(name, "pii-filter");
+            assert_eq!(policy, FailurePolicy::Closed);
+        }
+        _ => panic!("Expected plugins on-failure command"),
+    }
+    assert!(Cli::try_parse_from(["km", "plugins", "on-failure", "pii-filter", "maybe"]).is_err());
+}
+
+#[test]
+fn test_audit_commands() {
+    use km::cli::AuditCommands;
+
+    let cli = Cli::parse_from(["km", "audit", "export", "--since", "30d", "-o", "out.jsonl"]);
+    match cli.command {
+        Commands::Audit {
+            command:
+                AuditCommands::Export {
+                    session,
+                    since,
+                    output,
+                },
+        } => {
+            assert_eq!(session, None);
+            assert_eq!(since.as_deref(), Some("30d"));
+            assert_eq!(output, PathBuf::from("out.jsonl"));
+        }
+        _ => panic!("Expected audit export command"),
+    }
+
+    let cli = Cli::parse_from(["km", "audit", "verify"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Audit {
+            command: AuditCommands::Verify {
+                file: None,
+                since_export: false,
+                json: false
+            }
+        }
+    ));
+}
+
+#[test]
+fn test_storage_commands() {
+    let cli = Cli::parse_from(["km", "storage", "usage", "--json"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Storage {
+            json: true,
+            command: km::cli::StorageCommands::Usage,
+            ..
+        }
+    ));
+
+    let cli = Cli::parse_from([
+        "km",
+        "storage",
+        "prune",
+        "--max-sessions",
+        "20",
+        "--dry-run",
+        "-f",
+        "other.jsonl",
+    ]);
+    match cli.command {
+        Commands::Storage {
+            file,
+            command:
+                km::cli::StorageCommands::Prune {
+                    max_age_days,
+                    max_size_mb,
+                    max_sessions,
+                    dry_run,
+                },
+            ..
+        } => {
+            assert_eq!(file, PathBuf::from("other.jsonl"));
+            assert_eq!((max_age_days, max_size_mb), (None, None));
+            assert_eq!(max_sessions, Some(20));
+            assert!(dry_run);
+        }
+        _ => panic!("Expected Storage prune command"),
+    }
+}
+
+#[test]
+fn test_status_command() {
+    let cli = Cli::parse_from(["km", "status"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Status {
+            json: false,
+            refresh: false,
+            api: false
+        }
+    ));
+
+    let cli = Cli::parse_from(["km", "status", "--json", "--refresh"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Status {
+            json: true,
+            refresh: true,
+            api: false
+        }
+    ));
+
+    let cli = Cli::parse_from(["km", "status", "--api"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Status {
+            api: true,
+            refresh: false,
+            ..
+        }
+    ));
+    assert!(Cli::try_parse_from(["km", "status", "--api", "--refresh"]).is_err());
+}
+
+#[test]
+fn test_telemetry_commands() {
+    for (arg, expected) in [
+        ("on", km::cli::TelemetryCommands::On),
+        ("off", km::cli::TelemetryCommands::Off),
+        ("status", km::cli::TelemetryCommands::Status),
+    ] {
+        let cli = Cli::parse_from(["km", "telemetry", arg]);
+        match cli.command {
+            Commands::Telemetry { command } => assert_eq!(command, expected),
+            _ => panic!("Expected Telemetry command"),
+        }
+    }
+}
+
+#[test]
+fn test_sessions_recover_command() {
+    let cli = Cli::parse_from(["km", "sessions", "recover", "--dry-run"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Sessions {
+            command: km::cli::SessionsCommands::Recover { dry_run: true },
+            ..
+        }
+    ));
+}
+
+#[test]
+fn test_completion_and_docs_commands() {
+    let cli = Cli::parse_from(["km", "completion", "zsh"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Completion {
+            shell: km::completion::Shell::Zsh
+        }
+    ));
+
+    let cli = Cli::parse_from(["km", "docs", "man", "-o", "km.1"]);
+    match cli.command {
+        Commands::Docs {
+            command: km::cli::DocsCommands::Man { output },
+        } => assert_eq!(output, Some(PathBuf::from("km.1"))),
+        _ => panic!("Expected Docs man command"),
+    }
+
+    let cli = Cli::parse_from(["km", "__complete", "config-keys"]);
+    assert!(matches!(
+        cli.command,
+        Commands::CompleteValues {
+            kind: km::completion::ValueKind::ConfigKeys,
+            ..
+        }
+    ));
+    assert!(Cli::try_parse_from(["km", "completion", "tcsh"]).is_err());
+}
+
+#[test]
+fn test_integrate_commands() {
+    let cli = Cli::parse_from(["km", "integrate", "claude", "--server", "fs", "--dry-run"]);
+    match cli.command {
+        Commands::Integrate { target } => {
+            assert_eq!(target.client, km::clients::ClientKind::ClaudeDesktop);
+            assert_eq!(target.server.as_deref(), Some("fs"));
+            assert!(target.dry_run);
+            assert_eq!(target.file, None);
+        }
+        _ => panic!("Expected Integrate command"),
+    }
+
+    let cli = Cli::parse_from(["km", "unintegrate", "vscode", "--file", "mcp.json"]);
+    match cli.command {
+        Commands::Unintegrate { target } => {
+            assert_eq!(target.client, km::clients::ClientKind::VsCode);
+            assert_eq!(target.file, Some(PathBuf::from("mcp.json")));
+        }
+        _ => panic!("Expected Unintegrate command"),
+    }
+}
+
+#[test]
+fn test_monitor_and_sessions_labels() {
+    let cli = Cli::parse_from([
+        "km",
+        "monitor",
+        "--label",
+        "team=payments",
+        "--label",
+        "env=ci",
+        "--",
+        "server",
+    ]);
+    match cli.command {
+        Commands::Monitor { options, args, .. } => {
+            assert_eq!(
+                options.labels,
+                vec![
+                    ("team".to_string(), "payments".to_string()),
+                    ("env".to_string(), "ci".to_string())
+                ]
+            );
+            assert_eq!(args, vec!["server"]);
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+    assert!(Cli::try_parse_from(["km", "monitor", "--label", "oops", "--", "server"]).is_err());
+
+    let cli = Cli::parse_from(["km", "sessions", "list", "--label", "team=payments"]);
+    match cli.command {
+        Commands::Sessions {
+            command: km::cli::SessionsCommands::List { labels, .. },
+            ..
+        } => assert_eq!(labels.len(), 1),
+        _ => panic!("Expected Sessions list command"),
+    }
+}
+
+#[test]
+fn test_monitor_docker() {
+    let cli = Cli::parse_from([
+        "km",
+        "monitor",
+        "--docker",
+        "mcp/fetch:latest",
+        "--docker-arg=--network=none",
+    ]);
+    match cli.command {
+        Commands::Monitor { options, args, .. } => {
+            assert_eq!(options.docker.as_deref(), Some("mcp/fetch:latest"));
+            assert_eq!(options.docker_args, vec!["--network=none"]);
+            assert!(args.is_empty());
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+
+    let cli = Cli::parse_from(["km", "monitor", "--docker", "mcp/fetch", "--", "--verbose"]);
+    match cli.command {
+        Commands::Monitor { args, .. } => assert_eq!(args, vec!["--verbose"]),
+        _ => panic!("Expected Monitor command"),
+    }
+
+    // Without --docker there has to be a command
+    assert!(Cli::try_parse_from(["km", "monitor"]).is_err());
+    assert!(Cli::try_parse_from(["km", "monitor", "--docker-arg=-v", "--", "server"]).is_err());
+}
+
+#[test]
+fn test_monitor_confirm() {
+    let cli = Cli::parse_from([
+        "km",
+        "monitor",
+        "--confirm",
+        "high-risk",
+        "--confirm-timeout",
+        "30",
+        "--",
+        "server",
+    ]);
+    match cli.command {
+        Commands::Monitor { options, .. } => {
+            assert_eq!(options.confirm.as_deref(), Some("high-risk"));
+            assert_eq!(options.confirm_timeout, Some(30));
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+    // A timeout means nothing without something to confirm
+    assert!(
+        Cli::try_parse_from(["km", "monitor", "--confirm-timeout", "30", "--", "server"]).is_err()
+    );
+
+    let cli = Cli::parse_from(["km", "ctl", "approve", "3"]);
+    match cli.command {
+        Commands::Ctl { command, .. } => {
+            assert_eq!(command, km::cli::CtlCommands::Approve { id: 3 })
+        }
+        _ => panic!("Expected Ctl command"),
+    }
+}
+
+#[test]
+fn test_monitor_metrics_and_ctl_status_verbose() {
+    let cli = Cli::parse_from([
+        "km",
+        "monitor",
+        "--metrics-addr",
+        "127.0.0.1:9090",
+        "--",
+        "server",
+    ]);
+    match cli.command {
+        Commands::Monitor { options, .. } => {
+            assert_eq!(
+                options.metrics_addr,
+                Some("127.0.0.1:9090".parse().unwrap())
+            );
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+    assert!(
+        Cli::try_parse_from(["km", "monitor", "--metrics-addr", "9090", "--", "server"]).is_err()
+    );
+
+    let cli = Cli::parse_from(["km", "ctl", "status", "--verbose"]);
+    match cli.command {
+        Commands::Ctl { command, .. } => {
+            assert_eq!(command, km::cli::CtlCommands::Status { verbose: true })
+        }
+        _ => panic!("Expected Ctl command"),
+    }
+}
+
+#[test]
+fn test_monitor_shutdown_timeout() {
+    let cli = Cli::parse_from(["km", "monitor", "--shutdown-timeout", "15s", "--", "server"]);
+    match cli.command {
+        Commands::Monitor { options, .. } => {
+            assert_eq!(
+                options.shutdown_timeout,
+                Some(std::time::Duration::from_secs(15))
+            );
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+    let cli = Cli::parse_from(["km", "monitor", "--", "server"]);
+    match cli.command {
+        Commands::Monitor { options, .. } => assert_eq!(options.shutdown_timeout, None),
+        _ => panic!("Expected Monitor command"),
+    }
+    assert!(Cli::try_parse_from([
+        "km",
+        "monitor",
+        "--shutdown-timeout",
+        "later",
+        "--",
+        "server"
+    ])
+    .is_err());
+}
+
+#[test]
+fn test_search_command() {
+    let cli = Cli::parse_from([
+        "km",
+        "search",
+        "method:tools/call AND risk>=high",
+        "--json",
+        "-n",
+        "5",
+    ]);
+    match cli.command {
+        Commands::Search {
+            query,
+            file,
+            json,
+            limit,
+        } => {
+            assert_eq!(query, "method:tools/call AND risk>=high");
+            assert_eq!(file, PathBuf::from("mcp_traffic.jsonl"));
+            assert!(json);
+            assert_eq!(limit, Some(5));
+        }
+        _ => panic!("Expected Search command"),
+    }
+    assert!(Cli::try_parse_from(["km", "search"]).is_err());
+}
+
+#[test]
+fn test_tail_command() {
+    let cli = Cli::parse_from(["km", "tail"]);
+    match cli.command {
+        Commands::Tail { session, json } => {
+            assert_eq!(session, None);
+            assert!(!json);
+        }
+        _ => panic!("Expected Tail command"),
+    }
+
+    let cli = Cli::parse_from(["km", "tail", "3f2a", "--json"]);
+    match cli.command {
+        Commands::Tail { session, json } => {
+            assert_eq!(session.as_deref(), Some("3f2a"));
+            assert!(json);
+        }
+        _ => panic!("Expected Tail command"),
+    }
+}
+
+#[test]
+fn test_ctl_command() {
+    let cli = Cli::parse_from(["km", "ctl", "status"]);
+    match cli.command {
+        Commands::Ctl {
+            session,
+            json,
+            command,
+        } => {
+            assert_eq!(session, None);
+            assert!(!json);
+            assert_eq!(command, km::cli::CtlCommands::Status { verbose: false });
+        }
+        _ => panic!("Expected Ctl command"),
+    }
+
+    let cli = Cli::parse_from([
+        "km",
+        "ctl",
+        "filters",
+        "--method",
+        "tools/*",
+        "--payload-size-limit",
+        "4096",
+        "--session",
+        "3f2a",
+        "--json",
+    ]);
+    match cli.command {
+        Commands::Ctl {
+            session,
+            json,
+            command,
+        } => {
+            assert_eq!(session.as_deref(), Some("3f2a"));
+            assert!(json);
+            assert_eq!(
+                command,
+                km::cli::CtlCommands::Filters {
+                    methods: vec!["tools/*".to_string()],
+                    all_methods: false,
+                    payload_size_limit: Some(4096),
+                }
+            );
+        }
+        _ => panic!("Expected Ctl command"),
+    }
+
+    assert!(Cli::try_parse_from([
+        "km",
+        "ctl",
+        "filters",
+        "--all-methods",
+        "--method",
+        "tools/*"
+    ])
+    .is_err());
+}
+
+#[test]
+fn test_rules_command() {
+    let cli = Cli::parse_from(["km", "rules", "update", "exfil"]);
+    match cli.command {
+        Commands::Rules { command } => assert_eq!(
+            command,
+            km::cli::RulesCommands::Update {
+                name: Some("exfil".to_string())
+            }
+        ),
+        _ => panic!("Expected Rules command"),
+    }
+
+    let cli = Cli::parse_from(["km", "rules", "disable", "exfil"]);
+    match cli.command {
+        Commands::Rules { command } => assert_eq!(
+            command,
+            km::cli::RulesCommands::Disable {
+                name: "exfil".to_string()
+            }
+        ),
+        _ => panic!("Expected Rules command"),
+    }
+
+    assert!(Cli::try_parse_from(["km", "rules", "enable"]).is_err());
+}
+
+#[test]
+fn test_tools_command() {
+    let cli = Cli::parse_from(["km", "tools", "list", "3f2a", "--json"]);
+    match cli.command {
+        Commands::Tools { command } => assert_eq!(
+            command,
+            km::cli::ToolsCommands::List {
+                session: "3f2a".to_string(),
+                json: true
+            }
+        ),
+        _ => panic!("Expected Tools command"),
+    }
+
+    assert!(Cli::try_parse_from(["km", "tools", "list"]).is_err());
+}
+
+#[test]
+fn test_monitor_ci_thresholds() {
+    let cli = Cli::parse_from([
+        "km",
+        "monitor",
+        "--ci",
+        "--fail-on",
+        "high-risk>=1,errors>=5",
+        "--fail-on",
+        "policy-violations>=1",
+        "--ci-summary",
+        "km-ci.json",
+        "--",
+        "server",
+    ]);
+    match cli.command {
+        Commands::Monitor { options, .. } => {
+            assert!(options.ci);
+            let thresholds: Vec<String> = options.fail_on.iter().map(|t| t.to_string()).collect();
+            assert_eq!(
+                thresholds,
+                vec!["high-risk>=1", "errors>=5", "policy-violations>=1"]
+            );
+            assert_eq!(options.ci_summary, Some(PathBuf::from("km-ci.json")));
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+    // Thresholds only mean something in CI mode
+    assert!(Cli::try_parse_from(["km", "monitor", "--fail-on", "errors>=1", "--", "s"]).is_err());
+    assert!(
+        Cli::try_parse_from(["km", "monitor", "--ci", "--fail-on", "oops", "--", "s"]).is_err()
+    );
+}
+
+#[test]
+fn test_merge_and_run_id() {
+    let cli = Cli::parse_from([
+        "km",
+        "merge",
+        "a/mcp_traffic.jsonl",
+        "b/export.jsonl",
+        "-o",
+        "run.jsonl",
+        "--run-id",
+        "1234",
+    ]);
+    match cli.command {
+        Commands::Merge {
+            inputs,
+            output,
+            run_id,
+            session,
+        } => {
+            assert_eq!(inputs.len(), 2);
+            assert_eq!(output, PathBuf::from("run.jsonl"));
+            assert_eq!(run_id.as_deref(), Some("1234"));
+            assert_eq!(session, None);
+        }
+        _ => panic!("Expected Merge command"),
+    }
+    assert!(Cli::try_parse_from(["km", "merge", "-o", "run.jsonl"]).is_err());
+
+    let cli = Cli::parse_from(["km", "monitor", "--run-id", "1234", "--", "server"]);
+    match cli.command {
+        Commands::Monitor { options, .. } => assert_eq!(options.run_id.as_deref(), Some("1234")),
+        _ => panic!("Expected Monitor command"),
+    }
+}
+
+#[test]
+fn test_monitor_preset() {
+    let cli = Cli::parse_from(["km", "monitor", "--preset", "prod-audit", "--", "server"]);
+    match cli.command {
+        Commands::Monitor { options, .. } => {
+            assert_eq!(options.preset.as_deref(), Some("prod-audit"))
+        }
+        _ => panic!("Expected Monitor command"),
+    }
+
+    let cli = Cli::parse_from(["km", "presets", "list"]);
+    assert!(matches!(
+        cli.command,
+        Commands::Presets {
+            command: PresetsCommands::List
+        }
+    ));
+}
+
+#[test]
+fn test_explain_and_error_format() {
+    let cli = Cli::parse_from(["km", "explain", "config_not_found"]);
+    assert_eq!(cli.error_format, ErrorFormat::Text);
+    match cli.command {
+        Commands::Explain { code } => assert_eq!(code, Some(Code::ConfigNotFound)),
+        _ => panic!("Expected Explain command"),
+    }
+    assert!(Cli::try_parse_from(["km", "explain", "NO_SUCH_CODE"]).is_err());
+
+    let cli = Cli::parse_from(["km", "status", "--error-format", "json"]);
+    assert_eq!(cli.error_format, ErrorFormat::Json);
+}
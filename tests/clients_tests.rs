@@ -0,0 +1,191 @@
+use km::clients::{self, ClientKind, KmCommand, McpConfig};
+use serde_json::json;
+use std::fs;
+use std::path::PathBuf;
+use tempfile::TempDir;
+
+fn km() -> KmCommand {
+    KmCommand {
+        exe: "/usr/local/bin/km".to_string(),
+        config: PathBuf::from("/home/me/km_config.json"),
+    }
+}
+
+fn claude_config() -> McpConfig {
+    McpConfig::parse(
+        &json!({
+            "globalShortcut": "Ctrl+Space",
+            "mcpServers": {
+                "filesystem": {
+                    "command": "npx",
+                    "args": ["-y", "@modelcontextprotocol/server-filesystem", "/tmp"],
+                    "env": {"DEBUG": "1"}
+                },
+                "remote": {"url": "https://mcp.example.com/sse"}
+            }
+        })
+        .to_string(),
+    )
+    .unwrap()
+}
+
+#[test]
+fn test_detect_finds_installed_clients() {
+    let home = TempDir::new().unwrap();
+    let project = TempDir::new().unwrap();
+    assert!(clients::detect(home.path(), project.path()).is_empty());
+
+    let claude = ClientKind::ClaudeDesktop.config_paths(home.path(), project.path())[0].clone();
+    fs::create_dir_all(claude.parent().unwrap()).unwrap();
+    fs::write(&claude, "{}").unwrap();
+    let cursor = project.path().join(".cursor").join("mcp.json");
+    fs::create_dir_all(cursor.parent().unwrap()).unwrap();
+    fs::write(&cursor, "{}").unwrap();
+
+    let found = clients::detect(home.path(), project.path());
+    assert_eq!(found.len(), 2);
+    assert_eq!(found[0].kind, ClientKind::ClaudeDesktop);
+    assert_eq!(found[0].path, claude);
+    assert_eq!(found[1].kind, ClientKind::Cursor);
+    assert_eq!(found[1].path, cursor);
+}
+
+#[test]
+fn test_wrap_routes_servers_through_km() {
+    let mut config = claude_config();
+    assert_eq!(
+        config.server_names(),
+        vec![("filesystem".to_string(), false)]
+    );
+
+    assert_eq!(config.wrap(&km(), None), vec!["filesystem"]);
+    let doc: serde_json::Value = serde_json::from_str(&config.to_pretty()).unwrap();
+    let server = &doc["mcpServers"]["filesystem"];
+    assert_eq!(server["command"], "/usr/local/bin/km");
+    assert_eq!(
+        server["args"],
+        json!([
+            "--config",
+            "/home/me/km_config.json",
+            "monitor",
+            "--",
+            "npx",
+            "-y",
+            "@modelcontextprotocol/server-filesystem",
+            "/tmp"
+        ])
+    );
+    // Everything else is kept
+    assert_eq!(server["env"]["DEBUG"], "1");
+    assert_eq!(doc["globalShortcut"], "Ctrl+Space");
+    assert_eq!(
+        doc["mcpServers"]["remote"]["url"],
+        "https://mcp.example.com/sse"
+    );
+
+    // Wrapping twice changes nothing
+    assert_eq!(
+        config.server_names(),
+        vec![("filesystem".to_string(), true)]
+    );
+    assert!(config.wrap(&km(), None).is_empty());
+}
+
+#[test]
+fn test_wrap_single_server() {
+    let mut config =
+        McpConfig::parse(r#"{"mcpServers": {"a": {"command": "a"}, "b": {"command": "b"}}}"#)
+            .unwrap();
+    assert_eq!(config.wrap(&km(), Some("b")), vec!["b"]);
+    assert_eq!(
+        config.server_names(),
+        vec![("a".to_string(), false), ("b".to_string(), true)]
+    );
+}
+
+#[test]
+fn test_save_keeps_backup() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("claude_desktop_config.json");
+    let original = r#"{"mcpServers": {"a": {"command": "a"}}}"#;
+    fs::write(&path, original).unwrap();
+
+    let mut config = McpConfig::load(&path).unwrap();
+    config.wrap(&km(), None);
+    let backup = config.save(&path).unwrap();
+
+    assert_eq!(backup, dir.path().join("claude_desktop_config.json.bak"));
+    assert_eq!(fs::read_to_string(&backup).unwrap(), original);
+    assert_eq!(McpConfig::load(&path).unwrap(), config);
+}
+
+#[test]
+fn test_parse_rejects_non_objects() {
+    assert!(McpConfig::parse("[]").is_err());
+    assert!(McpConfig::parse("{").is_err());
+    assert!(McpConfig::parse("").unwrap().server_names().is_empty());
+}
+
+#[test]
+fn test_unwrap_restores_original_command() {
+    let original = claude_config();
+    let mut config = original.clone();
+    config.wrap(&km(), None);
+
+    assert_eq!(config.unwrap(Some("other")), Vec::<String>::new());
+    assert_eq!(config.unwrap(None), vec!["filesystem"]);
+    assert_eq!(config, original);
+    assert!(config.unwrap(None).is_empty());
+
+    // Servers without arguments come back without an empty args list
+    let mut bare = McpConfig::parse(r#"{"mcpServers": {"a": {"command": "a"}}}"#).unwrap();
+    let before = bare.clone();
+    bare.wrap(&km(), None);
+    bare.unwrap(None);
+    assert_eq!(bare, before);
+}
+
+#[test]
+fn test_vscode_servers_section() {
+    let mut config = McpConfig::parse(
+        r#"{"servers": {"git": {"type": "stdio", "command": "uvx", "args": ["mcp-server-git"]}}}"#,
+    )
+    .unwrap();
+    assert!(config.has_server("git"));
+    assert_eq!(config.wrap(&km(), Some("git")), vec!["git"]);
+    let doc: serde_json::Value = serde_json::from_str(&config.to_pretty()).unwrap();
+    assert_eq!(doc["servers"]["git"]["command"], "/usr/local/bin/km");
+    assert_eq!(doc["servers"]["git"]["type"], "stdio");
+    assert!(doc.get("mcpServers").is_none());
+}
+
+#[test]
+fn test_find_config_prefers_project_file() {
+    let home = TempDir::new().unwrap();
+    let project = TempDir::new().unwrap();
+    let err = ClientKind::VsCode
+        .find_config(home.path(), project.path())
+        .unwrap_err();
+    assert!(err.to_string().contains("--file"));
+
+    let workspace = project.path().join(".vscode").join("mcp.json");
+    fs::create_dir_all(workspace.parent().unwrap()).unwrap();
+    fs::write(&workspace, "{}").unwrap();
+    assert_eq!(
+        ClientKind::VsCode
+            .find_config(home.path(), project.path())
+            .unwrap(),
+        workspace
+    );
+}
+
+#[test]
+fn test_diff_marks_changed_lines() {
+    let before = "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n";
+    let after = "a\nb\nc\nd\ne\nF\ng\nh\ni\nj\n";
+    assert_eq!(
+        clients::diff(before, after),
+        "  c\n  d\n  e\n- f\n+ F\n  g\n  h\n  i\n"
+    );
+    assert_eq!(clients::diff("x\n", "x\n"), "");
+}
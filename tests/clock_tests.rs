@@ -0,0 +1,145 @@
+use chrono::{DateTime, Duration, Utc};
+use km::clock;
+use km::merge::{self, Capture, MergeOptions};
+use km::traffic::TrafficEntry;
+use std::net::UdpSocket;
+use std::thread;
+
+fn at(ms: i64) -> DateTime<Utc> {
+    DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+        .unwrap()
+        .with_timezone(&Utc)
+        + Duration::milliseconds(ms)
+}
+
+fn entry(
+    session: &str,
+    wall_ms: i64,
+    elapsed_ms: Option<f64>,
+    offset: Option<&str>,
+) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(wall_ms),
+        direction: "request".to_string(),
+        content: r#"{"jsonrpc":"2.0","id":1,"method":"ping"}"#.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: offset
+            .map(|ms| (clock::OFFSET_LABEL.to_string(), ms.to_string()))
+            .into_iter()
+            .collect(),
+    }
+}
+
+#[test]
+fn test_normalize_follows_the_monotonic_clock() {
+    // The system clock was set back 10s between the second and third message
+    let mut entries = vec![
+        entry("a", 0, Some(0.0), None),
+        entry("a", 1_000, Some(1_000.0), None),
+        entry("a", -8_000, Some(2_000.0), None),
+        entry("old", 500, None, None),
+    ];
+    clock::normalize(&mut entries);
+    assert_eq!(entries[2].timestamp, at(2_000));
+    // Entries without elapsed times keep their wall-clock time
+    assert_eq!(entries[3].timestamp, at(500));
+    assert_eq!(
+        clock::between(&entries[0], &entries[2]),
+        Duration::milliseconds(2_000)
+    );
+}
+
+#[test]
+fn test_normalize_applies_the_ntp_offset_once() {
+    let mut entries = vec![
+        entry("a", 0, Some(0.0), Some("-1500.0")),
+        entry("a", 250, Some(250.5), Some("-1500.0")),
+    ];
+    clock::normalize(&mut entries);
+    assert_eq!(entries[0].timestamp, at(-1_500));
+    assert_eq!(
+        entries[1].timestamp,
+        at(-1_250) + Duration::microseconds(500)
+    );
+    assert!(!entries[1].labels.contains_key(clock::OFFSET_LABEL));
+    assert_eq!(entries[1].labels[clock::CORRECTED_LABEL], "-1500.0");
+
+    let normalized: Vec<DateTime<Utc>> = entries.iter().map(|e| e.timestamp).collect();
+    clock::normalize(&mut entries);
+    let again: Vec<DateTime<Utc>> = entries.iter().map(|e| e.timestamp).collect();
+    assert_eq!(again, normalized);
+}
+
+#[test]
+fn test_merge_corrects_skewed_machines() {
+    // Machine b's clock runs 3s fast, so its first message looks later than
+    // machine a's second one
+    let captures = vec![
+        Capture {
+            name: "a.jsonl".to_string(),
+            entries: vec![
+                entry("a", 0, Some(0.0), Some("0.0")),
+                entry("a", 2_000, Some(2_000.0), Some("0.0")),
+            ],
+        },
+        Capture {
+            name: "b.jsonl".to_string(),
+            entries: vec![entry("b", 4_000, Some(0.0), Some("-3000.0"))],
+        },
+    ];
+    let merged = merge::merge(captures, &MergeOptions::default());
+    let order: Vec<&str> = merged
+        .iter()
+        .map(|e| e.session_id.as_deref().unwrap())
+        .collect();
+    assert_eq!(order, vec!["a", "b", "a"]);
+    assert_eq!(merged[1].timestamp, at(1_000));
+}
+
+/// A 64-bit NTP timestamp for `time`.
+fn ntp_timestamp(time: DateTime<Utc>) -> [u8; 8] {
+    let seconds = (time.timestamp() + 2_208_988_800) as u32;
+    let fraction = (((time.timestamp_subsec_nanos() as u64) << 32) / 1_000_000_000) as u32;
+    let mut bytes = [0u8; 8];
+    bytes[..4].copy_from_slice(&seconds.to_be_bytes());
+    bytes[4..].copy_from_slice(&fraction.to_be_bytes());
+    bytes
+}
+
+#[test]
+fn test_query_estimates_the_offset() {
+    // A server whose clock is 5s ahead of this machine's
+    let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+    let addr = server.local_addr().unwrap();
+    let responder = thread::spawn(move || {
+        let mut request = [0u8; 48];
+        let (_, from) = server.recv_from(&mut request).unwrap();
+        let mut reply = [0u8; 48];
+        reply[0] = 0x24;
+        reply[1] = 2;
+        reply[24..32].copy_from_slice(&request[40..48]);
+        let now = ntp_timestamp(Utc::now() + Duration::seconds(5));
+        reply[32..40].copy_from_slice(&now);
+        reply[40..48].copy_from_slice(&now);
+        server.send_to(&reply, from).unwrap();
+    });
+
+    let sample = clock::query(&addr.to_string(), clock::NTP_TIMEOUT).unwrap();
+    responder.join().unwrap();
+    assert!((sample.offset_ms - 5_000.0).abs() < 250.0, "{:?}", sample);
+    assert!(sample.delay_ms >= 0.0);
+}
+
+#[test]
+fn test_query_without_a_server_fails() {
+    // Nothing answers on this port
+    let socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+    let addr = socket.local_addr().unwrap();
+    drop(socket);
+    assert!(clock::query(&addr.to_string(), std::time::Duration::from_millis(200)).is_err());
+}
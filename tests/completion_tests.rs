@@ -0,0 +1,129 @@
+use clap::CommandFactory;
+use km::cli::Cli;
+use km::completion::{self, Shell, ValueKind};
+use km::manpage;
+use std::fs;
+use std::process::Command;
+use tempfile::TempDir;
+
+fn script(shell: Shell) -> String {
+    completion::generate(shell, &mut Cli::command())
+}
+
+#[test]
+fn test_scripts_cover_command_tree() {
+    for shell in [Shell::Bash, Shell::Zsh, Shell::Fish, Shell::Powershell] {
+        let script = script(shell);
+        for expected in [
+            "km sessions show",
+            "km plugins remove",
+            "--profile",
+            "km __complete sessions",
+            "km __complete plugins",
+            "km __complete profiles",
+            "km __complete config-keys",
+        ] {
+            assert!(
+                script.contains(expected),
+                "{:?} script is missing {}",
+                shell,
+                expected
+            );
+        }
+        // Hidden commands stay hidden
+        assert!(!script.contains("\"km __complete\""), "{:?}", shell);
+        assert!(!script.contains("override-tier"), "{:?}", shell);
+    }
+}
+
+#[test]
+fn test_bash_script_completes() {
+    if Command::new("bash").arg("--version").output().is_err() {
+        return;
+    }
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("km.bash");
+    fs::write(&path, script(Shell::Bash)).unwrap();
+
+    let complete = |words: &str| {
+        let output = Command::new("bash")
+            .arg("-c")
+            .arg(format!(
+                "source {:?}; COMP_WORDS=({}); COMP_CWORD=$((${{#COMP_WORDS[@]}}-1)); _km; echo \"${{COMPREPLY[*]}}\"",
+                path, words
+            ))
+            .output()
+            .unwrap();
+        assert!(output.status.success(), "{:?}", output);
+        String::from_utf8(output.stdout).unwrap().trim().to_string()
+    };
+
+    assert_eq!(complete("km ses"), "sessions");
+    assert_eq!(complete("km -c x.json --profile p plu"), "plugins");
+    assert_eq!(complete("km update --channel ''"), "stable beta");
+    assert!(complete("km sessions ''").contains("show"));
+    assert!(complete("km logs --").contains("--tail"));
+}
+
+#[test]
+fn test_dynamic_values() {
+    let dir = TempDir::new().unwrap();
+    let config = dir.path().join("km_config.json");
+    fs::write(
+        &config,
+        r#"{"api_key": "k", "api_url": "https://api.kilometers.ai",
+            "profiles": {"staging": {}, "prod": {}},
+            "presets": {"ci": {"methods": ["tools/*"]}}}"#,
+    )
+    .unwrap();
+    let log = dir.path().join("mcp_traffic.jsonl");
+    fs::write(
+        &log,
+        r#"{"timestamp":"2026-01-01T00:00:00Z","direction":"request","content":"{}","session_id":"sess-1"}"#,
+    )
+    .unwrap();
+
+    assert_eq!(
+        completion::values(ValueKind::Profiles, &config, &log),
+        vec!["prod", "staging"]
+    );
+    assert_eq!(
+        completion::values(ValueKind::Sessions, &config, &log),
+        vec!["sess-1"]
+    );
+    assert_eq!(
+        completion::values(ValueKind::Presets, &config, &log),
+        vec!["ci", "dev", "forensic", "prod-audit"]
+    );
+    assert!(completion::values(ValueKind::ConfigKeys, &config, &log)
+        .contains(&"update_channel".to_string()));
+
+    // Missing files just mean nothing to offer
+    let missing = dir.path().join("missing");
+    assert!(completion::values(ValueKind::Profiles, &missing, &missing).is_empty());
+    assert!(completion::values(ValueKind::Sessions, &missing, &missing).is_empty());
+}
+
+#[test]
+fn test_man_page() {
+    let page = manpage::render(&mut Cli::command());
+    assert!(page.starts_with(".TH KM 1"));
+    for section in [".SH NAME", ".SH SYNOPSIS", ".SH OPTIONS", ".SH COMMANDS"] {
+        assert!(page.contains(section), "missing {}", section);
+    }
+    assert!(page.contains(".SS km sessions show"));
+    assert!(page.contains(r"\fB\-\-profile\fR"));
+    assert!(!page.contains("__complete"));
+    // No line may start a roff request by accident
+    for line in page.lines() {
+        if line.starts_with('.') {
+            assert!(
+                [".TH", ".SH", ".SS", ".TP", ".PP"]
+                    .iter()
+                    .any(|r| line.starts_with(r)),
+                "stray request: {}",
+                line
+            );
+        }
+    }
+}
@@ -0,0 +1,121 @@
+use km::config::Config;
+use km::config_schema;
+use serde_json::json;
+use std::fs;
+use tempfile::TempDir;
+
+#[test]
+fn test_schema_describes_the_config_structs() {
+    let schema = config_schema::schema();
+    assert_eq!(schema["$schema"], "http://json-schema.org/draft-07/schema#");
+    assert_eq!(schema["additionalProperties"], false);
+
+    let properties = &schema["properties"];
+    assert_eq!(
+        properties["batch_size"],
+        json!({"type": "integer", "minimum": 0})
+    );
+    assert_eq!(properties["log_level"]["type"], json!(["string", "null"]));
+    assert_eq!(
+        properties["update_channel"],
+        json!({"enum": ["stable", "beta"]})
+    );
+    assert_eq!(
+        properties["clock"]["properties"]["ntp"],
+        json!({"type": "boolean"})
+    );
+    assert_eq!(
+        properties["presets"]["additionalProperties"]["properties"]["risk_at_least"],
+        json!({"enum": ["low", "medium", "high", "critical", null]})
+    );
+    assert_eq!(
+        properties["plugin_config"]["additionalProperties"],
+        json!({})
+    );
+    assert_eq!(
+        properties["profiles"]["additionalProperties"],
+        json!({"$ref": "#"})
+    );
+    assert_eq!(
+        properties["sinks"]["items"]["oneOf"]
+            .as_array()
+            .unwrap()
+            .len(),
+        6
+    );
+    assert!(properties.get("$schema").is_some());
+}
+
+#[test]
+fn test_valid_files_have_no_problems() {
+    let config = Config::new("k".to_string(), "https://api.kilometers.ai".to_string());
+    assert!(config_schema::check(&serde_json::to_value(&config).unwrap()).is_empty());
+
+    let file = json!({
+        "$schema": "./config.schema.json",
+        "api_key": "k",
+        "api_url": "https://api.kilometers.ai",
+        "batch_size": 50,
+        "sampling": {"rate": 0.5, "always_keep_risk": "high"},
+        "presets": {"ci": {"methods": ["tools/*"], "risk_at_least": "high"}},
+        "sinks": [
+            {"type": "file", "path": "/var/log/km.jsonl"},
+            {"type": "syslog", "address": "siem:6514", "protocol": "tls", "facility": 16},
+            {"type": "journald"}
+        ],
+        "plugin_config": {"guard": {"anything": [1, "two"]}},
+        "profiles": {"staging": {"api_url": "https://staging.kilometers.ai"}}
+    });
+    assert_eq!(config_schema::check(&file), Vec::<String>::new());
+}
+
+#[test]
+fn test_problems_name_the_setting() {
+    let file = json!({
+        "api_key": "k",
+        "api_url": "https://api.kilometers.ai",
+        "batch_sise": 50,
+        "queue_size": -1,
+        "clock": {"ntp": "yes"},
+        "update_channel": "nightly",
+        "sinks": [{"type": "kafka", "url": "http://rest:8082"}, {"type": "ftp"}],
+        "profiles": {"staging": {"compress_upload": false}}
+    });
+    let mut problems = config_schema::check(&file);
+    problems.sort();
+    assert_eq!(
+        problems,
+        vec![
+            "batch_sise: unknown setting",
+            "clock.ntp: expected boolean, got string",
+            "profiles.staging.compress_upload: unknown setting",
+            "queue_size: must be at least 0",
+            "sinks[0].topic: required",
+            r#"sinks[1].type: must be one of "file", "s3", "kafka", "webhook", "syslog", "journald""#,
+            r#"update_channel: must be one of "stable", "beta""#,
+        ]
+    );
+}
+
+#[test]
+fn test_load_ignores_unknown_settings_but_not_bad_values() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("km_config.json");
+    fs::write(
+        &path,
+        r#"{"api_key": "k", "api_url": "https://api.kilometers.ai", "batch_sise": 5}"#,
+    )
+    .unwrap();
+    assert_eq!(Config::load(&path).unwrap().batch_size, 100);
+
+    fs::write(
+        &path,
+        r#"{"api_key": "k", "api_url": "https://api.kilometers.ai", "batch_size": "5"}"#,
+    )
+    .unwrap();
+    let err = Config::load(&path).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "Failed to parse config file: batch_size: expected integer, got string"
+    );
+}
@@ -13,6 +13,7 @@ fn test_config_creation() {
         api_key: "test-api-key".to_string(),
         api_url: "https://api.kilometers.ai".to_string(),
         default_tier: None,
+        ..Default::default()
     };
     assert_eq!(config.api_key, "test-api-key");
     assert_eq!(config.api_url, "https://api.kilometers.ai");
@@ -28,6 +29,7 @@ fn test_config_save_and_load() {
         api_key: "save-test-key".to_string(),
         api_url: "https://test.api.com".to_string(),
         default_tier: Some("pro".to_string()),
+        ..Default::default()
     };
 
     original_config.save(&config_path).unwrap();
@@ -64,6 +66,7 @@ fn test_config_with_default_tier_none() {
         api_key: "test-key".to_string(),
         api_url: "https://api.test.com".to_string(),
         default_tier: None,
+        ..Default::default()
     };
 
     let json = serde_json::to_string(&config).unwrap();
@@ -86,6 +89,7 @@ fn test_config_load_with_env_file_exists() {
         api_key: "file-key".to_string(),
         api_url: "https://file.api.com".to_string(),
         default_tier: Some("basic".to_string()),
+        ..Default::default()
     };
     original_config.save(&config_path).unwrap();
 
@@ -215,6 +219,7 @@ fn test_config_serialization_pretty() {
         api_key: "test-key".to_string(),
         api_url: "https://api.test.com".to_string(),
         default_tier: Some("pro".to_string()),
+        ..Default::default()
     };
 
     config.save(&config_path).unwrap();
@@ -236,6 +241,7 @@ fn test_config_special_characters() {
         api_key: "key-with-special_chars.123!@#".to_string(),
         api_url: "https://api.test.com:8080/path".to_string(),
         default_tier: Some("tier-1".to_string()),
+        ..Default::default()
     };
 
     config.save(&config_path).unwrap();
@@ -262,6 +268,7 @@ fn test_config_load_with_env_tier_override() {
         api_key: "key".to_string(),
         api_url: "https://api.test.com".to_string(),
         default_tier: Some("free".to_string()),
+        ..Default::default()
     };
     config.save(&config_path).unwrap();
 
@@ -292,6 +299,7 @@ fn test_config_load_with_partial_env_override() {
         api_key: "file-key".to_string(),
         api_url: "https://file.api.com".to_string(),
         default_tier: Some("basic".to_string()),
+        ..Default::default()
     };
     config.save(&config_path).unwrap();
 
@@ -318,6 +326,7 @@ fn test_config_empty_api_key() {
         api_key: "".to_string(),
         api_url: "https://api.test.com".to_string(),
         default_tier: None,
+        ..Default::default()
     };
 
     config.save(&config_path).unwrap();
@@ -336,6 +345,7 @@ fn test_config_very_long_api_key() {
         api_key: long_key.clone(),
         api_url: "https://api.test.com".to_string(),
         default_tier: None,
+        ..Default::default()
     };
 
     config.save(&config_path).unwrap();
@@ -382,3 +392,330 @@ fn test_config_json_with_extra_fields() {
     assert_eq!(config.api_url, "https://api.test.com");
     assert_eq!(config.default_tier, Some("pro".to_string()));
 }
+
+#[test]
+fn test_config_typed_settings_default_and_load() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("typed.json");
+
+    let config = Config::new("key".to_string(), "https://api.test.com".to_string());
+    assert_eq!(config.batch_size, 100);
+    assert_eq!(config.batch_timeout, 5);
+    assert!(config.method_whitelist.is_empty());
+
+    // Defaults are not written out
+    config.save(&config_path).unwrap();
+    let contents = fs::read_to_string(&config_path).unwrap();
+    assert!(!contents.contains("batch_size"));
+    assert!(!contents.contains("method_whitelist"));
+
+    fs::write(
+        &config_path,
+        r#"{
+            "api_key": "key",
+            "api_url": "https://api.test.com",
+            "log_level": "debug",
+            "batch_size": 25,
+            "batch_timeout": 2,
+            "method_whitelist": ["tools/*"],
+            "payload_size_limit": 4096
+        }"#,
+    )
+    .unwrap();
+
+    let loaded = Config::load(&config_path).unwrap();
+    assert_eq!(loaded.batch_size, 25);
+    assert_eq!(loaded.batch_timeout, 2);
+    assert_eq!(loaded.method_whitelist, vec!["tools/*"]);
+    assert_eq!(loaded.payload_size_limit, Some(4096));
+    assert_eq!(loaded.tracing_level(), Some(tracing::Level::DEBUG));
+}
+
+#[test]
+fn test_config_get_and_set() {
+    let mut config = Config::new("key".to_string(), "https://api.test.com".to_string());
+
+    config.set("batch_size", "50").unwrap();
+    config
+        .set("method_whitelist", "tools/call, resources/*")
+        .unwrap();
+    config.set("redaction.enabled", "true").unwrap();
+    config.set("api_url", "https://other.example.com/").unwrap();
+
+    assert_eq!(config.get("batch_size").unwrap(), "50");
+    assert_eq!(
+        config.method_whitelist,
+        vec!["tools/call".to_string(), "resources/*".to_string()]
+    );
+    assert_eq!(config.get("redaction.enabled").unwrap(), "true");
+    assert_eq!(config.get("api_url").unwrap(), "https://other.example.com");
+
+    // Empty clears optional settings
+    config.set("payload_size_limit", "1024").unwrap();
+    config.set("payload_size_limit", "").unwrap();
+    assert_eq!(config.payload_size_limit, None);
+
+    assert!(config.set("batch_size", "lots").is_err());
+    assert!(config.set("redaction.enabled", "maybe").is_err());
+    assert!(config.set("no_such_key", "1").is_err());
+    assert!(config.get("no_such_key").is_err());
+}
+
+#[test]
+fn test_config_validate_reports_every_problem() {
+    let mut config = Config::new("key".to_string(), "https://api.test.com".to_string());
+    assert!(config.validate().is_empty());
+
+    config.api_url = "ftp://nope".to_string();
+    config.log_level = Some("loud".to_string());
+    config.batch_size = 0;
+    config.payload_size_limit = Some(0);
+    config.queue_size = 0;
+    config.risk_scan_budget = 0;
+    config.risk_providers = vec!["oracle".to_string()];
+    config.sampling.rate = 2.0;
+
+    let problems = config.validate();
+    assert_eq!(problems.len(), 8);
+    assert!(problems.iter().any(|p| p.starts_with("api_url")));
+    assert!(problems.iter().any(|p| p.starts_with("log_level")));
+    assert!(problems.iter().any(|p| p.starts_with("batch_size")));
+    assert!(problems.iter().any(|p| p.starts_with("payload_size_limit")));
+    assert!(problems.iter().any(|p| p.starts_with("queue_size")));
+    assert!(problems.iter().any(|p| p.starts_with("risk_scan_budget")));
+    assert!(problems.iter().any(|p| p.starts_with("risk_providers")));
+    assert!(problems.iter().any(|p| p.starts_with("sampling.rate")));
+}
+
+#[test]
+fn test_config_profiles_override_top_level_settings() {
+    let config: Config = serde_json::from_str(
+        r#"{
+            "api_key": "",
+            "api_url": "https://api.kilometers.ai",
+            "batch_size": 500,
+            "sampling": {"rate": 0.5, "keep_errors": false},
+            "profiles": {
+                "staging": {"api_url": "https://staging.kilometers.ai", "sampling": {"rate": 0.1}}
+            }
+        }"#,
+    )
+    .unwrap();
+
+    let staging = config.with_profile(Some("staging")).unwrap();
+    assert_eq!(staging.api_url, "https://staging.kilometers.ai");
+    assert_eq!(staging.batch_size, 500);
+    assert_eq!(staging.sampling.rate, 0.1);
+    assert!(!staging.sampling.keep_errors);
+
+    let top = config.with_profile(None).unwrap();
+    assert_eq!(top.api_url, "https://api.kilometers.ai");
+
+    let err = config.with_profile(Some("prod")).unwrap_err();
+    assert!(err.to_string().contains("Unknown profile 'prod'"));
+    assert!(err.to_string().contains("staging"));
+}
+
+#[test]
+fn test_config_set_in_profile() {
+    let mut config = Config::new(String::new(), "https://api.kilometers.ai".to_string());
+    config.batch_size = 500;
+
+    config
+        .set_in_profile("prod", "api_url", "https://prod.example.com")
+        .unwrap();
+    // Back to the default, which still has to override the top-level 500
+    config.set_in_profile("prod", "batch_size", "100").unwrap();
+    config
+        .set_in_profile("prod", "redaction.enabled", "true")
+        .unwrap();
+
+    assert_eq!(config.batch_size, 500);
+    assert_eq!(config.profiles["prod"]["batch_size"], 100);
+    assert_eq!(config.profiles["prod"]["redaction"]["enabled"], true);
+
+    let prod = config.with_profile(Some("prod")).unwrap();
+    assert_eq!(prod.api_url, "https://prod.example.com");
+    assert_eq!(prod.batch_size, 100);
+    assert!(prod.redaction.enabled);
+
+    assert!(config.set_in_profile("prod", "batch_size", "lots").is_err());
+    assert!(config
+        .set_in_profile("bad name", "batch_size", "1")
+        .is_err());
+    assert!(config.set_in_profile("prod", "api_key", "secret").is_err());
+}
+
+#[test]
+fn test_config_validate_reports_profile_problems() {
+    let mut config = Config::new("key".to_string(), "https://api.test.com".to_string());
+    config
+        .set_in_profile("staging", "api_url", "https://staging.test.com")
+        .unwrap();
+    assert!(config.validate().is_empty());
+
+    config.profiles.get_mut("staging").unwrap()["batch_size"] = serde_json::json!(0);
+    let problems = config.validate();
+    assert_eq!(problems.len(), 1);
+    assert!(problems[0].starts_with("profile 'staging': batch_size"));
+}
+
+#[test]
+fn test_config_load_with_env_applies_profile() {
+    let _lock = ENV_TEST_LOCK.lock().unwrap();
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("test_config.json");
+    env::remove_var("KM_API_KEY");
+    env::remove_var("KM_API_URL");
+
+    let mut config = Config::new("file-key".to_string(), "https://api.test.com".to_string());
+    config
+        .set_in_profile("staging", "api_url", "https://staging.test.com")
+        .unwrap();
+    config.save(&config_path).unwrap();
+
+    env::set_var("KM_PROFILE", "staging");
+    let staging = Config::load_with_env(&config_path);
+    env::set_var("KM_PROFILE", "missing");
+    let missing = Config::load_with_env(&config_path);
+    env::remove_var("KM_PROFILE");
+
+    assert_eq!(staging.unwrap().api_url, "https://staging.test.com");
+    assert!(missing.is_err());
+    assert_eq!(
+        Config::load_with_env(&config_path).unwrap().api_url,
+        "https://api.test.com"
+    );
+}
+
+#[test]
+fn test_config_logging_settings() {
+    let mut config = Config::default();
+    assert_eq!(config.get("logging.file").unwrap(), "true");
+    assert_eq!(config.get("logging.max_file_mb").unwrap(), "10");
+
+    config.set("logging.file", "off").unwrap();
+    config.set("logging.max_age_hours", "0").unwrap();
+    config.set("logging.max_files", "2").unwrap();
+    assert!(!config.logging.file);
+    assert_eq!(config.get("logging.max_age_hours").unwrap(), "0");
+    assert_eq!(config.logging.max_files, 2);
+    assert!(config.set("logging.max_file_mb", "big").is_err());
+
+    let config: Config = serde_json::from_str(
+        r#"{"api_key": "", "api_url": "https://api.kilometers.ai",
+            "logging": {"levels": {"km::uploader": "debug", "km::proxy": "loud"}, "max_file_mb": 0}}"#,
+    )
+    .unwrap();
+    assert!(config.logging.file);
+    let problems = config.validate();
+    assert!(
+        problems
+            .iter()
+            .any(|p| p.starts_with("logging.levels.km::proxy")),
+        "{:?}",
+        problems
+    );
+
+    let mut config = config;
+    config.logging.levels.remove("km::proxy");
+    let problems = config.validate();
+    assert!(!problems.iter().any(|p| p.starts_with("logging.levels")));
+    assert!(problems.contains(&"logging.max_file_mb must be greater than 0".to_string()));
+}
+
+#[test]
+fn test_config_language() {
+    let mut config = Config::default();
+    assert_eq!(config.get("language").unwrap(), "");
+
+    config.set("language", "JA").unwrap();
+    assert_eq!(config.language, Some(km::i18n::Lang::Ja));
+    assert_eq!(serde_json::to_value(&config).unwrap()["language"], "ja");
+    assert!(config.set("language", "fr").is_err());
+    config.set("language", "").unwrap();
+    assert_eq!(config.language, None);
+}
+
+#[test]
+fn test_config_offline() {
+    let mut config = Config::default();
+    assert_eq!(config.get("offline").unwrap(), "false");
+    assert!(!serde_json::to_string(&config).unwrap().contains("offline"));
+    config.set("offline", "true").unwrap();
+    assert!(config.offline);
+    assert_eq!(serde_json::to_value(&config).unwrap()["offline"], true);
+}
+
+#[test]
+fn test_config_entitlement_settings() {
+    let mut config = Config::default();
+    assert_eq!(config.get("entitlements.revalidate_minutes").unwrap(), "60");
+    assert_eq!(
+        config.get("entitlements.offline_grace_hours").unwrap(),
+        "72"
+    );
+    assert!(!serde_json::to_string(&config)
+        .unwrap()
+        .contains("entitlements"));
+
+    config.set("entitlements.revalidate_minutes", "15").unwrap();
+    config
+        .set("entitlements.offline_grace_hours", "12")
+        .unwrap();
+    assert_eq!(config.entitlements.offline_grace_hours, 12);
+    assert_eq!(
+        serde_json::to_value(&config).unwrap()["entitlements"],
+        serde_json::json!({"revalidate_minutes": 15, "offline_grace_hours": 12})
+    );
+    assert!(config.validate().is_empty());
+
+    config
+        .set("entitlements.offline_grace_hours", "1000")
+        .unwrap();
+    let problems = config.validate();
+    assert!(problems.iter().any(|p| p.contains("offline_grace_hours")));
+}
+
+#[test]
+fn test_config_encryption_settings() {
+    let mut config = Config::default();
+    assert_eq!(config.get("encryption.enabled").unwrap(), "false");
+    assert_eq!(config.get("encryption.key_source").unwrap(), "keychain");
+    assert!(!serde_json::to_string(&config)
+        .unwrap()
+        .contains("encryption"));
+
+    config.set("encryption.enabled", "yes").unwrap();
+    config.set("encryption.key_source", "Passphrase").unwrap();
+    assert!(config.encryption.enabled);
+    assert_eq!(
+        config.encryption.key_source,
+        km::encryption::KeySource::Passphrase
+    );
+    assert!(config.set("encryption.key_source", "hsm").is_err());
+    let saved = serde_json::to_value(&config).unwrap();
+    assert_eq!(
+        saved["encryption"],
+        serde_json::json!({"enabled": true, "key_source": "passphrase"})
+    );
+}
+
+#[test]
+fn test_config_retention_settings() {
+    let mut config = Config::default();
+    assert_eq!(config.get("retention.max_age_days").unwrap(), "");
+
+    config.set("retention.max_age_days", "30").unwrap();
+    config.set("retention.max_sessions", "100").unwrap();
+    assert_eq!(config.retention.max_age_days, Some(30));
+    assert_eq!(config.get("retention.max_sessions").unwrap(), "100");
+    assert!(config.set("retention.max_size_mb", "lots").is_err());
+
+    config.set("retention.max_size_mb", "0").unwrap();
+    assert!(config
+        .validate()
+        .contains(&"retention.max_size_mb must be greater than 0".to_string()));
+    config.set("retention.max_size_mb", "").unwrap();
+    assert_eq!(config.retention.max_size_mb, None);
+}
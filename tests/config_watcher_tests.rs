@@ -0,0 +1,65 @@
+use km::config::Config;
+use km::config_watcher::ConfigWatcher;
+use std::sync::mpsc;
+use std::time::Duration;
+use tempfile::TempDir;
+
+fn write_config(path: &std::path::Path, batch_size: usize) {
+    let config = Config {
+        api_key: "watch-test-key".to_string(),
+        api_url: "https://api.kilometers.ai".to_string(),
+        batch_size,
+        ..Default::default()
+    };
+    config.save(path).unwrap();
+}
+
+#[test]
+fn test_watcher_reports_valid_changes() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("config.json");
+    write_config(&config_path, 100);
+
+    let (tx, rx) = mpsc::channel();
+    let watcher = ConfigWatcher::spawn(
+        config_path.clone(),
+        Duration::from_millis(20),
+        move |config| {
+            let _ = tx.send(config.batch_size);
+        },
+    );
+
+    std::thread::sleep(Duration::from_millis(60));
+    write_config(&config_path, 25);
+
+    assert_eq!(rx.recv_timeout(Duration::from_secs(5)).unwrap(), 25);
+    watcher.stop();
+}
+
+#[test]
+fn test_watcher_ignores_invalid_changes() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("config.json");
+    write_config(&config_path, 100);
+
+    let (tx, rx) = mpsc::channel();
+    let watcher = ConfigWatcher::spawn(
+        config_path.clone(),
+        Duration::from_millis(20),
+        move |config| {
+            let _ = tx.send(config.batch_size);
+        },
+    );
+
+    std::thread::sleep(Duration::from_millis(60));
+    std::fs::write(&config_path, "{ not json").unwrap();
+    std::thread::sleep(Duration::from_millis(200));
+    write_config(&config_path, 0);
+    std::thread::sleep(Duration::from_millis(200));
+    write_config(&config_path, 50);
+
+    // Only the last, valid edit gets through
+    assert_eq!(rx.recv_timeout(Duration::from_secs(5)).unwrap(), 50);
+    assert!(rx.try_recv().is_err());
+    watcher.stop();
+}
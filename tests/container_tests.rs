@@ -0,0 +1,48 @@
+use km::container::{DockerRun, SESSION_LABEL};
+use km::traffic::Labels;
+
+#[test]
+fn test_docker_run_command() {
+    let mut run = DockerRun::new(
+        "ghcr.io/acme/mcp-server:1.2",
+        "3f2a9c4e-1b7d-4e0a-9f1c-2d3e4f5a6b7c",
+        vec!["--read-only".to_string()],
+    );
+    run.docker_args = vec!["--network=none".to_string()];
+    run.env = vec!["GITHUB_TOKEN".to_string()];
+    run.labels = Labels::from([("team".to_string(), "payments".to_string())]);
+
+    assert_eq!(run.name, "km-3f2a9c4e1b7d");
+    let session_label = format!("{}=3f2a9c4e-1b7d-4e0a-9f1c-2d3e4f5a6b7c", SESSION_LABEL);
+    assert_eq!(
+        run.command(),
+        vec![
+            "run",
+            "-i",
+            "--rm",
+            "--init",
+            "--name",
+            "km-3f2a9c4e1b7d",
+            "--label",
+            session_label.as_str(),
+            "--label",
+            "ai.kilometers.label.team=payments",
+            // By name only, so the token's value stays off the command line
+            "--env",
+            "GITHUB_TOKEN",
+            "--network=none",
+            "ghcr.io/acme/mcp-server:1.2",
+            "--read-only",
+        ]
+    );
+}
+
+#[test]
+fn test_session_is_labeled_with_the_container() {
+    let run = DockerRun::new("mcp/fetch", "abc-123", Vec::new());
+
+    let labels = run.session_labels();
+    assert_eq!(labels["container.image"], "mcp/fetch");
+    assert_eq!(labels["container.name"], "km-abc123");
+    assert_eq!(run.command().last().map(String::as_str), Some("mcp/fetch"));
+}
@@ -0,0 +1,140 @@
+use base64::{engine::general_purpose::STANDARD, Engine as _};
+use chrono::Utc;
+use km::content::{self, ContentKind, ContentParsers};
+use km::search::{self, Query};
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+
+fn png(width: u32, height: u32) -> Vec<u8> {
+    let mut data = b"\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR".to_vec();
+    data.extend(width.to_be_bytes());
+    data.extend(height.to_be_bytes());
+    data.extend([8, 6, 0, 0, 0]);
+    data
+}
+
+fn read_result(contents: Value) -> Value {
+    json!({"jsonrpc": "2.0", "id": 1, "result": {"contents": contents}})
+}
+
+#[test]
+fn test_describes_images_in_resources_and_tool_results() {
+    let parsers = ContentParsers::default();
+    let resource = read_result(json!([{
+        "uri": "file:///chart.png",
+        "mimeType": "image/png",
+        "blob": STANDARD.encode(png(640, 480))
+    }]));
+    let items = parsers.describe(&resource);
+    assert_eq!(items.len(), 1);
+    assert_eq!(items[0].uri.as_deref(), Some("file:///chart.png"));
+    assert_eq!(items[0].kind, ContentKind::Image);
+    assert_eq!((items[0].width, items[0].height), (Some(640), Some(480)));
+    assert_eq!(items[0].bytes, png(640, 480).len() as u64);
+
+    // Text parts of a tool result aren't embedded content
+    let mut gif = b"GIF89a".to_vec();
+    gif.extend([0x20, 0x00, 0x10, 0x00]);
+    let tool = json!({"jsonrpc": "2.0", "id": 2, "result": {"content": [
+        {"type": "text", "text": "Here is the icon"},
+        {"type": "image", "mimeType": "image/gif", "data": STANDARD.encode(&gif)}
+    ]}});
+    let items = parsers.describe(&tool);
+    assert_eq!(items.len(), 1);
+    assert_eq!((items[0].width, items[0].height), (Some(32), Some(16)));
+
+    // Requests and errors have nothing to describe
+    assert!(parsers
+        .describe(&json!({"jsonrpc": "2.0", "id": 3, "method": "resources/read"}))
+        .is_empty());
+}
+
+#[test]
+fn test_sniffed_type_overrides_the_declared_one() {
+    let items = ContentParsers::default().describe(&read_result(json!([{
+        "uri": "file:///upload.bin",
+        "mimeType": "application/octet-stream",
+        "blob": STANDARD.encode(png(1, 1))
+    }])));
+    assert_eq!(items[0].mime_type, "image/png");
+    assert_eq!(items[0].kind, ContentKind::Image);
+}
+
+#[test]
+fn test_counts_pdf_pages_and_table_rows() {
+    let pdf = "%PDF-1.4\n1 0 obj << /Type /Pages /Count 2 >> endobj\n\
+               2 0 obj << /Type /Page >> endobj\n3 0 obj << /Type/Page >> endobj\n%%EOF";
+    let items = ContentParsers::default().describe(&read_result(json!([
+        {"uri": "file:///report.pdf", "blob": STANDARD.encode(pdf)},
+        {"uri": "file:///orders.csv", "text": "id,item,note\n1,pen,\"red, fine\"\n2,ink,\"two\nlines\"\n"},
+        {"uri": "file:///notes.txt", "mimeType": "text/plain", "text": "a,b\nc,d\n"}
+    ])));
+    assert_eq!(items[0].mime_type, "application/pdf");
+    assert_eq!(items[0].pages, Some(2));
+
+    assert_eq!(items[1].kind, ContentKind::Table);
+    assert_eq!((items[1].rows, items[1].columns), (Some(2), Some(3)));
+
+    // Only tables are counted
+    assert_eq!(items[2].kind, ContentKind::Text);
+    assert_eq!(items[2].rows, None);
+}
+
+#[test]
+fn test_parse_size() {
+    assert_eq!(content::parse_size("5MB"), Ok(5 * 1024 * 1024));
+    assert_eq!(content::parse_size("512kb"), Ok(512 * 1024));
+    assert_eq!(content::parse_size("1.5G"), Ok(3 * 512 * 1024 * 1024));
+    assert_eq!(content::parse_size("100"), Ok(100));
+    assert!(content::parse_size("5 parsecs").is_err());
+    assert!(content::parse_size("MB").is_err());
+}
+
+fn response(content: Value, embedded: Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: Utc::now(),
+        direction: "response".to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("abc-1".to_string()),
+        metadata: [("content".to_string(), embedded)].into_iter().collect(),
+        labels: Default::default(),
+    }
+}
+
+#[test]
+fn test_search_matches_content_kind_and_size() {
+    let large = json!([{"mime_type": "image/png", "kind": "image", "bytes": 6 * 1024 * 1024}]);
+    let small = json!([{"mime_type": "image/jpeg", "kind": "image", "bytes": 2048}]);
+    let table = json!([{"mime_type": "text/csv", "kind": "table", "bytes": 6 * 1024 * 1024, "rows": 90000}]);
+    let entries = vec![
+        response(json!({"jsonrpc": "2.0", "id": 1, "result": {}}), large),
+        response(json!({"jsonrpc": "2.0", "id": 2, "result": {}}), small),
+        response(json!({"jsonrpc": "2.0", "id": 3, "result": {}}), table),
+    ];
+    let ids = |query: &str| -> Vec<u64> {
+        search::search(&entries, &Query::parse(query).unwrap())
+            .iter()
+            .map(|hit| {
+                serde_json::from_str::<Value>(&hit.content).unwrap()["id"]
+                    .as_u64()
+                    .unwrap()
+            })
+            .collect()
+    };
+
+    assert_eq!(sorted(ids("content:image AND content_size>5MB")), vec![1]);
+    assert_eq!(sorted(ids("content:image/*")), vec![1, 2]);
+    assert_eq!(sorted(ids("content_size>=6MB")), vec![1, 3]);
+    assert_eq!(sorted(ids("NOT content:table")), vec![1, 2]);
+    assert!(Query::parse("content_size~5MB").is_err());
+    assert!(Query::parse("content_size>huge").is_err());
+}
+
+fn sorted(mut ids: Vec<u64>) -> Vec<u64> {
+    ids.sort_unstable();
+    ids
+}
@@ -0,0 +1,360 @@
+use anyhow::Result;
+use chrono::Utc;
+use km::approval::{ApprovalGate, PendingApproval};
+use km::control::{
+    self, ControlClient, ControlRequest, ControlServer, FlushOutcome, MonitorControl, MonitorStatus,
+};
+use km::plugins::runtime::{Metadata, PluginAction, PluginHost, PluginInstance, PluginReply};
+use km::proxy::{CaptureSettings, ProxyOptions};
+use km::resources::ResourceSample;
+use km::risk::PatternRiskAnalyzer;
+use km::tail::TailServer;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+use std::sync::atomic::Ordering;
+use std::sync::{Arc, RwLock};
+use std::time::Duration;
+use tempfile::TempDir;
+
+/// A plugin that allows everything, known only by its name.
+#[derive(Debug)]
+struct NamedPlugin(&'static str);
+
+impl PluginInstance for NamedPlugin {
+    fn name(&self) -> &str {
+        self.0
+    }
+
+    fn call(&mut self, _hook: &str, _message: &Value, _metadata: &Metadata) -> Result<PluginReply> {
+        Ok(PluginReply {
+            action: PluginAction::Allow,
+            metadata: Metadata::new(),
+        })
+    }
+
+    fn notify(&mut self, _hook: &str, _message: &Value, _metadata: &Metadata) -> Result<()> {
+        Ok(())
+    }
+}
+
+fn proxy_options() -> ProxyOptions {
+    ProxyOptions {
+        capture: Arc::new(RwLock::new(CaptureSettings::default())),
+        plugins: Some(Arc::new(PluginHost::new(vec![Box::new(NamedPlugin(
+            "guard",
+        ))]))),
+        ..Default::default()
+    }
+}
+
+async fn connect(dir: &TempDir) -> ControlClient {
+    let endpoints = control::running(dir.path()).await;
+    let endpoint = control::resolve(&endpoints, None).unwrap();
+    ControlClient::connect(endpoint).await.unwrap()
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_status_reports_the_running_session() {
+    let dir = TempDir::new().unwrap();
+    let options = proxy_options();
+    options.counts.requests.fetch_add(3, Ordering::Relaxed);
+    options.counts.responses.fetch_add(2, Ordering::Relaxed);
+    options.resources.record(ResourceSample {
+        cpu_percent: 12.5,
+        memory_bytes: 48 * 1024 * 1024,
+    });
+    options.latency.record("tools/call", 20.0);
+    options.latency.record("tools/call", 40.0);
+    options.latency.record("initialize", 5.0);
+    let control = MonitorControl::new(
+        "session-1",
+        vec!["server".to_string(), "--stdio".to_string()],
+        std::path::Path::new("traffic.jsonl"),
+        &options,
+    );
+    let _server = ControlServer::start(dir.path(), control).unwrap();
+
+    let endpoints = control::running(dir.path()).await;
+    assert_eq!(endpoints.len(), 1);
+    assert_eq!(endpoints[0].session_id, "session-1");
+    assert_eq!(endpoints[0].pid, std::process::id());
+
+    let mut client = connect(&dir).await;
+    let status: MonitorStatus =
+        serde_json::from_value(client.request(&ControlRequest::Status).await.unwrap()).unwrap();
+    assert_eq!(status.session_id, "session-1");
+    assert_eq!(status.command, vec!["server", "--stdio"]);
+    assert_eq!((status.requests, status.responses), (3, 2));
+    assert_eq!(status.plugins, vec!["guard"]);
+    assert!(!status.uploads);
+    assert_eq!(
+        status.resources.as_ref().unwrap().memory_bytes_peak,
+        48 << 20
+    );
+    let methods: Vec<(&str, u64)> = status
+        .latency
+        .iter()
+        .map(|m| (m.method.as_str(), m.count))
+        .collect();
+    assert_eq!(methods, vec![("tools/call", 2), ("initialize", 1)]);
+    assert_eq!(status.latency[0].max_ms, 40.0);
+
+    let lines = control::render_status(&status, Utc::now());
+    assert!(lines[0].starts_with("Session:  session-1"));
+    assert!(lines.contains(&"Captured: 3 requests, 2 responses".to_string()));
+    assert!(lines.contains(&"Messages: none".to_string()));
+    assert!(lines.contains(&"Capture:  all methods".to_string()));
+    assert!(lines.contains(&"Plugins:  guard".to_string()));
+    assert!(lines.contains(
+        &"Server:   CPU 12.5% (avg 12.5%, peak 12.5%), memory 48.0 MB (avg 48.0 MB, peak 48.0 MB)"
+            .to_string()
+    ));
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_update_filters_changes_what_the_proxy_captures() {
+    let dir = TempDir::new().unwrap();
+    let options = proxy_options();
+    let capture = options.capture.clone();
+    let control = MonitorControl::new("session-1", Vec::new(), "t.jsonl".as_ref(), &options);
+    let _server = ControlServer::start(dir.path(), control).unwrap();
+    let mut client = connect(&dir).await;
+
+    let result = client
+        .request(&ControlRequest::UpdateFilters {
+            method_whitelist: Some(vec!["tools/*".to_string()]),
+            payload_size_limit: Some(2048),
+        })
+        .await
+        .unwrap();
+    assert_eq!(
+        result,
+        json!({"method_whitelist": ["tools/*"], "payload_size_limit": 2048})
+    );
+    assert!(capture.read().unwrap().captures(Some("tools/call")));
+    assert!(!capture.read().unwrap().captures(Some("ping")));
+
+    // Fields left out are kept; a zero limit removes the limit
+    client
+        .request(&ControlRequest::UpdateFilters {
+            method_whitelist: None,
+            payload_size_limit: Some(0),
+        })
+        .await
+        .unwrap();
+    let settings = capture.read().unwrap().clone();
+    assert_eq!(settings.method_whitelist, vec!["tools/*"]);
+    assert_eq!(settings.payload_size_limit, None);
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_reload_plugins_swaps_in_a_fresh_set() {
+    let dir = TempDir::new().unwrap();
+    let options = proxy_options();
+    let plugins = options.plugins.clone().unwrap();
+    let mut control = MonitorControl::new("session-1", Vec::new(), "t.jsonl".as_ref(), &options);
+    control.plugin_loader = Some(Box::new(|| {
+        Ok(PluginHost::new(vec![
+            Box::new(NamedPlugin("guard")),
+            Box::new(NamedPlugin("audit")),
+        ]))
+    }));
+    let _server = ControlServer::start(dir.path(), control).unwrap();
+    let mut client = connect(&dir).await;
+
+    let result = client
+        .request(&ControlRequest::ReloadPlugins)
+        .await
+        .unwrap();
+    assert_eq!(result, json!({"plugins": ["guard", "audit"]}));
+    assert_eq!(plugins.names(), vec!["guard", "audit"]);
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_requests_that_cant_be_served_return_errors() {
+    let dir = TempDir::new().unwrap();
+    let options = ProxyOptions::default();
+    let control = MonitorControl::new("session-1", Vec::new(), "t.jsonl".as_ref(), &options);
+    let _server = ControlServer::start(dir.path(), control).unwrap();
+    let mut client = connect(&dir).await;
+
+    let err = client
+        .request(&ControlRequest::ReloadPlugins)
+        .await
+        .unwrap_err();
+    assert!(err.to_string().contains("Plugins are disabled"), "{}", err);
+    let err = client
+        .request(&ControlRequest::StreamEvents)
+        .await
+        .unwrap_err();
+    assert!(
+        err.to_string().contains("Event streaming is unavailable"),
+        "{}",
+        err
+    );
+    let mut client = connect(&dir).await;
+    let err = client
+        .request(&ControlRequest::PendingApprovals)
+        .await
+        .unwrap_err();
+    assert!(err.to_string().contains("--confirm"), "{}", err);
+
+    // Without an uploader or spool, flush has nothing to do but still succeeds
+    let mut client = connect(&dir).await;
+    let outcome: FlushOutcome =
+        serde_json::from_value(client.request(&ControlRequest::Flush).await.unwrap()).unwrap();
+    assert_eq!(
+        outcome,
+        FlushOutcome {
+            events: false,
+            spool: None
+        }
+    );
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_held_requests_are_answered_over_ctl() {
+    let dir = TempDir::new().unwrap();
+    let gate = Arc::new(
+        ApprovalGate::new(
+            "high-risk",
+            Duration::from_secs(30),
+            Arc::new(PatternRiskAnalyzer::new()),
+        )
+        .unwrap(),
+    );
+    let options = ProxyOptions {
+        approval: Some(gate.clone()),
+        ..Default::default()
+    };
+    let control = MonitorControl::new("session-1", Vec::new(), "t.jsonl".as_ref(), &options);
+    let _server = ControlServer::start(dir.path(), control).unwrap();
+
+    let request = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+                         "params": {"name": "shell", "arguments": {"cmd": "rm -rf /"}}});
+    let held = std::thread::spawn(move || gate.check(&request, &request.to_string()));
+
+    let mut pending = Vec::new();
+    for _ in 0..100 {
+        let mut client = connect(&dir).await;
+        pending = serde_json::from_value::<Vec<PendingApproval>>(
+            client
+                .request(&ControlRequest::PendingApprovals)
+                .await
+                .unwrap(),
+        )
+        .unwrap();
+        if !pending.is_empty() {
+            break;
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+    }
+    assert_eq!(pending[0].tool.as_deref(), Some("shell"));
+
+    let mut client = connect(&dir).await;
+    let decide = ControlRequest::Decide {
+        id: pending[0].id,
+        approve: true,
+    };
+    client.request(&decide).await.unwrap();
+    assert!(held.join().unwrap().unwrap().approved());
+
+    let mut client = connect(&dir).await;
+    let err = client.request(&decide).await.unwrap_err();
+    assert!(err.to_string().contains("waiting for approval"), "{}", err);
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_flush_wakes_the_uploader() {
+    let dir = TempDir::new().unwrap();
+    let flush = Arc::new(tokio::sync::Notify::new());
+    let mut control = MonitorControl::new(
+        "session-1",
+        Vec::new(),
+        "t.jsonl".as_ref(),
+        &ProxyOptions::default(),
+    );
+    control.upload_flush = Some(flush.clone());
+    let _server = ControlServer::start(dir.path(), control).unwrap();
+    let mut client = connect(&dir).await;
+
+    let outcome: FlushOutcome =
+        serde_json::from_value(client.request(&ControlRequest::Flush).await.unwrap()).unwrap();
+    assert!(outcome.events);
+    tokio::time::timeout(Duration::from_secs(1), flush.notified())
+        .await
+        .expect("uploader was not woken");
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_stream_events_until_the_session_ends() {
+    let dir = TempDir::new().unwrap();
+    let tail = Arc::new(TailServer::start(&dir.path().join("tail"), "session-1").unwrap());
+    let options = ProxyOptions {
+        tail: Some(tail.clone()),
+        ..Default::default()
+    };
+    let control = MonitorControl::new("session-1", Vec::new(), "t.jsonl".as_ref(), &options);
+    let ctl_dir = dir.path().join("ctl");
+    let server = ControlServer::start(&ctl_dir, control).unwrap();
+    drop(options);
+
+    let endpoints = control::running(&ctl_dir).await;
+    let mut client = ControlClient::connect(&endpoints[0]).await.unwrap();
+    client.stream_events().await.unwrap();
+
+    tail.publish(&TrafficEntry {
+        timestamp: Utc::now(),
+        direction: "request".to_string(),
+        content: r#"{"jsonrpc":"2.0","id":1,"method":"ping"}"#.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("session-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    });
+    let line = tokio::time::timeout(Duration::from_secs(5), client.next_event())
+        .await
+        .unwrap()
+        .unwrap()
+        .unwrap();
+    let entry: TrafficEntry = serde_json::from_str(&line).unwrap();
+    assert_eq!(entry.direction, "request");
+
+    drop(server);
+    drop(tail);
+    let end = tokio::time::timeout(Duration::from_secs(5), client.next_event())
+        .await
+        .unwrap();
+    assert!(
+        matches!(end, Ok(None) | Err(_)),
+        "stream ends with the session"
+    );
+    assert!(control::running(&ctl_dir).await.is_empty());
+}
+
+#[tokio::test(flavor = "multi_thread")]
+async fn test_running_cleans_up_finished_sessions() {
+    let dir = TempDir::new().unwrap();
+    let control = MonitorControl::new(
+        "session-1",
+        Vec::new(),
+        "t.jsonl".as_ref(),
+        &ProxyOptions::default(),
+    );
+    let server = ControlServer::start(dir.path(), control).unwrap();
+    let endpoint = control::running(dir.path()).await.remove(0);
+    drop(server);
+
+    // A monitor that crashed leaves its endpoint file behind
+    let path = dir.path().join("session-1.json");
+    std::fs::write(&path, serde_json::to_string(&endpoint).unwrap()).unwrap();
+    assert!(control::running(dir.path()).await.is_empty());
+    assert!(!path.exists());
+    assert!(control::resolve(&[], Some("abc"))
+        .unwrap_err()
+        .to_string()
+        .contains("No running session matches 'abc'"));
+}
@@ -0,0 +1,197 @@
+use chrono::{DateTime, Utc};
+use km::correlation::{self, CallStatus, Correlator, MessageClass, MessageCounts};
+use km::traffic::TrafficEntry;
+use serde_json::json;
+
+fn at(ts: &str) -> DateTime<Utc> {
+    ts.parse().unwrap()
+}
+
+fn entry(ts: &str, direction: &str, content: serde_json::Value, session: &str) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(ts),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+#[test]
+fn test_correlator_pairs_response_with_request() {
+    let mut correlator = Correlator::new();
+    correlator.on_request(
+        &json!({"jsonrpc": "2.0", "id": 7, "method": "tools/call", "params": {}}),
+        Some("session-1"),
+        at("2025-01-01T10:00:00Z"),
+    );
+    assert_eq!(correlator.pending_count(), 1);
+
+    let call = correlator
+        .on_response(
+            &json!({"jsonrpc": "2.0", "id": 7, "result": {"content": []}}),
+            at("2025-01-01T10:00:00.250Z"),
+        )
+        .unwrap();
+
+    assert_eq!(call.method, "tools/call");
+    assert_eq!(call.session_id.as_deref(), Some("session-1"));
+    assert_eq!(call.duration_ms, Some(250.0));
+    assert_eq!(call.status, CallStatus::Success);
+    assert_eq!(correlator.pending_count(), 0);
+}
+
+#[test]
+fn test_correlator_reports_error_status() {
+    let mut correlator = Correlator::new();
+    correlator.on_request(
+        &json!({"jsonrpc": "2.0", "id": "abc", "method": "resources/read"}),
+        None,
+        at("2025-01-01T10:00:00Z"),
+    );
+
+    let call = correlator
+        .on_response(
+            &json!({"jsonrpc": "2.0", "id": "abc", "error": {"code": -32602, "message": "not found"}}),
+            at("2025-01-01T10:00:01Z"),
+        )
+        .unwrap();
+
+    assert_eq!(
+        call.status,
+        CallStatus::Error {
+            code: Some(-32602),
+            message: "not found".to_string()
+        }
+    );
+
+    let serialized = serde_json::to_value(&call).unwrap();
+    assert_eq!(serialized["status"], "error");
+    assert_eq!(serialized["duration_ms"], 1000.0);
+}
+
+#[test]
+fn test_correlator_ignores_notifications_and_unknown_ids() {
+    let mut correlator = Correlator::new();
+    correlator.on_request(
+        &json!({"jsonrpc": "2.0", "method": "notifications/initialized"}),
+        None,
+        at("2025-01-01T10:00:00Z"),
+    );
+    assert_eq!(correlator.pending_count(), 0);
+
+    assert!(correlator
+        .on_response(
+            &json!({"jsonrpc": "2.0", "id": 99, "result": {}}),
+            at("2025-01-01T10:00:00Z"),
+        )
+        .is_none());
+}
+
+#[test]
+fn test_correlate_capture_keeps_sessions_apart() {
+    let entries = vec![
+        entry(
+            "2025-01-01T10:00:00Z",
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize"}),
+            "a",
+        ),
+        entry(
+            "2025-01-01T10:00:01Z",
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}),
+            "b",
+        ),
+        entry(
+            "2025-01-01T10:00:02Z",
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {"tools": []}}),
+            "b",
+        ),
+    ];
+
+    let calls = correlation::correlate(&entries);
+
+    assert_eq!(calls.len(), 2);
+    assert_eq!(calls[0].method, "initialize");
+    assert_eq!(calls[0].status, CallStatus::Pending);
+    assert_eq!(calls[1].method, "tools/list");
+    assert_eq!(calls[1].status, CallStatus::Success);
+    assert_eq!(calls[1].duration_ms, Some(1000.0));
+}
+
+#[test]
+fn test_classify_messages_by_sender_and_shape() {
+    let request = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call"});
+    let notification = json!({"jsonrpc": "2.0", "method": "notifications/progress"});
+    let result = json!({"jsonrpc": "2.0", "id": 1, "result": {}});
+    let error = json!({"jsonrpc": "2.0", "id": 1, "error": {"code": -32601, "message": "nope"}});
+
+    assert_eq!(
+        MessageClass::of(&request, true),
+        MessageClass::ClientRequest
+    );
+    assert_eq!(
+        MessageClass::of(&notification, true),
+        MessageClass::ClientNotification
+    );
+    assert_eq!(
+        MessageClass::of(&result, true),
+        MessageClass::ClientResponse
+    );
+    // Servers ask clients for sampling and roots
+    assert_eq!(
+        MessageClass::of(&request, false),
+        MessageClass::ServerRequest
+    );
+    assert_eq!(
+        MessageClass::of(&notification, false),
+        MessageClass::ServerNotification
+    );
+    assert_eq!(
+        MessageClass::of(&result, false),
+        MessageClass::ServerResponse
+    );
+    assert_eq!(
+        MessageClass::of(&error, false),
+        MessageClass::ServerResponse
+    );
+
+    assert_eq!(
+        MessageClass::of(&json!("plain text"), false),
+        MessageClass::Other
+    );
+    assert_eq!(
+        MessageClass::of(&json!({"id": 1, "method": "x"}), true),
+        MessageClass::Other
+    );
+    assert_eq!(
+        MessageClass::of(&json!({"jsonrpc": "2.0", "id": 1}), false),
+        MessageClass::Other
+    );
+}
+
+#[test]
+fn test_message_counts() {
+    let mut counts = MessageCounts::default();
+    assert_eq!(counts.describe(), "none");
+    counts.add(MessageClass::ClientRequest, 12);
+    counts.add(MessageClass::ServerResponse, 12);
+    counts.add(MessageClass::ServerNotification, 1);
+    counts.add(MessageClass::Other, 2);
+    assert_eq!(counts.get(MessageClass::ClientRequest), 12);
+    assert_eq!(
+        counts.describe(),
+        "12 client requests, 12 server responses, 1 server notification, 2 other"
+    );
+    assert_eq!(
+        serde_json::to_value(counts).unwrap()["server_notifications"],
+        1
+    );
+}
@@ -0,0 +1,209 @@
+use chrono::Utc;
+use km::costs::{self, CostConfig, CostTracker, ModelPrice, SamplingUsage};
+use km::report::{self, ReportFormat, SessionReport};
+use km::risk::PatternRiskAnalyzer;
+use km::sessions;
+use km::traffic::{self, TrafficEntry};
+use km::uploader::{EventUploader, McpEvent};
+use serde_json::{json, Value};
+use std::sync::Arc;
+
+fn sampling_request(id: u64, text: &str) -> Value {
+    json!({
+        "jsonrpc": "2.0",
+        "id": id,
+        "method": "sampling/createMessage",
+        "params": {
+            "systemPrompt": "Be brief.",
+            "messages": [
+                {"role": "user", "content": {"type": "text", "text": text}},
+                {"role": "user", "content": {"type": "image", "data": "aGVsbG8=", "mimeType": "image/png"}}
+            ],
+            "modelPreferences": {"hints": [{"name": "claude-3-5-sonnet"}]},
+            "maxTokens": 200
+        }
+    })
+}
+
+fn sampling_result(id: u64, model: &str, text: &str) -> Value {
+    json!({
+        "jsonrpc": "2.0",
+        "id": id,
+        "result": {
+            "role": "assistant",
+            "content": {"type": "text", "text": text},
+            "model": model,
+            "stopReason": "endTurn"
+        }
+    })
+}
+
+fn pricing() -> CostConfig {
+    CostConfig {
+        pricing: [(
+            "acme-*".to_string(),
+            ModelPrice {
+                input: 1.0,
+                output: 2.0,
+            },
+        )]
+        .into_iter()
+        .collect(),
+    }
+}
+
+#[test]
+fn test_prices_prefer_configured_then_longest_pattern() {
+    let config = pricing();
+    assert_eq!(
+        config.price("ACME-large"),
+        Some(ModelPrice {
+            input: 1.0,
+            output: 2.0
+        })
+    );
+    assert_eq!(config.price("gpt-4o-mini-2024-07-18").unwrap().input, 0.15);
+    assert_eq!(config.price("gpt-4o-2024-08-06").unwrap().input, 2.5);
+    assert!(config.price("mystery-model").is_none());
+
+    // A configured price replaces a built-in one
+    let mut config = pricing();
+    config.pricing.insert(
+        "claude-3-5-sonnet*".to_string(),
+        ModelPrice {
+            input: 0.0,
+            output: 0.0,
+        },
+    );
+    assert_eq!(
+        config.price("claude-3-5-sonnet-20241022").unwrap().output,
+        0.0
+    );
+
+    config.pricing.insert(
+        "broken".to_string(),
+        ModelPrice {
+            input: -1.0,
+            output: 0.0,
+        },
+    );
+    assert!(config.validate().is_err());
+}
+
+#[test]
+fn test_usage_is_reported_or_estimated_from_text() {
+    let request = sampling_request(1, &"x".repeat(391));
+    // 9 characters of system prompt and 391 of text; the image isn't counted
+    let estimated = SamplingUsage::of(
+        &request,
+        &sampling_result(1, "claude-3-5-sonnet-20241022", &"y".repeat(81)),
+    )
+    .unwrap();
+    assert_eq!(estimated.model, "claude-3-5-sonnet-20241022");
+    assert_eq!(estimated.input_tokens, 100);
+    assert_eq!(estimated.output_tokens, 21);
+    assert!(estimated.estimated);
+
+    let mut reported = sampling_result(1, "", "ok");
+    reported["result"]["usage"] = json!({"inputTokens": 1200, "outputTokens": 300});
+    let reported = SamplingUsage::of(&request, &reported).unwrap();
+    // No model in the answer, so the first hint
+    assert_eq!(reported.model, "claude-3-5-sonnet");
+    assert_eq!((reported.input_tokens, reported.output_tokens), (1200, 300));
+    assert!(!reported.estimated);
+
+    let error = json!({"jsonrpc": "2.0", "id": 1, "error": {"code": -1, "message": "declined"}});
+    assert!(SamplingUsage::of(&request, &error).is_none());
+}
+
+#[test]
+fn test_tracker_pairs_server_requests_with_client_answers() {
+    let tracker = CostTracker::new(pricing());
+    // Nothing pending: client responses are ignored without parsing
+    tracker.response(&sampling_result(7, "acme-large", "ignored").to_string());
+    assert!(tracker.snapshot().is_empty());
+
+    for id in [7, 8] {
+        tracker.request(&sampling_request(id, &"x".repeat(3991)).to_string());
+    }
+    tracker.response(&sampling_result(7, "acme-large", &"y".repeat(4000)).to_string());
+    // Answered twice: only the first counts
+    tracker.response(&sampling_result(7, "acme-large", "again").to_string());
+    tracker.response(&sampling_result(8, "mystery-model", "hi").to_string());
+
+    let summary = tracker.snapshot();
+    let acme = &summary.models["acme-large"];
+    assert_eq!(acme.calls, 1);
+    assert_eq!((acme.input_tokens, acme.output_tokens), (1000, 1000));
+    assert_eq!(acme.estimated_calls, 1);
+    assert!((acme.cost_usd.unwrap() - 0.003).abs() < 1e-9);
+    assert!(summary.models["mystery-model"].cost_usd.is_none());
+    assert_eq!(summary.unpriced(), vec!["mystery-model"]);
+    assert!((summary.total_usd() - 0.003).abs() < 1e-9);
+}
+
+fn entry(direction: &str, content: Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: Utc::now(),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("abc-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+#[test]
+fn test_report_shows_sampling_costs() {
+    // The server asks (logged as a response), the client answers (a request)
+    let entries = vec![
+        entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call", "params": {"name": "summarize"}}),
+        ),
+        entry("response", sampling_request(1, "Summarize this")),
+        entry("request", sampling_result(1, "acme-large", "Done.")),
+        entry(
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {"content": []}}),
+        ),
+    ];
+    let summary = costs::summarize(&entries, &traffic::resolve_methods(&entries), &pricing());
+    assert_eq!(summary.models["acme-large"].calls, 1);
+
+    let summaries = sessions::summarize(&entries);
+    let report = SessionReport::build(
+        &entries,
+        &summaries[0],
+        &PatternRiskAnalyzer::new(),
+        &pricing(),
+    );
+    // The tools/call is still paired with its own response
+    assert_eq!(report.methods[0].method, "tools/call");
+    assert_eq!(report.methods[0].unanswered, 0);
+
+    let markdown = report::render(&report, ReportFormat::Md);
+    assert!(markdown.contains("## Sampling"), "{}", markdown);
+    assert!(markdown.contains("| acme-large | 1 | ~6 | ~2 | $0.0000 |"));
+    assert!(markdown.contains("estimated from the text"));
+}
+
+#[tokio::test]
+async fn test_batches_carry_cost_metadata() {
+    let costs = Arc::new(CostTracker::new(pricing()));
+    let uploader = EventUploader::new("token".to_string()).with_costs(costs.clone());
+    let events = vec![McpEvent::new("s", "request", "{}", None, None, None)];
+    let payloads = uploader.batch_payloads(&events, 4096);
+    assert!(payloads[0]["metadata"].get("costs").is_none());
+
+    costs.request(&sampling_request(1, "hello").to_string());
+    costs.response(&sampling_result(1, "acme-large", "hi").to_string());
+    let payloads = uploader.batch_payloads(&events, 4096);
+    let model = &payloads[0]["metadata"]["costs"]["models"]["acme-large"];
+    assert_eq!(model["calls"], 1);
+    assert_eq!(model["estimated_calls"], 1);
+}
@@ -0,0 +1,161 @@
+use km::config::Config;
+use km::credentials::{self, CredentialStore, EncryptedFileStore};
+use std::fs;
+use tempfile::TempDir;
+
+fn file_store(dir: &TempDir, passphrase: &str) -> EncryptedFileStore {
+    EncryptedFileStore::new(
+        dir.path().join(credentials::CREDENTIALS_FILE),
+        passphrase.to_string(),
+    )
+}
+
+#[test]
+fn test_encrypted_file_round_trip() {
+    let dir = TempDir::new().unwrap();
+    let store = file_store(&dir, "correct horse");
+
+    assert_eq!(store.get("km-api-key").unwrap(), None);
+    store.set("km-api-key", "km_live_secret_value").unwrap();
+    store.set("other", "second").unwrap();
+
+    assert_eq!(
+        store.get("km-api-key").unwrap().as_deref(),
+        Some("km_live_secret_value")
+    );
+    assert_eq!(store.get("other").unwrap().as_deref(), Some("second"));
+
+    let path = dir.path().join(credentials::CREDENTIALS_FILE);
+    let contents = fs::read_to_string(&path).unwrap();
+    assert!(!contents.contains("km_live_secret_value"));
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mode = fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o600);
+    }
+
+    store.delete("km-api-key").unwrap();
+    assert_eq!(store.get("km-api-key").unwrap(), None);
+    assert_eq!(store.get("other").unwrap().as_deref(), Some("second"));
+}
+
+#[test]
+fn test_encrypted_file_rejects_wrong_passphrase() {
+    let dir = TempDir::new().unwrap();
+    file_store(&dir, "right")
+        .set("km-api-key", "secret")
+        .unwrap();
+
+    let err = file_store(&dir, "wrong").get("km-api-key").unwrap_err();
+    assert!(err.to_string().contains("Failed to decrypt"));
+}
+
+#[test]
+fn test_migrate_moves_plaintext_key_out_of_config() {
+    let dir = TempDir::new().unwrap();
+    let config_path = dir.path().join("km_config.json");
+    Config::new(
+        "km_live_plaintext".to_string(),
+        "https://api.kilometers.ai".to_string(),
+    )
+    .save(&config_path)
+    .unwrap();
+
+    let open =
+        || -> anyhow::Result<Box<dyn CredentialStore>> { Ok(Box::new(file_store(&dir, "pass"))) };
+    let moved = credentials::migrate_config(&config_path, open).unwrap();
+    assert_eq!(moved, Some("encrypted credentials file"));
+
+    let saved = fs::read_to_string(&config_path).unwrap();
+    assert!(!saved.contains("km_live_plaintext"));
+    assert_eq!(Config::load(&config_path).unwrap().api_key, "");
+    assert_eq!(
+        file_store(&dir, "pass")
+            .get(&credentials::api_key_name(&config_path, None))
+            .unwrap()
+            .as_deref(),
+        Some("km_live_plaintext")
+    );
+
+    // Nothing left to move on the next run
+    assert_eq!(
+        credentials::migrate_config(&config_path, open).unwrap(),
+        None
+    );
+}
+
+#[test]
+fn test_save_config_keeps_key_in_memory() {
+    let dir = TempDir::new().unwrap();
+    let config_path = dir.path().join("km_config.json");
+    let store = file_store(&dir, "pass");
+
+    let mut config = Config::new("km_live_key".to_string(), "https://x.test".to_string());
+    credentials::save_config(&mut config, &config_path, &store).unwrap();
+
+    assert_eq!(config.api_key, "km_live_key");
+    assert_eq!(Config::load(&config_path).unwrap().api_key, "");
+    assert_eq!(
+        Config::load(&config_path).unwrap().api_url,
+        "https://x.test"
+    );
+}
+
+#[test]
+fn test_api_key_names_differ_per_config_file() {
+    let dir = TempDir::new().unwrap();
+    let staging = dir.path().join("staging.json");
+    let prod = dir.path().join("prod.json");
+    assert_ne!(
+        credentials::api_key_name(&staging, None),
+        credentials::api_key_name(&prod, None)
+    );
+    assert!(credentials::api_key_name(&staging, None).starts_with(credentials::API_KEY));
+}
+
+#[test]
+fn test_api_key_name_is_stable_once_config_exists() {
+    let dir = TempDir::new().unwrap();
+    let config_path = dir.path().join("km_config.json");
+    let before = credentials::api_key_name(&config_path, Some("staging"));
+    fs::write(&config_path, "{}").unwrap();
+    assert_eq!(
+        before,
+        credentials::api_key_name(&config_path, Some("staging"))
+    );
+    assert_ne!(before, credentials::api_key_name(&config_path, None));
+}
+
+#[test]
+fn test_migrate_moves_profile_keys() {
+    let dir = TempDir::new().unwrap();
+    let config_path = dir.path().join("km_config.json");
+    fs::write(
+        &config_path,
+        r#"{"api_key": "", "api_url": "https://api.kilometers.ai",
+            "profiles": {"staging": {"api_key": "km_staging", "api_url": "https://staging.test"}}}"#,
+    )
+    .unwrap();
+
+    let open =
+        || -> anyhow::Result<Box<dyn CredentialStore>> { Ok(Box::new(file_store(&dir, "pass"))) };
+    assert!(credentials::migrate_config(&config_path, open)
+        .unwrap()
+        .is_some());
+
+    let config = Config::load(&config_path).unwrap();
+    assert!(config.profiles["staging"].get("api_key").is_none());
+    assert_eq!(
+        config.profiles["staging"]["api_url"],
+        "https://staging.test"
+    );
+    assert_eq!(
+        file_store(&dir, "pass")
+            .get(&credentials::api_key_name(&config_path, Some("staging")))
+            .unwrap()
+            .as_deref(),
+        Some("km_staging")
+    );
+}
@@ -0,0 +1,160 @@
+use chrono::{Duration, Utc};
+use km::dashboard::{self, DashboardStats};
+use km::risk::{PatternRiskAnalyzer, RiskLevel};
+use km::traffic::{TrafficEntry, TrafficFollower};
+use serde_json::json;
+use std::fs::OpenOptions;
+use std::io::Write;
+use tempfile::TempDir;
+
+fn entry(direction: &str, content: serde_json::Value, duration_ms: Option<f64>) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: Utc::now(),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("session-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+#[test]
+fn test_stats_count_messages_by_kind() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let mut stats = DashboardStats::new(Some("session-1".to_string()));
+
+    stats.record(
+        &entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}),
+            None,
+        ),
+        &analyzer,
+    );
+    stats.record(
+        &entry(
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {}}),
+            Some(10.0),
+        ),
+        &analyzer,
+    );
+    stats.record(
+        &entry(
+            "request",
+            json!({"jsonrpc": "2.0", "method": "notifications/initialized"}),
+            None,
+        ),
+        &analyzer,
+    );
+    stats.record(
+        &entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call"}),
+            None,
+        ),
+        &analyzer,
+    );
+    stats.record(
+        &entry(
+            "response",
+            json!({"jsonrpc": "2.0", "id": 2, "error": {"code": -1, "message": "boom"}}),
+            Some(30.0),
+        ),
+        &analyzer,
+    );
+
+    assert_eq!(stats.total, 5);
+    assert_eq!(stats.requests, 2);
+    assert_eq!(stats.responses, 2);
+    assert_eq!(stats.notifications, 1);
+    assert_eq!(stats.errors, 1);
+    assert_eq!(stats.per_method.get("tools/list"), Some(&1));
+    assert_eq!(stats.average_latency_ms(), Some(20.0));
+}
+
+#[test]
+fn test_stats_track_high_risk_events() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let mut stats = DashboardStats::new(None);
+
+    stats.record(
+        &entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call", "params": {"arguments": {"cmd": "rm -rf /"}}}),
+            None,
+        ),
+        &analyzer,
+    );
+
+    assert_eq!(stats.recent_high_risk.len(), 1);
+    assert_eq!(stats.recent_high_risk[0].method, "tools/call");
+    assert!(!stats.risk_histogram.contains_key(&RiskLevel::Low));
+}
+
+#[test]
+fn test_render_lines_shows_quiet_session() {
+    let mut stats = DashboardStats::new(Some("abc".to_string()));
+    stats.last_activity = Some(Utc::now() - Duration::minutes(5));
+
+    let lines = dashboard::render_lines(&stats, Utc::now());
+    assert!(lines[0].contains("session abc"));
+    assert!(lines[0].contains("no traffic for 30s"));
+    assert!(lines.iter().any(|l| l.contains("(no requests yet)")));
+
+    stats.last_activity = Some(Utc::now());
+    let lines = dashboard::render_lines(&stats, Utc::now());
+    assert!(lines[0].contains("traffic in the last 30s"));
+}
+
+#[test]
+fn test_snapshot_uses_latest_session() {
+    let mut old = entry(
+        "request",
+        json!({"jsonrpc": "2.0", "id": 1, "method": "initialize"}),
+        None,
+    );
+    old.session_id = Some("old".to_string());
+    let new = entry(
+        "request",
+        json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}),
+        None,
+    );
+
+    let stats = dashboard::snapshot(&[old, new], None);
+    assert_eq!(stats.session_id.as_deref(), Some("session-1"));
+    assert_eq!(stats.total, 1);
+}
+
+#[test]
+fn test_traffic_follower_reads_appended_lines() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("traffic.jsonl");
+    let mut follower = TrafficFollower::new(path.clone());
+
+    // Missing file yields nothing
+    assert!(follower.poll().unwrap().is_empty());
+
+    let line = serde_json::to_string(&entry(
+        "request",
+        json!({"jsonrpc": "2.0", "id": 1, "method": "ping"}),
+        None,
+    ))
+    .unwrap();
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)
+        .unwrap();
+
+    // A partial line is held back until it is completed
+    write!(file, "{}", &line[..10]).unwrap();
+    assert!(follower.poll().unwrap().is_empty());
+    writeln!(file, "{}", &line[10..]).unwrap();
+    assert_eq!(follower.poll().unwrap().len(), 1);
+    assert!(follower.poll().unwrap().is_empty());
+}
@@ -0,0 +1,132 @@
+use km::config::Config;
+use km::dedup::{DedupConfig, DedupRuleConfig, Deduper};
+use km::uploader::McpEvent;
+use serde_json::{json, Value};
+use std::thread;
+use std::time::Duration;
+
+fn event(direction: &str, message: Value) -> McpEvent {
+    let method = message["method"].as_str().map(String::from);
+    McpEvent::new(
+        "session-1",
+        direction,
+        &message.to_string(),
+        method,
+        None,
+        None,
+    )
+}
+
+fn progress(progress: u64) -> McpEvent {
+    event(
+        "response",
+        json!({
+            "jsonrpc": "2.0",
+            "method": "notifications/progress",
+            "params": {"progressToken": "build", "progress": progress}
+        }),
+    )
+}
+
+fn deduper(window_ms: u64, ignore_params: &[&str]) -> Deduper {
+    Deduper::new(DedupConfig {
+        rules: vec![DedupRuleConfig {
+            methods: vec!["notifications/*".to_string()],
+            window_ms,
+            ignore_params: ignore_params.iter().map(|p| p.to_string()).collect(),
+        }],
+    })
+}
+
+#[test]
+fn test_repeats_collapse_into_the_first_notification() {
+    let dedup = deduper(60_000, &["progress"]);
+
+    let first = progress(1);
+    let first_id = first.id.clone();
+    let mut uploaded = dedup.process(first);
+    for n in 2..=50 {
+        uploaded.extend(dedup.process(progress(n)));
+    }
+    assert!(uploaded.is_empty());
+
+    let uploaded = dedup.flush();
+    assert_eq!(uploaded.len(), 1);
+    assert_eq!(uploaded[0].id, first_id);
+    let repeat = &uploaded[0].metadata["repeat"];
+    assert_eq!(repeat["count"], 50);
+    assert!(repeat["last_at"].as_str() >= repeat["first_at"].as_str());
+
+    let stats = dedup.stats();
+    assert_eq!(stats.collapsed(), 49);
+    assert_eq!(stats.aggregates(), 1);
+}
+
+#[test]
+fn test_a_different_notification_releases_the_run() {
+    let dedup = deduper(60_000, &[]);
+
+    assert!(dedup.process(progress(1)).is_empty());
+    assert!(dedup.process(progress(1)).is_empty());
+
+    // Same method, different params: the run so far goes out
+    let released = dedup.process(progress(2));
+    assert_eq!(released.len(), 1);
+    assert_eq!(released[0].metadata["repeat"]["count"], 2);
+
+    // A run of one is uploaded as it was captured
+    let released = dedup.flush();
+    assert_eq!(released.len(), 1);
+    assert!(!released[0].metadata.contains_key("repeat"));
+}
+
+#[test]
+fn test_requests_and_unmatched_methods_pass_through() {
+    let dedup = deduper(60_000, &[]);
+    let request = json!({"jsonrpc": "2.0", "id": 1, "method": "notifications/odd"});
+
+    assert_eq!(dedup.process(event("request", request.clone())).len(), 1);
+    assert_eq!(dedup.process(event("request", request)).len(), 1);
+    let ping = json!({"jsonrpc": "2.0", "method": "ping"});
+    assert_eq!(dedup.process(event("request", ping.clone())).len(), 1);
+    assert_eq!(dedup.process(event("request", ping)).len(), 1);
+    assert!(dedup.flush().is_empty());
+}
+
+#[test]
+fn test_runs_are_released_once_their_window_passes() {
+    let dedup = deduper(20, &["progress"]);
+
+    assert!(dedup.process(progress(1)).is_empty());
+    assert!(dedup.process(progress(2)).is_empty());
+    assert!(dedup.expired().is_empty());
+
+    thread::sleep(Duration::from_millis(40));
+    let released = dedup.expired();
+    assert_eq!(released.len(), 1);
+    assert_eq!(released[0].metadata["repeat"]["count"], 2);
+
+    // A repeat after the window starts a new run
+    assert!(dedup.process(progress(3)).is_empty());
+    assert_eq!(dedup.flush().len(), 1);
+}
+
+#[test]
+fn test_config_reports_bad_rules() {
+    let mut config = Config::new(
+        "km_test".to_string(),
+        "https://api.kilometers.ai".to_string(),
+    );
+    config.dedup.rules.push(DedupRuleConfig {
+        methods: Vec::new(),
+        window_ms: 0,
+        ignore_params: Vec::new(),
+    });
+
+    let problems = config.validate();
+    assert!(
+        problems.iter().any(|p| p.contains("dedup rule 1")),
+        "{:?}",
+        problems
+    );
+}
@@ -0,0 +1,236 @@
+use km::device_auth::DeviceAuthClient;
+use std::collections::VecDeque;
+use std::sync::{Arc, Mutex};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Canned responses per path, served in order; the last one repeats.
+type Routes = Vec<(&'static str, VecDeque<(u16, String)>)>;
+
+/// Minimal HTTP server answering each path from `routes` and recording the
+/// (path, JSON body) of every request.
+async fn serve(routes: Routes) -> (String, Arc<Mutex<Vec<(String, serde_json::Value)>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let seen = Arc::new(Mutex::new(Vec::new()));
+    let recorder = seen.clone();
+    let routes = Arc::new(Mutex::new(routes));
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut data = Vec::new();
+            let mut buf = vec![0u8; 16 * 1024];
+            let (headers, body_start) = loop {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break (String::new(), 0);
+                }
+                data.extend_from_slice(&buf[..n]);
+                if let Some(pos) = data.windows(4).position(|w| w == b"\r\n\r\n") {
+                    break (
+                        String::from_utf8_lossy(&data[..pos]).to_ascii_lowercase(),
+                        pos + 4,
+                    );
+                }
+            };
+            let length: usize = headers
+                .lines()
+                .find_map(|l| l.strip_prefix("content-length:"))
+                .and_then(|l| l.trim().parse().ok())
+                .unwrap_or(0);
+            while data.len() < body_start + length {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break;
+                }
+                data.extend_from_slice(&buf[..n]);
+            }
+
+            let path = headers
+                .split_whitespace()
+                .nth(1)
+                .unwrap_or_default()
+                .to_string();
+            let body = serde_json::from_slice(&data[body_start..]).unwrap_or_default();
+            recorder.lock().unwrap().push((path.clone(), body));
+
+            let (status, reply) = {
+                let mut routes = routes.lock().unwrap();
+                match routes.iter_mut().find(|(p, _)| *p == path) {
+                    Some((_, replies)) if replies.len() > 1 => replies.pop_front().unwrap(),
+                    Some((_, replies)) => replies[0].clone(),
+                    None => (404, "{}".to_string()),
+                }
+            };
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-type: application/json\r\ncontent-length: {}\r\nconnection: close\r\n\r\n{}",
+                status,
+                reply.len(),
+                reply
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    (format!("http://{}", addr), seen)
+}
+
+fn token_reply(access: &str, refresh: Option<&str>) -> String {
+    serde_json::json!({
+        "token": {
+            "accessToken": access,
+            "accessTokenExpiresAt": "2030-01-01T00:00:00Z",
+            "tokenType": "Bearer",
+            "refreshToken": refresh,
+        }
+    })
+    .to_string()
+}
+
+fn start_reply() -> String {
+    serde_json::json!({
+        "deviceCode": "dev-123",
+        "userCode": "ABCD-EFGH",
+        "verificationUri": "https://app.kilometers.ai/device",
+        "verificationUriComplete": "https://app.kilometers.ai/device?code=ABCD-EFGH",
+        "expiresIn": 30,
+        "interval": 1,
+    })
+    .to_string()
+}
+
+#[tokio::test]
+async fn test_login_polls_until_approved() {
+    let (base, seen) = serve(vec![
+        (
+            "/api/auth/device-code/start",
+            VecDeque::from([(200, start_reply())]),
+        ),
+        (
+            "/api/auth/device-code/poll",
+            VecDeque::from([
+                (400, r#"{"error":"authorization_pending"}"#.to_string()),
+                (200, token_reply("access-1", Some("refresh-1"))),
+            ]),
+        ),
+    ])
+    .await;
+
+    let mut shown = None;
+    let jwt = DeviceAuthClient::new(base)
+        .login(|start| shown = Some(start.user_code.clone()))
+        .await
+        .unwrap();
+
+    assert_eq!(shown.as_deref(), Some("ABCD-EFGH"));
+    assert_eq!(jwt.token, "access-1");
+    assert_eq!(jwt.refresh_token.as_deref(), Some("refresh-1"));
+    // 2030-01-01T00:00:00Z
+    assert_eq!(jwt.expires_at, 1_893_456_000);
+
+    let seen = seen.lock().unwrap();
+    let polls: Vec<_> = seen
+        .iter()
+        .filter(|(path, _)| path == "/api/auth/device-code/poll")
+        .collect();
+    assert_eq!(polls.len(), 2);
+    assert_eq!(polls[0].1["deviceCode"], "dev-123");
+}
+
+#[tokio::test]
+async fn test_login_stops_when_denied() {
+    let (base, _) = serve(vec![
+        (
+            "/api/auth/device-code/start",
+            VecDeque::from([(200, start_reply())]),
+        ),
+        (
+            "/api/auth/device-code/poll",
+            VecDeque::from([(400, r#"{"error":"access_denied"}"#.to_string())]),
+        ),
+    ])
+    .await;
+
+    let err = DeviceAuthClient::new(base).login(|_| {}).await.unwrap_err();
+    assert!(err.to_string().contains("denied"));
+}
+
+#[tokio::test]
+async fn test_refresh_keeps_refresh_token_when_not_rotated() {
+    let (base, seen) = serve(vec![(
+        "/api/auth/token/refresh",
+        VecDeque::from([(200, token_reply("access-2", None))]),
+    )])
+    .await;
+
+    let jwt = DeviceAuthClient::new(base)
+        .refresh("refresh-1")
+        .await
+        .unwrap();
+    assert_eq!(jwt.token, "access-2");
+    assert_eq!(jwt.refresh_token.as_deref(), Some("refresh-1"));
+    assert_eq!(seen.lock().unwrap()[0].1["refreshToken"], "refresh-1");
+}
+
+#[tokio::test]
+async fn test_refresh_fails_on_rejected_token() {
+    let (base, _) = serve(vec![(
+        "/api/auth/token/refresh",
+        VecDeque::from([(401, "{}".to_string())]),
+    )])
+    .await;
+
+    assert!(DeviceAuthClient::new(base).refresh("stale").await.is_err());
+}
+
+#[tokio::test]
+async fn test_revoke_treats_unknown_token_as_revoked() {
+    let (base, seen) = serve(vec![(
+        "/api/auth/token/revoke",
+        VecDeque::from([(200, "{}".to_string()), (500, "{}".to_string())]),
+    )])
+    .await;
+    let client = DeviceAuthClient::new(base.clone());
+
+    client.revoke("refresh-1").await.unwrap();
+    assert!(client.revoke("refresh-1").await.is_err());
+    assert_eq!(seen.lock().unwrap()[0].1["token"], "refresh-1");
+
+    // No revoke endpoint at all answers 404
+    let (other, _) = serve(Vec::new()).await;
+    DeviceAuthClient::new(other).revoke("x").await.unwrap();
+}
+
+#[tokio::test]
+async fn test_refresher_publishes_new_token() {
+    let (base, _) = serve(vec![(
+        "/api/auth/token/refresh",
+        VecDeque::from([(200, token_reply("access-2", Some("refresh-2")))]),
+    )])
+    .await;
+
+    // Already inside the refresh margin, so the refresh happens right away
+    let expiring = km::auth::JwtToken {
+        token: "access-1".to_string(),
+        expires_at: chrono::Utc::now().timestamp() as u64 + 10,
+        claims: Default::default(),
+        refresh_token: Some("refresh-1".to_string()),
+    };
+    let (tx, mut rx) = tokio::sync::watch::channel(expiring.token.clone());
+    let saved = Arc::new(Mutex::new(Vec::new()));
+    let recorder = saved.clone();
+    let handle = DeviceAuthClient::new(base).spawn_refresher(expiring, tx, move |fresh| {
+        recorder
+            .lock()
+            .unwrap()
+            .push(fresh.refresh_token.clone().unwrap_or_default())
+    });
+
+    tokio::time::timeout(std::time::Duration::from_secs(5), rx.changed())
+        .await
+        .unwrap()
+        .unwrap();
+    assert_eq!(*rx.borrow(), "access-2");
+    assert_eq!(saved.lock().unwrap()[0], "refresh-2");
+    handle.abort();
+}
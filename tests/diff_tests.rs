@@ -0,0 +1,224 @@
+use chrono::{DateTime, Duration, Utc};
+use km::diff::{self, SessionProfile};
+use km::risk::{PatternRiskAnalyzer, RiskLevel};
+use km::sessions;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+use std::io::Write;
+
+fn entry(session: &str, seconds: i64, direction: &str, content: Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+            .unwrap()
+            .with_timezone(&Utc)
+            + Duration::seconds(seconds),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+/// A session making `calls` as (tool, arguments, succeeded).
+fn session(id: &str, calls: &[(&str, Value, bool)]) -> Vec<TrafficEntry> {
+    let mut entries = Vec::new();
+    for (i, (tool, arguments, ok)) in calls.iter().enumerate() {
+        let rpc_id = i as i64 + 1;
+        entries.push(entry(
+            id,
+            rpc_id,
+            "request",
+            json!({"jsonrpc": "2.0", "id": rpc_id, "method": "tools/call",
+                   "params": {"name": tool, "arguments": arguments}}),
+        ));
+        let response = if *ok {
+            json!({"jsonrpc": "2.0", "id": rpc_id, "result": {"content": []}})
+        } else {
+            json!({"jsonrpc": "2.0", "id": rpc_id, "error": {"code": -32000, "message": "failed"}})
+        };
+        entries.push(entry(id, rpc_id, "response", response));
+    }
+    entries
+}
+
+fn baseline(id: &str) -> Vec<TrafficEntry> {
+    session(
+        id,
+        &[
+            ("read_file", json!({"path": "a.txt"}), true),
+            ("read_file", json!({"path": "b.txt"}), true),
+            ("list_dir", json!({"path": "."}), true),
+            ("list_dir", json!({"path": "src"}), true),
+        ],
+    )
+}
+
+fn profile(entries: &[TrafficEntry], id: &str) -> SessionProfile {
+    let summaries = sessions::summarize(entries);
+    let session = sessions::resolve(&summaries, id).unwrap();
+    SessionProfile::build(entries, session, &PatternRiskAnalyzer::new())
+}
+
+#[test]
+fn test_shape_keeps_types_not_values() {
+    assert_eq!(
+        diff::shape(&json!({"path": "a.txt", "options": {"recursive": true, "depth": 2}})),
+        "{options: {depth: number, recursive: boolean}, path: string}"
+    );
+    assert_eq!(diff::shape(&json!(["a", "b", 1])), "[number | string]");
+    assert_eq!(diff::shape(&json!([])), "[]");
+    assert_eq!(
+        diff::shape(&json!({"a": {"b": {"c": {"d": 1}}}})),
+        "{a: {b: {c: object}}}"
+    );
+}
+
+#[test]
+fn test_identical_behavior_is_not_drift() {
+    let a = baseline("before");
+    let b = baseline("after");
+    let diff = diff::compare(&profile(&a, "before"), &profile(&b, "after"));
+    assert!(!diff.has_drift(), "{:#?}", diff);
+    assert_eq!(diff.a, "before");
+    assert_eq!(diff.b, "after");
+    assert!(diff::render(&diff)
+        .iter()
+        .any(|l| l.starts_with("  read_file")));
+}
+
+#[test]
+fn test_new_and_removed_tools() {
+    let a = baseline("before");
+    let b = session(
+        "after",
+        &[
+            ("read_file", json!({"path": "a.txt"}), true),
+            ("read_file", json!({"path": "b.txt"}), true),
+            ("shell", json!({"cmd": "rm -rf /tmp/x"}), true),
+        ],
+    );
+    let diff = diff::compare(&profile(&a, "before"), &profile(&b, "after"));
+    assert!(diff.has_drift());
+
+    let shell = diff.tools.iter().find(|t| t.tool == "shell").unwrap();
+    assert_eq!((shell.a, shell.b), (0, 1));
+    assert!(shell.is_drift());
+    let list_dir = diff.tools.iter().find(|t| t.tool == "list_dir").unwrap();
+    assert_eq!((list_dir.a, list_dir.b), (2, 0));
+
+    let lines = diff::render(&diff);
+    assert!(
+        lines.iter().any(|l| l.starts_with("+ shell")),
+        "{:#?}",
+        lines
+    );
+    assert!(
+        lines.iter().any(|l| l.starts_with("- list_dir")),
+        "{:#?}",
+        lines
+    );
+
+    let high = diff
+        .risk
+        .iter()
+        .filter(|r| r.level >= RiskLevel::High)
+        .map(|r| r.b)
+        .sum::<u64>();
+    assert_eq!(high, 1);
+}
+
+#[test]
+fn test_changed_argument_shapes() {
+    let a = baseline("before");
+    let b = session(
+        "after",
+        &[
+            ("read_file", json!({"path": "a.txt"}), true),
+            (
+                "read_file",
+                json!({"path": "b.txt", "encoding": "utf-8"}),
+                true,
+            ),
+            ("list_dir", json!({"path": "."}), true),
+            ("list_dir", json!({"path": "src"}), true),
+        ],
+    );
+    let diff = diff::compare(&profile(&a, "before"), &profile(&b, "after"));
+    let read_file = diff.tools.iter().find(|t| t.tool == "read_file").unwrap();
+    assert_eq!(
+        read_file.new_shapes,
+        vec!["{encoding: string, path: string}"]
+    );
+    assert!(read_file.missing_shapes.is_empty());
+    assert!(diff.has_drift());
+    assert!(diff::render(&diff)
+        .contains(&"    + arguments {encoding: string, path: string}".to_string()));
+}
+
+#[test]
+fn test_error_rate_changes() {
+    let a = baseline("before");
+    let b = session(
+        "after",
+        &[
+            ("read_file", json!({"path": "a.txt"}), false),
+            ("read_file", json!({"path": "b.txt"}), true),
+            ("list_dir", json!({"path": "."}), true),
+            ("list_dir", json!({"path": "src"}), true),
+        ],
+    );
+    let diff = diff::compare(&profile(&a, "before"), &profile(&b, "after"));
+    let calls = &diff.methods[0];
+    assert_eq!(calls.method, "tools/call");
+    assert_eq!(calls.a_error_rate, 0.0);
+    assert_eq!(calls.b_error_rate, 0.25);
+    assert!(calls.is_drift());
+}
+
+#[test]
+fn test_diff_command_exit_status() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let write = |name: &str, entries: Vec<TrafficEntry>| {
+        let path = dir.path().join(name);
+        let mut file = std::fs::File::create(&path).unwrap();
+        for entry in entries {
+            writeln!(file, "{}", serde_json::to_string(&entry).unwrap()).unwrap();
+        }
+        path
+    };
+    let mut entries = baseline("before");
+    entries.extend(baseline("same"));
+    let log = write("traffic.jsonl", entries);
+    let other = write(
+        "upgraded.jsonl",
+        session("after", &[("shell", json!({"cmd": "ls"}), true)]),
+    );
+
+    let km = |args: &[&str]| {
+        std::process::Command::new(env!("CARGO_BIN_EXE_km"))
+            .args(args)
+            .output()
+            .unwrap()
+    };
+    let log = log.to_str().unwrap();
+    let unchanged = km(&["diff", "before", "same", "-f", log]);
+    assert!(unchanged.status.success());
+    assert!(String::from_utf8_lossy(&unchanged.stdout).contains("No behavioral drift found"));
+
+    let drifted = km(&[
+        "diff",
+        "before",
+        "after",
+        "-f",
+        log,
+        "--b-file",
+        other.to_str().unwrap(),
+    ]);
+    assert!(!drifted.status.success());
+    assert!(String::from_utf8_lossy(&drifted.stdout).contains("+ shell"));
+}
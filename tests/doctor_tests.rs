@@ -0,0 +1,245 @@
+use km::config::Config;
+use km::doctor::{self, check_locale, check_server, find_in_path, Check, Status};
+use km::plugins::marketplace::PluginRelease;
+use km::plugins::store::PluginStore;
+use km::plugins::verify::Trust;
+use std::path::{Path, PathBuf};
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal API: answers the health check and accepts only `good-key`.
+async fn serve_api() -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 16 * 1024];
+            let n = socket.read(&mut buf).await.unwrap_or(0);
+            let request = String::from_utf8_lossy(&buf[..n]).into_owned();
+            let path = request.split_whitespace().nth(1).unwrap_or("").to_string();
+
+            let (status, body) = match path.as_str() {
+                "/api/health" => (200, "{}".to_string()),
+                "/api/auth/exchange" if request.contains("good-key") => {
+                    (200, r#"{"jwt":"a.b.c","expiresIn":3600}"#.to_string())
+                }
+                "/api/auth/exchange" => (401, String::new()),
+                _ => (404, String::new()),
+            };
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: {}\r\nconnection: close\r\n\r\n{}",
+                status,
+                body.len(),
+                body
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}", addr)
+}
+
+fn write_config(dir: &TempDir, config: Config) -> PathBuf {
+    let path = dir.path().join("km_config.json");
+    config.save(&path).unwrap();
+    path
+}
+
+fn find<'a>(checks: &'a [Check], name: &str) -> &'a Check {
+    checks
+        .iter()
+        .find(|c| c.name == name)
+        .unwrap_or_else(|| panic!("no {} check in {:?}", name, checks))
+}
+
+#[tokio::test]
+async fn test_doctor_passes_with_working_setup() {
+    let temp_dir = TempDir::new().unwrap();
+    let api_url = serve_api().await;
+    let config_path = write_config(
+        &temp_dir,
+        Config::new("good-key".to_string(), api_url.clone()),
+    );
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let checks = doctor::run(&config_path, &store, None).await;
+    assert_eq!(find(&checks, "Config").status, Status::Ok);
+    assert_eq!(find(&checks, "API").status, Status::Ok);
+    // No version endpoint: an older server, assumed compatible
+    assert_eq!(find(&checks, "API version").status, Status::Ok);
+    assert_eq!(find(&checks, "Authentication").status, Status::Ok);
+    assert_eq!(find(&checks, "Plugins").status, Status::Ok);
+    assert!(checks.iter().all(|c| c.name != "Server"));
+}
+
+#[tokio::test]
+async fn test_doctor_reports_rejected_key() {
+    let temp_dir = TempDir::new().unwrap();
+    let api_url = serve_api().await;
+    let config_path = write_config(&temp_dir, Config::new("bad-key".to_string(), api_url));
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let checks = doctor::run(&config_path, &store, None).await;
+    let auth = find(&checks, "Authentication");
+    assert_eq!(auth.status, Status::Failed);
+    assert!(auth.fix.as_deref().unwrap().contains("km init"));
+}
+
+#[tokio::test]
+async fn test_doctor_reports_unreachable_api_and_skips_auth() {
+    let temp_dir = TempDir::new().unwrap();
+    // Bind and drop a listener to get a port nothing listens on
+    let port = std::net::TcpListener::bind("127.0.0.1:0")
+        .unwrap()
+        .local_addr()
+        .unwrap()
+        .port();
+    let config_path = write_config(
+        &temp_dir,
+        Config::new("good-key".to_string(), format!("http://127.0.0.1:{}", port)),
+    );
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let checks = doctor::run(&config_path, &store, None).await;
+    assert_eq!(find(&checks, "API").status, Status::Failed);
+    assert!(checks.iter().all(|c| c.name != "Authentication"));
+}
+
+#[tokio::test]
+async fn test_doctor_reports_config_problems() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let missing = temp_dir.path().join("missing.json");
+    let checks = doctor::run(&missing, &store, None).await;
+    let config = find(&checks, "Config");
+    assert_eq!(config.status, Status::Warning);
+    assert!(checks.iter().all(|c| c.name != "API"));
+
+    let broken = temp_dir.path().join("broken.json");
+    std::fs::write(&broken, "{ not json").unwrap();
+    let checks = doctor::run(&broken, &store, None).await;
+    assert_eq!(find(&checks, "Config").status, Status::Failed);
+
+    let api_url = serve_api().await;
+    let invalid = write_config(
+        &temp_dir,
+        Config {
+            batch_size: 0,
+            ..Config::new("good-key".to_string(), api_url)
+        },
+    );
+    let checks = doctor::run(&invalid, &store, None).await;
+    let config = find(&checks, "Config");
+    assert_eq!(config.status, Status::Failed);
+    assert!(config.detail.contains("batch_size"));
+}
+
+#[tokio::test]
+async fn test_doctor_reports_modified_plugins() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let release = PluginRelease {
+        name: "audit".to_string(),
+        version: "1.0.0".to_string(),
+        description: String::new(),
+        download_url: None,
+        sha256: None,
+        signature: None,
+        protocol: 1,
+        config_schema: None,
+    };
+    let plugin = store.install(&release, b"original", Trust::Signed).unwrap();
+    std::fs::write(&plugin.path, b"tampered").unwrap();
+
+    let missing = temp_dir.path().join("missing.json");
+    let checks = doctor::run(&missing, &store, None).await;
+    let plugins = find(&checks, "Plugins");
+    assert_eq!(plugins.status, Status::Failed);
+    assert!(plugins.detail.contains("audit"));
+}
+
+#[tokio::test]
+async fn test_doctor_reports_invalid_plugin_settings() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let release = PluginRelease {
+        name: "pii-filter".to_string(),
+        version: "1.0.0".to_string(),
+        description: String::new(),
+        download_url: None,
+        sha256: None,
+        signature: None,
+        protocol: 1,
+        config_schema: Some(serde_json::json!({"required": ["mode"]})),
+    };
+    store.install(&release, b"binary", Trust::Signed).unwrap();
+
+    let missing = temp_dir.path().join("missing.json");
+    let checks = doctor::run(&missing, &store, None).await;
+    let plugins = find(&checks, "Plugins");
+    assert_eq!(plugins.status, Status::Warning);
+    assert!(
+        plugins
+            .detail
+            .contains("pii-filter has invalid settings (mode: required)"),
+        "{}",
+        plugins.detail
+    );
+}
+
+#[test]
+fn test_server_lookup_uses_path() {
+    let temp_dir = TempDir::new().unwrap();
+    let server = temp_dir.path().join("my-mcp-server");
+    std::fs::write(&server, "#!/bin/sh\n").unwrap();
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(&server, std::fs::Permissions::from_mode(0o755)).unwrap();
+    }
+    let path = std::env::join_paths([Path::new("/nonexistent"), temp_dir.path()]).unwrap();
+
+    assert_eq!(
+        find_in_path("my-mcp-server", Some(&path)),
+        Some(server.clone())
+    );
+    assert_eq!(
+        find_in_path(server.to_str().unwrap(), None),
+        Some(server.clone())
+    );
+    assert_eq!(find_in_path("my-mcp-server", None), None);
+    assert_eq!(
+        check_server("my-mcp-server", Some(&path)).status,
+        Status::Ok
+    );
+    assert_eq!(
+        check_server("not-installed", Some(&path)).status,
+        Status::Failed
+    );
+}
+
+#[cfg(unix)]
+#[test]
+fn test_locale_check() {
+    let env = |vars: &'static [(&'static str, &'static str)]| {
+        move |name: &str| {
+            vars.iter()
+                .find(|(k, _)| *k == name)
+                .map(|(_, v)| v.to_string())
+        }
+    };
+
+    assert_eq!(
+        check_locale(env(&[("LANG", "en_US.UTF-8")])).status,
+        Status::Ok
+    );
+    assert_eq!(check_locale(env(&[("LANG", "C.utf8")])).status, Status::Ok);
+    assert_eq!(check_locale(env(&[])).status, Status::Warning);
+    // LC_ALL wins over LANG
+    let check = check_locale(env(&[("LC_ALL", "C"), ("LANG", "en_US.UTF-8")]));
+    assert_eq!(check.status, Status::Warning);
+    assert!(check.detail.contains("LC_ALL=C"));
+}
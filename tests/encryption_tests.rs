@@ -0,0 +1,128 @@
+use km::encryption::{self, PayloadCipher};
+use km::journal::{Interrupted, Journal, JournalStart};
+use km::spool::Spool;
+use km::traffic::{self, TrafficEntry, TrafficFollower};
+use km::uploader::McpEvent;
+use serde_json::json;
+use std::io::Write;
+use std::sync::Arc;
+use tempfile::TempDir;
+
+const KEY: [u8; 32] = [7; 32];
+const SECRET: &str =
+    r#"{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"token":"sk-secret"}}"#;
+
+#[test]
+fn test_seal_and_open_with_a_stored_key() {
+    let cipher = PayloadCipher::from_key(&KEY).unwrap();
+    let sealed = cipher.seal(SECRET).unwrap();
+    assert!(encryption::is_sealed(&sealed));
+    assert!(!encryption::is_sealed(SECRET));
+    assert!(!sealed.contains("sk-secret"));
+    // A fresh nonce every time
+    assert_ne!(cipher.seal(SECRET).unwrap(), sealed);
+    assert_eq!(cipher.open(&sealed).unwrap(), SECRET);
+
+    let other = PayloadCipher::from_key(&[8; 32]).unwrap();
+    assert!(other.open(&sealed).is_err());
+    assert!(cipher.open("km-enc:v1::not base64!").is_err());
+    assert!(cipher.open(SECRET).is_err());
+    assert!(PayloadCipher::from_key(&[1; 16]).is_err());
+}
+
+#[test]
+fn test_passphrase_keys_are_derived_from_the_stored_salt() {
+    let writer = PayloadCipher::from_passphrase("correct horse").unwrap();
+    let sealed = writer.seal(SECRET).unwrap();
+
+    // Another run picks a new salt but can still read what this one wrote
+    let reader = PayloadCipher::from_passphrase("correct horse").unwrap();
+    assert_eq!(reader.open(&sealed).unwrap(), SECRET);
+    let wrong = PayloadCipher::from_passphrase("battery staple").unwrap();
+    assert!(wrong.open(&sealed).is_err());
+
+    let keyed = PayloadCipher::from_key(&KEY).unwrap();
+    let error = keyed.open(&sealed).unwrap_err().to_string();
+    assert!(error.contains(encryption::PASSPHRASE_ENV), "{}", error);
+
+    // One cipher can hold both kinds of key
+    let both = keyed.with_passphrase("correct horse");
+    assert_eq!(both.open(&sealed).unwrap(), SECRET);
+    let from_key = PayloadCipher::from_key(&KEY).unwrap().seal(SECRET).unwrap();
+    let both = reader.with_key(&KEY).unwrap();
+    assert_eq!(both.open(&from_key).unwrap(), SECRET);
+}
+
+/// Reading sealed data goes through the process-wide cipher, so everything
+/// touching it is in this one test.
+#[test]
+fn test_stored_payloads_are_encrypted_and_read_back_transparently() {
+    let cipher = Arc::new(PayloadCipher::from_key(&KEY).unwrap());
+    encryption::install(cipher.clone());
+    let dir = TempDir::new().unwrap();
+
+    // Traffic log
+    let log = dir.path().join("traffic.jsonl");
+    let entry = TrafficEntry {
+        timestamp: chrono::Utc::now(),
+        direction: "request".to_string(),
+        content: cipher.seal(SECRET).unwrap(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("s1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    };
+    let mut file = std::fs::File::create(&log).unwrap();
+    writeln!(file, "{}", serde_json::to_string(&entry).unwrap()).unwrap();
+    let entries = traffic::read_entries(&log).unwrap();
+    assert_eq!(entries[0].content, SECRET);
+    assert_eq!(entries[0].rpc().unwrap()["method"], "tools/call");
+    let followed = TrafficFollower::new(log.clone()).poll().unwrap();
+    assert_eq!(followed[0].content, SECRET);
+
+    // Spool
+    let spool = Spool::new(dir.path().join("spool")).with_cipher(cipher.clone());
+    let payload = json!({"events": [{"payload": "sk-secret"}]});
+    let batch = spool
+        .enqueue("http://localhost/api/events/batch", &payload)
+        .unwrap();
+    let raw = std::fs::read_to_string(dir.path().join("spool").join(format!("{}.json", batch.id)))
+        .unwrap();
+    assert!(!raw.contains("sk-secret"), "{}", raw);
+    // Readable without the spool's own cipher
+    let pending = Spool::new(dir.path().join("spool")).pending().unwrap();
+    assert_eq!(pending[0].payload, payload);
+
+    // Journal
+    let start = JournalStart {
+        session_id: "s1".to_string(),
+        pid: std::process::id(),
+        started_at: chrono::Utc::now(),
+        endpoint: String::new(),
+        command: Vec::new(),
+        labels: Default::default(),
+        redact: false,
+    };
+    let journal = Journal::create(&dir.path().join("journal"), &start)
+        .unwrap()
+        .with_cipher(cipher.clone());
+    let event = McpEvent::new("s1", "request", SECRET, None, None, None);
+    journal.record(&event);
+    let raw = std::fs::read_to_string(journal.path()).unwrap();
+    assert!(!raw.contains("sk-secret"), "{}", raw);
+    let session = Interrupted::read(journal.path()).unwrap();
+    assert_eq!(session.pending[0].id, event.id);
+    assert_eq!(session.pending[0].payload, event.payload);
+
+    // Sealed with a key this process doesn't have
+    let foreign = PayloadCipher::from_key(&[9; 32]).unwrap();
+    let entry = TrafficEntry {
+        content: foreign.seal(SECRET).unwrap(),
+        ..entry
+    };
+    writeln!(file, "{}", serde_json::to_string(&entry).unwrap()).unwrap();
+    assert!(traffic::read_entries(&log).is_err());
+}
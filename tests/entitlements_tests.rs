@@ -0,0 +1,311 @@
+use base64::Engine;
+use chrono::{DateTime, Duration, Utc};
+use ed25519_dalek::{Signer, SigningKey};
+use km::auth::{JwtClaims, JwtToken};
+use km::entitlements::{
+    self, EntitlementSettings, Entitlements, Revalidator, SignedEntitlements, Source, RISK_ANALYSIS,
+};
+use serde_json::{json, Value};
+use std::sync::{Arc, Mutex};
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering `/api/user/features` with whatever
+/// `answer` holds at the time, and 404 for everything else.
+async fn serve(answer: Arc<Mutex<(u16, String)>>) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 16 * 1024];
+            let n = socket.read(&mut buf).await.unwrap_or(0);
+            let request = String::from_utf8_lossy(&buf[..n]).into_owned();
+            let (status, body) = if request.starts_with("GET /api/user/features ") {
+                answer.lock().unwrap().clone()
+            } else {
+                (404, String::new())
+            };
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-type: application/json\r\ncontent-length: {}\r\nconnection: close\r\n\r\n{}",
+                status,
+                body.len(),
+                body
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}", addr)
+}
+
+fn unreachable_url() -> String {
+    let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+    format!("http://{}", listener.local_addr().unwrap())
+}
+
+fn signing_key() -> SigningKey {
+    SigningKey::from_bytes(&[7u8; 32])
+}
+
+fn public_key(key: &SigningKey) -> String {
+    base64::engine::general_purpose::STANDARD.encode(key.verifying_key().to_bytes())
+}
+
+fn sign(key: &SigningKey, tier: &str, features: &[&str], expires_at: DateTime<Utc>) -> Value {
+    let claims = json!({
+        "tier": tier,
+        "features": features,
+        "user_id": "user-1",
+        "expires_at": expires_at,
+    })
+    .to_string();
+    json!({
+        "signature": base64::engine::general_purpose::STANDARD
+            .encode(key.sign(claims.as_bytes()).to_bytes()),
+        "claims": claims,
+    })
+}
+
+fn token(tier: &str) -> JwtToken {
+    JwtToken {
+        token: "test-token".to_string(),
+        expires_at: 0,
+        claims: JwtClaims {
+            sub: Some("user-1".to_string()),
+            tier: Some(tier.to_string()),
+            ..JwtClaims::default()
+        },
+        refresh_token: None,
+    }
+}
+
+#[test]
+fn test_tier_fallback_features() {
+    assert!(!Entitlements::none().has_feature(RISK_ANALYSIS));
+    assert_eq!(Entitlements::none().source, Source::None);
+    assert!(!Entitlements::from_tier("free").has_feature(RISK_ANALYSIS));
+    assert!(Entitlements::from_tier("pro").has_feature(RISK_ANALYSIS));
+
+    let lost = Entitlements::from_tier("free").lost_since(&Entitlements::from_tier("team"));
+    assert_eq!(lost, vec![RISK_ANALYSIS.to_string()]);
+    assert!(Entitlements::from_tier("team")
+        .lost_since(&Entitlements::from_tier("free"))
+        .is_empty());
+}
+
+#[tokio::test]
+async fn test_resolve_caches_until_expiry_or_refresh() {
+    let temp_dir = TempDir::new().unwrap();
+    let cache = temp_dir.path().join("entitlements.json");
+    let answer = Arc::new(Mutex::new((
+        200,
+        r#"{"tier": "pro", "features": ["risk_analysis", "sso"], "ttl_seconds": 600}"#.to_string(),
+    )));
+    let api_url = serve(answer.clone()).await;
+    let token = token("pro");
+    let settings = EntitlementSettings::default();
+
+    let first = entitlements::resolve(&cache, &api_url, Some(&token), false, &settings).await;
+    assert_eq!(first.source, Source::Api);
+    assert_eq!(first.tier, "pro");
+    assert!(first.has_feature("sso"));
+    assert!(first.expires_at > Utc::now() + Duration::seconds(500));
+    assert!(cache.exists());
+
+    // Downgraded on the server; the cached list stands until it expires
+    *answer.lock().unwrap() = (200, r#"{"tier": "free", "features": []}"#.to_string());
+    let cached = entitlements::resolve(&cache, &api_url, Some(&token), false, &settings).await;
+    assert_eq!(cached.source, Source::Cache);
+    assert!(cached.has_feature(RISK_ANALYSIS));
+
+    let refreshed = entitlements::resolve(&cache, &api_url, Some(&token), true, &settings).await;
+    assert_eq!(refreshed.source, Source::Api);
+    assert_eq!(refreshed.tier, "free");
+    assert!(!refreshed.has_feature(RISK_ANALYSIS));
+    assert_eq!(entitlements::load_cached(&cache).unwrap().tier, "free");
+
+    // A cache written for another account is ignored
+    let other = JwtToken {
+        claims: JwtClaims {
+            sub: Some("user-2".to_string()),
+            ..token.claims.clone()
+        },
+        ..token.clone()
+    };
+    *answer.lock().unwrap() = (200, r#"{"tier": "team", "features": ["sso"]}"#.to_string());
+    let theirs = entitlements::resolve(&cache, &api_url, Some(&other), false, &settings).await;
+    assert_eq!(theirs.tier, "team");
+    assert_eq!(theirs.source, Source::Api);
+}
+
+#[tokio::test]
+async fn test_resolve_degrades_without_the_api() {
+    let temp_dir = TempDir::new().unwrap();
+    let cache = temp_dir.path().join("entitlements.json");
+    let token = token("pro");
+    let settings = EntitlementSettings::default();
+
+    // Not signed in: local-only, without asking anyone
+    let local = entitlements::resolve(&cache, "http://unused", None, false, &settings).await;
+    assert_eq!(local.source, Source::None);
+    assert!(local.features.is_empty());
+
+    // Servers without the endpoint: the tier in the token decides
+    let answer = Arc::new(Mutex::new((404, String::new())));
+    let old_server = serve(answer).await;
+    let derived = entitlements::resolve(&cache, &old_server, Some(&token), false, &settings).await;
+    assert_eq!(derived.source, Source::Tier);
+    assert!(derived.has_feature(RISK_ANALYSIS));
+    assert!(!cache.exists());
+
+    // Unreachable: a recently expired list stands in, an old one doesn't
+    let unreachable = unreachable_url();
+    let mut stale = Entitlements::from_tier("team");
+    stale.features.insert("sso".to_string());
+    stale.source = Source::Api;
+    stale.api_url = unreachable.clone();
+    stale.user_id = Some("user-1".to_string());
+    stale.expires_at = Utc::now() - Duration::hours(1);
+    std::fs::write(&cache, serde_json::to_string(&stale).unwrap()).unwrap();
+    let offline = entitlements::resolve(&cache, &unreachable, Some(&token), false, &settings).await;
+    assert_eq!(offline.source, Source::Cache);
+    assert!(offline.has_feature("sso"));
+
+    stale.expires_at = Utc::now() - Duration::days(30);
+    std::fs::write(&cache, serde_json::to_string(&stale).unwrap()).unwrap();
+    let offline = entitlements::resolve(&cache, &unreachable, Some(&token), false, &settings).await;
+    assert_eq!(offline.source, Source::Tier);
+    assert_eq!(offline.tier, "pro");
+    assert!(!offline.has_feature("sso"));
+}
+
+#[tokio::test]
+async fn test_offline_grace_is_configurable() {
+    let temp_dir = TempDir::new().unwrap();
+    let cache = temp_dir.path().join("entitlements.json");
+    let token = token("free");
+    let unreachable = unreachable_url();
+
+    let mut stale = Entitlements::from_tier("team");
+    stale.source = Source::Api;
+    stale.api_url = unreachable.clone();
+    stale.user_id = Some("user-1".to_string());
+    stale.expires_at = Utc::now() - Duration::hours(5);
+    std::fs::write(&cache, serde_json::to_string(&stale).unwrap()).unwrap();
+
+    let mut settings = EntitlementSettings {
+        offline_grace_hours: 6,
+        ..EntitlementSettings::default()
+    };
+    let offline = entitlements::resolve(&cache, &unreachable, Some(&token), false, &settings).await;
+    assert_eq!(offline.source, Source::Cache);
+    assert!(offline.has_feature(RISK_ANALYSIS));
+
+    settings.offline_grace_hours = 4;
+    let offline = entitlements::resolve(&cache, &unreachable, Some(&token), false, &settings).await;
+    assert_eq!(offline.source, Source::Tier);
+    assert!(!offline.has_feature(RISK_ANALYSIS));
+
+    assert_eq!(
+        EntitlementSettings::default().offline_grace(),
+        Duration::hours(72)
+    );
+    settings.offline_grace_hours = 24 * 365;
+    assert!(settings.validate().is_err());
+    settings.offline_grace_hours = 0;
+    settings.revalidate_minutes = 0;
+    assert!(settings.validate().is_ok());
+    assert_eq!(settings.revalidate_interval(), None);
+}
+
+#[tokio::test]
+async fn test_trusted_keys_require_signed_plans() {
+    let temp_dir = TempDir::new().unwrap();
+    let cache = temp_dir.path().join("entitlements.json");
+    let token = token("free");
+    let key = signing_key();
+    let settings = EntitlementSettings {
+        trusted_keys: vec![public_key(&key)],
+        ..EntitlementSettings::default()
+    };
+    let expires_at = Utc::now() + Duration::hours(1);
+
+    // Unsigned answers aren't believed, nor cached
+    let answer = Arc::new(Mutex::new((
+        200,
+        r#"{"tier": "team", "features": ["risk_analysis"]}"#.to_string(),
+    )));
+    let api_url = serve(answer.clone()).await;
+    let unsigned = entitlements::resolve(&cache, &api_url, Some(&token), true, &settings).await;
+    assert_eq!(unsigned.source, Source::Tier);
+    assert!(!unsigned.has_feature(RISK_ANALYSIS));
+    assert!(!cache.exists());
+
+    // Signed ones are, and the plan comes from the token
+    let body = json!({
+        "tier": "enterprise",
+        "features": ["risk_analysis", "sso"],
+        "token": sign(&key, "team", &["risk_analysis"], expires_at),
+    });
+    *answer.lock().unwrap() = (200, body.to_string());
+    let signed = entitlements::resolve(&cache, &api_url, Some(&token), true, &settings).await;
+    assert_eq!(signed.source, Source::Api);
+    assert_eq!(signed.tier, "team");
+    assert!(signed.has_feature(RISK_ANALYSIS));
+    assert!(!signed.has_feature("sso"));
+    assert_eq!(signed.expires_at, expires_at);
+    let token_sent: SignedEntitlements = serde_json::from_value(body["token"].clone()).unwrap();
+    assert_eq!(signed.token, Some(token_sent));
+    let cached = entitlements::resolve(&cache, &api_url, Some(&token), false, &settings).await;
+    assert_eq!(cached.source, Source::Cache);
+    assert_eq!(cached.tier, "team");
+
+    // Tokens signed by another key are refused
+    let other = SigningKey::from_bytes(&[3u8; 32]);
+    let forged = json!({"tier": "team", "token": sign(&other, "team", &["sso"], expires_at)});
+    *answer.lock().unwrap() = (200, forged.to_string());
+    let refused = entitlements::resolve(&cache, &api_url, Some(&token), true, &settings).await;
+    assert_eq!(refused.source, Source::Cache);
+    assert!(!refused.has_feature("sso"));
+
+    // An edited cache no longer matches its token
+    let mut edited = entitlements::load_cached(&cache).unwrap();
+    edited.features.insert("sso".to_string());
+    std::fs::write(&cache, serde_json::to_string(&edited).unwrap()).unwrap();
+    let offline =
+        entitlements::resolve(&cache, &unreachable_url(), Some(&token), false, &settings).await;
+    assert_eq!(offline.source, Source::Tier);
+    assert!(!offline.has_feature("sso"));
+}
+
+#[tokio::test]
+async fn test_revalidator_notices_plan_changes() {
+    let temp_dir = TempDir::new().unwrap();
+    let answer = Arc::new(Mutex::new((
+        200,
+        r#"{"tier": "pro", "features": ["risk_analysis"]}"#.to_string(),
+    )));
+    let api_url = serve(answer.clone()).await;
+    let (tokens_tx, tokens_rx) = tokio::sync::watch::channel("test-token".to_string());
+    let mut revalidator = Revalidator {
+        cache_path: temp_dir.path().join("entitlements.json"),
+        api_url,
+        token: token("pro"),
+        tokens: Some(tokens_rx),
+        settings: EntitlementSettings::default(),
+    };
+
+    let current = Entitlements::from_tier("pro");
+    assert!(revalidator.check(&current).await.is_none());
+
+    // The subscription lapsed; the renewed access token is used
+    *answer.lock().unwrap() = (200, r#"{"tier": "free", "features": []}"#.to_string());
+    tokens_tx.send_replace("renewed-token".to_string());
+    let lapsed = revalidator.check(&current).await.unwrap();
+    assert_eq!(lapsed.tier, "free");
+    assert!(!lapsed.has_feature(RISK_ANALYSIS));
+    assert_eq!(revalidator.token.token, "renewed-token");
+    assert!(revalidator.check(&lapsed).await.is_none());
+}
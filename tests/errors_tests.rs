@@ -0,0 +1,97 @@
+use anyhow::Context;
+use km::errors::{classify, Category, Code, ErrorReport, KmError};
+use reqwest::StatusCode;
+use std::process::Command;
+
+#[test]
+fn test_classify_finds_the_outermost_code() {
+    let error: anyhow::Error = KmError::new(Code::ConfigNotFound, "No configuration").into();
+    assert_eq!(classify(&error), Code::ConfigNotFound);
+
+    let error = error.context("Failed to start");
+    assert_eq!(classify(&error), Code::ConfigNotFound);
+
+    let error = Err::<(), _>(error)
+        .context(KmError::new(Code::AuthFailed, "Failed to authenticate"))
+        .unwrap_err();
+    assert_eq!(classify(&error), Code::AuthFailed);
+
+    assert_eq!(classify(&anyhow::anyhow!("something broke")), Code::Other);
+}
+
+#[test]
+fn test_classify_io_errors() {
+    let refused = std::io::Error::from(std::io::ErrorKind::ConnectionRefused);
+    let error = anyhow::Error::new(refused).context("Failed to reach the API");
+    assert_eq!(classify(&error), Code::TransportUnreachable);
+
+    let timed_out = std::io::Error::from(std::io::ErrorKind::TimedOut);
+    assert_eq!(classify(&timed_out.into()), Code::TransportTimeout);
+
+    let missing = std::io::Error::from(std::io::ErrorKind::NotFound);
+    assert_eq!(classify(&missing.into()), Code::Other);
+}
+
+#[test]
+fn test_codes_for_status() {
+    assert_eq!(
+        Code::for_status(StatusCode::UNAUTHORIZED),
+        Code::AuthRejected
+    );
+    assert_eq!(Code::for_status(StatusCode::FORBIDDEN), Code::AuthRejected);
+    assert_eq!(
+        Code::for_status(StatusCode::TOO_MANY_REQUESTS),
+        Code::ApiRateLimited
+    );
+    assert_eq!(
+        Code::for_status(StatusCode::BAD_GATEWAY),
+        Code::ApiUnavailable
+    );
+    assert_eq!(Code::for_status(StatusCode::NOT_FOUND), Code::ApiError);
+
+    assert_eq!(Code::AuthRejected.category(), Category::Auth);
+    assert_eq!(Code::ApiRateLimited.category().as_str(), "api");
+    assert_eq!(Code::PluginUntrusted.to_string(), "PLUGIN_UNTRUSTED");
+}
+
+#[test]
+fn test_error_report_json() {
+    let error = Err::<(), _>(std::io::Error::from(std::io::ErrorKind::NotFound))
+        .context(KmError::new(
+            Code::ConfigNotFound,
+            "Failed to read config file",
+        ))
+        .unwrap_err();
+    let report = serde_json::to_value(ErrorReport::new(&error)).unwrap();
+    assert_eq!(report["code"], "CONFIG_NOT_FOUND");
+    assert!(report["message"]
+        .as_str()
+        .unwrap()
+        .starts_with("Failed to read config file: "));
+    assert_eq!(report["hint"], Code::ConfigNotFound.hint());
+}
+
+#[test]
+fn test_error_format_json_from_the_binary() {
+    let dir = tempfile::tempdir().unwrap();
+    let config = dir.path().join("missing.json");
+    let output = Command::new(env!("CARGO_BIN_EXE_km"))
+        .arg("--config")
+        .arg(&config)
+        .args(["--error-format", "json", "config", "get", "batch_size"])
+        .output()
+        .unwrap();
+    assert!(!output.status.success());
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    let report: serde_json::Value = serde_json::from_str(stderr.lines().last().unwrap()).unwrap();
+    assert_eq!(report["code"], "CONFIG_NOT_FOUND");
+    assert!(report["hint"].as_str().unwrap().contains("km init"));
+
+    let explain = Command::new(env!("CARGO_BIN_EXE_km"))
+        .args(["explain", "config_not_found"])
+        .output()
+        .unwrap();
+    assert!(explain.status.success());
+    let stdout = String::from_utf8_lossy(&explain.stdout);
+    assert!(stdout.starts_with("CONFIG_NOT_FOUND (config error)"));
+}
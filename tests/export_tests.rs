@@ -0,0 +1,169 @@
+use km::cli::ExportOptions;
+use km::export::{self, ExportFilter, ExportFormat};
+use km::handlers::handle_export;
+use km::traffic::{self, TrafficEntry};
+use std::fs;
+use std::path::{Path, PathBuf};
+use tempfile::TempDir;
+
+fn write_traffic_log(dir: &Path) -> PathBuf {
+    let log_file = dir.join("traffic.jsonl");
+    let lines = [
+        r#"{"timestamp":"2025-01-01T10:00:00Z","direction":"request","content":"{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"tools/list\"}","session_id":"session-a"}"#,
+        r#"{"timestamp":"2025-01-01T10:00:01Z","direction":"response","content":"{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{\"tools\":[]}}","duration_ms":12.5,"session_id":"session-a"}"#,
+        r#"{"timestamp":"2025-01-02T09:00:00Z","direction":"request","content":"{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"resources/read\"}","session_id":"session-b"}"#,
+        r#"{"timestamp":"2025-01-02T09:00:02Z","direction":"response","content":"{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{\"contents\":[]}}","duration_ms":30.0,"session_id":"session-b"}"#,
+        "not json",
+    ];
+    fs::write(&log_file, lines.join("\n")).unwrap();
+    log_file
+}
+
+#[test]
+fn test_method_matches_globs() {
+    assert!(traffic::method_matches("tools/*", "tools/call"));
+    assert!(traffic::method_matches("*/list", "resources/list"));
+    assert!(traffic::method_matches("*", "initialize"));
+    assert!(traffic::method_matches("initialize", "initialize"));
+    assert!(!traffic::method_matches("tools/*", "resources/read"));
+    assert!(!traffic::method_matches("tools/call", "tools/list"));
+}
+
+#[test]
+fn test_parse_time_bound_formats() {
+    assert!(traffic::parse_time_bound("2025-01-01T10:00:00Z").is_ok());
+    assert!(traffic::parse_time_bound("2025-01-01").is_ok());
+    assert!(traffic::parse_time_bound("24h").is_ok());
+    assert!(traffic::parse_time_bound("yesterday").is_err());
+}
+
+#[test]
+fn test_parse_duration() {
+    use std::time::Duration;
+    assert_eq!(traffic::parse_duration("15s"), Ok(Duration::from_secs(15)));
+    assert_eq!(traffic::parse_duration("2m"), Ok(Duration::from_secs(120)));
+    assert_eq!(traffic::parse_duration("30"), Ok(Duration::from_secs(30)));
+    assert!(traffic::parse_duration("-5s").is_err());
+    assert!(traffic::parse_duration("soon").is_err());
+}
+
+#[test]
+fn test_read_entries_skips_malformed_lines() {
+    let temp_dir = TempDir::new().unwrap();
+    let log_file = write_traffic_log(temp_dir.path());
+
+    let entries = traffic::read_entries(&log_file).unwrap();
+    assert_eq!(entries.len(), 4);
+}
+
+#[test]
+fn test_collect_records_resolves_response_methods() {
+    let temp_dir = TempDir::new().unwrap();
+    let entries: Vec<TrafficEntry> =
+        traffic::read_entries(&write_traffic_log(temp_dir.path())).unwrap();
+
+    let filter = ExportFilter {
+        method: Some("tools/*".to_string()),
+        ..Default::default()
+    };
+    let records = export::collect_records(&entries, &filter);
+
+    assert_eq!(records.len(), 2);
+    assert_eq!(records[1].direction, "response");
+    assert_eq!(records[1].method.as_deref(), Some("tools/list"));
+    assert_eq!(records[1].duration_ms, Some(12.5));
+}
+
+#[test]
+fn test_collect_records_filters_by_session_and_time() {
+    let temp_dir = TempDir::new().unwrap();
+    let entries = traffic::read_entries(&write_traffic_log(temp_dir.path())).unwrap();
+
+    let by_session = ExportFilter {
+        session_id: Some("session-b".to_string()),
+        ..Default::default()
+    };
+    assert_eq!(export::collect_records(&entries, &by_session).len(), 2);
+
+    let by_time = ExportFilter {
+        since: Some(traffic::parse_time_bound("2025-01-01T10:00:01Z").unwrap()),
+        until: Some(traffic::parse_time_bound("2025-01-02T09:00:00Z").unwrap()),
+        ..Default::default()
+    };
+    assert_eq!(export::collect_records(&entries, &by_time).len(), 2);
+}
+
+#[test]
+fn test_write_csv_escapes_content() {
+    let temp_dir = TempDir::new().unwrap();
+    let entries = traffic::read_entries(&write_traffic_log(temp_dir.path())).unwrap();
+    let records = export::collect_records(&entries, &ExportFilter::default());
+
+    let mut out = Vec::new();
+    export::write_csv(&records, &mut out).unwrap();
+    let csv = String::from_utf8(out).unwrap();
+
+    let mut lines = csv.lines();
+    assert_eq!(
+        lines.next().unwrap(),
+        "timestamp,session_id,direction,method,rpc_id,duration_ms,payload_size,content"
+    );
+    assert!(csv.contains(r#""{""jsonrpc"":""2.0"""#));
+    assert_eq!(csv.lines().count(), 5);
+}
+
+#[test]
+fn test_export_format_from_path() {
+    assert_eq!(
+        ExportFormat::from_path(Path::new("out.jsonl")),
+        Some(ExportFormat::Jsonl)
+    );
+    assert_eq!(
+        ExportFormat::from_path(Path::new("out.CSV")),
+        Some(ExportFormat::Csv)
+    );
+    assert_eq!(
+        ExportFormat::from_path(Path::new("out.parquet")),
+        Some(ExportFormat::Parquet)
+    );
+    assert_eq!(ExportFormat::from_path(Path::new("out.txt")), None);
+}
+
+#[test]
+fn test_handle_export_writes_jsonl() {
+    let temp_dir = TempDir::new().unwrap();
+    let log_file = write_traffic_log(temp_dir.path());
+    let output = temp_dir.path().join("export.jsonl");
+
+    let result = handle_export(
+        log_file,
+        output.clone(),
+        None,
+        ExportOptions {
+            session: Some("session-a".to_string()),
+            ..Default::default()
+        },
+    );
+    assert!(result.is_ok());
+
+    let contents = fs::read_to_string(&output).unwrap();
+    assert_eq!(contents.lines().count(), 2);
+    for line in contents.lines() {
+        let json: serde_json::Value = serde_json::from_str(line).unwrap();
+        assert_eq!(json["session_id"], "session-a");
+    }
+}
+
+#[test]
+fn test_handle_export_unknown_extension_requires_format() {
+    let temp_dir = TempDir::new().unwrap();
+    let log_file = write_traffic_log(temp_dir.path());
+
+    let result = handle_export(
+        log_file,
+        temp_dir.path().join("export.txt"),
+        None,
+        ExportOptions::default(),
+    );
+    assert!(result.is_err());
+}
@@ -0,0 +1,132 @@
+use km::framing::{Frame, FrameKind, FrameReader, Framing};
+use serde_json::json;
+use std::io::Cursor;
+
+fn read_frames(input: &str, framing: Framing) -> Vec<Frame> {
+    FrameReader::new(Cursor::new(input.as_bytes().to_vec()), framing)
+        .collect::<std::io::Result<Vec<_>>>()
+        .unwrap()
+}
+
+fn bodies(frames: &[Frame]) -> Vec<&str> {
+    frames.iter().map(|f| f.body.as_str()).collect()
+}
+
+/// Frames must pass every byte through unchanged
+fn assert_lossless(input: &str, frames: &[Frame]) {
+    let joined: Vec<u8> = frames.iter().flat_map(|f| f.raw.clone()).collect();
+    assert_eq!(String::from_utf8(joined).unwrap(), input);
+}
+
+#[test]
+fn test_newline_framing() {
+    let input = "{\"jsonrpc\":\"2.0\",\"id\":1}\nnot json\n{\"jsonrpc\":\"2.0\",\"id\":2}";
+    let frames = read_frames(input, Framing::Newline);
+
+    assert_eq!(
+        bodies(&frames),
+        vec![
+            "{\"jsonrpc\":\"2.0\",\"id\":1}",
+            "not json",
+            "{\"jsonrpc\":\"2.0\",\"id\":2}"
+        ]
+    );
+    assert!(frames.iter().all(|f| f.kind == FrameKind::Line));
+    assert!(frames[1].messages().is_empty());
+    assert_lossless(input, &frames);
+}
+
+#[test]
+fn test_content_length_framing() {
+    let first = r#"{"jsonrpc":"2.0","id":1,"result":{"text":"line one\nline two"}}"#;
+    let second = r#"{"jsonrpc":"2.0","method":"notifications/progress"}"#;
+    let input = format!(
+        "Content-Length: {}\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n{}Content-Length: {}\r\n\r\n{}",
+        first.len(),
+        first,
+        second.len(),
+        second
+    );
+
+    for framing in [Framing::ContentLength, Framing::Auto] {
+        let frames = read_frames(&input, framing);
+        assert_eq!(bodies(&frames), vec![first, second]);
+        assert!(frames.iter().all(|f| f.kind == FrameKind::ContentLength));
+        assert_eq!(frames[0].messages()[0]["id"], 1);
+        assert_lossless(&input, &frames);
+    }
+}
+
+#[test]
+fn test_brace_framing_handles_multiline_and_concatenated_messages() {
+    let input = "{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": {\"text\": \"} not the end {\"}\n}\n{\"jsonrpc\":\"2.0\",\"id\":2}{\"jsonrpc\":\"2.0\",\"id\":3}\n";
+
+    for framing in [Framing::Brace, Framing::Auto] {
+        let frames = read_frames(input, framing);
+        let ids: Vec<_> = frames
+            .iter()
+            .map(|f| f.messages()[0]["id"].clone())
+            .collect();
+        assert_eq!(ids, vec![json!(1), json!(2), json!(3)]);
+        assert_eq!(frames[0].messages()[0]["result"]["text"], "} not the end {");
+        assert_lossless(input, &frames);
+    }
+}
+
+#[test]
+fn test_batch_arrays_are_split_into_messages() {
+    let input = "[{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}},{\"jsonrpc\":\"2.0\",\"id\":2,\"result\":{}}]\n";
+    let frames = read_frames(input, Framing::Auto);
+
+    assert_eq!(frames.len(), 1);
+    assert!(frames[0].is_batch());
+    let ids: Vec<_> = frames[0]
+        .messages()
+        .iter()
+        .map(|m| m["id"].clone())
+        .collect();
+    assert_eq!(ids, vec![json!(1), json!(2)]);
+}
+
+#[test]
+fn test_auto_detection_falls_back_to_lines() {
+    // Log output that looks a bit like a header must not swallow messages
+    let input = "Connecting: localhost\nstarting server\n{\"jsonrpc\":\"2.0\",\"id\":1}\n";
+    let frames = read_frames(input, Framing::Auto);
+
+    assert_eq!(
+        bodies(&frames),
+        vec![
+            "Connecting: localhost",
+            "starting server",
+            "{\"jsonrpc\":\"2.0\",\"id\":1}"
+        ]
+    );
+    assert_lossless(input, &frames);
+}
+
+#[test]
+fn test_truncated_messages_are_passed_on() {
+    let input = "Content-Length: 100\r\n\r\n{\"jsonrpc\":";
+    let frames = read_frames(input, Framing::Auto);
+    assert_eq!(bodies(&frames), vec!["{\"jsonrpc\":"]);
+    assert_lossless(input, &frames);
+
+    let input = "{\"jsonrpc\": \"2.0\"";
+    let frames = read_frames(input, Framing::Brace);
+    assert_eq!(bodies(&frames), vec![input]);
+}
+
+#[test]
+fn test_replacing_a_body_keeps_the_framing() {
+    let input = "Content-Length: 2\r\n\r\n{}";
+    let frame = read_frames(input, Framing::Auto).remove(0);
+    let replaced = frame.replace_body("{\"a\":1}".to_string());
+
+    assert_eq!(replaced.kind, FrameKind::ContentLength);
+    assert_eq!(
+        String::from_utf8(replaced.raw).unwrap(),
+        "Content-Length: 7\r\n\r\n{\"a\":1}"
+    );
+    assert_eq!(Frame::encode(FrameKind::Line, "{}"), b"{}\n".to_vec());
+}
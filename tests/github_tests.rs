@@ -0,0 +1,138 @@
+use chrono::{DateTime, Utc};
+use km::ci::{self, CiCounts, CiSummary};
+use km::costs::CostConfig;
+use km::github::{self, GitHubActions};
+use km::report::{FindingKind, SessionReport};
+use km::risk::PatternRiskAnalyzer;
+use km::sessions;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use tempfile::TempDir;
+
+fn entry(direction: &str, content: Value, metadata: Option<(&str, Value)>) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+            .unwrap()
+            .with_timezone(&Utc),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("run-1".to_string()),
+        metadata: metadata
+            .into_iter()
+            .map(|(key, value)| (key.to_string(), value))
+            .collect(),
+        labels: Default::default(),
+    }
+}
+
+fn report() -> SessionReport {
+    let entries = vec![
+        entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+                   "params": {"name": "edit_file",
+                              "arguments": {"path": "/work/repo/src/main.rs", "line": 12}}}),
+            Some((
+                "policy",
+                json!({"rule": "no-edit", "decision": "deny", "enforced": true}),
+            )),
+        ),
+        entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call",
+                   "params": {"name": "read_file", "arguments": {"path": "/etc/passwd"}}}),
+            Some((
+                "policy",
+                json!({"rule": "no-etc, really", "decision": "deny", "enforced": false}),
+            )),
+        ),
+    ];
+    let summaries = sessions::summarize(&entries);
+    SessionReport::build(
+        &entries,
+        &summaries[0],
+        &PatternRiskAnalyzer::new(),
+        &CostConfig::default(),
+    )
+}
+
+fn actions(step_summary: Option<PathBuf>) -> GitHubActions {
+    GitHubActions {
+        workspace: Some(PathBuf::from("/work/repo")),
+        step_summary,
+    }
+}
+
+#[test]
+fn test_detected_only_in_github_actions() {
+    let env: HashMap<&str, &str> = [
+        ("GITHUB_ACTIONS", "true"),
+        ("GITHUB_WORKSPACE", "/work/repo"),
+        ("GITHUB_STEP_SUMMARY", ""),
+    ]
+    .into();
+    let detected = GitHubActions::detect(|name| env.get(name).map(|v| v.to_string())).unwrap();
+    assert_eq!(detected.workspace, Some(PathBuf::from("/work/repo")));
+    assert_eq!(detected.step_summary, None);
+
+    assert_eq!(GitHubActions::detect(|_| None), None);
+    assert_eq!(
+        GitHubActions::detect(|name| (name == "CI").then(|| "true".to_string())),
+        None
+    );
+}
+
+#[test]
+fn test_annotations_point_at_files_in_the_checkout() {
+    let report = report();
+    let policy: Vec<String> = report
+        .findings
+        .iter()
+        .filter(|f| f.kind == FindingKind::PolicyViolation)
+        .map(|f| actions(None).annotation(f))
+        .collect();
+    assert_eq!(
+        policy[0],
+        "::error file=src/main.rs,line=12,title=km%3A policy violation::\
+         Policy rule no-edit blocked a request to tool edit_file"
+    );
+    // Outside the checkout there's nothing to point at
+    assert!(
+        policy[1].starts_with(
+            "::warning title=km%3A policy violation::Policy rule no-etc, really denies"
+        ),
+        "{}",
+        policy[1]
+    );
+    assert!(!policy[1].contains("file="));
+}
+
+#[test]
+fn test_job_summary_is_appended() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("summary.md");
+    std::fs::write(&path, "earlier step\n").unwrap();
+
+    let report = report();
+    let thresholds = [ci::parse_threshold("policy-violations>=1").unwrap()];
+    let summary = CiSummary::evaluate("run-1", CiCounts::of_report(&report), &thresholds);
+    actions(Some(path.clone()))
+        .publish(&report, Some(&summary))
+        .unwrap();
+
+    let markdown = std::fs::read_to_string(&path).unwrap();
+    assert!(markdown.starts_with("earlier step\n### km session `run-1`\n"));
+    assert!(markdown.contains("| **Requests** | 2 |"), "{}", markdown);
+    assert!(markdown.contains("| **Policy violations** | 2 |"));
+    assert!(markdown.contains("| **CI thresholds** | ❌ policy-violations>=1 (was 2) |"));
+    assert!(markdown.contains("| km/policy-violation | edit_file |"));
+
+    let without_ci = github::job_summary(&report, None);
+    assert!(!without_ci.contains("CI thresholds"));
+}
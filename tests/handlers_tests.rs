@@ -1,5 +1,9 @@
+use km::cli::{ConfigCommands, IntegrateArgs};
+use km::clients::ClientKind;
 use km::config::Config;
-use km::handlers::{handle_clear_logs, handle_logs, handle_show_config};
+use km::handlers::{
+    handle_clear_logs, handle_config, handle_integrate, handle_logs, handle_show_config,
+};
 use std::fs;
 use std::path::PathBuf;
 use std::sync::Mutex;
@@ -260,3 +264,123 @@ fn test_handle_logs_empty_file() {
     // Clean up
     fs::remove_file(&log_file).ok();
 }
+
+#[test]
+fn test_handle_config_set_saves_valid_value() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("km_config.json");
+    Config::new("key".to_string(), "https://api.test.com".to_string())
+        .save(&config_path)
+        .unwrap();
+
+    let result = handle_config(
+        &config_path,
+        false,
+        Some(ConfigCommands::Set {
+            key: "batch_size".to_string(),
+            value: "10".to_string(),
+        }),
+    );
+    assert!(result.is_ok());
+    assert_eq!(Config::load(&config_path).unwrap().batch_size, 10);
+
+    assert!(handle_config(&config_path, false, Some(ConfigCommands::Validate)).is_ok());
+}
+
+#[test]
+fn test_handle_config_set_rejects_invalid_value() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("km_config.json");
+    Config::new("key".to_string(), "https://api.test.com".to_string())
+        .save(&config_path)
+        .unwrap();
+
+    let result = handle_config(
+        &config_path,
+        false,
+        Some(ConfigCommands::Set {
+            key: "log_level".to_string(),
+            value: "chatty".to_string(),
+        }),
+    );
+    assert!(result.is_err());
+    assert_eq!(Config::load(&config_path).unwrap().log_level, None);
+}
+
+#[test]
+fn test_handle_config_validate_fails_on_bad_file() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("km_config.json");
+    fs::write(
+        &config_path,
+        r#"{"api_key": "", "api_url": "localhost", "batch_size": 0}"#,
+    )
+    .unwrap();
+
+    let result = handle_config(&config_path, false, Some(ConfigCommands::Validate));
+    assert!(result.unwrap_err().to_string().contains("3 problem(s)"));
+}
+
+#[test]
+fn test_handle_config_schema_and_unknown_settings() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("km_config.json");
+    let schema_path = temp_dir.path().join("config.schema.json");
+
+    // Written without a config file
+    let result = handle_config(
+        &config_path,
+        false,
+        Some(ConfigCommands::Schema {
+            output: Some(schema_path.clone()),
+        }),
+    );
+    assert!(result.is_ok());
+    let schema: serde_json::Value =
+        serde_json::from_str(&fs::read_to_string(&schema_path).unwrap()).unwrap();
+    assert_eq!(schema["properties"]["batch_size"]["type"], "integer");
+
+    fs::write(
+        &config_path,
+        r#"{"$schema": "./config.schema.json", "api_key": "k", "api_url": "https://api.test.com", "bach_size": 10}"#,
+    )
+    .unwrap();
+    let result = handle_config(&config_path, false, Some(ConfigCommands::Validate));
+    assert!(result.unwrap_err().to_string().contains("1 problem(s)"));
+}
+
+#[test]
+fn test_handle_integrate_dry_run_then_write_and_undo() {
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = temp_dir.path().join("km_config.json");
+    let client_config = temp_dir.path().join("mcp.json");
+    let original = r#"{"mcpServers": {"fs": {"command": "npx", "args": ["server-fs"]}}}"#;
+    fs::write(&client_config, original).unwrap();
+    let target = |server: Option<&str>, dry_run: bool| IntegrateArgs {
+        client: ClientKind::Cursor,
+        server: server.map(String::from),
+        file: Some(client_config.clone()),
+        dry_run,
+    };
+
+    handle_integrate(&config_path, target(None, true), true).unwrap();
+    assert_eq!(fs::read_to_string(&client_config).unwrap(), original);
+    assert!(handle_integrate(&config_path, target(Some("git"), false), true).is_err());
+
+    handle_integrate(&config_path, target(Some("fs"), false), true).unwrap();
+    let wrapped: serde_json::Value =
+        serde_json::from_str(&fs::read_to_string(&client_config).unwrap()).unwrap();
+    assert_eq!(wrapped["mcpServers"]["fs"]["args"][2], "monitor");
+    assert_eq!(
+        fs::read_to_string(temp_dir.path().join("mcp.json.bak")).unwrap(),
+        original
+    );
+
+    handle_integrate(&config_path, target(None, false), false).unwrap();
+    let restored: serde_json::Value =
+        serde_json::from_str(&fs::read_to_string(&client_config).unwrap()).unwrap();
+    assert_eq!(
+        restored,
+        serde_json::from_str::<serde_json::Value>(original).unwrap()
+    );
+}
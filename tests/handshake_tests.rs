@@ -0,0 +1,148 @@
+use km::handshake::{Handshake, HandshakeTracker, PeerInfo};
+use km::sessions;
+use km::traffic::TrafficEntry;
+use serde_json::json;
+
+fn initialize() -> serde_json::Value {
+    json!({
+        "jsonrpc": "2.0",
+        "id": 0,
+        "method": "initialize",
+        "params": {
+            "protocolVersion": "2025-06-18",
+            "clientInfo": {"name": "claude-desktop", "version": "0.9.2"},
+            "capabilities": {"roots": {"listChanged": true}, "sampling": {}, "elicitation": null}
+        }
+    })
+}
+
+fn initialized() -> serde_json::Value {
+    json!({
+        "jsonrpc": "2.0",
+        "id": 0,
+        "result": {
+            "protocolVersion": "2025-03-26",
+            "serverInfo": {"name": "github", "version": "1.4.0"},
+            "capabilities": {
+                "tools": {"listChanged": true},
+                "resources": {"subscribe": true, "listChanged": false},
+                "logging": {},
+                "experimental": {"batching": {}}
+            }
+        }
+    })
+}
+
+#[test]
+fn test_handshake_records_both_sides() {
+    let mut handshake = Handshake::default();
+    assert!(handshake.is_empty());
+
+    handshake.observe(&initialize());
+    assert_eq!(handshake.protocol_version.as_deref(), Some("2025-06-18"));
+    assert_eq!(
+        handshake.client,
+        Some(PeerInfo {
+            name: "claude-desktop".to_string(),
+            version: Some("0.9.2".to_string()),
+        })
+    );
+    // Null and false capabilities aren't declared
+    assert_eq!(
+        handshake.client_capabilities.keys().collect::<Vec<_>>(),
+        vec!["roots", "sampling"]
+    );
+
+    handshake.observe(&initialized());
+    // The server has the last word on the version
+    assert_eq!(handshake.protocol_version.as_deref(), Some("2025-03-26"));
+    assert_eq!(
+        handshake.server.as_ref().unwrap().describe(),
+        "github 1.4.0"
+    );
+    assert_eq!(
+        handshake.server_capabilities["resources"],
+        vec!["subscribe"]
+    );
+    assert_eq!(
+        handshake.server_capabilities["experimental"],
+        vec!["batching"]
+    );
+    assert_eq!(
+        Handshake::describe_capabilities(&handshake.server_capabilities),
+        "experimental (batching), logging, resources (subscribe), tools (listChanged)"
+    );
+    assert_eq!(Handshake::describe_capabilities(&Default::default()), "-");
+}
+
+#[test]
+fn test_handshake_ignores_other_messages() {
+    let mut handshake = Handshake::default();
+    handshake.observe(&json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}));
+    handshake.observe(&json!({"jsonrpc": "2.0", "id": 1, "result": {"tools": []}}));
+    handshake.observe(&json!({"jsonrpc": "2.0", "id": 2, "error": {"code": -1, "message": "x"}}));
+    assert!(handshake.is_empty());
+
+    let tracker = HandshakeTracker::default();
+    tracker.observe("not json");
+    assert!(tracker.snapshot().is_none());
+    tracker.observe(&initialized().to_string());
+    let snapshot = tracker.snapshot().unwrap();
+    assert_eq!(snapshot.server.unwrap().name, "github");
+    assert!(snapshot.client.is_none());
+}
+
+#[test]
+fn test_handshake_serializes_only_what_was_seen() {
+    let mut handshake = Handshake::default();
+    handshake.observe(&initialized());
+    let value = serde_json::to_value(&handshake).unwrap();
+    assert_eq!(
+        value["server"],
+        json!({"name": "github", "version": "1.4.0"})
+    );
+    assert_eq!(
+        value["server_capabilities"]["tools"],
+        json!(["listChanged"])
+    );
+    assert!(value.get("client").is_none());
+    assert!(value.get("client_capabilities").is_none());
+
+    let back: Handshake = serde_json::from_value(value).unwrap();
+    assert_eq!(back, handshake);
+}
+
+#[test]
+fn test_sessions_show_the_handshake() {
+    let entry = |direction: &str, content: serde_json::Value| TrafficEntry {
+        timestamp: chrono::Utc::now(),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("abc-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    };
+    let summaries = sessions::summarize(&[
+        entry("request", initialize()),
+        entry("response", initialized()),
+    ]);
+    let session = &summaries[0];
+    assert_eq!(session.server.as_deref(), Some("github"));
+    assert_eq!(
+        session.handshake.client.as_ref().unwrap().name,
+        "claude-desktop"
+    );
+
+    let lines = sessions::render_summary(session);
+    assert!(lines.contains(&"Server:   github 1.4.0".to_string()));
+    assert!(lines.contains(&"  Protocol:             2025-03-26".to_string()));
+    assert!(lines.contains(&"  Client:               claude-desktop 0.9.2".to_string()));
+    assert!(lines.contains(&"  Client capabilities:  roots (listChanged), sampling".to_string()));
+
+    let value = serde_json::to_value(session).unwrap();
+    assert_eq!(value["handshake"]["client"]["name"], "claude-desktop");
+}
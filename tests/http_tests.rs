@@ -0,0 +1,176 @@
+use km::config::Config;
+use km::http::{HttpConfig, HttpOptions};
+use std::fs;
+use std::sync::{Arc, Mutex};
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering 200 to everything and recording the
+/// request line of each request.
+async fn serve() -> (String, Arc<Mutex<Vec<String>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let seen = Arc::new(Mutex::new(Vec::new()));
+    let recorder = seen.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut data = Vec::new();
+            let mut buf = vec![0u8; 4096];
+            loop {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break;
+                }
+                data.extend_from_slice(&buf[..n]);
+                if data.windows(4).any(|w| w == b"\r\n\r\n") {
+                    break;
+                }
+            }
+            let request = String::from_utf8_lossy(&data);
+            let line = request.lines().next().unwrap_or_default().to_string();
+            recorder.lock().unwrap().push(line);
+            let _ = socket
+                .write_all(b"HTTP/1.1 200 OK\r\ncontent-length: 2\r\nconnection: close\r\n\r\nok")
+                .await;
+        }
+    });
+
+    (format!("http://{}", addr), seen)
+}
+
+fn client(config: &HttpConfig) -> reqwest::Client {
+    HttpOptions::load(config)
+        .unwrap()
+        .apply(reqwest::Client::builder())
+        .build()
+        .unwrap()
+}
+
+#[tokio::test]
+async fn test_requests_go_through_configured_proxy() {
+    let (proxy, seen) = serve().await;
+    let client = client(&HttpConfig {
+        proxy: Some(proxy),
+        ..Default::default()
+    });
+
+    let response = client
+        .get("http://km.invalid/api/health")
+        .send()
+        .await
+        .unwrap();
+    assert!(response.status().is_success());
+    assert_eq!(
+        seen.lock().unwrap()[0],
+        "GET http://km.invalid/api/health HTTP/1.1"
+    );
+}
+
+#[tokio::test]
+async fn test_no_proxy_hosts_are_reached_directly() {
+    let (proxy, proxied) = serve().await;
+    let (direct, reached) = serve().await;
+    let client = client(&HttpConfig {
+        proxy: Some(proxy),
+        no_proxy: Some("localhost,127.0.0.1".to_string()),
+        ..Default::default()
+    });
+
+    client
+        .get(format!("{}/api/health", direct))
+        .send()
+        .await
+        .unwrap();
+    assert!(proxied.lock().unwrap().is_empty());
+    assert_eq!(reached.lock().unwrap()[0], "GET /api/health HTTP/1.1");
+}
+
+#[test]
+fn test_load_rejects_unreadable_or_empty_files() {
+    let dir = TempDir::new().unwrap();
+    let missing = dir.path().join("missing.pem");
+    let err = HttpOptions::load(&HttpConfig {
+        ca_bundle: Some(missing.display().to_string()),
+        ..Default::default()
+    })
+    .unwrap_err();
+    assert!(err.to_string().contains("http.ca_bundle"));
+
+    let empty = dir.path().join("empty.pem");
+    fs::write(&empty, "not a certificate\n").unwrap();
+    let err = HttpOptions::load(&HttpConfig {
+        ca_bundle: Some(empty.display().to_string()),
+        ..Default::default()
+    })
+    .unwrap_err();
+    assert!(err.to_string().contains("no certificates"));
+
+    let err = HttpOptions::load(&HttpConfig {
+        client_cert: Some(empty.display().to_string()),
+        ..Default::default()
+    })
+    .unwrap_err();
+    assert!(err.to_string().contains("http.client_cert"));
+
+    let err = HttpOptions::load(&HttpConfig {
+        client_key: Some(empty.display().to_string()),
+        ..Default::default()
+    })
+    .unwrap_err();
+    assert!(err.to_string().contains("http.client_cert is not"));
+}
+
+#[test]
+fn test_http_settings_round_trip_through_config() {
+    let mut config = Config::new(
+        "km_test".to_string(),
+        "https://api.kilometers.ai".to_string(),
+    );
+    config
+        .set("http.proxy", "http://proxy.corp.example:3128")
+        .unwrap();
+    config
+        .set("http.no_proxy", "localhost,.corp.example")
+        .unwrap();
+    config.set("http.insecure_skip_verify", "yes").unwrap();
+
+    assert_eq!(
+        config.get("http.proxy").unwrap(),
+        "http://proxy.corp.example:3128"
+    );
+    assert_eq!(config.get("http.insecure_skip_verify").unwrap(), "true");
+    assert_eq!(config.get("http.ca_bundle").unwrap(), "");
+    assert!(config.validate().is_empty());
+
+    config.set("http.ca_bundle", "/nonexistent/ca.pem").unwrap();
+    let problems = config.validate();
+    assert_eq!(problems.len(), 1);
+    assert!(problems[0].contains("http.ca_bundle"));
+
+    config.set("http.ca_bundle", "").unwrap();
+    config.set("http.proxy", "").unwrap();
+    config.set("http.no_proxy", "").unwrap();
+    config.set("http.insecure_skip_verify", "false").unwrap();
+    assert!(config.http.is_default());
+}
+
+#[test]
+fn test_http_settings_are_omitted_from_saved_config_by_default() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("km_config.json");
+    let mut config = Config::new(
+        "km_test".to_string(),
+        "https://api.kilometers.ai".to_string(),
+    );
+    config.save(&path).unwrap();
+    assert!(!fs::read_to_string(&path).unwrap().contains("\"http\""));
+
+    config.set("http.proxy", "http://proxy:8080").unwrap();
+    config.save(&path).unwrap();
+    assert_eq!(
+        Config::load(&path).unwrap().http.proxy.as_deref(),
+        Some("http://proxy:8080")
+    );
+}
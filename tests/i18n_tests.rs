@@ -0,0 +1,115 @@
+use km::control::{self, MonitorStatus};
+use km::doctor::{check_locale, Status};
+use km::i18n::{self, Lang};
+use std::collections::BTreeSet;
+
+fn placeholders(template: &str) -> BTreeSet<&str> {
+    template
+        .split('{')
+        .skip(1)
+        .filter_map(|part| part.split_once('}').map(|(name, _)| name))
+        .collect()
+}
+
+#[test]
+fn test_language_tags() {
+    assert_eq!(Lang::from_tag("ja"), Some(Lang::Ja));
+    assert_eq!(Lang::from_tag("de-DE"), Some(Lang::De));
+    assert_eq!(Lang::from_tag("en_US.UTF-8"), Some(Lang::En));
+    assert_eq!(Lang::from_tag("JA_jp"), Some(Lang::Ja));
+    assert_eq!(Lang::from_tag("fr"), None);
+    assert_eq!(Lang::from_tag(""), None);
+}
+
+#[test]
+fn test_km_lang_overrides_the_config() {
+    assert_eq!(i18n::select(None, None), Lang::En);
+    assert_eq!(i18n::select(None, Some(Lang::De)), Lang::De);
+    assert_eq!(i18n::select(Some("ja_JP.UTF-8"), Some(Lang::De)), Lang::Ja);
+    assert_eq!(i18n::select(Some(""), Some(Lang::De)), Lang::De);
+    assert_eq!(i18n::select(Some("klingon"), Some(Lang::De)), Lang::De);
+}
+
+#[test]
+fn test_catalogs_translate_every_message() {
+    let english = i18n::catalog(Lang::En);
+    for lang in [Lang::Ja, Lang::De] {
+        let catalog = i18n::catalog(lang);
+        assert_eq!(
+            catalog.len(),
+            english.len(),
+            "{} has extra or missing ids",
+            lang
+        );
+        for (id, template) in english {
+            let translated = catalog
+                .iter()
+                .find(|(key, _)| key == id)
+                .unwrap_or_else(|| panic!("{} has no translation of {}", lang, id));
+            assert_eq!(
+                placeholders(translated.1),
+                placeholders(template),
+                "{} {}",
+                lang,
+                id
+            );
+        }
+    }
+}
+
+#[test]
+fn test_messages_are_filled_in() {
+    assert_eq!(
+        i18n::text(Lang::En, "status.tailing", &[("count", &2)]),
+        "Tailing:  2 client(s)"
+    );
+    assert_eq!(
+        i18n::text(Lang::De, "doctor.failed", &[("count", &3)]),
+        "3 Prüfung(en) fehlgeschlagen"
+    );
+    // Filled-in text is not expanded again, and missing arguments stay visible
+    assert_eq!(
+        i18n::text(Lang::En, "doctor.api.reachable", &[("url", &"{url}")]),
+        "{url} is reachable"
+    );
+    assert_eq!(
+        i18n::text(Lang::En, "doctor.api.unreachable", &[("url", &"x")]),
+        "Cannot reach x: {error}"
+    );
+    assert_eq!(
+        i18n::text(Lang::Ja, "no.such.message", &[]),
+        "no.such.message"
+    );
+}
+
+#[test]
+fn test_status_and_doctor_in_japanese() {
+    i18n::init(Lang::Ja);
+    assert_eq!(i18n::current(), Lang::Ja);
+
+    let status: MonitorStatus = serde_json::from_value(serde_json::json!({
+        "session_id": "session-1",
+        "pid": 7,
+        "started_at": "2026-10-15T10:00:00Z",
+        "command": ["server"],
+        "log_file": "traffic.jsonl",
+        "requests": 3,
+        "responses": 2,
+        "method_whitelist": [],
+        "payload_size_limit": null,
+        "plugins": [],
+        "tail_clients": 0,
+        "uploads": false,
+        "queues": []
+    }))
+    .unwrap();
+    let lines = control::render_status(&status, status.started_at);
+    assert_eq!(lines[0], "セッション: session-1 (pid 7)");
+    assert!(lines.contains(&"記録:       リクエスト 3 件、レスポンス 2 件".to_string()));
+    assert!(lines.contains(&"プラグイン: なし".to_string()));
+
+    let check = check_locale(|name| (name == "LANG").then(|| "C".to_string()));
+    assert_eq!(check.status, Status::Warning);
+    assert_eq!(check.title(), "文字コード");
+    assert_eq!(check.detail, "LANG=C は UTF-8 ロケールではありません");
+}
@@ -0,0 +1,66 @@
+use km::idempotency::{self, SentBatches};
+use serde_json::json;
+use tempfile::TempDir;
+
+#[test]
+fn test_batch_id_follows_the_events() {
+    let batch = json!({"events": [{"id": "a"}, {"id": "b"}], "metadata": {"latency": 1}});
+    // Metadata rebuilt for a retry doesn't change the key
+    let rebuilt = json!({"events": [{"id": "a"}, {"id": "b"}], "metadata": {"latency": 2}});
+    assert_eq!(
+        idempotency::batch_id(&batch),
+        idempotency::batch_id(&rebuilt)
+    );
+    assert_ne!(
+        idempotency::batch_id(&batch),
+        idempotency::batch_id(&json!({"events": [{"id": "a"}]}))
+    );
+
+    // Bodies without events are hashed whole
+    let telemetry = json!({"event_type": "command_execution", "session_id": "s1"});
+    assert_eq!(
+        idempotency::batch_id(&telemetry),
+        idempotency::batch_id(&telemetry.clone())
+    );
+    assert_ne!(
+        idempotency::batch_id(&telemetry),
+        idempotency::batch_id(&json!({"event_type": "command_execution", "session_id": "s2"}))
+    );
+}
+
+#[test]
+fn test_sent_batches_persist() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("kilometers").join("sent_batches");
+
+    let sent = SentBatches::open(path.clone()).unwrap();
+    assert!(!sent.contains("batch-1"));
+    sent.record("batch-1").unwrap();
+    sent.record("batch-1").unwrap();
+    assert!(sent.contains("batch-1"));
+
+    let reopened = SentBatches::open(path.clone()).unwrap();
+    assert!(reopened.contains("batch-1"));
+    assert_eq!(std::fs::read_to_string(&path).unwrap().lines().count(), 1);
+}
+
+#[test]
+fn test_sent_batches_forget_old_entries() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("sent_batches");
+    let old = (chrono::Utc::now() - chrono::Duration::days(8)).timestamp();
+    let recent = chrono::Utc::now().timestamp();
+    std::fs::write(
+        &path,
+        format!("{} old-batch\n{} recent-batch\ngarbage\n", old, recent),
+    )
+    .unwrap();
+
+    let sent = SentBatches::open(path.clone()).unwrap();
+    assert!(!sent.contains("old-batch"));
+    assert!(sent.contains("recent-batch"));
+    assert_eq!(
+        std::fs::read_to_string(&path).unwrap(),
+        format!("{} recent-batch\n", recent)
+    );
+}
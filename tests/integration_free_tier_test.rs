@@ -186,6 +186,52 @@ fn test_local_only_flag_behavior() {
     }
 }
 
+#[test]
+fn test_local_only_and_offline_are_not_reported_as_auth_failures() {
+    let temp_dir = TempDir::new().expect("Failed to create temp directory");
+    let config_file = temp_dir.path().join("missing_config.json");
+    let log_file = temp_dir.path().join("local_only_test.log");
+    let km_binary = find_km_binary();
+
+    for (global, monitor, expected) in [
+        (
+            None,
+            Some("--local-only"),
+            "Running in local-only mode (--local-only)",
+        ),
+        (
+            Some("--offline"),
+            None,
+            "Offline mode - skipping authentication",
+        ),
+    ] {
+        let flag = global.or(monitor).unwrap();
+        let output = Command::new(&km_binary)
+            .args(["-vv", "--config", config_file.to_str().unwrap()])
+            .args(global)
+            .args(["monitor", "--log-file", log_file.to_str().unwrap()])
+            .args(monitor)
+            .args(["--", "echo", "test-server"])
+            .env_remove("KM_OFFLINE")
+            .stdin(Stdio::null())
+            .output()
+            .expect("Failed to run km");
+        let logs = format!(
+            "{}{}",
+            String::from_utf8_lossy(&output.stdout),
+            String::from_utf8_lossy(&output.stderr)
+        );
+
+        assert!(logs.contains(expected), "{}: {}", flag, logs);
+        assert!(
+            !logs.contains("Authentication failed"),
+            "{}: {}",
+            flag,
+            logs
+        );
+    }
+}
+
 #[test]
 fn test_unauthenticated_defaults_to_free_tier() {
     let temp_dir = TempDir::new().expect("Failed to create temp directory");
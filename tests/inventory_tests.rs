@@ -0,0 +1,129 @@
+use km::inventory::{self, Catalog, InventoryTracker, Tool};
+use serde_json::json;
+use tempfile::TempDir;
+
+fn tool(name: &str) -> Tool {
+    Tool {
+        name: name.to_string(),
+        description: None,
+        input_schema: None,
+    }
+}
+
+fn tools_list(names: &[&str]) -> serde_json::Value {
+    let tools: Vec<_> = names
+        .iter()
+        .map(|name| {
+            json!({
+                "name": name,
+                "description": format!("The {} tool", name),
+                "inputSchema": {"type": "object"}
+            })
+        })
+        .collect();
+    json!({ "tools": tools })
+}
+
+#[test]
+fn test_dangerous_tools_are_spotted_by_name() {
+    assert_eq!(tool("run_shell_command").dangers(), vec!["code_execution"]);
+    assert_eq!(tool("executeSQL").dangers(), vec!["code_execution"]);
+    assert_eq!(tool("delete-file").dangers(), vec!["destructive"]);
+    assert_eq!(tool("http_request").dangers(), vec!["network"]);
+    assert_eq!(
+        tool("writeSecret").dangers(),
+        vec!["file_write", "credentials"]
+    );
+    // Whole words only
+    assert!(tool("read_file").dangers().is_empty());
+    assert!(tool("list_shelves").dangers().is_empty());
+    assert!(tool("search_issues").dangers().is_empty());
+}
+
+#[test]
+fn test_catalog_merges_pages_by_name() {
+    let mut catalog = Catalog::new("session-1", "npx server");
+    assert!(catalog.merge(&tools_list(&["search", "read_file"])));
+    assert!(catalog.merge(&tools_list(&["write_file"])));
+    // Listing the same tools again changes nothing
+    assert!(!catalog.merge(&tools_list(&["search"])));
+    assert!(!catalog.merge(&json!({"resources": []})));
+
+    let names: Vec<_> = catalog.tools.iter().map(|t| t.name.as_str()).collect();
+    assert_eq!(names, vec!["read_file", "search", "write_file"]);
+    let search = catalog.get("search").unwrap();
+    assert_eq!(search.description.as_deref(), Some("The search tool"));
+    assert_eq!(search.input_schema, Some(json!({"type": "object"})));
+
+    // A tool listed with a new description replaces the old one
+    assert!(catalog.merge(&json!({"tools": [{"name": "search"}]})));
+    assert!(catalog.get("search").unwrap().description.is_none());
+}
+
+#[test]
+fn test_changes_between_sessions_flag_new_dangerous_tools() {
+    let dir = TempDir::new().unwrap();
+    let mut before = Catalog::new("aaa-1", "npx server");
+    before.server = Some("files".to_string());
+    before.merge(&tools_list(&["read_file", "search", "old_tool"]));
+    before.updated_at -= chrono::Duration::hours(2);
+    before.save(dir.path()).unwrap();
+
+    let mut after = Catalog::new("bbb-2", "npx server@2");
+    after.server = Some("files".to_string());
+    after.merge(&tools_list(&["read_file", "search", "run_command"]));
+    after.merge(&json!({"tools": [{"name": "search", "description": "Search, faster"}]}));
+    after.save(dir.path()).unwrap();
+
+    let mut other = Catalog::new("ccc-3", "uvx other");
+    other.server = Some("other".to_string());
+    other.merge(&tools_list(&["query"]));
+    other.updated_at -= chrono::Duration::hours(1);
+    other.save(dir.path()).unwrap();
+
+    let catalogs = inventory::load_all(dir.path()).unwrap();
+    assert_eq!(catalogs.len(), 3);
+    let after = inventory::resolve(&catalogs, "bbb").unwrap();
+    assert!(inventory::resolve(&catalogs, "zzz").is_err());
+
+    // The same server, by name, though the command changed
+    let previous = inventory::previous(&catalogs, after).unwrap();
+    assert_eq!(previous.session_id, "aaa-1");
+    assert!(inventory::previous(&catalogs, previous).is_none());
+
+    let changes = inventory::changes(previous, after);
+    assert_eq!(changes.added, vec!["run_command"]);
+    assert_eq!(changes.removed, vec!["old_tool"]);
+    assert_eq!(changes.changed, vec!["search"]);
+    assert_eq!(changes.dangerous["run_command"], vec!["code_execution"]);
+
+    let lines = inventory::render_list(after, Some(&changes));
+    assert!(lines.contains(&"Changes since session aaa-1".to_string()));
+    assert!(lines.contains(&"  + run_command  ! code_execution".to_string()));
+    assert!(lines.contains(&"  - old_tool".to_string()));
+    assert!(lines
+        .iter()
+        .any(|l| l.starts_with("! run_command") && l.ends_with("[code_execution]")));
+}
+
+#[test]
+fn test_tracker_saves_the_session_catalog() {
+    let dir = TempDir::new().unwrap();
+    let tracker = InventoryTracker::new(dir.path().to_path_buf(), "session-1", "npx server");
+    tracker.observe("not json", None);
+    tracker.observe(r#"{"jsonrpc":"2.0","id":1,"error":{"code":-1}}"#, None);
+    assert!(inventory::load_all(dir.path()).unwrap().is_empty());
+
+    let response = json!({"jsonrpc": "2.0", "id": 2, "result": tools_list(&["search"])});
+    tracker.observe(&response.to_string(), Some("files".to_string()));
+    let catalogs = inventory::load_all(dir.path()).unwrap();
+    assert_eq!(catalogs.len(), 1);
+    assert_eq!(catalogs[0].session_id, "session-1");
+    assert_eq!(catalogs[0].server.as_deref(), Some("files"));
+    assert_eq!(catalogs[0].command, "npx server");
+    assert_eq!(catalogs[0].tools.len(), 1);
+    assert_eq!(
+        catalogs[0].tools[0].description.as_deref(),
+        Some("The search tool")
+    );
+}
@@ -0,0 +1,234 @@
+use chrono::{Duration, Utc};
+use km::journal::{self, Interrupted, Journal, JournalStart};
+use km::process;
+use km::spool::Spool;
+use km::uploader::{EventUploader, McpEvent};
+use std::io::Write;
+use std::path::Path;
+use tempfile::TempDir;
+
+const ENDPOINT: &str = "http://localhost:8080/api/events/batch";
+
+/// A pid that's no longer running: a child that has already exited
+fn dead_pid() -> u32 {
+    let mut child = std::process::Command::new(std::env::current_exe().unwrap())
+        .arg("--list")
+        .stdout(std::process::Stdio::null())
+        .spawn()
+        .unwrap();
+    let pid = child.id();
+    child.wait().unwrap();
+    pid
+}
+
+fn start(session_id: &str, pid: u32, minutes_ago: i64) -> JournalStart {
+    JournalStart {
+        session_id: session_id.to_string(),
+        pid,
+        started_at: Utc::now() - Duration::minutes(minutes_ago),
+        endpoint: ENDPOINT.to_string(),
+        command: vec!["npx".to_string(), "server".to_string()],
+        labels: [("env".to_string(), "ci".to_string())].into(),
+        redact: false,
+    }
+}
+
+fn event(session_id: &str, direction: &str, content: &str) -> McpEvent {
+    McpEvent::new(
+        session_id,
+        direction,
+        content,
+        Some("tools/call".to_string()),
+        None,
+        None,
+    )
+}
+
+fn journal_path(dir: &Path, session_id: &str) -> std::path::PathBuf {
+    dir.join(format!("{}.jsonl", session_id))
+}
+
+#[test]
+fn test_read_returns_unacknowledged_events() {
+    let dir = TempDir::new().unwrap();
+    let journal = Journal::create(dir.path(), &start("s1", dead_pid(), 5)).unwrap();
+    assert_eq!(journal.path(), journal_path(dir.path(), "s1"));
+
+    let request = event("s1", "request", r#"{"id":1,"method":"tools/call"}"#);
+    let response = event("s1", "response", r#"{"id":1,"result":{}}"#);
+    journal.record(&request);
+    journal.record(&response);
+    journal.ack(vec![request.id.clone()]);
+    journal.ack(Vec::new());
+
+    let session = Interrupted::read(journal.path()).unwrap();
+    assert_eq!(session.start.session_id, "s1");
+    assert_eq!(session.start.command, vec!["npx", "server"]);
+    assert_eq!((session.requests, session.responses), (1, 1));
+    assert!(!session.ended);
+    assert_eq!(session.last_event, Some(response.timestamp));
+    let pending: Vec<&str> = session.pending.iter().map(|e| e.id.as_str()).collect();
+    assert_eq!(pending, vec![response.id.as_str()]);
+    assert_eq!(session.pending[0].payload, response.payload);
+}
+
+#[test]
+fn test_read_skips_a_line_cut_off_by_a_crash() {
+    let dir = TempDir::new().unwrap();
+    let journal = Journal::create(dir.path(), &start("s1", dead_pid(), 5)).unwrap();
+    journal.record(&event("s1", "request", r#"{"id":1}"#));
+    std::fs::OpenOptions::new()
+        .append(true)
+        .open(journal.path())
+        .unwrap()
+        .write_all(br#"{"type":"event","event":{"id":"#)
+        .unwrap();
+
+    let session = Interrupted::read(journal.path()).unwrap();
+    assert_eq!(session.pending.len(), 1);
+
+    std::fs::write(dir.path().join("empty.jsonl"), "").unwrap();
+    assert!(Interrupted::read(&dir.path().join("empty.jsonl")).is_err());
+}
+
+#[test]
+fn test_finalize_adds_a_recovered_session_end() {
+    let dir = TempDir::new().unwrap();
+    let journal = Journal::create(dir.path(), &start("s1", dead_pid(), 5)).unwrap();
+    let request = event("s1", "request", r#"{"id":1}"#);
+    journal.record(&request);
+    journal.ack(vec![request.id.clone()]);
+
+    let mut session = Interrupted::read(journal.path()).unwrap();
+    assert!(session.pending.is_empty());
+    session.finalize();
+    session.finalize();
+
+    assert!(session.ended);
+    assert_eq!(session.pending.len(), 1);
+    let end = &session.pending[0];
+    assert_eq!(end.direction, "session_end");
+    assert_eq!(end.timestamp, request.timestamp);
+    assert_eq!(end.metadata["recovered"], true);
+    assert_eq!(end.labels["env"], "ci");
+    let summary = end.payload.as_ref().unwrap();
+    assert_eq!(summary["requests"], 1);
+    assert_eq!(summary["responses"], 0);
+}
+
+#[test]
+fn test_interrupted_skips_running_sessions() {
+    let dir = TempDir::new().unwrap();
+    let running = Journal::create(dir.path(), &start("running", std::process::id(), 1)).unwrap();
+    running.record(&event("running", "request", "{}"));
+    let pid = dead_pid();
+    Journal::create(dir.path(), &start("newer", pid, 2)).unwrap();
+    Journal::create(dir.path(), &start("older", pid, 10)).unwrap();
+    std::fs::write(dir.path().join("notes.txt"), "not a journal").unwrap();
+    std::fs::write(dir.path().join("broken.jsonl"), "garbage\n").unwrap();
+
+    let ids: Vec<String> = journal::interrupted(dir.path())
+        .unwrap()
+        .into_iter()
+        .map(|s| s.start.session_id)
+        .collect();
+    assert_eq!(ids, vec!["older", "newer"]);
+
+    assert!(journal::interrupted(&dir.path().join("missing"))
+        .unwrap()
+        .is_empty());
+}
+
+#[test]
+fn test_recover_spools_unsent_events_and_removes_the_journal() {
+    let dir = TempDir::new().unwrap();
+    let spool_dir = TempDir::new().unwrap();
+    let spool = Spool::new(spool_dir.path().to_path_buf());
+    let journal = Journal::create(dir.path(), &start("s1", dead_pid(), 5)).unwrap();
+    let sent = event("s1", "request", r#"{"id":1}"#);
+    journal.record(&sent);
+    journal.ack(vec![sent.id.clone()]);
+    journal.record(&event("s1", "response", r#"{"id":1,"result":{}}"#));
+
+    let session = journal::interrupted(dir.path()).unwrap().remove(0);
+    let uploader = EventUploader::new(String::new());
+    assert_eq!(
+        journal::recover(session, &uploader, &spool, 5 * 1024 * 1024).unwrap(),
+        2
+    );
+
+    assert!(!journal.path().exists());
+    let pending = spool.pending().unwrap();
+    assert_eq!(pending.len(), 1);
+    assert_eq!(pending[0].endpoint, ENDPOINT);
+    let events = pending[0].payload["events"].as_array().unwrap();
+    let directions: Vec<&str> = events
+        .iter()
+        .map(|e| e["direction"].as_str().unwrap())
+        .collect();
+    assert_eq!(directions, vec!["response", "session_end"]);
+}
+
+#[test]
+fn test_spool_pending_moves_unsent_events_at_shutdown() {
+    let dir = TempDir::new().unwrap();
+    let spool_dir = TempDir::new().unwrap();
+    let spool = Spool::new(spool_dir.path().to_path_buf());
+    let journal = Journal::create(dir.path(), &start("s1", std::process::id(), 0)).unwrap();
+    let sent = event("s1", "request", r#"{"id":1}"#);
+    journal.record(&sent);
+    journal.ack(vec![sent.id.clone()]);
+    journal.record(&event("s1", "response", r#"{"id":1,"result":{}}"#));
+    journal.record(&event("s1", "session_end", "{}"));
+
+    let uploader = EventUploader::new(String::new());
+    assert_eq!(
+        journal
+            .spool_pending(&uploader, &spool, 5 * 1024 * 1024)
+            .unwrap(),
+        2
+    );
+    assert!(!journal.path().exists());
+    let pending = spool.pending().unwrap();
+    assert_eq!(pending.len(), 1);
+    assert_eq!(pending[0].endpoint, ENDPOINT);
+    assert_eq!(pending[0].payload["events"].as_array().unwrap().len(), 2);
+
+    // Already closed: nothing more to spool
+    assert_eq!(
+        journal
+            .spool_pending(&uploader, &spool, 5 * 1024 * 1024)
+            .unwrap(),
+        0
+    );
+}
+
+#[test]
+fn test_finish_removes_the_journal() {
+    let dir = TempDir::new().unwrap();
+    let journal = Journal::create(dir.path(), &start("s1", std::process::id(), 0)).unwrap();
+    assert!(journal.path().exists());
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mode = std::fs::metadata(journal.path())
+            .unwrap()
+            .permissions()
+            .mode();
+        assert_eq!(mode & 0o777, 0o600);
+    }
+
+    journal.finish();
+    assert!(!journal.path().exists());
+    // Writes after the session finished are dropped
+    journal.record(&event("s1", "request", "{}"));
+    assert!(!journal.path().exists());
+}
+
+#[test]
+fn test_is_running() {
+    assert!(process::is_running(std::process::id()));
+    assert!(!process::is_running(dead_pid()));
+    assert!(!process::is_running(0));
+    assert!(!process::is_running(u32::MAX));
+}
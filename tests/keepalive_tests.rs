@@ -0,0 +1,100 @@
+use km::control::{self, MonitorStatus};
+use km::keepalive::{self, Peer, PingHealth, PingTracker};
+
+#[test]
+fn test_pings_and_their_answers_are_counted() {
+    let pings = PingTracker::default();
+
+    assert!(pings.observe(Peer::Client, r#"{"jsonrpc":"2.0","id":1,"method":"ping"}"#));
+    assert!(pings.observe(Peer::Server, r#"{"jsonrpc":"2.0","id":1,"result":{}}"#));
+    assert!(pings.observe(
+        Peer::Server,
+        r#"{"jsonrpc":"2.0","id":"s1","method":"ping"}"#
+    ));
+    assert!(pings.observe(
+        Peer::Client,
+        r#"{"jsonrpc":"2.0","id":"s1","error":{"code":-32601,"message":"no"}}"#
+    ));
+    assert!(pings.observe(Peer::Client, r#"{"jsonrpc":"2.0","id":2,"method":"ping"}"#));
+
+    let health = pings.health();
+    assert_eq!(health.client_pings, 2);
+    assert_eq!(health.server_pings, 1);
+    assert_eq!(health.answered, 1);
+    assert_eq!(health.errors, 1);
+    assert_eq!(health.unanswered, 1);
+    assert!(health.last_rtt_ms.is_some());
+    assert!(health.last_answered_at.is_some());
+}
+
+#[test]
+fn test_other_messages_take_the_full_pipeline() {
+    let pings = PingTracker::default();
+    pings.observe(Peer::Client, r#"{"jsonrpc":"2.0","id":1,"method":"ping"}"#);
+
+    // A response from the wrong side, or to an id that wasn't a ping
+    assert!(!pings.observe(Peer::Client, r#"{"jsonrpc":"2.0","id":1,"result":{}}"#));
+    assert!(!pings.observe(Peer::Server, r#"{"jsonrpc":"2.0","id":7,"result":{}}"#));
+    assert!(!pings.observe(
+        Peer::Client,
+        r#"{"jsonrpc":"2.0","id":2,"method":"tools/list"}"#
+    ));
+    // Batches and anything too long to be a ping aren't parsed
+    assert!(!pings.observe(
+        Peer::Client,
+        r#"[{"jsonrpc":"2.0","id":3,"method":"ping"}]"#
+    ));
+    let padded = format!(
+        r#"{{"jsonrpc":"2.0","id":4,"method":"ping","params":{{"pad":"{}"}}}}"#,
+        "x".repeat(300)
+    );
+    assert!(!pings.observe(Peer::Client, &padded));
+
+    assert!(pings.observe(Peer::Server, r#"{"jsonrpc":"2.0","id":1,"result":{}}"#));
+    assert_eq!(pings.health().client_pings, 1);
+}
+
+#[test]
+fn test_ping_health_is_reported() {
+    let health = PingHealth {
+        client_pings: 12,
+        answered: 11,
+        unanswered: 1,
+        last_rtt_ms: Some(0.42),
+        max_rtt_ms: Some(1.2),
+        ..Default::default()
+    };
+
+    assert_eq!(
+        health.describe(),
+        "12 from the client, 0 from the server; 11 answered (last 0.4ms, max 1.2ms), 0 errors, 1 unanswered"
+    );
+    let metrics = keepalive::prometheus("session-1", &health);
+    assert!(metrics.contains("km_pings_total{session=\"session-1\",from=\"client\"} 12\n"));
+    assert!(
+        metrics.contains("km_ping_answers_total{session=\"session-1\",outcome=\"result\"} 11\n")
+    );
+    assert!(metrics.contains("km_ping_rtt_milliseconds{session=\"session-1\"} 0.42\n"));
+
+    let status: MonitorStatus = serde_json::from_value(serde_json::json!({
+        "session_id": "session-1",
+        "pid": 1,
+        "started_at": "2026-10-15T10:00:00Z",
+        "command": ["server"],
+        "log_file": "traffic.jsonl",
+        "requests": 0,
+        "responses": 0,
+        "method_whitelist": [],
+        "payload_size_limit": null,
+        "plugins": [],
+        "tail_clients": 0,
+        "uploads": false,
+        "queues": [],
+        "pings": health
+    }))
+    .unwrap();
+    let lines = control::render_status(&status, status.started_at);
+    assert!(lines
+        .iter()
+        .any(|line| line.starts_with("Pings:    12 from the client")));
+}
@@ -0,0 +1,222 @@
+use km::correlation::MessageCounts;
+use km::latency::{
+    self, ApiLatency, LatencyHistogram, LatencyStats, API_WINDOW, EXPORT_BUCKETS_MS,
+};
+use km::metrics::{MetricsServer, MetricsSource};
+use std::io::{Read, Write};
+use std::net::TcpStream;
+use std::sync::Arc;
+
+fn get(server: &MetricsServer, request: &str) -> String {
+    let mut stream = TcpStream::connect(server.addr()).unwrap();
+    stream.write_all(request.as_bytes()).unwrap();
+    let mut response = String::new();
+    stream.read_to_string(&mut response).unwrap();
+    response
+}
+
+#[test]
+fn test_percentiles_are_within_a_bucket() {
+    let mut histogram = LatencyHistogram::default();
+    assert_eq!(histogram.percentile(50.0), None);
+    // 1ms to 1000ms, evenly
+    for ms in 1..=1000 {
+        histogram.record(ms as f64);
+    }
+    assert_eq!(histogram.summary("ping").count, 1000);
+
+    for (p, exact) in [(50.0, 500.0), (90.0, 900.0), (99.0, 990.0)] {
+        let estimate = histogram.percentile(p).unwrap();
+        assert!(
+            estimate >= exact && estimate <= exact * 1.1,
+            "p{} = {}",
+            p,
+            estimate
+        );
+    }
+    assert_eq!(histogram.percentile(100.0), Some(1000.0));
+    let fastest = histogram.percentile(0.0).unwrap();
+    assert!((1.0..=1.1).contains(&fastest), "{}", fastest);
+}
+
+#[test]
+fn test_summary_counts_buckets_cumulatively() {
+    let mut histogram = LatencyHistogram::default();
+    for ms in [0.5, 3.0, 3.0, 40.0, 60000.0] {
+        histogram.record(ms);
+    }
+    histogram.record(f64::NAN);
+    let summary = histogram.summary("tools/call");
+
+    assert_eq!(summary.count, 5);
+    assert_eq!((summary.min_ms, summary.max_ms), (0.5, 60000.0));
+    assert_eq!(summary.mean_ms(), 60046.5 / 5.0);
+    assert_eq!(summary.buckets.len(), EXPORT_BUCKETS_MS.len());
+    let count = |le: f64| {
+        summary
+            .buckets
+            .iter()
+            .find(|b| b.le_ms == le)
+            .unwrap()
+            .count
+    };
+    assert_eq!(count(1.0), 1);
+    assert_eq!(count(2.5), 1);
+    assert_eq!(count(5.0), 3);
+    assert_eq!(count(50.0), 4);
+    // The slowest is only in +Inf
+    assert_eq!(count(30000.0), 4);
+}
+
+#[test]
+fn test_stats_snapshot_busiest_first_and_render() {
+    let stats = LatencyStats::default();
+    assert_eq!(
+        latency::render(&stats.snapshot()),
+        vec!["Latency:  no responses yet"]
+    );
+
+    stats.record("initialize", 8.0);
+    for _ in 0..3 {
+        stats.record("tools/call", 25.0);
+    }
+    let snapshot = stats.snapshot();
+    let methods: Vec<&str> = snapshot.iter().map(|m| m.method.as_str()).collect();
+    assert_eq!(methods, vec!["tools/call", "initialize"]);
+
+    let lines = latency::render(&snapshot);
+    assert_eq!(lines.len(), 3);
+    assert!(lines[0].starts_with("Latency:  method"));
+    assert!(lines[1].contains("tools/call") && lines[1].contains("25.0ms"));
+}
+
+#[test]
+fn test_prometheus_text() {
+    let stats = LatencyStats::default();
+    stats.record("tools/call", 3.0);
+    stats.record("tools/call", 700.0);
+    let messages = MessageCounts {
+        client_requests: 3,
+        client_notifications: 1,
+        server_responses: 2,
+        ..Default::default()
+    };
+    let text = latency::prometheus("s\"1", 4, 2, &messages, &stats.snapshot());
+
+    assert!(text.contains("# TYPE km_requests_total counter\n"));
+    assert!(text.contains("km_requests_total{session=\"s\\\"1\"} 4\n"));
+    assert!(text.contains("km_responses_total{session=\"s\\\"1\"} 2\n"));
+    assert!(
+        text.contains("km_messages_total{session=\"s\\\"1\",class=\"client_notification\"} 1\n")
+    );
+    assert!(text.contains("km_messages_total{session=\"s\\\"1\",class=\"server_request\"} 0\n"));
+    assert!(text.contains("# TYPE km_response_latency_milliseconds histogram\n"));
+    let labels = "session=\"s\\\"1\",method=\"tools/call\"";
+    for line in [
+        format!(
+            "km_response_latency_milliseconds_bucket{{{},le=\"2.5\"}} 0",
+            labels
+        ),
+        format!(
+            "km_response_latency_milliseconds_bucket{{{},le=\"5\"}} 1",
+            labels
+        ),
+        format!(
+            "km_response_latency_milliseconds_bucket{{{},le=\"1000\"}} 2",
+            labels
+        ),
+        format!(
+            "km_response_latency_milliseconds_bucket{{{},le=\"+Inf\"}} 2",
+            labels
+        ),
+        format!("km_response_latency_milliseconds_sum{{{}}} 703", labels),
+        format!("km_response_latency_milliseconds_count{{{}}} 2", labels),
+    ] {
+        assert!(
+            text.lines().any(|l| l == line),
+            "missing {}\n{}",
+            line,
+            text
+        );
+    }
+}
+
+#[test]
+fn test_api_latency_averages_and_windows() {
+    let api = ApiLatency::default();
+    assert_eq!(api.summary().describe(), "no uploads answered yet");
+    for _ in 0..100 {
+        api.record(10.0);
+    }
+    // One slow answer moves the average a tenth of the way, not half
+    api.record(1000.0);
+    let summary = api.summary();
+    assert!(
+        (summary.ewma_ms - 109.0).abs() < 1e-9,
+        "{}",
+        summary.ewma_ms
+    );
+    assert_eq!((summary.p50_ms, summary.p99_ms), (10.0, 10.0));
+    assert_eq!(summary.max_ms, 1000.0);
+
+    // Percentiles only see the most recent uploads
+    let api = ApiLatency::default();
+    for ms in 1..=300 {
+        api.record(ms as f64);
+    }
+    api.record(f64::NAN);
+    let summary = api.summary();
+    assert_eq!((summary.count, summary.window), (300, API_WINDOW));
+    assert_eq!(summary.sum_ms, 45150.0);
+    assert_eq!(
+        (
+            summary.p50_ms,
+            summary.p95_ms,
+            summary.p99_ms,
+            summary.max_ms
+        ),
+        (172.0, 288.0, 298.0, 300.0)
+    );
+    assert!(summary
+        .describe()
+        .contains("over 300 uploads; last 256: p50 172.0ms, p95 288.0ms"));
+
+    let text = latency::api_prometheus("abc", &summary);
+    assert!(text.contains("# TYPE km_api_upload_latency_milliseconds summary\n"));
+    assert!(text
+        .contains("km_api_upload_latency_milliseconds{session=\"abc\",quantile=\"0.95\"} 288\n"));
+    assert!(text.contains("km_api_upload_latency_milliseconds_count{session=\"abc\"} 300\n"));
+    assert!(text.contains("km_api_upload_latency_average_milliseconds{session=\"abc\"} "));
+    // No quantiles before the first upload
+    assert!(!latency::api_prometheus("abc", &ApiLatency::default().summary()).contains("quantile"));
+}
+
+#[test]
+fn test_metrics_server_serves_the_source() {
+    let stats = Arc::new(LatencyStats::default());
+    let source: MetricsSource = {
+        let stats = stats.clone();
+        Arc::new(move || {
+            latency::prometheus("session-1", 1, 1, &Default::default(), &stats.snapshot())
+        })
+    };
+    let server = MetricsServer::start("127.0.0.1:0".parse().unwrap(), source).unwrap();
+    assert_ne!(server.addr().port(), 0);
+
+    stats.record("ping", 1.5);
+    let response = get(&server, "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n");
+    assert!(response.starts_with("HTTP/1.1 200 OK\r\n"), "{}", response);
+    assert!(response.contains("Content-Type: text/plain; version=0.0.4"));
+    assert!(response.contains(
+        "km_response_latency_milliseconds_count{session=\"session-1\",method=\"ping\"} 1"
+    ));
+
+    let response = get(&server, "GET / HTTP/1.1\r\n\r\n");
+    assert!(response.starts_with("HTTP/1.1 404"), "{}", response);
+    let response = get(&server, "POST /metrics HTTP/1.1\r\n\r\n");
+    assert!(response.starts_with("HTTP/1.1 405"), "{}", response);
+
+    let addr = server.addr();
+    drop(server);
+    assert!(TcpStream::connect(addr).is_err());
+}
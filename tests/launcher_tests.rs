@@ -0,0 +1,122 @@
+use km::launcher::{self, Launcher};
+use km::server_env::{ServerEnv, ServerEnvConfig};
+use std::collections::HashMap;
+
+fn args(args: &[&str]) -> Vec<String> {
+    args.iter().map(|arg| arg.to_string()).collect()
+}
+
+#[test]
+fn test_launchers_are_detected() {
+    let detect = |program: &str, rest: &[&str]| Launcher::detect(program, &args(rest));
+
+    assert_eq!(
+        detect("npx", &["-y", "@modelcontextprotocol/server-github"]),
+        Some(Launcher::Npx)
+    );
+    assert_eq!(
+        detect(r"C:\Program Files\nodejs\npx.cmd", &["-y", "server"]),
+        Some(Launcher::Npx)
+    );
+    assert_eq!(
+        detect("/usr/local/bin/uvx", &["mcp-server-fetch"]),
+        Some(Launcher::Uvx)
+    );
+    assert_eq!(
+        detect("uv", &["tool", "run", "mcp-server-fetch"]),
+        Some(Launcher::Uvx)
+    );
+    assert_eq!(
+        detect("pipx", &["run", "mcp-server-time"]),
+        Some(Launcher::Pipx)
+    );
+    assert_eq!(detect("uv", &["run", "server.py"]), None);
+    assert_eq!(detect("node", &["server.js"]), None);
+}
+
+#[test]
+fn test_launcher_settings_do_not_override_the_environment() {
+    let mut env = ServerEnv::build(
+        &ServerEnvConfig::default(),
+        [("npm_config_loglevel".into(), "verbose".into())],
+        Vec::new(),
+    );
+    for (name, value) in Launcher::Npx.env() {
+        env.set_default(name, value);
+    }
+
+    assert_eq!(env.get("npm_config_yes").as_deref(), Some("true"));
+    assert_eq!(env.get("npm_config_loglevel").as_deref(), Some("verbose"));
+}
+
+#[test]
+fn test_templates_expand_from_the_environment() {
+    let vars = HashMap::from([
+        ("GITHUB_TOKEN", "ghp_secret"),
+        ("ROOT", "/srv/projects"),
+        ("EMPTY", ""),
+    ]);
+    let expand =
+        |template: &str| launcher::expand(template, |name| vars.get(name).map(|v| v.to_string()));
+
+    assert_eq!(
+        expand("--token=${GITHUB_TOKEN}").unwrap(),
+        "--token=ghp_secret"
+    );
+    assert_eq!(expand("${ROOT}/docs").unwrap(), "/srv/projects/docs");
+    assert_eq!(expand("${PORT:-8080}").unwrap(), "8080");
+    assert_eq!(expand("${EMPTY:-fallback}").unwrap(), "fallback");
+    assert_eq!(
+        expand("costs $5, literally $${ROOT}").unwrap(),
+        "costs $5, literally ${ROOT}"
+    );
+
+    let err = expand("${MISSING}").unwrap_err();
+    assert!(err.to_string().contains("MISSING isn't set"), "{}", err);
+    assert!(expand("${ROOT").is_err());
+    assert!(expand("${not a name}").is_err());
+}
+
+#[cfg(unix)]
+#[test]
+fn test_installer_output_does_not_reach_the_client() {
+    use std::io::{BufRead, BufReader, Write};
+    use std::os::unix::fs::PermissionsExt;
+    use std::process::{Command, Stdio};
+
+    let dir = tempfile::TempDir::new().unwrap();
+    // Stands in for npx installing the server before starting it
+    let npx = dir.path().join("npx");
+    std::fs::write(
+        &npx,
+        format!(
+            "#!/bin/sh\necho 'npm warn exec The following package was not found and will be installed'\necho 'added 12 packages in 2s'\nexec {}\n",
+            env!("CARGO_BIN_EXE_mock_mcp_server")
+        ),
+    )
+    .unwrap();
+    std::fs::set_permissions(&npx, std::fs::Permissions::from_mode(0o755)).unwrap();
+
+    let mut child = Command::new(env!("CARGO_BIN_EXE_km"))
+        .current_dir(dir.path())
+        .args(["monitor", "--local-only", "--no-plugins", "--log-file"])
+        .arg(dir.path().join("traffic.jsonl"))
+        .arg("--")
+        .arg(&npx)
+        .args(["-y", "mock-server"])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .unwrap();
+    let mut stdin = child.stdin.take().unwrap();
+    writeln!(stdin, r#"{{"jsonrpc":"2.0","id":1,"method":"tools/list"}}"#).unwrap();
+    drop(stdin);
+
+    let mut first = String::new();
+    BufReader::new(child.stdout.take().unwrap())
+        .read_line(&mut first)
+        .unwrap();
+    assert!(first.starts_with(r#"{"jsonrpc""#), "{}", first);
+    child.wait().unwrap();
+}
@@ -0,0 +1,139 @@
+use km::logging::{self, JsonLayer, LoggingConfig, RotatingFile, LOG_FILE_NAME};
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::fs;
+use std::io::Write;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tempfile::TempDir;
+use tracing::Level;
+use tracing_subscriber::filter::LevelFilter;
+use tracing_subscriber::prelude::*;
+
+/// Collects what a layer writes
+#[derive(Clone, Default)]
+struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+impl Write for Buffer {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.lock().unwrap().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Buffer {
+    fn lines(&self) -> Vec<Value> {
+        String::from_utf8(self.0.lock().unwrap().clone())
+            .unwrap()
+            .lines()
+            .map(|l| serde_json::from_str(l).unwrap())
+            .collect()
+    }
+}
+
+#[test]
+fn test_json_lines_carry_fields_and_span_context() {
+    let buffer = Buffer::default();
+    let subscriber = tracing_subscriber::registry().with(JsonLayer::new(buffer.clone()));
+    tracing::subscriber::with_default(subscriber, || {
+        let span = tracing::info_span!("upload", batch = 3);
+        let _guard = span.enter();
+        tracing::warn!(
+            event_id = "e-1",
+            bytes = 2048_u64,
+            "Event {} is too big",
+            "e-1"
+        );
+    });
+
+    let lines = buffer.lines();
+    assert_eq!(lines.len(), 1);
+    let line = &lines[0];
+    assert_eq!(line["level"], "WARN");
+    assert_eq!(line["target"], "logging_tests");
+    assert_eq!(line["message"], "Event e-1 is too big");
+    assert_eq!(line["event_id"], "e-1");
+    assert_eq!(line["bytes"], 2048);
+    assert_eq!(line["batch"], 3);
+    assert!(line["timestamp"].as_str().unwrap().ends_with('Z'));
+}
+
+#[test]
+fn test_targets_override_the_default_level() {
+    let levels = BTreeMap::from([
+        ("km::uploader".to_string(), "debug".to_string()),
+        ("km::proxy".to_string(), "error".to_string()),
+        ("km::bogus".to_string(), "loud".to_string()),
+    ]);
+    let filter = logging::targets(LevelFilter::INFO, &levels);
+
+    assert!(filter.would_enable("km::uploader", &Level::DEBUG));
+    assert!(!filter.would_enable("km::uploader", &Level::TRACE));
+    assert!(!filter.would_enable("km::proxy", &Level::WARN));
+    assert!(filter.would_enable("km::handlers", &Level::INFO));
+    assert!(!filter.would_enable("km::handlers", &Level::DEBUG));
+    // A level that doesn't parse leaves the target at the default
+    assert!(filter.would_enable("km::bogus", &Level::INFO));
+}
+
+#[test]
+fn test_rotates_by_size_and_keeps_max_files() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("logs").join(LOG_FILE_NAME);
+    let mut file = RotatingFile::open(&path, 100, None, 2).unwrap();
+
+    for n in 0..7 {
+        // Two 40-byte lines fit, a third starts a new file
+        file.write_all(format!("{:039}\n", n).as_bytes()).unwrap();
+    }
+    let read = |path: &std::path::Path| fs::read_to_string(path).unwrap();
+    assert_eq!(read(&path).lines().count(), 1);
+    assert_eq!(read(&file.rotated_path(1)).lines().count(), 2);
+    assert!(read(&file.rotated_path(1)).starts_with(&format!("{:039}", 4)));
+    assert!(read(&file.rotated_path(2)).starts_with(&format!("{:039}", 2)));
+    assert!(!file.rotated_path(3).exists());
+}
+
+#[test]
+fn test_rotates_by_age() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join(LOG_FILE_NAME);
+    fs::write(&path, "old\n").unwrap();
+
+    let mut file = RotatingFile::open(&path, 1024, Some(Duration::ZERO), 1).unwrap();
+    file.write_all(b"new\n").unwrap();
+    assert_eq!(fs::read_to_string(&path).unwrap(), "new\n");
+    assert_eq!(fs::read_to_string(file.rotated_path(1)).unwrap(), "old\n");
+
+    // Without a maximum age, an existing file is appended to
+    let mut file = RotatingFile::open(&path, 1024, None, 1).unwrap();
+    file.write_all(b"more\n").unwrap();
+    assert_eq!(fs::read_to_string(&path).unwrap(), "new\nmore\n");
+}
+
+#[test]
+fn test_config_opens_the_log_file() {
+    let dir = TempDir::new().unwrap();
+    let config = LoggingConfig {
+        max_file_mb: 1,
+        max_age_hours: 0,
+        ..Default::default()
+    };
+    let mut file = config.open(dir.path()).unwrap();
+    file.write_all(b"{}\n").unwrap();
+    assert!(dir.path().join("km.log").exists());
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mode = fs::metadata(dir.path().join("km.log"))
+            .unwrap()
+            .permissions()
+            .mode();
+        assert_eq!(mode & 0o777, 0o600);
+    }
+}
@@ -0,0 +1,117 @@
+use chrono::{DateTime, Duration, Utc};
+use km::merge::{self, Capture, MergeOptions};
+use km::traffic::{self, TrafficEntry};
+use std::path::PathBuf;
+use tempfile::TempDir;
+
+fn at(ms: i64) -> DateTime<Utc> {
+    DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+        .unwrap()
+        .with_timezone(&Utc)
+        + Duration::milliseconds(ms)
+}
+
+fn entry(session: &str, run_id: Option<&str>, ms: i64, id: u64) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(ms),
+        direction: "request".to_string(),
+        content: format!(
+            r#"{{"jsonrpc":"2.0","id":{},"method":"tools/call","params":{{"name":"t"}}}}"#,
+            id
+        ),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: run_id
+            .map(|id| (traffic::RUN_ID_LABEL.to_string(), id.to_string()))
+            .into_iter()
+            .collect(),
+    }
+}
+
+fn captures() -> Vec<Capture> {
+    vec![
+        Capture {
+            name: "agent-a.jsonl".to_string(),
+            entries: vec![
+                entry("aaaa", Some("run-7"), 0, 1),
+                entry("aaaa", Some("run-7"), 2_000, 2),
+                entry("old", Some("run-6"), 500, 1),
+            ],
+        },
+        Capture {
+            name: "agent-b.jsonl".to_string(),
+            entries: vec![
+                entry("bbbb", Some("run-7"), 1_000, 1),
+                entry("bbbb", Some("run-7"), 2_000, 2),
+            ],
+        },
+    ]
+}
+
+#[test]
+fn test_source_names_are_unique() {
+    let names = merge::source_names(&[
+        PathBuf::from("host-a/mcp_traffic.jsonl"),
+        PathBuf::from("host-b/mcp_traffic.jsonl"),
+        PathBuf::from("export.jsonl"),
+    ]);
+    assert_eq!(
+        names,
+        vec!["mcp_traffic.jsonl", "mcp_traffic.jsonl#2", "export.jsonl"]
+    );
+}
+
+#[test]
+fn test_merge_orders_by_time_and_labels_sources() {
+    let merged = merge::merge(captures(), &MergeOptions::default());
+    let order: Vec<(&str, &str)> = merged
+        .iter()
+        .map(|e| {
+            (
+                e.session_id.as_deref().unwrap(),
+                e.labels["source"].as_str(),
+            )
+        })
+        .collect();
+    assert_eq!(
+        order,
+        vec![
+            ("aaaa", "agent-a.jsonl"),
+            ("old", "agent-a.jsonl"),
+            ("bbbb", "agent-b.jsonl"),
+            // Same time: the earlier capture first
+            ("aaaa", "agent-a.jsonl"),
+            ("bbbb", "agent-b.jsonl"),
+        ]
+    );
+}
+
+#[test]
+fn test_merge_one_run_into_one_session() {
+    let options = MergeOptions {
+        run_id: Some("run-7".to_string()),
+        session: Some("run-7".to_string()),
+    };
+    let merged = merge::merge(captures(), &options);
+    assert_eq!(merged.len(), 4);
+    assert!(merged
+        .iter()
+        .all(|e| e.session_id.as_deref() == Some("run-7")));
+    assert_eq!(merged[0].labels[merge::SOURCE_SESSION_LABEL], "aaaa");
+    assert_eq!(merged[1].labels[merge::SOURCE_SESSION_LABEL], "bbbb");
+
+    // The merged capture reads back as a traffic log
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("merged.jsonl");
+    let mut file = std::fs::File::create(&path).unwrap();
+    merge::write_entries(&merged, &mut file).unwrap();
+    let entries = traffic::read_entries(&path).unwrap();
+    assert_eq!(entries.len(), 4);
+    assert_eq!(entries[3].labels["source"], "agent-b.jsonl");
+    assert!(merge::is_output(&path, &path));
+    assert!(!merge::is_output(&path, &PathBuf::from("-")));
+}
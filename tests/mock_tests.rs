@@ -0,0 +1,185 @@
+use chrono::{DateTime, Duration, Utc};
+use km::mock::{self, MockServer, MockStats, MOCK_MISS_CODE};
+use km::probe::{self, ProbeOptions};
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+
+fn entry(session: &str, ms: i64, direction: &str, content: Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+            .unwrap()
+            .with_timezone(&Utc)
+            + Duration::milliseconds(ms),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn read(id: u64, path: &str) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "method": "tools/call",
+           "params": {"name": "read_file", "arguments": {"path": path}}})
+}
+
+fn text(id: u64, text: &str) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "result": {"content": [{"type": "text", "text": text}]}})
+}
+
+fn capture() -> Vec<TrafficEntry> {
+    vec![
+        entry("one", 0, "request", read(1, "a.txt")),
+        entry("one", 10, "response", text(1, "first a")),
+        entry("one", 20, "request", read(2, "b.txt")),
+        entry("one", 30, "response", text(2, "b")),
+        entry("one", 40, "request", read(3, "a.txt")),
+        entry("one", 50, "response", text(3, "second a")),
+        entry("two", 0, "request", read(1, "a.txt")),
+        entry("two", 10, "response", text(1, "from two")),
+    ]
+}
+
+fn result_text(response: &Value) -> &str {
+    response["result"]["content"][0]["text"].as_str().unwrap()
+}
+
+#[test]
+fn test_request_key_ignores_key_order_and_meta() {
+    let a = json!({"name": "read_file", "arguments": {"path": "a", "limit": 1}});
+    let b = json!({"arguments": {"limit": 1, "path": "a"}, "name": "read_file",
+                   "_meta": {"progressToken": 7}});
+    assert_eq!(
+        mock::request_key("tools/call", Some(&a)),
+        mock::request_key("tools/call", Some(&b))
+    );
+    assert_ne!(
+        mock::request_key("tools/call", Some(&a)),
+        mock::request_key("tools/call", Some(&json!({"name": "read_file"})))
+    );
+    assert!(mock::request_key("tools/list", None).starts_with("tools/list#"));
+}
+
+#[test]
+fn test_serves_recordings_in_order_with_the_request_id() {
+    let mut server = MockServer::from_entries(&capture(), Some("one"), false);
+    assert_eq!(server.recorded(), 3);
+
+    let first = server.respond(&read(41, "a.txt")).unwrap();
+    assert_eq!(first["id"], 41);
+    assert_eq!(result_text(&first), "first a");
+    let second = server.respond(&read(42, "a.txt")).unwrap();
+    assert_eq!(result_text(&second), "second a");
+    // The last recording repeats once they run out
+    let third = server.respond(&read(43, "a.txt")).unwrap();
+    assert_eq!(result_text(&third), "second a");
+    assert_eq!(
+        result_text(&server.respond(&read(44, "b.txt")).unwrap()),
+        "b"
+    );
+}
+
+#[test]
+fn test_falls_back_to_the_method_unless_strict() {
+    let mut server = MockServer::from_entries(&capture(), None, false);
+    let response = server.respond(&read(1, "other.txt")).unwrap();
+    assert!(response.get("result").is_some());
+    assert_eq!(
+        server.stats,
+        MockStats {
+            exact: 0,
+            by_method: 1,
+            missed: 0,
+        }
+    );
+
+    let mut strict = MockServer::from_entries(&capture(), None, true);
+    let response = strict.respond(&read(9, "other.txt")).unwrap();
+    assert_eq!(response["id"], 9);
+    assert_eq!(response["error"]["code"], MOCK_MISS_CODE);
+    assert_eq!(strict.stats.missed, 1);
+
+    let unknown = strict
+        .respond(&json!({"jsonrpc": "2.0", "id": 10, "method": "prompts/list"}))
+        .unwrap();
+    assert_eq!(
+        unknown["error"]["message"],
+        "No recorded response for prompts/list"
+    );
+}
+
+#[test]
+fn test_notifications_get_no_answer() {
+    let mut server = MockServer::from_entries(&capture(), None, false);
+    assert!(server
+        .respond(&json!({"jsonrpc": "2.0", "method": "notifications/initialized"}))
+        .is_none());
+}
+
+#[test]
+fn test_serve_answers_lines_batches_and_bad_input() {
+    let mut server = MockServer::from_entries(&capture(), Some("two"), false);
+    let input = format!(
+        "{}\n{}\n[{},{}]\nnot json\n",
+        read(1, "a.txt"),
+        json!({"jsonrpc": "2.0", "method": "notifications/initialized"}),
+        read(2, "a.txt"),
+        read(3, "a.txt"),
+    );
+    let mut output = Vec::new();
+    server.serve(input.as_bytes(), &mut output).unwrap();
+
+    let lines: Vec<Value> = String::from_utf8(output)
+        .unwrap()
+        .lines()
+        .map(|l| serde_json::from_str(l).unwrap())
+        .collect();
+    assert_eq!(lines.len(), 3);
+    assert_eq!(result_text(&lines[0]), "from two");
+    assert_eq!(lines[1].as_array().unwrap().len(), 2);
+    assert_eq!(lines[1][1]["id"], 3);
+    assert_eq!(lines[2]["error"]["code"], -32700);
+}
+
+#[test]
+fn test_mock_replays_a_probe_recording() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let log = dir.path().join("fixture.jsonl");
+    let options = ProbeOptions {
+        calls: vec![probe::parse_call(r#"echo={"text": "hi"}"#).unwrap()],
+        timeout: std::time::Duration::from_secs(10),
+        ..Default::default()
+    };
+    let recorded = probe::probe(
+        env!("CARGO_BIN_EXE_mock_mcp_server"),
+        &[],
+        &options,
+        Some(&log),
+    )
+    .unwrap();
+    assert!(recorded.is_success(), "{:#?}", recorded);
+
+    // The same client against `km mock` gets the same answers
+    let args = vec![
+        "mock".to_string(),
+        "--from".to_string(),
+        log.to_string_lossy().to_string(),
+        "--strict".to_string(),
+    ];
+    let replayed = probe::probe(env!("CARGO_BIN_EXE_km"), &args, &options, None).unwrap();
+    assert!(replayed.is_success(), "{:#?}", replayed);
+    assert_eq!(replayed.server, recorded.server);
+    assert_eq!(replayed.tools, recorded.tools);
+    let calls = |report: &probe::ProbeReport| {
+        report
+            .methods
+            .iter()
+            .map(|m| (m.method.clone(), m.calls, m.errors))
+            .collect::<Vec<_>>()
+    };
+    assert_eq!(calls(&replayed), calls(&recorded));
+}
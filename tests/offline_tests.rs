@@ -0,0 +1,85 @@
+use km::errors::{classify, Code};
+use km::offline;
+use km::plugins::verify::TrustedKeys;
+use km::update::{Channel, Updater};
+use std::process::Command;
+
+#[test]
+fn test_select_offline_mode() {
+    assert!(!offline::select(false, None, false));
+    assert!(offline::select(true, None, false));
+    assert!(offline::select(false, None, true));
+    assert!(offline::select(false, Some("1"), false));
+    assert!(offline::select(false, Some("Yes"), false));
+    // KM_OFFLINE decides over the config file, --offline over both
+    assert!(!offline::select(false, Some("0"), true));
+    assert!(offline::select(true, Some("0"), false));
+    assert!(offline::select(false, Some(""), true));
+}
+
+#[tokio::test]
+async fn test_offline_mode_makes_no_calls() {
+    offline::init(true);
+    assert!(offline::enabled());
+
+    let error = offline::ensure_online("Signing in").unwrap_err();
+    assert_eq!(classify(&error), Code::Offline);
+    assert!(error
+        .to_string()
+        .starts_with("Signing in needs the network"));
+
+    // Nothing listens here; offline, nothing tries
+    let url = "http://127.0.0.1:9";
+    let error = km::remote_config::fetch(url, None).await.unwrap_err();
+    assert_eq!(classify(&error), Code::Offline);
+    let updater = Updater::new(url.to_string(), TrustedKeys::from_config(&[]).unwrap());
+    let error = updater.latest(Channel::Stable).await.unwrap_err();
+    assert_eq!(classify(&error), Code::Offline);
+    let error = km::clock::query("127.0.0.1:9", std::time::Duration::from_secs(1)).unwrap_err();
+    assert_eq!(classify(&error), Code::Offline);
+}
+
+#[test]
+fn test_offline_flag_from_the_binary() {
+    let dir = tempfile::tempdir().unwrap();
+    let config = dir.path().join("km_config.json");
+    std::fs::write(
+        &config,
+        r#"{"api_key": "km_test_key", "api_url": "http://127.0.0.1:9"}"#,
+    )
+    .unwrap();
+    let km = || {
+        let mut command = Command::new(env!("CARGO_BIN_EXE_km"));
+        command
+            .env("HOME", dir.path())
+            .env("XDG_CONFIG_HOME", dir.path().join(".config"))
+            .env_remove("KM_OFFLINE")
+            .arg("--config")
+            .arg(&config);
+        command
+    };
+
+    let status = km().args(["--offline", "status"]).output().unwrap();
+    assert!(status.status.success());
+    let stdout = String::from_utf8_lossy(&status.stdout);
+    assert!(stdout.starts_with("Offline mode"));
+    assert!(stdout.contains("http://127.0.0.1:9 (not contacted)"));
+
+    let status = km()
+        .env("KM_OFFLINE", "1")
+        .args(["status", "--json"])
+        .output()
+        .unwrap();
+    let status: serde_json::Value = serde_json::from_slice(&status.stdout).unwrap();
+    assert_eq!(status["offline"], true);
+    assert_eq!(status["signed_in"], false);
+
+    let search = km()
+        .args(["--offline", "--error-format", "json", "plugins", "search"])
+        .output()
+        .unwrap();
+    assert!(!search.status.success());
+    let stderr = String::from_utf8_lossy(&search.stderr);
+    let report: serde_json::Value = serde_json::from_str(stderr.lines().last().unwrap()).unwrap();
+    assert_eq!(report["code"], "OFFLINE");
+}
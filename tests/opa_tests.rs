@@ -0,0 +1,169 @@
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use km::opa::{self, OpaDecision, OpaPolicy, PolicyBundle};
+use serde_json::json;
+use std::path::Path;
+use tempfile::TempDir;
+
+const POLICY: &str = r#"package km
+
+default decision := {"allow": true}
+
+decision := {"allow": false, "reason": "shell is disabled"} if {
+    input.tool == "shell"
+}
+"#;
+
+fn write_bundle(path: &Path, files: &[(&str, &str)]) {
+    let file = std::fs::File::create(path).unwrap();
+    let mut archive = tar::Builder::new(GzEncoder::new(file, Compression::default()));
+    for (name, contents) in files {
+        let mut header = tar::Header::new_gnu();
+        header.set_size(contents.len() as u64);
+        header.set_mode(0o644);
+        header.set_cksum();
+        archive
+            .append_data(&mut header, name, contents.as_bytes())
+            .unwrap();
+    }
+    archive.into_inner().unwrap().finish().unwrap();
+}
+
+#[test]
+fn test_bundle_archive_is_read() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("bundle.tar.gz");
+    write_bundle(
+        &path,
+        &[
+            (
+                ".manifest",
+                r#"{"revision": "2024-06-01", "roots": ["km"]}"#,
+            ),
+            ("km/policy.rego", POLICY),
+            ("km/tools/data.json", r#"{"blocked": ["shell"]}"#),
+            ("data.json", r#"{"org": "acme"}"#),
+        ],
+    );
+
+    let bundle = PolicyBundle::open(&path).unwrap();
+    assert_eq!(bundle.revision.as_deref(), Some("2024-06-01"));
+    assert_eq!(bundle.modules.len(), 1);
+    assert_eq!(bundle.modules[0].0, "km/policy.rego");
+    assert_eq!(
+        bundle.data,
+        json!({"org": "acme", "km": {"tools": {"blocked": ["shell"]}}})
+    );
+}
+
+#[test]
+fn test_bundle_directory_is_read() {
+    let temp_dir = TempDir::new().unwrap();
+    std::fs::create_dir_all(temp_dir.path().join("km")).unwrap();
+    std::fs::write(temp_dir.path().join("km/policy.rego"), POLICY).unwrap();
+    std::fs::write(temp_dir.path().join("km/data.json"), r#"{"limit": 5}"#).unwrap();
+
+    let bundle = PolicyBundle::open(temp_dir.path()).unwrap();
+    assert_eq!(bundle.modules.len(), 1);
+    assert_eq!(bundle.data, json!({"km": {"limit": 5}}));
+    assert_eq!(bundle.revision, None);
+}
+
+#[test]
+fn test_bundle_without_policies_is_rejected() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("bundle.tar.gz");
+    write_bundle(&path, &[("data.json", "{}")]);
+    assert!(PolicyBundle::open(&path).is_err());
+
+    std::fs::write(temp_dir.path().join("plain.txt"), "not a bundle").unwrap();
+    assert!(PolicyBundle::open(&temp_dir.path().join("plain.txt")).is_err());
+}
+
+#[test]
+fn test_decision_values() {
+    assert!(OpaDecision::from_value(json!(true)).unwrap().allow);
+    assert!(!OpaDecision::from_value(json!(false)).unwrap().allow);
+    // An undefined decision allows
+    assert!(OpaDecision::from_value(json!(null)).unwrap().allow);
+
+    let decision = OpaDecision::from_value(json!({
+        "allow": true,
+        "redact": ["/params/arguments/password"]
+    }))
+    .unwrap();
+    assert_eq!(decision.redact, vec!["/params/arguments/password"]);
+    assert!(OpaDecision::from_value(json!("yes")).is_err());
+
+    let log = decision.log("request", Some("v1"));
+    assert_eq!(log["query"], "data.km.decision");
+    assert_eq!(log["revision"], "v1");
+    assert_eq!(log["result"]["allow"], true);
+}
+
+#[test]
+fn test_input_and_redaction() {
+    let request = json!({
+        "jsonrpc": "2.0",
+        "id": 3,
+        "method": "tools/call",
+        "params": {"name": "login", "arguments": {"user": "ann", "password": "hunter2"}}
+    });
+    let response = json!({"jsonrpc": "2.0", "id": 3, "result": {}});
+
+    let input = opa::input("response", &request, Some(&response), "session-1");
+    assert_eq!(input["phase"], "response");
+    assert_eq!(input["tool"], "login");
+    assert_eq!(input["method"], "tools/call");
+    assert_eq!(input["response"]["id"], 3);
+
+    let mut captured = request.clone();
+    opa::redact(
+        &mut captured,
+        &[
+            "/params/arguments/password".to_string(),
+            "/params/missing".to_string(),
+        ],
+    );
+    assert_eq!(
+        captured["params"]["arguments"]["password"],
+        "[REDACTED:policy]"
+    );
+    assert_eq!(captured["params"]["arguments"]["user"], "ann");
+}
+
+#[cfg(not(feature = "opa"))]
+#[test]
+fn test_policy_bundles_need_the_opa_feature() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("bundle.tar.gz");
+    write_bundle(&path, &[("km/policy.rego", POLICY)]);
+
+    let error = OpaPolicy::load(&path).unwrap_err().to_string();
+    assert!(error.contains("--features opa"));
+}
+
+#[cfg(feature = "opa")]
+#[test]
+fn test_rego_decides_calls() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("bundle.tar.gz");
+    write_bundle(&path, &[("km/policy.rego", POLICY)]);
+    let policy = OpaPolicy::load(&path).unwrap();
+
+    let shell =
+        json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call", "params": {"name": "shell"}});
+    let decision = policy
+        .decide(&opa::input("request", &shell, None, "s"))
+        .unwrap();
+    assert!(!decision.allow);
+    assert_eq!(decision.reason.as_deref(), Some("shell is disabled"));
+
+    let list = json!({"jsonrpc": "2.0", "id": 2, "method": "tools/list"});
+    assert!(
+        policy
+            .decide(&opa::input("request", &list, None, "s"))
+            .unwrap()
+            .allow
+    );
+}
@@ -0,0 +1,252 @@
+use chrono::{Duration, Utc};
+use km::correlation::{CallStatus, CorrelatedCall};
+use km::otel::{trace_id, OtlpConfig, SpanExporter};
+use serde_json::{json, Value};
+use std::collections::HashMap;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+use tokio::sync::mpsc;
+
+fn env(vars: &[(&str, &str)]) -> impl Fn(&str) -> Option<String> {
+    let vars: HashMap<String, String> = vars
+        .iter()
+        .map(|(k, v)| (k.to_string(), v.to_string()))
+        .collect();
+    move |name| vars.get(name).cloned()
+}
+
+const SESSION: &str = "6f1c2b9e-3d4a-4c5b-8e7f-0a1b2c3d4e5f";
+
+fn call(method: &str, params: Value, status: CallStatus) -> CorrelatedCall {
+    let started_at = Utc::now();
+    CorrelatedCall {
+        session_id: Some(SESSION.to_string()),
+        id: json!(7),
+        method: method.to_string(),
+        request: json!({"jsonrpc": "2.0", "id": 7, "method": method, "params": params}),
+        response: Some(json!({"jsonrpc": "2.0", "id": 7, "result": {}})),
+        started_at,
+        completed_at: Some(started_at + Duration::milliseconds(12)),
+        duration_ms: Some(12.0),
+        status,
+    }
+}
+
+fn attributes(span: &Value) -> HashMap<String, Value> {
+    span["attributes"]
+        .as_array()
+        .unwrap()
+        .iter()
+        .map(|a| (a["key"].as_str().unwrap().to_string(), a["value"].clone()))
+        .collect()
+}
+
+/// Collector stand-in: forwards each request's headers and body.
+async fn serve_collector() -> (String, mpsc::UnboundedReceiver<(String, Value)>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let (tx, rx) = mpsc::unbounded_channel();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut request = Vec::new();
+            let mut buf = vec![0u8; 64 * 1024];
+            // Read until the whole body announced by content-length is in
+            loop {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break;
+                }
+                request.extend_from_slice(&buf[..n]);
+                let text = String::from_utf8_lossy(&request).into_owned();
+                if let Some((head, body)) = text.split_once("\r\n\r\n") {
+                    let length = head
+                        .lines()
+                        .find_map(|l| {
+                            l.to_ascii_lowercase()
+                                .strip_prefix("content-length:")
+                                .map(|v| v.trim().parse::<usize>().unwrap())
+                        })
+                        .unwrap_or(0);
+                    if body.len() >= length {
+                        let _ = tx.send((head.to_string(), serde_json::from_str(body).unwrap()));
+                        break;
+                    }
+                }
+            }
+            let _ = socket
+                .write_all(b"HTTP/1.1 200 OK\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{}")
+                .await;
+        }
+    });
+
+    (format!("http://{}", addr), rx)
+}
+
+#[test]
+fn test_otlp_disabled_without_endpoint() {
+    assert_eq!(OtlpConfig::from_env(env(&[])).unwrap(), None);
+    assert_eq!(
+        OtlpConfig::from_env(env(&[
+            ("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"),
+            ("OTEL_SDK_DISABLED", "true"),
+        ]))
+        .unwrap(),
+        None
+    );
+    assert_eq!(
+        OtlpConfig::from_env(env(&[
+            ("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"),
+            ("OTEL_TRACES_EXPORTER", "none"),
+        ]))
+        .unwrap(),
+        None
+    );
+}
+
+#[test]
+fn test_otlp_config_from_standard_env_vars() {
+    let config = OtlpConfig::from_env(env(&[
+        ("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/"),
+        ("OTEL_EXPORTER_OTLP_HEADERS", "x-api-key=abc, x-tenant=dev"),
+        ("OTEL_EXPORTER_OTLP_TIMEOUT", "2500"),
+        (
+            "OTEL_RESOURCE_ATTRIBUTES",
+            "service.name=agent,deployment.environment=prod",
+        ),
+    ]))
+    .unwrap()
+    .unwrap();
+
+    assert_eq!(config.endpoint, "http://collector:4318/v1/traces");
+    assert_eq!(
+        config.headers,
+        vec![
+            ("x-api-key".to_string(), "abc".to_string()),
+            ("x-tenant".to_string(), "dev".to_string())
+        ]
+    );
+    assert_eq!(config.timeout, std::time::Duration::from_millis(2500));
+    assert_eq!(config.service_name, "agent");
+
+    // Signal-specific settings win, and the traces endpoint is used as is
+    let config = OtlpConfig::from_env(env(&[
+        ("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318"),
+        (
+            "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+            "http://traces:9999/custom",
+        ),
+        ("OTEL_SERVICE_NAME", "claude-desktop"),
+    ]))
+    .unwrap()
+    .unwrap();
+    assert_eq!(config.endpoint, "http://traces:9999/custom");
+    assert_eq!(config.service_name, "claude-desktop");
+
+    assert!(OtlpConfig::from_env(env(&[
+        ("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4317"),
+        ("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc"),
+    ]))
+    .is_err());
+}
+
+#[tokio::test]
+async fn test_span_per_call() {
+    let config = OtlpConfig::from_env(env(&[("OTEL_EXPORTER_OTLP_ENDPOINT", "http://c:4318")]))
+        .unwrap()
+        .unwrap();
+    let exporter = SpanExporter::new(config);
+    let calls = vec![
+        call(
+            "tools/call",
+            json!({"name": "shell", "arguments": {"command": "rm -rf /"}}),
+            CallStatus::Success,
+        ),
+        call(
+            "resources/read",
+            json!({}),
+            CallStatus::Error {
+                code: Some(-32602),
+                message: "bad uri".to_string(),
+            },
+        ),
+    ];
+
+    let payload = exporter.payload(&calls).await;
+    let resource = &payload["resourceSpans"][0];
+    assert_eq!(
+        resource["resource"]["attributes"][0],
+        json!({"key": "service.name", "value": {"stringValue": "km"}})
+    );
+    let spans = resource["scopeSpans"][0]["spans"].as_array().unwrap();
+    assert_eq!(spans.len(), 2);
+
+    let tool = &spans[0];
+    assert_eq!(tool["name"], "tools/call");
+    assert_eq!(tool["traceId"], "6f1c2b9e3d4a4c5b8e7f0a1b2c3d4e5f");
+    assert_eq!(tool["spanId"].as_str().unwrap().len(), 16);
+    assert_eq!(tool["status"]["code"], 1);
+    let start: u128 = tool["startTimeUnixNano"].as_str().unwrap().parse().unwrap();
+    let end: u128 = tool["endTimeUnixNano"].as_str().unwrap().parse().unwrap();
+    assert_eq!(end - start, 12_000_000);
+
+    let attrs = attributes(tool);
+    assert_eq!(attrs["rpc.method"]["stringValue"], "tools/call");
+    assert_eq!(attrs["mcp.tool.name"]["stringValue"], "shell");
+    assert!(attrs["km.risk.score"]["doubleValue"].as_f64().unwrap() > 0.5);
+    let size: usize = attrs["mcp.request.size"]["intValue"]
+        .as_str()
+        .unwrap()
+        .parse()
+        .unwrap();
+    assert_eq!(size, calls[0].request.to_string().len());
+    assert!(attrs.contains_key("mcp.response.size"));
+
+    let failed = &spans[1];
+    assert_eq!(failed["status"], json!({"code": 2, "message": "bad uri"}));
+    assert_eq!(
+        attributes(failed)["rpc.jsonrpc.error_code"]["intValue"],
+        "-32602"
+    );
+    // Calls from one session share a trace
+    assert_eq!(failed["traceId"], tool["traceId"]);
+    assert_ne!(failed["spanId"], tool["spanId"]);
+}
+
+#[test]
+fn test_trace_id_without_session() {
+    let id = trace_id(None);
+    assert_eq!(id.len(), 32);
+    assert!(id.chars().all(|c| c.is_ascii_hexdigit()));
+}
+
+#[tokio::test]
+async fn test_exporter_flushes_on_close() {
+    let (url, mut received) = serve_collector().await;
+    let config = OtlpConfig::from_env(env(&[
+        ("OTEL_EXPORTER_OTLP_ENDPOINT", &url),
+        ("OTEL_EXPORTER_OTLP_HEADERS", "x-api-key=secret"),
+    ]))
+    .unwrap()
+    .unwrap();
+
+    let (tx, rx) = mpsc::channel(16);
+    let handle = SpanExporter::new(config).spawn(rx);
+    tx.send(call("tools/list", json!({}), CallStatus::Success))
+        .await
+        .unwrap();
+    tx.send(call("tools/call", json!({}), CallStatus::Success))
+        .await
+        .unwrap();
+    drop(tx);
+    handle.await.unwrap();
+
+    let (head, body) = received.recv().await.unwrap();
+    assert!(head.starts_with("POST /v1/traces"));
+    assert!(head.to_ascii_lowercase().contains("x-api-key: secret"));
+    let spans = body["resourceSpans"][0]["scopeSpans"][0]["spans"]
+        .as_array()
+        .unwrap();
+    let names: Vec<&str> = spans.iter().map(|s| s["name"].as_str().unwrap()).collect();
+    assert_eq!(names, vec!["tools/list", "tools/call"]);
+}
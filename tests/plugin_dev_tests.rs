@@ -0,0 +1,186 @@
+#![cfg(unix)]
+
+use chrono::Utc;
+use km::plugins::dev::{self, DevManifest, Expectation, ExpectedAction, Harness, Template};
+use km::plugins::runtime::PluginAction;
+use km::plugins::sandbox::PluginSandboxConfig;
+use km::replay;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+use std::fs;
+use std::path::Path;
+use tempfile::TempDir;
+
+/// Blocks calls to the shell tool, tags file reads and allows everything
+/// else.
+const GUARD_SOURCE: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"hook":"on_response"'*) ;;
+    *'"name":"shell"'*) printf '{"id":%s,"action":"block","reason":"no shell access"}\n' "$id" ;;
+    *'"name":"read_file"'*) printf '{"id":%s,"action":"allow","metadata":{"reads":true}}\n' "$id" ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+/// A plugin directory whose "build" copies the script into place.
+fn plugin_dir(temp_dir: &TempDir) -> std::path::PathBuf {
+    let dir = temp_dir.path().join("guard");
+    fs::create_dir_all(&dir).unwrap();
+    fs::write(dir.join("guard.sh"), GUARD_SOURCE).unwrap();
+    fs::write(
+        dir.join(dev::MANIFEST_FILE),
+        json!({
+            "name": "guard",
+            "version": "0.1.0",
+            "build": ["cp", "guard.sh", "guard"],
+            "binary": "guard"
+        })
+        .to_string(),
+    )
+    .unwrap();
+    dir
+}
+
+fn entry(direction: &str, content: Value) -> String {
+    serde_json::to_string(&TrafficEntry {
+        timestamp: Utc::now(),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("dev-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    })
+    .unwrap()
+}
+
+fn tool_call(id: u64, name: &str) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "method": "tools/call", "params": {"name": name}})
+}
+
+fn capture(path: &Path) {
+    let lines = [
+        entry(
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize"}),
+        ),
+        entry("response", json!({"jsonrpc": "2.0", "id": 1, "result": {}})),
+        entry("request", tool_call(2, "read_file")),
+        entry("request", tool_call(3, "shell")),
+    ];
+    fs::write(path, lines.join("\n") + "\n").unwrap();
+}
+
+fn expectation(line: Value) -> Expectation {
+    serde_json::from_value(line).unwrap()
+}
+
+#[test]
+fn test_harness_decides_on_a_replayed_capture() {
+    let temp_dir = TempDir::new().unwrap();
+    let dir = plugin_dir(&temp_dir);
+    let log = temp_dir.path().join("mcp_traffic.jsonl");
+    capture(&log);
+
+    let manifest = DevManifest::read(&dir).unwrap();
+    manifest.build(&dir).unwrap();
+    let harness = Harness::load(
+        &dir,
+        &manifest,
+        &PluginSandboxConfig::default(),
+        &Value::Null,
+    )
+    .unwrap();
+    let entries = km::traffic::read_entries(&log).unwrap();
+    let decided = harness.replay(&replay::build_steps(&entries, Some("dev-1")));
+
+    assert_eq!(decided.len(), 3);
+    assert_eq!(decided[0].action, PluginAction::Allow);
+    assert_eq!(decided[1].tool.as_deref(), Some("read_file"));
+    assert_eq!(decided[1].metadata.get("reads"), Some(&json!(true)));
+    assert_eq!(
+        decided[2].action,
+        PluginAction::Block {
+            reason: "no shell access".to_string()
+        }
+    );
+
+    let expectations = [
+        expectation(json!({"method": "initialize", "action": "allow"})),
+        expectation(
+            json!({"method": "tools/*", "tool": "shell", "action": "block", "reason": "shell"}),
+        ),
+        expectation(json!({"id": 2, "action": "allow"})),
+    ];
+    assert!(dev::check(&expectations, &decided).is_empty());
+
+    let failures = dev::check(
+        &[
+            expectation(json!({"tool": "read_file", "action": "block"})),
+            expectation(json!({"id": 3, "action": "block", "reason": "policy"})),
+            expectation(json!({"method": "tools/list", "action": "allow"})),
+        ],
+        &decided,
+    );
+    assert_eq!(failures.len(), 3, "{:?}", failures);
+    assert!(failures[0].contains("expected Block, got Allow"));
+    assert!(failures[1].contains("does not mention \"policy\""));
+    assert!(failures[2].contains("no such request"));
+}
+
+#[test]
+fn test_scaffold_writes_a_plugin_that_reads_back() {
+    let temp_dir = TempDir::new().unwrap();
+    let dir = temp_dir.path().join("pii-filter");
+    let files = dev::scaffold(&dir, "pii-filter", Template::Go).unwrap();
+    assert!(files.contains(&dir.join("main.go")));
+    assert!(fs::read_to_string(dir.join("go.mod"))
+        .unwrap()
+        .starts_with("module pii-filter\n"));
+
+    let manifest = DevManifest::read(&dir).unwrap();
+    assert_eq!(manifest.release.name, "pii-filter");
+    assert_eq!(manifest.build, ["go", "build", "-o", "pii-filter", "."]);
+    let expectations = dev::read_expectations(&dir.join("expect.jsonl")).unwrap();
+    assert_eq!(expectations[0].action, ExpectedAction::Allow);
+
+    // Never writes over an existing plugin
+    assert!(dev::scaffold(&dir, "pii-filter", Template::Wasm).is_err());
+
+    let wasm = temp_dir.path().join("wasm");
+    dev::scaffold(&wasm, "pii-filter", Template::Wasm).unwrap();
+    assert!(fs::read_to_string(wasm.join("src/lib.rs"))
+        .unwrap()
+        .contains("pub extern \"C\" fn on_request"));
+    assert_eq!(
+        DevManifest::read(&wasm).unwrap().binary,
+        Path::new("target/wasm32-unknown-unknown/release/pii_filter.wasm")
+    );
+}
+
+#[test]
+fn test_fingerprint_follows_sources_only() {
+    let temp_dir = TempDir::new().unwrap();
+    let dir = plugin_dir(&temp_dir);
+    let manifest = DevManifest::read(&dir).unwrap();
+    let before = dev::fingerprint(&dir, &manifest).unwrap();
+
+    std::thread::sleep(std::time::Duration::from_millis(20));
+    manifest.build(&dir).unwrap();
+    fs::create_dir_all(dir.join(".km-dev")).unwrap();
+    fs::write(dir.join(".km-dev/scratch"), "x").unwrap();
+    assert_eq!(dev::fingerprint(&dir, &manifest), Some(before));
+
+    fs::write(
+        dir.join("guard.sh"),
+        GUARD_SOURCE.replace("no shell", "never"),
+    )
+    .unwrap();
+    assert!(dev::fingerprint(&dir, &manifest).unwrap() > before);
+}
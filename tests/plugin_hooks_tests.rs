@@ -0,0 +1,68 @@
+use km::plugins::hooks::{ToolCall, TypedHook};
+use serde_json::json;
+
+#[test]
+fn test_requests_map_to_typed_hooks() {
+    let call = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+        "params": {"name": "search", "arguments": {"query": "km", "limit": 5}}});
+    match TypedHook::for_request(&call) {
+        Some(TypedHook::ToolCall(ToolCall { name, arguments })) => {
+            assert_eq!(name, "search");
+            assert_eq!(arguments["limit"], 5);
+        }
+        other => panic!("expected a tool call, got {:?}", other),
+    }
+
+    let cases = [
+        (
+            json!({"method": "tools/call", "params": {"name": "list"}}),
+            Some("on_tool_call"),
+        ),
+        (
+            json!({"method": "resources/read", "params": {"uri": "file:///a"}}),
+            Some("on_resource_read"),
+        ),
+        (
+            json!({"method": "prompts/get", "params": {"name": "review"}}),
+            Some("on_prompt_get"),
+        ),
+        (json!({"method": "resources/read", "params": {}}), None),
+        (
+            json!({"method": "tools/call", "params": {"name": "x", "arguments": [1]}}),
+            None,
+        ),
+        (json!({"method": "tools/list"}), None),
+        (json!({"id": 1, "result": {}}), None),
+    ];
+    for (message, hook) in cases {
+        assert_eq!(
+            TypedHook::for_request(&message).map(|t| t.hook()),
+            hook,
+            "{}",
+            message
+        );
+    }
+    assert_eq!(
+        TypedHook::for_request(&call).unwrap().fallback(),
+        "on_request"
+    );
+}
+
+#[test]
+fn test_sampling_requests_come_from_the_server() {
+    let sampling = json!({"jsonrpc": "2.0", "id": 3, "method": "sampling/createMessage",
+        "params": {"messages": [{"role": "user", "content": {"type": "text", "text": "hi"}}],
+            "modelPreferences": {"hints": [{"name": "claude"}]}, "maxTokens": 50}});
+    assert!(TypedHook::for_request(&sampling).is_none());
+
+    let typed = TypedHook::for_server_message(&sampling).unwrap();
+    assert_eq!(typed.hook(), "on_sampling_request");
+    assert_eq!(typed.fallback(), "on_response");
+    // Plugins get the params in snake_case, like the rest of the protocol
+    let call = serde_json::to_value(&typed).unwrap();
+    assert_eq!(call["max_tokens"], 50);
+    assert_eq!(call["model_preferences"]["hints"][0]["name"], "claude");
+    assert!(call.get("system_prompt").is_none());
+
+    assert!(TypedHook::for_server_message(&json!({"id": 3, "result": {}})).is_none());
+}
@@ -0,0 +1,837 @@
+#![cfg(unix)]
+
+use km::audit::{DecisionLog, DecisionRecord, Verdict};
+use km::config::Config;
+use km::entitlements::Entitlements;
+use km::handlers::run_plugin_subcommand;
+use km::plugins::health::{FailurePolicy, HealthState};
+use km::plugins::marketplace::PluginRelease;
+use km::plugins::outbox::Outbox;
+use km::plugins::runtime::{
+    ChainOutcome, Metadata, PluginAction, PluginHost, PluginInstance, PluginProcess,
+};
+use km::plugins::sandbox::PluginSandboxConfig;
+use km::plugins::store::{InstalledPlugin, PluginRuntime, PluginStore};
+use km::plugins::verify::Trust;
+use serde_json::{json, Value};
+use std::collections::BTreeMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tempfile::TempDir;
+
+/// Answers every call: blocks tools/call, allows everything else.
+const GUARD_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"method":"tools/call"'*) printf '{"id":%s,"action":"block","reason":"no tools"}\n' "$id" ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+/// Rewrites every message into a tools/list request and tags it.
+const REWRITE_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  printf '{"id":%s,"action":"modify","message":{"jsonrpc":"2.0","id":1,"method":"tools/list"},"metadata":{"rewritten":true}}\n' "$id"
+done
+"#;
+
+/// Reads calls but never answers.
+const HUNG_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do sleep 30; done
+"#;
+
+/// Records the responses and session starts it is shown in its workdir.
+const AUDIT_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  case "$line" in
+    *'"hook":"on_response"'*) printf '%s\n' "$line" >> "$HOME/responses.log" ;;
+    *'"hook":"on_session_start"'*) printf '%s\n' "$line" >> "$HOME/sessions.log" ;;
+    *'"hook":"on_entitlements_changed"'*) printf '%s\n' "$line" >> "$HOME/plans.log" ;;
+    *)
+      id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+      printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+/// Reports its environment in the block reason.
+const ENV_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  printf '{"id":%s,"action":"block","reason":"%s|%s|%s"}\n' "$id" "$KM_PLUGIN_TEST_SECRET" "$HOME" "$(pwd)"
+done
+"#;
+
+/// Speaks protocol 2: records every call, blocks deleting files and allows
+/// everything else.
+const TYPED_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  printf '%s\n' "$line" >> "$HOME/calls.log"
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"hook":"on_tool_call"'*'"call":{"name":"delete_file"'*) printf '{"id":%s,"action":"block","reason":"no deleting"}\n' "$id" ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+/// Speaks protocol 3 and adds `km compliance`, plus `km <name>-extra`
+/// named after its own plugin directory.
+const COMMAND_PLUGIN: &str = r#"#!/bin/sh
+extra="$(basename "$(dirname "$PWD")")-extra"
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"hook":"describe"'*) printf '{"id":%s,"commands":[{"name":"compliance","about":"Compliance reports"},{"name":"%s"}]}\n' "$id" "$extra" ;;
+    *'"hook":"run_command"'*'"args":["report"]'*) printf '{"id":%s,"stdout":"%s: all clear\\n"}\n' "$id" "$extra" ;;
+    *'"hook":"run_command"'*) printf '{"id":%s,"stderr":"unknown report\\n","exit_code":2}\n' "$id" ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+/// Speaks protocol 4: records the responses it's shown and acknowledges
+/// all but the ones it finds too slow to handle.
+const ACK_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"hook":"on_response"'*)
+      printf '%s\n' "$line" >> "$HOME/responses.log"
+      case "$line" in
+        *'"slow"'*) ;;
+        *) printf '{"id":%s,"ack":true}\n' "$id" ;;
+      esac ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+/// Answers one call, then exits.
+const CRASH_PLUGIN: &str = r#"#!/bin/sh
+IFS= read -r line
+id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+printf '{"id":%s,"action":"allow"}\n' "$id"
+"#;
+
+/// Speaks protocol 5: reports it is serving until a `sick` file shows up
+/// in its workdir.
+const HEALTH_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"hook":"health"'*)
+      if [ -e "$HOME/sick" ]; then status=not_serving; else status=serving; fi
+      printf '{"id":%s,"status":"%s"}\n' "$id" "$status" ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+fn install(store: &PluginStore, name: &str, script: &str) -> InstalledPlugin {
+    install_speaking(store, name, script, 1)
+}
+
+fn install_speaking(
+    store: &PluginStore,
+    name: &str,
+    script: &str,
+    protocol: u32,
+) -> InstalledPlugin {
+    store
+        .install(&release(name, protocol), script.as_bytes(), Trust::Signed)
+        .unwrap()
+}
+
+fn release(name: &str, protocol: u32) -> PluginRelease {
+    PluginRelease {
+        name: name.to_string(),
+        version: "1.0.0".to_string(),
+        description: String::new(),
+        download_url: None,
+        sha256: None,
+        signature: None,
+        protocol,
+        config_schema: None,
+    }
+}
+
+fn start(store: &PluginStore, call_timeout_ms: u64, allow_unsigned: bool) -> PluginHost {
+    PluginHost::start(
+        store,
+        &sandbox(call_timeout_ms),
+        allow_unsigned,
+        &BTreeMap::new(),
+        &BTreeMap::new(),
+    )
+    .unwrap()
+}
+
+fn is_forwarded(outcome: &ChainOutcome) -> bool {
+    matches!(outcome, ChainOutcome::Forward { .. })
+}
+
+fn blocked_by(outcome: ChainOutcome) -> Option<(String, String)> {
+    match outcome {
+        ChainOutcome::Block { plugin, reason, .. } => Some((plugin, reason)),
+        ChainOutcome::Forward { .. } => None,
+    }
+}
+
+fn sandbox(call_timeout_ms: u64) -> PluginSandboxConfig {
+    PluginSandboxConfig {
+        call_timeout_ms,
+        ..Default::default()
+    }
+}
+
+#[test]
+fn test_plugin_allows_and_blocks() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let plugin = install(&store, "guard", GUARD_PLUGIN);
+
+    let mut process = PluginProcess::spawn(&plugin, &sandbox(5000)).unwrap();
+    let ping = json!({"jsonrpc": "2.0", "id": 1, "method": "ping"});
+    let call = json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call"});
+
+    let metadata = Metadata::new();
+    assert_eq!(
+        process.call("on_request", &ping, &metadata).unwrap().action,
+        PluginAction::Allow
+    );
+    assert_eq!(
+        process.call("on_request", &call, &metadata).unwrap().action,
+        PluginAction::Block {
+            reason: "no tools".to_string()
+        }
+    );
+}
+
+#[test]
+fn test_host_reports_first_block() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "guard", GUARD_PLUGIN);
+
+    let host = start(&store, 5000, false);
+    assert!(is_forwarded(&host.on_request(
+        &json!({"jsonrpc": "2.0", "id": 1, "method": "ping"})
+    )));
+    assert_eq!(
+        blocked_by(host.on_request(&json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call"}))),
+        Some(("guard".to_string(), "no tools".to_string()))
+    );
+}
+
+#[test]
+fn test_hung_plugin_times_out_and_is_restarted() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "hung", HUNG_PLUGIN);
+
+    let host = start(&store, 200, false);
+    assert!(!host.is_empty());
+
+    let started = Instant::now();
+    let message = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call"});
+    assert!(is_forwarded(&host.on_request(&message)));
+    assert!(started.elapsed() < Duration::from_secs(5));
+    assert!(host.is_empty());
+    let health = &host.health()[0];
+    assert_eq!(health.state, HealthState::Restarting);
+    assert_eq!(health.consecutive_failures, 1);
+    assert!(health.restart_at.is_some());
+
+    // Without restarts, it's down for the rest of the session
+    let config = PluginSandboxConfig {
+        max_restarts: 0,
+        ..sandbox(200)
+    };
+    let host =
+        PluginHost::start(&store, &config, false, &BTreeMap::new(), &BTreeMap::new()).unwrap();
+    assert!(is_forwarded(&host.on_request(&message)));
+    assert_eq!(host.health()[0].state, HealthState::Stopped);
+}
+
+#[test]
+fn test_crashed_plugin_is_restarted_after_backoff() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "crashy", CRASH_PLUGIN);
+    let message = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"});
+
+    let host = start(&store, 1000, false);
+    assert!(is_forwarded(&host.on_request(&message)));
+    std::thread::sleep(Duration::from_millis(200));
+    host.check_health();
+    let health = &host.health()[0];
+    assert_eq!(health.state, HealthState::Restarting);
+    assert!(health.last_error.as_deref().unwrap().contains("exited"));
+
+    // Not yet due
+    host.check_health();
+    assert_eq!(host.health()[0].restarts, 0);
+
+    std::thread::sleep(Duration::from_millis(1100));
+    host.check_health();
+    let health = &host.health()[0];
+    assert_eq!(health.state, HealthState::Healthy);
+    assert_eq!(health.restarts, 1);
+    assert_eq!(health.consecutive_failures, 1);
+
+    assert!(is_forwarded(&host.on_request(&message)));
+    assert_eq!(host.health()[0].consecutive_failures, 0);
+}
+
+#[test]
+fn test_closed_failure_policy_blocks_while_plugin_is_down() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "hung", HUNG_PLUGIN);
+    store
+        .install(
+            &release("unsigned", 1),
+            GUARD_PLUGIN.as_bytes(),
+            Trust::ChecksumOnly,
+        )
+        .unwrap();
+    let policies = BTreeMap::from([
+        ("hung".to_string(), FailurePolicy::Closed),
+        ("unsigned".to_string(), FailurePolicy::Open),
+    ]);
+    let host = start(&store, 200, false).with_failure_policies(&policies);
+    let message = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"});
+
+    let blocked = Some(("hung".to_string(), "plugin hung is unavailable".to_string()));
+    assert_eq!(blocked_by(host.on_request(&message)), blocked);
+    // Still down: blocked without waiting on the plugin
+    let started = Instant::now();
+    assert_eq!(blocked_by(host.on_request(&message)), blocked);
+    assert!(started.elapsed() < Duration::from_millis(100));
+
+    let health = host.health();
+    assert_eq!(health[1].name, "unsigned");
+    assert_eq!(health[1].state, HealthState::Stopped);
+    assert!(health[1]
+        .last_error
+        .as_deref()
+        .unwrap()
+        .contains("unsigned"));
+
+    // Plugins that didn't start hold requests up too when they fail closed
+    let policies = BTreeMap::from([("unsigned".to_string(), FailurePolicy::Closed)]);
+    store.remove("hung").unwrap();
+    let host = start(&store, 200, false).with_failure_policies(&policies);
+    assert_eq!(
+        blocked_by(host.on_request(&message)),
+        Some((
+            "unsigned".to_string(),
+            "plugin unsigned is unavailable".to_string()
+        ))
+    );
+}
+
+#[test]
+fn test_protocol_5_plugins_answer_health_checks() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let plugin = install_speaking(&store, "checked", HEALTH_PLUGIN, 5);
+
+    let host = start(&store, 1000, false);
+    host.check_health();
+    let health = &host.health()[0];
+    assert_eq!(health.state, HealthState::Healthy);
+    assert!(health.last_check.is_some());
+
+    std::fs::write(plugin.path.parent().unwrap().join("work/sick"), "").unwrap();
+    host.check_health();
+    let health = &host.health()[0];
+    assert_eq!(health.state, HealthState::Restarting);
+    assert_eq!(
+        health.last_error.as_deref(),
+        Some("Plugin checked reports it is not_serving")
+    );
+}
+
+#[test]
+fn test_each_plugin_decision_is_logged() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "guard", GUARD_PLUGIN);
+    install(&store, "rewrite", REWRITE_PLUGIN);
+    let log = Arc::new(DecisionLog::create(&temp_dir.path().join("decisions"), "s-1").unwrap());
+
+    let host = start(&store, 1000, false).with_decision_log(log.clone());
+    host.on_request(&json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}));
+    host.on_request(&json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call",
+                            "params": {"name": "shell"}}));
+    // Kept when the plugins are reloaded
+    host.replace(start(&store, 1000, false));
+    host.on_request(&json!({"jsonrpc": "2.0", "id": 3, "method": "tools/list"}));
+
+    let decided: Vec<(String, Verdict, Value)> = std::fs::read_to_string(log.path())
+        .unwrap()
+        .lines()
+        .map(|line| serde_json::from_str::<DecisionRecord>(line).unwrap())
+        .map(|record| (record.actor, record.action, record.request_id))
+        .collect();
+    assert_eq!(
+        decided,
+        vec![
+            ("guard".to_string(), Verdict::Allow, json!(1)),
+            ("rewrite".to_string(), Verdict::Modify, json!(1)),
+            ("guard".to_string(), Verdict::Block, json!(2)),
+            ("guard".to_string(), Verdict::Allow, json!(3)),
+            ("rewrite".to_string(), Verdict::Modify, json!(3)),
+        ]
+    );
+    assert!(km::audit::verify_file(log.path(), false).unwrap()[0].is_intact());
+}
+
+#[test]
+fn test_unsigned_and_modified_plugins_are_not_started() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    store
+        .install(
+            &release("unsigned", 1),
+            GUARD_PLUGIN.as_bytes(),
+            Trust::ChecksumOnly,
+        )
+        .unwrap();
+    let tampered = install(&store, "tampered", GUARD_PLUGIN);
+    std::fs::write(&tampered.path, HUNG_PLUGIN).unwrap();
+
+    assert!(start(&store, 1000, false).is_empty());
+    // Opting in to unsigned plugins still refuses modified binaries
+    let host = start(&store, 1000, true);
+    assert_eq!(
+        blocked_by(host.on_request(&json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call"}))),
+        Some(("unsigned".to_string(), "no tools".to_string()))
+    );
+}
+
+#[test]
+fn test_plugin_environment_is_scrubbed() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let plugin = install(&store, "env", ENV_PLUGIN);
+    std::env::set_var("KM_PLUGIN_TEST_SECRET", "secret-value");
+
+    let mut process = PluginProcess::spawn(&plugin, &sandbox(5000)).unwrap();
+    let reason = match process
+        .call("on_request", &json!({}), &Metadata::new())
+        .unwrap()
+        .action
+    {
+        PluginAction::Block { reason } => reason,
+        other => panic!("unexpected action {:?}", other),
+    };
+
+    let workdir = plugin.path.parent().unwrap().join("work");
+    let workdir = workdir.canonicalize().unwrap();
+    let parts: Vec<&str> = reason.split('|').collect();
+    assert_eq!(parts[0], "");
+    for dir in &parts[1..] {
+        assert_eq!(std::path::Path::new(dir).canonicalize().unwrap(), workdir);
+    }
+}
+
+#[test]
+fn test_chain_order_follows_priorities() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "guard", GUARD_PLUGIN);
+    install(&store, "rewrite", REWRITE_PLUGIN);
+    let call = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call"});
+
+    // By name: guard runs first and blocks before the rewrite happens
+    let host = start(&store, 5000, false);
+    assert_eq!(
+        blocked_by(host.on_request(&call)),
+        Some(("guard".to_string(), "no tools".to_string()))
+    );
+
+    // Rewrite first: guard only sees the rewritten tools/list request
+    let priorities = BTreeMap::from([("rewrite".to_string(), 10)]);
+    let host =
+        PluginHost::start(&store, &sandbox(5000), false, &priorities, &BTreeMap::new()).unwrap();
+    match host.on_request(&call) {
+        ChainOutcome::Forward { message, metadata } => {
+            assert_eq!(message["method"], "tools/list");
+            assert_eq!(metadata.get("rewritten"), Some(&Value::Bool(true)));
+        }
+        other => panic!("expected the message to be forwarded, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_responses_are_shown_to_plugins_without_waiting() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let plugin = install(&store, "audit", AUDIT_PLUGIN);
+
+    let host = start(&store, 5000, false);
+    host.on_response(&json!({"jsonrpc": "2.0", "id": 1, "result": {"tools": []}}));
+    // The plugin still answers requests after a notification
+    assert!(is_forwarded(&host.on_request(
+        &json!({"jsonrpc": "2.0", "id": 2, "method": "ping"})
+    )));
+
+    let log = plugin.path.parent().unwrap().join("work/responses.log");
+    let recorded: Value =
+        serde_json::from_str(std::fs::read_to_string(&log).unwrap().trim()).unwrap();
+    assert_eq!(recorded["hook"], "on_response");
+    assert_eq!(recorded["message"]["result"], json!({"tools": []}));
+    assert!(!host.is_empty());
+}
+
+#[test]
+fn test_session_start_carries_labels() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let audit = install(&store, "audit", AUDIT_PLUGIN);
+    // Answers the notification like any call; the stray reply is skipped
+    install(&store, "guard", GUARD_PLUGIN);
+
+    let host = start(&store, 5000, false);
+    let labels = BTreeMap::from([("team".to_string(), "payments".to_string())]);
+    host.on_session_start("session-1", &labels, &Entitlements::from_tier("pro"));
+    assert_eq!(
+        blocked_by(host.on_request(&json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call"}))),
+        Some(("guard".to_string(), "no tools".to_string()))
+    );
+
+    let log = audit.path.parent().unwrap().join("work/sessions.log");
+    let recorded: Value =
+        serde_json::from_str(std::fs::read_to_string(&log).unwrap().trim()).unwrap();
+    assert_eq!(recorded["hook"], "on_session_start");
+    assert_eq!(recorded["message"]["session_id"], "session-1");
+    assert_eq!(recorded["message"]["labels"], json!({"team": "payments"}));
+    assert_eq!(recorded["message"]["tier"], "pro");
+    assert_eq!(recorded["message"]["features"], json!(["risk_analysis"]));
+}
+
+#[test]
+fn test_plan_changes_reach_plugins() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let audit = install(&store, "audit", AUDIT_PLUGIN);
+
+    let host = start(&store, 5000, false);
+    host.on_session_start(
+        "session-1",
+        &BTreeMap::new(),
+        &Entitlements::from_tier("pro"),
+    );
+    host.on_entitlements_changed(&Entitlements::from_tier("free"));
+    // Notifications are written in order; a call after them finds both
+    host.on_request(&json!({"jsonrpc": "2.0", "id": 2, "method": "tools/list"}));
+
+    let changes = recorded_calls(&audit, "plans.log");
+    assert_eq!(changes.len(), 1);
+    assert_eq!(changes[0]["hook"], "on_entitlements_changed");
+    assert_eq!(changes[0]["message"]["tier"], "free");
+    assert_eq!(changes[0]["message"]["features"], json!([]));
+    assert_eq!(changes[0]["message"]["entitlement_token"], Value::Null);
+}
+
+/// Hook calls a plugin recorded in its workdir
+fn recorded_calls(plugin: &InstalledPlugin, log: &str) -> Vec<Value> {
+    let log = plugin.path.parent().unwrap().join("work").join(log);
+    std::fs::read_to_string(log)
+        .unwrap()
+        .lines()
+        .map(|line| serde_json::from_str(line).unwrap())
+        .collect()
+}
+
+#[test]
+fn test_protocol_2_plugins_get_typed_hooks() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let audit = install(&store, "audit", AUDIT_PLUGIN);
+    let typed = install_speaking(&store, "typed", TYPED_PLUGIN, 2);
+
+    let host = start(&store, 5000, false);
+    let delete = json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+        "params": {"name": "delete_file", "arguments": {"path": "/etc/hosts"}}});
+    assert_eq!(
+        blocked_by(host.on_request(&delete)),
+        Some(("typed".to_string(), "no deleting".to_string()))
+    );
+    for request in [
+        json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call",
+            "params": {"name": "read_file", "arguments": {"path": "README.md"}}}),
+        json!({"jsonrpc": "2.0", "id": 3, "method": "resources/read",
+            "params": {"uri": "file:///notes.txt"}}),
+        json!({"jsonrpc": "2.0", "id": 4, "method": "prompts/get",
+            "params": {"name": "review", "arguments": {"lang": "rust"}}}),
+        // Params that don't parse fall back to on_request
+        json!({"jsonrpc": "2.0", "id": 5, "method": "tools/call", "params": {}}),
+    ] {
+        assert!(is_forwarded(&host.on_request(&request)));
+    }
+    host.on_response(
+        &json!({"jsonrpc": "2.0", "id": 9, "method": "sampling/createMessage",
+        "params": {"messages": [{"role": "user", "content": {"type": "text", "text": "hi"}}],
+            "systemPrompt": "Be brief", "maxTokens": 100}}),
+    );
+    // Waits until both plugins have handled the notification
+    assert!(is_forwarded(&host.on_request(
+        &json!({"jsonrpc": "2.0", "id": 6, "method": "ping"})
+    )));
+
+    let calls = recorded_calls(&typed, "calls.log");
+    let hooks: Vec<&str> = calls.iter().map(|c| c["hook"].as_str().unwrap()).collect();
+    assert_eq!(
+        hooks,
+        vec![
+            "on_tool_call",
+            "on_tool_call",
+            "on_resource_read",
+            "on_prompt_get",
+            "on_request",
+            "on_sampling_request",
+            "on_request",
+        ]
+    );
+    assert_eq!(
+        calls[1]["call"],
+        json!({"name": "read_file", "arguments": {"path": "README.md"}})
+    );
+    assert_eq!(calls[1]["message"]["id"], 2);
+    assert_eq!(calls[2]["call"], json!({"uri": "file:///notes.txt"}));
+    assert_eq!(calls[3]["call"]["arguments"]["lang"], "rust");
+    assert!(calls[4].get("call").is_none());
+    assert_eq!(calls[5]["call"]["max_tokens"], 100);
+    assert_eq!(calls[5]["call"]["system_prompt"], "Be brief");
+    assert_eq!(calls[5]["call"]["messages"][0]["role"], "user");
+
+    // Protocol 1 plugins see the same traffic through the generic hooks
+    let responses = recorded_calls(&audit, "responses.log");
+    assert_eq!(responses.len(), 1);
+    assert_eq!(responses[0]["message"]["method"], "sampling/createMessage");
+    assert!(responses[0].get("call").is_none());
+}
+
+#[test]
+fn test_plugins_provide_subcommands() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install_speaking(&store, "compliance", COMMAND_PLUGIN, 3);
+    install_speaking(&store, "shadow", COMMAND_PLUGIN, 3);
+    // Protocol 1 plugins are never asked for commands
+    install(&store, "guard", GUARD_PLUGIN);
+
+    let host = start(&store, 5000, false);
+    let commands: Vec<(String, String)> = host
+        .commands()
+        .into_iter()
+        .map(|c| (c.name, c.plugin))
+        .collect();
+    assert_eq!(
+        commands,
+        vec![
+            ("compliance".to_string(), "compliance".to_string()),
+            ("compliance-extra".to_string(), "compliance".to_string()),
+            ("shadow-extra".to_string(), "shadow".to_string()),
+        ]
+    );
+
+    let output = host
+        .run_command("shadow-extra", &["report".to_string()])
+        .unwrap()
+        .unwrap();
+    assert_eq!(output.stdout, "shadow-extra: all clear\n");
+    assert_eq!(output.exit_code, 0);
+    let output = host
+        .run_command("compliance", &["audit".to_string()])
+        .unwrap()
+        .unwrap();
+    assert_eq!(
+        (output.stderr.as_str(), output.exit_code),
+        ("unknown report\n", 2)
+    );
+    assert!(host.run_command("unknown", &[]).unwrap().is_none());
+    // The chain keeps working
+    assert!(is_forwarded(&host.on_request(
+        &json!({"jsonrpc": "2.0", "id": 1, "method": "ping"})
+    )));
+
+    let args = |args: &[&str]| args.iter().map(|a| a.to_string()).collect::<Vec<_>>();
+    let settings = Config::default();
+    assert!(run_plugin_subcommand(&store, &settings, &args(&["compliance", "report"])).is_ok());
+    let error =
+        run_plugin_subcommand(&store, &settings, &args(&["compliance", "audit"])).unwrap_err();
+    assert_eq!(error.to_string(), "km compliance failed with exit code 2");
+    let error = run_plugin_subcommand(&store, &settings, &args(&["nope"])).unwrap_err();
+    assert!(
+        error.to_string().contains("km plugins commands"),
+        "{}",
+        error
+    );
+}
+
+/// Records its configuration and refuses `mode: off`.
+const CONFIGURED_PLUGIN: &str = r#"#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/^{"id":\([0-9]*\),.*/\1/p')
+  case "$line" in
+    *'"hook":"configure"'*'"mode":"off"'*) printf '{"id":%s,"action":"block","reason":"mode off is not supported"}\n' "$id" ;;
+    *'"hook":"configure"'*) printf '%s\n' "$line" > "$HOME/configure.log"; printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+    *) printf '{"id":%s,"action":"allow"}\n' "$id" ;;
+  esac
+done
+"#;
+
+#[test]
+fn test_plugin_settings_are_validated_and_delivered() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let release = PluginRelease {
+        config_schema: Some(json!({
+            "type": "object",
+            "required": ["mode"],
+            "properties": {"mode": {"type": "string"}, "level": {"type": "integer"}}
+        })),
+        ..release("configured", 1)
+    };
+    let plugin = store
+        .install(&release, CONFIGURED_PLUGIN.as_bytes(), Trust::Signed)
+        .unwrap();
+    let start_with = |settings: Value| {
+        PluginHost::start(
+            &store,
+            &sandbox(5000),
+            false,
+            &BTreeMap::new(),
+            &BTreeMap::from([("configured".to_string(), settings)]),
+        )
+        .unwrap()
+    };
+
+    // Missing required settings and wrong types keep the plugin from loading
+    assert!(start_with(Value::Null).is_empty());
+    assert_eq!(
+        plugin.check_settings(&json!({"mode": "strict", "level": "high"})),
+        vec!["level: expected integer, got string"]
+    );
+    assert!(start_with(json!({"mode": "strict", "level": "high"})).is_empty());
+    // The plugin can refuse settings the schema allows
+    assert!(start_with(json!({"mode": "off"})).is_empty());
+
+    let host = start_with(json!({"mode": "strict", "level": 2}));
+    assert_eq!(host.names(), vec!["configured"]);
+    let log = plugin.path.parent().unwrap().join("work/configure.log");
+    let recorded: Value =
+        serde_json::from_str(std::fs::read_to_string(&log).unwrap().trim()).unwrap();
+    assert_eq!(recorded["message"], json!({"mode": "strict", "level": 2}));
+}
+
+#[test]
+fn test_outbox_keeps_unacknowledged_messages() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("outbox.jsonl");
+
+    let mut outbox = Outbox::open(&path, 3).unwrap();
+    let first = outbox.push(&json!({"n": 1}));
+    let second = outbox.push(&json!({"n": 2}));
+    outbox.ack(first);
+    // Acknowledged twice, or never sent
+    outbox.ack(first);
+    outbox.ack(99);
+    drop(outbox);
+
+    let mut outbox = Outbox::open(&path, 3).unwrap();
+    assert_eq!(outbox.pending(), vec![(second, json!({"n": 2}))]);
+    // Sequence numbers carry on from the last run
+    let third = outbox.push(&json!({"n": 3}));
+    assert!(third > second);
+    outbox.push(&json!({"n": 4}));
+    // Past max_lag the oldest goes
+    outbox.push(&json!({"n": 5}));
+    let pending: Vec<Value> = outbox.pending().into_iter().map(|(_, m)| m).collect();
+    assert_eq!(
+        pending,
+        vec![json!({"n": 3}), json!({"n": 4}), json!({"n": 5})]
+    );
+
+    for (seq, _) in outbox.pending() {
+        outbox.ack(seq);
+    }
+    assert_eq!(std::fs::read_to_string(&path).unwrap(), "");
+}
+
+#[test]
+fn test_unacknowledged_responses_are_sent_again() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let plugin = install_speaking(&store, "acker", ACK_PLUGIN, 4);
+    let response =
+        |id: u64, note: &str| json!({"jsonrpc": "2.0", "id": id, "result": {"note": note}});
+    let log = plugin.path.parent().unwrap().join("work/responses.log");
+    let seen = || -> Vec<u64> {
+        std::fs::read_to_string(&log)
+            .unwrap_or_default()
+            .lines()
+            .map(|line| {
+                serde_json::from_str::<Value>(line).unwrap()["message"]["id"]
+                    .as_u64()
+                    .unwrap()
+            })
+            .collect()
+    };
+
+    let host = start(&store, 5000, false);
+    host.on_response(&response(1, "fast"));
+    host.on_response(&response(2, "slow"));
+    std::thread::sleep(Duration::from_millis(300));
+    // Stopped before it got to the slow one
+    drop(host);
+    assert_eq!(seen(), vec![1, 2]);
+
+    let host = start(&store, 5000, false);
+    host.on_response(&response(3, "fast"));
+    std::thread::sleep(Duration::from_millis(300));
+    assert_eq!(seen(), vec![1, 2, 2, 3]);
+    drop(host);
+
+    let outbox = Outbox::open(&plugin.path.parent().unwrap().join("outbox.jsonl"), 10).unwrap();
+    let pending: Vec<Value> = outbox.pending().into_iter().map(|(_, m)| m).collect();
+    assert_eq!(pending, vec![response(2, "slow")]);
+}
+
+#[test]
+fn test_wasm_modules_are_detected_on_install() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    // Smallest valid module: magic number and version 1
+    let plugin = install(&store, "filter", "\0asm\x01\0\0\0");
+
+    assert_eq!(plugin.runtime, PluginRuntime::Wasm);
+    assert!(plugin.path.to_string_lossy().ends_with("filter.wasm"));
+    assert_eq!(
+        store.get("filter").unwrap().unwrap().runtime,
+        PluginRuntime::Wasm
+    );
+    assert_eq!(
+        install(&store, "guard", GUARD_PLUGIN).runtime,
+        PluginRuntime::Native
+    );
+}
+
+#[cfg(not(feature = "wasm"))]
+#[test]
+fn test_wasm_plugins_need_the_wasm_feature() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    install(&store, "filter", "\0asm\x01\0\0\0");
+
+    // Skipped with a warning rather than failing the session
+    assert!(start(&store, 1000, false).is_empty());
+}
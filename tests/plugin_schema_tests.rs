@@ -0,0 +1,103 @@
+use km::plugins::schema::validate;
+use serde_json::json;
+
+fn schema() -> serde_json::Value {
+    json!({
+        "type": "object",
+        "required": ["mode"],
+        "additionalProperties": false,
+        "properties": {
+            "mode": {"type": "string", "enum": ["strict", "lenient"]},
+            "threshold": {"type": "number", "minimum": 0, "maximum": 1},
+            "retries": {"type": "integer"},
+            "region": {"type": "string", "pattern": "^[a-z]{2}-[a-z]+$", "maxLength": 12},
+            "hosts": {"type": "array", "items": {"type": "string", "minLength": 1}},
+            "limits": {"type": "object", "properties": {"rps": {"type": ["integer", "null"]}}}
+        }
+    })
+}
+
+#[test]
+fn test_valid_settings_pass() {
+    let settings = json!({
+        "mode": "strict",
+        "threshold": 0.5,
+        "retries": 3.0,
+        "region": "eu-west",
+        "hosts": ["a.example.com"],
+        "limits": {"rps": null, "burst": 10}
+    });
+    assert!(validate(&schema(), &settings).is_empty());
+    // No schema keywords accept anything
+    assert!(validate(&json!({}), &json!([1, "two"])).is_empty());
+    assert!(validate(&json!(true), &json!(null)).is_empty());
+}
+
+#[test]
+fn test_problems_name_the_setting() {
+    let settings = json!({
+        "threshold": 1.5,
+        "retries": 2.5,
+        "region": "Europe",
+        "hosts": ["ok", ""],
+        "limits": {"rps": "fast"},
+        "colour": "blue"
+    });
+    let mut problems = validate(&schema(), &settings);
+    problems.sort();
+    assert_eq!(
+        problems,
+        vec![
+            "colour: unknown setting",
+            "hosts[1]: must be at least 1 characters",
+            "limits.rps: expected integer or null, got string",
+            "mode: required",
+            "region: must match ^[a-z]{2}-[a-z]+$",
+            "retries: expected integer, got number",
+            "threshold: must be at most 1",
+        ]
+    );
+
+    assert_eq!(
+        validate(&schema(), &json!({"mode": "loose"})),
+        vec![r#"mode: must be one of "strict", "lenient""#]
+    );
+    assert_eq!(
+        validate(&schema(), &json!("strict")),
+        vec!["expected object, got string"]
+    );
+}
+
+#[test]
+fn test_variants_maps_and_recursion() {
+    let schema = json!({
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+            "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+            "targets": {"type": "array", "items": {"oneOf": [
+                {"properties": {"kind": {"const": "file"}, "path": {"type": "string"}},
+                 "required": ["kind", "path"], "additionalProperties": false},
+                {"properties": {"kind": {"const": "stdout"}}, "additionalProperties": false}
+            ]}},
+            "overrides": {"type": "object", "additionalProperties": {"$ref": "#"}}
+        }
+    });
+    let settings = json!({
+        "labels": {"team": "core", "tier": 2},
+        "targets": [{"kind": "file"}, {"kind": "stdout", "path": "x"}, {"kind": "s3"}],
+        "overrides": {"ci": {"labels": {"team": "ci"}, "colour": "blue"}}
+    });
+    let mut problems = validate(&schema, &settings);
+    problems.sort();
+    assert_eq!(
+        problems,
+        vec![
+            "labels.tier: expected string, got integer",
+            "overrides.ci.colour: unknown setting",
+            "targets[0].path: required",
+            "targets[1].path: unknown setting",
+            r#"targets[2].kind: must be one of "file", "stdout""#,
+        ]
+    );
+}
@@ -0,0 +1,437 @@
+use base64::Engine;
+use ed25519_dalek::{Signer, SigningKey};
+use km::cli::PluginCommands;
+use km::config::Config;
+use km::handlers::run_plugin_command;
+use km::plugins::health::FailurePolicy;
+use km::plugins::marketplace::{PluginManifest, PluginRelease};
+use km::plugins::store::PluginStore;
+use km::plugins::verify::{sha256_hex, verify_release, Trust, TrustedKeys};
+use km::plugins::{compare_versions, parse_spec, PROTOCOL_VERSION};
+use std::cmp::Ordering;
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+fn release(name: &str, version: &str) -> PluginRelease {
+    PluginRelease {
+        name: name.to_string(),
+        version: version.to_string(),
+        description: format!("{} plugin", name),
+        download_url: None,
+        sha256: None,
+        signature: None,
+        protocol: 1,
+        config_schema: None,
+    }
+}
+
+/// The binary `serve_marketplace` returns for a release
+fn served_binary(name: &str, version: &str) -> Vec<u8> {
+    format!("binary for /api/plugins/{}/{}/download", name, version).into_bytes()
+}
+
+fn signed_release(name: &str, version: &str, key: &SigningKey) -> PluginRelease {
+    let binary = served_binary(name, version);
+    PluginRelease {
+        sha256: Some(sha256_hex(&binary)),
+        signature: Some(
+            base64::engine::general_purpose::STANDARD.encode(key.sign(&binary).to_bytes()),
+        ),
+        ..release(name, version)
+    }
+}
+
+/// Minimal marketplace API: serves `manifest` and a fake binary for every
+/// download URL.
+async fn serve_marketplace(manifest: PluginManifest) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let manifest = serde_json::to_string(&manifest).unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 16 * 1024];
+            let n = socket.read(&mut buf).await.unwrap_or(0);
+            let request = String::from_utf8_lossy(&buf[..n]).into_owned();
+            let path = request.split_whitespace().nth(1).unwrap_or("").to_string();
+
+            let (status, body) = if path == "/api/plugins/manifest" {
+                (200, manifest.clone())
+            } else if path.ends_with("/download") {
+                (200, format!("binary for {}", path))
+            } else {
+                (404, String::new())
+            };
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: {}\r\nconnection: close\r\n\r\n{}",
+                status,
+                body.len(),
+                body
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}", addr)
+}
+
+fn write_config(dir: &TempDir, api_url: &str, trusted_keys: Vec<String>) -> std::path::PathBuf {
+    let path = dir.path().join("km_config.json");
+    Config {
+        api_key: "test-key".to_string(),
+        api_url: api_url.to_string(),
+        plugin_trusted_keys: trusted_keys,
+        ..Default::default()
+    }
+    .save(&path)
+    .unwrap();
+    path
+}
+
+#[test]
+fn test_compare_versions() {
+    assert_eq!(compare_versions("1.10.0", "1.9.2"), Ordering::Greater);
+    assert_eq!(compare_versions("v1.2", "1.2.0"), Ordering::Equal);
+    assert_eq!(compare_versions("2.0.0-beta", "2.0.0"), Ordering::Less);
+    assert_eq!(compare_versions("0.9.9", "1.0.0"), Ordering::Less);
+}
+
+#[test]
+fn test_parse_spec() {
+    assert_eq!(
+        parse_spec("risk-guard@1.2.0").unwrap(),
+        ("risk-guard".to_string(), Some("1.2.0".to_string()))
+    );
+    assert_eq!(
+        parse_spec("risk-guard").unwrap(),
+        ("risk-guard".to_string(), None)
+    );
+    assert!(parse_spec("risk-guard@").is_err());
+    assert!(parse_spec("../escape").is_err());
+}
+
+#[test]
+fn test_manifest_latest_and_search() {
+    let manifest = PluginManifest {
+        plugins: vec![
+            release("audit", "1.9.0"),
+            release("audit", "1.10.0"),
+            release("redactor", "0.3.0"),
+        ],
+    };
+
+    assert_eq!(manifest.latest("audit").unwrap().version, "1.10.0");
+    assert!(manifest.find("audit", "1.9.0").is_some());
+
+    let results = manifest.search("AUD");
+    assert_eq!(results.len(), 1);
+    assert_eq!(results[0].version, "1.10.0");
+    assert_eq!(manifest.search("").len(), 2);
+}
+
+#[test]
+fn test_store_install_replace_and_remove() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    store
+        .install(&release("audit", "1.0.0"), b"v1", Trust::Signed)
+        .unwrap();
+    let plugin = store
+        .install(&release("audit", "1.1.0"), b"v2", Trust::Signed)
+        .unwrap();
+
+    assert_eq!(std::fs::read(&plugin.path).unwrap(), b"v2");
+    assert!(plugin.check_integrity().is_ok());
+    let installed = store.installed().unwrap();
+    assert_eq!(installed.len(), 1);
+    assert_eq!(installed[0].version, "1.1.0");
+
+    assert!(store.remove("audit").unwrap());
+    assert!(!store.remove("audit").unwrap());
+    assert!(store.installed().unwrap().is_empty());
+}
+
+#[test]
+fn test_store_records_plugin_protocol() {
+    let temp_dir = TempDir::new().unwrap();
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let typed = PluginRelease {
+        protocol: 2,
+        ..release("audit", "2.0.0")
+    };
+    assert_eq!(
+        store
+            .install(&typed, b"v2", Trust::Signed)
+            .unwrap()
+            .protocol,
+        2
+    );
+    let newer = PluginRelease {
+        protocol: PROTOCOL_VERSION + 1,
+        ..release("audit", "3.0.0")
+    };
+    let error = store.install(&newer, b"v3", Trust::Signed).unwrap_err();
+    assert!(error.to_string().contains("update km"), "{}", error);
+    assert_eq!(store.get("audit").unwrap().unwrap().version, "2.0.0");
+
+    // Releases and plugin.json files from before protocol versions speak 1
+    let old: PluginRelease =
+        serde_json::from_str(r#"{"name": "audit", "version": "1.0.0"}"#).unwrap();
+    assert_eq!(old.protocol, 1);
+}
+
+#[tokio::test]
+async fn test_install_pins_and_update_skips_pinned() {
+    let api_url = serve_marketplace(PluginManifest {
+        plugins: vec![
+            release("audit", "1.0.0"),
+            release("audit", "2.0.0"),
+            release("redactor", "0.1.0"),
+        ],
+    })
+    .await;
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = write_config(&temp_dir, &api_url, Vec::new());
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let install = |spec: &str| PluginCommands::Install {
+        spec: spec.to_string(),
+        allow_unsigned: true,
+    };
+    run_plugin_command(&config_path, &store, install("audit@1.0.0"))
+        .await
+        .unwrap();
+    run_plugin_command(&config_path, &store, install("redactor"))
+        .await
+        .unwrap();
+
+    let config = Config::load(&config_path).unwrap();
+    assert_eq!(config.plugin_pins.get("audit").unwrap(), "1.0.0");
+    assert!(!config.plugin_pins.contains_key("redactor"));
+
+    run_plugin_command(
+        &config_path,
+        &store,
+        PluginCommands::Update {
+            name: None,
+            allow_unsigned: true,
+        },
+    )
+    .await
+    .unwrap();
+    assert_eq!(store.get("audit").unwrap().unwrap().version, "1.0.0");
+
+    run_plugin_command(
+        &config_path,
+        &store,
+        PluginCommands::Remove {
+            name: "audit".to_string(),
+        },
+    )
+    .await
+    .unwrap();
+    assert!(store.get("audit").unwrap().is_none());
+    assert!(Config::load(&config_path).unwrap().plugin_pins.is_empty());
+}
+
+#[tokio::test]
+async fn test_plugin_config_is_checked_against_the_schema() {
+    let api_url = serve_marketplace(PluginManifest::default()).await;
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = write_config(&temp_dir, &api_url, Vec::new());
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let schema = serde_json::json!({
+        "type": "object",
+        "required": ["mode", "region"],
+        "properties": {
+            "mode": {"type": "string", "enum": ["strict", "lenient"]},
+            "region": {"type": "string"},
+            "threshold": {"type": "number"}
+        }
+    });
+    let release = PluginRelease {
+        config_schema: Some(schema),
+        ..release("pii-filter", "1.0.0")
+    };
+    store.install(&release, b"binary", Trust::Signed).unwrap();
+
+    let set = |key: &str, value: Option<&str>| PluginCommands::Config {
+        name: "pii-filter".to_string(),
+        key: Some(key.to_string()),
+        value: value.map(String::from),
+        unset: value.is_none(),
+    };
+    let settings = || Config::load(&config_path).unwrap().plugin_config;
+
+    // Required settings can be filled in one at a time
+    run_plugin_command(&config_path, &store, set("mode", Some("strict")))
+        .await
+        .unwrap();
+    run_plugin_command(&config_path, &store, set("threshold", Some("0.8")))
+        .await
+        .unwrap();
+    assert_eq!(
+        settings()["pii-filter"],
+        serde_json::json!({"mode": "strict", "threshold": 0.8})
+    );
+
+    let error = run_plugin_command(&config_path, &store, set("mode", Some("loose")))
+        .await
+        .unwrap_err();
+    assert_eq!(
+        error.to_string(),
+        r#"Invalid settings for pii-filter: mode: must be one of "strict", "lenient""#
+    );
+    assert_eq!(settings()["pii-filter"]["mode"], "strict");
+
+    run_plugin_command(&config_path, &store, set("threshold", None))
+        .await
+        .unwrap();
+    // Removing a required setting would stop the plugin from loading
+    let error = run_plugin_command(&config_path, &store, set("mode", None))
+        .await
+        .unwrap_err();
+    assert!(error.to_string().ends_with("mode: required"), "{}", error);
+    assert_eq!(
+        settings()["pii-filter"],
+        serde_json::json!({"mode": "strict"})
+    );
+
+    // Plugins that aren't installed have nothing to check against
+    run_plugin_command(
+        &config_path,
+        &store,
+        PluginCommands::Config {
+            name: "other".to_string(),
+            key: Some("tags".to_string()),
+            value: Some(r#"["a", "b"]"#.to_string()),
+            unset: false,
+        },
+    )
+    .await
+    .unwrap();
+    assert_eq!(settings()["other"]["tags"], serde_json::json!(["a", "b"]));
+}
+
+#[tokio::test]
+async fn test_failure_policies_are_saved_per_plugin() {
+    let api_url = serve_marketplace(PluginManifest::default()).await;
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = write_config(&temp_dir, &api_url, Vec::new());
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+    let on_failure = |policy: FailurePolicy| PluginCommands::OnFailure {
+        name: "pii-filter".to_string(),
+        policy,
+    };
+    let policies = || Config::load(&config_path).unwrap().plugin_failure_policies;
+
+    run_plugin_command(&config_path, &store, on_failure(FailurePolicy::Closed))
+        .await
+        .unwrap();
+    assert_eq!(policies().get("pii-filter"), Some(&FailurePolicy::Closed));
+
+    // Open is the default, so it isn't kept
+    run_plugin_command(&config_path, &store, on_failure(FailurePolicy::Open))
+        .await
+        .unwrap();
+    assert!(policies().is_empty());
+
+    let invalid = PluginCommands::OnFailure {
+        name: "../escape".to_string(),
+        policy: FailurePolicy::Closed,
+    };
+    assert!(run_plugin_command(&config_path, &store, invalid)
+        .await
+        .is_err());
+}
+
+#[tokio::test]
+async fn test_install_unknown_version_fails() {
+    let api_url = serve_marketplace(PluginManifest {
+        plugins: vec![release("audit", "1.0.0")],
+    })
+    .await;
+    let temp_dir = TempDir::new().unwrap();
+    let config_path = write_config(&temp_dir, &api_url, Vec::new());
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let result = run_plugin_command(
+        &config_path,
+        &store,
+        PluginCommands::Install {
+            spec: "audit@9.9.9".to_string(),
+            allow_unsigned: true,
+        },
+    )
+    .await;
+
+    assert!(result.is_err());
+    assert!(store.installed().unwrap().is_empty());
+}
+
+#[test]
+fn test_verify_release_checksum_and_signature() {
+    let key = SigningKey::from_bytes(&[7u8; 32]);
+    let trusted = TrustedKeys::from_config(&[
+        base64::engine::general_purpose::STANDARD.encode(key.verifying_key().to_bytes())
+    ])
+    .unwrap();
+    let binary = served_binary("audit", "1.0.0");
+    let signed = signed_release("audit", "1.0.0", &key);
+
+    assert_eq!(
+        verify_release(&signed, &binary, &trusted).unwrap(),
+        Trust::Signed
+    );
+    // Same release, but nobody we trust signed it
+    assert_eq!(
+        verify_release(&signed, &binary, &TrustedKeys::default()).unwrap(),
+        Trust::ChecksumOnly
+    );
+    assert_eq!(
+        verify_release(&release("audit", "1.0.0"), &binary, &trusted).unwrap(),
+        Trust::Unverified
+    );
+    assert!(verify_release(&signed, b"tampered", &trusted).is_err());
+}
+
+#[tokio::test]
+async fn test_install_requires_trusted_signature() {
+    let key = SigningKey::from_bytes(&[7u8; 32]);
+    let api_url = serve_marketplace(PluginManifest {
+        plugins: vec![
+            signed_release("audit", "1.0.0", &key),
+            release("redactor", "0.1.0"),
+        ],
+    })
+    .await;
+    let temp_dir = TempDir::new().unwrap();
+    let public_key =
+        base64::engine::general_purpose::STANDARD.encode(key.verifying_key().to_bytes());
+    let config_path = write_config(&temp_dir, &api_url, vec![public_key]);
+    let store = PluginStore::new(temp_dir.path().join("plugins"));
+
+    let install = |spec: &str, allow_unsigned: bool| PluginCommands::Install {
+        spec: spec.to_string(),
+        allow_unsigned,
+    };
+    run_plugin_command(&config_path, &store, install("audit", false))
+        .await
+        .unwrap();
+    assert!(store.get("audit").unwrap().unwrap().signed);
+
+    assert!(
+        run_plugin_command(&config_path, &store, install("redactor", false))
+            .await
+            .is_err()
+    );
+    assert!(store.get("redactor").unwrap().is_none());
+
+    run_plugin_command(&config_path, &store, install("redactor", true))
+        .await
+        .unwrap();
+    assert!(!store.get("redactor").unwrap().unwrap().signed);
+}
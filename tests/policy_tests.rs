@@ -0,0 +1,187 @@
+use km::config::Config;
+use km::policy::{Decision, Policy, PolicyAction, PolicyConfig, PolicyMode, PolicyRuleConfig};
+use serde_json::{json, Value};
+
+fn rule(name: &str, action: PolicyAction) -> PolicyRuleConfig {
+    PolicyRuleConfig {
+        name: name.to_string(),
+        action,
+        methods: Vec::new(),
+        tools: Vec::new(),
+        arguments: Default::default(),
+        risk_above: None,
+        set: Default::default(),
+        message: None,
+    }
+}
+
+fn tool_call(tool: &str, arguments: Value) -> Value {
+    json!({
+        "jsonrpc": "2.0",
+        "id": 1,
+        "method": "tools/call",
+        "params": { "name": tool, "arguments": arguments }
+    })
+}
+
+#[test]
+fn test_first_matching_rule_decides() {
+    let policy = Policy::from_config(&PolicyConfig {
+        mode: PolicyMode::Enforce,
+        default_action: PolicyAction::Allow,
+        rules: vec![
+            PolicyRuleConfig {
+                tools: vec!["read_*".to_string()],
+                ..rule("reads", PolicyAction::Allow)
+            },
+            PolicyRuleConfig {
+                methods: vec!["tools/*".to_string()],
+                message: Some("Only read tools are enabled".to_string()),
+                ..rule("no-tools", PolicyAction::Deny)
+            },
+        ],
+    })
+    .unwrap();
+
+    assert_eq!(
+        policy.evaluate(&tool_call("read_file", json!({}))),
+        Decision::Allow {
+            rule: Some("reads".to_string())
+        }
+    );
+    assert_eq!(
+        policy.evaluate(&tool_call("write_file", json!({}))),
+        Decision::Deny {
+            rule: "no-tools".to_string(),
+            message: "Only read tools are enabled".to_string()
+        }
+    );
+    let list = json!({"jsonrpc": "2.0", "id": 2, "method": "resources/list"});
+    assert_eq!(policy.evaluate(&list), Decision::Allow { rule: None });
+}
+
+#[test]
+fn test_argument_and_risk_conditions() {
+    let policy = Policy::from_config(&PolicyConfig {
+        rules: vec![
+            PolicyRuleConfig {
+                tools: vec!["shell".to_string()],
+                arguments: [("command".to_string(), r"^git\s".to_string())].into(),
+                ..rule("git-only", PolicyAction::Allow)
+            },
+            PolicyRuleConfig {
+                risk_above: Some(0.6),
+                ..rule("risky", PolicyAction::Deny)
+            },
+        ],
+        ..Default::default()
+    })
+    .unwrap();
+
+    let git = tool_call("shell", json!({"command": "git status"}));
+    assert_eq!(policy.evaluate(&git).rule(), Some("git-only"));
+
+    let wipe = tool_call("shell", json!({"command": "rm -rf /"}));
+    match policy.evaluate(&wipe) {
+        Decision::Deny { rule, message } => {
+            assert_eq!(rule, "risky");
+            assert_eq!(message, "Tool shell is not allowed");
+        }
+        other => panic!("expected deny, got {:?}", other),
+    }
+
+    let echo = tool_call("shell", json!({"command": "echo hi"}));
+    assert_eq!(policy.evaluate(&echo), Decision::Allow { rule: None });
+}
+
+#[test]
+fn test_rewrite_sets_json_pointers() {
+    let policy = Policy::from_config(&PolicyConfig {
+        rules: vec![PolicyRuleConfig {
+            tools: vec!["search".to_string()],
+            set: [
+                ("/params/arguments/limit".to_string(), json!(10)),
+                ("/params/_meta/policy".to_string(), json!("capped")),
+            ]
+            .into(),
+            ..rule("cap-results", PolicyAction::Rewrite)
+        }],
+        ..Default::default()
+    })
+    .unwrap();
+
+    let request = tool_call("search", json!({"query": "x", "limit": 5000}));
+    match policy.evaluate(&request) {
+        Decision::Rewrite { rule, message } => {
+            assert_eq!(rule, "cap-results");
+            assert_eq!(message["params"]["arguments"]["limit"], 10);
+            assert_eq!(message["params"]["arguments"]["query"], "x");
+            assert_eq!(message["params"]["_meta"]["policy"], "capped");
+        }
+        other => panic!("expected rewrite, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_default_deny() {
+    let policy = Policy::from_config(&PolicyConfig {
+        default_action: PolicyAction::Deny,
+        rules: vec![PolicyRuleConfig {
+            methods: vec!["initialize".to_string(), "tools/list".to_string()],
+            ..rule("handshake", PolicyAction::Allow)
+        }],
+        ..Default::default()
+    })
+    .unwrap();
+
+    let init = json!({"jsonrpc": "2.0", "id": 0, "method": "initialize"});
+    assert!(matches!(policy.evaluate(&init), Decision::Allow { .. }));
+    assert_eq!(
+        policy.evaluate(&tool_call("anything", json!({}))).rule(),
+        Some("default")
+    );
+    // Responses to server requests carry no method and pass through
+    let response = json!({"jsonrpc": "2.0", "id": 7, "result": {}});
+    assert_eq!(policy.evaluate(&response), Decision::Allow { rule: None });
+}
+
+#[test]
+fn test_invalid_policies_are_reported() {
+    let bad_regex = PolicyConfig {
+        rules: vec![PolicyRuleConfig {
+            arguments: [("path".to_string(), "([".to_string())].into(),
+            ..rule("broken", PolicyAction::Deny)
+        }],
+        ..Default::default()
+    };
+    assert!(Policy::from_config(&bad_regex).is_err());
+
+    let empty_rewrite = PolicyConfig {
+        rules: vec![rule("noop", PolicyAction::Rewrite)],
+        ..Default::default()
+    };
+    assert!(Policy::from_config(&empty_rewrite).is_err());
+
+    let mut config = Config::new("key".to_string(), "https://api.test.com".to_string());
+    config.policies = bad_regex;
+    assert!(config.validate().iter().any(|p| p.starts_with("policies:")));
+}
+
+#[test]
+fn test_policy_settings_from_config_file() {
+    let mut config = Config::new("key".to_string(), "https://api.test.com".to_string());
+    config.set("policies.mode", "Enforce").unwrap();
+    config.set("policies.default_action", "deny").unwrap();
+    assert!(config.set("policies.mode", "strict").is_err());
+
+    assert_eq!(config.policies.mode, PolicyMode::Enforce);
+    assert_eq!(config.get("policies.mode").unwrap(), "enforce");
+    assert_eq!(config.get("policies.default_action").unwrap(), "deny");
+
+    let parsed: PolicyConfig = serde_json::from_value(json!({
+        "mode": "enforce",
+        "rules": [{ "name": "no-shell", "action": "deny", "tools": ["shell"] }]
+    }))
+    .unwrap();
+    assert_eq!(parsed.rules[0].tools, vec!["shell"]);
+}
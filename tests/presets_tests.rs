@@ -0,0 +1,78 @@
+use km::config::Config;
+use km::presets::{self, CapturePreset};
+use km::risk::RiskLevel;
+use std::collections::BTreeMap;
+
+#[test]
+fn test_built_in_presets() {
+    let audit = presets::find(&BTreeMap::new(), "prod-audit").unwrap();
+    let settings = audit.capture_settings();
+    assert_eq!(settings.method_whitelist, vec!["tools/call"]);
+    assert_eq!(settings.risk_at_least, Some(RiskLevel::High));
+    assert!(!audit.capture_pings);
+    assert_eq!(audit.describe(), "tools/call, and high risk or above");
+
+    let forensic = presets::find(&BTreeMap::new(), "forensic").unwrap();
+    assert!(forensic.capture_pings);
+    assert!(forensic.capture_settings().captures(Some("ping")));
+    assert_eq!(forensic.capture_settings().payload_size_limit, None);
+
+    let err = presets::find(&BTreeMap::new(), "audit").unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "Unknown preset 'audit'. Presets: dev, forensic, prod-audit"
+    );
+}
+
+#[test]
+fn test_custom_presets_from_config() {
+    let config: Config = serde_json::from_str(
+        r#"{"api_key": "k", "api_url": "https://api.kilometers.ai",
+            "presets": {
+              "ci": {"description": "Tools only", "methods": ["tools/*"],
+                     "payload_size_limit": 4096},
+              "dev": {"methods": ["tools/*", "resources/*"], "capture_pings": true}
+            }}"#,
+    )
+    .unwrap();
+    assert!(config.validate().is_empty(), "{:?}", config.validate());
+
+    let all = presets::all(&config.presets);
+    let names: Vec<&str> = all.keys().map(String::as_str).collect();
+    assert_eq!(names, vec!["ci", "dev", "forensic", "prod-audit"]);
+    // A config preset takes the place of the built-in one
+    let (dev, custom) = &all["dev"];
+    assert!(custom);
+    assert!(dev.capture_pings);
+    assert!(!all["forensic"].1);
+
+    let ci = presets::find(&config.presets, "ci").unwrap();
+    assert_eq!(ci.describe(), "tools/*; uploads payloads up to 4096 bytes");
+    let settings = ci.capture_settings();
+    assert!(settings.captures(Some("tools/call")));
+    assert!(!settings.captures(Some("resources/read")));
+    assert_eq!(settings.payload_size_limit, Some(4096));
+}
+
+#[test]
+fn test_invalid_presets_are_reported() {
+    let mut config = Config::new("k".to_string(), "https://api.kilometers.ai".to_string());
+    config.presets.insert(
+        "broken".to_string(),
+        CapturePreset {
+            methods: vec![" ".to_string()],
+            ..Default::default()
+        },
+    );
+    assert_eq!(
+        config.validate(),
+        vec!["preset 'broken': methods must not contain empty entries"]
+    );
+
+    // Without methods everything is captured, so a risk level adds nothing
+    let everything = CapturePreset {
+        risk_at_least: Some(RiskLevel::High),
+        ..Default::default()
+    };
+    assert_eq!(everything.capture_settings().risk_at_least, None);
+}
@@ -0,0 +1,138 @@
+use km::probe::{self, ProbeCall, ProbeOptions};
+use km::sessions;
+use km::traffic;
+use serde_json::json;
+use std::time::Duration;
+
+fn mock_server() -> String {
+    env!("CARGO_BIN_EXE_mock_mcp_server").to_string()
+}
+
+fn options(calls: &[&str]) -> ProbeOptions {
+    ProbeOptions {
+        calls: calls
+            .iter()
+            .map(|c| probe::parse_call(c).unwrap())
+            .collect(),
+        timeout: Duration::from_secs(10),
+        ..Default::default()
+    }
+}
+
+#[test]
+fn test_parse_call() {
+    assert_eq!(
+        probe::parse_call("echo").unwrap(),
+        ProbeCall {
+            tool: "echo".to_string(),
+            arguments: json!({}),
+        }
+    );
+    assert_eq!(
+        probe::parse_call(r#"echo={"text": "a=b"}"#)
+            .unwrap()
+            .arguments,
+        json!({"text": "a=b"})
+    );
+    assert!(probe::parse_call("echo={not json").is_err());
+    assert!(probe::parse_call("echo=[1]").is_err());
+    assert!(probe::parse_call("={}").is_err());
+}
+
+#[test]
+fn test_probe_handshake_and_listing() {
+    let report = probe::probe(&mock_server(), &[], &options(&[]), None).unwrap();
+
+    assert!(report.is_success(), "{:#?}", report);
+    assert_eq!(report.server.as_deref(), Some("mock-mcp-server 1.0.0"));
+    assert_eq!(report.protocol_version.as_deref(), Some("2024-11-05"));
+    assert_eq!(report.tools, vec!["echo"]);
+    assert_eq!(report.resources, Some(0));
+    let methods: Vec<&str> = report.methods.iter().map(|m| m.method.as_str()).collect();
+    assert_eq!(methods, vec!["initialize", "tools/list", "resources/list"]);
+    assert_eq!(report.tool_calls, 0);
+}
+
+#[test]
+fn test_probe_tool_calls_report_latency_and_errors() {
+    let mut options = options(&[r#"echo={"text": "hi"}"#, "missing"]);
+    options.count = Some(6);
+    let report = probe::probe(&mock_server(), &[], &options, None).unwrap();
+
+    assert_eq!(report.tool_calls, 6);
+    let echo = report
+        .methods
+        .iter()
+        .find(|m| m.method == "tools/call echo")
+        .unwrap();
+    assert_eq!((echo.calls, echo.errors, echo.unanswered), (3, 0, 0));
+    assert!(echo.latency.is_some());
+    let missing = report
+        .methods
+        .iter()
+        .find(|m| m.method == "tools/call missing")
+        .unwrap();
+    assert_eq!((missing.calls, missing.errors), (3, 3));
+
+    // Error responses are counted, but calling a tool the server doesn't list is a problem
+    assert_eq!(report.problems, vec!["missing isn't offered by tools/list"]);
+    assert!(!report.is_success());
+}
+
+#[test]
+fn test_probe_at_a_target_rate() {
+    let mut options = options(&[r#"echo={"text": "load"}"#]);
+    options.rate = 50.0;
+    options.count = Some(20);
+    let report = probe::probe(&mock_server(), &[], &options, None).unwrap();
+
+    assert!(report.is_success(), "{:#?}", report);
+    assert_eq!(report.tool_calls, 20);
+    // 20 calls at 50/s take about 0.4s
+    assert!(report.elapsed_secs >= 0.35, "{}", report.elapsed_secs);
+    assert!(report.throughput() <= 60.0, "{}", report.throughput());
+}
+
+#[test]
+fn test_probe_records_a_session() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let log = dir.path().join("probe.jsonl");
+    let options = options(&[r#"echo={"text": "hi"}"#]);
+    let report = probe::probe(&mock_server(), &[], &options, Some(&log)).unwrap();
+    assert!(report.is_success(), "{:#?}", report);
+
+    let entries = traffic::read_entries(&log).unwrap();
+    let summaries = sessions::summarize(&entries);
+    assert_eq!(summaries.len(), 1);
+    assert_eq!(summaries[0].id, report.session_id);
+    // initialize, tools/list, resources/list, one tool call, plus the notification
+    assert_eq!(summaries[0].requests, 5);
+    assert_eq!(summaries[0].tools.get("echo"), Some(&1));
+    assert!(entries
+        .iter()
+        .filter(|e| e.direction == "response")
+        .all(|e| e.duration_ms.is_some()));
+}
+
+#[test]
+fn test_probe_server_that_exits() {
+    let report = probe::probe(
+        env!("CARGO_BIN_EXE_km"),
+        &["--version".to_string()],
+        &options(&[]),
+        None,
+    )
+    .unwrap();
+
+    assert!(!report.is_success());
+    assert!(report.server.is_none());
+    assert!(
+        report
+            .problems
+            .iter()
+            .any(|p| p.starts_with("Server wrote output that isn't JSON")
+                || p == "Server exited before answering initialize"),
+        "{:#?}",
+        report.problems
+    );
+}
@@ -0,0 +1,150 @@
+use km::process::{self, StopSignal};
+use std::io::{BufRead, BufReader, Write};
+use std::process::{Command, Stdio};
+use std::time::{Duration, Instant};
+
+const REQUEST: &str = r#"{"jsonrpc":"2.0","id":1,"method":"tools/list"}"#;
+
+fn monitor(dir: &tempfile::TempDir, server: &[&str]) -> Command {
+    let mut command = Command::new(env!("CARGO_BIN_EXE_km"));
+    command
+        .current_dir(dir.path())
+        .args(["monitor", "--local-only", "--no-plugins", "--log-file"])
+        .arg(dir.path().join("traffic.jsonl"))
+        .arg("--")
+        .args(server)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null());
+    command
+}
+
+fn logged(dir: &tempfile::TempDir) -> Vec<String> {
+    std::fs::read_to_string(dir.path().join("traffic.jsonl"))
+        .unwrap_or_default()
+        .lines()
+        .map(String::from)
+        .collect()
+}
+
+#[test]
+fn test_stop_signal() {
+    let stop = StopSignal::default();
+    let shared = stop.clone();
+    assert!(!stop.is_requested());
+    shared.request();
+    assert!(stop.is_requested());
+}
+
+#[test]
+fn test_stop_returns_at_once_for_exited_processes() {
+    let mut child = process::command(env!("CARGO_BIN_EXE_km"), &["--version".to_string()])
+        .stdout(Stdio::null())
+        .spawn()
+        .unwrap();
+    child.wait().unwrap();
+    let started = Instant::now();
+    assert!(process::stop(&mut child, Duration::from_secs(10))
+        .unwrap()
+        .success());
+    assert!(started.elapsed() < Duration::from_secs(1));
+}
+
+#[test]
+fn test_monitor_exits_when_the_client_hangs_up() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let mut child = monitor(&dir, &[env!("CARGO_BIN_EXE_mock_mcp_server")])
+        .spawn()
+        .unwrap();
+    writeln!(child.stdin.take().unwrap(), "{}", REQUEST).unwrap();
+
+    let status = process::wait_timeout(&mut child, Duration::from_secs(10))
+        .unwrap()
+        .expect("km monitor should exit once its input closes");
+    assert!(status.success());
+    assert_eq!(logged(&dir).len(), 2, "the request and its response");
+}
+
+#[test]
+fn test_monitor_forwards_pings_without_logging_them() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let mut child = monitor(&dir, &[env!("CARGO_BIN_EXE_mock_mcp_server")])
+        .spawn()
+        .unwrap();
+    let mut stdin = child.stdin.take().unwrap();
+    let mut stdout = BufReader::new(child.stdout.take().unwrap());
+    writeln!(
+        stdin,
+        r#"{{"jsonrpc":"2.0","id":"keepalive","method":"ping"}}"#
+    )
+    .unwrap();
+    let mut pong = String::new();
+    stdout.read_line(&mut pong).unwrap();
+    assert!(pong.contains(r#""id":"keepalive""#), "{}", pong);
+    writeln!(stdin, "{}", REQUEST).unwrap();
+    drop(stdin);
+
+    let status = process::wait_timeout(&mut child, Duration::from_secs(10))
+        .unwrap()
+        .expect("km monitor should exit once its input closes");
+    assert!(status.success());
+    let logged = logged(&dir);
+    assert_eq!(logged.len(), 2, "only tools/list and its response");
+    assert!(logged.iter().all(|line| !line.contains("keepalive")));
+}
+
+#[test]
+fn test_monitor_exits_when_the_server_does() {
+    let dir = tempfile::TempDir::new().unwrap();
+    // A "server" that exits straight away while the client stays connected
+    let mut child = monitor(&dir, &[env!("CARGO_BIN_EXE_km"), "--version"])
+        .spawn()
+        .unwrap();
+    let _stdin = child.stdin.take().unwrap();
+
+    let status = process::wait_timeout(&mut child, Duration::from_secs(10))
+        .unwrap()
+        .expect("km monitor should exit with its server");
+    assert!(status.success());
+}
+
+#[cfg(unix)]
+#[test]
+fn test_stop_kills_processes_that_ignore_the_request() {
+    let mut child = process::command(
+        "sh",
+        &["-c".to_string(), "trap '' TERM; sleep 30".to_string()],
+    )
+    .spawn()
+    .unwrap();
+    std::thread::sleep(Duration::from_millis(200));
+
+    let started = Instant::now();
+    let status = process::stop(&mut child, Duration::from_millis(300)).unwrap();
+    assert!(!status.success());
+    assert!(started.elapsed() >= Duration::from_millis(300));
+    assert!(started.elapsed() < Duration::from_secs(10));
+}
+
+#[cfg(unix)]
+#[test]
+fn test_monitor_stops_the_server_on_sigterm() {
+    let dir = tempfile::TempDir::new().unwrap();
+    let mut child = monitor(&dir, &[env!("CARGO_BIN_EXE_mock_mcp_server")])
+        .spawn()
+        .unwrap();
+    let mut stdin = child.stdin.take().unwrap();
+    let mut stdout = BufReader::new(child.stdout.take().unwrap());
+    writeln!(stdin, "{}", REQUEST).unwrap();
+    let mut response = String::new();
+    stdout.read_line(&mut response).unwrap();
+    assert!(response.contains(r#""id":1"#), "{}", response);
+
+    // The client is still connected, so only the signal ends the run
+    unsafe { libc::kill(child.id() as libc::pid_t, libc::SIGTERM) };
+    let status = process::wait_timeout(&mut child, Duration::from_secs(10))
+        .unwrap()
+        .expect("km monitor should exit on SIGTERM");
+    assert!(status.success(), "{:?}", status);
+    assert_eq!(logged(&dir).len(), 2, "the log is flushed before exiting");
+}
@@ -0,0 +1,118 @@
+use serde_json::json;
+use std::io::{BufRead, BufReader, Lines, Write};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::time::{Duration, Instant};
+use tempfile::TempDir;
+
+/// Round trips timed in each run, after the warm-up
+const ROUND_TRIPS: usize = 500;
+const WARM_UP: usize = 50;
+
+/// What km may add to the p99 round trip of a typical message. Unoptimized
+/// builds get more room; `cargo test --release --test proxy_latency_tests
+/// -- --nocapture` checks the real budget and prints the numbers.
+const P99_BUDGET: Duration = if cfg!(debug_assertions) {
+    Duration::from_millis(10)
+} else {
+    Duration::from_millis(1)
+};
+
+struct Session {
+    child: Child,
+    stdin: Option<ChildStdin>,
+    stdout: Lines<BufReader<ChildStdout>>,
+}
+
+impl Session {
+    fn start(command: &mut Command) -> Self {
+        let mut child = command
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn()
+            .unwrap();
+        let stdin = child.stdin.take().unwrap();
+        let stdout = BufReader::new(child.stdout.take().unwrap()).lines();
+        Self {
+            child,
+            stdin: Some(stdin),
+            stdout,
+        }
+    }
+
+    /// Round-trip times for a typical `tools/call` exchange, slowest last
+    fn round_trips(&mut self) -> Vec<Duration> {
+        let mut times = Vec::new();
+        for id in 0..WARM_UP + ROUND_TRIPS {
+            let request = json!({
+                "jsonrpc": "2.0",
+                "id": id,
+                "method": "tools/call",
+                "params": {"name": "echo", "arguments": {"text": "x".repeat(512)}},
+            });
+            let start = Instant::now();
+            let stdin = self.stdin.as_mut().unwrap();
+            writeln!(stdin, "{}", request).unwrap();
+            stdin.flush().unwrap();
+            let response = self.stdout.next().unwrap().unwrap();
+            let elapsed = start.elapsed();
+            assert!(response.contains(&format!("\"id\":{}", id)), "{}", response);
+            if id >= WARM_UP {
+                times.push(elapsed);
+            }
+        }
+        times.sort();
+        times
+    }
+}
+
+impl Drop for Session {
+    /// Close stdin so the session shuts down cleanly, as an agent would
+    fn drop(&mut self) {
+        drop(self.stdin.take());
+        let deadline = Instant::now() + Duration::from_secs(5);
+        while matches!(self.child.try_wait(), Ok(None)) && Instant::now() < deadline {
+            std::thread::sleep(Duration::from_millis(10));
+        }
+        let _ = self.child.kill();
+        let _ = self.child.wait();
+    }
+}
+
+fn percentile(sorted: &[Duration], p: f64) -> Duration {
+    sorted[((sorted.len() - 1) as f64 * p).round() as usize]
+}
+
+#[test]
+fn test_proxy_adds_little_latency() {
+    let dir = TempDir::new().unwrap();
+    let server = env!("CARGO_BIN_EXE_mock_mcp_server");
+
+    let direct = Session::start(&mut Command::new(server)).round_trips();
+    let proxied = Session::start(
+        Command::new(env!("CARGO_BIN_EXE_km"))
+            .current_dir(dir.path())
+            .args(["monitor", "--local-only", "--no-plugins", "--log-file"])
+            .arg(dir.path().join("traffic.jsonl"))
+            .args(["--", server]),
+    )
+    .round_trips();
+
+    let (direct_p50, direct_p99) = (percentile(&direct, 0.5), percentile(&direct, 0.99));
+    let (proxied_p50, proxied_p99) = (percentile(&proxied, 0.5), percentile(&proxied, 0.99));
+    println!(
+        "direct p50 {:?} p99 {:?}; through km p50 {:?} p99 {:?}",
+        direct_p50, direct_p99, proxied_p50, proxied_p99
+    );
+    let added = proxied_p99.saturating_sub(direct_p99);
+    assert!(
+        added < P99_BUDGET,
+        "km added {:?} to the p99 round trip (budget {:?})",
+        added,
+        P99_BUDGET
+    );
+
+    // Every exchange still reaches the traffic log
+    let log = std::fs::read_to_string(dir.path().join("traffic.jsonl")).unwrap();
+    assert_eq!(log.lines().count(), 2 * (WARM_UP + ROUND_TRIPS));
+}
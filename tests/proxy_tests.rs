@@ -58,10 +58,6 @@ fn test_spawn_proxy_process_with_multiple_args() {
     }
 }
 
-// Note: run_proxy is difficult to test in unit tests
-// as it involves actual process spawning and I/O operations. These would be
-// better tested in integration tests with mock processes.
-
 #[cfg(test)]
 mod json_detection_tests {
     use serde_json::Value;
@@ -100,3 +96,181 @@ mod json_detection_tests {
         assert!(result.is_err());
     }
 }
+
+/// Several sessions in one process; `cat` stands in for the server and
+/// echoes every request back.
+#[cfg(unix)]
+mod concurrent_session_tests {
+    use km::proxy::{run_proxy_with, ClientIo, ProxyOptions};
+    use std::io::Write;
+    use std::os::unix::net::UnixStream;
+    use std::sync::atomic::Ordering;
+    use std::sync::{Arc, Mutex};
+    use std::time::{Duration, Instant};
+    use tempfile::TempDir;
+
+    /// Client output that can be read back while a proxy run writes to it
+    #[derive(Clone, Default)]
+    struct SharedOutput(Arc<Mutex<Vec<u8>>>);
+
+    impl SharedOutput {
+        fn lines(&self) -> usize {
+            self.0
+                .lock()
+                .unwrap()
+                .iter()
+                .filter(|&&b| b == b'\n')
+                .count()
+        }
+    }
+
+    impl Write for SharedOutput {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    fn requests(count: u64) -> String {
+        (1..=count)
+            .map(|id| {
+                format!(
+                    "{{\"jsonrpc\":\"2.0\",\"id\":{},\"method\":\"tools/list\"}}\n",
+                    id
+                )
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_sessions_have_their_own_client_counts_and_stop() {
+        let temp_dir = TempDir::new().unwrap();
+        let log_file = temp_dir.path().join("traffic.jsonl");
+
+        let a_options = ProxyOptions::default();
+        let a_counts = a_options.counts.clone();
+        let a_output = SharedOutput::default();
+        let a = {
+            let log_file = log_file.clone();
+            let client = ClientIo::new(std::io::Cursor::new(requests(3)), a_output.clone());
+            std::thread::spawn(move || {
+                run_proxy_with("cat", &[], &log_file, "a", a_options, client)
+            })
+        };
+
+        // b's client stays connected, so b only ends when it's stopped
+        let (b_input, mut b_client) = UnixStream::pair().unwrap();
+        b_client.write_all(requests(1).as_bytes()).unwrap();
+        let b_options = ProxyOptions::default();
+        let b_counts = b_options.counts.clone();
+        let b_stop = b_options.stop.clone();
+        let b_output = SharedOutput::default();
+        let b = {
+            let log_file = log_file.clone();
+            let client = ClientIo::new(b_input, b_output.clone());
+            std::thread::spawn(move || {
+                run_proxy_with("cat", &[], &log_file, "b", b_options, client)
+            })
+        };
+
+        a.join().unwrap().unwrap();
+        let deadline = Instant::now() + Duration::from_secs(10);
+        while b_output.lines() < 1 && Instant::now() < deadline {
+            std::thread::sleep(Duration::from_millis(20));
+        }
+        assert!(!b.is_finished());
+        b_stop.request();
+        b.join().unwrap().unwrap();
+        drop(b_client);
+
+        assert_eq!(a_output.lines(), 3);
+        assert_eq!(b_output.lines(), 1);
+        assert_eq!(a_counts.requests.load(Ordering::Relaxed), 3);
+        assert_eq!(a_counts.responses.load(Ordering::Relaxed), 3);
+        assert_eq!(b_counts.requests.load(Ordering::Relaxed), 1);
+        assert_eq!(b_counts.responses.load(Ordering::Relaxed), 1);
+
+        // Both wrote to the same traffic log, each under its own id
+        let log = std::fs::read_to_string(&log_file).unwrap();
+        let sessions: Vec<String> = log
+            .lines()
+            .map(|line| {
+                let entry: serde_json::Value = serde_json::from_str(line).unwrap();
+                entry["session_id"].as_str().unwrap().to_string()
+            })
+            .collect();
+        assert_eq!(sessions.iter().filter(|s| *s == "a").count(), 6);
+        assert_eq!(sessions.iter().filter(|s| *s == "b").count(), 2);
+    }
+}
+
+/// Responses carry the status and round-trip time of the call they answer,
+/// in the traffic log and in the events queued for upload.
+mod call_status_tests {
+    use km::proxy::{run_proxy_with, ClientIo, ProxyOptions};
+    use km::queue;
+    use km::traffic;
+    use std::io::Cursor;
+    use std::time::Duration;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_responses_record_call_status_and_duration() {
+        let temp_dir = TempDir::new().unwrap();
+        let log_file = temp_dir.path().join("traffic.jsonl");
+        let (events, mut queued) = queue::bounded(16, Duration::from_secs(1));
+        let options = ProxyOptions {
+            events: Some(events),
+            ..Default::default()
+        };
+        let requests = concat!(
+            "{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"tools/list\"}\n",
+            "{\"jsonrpc\":\"2.0\",\"id\":2,\"method\":\"no/such/method\"}\n",
+        );
+        let client = ClientIo::new(Cursor::new(requests), Vec::new());
+        run_proxy_with(
+            env!("CARGO_BIN_EXE_mock_mcp_server"),
+            &[],
+            &log_file,
+            "s",
+            options,
+            client,
+        )
+        .unwrap();
+
+        let entries = traffic::read_entries(&log_file).unwrap();
+        let responses: Vec<_> = entries
+            .iter()
+            .filter(|e| e.direction == "response")
+            .collect();
+        assert_eq!(responses.len(), 2);
+        assert_eq!(responses[0].status.as_deref(), Some("success"));
+        assert_eq!(responses[0].error_code, None);
+        assert!(responses[0].duration_ms.is_some());
+        assert_eq!(responses[1].status.as_deref(), Some("error"));
+        assert_eq!(responses[1].error_code, Some(-32601));
+        assert!(responses[1].duration_ms.is_some());
+        assert!(entries
+            .iter()
+            .filter(|e| e.direction == "request")
+            .all(|e| e.status.is_none()));
+
+        let mut payloads = Vec::new();
+        while let Ok(event) = queued.try_recv() {
+            if event.direction == "response" {
+                payloads.push(serde_json::to_value(&event).unwrap());
+            }
+        }
+        assert_eq!(payloads.len(), 2);
+        assert_eq!(payloads[0]["status"], "success");
+        assert!(payloads[0].get("error_code").is_none());
+        assert!(payloads[0]["duration_ms"].is_f64());
+        assert_eq!(payloads[1]["status"], "error");
+        assert_eq!(payloads[1]["error_code"], -32601);
+        assert!(payloads[1]["duration_ms"].is_f64());
+    }
+}
@@ -0,0 +1,52 @@
+use km::queue;
+use std::thread;
+use std::time::Duration;
+
+#[test]
+fn test_queue_waits_for_consumer_instead_of_dropping() {
+    let (queue, mut rx) = queue::bounded(1, Duration::from_secs(5));
+    let stats = queue.stats();
+
+    let producer = thread::spawn(move || (0..5).filter(|&i| queue.push(i)).count());
+
+    let mut received = Vec::new();
+    while let Some(item) = rx.blocking_recv() {
+        received.push(item);
+        // A slow consumer: the producer has to wait for room
+        thread::sleep(Duration::from_millis(20));
+    }
+
+    assert_eq!(producer.join().unwrap(), 5);
+    assert_eq!(received, vec![0, 1, 2, 3, 4]);
+    assert_eq!(stats.sent(), 5);
+    assert_eq!(stats.dropped(), 0);
+    assert!(stats.delayed() > 0);
+}
+
+#[test]
+fn test_queue_drops_and_counts_after_max_wait() {
+    let (queue, mut rx) = queue::bounded(1, Duration::from_millis(20));
+
+    assert!(queue.push("first"));
+    assert!(!queue.push("second"));
+    assert!(!queue.push("third"));
+
+    let stats = queue.stats();
+    assert_eq!(stats.sent(), 1);
+    assert_eq!(stats.dropped(), 2);
+    assert_eq!(rx.try_recv().unwrap(), "first");
+
+    // Room again once the consumer catches up
+    assert!(queue.push("fourth"));
+    assert_eq!(stats.dropped(), 2);
+}
+
+#[test]
+fn test_queue_push_after_consumer_is_gone() {
+    let (queue, rx) = queue::bounded(4, Duration::from_secs(5));
+    drop(rx);
+
+    assert!(!queue.push(1));
+    // Nothing was waiting to be uploaded, so nothing counts as dropped
+    assert_eq!(queue.stats().dropped(), 0);
+}
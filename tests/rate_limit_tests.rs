@@ -0,0 +1,96 @@
+use chrono::{TimeZone, Utc};
+use km::rate_limit::{self, Backoff, RateLimit, RateLimiter};
+use reqwest::header::{HeaderMap, HeaderValue, RETRY_AFTER};
+use reqwest::StatusCode;
+use std::time::Duration;
+
+fn headers(retry_after: &'static str) -> HeaderMap {
+    let mut headers = HeaderMap::new();
+    headers.insert(RETRY_AFTER, HeaderValue::from_static(retry_after));
+    headers
+}
+
+#[test]
+fn test_retry_after_seconds_and_dates() {
+    let now = Utc.with_ymd_and_hms(2025, 10, 21, 7, 28, 0).unwrap();
+    assert_eq!(
+        rate_limit::retry_after(&headers("30"), now),
+        Some(Duration::from_secs(30))
+    );
+    assert_eq!(
+        rate_limit::retry_after(&headers("Tue, 21 Oct 2025 07:29:30 GMT"), now),
+        Some(Duration::from_secs(90))
+    );
+    // A date already past means now
+    assert_eq!(
+        rate_limit::retry_after(&headers("Tue, 21 Oct 2025 07:00:00 GMT"), now),
+        Some(Duration::ZERO)
+    );
+    assert_eq!(rate_limit::retry_after(&headers("soon"), now), None);
+    assert_eq!(rate_limit::retry_after(&HeaderMap::new(), now), None);
+}
+
+#[test]
+fn test_throttled_statuses() {
+    assert!(rate_limit::is_throttled(StatusCode::TOO_MANY_REQUESTS));
+    assert!(rate_limit::is_throttled(StatusCode::SERVICE_UNAVAILABLE));
+    assert!(!rate_limit::is_throttled(StatusCode::INTERNAL_SERVER_ERROR));
+    assert!(!rate_limit::is_throttled(StatusCode::BAD_REQUEST));
+}
+
+#[test]
+fn test_backoff_grows_with_jitter_up_to_max() {
+    let backoff = Backoff {
+        base: Duration::from_secs(1),
+        max: Duration::from_secs(10),
+    };
+    for _ in 0..100 {
+        let first = backoff.delay(0);
+        assert!(first >= Duration::from_millis(500) && first <= Duration::from_secs(1));
+        let third = backoff.delay(2);
+        assert!(third >= Duration::from_secs(2) && third <= Duration::from_secs(4));
+        let late = backoff.delay(40);
+        assert!(late >= Duration::from_secs(5) && late <= Duration::from_secs(10));
+    }
+    // Jittered: not every wait is the same
+    let waits: std::collections::HashSet<Duration> = (0..20).map(|_| backoff.delay(3)).collect();
+    assert!(waits.len() > 1);
+}
+
+#[test]
+fn test_limiter_allows_a_burst_then_paces() {
+    let limit = RateLimit {
+        requests_per_minute: 60,
+        burst: Some(2),
+    };
+    let limiter = RateLimiter::new(Some(&limit));
+    assert!(limiter.try_acquire().is_ok());
+    assert!(limiter.try_acquire().is_ok());
+    let wait = limiter.try_acquire().unwrap_err();
+    assert!(wait > Duration::from_millis(900) && wait <= Duration::from_secs(1));
+
+    // The burst defaults to a second's worth, at least one request
+    let limiter = RateLimiter::new(Some(&RateLimit {
+        requests_per_minute: 30,
+        burst: None,
+    }));
+    assert!(limiter.try_acquire().is_ok());
+    assert!(limiter.try_acquire().is_err());
+}
+
+#[tokio::test]
+async fn test_pause_holds_back_every_request() {
+    let limiter = RateLimiter::default();
+    assert!(limiter.try_acquire().is_ok());
+    assert!(limiter.try_acquire().is_ok());
+
+    limiter.pause(Duration::from_millis(200));
+    // A shorter pause doesn't cut a longer one short
+    limiter.pause(Duration::from_millis(10));
+    let wait = limiter.try_acquire().unwrap_err();
+    assert!(wait > Duration::from_millis(100));
+
+    let started = std::time::Instant::now();
+    limiter.acquire().await;
+    assert!(started.elapsed() >= Duration::from_millis(150));
+}
@@ -0,0 +1,211 @@
+use base64::Engine;
+use ed25519_dalek::{Signer, SigningKey};
+use km::config::{self, Config, Source};
+use km::remote_config::{self, RemoteConfigSettings, SignedLayer};
+use serde_json::{json, Value};
+use std::fs;
+use std::path::{Path, PathBuf};
+use tempfile::TempDir;
+use wiremock::matchers::{method, path};
+use wiremock::{Mock, MockServer, ResponseTemplate};
+
+fn signing_key() -> SigningKey {
+    SigningKey::from_bytes(&[7u8; 32])
+}
+
+fn public_key(key: &SigningKey) -> String {
+    base64::engine::general_purpose::STANDARD.encode(key.verifying_key().to_bytes())
+}
+
+fn sign(key: &SigningKey, layer: &Value) -> SignedLayer {
+    let layer = layer.to_string();
+    SignedLayer {
+        signature: base64::engine::general_purpose::STANDARD
+            .encode(key.sign(layer.as_bytes()).to_bytes()),
+        layer,
+    }
+}
+
+fn team_layer() -> Value {
+    json!({
+        "api_key": "km_live_from_the_layer",
+        "batch_size": 50,
+        "method_whitelist": ["tools/*"],
+        "redaction": {"enabled": true},
+        "remote_config": {"source": "https://evil.example.com/config"}
+    })
+}
+
+/// A config file using the layer at `source`, with `extra` settings
+fn write_config(dir: &TempDir, source: &str, extra: Value) -> PathBuf {
+    let path = dir.path().join("km_config.json");
+    let mut file = json!({
+        "api_key": "km_live_local",
+        "api_url": "https://api.kilometers.ai",
+        "remote_config": {
+            "source": source,
+            "trusted_keys": [public_key(&signing_key())]
+        }
+    });
+    for (key, value) in extra.as_object().unwrap() {
+        file[key] = value.clone();
+    }
+    fs::write(&path, file.to_string()).unwrap();
+    path
+}
+
+async fn serve_layer(signed: &SignedLayer) -> MockServer {
+    let server = MockServer::start().await;
+    Mock::given(method("GET"))
+        .and(path("/team/config"))
+        .respond_with(ResponseTemplate::new(200).set_body_json(signed))
+        .mount(&server)
+        .await;
+    server
+}
+
+async fn refresh(config_path: &Path) -> anyhow::Result<remote_config::Layer> {
+    let file = Config::load(config_path).unwrap();
+    remote_config::refresh(config_path, &file.remote_config, &file.api_url, None).await
+}
+
+#[tokio::test]
+async fn test_layer_applies_below_the_config_file() {
+    let server = serve_layer(&sign(&signing_key(), &team_layer())).await;
+    let dir = TempDir::new().unwrap();
+    let source = format!("{}/team/config", server.uri());
+    let config_path = write_config(&dir, &source, json!({"batch_size": 200}));
+
+    let layer = refresh(&config_path).await.unwrap();
+    assert_eq!(layer.source, source);
+    assert!(remote_config::cache_path(&config_path).exists());
+
+    let config = Config::load_layered(&config_path).unwrap();
+    assert_eq!(config.batch_size, 200);
+    assert_eq!(config.method_whitelist, ["tools/*"]);
+    assert!(config.redaction.enabled);
+    // What says who the user is and where the layer comes from stays local
+    assert_eq!(config.api_key, "km_live_local");
+    assert_eq!(
+        config.remote_config.source.as_deref(),
+        Some(source.as_str())
+    );
+
+    // The file as written is what `km config set` edits and saves
+    let file = Config::load(&config_path).unwrap();
+    assert!(file.method_whitelist.is_empty());
+}
+
+#[tokio::test]
+async fn test_unsigned_layers_are_refused_and_the_cache_is_kept() {
+    let dir = TempDir::new().unwrap();
+    let good = serve_layer(&sign(&signing_key(), &team_layer())).await;
+    let config_path = write_config(&dir, &format!("{}/team/config", good.uri()), json!({}));
+    refresh(&config_path).await.unwrap();
+
+    let forged = sign(
+        &SigningKey::from_bytes(&[3u8; 32]),
+        &json!({"batch_size": 1}),
+    );
+    let bad = serve_layer(&forged).await;
+    let config_path = write_config(&dir, &format!("{}/team/config", bad.uri()), json!({}));
+    let err = refresh(&config_path).await.unwrap_err();
+    assert!(err.to_string().contains("trusted_keys"), "{:#}", err);
+
+    // The cached layer came from the old source, so it no longer applies,
+    // but it wasn't replaced by the forged one either
+    let cached = fs::read_to_string(remote_config::cache_path(&config_path)).unwrap();
+    assert!(cached.contains(&good.uri()));
+    assert_eq!(
+        Config::load_layered(&config_path).unwrap().batch_size,
+        config::DEFAULT_BATCH_SIZE
+    );
+}
+
+#[tokio::test]
+async fn test_tampered_cache_is_ignored() {
+    let server = serve_layer(&sign(&signing_key(), &team_layer())).await;
+    let dir = TempDir::new().unwrap();
+    let config_path = write_config(&dir, &format!("{}/team/config", server.uri()), json!({}));
+    refresh(&config_path).await.unwrap();
+
+    let cache = remote_config::cache_path(&config_path);
+    let tampered = fs::read_to_string(&cache)
+        .unwrap()
+        .replace("tools/*", "anything/*");
+    fs::write(&cache, tampered).unwrap();
+
+    let config = Config::load_layered(&config_path).unwrap();
+    assert!(config.method_whitelist.is_empty());
+}
+
+#[tokio::test]
+async fn test_sources_name_the_layer_each_setting_comes_from() {
+    let server = serve_layer(&sign(&signing_key(), &team_layer())).await;
+    let dir = TempDir::new().unwrap();
+    let source = format!("{}/team/config", server.uri());
+    let config_path = write_config(&dir, &source, json!({"batch_size": 200}));
+    refresh(&config_path).await.unwrap();
+
+    let sources = config::sources(&config_path).unwrap();
+    let source_of = |key: &str| {
+        sources
+            .iter()
+            .find(|(name, _)| *name == key)
+            .map(|(_, source)| source.clone())
+            .unwrap()
+    };
+
+    assert_eq!(source_of("batch_size"), Source::File);
+    assert_eq!(
+        source_of("method_whitelist"),
+        Source::Remote(source.clone())
+    );
+    assert_eq!(source_of("redaction.enabled"), Source::Remote(source));
+    assert_eq!(source_of("queue_size"), Source::Default);
+    assert_eq!(source_of("remote_config.source"), Source::File);
+}
+
+#[test]
+fn test_api_source_resolves_against_the_api_url() {
+    let settings = RemoteConfigSettings {
+        source: Some(remote_config::API_SOURCE.to_string()),
+        trusted_keys: vec![public_key(&signing_key())],
+        ..Default::default()
+    };
+
+    assert!(settings.uses_api());
+    assert_eq!(
+        settings.url("https://api.example.com/").as_deref(),
+        Some("https://api.example.com/api/cli/config")
+    );
+    assert_eq!(
+        RemoteConfigSettings::default().url("https://api.example.com"),
+        None
+    );
+}
+
+#[test]
+fn test_config_reports_a_source_without_trusted_keys() {
+    let mut config = Config::new(
+        "km_test".to_string(),
+        "https://api.kilometers.ai".to_string(),
+    );
+    config
+        .set("remote_config.source", "https://config.example.com/km")
+        .unwrap();
+
+    let problems = config.validate();
+    assert!(
+        problems
+            .iter()
+            .any(|p| p.contains("remote_config.trusted_keys")),
+        "{:?}",
+        problems
+    );
+
+    config
+        .set("remote_config.trusted_keys", &public_key(&signing_key()))
+        .unwrap();
+    assert!(config.validate().is_empty(), "{:?}", config.validate());
+}
@@ -0,0 +1,230 @@
+use km::policy::{Policy, PolicyAction, PolicyConfig, PolicyMode, PolicyRuleConfig};
+use km::replay::{self, ReplayChecks, ReplayOutcome, ReplaySummary};
+use km::risk::{PatternRiskAnalyzer, RiskLevel};
+use km::traffic::TrafficEntry;
+use serde_json::json;
+use std::time::Duration;
+
+fn entry(ts: &str, direction: &str, content: serde_json::Value, session: &str) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: ts.parse().unwrap(),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn capture() -> Vec<TrafficEntry> {
+    vec![
+        entry(
+            "2025-01-01T10:00:00Z",
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {}}),
+            "old",
+        ),
+        entry(
+            "2025-01-02T10:00:00Z",
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {}}),
+            "latest",
+        ),
+        entry(
+            "2025-01-02T10:00:00.500Z",
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {"protocolVersion": "2024-11-05"}}),
+            "latest",
+        ),
+        entry(
+            "2025-01-02T10:00:01Z",
+            "request",
+            json!({"jsonrpc": "2.0", "method": "notifications/initialized"}),
+            "latest",
+        ),
+        entry(
+            "2025-01-02T10:00:02Z",
+            "request",
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/list"}),
+            "latest",
+        ),
+        entry(
+            "2025-01-02T10:00:02.250Z",
+            "response",
+            json!({"jsonrpc": "2.0", "id": 2, "result": {"tools": []}}),
+            "latest",
+        ),
+    ]
+}
+
+#[test]
+fn test_select_session_defaults_to_latest() {
+    let entries = capture();
+    assert_eq!(
+        replay::select_session(&entries, None),
+        Some("latest".to_string())
+    );
+    assert_eq!(
+        replay::select_session(&entries, Some("old")),
+        Some("old".to_string())
+    );
+}
+
+#[test]
+fn test_build_steps_pairs_requests_with_responses() {
+    let entries = capture();
+    let steps = replay::build_steps(&entries, Some("latest"));
+
+    assert_eq!(steps.len(), 3);
+    assert_eq!(steps[0].method.as_deref(), Some("initialize"));
+    assert!(steps[0].recorded_response.is_some());
+    assert_eq!(
+        steps[1].method.as_deref(),
+        Some("notifications/initialized")
+    );
+    assert!(steps[1].recorded_response.is_none());
+    assert_eq!(steps[2].offset, Duration::from_secs(2));
+    assert_eq!(
+        steps[2].recorded_response.as_ref().unwrap()["result"]["tools"],
+        json!([])
+    );
+}
+
+#[test]
+fn test_compare_responses_ignores_envelope() {
+    let expected = json!({"jsonrpc": "2.0", "id": 1, "result": {"ok": true}});
+    let same = json!({"jsonrpc": "2.0", "id": 7, "result": {"ok": true}});
+    let different = json!({"jsonrpc": "2.0", "id": 1, "result": {"ok": false}});
+
+    assert_eq!(
+        replay::compare_responses(&expected, &same),
+        ReplayOutcome::Match
+    );
+    assert!(matches!(
+        replay::compare_responses(&expected, &different),
+        ReplayOutcome::Mismatch { .. }
+    ));
+}
+
+#[test]
+fn test_replay_dry_run_reports_recorded_durations() {
+    let mut entries = capture();
+    entries[2].duration_ms = Some(500.0);
+
+    let steps = replay::build_steps(&entries, Some("latest"));
+    let results = replay::replay_dry_run(&steps, 0.0, &ReplayChecks::default());
+
+    assert_eq!(results.len(), 3);
+    assert_eq!(results[0].duration_ms, Some(500.0));
+    assert!(ReplaySummary::from_results(&results).is_success());
+}
+
+fn shell_call() -> TrafficEntry {
+    entry(
+        "2025-01-02T10:00:03Z",
+        "request",
+        json!({
+            "jsonrpc": "2.0",
+            "id": 3,
+            "method": "tools/call",
+            "params": {"name": "shell", "arguments": {"cmd": "rm -rf /"}}
+        }),
+        "latest",
+    )
+}
+
+#[test]
+fn test_replay_dry_run_assesses_risk() {
+    let mut entries = capture();
+    entries.push(shell_call());
+
+    let steps = replay::build_steps(&entries, Some("latest"));
+    let results = replay::replay_dry_run(&steps, 0.0, &ReplayChecks::default());
+
+    assert_eq!(results[0].checked.risk.level, RiskLevel::Low);
+    let shell = &results[3].checked.risk;
+    assert!(shell.level >= RiskLevel::High);
+    assert!(shell
+        .matched_patterns
+        .contains(&"destructive_shell".to_string()));
+    let summary = ReplaySummary::from_results(&results);
+    assert_eq!(summary.high_risk, 1);
+    assert!(summary.is_success());
+}
+
+#[test]
+fn test_replay_blocks_messages_an_enforced_policy_denies() {
+    let mut entries = capture();
+    entries.push(shell_call());
+    let policy = Policy::from_config(&PolicyConfig {
+        mode: PolicyMode::Enforce,
+        default_action: PolicyAction::Allow,
+        rules: vec![PolicyRuleConfig {
+            name: "no-shell".to_string(),
+            action: PolicyAction::Deny,
+            methods: Vec::new(),
+            tools: vec!["shell".to_string()],
+            arguments: Default::default(),
+            risk_above: None,
+            set: Default::default(),
+            message: Some("Shell is disabled".to_string()),
+        }],
+    })
+    .unwrap();
+    let checks = ReplayChecks::new(PatternRiskAnalyzer::new(), Some(policy));
+
+    let steps = replay::build_steps(&entries, Some("latest"));
+    let results = replay::replay_dry_run(&steps, 0.0, &checks);
+
+    assert_eq!(results[0].outcome, ReplayOutcome::Sent);
+    assert!(results[0].checked.policy.is_none());
+    assert_eq!(
+        results[3].outcome,
+        ReplayOutcome::Blocked {
+            rule: "no-shell".to_string(),
+            message: "Shell is disabled".to_string()
+        }
+    );
+    assert_eq!(ReplaySummary::from_results(&results).blocked, 1);
+}
+
+#[test]
+fn test_parse_speed_rejects_non_positive_values() {
+    assert_eq!(replay::parse_speed("2.5"), Ok(2.5));
+    for value in ["0", "-1", "NaN", "inf", "1e-400", "fast"] {
+        assert!(
+            replay::parse_speed(value).is_err(),
+            "{} was accepted",
+            value
+        );
+    }
+}
+
+#[test]
+fn test_replay_against_mock_server() {
+    let entries = capture();
+    let steps = replay::build_steps(&entries, Some("latest"));
+
+    let results = replay::replay_against_server(
+        &steps,
+        env!("CARGO_BIN_EXE_mock_mcp_server"),
+        &[],
+        0.0,
+        Duration::from_secs(5),
+        &ReplayChecks::default(),
+    )
+    .unwrap();
+
+    assert_eq!(results.len(), 3);
+    // The mock server's initialize result differs from the recorded one
+    assert!(matches!(results[0].outcome, ReplayOutcome::Mismatch { .. }));
+    assert_eq!(results[1].outcome, ReplayOutcome::Sent);
+
+    let summary = ReplaySummary::from_results(&results);
+    assert_eq!(summary.timed_out, 0);
+    assert!(!summary.is_success());
+}
@@ -0,0 +1,303 @@
+use chrono::{DateTime, Duration, Utc};
+use km::costs::CostConfig;
+use km::report::{self, ReportFormat, SessionReport};
+use km::risk::{PatternRiskAnalyzer, RiskLevel};
+use km::sessions;
+use km::traffic::TrafficEntry;
+use serde_json::{json, Value};
+use std::path::Path;
+
+fn at(ms: i64) -> DateTime<Utc> {
+    DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+        .unwrap()
+        .with_timezone(&Utc)
+        + Duration::milliseconds(ms)
+}
+
+fn entry(session: &str, ms: i64, direction: &str, content: Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(ms),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn call(id: u64, tool: &str, arguments: Value) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "method": "tools/call",
+           "params": {"name": tool, "arguments": arguments}})
+}
+
+fn ok(id: u64, text: &str) -> Value {
+    json!({"jsonrpc": "2.0", "id": id, "result": {"content": [{"type": "text", "text": text}]}})
+}
+
+fn sample() -> Vec<TrafficEntry> {
+    vec![
+        entry(
+            "abc-1",
+            0,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize"}),
+        ),
+        entry(
+            "abc-1",
+            10,
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {"serverInfo": {"name": "files"}}}),
+        ),
+        entry(
+            "abc-1",
+            1_000,
+            "request",
+            call(2, "read_file", json!({"path": "a.txt"})),
+        ),
+        entry("abc-1", 1_020, "response", ok(2, &"x".repeat(5000))),
+        entry(
+            "abc-1",
+            2_000,
+            "request",
+            call(3, "read_file", json!({"path": "b.txt"})),
+        ),
+        entry("abc-1", 2_100, "response", ok(3, "short")),
+        entry(
+            "abc-1",
+            3_000,
+            "request",
+            call(4, "shell", json!({"cmd": "rm -rf /"})),
+        ),
+        entry(
+            "abc-1",
+            3_500,
+            "response",
+            json!({"jsonrpc": "2.0", "id": 4, "error": {"code": -32000, "message": "denied"}}),
+        ),
+        entry(
+            "abc-1",
+            4_000,
+            "request",
+            call(5, "read_file", json!({"path": "c.txt"})),
+        ),
+        entry(
+            "other",
+            0,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}),
+        ),
+    ]
+}
+
+fn build() -> SessionReport {
+    let entries = sample();
+    let summaries = sessions::summarize(&entries);
+    let session = sessions::resolve(&summaries, "abc").unwrap();
+    SessionReport::build(
+        &entries,
+        session,
+        &PatternRiskAnalyzer::new(),
+        &CostConfig::default(),
+    )
+}
+
+#[test]
+fn test_percentile_uses_nearest_rank() {
+    let values: Vec<f64> = (1..=10).map(f64::from).collect();
+    assert_eq!(report::percentile(&values, 50.0), 5.0);
+    assert_eq!(report::percentile(&values, 90.0), 9.0);
+    assert_eq!(report::percentile(&values, 99.0), 10.0);
+    assert_eq!(report::percentile(&[7.0], 50.0), 7.0);
+}
+
+#[test]
+fn test_report_covers_only_the_session() {
+    let report = build();
+    assert_eq!(report.session.id, "abc-1");
+    assert_eq!(report.timeline.len(), 5);
+    assert!(report.methods.iter().all(|m| m.method != "tools/list"));
+    assert_eq!(report.timeline_omitted, 0);
+}
+
+#[test]
+fn test_methods_have_error_rates_and_latency_percentiles() {
+    let report = build();
+    let tools = &report.methods[0];
+    assert_eq!(tools.method, "tools/call");
+    assert_eq!(tools.calls, 4);
+    assert_eq!(tools.errors, 1);
+    assert_eq!(tools.unanswered, 1);
+    assert_eq!(tools.error_rate(), 0.25);
+    let latency = tools.latency.as_ref().unwrap();
+    assert_eq!(latency.p50, 100.0);
+    assert_eq!(latency.max, 500.0);
+
+    let initialize = &report.methods[1];
+    assert_eq!(initialize.method, "initialize");
+    assert_eq!(initialize.latency.as_ref().unwrap().p99, 10.0);
+}
+
+#[test]
+fn test_risk_distribution_and_largest_payloads() {
+    let report = build();
+    assert_eq!(report.risk.values().sum::<u64>(), 5);
+    assert!(report.risk[&RiskLevel::High] + report.risk[&RiskLevel::Critical] >= 1);
+
+    let largest = &report.largest_payloads[0];
+    assert_eq!(largest.direction, "response");
+    assert_eq!(largest.method.as_deref(), Some("tools/call"));
+    assert!(largest.bytes > 5000);
+
+    let shell = report
+        .timeline
+        .iter()
+        .find(|c| c.tool.as_deref() == Some("shell"))
+        .unwrap();
+    assert!(shell.risk >= RiskLevel::High);
+}
+
+#[test]
+fn test_markdown_report() {
+    let markdown = report::render(&build(), ReportFormat::Md);
+    assert!(markdown.starts_with("# Session report: abc-1\n"));
+    assert!(markdown.contains("| **Server** | files |"));
+    assert!(markdown.contains("## Tools"));
+    assert!(
+        markdown.contains("| read_file | 3 | 75.0% |"),
+        "{}",
+        markdown
+    );
+    assert!(
+        markdown.contains("| tools/call | 4 | 1 | 25.0% | 1 |"),
+        "{}",
+        markdown
+    );
+    assert!(markdown.contains("error -32000: denied"));
+    assert!(markdown.contains("| +4s | tools/call | read_file | - | low | no response |"));
+}
+
+#[test]
+fn test_html_report_escapes_payload_text() {
+    let mut entries = sample();
+    entries.push(entry(
+        "abc-1",
+        5_000,
+        "request",
+        call(6, "<script>alert(1)</script>", json!({})),
+    ));
+    let summaries = sessions::summarize(&entries);
+    let report = SessionReport::build(
+        &entries,
+        &summaries[0],
+        &PatternRiskAnalyzer::new(),
+        &CostConfig::default(),
+    );
+    let html = report::render(&report, ReportFormat::Html);
+
+    assert!(html.starts_with("<!DOCTYPE html>"));
+    assert!(html.contains("<h2>Timeline</h2>"));
+    assert!(html.contains("&lt;script&gt;alert(1)&lt;/script&gt;"));
+    assert!(!html.contains("<script>"));
+    assert!(html.trim_end().ends_with("</html>"));
+}
+
+#[test]
+fn test_format_from_output_extension() {
+    assert_eq!(
+        ReportFormat::from_path(Path::new("incident.html")),
+        Some(ReportFormat::Html)
+    );
+    assert_eq!(
+        ReportFormat::from_path(Path::new("pr.md")),
+        Some(ReportFormat::Md)
+    );
+    assert_eq!(
+        ReportFormat::from_path(Path::new("km.sarif")),
+        Some(ReportFormat::Sarif)
+    );
+    assert_eq!(ReportFormat::from_path(Path::new("report.txt")), None);
+}
+
+#[test]
+fn test_sarif_lists_high_risk_requests_and_policy_violations() {
+    let mut entries = sample();
+    let mut denied = entry(
+        "abc-1",
+        5_000,
+        "request",
+        call(6, "list_dir", json!({"path": "."})),
+    );
+    denied.metadata.insert(
+        "policy".to_string(),
+        json!({"rule": "no-list", "decision": "deny", "enforced": false}),
+    );
+    entries.push(denied);
+    let mut redacted = entry("abc-1", 5_500, "response", ok(5, "secret"));
+    redacted.metadata.insert(
+        "policy_bundle".to_string(),
+        json!({"phase": "response", "revision": "7",
+               "result": {"allow": false, "reason": "leaks secrets"}}),
+    );
+    entries.push(redacted);
+
+    let summaries = sessions::summarize(&entries);
+    let mut report = SessionReport::build(
+        &entries,
+        &summaries[0],
+        &PatternRiskAnalyzer::new(),
+        &CostConfig::default(),
+    );
+    report.log = Some("logs/mcp_traffic.jsonl".into());
+    assert_eq!(report.findings.len(), 3, "{:?}", report.findings);
+
+    let sarif: Value = serde_json::from_str(&report::render(&report, ReportFormat::Sarif)).unwrap();
+    assert_eq!(sarif["version"], "2.1.0");
+    let run = &sarif["runs"][0];
+    assert_eq!(run["tool"]["driver"]["name"], "km");
+    assert_eq!(run["tool"]["driver"]["rules"].as_array().unwrap().len(), 2);
+    assert_eq!(run["properties"]["session"], "abc-1");
+
+    let results = run["results"].as_array().unwrap();
+    let shell = &results[0];
+    assert_eq!(shell["ruleId"], "km/high-risk-request");
+    assert_eq!(shell["ruleIndex"], 0);
+    assert!(shell["message"]["text"]
+        .as_str()
+        .unwrap()
+        .contains("tool shell"));
+    let location = &shell["locations"][0];
+    assert_eq!(location["logicalLocations"][0]["name"], "shell");
+    assert_eq!(
+        location["physicalLocation"]["artifactLocation"]["uri"],
+        "logs/mcp_traffic.jsonl"
+    );
+    assert_eq!(location["physicalLocation"]["region"]["startLine"], 7);
+
+    let audit = &results[1];
+    assert_eq!(audit["ruleId"], "km/policy-violation");
+    assert_eq!(audit["level"], "warning");
+    // Lines count the other session's entry before it
+    assert_eq!(
+        audit["locations"][0]["physicalLocation"]["region"]["startLine"],
+        11
+    );
+    assert_eq!(
+        audit["message"]["text"],
+        "Policy rule no-list denies requests to tool list_dir; forwarded in audit mode"
+    );
+
+    let bundle = &results[2];
+    assert_eq!(bundle["level"], "error");
+    assert_eq!(
+        bundle["locations"][0]["logicalLocations"][0]["name"],
+        "read_file"
+    );
+    assert_eq!(
+        bundle["message"]["text"],
+        "The policy bundle blocked the response to tool read_file: leaks secrets"
+    );
+}
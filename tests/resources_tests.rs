@@ -0,0 +1,105 @@
+use km::correlation::MessageCounts;
+use km::resources::{ProcessSampler, ResourceSample, ResourceStats, ResourceUsage};
+use km::uploader::{McpEvent, SessionEnd};
+use std::time::{Duration, Instant};
+
+fn sample(cpu_percent: f64, memory_mb: u64) -> ResourceSample {
+    ResourceSample {
+        cpu_percent,
+        memory_bytes: memory_mb * 1024 * 1024,
+    }
+}
+
+#[test]
+fn test_usage_tracks_latest_average_and_peak() {
+    let mut usage = ResourceUsage::default();
+    usage.add(sample(10.0, 20));
+    usage.add(sample(50.0, 40));
+    usage.add(sample(0.0, 30));
+
+    assert_eq!(usage.samples, 3);
+    assert_eq!(usage.cpu_percent, 0.0);
+    assert_eq!(usage.cpu_percent_avg, 20.0);
+    assert_eq!(usage.cpu_percent_peak, 50.0);
+    assert_eq!(usage.memory_bytes, 30 << 20);
+    assert_eq!(usage.memory_bytes_avg, 30 << 20);
+    assert_eq!(usage.memory_bytes_peak, 40 << 20);
+    assert_eq!(
+        usage.describe(),
+        "CPU 0.0% (avg 20.0%, peak 50.0%), memory 30.0 MB (avg 30.0 MB, peak 40.0 MB)"
+    );
+}
+
+#[test]
+fn test_stats_are_empty_until_sampled() {
+    let stats = ResourceStats::default();
+    assert!(stats.usage().is_none());
+    stats.record(sample(5.0, 10));
+    assert_eq!(stats.usage().unwrap().samples, 1);
+}
+
+#[cfg(any(target_os = "linux", target_os = "macos", windows))]
+#[test]
+fn test_sampling_a_running_process() {
+    let mut sampler = ProcessSampler::new(std::process::id());
+
+    // Keep a core busy so there's CPU time to measure
+    let busy_until = Instant::now() + Duration::from_millis(300);
+    let mut spins = 0u64;
+    while Instant::now() < busy_until {
+        spins = std::hint::black_box(spins + 1);
+    }
+
+    let reading = sampler.sample().unwrap();
+    assert!(reading.cpu_percent > 0.0, "{:?}", reading);
+    assert!(reading.memory_bytes > 1024 * 1024, "{:?}", reading);
+}
+
+#[test]
+fn test_sampling_a_process_that_has_exited() {
+    let mut child = std::process::Command::new(env!("CARGO_BIN_EXE_km"))
+        .arg("--version")
+        .stdout(std::process::Stdio::null())
+        .spawn()
+        .unwrap();
+    let pid = child.id();
+    child.wait().unwrap();
+    // On Windows an open handle keeps the process queryable
+    drop(child);
+    assert!(ProcessSampler::new(pid).sample().is_err());
+}
+
+#[test]
+fn test_session_end_event_carries_the_summary() {
+    let mut usage = ResourceUsage::default();
+    usage.add(sample(25.0, 64));
+    let started_at = chrono::Utc::now();
+    let event = McpEvent::session_end(
+        "session-1",
+        &SessionEnd {
+            started_at,
+            ended_at: started_at + chrono::Duration::seconds(90),
+            requests: 4,
+            responses: 3,
+            messages: MessageCounts {
+                client_requests: 3,
+                client_notifications: 1,
+                server_responses: 3,
+                ..Default::default()
+            },
+            resources: Some(usage),
+            handshake: None,
+        },
+    );
+
+    assert_eq!(event.session_id, "session-1");
+    assert_eq!(event.direction, "session_end");
+    assert!(event.method.is_none());
+    let payload = event.payload.unwrap();
+    assert_eq!(payload["requests"], 4);
+    assert_eq!(payload["responses"], 3);
+    assert_eq!(payload["messages"]["client_notifications"], 1);
+    assert_eq!(payload["messages"]["server_requests"], 0);
+    assert_eq!(payload["resources"]["cpu_percent_peak"], 25.0);
+    assert_eq!(payload["resources"]["memory_bytes_peak"], 64 << 20);
+}
@@ -0,0 +1,233 @@
+use chrono::{DateTime, Duration, Utc};
+use km::retention::{self, Janitor, RetentionConfig};
+use km::traffic::{self, TrafficEntry};
+use std::collections::HashSet;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+use tempfile::TempDir;
+
+fn entry(session: Option<&str>, at: DateTime<Utc>, content: &str) -> String {
+    serde_json::to_string(&TrafficEntry {
+        timestamp: at,
+        direction: "request".to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: session.map(String::from),
+        metadata: Default::default(),
+        labels: Default::default(),
+    })
+    .unwrap()
+}
+
+/// Sessions a (10 days ago), b (5 days ago) and c (now), two entries each,
+/// plus a line that isn't an entry.
+fn write_log(dir: &TempDir) -> PathBuf {
+    let now = Utc::now();
+    let path = dir.path().join("traffic.jsonl");
+    let mut file = std::fs::File::create(&path).unwrap();
+    for (session, days) in [("a", 10), ("b", 5), ("c", 0)] {
+        for _ in 0..2 {
+            let line = entry(Some(session), now - Duration::days(days), &"x".repeat(100));
+            writeln!(file, "{}", line).unwrap();
+        }
+    }
+    writeln!(file, "not an entry").unwrap();
+    path
+}
+
+fn sessions(path: &Path) -> Vec<String> {
+    let mut ids: Vec<String> = traffic::read_entries(path)
+        .unwrap()
+        .into_iter()
+        .filter_map(|e| e.session_id)
+        .collect();
+    ids.dedup();
+    ids
+}
+
+#[test]
+fn test_usage_by_session() {
+    let dir = TempDir::new().unwrap();
+    let log = write_log(&dir);
+    let spool = dir.path().join("spool");
+    std::fs::create_dir(&spool).unwrap();
+    std::fs::write(spool.join("1.json"), "12345").unwrap();
+    let legacy = entry(None, Utc::now() - Duration::days(30), "{}");
+    let mut file = std::fs::OpenOptions::new().append(true).open(&log).unwrap();
+    writeln!(file, "{}", legacy).unwrap();
+
+    let usage = retention::usage(
+        &log,
+        &[
+            ("spool", spool.clone()),
+            ("blobs", dir.path().join("missing")),
+        ],
+    )
+    .unwrap();
+    let ids: Vec<&str> = usage
+        .sessions
+        .iter()
+        .map(|s| s.session_id.as_str())
+        .collect();
+    assert_eq!(ids, vec!["c", "b", "a", retention::NO_SESSION]);
+    assert_eq!(usage.sessions[0].entries, 2);
+    assert_eq!(
+        usage.log_bytes,
+        std::fs::metadata(&log).unwrap().len(),
+        "{:?}",
+        usage
+    );
+    let counted: u64 = usage.sessions.iter().map(|s| s.bytes).sum();
+    assert_eq!(counted, usage.log_bytes - "not an entry\n".len() as u64);
+    assert_eq!((usage.areas[0].files, usage.areas[0].bytes), (1, 5));
+    assert_eq!((usage.areas[1].files, usage.areas[1].bytes), (0, 0));
+
+    let lines = retention::render_usage(&usage);
+    assert!(lines[0].contains("in 4 session(s)"), "{:?}", lines);
+    assert!(lines.iter().any(|l| l.starts_with("SESSION")));
+    assert!(lines
+        .iter()
+        .any(|l| l.starts_with("spool") && l.contains("1 file(s)")));
+    assert_eq!(retention::human_bytes(512), "512 B");
+    assert_eq!(retention::human_bytes(1536), "1.5 KB");
+}
+
+#[test]
+fn test_prune_by_count_and_age() {
+    let dir = TempDir::new().unwrap();
+    let log = write_log(&dir);
+    let limits = RetentionConfig {
+        max_sessions: Some(2),
+        ..Default::default()
+    };
+
+    let report = retention::prune_log(&log, &limits, &HashSet::new(), Utc::now(), true).unwrap();
+    assert_eq!(report.sessions, vec!["a"]);
+    assert_eq!(report.entries, 2);
+    assert_eq!(
+        sessions(&log),
+        vec!["a", "b", "c"],
+        "dry run changed the log"
+    );
+
+    retention::prune_log(&log, &limits, &HashSet::new(), Utc::now(), false).unwrap();
+    assert_eq!(sessions(&log), vec!["b", "c"]);
+    let contents = std::fs::read_to_string(&log).unwrap();
+    assert!(contents.ends_with("not an entry\n"));
+    assert!(!dir.path().join(".traffic.jsonl.tmp").exists());
+
+    let limits = RetentionConfig {
+        max_age_days: Some(3),
+        ..Default::default()
+    };
+    // Sessions in `keep` stay whatever their age
+    let keep = HashSet::from(["b".to_string()]);
+    let report = retention::prune_log(&log, &limits, &keep, Utc::now(), false).unwrap();
+    assert!(report.sessions.is_empty());
+    let report = retention::prune_log(&log, &limits, &HashSet::new(), Utc::now(), false).unwrap();
+    assert_eq!(report.sessions, vec!["b"]);
+    assert_eq!(sessions(&log), vec!["c"]);
+}
+
+#[test]
+fn test_prune_by_size_removes_oldest_first() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("traffic.jsonl");
+    let now = Utc::now();
+    let mut file = std::fs::File::create(&path).unwrap();
+    // Three sessions of about 400KB each
+    for (session, minutes) in [("old", 30), ("middle", 20), ("new", 10)] {
+        for _ in 0..4 {
+            let line = entry(
+                Some(session),
+                now - Duration::minutes(minutes),
+                &"y".repeat(100 * 1024),
+            );
+            writeln!(file, "{}", line).unwrap();
+        }
+    }
+    let limits = RetentionConfig {
+        max_size_mb: Some(1),
+        ..Default::default()
+    };
+    let report = retention::prune_log(&path, &limits, &HashSet::new(), now, false).unwrap();
+    assert_eq!(report.sessions, vec!["old"]);
+    assert!(std::fs::metadata(&path).unwrap().len() <= 1024 * 1024);
+    assert_eq!(sessions(&path), vec!["middle", "new"]);
+
+    // A missing log has nothing to prune
+    let missing = dir.path().join("missing.jsonl");
+    let report = retention::prune_log(&missing, &limits, &HashSet::new(), now, false).unwrap();
+    assert!(report.is_empty());
+    assert!(!missing.exists());
+}
+
+#[test]
+fn test_prune_blobs_by_last_use() {
+    let dir = TempDir::new().unwrap();
+    let old = dir.path().join("old.json");
+    let fresh = dir.path().join("fresh.json");
+    std::fs::write(&old, "old blob").unwrap();
+    std::fs::write(&fresh, "fresh").unwrap();
+    let two_days_ago = SystemTime::now() - std::time::Duration::from_secs(2 * 24 * 60 * 60);
+    std::fs::File::options()
+        .append(true)
+        .open(&old)
+        .unwrap()
+        .set_modified(two_days_ago)
+        .unwrap();
+
+    let unlimited = RetentionConfig::default();
+    assert_eq!(
+        retention::prune_blobs(dir.path(), &unlimited, SystemTime::now(), false).unwrap(),
+        (0, 0)
+    );
+    let limits = RetentionConfig {
+        max_age_days: Some(1),
+        ..Default::default()
+    };
+    assert_eq!(
+        retention::prune_blobs(dir.path(), &limits, SystemTime::now(), true).unwrap(),
+        (1, 8)
+    );
+    assert!(old.exists());
+    assert_eq!(
+        retention::prune_blobs(dir.path(), &limits, SystemTime::now(), false).unwrap(),
+        (1, 8)
+    );
+    assert!(!old.exists());
+    assert!(fresh.exists());
+}
+
+#[test]
+fn test_janitor_keeps_its_own_session() {
+    let dir = TempDir::new().unwrap();
+    let log = write_log(&dir);
+    let limits = RetentionConfig {
+        max_age_days: Some(1),
+        max_sessions: Some(2),
+        ..Default::default()
+    };
+    let mut janitor = Janitor::new(limits, "a", None);
+    assert!(janitor.due());
+    janitor.run(&log);
+    assert!(!janitor.due());
+    assert_eq!(sessions(&log), vec!["a", "c"]);
+}
+
+#[test]
+fn test_validate_rejects_zero_limits() {
+    assert!(RetentionConfig::default().validate().is_ok());
+    let limits = RetentionConfig {
+        max_sessions: Some(0),
+        ..Default::default()
+    };
+    assert_eq!(
+        limits.validate().unwrap_err().to_string(),
+        "retention.max_sessions must be greater than 0"
+    );
+}
@@ -0,0 +1,194 @@
+use km::risk::arguments::{self, ArgumentRole};
+use km::risk::heuristic::HeuristicRiskAnalyzer;
+use km::risk::{PatternRiskAnalyzer, RiskLevel};
+use serde_json::json;
+
+fn call(tool: &str, arguments: serde_json::Value) -> String {
+    json!({
+        "jsonrpc": "2.0",
+        "id": 1,
+        "method": "tools/call",
+        "params": {"name": tool, "arguments": arguments}
+    })
+    .to_string()
+}
+
+fn patterns(analyzer: &PatternRiskAnalyzer, content: &str) -> Vec<String> {
+    analyzer
+        .analyze(Some("tools/call"), content)
+        .matched_patterns
+}
+
+#[test]
+fn test_argument_roles_come_from_names_and_schemas() {
+    assert_eq!(arguments::role("path", None), Some(ArgumentRole::Path));
+    assert_eq!(
+        arguments::role("sourceFiles", None),
+        Some(ArgumentRole::Path)
+    );
+    assert_eq!(
+        arguments::role("working_dir", None),
+        Some(ArgumentRole::Path)
+    );
+    assert_eq!(arguments::role("sql", None), Some(ArgumentRole::Sql));
+    assert_eq!(arguments::role("query", None), Some(ArgumentRole::Sql));
+    assert_eq!(
+        arguments::role("callback_url", None),
+        Some(ArgumentRole::Url)
+    );
+    assert_eq!(
+        arguments::role("command", None),
+        Some(ArgumentRole::Command)
+    );
+    assert_eq!(arguments::role("content", None), None);
+
+    let uri = json!({"type": "string", "format": "uri"});
+    assert_eq!(
+        arguments::role("target", Some(&uri)),
+        Some(ArgumentRole::Url)
+    );
+    let described = json!({"type": "string", "description": "Absolute path of the log"});
+    assert_eq!(
+        arguments::role("location", Some(&described)),
+        Some(ArgumentRole::Path)
+    );
+}
+
+#[test]
+fn test_path_arguments() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let read = |path: &str| patterns(&analyzer, &call("read_file", json!({ "path": path })));
+
+    assert_eq!(read("/etc/shadow"), vec!["sensitive_path_argument"]);
+    assert_eq!(read("~/.ssh/id_ed25519"), vec!["sensitive_path_argument"]);
+    assert_eq!(
+        read("C:\\Windows\\System32\\config\\SAM"),
+        vec!["sensitive_path_argument"]
+    );
+    assert_eq!(read("app/.env"), vec!["sensitive_path_argument"]);
+    assert_eq!(
+        read("docs/../../secrets.txt"),
+        vec!["path_traversal_argument"]
+    );
+    // A project directory named etc isn't /etc
+    assert!(read("src/etc/notes.md").is_empty());
+    assert!(read("/home/me/project/README.md").is_empty());
+}
+
+#[test]
+fn test_sql_arguments() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let query = |sql: &str| patterns(&analyzer, &call("run_query", json!({ "sql": sql })));
+
+    assert_eq!(query("DROP TABLE users"), vec!["destructive_sql_argument"]);
+    assert_eq!(
+        query("select 1; delete from orders"),
+        vec!["destructive_sql_argument"]
+    );
+    assert_eq!(
+        query("UPDATE users SET admin = true"),
+        vec!["destructive_sql_argument"]
+    );
+    assert!(query("DELETE FROM sessions WHERE expires < now()").is_empty());
+    assert!(query("SELECT * FROM users").is_empty());
+}
+
+#[test]
+fn test_url_arguments() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let fetch = |url: &str| patterns(&analyzer, &call("fetch", json!({ "url": url })));
+
+    assert_eq!(
+        fetch("http://169.254.169.254/latest/meta-data/iam/"),
+        vec!["cloud_metadata_url_argument"]
+    );
+    for internal in [
+        "http://127.0.0.1:8080/admin",
+        "http://10.1.2.3/",
+        "https://192.168.0.10/",
+        "http://[::1]/",
+        "http://localhost:3000",
+        "http://db.internal/",
+    ] {
+        assert_eq!(
+            fetch(internal),
+            vec!["internal_url_argument"],
+            "{}",
+            internal
+        );
+    }
+    assert!(fetch("https://example.com/docs").is_empty());
+    assert!(fetch("not a url").is_empty());
+}
+
+#[test]
+fn test_text_arguments_no_longer_trip_path_and_sql_patterns() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let schema = json!({
+        "type": "object",
+        "properties": {
+            "title": {"type": "string"},
+            "body": {"type": "string"}
+        }
+    });
+    let content = call(
+        "create_issue",
+        json!({
+            "title": "Docs",
+            "body": "Explain why /etc/passwd is readable and when to DROP TABLE"
+        }),
+    );
+
+    // Without the schema the payload patterns still apply
+    let unknown = analyzer.analyze(Some("tools/call"), &content);
+    assert!(unknown
+        .matched_patterns
+        .contains(&"sensitive_path".to_string()));
+
+    // With it, km knows neither argument is a path or SQL
+    let known = analyzer.analyze_with_schemas(Some("tools/call"), &content, |tool| {
+        (tool == "create_issue").then(|| schema.clone())
+    });
+    assert!(known.matched_patterns.is_empty());
+    assert_eq!(known.level, RiskLevel::Low);
+    assert!(known.explanation.categories.is_empty());
+}
+
+#[test]
+fn test_argument_rules_replace_the_payload_pattern_they_cover() {
+    let analyzer = PatternRiskAnalyzer::new();
+    let assessment = analyzer.analyze(
+        Some("tools/call"),
+        &call("read_file", json!({"options": {"path": "/etc/passwd"}})),
+    );
+    assert_eq!(assessment.matched_patterns, vec!["sensitive_path_argument"]);
+    let contribution = &assessment.explanation.contributions[0];
+    assert_eq!(contribution.argument.as_deref(), Some("options.path"));
+    assert!((assessment.score - 0.6).abs() < 1e-6);
+    assert_eq!(
+        assessment.explanation.lines()[1],
+        "  +0.40  sensitive_path_argument (sensitive_data) in `options.path`"
+    );
+
+    // Responses and other methods are left to the payload patterns
+    let response = analyzer.analyze(
+        Some("tools/call"),
+        r#"{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"/etc/passwd"}]}}"#,
+    );
+    assert_eq!(response.matched_patterns, vec!["sensitive_path"]);
+}
+
+#[test]
+fn test_heuristics_skip_signals_an_argument_rule_covers() {
+    let heuristic = HeuristicRiskAnalyzer::new(PatternRiskAnalyzer::new());
+    let assessment = heuristic.analyze(
+        Some("tools/call"),
+        &call("read_file", json!({"path": "../../../etc/hosts"})),
+    );
+    assert!(assessment
+        .matched_patterns
+        .contains(&"path_traversal_argument".to_string()));
+    assert!(!assessment
+        .matched_patterns
+        .contains(&"path_traversal".to_string()));
+}
@@ -0,0 +1,109 @@
+use km::build_info;
+use km::schema::{self, Kind, EVENT};
+use km::uploader::McpEvent;
+use serde_json::json;
+
+#[test]
+fn test_protobuf_encoding() {
+    // Field 1 (events), length 3: field 1 (id), length 1, "a"
+    let body =
+        schema::encode_batch(schema::EVENTS_PROTOBUF, &json!({"events": [{"id": "a"}]})).unwrap();
+    assert_eq!(body, vec![0x0a, 0x03, 0x0a, 0x01, b'a']);
+
+    let body = schema::encode_batch(schema::EVENTS_JSON, &json!({"events": []})).unwrap();
+    assert_eq!(body, br#"{"events":[]}"#);
+    assert_eq!(
+        schema::content_type(schema::EVENTS_PROTOBUF),
+        "application/x-protobuf"
+    );
+}
+
+#[test]
+fn test_protobuf_round_trip() {
+    let batch = json!({
+        "events": [
+            {
+                "id": "e1",
+                "session_id": "s1",
+                "timestamp": "2025-03-01T12:00:00.123456Z",
+                "direction": "response",
+                "method": "tools/call",
+                "rpc_id": "req-1",
+                "duration_ms": 12.5,
+                "payload_size": 300,
+                "payload": {"jsonrpc": "2.0", "result": {"content": []}},
+                "payload_sha256": "ab",
+                "payload_truncated": true,
+                "payload_uri": "file:///tmp/blob",
+                "metadata": {"risk": {"score": 0.4, "level": "medium"}, "sample_rate": 0.1},
+                "labels": {"env": "ci"}
+            },
+            {"id": "e2", "session_id": "s1", "payload_size": 0, "payload": "plain text"}
+        ],
+        "metadata": {
+            "client": schema::client_metadata(),
+            "latency": [{
+                "method": "tools/call", "count": 2, "sum_ms": 42.0, "min_ms": 12.5,
+                "p50_ms": 12.5, "p90_ms": 29.5, "p99_ms": 29.5, "max_ms": 29.5,
+                "buckets": [{"le_ms": 1.0, "count": 0}, {"le_ms": 25.0, "count": 1}]
+            }]
+        }
+    });
+    let body = schema::encode_batch(schema::EVENTS_PROTOBUF, &batch).unwrap();
+    assert!(body.len() < batch.to_string().len());
+    assert_eq!(schema::decode_batch(&body).unwrap(), batch);
+}
+
+#[test]
+fn test_schema_covers_every_event_field() {
+    let mut event = McpEvent::new(
+        "s1",
+        "request",
+        r#"{"jsonrpc":"2.0","id":1,"method":"ping"}"#,
+        Some("ping".to_string()),
+        Some(1.5),
+        None,
+    );
+    event.payload_sha256 = Some("ab".to_string());
+    event.payload_truncated = true;
+    event.payload_uri = Some("file:///tmp/blob".to_string());
+    event.metadata.insert("recovered".to_string(), json!(true));
+    event.labels.insert("env".to_string(), "ci".to_string());
+
+    let value = serde_json::to_value(&event).unwrap();
+    for key in value.as_object().unwrap().keys() {
+        assert!(
+            EVENT.fields.iter().any(|field| field.name == key),
+            "McpEvent field {} is missing from the schema",
+            key
+        );
+    }
+    assert!(EVENT
+        .fields
+        .iter()
+        .any(|field| field.name == "payload" && matches!(field.kind, Kind::Json)));
+}
+
+#[test]
+fn test_documented_proto_matches_the_schema() {
+    let docs =
+        std::fs::read_to_string(concat!(env!("CARGO_MANIFEST_DIR"), "/API_ENDPOINTS.md")).unwrap();
+    assert!(
+        docs.contains(&schema::proto()),
+        "API_ENDPOINTS.md is out of date; paste in schema::proto():\n{}",
+        schema::proto()
+    );
+}
+
+#[test]
+fn test_client_metadata() {
+    let client = schema::client_metadata();
+    assert_eq!(client["name"], "km");
+    assert_eq!(client["version"], build_info::VERSION);
+    assert!(!client["commit"].as_str().unwrap().is_empty());
+    assert_eq!(
+        client["build_date"].as_str().unwrap().len(),
+        "2026-10-15".len()
+    );
+    assert_eq!(client["target"], build_info::TARGET);
+}
@@ -0,0 +1,219 @@
+use chrono::{DateTime, Duration, Utc};
+use km::risk::RiskLevel;
+use km::search::{self, Query};
+use km::traffic::TrafficEntry;
+use serde_json::json;
+
+fn at(minutes: i64) -> DateTime<Utc> {
+    DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+        .unwrap()
+        .with_timezone(&Utc)
+        + Duration::minutes(minutes)
+}
+
+fn entry(session: &str, minutes: i64, direction: &str, content: serde_json::Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(minutes),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn sample() -> Vec<TrafficEntry> {
+    let mut labelled = entry(
+        "def-2",
+        10,
+        "request",
+        json!({"jsonrpc": "2.0", "id": 1, "method": "resources/list"}),
+    );
+    labelled
+        .labels
+        .insert("env".to_string(), "prod".to_string());
+    vec![
+        entry(
+            "abc-1",
+            0,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+                   "params": {"name": "sql", "arguments": {"query": "DROP TABLE users"}}}),
+        ),
+        entry(
+            "abc-1",
+            1,
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {"content": "ok"}}),
+        ),
+        entry(
+            "abc-1",
+            2,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/list"}),
+        ),
+        labelled,
+    ]
+}
+
+fn matching(query: &str) -> Vec<(String, String)> {
+    let query = Query::parse(query).unwrap();
+    search::search(&sample(), &query)
+        .into_iter()
+        .map(|hit| (hit.method.unwrap_or_default(), hit.direction))
+        .collect()
+}
+
+fn pair(method: &str, direction: &str) -> (String, String) {
+    (method.to_string(), direction.to_string())
+}
+
+#[test]
+fn test_search_example_query() {
+    let hits = search::search(
+        &sample(),
+        &Query::parse(r#"method:tools/call AND risk>=high AND payload~"DROP TABLE""#).unwrap(),
+    );
+    assert_eq!(hits.len(), 1);
+    assert_eq!(hits[0].risk, RiskLevel::High);
+    assert_eq!(hits[0].session_id.as_deref(), Some("abc-1"));
+}
+
+#[test]
+fn test_search_method_globs_and_direction() {
+    assert_eq!(
+        matching("method:tools/*"),
+        vec![
+            pair("tools/call", "request"),
+            pair("tools/call", "response"),
+            pair("tools/list", "request"),
+        ]
+    );
+    assert_eq!(
+        matching("method:tools/* direction:response"),
+        vec![pair("tools/call", "response")]
+    );
+    assert_eq!(
+        matching("method!=tools/*"),
+        vec![pair("resources/list", "request")]
+    );
+    assert_eq!(
+        matching(r#"method~"^tools/(list|read)$""#),
+        vec![pair("tools/list", "request")]
+    );
+}
+
+#[test]
+fn test_search_boolean_operators_and_grouping() {
+    assert_eq!(
+        matching("method:tools/list OR method:resources/list"),
+        vec![
+            pair("tools/list", "request"),
+            pair("resources/list", "request")
+        ]
+    );
+    assert_eq!(
+        matching("NOT (method:tools/* OR session:def)"),
+        Vec::<(String, String)>::new()
+    );
+    assert_eq!(
+        matching("dir:req AND NOT (method:tools/list OR label:env=prod)"),
+        vec![pair("tools/call", "request")]
+    );
+}
+
+#[test]
+fn test_search_time_ranges_risk_and_payload() {
+    assert_eq!(
+        matching("time>=2025-01-31T10:02:00Z").len(),
+        2,
+        "time bounds are inclusive"
+    );
+    assert_eq!(
+        matching("since:2025-01-31T10:01:00Z until:2025-01-31T10:02:00Z"),
+        vec![
+            pair("tools/call", "response"),
+            pair("tools/list", "request")
+        ]
+    );
+    assert_eq!(matching("risk:low").len(), 3);
+    assert_eq!(matching("risk>medium"), vec![pair("tools/call", "request")]);
+    // Bare words and payload: search case-insensitively
+    assert_eq!(matching("drop"), vec![pair("tools/call", "request")]);
+    assert_eq!(
+        matching(r#"payload:"drop table""#),
+        vec![pair("tools/call", "request")]
+    );
+    assert_eq!(matching(r#"payload~"drop table""#).len(), 0);
+    assert_eq!(matching("").len(), 4, "an empty query matches everything");
+}
+
+#[test]
+fn test_search_call_status_and_duration() {
+    let mut ok = entry(
+        "abc-1",
+        1,
+        "response",
+        json!({"jsonrpc": "2.0", "id": 1, "result": {}}),
+    );
+    ok.status = Some("success".to_string());
+    ok.duration_ms = Some(40.0);
+    let mut failed = entry(
+        "abc-1",
+        3,
+        "response",
+        json!({"jsonrpc": "2.0", "id": 2, "error": {"code": -32601, "message": "nope"}}),
+    );
+    failed.status = Some("error".to_string());
+    failed.error_code = Some(-32601);
+    failed.duration_ms = Some(2500.0);
+    let entries = vec![ok, failed];
+    let count = |query: &str| search::search(&entries, &Query::parse(query).unwrap()).len();
+
+    assert_eq!(count("status:error"), 1);
+    assert_eq!(count("status!=error"), 1);
+    assert_eq!(count("duration>2s"), 1);
+    assert_eq!(count("duration<=40ms"), 1);
+    assert_eq!(count("duration>=40"), 2);
+    assert_eq!(count("status:success AND duration>1s"), 0);
+}
+
+#[test]
+fn test_search_query_errors() {
+    for (query, expected) in [
+        ("colour:red", "Unknown field 'colour'"),
+        ("risk>=extreme", "Unknown risk level"),
+        ("method>tools/call", "'method' can't be compared with '>'"),
+        ("(method:tools/call", "Missing ')'"),
+        ("method:tools/call)", "Unexpected ')'"),
+        ("method:tools/call AND", "search term was expected"),
+        (r#"payload:"unterminated"#, "Unterminated quote"),
+        (r#"payload~"(""#, "Invalid regex"),
+        ("direction:sideways", "Unknown direction"),
+        ("status:pending", "Unknown status"),
+        ("duration>soon", "not a duration"),
+        ("status>error", "'status' can't be compared with '>'"),
+    ] {
+        let err = format!("{:#}", Query::parse(query).unwrap_err());
+        assert!(err.contains(expected), "{}: {}", query, err);
+    }
+}
+
+#[test]
+fn test_render_search_hits() {
+    let hits = search::search(&sample(), &Query::parse("session:abc").unwrap());
+    let lines = search::render(&hits);
+    assert_eq!(lines.len(), 4);
+    assert!(lines[0].starts_with("TIME"));
+    assert!(lines[1].contains("abc-1") && lines[1].contains("tools/call"));
+    assert!(lines[1].contains("high"));
+    assert!(
+        lines[1].ends_with('…'),
+        "long payloads are cut: {}",
+        lines[1]
+    );
+}
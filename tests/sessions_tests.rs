@@ -0,0 +1,178 @@
+use chrono::{DateTime, Duration, Utc};
+use km::sessions;
+use km::traffic::{self, TrafficEntry};
+use serde_json::json;
+
+fn at(minutes: i64) -> DateTime<Utc> {
+    DateTime::parse_from_rfc3339("2025-01-31T10:00:00Z")
+        .unwrap()
+        .with_timezone(&Utc)
+        + Duration::minutes(minutes)
+}
+
+fn entry(session: &str, minutes: i64, direction: &str, content: serde_json::Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: at(minutes),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some(session.to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn sample() -> Vec<TrafficEntry> {
+    vec![
+        entry(
+            "abc-1",
+            0,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize"}),
+        ),
+        entry(
+            "abc-1",
+            0,
+            "response",
+            json!({"jsonrpc": "2.0", "id": 1, "result": {"serverInfo": {"name": "files"}}}),
+        ),
+        entry(
+            "abc-1",
+            5,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/call", "params": {"name": "read_file"}}),
+        ),
+        entry(
+            "abc-1",
+            6,
+            "response",
+            json!({"jsonrpc": "2.0", "id": 2, "error": {"code": -32000, "message": "denied"}}),
+        ),
+        entry(
+            "abd-2",
+            60,
+            "request",
+            json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}),
+        ),
+    ]
+}
+
+#[test]
+fn test_summarize_sessions_most_recent_first() {
+    let summaries = sessions::summarize(&sample());
+
+    assert_eq!(summaries.len(), 2);
+    assert_eq!(summaries[0].id, "abd-2");
+
+    let first = &summaries[1];
+    assert_eq!(first.started, at(0));
+    assert_eq!(first.ended, at(6));
+    assert_eq!(first.duration_secs(), 360);
+    assert_eq!(first.server.as_deref(), Some("files"));
+    assert_eq!(first.messages, 4);
+    assert_eq!(first.requests, 2);
+    assert_eq!(first.errors, 1);
+    assert_eq!(first.methods.get("tools/call"), Some(&1));
+    assert_eq!(first.tools.get("read_file"), Some(&1));
+}
+
+#[test]
+fn test_resolve_by_unique_prefix() {
+    let summaries = sessions::summarize(&sample());
+
+    assert_eq!(sessions::resolve(&summaries, "abc").unwrap().id, "abc-1");
+    assert_eq!(sessions::resolve(&summaries, "abd-2").unwrap().id, "abd-2");
+
+    let ambiguous = sessions::resolve(&summaries, "ab").unwrap_err();
+    assert!(ambiguous.to_string().contains("matches 2 sessions"));
+    assert!(sessions::resolve(&summaries, "zzz").is_err());
+}
+
+#[test]
+fn test_events_filter_by_method_includes_responses() {
+    let records = sessions::events(&sample(), "abc-1", Some("tools/*"));
+
+    assert_eq!(records.len(), 2);
+    assert_eq!(records[0].direction, "request");
+    assert_eq!(records[1].direction, "response");
+    assert!(records
+        .iter()
+        .all(|r| r.method.as_deref() == Some("tools/call")));
+
+    assert_eq!(sessions::events(&sample(), "abc-1", None).len(), 4);
+}
+
+#[test]
+fn test_since_keeps_sessions_active_after_bound() {
+    let summaries = sessions::since(sessions::summarize(&sample()), at(30));
+
+    assert_eq!(summaries.len(), 1);
+    assert_eq!(summaries[0].id, "abd-2");
+}
+
+#[test]
+fn test_render_list_and_summary() {
+    let summaries = sessions::summarize(&sample());
+
+    let list = sessions::render_list(&summaries);
+    assert_eq!(list.len(), 3);
+    assert!(list[0].starts_with("SESSION"));
+    assert!(list[2].contains("abc-1") && list[2].contains("6m00s") && list[2].contains("files"));
+
+    let summary = sessions::render_summary(&summaries[1]);
+    assert!(summary.iter().any(|l| l.contains("Server:   files")));
+    assert!(summary.iter().any(|l| l == "Tools"));
+    assert!(summary.iter().any(|l| l.contains("read_file")));
+}
+
+#[test]
+fn test_labels_are_summarized_and_filtered() {
+    let mut entries = sample();
+    for entry in entries
+        .iter_mut()
+        .filter(|e| e.session_id.as_deref() == Some("abc-1"))
+    {
+        entry.labels = [("team", "payments"), ("env", "ci")]
+            .into_iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect();
+    }
+    let summaries = sessions::summarize(&entries);
+    let labelled = summaries.iter().find(|s| s.id == "abc-1").unwrap();
+    assert_eq!(labelled.labels["team"], "payments");
+    assert!(
+        sessions::render_summary(labelled).contains(&"Labels:   env=ci, team=payments".to_string())
+    );
+
+    let wanted = vec![traffic::parse_label("team=payments").unwrap()];
+    let matching: Vec<_> = summaries
+        .iter()
+        .filter(|s| traffic::has_labels(&s.labels, &wanted))
+        .map(|s| s.id.as_str())
+        .collect();
+    assert_eq!(matching, vec!["abc-1"]);
+    let other = vec![traffic::parse_label("team=search").unwrap()];
+    assert!(!traffic::has_labels(&labelled.labels, &other));
+
+    // Unlabelled sessions don't print or serialize labels
+    let plain = summaries.iter().find(|s| s.id == "abd-2").unwrap();
+    assert!(serde_json::to_value(plain).unwrap().get("labels").is_none());
+}
+
+#[test]
+fn test_parse_label() {
+    assert_eq!(
+        traffic::parse_label("env=").unwrap(),
+        ("env".to_string(), String::new())
+    );
+    assert_eq!(
+        traffic::parse_label("k8s.io/app=a=b").unwrap(),
+        ("k8s.io/app".to_string(), "a=b".to_string())
+    );
+    assert!(traffic::parse_label("team").is_err());
+    assert!(traffic::parse_label("=x").is_err());
+    assert!(traffic::parse_label("my team=x").is_err());
+}
@@ -0,0 +1,167 @@
+use km::config::Config;
+use km::payloads::{S3Credentials, S3Uploader};
+use km::sinks::{EventSink, FileSink, KafkaSink, S3Sink, SinkConfig, Sinks, WebhookSink};
+use serde_json::{json, Value};
+use std::sync::Arc;
+use tempfile::TempDir;
+use wiremock::matchers::{header, method, path};
+use wiremock::{Mock, MockServer, ResponseTemplate};
+
+fn batch() -> Value {
+    json!({"events": [
+        {"id": "e1", "session_id": "s1", "direction": "request"},
+        {"id": "e2", "session_id": "s1", "direction": "response"}
+    ]})
+}
+
+#[test]
+fn test_sinks_config() {
+    let config: Config = serde_json::from_value(json!({
+        "api_key": "key",
+        "api_url": "http://localhost:5194",
+        "sinks": [
+            {"type": "file", "path": "/var/log/km/events.jsonl"},
+            {"type": "s3", "url": "https://s3.us-east-1.amazonaws.com/lake/mcp"},
+            {"type": "kafka", "url": "http://kafka-rest:8082", "topic": "mcp-events"},
+            {"type": "webhook", "url": "https://hooks.example.com/km",
+             "headers": {"authorization": "Bearer secret"}}
+        ]
+    }))
+    .unwrap();
+    assert_eq!(config.sinks.len(), 4);
+    assert_eq!(
+        config.sinks[2],
+        SinkConfig::Kafka {
+            url: "http://kafka-rest:8082".to_string(),
+            topic: "mcp-events".to_string(),
+        }
+    );
+    assert!(config.sinks.iter().all(|sink| sink.validate().is_ok()));
+
+    let bad = [
+        json!({"type": "file", "path": ""}),
+        json!({"type": "s3", "url": "s3://lake"}),
+        json!({"type": "kafka", "url": "http://kafka-rest:8082", "topic": " "}),
+        json!({"type": "webhook", "url": "hooks.example.com"}),
+        json!({"type": "webhook", "url": "https://hooks.example.com", "headers": {"bad header": "x"}}),
+    ];
+    for sink in bad {
+        let sink: SinkConfig = serde_json::from_value(sink.clone()).unwrap();
+        assert!(sink.validate().is_err(), "{:?} should be invalid", sink);
+    }
+    assert!(serde_json::from_value::<SinkConfig>(json!({"type": "ftp", "url": "x"})).is_err());
+
+    let mut config = config;
+    config.sinks.push(SinkConfig::Kafka {
+        url: "kafka-rest:8082".to_string(),
+        topic: "mcp-events".to_string(),
+    });
+    assert!(config.validate().iter().any(|p| p.starts_with("sinks")));
+}
+
+#[tokio::test]
+async fn test_file_sink_appends_json_lines() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("lake").join("events.jsonl");
+    let sink = FileSink::new(path.clone());
+
+    sink.send(&batch()).await.unwrap();
+    sink.send(&json!({"events": [{"id": "e3"}]})).await.unwrap();
+
+    let lines: Vec<Value> = std::fs::read_to_string(&path)
+        .unwrap()
+        .lines()
+        .map(|line| serde_json::from_str(line).unwrap())
+        .collect();
+    let ids: Vec<&str> = lines.iter().map(|e| e["id"].as_str().unwrap()).collect();
+    assert_eq!(ids, vec!["e1", "e2", "e3"]);
+}
+
+#[tokio::test]
+async fn test_webhook_and_kafka_sinks() {
+    let mock_server = MockServer::start().await;
+    Mock::given(method("POST"))
+        .and(path("/hook"))
+        .and(header("x-team", "payments"))
+        .respond_with(ResponseTemplate::new(200))
+        .mount(&mock_server)
+        .await;
+    Mock::given(method("POST"))
+        .and(path("/topics/mcp-events"))
+        .and(header("content-type", "application/vnd.kafka.json.v2+json"))
+        .respond_with(ResponseTemplate::new(200))
+        .mount(&mock_server)
+        .await;
+
+    let webhook = WebhookSink::new(
+        &format!("{}/hook", mock_server.uri()),
+        [("x-team".to_string(), "payments".to_string())].into(),
+    );
+    webhook.send(&batch()).await.unwrap();
+    let kafka = KafkaSink::new(&mock_server.uri(), "mcp-events");
+    assert_eq!(kafka.name(), "kafka:mcp-events");
+    kafka.send(&batch()).await.unwrap();
+
+    let requests = mock_server.received_requests().await.unwrap();
+    assert_eq!(requests.len(), 2);
+    let hook: Value = serde_json::from_slice(&requests[0].body).unwrap();
+    assert_eq!(hook, batch());
+    let records: Value = serde_json::from_slice(&requests[1].body).unwrap();
+    assert_eq!(records["records"].as_array().unwrap().len(), 2);
+    assert_eq!(records["records"][0]["key"], "s1");
+    assert_eq!(records["records"][1]["value"]["id"], "e2");
+}
+
+#[tokio::test]
+async fn test_s3_sink_writes_one_object_per_batch() {
+    let mock_server = MockServer::start().await;
+    Mock::given(method("PUT"))
+        .respond_with(ResponseTemplate::new(200))
+        .mount(&mock_server)
+        .await;
+    let credentials = S3Credentials {
+        access_key_id: "AKIDEXAMPLE".to_string(),
+        secret_access_key: "secret".to_string(),
+        session_token: None,
+    };
+    let sink = S3Sink::new(
+        &format!("{}/lake/mcp", mock_server.uri()),
+        S3Uploader::new("us-east-1", credentials),
+    )
+    .unwrap();
+
+    // A retry lands on the same object
+    sink.send(&batch()).await.unwrap();
+    sink.send(&batch()).await.unwrap();
+
+    let requests = mock_server.received_requests().await.unwrap();
+    assert_eq!(requests.len(), 2);
+    assert_eq!(requests[0].url.path(), requests[1].url.path());
+    let object = requests[0].url.path();
+    assert!(object.starts_with("/lake/mcp/dt="), "{}", object);
+    assert!(object.ends_with(".jsonl"), "{}", object);
+    assert!(requests[0].headers.contains_key("authorization"));
+    assert_eq!(
+        String::from_utf8_lossy(&requests[0].body).lines().count(),
+        2
+    );
+}
+
+#[tokio::test]
+async fn test_fan_out_survives_a_failing_sink() {
+    let temp_dir = TempDir::new().unwrap();
+    let path = temp_dir.path().join("events.jsonl");
+    let mock_server = MockServer::start().await;
+    Mock::given(method("POST"))
+        .respond_with(ResponseTemplate::new(500))
+        .mount(&mock_server)
+        .await;
+    let failing = format!("{}/hook", mock_server.uri());
+
+    let sinks = Sinks::new(vec![
+        Arc::new(WebhookSink::new(&failing, Default::default())),
+        Arc::new(FileSink::new(path.clone())),
+    ]);
+    assert_eq!(sinks.send(&batch()).await, vec![failing]);
+    assert_eq!(std::fs::read_to_string(&path).unwrap().lines().count(), 2);
+}
@@ -0,0 +1,227 @@
+use km::idempotency::{self, SentBatches};
+use km::spool::Spool;
+use serde_json::json;
+use std::sync::Arc;
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering every request with `status`.
+async fn serve_status(status: u16) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 64 * 1024];
+            let _ = socket.read(&mut buf).await;
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                status
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}/api/events/telemetry", addr)
+}
+
+/// Minimal HTTP server accepting requests made with `token` and answering
+/// 401 to any other.
+async fn serve_token(token: &'static str) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 64 * 1024];
+            let n = socket.read(&mut buf).await.unwrap_or(0);
+            let request = String::from_utf8_lossy(&buf[..n]).to_lowercase();
+            let status = if request.contains(&format!("authorization: bearer {}", token)) {
+                "200 OK"
+            } else {
+                "401 Unauthorized"
+            };
+            let response = format!(
+                "HTTP/1.1 {}\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                status
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}/api/events/telemetry", addr)
+}
+
+/// Minimal HTTP server answering every request with 429 and `Retry-After`.
+async fn serve_throttled(retry_after: &'static str) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 64 * 1024];
+            let _ = socket.read(&mut buf).await;
+            let response = format!(
+                "HTTP/1.1 429 Too Many Requests\r\nretry-after: {}\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                retry_after
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    format!("http://{}/api/events/telemetry", addr)
+}
+
+#[test]
+fn test_enqueue_and_pending_preserve_order() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().join("spool"));
+
+    assert_eq!(spool.count().unwrap(), 0);
+
+    let first = spool
+        .enqueue("http://localhost/api", &json!({"n": 1}))
+        .unwrap();
+    std::thread::sleep(std::time::Duration::from_millis(2));
+    spool
+        .enqueue("http://localhost/api", &json!({"n": 2}))
+        .unwrap();
+
+    let pending = spool.pending().unwrap();
+    assert_eq!(pending.len(), 2);
+    assert_eq!(pending[0].id, first.id);
+    assert_eq!(pending[0].payload, json!({"n": 1}));
+    assert_eq!(pending[1].payload, json!({"n": 2}));
+
+    spool.remove(&first.id).unwrap();
+    assert_eq!(spool.count().unwrap(), 1);
+}
+
+#[test]
+fn test_pending_skips_corrupt_files() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+
+    spool.enqueue("http://localhost/api", &json!({})).unwrap();
+    std::fs::write(temp_dir.path().join("0-broken.json"), "not json").unwrap();
+
+    assert_eq!(spool.pending().unwrap().len(), 1);
+}
+
+#[tokio::test]
+async fn test_flush_uploads_and_removes_batches() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let endpoint = serve_status(200).await;
+
+    spool.enqueue(&endpoint, &json!({"n": 1})).unwrap();
+    spool.enqueue(&endpoint, &json!({"n": 2})).unwrap();
+
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+
+    assert_eq!(report.sent, 2);
+    assert_eq!(report.remaining, 0);
+    assert_eq!(spool.count().unwrap(), 0);
+}
+
+#[tokio::test]
+async fn test_flush_keeps_batches_when_server_unavailable() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let endpoint = serve_status(503).await;
+
+    spool.enqueue(&endpoint, &json!({"n": 1})).unwrap();
+    spool.enqueue(&endpoint, &json!({"n": 2})).unwrap();
+
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+
+    assert_eq!(report.sent, 0);
+    assert_eq!(report.remaining, 2);
+
+    let pending = spool.pending().unwrap();
+    assert_eq!(pending.len(), 2);
+    assert_eq!(pending[0].attempts, 1);
+}
+
+#[tokio::test]
+async fn test_flush_keeps_batches_until_the_token_is_accepted() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let endpoint = serve_token("fresh").await;
+
+    spool.enqueue(&endpoint, &json!({"n": 1})).unwrap();
+    spool.enqueue(&endpoint, &json!({"n": 2})).unwrap();
+
+    // An expired token says nothing about the batches: keep them all
+    let report = spool
+        .flush(&reqwest::Client::new(), "expired")
+        .await
+        .unwrap();
+    assert_eq!((report.sent, report.rejected, report.remaining), (0, 0, 2));
+    assert_eq!(spool.count().unwrap(), 2);
+
+    let report = spool.flush(&reqwest::Client::new(), "fresh").await.unwrap();
+    assert_eq!((report.sent, report.remaining), (2, 0));
+    assert_eq!(spool.count().unwrap(), 0);
+}
+
+#[tokio::test]
+async fn test_flush_reports_retry_after() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let endpoint = serve_throttled("120").await;
+
+    spool.enqueue(&endpoint, &json!({"n": 1})).unwrap();
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+
+    assert_eq!(report.sent, 0);
+    assert_eq!(report.remaining, 1);
+    assert_eq!(report.retry_after_secs, Some(120));
+    assert_eq!(spool.pending().unwrap()[0].attempts, 1);
+}
+
+#[tokio::test]
+async fn test_flush_skips_batches_already_delivered() {
+    let mock_server = wiremock::MockServer::start().await;
+    wiremock::Mock::given(wiremock::matchers::method("POST"))
+        .respond_with(wiremock::ResponseTemplate::new(200))
+        .mount(&mock_server)
+        .await;
+    let temp_dir = TempDir::new().unwrap();
+    let sent = Arc::new(SentBatches::open(temp_dir.path().join("sent_batches")).unwrap());
+    let spool = Spool::new(temp_dir.path().join("spool")).with_sent_batches(sent.clone());
+    let endpoint = format!("{}/api/events/batch", mock_server.uri());
+    let payload = json!({"events": [{"id": "e1"}]});
+
+    spool.enqueue(&endpoint, &payload).unwrap();
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+    assert_eq!(report.sent, 1);
+
+    // The same batch spooled again, e.g. by a second attempt that timed out
+    spool.enqueue(&endpoint, &payload).unwrap();
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+    assert_eq!((report.sent, report.already_sent), (0, 1));
+    assert!(spool.pending().unwrap().is_empty());
+
+    let requests = mock_server.received_requests().await.unwrap();
+    assert_eq!(requests.len(), 1);
+    assert_eq!(
+        requests[0].headers.get("idempotency-key").unwrap(),
+        idempotency::batch_id(&payload).as_str()
+    );
+}
+
+#[tokio::test]
+async fn test_flush_drops_rejected_batches() {
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let endpoint = serve_status(400).await;
+
+    spool.enqueue(&endpoint, &json!({"bad": true})).unwrap();
+
+    let report = spool.flush(&reqwest::Client::new(), "token").await.unwrap();
+
+    assert_eq!(report.rejected, 1);
+    assert_eq!(spool.count().unwrap(), 0);
+}
@@ -0,0 +1,164 @@
+use km::sinks::{EventSink, SinkConfig, Sinks};
+use km::syslog::{self, SyslogFormat, SyslogProtocol, SyslogSink};
+use serde_json::{json, Value};
+use tokio::io::AsyncReadExt;
+use tokio::net::{TcpListener, UdpSocket};
+
+fn event(level: Option<&str>) -> Value {
+    let mut event = json!({
+        "id": "e1",
+        "session_id": "s1",
+        "timestamp": "2025-03-01T12:00:00Z",
+        "direction": "request",
+        "method": "tools/call",
+        "rpc_id": 7,
+        "payload_size": 42,
+        "payload": {"jsonrpc": "2.0"}
+    });
+    if let Some(level) = level {
+        event["metadata"] = json!({"risk": {
+            "score": 0.72, "level": level, "matched_patterns": ["ssh_key", "a|b=c"]
+        }});
+    }
+    event
+}
+
+#[test]
+fn test_severity_follows_risk_level() {
+    assert_eq!(syslog::severity(&event(Some("critical"))), 2);
+    assert_eq!(syslog::severity(&event(Some("high"))), 3);
+    assert_eq!(syslog::severity(&event(Some("medium"))), 4);
+    assert_eq!(syslog::severity(&event(Some("low"))), 5);
+    assert_eq!(syslog::severity(&event(None)), 6);
+}
+
+#[test]
+fn test_rfc5424_record() {
+    let record = syslog::record(&event(Some("high")), SyslogFormat::Rfc5424, 16, "box");
+    // local0 (16) * 8 + error (3)
+    assert!(
+        record.starts_with("<131>1 2025-03-01T12:00:00.000Z box km "),
+        "{}",
+        record
+    );
+    assert!(record.contains(" tools/call [km@32473 id=\"e1\" session=\"s1\""));
+    assert!(record.contains("rpcId=\"7\""));
+    assert!(record.contains("risk=\"high\" riskScore=\"0.72\" patterns=\"ssh_key,a|b=c\"]"));
+    assert!(record.ends_with("] request tools/call risk=high"));
+}
+
+#[test]
+fn test_cef_and_leef_messages() {
+    let cef = syslog::cef(&event(Some("high")));
+    assert!(cef.starts_with("CEF:0|Kilometers|km|"), "{}", cef);
+    assert!(cef.contains("|tools/call|MCP tools/call|7|"));
+    assert!(cef.contains("cs1=s1 cs1Label=session"));
+    assert!(cef.contains("cs4=ssh_key,a|b\\=c"));
+
+    let leef = syslog::leef(&event(None));
+    assert!(leef.starts_with("LEEF:1.0|Kilometers|km|"), "{}", leef);
+    assert!(leef.contains("|tools/call|devTime=2025-03-01T12:00:00.000Z\t"));
+    assert!(leef.contains("\tsev=1\t"));
+    assert!(leef.contains("\tsession=s1\t"));
+
+    let record = syslog::record(&event(None), SyslogFormat::Cef, 1, "box");
+    assert!(record.starts_with("<14>1 "));
+    assert!(record.contains(" - CEF:0|"));
+}
+
+#[test]
+fn test_journal_entry() {
+    let mut event = event(Some("medium"));
+    event["method"] = json!("line one\nline two");
+    let entry = syslog::journal_entry(&event);
+    let text = String::from_utf8_lossy(&entry);
+    assert!(text.starts_with("MESSAGE"));
+    assert!(text.contains("PRIORITY=4\n"));
+    assert!(text.contains("SYSLOG_IDENTIFIER=km\n"));
+    assert!(text.contains("KM_SESSION=s1\n"));
+    assert!(text.contains("KM_RPC_ID=7\n"));
+    // Multi-line values are length-prefixed
+    let mut method = b"KM_METHOD\n".to_vec();
+    method.extend(17u64.to_le_bytes());
+    method.extend(b"line one\nline two\n");
+    assert!(entry.windows(method.len()).any(|w| w == method.as_slice()));
+}
+
+#[test]
+fn test_syslog_sink_config() {
+    let sink: SinkConfig = serde_json::from_value(json!({
+        "type": "syslog", "address": "siem.example.com:6514", "protocol": "tls", "format": "cef"
+    }))
+    .unwrap();
+    assert_eq!(
+        sink,
+        SinkConfig::Syslog {
+            address: "siem.example.com:6514".to_string(),
+            protocol: SyslogProtocol::Tls,
+            format: SyslogFormat::Cef,
+            facility: None,
+            ca_file: None,
+        }
+    );
+    assert!(sink.validate().is_ok());
+
+    for bad in [
+        json!({"type": "syslog", "address": "siem.example.com"}),
+        json!({"type": "syslog", "address": "siem:514", "facility": 24}),
+        json!({"type": "syslog", "address": "siem:514", "ca_file": "/etc/ca.pem"}),
+    ] {
+        let sink: SinkConfig = serde_json::from_value(bad).unwrap();
+        assert!(sink.validate().is_err(), "{:?} should be invalid", sink);
+    }
+    let journald: SinkConfig = serde_json::from_value(json!({"type": "journald"})).unwrap();
+    assert_eq!(journald, SinkConfig::Journald);
+}
+
+#[tokio::test]
+async fn test_syslog_sink_over_udp() {
+    let collector = UdpSocket::bind("127.0.0.1:0").await.unwrap();
+    let address = collector.local_addr().unwrap().to_string();
+    let sinks = Sinks::from_config(&[SinkConfig::Syslog {
+        address,
+        protocol: SyslogProtocol::Udp,
+        format: SyslogFormat::Rfc5424,
+        facility: None,
+        ca_file: None,
+    }])
+    .unwrap();
+
+    let failed = sinks
+        .send(&json!({"events": [event(Some("critical")), event(None)]}))
+        .await;
+    assert!(failed.is_empty());
+
+    let mut buf = [0u8; 4096];
+    let len = collector.recv(&mut buf).await.unwrap();
+    assert!(String::from_utf8_lossy(&buf[..len]).starts_with("<130>1 "));
+    let len = collector.recv(&mut buf).await.unwrap();
+    assert!(String::from_utf8_lossy(&buf[..len]).starts_with("<134>1 "));
+}
+
+#[tokio::test]
+async fn test_syslog_sink_frames_tcp_records() {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let address = listener.local_addr().unwrap().to_string();
+    let sink = SyslogSink::new(
+        &address,
+        SyslogProtocol::Tcp,
+        SyslogFormat::Leef,
+        syslog::DEFAULT_FACILITY,
+        None,
+    )
+    .unwrap();
+
+    sink.send(&json!({"events": [event(None)]})).await.unwrap();
+    drop(sink);
+
+    let (mut stream, _) = listener.accept().await.unwrap();
+    let mut received = String::new();
+    stream.read_to_string(&mut received).await.unwrap();
+    let (len, record) = received.split_once(' ').unwrap();
+    assert_eq!(len.parse::<usize>().unwrap(), record.len());
+    assert!(record.contains(" - LEEF:1.0|"));
+}
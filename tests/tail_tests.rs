@@ -0,0 +1,152 @@
+use chrono::{DateTime, Utc};
+use km::tail::{self, TailPrinter, TailServer};
+use km::traffic::TrafficEntry;
+use serde_json::json;
+use std::time::{Duration, Instant};
+use tempfile::TempDir;
+
+fn entry(direction: &str, content: serde_json::Value) -> TrafficEntry {
+    TrafficEntry {
+        timestamp: DateTime::parse_from_rfc3339("2025-01-31T10:00:00.250Z")
+            .unwrap()
+            .with_timezone(&Utc),
+        direction: direction.to_string(),
+        content: content.to_string(),
+        duration_ms: None,
+        status: None,
+        error_code: None,
+        elapsed_ms: None,
+        session_id: Some("session-1".to_string()),
+        metadata: Default::default(),
+        labels: Default::default(),
+    }
+}
+
+fn wait_for_subscribers(server: &TailServer, count: usize) {
+    let deadline = Instant::now() + Duration::from_secs(5);
+    while server.subscriber_count() < count {
+        assert!(Instant::now() < deadline, "client never subscribed");
+        std::thread::sleep(Duration::from_millis(10));
+    }
+}
+
+#[test]
+fn test_tail_streams_events_until_the_session_ends() {
+    let dir = TempDir::new().unwrap();
+    let server = TailServer::start(dir.path(), "session-1").unwrap();
+
+    let endpoints = tail::running(dir.path());
+    assert_eq!(endpoints.len(), 1);
+    assert_eq!(endpoints[0].session_id, "session-1");
+    assert_eq!(endpoints[0].pid, std::process::id());
+
+    let endpoint = tail::resolve(&endpoints, Some("sess")).unwrap();
+    let mut events = tail::subscribe(endpoint).unwrap();
+    wait_for_subscribers(&server, 1);
+
+    server.publish(&entry(
+        "request",
+        json!({"jsonrpc": "2.0", "id": 1, "method": "tools/list"}),
+    ));
+    server.publish(&entry(
+        "response",
+        json!({"jsonrpc": "2.0", "id": 1, "result": {"tools": []}}),
+    ));
+
+    let first: TrafficEntry = serde_json::from_str(&events.next().unwrap().unwrap()).unwrap();
+    assert_eq!(first.direction, "request");
+    let second: TrafficEntry = serde_json::from_str(&events.next().unwrap().unwrap()).unwrap();
+    assert_eq!(second.direction, "response");
+
+    drop(server);
+    assert!(events.next().is_none(), "stream ends with the session");
+    assert!(tail::running(dir.path()).is_empty());
+    assert!(std::fs::read_dir(dir.path()).unwrap().next().is_none());
+}
+
+#[test]
+fn test_tail_rejects_clients_without_the_token() {
+    let dir = TempDir::new().unwrap();
+    let server = TailServer::start(dir.path(), "session-1").unwrap();
+    let mut endpoint = tail::running(dir.path()).remove(0);
+    endpoint.token = "wrong".to_string();
+
+    let mut events = tail::subscribe(&endpoint).unwrap();
+    server.publish(&entry(
+        "request",
+        json!({"jsonrpc": "2.0", "method": "ping"}),
+    ));
+    assert!(events.next().is_none());
+    assert_eq!(server.subscriber_count(), 0);
+}
+
+#[test]
+fn test_tail_cleans_up_endpoints_of_finished_sessions() {
+    let dir = TempDir::new().unwrap();
+    let server = TailServer::start(dir.path(), "session-1").unwrap();
+    let stale = tail::running(dir.path()).remove(0);
+    drop(server);
+
+    // A monitor that crashed leaves its endpoint file behind
+    std::fs::write(
+        dir.path().join("session-1.json"),
+        serde_json::to_string(&stale).unwrap(),
+    )
+    .unwrap();
+    assert!(tail::running(dir.path()).is_empty());
+    assert!(!dir.path().join("session-1.json").exists());
+}
+
+#[test]
+fn test_resolve_running_sessions() {
+    let dir = TempDir::new().unwrap();
+    assert!(tail::resolve(&[], None)
+        .unwrap_err()
+        .to_string()
+        .contains("No running km monitor sessions"));
+
+    let _older = TailServer::start(dir.path(), "abc-1").unwrap();
+    std::thread::sleep(Duration::from_millis(5));
+    let _newer = TailServer::start(dir.path(), "abd-2").unwrap();
+    let endpoints = tail::running(dir.path());
+
+    assert_eq!(tail::resolve(&endpoints, None).unwrap().session_id, "abd-2");
+    assert_eq!(
+        tail::resolve(&endpoints, Some("abc")).unwrap().session_id,
+        "abc-1"
+    );
+    assert!(tail::resolve(&endpoints, Some("ab"))
+        .unwrap_err()
+        .to_string()
+        .contains("matches 2 running sessions"));
+    assert!(tail::resolve(&endpoints, Some("zzz"))
+        .unwrap_err()
+        .to_string()
+        .contains("No running session matches 'zzz'"));
+}
+
+#[test]
+fn test_tail_printer_resolves_response_methods() {
+    let mut printer = TailPrinter::new();
+    let request = printer.render(&entry(
+        "request",
+        json!({"jsonrpc": "2.0", "id": 7, "method": "tools/call",
+               "params": {"arguments": {"command": "rm -rf /"}}}),
+    ));
+    assert!(
+        request.starts_with("10:00:00.250 → tools/call"),
+        "{}",
+        request
+    );
+    assert!(request.contains("high"), "{}", request);
+
+    let mut response = entry("response", json!({"jsonrpc": "2.0", "id": 7, "result": {}}));
+    response.duration_ms = Some(12.5);
+    let response = printer.render(&response);
+    assert!(
+        response.starts_with("10:00:00.250 ← tools/call"),
+        "{}",
+        response
+    );
+    assert!(response.contains("12.5ms"), "{}", response);
+}
@@ -0,0 +1,204 @@
+use chrono::{Duration, Utc};
+use clap::CommandFactory;
+use km::cli::Cli;
+use km::telemetry::{self, Outcome, Telemetry, UsageEvent};
+use std::sync::{Arc, Mutex};
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+fn event(command: &str) -> UsageEvent {
+    UsageEvent::new(command, std::time::Duration::from_millis(42), &Ok(()))
+}
+
+/// Minimal HTTP server that keeps the body of every request and answers
+/// with `status`.
+async fn collector(status: u16) -> (String, Arc<Mutex<Vec<String>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let bodies = Arc::new(Mutex::new(Vec::new()));
+    let received = bodies.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            // Read until the whole body is in; headers and body may arrive apart
+            let mut request = Vec::new();
+            let mut buf = vec![0u8; 64 * 1024];
+            loop {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                request.extend_from_slice(&buf[..n]);
+                let text = String::from_utf8_lossy(&request).into_owned();
+                if let Some((headers, body)) = text.split_once("\r\n\r\n") {
+                    let length = headers
+                        .lines()
+                        .find_map(|line| {
+                            let (name, value) = line.split_once(':')?;
+                            name.eq_ignore_ascii_case("content-length")
+                                .then(|| value.trim().parse::<usize>().ok())?
+                        })
+                        .unwrap_or(0);
+                    if body.len() >= length {
+                        received.lock().unwrap().push(body.to_string());
+                        break;
+                    }
+                }
+                if n == 0 {
+                    break;
+                }
+            }
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: 0\r\nconnection: close\r\n\r\n",
+                status
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    (format!("http://{}/api/telemetry", addr), bodies)
+}
+
+#[test]
+fn test_off_until_turned_on() {
+    let temp_dir = TempDir::new().unwrap();
+    let telemetry = Telemetry::new(temp_dir.path().join("telemetry"));
+    assert!(!telemetry.state().enabled);
+    assert!(!telemetry.is_active());
+
+    let state = telemetry.enable().unwrap();
+    assert!(state.enabled);
+    let install_id = state.install_id.clone().unwrap();
+    // Turning it on again keeps the id
+    assert_eq!(
+        telemetry.enable().unwrap().install_id,
+        Some(install_id.clone())
+    );
+
+    telemetry.record(&event("status")).unwrap();
+    assert_eq!(telemetry.queued().unwrap().len(), 1);
+
+    // Off forgets the id and drops what was queued
+    telemetry.disable().unwrap();
+    assert!(!telemetry.state().enabled);
+    assert_eq!(telemetry.state().install_id, None);
+    assert!(telemetry.queued().unwrap().is_empty());
+    assert_ne!(telemetry.enable().unwrap().install_id, Some(install_id));
+}
+
+#[test]
+fn test_environment_opt_out() {
+    let env = |vars: &'static [(&'static str, &'static str)]| {
+        move |name: &str| {
+            vars.iter()
+                .find(|(var, _)| *var == name)
+                .map(|(_, value)| value.to_string())
+        }
+    };
+    assert_eq!(telemetry::disabled_by(env(&[])), None);
+    assert_eq!(
+        telemetry::disabled_by(env(&[("KM_TELEMETRY", "off")])),
+        Some("KM_TELEMETRY")
+    );
+    assert_eq!(telemetry::disabled_by(env(&[("KM_TELEMETRY", "1")])), None);
+    assert_eq!(
+        telemetry::disabled_by(env(&[("DO_NOT_TRACK", "1")])),
+        Some("DO_NOT_TRACK")
+    );
+    assert_eq!(telemetry::disabled_by(env(&[("DO_NOT_TRACK", "0")])), None);
+}
+
+#[test]
+fn test_events_carry_no_details() {
+    let failed: anyhow::Result<()> = Err(anyhow::Error::new(std::io::Error::new(
+        std::io::ErrorKind::NotFound,
+        "/home/alice/secret.json",
+    ))
+    .context("Failed to read /home/alice/secret.json"));
+    let event = UsageEvent::new("export", std::time::Duration::from_secs(2), &failed);
+    assert_eq!(event.outcome, Outcome::Error);
+    assert_eq!(event.error_category.as_deref(), Some("io"));
+    assert_eq!(event.duration_ms, 2000);
+
+    let recorded = serde_json::to_value(&event).unwrap();
+    let mut fields: Vec<&str> = recorded
+        .as_object()
+        .unwrap()
+        .keys()
+        .map(|k| k.as_str())
+        .collect();
+    fields.sort();
+    let mut documented: Vec<&str> = telemetry::FIELDS.iter().map(|(f, _)| *f).collect();
+    documented.sort();
+    assert_eq!(fields, documented);
+    assert!(!recorded.to_string().contains("alice"));
+
+    assert_eq!(
+        telemetry::error_category(&anyhow::anyhow!("something else")),
+        "other"
+    );
+}
+
+#[test]
+fn test_command_names() {
+    let name = |args: &[&str]| {
+        let cli = Cli::command();
+        let matches = cli.clone().try_get_matches_from(args).unwrap();
+        telemetry::command_name(&cli, &matches)
+    };
+    assert_eq!(name(&["km", "flush"]).as_deref(), Some("flush"));
+    assert_eq!(
+        name(&["km", "storage", "prune", "--max-sessions", "3"]).as_deref(),
+        Some("storage prune")
+    );
+    assert_eq!(
+        name(&["km", "my-plugin-command", "--secret", "x"]).as_deref(),
+        Some("plugin")
+    );
+    assert_eq!(name(&["km", "__complete", "sessions"]), None);
+}
+
+#[test]
+fn test_queue_is_capped() {
+    let temp_dir = TempDir::new().unwrap();
+    let telemetry = Telemetry::new(temp_dir.path().to_path_buf());
+    telemetry.enable().unwrap();
+    for i in 0..1005 {
+        telemetry.record(&event(&format!("cmd{}", i))).unwrap();
+    }
+    let queued = telemetry.queued().unwrap();
+    assert_eq!(queued.len(), 1000);
+    assert_eq!(queued[0].command, "cmd5");
+}
+
+#[tokio::test]
+async fn test_upload_empties_the_queue() {
+    let temp_dir = TempDir::new().unwrap();
+    let telemetry = Telemetry::new(temp_dir.path().to_path_buf());
+    let client = reqwest::Client::new();
+    let (url, bodies) = collector(200).await;
+
+    // Nothing is sent while telemetry is off
+    telemetry.record(&event("status")).unwrap();
+    assert_eq!(telemetry.upload(&client, &url).await.unwrap(), 0);
+    assert!(bodies.lock().unwrap().is_empty());
+
+    let state = telemetry.enable().unwrap();
+    telemetry.record(&event("flush")).unwrap();
+    assert!(!telemetry.upload_due(2, Utc::now()));
+    assert!(telemetry.upload_due(2, Utc::now() + Duration::hours(25)));
+    assert!(telemetry.upload_due(50, Utc::now()));
+
+    assert_eq!(telemetry.upload(&client, &url).await.unwrap(), 2);
+    assert!(telemetry.queued().unwrap().is_empty());
+    assert!(telemetry.state().last_upload.is_some());
+
+    let body: serde_json::Value = serde_json::from_str(&bodies.lock().unwrap()[0]).unwrap();
+    assert_eq!(body["install_id"], state.install_id.unwrap().as_str());
+    assert_eq!(body["events"][1]["command"], "flush");
+    assert_eq!(body["events"][1]["outcome"], "ok");
+
+    // A failed upload keeps the events for next time
+    let (failing, _) = collector(503).await;
+    telemetry.record(&event("status")).unwrap();
+    assert!(telemetry.upload(&client, &failing).await.is_err());
+    assert_eq!(telemetry.queued().unwrap().len(), 1);
+}
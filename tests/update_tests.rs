@@ -0,0 +1,319 @@
+use base64::Engine;
+use ed25519_dalek::{Signer, SigningKey};
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use km::build_info;
+use km::config::Config;
+use km::plugins::verify::{sha256_hex, TrustedKeys};
+use km::update::{self, Channel, LatestCheck, Updater};
+use std::collections::HashMap;
+use std::fs;
+use std::sync::Arc;
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering each path from `routes`; `{base}` in a
+/// body is replaced with the server's URL.
+async fn serve(routes: Vec<(&'static str, Vec<u8>)>) -> String {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let base = format!("http://{}", listener.local_addr().unwrap());
+    let routes: Arc<HashMap<_, _>> = Arc::new(
+        routes
+            .into_iter()
+            .map(|(path, body)| {
+                let body = match String::from_utf8(body.clone()) {
+                    Ok(text) => text.replace("{base}", &base).into_bytes(),
+                    Err(_) => body,
+                };
+                (path.to_string(), body)
+            })
+            .collect(),
+    );
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 16 * 1024];
+            let n = socket.read(&mut buf).await.unwrap_or(0);
+            let request = String::from_utf8_lossy(&buf[..n]).into_owned();
+            let path = request.split_whitespace().nth(1).unwrap_or("").to_string();
+
+            let (status, body) = match routes.get(&path) {
+                Some(body) => (200, body.clone()),
+                None => (404, Vec::new()),
+            };
+            let head = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: {}\r\nconnection: close\r\n\r\n",
+                status,
+                body.len()
+            );
+            let _ = socket.write_all(head.as_bytes()).await;
+            let _ = socket.write_all(&body).await;
+        }
+    });
+
+    base
+}
+
+fn tar_gz(name: &str, contents: &[u8]) -> Vec<u8> {
+    let mut builder = tar::Builder::new(GzEncoder::new(Vec::new(), Compression::default()));
+    let mut header = tar::Header::new_gnu();
+    header.set_size(contents.len() as u64);
+    header.set_mode(0o755);
+    header.set_cksum();
+    builder.append_data(&mut header, name, contents).unwrap();
+    builder.into_inner().unwrap().finish().unwrap()
+}
+
+/// A zip archive with one stored (uncompressed) entry.
+fn stored_zip(name: &str, contents: &[u8]) -> Vec<u8> {
+    let mut zip = Vec::new();
+    zip.extend_from_slice(&[0x50, 0x4b, 0x03, 0x04]);
+    zip.extend_from_slice(&20u16.to_le_bytes()); // version needed
+    zip.extend_from_slice(&0u16.to_le_bytes()); // flags
+    zip.extend_from_slice(&0u16.to_le_bytes()); // stored
+    zip.extend_from_slice(&[0; 8]); // time, date, crc (not checked)
+    zip.extend_from_slice(&(contents.len() as u32).to_le_bytes());
+    zip.extend_from_slice(&(contents.len() as u32).to_le_bytes());
+    zip.extend_from_slice(&(name.len() as u16).to_le_bytes());
+    zip.extend_from_slice(&0u16.to_le_bytes());
+    zip.extend_from_slice(name.as_bytes());
+    zip.extend_from_slice(contents);
+    zip
+}
+
+fn github_feed() -> Vec<u8> {
+    serde_json::json!([
+        {"tag_name": "v9.1.0-beta.1", "prerelease": true, "assets": []},
+        {"tag_name": "v9.2.0", "draft": true, "assets": []},
+        {
+            "tag_name": "v9.0.0",
+            "prerelease": false,
+            "assets": [
+                {"name": "km-linux-amd64.tar.gz", "browser_download_url": "{base}/dl/km-linux-amd64.tar.gz"},
+                {"name": "km-linux-amd64.tar.gz.sha256", "browser_download_url": "{base}/dl/km-linux-amd64.tar.gz.sha256"},
+                {"name": "km-linux-amd64.tar.gz.sig", "browser_download_url": "{base}/dl/km-linux-amd64.tar.gz.sig"}
+            ]
+        },
+        {"tag_name": "v0.1.0", "assets": []}
+    ])
+    .to_string()
+    .into_bytes()
+}
+
+#[tokio::test]
+async fn test_channels_pick_latest_release() {
+    let base = serve(vec![("/releases", github_feed())]).await;
+    let updater = Updater::new(format!("{}/releases", base), TrustedKeys::default());
+
+    // Drafts are never offered
+    let stable = updater.latest(Channel::Stable).await.unwrap().unwrap();
+    assert_eq!(stable.version, "9.0.0");
+    let beta = updater.latest(Channel::Beta).await.unwrap().unwrap();
+    assert_eq!(beta.version, "9.1.0-beta.1");
+    assert_eq!(beta.channel, Channel::Beta);
+}
+
+#[tokio::test]
+async fn test_kilometers_feed_format() {
+    let feed = serde_json::json!({
+        "releases": [
+            {"version": "3.0.0", "channel": "beta", "assets": []},
+            {"version": "2.0.0", "assets": [
+                {"name": "km-linux-amd64.tar.gz", "url": "{base}/x", "sha256": "ab"}
+            ]}
+        ]
+    });
+    let base = serve(vec![("/api/updates", feed.to_string().into_bytes())]).await;
+    let updater = Updater::new(format!("{}/api/updates", base), TrustedKeys::default());
+
+    let stable = updater.latest(Channel::Stable).await.unwrap().unwrap();
+    assert_eq!(stable.version, "2.0.0");
+    let asset = stable.asset("km-linux-amd64.tar.gz").unwrap();
+    assert_eq!(asset.sha256.as_deref(), Some("ab"));
+    assert_eq!(asset.url, format!("{}/x", base));
+}
+
+#[tokio::test]
+async fn test_download_verifies_checksum_and_signature() {
+    let archive = tar_gz("km", b"new km binary");
+    let key = SigningKey::from_bytes(&[9u8; 32]);
+    let signature = base64::engine::general_purpose::STANDARD.encode(key.sign(&archive).to_bytes());
+    let base = serve(vec![
+        ("/releases", github_feed()),
+        ("/dl/km-linux-amd64.tar.gz", archive.clone()),
+        (
+            "/dl/km-linux-amd64.tar.gz.sha256",
+            format!("{}  km-linux-amd64.tar.gz\n", sha256_hex(&archive)).into_bytes(),
+        ),
+        ("/dl/km-linux-amd64.tar.gz.sig", signature.into_bytes()),
+    ])
+    .await;
+    let trusted = TrustedKeys::from_config(&[
+        base64::engine::general_purpose::STANDARD.encode(key.verifying_key().to_bytes())
+    ])
+    .unwrap();
+
+    let updater = Updater::new(format!("{}/releases", base), trusted);
+    let release = updater.latest(Channel::Stable).await.unwrap().unwrap();
+    let asset = release.asset("km-linux-amd64.tar.gz").unwrap();
+    let downloaded = updater.download(&release, asset).await.unwrap();
+    assert_eq!(
+        update::extract_binary(&asset.name, &downloaded).unwrap(),
+        b"new km binary"
+    );
+
+    // Signed by someone else
+    let other = SigningKey::from_bytes(&[3u8; 32]);
+    let untrusted = TrustedKeys::from_config(&[
+        base64::engine::general_purpose::STANDARD.encode(other.verifying_key().to_bytes())
+    ])
+    .unwrap();
+    let err = Updater::new(format!("{}/releases", base), untrusted)
+        .download(&release, asset)
+        .await
+        .unwrap_err();
+    assert!(err.to_string().contains("not signed"));
+}
+
+#[tokio::test]
+async fn test_download_rejects_bad_or_missing_checksum() {
+    let base = serve(vec![
+        ("/releases", github_feed()),
+        ("/dl/km-linux-amd64.tar.gz", b"tampered".to_vec()),
+        (
+            "/dl/km-linux-amd64.tar.gz.sha256",
+            sha256_hex(b"original").into_bytes(),
+        ),
+    ])
+    .await;
+    let updater = Updater::new(format!("{}/releases", base), TrustedKeys::default());
+    let release = updater.latest(Channel::Stable).await.unwrap().unwrap();
+    let asset = release.asset("km-linux-amd64.tar.gz").unwrap();
+
+    let err = updater.download(&release, asset).await.unwrap_err();
+    assert!(err.to_string().contains("Checksum mismatch"));
+
+    let mut unchecked = release.clone();
+    unchecked.assets.truncate(1);
+    let err = updater
+        .download(&unchecked, &unchecked.assets[0])
+        .await
+        .unwrap_err();
+    assert!(err.to_string().contains("no checksum"));
+}
+
+#[test]
+fn test_extract_binary_from_archives() {
+    assert_eq!(
+        update::extract_binary("km-darwin-arm64.tar.gz", &tar_gz("km", b"mac")).unwrap(),
+        b"mac"
+    );
+    assert_eq!(
+        update::extract_binary("km-windows-amd64.zip", &stored_zip("km.exe", b"win")).unwrap(),
+        b"win"
+    );
+    assert!(update::extract_binary("km-linux-amd64.tar.gz", &tar_gz("README", b"x")).is_err());
+    assert!(
+        update::extract_binary("km-windows-amd64.zip", &stored_zip("other.exe", b"x")).is_err()
+    );
+}
+
+#[test]
+fn test_asset_names_match_release_workflow() {
+    assert_eq!(
+        update::asset_name_for("linux", "x86_64").as_deref(),
+        Some("km-linux-amd64.tar.gz")
+    );
+    assert_eq!(
+        update::asset_name_for("macos", "aarch64").as_deref(),
+        Some("km-darwin-arm64.tar.gz")
+    );
+    assert_eq!(
+        update::asset_name_for("windows", "x86_64").as_deref(),
+        Some("km-windows-amd64.zip")
+    );
+    assert_eq!(update::asset_name_for("freebsd", "x86_64"), None);
+    assert!(update::is_newer("0.3.0", "0.2.9"));
+    assert!(!update::is_newer("0.3.0-beta.1", "0.3.0"));
+}
+
+#[test]
+fn test_replace_executable_swaps_file() {
+    let dir = TempDir::new().unwrap();
+    let exe = dir.path().join("km");
+    fs::write(&exe, b"old").unwrap();
+
+    update::replace_executable(&exe, b"new").unwrap();
+
+    assert_eq!(fs::read(&exe).unwrap(), b"new");
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        assert_eq!(
+            fs::metadata(&exe).unwrap().permissions().mode() & 0o777,
+            0o755
+        );
+    }
+    // Nothing staged is left behind
+    assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 1);
+}
+
+#[test]
+fn test_update_settings_in_config() {
+    let mut config = Config::default();
+    assert_eq!(config.get("update_channel").unwrap(), "stable");
+    config.set("update_channel", "Beta").unwrap();
+    assert_eq!(config.update_channel, Channel::Beta);
+    assert!(config.set("update_channel", "nightly").is_err());
+
+    config
+        .set("update_url", "https://updates.corp.example/api/updates/")
+        .unwrap();
+    assert_eq!(
+        config.get("update_url").unwrap(),
+        "https://updates.corp.example/api/updates"
+    );
+    config.set("update_trusted_keys", "not-a-key").unwrap();
+    assert!(config
+        .validate()
+        .iter()
+        .any(|p| p.starts_with("update_trusted_keys")));
+}
+
+#[test]
+fn test_latest_check_is_saved_per_channel() {
+    let dir = TempDir::new().unwrap();
+    let path = dir.path().join("latest_release.json");
+    let check = LatestCheck::new(Channel::Stable, "9.0.0".to_string());
+    update::save_check(&path, &check).unwrap();
+
+    assert_eq!(
+        update::load_check(&path, Channel::Stable),
+        Some(check.clone())
+    );
+    assert_eq!(update::load_check(&path, Channel::Beta), None);
+    assert_eq!(check.newer_than(build_info::VERSION), Some("9.0.0"));
+    assert_eq!(check.newer_than("9.0.0"), None);
+
+    assert!(check.is_fresh(chrono::Utc::now()));
+    assert!(!check.is_fresh(check.checked_at + chrono::Duration::hours(25)));
+}
+
+#[tokio::test]
+async fn test_requests_name_the_km_build() {
+    let server = wiremock::MockServer::start().await;
+    wiremock::Mock::given(wiremock::matchers::method("GET"))
+        .and(wiremock::matchers::header(
+            "user-agent",
+            build_info::user_agent().as_str(),
+        ))
+        .respond_with(wiremock::ResponseTemplate::new(200).set_body_string(r#"{"releases": []}"#))
+        .expect(1)
+        .mount(&server)
+        .await;
+
+    let updater = Updater::new(format!("{}/releases", server.uri()), TrustedKeys::default());
+    assert_eq!(updater.latest(Channel::Stable).await.unwrap(), None);
+    assert!(build_info::user_agent().starts_with(&format!("km/{} (", build_info::VERSION)));
+}
@@ -0,0 +1,824 @@
+use km::capabilities::Capabilities;
+use km::idempotency::{self, SentBatches};
+use km::journal::{Interrupted, Journal, JournalStart};
+use km::latency::LatencyStats;
+use km::queue;
+use km::schema;
+use km::spool::Spool;
+use km::uploader::{BatchSettings, DrainReport, EventUploader, McpEvent};
+use std::io::Read;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tempfile::TempDir;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpListener;
+
+/// Minimal HTTP server answering every request with `status` and counting
+/// how many requests it saw.
+async fn serve_status(status: u16) -> (String, Arc<AtomicUsize>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let hits = Arc::new(AtomicUsize::new(0));
+    let counter = hits.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 64 * 1024];
+            let _ = socket.read(&mut buf).await;
+            counter.fetch_add(1, Ordering::SeqCst);
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                status
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    (format!("http://{}/api/events/batch", addr), hits)
+}
+
+/// Minimal HTTP server answering the first `throttled` requests with 429
+/// and `Retry-After: 1`, the rest with 200, and counting every request.
+async fn serve_throttled(throttled: usize) -> (String, Arc<AtomicUsize>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let hits = Arc::new(AtomicUsize::new(0));
+    let counter = hits.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut buf = vec![0u8; 64 * 1024];
+            let _ = socket.read(&mut buf).await;
+            let response = if counter.fetch_add(1, Ordering::SeqCst) < throttled {
+                "HTTP/1.1 429 Too Many Requests\r\nretry-after: 1\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{}"
+            } else {
+                "HTTP/1.1 200 OK\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{}"
+            };
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    (format!("http://{}/api/events/batch", addr), hits)
+}
+
+/// A request seen by `serve_recording`: lowercased headers and the decoded body.
+#[derive(Debug, Clone)]
+struct Recorded {
+    headers: String,
+    body: serde_json::Value,
+}
+
+/// Minimal HTTP server that records each request, gunzipping bodies sent
+/// with `content-encoding: gzip` and decoding protobuf ones. Gzip bodies get
+/// `gzip_status`, the rest 200.
+async fn serve_recording(gzip_status: u16) -> (String, Arc<Mutex<Vec<Recorded>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let seen = Arc::new(Mutex::new(Vec::new()));
+    let recorder = seen.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let mut data = Vec::new();
+            let mut buf = vec![0u8; 64 * 1024];
+            let (headers, body_start) = loop {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break (String::new(), 0);
+                }
+                data.extend_from_slice(&buf[..n]);
+                if let Some(pos) = data.windows(4).position(|w| w == b"\r\n\r\n") {
+                    break (
+                        String::from_utf8_lossy(&data[..pos]).to_ascii_lowercase(),
+                        pos + 4,
+                    );
+                }
+            };
+            let length: usize = headers
+                .lines()
+                .find_map(|l| l.strip_prefix("content-length:"))
+                .and_then(|l| l.trim().parse().ok())
+                .unwrap_or(0);
+            while data.len() < body_start + length {
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                if n == 0 {
+                    break;
+                }
+                data.extend_from_slice(&buf[..n]);
+            }
+
+            let raw = &data[body_start..];
+            let gzip = headers.contains("content-encoding: gzip");
+            let body = if gzip {
+                let mut decoded = Vec::new();
+                flate2::read::GzDecoder::new(raw)
+                    .read_to_end(&mut decoded)
+                    .unwrap();
+                decoded
+            } else {
+                raw.to_vec()
+            };
+            let body = if headers.contains("content-type: application/x-protobuf") {
+                schema::decode_batch(&body).unwrap()
+            } else {
+                serde_json::from_slice(&body).unwrap_or_default()
+            };
+            recorder.lock().unwrap().push(Recorded { headers, body });
+
+            let status = if gzip { gzip_status } else { 200 };
+            let response = format!(
+                "HTTP/1.1 {} Status\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                status
+            );
+            let _ = socket.write_all(response.as_bytes()).await;
+        }
+    });
+
+    (format!("http://{}/api/events/batch", addr), seen)
+}
+
+/// Minimal HTTP server that answers each request after `delay`, on its own
+/// task, recording the most requests it had in flight at once and the
+/// `metadata.sequence` of each body.
+async fn serve_slowly(delay: Duration) -> (String, Arc<AtomicUsize>, Arc<Mutex<Vec<u64>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let in_flight = Arc::new(AtomicUsize::new(0));
+    let most = Arc::new(AtomicUsize::new(0));
+    let sequences = Arc::new(Mutex::new(Vec::new()));
+    let (peak, seen) = (most.clone(), sequences.clone());
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let (in_flight, peak, seen) = (in_flight.clone(), peak.clone(), seen.clone());
+            tokio::spawn(async move {
+                let now = in_flight.fetch_add(1, Ordering::SeqCst) + 1;
+                peak.fetch_max(now, Ordering::SeqCst);
+                let mut data = Vec::new();
+                let mut buf = vec![0u8; 64 * 1024];
+                let body = loop {
+                    let n = socket.read(&mut buf).await.unwrap_or(0);
+                    data.extend_from_slice(&buf[..n]);
+                    let text = String::from_utf8_lossy(&data).to_string();
+                    if let Some((_, body)) = text.split_once("\r\n\r\n") {
+                        if let Ok(body) = serde_json::from_str::<serde_json::Value>(body) {
+                            break body;
+                        }
+                    }
+                    if n == 0 {
+                        break serde_json::Value::Null;
+                    }
+                };
+                if let Some(sequence) = body["metadata"]["sequence"].as_u64() {
+                    seen.lock().unwrap().push(sequence);
+                }
+                tokio::time::sleep(delay).await;
+                in_flight.fetch_sub(1, Ordering::SeqCst);
+                let _ = socket
+                    .write_all(
+                        b"HTTP/1.1 200 OK\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{}",
+                    )
+                    .await;
+            });
+        }
+    });
+
+    (format!("http://{}/api/events/batch", addr), most, sequences)
+}
+
+/// Minimal HTTP server that answers each request on its own task: after
+/// `delay` when the body mentions "slow", with 503 when it mentions "fail",
+/// at once otherwise. Records the `metadata.sequence` of each batch it
+/// accepted, in the order it answered them.
+async fn serve_by_content(delay: Duration) -> (String, Arc<Mutex<Vec<u64>>>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let answered = Arc::new(Mutex::new(Vec::new()));
+    let seen = answered.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let seen = seen.clone();
+            tokio::spawn(async move {
+                let mut data = Vec::new();
+                let mut buf = vec![0u8; 64 * 1024];
+                let (text, body) = loop {
+                    let n = socket.read(&mut buf).await.unwrap_or(0);
+                    data.extend_from_slice(&buf[..n]);
+                    let text = String::from_utf8_lossy(&data).to_string();
+                    if let Some((_, body)) = text.split_once("\r\n\r\n") {
+                        if let Ok(body) = serde_json::from_str::<serde_json::Value>(body) {
+                            break (text, body);
+                        }
+                    }
+                    if n == 0 {
+                        break (text, serde_json::Value::Null);
+                    }
+                };
+                if text.contains("slow") {
+                    tokio::time::sleep(delay).await;
+                }
+                let status = if text.contains("fail") {
+                    "503 Service Unavailable"
+                } else {
+                    if let Some(sequence) = body["metadata"]["sequence"].as_u64() {
+                        seen.lock().unwrap().push(sequence);
+                    }
+                    "200 OK"
+                };
+                let response = format!(
+                    "HTTP/1.1 {}\r\ncontent-length: 2\r\nconnection: close\r\n\r\n{{}}",
+                    status
+                );
+                let _ = socket.write_all(response.as_bytes()).await;
+            });
+        }
+    });
+
+    (format!("http://{}/api/events/batch", addr), answered)
+}
+
+fn settings(endpoint: &str, batch_size: usize) -> BatchSettings {
+    BatchSettings {
+        endpoint: endpoint.to_string(),
+        batch_size,
+        batch_timeout: Duration::from_secs(60),
+        max_batch_bytes: 1024 * 1024,
+        compress: true,
+        concurrency: 1,
+    }
+}
+
+fn event(content: &str) -> McpEvent {
+    McpEvent::new("session-1", "request", content, None, None, None)
+}
+
+#[test]
+fn test_event_parses_payload_and_id() {
+    let event = McpEvent::new(
+        "session-1",
+        "request",
+        r#"{"jsonrpc":"2.0","id":3,"method":"tools/list"}"#,
+        Some("tools/list".to_string()),
+        None,
+        None,
+    );
+
+    assert_eq!(event.rpc_id, Some(serde_json::json!(3)));
+    assert_eq!(event.payload.unwrap()["method"], "tools/list");
+}
+
+#[test]
+fn test_event_omits_oversized_payload() {
+    let content = format!(r#"{{"data":"{}"}}"#, "x".repeat(100));
+    let event = McpEvent::new("session-1", "response", &content, None, None, Some(64));
+
+    assert!(event.payload.is_none());
+    assert_eq!(event.payload_size, content.len());
+    assert_eq!(
+        event.payload_sha256.as_deref(),
+        Some(km::plugins::verify::sha256_hex(content.as_bytes()).as_str())
+    );
+}
+
+#[tokio::test]
+async fn test_uploader_batches_by_size_and_flushes_on_close() {
+    let (endpoint, hits) = serve_status(200).await;
+    let uploader = EventUploader::new("token".to_string());
+    let (tx, rx) = tokio::sync::mpsc::channel(16);
+    let (_settings_tx, settings_rx) = tokio::sync::watch::channel(settings(&endpoint, 2));
+
+    let handle = uploader.spawn(settings_rx, rx);
+
+    for i in 0..5 {
+        tx.send(event(&format!(r#"{{"n":{}}}"#, i))).await.unwrap();
+    }
+    drop(tx);
+    handle.await.unwrap();
+
+    // Two full batches plus the remainder when the channel closed
+    assert_eq!(hits.load(Ordering::SeqCst), 3);
+}
+
+#[tokio::test]
+async fn test_uploader_sends_batches_concurrently_in_numbered_order() {
+    let (endpoint, most, sequences) = serve_slowly(Duration::from_millis(300)).await;
+    let uploader = EventUploader::new("token".to_string());
+    let (tx, rx) = tokio::sync::mpsc::channel(16);
+    let settings = BatchSettings {
+        concurrency: 3,
+        ..settings(&endpoint, 1)
+    };
+    let (_settings_tx, settings_rx) = tokio::sync::watch::channel(settings);
+    let stats = uploader.stats();
+
+    let started = std::time::Instant::now();
+    let handle = uploader.spawn(settings_rx, rx);
+    for i in 0..6 {
+        tx.send(event(&format!(r#"{{"n":{}}}"#, i))).await.unwrap();
+    }
+    drop(tx);
+    // Closing waits for the uploads still in flight
+    handle.await.unwrap();
+
+    assert_eq!(stats.uploaded(), 6);
+    assert_eq!(most.load(Ordering::SeqCst), 3);
+    // Two rounds of three, not six one after another
+    assert!(started.elapsed() < Duration::from_millis(1500));
+    let mut sequences = sequences.lock().unwrap().clone();
+    sequences.sort_unstable();
+    assert_eq!(sequences, vec![1, 2, 3, 4, 5, 6]);
+}
+
+#[tokio::test]
+async fn test_uploader_settles_each_session_in_order() {
+    let (endpoint, answered) = serve_by_content(Duration::from_millis(300)).await;
+    let temp_dir = TempDir::new().unwrap();
+    let start = JournalStart {
+        session_id: "session-1".to_string(),
+        pid: std::process::id(),
+        started_at: chrono::Utc::now(),
+        endpoint: String::new(),
+        command: Vec::new(),
+        labels: Default::default(),
+        redact: false,
+    };
+    let journal = Arc::new(Journal::create(temp_dir.path(), &start).unwrap());
+    let uploader = EventUploader::new("token".to_string()).with_journal(journal.clone());
+    let (tx, rx) = tokio::sync::mpsc::channel(16);
+    let settings = BatchSettings {
+        concurrency: 3,
+        ..settings(&endpoint, 1)
+    };
+    let (_settings_tx, settings_rx) = tokio::sync::watch::channel(settings);
+
+    let handle = uploader.spawn(settings_rx, rx);
+    let slow = event(r#"{"n":"slow"}"#);
+    let fast = event(r#"{"n":"fast"}"#);
+    let other = McpEvent::new("session-2", "request", r#"{"n":1}"#, None, None, None);
+    for event in [&slow, &fast, &other] {
+        tx.send(event.clone()).await.unwrap();
+    }
+    drop(tx);
+    handle.await.unwrap();
+
+    // All three were in flight at once, and the slow one finished last...
+    let answered = answered.lock().unwrap().clone();
+    assert_eq!(answered.len(), 3);
+    assert_eq!(answered.last(), Some(&1));
+    // ...but its session's batches were still acknowledged in order
+    let acked: Vec<String> = std::fs::read_to_string(journal.path())
+        .unwrap()
+        .lines()
+        .map(|line| serde_json::from_str::<serde_json::Value>(line).unwrap())
+        .filter(|record| record["type"] == "ack")
+        .flat_map(|record| serde_json::from_value::<Vec<String>>(record["ids"].clone()).unwrap())
+        .collect();
+    let position = |id: &str| acked.iter().position(|acked| acked == id).unwrap();
+    assert!(position(&slow.id) < position(&fast.id));
+    assert_eq!(acked.len(), 3);
+}
+
+#[tokio::test]
+async fn test_uploader_spools_the_rest_of_a_session_after_a_failure() {
+    let (endpoint, answered) = serve_by_content(Duration::from_millis(300)).await;
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let uploader = EventUploader::new("token".to_string()).with_spool(spool.clone());
+    let (tx, rx) = tokio::sync::mpsc::channel(16);
+    let settings = BatchSettings {
+        concurrency: 2,
+        ..settings(&endpoint, 1)
+    };
+    let (_settings_tx, settings_rx) = tokio::sync::watch::channel(settings);
+    let stats = uploader.stats();
+
+    let handle = uploader.spawn(settings_rx, rx);
+    tx.send(event(r#"{"n":"slow fail"}"#)).await.unwrap();
+    for n in 2..=4 {
+        tx.send(event(&format!(r#"{{"n":{}}}"#, n))).await.unwrap();
+    }
+    drop(tx);
+    handle.await.unwrap();
+
+    // The second batch was already in flight; the ones that hadn't started
+    // are spooled behind the failed one, so a retry replays them in order
+    assert_eq!(*answered.lock().unwrap(), vec![2]);
+    assert_eq!(stats.uploaded(), 1);
+    assert_eq!(stats.spooled(), 3);
+    let sequences: Vec<u64> = spool
+        .pending()
+        .unwrap()
+        .iter()
+        .map(|batch| batch.payload["metadata"]["sequence"].as_u64().unwrap())
+        .collect();
+    assert_eq!(sequences, vec![1, 3, 4]);
+}
+
+#[tokio::test]
+async fn test_uploader_sends_one_at_a_time_with_concurrency_one() {
+    let (endpoint, most, _) = serve_slowly(Duration::from_millis(100)).await;
+    let uploader = EventUploader::new("token".to_string());
+    let (tx, rx) = tokio::sync::mpsc::channel(16);
+    let (_settings_tx, settings_rx) = tokio::sync::watch::channel(settings(&endpoint, 1));
+
+    let handle = uploader.spawn(settings_rx, rx);
+    for i in 0..3 {
+        tx.send(event(&format!(r#"{{"n":{}}}"#, i))).await.unwrap();
+    }
+    drop(tx);
+    handle.await.unwrap();
+
+    assert_eq!(most.load(Ordering::SeqCst), 1);
+}
+
+#[tokio::test]
+async fn test_uploader_reports_failures_without_a_spool() {
+    let (endpoint, _) = serve_status(503).await;
+    let uploader = EventUploader::new("token".to_string());
+    let stats = uploader.stats();
+
+    let error = uploader
+        .send_batch(
+            &settings(&endpoint, 100),
+            &[event(r#"{"n":1}"#), event(r#"{"n":2}"#)],
+        )
+        .await
+        .unwrap_err();
+
+    assert!(error.to_string().contains("503"));
+    assert_eq!(stats.dropped(), 2);
+    assert_eq!(stats.uploaded(), 0);
+}
+
+#[tokio::test]
+async fn test_uploader_spools_failed_batches() {
+    let (endpoint, _) = serve_status(503).await;
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let uploader = EventUploader::new("token".to_string()).with_spool(spool.clone());
+
+    uploader
+        .send_batch(
+            &settings(&endpoint, 100),
+            &[event(r#"{"n":1}"#), event(r#"{"n":2}"#)],
+        )
+        .await
+        .unwrap();
+
+    let pending = spool.pending().unwrap();
+    assert_eq!(pending.len(), 1);
+    assert_eq!(pending[0].payload["events"].as_array().unwrap().len(), 2);
+}
+
+#[tokio::test]
+async fn test_uploader_acknowledges_delivered_and_spooled_events() {
+    let temp_dir = TempDir::new().unwrap();
+    let start = JournalStart {
+        session_id: "session-1".to_string(),
+        pid: std::process::id(),
+        started_at: chrono::Utc::now(),
+        endpoint: String::new(),
+        command: Vec::new(),
+        labels: Default::default(),
+        redact: false,
+    };
+    let journal = Arc::new(Journal::create(&temp_dir.path().join("journal"), &start).unwrap());
+    let spool = Spool::new(temp_dir.path().join("spool"));
+    let uploader = EventUploader::new("token".to_string())
+        .with_spool(spool)
+        .with_journal(journal.clone());
+
+    let (ok, _) = serve_status(200).await;
+    let (down, _) = serve_status(503).await;
+    for endpoint in [ok, down] {
+        let batch = [event(r#"{"n":1}"#), event(r#"{"n":2}"#)];
+        for e in &batch {
+            journal.record(e);
+        }
+        uploader
+            .send_batch(&settings(&endpoint, 100), &batch)
+            .await
+            .unwrap();
+    }
+    journal.record(&event(r#"{"n":3}"#));
+
+    let session = Interrupted::read(journal.path()).unwrap();
+    assert_eq!(session.pending.len(), 1);
+    assert_eq!(session.pending[0].payload.as_ref().unwrap()["n"], 3);
+}
+
+#[tokio::test]
+async fn test_drain_report_accounts_for_every_event() {
+    let temp_dir = TempDir::new().unwrap();
+    let spooling = EventUploader::new("token".to_string())
+        .with_spool(Spool::new(temp_dir.path().to_path_buf()));
+    let dropping = EventUploader::new("token".to_string());
+    let (ok, _) = serve_status(200).await;
+    let (down, _) = serve_status(503).await;
+    let batch = [event(r#"{"n":1}"#), event(r#"{"n":2}"#)];
+
+    spooling
+        .send_batch(&settings(&ok, 100), &batch)
+        .await
+        .unwrap();
+    spooling
+        .send_batch(&settings(&down, 100), &batch)
+        .await
+        .unwrap();
+    let stats = spooling.stats();
+    assert_eq!(
+        (stats.uploaded(), stats.spooled(), stats.dropped()),
+        (2, 2, 0)
+    );
+
+    assert!(dropping
+        .send_batch(&settings(&down, 100), &batch)
+        .await
+        .is_err());
+    assert_eq!(dropping.stats().dropped(), 2);
+
+    // Seven events queued and one dropped by the full queue; of the seven,
+    // four went through the uploader, two were spooled at the deadline and
+    // one was never accounted for
+    let (events, _rx) = queue::bounded(7, Duration::from_millis(1));
+    for i in 0..8 {
+        events.push(i);
+    }
+    let report = DrainReport::new(&events.stats(), &stats, 2);
+    assert_eq!(
+        report,
+        DrainReport {
+            uploaded: 2,
+            spooled: 4,
+            dropped: 2,
+        }
+    );
+    assert_eq!(report.persisted(), 6);
+}
+
+#[tokio::test]
+async fn test_uploader_waits_out_retry_after() {
+    let (endpoint, hits) = serve_throttled(1).await;
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let uploader = EventUploader::new("token".to_string()).with_spool(spool.clone());
+
+    let started = std::time::Instant::now();
+    uploader
+        .send_batch(&settings(&endpoint, 100), &[event(r#"{"n":1}"#)])
+        .await
+        .unwrap();
+
+    assert!(started.elapsed() >= Duration::from_millis(900));
+    assert_eq!(hits.load(Ordering::SeqCst), 2);
+    assert_eq!(uploader.stats().uploaded(), 1);
+    assert!(spool.pending().unwrap().is_empty());
+}
+
+#[tokio::test]
+async fn test_uploader_spools_when_still_throttled() {
+    let (endpoint, hits) = serve_throttled(usize::MAX).await;
+    let temp_dir = TempDir::new().unwrap();
+    let spool = Spool::new(temp_dir.path().to_path_buf());
+    let uploader = EventUploader::new("token".to_string()).with_spool(spool.clone());
+
+    uploader
+        .send_batch(&settings(&endpoint, 100), &[event(r#"{"n":1}"#)])
+        .await
+        .unwrap();
+
+    // The first attempt and two retries
+    assert_eq!(hits.load(Ordering::SeqCst), 3);
+    assert_eq!(spool.pending().unwrap().len(), 1);
+}
+
+#[tokio::test]
+async fn test_uploader_sends_each_batch_once() {
+    let mock_server = wiremock::MockServer::start().await;
+    wiremock::Mock::given(wiremock::matchers::method("POST"))
+        .respond_with(wiremock::ResponseTemplate::new(200))
+        .mount(&mock_server)
+        .await;
+    let temp_dir = TempDir::new().unwrap();
+    let sent = Arc::new(SentBatches::open(temp_dir.path().join("sent_batches")).unwrap());
+    let uploader = EventUploader::new("token".to_string()).with_sent_batches(sent.clone());
+    let endpoint = format!("{}/api/events/batch", mock_server.uri());
+    let batch = [event(r#"{"n":1}"#), event(r#"{"n":2}"#)];
+
+    // A retry of a delivered batch, e.g. after the journal ack was lost
+    for _ in 0..2 {
+        uploader
+            .send_batch(&settings(&endpoint, 100), &batch)
+            .await
+            .unwrap();
+    }
+
+    let requests = mock_server.received_requests().await.unwrap();
+    assert_eq!(requests.len(), 1);
+    let payload: serde_json::Value = serde_json::from_slice(&requests[0].body).unwrap();
+    let key = idempotency::batch_id(&payload);
+    assert_eq!(
+        requests[0].headers.get("idempotency-key").unwrap(),
+        key.as_str()
+    );
+    assert!(sent.contains(&key));
+    assert_eq!(uploader.stats().uploaded(), 4);
+}
+
+#[tokio::test]
+async fn test_uploader_picks_up_new_batch_size() {
+    let (endpoint, hits) = serve_status(200).await;
+    let uploader = EventUploader::new("token".to_string());
+    let (tx, rx) = tokio::sync::mpsc::channel(16);
+    let (settings_tx, settings_rx) = tokio::sync::watch::channel(settings(&endpoint, 100));
+
+    let handle = uploader.spawn(settings_rx, rx);
+    settings_tx.send_replace(settings(&endpoint, 1));
+
+    for i in 0..3 {
+        tx.send(event(&format!(r#"{{"n":{}}}"#, i))).await.unwrap();
+    }
+    drop(tx);
+    handle.await.unwrap();
+
+    assert_eq!(hits.load(Ordering::SeqCst), 3);
+}
+
+#[tokio::test]
+async fn test_uploader_gzips_large_bodies() {
+    let (endpoint, seen) = serve_recording(200).await;
+    let uploader = EventUploader::new("token".to_string());
+    let content = format!(r#"{{"data":"{}"}}"#, "a".repeat(4096));
+
+    uploader
+        .send_batch(
+            &settings(&endpoint, 100),
+            &[event(&content), event(r#"{"n":1}"#)],
+        )
+        .await
+        .unwrap();
+
+    let seen = seen.lock().unwrap();
+    assert_eq!(seen.len(), 1);
+    assert!(seen[0].headers.contains("content-encoding: gzip"));
+    assert!(seen[0].headers.contains("content-type: application/json"));
+    assert_eq!(seen[0].body["events"].as_array().unwrap().len(), 2);
+}
+
+#[tokio::test]
+async fn test_uploader_splits_batches_by_bytes() {
+    let (endpoint, seen) = serve_recording(200).await;
+    let uploader = EventUploader::new("token".to_string());
+    let mut settings = settings(&endpoint, 100);
+    settings.max_batch_bytes = 2048;
+    settings.compress = false;
+
+    let events: Vec<_> = (0..10)
+        .map(|i| event(&format!(r#"{{"n":{},"data":"{}"}}"#, i, "b".repeat(300))))
+        .collect();
+    uploader.send_batch(&settings, &events).await.unwrap();
+
+    let seen = seen.lock().unwrap();
+    assert!(
+        seen.len() > 1,
+        "expected a split, got {} upload(s)",
+        seen.len()
+    );
+    let mut total = 0;
+    for upload in seen.iter() {
+        assert!(!upload.headers.contains("content-encoding"));
+        assert!(upload.body.to_string().len() <= 2048);
+        total += upload.body["events"].as_array().unwrap().len();
+    }
+    assert_eq!(total, 10);
+}
+
+#[tokio::test]
+async fn test_uploader_drops_payload_of_oversized_event() {
+    let uploader = EventUploader::new("token".to_string());
+    let big = event(&format!(r#"{{"data":"{}"}}"#, "c".repeat(5000)));
+    let small = event(r#"{"n":1}"#);
+
+    let payloads = uploader.batch_payloads(&[big.clone(), small], 2048);
+
+    // Without its payload the big event fits alongside the small one
+    assert_eq!(payloads.len(), 1);
+    let events = payloads[0]["events"].as_array().unwrap();
+    assert_eq!(events[0]["id"], big.id.as_str());
+    assert!(events[0]["payload"].is_null());
+    assert_eq!(events[0]["payload_size"], big.payload_size);
+    assert_eq!(events[1]["payload"]["n"], 1);
+}
+
+#[tokio::test]
+async fn test_batches_carry_latency_metadata() {
+    let latency = Arc::new(LatencyStats::default());
+    let events: Vec<McpEvent> = (0..20)
+        .map(|n| event(&format!(r#"{{"n":{}}}"#, n)))
+        .collect();
+
+    // Nothing is sent until there is a response to report
+    let uploader = EventUploader::new("token".to_string()).with_latency(latency.clone());
+    let payloads = uploader.batch_payloads(&events, 2048);
+    assert!(payloads[0]["metadata"].get("latency").is_none());
+    assert_eq!(payloads[0]["metadata"]["client"]["name"], "km");
+    assert!(payloads[0]["metadata"].get("run_id").is_none());
+    let with_run = uploader
+        .clone()
+        .with_run_id("run-7")
+        .batch_payloads(&events, 2048);
+    assert_eq!(with_run[0]["metadata"]["run_id"], "run-7");
+
+    latency.record("tools/call", 12.0);
+    latency.record("tools/call", 30.0);
+    let payloads = uploader.batch_payloads(&events, 2048);
+    assert!(payloads.len() > 1);
+    for payload in &payloads {
+        assert!(payload.to_string().len() <= 2048);
+        let methods = payload["metadata"]["latency"].as_array().unwrap();
+        assert_eq!(methods[0]["method"], "tools/call");
+        assert_eq!(methods[0]["count"], 2);
+        assert_eq!(methods[0]["max_ms"], 30.0);
+    }
+}
+
+#[tokio::test]
+async fn test_uploader_falls_back_when_gzip_is_rejected() {
+    let (endpoint, seen) = serve_recording(415).await;
+    let uploader = EventUploader::new("token".to_string());
+    let content = format!(r#"{{"data":"{}"}}"#, "d".repeat(4096));
+
+    for _ in 0..2 {
+        uploader
+            .send_batch(&settings(&endpoint, 100), &[event(&content)])
+            .await
+            .unwrap();
+    }
+
+    let seen = seen.lock().unwrap();
+    // Gzip once, retried plain, then plain from then on
+    assert_eq!(seen.len(), 3);
+    assert!(seen[0].headers.contains("content-encoding: gzip"));
+    assert!(!seen[1].headers.contains("content-encoding"));
+    assert!(!seen[2].headers.contains("content-encoding"));
+    assert_eq!(
+        seen[2].body["events"][0]["payload"]["data"]
+            .as_str()
+            .unwrap()
+            .len(),
+        4096
+    );
+}
+
+#[tokio::test]
+async fn test_uploader_follows_negotiated_capabilities() {
+    let (endpoint, seen) = serve_recording(200).await;
+    let capabilities = Capabilities {
+        gzip_uploads: false,
+        ..Default::default()
+    };
+    let uploader = EventUploader::new("token".to_string()).with_capabilities(&capabilities);
+    let content = format!(r#"{{"data":"{}"}}"#, "e".repeat(4096));
+
+    uploader
+        .send_batch(&settings(&endpoint, 100), &[event(&content)])
+        .await
+        .unwrap();
+
+    let seen = seen.lock().unwrap();
+    assert_eq!(seen.len(), 1);
+    assert!(!seen[0].headers.contains("content-encoding"));
+    assert!(seen[0].headers.contains("km-event-version: 1"));
+}
+
+#[tokio::test]
+async fn test_uploader_sends_protobuf_when_negotiated() {
+    let (endpoint, seen) = serve_recording(200).await;
+    let capabilities = Capabilities {
+        event_version: schema::EVENTS_PROTOBUF,
+        ..Default::default()
+    };
+    let uploader = EventUploader::new("token".to_string()).with_capabilities(&capabilities);
+    let mut labelled = event(r#"{"jsonrpc":"2.0","id":4,"method":"tools/call"}"#);
+    labelled
+        .labels
+        .insert("team".to_string(), "payments".to_string());
+    let events = vec![labelled, event("not json"), event(&"x".repeat(4096))];
+
+    uploader
+        .send_batch(&settings(&endpoint, 100), &events)
+        .await
+        .unwrap();
+
+    let seen = seen.lock().unwrap();
+    assert_eq!(seen.len(), 1);
+    assert!(seen[0]
+        .headers
+        .contains("content-type: application/x-protobuf"));
+    assert!(seen[0].headers.contains("km-event-version: 2"));
+    assert!(seen[0].headers.contains("content-encoding: gzip"));
+    let expected = uploader.batch_payloads(&events, 1024 * 1024).remove(0);
+    assert_eq!(seen[0].body, expected);
+}